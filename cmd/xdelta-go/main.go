@@ -0,0 +1,15 @@
+// xdelta-go 与 cmd/xdelta 相同的命令行工具，换一个名字安装，不会与 xdelta3 的 xdelta 命令冲突；
+// 与服务中嵌入的 xdelta_ffi 行为一致，用于现场排查补丁问题。子命令 diff、apply、inspect、verify 等，
+// 文件参数为 - 时使用标准输入输出，退出码可用于脚本（0 成功，1 用法错误，2 补丁损坏或不受支持，3 补丁与旧数据不匹配，
+// 4 其他错误），详见 internal/cli
+package main
+
+import (
+	"os"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Run("xdelta-go", os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,12 @@
+// xdelta 基于 xdelta_ffi 的命令行工具，不需要另外安装 xdelta3；子命令、参数和退出码见 internal/cli
+package main
+
+import (
+	"os"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/internal/cli"
+)
+
+func main() {
+	os.Exit(cli.Run("xdelta", os.Args[1:], os.Stdout, os.Stderr))
+}
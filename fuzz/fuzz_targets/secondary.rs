@@ -0,0 +1,16 @@
+// fuzz/fuzz_targets/secondary.rs
+//! Secondary decompression (xz/LZMA2, DJW, FGK, LZ4, zlib, zstd) of
+//! arbitrary bytes; the last byte sets the feeding step. Seed the corpus
+//! with src/testdata/*.xz, then run from the repository root:
+//!
+//!   cargo +nightly fuzz run secondary fuzz/corpus/secondary src/testdata
+
+#![no_main]
+
+use libfuzzer_sys::fuzz_target;
+
+fuzz_target!(|data: &[u8]| {
+    if let Some((&step, stream)) = data.split_last() {
+        let _ = xdelta::fuzzing::decompress_secondary(stream, usize::from(step) * 61 + 1);
+    }
+});
@@ -1,3 +1,5 @@
 module github.com/PangolinLab/xdelta-rust-goffi
 
 go 1.24
+
+require github.com/ebitengine/purego v0.10.1
@@ -0,0 +1,626 @@
+// cli 实现 cmd/xdelta 和 cmd/xdelta-go 共用的命令行工具，基于 xdelta_ffi，不需要另外安装 xdelta3；两者行为相同，
+// 只有命令名不同（下面写作 xdelta）
+//
+//	xdelta diff [--block-size N] [--threads N] [--vcdiff | --bsdiff] [--reverse undo-patch] <old> <new> <patch>
+//	xdelta apply [--max-output N] [--max-memory N] <old> <patch> <out>
+//	xdelta inspect [--json] <patch>
+//	xdelta verify [--max-output N] [--max-memory N] <old> <patch>
+//	xdelta merge <patch>... <out>
+//	xdelta dirdiff [--previous manifest.json] [--paranoid] [--dedup] [--blobs dir] [--renames] [--bundle] <old-dir> <new-dir> <out-dir>
+//	xdelta dirapply [--blobs dir] <base-dir> <patch-dir> <out-dir>
+//	xdelta manifest <dir>
+//	xdelta version [--json]
+//
+// manifest 把目录的清单（每个文件的大小、修改时间和哈希）写到标准输出，可以作为下一次 dirdiff 的 --previous；
+// dirdiff 的 --previous 也可以是上一次 dirdiff 写出的 manifest.json，大小和修改时间不变的文件不再读取，
+// 加上 --paranoid 时仍然读取并比较 XXH64；--dedup 按内容去重保存补丁和新增文件，--blobs 把它们保存在另一个目录中
+// （可以由多次 dirdiff 共用），dirapply 时用同一个 --blobs 取得；--renames 把与某个旧文件相同的新增文件记录为它的副本（改名），
+// 不保存内容；--bundle 把结果写成单个包文件 <out-dir>，dirapply 的 <patch-dir> 也可以是这样的包
+//
+// diff 的 --threads 与 xdelta_ffi.WithThreads 相同，默认 1；不为 1 时生成的补丁可能稍大，但与线程数无关；
+// --vcdiff 写出标准的 RFC 3284 VCDIFF 补丁（xdelta_ffi.WithStandardVCDIFF），可以用 xdelta3 -d -s <old> <patch> <out> 应用，
+// --bsdiff 写出 bsdiff 4.x 补丁（xdelta_ffi.WithBSDiff），可以用 bspatch <old> <new> <patch> 应用，此时新旧数据都读入内存，
+// --block-size 和 --threads 无效；apply、inspect、verify 自动识别 VCDIFF 补丁（包括 xdelta3 生成的）和 bsdiff 补丁，
+// bsdiff 补丁由原生层读入整个补丁后再写出结果
+// --reverse 同时把从 <new> 回到 <old> 的反向补丁（xdelta_ffi.WithReverse）写入给出的文件，用于回滚，格式与正向补丁相同，
+// 新旧数据同样都读入内存
+//
+// apply、verify 的 --max-output 拒绝输出超过 N 字节的补丁（xdelta_ffi.WithMaxOutputSize），在解码到超出的位置时停止，
+// 不会先分配或写出这部分数据；--max-memory 限制原生层的内存约为 N 字节（xdelta_ffi.WithMaxMemory）；
+// 应用来源不可信的补丁时应该设置，默认都不限制
+//
+// merge 把首尾相接的补丁（v1→v2、v2→v3……）合并成一个从第一个旧版本直接到最后一个新版本的补丁（xdelta_ffi.MergePatches），
+// 不需要任何一个版本的数据，相当于 xdelta3 merge；补丁都读入内存
+//
+// version 打印本工具使用的 xdelta_ffi 版本，以及实际加载的原生库的版本、ABI 修订号和路径（xdelta_ffi.Version、LibraryPath），
+// 用于确认排查问题时用的是与服务中相同的库；原生库加载失败时打印原因并以退出码 4 结束
+//
+// 文件参数可以为 -，表示标准输入（输出参数为标准输出）；diff、apply、verify 按流处理，
+// 可以用于比内存大的文件；apply、verify 需要随机读取旧数据，旧数据为 - 时先复制到临时文件
+// 原生库按 xdelta_ffi.Init 的顺序查找，可以用环境变量 XDELTA_LIB_PATH 指定
+//
+// 退出码：0 成功，1 用法错误，2 补丁损坏或不受支持，3 补丁与旧数据不匹配，4 其他错误（例如读写失败）
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+const (
+	exitOK = iota
+	exitUsage
+	exitCorrupt
+	exitMismatch
+	exitFailure
+)
+
+const usageText = `usage:
+  %[1]s diff [--block-size N] [--threads N] [--vcdiff | --bsdiff] [--reverse undo-patch] <old> <new> <patch>
+  %[1]s apply [--max-output N] [--max-memory N] <old> <patch> <out>
+  %[1]s inspect [--json] <patch>
+  %[1]s verify [--max-output N] [--max-memory N] <old> <patch>
+  %[1]s merge <patch>... <out>
+  %[1]s dirdiff [--previous manifest.json] [--paranoid] [--dedup] [--blobs dir] [--renames] [--bundle] <old-dir> <new-dir> <out-dir>
+  %[1]s dirapply [--blobs dir] <base-dir> <patch-dir> <out-dir>
+  %[1]s manifest <dir>
+  %[1]s version [--json]
+a file argument of - means stdin (stdout for <patch> of diff and <out> of apply and merge)
+`
+
+// usage 命令名为 name 的用法说明
+func usage(name string) string { return fmt.Sprintf(usageText, name) }
+
+// usageError 参数有误，退出码为 exitUsage
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// Run 以 name 为命令名执行 args（不含命令名）给出的子命令，返回退出码
+func Run(name string, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage(name))
+		return exitUsage
+	}
+	var err error
+	switch args[0] {
+	case "diff":
+		err = cmdDiff(args[1:])
+	case "apply":
+		err = cmdApply(args[1:])
+	case "inspect":
+		err = cmdInspect(args[1:], stdout)
+	case "verify":
+		err = cmdVerify(args[1:], stdout)
+	case "merge":
+		err = cmdMerge(args[1:])
+	case "dirdiff":
+		err = cmdDirDiff(args[1:], stderr, name)
+	case "dirapply":
+		err = cmdDirApply(args[1:])
+	case "manifest":
+		err = cmdManifest(args[1:], stdout)
+	case "version":
+		err = cmdVersion(args[1:], stdout)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage(name))
+		return exitOK
+	default:
+		err = usageError(fmt.Sprintf("unknown command %q", args[0]))
+	}
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "%s %s: %v\n", name, args[0], err)
+	code := exitCode(err)
+	if code == exitUsage {
+		fmt.Fprint(stderr, usage(name))
+	}
+	return code
+}
+
+// exitCode 按错误的种类选择退出码
+func exitCode(err error) int {
+	var u usageError
+	switch {
+	case errors.As(err, &u), errors.Is(err, flag.ErrHelp), errors.Is(err, xdelta_ffi.ErrInvalidArgument):
+		return exitUsage
+	case errors.Is(err, xdelta_ffi.ErrCorruptPatch), errors.Is(err, xdelta_ffi.ErrUnsupportedPatch):
+		return exitCorrupt
+	case errors.Is(err, xdelta_ffi.ErrSourceMismatch), errors.Is(err, xdelta_ffi.ErrTargetMismatch):
+		return exitMismatch
+	default:
+		return exitFailure
+	}
+}
+
+// parseArgs 解析 fs 的选项，要求恰好剩下 n 个位置参数
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, usageError(err.Error())
+	}
+	if fs.NArg() != n {
+		return nil, usageError(fmt.Sprintf("expected %d arguments, got %d", n, fs.NArg()))
+	}
+	return fs.Args(), nil
+}
+
+func cmdDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	blockSize := fs.Uint("block-size", uint(xdelta_ffi.AutoBlockSize), "block size in bytes, 0 chooses one from the input sizes as RecommendedBlockSize does")
+	threads := fs.Int("threads", 1, "encoding threads, 0 uses every core; above 1 the new data is matched in independent 8 MiB pieces")
+	vcdiff := fs.Bool("vcdiff", false, "write a standard RFC 3284 VCDIFF patch that xdelta3 -d can apply")
+	bsdiff := fs.Bool("bsdiff", false, "write a bsdiff 4 patch that bspatch can apply; both inputs are read into memory")
+	reverse := fs.String("reverse", "", "also write the patch from <new> back to <old> to this file; both inputs are read into memory")
+	rest, err := parseArgs(fs, args, 3)
+	if err != nil {
+		return err
+	}
+	if bs := *blockSize; bs != uint(xdelta_ffi.AutoBlockSize) && (bs < uint(xdelta_ffi.MinBlockSize) || bs > uint(xdelta_ffi.MaxBlockSize)) {
+		return usageError(fmt.Sprintf("block size %d is out of range [%d, %d]", *blockSize, xdelta_ffi.MinBlockSize, xdelta_ffi.MaxBlockSize))
+	}
+	if *threads < 0 || *threads > xdelta_ffi.MaxThreads {
+		return usageError(fmt.Sprintf("thread count %d is out of range [0, %d]", *threads, xdelta_ffi.MaxThreads))
+	}
+	if *vcdiff && *bsdiff {
+		return usageError("--vcdiff and --bsdiff cannot be used together")
+	}
+	opts := []xdelta_ffi.Option{xdelta_ffi.WithThreads(*threads)}
+	if *vcdiff {
+		opts = append(opts, xdelta_ffi.WithStandardVCDIFF())
+	}
+	oldPath, newPath, patchPath := rest[0], rest[1], rest[2]
+	if oldPath == "-" && newPath == "-" {
+		return usageError("only one of <old> and <new> can be stdin")
+	}
+	if *reverse == "-" && patchPath == "-" {
+		return usageError("only one of <patch> and --reverse can be stdout")
+	}
+	if *bsdiff {
+		return diffInMemory(oldPath, newPath, patchPath, *reverse, xdelta_ffi.WithBSDiff())
+	}
+	if *reverse != "" {
+		return diffInMemory(oldPath, newPath, patchPath, *reverse, append(opts, xdelta_ffi.WithBlockSize(uint32(*blockSize)))...)
+	}
+	if oldPath != "-" && newPath != "-" && patchPath != "-" {
+		return xdelta_ffi.CreateDiffsFile(oldPath, newPath, patchPath, uint32(*blockSize), opts...)
+	}
+	old, err := openInput(oldPath)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	nw, err := openInput(newPath)
+	if err != nil {
+		return err
+	}
+	defer nw.Close()
+	return writeOutput(patchPath, func(w io.Writer) error {
+		return xdelta_ffi.CreateDiffsStream(old, nw, w, append(opts, xdelta_ffi.WithBlockSize(uint32(*blockSize)))...)
+	})
+}
+
+// diffInMemory 把两份输入读入内存，用 CreateDiffs 生成补丁（--bsdiff），reversePath 不为空时同时写出反向补丁（--reverse）
+func diffInMemory(oldPath, newPath, patchPath, reversePath string, opts ...xdelta_ffi.Option) error {
+	oldData, err := readInput(oldPath)
+	if err != nil {
+		return err
+	}
+	newData, err := readInput(newPath)
+	if err != nil {
+		return err
+	}
+	var reverse []byte
+	if reversePath != "" {
+		opts = append(opts, xdelta_ffi.WithReverse(&reverse))
+	}
+	patch, err := xdelta_ffi.CreateDiffs(oldData, newData, opts...)
+	if err != nil {
+		return err
+	}
+	if reversePath != "" {
+		if err := writeOutput(reversePath, func(w io.Writer) error {
+			_, err := w.Write(reverse)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return writeOutput(patchPath, func(w io.Writer) error {
+		_, err := w.Write(patch)
+		return err
+	})
+}
+
+// limitFlags 注册 apply、verify 共用的 --max-output 和 --max-memory，返回对应的选项
+func limitFlags(fs *flag.FlagSet) func() []xdelta_ffi.Option {
+	maxOutput := fs.Int64("max-output", 0, "fail once the output would exceed this many bytes, 0 for no limit")
+	maxMemory := fs.Int64("max-memory", 0, "keep the native memory use to about this many bytes, 0 for no limit")
+	return func() []xdelta_ffi.Option {
+		return []xdelta_ffi.Option{xdelta_ffi.WithMaxOutputSize(*maxOutput), xdelta_ffi.WithMaxMemory(*maxMemory)}
+	}
+}
+
+func cmdApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	limits := limitFlags(fs)
+	rest, err := parseArgs(fs, args, 3)
+	if err != nil {
+		return err
+	}
+	opts := limits()
+	oldPath, patchPath, outPath := rest[0], rest[1], rest[2]
+	if oldPath == "-" && patchPath == "-" {
+		return usageError("only one of <old> and <patch> can be stdin")
+	}
+	patch, err := openInput(patchPath)
+	if err != nil {
+		return err
+	}
+	defer patch.Close()
+	pr := bufio.NewReader(patch)
+	if oldPath != "-" && patchPath != "-" && outPath != "-" {
+		return xdelta_ffi.ApplyDiffsFile(oldPath, patchPath, outPath, opts...)
+	}
+	old, release, err := openOld(oldPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return writeOutput(outPath, func(w io.Writer) error {
+		return xdelta_ffi.ApplyDiffsStream(old, pr, w, opts...)
+	})
+}
+
+func cmdInspect(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	rest, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	// 统计需要解析整个补丁，补丁通常远小于新旧数据，直接读入内存
+	f, err := openInput(rest[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	patch, err := xdelta_ffi.ReadPatch(f)
+	if err != nil {
+		return err
+	}
+	info := patch.Info()
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(inspectJSON{
+			Format:       info.Format,
+			Secondary:    info.Secondary,
+			Enveloped:    info.Enveloped,
+			Windows:      info.Windows,
+			Instructions: info.Instructions,
+			AddBytes:     info.AddBytes,
+			CopyBytes:    info.CopyBytes,
+			RunBytes:     info.RunBytes,
+			TargetSize:   info.TargetSize,
+			SourceSize:   info.SourceSize,
+			BlockSize:    info.BlockSize,
+			Checksum:     info.Checksum.String(),
+			PatchSize:    info.PatchSize,
+			Ratio:        info.Ratio,
+		})
+	}
+	secondary := info.Secondary
+	if secondary == "" {
+		secondary = "none"
+	}
+	_, err = fmt.Fprintf(stdout, "format:       %s\nsecondary:    %s\nenveloped:    %t\nwindows:      %d\n"+
+		"instructions: %d\nadd bytes:    %d\ncopy bytes:   %d\nrun bytes:    %d\ntarget size:  %d\nsource size:  %d\nblock size:   %d\nchecksum:     %s\n"+
+		"patch size:   %d\nratio:        %.4f\n",
+		info.Format, secondary, info.Enveloped, info.Windows, info.Instructions, info.AddBytes, info.CopyBytes,
+		info.RunBytes, info.TargetSize, info.SourceSize, info.BlockSize, info.Checksum, info.PatchSize, info.Ratio)
+	return err
+}
+
+// inspectJSON inspect --json 的输出
+type inspectJSON struct {
+	Format       string  `json:"format"`
+	Secondary    string  `json:"secondary"`
+	Enveloped    bool    `json:"enveloped"`
+	Windows      int64   `json:"windows"`
+	Instructions int64   `json:"instructions"`
+	AddBytes     int64   `json:"add_bytes"`
+	CopyBytes    int64   `json:"copy_bytes"`
+	RunBytes     int64   `json:"run_bytes"`
+	TargetSize   int64   `json:"target_size"`
+	SourceSize   int64   `json:"source_size"`
+	BlockSize    uint32  `json:"block_size"`
+	Checksum     string  `json:"checksum"`
+	PatchSize    int64   `json:"patch_size"`
+	Ratio        float64 `json:"ratio"`
+}
+
+func cmdVerify(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	limits := limitFlags(fs)
+	rest, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	opts := limits()
+	oldPath, patchPath := rest[0], rest[1]
+	if oldPath == "-" && patchPath == "-" {
+		return usageError("only one of <old> and <patch> can be stdin")
+	}
+	patch, err := openInput(patchPath)
+	if err != nil {
+		return err
+	}
+	defer patch.Close()
+	pr := bufio.NewReader(patch)
+	// 完整解码一遍，输出直接丢弃
+	n := &countWriter{}
+	old, release, err := openOld(oldPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := xdelta_ffi.ApplyDiffsStream(old, pr, n, opts...); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "ok: %d bytes of output\n", n.n)
+	return err
+}
+
+func cmdMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if fs.NArg() < 2 {
+		return usageError(fmt.Sprintf("expected at least 2 arguments, got %d", fs.NArg()))
+	}
+	rest := fs.Args()
+	patches := make([][]byte, len(rest)-1)
+	for i, path := range rest[:len(rest)-1] {
+		p, err := readInput(path)
+		if err != nil {
+			return err
+		}
+		patches[i] = p
+	}
+	merged, err := xdelta_ffi.MergePatches(patches...)
+	if err != nil {
+		return err
+	}
+	return writeOutput(rest[len(rest)-1], func(w io.Writer) error {
+		_, err := w.Write(merged)
+		return err
+	})
+}
+
+func cmdDirDiff(args []string, stderr io.Writer, name string) error {
+	fs := flag.NewFlagSet("dirdiff", flag.ContinueOnError)
+	previous := fs.String("previous", "", "manifest of an earlier dirdiff or of manifest; files with the same size and mtime are not read")
+	paranoid := fs.Bool("paranoid", false, "with --previous, still read such files and compare their XXH64")
+	dedup := fs.Bool("dedup", false, "store each distinct patch and added file once, keyed by its SHA-256")
+	blobs := fs.String("blobs", "", "store the deduplicated blobs in this directory instead of out-dir (implies --dedup)")
+	renames := fs.Bool("renames", false, "record added files with the content of an old file as copies of it instead of storing them")
+	bundle := fs.Bool("bundle", false, "write a single bundle file to out-dir instead of a directory")
+	rest, err := parseArgs(fs, args, 3)
+	if err != nil {
+		return err
+	}
+	var opts []xdelta_ffi.Option
+	if *previous != "" {
+		f, err := os.Open(*previous)
+		if err != nil {
+			return err
+		}
+		m, err := xdelta_ffi.LoadManifest(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", *previous, err)
+		}
+		opts = append(opts, xdelta_ffi.WithPreviousManifest(m))
+	} else if *paranoid {
+		return usageError("--paranoid requires --previous")
+	}
+	if *paranoid {
+		opts = append(opts, xdelta_ffi.WithParanoidHashing())
+	}
+	if *dedup {
+		opts = append(opts, xdelta_ffi.WithBlobDedup())
+	}
+	if *blobs != "" {
+		opts = append(opts, xdelta_ffi.WithBlobStore(xdelta_ffi.NewDirBlobStore(*blobs)))
+	}
+	if *renames {
+		opts = append(opts, xdelta_ffi.WithRenameDetection())
+	}
+	var m *xdelta_ffi.DirManifest
+	if *bundle {
+		m, err = createDirBundle(rest[0], rest[1], rest[2], opts)
+	} else {
+		m, err = xdelta_ffi.CreateDirDiff(rest[0], rest[1], rest[2], opts...)
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range m.Skipped {
+		fmt.Fprintf(stderr, "%s dirdiff: skipped %s: %s\n", name, s.Path, s.Reason)
+	}
+	if st := m.DedupStats(); st.References > 0 {
+		fmt.Fprintf(stderr, "%s dirdiff: %d blobs for %d files, %d of %d bytes stored, %d saved\n",
+			name, st.Blobs, st.References, st.StoredBytes, st.ReferencedBytes, st.SavedBytes())
+	}
+	return nil
+}
+
+// createDirBundle 把目录补丁打包写入文件 out，失败时删除写了一半的文件
+func createDirBundle(oldDir, newDir, out string, opts []xdelta_ffi.Option) (*xdelta_ffi.DirManifest, error) {
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	m, err := xdelta_ffi.CreateDirBundle(oldDir, newDir, f, opts...)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return nil, err
+	}
+	return m, nil
+}
+
+func cmdDirApply(args []string) error {
+	fs := flag.NewFlagSet("dirapply", flag.ContinueOnError)
+	blobs := fs.String("blobs", "", "directory of the blobs of a dirdiff made with --blobs")
+	rest, err := parseArgs(fs, args, 3)
+	if err != nil {
+		return err
+	}
+	var opts []xdelta_ffi.Option
+	if *blobs != "" {
+		opts = append(opts, xdelta_ffi.WithBlobStore(xdelta_ffi.NewDirBlobStore(*blobs)))
+	}
+	return xdelta_ffi.ApplyDirDiff(rest[0], rest[1], rest[2], opts...)
+}
+
+func cmdManifest(args []string, stdout io.Writer) error {
+	rest, err := parseArgs(flag.NewFlagSet("manifest", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	m, err := xdelta_ffi.ComputeManifest(rest[0])
+	if err != nil {
+		return err
+	}
+	_, err = m.WriteTo(stdout)
+	return err
+}
+
+func cmdVersion(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	v, err := xdelta_ffi.Version()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(versionJSON{
+			Wrapper:       xdelta_ffi.WrapperVersion,
+			WrapperABI:    xdelta_ffi.WrapperABIVersion,
+			Library:       v.CrateVersion,
+			LibraryABI:    v.ABIVersion,
+			FormatVersion: v.FormatVersion,
+			Algorithm:     v.Algorithm,
+			Path:          xdelta_ffi.LibraryPath(),
+		})
+	}
+	_, err = fmt.Fprintf(stdout, "wrapper:      %s (abi %d)\nlibrary:      %s (abi %d)\nformat:       %d\nalgorithm:    %s\npath:         %s\n",
+		xdelta_ffi.WrapperVersion, xdelta_ffi.WrapperABIVersion, v.CrateVersion, v.ABIVersion, v.FormatVersion, v.Algorithm,
+		xdelta_ffi.LibraryPath())
+	return err
+}
+
+// versionJSON version --json 的输出
+type versionJSON struct {
+	Wrapper       string `json:"wrapper"`
+	WrapperABI    int    `json:"wrapper_abi"`
+	Library       string `json:"library"`
+	LibraryABI    int    `json:"library_abi"`
+	FormatVersion int    `json:"format_version"`
+	Algorithm     string `json:"algorithm"`
+	Path          string `json:"path"`
+}
+
+// countWriter 丢弃写入的数据，只记录字节数
+type countWriter struct{ n int64 }
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// openInput 打开输入文件，- 为标准输入
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// readInput 读入整个输入文件，- 为标准输入
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// openOld 打开需要随机读取的旧数据，- 时把标准输入复制到临时文件；使用完毕后调用 release
+func openOld(path string) (*os.File, func(), error) {
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+	tmp, err := os.CreateTemp("", "xdelta-old-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, os.Stdin); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return tmp, release, nil
+}
+
+// writeOutput 把 fn 的输出写入 path，- 为标准输出；写入文件失败时删除写了一半的文件
+func writeOutput(path string, fn func(w io.Writer) error) error {
+	if path == "-" {
+		w := bufio.NewWriterSize(os.Stdout, 1<<20)
+		if err := fn(w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	err = fn(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+// TestMain 没有设置 XDELTA_LIB_PATH 时使用 cargo build --release 生成的原生库
+func TestMain(m *testing.M) {
+	if os.Getenv("XDELTA_LIB_PATH") == "" {
+		name := "libxdelta.so"
+		switch runtime.GOOS {
+		case "darwin":
+			name = "libxdelta.dylib"
+		case "windows":
+			name = "xdelta.dll"
+		}
+		if p := filepath.Join("..", "..", "target", "release", name); fileExists(p) {
+			xdelta_ffi.SetLibraryPath(p)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// requireNative 没有原生后端或原生库加载失败时跳过测试（没有原生后端时 Init 成功，Version 返回 ErrNotSupported）
+func requireNative(t *testing.T) {
+	t.Helper()
+	if _, err := xdelta_ffi.Version(); err != nil {
+		t.Skipf("native library not available: %v", err)
+	}
+}
+
+// run 执行命令，返回退出码和标准输出、标准错误；stdin 不为 nil 时作为标准输入
+func run(t *testing.T, stdin []byte, args ...string) (int, string, string) {
+	t.Helper()
+	if stdin != nil {
+		in := filepath.Join(t.TempDir(), "stdin")
+		if err := os.WriteFile(in, stdin, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		saved := os.Stdin
+		os.Stdin = f
+		defer func() { os.Stdin = saved }()
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	saved := os.Stdout
+	os.Stdout = out
+	var stdout, stderr bytes.Buffer
+	code := Run("xdelta-go", args, &stdout, &stderr)
+	os.Stdout = saved
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(&stdout, out); err != nil {
+		t.Fatal(err)
+	}
+	return code, stdout.String(), stderr.String()
+}
+
+// TestRunRoundTrip diff、apply、verify、inspect 在文件和标准输入输出上得到相同的结果
+func TestRunRoundTrip(t *testing.T) {
+	requireNative(t)
+	dir := t.TempDir()
+	oldData := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 2000)
+	newData := append(bytes.Clone(oldData[:40000]), append([]byte("inserted"), oldData[40010:]...)...)
+	oldPath, newPath, patchPath, outPath := filepath.Join(dir, "old"), filepath.Join(dir, "new"), filepath.Join(dir, "patch"), filepath.Join(dir, "out")
+	for p, b := range map[string][]byte{oldPath: oldData, newPath: newData} {
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, _, stderr := run(t, nil, "diff", oldPath, newPath, patchPath); code != exitOK {
+		t.Fatalf("diff: exit %d: %s", code, stderr)
+	}
+	if code, _, stderr := run(t, nil, "apply", oldPath, patchPath, outPath); code != exitOK {
+		t.Fatalf("apply: exit %d: %s", code, stderr)
+	}
+	if got, _ := os.ReadFile(outPath); !bytes.Equal(got, newData) {
+		t.Fatalf("apply wrote %d bytes, want %d", len(got), len(newData))
+	}
+	patch, err := os.ReadFile(patchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, streamed, stderr := run(t, newData, "diff", oldPath, "-", "-")
+	if code != exitOK {
+		t.Fatalf("diff to stdout: exit %d: %s", code, stderr)
+	}
+	if streamed != string(patch) {
+		t.Fatalf("diff to stdout wrote %d bytes, want the %d byte patch", len(streamed), len(patch))
+	}
+	code, applied, stderr := run(t, patch, "apply", oldPath, "-", "-")
+	if code != exitOK || applied != string(newData) {
+		t.Fatalf("apply from stdin: exit %d, %d bytes: %s", code, len(applied), stderr)
+	}
+	if code, _, stderr := run(t, oldData, "verify", "-", patchPath); code != exitOK {
+		t.Fatalf("verify with old data on stdin: exit %d: %s", code, stderr)
+	}
+	code, info, stderr := run(t, nil, "inspect", "--json", patchPath)
+	if code != exitOK || !strings.Contains(info, fmt.Sprintf(`"target_size": %d`, len(newData))) {
+		t.Fatalf("inspect: exit %d: %s%s", code, info, stderr)
+	}
+}
+
+// TestRunExitCodes 用法错误、损坏的补丁、补丁与旧数据不匹配和读写失败的退出码
+func TestRunExitCodes(t *testing.T) {
+	requireNative(t)
+	dir := t.TempDir()
+	oldData := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	newData := append(bytes.Clone(oldData), "tail"...)
+	oldPath, otherPath, patchPath := filepath.Join(dir, "old"), filepath.Join(dir, "other"), filepath.Join(dir, "patch")
+	patch, err := xdelta_ffi.CreateDiffs(oldData, newData, xdelta_ffi.WithChecksum(xdelta_ffi.ChecksumXXH3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, b := range map[string][]byte{oldPath: oldData, otherPath: bytes.Repeat([]byte("x"), len(oldData)), patchPath: patch} {
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt := filepath.Join(dir, "corrupt")
+	if err := os.WriteFile(corrupt, patch[:len(patch)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{nil, exitUsage},
+		{[]string{"frobnicate"}, exitUsage},
+		{[]string{"apply", oldPath}, exitUsage},
+		{[]string{"verify", oldPath, patchPath}, exitOK},
+		{[]string{"verify", oldPath, corrupt}, exitCorrupt},
+		{[]string{"inspect", corrupt}, exitCorrupt},
+		{[]string{"verify", otherPath, patchPath}, exitMismatch},
+		{[]string{"apply", filepath.Join(dir, "missing"), patchPath, filepath.Join(dir, "out")}, exitFailure},
+	} {
+		if code, _, stderr := run(t, nil, tc.args...); code != tc.want {
+			t.Errorf("%v: exit %d, want %d: %s", tc.args, code, tc.want, stderr)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// src/alloc.rs
+//! Accounting for the memory that outlives an FFI call: buffers released
+//! with xdelta_free_data, error strings released with xdelta_free_error and
+//! the handles released by the *_free functions. Anything allocated and
+//! dropped within a single call is plain Rust ownership and cannot leak, so
+//! these counters are what tells a host whether it forgot to free something.
+use std::alloc::Layout;
+use std::ffi::CString;
+use std::os::raw::c_char;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+/// Bytes in front of every buffer recording its length, so freeing it can
+/// update the byte count and rebuild the layout; 16 keeps the data aligned
+/// like malloc's result.
+const HEADER: usize = 16;
+
+static LIVE_BUFFERS: AtomicU64 = AtomicU64::new(0);
+static LIVE_BYTES: AtomicU64 = AtomicU64::new(0);
+static LIVE_HANDLES: AtomicU64 = AtomicU64::new(0);
+static TOTAL_BUFFERS: AtomicU64 = AtomicU64::new(0);
+static TOTAL_BYTES: AtomicU64 = AtomicU64::new(0);
+
+/// Layout matches xdelta_alloc_stats in xdelta_interface.h.
+#[repr(C)]
+pub struct AllocStats {
+    pub live_buffers: u64,
+    pub live_bytes: u64,
+    pub live_handles: u64,
+    pub total_buffers: u64,
+    pub total_bytes: u64,
+}
+
+fn track(bytes: usize) {
+    LIVE_BUFFERS.fetch_add(1, Ordering::Relaxed);
+    LIVE_BYTES.fetch_add(bytes as u64, Ordering::Relaxed);
+    TOTAL_BUFFERS.fetch_add(1, Ordering::Relaxed);
+    TOTAL_BYTES.fetch_add(bytes as u64, Ordering::Relaxed);
+}
+
+fn untrack(bytes: usize) {
+    LIVE_BUFFERS.fetch_sub(1, Ordering::Relaxed);
+    LIVE_BYTES.fetch_sub(bytes as u64, Ordering::Relaxed);
+}
+
+fn buffer_layout(len: usize) -> Option<Layout> {
+    Layout::from_size_align(len.checked_add(HEADER)?, HEADER).ok()
+}
+
+/// Allocate a buffer of `len` bytes for the caller, NULL when out of memory.
+/// It comes from the global allocator, so it shows in xdelta_native_stats.
+pub(crate) fn alloc_buffer(len: usize) -> *mut u8 {
+    let Some(layout) = buffer_layout(len) else {
+        return std::ptr::null_mut();
+    };
+    let p = unsafe { std::alloc::alloc(layout) };
+    if p.is_null() {
+        return p;
+    }
+    unsafe {
+        (p as *mut usize).write(len);
+    }
+    track(len);
+    unsafe { p.add(HEADER) }
+}
+
+/// Release a buffer from alloc_buffer; NULL is ignored.
+///
+/// # Safety
+/// `p` must come from alloc_buffer and not have been freed yet.
+pub(crate) unsafe fn free_buffer(p: *mut u8) {
+    if p.is_null() {
+        return;
+    }
+    unsafe {
+        let base = p.sub(HEADER);
+        let len = (base as *const usize).read();
+        untrack(len);
+        std::alloc::dealloc(base, buffer_layout(len).expect("layout of a live buffer"));
+    }
+}
+
+/// Hand an error message to the caller, released with free_error.
+pub(crate) fn error_string(msg: CString) -> *mut c_char {
+    track(msg.as_bytes_with_nul().len());
+    msg.into_raw()
+}
+
+/// Release a string from error_string; NULL is ignored.
+///
+/// # Safety
+/// `p` must come from error_string and not have been freed yet.
+pub(crate) unsafe fn free_error(p: *mut c_char) {
+    if p.is_null() {
+        return;
+    }
+    let msg = unsafe { CString::from_raw(p) };
+    untrack(msg.as_bytes_with_nul().len());
+}
+
+/// Box `v` and hand it to the caller as a handle, released with free_handle.
+pub(crate) fn into_handle<T>(v: T) -> *mut T {
+    LIVE_HANDLES.fetch_add(1, Ordering::Relaxed);
+    Box::into_raw(Box::new(v))
+}
+
+/// Drop a handle from into_handle; NULL is ignored.
+///
+/// # Safety
+/// `h` must come from into_handle::<T> and not have been freed yet.
+pub(crate) unsafe fn free_handle<T>(h: *mut T) {
+    if h.is_null() {
+        return;
+    }
+    LIVE_HANDLES.fetch_sub(1, Ordering::Relaxed);
+    drop(unsafe { Box::from_raw(h) });
+}
+
+/// 填写跨越 FFI 边界、尚未释放的内存的统计，用于排查调用方忘记释放的情况，stats 为 NULL 时什么也不做：
+/// 缓冲区和错误信息的个数与字节数、句柄个数（不含句柄持有的内存）以及累计分配的缓冲区个数与字节数
+/// 计数是原子的，可以在任意时刻、任意线程调用；与其他线程的调用并发时各项之间不保证是同一时刻的值
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_debug_alloc_stats(stats: *mut AllocStats) {
+    let Some(stats) = (unsafe { stats.as_mut() }) else {
+        return;
+    };
+    stats.live_buffers = LIVE_BUFFERS.load(Ordering::Relaxed);
+    stats.live_bytes = LIVE_BYTES.load(Ordering::Relaxed);
+    stats.live_handles = LIVE_HANDLES.load(Ordering::Relaxed);
+    stats.total_buffers = TOTAL_BUFFERS.load(Ordering::Relaxed);
+    stats.total_bytes = TOTAL_BYTES.load(Ordering::Relaxed);
+}
@@ -0,0 +1,149 @@
+// src/batch.rs
+//! Many small patches in one call (`xdelta_create_patches`): for records of
+//! a few KiB the fixed cost of each FFI call, not the encoding, dominates.
+//! The inputs arrive in one buffer and the patches leave in one buffer.
+
+use std::os::raw::{c_char, c_int};
+
+use crate::cancel::CancelToken;
+use crate::encoder::{create_patch_to, threads_from_c, Encoding};
+use crate::window::create_patch_window_to;
+use crate::{fail, input_slice, return_buffer, XDeltaError};
+
+/// One pair of a batch and its result. Layout matches xdelta_batch_item in
+/// xdelta_interface.h.
+#[repr(C)]
+#[derive(Clone, Copy)]
+pub struct BatchItem {
+    pub old_offset: u64,
+    pub old_len: u64,
+    pub new_offset: u64,
+    pub new_len: u64,
+    pub block_size: u32,
+    /// set by the library: 0 or an XDELTA_ERR_* code
+    pub code: i32,
+    /// set by the library: where the patch (or the error message) is in the output
+    pub out_offset: u64,
+    pub out_len: u64,
+}
+
+/// Encode one share of the items, appending each patch or error message to
+/// the returned buffer. Stops with `Err` only when canceled.
+fn encode_share(
+    data: &[u8],
+    items: &mut [BatchItem],
+    encoding: Encoding,
+    source_window: u64,
+    cancel: Option<&CancelToken>,
+) -> Result<Vec<u8>, XDeltaError> {
+    let mut out = Vec::new();
+    for item in items.iter_mut() {
+        let start = out.len();
+        let r = pair(data, item).and_then(|(old, new)| {
+            let block_size = item.block_size as usize;
+            if source_window > 0 {
+                create_patch_window_to(old, new, block_size, source_window, encoding, cancel, &mut out)
+            } else {
+                create_patch_to(old, new, block_size, encoding, None, cancel, &mut out)
+            }
+        });
+        match r {
+            Ok(()) => item.code = 0,
+            Err(XDeltaError::Canceled) => return Err(XDeltaError::Canceled),
+            Err(e) => {
+                out.truncate(start);
+                item.code = e.code();
+                out.extend_from_slice(e.to_string().as_bytes());
+            }
+        }
+        item.out_offset = start as u64;
+        item.out_len = (out.len() - start) as u64;
+    }
+    Ok(out)
+}
+
+/// The old and new data of `item` inside `data`.
+fn pair<'a>(data: &'a [u8], item: &BatchItem) -> Result<(&'a [u8], &'a [u8]), XDeltaError> {
+    let range = |offset: u64, len: u64, what: &str| {
+        offset
+            .checked_add(len)
+            .filter(|&end| end <= data.len() as u64)
+            .map(|end| &data[offset as usize..end as usize])
+            .ok_or_else(|| XDeltaError::InvalidArg(format!("{} data is outside the input buffer", what)))
+    };
+    Ok((range(item.old_offset, item.old_len, "old")?, range(item.new_offset, item.new_len, "new")?))
+}
+
+/// 为 items 中的 count 对数据创建补丁，两份数据都在 data 中（位置见 xdelta_batch_item），整个批次只需一次调用
+/// 每一对的补丁与 threads 为 1 的 xdelta_create_patch_data_cancel（source_window 大于 0 时为 xdelta_create_patch_data_window）
+/// 使用同样的参数和这一对的 block_size 得到的补丁逐字节相同；threads 为同时编码的对数（每一对总是单线程编码），0 为所有 CPU 核心
+/// 某一对失败不影响其他对：它的 code 为错误码，out_offset、out_len 指向错误信息；全部完成后返回 0，
+/// *out 为按顺序拼接的全部结果（*out_len 字节），使用 xdelta_free_data 释放
+/// 参数不合法或被取消时返回 XDELTA_ERR_* 错误码，不返回任何结果；err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patches(
+    data: *const u8,
+    data_len: usize,
+    items: *mut BatchItem,
+    count: usize,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    threads: c_int,
+    source_window: u64,
+    cancel: *const CancelToken,
+    out: *mut *mut u8,
+    out_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Vec<u8>, XDeltaError> {
+        if out.is_null() || out_len.is_null() || (items.is_null() && count > 0) {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let data = unsafe { input_slice(data, data_len) }?;
+        let items: &mut [BatchItem] = if count == 0 {
+            &mut []
+        } else {
+            unsafe { std::slice::from_raw_parts_mut(items, count) }
+        };
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let threads = threads_from_c(threads)?.unwrap_or(1);
+        let cancel = unsafe { cancel.as_ref() };
+
+        // contiguous shares, so each thread's output is already in item order
+        let share = count.div_ceil(threads.max(1)).max(1);
+        let shares: Vec<&mut [BatchItem]> = items.chunks_mut(share).collect();
+        let outputs: Vec<_> = if shares.len() <= 1 {
+            shares.into_iter().map(|s| encode_share(data, s, encoding, source_window, cancel)).collect()
+        } else {
+            std::thread::scope(|scope| {
+                let workers: Vec<_> = shares
+                    .into_iter()
+                    .map(|s| scope.spawn(move || encode_share(data, s, encoding, source_window, cancel)))
+                    .collect();
+                workers
+                    .into_iter()
+                    .map(|w| w.join().unwrap_or_else(|e| std::panic::resume_unwind(e)))
+                    .collect()
+            })
+        };
+
+        let mut outputs = outputs.into_iter().collect::<Result<Vec<_>, _>>()?;
+        if outputs.len() <= 1 {
+            return Ok(outputs.pop().unwrap_or_default());
+        }
+        let mut joined = Vec::with_capacity(outputs.iter().map(Vec::len).sum());
+        for (share_items, output) in items.chunks_mut(share).zip(&outputs) {
+            for item in share_items {
+                item.out_offset += joined.len() as u64;
+            }
+            joined.extend_from_slice(output);
+        }
+        Ok(joined)
+    })();
+
+    match r {
+        Ok(joined) => return_buffer(joined, out, out_len, err),
+        Err(e) => fail(e, err),
+    }
+}
@@ -0,0 +1,505 @@
+// src/bsdiff.rs
+//! bsdiff 4.x patches (XDELTA_FORMAT_BSDIFF), for clients that only run
+//! bspatch. `Decoder` recognises them by their magic and applies them with
+//! `apply_patch`, so every apply entry point takes them.
+//!
+//! The algorithm is Colin Percival's: a suffix array of the old data
+//! (Larsson-Sadakane qsufsort), then a greedy scan of the new data that
+//! extends approximate matches forwards and backwards. The resulting control
+//! triples, byte-wise differences and extra bytes are compressed as three
+//! bzip2 streams after a 32 byte header:
+//!
+//! "BSDIFF40", control length, diff length, new size
+//!
+//! all lengths as 64-bit sign-magnitude little-endian numbers. For the same
+//! input the control block is the one the reference bsdiff writes; only the
+//! bzip2 streams differ byte-wise from libbz2's.
+//!
+//! The suffix array and its inverse take 16 bytes per old byte, on top of
+//! the difference and extra blocks of up to the size of the new data. Like
+//! the reference, long runs of one byte in the new data take time quadratic
+//! in their length: the search settles on the shortest equal suffix and the
+//! scan advances one byte at a time.
+
+use std::io::Write;
+
+use crate::bzip2;
+use crate::cancel::{self, CancelToken};
+use crate::decoder::Source;
+use crate::XDeltaError;
+
+pub(crate) const MAGIC: &[u8; 8] = b"BSDIFF40";
+/// Magic and the three lengths.
+pub(crate) const HEADER_LEN: usize = 32;
+
+/// Bytes of the diff and extra blocks applied per chunk.
+const APPLY_CHUNK: usize = 64 * 1024;
+
+/// New bytes scanned between cancellation checks.
+const CANCEL_STRIDE: usize = 1 << 20;
+
+/// Write the bsdiff patch turning `old` into `new` to `out`.
+pub(crate) fn create_patch_to<W: Write>(
+    old: &[u8],
+    new: &[u8],
+    cancel: Option<&CancelToken>,
+    out: &mut W,
+) -> Result<(), XDeltaError> {
+    let sa = suffix_array(old, cancel)?;
+    cancel::advance(cancel, old.len());
+
+    let mut ctrl = Vec::new();
+    let mut diff = Vec::with_capacity(new.len());
+    let mut extra = Vec::new();
+    let (newsize, oldsize) = (new.len() as i64, old.len() as i64);
+    let (mut scan, mut len, mut pos) = (0i64, 0i64, 0i64);
+    let (mut lastscan, mut lastpos, mut lastoffset) = (0i64, 0i64, 0i64);
+    let mut checked = 0i64;
+    while scan < newsize {
+        let mut oldscore = 0i64;
+        scan += len;
+        let mut scsc = scan;
+        while scan < newsize {
+            if scan - checked >= CANCEL_STRIDE as i64 {
+                cancel::check(cancel)?;
+                cancel::advance(cancel, (scan - checked) as usize);
+                checked = scan;
+            }
+            (len, pos) = search(&sa, old, &new[scan as usize..]);
+            while scsc < scan + len {
+                if scsc + lastoffset < oldsize && old[(scsc + lastoffset) as usize] == new[scsc as usize] {
+                    oldscore += 1;
+                }
+                scsc += 1;
+            }
+            if (len == oldscore && len != 0) || len > oldscore + 8 {
+                break;
+            }
+            if scan + lastoffset < oldsize && old[(scan + lastoffset) as usize] == new[scan as usize] {
+                oldscore -= 1;
+            }
+            scan += 1;
+        }
+
+        if len != oldscore || scan == newsize {
+            // extend the previous match forwards while more than half of the bytes agree
+            let (mut s, mut sf, mut lenf) = (0i64, 0i64, 0i64);
+            let mut i = 0i64;
+            while lastscan + i < scan && lastpos + i < oldsize {
+                if old[(lastpos + i) as usize] == new[(lastscan + i) as usize] {
+                    s += 1;
+                }
+                i += 1;
+                if s * 2 - i > sf * 2 - lenf {
+                    sf = s;
+                    lenf = i;
+                }
+            }
+
+            // and this one backwards
+            let mut lenb = 0i64;
+            if scan < newsize {
+                let (mut s, mut sb) = (0i64, 0i64);
+                let mut i = 1i64;
+                while scan >= lastscan + i && pos >= i {
+                    if old[(pos - i) as usize] == new[(scan - i) as usize] {
+                        s += 1;
+                    }
+                    if s * 2 - i > sb * 2 - lenb {
+                        sb = s;
+                        lenb = i;
+                    }
+                    i += 1;
+                }
+            }
+
+            if lastscan + lenf > scan - lenb {
+                let overlap = (lastscan + lenf) - (scan - lenb);
+                let (mut s, mut ss, mut lens) = (0i64, 0i64, 0i64);
+                for i in 0..overlap {
+                    if new[(lastscan + lenf - overlap + i) as usize] == old[(lastpos + lenf - overlap + i) as usize] {
+                        s += 1;
+                    }
+                    if new[(scan - lenb + i) as usize] == old[(pos - lenb + i) as usize] {
+                        s -= 1;
+                    }
+                    if s > ss {
+                        ss = s;
+                        lens = i + 1;
+                    }
+                }
+                lenf += lens - overlap;
+                lenb -= lens;
+            }
+
+            let (nf, of) = (lastscan as usize, lastpos as usize);
+            diff.extend((0..lenf as usize).map(|i| new[nf + i].wrapping_sub(old[of + i])));
+            let extra_len = (scan - lenb) - (lastscan + lenf);
+            extra.extend_from_slice(&new[(lastscan + lenf) as usize..(scan - lenb) as usize]);
+
+            push_int(&mut ctrl, lenf);
+            push_int(&mut ctrl, extra_len);
+            push_int(&mut ctrl, (pos - lenb) - (lastpos + lenf));
+
+            lastscan = scan - lenb;
+            lastpos = pos - lenb;
+            lastoffset = pos - scan;
+        }
+    }
+    cancel::check(cancel)?;
+    cancel::advance(cancel, (newsize - checked) as usize);
+
+    let ctrl = bzip2::compress(&ctrl);
+    let diff = bzip2::compress(&diff);
+    let extra = bzip2::compress(&extra);
+    let mut header = Vec::with_capacity(32);
+    header.extend_from_slice(MAGIC);
+    push_int(&mut header, ctrl.len() as i64);
+    push_int(&mut header, diff.len() as i64);
+    push_int(&mut header, newsize);
+    for part in [&header, &ctrl, &diff, &extra] {
+        out.write_all(part)
+            .map_err(|e| XDeltaError::Io(format!("failed to write patch: {}", e)))?;
+    }
+    Ok(())
+}
+
+/// Append `x` as bsdiff's 64-bit integer: the magnitude little-endian with
+/// the sign in the top bit.
+fn push_int(out: &mut Vec<u8>, x: i64) {
+    let mut b = x.unsigned_abs().to_le_bytes();
+    if x < 0 {
+        b[7] |= 0x80;
+    }
+    out.extend_from_slice(&b);
+}
+
+/// Read one of bsdiff's 64-bit integers.
+fn read_int(b: &[u8]) -> i64 {
+    let mut m = [0u8; 8];
+    m.copy_from_slice(&b[..8]);
+    m[7] &= 0x7f;
+    let v = i64::from_le_bytes(m);
+    if b[7] & 0x80 != 0 {
+        -v
+    } else {
+        v
+    }
+}
+
+fn corrupt(what: &str) -> XDeltaError {
+    XDeltaError::Corrupt(format!("bsdiff: {}", what))
+}
+
+/// The new size a patch header declares, once the header is complete
+/// (`None` before). The block lengths are checked against the patch when it
+/// is applied.
+pub(crate) fn header_new_size(patch: &[u8]) -> Result<Option<u64>, XDeltaError> {
+    if patch.len() < HEADER_LEN {
+        return Ok(None);
+    }
+    if &patch[..8] != MAGIC {
+        return Err(corrupt("bad magic"));
+    }
+    let (ctrl, diff, new) = (read_int(&patch[8..]), read_int(&patch[16..]), read_int(&patch[24..]));
+    if ctrl < 0 || diff < 0 || new < 0 {
+        return Err(corrupt("invalid header"));
+    }
+    Ok(Some(new as u64))
+}
+
+/// Composition of an applied patch.
+#[derive(Default)]
+pub(crate) struct Applied {
+    pub(crate) entries: u64,
+    pub(crate) diff_bytes: u64,
+    pub(crate) extra_bytes: u64,
+}
+
+/// Apply the complete bsdiff patch `patch`, reading the old data from `src`
+/// and writing the new data to `out`, with the result bspatch gives. Without
+/// a source only the structure is checked: every block is decompressed and
+/// the control entries are checked, but nothing is read or written. Memory
+/// stays at about one bzip2 block per block whatever the size of the output.
+/// `on_read`, if given, is told (offset, length) of every range of the old
+/// data the control entries add to the diff block, clipped to the old data
+/// (without a source only its start is known).
+pub(crate) fn apply_patch<S: Source, W: Write + ?Sized>(
+    patch: &[u8],
+    mut src: Option<&mut S>,
+    out: &mut W,
+    cancel: Option<&CancelToken>,
+    mut on_read: Option<&mut dyn FnMut(u64, u64)>,
+) -> Result<Applied, XDeltaError> {
+    let Some(new_size) = header_new_size(patch)? else {
+        return Err(corrupt("truncated header"));
+    };
+    let new_size = new_size as i64;
+    let body = &patch[HEADER_LEN..];
+    let (ctrl_len, diff_len) = (read_int(&patch[8..]) as u64, read_int(&patch[16..]) as u64);
+    if ctrl_len > body.len() as u64 || diff_len > body.len() as u64 - ctrl_len {
+        return Err(corrupt("invalid header"));
+    }
+    let (ctrl_len, diff_len) = (ctrl_len as usize, diff_len as usize);
+    let old_len = match &src {
+        Some(s) => match s.len() {
+            Some(n) => n as i64,
+            None => {
+                return Err(XDeltaError::Unsupported(
+                    "bsdiff patches need the length of the old data".into(),
+                ))
+            }
+        },
+        None => i64::MAX,
+    };
+    let block = |name: &'static str| move |e: XDeltaError| e.context(&format!("bsdiff {} block", name));
+    let mut ctrl = bzip2::Reader::new(&body[..ctrl_len]).map_err(block("control"))?;
+    let mut diff = bzip2::Reader::new(&body[ctrl_len..ctrl_len + diff_len]).map_err(block("diff"))?;
+    let mut extra = bzip2::Reader::new(&body[ctrl_len + diff_len..]).map_err(block("extra"))?;
+
+    let mut st = Applied::default();
+    let mut buf = Vec::new();
+    let mut old = Vec::new();
+    let (mut new_pos, mut old_pos) = (0i64, 0i64);
+    while new_pos < new_size {
+        cancel::check(cancel)?;
+        let mut entry = [0u8; 24];
+        ctrl.read_exact(&mut entry).map_err(block("control"))?;
+        let (add, cp, seek) = (read_int(&entry), read_int(&entry[8..]), read_int(&entry[16..]));
+        if add < 0 || cp < 0 || add > new_size - new_pos || cp > new_size - new_pos - add {
+            return Err(corrupt("control entry exceeds the new size"));
+        }
+        let old_end = old_pos.checked_add(add).ok_or_else(|| corrupt("old offset overflows"))?;
+        if let Some(f) = on_read.as_deref_mut() {
+            let (lo, hi) = (i64::max(old_pos, 0), i64::min(old_end, old_len));
+            if lo < hi {
+                f(lo as u64, (hi - lo) as u64);
+            }
+        }
+        if buf.is_empty() && add + cp > 0 {
+            buf = vec![0u8; APPLY_CHUNK];
+        }
+
+        let mut done = 0i64;
+        while done < add {
+            let chunk = &mut buf[..i64::min(add - done, APPLY_CHUNK as i64) as usize];
+            diff.read_exact(chunk).map_err(block("diff"))?;
+            if let Some(s) = src.as_deref_mut() {
+                // like bspatch, bytes outside the old data are taken as they are
+                let pos = old_pos + done;
+                let (lo, hi) = (i64::max(-pos, 0), i64::min(chunk.len() as i64, old_len - pos));
+                if lo < hi {
+                    old.resize((hi - lo) as usize, 0);
+                    s.read_at((pos + lo) as u64, &mut old)?;
+                    for (c, o) in chunk[lo as usize..hi as usize].iter_mut().zip(&old) {
+                        *c = c.wrapping_add(*o);
+                    }
+                }
+                write_out(out, chunk)?;
+            }
+            done += chunk.len() as i64;
+        }
+        let mut done = 0i64;
+        while done < cp {
+            let chunk = &mut buf[..i64::min(cp - done, APPLY_CHUNK as i64) as usize];
+            extra.read_exact(chunk).map_err(block("extra"))?;
+            if src.is_some() {
+                write_out(out, chunk)?;
+            }
+            done += chunk.len() as i64;
+        }
+        new_pos += add + cp;
+        old_pos = old_end.checked_add(seek).ok_or_else(|| corrupt("old offset overflows"))?;
+        st.entries += 1;
+        st.diff_bytes += add as u64;
+        st.extra_bytes += cp as u64;
+    }
+    ctrl.finish().map_err(block("control"))?;
+    diff.finish().map_err(block("diff"))?;
+    extra.finish().map_err(block("extra"))?;
+    Ok(st)
+}
+
+fn write_out<W: Write + ?Sized>(out: &mut W, data: &[u8]) -> Result<(), XDeltaError> {
+    out.write_all(data).map_err(|e| XDeltaError::Io(e.to_string()))
+}
+
+/// Longest match of a prefix of `new` among the suffixes of `old`, as
+/// (length, position), by binary search over the suffix array.
+fn search(sa: &[i64], old: &[u8], new: &[u8]) -> (i64, i64) {
+    let (mut st, mut en) = (0usize, sa.len() - 1);
+    while en - st >= 2 {
+        let x = st + (en - st) / 2;
+        let suffix = &old[sa[x] as usize..];
+        let n = usize::min(suffix.len(), new.len());
+        if suffix[..n] < new[..n] {
+            st = x;
+        } else {
+            en = x;
+        }
+    }
+    let x = match_len(&old[sa[st] as usize..], new);
+    let y = match_len(&old[sa[en] as usize..], new);
+    if x > y {
+        (x as i64, sa[st])
+    } else {
+        (y as i64, sa[en])
+    }
+}
+
+fn match_len(a: &[u8], b: &[u8]) -> usize {
+    a.iter().zip(b).take_while(|(x, y)| x == y).count()
+}
+
+/// Suffix array of `old` including the empty suffix (which sorts first),
+/// built with Larsson and Sadakane's qsufsort as in the reference bsdiff.
+fn suffix_array(old: &[u8], cancel: Option<&CancelToken>) -> Result<Vec<i64>, XDeltaError> {
+    let n = old.len();
+    let mut i_arr = vec![0i64; n + 1];
+    let mut v = vec![0i64; n + 1];
+    let mut buckets = [0i64; 256];
+    for &b in old {
+        buckets[b as usize] += 1;
+    }
+    for i in 1..256 {
+        buckets[i] += buckets[i - 1];
+    }
+    for i in (1..256).rev() {
+        buckets[i] = buckets[i - 1];
+    }
+    buckets[0] = 0;
+    for (i, &b) in old.iter().enumerate() {
+        buckets[b as usize] += 1;
+        i_arr[buckets[b as usize] as usize] = i as i64;
+    }
+    i_arr[0] = n as i64;
+    for (i, &b) in old.iter().enumerate() {
+        v[i] = buckets[b as usize];
+    }
+    v[n] = 0;
+    for i in 1..256 {
+        if buckets[i] == buckets[i - 1] + 1 {
+            i_arr[buckets[i] as usize] = -1;
+        }
+    }
+    i_arr[0] = -1;
+
+    let mut h = 1usize;
+    while i_arr[0] != -(n as i64 + 1) {
+        cancel::check(cancel)?;
+        let mut len = 0i64;
+        let mut i = 0usize;
+        while i < n + 1 {
+            if i_arr[i] < 0 {
+                len -= i_arr[i];
+                i = (i as i64 - i_arr[i]) as usize;
+            } else {
+                if len != 0 {
+                    i_arr[i - len as usize] = -len;
+                }
+                let group = (v[i_arr[i] as usize] + 1) as usize - i;
+                split(&mut i_arr, &mut v, i, group, h);
+                i += group;
+                len = 0;
+            }
+        }
+        if len != 0 {
+            i_arr[i - len as usize] = -len;
+        }
+        h += h;
+    }
+    for (i, &r) in v.iter().enumerate() {
+        i_arr[r as usize] = i as i64;
+    }
+    Ok(i_arr)
+}
+
+/// Sort the group `start..start + len` of `i_arr` by the rank `h` bytes
+/// further on, updating the ranks in `v` and marking sorted singletons.
+/// A ternary quicksort that recurses into the smaller side only.
+fn split(i_arr: &mut [i64], v: &mut [i64], mut start: usize, mut len: usize, h: usize) {
+    let key = |v: &[i64], s: i64| v[s as usize + h];
+    loop {
+        if len < 16 {
+            let mut k = start;
+            while k < start + len {
+                let mut j = 1;
+                let mut x = key(v, i_arr[k]);
+                let mut i = 1;
+                while k + i < start + len {
+                    let y = key(v, i_arr[k + i]);
+                    if y < x {
+                        x = y;
+                        j = 0;
+                    }
+                    if y == x {
+                        i_arr.swap(k + j, k + i);
+                        j += 1;
+                    }
+                    i += 1;
+                }
+                for i in 0..j {
+                    v[i_arr[k + i] as usize] = (k + j - 1) as i64;
+                }
+                if j == 1 {
+                    i_arr[k] = -1;
+                }
+                k += j;
+            }
+            return;
+        }
+
+        let x = key(v, i_arr[start + len / 2]);
+        let (mut jj, mut kk) = (0usize, 0usize);
+        for i in start..start + len {
+            let y = key(v, i_arr[i]);
+            if y < x {
+                jj += 1;
+            }
+            if y == x {
+                kk += 1;
+            }
+        }
+        jj += start;
+        kk += jj;
+
+        let (mut i, mut j, mut k) = (start, 0usize, 0usize);
+        while i < jj {
+            let y = key(v, i_arr[i]);
+            if y < x {
+                i += 1;
+            } else if y == x {
+                i_arr.swap(i, jj + j);
+                j += 1;
+            } else {
+                i_arr.swap(i, kk + k);
+                k += 1;
+            }
+        }
+        while jj + j < kk {
+            if key(v, i_arr[jj + j]) == x {
+                j += 1;
+            } else {
+                i_arr.swap(jj + j, kk + k);
+                k += 1;
+            }
+        }
+
+        for i in 0..kk - jj {
+            v[i_arr[jj + i] as usize] = (kk - 1) as i64;
+        }
+        if jj == kk - 1 {
+            i_arr[jj] = -1;
+        }
+
+        let (less, greater) = ((start, jj - start), (kk, start + len - kk));
+        let (small, large) = if less.1 <= greater.1 { (less, greater) } else { (greater, less) };
+        if small.1 > 0 {
+            split(i_arr, v, small.0, small.1, h);
+        }
+        if large.1 == 0 {
+            return;
+        }
+        (start, len) = large;
+    }
+}
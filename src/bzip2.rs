@@ -0,0 +1,865 @@
+// src/bzip2.rs
+//! bzip2 compression and decompression, enough for the blocks of bsdiff patches.
+//!
+//! The stream is the one `bzip2 -9` writes: the input is run-length encoded
+//! into blocks of up to 900 000 bytes, each block goes through the
+//! Burrows-Wheeler transform, move-to-front with zero-run coding and up to six
+//! Huffman tables chosen per group of 50 symbols. Any bzip2 decoder reads it;
+//! the output is not byte-identical to libbz2, whose sorting and table
+//! heuristics differ. `Reader` decodes any single bzip2 stream except the
+//! long-deprecated randomised blocks.
+
+use crate::XDeltaError;
+
+/// Block size in units of 100 000 bytes, the `9` of `BZh9`.
+const LEVEL: usize = 9;
+/// Bytes of run-length encoded input per block, with libbz2's slack of 19.
+const BLOCK_MAX: usize = LEVEL * 100_000 - 19;
+/// Symbols coded with the same Huffman table.
+const GROUP: usize = 50;
+/// Longest Huffman code the encoder produces; decoders accept up to 20.
+const MAX_CODE_LEN: u32 = 17;
+/// Rounds of refining the tables against the selectors they produce.
+const ITERATIONS: usize = 4;
+
+const BLOCK_MAGIC: u64 = 0x3141_5926_5359;
+const END_MAGIC: u64 = 0x1772_4538_5090;
+
+const RUNA: u16 = 0;
+const RUNB: u16 = 1;
+
+/// Compress `data` into a complete bzip2 stream.
+pub(crate) fn compress(data: &[u8]) -> Vec<u8> {
+    let mut w = BitWriter::default();
+    for &b in b"BZh" {
+        w.put(8, b as u32);
+    }
+    w.put(8, b'0' as u32 + LEVEL as u32);
+    let mut combined: u32 = 0;
+    let mut block = Vec::with_capacity(usize::min(BLOCK_MAX, data.len() + data.len() / 4 + 5));
+    let mut rest = data;
+    while !rest.is_empty() {
+        block.clear();
+        let used = fill_block(rest, &mut block);
+        let crc = crc32(&rest[..used]);
+        rest = &rest[used..];
+        combined = combined.rotate_left(1) ^ crc;
+        write_block(&mut w, &block, crc);
+    }
+    w.put64(48, END_MAGIC);
+    w.put(32, combined);
+    w.finish()
+}
+
+/// Run-length encode the start of `data` into `block` (four equal bytes are
+/// followed by the count of further ones, up to 251), stopping before the
+/// block would exceed `BLOCK_MAX`. Returns how many input bytes were used.
+fn fill_block(data: &[u8], block: &mut Vec<u8>) -> usize {
+    let mut i = 0;
+    while i < data.len() {
+        let b = data[i];
+        let run = data[i..].iter().take(255).take_while(|&&c| c == b).count();
+        let unit = if run >= 4 { 5 } else { run };
+        if block.len() + unit > BLOCK_MAX {
+            break;
+        }
+        if run >= 4 {
+            block.extend_from_slice(&[b, b, b, b, (run - 4) as u8]);
+        } else {
+            block.extend(std::iter::repeat(b).take(run));
+        }
+        i += run;
+    }
+    i
+}
+
+fn write_block(w: &mut BitWriter, block: &[u8], crc: u32) {
+    let (last, orig_ptr) = bwt(block);
+
+    let mut in_use = [false; 256];
+    for &b in block {
+        in_use[b as usize] = true;
+    }
+    let mut seq = [0u8; 256];
+    let mut n_in_use = 0usize;
+    for (b, used) in in_use.iter().enumerate() {
+        if *used {
+            seq[b] = n_in_use as u8;
+            n_in_use += 1;
+        }
+    }
+    let alpha = n_in_use + 2;
+    let symbols = mtf_symbols(&last, &seq, n_in_use);
+
+    w.put64(48, BLOCK_MAGIC);
+    w.put(32, crc);
+    w.put(1, 0); // not randomised
+    w.put(24, orig_ptr as u32);
+    let mut ranges = 0u32;
+    for r in 0..16 {
+        if in_use[r * 16..r * 16 + 16].iter().any(|&u| u) {
+            ranges |= 1 << (15 - r);
+        }
+    }
+    w.put(16, ranges);
+    for r in 0..16 {
+        if ranges & (1 << (15 - r)) != 0 {
+            let mut bits = 0u32;
+            for (j, &u) in in_use[r * 16..r * 16 + 16].iter().enumerate() {
+                if u {
+                    bits |= 1 << (15 - j);
+                }
+            }
+            w.put(16, bits);
+        }
+    }
+
+    let (lens, selectors) = choose_tables(&symbols, alpha);
+    w.put(3, lens.len() as u32);
+    w.put(15, selectors.len() as u32);
+    let mut order: Vec<u8> = (0..lens.len() as u8).collect();
+    for &s in &selectors {
+        let j = order.iter().position(|&t| t == s).expect("selector names a table");
+        order[..=j].rotate_right(1);
+        for _ in 0..j {
+            w.put(1, 1);
+        }
+        w.put(1, 0);
+    }
+    for len in &lens {
+        let mut curr = len[0];
+        w.put(5, curr);
+        for &l in len {
+            while curr < l {
+                w.put(2, 2);
+                curr += 1;
+            }
+            while curr > l {
+                w.put(2, 3);
+                curr -= 1;
+            }
+            w.put(1, 0);
+        }
+    }
+    let codes: Vec<Vec<u32>> = lens.iter().map(|len| assign_codes(len)).collect();
+    for (group, &s) in symbols.chunks(GROUP).zip(&selectors) {
+        let (len, code) = (&lens[s as usize], &codes[s as usize]);
+        for &sym in group {
+            w.put(len[sym as usize], code[sym as usize]);
+        }
+    }
+}
+
+/// Burrows-Wheeler transform of `block` as bzip2 defines it: the last column
+/// of the sorted rotations and the row of the unrotated block. Rotations are
+/// sorted by prefix doubling with counting sorts, O(n log n) in the worst
+/// case; equal rotations (a periodic block) may come in any order, which
+/// changes neither the last column nor what a decoder produces.
+fn bwt(block: &[u8]) -> (Vec<u8>, usize) {
+    let n = block.len();
+    let mut sa: Vec<u32> = Vec::with_capacity(n);
+    let mut counts = [0usize; 257];
+    for &b in block {
+        counts[b as usize + 1] += 1;
+    }
+    for i in 1..257 {
+        counts[i] += counts[i - 1];
+    }
+    let mut rank: Vec<u32> = block.iter().map(|&b| b as u32).collect();
+    {
+        let mut next = counts;
+        sa.resize(n, 0);
+        for (i, &b) in block.iter().enumerate() {
+            sa[next[b as usize]] = i as u32;
+            next[b as usize] += 1;
+        }
+    }
+    let mut classes = 256usize;
+    let mut tmp = vec![0u32; n];
+    let mut new_rank = vec![0u32; n];
+    let mut k = 1usize;
+    while k < n {
+        // rotations ordered by the rank of their second half, then stably by the first
+        for (t, &s) in tmp.iter_mut().zip(&sa) {
+            *t = ((s as usize + n - k) % n) as u32;
+        }
+        let mut cnt = vec![0usize; classes + 1];
+        for &t in &tmp {
+            cnt[rank[t as usize] as usize + 1] += 1;
+        }
+        for i in 1..cnt.len() {
+            cnt[i] += cnt[i - 1];
+        }
+        for &t in &tmp {
+            let r = rank[t as usize] as usize;
+            sa[cnt[r]] = t;
+            cnt[r] += 1;
+        }
+        let key = |s: u32| (rank[s as usize], rank[(s as usize + k) % n]);
+        let mut c = 0u32;
+        new_rank[sa[0] as usize] = 0;
+        for i in 1..n {
+            if key(sa[i]) != key(sa[i - 1]) {
+                c += 1;
+            }
+            new_rank[sa[i] as usize] = c;
+        }
+        std::mem::swap(&mut rank, &mut new_rank);
+        classes = c as usize + 1;
+        if classes == n {
+            break;
+        }
+        k *= 2;
+    }
+    let mut orig_ptr = 0;
+    let last = sa
+        .iter()
+        .enumerate()
+        .map(|(i, &s)| {
+            if s == 0 {
+                orig_ptr = i;
+            }
+            block[(s as usize + n - 1) % n]
+        })
+        .collect();
+    (last, orig_ptr)
+}
+
+/// Move-to-front over the last column with runs of zeros written as
+/// bijective base-2 numbers of RUNA/RUNB, ending with the end-of-block symbol.
+fn mtf_symbols(last: &[u8], seq: &[u8; 256], n_in_use: usize) -> Vec<u16> {
+    let mut order: Vec<u8> = (0..n_in_use).map(|i| i as u8).collect();
+    let mut out = Vec::with_capacity(last.len() + 1);
+    let mut zeros = 0usize;
+    let flush = |out: &mut Vec<u16>, zeros: &mut usize| {
+        if *zeros == 0 {
+            return;
+        }
+        let mut z = *zeros - 1;
+        loop {
+            out.push(if z & 1 == 1 { RUNB } else { RUNA });
+            if z < 2 {
+                break;
+            }
+            z = (z - 2) / 2;
+        }
+        *zeros = 0;
+    };
+    for &b in last {
+        let s = seq[b as usize];
+        if order[0] == s {
+            zeros += 1;
+            continue;
+        }
+        flush(&mut out, &mut zeros);
+        let j = order.iter().position(|&o| o == s).expect("byte is in use");
+        order[..=j].rotate_right(1);
+        out.push(j as u16 + 1);
+    }
+    flush(&mut out, &mut zeros);
+    out.push(n_in_use as u16 + 1);
+    out
+}
+
+/// Huffman code lengths of up to six tables and the table of each group of
+/// `GROUP` symbols, refined a few times from an initial split by frequency.
+fn choose_tables(symbols: &[u16], alpha: usize) -> (Vec<Vec<u32>>, Vec<u8>) {
+    let n_groups = match symbols.len() {
+        0..=199 => 2,
+        200..=599 => 3,
+        600..=1199 => 4,
+        1200..=2399 => 5,
+        _ => 6,
+    };
+    let mut freq = vec![0u32; alpha];
+    for &s in symbols {
+        freq[s as usize] += 1;
+    }
+    // each table starts out cheap for a range of symbols holding an equal share
+    let mut lens = vec![vec![15u32; alpha]; n_groups];
+    let mut remaining = symbols.len() as u64;
+    let mut start = 0usize;
+    for (t, len) in lens.iter_mut().enumerate() {
+        let share = remaining / (n_groups - t) as u64;
+        let mut end = start;
+        let mut taken = 0u64;
+        while end < alpha && (taken < share || end == start) {
+            taken += freq[end] as u64;
+            end += 1;
+        }
+        if t == n_groups - 1 {
+            end = alpha;
+        }
+        for l in &mut len[start..end] {
+            *l = 0;
+        }
+        remaining = remaining.saturating_sub(taken);
+        start = end.min(alpha);
+    }
+    let mut selectors = vec![0u8; symbols.len().div_ceil(GROUP)];
+    for _ in 0..ITERATIONS {
+        let mut rfreq = vec![vec![0u32; alpha]; n_groups];
+        for (group, sel) in symbols.chunks(GROUP).zip(selectors.iter_mut()) {
+            let mut best = 0;
+            let mut best_cost = u32::MAX;
+            for (t, len) in lens.iter().enumerate() {
+                let cost: u32 = group.iter().map(|&s| len[s as usize]).sum();
+                if cost < best_cost {
+                    best_cost = cost;
+                    best = t;
+                }
+            }
+            *sel = best as u8;
+            for &s in group {
+                rfreq[best][s as usize] += 1;
+            }
+        }
+        for (len, f) in lens.iter_mut().zip(&rfreq) {
+            *len = code_lengths(f, MAX_CODE_LEN);
+        }
+    }
+    (lens, selectors)
+}
+
+/// Huffman code lengths for `freq`, every symbol getting a code, none longer
+/// than `max_len`: while the tree is too deep the weights are flattened and
+/// the tree rebuilt, as libbz2 does.
+fn code_lengths(freq: &[u32], max_len: u32) -> Vec<u32> {
+    let mut weights: Vec<u64> = freq.iter().map(|&f| u64::from(f.max(1))).collect();
+    loop {
+        let lens = huffman_depths(&weights);
+        if lens.iter().all(|&l| l <= max_len) {
+            return lens;
+        }
+        for w in &mut weights {
+            *w = 1 + *w / 2;
+        }
+    }
+}
+
+/// Depth of every leaf of a Huffman tree over `weights`.
+fn huffman_depths(weights: &[u64]) -> Vec<u32> {
+    use std::cmp::Reverse;
+    use std::collections::BinaryHeap;
+    let n = weights.len();
+    let mut parent = vec![usize::MAX; 2 * n];
+    let mut heap: BinaryHeap<Reverse<(u64, usize)>> = weights.iter().enumerate().map(|(i, &w)| Reverse((w, i))).collect();
+    let mut next = n;
+    while heap.len() > 1 {
+        let Reverse((w1, a)) = heap.pop().expect("two nodes");
+        let Reverse((w2, b)) = heap.pop().expect("two nodes");
+        parent[a] = next;
+        parent[b] = next;
+        heap.push(Reverse((w1 + w2, next)));
+        next += 1;
+    }
+    (0..n)
+        .map(|i| {
+            let mut depth = 0;
+            let mut p = parent[i];
+            while p != usize::MAX {
+                depth += 1;
+                p = parent[p];
+            }
+            depth.max(1)
+        })
+        .collect()
+}
+
+/// Canonical codes for `lens`: shorter codes first, equal lengths by symbol.
+fn assign_codes(lens: &[u32]) -> Vec<u32> {
+    let mut codes = vec![0u32; lens.len()];
+    let (min, max) = (*lens.iter().min().unwrap_or(&1), *lens.iter().max().unwrap_or(&1));
+    let mut code = 0u32;
+    for len in min..=max {
+        for (c, &l) in codes.iter_mut().zip(lens) {
+            if l == len {
+                *c = code;
+                code += 1;
+            }
+        }
+        code <<= 1;
+    }
+    codes
+}
+
+/// bzip2's CRC-32: polynomial 0x04C11DB7 fed most significant bit first.
+fn crc32(data: &[u8]) -> u32 {
+    static TABLE: std::sync::OnceLock<[u32; 256]> = std::sync::OnceLock::new();
+    let table = TABLE.get_or_init(|| {
+        let mut t = [0u32; 256];
+        for (i, e) in t.iter_mut().enumerate() {
+            let mut c = (i as u32) << 24;
+            for _ in 0..8 {
+                c = if c & 0x8000_0000 != 0 { (c << 1) ^ 0x04C1_1DB7 } else { c << 1 };
+            }
+            *e = c;
+        }
+        t
+    });
+    let mut crc = !0u32;
+    for &b in data {
+        crc = (crc << 8) ^ table[((crc >> 24) ^ b as u32) as usize];
+    }
+    !crc
+}
+
+/// Bits written most significant first, as bzip2 reads them.
+#[derive(Default)]
+struct BitWriter {
+    out: Vec<u8>,
+    acc: u64,
+    bits: u32,
+}
+
+impl BitWriter {
+    /// Append the low `n` bits of `v`, `n` at most 32.
+    fn put(&mut self, n: u32, v: u32) {
+        self.acc = (self.acc << n) | u64::from(v) & ((1u64 << n) - 1);
+        self.bits += n;
+        while self.bits >= 8 {
+            self.bits -= 8;
+            self.out.push((self.acc >> self.bits) as u8);
+        }
+    }
+
+    fn put64(&mut self, n: u32, v: u64) {
+        self.put(n - 32, (v >> 32) as u32);
+        self.put(32, v as u32);
+    }
+
+    fn finish(mut self) -> Vec<u8> {
+        if self.bits > 0 {
+            self.out.push((self.acc << (8 - self.bits)) as u8);
+        }
+        self.out
+    }
+}
+
+/// Longest Huffman code a bzip2 stream may use.
+const MAX_DECODE_LEN: usize = 20;
+/// Selectors libbz2 keeps; streams may declare more, the rest are read and dropped.
+const MAX_SELECTORS: usize = 18_002;
+
+fn corrupt(what: &str) -> XDeltaError {
+    XDeltaError::Corrupt(format!("bzip2: {}", what))
+}
+
+/// Incremental decompressor for one bzip2 stream held in memory. Blocks are
+/// decoded as they are read, so memory stays at one block whatever the size
+/// of the stream; every block CRC and the stream CRC are checked.
+pub(crate) struct Reader<'a> {
+    bits: BitReader<'a>,
+    /// decoded bytes per block, from the `BZh` level
+    block_max: usize,
+    /// BWT vector of the current block, reused between blocks
+    tt: Vec<u32>,
+    /// output of the current block and how much of it was read
+    out: Vec<u8>,
+    pos: usize,
+    combined: u32,
+    ended: bool,
+}
+
+impl<'a> Reader<'a> {
+    pub(crate) fn new(data: &'a [u8]) -> Result<Self, XDeltaError> {
+        let mut bits = BitReader { data, pos: 0, acc: 0, count: 0 };
+        if bits.get(24)? != 0x42_5A68 {
+            return Err(corrupt("bad magic"));
+        }
+        let level = bits.get(8)?;
+        if !(u32::from(b'1')..=u32::from(b'9')).contains(&level) {
+            return Err(corrupt("bad block size"));
+        }
+        Ok(Reader {
+            bits,
+            block_max: (level - u32::from(b'0')) as usize * 100_000,
+            tt: Vec::new(),
+            out: Vec::new(),
+            pos: 0,
+            combined: 0,
+            ended: false,
+        })
+    }
+
+    /// Fill `buf` completely; the stream ending first is Corrupt.
+    pub(crate) fn read_exact(&mut self, mut buf: &mut [u8]) -> Result<(), XDeltaError> {
+        while !buf.is_empty() {
+            if self.pos == self.out.len() && !self.next_block()? {
+                return Err(corrupt("truncated stream"));
+            }
+            let n = usize::min(buf.len(), self.out.len() - self.pos);
+            buf[..n].copy_from_slice(&self.out[self.pos..self.pos + n]);
+            self.pos += n;
+            buf = &mut buf[n..];
+        }
+        Ok(())
+    }
+
+    /// Check that the stream is intact up to its end once the caller has
+    /// read what it needs: a stream cut before its end marker is Corrupt.
+    /// Decoded bytes the caller did not read are ignored, as bspatch does.
+    pub(crate) fn finish(&mut self) -> Result<(), XDeltaError> {
+        if self.pos < self.out.len() {
+            return Ok(());
+        }
+        self.next_block().map(|_| ())
+    }
+
+    /// Decode the next block into `out`, false at the end of the stream.
+    fn next_block(&mut self) -> Result<bool, XDeltaError> {
+        if self.ended {
+            return Ok(false);
+        }
+        self.out.clear();
+        self.pos = 0;
+        loop {
+            let magic = self.bits.get64(48)?;
+            if magic == END_MAGIC {
+                if self.bits.get(32)? != self.combined {
+                    return Err(corrupt("bad stream CRC"));
+                }
+                self.ended = true;
+                return Ok(false);
+            }
+            if magic != BLOCK_MAGIC {
+                return Err(corrupt("bad block magic"));
+            }
+            let crc = self.bits.get(32)?;
+            self.read_block()?;
+            if crc32(&self.out) != crc {
+                return Err(corrupt("bad block CRC"));
+            }
+            self.combined = self.combined.rotate_left(1) ^ crc;
+            if !self.out.is_empty() {
+                return Ok(true);
+            }
+        }
+    }
+
+    fn read_block(&mut self) -> Result<(), XDeltaError> {
+        let r = &mut self.bits;
+        if r.get(1)? != 0 {
+            return Err(corrupt("randomised blocks are not supported"));
+        }
+        let orig_ptr = r.get(24)? as usize;
+
+        let ranges = r.get(16)?;
+        let mut seq = Vec::with_capacity(256);
+        for i in 0..16 {
+            if ranges & (1 << (15 - i)) != 0 {
+                let used = r.get(16)?;
+                for j in 0..16 {
+                    if used & (1 << (15 - j)) != 0 {
+                        seq.push((i * 16 + j) as u8);
+                    }
+                }
+            }
+        }
+        if seq.is_empty() {
+            return Err(corrupt("block uses no bytes"));
+        }
+        let alpha = seq.len() + 2;
+
+        let n_groups = r.get(3)? as usize;
+        if !(2..=6).contains(&n_groups) {
+            return Err(corrupt("bad number of Huffman tables"));
+        }
+        let n_selectors = r.get(15)? as usize;
+        if n_selectors == 0 {
+            return Err(corrupt("no selectors"));
+        }
+        let mut order: Vec<u8> = (0..n_groups as u8).collect();
+        let mut selectors = Vec::with_capacity(usize::min(n_selectors, MAX_SELECTORS));
+        for i in 0..n_selectors {
+            let mut j = 0usize;
+            while r.get(1)? == 1 {
+                j += 1;
+                if j >= n_groups {
+                    return Err(corrupt("bad selector"));
+                }
+            }
+            order[..=j].rotate_right(1);
+            if i < MAX_SELECTORS {
+                selectors.push(order[0]);
+            }
+        }
+
+        let mut tables = Vec::with_capacity(n_groups);
+        for _ in 0..n_groups {
+            let mut lens = vec![0u8; alpha];
+            let mut curr = r.get(5)? as i32;
+            for l in lens.iter_mut() {
+                loop {
+                    if !(1..=MAX_DECODE_LEN as i32).contains(&curr) {
+                        return Err(corrupt("bad code length"));
+                    }
+                    if r.get(1)? == 0 {
+                        break;
+                    }
+                    curr += if r.get(1)? == 0 { 1 } else { -1 };
+                }
+                *l = curr as u8;
+            }
+            tables.push(Huffman::new(&lens));
+        }
+
+        // Huffman and move-to-front decoding, undoing the zero-run coding
+        let eob = (alpha - 1) as u16;
+        let mut mtf: Vec<u8> = (0..seq.len()).map(|i| i as u8).collect();
+        let mut counts = [0u32; 256];
+        let tt = &mut self.tt;
+        tt.clear();
+        let (mut run, mut weight) = (0usize, 1usize);
+        let mut left = 0usize;
+        let mut next_selector = 0usize;
+        let mut table = &tables[0];
+        loop {
+            if left == 0 {
+                let Some(&s) = selectors.get(next_selector) else {
+                    return Err(corrupt("ran out of selectors"));
+                };
+                next_selector += 1;
+                table = &tables[s as usize];
+                left = GROUP;
+            }
+            left -= 1;
+            let sym = table.decode(r)?;
+            if sym == RUNA || sym == RUNB {
+                run += if sym == RUNA { weight } else { 2 * weight };
+                weight <<= 1;
+                if run > self.block_max {
+                    return Err(corrupt("block too long"));
+                }
+                continue;
+            }
+            if run > 0 {
+                if tt.len() + run > self.block_max {
+                    return Err(corrupt("block too long"));
+                }
+                let b = seq[mtf[0] as usize];
+                counts[b as usize] += run as u32;
+                tt.extend(std::iter::repeat(u32::from(b)).take(run));
+                (run, weight) = (0, 1);
+            }
+            if sym == eob {
+                break;
+            }
+            let j = (sym - 1) as usize;
+            mtf[..=j].rotate_right(1);
+            if tt.len() >= self.block_max {
+                return Err(corrupt("block too long"));
+            }
+            let b = seq[mtf[0] as usize];
+            counts[b as usize] += 1;
+            tt.push(u32::from(b));
+        }
+        if orig_ptr >= tt.len() {
+            return Err(corrupt("bad BWT origin"));
+        }
+
+        // inverse Burrows-Wheeler transform, each entry keeps its byte in the
+        // low 8 bits and the index of the next one above them
+        let mut start = [0u32; 256];
+        let mut sum = 0u32;
+        for (s, &c) in start.iter_mut().zip(&counts) {
+            *s = sum;
+            sum += c;
+        }
+        for i in 0..tt.len() {
+            let b = (tt[i] & 0xff) as usize;
+            tt[start[b] as usize] |= (i as u32) << 8;
+            start[b] += 1;
+        }
+
+        // the initial run-length coding: four equal bytes are followed by
+        // the count of further ones
+        let mut at = (tt[orig_ptr] >> 8) as usize;
+        let (mut last, mut same) = (0u8, 0usize);
+        for _ in 0..tt.len() {
+            let e = tt[at];
+            let b = e as u8;
+            at = (e >> 8) as usize;
+            if same == 4 {
+                self.out.extend(std::iter::repeat(last).take(b as usize));
+                same = 0;
+                continue;
+            }
+            if same > 0 && b == last {
+                same += 1;
+            } else {
+                (last, same) = (b, 1);
+            }
+            self.out.push(b);
+        }
+        Ok(())
+    }
+}
+
+/// Canonical Huffman decoder: codes are assigned in order of length, then
+/// symbol, as bzip2's encoder assigns them.
+struct Huffman {
+    /// symbols per code length
+    count: [u16; MAX_DECODE_LEN + 1],
+    /// symbols sorted by code length
+    symbols: Vec<u16>,
+}
+
+impl Huffman {
+    fn new(lens: &[u8]) -> Huffman {
+        let mut count = [0u16; MAX_DECODE_LEN + 1];
+        for &l in lens {
+            count[l as usize] += 1;
+        }
+        let mut symbols = Vec::with_capacity(lens.len());
+        for len in 1..=MAX_DECODE_LEN as u8 {
+            symbols.extend((0..lens.len() as u16).filter(|&s| lens[s as usize] == len));
+        }
+        Huffman { count, symbols }
+    }
+
+    fn decode(&self, r: &mut BitReader) -> Result<u16, XDeltaError> {
+        // code: bits read so far; first: first code of this length; index: its symbol
+        let (mut code, mut first, mut index) = (0u32, 0u32, 0u32);
+        for len in 1..=MAX_DECODE_LEN {
+            code |= r.get(1)?;
+            let count = u32::from(self.count[len]);
+            if code - first < count {
+                return Ok(self.symbols[(index + code - first) as usize]);
+            }
+            index += count;
+            first = (first + count) << 1;
+            code <<= 1;
+        }
+        Err(corrupt("bad Huffman code"))
+    }
+}
+
+/// Bits read most significant first.
+struct BitReader<'a> {
+    data: &'a [u8],
+    pos: usize,
+    acc: u64,
+    count: u32,
+}
+
+impl BitReader<'_> {
+    /// Read `n` bits, `n` at most 32.
+    fn get(&mut self, n: u32) -> Result<u32, XDeltaError> {
+        while self.count < n {
+            let Some(&b) = self.data.get(self.pos) else {
+                return Err(corrupt("truncated stream"));
+            };
+            self.pos += 1;
+            self.acc = (self.acc << 8) | u64::from(b);
+            self.count += 8;
+        }
+        self.count -= n;
+        Ok(((self.acc >> self.count) & ((1u64 << n) - 1)) as u32)
+    }
+
+    fn get64(&mut self, n: u32) -> Result<u64, XDeltaError> {
+        let hi = self.get(n - 32)?;
+        Ok((u64::from(hi) << 32) | u64::from(self.get(32)?))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::fixtures::{mixed, noise, run_tool, sample};
+
+    fn decompress(stream: &[u8], len: usize) -> Result<Vec<u8>, XDeltaError> {
+        let mut r = Reader::new(stream)?;
+        let mut out = vec![0; len];
+        r.read_exact(&mut out)?;
+        r.finish()?;
+        Ok(out)
+    }
+
+    #[test]
+    fn decodes_reference_streams() {
+        let streams: [(&str, &[u8], Vec<u8>); 3] = [
+            ("sample-1.bz2", include_bytes!("testdata/sample-1.bz2"), sample()),
+            ("sample-9.bz2", include_bytes!("testdata/sample-9.bz2"), sample()),
+            ("mixed.bz2", include_bytes!("testdata/mixed.bz2"), mixed()),
+        ];
+        for (name, stream, want) in &streams {
+            assert_eq!(&decompress(stream, want.len()).unwrap(), want, "{}", name);
+        }
+    }
+
+    #[test]
+    fn round_trip() {
+        let runs: Vec<u8> = (0..3000u32).flat_map(|i| std::iter::repeat((i % 7) as u8).take(i as usize % 600)).collect();
+        for data in [Vec::new(), b"a".to_vec(), b"aaaa".to_vec(), sample(), mixed(), runs, vec![0; 2_000_000]] {
+            let stream = compress(&data);
+            assert_eq!(decompress(&stream, data.len()).unwrap(), data, "{} bytes", data.len());
+        }
+    }
+
+    #[test]
+    fn blocks_span_the_block_limit() {
+        // noise does not shrink under run-length encoding, so this is two blocks
+        let data = noise(BLOCK_MAX + 1000);
+        let stream = compress(&data);
+        assert_eq!(decompress(&stream, data.len()).unwrap(), data);
+    }
+
+    #[test]
+    fn compresses_text() {
+        let data = sample();
+        let stream = compress(&data);
+        assert!(stream.len() < data.len() / 20, "{} bytes from {}", stream.len(), data.len());
+    }
+
+    #[test]
+    fn reference_tool_reads_our_streams() {
+        let runs = vec![b'x'; 100_000];
+        for data in [sample(), mixed(), runs, Vec::new()] {
+            let Some(got) = run_tool("bzip2", &["-dc"], &compress(&data)) else {
+                eprintln!("bzip2 is not installed, skipping");
+                return;
+            };
+            assert_eq!(got, data, "{} bytes", data.len());
+        }
+    }
+
+    #[test]
+    fn truncated_and_corrupt_streams() {
+        let data = sample();
+        let stream = compress(&data);
+        for cut in [0, 3, 4, 10, stream.len() / 2, stream.len() - 1] {
+            assert!(decompress(&stream[..cut], data.len()).is_err(), "cut at {}", cut);
+        }
+        let mut bad = stream.clone();
+        bad[0] = b'C';
+        assert!(matches!(decompress(&bad, data.len()), Err(XDeltaError::Corrupt(_))));
+        let mut bad = stream.clone();
+        bad[3] = b'0';
+        assert!(matches!(decompress(&bad, data.len()), Err(XDeltaError::Corrupt(_))));
+        // the block CRC starts after the 4-byte header and the 48-bit block magic
+        let mut bad = stream.clone();
+        bad[10] ^= 0x01;
+        assert!(matches!(decompress(&bad, data.len()), Err(XDeltaError::Corrupt(_))));
+        for at in [40, stream.len() / 2] {
+            let mut bad = stream.clone();
+            bad[at] ^= 0x08;
+            assert!(decompress(&bad, data.len()).is_err(), "flipped byte {}", at);
+        }
+        // reading past the end of the stream
+        assert!(matches!(decompress(&stream, data.len() + 1), Err(XDeltaError::Corrupt(_))));
+    }
+
+    #[test]
+    fn unread_output_is_ignored() {
+        let data = sample();
+        assert_eq!(decompress(&compress(&data), 100).unwrap(), &data[..100]);
+    }
+
+    #[test]
+    fn crc_matches_the_specification() {
+        // CRC-32/BZIP2 check value
+        assert_eq!(crc32(b"123456789"), 0xfc891918);
+    }
+}
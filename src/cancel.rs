@@ -0,0 +1,71 @@
+// src/cancel.rs
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::Arc;
+
+use crate::alloc::{free_handle, into_handle};
+use crate::XDeltaError;
+
+/// 协作式取消标记：Go 侧在 context 结束时置位，编码/解码在窗口之间检查
+/// 克隆出的副本共享同一个标记，可以交给长期存在的解码器持有；
+/// 同时累计已处理的输入字节数，供 Go 侧轮询进度
+#[derive(Clone)]
+pub struct CancelToken(Arc<Shared>);
+
+struct Shared {
+    cancelled: AtomicBool,
+    progress: AtomicU64,
+}
+
+impl CancelToken {
+    pub(crate) fn is_cancelled(&self) -> bool {
+        self.0.cancelled.load(Ordering::Relaxed)
+    }
+}
+
+/// Returns `Canceled` once the (optional) token has been triggered.
+pub(crate) fn check(cancel: Option<&CancelToken>) -> Result<(), XDeltaError> {
+    match cancel {
+        Some(c) if c.is_cancelled() => Err(XDeltaError::Canceled),
+        _ => Ok(()),
+    }
+}
+
+/// Count `n` more input bytes as processed on the (optional) token.
+pub(crate) fn advance(cancel: Option<&CancelToken>, n: usize) {
+    if let Some(c) = cancel {
+        c.0.progress.fetch_add(n as u64, Ordering::Relaxed);
+    }
+}
+
+/// 创建取消标记
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_cancel_new() -> *mut CancelToken {
+    into_handle(CancelToken(Arc::new(Shared {
+        cancelled: AtomicBool::new(false),
+        progress: AtomicU64::new(0),
+    })))
+}
+
+/// 置位取消标记，可以在任意线程调用
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_cancel_trigger(c: *const CancelToken) {
+    if let Some(c) = unsafe { c.as_ref() } {
+        c.0.cancelled.store(true, Ordering::Relaxed);
+    }
+}
+
+/// 返回使用该标记的操作已经处理的输入字节数（创建补丁时为旧数据加新数据，应用时为补丁），
+/// 在窗口之间更新，可以在任意线程调用；c 为 NULL 时返回 0
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_cancel_progress(c: *const CancelToken) -> u64 {
+    match unsafe { c.as_ref() } {
+        Some(c) => c.0.progress.load(Ordering::Relaxed),
+        None => 0,
+    }
+}
+
+/// 释放取消标记，调用前必须确保没有正在使用它的操作
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_cancel_free(c: *mut CancelToken) {
+    unsafe { free_handle(c) }
+}
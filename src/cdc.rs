@@ -0,0 +1,388 @@
+// src/cdc.rs
+//! Content-defined chunking (FastCDC) for data with insertions and deletions.
+//! Chunk boundaries depend only on the bytes just before them, so an edit
+//! moves the boundaries of the chunks around it and no others; both sides are
+//! cut the same way and every chunk of the target found in the source becomes
+//! a COPY, extended byte by byte in both directions until the data differs.
+//! Each window of the target is also encoded with fixed blocks and whichever
+//! records are shorter are kept, so the patch is never much worse than the
+//! normal one. The records are ordinary native records.
+use sha2::{Digest, Sha256};
+use std::collections::hash_map::Entry;
+use std::collections::HashMap;
+use std::io::Write;
+use std::sync::Arc;
+
+use crate::cancel::{self, CancelToken};
+use crate::checksum::Xxh3;
+use crate::encoder::{drain, piece_records, push_add, Encoder, Encoding, Signatures, CANCEL_WINDOW};
+use crate::logging::{log_at, DEBUG};
+use crate::XDeltaError;
+
+/// Range of log2 of the average chunk length (64 bytes to 1 MiB).
+pub(crate) const MIN_AVG_SHIFT: i32 = 6;
+pub(crate) const MAX_AVG_SHIFT: i32 = 20;
+
+/// Longest COPY record, the length field is a u32.
+const MAX_COPY: usize = u32::MAX as usize;
+
+/// Random values the gear hash adds per byte, generated with splitmix64 so
+/// the boundaries are the same on every build.
+const GEAR: [u64; 256] = {
+    let mut table = [0u64; 256];
+    let mut state: u64 = 0x9e37_79b9_7f4a_7c15;
+    let mut i = 0;
+    while i < 256 {
+        state = state.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = state;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        table[i] = z ^ (z >> 31);
+        i += 1;
+    }
+    table
+};
+
+/// Cuts data into chunks of `min..=max` bytes averaging about `avg`. Every
+/// position after `min` is a boundary with the same probability; FastCDC's
+/// normalized chunking would narrow the spread of lengths, but it makes the
+/// boundaries depend on the distance from the chunk start, and after an edit
+/// the two sides then take several chunks longer to fall into step again.
+struct Chunker {
+    min: usize,
+    max: usize,
+    mask: u64,
+}
+
+impl Chunker {
+    fn new(avg: usize) -> Self {
+        let min = avg / 4;
+        // the high bits of the gear hash depend on the most bytes
+        Chunker {
+            min,
+            max: avg * 8,
+            mask: !0u64 << (64 - (avg - min).ilog2()),
+        }
+    }
+
+    /// Length of the chunk at `data[pos..]`. The hash is started up to 64
+    /// bytes before the first possible boundary, even before `pos`, so once
+    /// it covers its 64 bytes whether a position is a boundary depends only
+    /// on the bytes before it and not on where the chunk started.
+    fn cut(&self, data: &[u8], pos: usize) -> usize {
+        let rest = data.len() - pos;
+        if rest <= self.min {
+            return rest;
+        }
+        let end = pos + rest.min(self.max);
+        let first = pos + self.min;
+        let mut hash = 0u64;
+        for &b in &data[first.saturating_sub(64)..first] {
+            hash = (hash << 1).wrapping_add(GEAR[b as usize]);
+        }
+        for (i, &b) in data.iter().enumerate().take(end).skip(first) {
+            hash = (hash << 1).wrapping_add(GEAR[b as usize]);
+            if hash & self.mask == 0 {
+                return i + 1 - pos;
+            }
+        }
+        end - pos
+    }
+}
+
+fn fingerprint(chunk: &[u8]) -> u64 {
+    let mut h = Xxh3::new();
+    h.update(chunk);
+    h.digest()
+}
+
+/// Where the chunks of the source start, by length and fingerprint; only the
+/// first of identical chunks is kept, and matches are confirmed byte by byte.
+struct ChunkIndex<'a> {
+    old: &'a [u8],
+    chunker: Chunker,
+    map: HashMap<(u32, u64), u64>,
+}
+
+impl<'a> ChunkIndex<'a> {
+    fn new(old: &'a [u8], avg: usize, cancel: Option<&CancelToken>) -> Result<Self, XDeltaError> {
+        let chunker = Chunker::new(avg);
+        let mut map = HashMap::with_capacity(old.len() / avg);
+        let mut pos = 0;
+        let mut checked = 0;
+        while pos < old.len() {
+            if pos >= checked {
+                cancel::check(cancel)?;
+                checked = pos + CANCEL_WINDOW;
+            }
+            let n = chunker.cut(old, pos);
+            if let Entry::Vacant(e) = map.entry((n as u32, fingerprint(&old[pos..pos + n]))) {
+                e.insert(pos as u64);
+            }
+            pos += n;
+        }
+        log_at!(DEBUG, "cdc: {} chunks of {} bytes on average in {} bytes of old data", map.len(), avg, old.len());
+        Ok(ChunkIndex { old, chunker, map })
+    }
+
+    fn lookup(&self, chunk: &[u8]) -> Option<usize> {
+        let off = *self.map.get(&(chunk.len() as u32, fingerprint(chunk)))? as usize;
+        (self.old[off..off + chunk.len()] == *chunk).then_some(off)
+    }
+
+    /// Native records of `new[start..]` up to the first record boundary at or
+    /// after `limit`; returns them and where they end. Extending a COPY
+    /// forward stops at `limit`, so the windows do not depend on what follows.
+    fn window(&self, new: &[u8], start: usize, limit: usize) -> (Vec<u8>, usize) {
+        let mut records = Vec::new();
+        let mut add_from = start;
+        let mut pos = start;
+        while pos < limit {
+            let n = self.chunker.cut(new, pos);
+            let Some(mut off) = self.lookup(&new[pos..pos + n]) else {
+                pos += n;
+                continue;
+            };
+            let mut from = pos;
+            while from > add_from && off > 0 && self.old[off - 1] == new[from - 1] {
+                from -= 1;
+                off -= 1;
+            }
+            let mut end = pos + n;
+            let stop = limit.max(end);
+            while end < stop && off + (end - from) < self.old.len() && self.old[off + (end - from)] == new[end] {
+                end += 1;
+            }
+            if from > add_from {
+                push_add(&mut records, &new[add_from..from]);
+            }
+            let mut copy_off = off;
+            for piece in new[from..end].chunks(MAX_COPY) {
+                records.push(0x01); // COPY
+                records.extend_from_slice(&(copy_off as u64).to_le_bytes());
+                records.extend_from_slice(&(piece.len() as u32).to_le_bytes());
+                copy_off += piece.len();
+            }
+            pos = end;
+            add_from = end;
+        }
+        if pos > add_from {
+            push_add(&mut records, &new[add_from..pos]);
+        }
+        (records, pos)
+    }
+}
+
+/// Encode `new` against `old` with content-defined chunks of `encoding.cdc`
+/// bytes on average, window by window falling back to the fixed-block records
+/// against `sigs` where they are shorter, and write the patch to `out`.
+/// Always sequential.
+pub(crate) fn encode<W: Write>(
+    old: &[u8],
+    sigs: &Arc<Signatures>,
+    new: &[u8],
+    encoding: Encoding,
+    cancel: Option<&CancelToken>,
+    out: &mut W,
+) -> Result<(), XDeltaError> {
+    let index = ChunkIndex::new(old, encoding.cdc, cancel)?;
+    let mut enc = Encoder::new(Arc::clone(sigs), encoding)?;
+    let mut start = 0;
+    while start < new.len() {
+        cancel::check(cancel)?;
+        let (chunked, end) = index.window(new, start, new.len().min(start + CANCEL_WINDOW));
+        let piece = &new[start..end];
+        let fixed = piece_records(sigs, piece, encoding.matching, 0, cancel)?;
+        log_at!(
+            DEBUG,
+            "cdc: window of {} bytes, {} bytes of records with chunks, {} with fixed blocks",
+            piece.len(),
+            chunked.len(),
+            fixed.len()
+        );
+        enc.write_records(if fixed.len() < chunked.len() { &fixed } else { &chunked }, piece)?;
+        drain(&mut enc, out)?;
+        cancel::advance(cancel, piece.len());
+        start = end;
+    }
+    enc.finish()?;
+    drain(&mut enc, out)
+}
+
+/// Magic of serialized chunk signatures, shaped like `SIGNATURE_MAGIC` of the
+/// fixed-block signatures so neither is mistaken for the other.
+const CHUNK_SIGNATURE_MAGIC: [u8; 8] = [0x89, b'X', b'D', b'C', b'D', b'C', 0x0D, 0x0A];
+
+/// Revision of the serialized chunk signature layout.
+const CHUNK_SIGNATURE_VERSION: u8 = 1;
+
+/// magic, version, average chunk length (u32) and chunk count (u64)
+const CHUNK_SIGNATURE_HEADER: usize = 8 + 1 + 4 + 8;
+
+/// length (u32) and SHA-256 of one chunk
+const CHUNK_SIGNATURE_ENTRY: usize = 4 + 32;
+
+fn check_avg(avg: usize) -> Result<(), XDeltaError> {
+    let (lo, hi) = (1usize << MIN_AVG_SHIFT, 1usize << MAX_AVG_SHIFT);
+    if !avg.is_power_of_two() || avg < lo || avg > hi {
+        return Err(XDeltaError::InvalidArg(format!(
+            "average chunk length {} is not a power of two in [{}, {}]",
+            avg, lo, hi
+        )));
+    }
+    Ok(())
+}
+
+fn chunk_hash(chunk: &[u8]) -> [u8; 32] {
+    Sha256::digest(chunk).into()
+}
+
+/// Content-defined chunk signature of `old` for a peer that holds only the
+/// new data (little endian): CHUNK_SIGNATURE_MAGIC, CHUNK_SIGNATURE_VERSION,
+/// the average chunk length as u32 and the chunk count as u64, then for every
+/// chunk in order its length as u32 and its SHA-256. Unlike the fixed-block
+/// signatures there is no weak sum: the other side cuts its data the same
+/// way and only looks whole chunks up, so nothing has to roll.
+pub(crate) fn chunk_signature(old: &[u8], avg: usize, cancel: Option<&CancelToken>) -> Result<Vec<u8>, XDeltaError> {
+    check_avg(avg)?;
+    let chunker = Chunker::new(avg);
+    let mut body = Vec::with_capacity(old.len() / avg * CHUNK_SIGNATURE_ENTRY);
+    let mut chunks: u64 = 0;
+    let mut pos = 0;
+    let mut checked = 0;
+    while pos < old.len() {
+        if pos >= checked {
+            cancel::check(cancel)?;
+            checked = pos + CANCEL_WINDOW;
+        }
+        let n = chunker.cut(old, pos);
+        body.extend_from_slice(&(n as u32).to_le_bytes());
+        body.extend_from_slice(&chunk_hash(&old[pos..pos + n]));
+        chunks += 1;
+        pos += n;
+    }
+    log_at!(DEBUG, "cdc: signature of {} chunks of {} bytes on average over {} bytes", chunks, avg, old.len());
+    let mut out = Vec::with_capacity(CHUNK_SIGNATURE_HEADER + body.len());
+    out.extend_from_slice(&CHUNK_SIGNATURE_MAGIC);
+    out.push(CHUNK_SIGNATURE_VERSION);
+    out.extend_from_slice(&(avg as u32).to_le_bytes());
+    out.extend_from_slice(&chunks.to_le_bytes());
+    out.extend_from_slice(&body);
+    Ok(out)
+}
+
+/// Where the chunks of a chunk signature start in the old data, by length
+/// and SHA-256; only the first of identical chunks is kept.
+struct ChunkSignature {
+    chunker: Chunker,
+    map: HashMap<(u32, [u8; 32]), u64>,
+}
+
+impl ChunkSignature {
+    fn from_bytes(data: &[u8]) -> Result<Self, XDeltaError> {
+        if data.len() < CHUNK_SIGNATURE_MAGIC.len() + 1 || data[..CHUNK_SIGNATURE_MAGIC.len()] != CHUNK_SIGNATURE_MAGIC {
+            return Err(XDeltaError::Corrupt("missing chunk signature magic".into()));
+        }
+        let version = data[CHUNK_SIGNATURE_MAGIC.len()];
+        if version != CHUNK_SIGNATURE_VERSION {
+            return Err(XDeltaError::Unsupported(format!("chunk signature version {}", version)));
+        }
+        if data.len() < CHUNK_SIGNATURE_HEADER {
+            return Err(XDeltaError::Corrupt("truncated chunk signature header".into()));
+        }
+        let avg = u32::from_le_bytes(data[9..13].try_into().unwrap()) as usize;
+        let chunks = u64::from_le_bytes(data[13..21].try_into().unwrap());
+        check_avg(avg).map_err(|_| XDeltaError::Corrupt(format!("average chunk length {} in chunk signature", avg)))?;
+        let body = &data[CHUNK_SIGNATURE_HEADER..];
+        if chunks.checked_mul(CHUNK_SIGNATURE_ENTRY as u64) != Some(body.len() as u64) {
+            return Err(XDeltaError::Corrupt(format!(
+                "chunk signature of {} chunks has {} bytes of chunk sums",
+                chunks,
+                body.len()
+            )));
+        }
+        let chunker = Chunker::new(avg);
+        let mut map = HashMap::with_capacity(chunks as usize);
+        let mut offset: u64 = 0;
+        for entry in body.chunks_exact(CHUNK_SIGNATURE_ENTRY) {
+            let n = u32::from_le_bytes(entry[..4].try_into().unwrap());
+            if n == 0 || n as usize > chunker.max {
+                return Err(XDeltaError::Corrupt(format!("chunk of {} bytes in chunk signature", n)));
+            }
+            map.entry((n, entry[4..].try_into().unwrap())).or_insert(offset);
+            offset += n as u64;
+        }
+        Ok(ChunkSignature { chunker, map })
+    }
+
+    /// Native records of `new[start..]` up to the first chunk boundary at or
+    /// after `limit`; returns them and where they end. Contiguous matching
+    /// chunks become one COPY.
+    fn window(&self, new: &[u8], start: usize, limit: usize) -> (Vec<u8>, usize) {
+        let mut records = Vec::new();
+        let mut add_from = start;
+        let mut copy: Option<(u64, usize)> = None;
+        let mut pos = start;
+        let flush_copy = |records: &mut Vec<u8>, copy: &mut Option<(u64, usize)>| {
+            if let Some((off, len)) = copy.take() {
+                records.push(0x01); // COPY
+                records.extend_from_slice(&off.to_le_bytes());
+                records.extend_from_slice(&(len as u32).to_le_bytes());
+            }
+        };
+        while pos < limit {
+            let n = self.chunker.cut(new, pos);
+            let chunk = &new[pos..pos + n];
+            if let Some(&off) = self.map.get(&(n as u32, chunk_hash(chunk))) {
+                if pos > add_from {
+                    push_add(&mut records, &new[add_from..pos]);
+                }
+                match &mut copy {
+                    Some((start, len)) if *start + *len as u64 == off && *len + n <= MAX_COPY => *len += n,
+                    _ => {
+                        flush_copy(&mut records, &mut copy);
+                        copy = Some((off, n));
+                    }
+                }
+                add_from = pos + n;
+            } else {
+                flush_copy(&mut records, &mut copy);
+            }
+            pos += n;
+        }
+        flush_copy(&mut records, &mut copy);
+        if pos > add_from {
+            push_add(&mut records, &new[add_from..pos]);
+        }
+        (records, pos)
+    }
+}
+
+/// Encode `new` against the old data described by the chunk signature `sig`
+/// and write the patch to `out`: `new` is cut into chunks the same way, and
+/// every chunk with the length and SHA-256 of one in the signature is copied
+/// from there. Always sequential; the fixed-block fallback of `encode` needs
+/// the old data and does not apply.
+pub(crate) fn encode_from_signature<W: Write>(
+    sig: &[u8],
+    new: &[u8],
+    encoding: Encoding,
+    cancel: Option<&CancelToken>,
+    out: &mut W,
+) -> Result<(), XDeltaError> {
+    let index = ChunkSignature::from_bytes(sig)?;
+    // the records are decided here, the encoder only needs signatures to exist
+    let mut enc = Encoder::new(Arc::new(Signatures::new(1)?), encoding)?;
+    let mut start = 0;
+    while start < new.len() {
+        cancel::check(cancel)?;
+        let (records, end) = index.window(new, start, new.len().min(start + CANCEL_WINDOW));
+        log_at!(DEBUG, "cdc: window of {} bytes, {} bytes of records from the chunk signature", end - start, records.len());
+        enc.write_records(&records, &new[start..end])?;
+        drain(&mut enc, out)?;
+        cancel::advance(cancel, end - start);
+        start = end;
+    }
+    enc.finish()?;
+    drain(&mut enc, out)
+}
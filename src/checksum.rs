@@ -0,0 +1,431 @@
+// src/checksum.rs
+//! Integrity checksums over the reconstructed target.
+//!
+//! Native patches carry them as CHECKSUM records: `[0x02][kind u8][sum]`,
+//! the sum (4 bytes for adler32, 8 for XXH3-64, little-endian) covering the
+//! target bytes produced since the previous CHECKSUM record. The encoder
+//! starts the patch with one over no bytes at all, which announces the kind
+//! before any output, and closes a window every `CHECKSUM_WINDOW` bytes of
+//! target at a record boundary and at the end. VCDIFF output uses xdelta3's
+//! adler32 per window instead.
+
+/// Target bytes covered by one CHECKSUM record of a native patch (at least;
+/// windows end at record boundaries).
+pub(crate) const CHECKSUM_WINDOW: u64 = 1 << 20;
+
+/// Opcode of the CHECKSUM record.
+pub(crate) const CHECKSUM_RECORD: u8 = 0x02;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub(crate) enum Checksum {
+    Adler32,
+    Xxh3,
+}
+
+impl Checksum {
+    pub(crate) fn id(self) -> u8 {
+        match self {
+            Checksum::Adler32 => 1,
+            Checksum::Xxh3 => 2,
+        }
+    }
+
+    pub(crate) fn from_id(id: u8) -> Option<Checksum> {
+        match id {
+            1 => Some(Checksum::Adler32),
+            2 => Some(Checksum::Xxh3),
+            _ => None,
+        }
+    }
+
+    /// Length of the sum in a CHECKSUM record.
+    pub(crate) fn len(self) -> usize {
+        match self {
+            Checksum::Adler32 => 4,
+            Checksum::Xxh3 => 8,
+        }
+    }
+
+    pub(crate) fn name(self) -> &'static str {
+        match self {
+            Checksum::Adler32 => "adler32",
+            Checksum::Xxh3 => "xxh3",
+        }
+    }
+}
+
+/// Append a CHECKSUM record.
+pub(crate) fn push_record(out: &mut Vec<u8>, kind: Checksum, sum: u64) {
+    out.push(CHECKSUM_RECORD);
+    out.push(kind.id());
+    out.extend_from_slice(&sum.to_le_bytes()[..kind.len()]);
+}
+
+/// Incremental adler32 (RFC 1950).
+#[derive(Clone, Copy)]
+pub(crate) struct Adler32 {
+    a: u32,
+    b: u32,
+}
+
+impl Adler32 {
+    const MOD: u32 = 65521;
+    /// longest run for which the sums cannot overflow before the reduction
+    const NMAX: usize = 5552;
+
+    pub(crate) fn new() -> Self {
+        Adler32 { a: 1, b: 0 }
+    }
+
+    pub(crate) fn update(&mut self, data: &[u8]) {
+        for chunk in data.chunks(Self::NMAX) {
+            for &x in chunk {
+                self.a += x as u32;
+                self.b += self.a;
+            }
+            self.a %= Self::MOD;
+            self.b %= Self::MOD;
+        }
+    }
+
+    pub(crate) fn value(&self) -> u32 {
+        (self.b << 16) | self.a
+    }
+}
+
+pub(crate) fn adler32(data: &[u8]) -> u32 {
+    let mut a = Adler32::new();
+    a.update(data);
+    a.value()
+}
+
+const P32_1: u64 = 0x9E37_79B1;
+const P32_2: u64 = 0x85EB_CA77;
+const P32_3: u64 = 0xC2B2_AE3D;
+const P64_1: u64 = 0x9E37_79B1_85EB_CA87;
+const P64_2: u64 = 0xC2B2_AE3D_27D4_EB4F;
+const P64_3: u64 = 0x1656_67B1_9E37_79F9;
+const P64_4: u64 = 0x85EB_CA77_C2B2_AE63;
+const P64_5: u64 = 0x27D4_EB2F_1656_67C5;
+const PRIME_MX1: u64 = 0x1656_6791_9E37_79F9;
+const PRIME_MX2: u64 = 0x9FB2_1C65_1E98_DF25;
+
+/// The default XXH3 secret (kSecret of the reference implementation).
+const SECRET: [u8; 192] = [
+    0xb8, 0xfe, 0x6c, 0x39, 0x23, 0xa4, 0x4b, 0xbe, 0x7c, 0x01, 0x81, 0x2c, 0xf7, 0x21, 0xad, 0x1c, 0xde, 0xd4, 0x6d,
+    0xe9, 0x83, 0x90, 0x97, 0xdb, 0x72, 0x40, 0xa4, 0xa4, 0xb7, 0xb3, 0x67, 0x1f, 0xcb, 0x79, 0xe6, 0x4e, 0xcc, 0xc0,
+    0xe5, 0x78, 0x82, 0x5a, 0xd0, 0x7d, 0xcc, 0xff, 0x72, 0x21, 0xb8, 0x08, 0x46, 0x74, 0xf7, 0x43, 0x24, 0x8e, 0xe0,
+    0x35, 0x90, 0xe6, 0x81, 0x3a, 0x26, 0x4c, 0x3c, 0x28, 0x52, 0xbb, 0x91, 0xc3, 0x00, 0xcb, 0x88, 0xd0, 0x65, 0x8b,
+    0x1b, 0x53, 0x2e, 0xa3, 0x71, 0x64, 0x48, 0x97, 0xa2, 0x0d, 0xf9, 0x4e, 0x38, 0x19, 0xef, 0x46, 0xa9, 0xde, 0xac,
+    0xd8, 0xa8, 0xfa, 0x76, 0x3f, 0xe3, 0x9c, 0x34, 0x3f, 0xf9, 0xdc, 0xbb, 0xc7, 0xc7, 0x0b, 0x4f, 0x1d, 0x8a, 0x51,
+    0xe0, 0x4b, 0xcd, 0xb4, 0x59, 0x31, 0xc8, 0x9f, 0x7e, 0xc9, 0xd9, 0x78, 0x73, 0x64, 0xea, 0xc5, 0xac, 0x83, 0x34,
+    0xd3, 0xeb, 0xc3, 0xc5, 0x81, 0xa0, 0xff, 0xfa, 0x13, 0x63, 0xeb, 0x17, 0x0d, 0xdd, 0x51, 0xb7, 0xf0, 0xda, 0x49,
+    0xd3, 0x16, 0x55, 0x26, 0x29, 0xd4, 0x68, 0x9e, 0x2b, 0x16, 0xbe, 0x58, 0x7d, 0x47, 0xa1, 0xfc, 0x8f, 0xf8, 0xb8,
+    0xd1, 0x7a, 0xd0, 0x31, 0xce, 0x45, 0xcb, 0x3a, 0x8f, 0x95, 0x16, 0x04, 0x28, 0xaf, 0xd7, 0xfb, 0xca, 0xbb, 0x4b,
+    0x40, 0x7e,
+];
+
+const STRIPE_LEN: usize = 64;
+const SECRET_CONSUME_RATE: usize = 8;
+const STRIPES_PER_BLOCK: usize = (SECRET.len() - STRIPE_LEN) / SECRET_CONSUME_RATE;
+const BLOCK_LEN: usize = STRIPE_LEN * STRIPES_PER_BLOCK;
+/// inputs up to this length are hashed in one go by the short-input paths
+const MIDSIZE_MAX: usize = 240;
+
+fn read32(b: &[u8], at: usize) -> u64 {
+    u32::from_le_bytes(b[at..at + 4].try_into().unwrap()) as u64
+}
+
+fn read64(b: &[u8], at: usize) -> u64 {
+    u64::from_le_bytes(b[at..at + 8].try_into().unwrap())
+}
+
+fn mul128_fold64(a: u64, b: u64) -> u64 {
+    let p = a as u128 * b as u128;
+    p as u64 ^ (p >> 64) as u64
+}
+
+fn xxh64_avalanche(mut h: u64) -> u64 {
+    h ^= h >> 33;
+    h = h.wrapping_mul(P64_2);
+    h ^= h >> 29;
+    h = h.wrapping_mul(P64_3);
+    h ^ (h >> 32)
+}
+
+fn avalanche(mut h: u64) -> u64 {
+    h ^= h >> 37;
+    h = h.wrapping_mul(PRIME_MX1);
+    h ^ (h >> 32)
+}
+
+fn rrmxmx(mut h: u64, len: u64) -> u64 {
+    h ^= h.rotate_left(49) ^ h.rotate_left(24);
+    h = h.wrapping_mul(PRIME_MX2);
+    h ^= (h >> 35).wrapping_add(len);
+    h = h.wrapping_mul(PRIME_MX2);
+    h ^ (h >> 28)
+}
+
+fn mix16(data: &[u8], at: usize, secret: usize) -> u64 {
+    mul128_fold64(
+        read64(data, at) ^ read64(&SECRET, secret),
+        read64(data, at + 8) ^ read64(&SECRET, secret + 8),
+    )
+}
+
+/// XXH3-64 with seed 0 of inputs up to `MIDSIZE_MAX` bytes.
+fn xxh3_short(data: &[u8]) -> u64 {
+    let len = data.len();
+    let len64 = len as u64;
+    match len {
+        0 => xxh64_avalanche(read64(&SECRET, 56) ^ read64(&SECRET, 64)),
+        1..=3 => {
+            let combined = (data[0] as u64) << 16 | (data[len >> 1] as u64) << 24 | data[len - 1] as u64 | len64 << 8;
+            xxh64_avalanche(combined ^ (read32(&SECRET, 0) ^ read32(&SECRET, 4)))
+        }
+        4..=8 => {
+            let input = read32(data, len - 4).wrapping_add(read32(data, 0) << 32);
+            rrmxmx(input ^ (read64(&SECRET, 8) ^ read64(&SECRET, 16)), len64)
+        }
+        9..=16 => {
+            let lo = read64(data, 0) ^ (read64(&SECRET, 24) ^ read64(&SECRET, 32));
+            let hi = read64(data, len - 8) ^ (read64(&SECRET, 40) ^ read64(&SECRET, 48));
+            let acc = len64.wrapping_add(lo.swap_bytes()).wrapping_add(hi).wrapping_add(mul128_fold64(lo, hi));
+            avalanche(acc)
+        }
+        17..=128 => {
+            let mut acc = len64.wrapping_mul(P64_1);
+            let pairs = (len - 1) / 32;
+            for i in (0..=pairs).rev() {
+                acc = acc.wrapping_add(mix16(data, 16 * i, 32 * i));
+                acc = acc.wrapping_add(mix16(data, len - 16 * (i + 1), 32 * i + 16));
+            }
+            avalanche(acc)
+        }
+        _ => {
+            let mut acc = len64.wrapping_mul(P64_1);
+            for i in 0..8 {
+                acc = acc.wrapping_add(mix16(data, 16 * i, 16 * i));
+            }
+            acc = avalanche(acc);
+            for i in 8..len / 16 {
+                acc = acc.wrapping_add(mix16(data, 16 * i, 16 * (i - 8) + 3));
+            }
+            acc = acc.wrapping_add(mix16(data, len - 16, 136 - 17));
+            avalanche(acc)
+        }
+    }
+}
+
+fn accumulate_stripe(acc: &mut [u64; 8], stripe: &[u8], secret: usize) {
+    for i in 0..8 {
+        let value = read64(stripe, 8 * i);
+        let key = value ^ read64(&SECRET, secret + 8 * i);
+        acc[i ^ 1] = acc[i ^ 1].wrapping_add(value);
+        acc[i] = acc[i].wrapping_add((key & 0xffff_ffff).wrapping_mul(key >> 32));
+    }
+}
+
+fn scramble(acc: &mut [u64; 8]) {
+    for (i, a) in acc.iter_mut().enumerate() {
+        let mut v = *a;
+        v ^= v >> 47;
+        v ^= read64(&SECRET, SECRET.len() - STRIPE_LEN + 8 * i);
+        *a = v.wrapping_mul(P32_1);
+    }
+}
+
+/// Streaming XXH3-64 with seed 0; the digest equals `XXH3_64bits` of
+/// everything passed to `update`.
+#[derive(Clone)]
+pub(crate) struct Xxh3 {
+    acc: [u64; 8],
+    /// input not yet accumulated, at most one block; a full block is only
+    /// consumed once more input follows, since the last one is hashed differently
+    buf: Box<[u8; BLOCK_LEN]>,
+    buffered: usize,
+    /// the last stripe of the most recently consumed block
+    last_stripe: [u8; STRIPE_LEN],
+    total: u64,
+}
+
+impl Xxh3 {
+    const INIT: [u64; 8] = [P32_3, P64_1, P64_2, P64_3, P64_4, P32_2, P64_5, P32_1];
+
+    pub(crate) fn new() -> Self {
+        Xxh3 {
+            acc: Self::INIT,
+            buf: Box::new([0u8; BLOCK_LEN]),
+            buffered: 0,
+            last_stripe: [0u8; STRIPE_LEN],
+            total: 0,
+        }
+    }
+
+    pub(crate) fn reset(&mut self) {
+        self.acc = Self::INIT;
+        self.buffered = 0;
+        self.total = 0;
+    }
+
+    fn consume_block(acc: &mut [u64; 8], block: &[u8]) {
+        for (n, stripe) in block.chunks_exact(STRIPE_LEN).enumerate() {
+            accumulate_stripe(acc, stripe, n * SECRET_CONSUME_RATE);
+        }
+        scramble(acc);
+    }
+
+    pub(crate) fn update(&mut self, mut data: &[u8]) {
+        self.total += data.len() as u64;
+        if self.buffered < BLOCK_LEN {
+            let n = data.len().min(BLOCK_LEN - self.buffered);
+            self.buf[self.buffered..self.buffered + n].copy_from_slice(&data[..n]);
+            self.buffered += n;
+            data = &data[n..];
+        }
+        if data.is_empty() {
+            return;
+        }
+        // the buffer is full and more input follows
+        Self::consume_block(&mut self.acc, &self.buf[..]);
+        let mut tail = &self.buf[BLOCK_LEN - STRIPE_LEN..];
+        // whole blocks straight from the input, keeping the last one back
+        while data.len() > BLOCK_LEN {
+            Self::consume_block(&mut self.acc, &data[..BLOCK_LEN]);
+            tail = &data[BLOCK_LEN - STRIPE_LEN..BLOCK_LEN];
+            data = &data[BLOCK_LEN..];
+        }
+        self.last_stripe.copy_from_slice(tail);
+        self.buf[..data.len()].copy_from_slice(data);
+        self.buffered = data.len();
+    }
+
+    pub(crate) fn digest(&self) -> u64 {
+        if self.total <= MIDSIZE_MAX as u64 {
+            return xxh3_short(&self.buf[..self.buffered]);
+        }
+        let mut acc = self.acc;
+        let rest = &self.buf[..self.buffered];
+        let stripes = (rest.len() - 1) / STRIPE_LEN;
+        for n in 0..stripes {
+            accumulate_stripe(&mut acc, &rest[n * STRIPE_LEN..], n * SECRET_CONSUME_RATE);
+        }
+        let mut last = [0u8; STRIPE_LEN];
+        if rest.len() >= STRIPE_LEN {
+            last.copy_from_slice(&rest[rest.len() - STRIPE_LEN..]);
+        } else {
+            // the last stripe reaches back into the previous block
+            let from_prev = STRIPE_LEN - rest.len();
+            last[..from_prev].copy_from_slice(&self.last_stripe[rest.len()..]);
+            last[from_prev..].copy_from_slice(rest);
+        }
+        accumulate_stripe(&mut acc, &last, SECRET.len() - STRIPE_LEN - 7);
+        let mut h = self.total.wrapping_mul(P64_1);
+        for (i, pair) in acc.chunks_exact(2).enumerate() {
+            let secret = 11 + 16 * i;
+            h = h.wrapping_add(mul128_fold64(pair[0] ^ read64(&SECRET, secret), pair[1] ^ read64(&SECRET, secret + 8)));
+        }
+        avalanche(h)
+    }
+}
+
+/// A running checksum of either kind.
+pub(crate) enum Running {
+    Adler32(Adler32),
+    Xxh3(Xxh3),
+}
+
+impl Running {
+    pub(crate) fn new(kind: Checksum) -> Self {
+        match kind {
+            Checksum::Adler32 => Running::Adler32(Adler32::new()),
+            Checksum::Xxh3 => Running::Xxh3(Xxh3::new()),
+        }
+    }
+
+    pub(crate) fn kind(&self) -> Checksum {
+        match self {
+            Running::Adler32(_) => Checksum::Adler32,
+            Running::Xxh3(_) => Checksum::Xxh3,
+        }
+    }
+
+    pub(crate) fn update(&mut self, data: &[u8]) {
+        match self {
+            Running::Adler32(a) => a.update(data),
+            Running::Xxh3(x) => x.update(data),
+        }
+    }
+
+    /// The sum of everything since the last call, starting over.
+    pub(crate) fn take(&mut self) -> u64 {
+        match self {
+            Running::Adler32(a) => std::mem::replace(a, Adler32::new()).value() as u64,
+            Running::Xxh3(x) => {
+                let sum = x.digest();
+                x.reset();
+                sum
+            }
+        }
+    }
+}
+
+/// Inserts CHECKSUM records into a native record stream; the encoder passes
+/// the records together with the target bytes they produce.
+pub(crate) struct RecordSums {
+    sum: Running,
+    /// target bytes covered by the open window
+    window: u64,
+    started: bool,
+}
+
+impl RecordSums {
+    pub(crate) fn new(kind: Checksum) -> Self {
+        RecordSums {
+            sum: Running::new(kind),
+            window: 0,
+            started: false,
+        }
+    }
+
+    /// Copy complete `records` to `out`, closing a window after the record
+    /// that fills it. `target` is exactly the output of `records`.
+    pub(crate) fn write(&mut self, mut records: &[u8], mut target: &[u8], out: &mut Vec<u8>) {
+        self.start(out);
+        while !records.is_empty() {
+            let (rec, len) = match records[0] {
+                0x00 => {
+                    let len = u32::from_le_bytes(records[1..5].try_into().unwrap()) as usize;
+                    (5 + len, len)
+                }
+                _ => (13, u32::from_le_bytes(records[9..13].try_into().unwrap()) as usize),
+            };
+            out.extend_from_slice(&records[..rec]);
+            self.sum.update(&target[..len]);
+            self.window += len as u64;
+            records = &records[rec..];
+            target = &target[len..];
+            if self.window >= CHECKSUM_WINDOW {
+                self.close(out);
+            }
+        }
+    }
+
+    /// Close the open window, so everything written so far is covered.
+    pub(crate) fn close(&mut self, out: &mut Vec<u8>) {
+        self.start(out);
+        if self.window > 0 {
+            push_record(out, self.sum.kind(), self.sum.take());
+            self.window = 0;
+        }
+    }
+
+    /// The leading record over no bytes, which announces the kind.
+    fn start(&mut self, out: &mut Vec<u8>) {
+        if !self.started {
+            push_record(out, self.sum.kind(), self.sum.take());
+            self.started = true;
+        }
+    }
+}
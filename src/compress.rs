@@ -0,0 +1,328 @@
+// src/compress.rs
+use std::io::Write;
+
+use flate2::{Decompress, FlushDecompress, Status};
+use zstd::stream::raw::{InBuffer, Operation, OutBuffer};
+
+use crate::djw::Djw;
+use crate::fgk::Fgk;
+use crate::huffman::{FramedDecoder, FramedEncoder};
+use crate::lz4::{Lz4Decoder, Lz4Encoder};
+use crate::lzma::{LzmaDecoder, LzmaEncoder};
+use crate::XDeltaError;
+
+/// Secondary compression of the patch stream, applied on top of the records.
+/// Values match XDELTA_SECONDARY_* in xdelta_interface.h.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub(crate) enum Secondary {
+    None = 0,
+    Zlib = 1,
+    Zstd = 2,
+    Lz4 = 3,
+    Lzma = 4,
+    Djw = 5,
+    Fgk = 6,
+}
+
+impl Secondary {
+    /// The secondary compression of a native patch that starts with `first`.
+    pub(crate) fn detect(first: u8) -> Secondary {
+        match first {
+            b if is_zlib_header(b) => Secondary::Zlib,
+            ZSTD_MAGIC => Secondary::Zstd,
+            b if b == crate::lz4::MAGIC[0] => Secondary::Lz4,
+            b if b == crate::lzma::MAGIC[0] => Secondary::Lzma,
+            b if b == crate::djw::MAGIC[0] => Secondary::Djw,
+            b if b == crate::fgk::MAGIC[0] => Secondary::Fgk,
+            _ => Secondary::None,
+        }
+    }
+
+    pub(crate) fn name(self) -> &'static str {
+        match self {
+            Secondary::None => "none",
+            Secondary::Zlib => "zlib",
+            Secondary::Zstd => "zstd",
+            Secondary::Lz4 => "lz4",
+            Secondary::Lzma => "lzma",
+            Secondary::Djw => "djw",
+            Secondary::Fgk => "fgk",
+        }
+    }
+}
+
+/// Secondary compressor and its level. The level uses xdelta3's scale from
+/// 0 (fastest) to 9 (smallest); `None` keeps the codec's own default.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Compression {
+    pub(crate) secondary: Secondary,
+    pub(crate) level: Option<u32>,
+}
+
+impl Compression {
+    pub(crate) const NONE: Compression = Compression {
+        secondary: Secondary::None,
+        level: None,
+    };
+
+    /// Parse the C arguments; `level` is -1 for the default or 0..=9.
+    pub(crate) fn from_c(secondary: i32, level: i32) -> Result<Self, XDeltaError> {
+        let secondary = match secondary {
+            0 => Secondary::None,
+            1 => Secondary::Zlib,
+            2 => Secondary::Zstd,
+            3 => Secondary::Lz4,
+            4 => Secondary::Lzma,
+            5 => Secondary::Djw,
+            6 => Secondary::Fgk,
+            other => return Err(XDeltaError::InvalidArg(format!("unknown secondary compression {}", other))),
+        };
+        let level = match level {
+            -1 => None,
+            0..=9 => Some(level as u32),
+            other => {
+                return Err(XDeltaError::InvalidArg(format!("compression level {} is out of range [0, 9]", other)));
+            }
+        };
+        Ok(Compression { secondary, level })
+    }
+}
+
+/// zstd levels for xdelta3-style levels 0..=9; zstd cannot store, so 0 is its fastest level.
+const ZSTD_LEVELS: [i32; 10] = [1, 1, 2, 3, 5, 7, 9, 12, 16, 19];
+
+/// First byte of the zstd frame magic 28 B5 2F FD.
+const ZSTD_MAGIC: u8 = 0x28;
+
+/// Whether `b` is a zlib CMF byte: deflate with a window of at most 32 KiB.
+/// flate2 writes 0x78, or 0x08 at level 0; 0x28 (a 1 KiB window) is never
+/// produced and is left to zstd.
+fn is_zlib_header(b: u8) -> bool {
+    b & 0x0f == 8 && b >> 4 <= 7 && b != ZSTD_MAGIC
+}
+
+/// Output size of one decompression step.
+const INFLATE_CHUNK: usize = 64 * 1024;
+
+fn compress_err(e: std::io::Error) -> XDeltaError {
+    XDeltaError::Io(format!("secondary compression failed: {}", e))
+}
+
+/// Compresses the record stream produced by the encoder. Uncompressed
+/// patches are passed through unchanged, so their format is the same as
+/// before secondary compression existed.
+pub(crate) enum Compressor {
+    None,
+    Zlib(flate2::write::ZlibEncoder<Vec<u8>>),
+    Zstd(zstd::stream::write::Encoder<'static, Vec<u8>>),
+    Lz4(Lz4Encoder),
+    Lzma(LzmaEncoder),
+    Djw(FramedEncoder<Djw>),
+    Fgk(FramedEncoder<Fgk>),
+}
+
+impl Compressor {
+    pub(crate) fn new(c: Compression) -> Result<Self, XDeltaError> {
+        Ok(match c.secondary {
+            Secondary::None => Compressor::None,
+            Secondary::Zlib => {
+                // zlib already uses the 0 (store) ..= 9 scale
+                let level = c.level.map_or(flate2::Compression::default(), flate2::Compression::new);
+                Compressor::Zlib(flate2::write::ZlibEncoder::new(Vec::new(), level))
+            }
+            Secondary::Zstd => {
+                let level = c.level.map_or(zstd::DEFAULT_COMPRESSION_LEVEL, |l| ZSTD_LEVELS[l as usize]);
+                Compressor::Zstd(zstd::stream::write::Encoder::new(Vec::new(), level).map_err(compress_err)?)
+            }
+            Secondary::Lz4 => Compressor::Lz4(Lz4Encoder::new(c.level)),
+            Secondary::Lzma => Compressor::Lzma(LzmaEncoder::new(c.level)),
+            Secondary::Djw => Compressor::Djw(FramedEncoder::new(c.level)),
+            Secondary::Fgk => Compressor::Fgk(FramedEncoder::new(c.level)),
+        })
+    }
+
+    /// Compress `records` and append whatever compressed bytes are ready to `out`.
+    pub(crate) fn write(&mut self, records: &[u8], out: &mut Vec<u8>) -> Result<(), XDeltaError> {
+        match self {
+            Compressor::None => out.extend_from_slice(records),
+            Compressor::Zlib(z) => {
+                z.write_all(records).map_err(compress_err)?;
+                out.append(z.get_mut());
+            }
+            Compressor::Zstd(z) => {
+                z.write_all(records).map_err(compress_err)?;
+                out.append(z.get_mut());
+            }
+            Compressor::Lz4(z) => z.write(records, out),
+            Compressor::Lzma(z) => z.write(records, out),
+            Compressor::Djw(z) => z.write(records, out),
+            Compressor::Fgk(z) => z.write(records, out),
+        }
+        Ok(())
+    }
+
+    /// Make everything written so far decodable by the receiver.
+    pub(crate) fn flush(&mut self, out: &mut Vec<u8>) -> Result<(), XDeltaError> {
+        match self {
+            Compressor::None => {}
+            Compressor::Zlib(z) => {
+                z.flush().map_err(compress_err)?;
+                out.append(z.get_mut());
+            }
+            Compressor::Zstd(z) => {
+                z.flush().map_err(compress_err)?;
+                out.append(z.get_mut());
+            }
+            Compressor::Lz4(z) => z.flush(out),
+            Compressor::Lzma(z) => z.flush(out),
+            Compressor::Djw(z) => z.flush(out),
+            Compressor::Fgk(z) => z.flush(out),
+        }
+        Ok(())
+    }
+
+    /// End the compressed stream.
+    pub(crate) fn finish(&mut self, out: &mut Vec<u8>) -> Result<(), XDeltaError> {
+        match self {
+            Compressor::None => {}
+            Compressor::Zlib(z) => {
+                z.try_finish().map_err(compress_err)?;
+                out.append(z.get_mut());
+            }
+            Compressor::Zstd(z) => {
+                z.do_finish().map_err(compress_err)?;
+                out.append(z.get_mut());
+            }
+            Compressor::Lz4(z) => z.finish(out),
+            Compressor::Lzma(z) => z.finish(out),
+            Compressor::Djw(z) => z.finish(out),
+            Compressor::Fgk(z) => z.finish(out),
+        }
+        Ok(())
+    }
+}
+
+/// Undoes secondary compression in front of the record decoder. The kind is
+/// detected from the first patch byte: records start with opcode 0x00, 0x01
+/// or 0x02, which is neither a zlib header nor the zstd, LZ4, xz, DJW or FGK
+/// magic.
+pub(crate) enum Decompressor {
+    /// no patch byte seen yet
+    Detect,
+    None,
+    Zlib { z: Decompress, ended: bool },
+    Zstd { z: zstd::stream::raw::Decoder<'static>, pending: bool },
+    Lz4(Lz4Decoder),
+    Lzma(LzmaDecoder),
+    Djw(FramedDecoder<Djw>),
+    Fgk(FramedDecoder<Fgk>),
+}
+
+impl Decompressor {
+    /// Decompress `patch` and pass the records to `sink` in chunks.
+    pub(crate) fn feed(
+        &mut self,
+        mut patch: &[u8],
+        scratch: &mut Vec<u8>,
+        mut sink: impl FnMut(&[u8]) -> Result<(), XDeltaError>,
+    ) -> Result<(), XDeltaError> {
+        if patch.is_empty() {
+            return Ok(());
+        }
+        if let Decompressor::Detect = self {
+            *self = match Secondary::detect(patch[0]) {
+                Secondary::Zlib => Decompressor::Zlib {
+                    z: Decompress::new(true),
+                    ended: false,
+                },
+                Secondary::Zstd => Decompressor::Zstd {
+                    z: zstd::stream::raw::Decoder::new()
+                        .map_err(|e| XDeltaError::Corrupt(format!("invalid zstd stream: {}", e)))?,
+                    pending: true,
+                },
+                Secondary::Lz4 => Decompressor::Lz4(Lz4Decoder::new()),
+                Secondary::Lzma => Decompressor::Lzma(LzmaDecoder::new()),
+                Secondary::Djw => Decompressor::Djw(FramedDecoder::new()),
+                Secondary::Fgk => Decompressor::Fgk(FramedDecoder::new()),
+                Secondary::None => Decompressor::None,
+            };
+        }
+        if scratch.len() < INFLATE_CHUNK {
+            scratch.resize(INFLATE_CHUNK, 0);
+        }
+        match self {
+            Decompressor::Detect => unreachable!(),
+            Decompressor::None => sink(patch),
+            Decompressor::Lz4(z) => z.feed(patch, &mut sink),
+            Decompressor::Lzma(z) => z.feed(patch, &mut sink),
+            Decompressor::Djw(z) => z.feed(patch, &mut sink),
+            Decompressor::Fgk(z) => z.feed(patch, &mut sink),
+            Decompressor::Zlib { z, ended } => {
+                loop {
+                    if *ended {
+                        if !patch.is_empty() {
+                            return Err(XDeltaError::Corrupt("trailing data after zlib stream".into()));
+                        }
+                        return Ok(());
+                    }
+                    let (in0, out0) = (z.total_in(), z.total_out());
+                    let status = z
+                        .decompress(patch, scratch, FlushDecompress::None)
+                        .map_err(|e| XDeltaError::Corrupt(format!("invalid zlib stream: {}", e)))?;
+                    let read = (z.total_in() - in0) as usize;
+                    let written = (z.total_out() - out0) as usize;
+                    patch = &patch[read..];
+                    *ended = status == Status::StreamEnd;
+                    sink(&scratch[..written])?;
+                    if patch.is_empty() && written < scratch.len() {
+                        return Ok(());
+                    }
+                    if read == 0 && written == 0 {
+                        return Err(XDeltaError::Corrupt("invalid zlib stream".into()));
+                    }
+                }
+            }
+            Decompressor::Zstd { z, pending } => {
+                let mut input = InBuffer::around(patch);
+                loop {
+                    let mut output = OutBuffer::around(&mut scratch[..]);
+                    let hint = z
+                        .run(&mut input, &mut output)
+                        .map_err(|e| XDeltaError::Corrupt(format!("invalid zstd stream: {}", e)))?;
+                    let written = output.pos();
+                    *pending = hint != 0;
+                    sink(&scratch[..written])?;
+                    if input.pos() == patch.len() && written < scratch.len() {
+                        return Ok(());
+                    }
+                }
+            }
+        }
+    }
+
+    /// The secondary compression detected so far.
+    pub(crate) fn secondary(&self) -> Secondary {
+        match self {
+            Decompressor::Detect | Decompressor::None => Secondary::None,
+            Decompressor::Zlib { .. } => Secondary::Zlib,
+            Decompressor::Zstd { .. } => Secondary::Zstd,
+            Decompressor::Lz4(_) => Secondary::Lz4,
+            Decompressor::Lzma(_) => Secondary::Lzma,
+            Decompressor::Djw(_) => Secondary::Djw,
+            Decompressor::Fgk(_) => Secondary::Fgk,
+        }
+    }
+
+    /// Reject a compressed patch that stops before the end of its stream.
+    pub(crate) fn finish(&self) -> Result<(), XDeltaError> {
+        match self {
+            Decompressor::Zlib { ended: false, .. } => Err(XDeltaError::Corrupt("truncated zlib stream".into())),
+            Decompressor::Zstd { pending: true, .. } => Err(XDeltaError::Corrupt("truncated zstd stream".into())),
+            Decompressor::Lz4(z) if !z.ended() => Err(XDeltaError::Corrupt("truncated lz4 stream".into())),
+            Decompressor::Lzma(z) if !z.ended() => Err(XDeltaError::Corrupt("truncated xz stream".into())),
+            Decompressor::Djw(z) if !z.ended() => Err(XDeltaError::Corrupt("truncated djw stream".into())),
+            Decompressor::Fgk(z) if !z.ended() => Err(XDeltaError::Corrupt("truncated fgk stream".into())),
+            _ => Ok(()),
+        }
+    }
+}
@@ -0,0 +1,913 @@
+// src/decoder.rs
+use std::fs::File;
+use std::io::{Read, Seek, SeekFrom, Write};
+
+use sha2::{Digest, Sha256};
+
+use crate::bsdiff;
+use crate::cancel::{self, CancelToken};
+use crate::checksum::{Checksum, Running, CHECKSUM_RECORD};
+use crate::compress::{Decompressor, Secondary};
+use crate::encoder::{CANCEL_WINDOW, END_RECORD, END_RECORD_LEN, HEADER_RECORD, HEADER_RECORD_LEN};
+use crate::logging::{log_at, DEBUG};
+use crate::stats;
+use crate::vcdiff::{self, VcdiffReader};
+use crate::XDeltaError;
+
+/// Random-access view of the "old" data that COPY records read from.
+pub(crate) trait Source {
+    /// Total length of the source, if known.
+    fn len(&self) -> Option<u64>;
+    /// Fill `buf` completely from `offset`; a short read is an error.
+    fn read_at(&mut self, offset: u64, buf: &mut [u8]) -> Result<(), XDeltaError>;
+}
+
+pub(crate) struct SliceSource<'a>(pub(crate) &'a [u8]);
+
+impl Source for SliceSource<'_> {
+    fn len(&self) -> Option<u64> {
+        Some(self.0.len() as u64)
+    }
+
+    fn read_at(&mut self, offset: u64, buf: &mut [u8]) -> Result<(), XDeltaError> {
+        let start = offset as usize;
+        buf.copy_from_slice(&self.0[start..start + buf.len()]);
+        Ok(())
+    }
+}
+
+pub(crate) struct FileSource {
+    file: File,
+    len: u64,
+}
+
+impl FileSource {
+    pub(crate) fn new(file: File) -> Result<Self, XDeltaError> {
+        let len = file.metadata().map_err(|e| XDeltaError::Io(e.to_string()))?.len();
+        Ok(FileSource { file, len })
+    }
+}
+
+impl Source for FileSource {
+    fn len(&self) -> Option<u64> {
+        Some(self.len)
+    }
+
+    fn read_at(&mut self, offset: u64, buf: &mut [u8]) -> Result<(), XDeltaError> {
+        self.file
+            .seek(SeekFrom::Start(offset))
+            .and_then(|_| self.file.read_exact(buf))
+            .map_err(|e| XDeltaError::Io(format!("failed to read old file: {}", e)))
+    }
+}
+
+/// Stand-in for the old data when a patch is only validated; COPY records
+/// are checked against the length, if known, but never read.
+pub(crate) struct NoSource(pub(crate) Option<u64>);
+
+impl Source for NoSource {
+    fn len(&self) -> Option<u64> {
+        self.0
+    }
+
+    fn read_at(&mut self, _offset: u64, _buf: &mut [u8]) -> Result<(), XDeltaError> {
+        Err(XDeltaError::InvalidArg("no source data while validating".into()))
+    }
+}
+
+/// XDELTA_FORMAT_BSDIFF, as `PatchInfo::format` reports it.
+const FORMAT_BSDIFF: u32 = 2;
+
+/// Size of the scratch buffer COPY records are streamed through.
+const COPY_CHUNK: usize = 64 * 1024;
+
+enum State {
+    /// waiting for the next opcode
+    Opcode,
+    /// collecting the 4 length bytes of an ADD record
+    AddLen { have: usize, buf: [u8; 4] },
+    /// passing through `remaining` bytes of ADD data
+    AddData { remaining: usize },
+    /// collecting the 12 offset/length bytes of a COPY record
+    CopyEntry { have: usize, buf: [u8; 12] },
+    /// waiting for the kind byte of a CHECKSUM record
+    ChecksumKind,
+    /// collecting the sum of a CHECKSUM record
+    ChecksumSum { kind: Checksum, have: usize, buf: [u8; 8] },
+    /// waiting for the format revision of the HEADER record
+    HeaderVersion,
+    /// collecting the 8 target length bytes of the END record
+    EndLen { have: usize, buf: [u8; 8] },
+    /// past the END record, no more records may follow
+    Ended,
+}
+
+/// Composition of a patch, gathered while it is decoded or validated.
+/// Layout matches xdelta_patch_info in xdelta_interface.h.
+#[repr(C)]
+#[derive(Default, Clone, Copy)]
+pub struct PatchInfo {
+    /// XDELTA_FORMAT_*
+    pub format: u32,
+    /// XDELTA_SECONDARY_* for native patches, the VCDIFF compressor id (xdelta3: 1 DJW, 2 LZMA, 16 FGK) otherwise
+    pub secondary: u32,
+    pub windows: u64,
+    pub instructions: u64,
+    pub add_bytes: u64,
+    pub copy_bytes: u64,
+    pub run_bytes: u64,
+    pub target_size: u64,
+    /// shortest source the patch can be applied to: the end of the furthest
+    /// COPY from the source (VCDIFF: of the furthest source segment)
+    pub source_size: u64,
+    /// id of the output checksum (1 adler32, 2 XXH3), 0 without one
+    pub checksum: u32,
+}
+
+impl PatchInfo {
+    pub(crate) fn merge(&mut self, w: &PatchInfo) {
+        self.windows += w.windows;
+        self.instructions += w.instructions;
+        self.add_bytes += w.add_bytes;
+        self.copy_bytes += w.copy_bytes;
+        self.run_bytes += w.run_bytes;
+        self.source_size = self.source_size.max(w.source_size);
+        if self.checksum == 0 {
+            self.checksum = w.checksum;
+        }
+    }
+}
+
+/// A run of whole records or windows of a patch that can be decoded on its own,
+/// see `patch_segments`. Layout matches xdelta_patch_segment in xdelta_interface.h.
+#[repr(C)]
+#[derive(Default, Clone, Copy)]
+pub struct Segment {
+    pub patch_offset: u64,
+    pub patch_len: u64,
+    pub target_offset: u64,
+    pub target_len: u64,
+}
+
+/// Where a COPY reads from: an absolute offset into the source, or (VCDIFF
+/// only) an offset into the target window being decoded.
+#[derive(Clone, Copy)]
+pub(crate) enum CopyFrom {
+    Source(u64),
+    Target(u64),
+}
+
+/// The structure of a patch as the decoder walks it, see `Decoder::write_traced`.
+/// `at` is the target offset of an instruction, relative to the current
+/// VCDIFF window (native patches have no windows, so it is absolute there).
+pub(crate) enum Event<'a> {
+    /// VCDIFF file header
+    Header {
+        indicator: u8,
+        secondary: Option<u8>,
+        app_header: Option<&'a [u8]>,
+    },
+    /// VCDIFF window header; `source` is (offset, length) of the source segment
+    Window {
+        indicator: u8,
+        source: Option<(u64, u64)>,
+        target_len: u64,
+        checksum: Option<u32>,
+        sections: [u64; 3],
+    },
+    Add { at: u64, len: u64 },
+    /// the data of the ADD just reported, possibly in several pieces
+    AddData(&'a [u8]),
+    Run { at: u64, len: u64, byte: u8 },
+    Copy { at: u64, len: u64, from: CopyFrom },
+    /// native CHECKSUM record over the target bytes since the previous one
+    Checksum { at: u64, kind: Checksum, sum: u64 },
+    /// native END record, `at` is the target length it declares
+    End { at: u64 },
+}
+
+/// Observer of decoder events; `None` on the normal decoding paths.
+pub(crate) type Trace<'t> = Option<&'t mut dyn FnMut(&Event) -> Result<(), XDeltaError>>;
+
+pub(crate) fn emit(trace: &mut Trace, event: Event) -> Result<(), XDeltaError> {
+    match trace {
+        Some(f) => f(&event),
+        None => Ok(()),
+    }
+}
+
+/// Bytes of output declared so far, checked against an optional limit.
+struct OutputLimit {
+    max: Option<u64>,
+    produced: u64,
+}
+
+impl OutputLimit {
+    fn reserve(&mut self, len: u64) -> Result<(), XDeltaError> {
+        let produced = self.produced.saturating_add(len);
+        if let Some(max) = self.max {
+            if produced > max {
+                return Err(XDeltaError::OutputTooLarge(format!("output exceeds the limit of {} bytes", max)));
+            }
+        }
+        self.produced = produced;
+        Ok(())
+    }
+}
+
+/// Streaming decoder: patch bytes are written in arbitrary chunks and the
+/// reconstructed data is written to `out` as records complete.
+/// Secondary compression is detected and undone in front of the records;
+/// VCDIFF patches are recognised by their magic and decoded separately.
+/// bsdiff patches are recognised too, but their blocks are read side by
+/// side, so they are buffered whole and applied by `finish`.
+pub(crate) struct Decoder<S: Source> {
+    src: S,
+    vcdiff: Option<VcdiffReader>,
+    bsdiff: Option<Vec<u8>>,
+    front: Decompressor,
+    /// decompressed records waiting to be decoded
+    inflated: Vec<u8>,
+    state: State,
+    scratch: Vec<u8>,
+    cancel: Option<CancelToken>,
+    /// whether any patch byte has been seen
+    started: bool,
+    limit: OutputLimit,
+    /// check the records without reading the source or producing output
+    validate_only: bool,
+    /// record counts of the native format
+    info: PatchInfo,
+    /// running checksum of the output since the last CHECKSUM record, once
+    /// the first one has named the kind
+    sum: Option<Running>,
+    /// index and target offset of the open checksum window
+    sum_window: u64,
+    sum_start: u64,
+    /// target offset of the last CHECKSUM record, also when only validating
+    last_sum_at: Option<u64>,
+    /// whether a record has been decoded, a HEADER record can only come first
+    opened: bool,
+    /// the patch started with a HEADER record, so it has to end with END
+    headed: bool,
+}
+
+impl<S: Source> Decoder<S> {
+    pub(crate) fn new(src: S) -> Self {
+        Decoder {
+            src,
+            vcdiff: None,
+            bsdiff: None,
+            front: Decompressor::Detect,
+            inflated: Vec::new(),
+            state: State::Opcode,
+            scratch: Vec::new(),
+            cancel: None,
+            started: false,
+            limit: OutputLimit { max: None, produced: 0 },
+            validate_only: false,
+            info: PatchInfo::default(),
+            sum: None,
+            sum_window: 0,
+            sum_start: 0,
+            last_sum_at: None,
+            opened: false,
+            headed: false,
+        }
+    }
+
+    /// Only check the structure of the patch: COPY records are range-checked
+    /// against the source length (when known) but never read, and nothing
+    /// is written to the output, so checksums are not verified either.
+    pub(crate) fn set_validate_only(&mut self) {
+        self.validate_only = true;
+    }
+
+    /// Reject the patch as soon as its records declare more than `max` bytes
+    /// of output, before any of that output is produced.
+    pub(crate) fn set_max_output(&mut self, max: Option<u64>) {
+        self.limit.max = max;
+    }
+
+    /// Check `cancel` between patch windows and between chunks of long COPY records.
+    pub(crate) fn set_cancel(&mut self, cancel: Option<CancelToken>) {
+        self.cancel = cancel;
+    }
+
+    pub(crate) fn write<W: Write + ?Sized>(&mut self, patch: &[u8], out: &mut W) -> Result<(), XDeltaError> {
+        self.feed(patch, out, &mut None)?;
+        log_at!(
+            DEBUG,
+            "decoder: window of {} patch bytes, {} bytes of output so far",
+            patch.len(),
+            self.limit.produced
+        );
+        Ok(())
+    }
+
+    /// Like `write`, reporting every header and instruction to `trace` before it is executed.
+    pub(crate) fn write_traced<W: Write + ?Sized>(
+        &mut self,
+        patch: &[u8],
+        out: &mut W,
+        trace: &mut dyn FnMut(&Event) -> Result<(), XDeltaError>,
+    ) -> Result<(), XDeltaError> {
+        self.feed(patch, out, &mut Some(trace))
+    }
+
+    fn feed<W: Write + ?Sized>(&mut self, patch: &[u8], out: &mut W, trace: &mut Trace) -> Result<(), XDeltaError> {
+        let before = self.limit.produced;
+        let r = self.decode(patch, out, trace);
+        // a bsdiff patch produces its output in `finish`
+        if !self.validate_only && self.bsdiff.is_none() {
+            stats::decoded(self.limit.produced - before);
+        }
+        r
+    }
+
+    fn decode<W: Write + ?Sized>(&mut self, patch: &[u8], out: &mut W, trace: &mut Trace) -> Result<(), XDeltaError> {
+        if !self.started && patch.first() == Some(&vcdiff::MAGIC[0]) {
+            self.vcdiff = Some(VcdiffReader::new(self.validate_only));
+        }
+        if !self.started && patch.first() == Some(&bsdiff::MAGIC[0]) {
+            self.bsdiff = Some(Vec::new());
+        }
+        self.started |= !patch.is_empty();
+        if let Some(buf) = &mut self.bsdiff {
+            if trace.is_some() {
+                return Err(XDeltaError::Unsupported("bsdiff patches can only be applied as a whole".into()));
+            }
+            let had_header = buf.len() >= bsdiff::HEADER_LEN;
+            buf.extend_from_slice(patch);
+            if !had_header {
+                if let Some(n) = bsdiff::header_new_size(buf)? {
+                    self.limit.reserve(n)?;
+                }
+            }
+            return Ok(());
+        }
+        if let Some(v) = &mut self.vcdiff {
+            let limit = &mut self.limit;
+            return v.write(patch, &mut self.src, out, |len| limit.reserve(len), trace);
+        }
+        // the front and its buffer are moved out so the records can be decoded while they are borrowed
+        let mut front = std::mem::replace(&mut self.front, Decompressor::Detect);
+        let mut inflated = std::mem::take(&mut self.inflated);
+        let r = front.feed(patch, &mut inflated, |records| self.write_records(records, out, trace));
+        self.front = front;
+        self.inflated = inflated;
+        r
+    }
+
+    fn write_records<W: Write + ?Sized>(
+        &mut self,
+        mut patch: &[u8],
+        out: &mut W,
+        trace: &mut Trace,
+    ) -> Result<(), XDeltaError> {
+        while !patch.is_empty() {
+            match &mut self.state {
+                State::Opcode => {
+                    let opcode = patch[0];
+                    patch = &patch[1..];
+                    let first = !std::mem::replace(&mut self.opened, true);
+                    self.state = match opcode {
+                        0x00 => State::AddLen { have: 0, buf: [0u8; 4] },
+                        0x01 => State::CopyEntry { have: 0, buf: [0u8; 12] },
+                        CHECKSUM_RECORD => State::ChecksumKind,
+                        END_RECORD => State::EndLen { have: 0, buf: [0u8; 8] },
+                        HEADER_RECORD if first => State::HeaderVersion,
+                        HEADER_RECORD => {
+                            return Err(XDeltaError::Corrupt("HEADER record after the start of the patch".into()));
+                        }
+                        other => {
+                            return Err(XDeltaError::Corrupt(format!("unknown opcode {:#x}", other)));
+                        }
+                    };
+                }
+                State::AddLen { have, buf } => {
+                    let n = usize::min(4 - *have, patch.len());
+                    buf[*have..*have + n].copy_from_slice(&patch[..n]);
+                    *have += n;
+                    patch = &patch[n..];
+                    if *have == 4 {
+                        let len = u32::from_le_bytes(*buf) as usize;
+                        let at = self.limit.produced;
+                        self.limit.reserve(len as u64)?;
+                        emit(trace, Event::Add { at, len: len as u64 })?;
+                        self.info.instructions += 1;
+                        self.info.add_bytes += len as u64;
+                        self.state = if len == 0 { State::Opcode } else { State::AddData { remaining: len } };
+                    }
+                }
+                State::AddData { remaining } => {
+                    let n = usize::min(*remaining, patch.len());
+                    emit(trace, Event::AddData(&patch[..n]))?;
+                    if !self.validate_only {
+                        write_out(out, &patch[..n])?;
+                        if let Some(sum) = &mut self.sum {
+                            sum.update(&patch[..n]);
+                        }
+                    }
+                    *remaining -= n;
+                    patch = &patch[n..];
+                    if *remaining == 0 {
+                        self.state = State::Opcode;
+                    }
+                }
+                State::CopyEntry { have, buf } => {
+                    let n = usize::min(12 - *have, patch.len());
+                    buf[*have..*have + n].copy_from_slice(&patch[..n]);
+                    *have += n;
+                    patch = &patch[n..];
+                    if *have == 12 {
+                        let mut offb = [0u8; 8];
+                        offb.copy_from_slice(&buf[..8]);
+                        let mut lenb = [0u8; 4];
+                        lenb.copy_from_slice(&buf[8..]);
+                        let offset = u64::from_le_bytes(offb);
+                        let len = u32::from_le_bytes(lenb) as u64;
+                        let at = self.limit.produced;
+                        self.limit.reserve(len)?;
+                        emit(trace, Event::Copy { at, len, from: CopyFrom::Source(offset) })?;
+                        self.info.instructions += 1;
+                        self.info.copy_bytes += len;
+                        self.info.source_size = self.info.source_size.max(offset.saturating_add(len));
+                        self.state = State::Opcode;
+                        self.copy(offset, len, out)?;
+                    }
+                }
+                State::ChecksumKind => {
+                    let Some(kind) = Checksum::from_id(patch[0]) else {
+                        return Err(XDeltaError::Unsupported(format!("unknown checksum kind {}", patch[0])));
+                    };
+                    patch = &patch[1..];
+                    self.state = State::ChecksumSum { kind, have: 0, buf: [0u8; 8] };
+                }
+                State::ChecksumSum { kind, have, buf } => {
+                    let kind = *kind;
+                    let n = usize::min(kind.len() - *have, patch.len());
+                    buf[*have..*have + n].copy_from_slice(&patch[..n]);
+                    *have += n;
+                    patch = &patch[n..];
+                    if *have == kind.len() {
+                        let sum = u64::from_le_bytes(*buf);
+                        self.state = State::Opcode;
+                        emit(trace, Event::Checksum { at: self.limit.produced, kind, sum })?;
+                        if self.info.checksum == 0 {
+                            self.info.checksum = kind.id() as u32;
+                        }
+                        self.last_sum_at = Some(self.limit.produced);
+                        self.check_sum(kind, sum)?;
+                    }
+                }
+                State::HeaderVersion => {
+                    let revision = patch[0];
+                    patch = &patch[1..];
+                    if revision < 3 || revision as u32 > crate::version::FORMAT_VERSION {
+                        return Err(XDeltaError::Unsupported(format!("native format revision {}", revision)));
+                    }
+                    self.headed = true;
+                    self.state = State::Opcode;
+                }
+                State::EndLen { have, buf } => {
+                    let n = usize::min(8 - *have, patch.len());
+                    buf[*have..*have + n].copy_from_slice(&patch[..n]);
+                    *have += n;
+                    patch = &patch[n..];
+                    if *have == 8 {
+                        let declared = u64::from_le_bytes(*buf);
+                        if declared != self.limit.produced {
+                            return Err(XDeltaError::Corrupt(format!(
+                                "end record declares {} bytes of output, the records produce {}",
+                                declared, self.limit.produced
+                            )));
+                        }
+                        self.state = State::Ended;
+                        emit(trace, Event::End { at: declared })?;
+                    }
+                }
+                State::Ended => return Err(XDeltaError::Corrupt("data after the end record".into())),
+            }
+        }
+        Ok(())
+    }
+
+    /// Compare a CHECKSUM record with the output since the previous one. The
+    /// first record has to come before any output (the encoder starts the
+    /// patch with one over no bytes) and names the kind for the rest.
+    fn check_sum(&mut self, kind: Checksum, sum: u64) -> Result<(), XDeltaError> {
+        if self.validate_only {
+            return Ok(());
+        }
+        let end = self.limit.produced;
+        let running = match &mut self.sum {
+            Some(running) if running.kind() == kind => running,
+            Some(_) => return Err(XDeltaError::Corrupt("checksum kind changes within the patch".into())),
+            None if end == 0 => self.sum.insert(Running::new(kind)),
+            None => return Err(XDeltaError::Corrupt("first checksum record after the start of the output".into())),
+        };
+        if running.take() != sum {
+            return Err(XDeltaError::ChecksumMismatch(format!(
+                "{} of checksum window {} (target bytes {}..{})",
+                kind.name(),
+                self.sum_window,
+                self.sum_start,
+                end
+            )));
+        }
+        if end > self.sum_start {
+            self.sum_window += 1;
+            self.sum_start = end;
+        }
+        Ok(())
+    }
+
+    /// Must be called once the whole patch has been written; a patch that
+    /// stops in the middle of a record is rejected, and so is an empty patch.
+    /// A native patch that starts with a HEADER record ends after its END
+    /// record, one without (the original format) after any complete record.
+    /// A patch with checksums must end with one over the
+    /// last output bytes: output after the last CHECKSUM record would be
+    /// accepted unverified (the encoder always closes the last window).
+    /// A bsdiff patch is applied here, its output goes to `out`.
+    pub(crate) fn finish<W: Write + ?Sized>(&mut self, out: &mut W) -> Result<(), XDeltaError> {
+        if !self.started {
+            return Err(XDeltaError::Corrupt("empty patch".into()));
+        }
+        if let Some(patch) = &self.bsdiff {
+            let src = if self.validate_only { None } else { Some(&mut self.src) };
+            let applied = bsdiff::apply_patch(patch, src, out, self.cancel.as_ref(), None)?;
+            self.info.instructions = applied.entries;
+            self.info.add_bytes = applied.extra_bytes;
+            self.info.copy_bytes = applied.diff_bytes;
+            if !self.validate_only {
+                stats::decoded(self.limit.produced);
+            }
+            return Ok(());
+        }
+        if let Some(v) = &self.vcdiff {
+            return v.finish();
+        }
+        self.front.finish()?;
+        let truncated = match self.state {
+            State::Opcode | State::Ended => None,
+            State::HeaderVersion => Some("truncated HEADER record"),
+            State::EndLen { .. } => Some("truncated end record"),
+            State::AddLen { .. } => Some("truncated ADD length"),
+            State::AddData { .. } => Some("truncated ADD data"),
+            State::CopyEntry { .. } => Some("truncated COPY entry"),
+            State::ChecksumKind | State::ChecksumSum { .. } => Some("truncated checksum record"),
+        };
+        if let Some(what) = truncated {
+            return Err(XDeltaError::Corrupt(what.into()));
+        }
+        if self.headed && !matches!(self.state, State::Ended) {
+            return Err(XDeltaError::Corrupt("truncated patch: no end record".into()));
+        }
+        match self.last_sum_at {
+            Some(at) if at < self.limit.produced => Err(XDeltaError::Corrupt(format!(
+                "{} bytes of output after the last checksum record are not covered by a checksum",
+                self.limit.produced - at
+            ))),
+            _ => Ok(()),
+        }
+    }
+
+    /// Composition of the patch decoded so far.
+    pub(crate) fn info(&self) -> PatchInfo {
+        let mut info = match &self.vcdiff {
+            Some(v) => v.info(),
+            None if self.bsdiff.is_some() => PatchInfo { format: FORMAT_BSDIFF, ..self.info },
+            None => PatchInfo {
+                format: 0,
+                secondary: self.front.secondary() as u32,
+                ..self.info
+            },
+        };
+        info.target_size = self.limit.produced;
+        info
+    }
+
+    fn copy<W: Write + ?Sized>(&mut self, offset: u64, len: u64, out: &mut W) -> Result<(), XDeltaError> {
+        let in_range = match (self.src.len(), offset.checked_add(len)) {
+            (Some(src_len), Some(end)) => end <= src_len,
+            (None, Some(_)) => true,
+            (_, None) => false,
+        };
+        if !in_range {
+            return Err(XDeltaError::SourceMismatch("COPY out of range".into()));
+        }
+        if self.validate_only {
+            return Ok(());
+        }
+        if self.scratch.is_empty() {
+            self.scratch = vec![0u8; COPY_CHUNK];
+        }
+        let mut done = 0u64;
+        while done < len {
+            cancel::check(self.cancel.as_ref())?;
+            let n = u64::min(len - done, COPY_CHUNK as u64) as usize;
+            self.src.read_at(offset + done, &mut self.scratch[..n])?;
+            write_out(out, &self.scratch[..n])?;
+            if let Some(sum) = &mut self.sum {
+                sum.update(&self.scratch[..n]);
+            }
+            done += n as u64;
+        }
+        Ok(())
+    }
+}
+
+fn write_out<W: Write + ?Sized>(out: &mut W, data: &[u8]) -> Result<(), XDeltaError> {
+    out.write_all(data).map_err(|e| XDeltaError::Io(e.to_string()))
+}
+
+/// Apply the simple patch format to `old` -> produces reconstructed `new`.
+pub(crate) fn apply_patch_bytes(old: &[u8], patch: &[u8]) -> Result<Vec<u8>, XDeltaError> {
+    apply_patch_bytes_cancel(old, patch, None, None)
+}
+
+/// Same as `apply_patch_bytes`, checking `cancel` between windows and
+/// failing once the output would exceed `max_output`.
+pub(crate) fn apply_patch_bytes_cancel(
+    old: &[u8],
+    patch: &[u8],
+    max_output: Option<u64>,
+    cancel: Option<&CancelToken>,
+) -> Result<Vec<u8>, XDeltaError> {
+    let mut out: Vec<u8> = Vec::new();
+    let mut dec = Decoder::new(SliceSource(old));
+    dec.set_cancel(cancel.cloned());
+    dec.set_max_output(max_output);
+    for window in patch.chunks(CANCEL_WINDOW) {
+        cancel::check(cancel)?;
+        dec.write(window, &mut out)?;
+        cancel::advance(cancel, window.len());
+    }
+    dec.finish(&mut out)?;
+    Ok(out)
+}
+
+/// Output sink writing into a caller's fixed buffer. The decoder's output
+/// limit is the buffer length, so running out of room here means the limit
+/// check was bypassed and is reported as an I/O error rather than a panic.
+struct SliceSink<'a> {
+    buf: &'a mut [u8],
+    len: usize,
+}
+
+impl Write for SliceSink<'_> {
+    fn write(&mut self, data: &[u8]) -> std::io::Result<usize> {
+        if self.buf.len() - self.len < data.len() {
+            return Err(std::io::Error::new(std::io::ErrorKind::WriteZero, "output buffer is full"));
+        }
+        self.buf[self.len..self.len + data.len()].copy_from_slice(data);
+        self.len += data.len();
+        Ok(data.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Decode `patch` against `old` straight into `dst` and return the output
+/// length. Output past the end of `dst` is refused as OutputTooLarge before
+/// it is produced; no buffer here grows with the output (VCDIFF still keeps
+/// one target window).
+pub(crate) fn apply_patch_into(old: &[u8], patch: &[u8], dst: &mut [u8]) -> Result<usize, XDeltaError> {
+    let limit = dst.len() as u64;
+    let mut sink = SliceSink { buf: dst, len: 0 };
+    let mut dec = Decoder::new(SliceSource(old));
+    dec.set_max_output(Some(limit));
+    dec.write(patch, &mut sink)?;
+    dec.finish(&mut sink)?;
+    Ok(sink.len)
+}
+
+/// Decode `patch` against `old` into `dst`, whose length is the output size
+/// the patch declares (`validate_patch_bytes`), checking `cancel` between windows
+/// like `apply_patch_bytes_cancel`. Output that overruns or does not fill
+/// `dst` means the declared size and the records disagree: Corrupt.
+pub(crate) fn apply_patch_exact(
+    old: &[u8],
+    patch: &[u8],
+    dst: &mut [u8],
+    cancel: Option<&CancelToken>,
+) -> Result<(), XDeltaError> {
+    let declared = dst.len() as u64;
+    let mut sink = SliceSink { buf: dst, len: 0 };
+    let mut dec = Decoder::new(SliceSource(old));
+    dec.set_cancel(cancel.cloned());
+    dec.set_max_output(Some(declared));
+    let r = patch
+        .chunks(CANCEL_WINDOW)
+        .try_for_each(|window| {
+            cancel::check(cancel)?;
+            dec.write(window, &mut sink)?;
+            cancel::advance(cancel, window.len());
+            Ok(())
+        })
+        .and_then(|()| dec.finish(&mut sink));
+    match r {
+        Err(XDeltaError::OutputTooLarge(_)) => Err(XDeltaError::Corrupt(format!(
+            "patch produces more than the {} bytes it declares",
+            declared
+        ))),
+        Err(e) => Err(e),
+        Ok(()) if sink.len as u64 != declared => Err(XDeltaError::Corrupt(format!(
+            "patch produces {} bytes but declares {}",
+            sink.len, declared
+        ))),
+        Ok(()) => Ok(()),
+    }
+}
+
+/// Output sink for verification: counts and hashes the output instead of keeping it.
+struct HashSink {
+    hasher: Sha256,
+    len: u64,
+}
+
+impl Write for HashSink {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.hasher.update(buf);
+        self.len += buf.len() as u64;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Decode `patch` against `old` like `apply_patch_bytes_cancel`, but discard
+/// the output; returns its length and SHA-256. Memory use does not depend on
+/// the size of the output (VCDIFF still buffers one target window).
+pub(crate) fn verify_patch_bytes(
+    old: &[u8],
+    patch: &[u8],
+    max_output: Option<u64>,
+    cancel: Option<&CancelToken>,
+) -> Result<(u64, [u8; 32]), XDeltaError> {
+    let mut sink = HashSink {
+        hasher: Sha256::new(),
+        len: 0,
+    };
+    let mut dec = Decoder::new(SliceSource(old));
+    dec.set_cancel(cancel.cloned());
+    dec.set_max_output(max_output);
+    for window in patch.chunks(CANCEL_WINDOW) {
+        cancel::check(cancel)?;
+        dec.write(window, &mut sink)?;
+        cancel::advance(cancel, window.len());
+    }
+    dec.finish(&mut sink)?;
+    Ok((sink.len, sink.hasher.finalize().into()))
+}
+
+/// Output length `patch` declares. VCDIFF patches are answered from the window
+/// headers alone and bsdiff patches from their header; native patches have no
+/// header, so their records are walked (ADD data is skipped, but a compressed
+/// patch has to be decompressed).
+pub(crate) fn patch_target_size(patch: &[u8]) -> Result<u64, XDeltaError> {
+    if patch.first() == Some(&vcdiff::MAGIC[0]) {
+        return vcdiff::target_size(patch);
+    }
+    if patch.first() == Some(&bsdiff::MAGIC[0]) {
+        return bsdiff::header_new_size(patch)?
+            .ok_or_else(|| XDeltaError::Corrupt("bsdiff: truncated header".into()));
+    }
+    Ok(validate_patch_bytes(patch, None)?.target_size)
+}
+
+/// Split `patch` into segments of roughly `segment_size` target bytes (a
+/// segment is never cut inside a record or window), returning the length of
+/// the patch header and the segments in target order. Each segment only
+/// copies from the source, so the header followed by the segment's patch
+/// bytes decodes to its part of the target, independently of the others.
+/// Native patches have no header unless they start with a HEADER record or
+/// carry checksums: the HEADER record and the leading CHECKSUM record, which
+/// names the kind, are the header, and with checksums segments end after
+/// CHECKSUM records. The END record belongs to no segment: after a HEADER
+/// record each segment is decoded followed by an END record of its own. A compressed native patch or a bsdiff patch
+/// cannot be split and is returned as a single segment. Only the framing is checked here:
+/// COPY records are range-checked when the segments are decoded.
+pub(crate) fn patch_segments(patch: &[u8], segment_size: u64) -> Result<(usize, Vec<Segment>), XDeltaError> {
+    match patch.first() {
+        None => return Err(XDeltaError::Corrupt("empty patch".into())),
+        Some(&b) if b == vcdiff::MAGIC[0] => return vcdiff::segments(patch, segment_size),
+        Some(&b) if Secondary::detect(b) != Secondary::None || b == bsdiff::MAGIC[0] => {
+            let target_len = patch_target_size(patch)?;
+            return Ok((0, vec![Segment { patch_len: patch.len() as u64, target_len, ..Segment::default() }]));
+        }
+        Some(_) => {}
+    }
+    let headed = patch[0] == HEADER_RECORD;
+    let lead = if headed { HEADER_RECORD_LEN } else { 0 };
+    let summed = patch.get(lead) == Some(&CHECKSUM_RECORD);
+    let mut header = 0usize;
+    let mut segs = Vec::new();
+    let mut cur = Segment::default();
+    let mut pos = 0usize;
+    let mut ended = false;
+    while pos < patch.len() {
+        let rest = &patch[pos..];
+        if ended {
+            return Err(XDeltaError::Corrupt("data after the end record".into()));
+        }
+        let (len, rec) = match rest[0] {
+            0x00 => {
+                let Some(b) = rest.get(1..5) else {
+                    return Err(XDeltaError::Corrupt("truncated ADD length".into()));
+                };
+                let len = u32::from_le_bytes(b.try_into().unwrap()) as usize;
+                if rest.len() - 5 < len {
+                    return Err(XDeltaError::Corrupt("truncated ADD data".into()));
+                }
+                (len as u64, 5 + len)
+            }
+            0x01 => {
+                let Some(b) = rest.get(9..13) else {
+                    return Err(XDeltaError::Corrupt("truncated COPY entry".into()));
+                };
+                (u32::from_le_bytes(b.try_into().unwrap()) as u64, 13)
+            }
+            CHECKSUM_RECORD => {
+                let Some(&id) = rest.get(1) else {
+                    return Err(XDeltaError::Corrupt("truncated checksum record".into()));
+                };
+                let Some(kind) = Checksum::from_id(id) else {
+                    return Err(XDeltaError::Unsupported(format!("unknown checksum kind {}", id)));
+                };
+                if rest.len() < 2 + kind.len() {
+                    return Err(XDeltaError::Corrupt("truncated checksum record".into()));
+                }
+                (0, 2 + kind.len())
+            }
+            HEADER_RECORD if pos == 0 => {
+                let Some(&revision) = rest.get(1) else {
+                    return Err(XDeltaError::Corrupt("truncated HEADER record".into()));
+                };
+                if revision < 3 || revision as u32 > crate::version::FORMAT_VERSION {
+                    return Err(XDeltaError::Unsupported(format!("native format revision {}", revision)));
+                }
+                (0, HEADER_RECORD_LEN)
+            }
+            END_RECORD => {
+                let Some(b) = rest.get(1..END_RECORD_LEN) else {
+                    return Err(XDeltaError::Corrupt("truncated end record".into()));
+                };
+                let declared = u64::from_le_bytes(b.try_into().unwrap());
+                let produced = cur.target_offset + cur.target_len;
+                if declared != produced {
+                    return Err(XDeltaError::Corrupt(format!(
+                        "end record declares {} bytes of output, the records produce {}",
+                        declared, produced
+                    )));
+                }
+                ended = true;
+                pos += END_RECORD_LEN;
+                continue;
+            }
+            other => return Err(XDeltaError::Corrupt(format!("unknown opcode {:#x}", other))),
+        };
+        if (headed && pos == 0) || (summed && pos == lead) {
+            header = pos + rec;
+            pos += rec;
+            continue;
+        }
+        if cur.patch_len == 0 {
+            cur.patch_offset = pos as u64;
+        }
+        cur.patch_len += rec as u64;
+        cur.target_len += len;
+        pos += rec;
+        if cur.target_len >= segment_size && (!summed || rest[0] == CHECKSUM_RECORD) {
+            let next = cur.target_offset + cur.target_len;
+            segs.push(cur);
+            cur = Segment { target_offset: next, ..Segment::default() };
+        }
+    }
+    if headed && !ended {
+        return Err(XDeltaError::Corrupt("truncated patch: no end record".into()));
+    }
+    if cur.patch_len > 0 {
+        segs.push(cur);
+    }
+    Ok((header, segs))
+}
+
+/// Check that `patch` is structurally sound without the old data: every
+/// record or window is parsed and its lengths and offsets are checked, and
+/// COPY records are range-checked against `source_len` when it is known.
+/// Nothing is reconstructed, so the cost is linear in the patch size.
+/// Returns the composition of the patch, including the output length it declares.
+pub(crate) fn validate_patch_bytes(patch: &[u8], source_len: Option<u64>) -> Result<PatchInfo, XDeltaError> {
+    let mut dec = Decoder::new(NoSource(source_len));
+    dec.set_validate_only();
+    dec.write(patch, &mut std::io::sink())?;
+    dec.finish(&mut std::io::sink())?;
+    Ok(dec.info())
+}
@@ -0,0 +1,403 @@
+// src/djw.rs
+//! DJW secondary compression: semi-static Huffman coding with several code
+//! tables per block, the scheme of xdelta3's DJW coder (and of bzip2's
+//! entropy stage). A block is cut into groups of GROUP_LEN symbols, each
+//! group picks the table that codes it shortest, and the tables are refined
+//! a few times against the groups that chose them.
+//!
+//! A coded block is, MSB first: the symbols in use as bzip2 sends them (16
+//! bits for which ranges of 16 byte values occur, then 16 bits for each of
+//! those ranges); the number of tables minus one (3 bits); for each table
+//! the code lengths of the symbols in use, an initial 5-bit length and then
+//! per symbol "1 0" (+1) or "1 1" (-1) steps to its length and a 0; one
+//! selector per group, as its move-to-front position in unary; then the
+//! symbols. When the extra tables do not pay for themselves the block is
+//! coded with one table instead.
+
+use crate::huffman::{canonical_codes, code_lengths, BitReader, BitWriter, BlockCodec, CanonicalDecoder, MAX_CODE_LEN};
+use crate::XDeltaError;
+
+pub(crate) const MAGIC: [u8; 4] = [0xd9, b'D', b'J', b'W'];
+
+const GROUP_LEN: usize = 32;
+const MAX_TABLES: usize = 8;
+
+/// Refinement passes for xdelta3-style levels 0..=9.
+const PASSES: [usize; 10] = [0, 1, 1, 2, 2, 3, 4, 4, 6, 8];
+/// Level used without WithCompressionLevel.
+const DEFAULT_LEVEL: u32 = 6;
+
+pub(crate) struct Djw;
+
+impl Djw {
+    /// Tables for a block of `len` bytes: more groups can pay for more tables.
+    fn tables(len: usize, level: Option<u32>) -> usize {
+        if level == Some(0) {
+            return 1;
+        }
+        match len {
+            0..=511 => 1,
+            512..=2047 => 2,
+            2048..=8191 => 3,
+            8192..=32767 => 4,
+            32768..=131071 => 6,
+            _ => MAX_TABLES,
+        }
+    }
+}
+
+/// Lengths for the symbol counts of one table. Every symbol in the block
+/// keeps a code, so a group can always pick any table.
+fn table_lengths(freqs: &[u32; 256], present: &[bool; 256]) -> Vec<u8> {
+    let weights: Vec<u32> = (0..256).map(|s| freqs[s] * 16 + present[s] as u32).collect();
+    code_lengths(&weights, MAX_CODE_LEN)
+}
+
+/// The table coding `group` shortest, the first one on a tie.
+fn best_table(group: &[u8], lens: &[Vec<u8>]) -> usize {
+    let mut best = (usize::MAX, 0);
+    for (t, l) in lens.iter().enumerate() {
+        let cost: usize = group.iter().map(|&b| l[b as usize] as usize).sum();
+        if cost < best.0 {
+            best = (cost, t);
+        }
+    }
+    best.1
+}
+
+/// Code `raw` with `n_tables` tables refined `passes` times.
+fn encode_tables(raw: &[u8], used: &[usize], n_tables: usize, passes: usize, out: &mut Vec<u8>) {
+    let mut present = [false; 256];
+    for &s in used {
+        present[s] = true;
+    }
+    // start from tables that each favour one slice of the symbols by frequency, as bzip2 does
+    let mut lens: Vec<Vec<u8>> = (0..n_tables)
+        .map(|t| {
+            let (lo, hi) = (used.len() * t / n_tables, used.len() * (t + 1) / n_tables);
+            let mut l = vec![MAX_CODE_LEN as u8; 256];
+            for &s in &used[lo..hi] {
+                l[s] = 1;
+            }
+            l
+        })
+        .collect();
+    let groups: Vec<&[u8]> = raw.chunks(GROUP_LEN).collect();
+    let mut selectors = vec![0usize; groups.len()];
+    for pass in 0..=passes {
+        let mut table_freqs = vec![[0u32; 256]; n_tables];
+        for (g, group) in groups.iter().enumerate() {
+            // the last pass keeps its choices: the tables below are built from them
+            selectors[g] = if n_tables == 1 { 0 } else { best_table(group, &lens) };
+            for &b in *group {
+                table_freqs[selectors[g]][b as usize] += 1;
+            }
+        }
+        lens = table_freqs.iter().map(|f| table_lengths(f, &present)).collect();
+        if n_tables == 1 && pass == 0 {
+            break;
+        }
+    }
+
+    let mut w = BitWriter::new(out);
+    let ranges: u32 = (0..16).filter(|&r| present[r * 16..r * 16 + 16].contains(&true)).fold(0, |m, r| m | 0x8000 >> r);
+    w.put(ranges, 16);
+    for r in (0..16).filter(|&r| ranges & 0x8000 >> r != 0) {
+        w.put((0..16).filter(|&i| present[r * 16 + i]).fold(0, |m, i| m | 0x8000 >> i), 16);
+    }
+    w.put(n_tables as u32 - 1, 3);
+    for l in &lens {
+        let mut cur = l[used[0]] as u32;
+        w.put(cur, 5);
+        for &s in used {
+            let target = l[s] as u32;
+            while cur != target {
+                if cur < target {
+                    w.put(0b10, 2);
+                    cur += 1;
+                } else {
+                    w.put(0b11, 2);
+                    cur -= 1;
+                }
+            }
+            w.put(0, 1);
+        }
+    }
+    let mut mtf: Vec<usize> = (0..n_tables).collect();
+    for &sel in &selectors {
+        let pos = mtf.iter().position(|&t| t == sel).unwrap();
+        mtf.remove(pos);
+        mtf.insert(0, sel);
+        for _ in 0..pos {
+            w.put(1, 1);
+        }
+        if pos + 1 < n_tables {
+            w.put(0, 1);
+        }
+    }
+    let codes: Vec<Vec<u32>> = lens.iter().map(|l| canonical_codes(l)).collect();
+    for (g, group) in groups.iter().enumerate() {
+        let (l, c) = (&lens[selectors[g]], &codes[selectors[g]]);
+        for &b in *group {
+            w.put(c[b as usize], l[b as usize] as u32);
+        }
+    }
+    w.finish();
+}
+
+impl BlockCodec for Djw {
+    const MAGIC: [u8; 4] = MAGIC;
+    const NAME: &'static str = "djw";
+
+    fn encode(raw: &[u8], level: Option<u32>, out: &mut Vec<u8>) {
+        let n_tables = Djw::tables(raw.len(), level);
+        let passes = PASSES[level.unwrap_or(DEFAULT_LEVEL) as usize];
+        let mut present = [false; 256];
+        for &b in raw {
+            present[b as usize] = true;
+        }
+        let used: Vec<usize> = (0..256).filter(|&s| present[s]).collect();
+        let start = out.len();
+        encode_tables(raw, &used, n_tables, passes, out);
+        if n_tables > 1 {
+            let mut one = Vec::new();
+            encode_tables(raw, &used, 1, 0, &mut one);
+            if one.len() <= out.len() - start {
+                out.truncate(start);
+                out.extend_from_slice(&one);
+            }
+        }
+    }
+
+    fn decode(coded: &[u8], raw_len: usize, out: &mut Vec<u8>) -> Result<(), XDeltaError> {
+        let corrupt = |msg: &str| XDeltaError::Corrupt(format!("invalid djw stream: {}", msg));
+        out.clear();
+        let mut r = BitReader::new(coded, Self::NAME);
+        let ranges = r.bits(16)?;
+        let mut used = Vec::new();
+        for range in (0..16).filter(|&i| ranges & 0x8000 >> i != 0) {
+            let bits = r.bits(16)?;
+            used.extend((0..16).filter(|&i| bits & 0x8000 >> i != 0).map(|i| range * 16 + i));
+        }
+        if used.is_empty() {
+            return Err(corrupt("no symbols in use"));
+        }
+        let n_tables = r.bits(3)? as usize + 1;
+        let mut tables = Vec::with_capacity(n_tables);
+        for _ in 0..n_tables {
+            let mut lens = [0u8; 256];
+            let mut cur = r.bits(5)?;
+            for &s in &used {
+                loop {
+                    // every symbol in use has a code
+                    if cur == 0 || cur as usize > MAX_CODE_LEN {
+                        return Err(corrupt("code length out of range"));
+                    }
+                    if r.bit()? == 0 {
+                        break;
+                    }
+                    if r.bit()? == 0 {
+                        cur += 1;
+                    } else {
+                        cur -= 1;
+                    }
+                }
+                lens[s] = cur as u8;
+            }
+            tables.push(CanonicalDecoder::new(&lens, Self::NAME)?);
+        }
+        let n_groups = raw_len.div_ceil(GROUP_LEN);
+        let mut selectors = Vec::with_capacity(n_groups);
+        let mut mtf: Vec<usize> = (0..n_tables).collect();
+        for _ in 0..n_groups {
+            let mut pos = 0;
+            while pos + 1 < n_tables && r.bit()? == 1 {
+                pos += 1;
+            }
+            let sel = mtf.remove(pos);
+            mtf.insert(0, sel);
+            selectors.push(sel);
+        }
+        out.reserve(raw_len);
+        for (g, &sel) in selectors.iter().enumerate() {
+            let n = usize::min(GROUP_LEN, raw_len - g * GROUP_LEN);
+            for _ in 0..n {
+                out.push(tables[sel].decode(&mut r)? as u8);
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::huffman::{FramedDecoder, FramedEncoder};
+
+    fn compress(data: &[u8], level: Option<u32>) -> Vec<u8> {
+        let mut enc = FramedEncoder::<Djw>::new(level);
+        let mut out = Vec::new();
+        enc.write(data, &mut out);
+        enc.finish(&mut out);
+        out
+    }
+
+    fn decompress(stream: &[u8]) -> Result<Vec<u8>, XDeltaError> {
+        let mut dec = FramedDecoder::<Djw>::new();
+        let mut out = Vec::new();
+        dec.feed(stream, &mut |b: &[u8]| {
+            out.extend_from_slice(b);
+            Ok(())
+        })?;
+        if !dec.ended() {
+            return Err(XDeltaError::Corrupt("truncated".into()));
+        }
+        Ok(out)
+    }
+
+    /// Text-like data whose statistics change halfway, so several tables pay off.
+    fn fixture(n: usize) -> Vec<u8> {
+        let mut x = 12345u32;
+        (0..n)
+            .map(|i| {
+                x = x.wrapping_mul(1103515245).wrapping_add(12345);
+                let r = (x >> 16) as usize;
+                if i < n / 2 {
+                    b"etaoin shrdlu"[r % 13]
+                } else {
+                    b"0123456789abcdef"[r % 16]
+                }
+            })
+            .collect()
+    }
+
+    #[test]
+    fn round_trip() {
+        for n in [0, 1, 31, 32, 33, 1000, 70_000, 300_000] {
+            let data = fixture(n);
+            for level in [None, Some(0), Some(9)] {
+                let stream = compress(&data, level);
+                assert_eq!(decompress(&stream).unwrap(), data, "{} bytes, level {:?}", n, level);
+            }
+        }
+    }
+
+    #[test]
+    fn compresses_skewed_data() {
+        let data = fixture(100_000);
+        let stream = compress(&data, None);
+        // 13 or 16 symbols take about 4 bits each
+        assert!(stream.len() < data.len() * 6 / 10, "{} bytes from {}", stream.len(), data.len());
+    }
+
+    #[test]
+    fn more_tables_help_mixed_data() {
+        let data = fixture(100_000);
+        let one = compress(&data, Some(0));
+        let many = compress(&data, Some(9));
+        assert!(many.len() < one.len(), "{} bytes with several tables, {} with one", many.len(), one.len());
+    }
+
+    #[test]
+    fn single_symbol_and_all_symbols() {
+        let same = vec![7u8; 5000];
+        assert_eq!(decompress(&compress(&same, None)).unwrap(), same);
+        let all: Vec<u8> = (0..=255).cycle().take(5000).collect();
+        assert_eq!(decompress(&compress(&all, None)).unwrap(), all);
+    }
+
+    #[test]
+    fn blocks_span_the_block_limit() {
+        let data = fixture(crate::huffman::BLOCK_MAX * 2 + 100);
+        assert_eq!(decompress(&compress(&data, Some(1))).unwrap(), data);
+    }
+
+    #[test]
+    fn truncated_and_corrupt_streams() {
+        let data = fixture(10_000);
+        let stream = compress(&data, None);
+        for cut in [0, 3, 4, 10, stream.len() / 2, stream.len() - 1] {
+            assert!(decompress(&stream[..cut]).is_err(), "cut at {}", cut);
+        }
+        let mut bad = stream.clone();
+        bad[0] ^= 1;
+        assert!(decompress(&bad).is_err());
+        // flip a bit in the coded data: the decode or the CRC check must fail
+        let mut bad = stream.clone();
+        bad[40] ^= 0x10;
+        assert!(decompress(&bad).is_err());
+        let mut trailing = stream.clone();
+        trailing.push(0);
+        assert!(decompress(&trailing).is_err());
+    }
+
+    #[test]
+    fn incompressible_blocks_are_stored() {
+        let mut x = 1u64;
+        let data: Vec<u8> = (0..5000)
+            .map(|_| {
+                x ^= x << 13;
+                x ^= x >> 7;
+                x ^= x << 17;
+                x as u8
+            })
+            .collect();
+        let stream = compress(&data, None);
+        assert_eq!(stream.len(), 4 + 12 + data.len() + 4);
+        assert_eq!(decompress(&stream).unwrap(), data);
+    }
+
+    #[test]
+    fn every_cut_and_flipped_byte_is_rejected() {
+        // two blocks, one coded with several tables and one stored
+        let mut data = fixture(3000);
+        data.extend_from_slice(&crate::fixtures::noise(300));
+        let mut enc = FramedEncoder::<Djw>::new(Some(9));
+        let mut stream = Vec::new();
+        enc.write(&data[..3000], &mut stream);
+        enc.flush(&mut stream);
+        enc.write(&data[3000..], &mut stream);
+        enc.finish(&mut stream);
+        assert_eq!(decompress(&stream).unwrap(), data);
+        crate::fixtures::check_malformed(&data, &stream, decompress);
+    }
+
+    #[test]
+    fn block_headers_out_of_range_are_rejected() {
+        let header = |raw: u32, coded: u32| {
+            let mut s = MAGIC.to_vec();
+            s.extend_from_slice(&raw.to_le_bytes());
+            s.extend_from_slice(&coded.to_le_bytes());
+            s.extend_from_slice(&[0; 4]);
+            s
+        };
+        let max = crate::huffman::BLOCK_MAX as u32;
+        for (raw, coded) in [(max + 1, 10), (100, 0), (100, 100), (100, 200), (100, 0x8000_0000 | 99), (u32::MAX, u32::MAX)] {
+            assert!(
+                matches!(decompress(&header(raw, coded)), Err(XDeltaError::Corrupt(_))),
+                "raw {} coded {:#x}",
+                raw,
+                coded
+            );
+        }
+    }
+
+    #[test]
+    fn decodes_a_stream_fed_in_pieces() {
+        let data = fixture(70_000);
+        let stream = compress(&data, None);
+        for step in [1, 7, 4096] {
+            let mut dec = FramedDecoder::<Djw>::new();
+            let mut out = Vec::new();
+            for piece in stream.chunks(step) {
+                dec.feed(piece, &mut |b: &[u8]| {
+                    out.extend_from_slice(b);
+                    Ok(())
+                })
+                .unwrap();
+            }
+            assert!(dec.ended());
+            assert_eq!(out, data, "pieces of {} bytes", step);
+        }
+    }
+}
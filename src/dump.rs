@@ -0,0 +1,118 @@
+// src/dump.rs
+//! Text listing of a patch, the equivalent of `xdelta3 printdelta`.
+//!
+//! The decoder walks the patch in validation mode, so no source is needed
+//! and nothing is reconstructed. Lines are written as the headers and
+//! instructions are reached; when the patch turns out to be corrupt,
+//! everything up to the bad record has been listed before the error.
+use std::io::Write;
+
+use crate::compress::Secondary;
+use crate::decoder::{CopyFrom, Decoder, Event, NoSource};
+use crate::vcdiff;
+use crate::XDeltaError;
+
+fn io_err(e: std::io::Error) -> XDeltaError {
+    XDeltaError::Io(e.to_string())
+}
+
+/// Write the listing of `patch` to `out`; with `instructions` every ADD,
+/// COPY, RUN, CHECKSUM and END is listed as well, otherwise only headers and totals.
+pub(crate) fn dump_patch<W: Write>(patch: &[u8], instructions: bool, out: &mut W) -> Result<(), XDeltaError> {
+    let is_vcdiff = patch.first() == Some(&vcdiff::MAGIC[0]);
+    if is_vcdiff {
+        writeln!(out, "format: vcdiff").map_err(io_err)?;
+    } else {
+        let secondary = patch.first().map_or(Secondary::None, |&b| Secondary::detect(b));
+        writeln!(out, "format: native\nsecondary: {}", secondary.name()).map_err(io_err)?;
+    }
+
+    let mut dec = Decoder::new(NoSource(None));
+    dec.set_validate_only();
+    let mut window = 0u64;
+    // target offset of the current window and of the next one
+    let (mut start, mut next) = (0u64, 0u64);
+    let mut trace = |e: &Event| -> Result<(), XDeltaError> {
+        match *e {
+            Event::Header {
+                indicator,
+                secondary,
+                app_header,
+            } => {
+                writeln!(out, "header indicator: {}", vcdiff::indicator_names(indicator, false)).map_err(io_err)?;
+                let name = secondary.map_or("none", vcdiff::secondary_name);
+                writeln!(out, "secondary: {}", name).map_err(io_err)?;
+                if let Some(app) = app_header {
+                    writeln!(out, "app header: \"{}\"", app.escape_ascii()).map_err(io_err)?;
+                }
+            }
+            Event::Window {
+                indicator,
+                source,
+                target_len,
+                checksum,
+                sections: [data, inst, addr],
+            } => {
+                start = next;
+                next = next.saturating_add(target_len);
+                writeln!(out, "window {}: indicator {}", window, vcdiff::indicator_names(indicator, true))
+                    .map_err(io_err)?;
+                window += 1;
+                match source {
+                    Some((at, len)) => writeln!(out, "  source: offset {} length {}", at, len),
+                    None => writeln!(out, "  source: none"),
+                }
+                .map_err(io_err)?;
+                writeln!(out, "  target: offset {} length {}", start, target_len).map_err(io_err)?;
+                match checksum {
+                    Some(sum) => writeln!(out, "  adler32: {:#010x}", sum),
+                    None => writeln!(out, "  adler32: none"),
+                }
+                .map_err(io_err)?;
+                writeln!(out, "  sections: data {} inst {} addr {}", data, inst, addr).map_err(io_err)?;
+            }
+            Event::Add { at, len } if instructions => {
+                writeln!(out, "    {:012} ADD {}", start + at, len).map_err(io_err)?;
+            }
+            Event::Run { at, len, byte } if instructions => {
+                writeln!(out, "    {:012} RUN {} {:#04x}", start + at, len, byte).map_err(io_err)?;
+            }
+            Event::Copy { at, len, from } if instructions => {
+                match from {
+                    CopyFrom::Source(off) => writeln!(out, "    {:012} COPY {} S@{}", start + at, len, off),
+                    CopyFrom::Target(off) => writeln!(out, "    {:012} COPY {} T@{}", start + at, len, start + off),
+                }
+                .map_err(io_err)?;
+            }
+            Event::Checksum { at, kind, sum } if instructions => {
+                let width = 2 + 2 * kind.len();
+                writeln!(out, "    {:012} CHECKSUM {} {:#0width$x}", start + at, kind.name(), sum, width = width)
+                    .map_err(io_err)?;
+            }
+            Event::End { at } if instructions => {
+                writeln!(out, "    {:012} END", at).map_err(io_err)?;
+            }
+            _ => {}
+        }
+        Ok(())
+    };
+    dec.write_traced(patch, &mut std::io::sink(), &mut trace)?;
+    dec.finish(&mut std::io::sink())?;
+
+    let info = dec.info();
+    if is_vcdiff {
+        writeln!(
+            out,
+            "total: windows {} instructions {} add {} copy {} run {} target {}",
+            info.windows, info.instructions, info.add_bytes, info.copy_bytes, info.run_bytes, info.target_size
+        )
+    } else {
+        writeln!(
+            out,
+            "total: records {} add {} copy {} target {}",
+            info.instructions, info.add_bytes, info.copy_bytes, info.target_size
+        )
+    }
+    .map_err(io_err)?;
+    out.flush().map_err(io_err)
+}
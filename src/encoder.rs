@@ -0,0 +1,1213 @@
+// src/encoder.rs
+use sha2::{Digest, Sha256};
+use std::collections::hash_map::Entry;
+use std::collections::HashMap;
+use std::io::{Read, Write};
+use std::sync::Arc;
+
+use crate::bsdiff;
+use crate::cancel::{self, CancelToken};
+use crate::cdc;
+use crate::checksum::{Checksum, RecordSums};
+use crate::compress::{Compression, Compressor, Secondary};
+use crate::logging::{log_at, DEBUG};
+use crate::stats;
+use crate::vcdiff::VcdiffWriter;
+use crate::XDeltaError;
+
+/// How much input is processed between two cancellation checks.
+pub(crate) const CANCEL_WINDOW: usize = 1024 * 1024;
+
+/// Size of the pieces of "new" data that are encoded independently when
+/// encoding on several threads. Pieces are cut at fixed offsets, so the patch
+/// is the same for every thread count above one.
+pub(crate) const PARALLEL_CHUNK: usize = 8 * 1024 * 1024;
+
+/// With fast matching, how many blocks are passed as ADD without looking
+/// for matches once a whole block of offsets has been tried in vain.
+const FAST_SKIP_BLOCKS: usize = 7;
+
+/// Flag or-ed into the C format argument to select fast matching
+/// (XDELTA_FORMAT_FLAG_FAST_MATCH in xdelta_interface.h).
+const FORMAT_FLAG_FAST_MATCH: i32 = 0x100;
+
+/// Flags or-ed into the C format argument to select the integrity checksum
+/// (XDELTA_FORMAT_FLAG_ADLER32 and XDELTA_FORMAT_FLAG_XXH3).
+const FORMAT_FLAG_ADLER32: i32 = 0x200;
+const FORMAT_FLAG_XXH3: i32 = 0x400;
+
+/// Bit OR-ed into the patch format to take the append-only shortcut when the
+/// new data starts with the whole source, see `append_patch`
+/// (XDELTA_FORMAT_FLAG_APPEND in xdelta_interface.h).
+const FORMAT_FLAG_APPEND: i32 = 0x800;
+
+/// Bits of the C format argument holding log2 of the average chunk length
+/// for content-defined chunking, 0 to match fixed blocks only, see `cdc`
+/// (XDELTA_FORMAT_CDC_SHIFT and XDELTA_FORMAT_CDC_MASK in xdelta_interface.h).
+const FORMAT_CDC_SHIFT: i32 = 12;
+const FORMAT_CDC_MASK: i32 = 0x1f << FORMAT_CDC_SHIFT;
+
+/// Flag or-ed into the C format argument to select lazy matching
+/// (XDELTA_FORMAT_FLAG_LAZY_MATCH in xdelta_interface.h).
+const FORMAT_FLAG_LAZY_MATCH: i32 = 0x20000;
+
+/// Bits of the C format argument holding the minimum number of contiguous
+/// matching blocks written as a COPY, 0 for every match
+/// (XDELTA_FORMAT_MIN_MATCH_SHIFT and XDELTA_FORMAT_MIN_MATCH_MASK).
+const FORMAT_MIN_MATCH_SHIFT: i32 = 18;
+const FORMAT_MIN_MATCH_MASK: i32 = 0xf << FORMAT_MIN_MATCH_SHIFT;
+
+/// Flag or-ed into the C format argument to end a native patch with an END
+/// record (XDELTA_FORMAT_FLAG_END in xdelta_interface.h).
+const FORMAT_FLAG_END: i32 = 0x400000;
+
+/// Contiguous matching blocks are merged into one COPY of at most this many
+/// bytes before it is written, see `Encoder::encode`.
+const MAX_MERGED_COPY: usize = 1 << 20;
+
+/// Upper bound for the thread count, which also bounds the memory of the
+/// file version (one piece per thread is buffered).
+const MAX_THREADS: usize = 256;
+
+/// Resolve the thread count passed from C: 1 keeps the sequential encoder
+/// (`None`), 0 encodes in pieces on every available core. A machine with a
+/// single core still cuts the pieces, so the patch does not depend on it.
+pub(crate) fn threads_from_c(threads: i32) -> Result<Option<usize>, XDeltaError> {
+    match threads {
+        0 => Ok(Some(std::thread::available_parallelism().map_or(1, |n| n.get()).min(MAX_THREADS))),
+        1 => Ok(None),
+        2.. if threads as usize <= MAX_THREADS => Ok(Some(threads as usize)),
+        _ => Err(XDeltaError::InvalidArg(format!("thread count {} is out of range [0, {}]", threads, MAX_THREADS))),
+    }
+}
+
+/// Run `f` on every item on its own scoped thread and collect the results in order.
+fn parallel_map<T: Sync, R: Send>(items: &[T], f: impl Fn(&T) -> R + Sync) -> Vec<R> {
+    std::thread::scope(|s| {
+        let f = &f;
+        let workers: Vec<_> = items.iter().map(|item| s.spawn(move || f(item))).collect();
+        workers
+            .into_iter()
+            .map(|w| w.join().unwrap_or_else(|e| std::panic::resume_unwind(e)))
+            .collect()
+    })
+}
+
+/// A simple rsync-style rolling checksum (a,b) described in rsync tech report.
+/// Weak checksum is (b << 16) | a (u32).
+#[derive(Clone, Copy, Debug)]
+struct Rolling {
+    a: u32,
+    b: u32,
+    len: usize,
+}
+impl Rolling {
+    fn from_slice(buf: &[u8]) -> Self {
+        let mut a: u32 = 0;
+        let mut b: u32 = 0;
+        for (i, &v) in buf.iter().enumerate() {
+            a = a.wrapping_add(v as u32);
+            b = b.wrapping_add((buf.len() - i) as u32 * v as u32);
+        }
+        Rolling {
+            a,
+            b,
+            len: buf.len(),
+        }
+    }
+
+    /// roll window: remove `prev` byte, add `next` byte
+    fn roll(&mut self, prev: u8, next: u8) {
+        let len = self.len as u32;
+        // based on rsync-style weak checksum updates
+        self.a = self.a.wrapping_sub(prev as u32).wrapping_add(next as u32);
+        self.b = self.b.wrapping_sub((len).wrapping_mul(prev as u32)).wrapping_add(self.a);
+    }
+
+    fn chksum(&self) -> u32 {
+        ((self.b & 0xffff_ffff) << 16) ^ (self.a & 0xffff)
+    }
+}
+
+/// Block signature entry
+struct SigEntry {
+    block_index: u64,
+    strong_hash: [u8; 32], // sha256
+}
+
+fn strong_hash(buf: &[u8]) -> [u8; 32] {
+    let mut hasher = Sha256::new();
+    hasher.update(buf);
+    let mut arr = [0u8; 32];
+    arr.copy_from_slice(&hasher.finalize());
+    arr
+}
+
+/// Magic of serialized signatures; like the Go envelope, the first byte is not
+/// the first byte of any patch format and 0D 0A exposes text-mode transfers.
+const SIGNATURE_MAGIC: [u8; 8] = [0x89, b'X', b'D', b'S', b'U', b'M', 0x0D, 0x0A];
+
+/// Revision of the serialized signature layout.
+const SIGNATURE_VERSION: u8 = 1;
+
+/// magic, version, block size (u32) and block count (u64)
+const SIGNATURE_HEADER: usize = 8 + 1 + 4 + 8;
+
+/// weak sum (u32) and SHA-256 of one block
+const SIGNATURE_ENTRY: usize = 4 + 32;
+
+/// Signatures of the "old" file, built block by block so the source never
+/// has to be resident in memory as a whole.
+pub(crate) struct Signatures {
+    block_size: usize,
+    map: HashMap<u32, Vec<SigEntry>>,
+    blocks: u64,
+}
+
+impl Signatures {
+    pub(crate) fn new(block_size: usize) -> Result<Self, XDeltaError> {
+        if block_size == 0 {
+            return Err(XDeltaError::InvalidArg("block_size must be > 0".into()));
+        }
+        Ok(Signatures {
+            block_size,
+            map: HashMap::new(),
+            blocks: 0,
+        })
+    }
+
+    /// Build signatures by reading the "old" file sequentially.
+    /// Returns the signatures and the number of bytes read.
+    pub(crate) fn from_reader<R: Read>(mut old: R, block_size: usize) -> Result<(Self, u64), XDeltaError> {
+        let mut sigs = Signatures::new(block_size)?;
+        let mut buf = vec![0u8; block_size];
+        let mut total: u64 = 0;
+        loop {
+            let n = read_full(&mut old, &mut buf)?;
+            if n == 0 {
+                break;
+            }
+            sigs.push_block(&buf[..n]);
+            total += n as u64;
+            if n < block_size {
+                break;
+            }
+        }
+        Ok((sigs, total))
+    }
+
+    /// Append the next block of the old file. Every block but the last must be
+    /// exactly `block_size` long.
+    fn push_block(&mut self, block: &[u8]) {
+        let (weak, strong) = block_hashes(block);
+        self.push_hashes(weak, strong);
+    }
+
+    fn push_hashes(&mut self, weak: u32, strong_hash: [u8; 32]) {
+        // Most weak sums occur once; the default first allocation of four
+        // entries would quadruple the size of the table.
+        self.map.entry(weak).or_insert_with(|| Vec::with_capacity(1)).push(SigEntry {
+            block_index: self.blocks,
+            strong_hash,
+        });
+        self.blocks += 1;
+    }
+
+    /// Index block `index` of the old data out of order, for a source window
+    /// that slides over it; returns the weak sum `remove_block` needs.
+    pub(crate) fn insert_block(&mut self, index: u64, block: &[u8]) -> u32 {
+        let (weak, strong_hash) = block_hashes(block);
+        self.map.entry(weak).or_insert_with(|| Vec::with_capacity(1)).push(SigEntry {
+            block_index: index,
+            strong_hash,
+        });
+        weak
+    }
+
+    /// Drop block `index` again once the window has moved past it.
+    pub(crate) fn remove_block(&mut self, index: u64, weak: u32) {
+        if let Entry::Occupied(mut e) = self.map.entry(weak) {
+            let entries = e.get_mut();
+            if let Some(i) = entries.iter().position(|s| s.block_index == index) {
+                entries.remove(i);
+            }
+            if entries.is_empty() {
+                e.remove();
+            }
+        }
+    }
+
+    /// Serialize the signatures for a peer that encodes against them without
+    /// the source (little endian): SIGNATURE_MAGIC, SIGNATURE_VERSION, the
+    /// block size as u32 and the block count as u64, then for every block in
+    /// order its weak sum as u32 and its SHA-256.
+    pub(crate) fn to_bytes(&self) -> Vec<u8> {
+        let mut entries = vec![[0u8; SIGNATURE_ENTRY]; self.blocks as usize];
+        for (weak, list) in &self.map {
+            for e in list {
+                let entry = &mut entries[e.block_index as usize];
+                entry[..4].copy_from_slice(&weak.to_le_bytes());
+                entry[4..].copy_from_slice(&e.strong_hash);
+            }
+        }
+        let mut out = Vec::with_capacity(SIGNATURE_HEADER + entries.len() * SIGNATURE_ENTRY);
+        out.extend_from_slice(&SIGNATURE_MAGIC);
+        out.push(SIGNATURE_VERSION);
+        out.extend_from_slice(&(self.block_size as u32).to_le_bytes());
+        out.extend_from_slice(&self.blocks.to_le_bytes());
+        for entry in &entries {
+            out.extend_from_slice(entry);
+        }
+        out
+    }
+
+    /// Parse signatures serialized by `to_bytes`.
+    pub(crate) fn from_bytes(data: &[u8]) -> Result<Self, XDeltaError> {
+        if data.len() < SIGNATURE_MAGIC.len() + 1 || data[..SIGNATURE_MAGIC.len()] != SIGNATURE_MAGIC {
+            return Err(XDeltaError::Corrupt("missing signature magic".into()));
+        }
+        let version = data[SIGNATURE_MAGIC.len()];
+        if version != SIGNATURE_VERSION {
+            return Err(XDeltaError::Unsupported(format!("signature version {}", version)));
+        }
+        if data.len() < SIGNATURE_HEADER {
+            return Err(XDeltaError::Corrupt("truncated signature header".into()));
+        }
+        let block_size = u32::from_le_bytes(data[9..13].try_into().unwrap()) as usize;
+        let blocks = u64::from_le_bytes(data[13..21].try_into().unwrap());
+        if block_size == 0 {
+            return Err(XDeltaError::Corrupt("signature block size is 0".into()));
+        }
+        let body = &data[SIGNATURE_HEADER..];
+        if blocks.checked_mul(SIGNATURE_ENTRY as u64) != Some(body.len() as u64) {
+            return Err(XDeltaError::Corrupt(format!(
+                "signature of {} blocks has {} bytes of block sums",
+                blocks,
+                body.len()
+            )));
+        }
+        let mut sigs = Signatures::new(block_size)?;
+        sigs.map.reserve(blocks as usize);
+        for entry in body.chunks_exact(SIGNATURE_ENTRY) {
+            let weak = u32::from_le_bytes(entry[..4].try_into().unwrap());
+            sigs.push_hashes(weak, entry[4..].try_into().unwrap());
+        }
+        Ok(sigs)
+    }
+
+    fn lookup(&self, weak: u32, window: &[u8]) -> Option<u64> {
+        let candidates = self.map.get(&weak)?;
+        // Compute strong for this window and compare
+        let strong = strong_hash(window);
+        candidates
+            .iter()
+            .find(|e| e.strong_hash == strong)
+            .map(|e| e.block_index * (self.block_size as u64))
+    }
+
+    /// Like `lookup`, but returns `prefer` if the block at that source offset
+    /// is one of the matches. The entries of a weak sum are in block order
+    /// (blocks are only appended, or slide in and out of a window in order),
+    /// so the preferred one is found by bisection even among many equal blocks.
+    fn lookup_preferring(&self, weak: u32, window: &[u8], prefer: u64) -> Option<u64> {
+        let candidates = self.map.get(&weak)?;
+        let strong = strong_hash(window);
+        let block_size = self.block_size as u64;
+        if prefer % block_size == 0 {
+            if let Ok(i) = candidates.binary_search_by_key(&(prefer / block_size), |e| e.block_index) {
+                if candidates[i].strong_hash == strong {
+                    return Some(prefer);
+                }
+            }
+        }
+        candidates
+            .iter()
+            .find(|e| e.strong_hash == strong)
+            .map(|e| e.block_index * block_size)
+    }
+}
+
+fn block_hashes(block: &[u8]) -> (u32, [u8; 32]) {
+    (Rolling::from_slice(block).chksum(), strong_hash(block))
+}
+
+/// Incremental signature builder for an "old" file that arrives in
+/// arbitrarily sized chunks.
+pub(crate) struct SignatureBuilder {
+    sigs: Signatures,
+    partial: Vec<u8>,
+}
+
+impl SignatureBuilder {
+    pub(crate) fn new(block_size: usize) -> Result<Self, XDeltaError> {
+        Ok(SignatureBuilder {
+            sigs: Signatures::new(block_size)?,
+            partial: Vec::with_capacity(block_size),
+        })
+    }
+
+    pub(crate) fn write(&mut self, mut data: &[u8]) {
+        let block_size = self.sigs.block_size;
+        if !self.partial.is_empty() {
+            let n = usize::min(block_size - self.partial.len(), data.len());
+            self.partial.extend_from_slice(&data[..n]);
+            data = &data[n..];
+            if self.partial.len() < block_size {
+                return;
+            }
+            let block = std::mem::take(&mut self.partial);
+            self.sigs.push_block(&block);
+            self.partial = block;
+            self.partial.clear();
+        }
+        let mut blocks = data.chunks_exact(block_size);
+        for block in &mut blocks {
+            self.sigs.push_block(block);
+        }
+        self.partial.extend_from_slice(blocks.remainder());
+    }
+
+    /// Same as `write`, with the blocks hashed on up to `threads` threads.
+    /// The signatures are identical to the ones `write` builds.
+    pub(crate) fn write_parallel(&mut self, mut data: &[u8], threads: usize) {
+        let block_size = self.sigs.block_size;
+        if !self.partial.is_empty() {
+            let n = usize::min(block_size - self.partial.len(), data.len());
+            self.write(&data[..n]);
+            data = &data[n..];
+        }
+        let blocks = data.len() / block_size;
+        if threads <= 1 || blocks < 2 {
+            self.write(data);
+            return;
+        }
+        let (whole, rest) = data.split_at(blocks * block_size);
+        let parts: Vec<&[u8]> = whole.chunks(blocks.div_ceil(threads) * block_size).collect();
+        let hashes = parallel_map(&parts, |part| part.chunks_exact(block_size).map(block_hashes).collect::<Vec<_>>());
+        for (weak, strong) in hashes.into_iter().flatten() {
+            self.sigs.push_hashes(weak, strong);
+        }
+        self.write(rest);
+    }
+
+    /// Whether nothing has been written yet.
+    pub(crate) fn is_empty(&self) -> bool {
+        self.sigs.blocks == 0 && self.partial.is_empty()
+    }
+
+    /// Seal the source: the trailing short block (if any) gets its signature.
+    pub(crate) fn finish(mut self) -> Signatures {
+        if !self.partial.is_empty() {
+            self.sigs.push_block(&self.partial);
+        }
+        self.sigs
+    }
+}
+
+/// Fill `buf` as far as possible; returns the number of bytes read (short only at EOF).
+pub(crate) fn read_full<R: Read>(r: &mut R, buf: &mut [u8]) -> Result<usize, XDeltaError> {
+    let mut n = 0;
+    while n < buf.len() {
+        match r.read(&mut buf[n..]) {
+            Ok(0) => break,
+            Ok(m) => n += m,
+            Err(e) if e.kind() == std::io::ErrorKind::Interrupted => continue,
+            Err(e) => return Err(XDeltaError::Io(e.to_string())),
+        }
+    }
+    Ok(n)
+}
+
+/// Patch format produced by the encoder. Values match XDELTA_FORMAT_* in xdelta_interface.h.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub(crate) enum Format {
+    /// the records below, optionally with secondary compression
+    Native,
+    /// RFC 3284, readable by xdelta3 and other VCDIFF decoders
+    Vcdiff,
+    /// bsdiff 4.x, readable by bspatch; only for in-memory old and new data
+    Bsdiff,
+}
+
+/// How `Encoder::encode` looks for matches and turns them into COPYs.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Matching {
+    /// stop looking for matches in stretches that have none
+    pub(crate) fast: bool,
+    /// collect contiguous matching blocks into runs, preferring the block that
+    /// continues the run, and write every run as one COPY
+    pub(crate) lazy: bool,
+    /// runs of fewer contiguous matching blocks are written as ADD, 0 or 1 for
+    /// none; above 1 blocks are collected into runs as with `lazy`
+    pub(crate) min_match: usize,
+}
+
+impl Matching {
+    pub(crate) const GREEDY: Matching = Matching {
+        fast: false,
+        lazy: false,
+        min_match: 0,
+    };
+
+    /// Whether contiguous matching blocks are collected into runs before
+    /// they are written; otherwise every block is its own COPY as it is found.
+    fn runs(&self) -> bool {
+        self.lazy || self.min_match > 1
+    }
+}
+
+/// Everything that decides how records are turned into patch bytes.
+#[derive(Clone, Copy, Debug)]
+pub(crate) struct Encoding {
+    pub(crate) format: Format,
+    pub(crate) compression: Compression,
+    /// how matches are found and written, see `Encoder::encode`
+    pub(crate) matching: Matching,
+    /// checksum over the target written into the patch, see `checksum`
+    pub(crate) checksum: Option<Checksum>,
+    /// encode new data that starts with the whole source without matching, see `append_patch`
+    pub(crate) append: bool,
+    /// average chunk length of content-defined chunking, 0 if off, see `cdc`
+    pub(crate) cdc: usize,
+    /// end a native patch with an END record
+    pub(crate) end: bool,
+}
+
+impl Encoding {
+    pub(crate) const NATIVE: Encoding = Encoding {
+        format: Format::Native,
+        compression: Compression::NONE,
+        matching: Matching::GREEDY,
+        checksum: None,
+        append: false,
+        cdc: 0,
+        end: false,
+    };
+
+    pub(crate) fn from_c(format: i32, secondary: i32, level: i32) -> Result<Self, XDeltaError> {
+        let matching = Matching {
+            fast: format & FORMAT_FLAG_FAST_MATCH != 0,
+            lazy: format & FORMAT_FLAG_LAZY_MATCH != 0,
+            min_match: ((format & FORMAT_MIN_MATCH_MASK) >> FORMAT_MIN_MATCH_SHIFT) as usize,
+        };
+        let append = format & FORMAT_FLAG_APPEND != 0;
+        let end = format & FORMAT_FLAG_END != 0;
+        let checksum = match format & (FORMAT_FLAG_ADLER32 | FORMAT_FLAG_XXH3) {
+            0 => None,
+            FORMAT_FLAG_ADLER32 => Some(Checksum::Adler32),
+            FORMAT_FLAG_XXH3 => Some(Checksum::Xxh3),
+            _ => return Err(XDeltaError::InvalidArg("more than one checksum selected".into())),
+        };
+        let cdc = match (format & FORMAT_CDC_MASK) >> FORMAT_CDC_SHIFT {
+            0 => 0,
+            shift if (cdc::MIN_AVG_SHIFT..=cdc::MAX_AVG_SHIFT).contains(&shift) => 1usize << shift,
+            shift => {
+                return Err(XDeltaError::InvalidArg(format!(
+                    "average chunk length 2^{} is out of range [2^{}, 2^{}]",
+                    shift,
+                    cdc::MIN_AVG_SHIFT,
+                    cdc::MAX_AVG_SHIFT
+                )))
+            }
+        };
+        let flags = FORMAT_FLAG_FAST_MATCH
+            | FORMAT_FLAG_ADLER32
+            | FORMAT_FLAG_XXH3
+            | FORMAT_FLAG_APPEND
+            | FORMAT_CDC_MASK
+            | FORMAT_FLAG_LAZY_MATCH
+            | FORMAT_MIN_MATCH_MASK
+            | FORMAT_FLAG_END;
+        let format = match format & !flags {
+            0 => Format::Native,
+            1 => Format::Vcdiff,
+            2 => Format::Bsdiff,
+            other => return Err(XDeltaError::InvalidArg(format!("unknown patch format {}", other))),
+        };
+        let compression = Compression::from_c(secondary, level)?;
+        if format == Format::Vcdiff && compression.secondary != Secondary::None {
+            return Err(XDeltaError::InvalidArg(
+                "secondary compression is not available for VCDIFF output".into(),
+            ));
+        }
+        if format == Format::Vcdiff && checksum == Some(Checksum::Xxh3) {
+            return Err(XDeltaError::InvalidArg("VCDIFF output only carries adler32 checksums".into()));
+        }
+        if format != Format::Native && end {
+            return Err(XDeltaError::InvalidArg("only native patches have an END record".into()));
+        }
+        if format == Format::Bsdiff && (compression.secondary != Secondary::None || checksum.is_some() || cdc > 0) {
+            return Err(XDeltaError::InvalidArg(
+                "bsdiff output takes no secondary compression, checksums or content-defined chunking".into(),
+            ));
+        }
+        Ok(Encoding {
+            format,
+            compression,
+            matching,
+            checksum,
+            append,
+            cdc,
+            end,
+        })
+    }
+}
+
+/// Where finished records go; native records get their CHECKSUM records on the way.
+enum Sink {
+    Native(Compressor, Option<RecordSums>),
+    Vcdiff(VcdiffWriter),
+}
+
+/// Streaming encoder: the "new" data is fed in arbitrary chunks and patch
+/// records are appended to `out` as soon as they are decided.
+///
+/// Patch format (simple custom):
+/// [records...] where each record is:
+/// opcode: u8 (0x00 = ADD, 0x01 = COPY)
+/// If ADD:
+///   length: u32 (little-endian)
+///   data: [length] bytes
+/// If COPY:
+///   offset: u64 (little-endian)  // offset in old file
+///   length: u32 (little-endian)
+/// Opcode 0x02 is a CHECKSUM record, see `checksum`.
+/// With XDELTA_FORMAT_FLAG_END the first record is HEADER (0x05) with the
+/// format revision as a u8 and the last is END (0x03) with the target length
+/// as a u64 (little-endian): a patch that starts with HEADER has to end with
+/// END, so one cut anywhere, even between two records, is rejected instead of
+/// producing a short target. Without the flag the patch has neither record
+/// and ends after its last record, as patches always did; decoders accept
+/// both.
+///
+/// This is simple, versionable, and easy to apply.
+///
+/// With secondary compression the record stream is additionally compressed
+/// as a whole; the decoder recognises it by the first byte. For VCDIFF output
+/// the records are re-encoded by `VcdiffWriter` instead.
+pub(crate) struct Encoder {
+    /// shared with other encoders diffing against the same source
+    sigs: Arc<Signatures>,
+    /// unconsumed "new" bytes, `buf[pos..]` is still to be encoded
+    buf: Vec<u8>,
+    pos: usize,
+    /// rolling checksum of the full window at `pos`, if still valid
+    rolling: Option<Rolling>,
+    pending_add: Vec<u8>,
+    /// records not yet passed to the sink
+    records: Vec<u8>,
+    /// the target bytes `records` produce, collected only for checksums
+    target: Vec<u8>,
+    summing: bool,
+    /// records with CHECKSUM records inserted, on their way to the compressor
+    summed: Vec<u8>,
+    sink: Sink,
+    out: Vec<u8>,
+    /// whether any record has been produced yet
+    emitted: bool,
+    /// "new" bytes fed so far, for diagnostics
+    input: u64,
+    matching: Matching,
+    /// offsets tried in a row without a match, for fast matching
+    misses: usize,
+    /// the run of contiguous matching blocks not written yet, when matching
+    /// collects runs: source offset and the new bytes it produces
+    run: Option<u64>,
+    run_data: Vec<u8>,
+    /// the run continues one already written as a COPY, so it is kept however short
+    run_kept: bool,
+    /// added to every COPY offset, for a source that is a slice of the old data
+    source_base: u64,
+    /// the patch starts with a HEADER record, write the END record in `finish` (XDELTA_FORMAT_FLAG_END)
+    terminate: bool,
+}
+
+impl Encoder {
+    pub(crate) fn new(sigs: Arc<Signatures>, encoding: Encoding) -> Result<Self, XDeltaError> {
+        let mut sink = match encoding.format {
+            Format::Native => {
+                Sink::Native(Compressor::new(encoding.compression)?, encoding.checksum.map(RecordSums::new))
+            }
+            Format::Vcdiff => Sink::Vcdiff(VcdiffWriter::new(encoding.checksum.is_some())),
+            Format::Bsdiff => {
+                return Err(XDeltaError::InvalidArg(
+                    "bsdiff patches can only be created from in-memory data".into(),
+                ))
+            }
+        };
+        let mut out = Vec::new();
+        if let (Sink::Native(c, _), true) = (&mut sink, encoding.end) {
+            c.write(&[HEADER_RECORD, crate::version::FORMAT_VERSION as u8], &mut out)?;
+        }
+        Ok(Encoder {
+            sigs,
+            buf: Vec::new(),
+            pos: 0,
+            rolling: None,
+            pending_add: Vec::new(),
+            records: Vec::new(),
+            target: Vec::new(),
+            summing: encoding.checksum.is_some(),
+            summed: Vec::new(),
+            sink,
+            out,
+            emitted: false,
+            input: 0,
+            matching: encoding.matching,
+            misses: 0,
+            run: None,
+            run_data: Vec::new(),
+            run_kept: false,
+            source_base: 0,
+            terminate: encoding.end,
+        })
+    }
+
+    /// Shift every COPY offset by `base`, so a patch against old data that
+    /// starts at `base` copies from the whole old data. Only before any input.
+    pub(crate) fn set_source_base(&mut self, base: u64) -> Result<(), XDeltaError> {
+        if self.input > 0 {
+            return Err(XDeltaError::InvalidArg("source offset set after the first write".into()));
+        }
+        self.source_base = base;
+        Ok(())
+    }
+
+    /// Feed more "new" data. Only windows that can no longer change are encoded.
+    pub(crate) fn write(&mut self, data: &[u8]) -> Result<(), XDeltaError> {
+        if self.pos > 0 && self.pos >= self.buf.len() / 2 {
+            self.buf.drain(..self.pos);
+            self.pos = 0;
+        }
+        self.buf.extend_from_slice(data);
+        self.input += data.len() as u64;
+        stats::encoded(data.len() as u64);
+        self.encode(false);
+        self.pump()?;
+        log_at!(
+            DEBUG,
+            "encoder: window of {} bytes, {} bytes in, {} bytes pending, {} bytes of patch buffered",
+            data.len(),
+            self.input,
+            self.buf.len() - self.pos,
+            self.out.len()
+        );
+        Ok(())
+    }
+
+    /// Encode `data` on up to `threads` threads as independent pieces of
+    /// `PARALLEL_CHUNK` bytes: every piece is matched as if the input started
+    /// there, so no COPY spans two pieces, and the records are passed to the
+    /// sink in order. Nothing may be pending from earlier writes, so a caller
+    /// either uses `write` or this, and a short piece may only come last.
+    pub(crate) fn write_parallel(
+        &mut self,
+        data: &[u8],
+        threads: usize,
+        cancel: Option<&CancelToken>,
+    ) -> Result<(), XDeltaError> {
+        debug_assert!(self.pos == self.buf.len() && self.pending_add.is_empty());
+        for group in data.chunks(PARALLEL_CHUNK * threads) {
+            cancel::check(cancel)?;
+            let pieces: Vec<&[u8]> = group.chunks(PARALLEL_CHUNK).collect();
+            log_at!(DEBUG, "encoder: {} bytes in {} pieces on {} threads", group.len(), pieces.len(), threads);
+            // the piece encoders count the bytes for xdelta_native_stats
+            self.input += group.len() as u64;
+            let (sigs, matching, base) = (&self.sigs, self.matching, self.source_base);
+            let results = parallel_map(&pieces, |piece| piece_records(sigs, piece, matching, base, cancel));
+            for (records, piece) in results.into_iter().zip(&pieces) {
+                self.records.extend_from_slice(&records?);
+                if self.summing {
+                    self.target.extend_from_slice(piece);
+                }
+                self.emitted = true;
+                self.pump()?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Emit `data`, the source bytes at `offset`, as COPY records without
+    /// looking for matches. Nothing may be pending from earlier writes.
+    pub(crate) fn write_copy(&mut self, offset: u64, data: &[u8]) -> Result<(), XDeltaError> {
+        debug_assert!(self.pos == self.buf.len() && self.pending_add.is_empty());
+        let mut offset = offset + self.source_base;
+        for piece in data.chunks(PARALLEL_CHUNK) {
+            self.records.push(0x01); // COPY
+            self.records.extend_from_slice(&offset.to_le_bytes());
+            self.records.extend_from_slice(&(piece.len() as u32).to_le_bytes());
+            if self.summing {
+                self.target.extend_from_slice(piece);
+            }
+            offset += piece.len() as u64;
+            self.emitted = true;
+            self.pump()?;
+        }
+        self.input += data.len() as u64;
+        stats::encoded(data.len() as u64);
+        Ok(())
+    }
+
+    /// Emit `data` as ADD records without looking for matches. Nothing may
+    /// be pending from earlier writes.
+    pub(crate) fn write_literal(&mut self, data: &[u8]) -> Result<(), XDeltaError> {
+        debug_assert!(self.pos == self.buf.len() && self.pending_add.is_empty());
+        for piece in data.chunks(PARALLEL_CHUNK) {
+            push_add(&mut self.records, piece);
+            if self.summing {
+                self.target.extend_from_slice(piece);
+            }
+            self.emitted = true;
+            self.pump()?;
+        }
+        self.input += data.len() as u64;
+        stats::encoded(data.len() as u64);
+        Ok(())
+    }
+
+    /// Pass native `records` decided elsewhere, which produce `target`, to
+    /// the sink. Nothing may be pending from earlier writes.
+    pub(crate) fn write_records(&mut self, records: &[u8], target: &[u8]) -> Result<(), XDeltaError> {
+        debug_assert!(self.pos == self.buf.len() && self.pending_add.is_empty());
+        self.records.extend_from_slice(records);
+        if self.summing {
+            self.target.extend_from_slice(target);
+        }
+        self.input += target.len() as u64;
+        self.emitted = true;
+        self.pump()
+    }
+
+    /// Encode everything that is left and flush pending adds.
+    ///
+    /// An empty target still produces a single zero-length ADD record, so a
+    /// valid patch is never empty and an empty patch can be rejected as corrupt.
+    pub(crate) fn finish(&mut self) -> Result<(), XDeltaError> {
+        self.encode(true);
+        self.end_run();
+        self.flush_add();
+        if !self.emitted {
+            push_add(&mut self.records, &[]);
+            self.emitted = true;
+        }
+        self.pump()?;
+        self.close_sums()?;
+        match &mut self.sink {
+            Sink::Native(c, _) => {
+                if self.terminate {
+                    let mut end = Vec::with_capacity(END_RECORD_LEN);
+                    push_end(&mut end, self.input);
+                    c.write(&end, &mut self.out)?;
+                }
+                c.finish(&mut self.out)?
+            }
+            Sink::Vcdiff(v) => v.finish(&mut self.out),
+        }
+        log_at!(DEBUG, "encoder: finished after {} bytes in, {} bytes of patch buffered", self.input, self.out.len());
+        Ok(())
+    }
+
+    /// Force a window boundary: everything fed so far is encoded as if the
+    /// input ended here, but more data may still be written afterwards.
+    pub(crate) fn flush(&mut self) -> Result<(), XDeltaError> {
+        self.encode(true);
+        self.end_run();
+        self.flush_add();
+        self.buf.clear();
+        self.pos = 0;
+        self.rolling = None;
+        self.misses = 0;
+        self.pump()?;
+        self.close_sums()?;
+        match &mut self.sink {
+            Sink::Native(c, _) => c.flush(&mut self.out),
+            Sink::Vcdiff(v) => {
+                v.flush(&mut self.out);
+                Ok(())
+            }
+        }
+    }
+
+    /// The signatures of an encoder that does not share them, for a source
+    /// window that adds and removes blocks between writes.
+    pub(crate) fn signatures_mut(&mut self) -> &mut Signatures {
+        Arc::get_mut(&mut self.sigs).expect("signatures of a windowed encoder are not shared")
+    }
+
+    /// Patch bytes produced so far; the caller drains them.
+    pub(crate) fn output(&mut self) -> &mut Vec<u8> {
+        &mut self.out
+    }
+
+    /// Move the records decided so far through the sink into `out`.
+    fn pump(&mut self) -> Result<(), XDeltaError> {
+        match &mut self.sink {
+            Sink::Native(c, None) => c.write(&self.records, &mut self.out)?,
+            Sink::Native(c, Some(sums)) => {
+                sums.write(&self.records, &self.target, &mut self.summed);
+                c.write(&self.summed, &mut self.out)?;
+                self.summed.clear();
+            }
+            Sink::Vcdiff(v) => v.write(&self.records, &self.target, &mut self.out)?,
+        }
+        self.records.clear();
+        self.target.clear();
+        Ok(())
+    }
+
+    /// Close the open checksum window of a native patch.
+    fn close_sums(&mut self) -> Result<(), XDeltaError> {
+        if let Sink::Native(c, Some(sums)) = &mut self.sink {
+            sums.close(&mut self.summed);
+            c.write(&self.summed, &mut self.out)?;
+            self.summed.clear();
+        }
+        Ok(())
+    }
+
+    fn flush_add(&mut self) {
+        if !self.pending_add.is_empty() {
+            push_add(&mut self.records, &self.pending_add);
+            if self.summing {
+                self.target.extend_from_slice(&self.pending_add);
+            }
+            self.pending_add.clear();
+            self.emitted = true;
+        }
+    }
+
+    /// Add the `len` bytes at `pos`, which match the source at `offset`, to
+    /// the open run, first writing the run out if they do not continue it.
+    fn extend_run(&mut self, offset: u64, len: usize) {
+        let mut kept = false;
+        if let Some(start) = self.run {
+            if start + self.run_data.len() as u64 == offset {
+                if self.run_data.len() + len <= MAX_MERGED_COPY
+                    || self.run_data.len() < self.matching.min_match * self.sigs.block_size
+                {
+                    self.run_data.extend_from_slice(&self.buf[self.pos..self.pos + len]);
+                    return;
+                }
+                kept = true;
+            }
+        }
+        self.end_run();
+        self.run = Some(offset);
+        self.run_kept = kept;
+        self.run_data.extend_from_slice(&self.buf[self.pos..self.pos + len]);
+    }
+
+    /// Write out the open run as one COPY, or as ADD if it has fewer bytes
+    /// than `min_match` blocks.
+    fn end_run(&mut self) {
+        let Some(offset) = self.run.take() else {
+            return;
+        };
+        if !self.run_kept && self.run_data.len() < self.matching.min_match * self.sigs.block_size {
+            self.pending_add.extend_from_slice(&self.run_data);
+        } else {
+            self.flush_add();
+            self.records.push(0x01); // COPY
+            self.records.extend_from_slice(&(offset + self.source_base).to_le_bytes());
+            self.records.extend_from_slice(&(self.run_data.len() as u32).to_le_bytes());
+            if self.summing {
+                self.target.extend_from_slice(&self.run_data);
+            }
+            self.emitted = true;
+        }
+        self.run_data.clear();
+    }
+
+    /// With fast matching, once a whole block of consecutive offsets had no
+    /// match (which covers every alignment against the old blocks), the next
+    /// `FAST_SKIP_BLOCKS` blocks are passed as ADD without looking. Data
+    /// without matches, such as compressed files, is then hashed only once
+    /// every eight blocks; a matching stretch is found at most that late.
+    ///
+    /// Greedy matching writes every matching block as its own COPY. Lazy
+    /// matching and a minimum match length collect contiguous matching blocks
+    /// into one run (up to `MAX_MERGED_COPY` bytes), preferring among the
+    /// source blocks with the same hashes the one that continues it, and write
+    /// the run as a single COPY once it ends; runs shorter than `min_match`
+    /// blocks are written as ADD. None of this changes the format.
+    fn encode(&mut self, eof: bool) {
+        let block_size = self.sigs.block_size;
+        loop {
+            let remaining = self.buf.len() - self.pos;
+            if remaining == 0 || (!eof && remaining < block_size) {
+                break;
+            }
+            if self.matching.fast && self.misses >= block_size {
+                let skip = FAST_SKIP_BLOCKS * block_size;
+                if !eof && remaining < skip + block_size {
+                    // decide only once the data after the skip is known, so
+                    // the patch does not depend on how the input was chunked
+                    break;
+                }
+                let n = skip.min(remaining);
+                self.end_run();
+                self.pending_add.extend_from_slice(&self.buf[self.pos..self.pos + n]);
+                self.pos += n;
+                self.rolling = None;
+                self.misses = 0;
+                self.flush_add();
+                continue;
+            }
+            let try_len = usize::min(block_size, remaining);
+            let window = &self.buf[self.pos..self.pos + try_len];
+            let weak = match self.rolling {
+                Some(r) if try_len == block_size => r,
+                _ => Rolling::from_slice(window),
+            };
+
+            let found = match self.run {
+                Some(start) if self.matching.runs() => {
+                    self.sigs.lookup_preferring(weak.chksum(), window, start + self.run_data.len() as u64)
+                }
+                _ => self.sigs.lookup(weak.chksum(), window),
+            };
+            if let Some(offset_in_old) = found {
+                if self.matching.runs() {
+                    self.extend_run(offset_in_old, try_len);
+                    self.pos += try_len;
+                    self.rolling = None;
+                    self.misses = 0;
+                    continue;
+                }
+                // Found a match. Flush any pending adds.
+                self.flush_add();
+                self.records.push(0x01); // COPY
+                self.records.extend_from_slice(&(offset_in_old + self.source_base).to_le_bytes());
+                let copy_len = try_len as u32;
+                self.records.extend_from_slice(&copy_len.to_le_bytes());
+                if self.summing {
+                    self.target.extend_from_slice(&self.buf[self.pos..self.pos + try_len]);
+                }
+                self.emitted = true;
+                self.pos += try_len;
+                self.rolling = None;
+                self.misses = 0;
+                continue;
+            }
+
+            // sliding by 1 byte: add first byte to pending_add and continue
+            self.end_run();
+            let prev = self.buf[self.pos];
+            self.pending_add.push(prev);
+            self.pos += 1;
+            self.misses += 1;
+            self.rolling = if try_len == block_size && self.pos + block_size <= self.buf.len() {
+                let mut r = weak;
+                r.roll(prev, self.buf[self.pos + block_size - 1]);
+                Some(r)
+            } else {
+                None
+            };
+            // To avoid pathological O(n^2) behavior for huge pending_add, flush periodically:
+            if self.pending_add.len() >= block_size {
+                self.flush_add();
+            }
+        }
+    }
+}
+
+/// The native records of one piece of a parallel encoding.
+pub(crate) fn piece_records(
+    sigs: &Arc<Signatures>,
+    piece: &[u8],
+    matching: Matching,
+    base: u64,
+    cancel: Option<&CancelToken>,
+) -> Result<Vec<u8>, XDeltaError> {
+    let mut enc = Encoder::new(Arc::clone(sigs), Encoding { matching, ..Encoding::NATIVE })?;
+    enc.source_base = base;
+    for window in piece.chunks(CANCEL_WINDOW) {
+        cancel::check(cancel)?;
+        enc.write(window)?;
+    }
+    enc.finish()?;
+    Ok(std::mem::take(enc.output()))
+}
+
+pub(crate) fn push_add(out: &mut Vec<u8>, data: &[u8]) {
+    out.push(0x00); // ADD
+    out.extend_from_slice(&(data.len() as u32).to_le_bytes());
+    out.extend_from_slice(data);
+}
+
+/// Opcode of the optional record that ends a native patch. A patch has one
+/// exactly when it starts with a HEADER record.
+pub(crate) const END_RECORD: u8 = 0x03;
+/// Length of the END record: opcode and u64 target length.
+pub(crate) const END_RECORD_LEN: usize = 9;
+
+/// Opcode of the record that opens a native patch ending with an END record,
+/// followed by the format revision it was written with. 0x04 starts an LZ4
+/// frame, so the opcode is 0x05.
+pub(crate) const HEADER_RECORD: u8 = 0x05;
+/// Length of the HEADER record: opcode and u8 format revision.
+pub(crate) const HEADER_RECORD_LEN: usize = 2;
+
+/// Append the END record of a patch whose records produce `target_len` bytes.
+pub(crate) fn push_end(out: &mut Vec<u8>, target_len: u64) {
+    out.push(END_RECORD);
+    out.extend_from_slice(&target_len.to_le_bytes());
+}
+
+pub(crate) fn create_patch_bytes(old: &[u8], new: &[u8], block_size: usize) -> Result<Vec<u8>, XDeltaError> {
+    create_patch_bytes_cancel(old, new, block_size, Encoding::NATIVE, None, None)
+}
+
+/// Same as `create_patch_bytes` in the given encoding, in pieces on
+/// `threads` threads if given, checking `cancel` between windows.
+pub(crate) fn create_patch_bytes_cancel(
+    old: &[u8],
+    new: &[u8],
+    block_size: usize,
+    encoding: Encoding,
+    threads: Option<usize>,
+    cancel: Option<&CancelToken>,
+) -> Result<Vec<u8>, XDeltaError> {
+    let mut patch = Vec::new();
+    create_patch_to(old, new, block_size, encoding, threads, cancel, &mut patch)?;
+    Ok(patch)
+}
+
+/// Same as `create_patch_bytes_cancel`, writing the patch to `out` window by
+/// window as it is produced instead of collecting it; the bytes are the same.
+pub(crate) fn create_patch_to<W: Write>(
+    old: &[u8],
+    new: &[u8],
+    block_size: usize,
+    encoding: Encoding,
+    threads: Option<usize>,
+    cancel: Option<&CancelToken>,
+    out: &mut W,
+) -> Result<(), XDeltaError> {
+    if encoding.format == Format::Bsdiff {
+        return bsdiff::create_patch_to(old, new, cancel, out);
+    }
+    if append_patch(old, new, block_size, encoding, cancel, out)? {
+        return Ok(());
+    }
+    let sigs = build_signatures(old, block_size, threads, cancel)?;
+    if encoding.cdc > 0 {
+        return cdc::encode(old, &Arc::new(sigs), new, encoding, cancel, out);
+    }
+    encode_cancel_to(&Arc::new(sigs), new, encoding, threads, cancel, out)
+}
+
+/// With `encoding.append`, write the patch for `new` to `out` if it starts
+/// with all of a non-empty `old`: COPY records of the whole source followed
+/// by ADD records of the rest, without building signatures or looking for
+/// matches. `false` if the shortcut is off or does not apply, so the caller
+/// encodes normally; nothing has been written then.
+pub(crate) fn append_patch<W: Write>(
+    old: &[u8],
+    new: &[u8],
+    block_size: usize,
+    encoding: Encoding,
+    cancel: Option<&CancelToken>,
+    out: &mut W,
+) -> Result<bool, XDeltaError> {
+    if !encoding.append || old.is_empty() || !new.starts_with(old) {
+        return Ok(false);
+    }
+    log_at!(DEBUG, "encoder: new data is the {} source bytes plus {} appended", old.len(), new.len() - old.len());
+    let mut enc = Encoder::new(Arc::new(Signatures::new(block_size)?), encoding)?;
+    // the source is not indexed, so each of its windows counts for both old and new
+    for (i, window) in old.chunks(CANCEL_WINDOW).enumerate() {
+        cancel::check(cancel)?;
+        enc.write_copy((i * CANCEL_WINDOW) as u64, window)?;
+        drain(&mut enc, out)?;
+        cancel::advance(cancel, 2 * window.len());
+    }
+    for window in new[old.len()..].chunks(CANCEL_WINDOW) {
+        cancel::check(cancel)?;
+        enc.write_literal(window)?;
+        drain(&mut enc, out)?;
+        cancel::advance(cancel, window.len());
+    }
+    enc.finish()?;
+    drain(&mut enc, out)?;
+    Ok(true)
+}
+
+/// Move the patch bytes `enc` has produced so far to `out`.
+pub(crate) fn drain<W: Write>(enc: &mut Encoder, out: &mut W) -> Result<(), XDeltaError> {
+    let buf = enc.output();
+    out.write_all(buf)
+        .map_err(|e| XDeltaError::Io(format!("failed to write patch file: {}", e)))?;
+    buf.clear();
+    Ok(())
+}
+
+/// Signatures of an in-memory source, built on `threads` threads if given,
+/// checking `cancel` between windows.
+pub(crate) fn build_signatures(
+    old: &[u8],
+    block_size: usize,
+    threads: Option<usize>,
+    cancel: Option<&CancelToken>,
+) -> Result<Signatures, XDeltaError> {
+    let mut builder = SignatureBuilder::new(block_size)?;
+    if let Some(threads) = threads {
+        for window in old.chunks(PARALLEL_CHUNK * threads) {
+            cancel::check(cancel)?;
+            builder.write_parallel(window, threads);
+            cancel::advance(cancel, window.len());
+        }
+    } else {
+        for window in old.chunks(CANCEL_WINDOW) {
+            cancel::check(cancel)?;
+            builder.write(window);
+            cancel::advance(cancel, window.len());
+        }
+    }
+    Ok(builder.finish())
+}
+
+/// Encode `new` against already built signatures, in pieces on `threads`
+/// threads if given, checking `cancel` between windows. Without threads the
+/// sequential encoder is used, whose matches may span the whole input.
+pub(crate) fn encode_cancel(
+    sigs: &Arc<Signatures>,
+    new: &[u8],
+    encoding: Encoding,
+    threads: Option<usize>,
+    cancel: Option<&CancelToken>,
+) -> Result<Vec<u8>, XDeltaError> {
+    let mut patch = Vec::new();
+    encode_cancel_to(sigs, new, encoding, threads, cancel, &mut patch)?;
+    Ok(patch)
+}
+
+/// Same as `encode_cancel`, writing the patch to `out` as it is produced.
+pub(crate) fn encode_cancel_to<W: Write>(
+    sigs: &Arc<Signatures>,
+    new: &[u8],
+    encoding: Encoding,
+    threads: Option<usize>,
+    cancel: Option<&CancelToken>,
+    out: &mut W,
+) -> Result<(), XDeltaError> {
+    let mut enc = Encoder::new(Arc::clone(sigs), encoding)?;
+    if let Some(threads) = threads {
+        // whole groups, so the pieces are cut where write_parallel would cut them
+        for group in new.chunks(PARALLEL_CHUNK * threads) {
+            enc.write_parallel(group, threads, cancel)?;
+            drain(&mut enc, out)?;
+            cancel::advance(cancel, group.len());
+        }
+    } else {
+        for window in new.chunks(CANCEL_WINDOW) {
+            cancel::check(cancel)?;
+            enc.write(window)?;
+            drain(&mut enc, out)?;
+            cancel::advance(cancel, window.len());
+        }
+    }
+    cancel::check(cancel)?;
+    enc.finish()?;
+    drain(&mut enc, out)
+}
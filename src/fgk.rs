@@ -0,0 +1,321 @@
+// src/fgk.rs
+//! FGK secondary compression: adaptive Huffman coding (Faller, Gallager and
+//! Knuth), the scheme of xdelta3's FGK coder. No tables are sent; both sides
+//! start every block from the same tree, all 256 symbols with weight 1, and
+//! update it after each symbol. Weights are halved and the tree rebuilt once
+//! the total reaches WEIGHT_LIMIT, which keeps codes short and lets the
+//! model follow changing statistics.
+//!
+//! The tree keeps the sibling property in its node array: weights do not
+//! increase with the index, the root is node 0 and the children of a node
+//! are adjacent. A coded block is the MSB-first codes, root to leaf, of its
+//! symbols. The compression level has no effect.
+
+use crate::huffman::{BitReader, BitWriter, BlockCodec};
+use crate::XDeltaError;
+
+pub(crate) const MAGIC: [u8; 4] = [0xdb, b'F', b'G', b'K'];
+
+const SYMBOLS: usize = 256;
+const NODES: usize = 2 * SYMBOLS - 1;
+const WEIGHT_LIMIT: u32 = 1 << 16;
+
+#[derive(Clone, Copy, Default)]
+struct Node {
+    weight: u32,
+    parent: usize,
+    /// first child of an internal node, the second is child + 1; the symbol of a leaf
+    child: usize,
+    leaf: bool,
+}
+
+struct Tree {
+    nodes: [Node; NODES],
+    /// node of each symbol
+    leaves: [usize; SYMBOLS],
+}
+
+impl Tree {
+    fn new() -> Self {
+        let mut tree = Tree {
+            nodes: [Node::default(); NODES],
+            leaves: [0; SYMBOLS],
+        };
+        for s in 0..SYMBOLS {
+            tree.leaves[s] = s;
+            tree.nodes[s] = Node { weight: 1, parent: 0, child: s, leaf: true };
+        }
+        tree.rebuild();
+        tree
+    }
+
+    /// Rebuild the tree from the leaf weights. Huffman's algorithm with two
+    /// queues merges nodes in order of weight, so numbering them from the end
+    /// as they are merged gives the sibling property.
+    fn rebuild(&mut self) {
+        let mut weights: Vec<(u32, usize)> = (0..SYMBOLS).map(|s| (self.nodes[self.leaves[s]].weight, s)).collect();
+        weights.sort();
+        // leaves by weight, and merged nodes (weight, first child) in the order they were made
+        let mut leaves = weights.into_iter().peekable();
+        let mut merged: std::collections::VecDeque<(u32, usize)> = std::collections::VecDeque::new();
+        let mut next = NODES;
+        let mut take = |tree: &mut Tree, leaves: &mut std::iter::Peekable<std::vec::IntoIter<(u32, usize)>>,
+                        merged: &mut std::collections::VecDeque<(u32, usize)>| {
+            let leaf_first = match (leaves.peek(), merged.front()) {
+                (Some(l), Some(m)) => l.0 <= m.0,
+                (l, _) => l.is_some(),
+            };
+            next -= 1;
+            if leaf_first {
+                let (weight, s) = leaves.next().unwrap();
+                tree.nodes[next] = Node { weight, parent: 0, child: s, leaf: true };
+                tree.leaves[s] = next;
+            } else {
+                let (weight, child) = merged.pop_front().unwrap();
+                tree.nodes[next] = Node { weight, parent: 0, child, leaf: false };
+                tree.nodes[child].parent = next;
+                tree.nodes[child + 1].parent = next;
+            }
+            (next, tree.nodes[next].weight)
+        };
+        loop {
+            let (a, wa) = take(self, &mut leaves, &mut merged);
+            if a == 0 {
+                return;
+            }
+            let (b, wb) = take(self, &mut leaves, &mut merged);
+            debug_assert_eq!(b + 1, a);
+            merged.push_back((wa + wb, b));
+        }
+    }
+
+    /// Count one more `sym`, keeping the sibling property.
+    fn update(&mut self, sym: u8) {
+        let mut cur = self.leaves[sym as usize];
+        loop {
+            let w = self.nodes[cur].weight;
+            // the first node of this weight; weights do not increase with the index
+            let leader = self.nodes[..cur].partition_point(|n| n.weight > w);
+            if leader != cur {
+                self.swap(leader, cur);
+                cur = leader;
+            }
+            self.nodes[cur].weight += 1;
+            if cur == 0 {
+                break;
+            }
+            cur = self.nodes[cur].parent;
+        }
+        if self.nodes[0].weight >= WEIGHT_LIMIT {
+            for s in 0..SYMBOLS {
+                let n = &mut self.nodes[self.leaves[s]];
+                n.weight = n.weight.div_ceil(2);
+            }
+            self.rebuild();
+        }
+    }
+
+    /// Exchange the subtrees at `a` and `b`, which have the same weight and
+    /// are not ancestors of each other; every weight is at least 1, so a
+    /// parent always weighs more than its child.
+    fn swap(&mut self, a: usize, b: usize) {
+        let (pa, pb) = (self.nodes[a].parent, self.nodes[b].parent);
+        self.nodes.swap(a, b);
+        self.nodes[a].parent = pa;
+        self.nodes[b].parent = pb;
+        for n in [a, b] {
+            let node = self.nodes[n];
+            if node.leaf {
+                self.leaves[node.child] = n;
+            } else {
+                self.nodes[node.child].parent = n;
+                self.nodes[node.child + 1].parent = n;
+            }
+        }
+    }
+}
+
+pub(crate) struct Fgk;
+
+impl BlockCodec for Fgk {
+    const MAGIC: [u8; 4] = MAGIC;
+    const NAME: &'static str = "fgk";
+
+    fn encode(raw: &[u8], _level: Option<u32>, out: &mut Vec<u8>) {
+        let mut tree = Tree::new();
+        let mut w = BitWriter::new(out);
+        let mut path = Vec::new();
+        for &b in raw {
+            let mut n = tree.leaves[b as usize];
+            while n != 0 {
+                let parent = tree.nodes[n].parent;
+                path.push((n != tree.nodes[parent].child) as u32);
+                n = parent;
+            }
+            for &bit in path.iter().rev() {
+                w.put(bit, 1);
+            }
+            path.clear();
+            tree.update(b);
+        }
+        w.finish();
+    }
+
+    fn decode(coded: &[u8], raw_len: usize, out: &mut Vec<u8>) -> Result<(), XDeltaError> {
+        out.clear();
+        out.reserve(raw_len);
+        let mut tree = Tree::new();
+        let mut r = BitReader::new(coded, Self::NAME);
+        for _ in 0..raw_len {
+            let mut n = 0;
+            while !tree.nodes[n].leaf {
+                n = tree.nodes[n].child + r.bit()? as usize;
+            }
+            let b = tree.nodes[n].child as u8;
+            out.push(b);
+            tree.update(b);
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::huffman::{FramedDecoder, FramedEncoder};
+
+    fn compress(data: &[u8]) -> Vec<u8> {
+        let mut enc = FramedEncoder::<Fgk>::new(None);
+        let mut out = Vec::new();
+        enc.write(data, &mut out);
+        enc.finish(&mut out);
+        out
+    }
+
+    fn decompress(stream: &[u8]) -> Result<Vec<u8>, XDeltaError> {
+        let mut dec = FramedDecoder::<Fgk>::new();
+        let mut out = Vec::new();
+        dec.feed(stream, &mut |b: &[u8]| {
+            out.extend_from_slice(b);
+            Ok(())
+        })?;
+        if !dec.ended() {
+            return Err(XDeltaError::Corrupt("truncated".into()));
+        }
+        Ok(out)
+    }
+
+    fn fixture(n: usize) -> Vec<u8> {
+        let mut x = 99u32;
+        (0..n)
+            .map(|_| {
+                x = x.wrapping_mul(1103515245).wrapping_add(12345);
+                b"aaaaaaaabbbbccd "[(x >> 16) as usize % 16]
+            })
+            .collect()
+    }
+
+    /// Walk the whole tree and check the invariants the coder relies on.
+    fn check_sibling_property(tree: &Tree) {
+        for i in 1..NODES {
+            assert!(tree.nodes[i - 1].weight >= tree.nodes[i].weight, "weights increase at node {}", i);
+        }
+        for (i, n) in tree.nodes.iter().enumerate() {
+            if n.leaf {
+                assert_eq!(tree.leaves[n.child], i);
+            } else {
+                assert_eq!(tree.nodes[n.child].parent, i);
+                assert_eq!(tree.nodes[n.child + 1].parent, i);
+                assert_eq!(n.weight, tree.nodes[n.child].weight + tree.nodes[n.child + 1].weight);
+            }
+        }
+    }
+
+    #[test]
+    fn updates_keep_the_sibling_property() {
+        let mut tree = Tree::new();
+        check_sibling_property(&tree);
+        // more than WEIGHT_LIMIT updates, so the tree is also rebuilt
+        for (i, &b) in fixture(70_000).iter().enumerate() {
+            tree.update(b);
+            if i % 4999 == 0 {
+                check_sibling_property(&tree);
+            }
+        }
+        check_sibling_property(&tree);
+    }
+
+    #[test]
+    fn round_trip() {
+        for n in [0, 1, 255, 1000, 100_000] {
+            let data = fixture(n);
+            assert_eq!(decompress(&compress(&data)).unwrap(), data, "{} bytes", n);
+        }
+        let all: Vec<u8> = (0..=255).cycle().take(3000).collect();
+        assert_eq!(decompress(&compress(&all)).unwrap(), all);
+    }
+
+    #[test]
+    fn compresses_skewed_data() {
+        let data = fixture(100_000);
+        let stream = compress(&data);
+        // the entropy of the fixture is under 2.7 bits per symbol
+        assert!(stream.len() < data.len() * 4 / 10, "{} bytes from {}", stream.len(), data.len());
+    }
+
+    #[test]
+    fn adapts_to_a_run() {
+        let data = vec![b'x'; 50_000];
+        let stream = compress(&data);
+        assert!(stream.len() < data.len() / 6, "{} bytes from {}", stream.len(), data.len());
+        assert_eq!(decompress(&stream).unwrap(), data);
+    }
+
+    #[test]
+    fn truncated_and_corrupt_streams() {
+        let data = fixture(10_000);
+        let stream = compress(&data);
+        for cut in [0, 3, 4, 10, stream.len() / 2, stream.len() - 1] {
+            assert!(decompress(&stream[..cut]).is_err(), "cut at {}", cut);
+        }
+        let mut bad = stream.clone();
+        bad[30] ^= 0x04;
+        assert!(decompress(&bad).is_err());
+        let mut bad = stream.clone();
+        bad[8] ^= 0xff;
+        assert!(decompress(&bad).is_err());
+    }
+
+    #[test]
+    fn every_cut_and_flipped_byte_is_rejected() {
+        let mut data = fixture(3000);
+        data.extend_from_slice(&crate::fixtures::noise(300));
+        let mut enc = FramedEncoder::<Fgk>::new(None);
+        let mut stream = Vec::new();
+        enc.write(&data[..3000], &mut stream);
+        enc.flush(&mut stream);
+        enc.write(&data[3000..], &mut stream);
+        enc.finish(&mut stream);
+        assert_eq!(decompress(&stream).unwrap(), data);
+        crate::fixtures::check_malformed(&data, &stream, decompress);
+    }
+
+    #[test]
+    fn decodes_a_stream_fed_in_pieces() {
+        let data = fixture(70_000);
+        let stream = compress(&data);
+        for step in [1, 7, 4096] {
+            let mut dec = FramedDecoder::<Fgk>::new();
+            let mut out = Vec::new();
+            for piece in stream.chunks(step) {
+                dec.feed(piece, &mut |b: &[u8]| {
+                    out.extend_from_slice(b);
+                    Ok(())
+                })
+                .unwrap();
+            }
+            assert!(dec.ended());
+            assert_eq!(out, data, "pieces of {} bytes", step);
+        }
+    }
+}
@@ -0,0 +1,491 @@
+// src/file.rs
+use std::fs::{self, File};
+use std::io::{BufReader, BufWriter, Read, Seek, SeekFrom, Write};
+use std::mem::ManuallyDrop;
+use std::path::Path;
+use std::sync::Arc;
+
+use crate::cancel::CancelToken;
+use crate::decoder::{patch_segments, Decoder, FileSource, Segment, SliceSource, Source};
+use crate::encoder::{create_patch_to, read_full, Encoder, Encoding, Format, SignatureBuilder, Signatures, PARALLEL_CHUNK};
+use crate::mmap::Mmap;
+use crate::window::{create_patch_window_to, SourceWindow};
+use crate::XDeltaError;
+
+/// Size of the chunks the "new" file is streamed through the encoder in.
+const READ_CHUNK: usize = 1024 * 1024;
+
+/// 文件版本的统计信息，与 C 侧 xdelta_file_stats 布局一致
+/// 应用补丁时 new_size 为输出文件大小
+#[repr(C)]
+#[derive(Default)]
+pub struct FileStats {
+    pub old_size: u64,
+    pub new_size: u64,
+    pub patch_size: u64,
+}
+
+fn open(path: &Path, what: &str) -> Result<File, XDeltaError> {
+    File::open(path).map_err(|e| XDeltaError::Io(format!("failed to open {} file {}: {}", what, path.display(), e)))
+}
+
+/// Where a patch or output file goes: a path created here and removed again
+/// on error, or a file the caller opened, which it also cleans up itself.
+pub(crate) enum Output<'a> {
+    Path(&'a Path),
+    File(&'a File),
+}
+
+impl Output<'_> {
+    fn create(&self, what: &str) -> Result<File, XDeltaError> {
+        match self {
+            Output::Path(path) => File::create(path)
+                .map_err(|e| XDeltaError::Io(format!("failed to create {} file {}: {}", what, path.display(), e))),
+            // a duplicate of the handle, so dropping it leaves the caller's open
+            Output::File(file) => file
+                .try_clone()
+                .map_err(|e| XDeltaError::Io(format!("failed to duplicate {} file handle: {}", what, e))),
+        }
+    }
+
+    fn discard(&self) {
+        if let Output::Path(path) = self {
+            let _ = fs::remove_file(path);
+        }
+    }
+}
+
+/// Borrow a file descriptor (a `HANDLE` on Windows) the caller opened and keeps
+/// open for the duration of the call; it is not closed when the `File` goes away.
+pub(crate) fn borrow_file(fd: isize, what: &str) -> Result<ManuallyDrop<File>, XDeltaError> {
+    #[cfg(unix)]
+    {
+        use std::os::unix::io::{FromRawFd, RawFd};
+        let fd = RawFd::try_from(fd).ok().filter(|fd| *fd >= 0);
+        let fd = fd.ok_or_else(|| XDeltaError::InvalidArg(format!("invalid {} file descriptor", what)))?;
+        Ok(ManuallyDrop::new(unsafe { File::from_raw_fd(fd) }))
+    }
+    #[cfg(windows)]
+    {
+        use std::os::windows::io::{FromRawHandle, RawHandle};
+        // 0 and INVALID_HANDLE_VALUE
+        if fd == 0 || fd == -1 {
+            return Err(XDeltaError::InvalidArg(format!("invalid {} file handle", what)));
+        }
+        Ok(ManuallyDrop::new(unsafe { File::from_raw_handle(fd as RawHandle) }))
+    }
+}
+
+/// Name of an input in error messages: `what` and, when known, its path.
+fn describe(what: &str, path: Option<&Path>) -> String {
+    match path {
+        Some(path) => format!("{} file {}", what, path.display()),
+        None => format!("{} file", what),
+    }
+}
+
+/// Stream `old` and `new` from disk and write the patch to `patch_path`.
+/// Only the block signatures of `old` and one window of `new` are kept in memory.
+/// With `window` only the signatures of that many bytes of `old` around the
+/// current offset are kept, and `old` is read as the window moves.
+/// With `mmap` both inputs are read through read-only mappings instead of
+/// `read` calls where the system allows it; the patch is the same either way.
+/// A partially written patch file is removed on error.
+pub(crate) fn create_patch_file(
+    old_path: &Path,
+    new_path: &Path,
+    patch_path: &Path,
+    block_size: usize,
+    encoding: Encoding,
+    threads: Option<usize>,
+    window: Option<u64>,
+    mmap: bool,
+) -> Result<FileStats, XDeltaError> {
+    let old = open(old_path, "old")?;
+    let new = open(new_path, "new")?;
+    let names = (describe("old", Some(old_path)), describe("new", Some(new_path)));
+    create_patch_files(&old, &new, &names, Output::Path(patch_path), block_size, encoding, threads, window, mmap)
+}
+
+/// `create_patch_file` over files the caller already opened, read from their
+/// current offsets; `names` describe `old` and `new` in error messages.
+pub(crate) fn create_patch_files(
+    old: &File,
+    new: &File,
+    names: &(String, String),
+    patch: Output,
+    block_size: usize,
+    encoding: Encoding,
+    threads: Option<usize>,
+    window: Option<u64>,
+    mmap: bool,
+) -> Result<FileStats, XDeltaError> {
+    if encoding.format == Format::Bsdiff {
+        // checked before the signatures are built, Encoder::new would only refuse it after
+        return Err(XDeltaError::InvalidArg("bsdiff patches can only be created from in-memory data".into()));
+    }
+    let old_map = if mmap { Mmap::map(old) } else { None };
+    let new_map = if mmap { Mmap::map(new) } else { None };
+    if encoding.append {
+        if let Some(stats) = create_append_file(old, new, &old_map, &new_map, &patch, block_size, encoding)? {
+            let checked =
+                check_mapped(&old_map, old, &names.0).and_then(|()| check_mapped(&new_map, new, &names.1));
+            if let Err(e) = checked {
+                patch.discard();
+                return Err(e);
+            }
+            return Ok(stats);
+        }
+    }
+    let (enc, source, old_size) = match window {
+        None => {
+            let (sigs, old_size) = match &old_map {
+                Some(m) => signatures(m.as_slice(), block_size, threads)?,
+                None => signatures(BufReader::new(old), block_size, threads)?,
+            };
+            (Encoder::new(Arc::new(sigs), encoding)?, None, old_size)
+        }
+        Some(window) => {
+            let source: Box<dyn Source> = match &old_map {
+                Some(m) => Box::new(SliceSource(m.as_slice())),
+                None => Box::new(FileSource::new(
+                    old.try_clone().map_err(|e| XDeltaError::Io(format!("failed to reopen old file: {}", e)))?,
+                )?),
+            };
+            let old_size = source.len().unwrap_or(0);
+            let source = SourceWindow::new(source, block_size, window)?;
+            (Encoder::new(Arc::new(Signatures::new(block_size)?), encoding)?, Some(source), old_size)
+        }
+    };
+    let threads = if source.is_some() { None } else { threads };
+
+    let file = patch.create("patch")?;
+    let r = match &new_map {
+        Some(m) => encode_to(enc, source, threads, m.as_slice(), BufWriter::new(file)),
+        None => encode_to(enc, source, threads, new, BufWriter::new(file)),
+    }
+    .and_then(|sizes| {
+        check_mapped(&old_map, old, &names.0)?;
+        check_mapped(&new_map, new, &names.1)?;
+        Ok(sizes)
+    });
+    match r {
+        Ok((new_size, patch_size)) => Ok(FileStats {
+            old_size,
+            new_size,
+            patch_size,
+        }),
+        Err(e) => {
+            patch.discard();
+            Err(e)
+        }
+    }
+}
+
+/// Encode in-memory `old` and `new` like `create_patch_bytes_cancel` (or
+/// `create_patch_bytes_window` with `window`), writing the patch straight to
+/// `patch_path` window by window instead of collecting it in memory. The file
+/// holds the same bytes the in-memory version returns; it is removed on error.
+pub(crate) fn create_patch_data_file(
+    old: &[u8],
+    new: &[u8],
+    patch_path: &Path,
+    block_size: usize,
+    encoding: Encoding,
+    threads: Option<usize>,
+    window: Option<u64>,
+    cancel: Option<&CancelToken>,
+) -> Result<FileStats, XDeltaError> {
+    let patch = File::create(patch_path)
+        .map_err(|e| XDeltaError::Io(format!("failed to create patch file {}: {}", patch_path.display(), e)))?;
+    let mut patch = CountingWriter { inner: BufWriter::new(patch), written: 0 };
+    let r = match window {
+        Some(window) => create_patch_window_to(old, new, block_size, window, encoding, cancel, &mut patch),
+        None => create_patch_to(old, new, block_size, encoding, threads, cancel, &mut patch),
+    }
+    .and_then(|()| patch.flush().map_err(|e| XDeltaError::Io(format!("failed to write patch file: {}", e))));
+    match r {
+        Ok(()) => Ok(FileStats {
+            old_size: old.len() as u64,
+            new_size: new.len() as u64,
+            patch_size: patch.written,
+        }),
+        Err(e) => {
+            drop(patch);
+            let _ = fs::remove_file(patch_path);
+            Err(e)
+        }
+    }
+}
+
+/// The file version of `append_patch`: if the new file starts with the whole,
+/// non-empty old file, write COPY records of all of it and ADD records of the
+/// rest to `patch_path`. The files are compared chunk by chunk while the COPY
+/// records collect in memory (a few bytes per MiB), so the patch file is only
+/// created once the old file is known to be a prefix. `None` if it is not;
+/// both files are then rewound for the normal encoder.
+fn create_append_file(
+    old: &File,
+    new: &File,
+    old_map: &Option<Mmap>,
+    new_map: &Option<Mmap>,
+    patch_out: &Output,
+    block_size: usize,
+    encoding: Encoding,
+) -> Result<Option<FileStats>, XDeltaError> {
+    let len = |f: &File| f.metadata().map(|m| m.len()).map_err(|e| XDeltaError::Io(e.to_string()));
+    if len(old)? == 0 || len(new)? < len(old)? {
+        return Ok(None);
+    }
+    let mut enc = Encoder::new(Arc::new(Signatures::new(block_size)?), encoding)?;
+    let mut old_in = input(old_map, old);
+    let mut new_in = input(new_map, new);
+    let mut buf = vec![0u8; READ_CHUNK];
+    let mut other = vec![0u8; READ_CHUNK];
+    let mut old_size = 0u64;
+    loop {
+        let n = read_full(&mut old_in, &mut buf)?;
+        if n == 0 {
+            break;
+        }
+        if read_full(&mut new_in, &mut other[..n])? != n || buf[..n] != other[..n] {
+            let rewind = |mut f: &File| f.seek(SeekFrom::Start(0)).map_err(|e| XDeltaError::Io(e.to_string()));
+            rewind(old)?;
+            rewind(new)?;
+            return Ok(None);
+        }
+        enc.write_copy(old_size, &buf[..n])?;
+        old_size += n as u64;
+    }
+
+    let mut patch = CountingWriter { inner: BufWriter::new(patch_out.create("patch")?), written: 0 };
+    let write_err = |e: std::io::Error| XDeltaError::Io(format!("failed to write patch file: {}", e));
+    let r = (|| -> Result<u64, XDeltaError> {
+        let mut new_size = old_size;
+        loop {
+            patch.write_all(enc.output()).map_err(write_err)?;
+            enc.output().clear();
+            let n = read_full(&mut new_in, &mut buf)?;
+            if n == 0 {
+                break;
+            }
+            enc.write_literal(&buf[..n])?;
+            new_size += n as u64;
+        }
+        enc.finish()?;
+        patch.write_all(enc.output()).map_err(write_err)?;
+        patch.flush().map_err(write_err)?;
+        Ok(new_size)
+    })();
+    match r {
+        Ok(new_size) => Ok(Some(FileStats {
+            old_size,
+            new_size,
+            patch_size: patch.written,
+        })),
+        Err(e) => {
+            patch_out.discard();
+            Err(e)
+        }
+    }
+}
+
+/// Read a file through its mapping if there is one.
+fn input<'a>(map: &'a Option<Mmap>, file: &'a File) -> Box<dyn Read + 'a> {
+    match map {
+        Some(m) => Box::new(m.as_slice()),
+        None => Box::new(file),
+    }
+}
+
+/// Fail if a mapped input no longer has the length it was mapped at; `name`
+/// comes from `describe`.
+fn check_mapped(map: &Option<Mmap>, file: &File, name: &str) -> Result<(), XDeltaError> {
+    match map {
+        Some(m) if !m.unchanged(file) => Err(XDeltaError::Io(format!("{} changed while it was being read", name))),
+        _ => Ok(()),
+    }
+}
+
+fn signatures<R: Read>(old: R, block_size: usize, threads: Option<usize>) -> Result<(Signatures, u64), XDeltaError> {
+    match threads {
+        Some(threads) => signatures_parallel(old, block_size, threads),
+        None => Signatures::from_reader(old, block_size),
+    }
+}
+
+/// Signatures of the old file hashed on `threads` threads, reading one piece per thread at a time.
+fn signatures_parallel<R: Read>(
+    mut old: R,
+    block_size: usize,
+    threads: usize,
+) -> Result<(Signatures, u64), XDeltaError> {
+    let mut builder = SignatureBuilder::new(block_size)?;
+    let mut buf = vec![0u8; PARALLEL_CHUNK * threads];
+    let mut total = 0u64;
+    loop {
+        let n = read_full(&mut old, &mut buf)?;
+        builder.write_parallel(&buf[..n], threads);
+        total += n as u64;
+        if n < buf.len() {
+            break;
+        }
+    }
+    Ok((builder.finish(), total))
+}
+
+/// Stream `new` through `enc` into `patch`, moving `source` along if given.
+fn encode_to<R: Read, W: Write>(
+    mut enc: Encoder,
+    mut source: Option<SourceWindow>,
+    threads: Option<usize>,
+    mut new: R,
+    mut patch: W,
+) -> Result<(u64, u64), XDeltaError> {
+    let write_err = |e: std::io::Error| XDeltaError::Io(format!("failed to write patch file: {}", e));
+    // in pieces a whole group is read at once, so that pieces are cut at the
+    // same offsets as in the in-memory version
+    let mut buf = vec![0u8; threads.map_or(READ_CHUNK, |t| PARALLEL_CHUNK * t)];
+    let mut new_size = 0u64;
+    let mut patch_size = 0u64;
+    loop {
+        let n = read_full(&mut new, &mut buf)?;
+        if n == 0 {
+            break;
+        }
+        new_size += n as u64;
+        match (&mut source, threads) {
+            (Some(source), _) => source.write(&mut enc, &buf[..n], None)?,
+            (None, Some(threads)) => enc.write_parallel(&buf[..n], threads, None)?,
+            (None, None) => enc.write(&buf[..n])?,
+        }
+        let out = enc.output();
+        patch.write_all(out).map_err(write_err)?;
+        patch_size += out.len() as u64;
+        out.clear();
+    }
+    enc.finish()?;
+    let out = enc.output();
+    patch.write_all(out).map_err(write_err)?;
+    patch_size += out.len() as u64;
+    patch.flush().map_err(write_err)?;
+    Ok((new_size, patch_size))
+}
+
+/// Counts the bytes passing through to the wrapped writer.
+struct CountingWriter<W: Write> {
+    inner: W,
+    written: u64,
+}
+
+impl<W: Write> Write for CountingWriter<W> {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        let n = self.inner.write(buf)?;
+        self.written += n as u64;
+        Ok(n)
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        self.inner.flush()
+    }
+}
+
+/// Split the patch file at `path` like `patch_segments`. The patch is read
+/// through a read-only mapping where the system allows it, so a large patch
+/// is not copied into memory just to find its record boundaries.
+pub(crate) fn patch_file_segments(path: &Path, segment_size: u64) -> Result<(usize, Vec<Segment>), XDeltaError> {
+    let mut file = open(path, "patch")?;
+    if let Some(m) = Mmap::map(&file) {
+        return patch_segments(m.as_slice(), segment_size);
+    }
+    let mut data = Vec::new();
+    file.read_to_end(&mut data)
+        .map_err(|e| XDeltaError::Io(format!("failed to read patch file {}: {}", path.display(), e)))?;
+    patch_segments(&data, segment_size)
+}
+
+/// Apply the patch at `patch_path` to `old_path`, writing the result to `out_path`.
+/// The old file is read at random offsets, through a read-only mapping with
+/// `mmap` where the system allows it; the patch is streamed. `out_path` is
+/// removed again if decoding fails.
+pub(crate) fn apply_patch_file(
+    old_path: &Path,
+    patch_path: &Path,
+    out_path: &Path,
+    max_output: Option<u64>,
+    mmap: bool,
+) -> Result<FileStats, XDeltaError> {
+    let old = open(old_path, "old")?;
+    let patch = open(patch_path, "patch")?;
+    apply_patch_files(&old, &describe("old", Some(old_path)), &patch, Output::Path(out_path), max_output, mmap)
+}
+
+/// `apply_patch_file` over files the caller already opened; `old` is read at
+/// absolute offsets, `patch` from its current offset. `old_name` describes
+/// `old` in error messages.
+pub(crate) fn apply_patch_files(
+    old: &File,
+    old_name: &str,
+    patch: &File,
+    out: Output,
+    max_output: Option<u64>,
+    mmap: bool,
+) -> Result<FileStats, XDeltaError> {
+    let old_map = if mmap { Mmap::map(old) } else { None };
+    let mut file = CountingWriter {
+        inner: BufWriter::new(out.create("output")?),
+        written: 0,
+    };
+    let (r, old_size) = match &old_map {
+        Some(m) => {
+            let r = decode_to(SliceSource(m.as_slice()), patch, &mut file, max_output)
+                .and_then(|n| check_mapped(&old_map, old, old_name).map(|_| n));
+            (r, m.as_slice().len() as u64)
+        }
+        None => {
+            let source = FileSource::new(
+                old.try_clone().map_err(|e| XDeltaError::Io(format!("failed to reopen old file: {}", e)))?,
+            )?;
+            let old_size = source.len().unwrap_or(0);
+            (decode_to(source, patch, &mut file, max_output), old_size)
+        }
+    };
+    let new_size = file.written;
+    drop(file);
+    match r {
+        Ok(patch_size) => Ok(FileStats {
+            old_size,
+            new_size,
+            patch_size,
+        }),
+        Err(e) => {
+            out.discard();
+            Err(e)
+        }
+    }
+}
+
+/// Decode the whole of `patch` against `old` into `out`, returning the patch size.
+fn decode_to<S: Source, W: Write>(
+    old: S,
+    mut patch: &File,
+    out: &mut W,
+    max_output: Option<u64>,
+) -> Result<u64, XDeltaError> {
+    let mut dec = Decoder::new(old);
+    dec.set_max_output(max_output);
+    let mut buf = vec![0u8; READ_CHUNK];
+    let mut patch_size = 0u64;
+    loop {
+        let n = read_full(&mut patch, &mut buf)?;
+        if n == 0 {
+            break;
+        }
+        patch_size += n as u64;
+        dec.write(&buf[..n], out)?;
+    }
+    dec.finish(out)?;
+    out.flush()
+        .map_err(|e| XDeltaError::Io(format!("failed to write output file: {}", e)))?;
+    Ok(patch_size)
+}
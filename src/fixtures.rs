@@ -0,0 +1,99 @@
+// src/fixtures.rs
+//! Inputs and reference streams for the codec unit tests.
+//!
+//! The streams in src/testdata were written by the reference tools from the
+//! inputs below (xz 5.6.4, bzip2 1.0.8, lz4 1.9.4). The --check=none streams
+//! are what xdelta3's -S lzma writes: liblzma's easy encoder without a check.
+//! long is sample sixteen times, past the 2 MiB limit of one LZMA2 chunk:
+//!
+//!   xz -c sample > sample.xz
+//!   xz -c --check=sha256 --block-size=65536 sample > sample-blocks-sha256.xz
+//!   xz -c --check=none -9e sample > sample-none-9e.xz
+//!   xz -c --check=none -0 sample > sample-none-0.xz; xz -c --check=none -6 sample > sample-none-6.xz
+//!   xz -c --check=crc64 --lzma2=preset=6,lc=0,lp=2,pb=0 sample > sample-lc0-lp2-pb0.xz
+//!   xz -c --check=crc64 --lzma2=preset=6,lc=4,lp=0,pb=4 sample > sample-lc4-pb4.xz
+//!   xz -c --check=none -6 long > long-none.xz; xz -c --check=none < /dev/null > empty-none.xz
+//!   bzip2 -c -1 sample > sample-1.bz2; bzip2 -c -9 sample > sample-9.bz2
+//!   lz4 -c -B4 --no-frame-crc -12 sample > sample.lz4
+//!   xz -c mixed > mixed.xz; bzip2 -c -9 mixed > mixed.bz2
+//!   lz4 -c -B4 --no-frame-crc mixed > mixed.lz4
+
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+const TEXT_OLD: &[u8] = include_bytes!("../xdelta_ffi/testdata/text.old");
+const TEXT_NEW: &[u8] = include_bytes!("../xdelta_ffi/testdata/text.new");
+
+/// Both text fixtures, four times: 176 656 bytes, more than one block of
+/// every codec and of bzip2 -1.
+pub(crate) fn sample() -> Vec<u8> {
+    [TEXT_OLD, TEXT_NEW].concat().repeat(4)
+}
+
+/// 16 KiB of xorshift64 noise (seed 1, low byte) followed by text.old, so
+/// the codecs have to store part of it.
+pub(crate) fn mixed() -> Vec<u8> {
+    let mut out = noise(16384);
+    out.extend_from_slice(TEXT_OLD);
+    out
+}
+
+pub(crate) fn noise(n: usize) -> Vec<u8> {
+    let mut x = 1u64;
+    (0..n)
+        .map(|_| {
+            x ^= x << 13;
+            x ^= x >> 7;
+            x ^= x << 17;
+            x as u8
+        })
+        .collect()
+}
+
+/// Run a reference tool on `input` and return what it writes, or None when
+/// the tool is not installed, so interoperability is checked where it can be.
+pub(crate) fn run_tool(tool: &str, args: &[&str], input: &[u8]) -> Option<Vec<u8>> {
+    let mut child = Command::new(tool)
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()
+        .ok()?;
+    let mut stdin = child.stdin.take().unwrap();
+    let input = input.to_vec();
+    let writer = std::thread::spawn(move || stdin.write_all(&input));
+    let out = child.wait_with_output().unwrap();
+    writer.join().unwrap().unwrap();
+    assert!(out.status.success(), "{} {:?} failed", tool, args);
+    Some(out.stdout)
+}
+
+/// Check that `decode` rejects every truncation of `stream`, which encodes
+/// `data`, and noise, without panicking. With any one byte flipped it must
+/// fail or still return `data`: the CRC of each block covers the output, but
+/// bits the format ignores, such as the padding after the last code of a
+/// Huffman block, may change without harm.
+pub(crate) fn check_malformed(data: &[u8], stream: &[u8], decode: impl Fn(&[u8]) -> Result<Vec<u8>, crate::XDeltaError>) {
+    for cut in 0..stream.len() {
+        assert!(decode(&stream[..cut]).is_err(), "cut at {} of {}", cut, stream.len());
+    }
+    for at in 0..stream.len() {
+        for flip in [0x01, 0x80] {
+            let mut bad = stream.to_vec();
+            bad[at] ^= flip;
+            if let Ok(out) = decode(&bad) {
+                assert!(out == data, "byte {} of {} xor {:#x} decodes to other data", at, stream.len(), flip);
+            }
+        }
+    }
+    let mut trailing = stream.to_vec();
+    trailing.push(0);
+    assert!(decode(&trailing).is_err(), "trailing byte");
+    // noise behind a valid magic exercises the block decoders, not just the magic check
+    for n in [1, 16, 100, 5000] {
+        let mut garbage = stream[..4].to_vec();
+        garbage.extend_from_slice(&noise(n));
+        assert!(decode(&garbage).is_err(), "{} bytes of noise", n);
+    }
+}
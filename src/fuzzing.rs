@@ -0,0 +1,92 @@
+// src/fuzzing.rs
+//! Entry points for the cargo-fuzz targets in fuzz/, built with
+//! `--cfg fuzzing` (cargo fuzz sets it) and in the unit tests. Each decodes
+//! untrusted bytes and must return, with output or an error, but never panic
+//! or allocate without bound.
+
+use crate::compress::Decompressor;
+use crate::XDeltaError;
+
+/// Output the targets accept before giving up, so a small input that claims
+/// a huge stream ends as an error rather than exhausting memory.
+const OUTPUT_LIMIT: usize = 64 << 20;
+
+/// Undo the secondary compression of `data` as the patch decoder does: the
+/// first byte picks the codec (xz, DJW, FGK, LZ4, zlib, zstd or none), and the
+/// stream is fed in pieces of `step` bytes (at least one) so the decoders'
+/// state across calls is exercised as well. Errors come back as their message.
+pub fn decompress_secondary(data: &[u8], step: usize) -> Result<Vec<u8>, String> {
+    decode(data, step).map_err(|e| e.to_string())
+}
+
+fn decode(data: &[u8], step: usize) -> Result<Vec<u8>, XDeltaError> {
+    let mut dec = Decompressor::Detect;
+    let mut scratch = Vec::new();
+    let mut out = Vec::new();
+    for piece in data.chunks(step.max(1)) {
+        dec.feed(piece, &mut scratch, |b: &[u8]| {
+            if out.len() + b.len() > OUTPUT_LIMIT {
+                return Err(XDeltaError::OutputTooLarge(format!("more than {} bytes", OUTPUT_LIMIT)));
+            }
+            out.extend_from_slice(b);
+            Ok(())
+        })?;
+    }
+    dec.finish()?;
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::compress::{Compression, Compressor, Secondary};
+    use crate::fixtures::{mixed, noise, sample};
+
+    fn compress(secondary: Secondary, data: &[u8]) -> Vec<u8> {
+        let mut c = Compressor::new(Compression { secondary, level: None }).unwrap();
+        let mut out = Vec::new();
+        c.write(data, &mut out).unwrap();
+        c.finish(&mut out).unwrap();
+        out
+    }
+
+    /// What the fuzz target does with its seeds, and a fixed run of mutations
+    /// of them, so the entry point stays sound between fuzzing campaigns.
+    #[test]
+    fn seeds_and_mutations_do_not_panic() {
+        let mut seeds: Vec<Vec<u8>> = vec![
+            include_bytes!("testdata/sample-none-6.xz").to_vec(),
+            include_bytes!("testdata/sample-lc0-lp2-pb0.xz").to_vec(),
+            include_bytes!("testdata/mixed.xz").to_vec(),
+        ];
+        let mut data = sample()[..4000].to_vec();
+        data.extend_from_slice(&noise(500));
+        for secondary in [Secondary::Lzma, Secondary::Djw, Secondary::Fgk] {
+            let stream = compress(secondary, &data);
+            assert_eq!(decompress_secondary(&stream, usize::MAX).unwrap(), data, "{}", secondary.name());
+            assert_eq!(decompress_secondary(&stream, 7).unwrap(), data, "{} in pieces", secondary.name());
+            seeds.push(stream);
+        }
+        assert_eq!(decompress_secondary(&seeds[2], 1000).unwrap(), mixed());
+
+        let mut x = 0x9e3779b97f4a7c15u64;
+        let mut next = move || {
+            x ^= x << 13;
+            x ^= x >> 7;
+            x ^= x << 17;
+            x as usize
+        };
+        for _ in 0..3000 {
+            let mut input = seeds[next() % seeds.len()].clone();
+            for _ in 0..1 + next() % 4 {
+                let at = next() % input.len();
+                match next() % 3 {
+                    0 => input[at] ^= 1 << (next() % 8),
+                    1 => input[at] = next() as u8,
+                    _ => input.truncate(at.max(1)),
+                }
+            }
+            let _ = decompress_secondary(&input, 1 + next() % 5000);
+        }
+    }
+}
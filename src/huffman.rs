@@ -0,0 +1,505 @@
+// src/huffman.rs
+//! Pieces shared by the DJW and FGK secondary compressors: the block
+//! framing both streams use, MSB-first bit I/O and canonical Huffman codes.
+//!
+//! A stream is a 4-byte magic followed by blocks, each with a 12-byte
+//! header: the raw length (u32 LE, 0 ends the stream and has no other
+//! fields), the coded length (u32 LE, the high bit set when the block is
+//! stored uncompressed) and the CRC32 of the raw bytes. Every block is coded
+//! on its own, so a flush only has to end the current block.
+
+use std::marker::PhantomData;
+
+use crate::XDeltaError;
+
+/// Largest raw block.
+pub(crate) const BLOCK_MAX: usize = 1 << 20;
+/// High bit of the coded length: the block is stored uncompressed.
+const STORED: u32 = 0x8000_0000;
+const BLOCK_HEADER_LEN: usize = 12;
+
+/// Longest Huffman code.
+pub(crate) const MAX_CODE_LEN: usize = 16;
+
+/// One block codec inside the shared framing.
+pub(crate) trait BlockCodec {
+    const MAGIC: [u8; 4];
+    /// stream name for error messages
+    const NAME: &'static str;
+    /// Append the coding of `raw` (not empty) at `level` to `out`.
+    fn encode(raw: &[u8], level: Option<u32>, out: &mut Vec<u8>);
+    /// Decode `coded` into `out`, which is cleared and must end up `raw_len` bytes long.
+    fn decode(coded: &[u8], raw_len: usize, out: &mut Vec<u8>) -> Result<(), XDeltaError>;
+}
+
+pub(crate) fn crc32(data: &[u8]) -> u32 {
+    let mut c = flate2::Crc::new();
+    c.update(data);
+    c.sum()
+}
+
+/// Streaming encoder: input is collected into blocks of BLOCK_MAX bytes.
+pub(crate) struct FramedEncoder<C: BlockCodec> {
+    level: Option<u32>,
+    started: bool,
+    block: Vec<u8>,
+    coded: Vec<u8>,
+    codec: PhantomData<C>,
+}
+
+impl<C: BlockCodec> FramedEncoder<C> {
+    pub(crate) fn new(level: Option<u32>) -> Self {
+        FramedEncoder {
+            level,
+            started: false,
+            block: Vec::new(),
+            coded: Vec::new(),
+            codec: PhantomData,
+        }
+    }
+
+    pub(crate) fn write(&mut self, mut data: &[u8], out: &mut Vec<u8>) {
+        while !data.is_empty() {
+            let n = usize::min(BLOCK_MAX - self.block.len(), data.len());
+            self.block.extend_from_slice(&data[..n]);
+            data = &data[n..];
+            if self.block.len() == BLOCK_MAX {
+                self.emit(out);
+            }
+        }
+    }
+
+    /// End the current block, so everything written so far can be decoded.
+    pub(crate) fn flush(&mut self, out: &mut Vec<u8>) {
+        if !self.block.is_empty() {
+            self.emit(out);
+        }
+    }
+
+    pub(crate) fn finish(&mut self, out: &mut Vec<u8>) {
+        self.flush(out);
+        self.start(out);
+        out.extend_from_slice(&0u32.to_le_bytes());
+    }
+
+    fn start(&mut self, out: &mut Vec<u8>) {
+        if !self.started {
+            out.extend_from_slice(&C::MAGIC);
+            self.started = true;
+        }
+    }
+
+    fn emit(&mut self, out: &mut Vec<u8>) {
+        self.start(out);
+        self.coded.clear();
+        C::encode(&self.block, self.level, &mut self.coded);
+        out.extend_from_slice(&(self.block.len() as u32).to_le_bytes());
+        if self.coded.len() < self.block.len() {
+            out.extend_from_slice(&(self.coded.len() as u32).to_le_bytes());
+            out.extend_from_slice(&crc32(&self.block).to_le_bytes());
+            out.extend_from_slice(&self.coded);
+        } else {
+            out.extend_from_slice(&(self.block.len() as u32 | STORED).to_le_bytes());
+            out.extend_from_slice(&crc32(&self.block).to_le_bytes());
+            out.extend_from_slice(&self.block);
+        }
+        self.block.clear();
+    }
+}
+
+enum State {
+    Magic,
+    /// the raw length, or the rest of the block header once it is known not to be 0
+    Header,
+    Block { raw_len: usize, coded_len: usize, stored: bool, crc: u32 },
+    Ended,
+}
+
+/// Streaming decoder, passing each decoded block to the sink.
+pub(crate) struct FramedDecoder<C: BlockCodec> {
+    state: State,
+    /// bytes of the magic, block header or block collected so far
+    pending: Vec<u8>,
+    block: Vec<u8>,
+    codec: PhantomData<C>,
+}
+
+impl<C: BlockCodec> FramedDecoder<C> {
+    pub(crate) fn new() -> Self {
+        FramedDecoder {
+            state: State::Magic,
+            pending: Vec::new(),
+            block: Vec::new(),
+            codec: PhantomData,
+        }
+    }
+
+    fn corrupt(msg: &str) -> XDeltaError {
+        XDeltaError::Corrupt(format!("invalid {} stream: {}", C::NAME, msg))
+    }
+
+    pub(crate) fn feed(
+        &mut self,
+        mut patch: &[u8],
+        sink: &mut impl FnMut(&[u8]) -> Result<(), XDeltaError>,
+    ) -> Result<(), XDeltaError> {
+        while !patch.is_empty() {
+            let want = match self.state {
+                State::Magic => 4,
+                // the raw length first: the end marker has no other fields
+                State::Header if self.pending.len() < 4 => 4,
+                State::Header => BLOCK_HEADER_LEN,
+                State::Block { coded_len, .. } => coded_len,
+                State::Ended => {
+                    return Err(XDeltaError::Corrupt(format!("trailing data after {} stream", C::NAME)));
+                }
+            };
+            let n = usize::min(want - self.pending.len(), patch.len());
+            self.pending.extend_from_slice(&patch[..n]);
+            patch = &patch[n..];
+            if self.pending.len() < want {
+                return Ok(());
+            }
+            let piece = &self.pending[..];
+            self.state = match self.state {
+                State::Magic => {
+                    if piece != C::MAGIC {
+                        return Err(Self::corrupt("bad magic"));
+                    }
+                    State::Header
+                }
+                State::Header if piece.len() == 4 => {
+                    if read_u32(piece, 0) == 0 {
+                        State::Ended
+                    } else {
+                        // keep the raw length and collect the rest of the header
+                        continue;
+                    }
+                }
+                State::Header => {
+                    let raw_len = read_u32(piece, 0) as usize;
+                    let coded = read_u32(piece, 4);
+                    let stored = coded & STORED != 0;
+                    let coded_len = (coded & !STORED) as usize;
+                    if raw_len > BLOCK_MAX {
+                        return Err(Self::corrupt("block size out of range"));
+                    }
+                    if coded_len == 0 || stored && coded_len != raw_len || !stored && coded_len >= raw_len {
+                        return Err(Self::corrupt("coded block size out of range"));
+                    }
+                    State::Block { raw_len, coded_len, stored, crc: read_u32(piece, 8) }
+                }
+                State::Block { raw_len, stored, crc, .. } => {
+                    let raw = if stored {
+                        piece
+                    } else {
+                        C::decode(piece, raw_len, &mut self.block)?;
+                        if self.block.len() != raw_len {
+                            return Err(Self::corrupt("block decodes to the wrong length"));
+                        }
+                        &self.block[..]
+                    };
+                    if crc32(raw) != crc {
+                        return Err(Self::corrupt("block CRC mismatch"));
+                    }
+                    sink(raw)?;
+                    State::Header
+                }
+                State::Ended => unreachable!(),
+            };
+            self.pending.clear();
+        }
+        Ok(())
+    }
+
+    pub(crate) fn ended(&self) -> bool {
+        matches!(self.state, State::Ended)
+    }
+}
+
+fn read_u32(b: &[u8], at: usize) -> u32 {
+    u32::from_le_bytes([b[at], b[at + 1], b[at + 2], b[at + 3]])
+}
+
+/// MSB-first bit writer.
+pub(crate) struct BitWriter<'a> {
+    out: &'a mut Vec<u8>,
+    acc: u64,
+    bits: u32,
+}
+
+impl<'a> BitWriter<'a> {
+    pub(crate) fn new(out: &'a mut Vec<u8>) -> Self {
+        BitWriter { out, acc: 0, bits: 0 }
+    }
+
+    /// Write the low `len` (at most 32) bits of `v`.
+    pub(crate) fn put(&mut self, v: u32, len: u32) {
+        debug_assert!(len <= 32);
+        self.acc = self.acc << len | (v as u64 & ((1u64 << len) - 1));
+        self.bits += len;
+        while self.bits >= 8 {
+            self.bits -= 8;
+            self.out.push((self.acc >> self.bits) as u8);
+        }
+    }
+
+    /// Pad the last byte with zero bits.
+    pub(crate) fn finish(mut self) {
+        if self.bits > 0 {
+            let pad = 8 - self.bits;
+            self.put(0, pad);
+        }
+    }
+}
+
+/// MSB-first bit reader; reading past the end is a corrupt stream.
+pub(crate) struct BitReader<'a> {
+    data: &'a [u8],
+    pos: usize,
+    acc: u64,
+    bits: u32,
+    name: &'static str,
+}
+
+impl<'a> BitReader<'a> {
+    pub(crate) fn new(data: &'a [u8], name: &'static str) -> Self {
+        BitReader { data, pos: 0, acc: 0, bits: 0, name }
+    }
+
+    pub(crate) fn bit(&mut self) -> Result<u32, XDeltaError> {
+        if self.bits == 0 {
+            let Some(&b) = self.data.get(self.pos) else {
+                return Err(XDeltaError::Corrupt(format!("invalid {} stream: truncated block", self.name)));
+            };
+            self.pos += 1;
+            self.acc = b as u64;
+            self.bits = 8;
+        }
+        self.bits -= 1;
+        Ok((self.acc >> self.bits) as u32 & 1)
+    }
+
+    pub(crate) fn bits(&mut self, len: u32) -> Result<u32, XDeltaError> {
+        let mut v = 0;
+        for _ in 0..len {
+            v = v << 1 | self.bit()?;
+        }
+        Ok(v)
+    }
+}
+
+/// Huffman code lengths for `freqs`, none longer than `max_len`; symbols
+/// with a zero frequency get length 0 (no code). A single used symbol gets
+/// length 1. Ties are broken by symbol, so the result is deterministic.
+pub(crate) fn code_lengths(freqs: &[u32], max_len: usize) -> Vec<u8> {
+    let mut weights: Vec<u64> = freqs.iter().map(|&f| f as u64).collect();
+    loop {
+        let lens = unlimited_lengths(&weights);
+        if lens.iter().all(|&l| l as usize <= max_len) {
+            return lens;
+        }
+        // flatten the distribution until the longest code fits, as bzip2 does
+        for w in weights.iter_mut().filter(|w| **w > 0) {
+            *w = 1 + *w / 2;
+        }
+    }
+}
+
+fn unlimited_lengths(weights: &[u64]) -> Vec<u8> {
+    use std::cmp::Reverse;
+    use std::collections::BinaryHeap;
+
+    let mut lens = vec![0u8; weights.len()];
+    let used: Vec<usize> = (0..weights.len()).filter(|&s| weights[s] > 0).collect();
+    match used.len() {
+        0 => return lens,
+        1 => {
+            lens[used[0]] = 1;
+            return lens;
+        }
+        _ => {}
+    }
+    // nodes 0..n are the symbols, internal nodes follow; parent of the root is itself
+    let mut parent: Vec<usize> = Vec::with_capacity(2 * used.len());
+    let mut heap = BinaryHeap::new();
+    for (i, &s) in used.iter().enumerate() {
+        parent.push(i);
+        heap.push(Reverse((weights[s], i)));
+    }
+    while heap.len() > 1 {
+        let Reverse((wa, a)) = heap.pop().unwrap();
+        let Reverse((wb, b)) = heap.pop().unwrap();
+        let n = parent.len();
+        parent.push(n);
+        parent[a] = n;
+        parent[b] = n;
+        heap.push(Reverse((wa + wb, n)));
+    }
+    // internal nodes are created after their children, so depths can be filled from the root down
+    let mut depth = vec![0u8; parent.len()];
+    for n in (0..parent.len() - 1).rev() {
+        depth[n] = depth[parent[n]] + 1;
+    }
+    for (i, &s) in used.iter().enumerate() {
+        lens[s] = depth[i];
+    }
+    lens
+}
+
+/// Canonical codes for `lens`: shorter codes first, by symbol within a length.
+pub(crate) fn canonical_codes(lens: &[u8]) -> Vec<u32> {
+    let mut count = [0u32; MAX_CODE_LEN + 1];
+    for &l in lens {
+        count[l as usize] += 1;
+    }
+    count[0] = 0;
+    let mut next = [0u32; MAX_CODE_LEN + 2];
+    for len in 1..=MAX_CODE_LEN {
+        next[len + 1] = (next[len] + count[len]) << 1;
+    }
+    let mut codes = vec![0u32; lens.len()];
+    for (s, &l) in lens.iter().enumerate() {
+        if l > 0 {
+            codes[s] = next[l as usize];
+            next[l as usize] += 1;
+        }
+    }
+    codes
+}
+
+/// Decoder for a canonical code, one bit at a time as in zlib's puff.
+pub(crate) struct CanonicalDecoder {
+    count: [u16; MAX_CODE_LEN + 1],
+    /// symbols ordered by code
+    symbols: Vec<u16>,
+}
+
+impl CanonicalDecoder {
+    /// Build the decoder; lengths above MAX_CODE_LEN or more codes of a
+    /// length than fit (an over-subscribed code) are corrupt. An incomplete
+    /// code is accepted, its unused codes fail to decode.
+    pub(crate) fn new(lens: &[u8], name: &str) -> Result<Self, XDeltaError> {
+        let mut count = [0u16; MAX_CODE_LEN + 1];
+        for &l in lens {
+            if l as usize > MAX_CODE_LEN {
+                return Err(XDeltaError::Corrupt(format!("invalid {} stream: code length {}", name, l)));
+            }
+            count[l as usize] += 1;
+        }
+        count[0] = 0;
+        let mut left: i32 = 1;
+        for &c in &count[1..] {
+            left = (left << 1) - c as i32;
+            if left < 0 {
+                return Err(XDeltaError::Corrupt(format!("invalid {} stream: over-subscribed code", name)));
+            }
+        }
+        let mut symbols = Vec::with_capacity(lens.len());
+        for len in 1..=MAX_CODE_LEN as u8 {
+            symbols.extend((0..lens.len()).filter(|&s| lens[s] == len).map(|s| s as u16));
+        }
+        Ok(CanonicalDecoder { count, symbols })
+    }
+
+    pub(crate) fn decode(&self, r: &mut BitReader) -> Result<u16, XDeltaError> {
+        let (mut code, mut first, mut index) = (0i32, 0i32, 0i32);
+        for len in 1..=MAX_CODE_LEN {
+            code |= r.bit()? as i32;
+            let count = self.count[len] as i32;
+            if code - first < count {
+                return Ok(self.symbols[(index + code - first) as usize]);
+            }
+            index += count;
+            first = (first + count) << 1;
+            code <<= 1;
+        }
+        Err(XDeltaError::Corrupt(format!("invalid {} stream: unused code", r.name)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn bits_round_trip() {
+        let mut out = Vec::new();
+        let mut w = BitWriter::new(&mut out);
+        let values = [(1u32, 1u32), (0, 3), (0x1234, 16), (5, 3), (0xffff_ffff, 32), (0, 1)];
+        for &(v, len) in &values {
+            w.put(v, len);
+        }
+        w.finish();
+        let mut r = BitReader::new(&out, "test");
+        for &(v, len) in &values {
+            assert_eq!(r.bits(len).unwrap(), v);
+        }
+    }
+
+    #[test]
+    fn reading_past_the_end_is_corrupt() {
+        let data = [0xa5u8];
+        let mut r = BitReader::new(&data, "test");
+        assert_eq!(r.bits(8).unwrap(), 0xa5);
+        assert!(matches!(r.bit(), Err(XDeltaError::Corrupt(_))));
+    }
+
+    #[test]
+    fn lengths_are_a_complete_prefix_code() {
+        let freqs: Vec<u32> = (0..256).map(|s| if s % 7 == 0 { 0 } else { 1 + (s * s) % 1000 }).collect();
+        let lens = code_lengths(&freqs, MAX_CODE_LEN);
+        let kraft: f64 = lens.iter().filter(|&&l| l > 0).map(|&l| 0.5f64.powi(l as i32)).sum();
+        assert!((kraft - 1.0).abs() < 1e-9, "kraft sum {}", kraft);
+        for (s, &l) in lens.iter().enumerate() {
+            assert_eq!(l == 0, freqs[s] == 0, "symbol {}", s);
+        }
+    }
+
+    #[test]
+    fn lengths_are_limited() {
+        // Fibonacci frequencies make the unlimited code as deep as there are symbols
+        let mut freqs = vec![1u32, 1];
+        while freqs.len() < 30 {
+            let n = freqs.len();
+            freqs.push(freqs[n - 1] + freqs[n - 2]);
+        }
+        let lens = code_lengths(&freqs, MAX_CODE_LEN);
+        assert!(lens.iter().all(|&l| l >= 1 && l as usize <= MAX_CODE_LEN));
+        assert!(CanonicalDecoder::new(&lens, "test").is_ok());
+    }
+
+    #[test]
+    fn single_symbol_gets_a_one_bit_code() {
+        let mut freqs = vec![0u32; 256];
+        freqs[42] = 10;
+        let lens = code_lengths(&freqs, MAX_CODE_LEN);
+        assert_eq!(lens[42], 1);
+        assert_eq!(lens.iter().filter(|&&l| l > 0).count(), 1);
+    }
+
+    #[test]
+    fn canonical_codes_decode() {
+        let freqs: Vec<u32> = (0..256).map(|s| (s as u32 % 13) * 3).collect();
+        let lens = code_lengths(&freqs, MAX_CODE_LEN);
+        let codes = canonical_codes(&lens);
+        let symbols: Vec<u16> = (0..2000u32).map(|i| (i * 37 % 256) as u16).filter(|&s| lens[s as usize] > 0).collect();
+        let mut out = Vec::new();
+        let mut w = BitWriter::new(&mut out);
+        for &s in &symbols {
+            w.put(codes[s as usize], lens[s as usize] as u32);
+        }
+        w.finish();
+        let dec = CanonicalDecoder::new(&lens, "test").unwrap();
+        let mut r = BitReader::new(&out, "test");
+        for &s in &symbols {
+            assert_eq!(dec.decode(&mut r).unwrap(), s);
+        }
+    }
+
+    #[test]
+    fn over_subscribed_code_is_corrupt() {
+        assert!(matches!(CanonicalDecoder::new(&[1, 1, 1], "test"), Err(XDeltaError::Corrupt(_))));
+        assert!(matches!(CanonicalDecoder::new(&[17], "test"), Err(XDeltaError::Corrupt(_))));
+    }
+}
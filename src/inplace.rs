@@ -0,0 +1,275 @@
+// src/inplace.rs
+//! Applying a patch to a file in place, without room for a second copy of it.
+//!
+//! The target is described as pieces (see `merge::layout`). Only the COPY
+//! pieces read the file, so they are executed first, in an order in which no
+//! byte is overwritten before every COPY that reads it has run: a COPY has to
+//! precede each COPY whose target range overlaps its source range. Cycles in
+//! that relation are broken by reading the source of one COPY of the cycle
+//! into memory before anything is written, turning it into literal data
+//! (Burns and Long, "In-place reconstruction of delta compressed files").
+//! Literal pieces are written last and the file is then cut to the target length.
+use std::fs::OpenOptions;
+use std::io::{Read, Seek, SeekFrom, Write};
+use std::path::Path;
+
+use crate::file::FileStats;
+use crate::merge::{self, Piece};
+use crate::XDeltaError;
+
+/// Size of the buffer COPY, RUN and spill data are moved through.
+const MOVE_CHUNK: usize = 1024 * 1024;
+
+#[derive(Clone, Copy)]
+struct Move {
+    src: u64,
+    dst: u64,
+    len: u64,
+}
+
+/// Order in which the moves can be executed in place, and the moves that
+/// have to be read into memory up front instead.
+struct Plan {
+    order: Vec<usize>,
+    spilled: Vec<bool>,
+    spill_bytes: u64,
+}
+
+/// Source ranges of the moves as an implicit search tree over the moves
+/// sorted by source offset; every node keeps the largest end in its subtree.
+struct ReadIndex {
+    by_src: Vec<usize>,
+    max_end: Vec<u64>,
+}
+
+impl ReadIndex {
+    fn new(moves: &[Move]) -> ReadIndex {
+        let mut by_src: Vec<usize> = (0..moves.len()).collect();
+        by_src.sort_by_key(|&i| moves[i].src);
+        let mut index = ReadIndex { max_end: vec![0; by_src.len()], by_src };
+        index.build(moves, 0, moves.len());
+        index
+    }
+
+    fn build(&mut self, moves: &[Move], lo: usize, hi: usize) -> u64 {
+        if lo >= hi {
+            return 0;
+        }
+        let mid = lo + (hi - lo) / 2;
+        let m = &moves[self.by_src[mid]];
+        let end = u64::max(m.src + m.len, u64::max(self.build(moves, lo, mid), self.build(moves, mid + 1, hi)));
+        self.max_end[mid] = end;
+        end
+    }
+
+    /// Append to `out` every move whose source range overlaps `start..end`.
+    fn overlapping(&self, moves: &[Move], start: u64, end: u64, out: &mut Vec<usize>) {
+        self.query(moves, 0, self.by_src.len(), start, end, out);
+    }
+
+    fn query(&self, moves: &[Move], lo: usize, hi: usize, start: u64, end: u64, out: &mut Vec<usize>) {
+        if lo >= hi {
+            return;
+        }
+        let mid = lo + (hi - lo) / 2;
+        if self.max_end[mid] <= start {
+            return;
+        }
+        self.query(moves, lo, mid, start, end, out);
+        let i = self.by_src[mid];
+        let m = &moves[i];
+        if m.src < end {
+            if m.src + m.len > start {
+                out.push(i);
+            }
+            self.query(moves, mid + 1, hi, start, end, out);
+        }
+    }
+}
+
+/// Topological order of the moves by a depth-first search over the moves that
+/// have to run before each one. When a cycle closes, the shorter of the two
+/// moves on the closing edge is spilled, which removes the edge.
+fn plan(moves: &[Move], max_spill: Option<u64>) -> Result<Plan, XDeltaError> {
+    const NEW: u8 = 0;
+    const ACTIVE: u8 = 1;
+    const DONE: u8 = 2;
+    let index = ReadIndex::new(moves);
+    let mut state = vec![NEW; moves.len()];
+    let mut plan = Plan {
+        order: Vec::with_capacity(moves.len()),
+        spilled: vec![false; moves.len()],
+        spill_bytes: 0,
+    };
+    // (move, the moves reading its target range, how many of them were visited)
+    let mut stack: Vec<(usize, Vec<usize>, usize)> = Vec::new();
+    let pending = |v: usize| {
+        let mut before = Vec::new();
+        index.overlapping(moves, moves[v].dst, moves[v].dst + moves[v].len, &mut before);
+        before.retain(|&u| u != v);
+        before
+    };
+    for root in 0..moves.len() {
+        if state[root] != NEW {
+            continue;
+        }
+        state[root] = ACTIVE;
+        stack.push((root, pending(root), 0));
+        while let Some((v, before, next)) = stack.last_mut() {
+            let v = *v;
+            if plan.spilled[v] || *next == before.len() {
+                stack.pop();
+                state[v] = DONE;
+                if !plan.spilled[v] {
+                    plan.order.push(v);
+                }
+                continue;
+            }
+            let u = before[*next];
+            *next += 1;
+            if plan.spilled[u] {
+                continue;
+            }
+            match state[u] {
+                NEW => {
+                    state[u] = ACTIVE;
+                    stack.push((u, pending(u), 0));
+                }
+                ACTIVE => {
+                    let victim = if moves[u].len <= moves[v].len { u } else { v };
+                    plan.spilled[victim] = true;
+                    plan.spill_bytes += moves[victim].len;
+                    if let Some(max) = max_spill.filter(|&max| plan.spill_bytes > max) {
+                        return Err(XDeltaError::OutOfMemory(format!(
+                            "applying the patch in place needs more than {} bytes of memory for data that is \
+                             overwritten before it is read",
+                            max
+                        )));
+                    }
+                }
+                _ => {}
+            }
+        }
+    }
+    Ok(plan)
+}
+
+fn io_err(what: &str) -> impl Fn(std::io::Error) -> XDeltaError + '_ {
+    move |e| XDeltaError::Io(format!("failed to {} {}", what, e))
+}
+
+fn read_at<F: Read + Seek>(f: &mut F, off: u64, buf: &mut [u8]) -> Result<(), XDeltaError> {
+    f.seek(SeekFrom::Start(off)).and_then(|_| f.read_exact(buf)).map_err(io_err("read the file:"))
+}
+
+fn write_at<F: Write + Seek>(f: &mut F, off: u64, buf: &[u8]) -> Result<(), XDeltaError> {
+    f.seek(SeekFrom::Start(off)).and_then(|_| f.write_all(buf)).map_err(io_err("write the file:"))
+}
+
+/// Move `m.len` bytes within the file like memmove: a move to a higher offset
+/// that overlaps its own source is copied from the end.
+fn move_within<F: Read + Write + Seek>(f: &mut F, m: Move, buf: &mut [u8]) -> Result<(), XDeltaError> {
+    let backward = m.dst > m.src && m.dst < m.src + m.len;
+    let mut done = 0u64;
+    while done < m.len {
+        let n = u64::min(m.len - done, buf.len() as u64);
+        let off = if backward { m.len - done - n } else { done };
+        read_at(f, m.src + off, &mut buf[..n as usize])?;
+        write_at(f, m.dst + off, &buf[..n as usize])?;
+        done += n;
+    }
+    Ok(())
+}
+
+/// Apply `patch` to the file at `path`, overwriting it with the target.
+/// Everything that can fail without touching the file is checked first: the
+/// patch is parsed, its COPYs are range-checked, the order is planned and the
+/// spilled data is read. An error after that leaves the file half-patched.
+/// `max_spill` bounds the memory taken by spilled data.
+pub(crate) fn apply_patch_in_place(
+    path: &Path,
+    patch: &[u8],
+    max_output: Option<u64>,
+    max_spill: Option<u64>,
+) -> Result<FileStats, XDeltaError> {
+    let mut file = OpenOptions::new()
+        .read(true)
+        .write(true)
+        .open(path)
+        .map_err(|e| XDeltaError::Io(format!("failed to open {}: {}", path.display(), e)))?;
+    let old_size = file.metadata().map_err(io_err("stat the file:"))?.len();
+
+    let mut data = Vec::new();
+    let layout = merge::layout(patch, None, &mut data)?;
+    if let Some(max) = max_output.filter(|&max| layout.len > max) {
+        return Err(XDeltaError::OutputTooLarge(format!(
+            "patch declares {} bytes of output, the limit is {}",
+            layout.len, max
+        )));
+    }
+    let mut moves = Vec::new();
+    // index into `moves` of every COPY piece, None for pieces already in place
+    let mut move_of = Vec::with_capacity(layout.segs.len());
+    for s in &layout.segs {
+        let Piece::Copy(src) = s.piece else {
+            move_of.push(None);
+            continue;
+        };
+        if src.checked_add(s.len).is_none_or(|end| end > old_size) {
+            return Err(XDeltaError::SourceMismatch(format!("COPY beyond the end of the {} byte file", old_size)));
+        }
+        if src == s.at {
+            move_of.push(None);
+            continue;
+        }
+        move_of.push(Some(moves.len()));
+        moves.push(Move { src, dst: s.at, len: s.len });
+    }
+
+    let plan = plan(&moves, max_spill)?;
+    let mut spill = Vec::new();
+    // offset into `spill` of every spilled move
+    let mut spill_at = vec![0usize; moves.len()];
+    for (i, m) in moves.iter().enumerate() {
+        if plan.spilled[i] {
+            spill_at[i] = spill.len();
+            spill.resize(spill.len() + m.len as usize, 0);
+            let at = spill_at[i];
+            read_at(&mut file, m.src, &mut spill[at..])?;
+        }
+    }
+
+    let mut buf = vec![0u8; MOVE_CHUNK];
+    for &i in &plan.order {
+        move_within(&mut file, moves[i], &mut buf)?;
+    }
+    for (s, mv) in layout.segs.iter().zip(&move_of) {
+        match s.piece {
+            Piece::Add(a) => write_at(&mut file, s.at, &data[a..a + s.len as usize])?,
+            Piece::Run(b) => {
+                buf.fill(b);
+                let mut done = 0u64;
+                while done < s.len {
+                    let n = u64::min(s.len - done, buf.len() as u64);
+                    write_at(&mut file, s.at + done, &buf[..n as usize])?;
+                    done += n;
+                }
+            }
+            Piece::Copy(_) => {
+                if let Some(i) = *mv {
+                    if plan.spilled[i] {
+                        let at = spill_at[i];
+                        write_at(&mut file, s.at, &spill[at..at + s.len as usize])?;
+                    }
+                }
+            }
+        }
+    }
+    file.set_len(layout.len).map_err(io_err("resize the file:"))?;
+    file.flush().map_err(io_err("write the file:"))?;
+    Ok(FileStats {
+        old_size,
+        new_size: layout.len,
+        patch_size: patch.len() as u64,
+    })
+}
@@ -1,252 +1,172 @@
 // src/lib.rs
-use sha2::{Digest, Sha256};
-use std::collections::HashMap;
-use std::ffi::CString;
+use std::ffi::{CStr, CString};
 use std::os::raw::{c_char, c_int};
 use thiserror::Error;
-use std::cell::RefCell;
 
-thread_local! {
-    static LAST_ERROR: RefCell<Option<CString>> = RefCell::new(None);
-}
+mod alloc;
+mod batch;
+mod bsdiff;
+mod bzip2;
+mod cancel;
+mod cdc;
+mod checksum;
+mod compress;
+mod decoder;
+mod djw;
+mod dump;
+mod encoder;
+mod fgk;
+mod file;
+#[cfg(test)]
+mod fixtures;
+#[cfg(any(fuzzing, test))]
+pub mod fuzzing;
+mod huffman;
+mod inplace;
+mod logging;
+mod lz4;
+mod lzma;
+mod merge;
+mod mmap;
+mod ranges;
+mod source;
+mod stats;
+mod stream;
+mod vcdiff;
+mod version;
+mod window;
 
-fn set_last_error(err: &str) {
-    LAST_ERROR.with(|cell| {
-        *cell.borrow_mut() = Some(CString::new(err).unwrap_or_else(|_| CString::new("internal error").unwrap()));
-    });
-}
+use decoder::{
+    apply_patch_bytes, apply_patch_bytes_cancel, apply_patch_exact, apply_patch_into, patch_segments, patch_target_size,
+    validate_patch_bytes, verify_patch_bytes, PatchInfo, Segment,
+};
+use cancel::CancelToken;
+use encoder::{create_patch_bytes, create_patch_bytes_cancel, create_patch_to, threads_from_c, Encoding};
+use file::FileStats;
+use logging::log_at;
+use ranges::SourceRange;
+use window::{create_patch_bytes_window, create_patch_window_to};
 
-#[unsafe(no_mangle)]
-pub extern "C" fn xdelta_last_error() -> *const c_char {
-    LAST_ERROR.with(|cell| {
-        cell.borrow()
-            .as_ref()
-            .map(|s| s.as_ptr())
-            .unwrap_or(std::ptr::null())
-    })
-}
+/// 返回给 C 侧的错误码，与 xdelta_interface.h 中的 XDELTA_ERR_* 一致
+const ERR_INVALID_ARGUMENT: c_int = -1;
+const ERR_CANCELED: c_int = -2;
+const ERR_CORRUPT_PATCH: c_int = -3;
+const ERR_SOURCE_MISMATCH: c_int = -4;
+const ERR_OUTPUT_TOO_LARGE: c_int = -5;
+const ERR_IO: c_int = -6;
+const ERR_OUT_OF_MEMORY: c_int = -7;
+const ERR_UNSUPPORTED: c_int = -8;
+const ERR_CHECKSUM_MISMATCH: c_int = -9;
 
 #[derive(Error, Debug)]
 enum XDeltaError {
     #[error("invalid argument: {0}")]
     InvalidArg(String),
+    #[error("corrupt patch: {0}")]
+    Corrupt(String),
+    #[error("source mismatch: {0}")]
+    SourceMismatch(String),
+    #[error("io error: {0}")]
+    Io(String),
+    #[error("output too large: {0}")]
+    OutputTooLarge(String),
+    #[error("operation canceled")]
+    Canceled,
+    #[error("out of memory: {0}")]
+    OutOfMemory(String),
+    #[error("unsupported patch: {0}")]
+    Unsupported(String),
+    #[error("checksum mismatch: {0}")]
+    ChecksumMismatch(String),
 }
 
-/// A simple rsync-style rolling checksum (a,b) described in rsync tech report.
-/// Weak checksum is (b << 16) | a (u32).
-#[derive(Clone, Copy, Debug)]
-struct Rolling {
-    a: u32,
-    b: u32,
-    len: usize,
-}
-impl Rolling {
-    fn new() -> Self {
-        Rolling { a: 0, b: 0, len: 0 }
-    }
-
-    fn from_slice(buf: &[u8]) -> Self {
-        let mut a: u32 = 0;
-        let mut b: u32 = 0;
-        for (i, &v) in buf.iter().enumerate() {
-            a = a.wrapping_add(v as u32);
-            b = b.wrapping_add((buf.len() - i) as u32 * v as u32);
-        }
-        Rolling {
-            a,
-            b,
-            len: buf.len(),
-        }
-    }
-
-    /// roll window: remove `prev` byte, add `next` byte
-    fn roll(&mut self, prev: u8, next: u8) {
-        let len = self.len as u32;
-        // based on rsync-style weak checksum updates
-        self.a = self.a.wrapping_sub(prev as u32).wrapping_add(next as u32);
-        self.b = self.b.wrapping_sub((len) * (prev as u32)).wrapping_add(self.a);
-    }
-
-    fn chksum(&self) -> u32 {
-        ((self.b & 0xffff_ffff) << 16) ^ (self.a & 0xffff)
-    }
-}
-
-/// Block signature entry
-struct SigEntry {
-    block_index: u64,
-    strong_hash: [u8; 32], // sha256
-}
-
-/// Build signatures for the "old" file
-fn build_signatures(old: &[u8], block_size: usize) -> HashMap<u32, Vec<SigEntry>> {
-    let mut map: HashMap<u32, Vec<SigEntry>> = HashMap::new();
-    let mut idx: u64 = 0;
-    let mut offset = 0usize;
-    while offset < old.len() {
-        let end = usize::min(offset + block_size, old.len());
-        let slice = &old[offset..end];
-        let weak = Rolling::from_slice(slice).chksum();
-        let mut hasher = Sha256::new();
-        hasher.update(slice);
-        let strong = hasher.finalize();
-        let mut arr = [0u8; 32];
-        arr.copy_from_slice(&strong);
-        map.entry(weak).or_default().push(SigEntry {
-            block_index: idx,
-            strong_hash: arr,
-        });
-        idx += 1;
-        offset += block_size;
-    }
-    map
-}
-
-/// Patch format (simple custom):
-/// [records...] where each record is:
-/// opcode: u8 (0x00 = ADD, 0x01 = COPY)
-/// If ADD:
-///   length: u32 (little-endian)
-///   data: [length] bytes
-/// If COPY:
-///   offset: u64 (little-endian)  // offset in old file
-///   length: u32 (little-endian)
-///
-/// This is simple, versionable, and easy to apply.
-fn create_patch_bytes(old: &[u8], new: &[u8], block_size: usize) -> Result<Vec<u8>, XDeltaError> {
-    if block_size == 0 {
-        return Err(XDeltaError::InvalidArg("block_size must be > 0".into()));
-    }
-    let sigs = build_signatures(old, block_size);
-
-    let mut out: Vec<u8> = Vec::with_capacity(new.len() / 4);
-    let mut pos: usize = 0;
-    let mut pending_add: Vec<u8> = Vec::new();
-
-    // helper to flush pending adds
-    let flush_add = |out: &mut Vec<u8>, pending: &mut Vec<u8>| {
-        if !pending.is_empty() {
-            out.push(0x00); // ADD
-            let len = pending.len() as u32;
-            out.extend_from_slice(&len.to_le_bytes());
-            out.extend_from_slice(&pending[..]);
-            pending.clear();
-        }
-    };
-
-    while pos < new.len() {
-        let remaining = new.len() - pos;
-        let try_len = usize::min(block_size, remaining);
-        if try_len < 1 {
-            // shouldn't happen, but safety
-            pending_add.push(new[pos]);
-            pos += 1;
-            continue;
-        }
-
-        if pos + try_len <= new.len() {
-            let window = &new[pos..pos + try_len];
-            let weak = Rolling::from_slice(window).chksum();
-            let candidates = sigs.get(&weak);
-            let mut matched = false;
-            if let Some(vec) = candidates {
-                // Compute strong for this window and compare
-                let mut hasher = Sha256::new();
-                hasher.update(window);
-                let strong = hasher.finalize();
-
-                for e in vec {
-                    if e.strong_hash[..] == strong[..] {
-                        // Found a match. Flush any pending adds.
-                        flush_add(&mut out, &mut pending_add);
-                        out.push(0x01); // COPY
-                        let offset_in_old: u64 = e.block_index * (block_size as u64);
-                        out.extend_from_slice(&offset_in_old.to_le_bytes());
-                        let copy_len = try_len as u32;
-                        out.extend_from_slice(&copy_len.to_le_bytes());
-                        pos += try_len;
-                        matched = true;
-                        break;
-                    }
-                }
-            }
+impl XDeltaError {
+    /// Prefix the message with `what`, keeping the kind of error (and so its C code).
+    fn context(self, what: &str) -> XDeltaError {
+        let wrap = |m: String| format!("{}: {}", what, m);
+        match self {
+            XDeltaError::InvalidArg(m) => XDeltaError::InvalidArg(wrap(m)),
+            XDeltaError::Corrupt(m) => XDeltaError::Corrupt(wrap(m)),
+            XDeltaError::SourceMismatch(m) => XDeltaError::SourceMismatch(wrap(m)),
+            XDeltaError::Io(m) => XDeltaError::Io(wrap(m)),
+            XDeltaError::OutputTooLarge(m) => XDeltaError::OutputTooLarge(wrap(m)),
+            XDeltaError::Canceled => XDeltaError::Canceled,
+            XDeltaError::OutOfMemory(m) => XDeltaError::OutOfMemory(wrap(m)),
+            XDeltaError::Unsupported(m) => XDeltaError::Unsupported(wrap(m)),
+            XDeltaError::ChecksumMismatch(m) => XDeltaError::ChecksumMismatch(wrap(m)),
+        }
+    }
 
-            if !matched {
-                // sliding by 1 byte: add first byte to pending_add and continue
-                pending_add.push(new[pos]);
-                pos += 1;
-                // To avoid pathological O(n^2) behavior for huge pending_add, flush periodically:
-                if pending_add.len() >= block_size {
-                    flush_add(&mut out, &mut pending_add);
-                }
-            }
-        } else {
-            // leftover bytes less than try_len (end of file)
-            pending_add.extend_from_slice(&new[pos..]);
-            break;
+    fn code(&self) -> c_int {
+        match self {
+            XDeltaError::InvalidArg(_) => ERR_INVALID_ARGUMENT,
+            XDeltaError::Corrupt(_) => ERR_CORRUPT_PATCH,
+            XDeltaError::SourceMismatch(_) => ERR_SOURCE_MISMATCH,
+            XDeltaError::Io(_) => ERR_IO,
+            XDeltaError::OutputTooLarge(_) => ERR_OUTPUT_TOO_LARGE,
+            XDeltaError::Canceled => ERR_CANCELED,
+            XDeltaError::OutOfMemory(_) => ERR_OUT_OF_MEMORY,
+            XDeltaError::Unsupported(_) => ERR_UNSUPPORTED,
+            XDeltaError::ChecksumMismatch(_) => ERR_CHECKSUM_MISMATCH,
         }
     }
+}
 
-    // flush remaining adds
-    if !pending_add.is_empty() {
-        out.push(0x00);
-        let len = pending_add.len() as u32;
-        out.extend_from_slice(&len.to_le_bytes());
-        out.extend_from_slice(&pending_add[..]);
+/// Hand the message of `e` to the caller through `err` (if non-NULL) and map
+/// it to its C return code. The string is released with xdelta_free_error.
+fn fail(e: XDeltaError, err: *mut *mut c_char) -> c_int {
+    log_at!(logging::DEBUG, "returning error {}: {}", e.code(), e);
+    if !err.is_null() {
+        let msg = CString::new(e.to_string()).unwrap_or_else(|_| CString::new("internal error").unwrap());
+        unsafe {
+            *err = alloc::error_string(msg);
+        }
     }
+    e.code()
+}
 
-    Ok(out)
+/// Run a decoding step, turning a panic into a corrupt-patch error. Patches
+/// often come from untrusted sources, and a panic unwinding out of an
+/// extern "C" function would abort the whole host process.
+fn guard_decode<T>(f: impl FnOnce() -> Result<T, XDeltaError>) -> Result<T, XDeltaError> {
+    std::panic::catch_unwind(std::panic::AssertUnwindSafe(f)).unwrap_or_else(|payload| {
+        let reason = payload
+            .downcast_ref::<&str>()
+            .map(|s| s.to_string())
+            .or_else(|| payload.downcast_ref::<String>().cloned())
+            .unwrap_or_else(|| "unknown panic".into());
+        log_at!(logging::ERROR, "decoder panicked: {}", reason);
+        Err(XDeltaError::Corrupt("malformed patch (decoder panicked)".into()))
+    })
 }
 
-/// Apply the simple patch format to `old` -> produces reconstructed `new`.
-fn apply_patch_bytes(old: &[u8], patch: &[u8]) -> Result<Vec<u8>, XDeltaError> {
-    let mut pos = 0usize;
-    let mut out: Vec<u8> = Vec::new();
-    while pos < patch.len() {
-        let opcode = patch[pos];
-        pos += 1;
-        match opcode {
-            0x00 => {
-                if pos + 4 > patch.len() {
-                    return Err(XDeltaError::InvalidArg("truncated ADD length".into()));
-                }
-                let mut lenb = [0u8; 4];
-                lenb.copy_from_slice(&patch[pos..pos + 4]);
-                pos += 4;
-                let len = u32::from_le_bytes(lenb) as usize;
-                if pos + len > patch.len() {
-                    return Err(XDeltaError::InvalidArg("truncated ADD data".into()));
-                }
-                out.extend_from_slice(&patch[pos..pos + len]);
-                pos += len;
-            }
-            0x01 => {
-                if pos + 8 + 4 > patch.len() {
-                    return Err(XDeltaError::InvalidArg("truncated COPY entry".into()));
-                }
-                let mut offb = [0u8; 8];
-                offb.copy_from_slice(&patch[pos..pos + 8]);
-                pos += 8;
-                let offset = u64::from_le_bytes(offb) as usize;
-                let mut lenb = [0u8; 4];
-                lenb.copy_from_slice(&patch[pos..pos + 4]);
-                pos += 4;
-                let len = u32::from_le_bytes(lenb) as usize;
-                if offset + len > old.len() {
-                    return Err(XDeltaError::InvalidArg("COPY out of range".into()));
-                }
-                out.extend_from_slice(&old[offset..offset + len]);
-            }
-            other => {
-                return Err(XDeltaError::InvalidArg(format!("unknown opcode {:#x}", other)));
-            }
+/// Hand `data` to the caller as a malloc'd buffer released by xdelta_free_data.
+fn return_buffer(data: Vec<u8>, out: *mut *mut u8, out_len: *mut usize, err: *mut *mut c_char) -> c_int {
+    unsafe {
+        *out_len = data.len();
+        *out = alloc::alloc_buffer(data.len());
+        if (*out).is_null() {
+            return fail(XDeltaError::OutOfMemory("failed to allocate memory".into()), err);
         }
+        std::ptr::copy_nonoverlapping(data.as_ptr(), *out, data.len());
     }
-    Ok(out)
+    0
+}
+
+/// Borrow a caller-owned input buffer. NULL is accepted for an empty buffer
+/// so callers can pass their own memory without allocating for len == 0.
+unsafe fn input_slice<'a>(data: *const u8, len: usize) -> Result<&'a [u8], XDeltaError> {
+    if data.is_null() {
+        if len > 0 {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        return Ok(&[]);
+    }
+    Ok(unsafe { std::slice::from_raw_parts(data, len) })
 }
 
 /// 创建补丁数据（内存版本）
-/// 成功时返回0，失败返回-1
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
 #[unsafe(no_mangle)]
 pub extern "C" fn xdelta_create_patch_data(
     old_data: *const u8,
@@ -256,40 +176,244 @@ pub extern "C" fn xdelta_create_patch_data(
     patch_data: *mut *mut u8,
     patch_len: *mut usize,
     block_size: u32,
+    err: *mut *mut c_char,
 ) -> c_int {
     let r = (|| -> Result<Vec<u8>, XDeltaError> {
-        if old_data.is_null() || new_data.is_null() || patch_data.is_null() || patch_len.is_null() {
+        if patch_data.is_null() || patch_len.is_null() {
             return Err(XDeltaError::InvalidArg("null pointer".into()));
         }
 
-        let old_bytes = unsafe { std::slice::from_raw_parts(old_data, old_len) };
-        let new_bytes = unsafe { std::slice::from_raw_parts(new_data, new_len) };
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let new_bytes = unsafe { input_slice(new_data, new_len) }?;
 
         create_patch_bytes(old_bytes, new_bytes, block_size as usize)
     })();
 
     match r {
-        Ok(data) => {
-            unsafe {
-                *patch_len = data.len();
-                *patch_data = libc::malloc(data.len()) as *mut u8;
-                if (*patch_data).is_null() {
-                    set_last_error("failed to allocate memory");
-                    return -1;
+        Ok(data) => return_buffer(data, patch_data, patch_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 创建补丁数据（内存版本，可取消）
+/// format 为 XDELTA_FORMAT_* 之一，XDELTA_FORMAT_VCDIFF 输出 RFC 3284 VCDIFF，不能与二次压缩同时使用；
+/// 可以按位或 XDELTA_FORMAT_FLAG_*，例如 XDELTA_FORMAT_FLAG_ADLER32 在补丁中写入输出的校验和
+/// secondary 为 XDELTA_SECONDARY_* 之一，选择对整个补丁做的二次压缩，应用补丁时自动识别
+/// level 为压缩级别，-1 使用压缩器的默认级别，0..9 从最快到补丁最小，超出范围返回 XDELTA_ERR_INVALID_ARGUMENT
+/// threads 为编码线程数，0 使用全部核心，1 为单线程编码；不为 1 时新数据按 8 MiB 分段独立匹配，COPY 不会跨越分段，
+/// 结果与线程数（以及核心数）无关
+/// cancel 可以为 NULL；编码在每个窗口之间检查 cancel，被取消时释放所有中间结果
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_data_cancel(
+    old_data: *const u8,
+    old_len: usize,
+    new_data: *const u8,
+    new_len: usize,
+    patch_data: *mut *mut u8,
+    patch_len: *mut usize,
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    threads: c_int,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Vec<u8>, XDeltaError> {
+        if patch_data.is_null() || patch_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let new_bytes = unsafe { input_slice(new_data, new_len) }?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let threads = threads_from_c(threads)?;
+
+        create_patch_bytes_cancel(old_bytes, new_bytes, block_size as usize, encoding, threads, unsafe {
+            cancel.as_ref()
+        })
+    })();
+
+    match r {
+        Ok(data) => return_buffer(data, patch_data, patch_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 源窗口版本：新数据的每个位置只与旧数据中前后共 source_window 字节（按块向下取整，至少一块）匹配，
+/// 窗口随编码位置向后滑动，签名表只覆盖窗口内的块，内存与旧数据的大小无关（相当于 xdelta3 -B）；
+/// 挪动超过半个窗口的数据不再能匹配，补丁会变大。COPY 仍使用旧数据中的绝对偏移，应用补丁时不需要知道窗口大小
+/// source_window 为 0 时与 threads 为 1 的 xdelta_create_patch_data_cancel 相同；总是单线程编码，
+/// 其余参数与 xdelta_create_patch_data_cancel 相同
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_data_window(
+    old_data: *const u8,
+    old_len: usize,
+    new_data: *const u8,
+    new_len: usize,
+    patch_data: *mut *mut u8,
+    patch_len: *mut usize,
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    source_window: u64,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Vec<u8>, XDeltaError> {
+        if patch_data.is_null() || patch_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let new_bytes = unsafe { input_slice(new_data, new_len) }?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let cancel = unsafe { cancel.as_ref() };
+        if source_window == 0 {
+            return create_patch_bytes_cancel(old_bytes, new_bytes, block_size as usize, encoding, None, cancel);
+        }
+        create_patch_bytes_window(old_bytes, new_bytes, block_size as usize, source_window, encoding, cancel)
+    })();
+
+    match r {
+        Ok(data) => return_buffer(data, patch_data, patch_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 内存输入、文件输出版本：与 xdelta_create_patch_data_window 相同（source_window 为 0 时与 xdelta_create_patch_data_cancel 相同，
+/// threads 只在这时有效），但补丁在编码过程中逐个窗口写入 patch_path，不在内存中保存整个补丁，
+/// 写出的文件与内存版本返回的补丁逐字节相同；失败或被取消时删除未写完的补丁文件。stats 可以为 NULL
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_data_to_file(
+    old_data: *const u8,
+    old_len: usize,
+    new_data: *const u8,
+    new_len: usize,
+    patch_path: *const c_char,
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    threads: c_int,
+    source_window: u64,
+    cancel: *const CancelToken,
+    stats: *mut FileStats,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<FileStats, XDeltaError> {
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let new_bytes = unsafe { input_slice(new_data, new_len) }?;
+        let patch_path = path_arg(patch_path, "patch")?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let threads = threads_from_c(threads)?;
+        let window = (source_window > 0).then_some(source_window);
+        let block_size = block_size as usize;
+        let cancel = unsafe { cancel.as_ref() };
+        file::create_patch_data_file(old_bytes, new_bytes, patch_path, block_size, encoding, threads, window, cancel)
+    })();
+
+    match r {
+        Ok(s) => {
+            if !stats.is_null() {
+                unsafe {
+                    *stats = s;
                 }
-                std::ptr::copy_nonoverlapping(data.as_ptr(), *patch_data, data.len());
             }
             0
-        },
-        Err(e) => {
-            set_last_error(&format!("{}", e));
-            -1
         }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 与 xdelta_create_patch_data_to_file 相同，但补丁直接写入调用方的缓冲区 dst（dst_cap 字节），不分配随补丁增长的内存，
+/// 内容与内存版本返回的补丁逐字节相同；patch_len 不能为 NULL，成功时写入补丁的长度
+/// 补丁超过 dst_cap 时编码照常完成但不再写入 dst，返回 XDELTA_ERR_OUTPUT_TOO_LARGE，patch_len 为完整补丁的长度，
+/// 调用方可以按它准备缓冲区后重试，此时 dst 中的内容没有意义；dst_cap 为 0 时 dst 可以为 NULL
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_into(
+    old_data: *const u8,
+    old_len: usize,
+    new_data: *const u8,
+    new_len: usize,
+    dst: *mut u8,
+    dst_cap: usize,
+    patch_len: *mut usize,
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    threads: c_int,
+    source_window: u64,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if patch_len.is_null() || (dst.is_null() && dst_cap > 0) {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let new_bytes = unsafe { input_slice(new_data, new_len) }?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let threads = threads_from_c(threads)?;
+        let block_size = block_size as usize;
+        let cancel = unsafe { cancel.as_ref() };
+        let buf: &mut [u8] = if dst_cap == 0 {
+            &mut []
+        } else {
+            unsafe { std::slice::from_raw_parts_mut(dst, dst_cap) }
+        };
+        let mut out = FixedWriter { buf, written: 0 };
+        if source_window > 0 {
+            create_patch_window_to(old_bytes, new_bytes, block_size, source_window, encoding, cancel, &mut out)?;
+        } else {
+            create_patch_to(old_bytes, new_bytes, block_size, encoding, threads, cancel, &mut out)?;
+        }
+        unsafe { *patch_len = out.written };
+        if out.written > dst_cap {
+            return Err(XDeltaError::OutputTooLarge(format!(
+                "patch of {} bytes does not fit in {} bytes",
+                out.written, dst_cap
+            )));
+        }
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// Writer into a caller's fixed buffer that keeps counting once the buffer
+/// is full, so the caller learns how large the buffer has to be.
+struct FixedWriter<'a> {
+    buf: &'a mut [u8],
+    written: usize,
+}
+
+impl std::io::Write for FixedWriter<'_> {
+    fn write(&mut self, data: &[u8]) -> std::io::Result<usize> {
+        if let Some(room) = self.buf.get_mut(self.written..) {
+            let n = usize::min(room.len(), data.len());
+            room[..n].copy_from_slice(&data[..n]);
+        }
+        self.written = self.written.saturating_add(data.len());
+        Ok(data.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
     }
 }
 
 /// 应用补丁数据（内存版本）
-/// 成功时返回0，失败返回-1
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
 #[unsafe(no_mangle)]
 pub extern "C" fn xdelta_apply_patch_data(
     old_data: *const u8,
@@ -298,44 +422,720 @@ pub extern "C" fn xdelta_apply_patch_data(
     patch_len: usize,
     new_data: *mut *mut u8,
     new_len: *mut usize,
+    err: *mut *mut c_char,
 ) -> c_int {
-    let r = (|| -> Result<Vec<u8>, XDeltaError> {
-        if old_data.is_null() || patch_data.is_null() || new_data.is_null() || new_len.is_null() {
+    let r = guard_decode(|| -> Result<Vec<u8>, XDeltaError> {
+        if new_data.is_null() || new_len.is_null() {
             return Err(XDeltaError::InvalidArg("null pointer".into()));
         }
 
-        let old_bytes = unsafe { std::slice::from_raw_parts(old_data, old_len) };
-        let patch_bytes = unsafe { std::slice::from_raw_parts(patch_data, patch_len) };
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
 
         apply_patch_bytes(old_bytes, patch_bytes)
-    })();
+    });
 
     match r {
-        Ok(data) => {
+        Ok(data) => return_buffer(data, new_data, new_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 应用补丁数据（内存版本，可取消）
+/// max_output 为输出大小上限，0 表示不限制；补丁声明的输出超过上限时在产生这部分输出之前返回 XDELTA_ERR_OUTPUT_TOO_LARGE
+/// cancel 可以为 NULL；解码在每个窗口之间检查 cancel，被取消时释放已产生的部分输出
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_apply_patch_data_cancel(
+    old_data: *const u8,
+    old_len: usize,
+    patch_data: *const u8,
+    patch_len: usize,
+    new_data: *mut *mut u8,
+    new_len: *mut usize,
+    max_output: u64,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| -> Result<Vec<u8>, XDeltaError> {
+        if new_data.is_null() || new_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+
+        apply_patch_bytes_cancel(old_bytes, patch_bytes, max_limit(max_output), unsafe { cancel.as_ref() })
+    });
+
+    match r {
+        Ok(data) => return_buffer(data, new_data, new_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 把补丁应用到旧数据，输出直接写入调用方的缓冲区 dst（dst_cap 字节），不分配随输出增长的内存
+/// 输出超过 dst_cap 时在写出超出的部分之前返回 XDELTA_ERR_OUTPUT_TOO_LARGE，此时 dst 中已写入的内容没有意义；
+/// dst_cap 为 0 时 dst 可以为 NULL；new_len 不能为 NULL，成功时写入输出的长度
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_apply_patch_into(
+    old_data: *const u8,
+    old_len: usize,
+    patch_data: *const u8,
+    patch_len: usize,
+    dst: *mut u8,
+    dst_cap: usize,
+    new_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if new_len.is_null() || (dst.is_null() && dst_cap > 0) {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        let out: &mut [u8] = if dst_cap == 0 {
+            &mut []
+        } else {
+            unsafe { std::slice::from_raw_parts_mut(dst, dst_cap) }
+        };
+        apply_patch_into(old_bytes, patch_bytes, out)
+    });
+
+    match r {
+        Ok(n) => {
+            unsafe { *new_len = n };
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 与 xdelta_apply_patch_into 相同，但 dst_cap 必须是补丁声明的输出长度（xdelta_validate_patch_data 的 new_len），调用方据此预先分配 dst；
+/// 实际输出多于或少于 dst_cap 时返回 XDELTA_ERR_CORRUPT_PATCH，此时 dst 中已写入的内容没有意义
+/// cancel 可以为 NULL，解码在每个窗口之间检查 cancel，被取消时返回 XDELTA_ERR_CANCELED
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_apply_patch_exact(
+    old_data: *const u8,
+    old_len: usize,
+    patch_data: *const u8,
+    patch_len: usize,
+    dst: *mut u8,
+    dst_cap: usize,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if dst.is_null() && dst_cap > 0 {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        let out: &mut [u8] = if dst_cap == 0 {
+            &mut []
+        } else {
+            unsafe { std::slice::from_raw_parts_mut(dst, dst_cap) }
+        };
+        apply_patch_exact(old_bytes, patch_bytes, out, unsafe { cancel.as_ref() })
+    });
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 校验补丁能否应用到旧数据：完整解码但丢弃输出，内存占用与输出大小无关
+/// max_output、cancel 与 xdelta_apply_patch_data_cancel 相同；new_len、sha256 可以为 NULL，
+/// 非 NULL 时返回输出的长度和 SHA-256（sha256 指向 32 字节的缓冲区）
+/// 成功时返回0，失败返回的错误码与 xdelta_apply_patch_data_cancel 相同，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_verify_patch_data(
+    old_data: *const u8,
+    old_len: usize,
+    patch_data: *const u8,
+    patch_len: usize,
+    max_output: u64,
+    new_len: *mut u64,
+    sha256: *mut u8,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+
+        verify_patch_bytes(old_bytes, patch_bytes, max_limit(max_output), unsafe { cancel.as_ref() })
+    });
+
+    match r {
+        Ok((len, sum)) => {
             unsafe {
-                *new_len = data.len();
-                *new_data = libc::malloc(data.len()) as *mut u8;
-                if (*new_data).is_null() {
-                    set_last_error("failed to allocate memory");
-                    return -1;
+                if !new_len.is_null() {
+                    *new_len = len;
+                }
+                if !sha256.is_null() {
+                    std::ptr::copy_nonoverlapping(sum.as_ptr(), sha256, sum.len());
                 }
-                std::ptr::copy_nonoverlapping(data.as_ptr(), *new_data, data.len());
             }
             0
-        },
-        Err(e) => {
-            set_last_error(&format!("{}", e));
-            -1
         }
+        Err(e) => fail(e, err),
     }
 }
 
-/// 释放通过xdelta_create_patch_data或xdelta_apply_patch_data分配的内存
+/// 只检查补丁的结构，不需要旧数据：解析全部记录（VCDIFF 为全部窗口和指令），检查长度、偏移是否自洽、补丁是否截断
+/// source_len 为旧数据长度，未知时传 -1；已知时 COPY 超出范围返回 XDELTA_ERR_SOURCE_MISMATCH
+/// 不重建新数据，耗时与补丁大小成线性，不会按补丁声明的输出大小分配内存；VCDIFF 的 adler32 校验和无法在这里检查
+/// new_len 可以为 NULL，非 NULL 时返回补丁声明的输出长度
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
 #[unsafe(no_mangle)]
-pub extern "C" fn xdelta_free_data(data: *mut u8) {
-    if !data.is_null() {
-        unsafe {
-            libc::free(data as *mut libc::c_void);
+pub extern "C" fn xdelta_validate_patch_data(
+    patch_data: *const u8,
+    patch_len: usize,
+    source_len: i64,
+    new_len: *mut u64,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        validate_patch_bytes(patch_bytes, u64::try_from(source_len).ok())
+    });
+
+    match r {
+        Ok(info) => {
+            if !new_len.is_null() {
+                unsafe { *new_len = info.target_size };
+            }
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 统计补丁的组成，不需要旧数据；对补丁的检查与 xdelta_validate_patch_data 相同，补丁不合法时返回错误而不是部分结果
+/// info 不能为 NULL；成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_inspect_patch_data(
+    patch_data: *const u8,
+    patch_len: usize,
+    info: *mut PatchInfo,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if info.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        validate_patch_bytes(patch_bytes, None)
+    });
+
+    match r {
+        Ok(i) => {
+            unsafe { *info = i };
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 读取补丁声明的输出长度，不需要旧数据：VCDIFF 只解析窗口头，耗时与窗口数成正比；
+/// 本库格式没有文件头，需要遍历全部记录（跳过 ADD 数据），二次压缩的补丁还需要解压
+/// 补丁截断时返回 XDELTA_ERR_CORRUPT_PATCH；new_len 不能为 NULL，成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_patch_target_size(
+    patch_data: *const u8,
+    patch_len: usize,
+    new_len: *mut u64,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if new_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        patch_target_size(patch_bytes)
+    });
+
+    match r {
+        Ok(n) => {
+            unsafe { *new_len = n };
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 把补丁按记录（VCDIFF 为窗口）边界切成若干段，每段约 segment_size 字节输出，不需要旧数据；
+/// 补丁开头 header_len 字节（本库格式为 0，带校验和时为第一个校验和记录，VCDIFF 为文件头）加上某一段的补丁数据就是只生成这一段输出的补丁，
+/// 各段只从旧数据复制，可以分别、并行解码；二次压缩的本库格式补丁无法切分，作为一段返回
+/// 只检查补丁的分帧，COPY 的范围在解码各段时检查；segments 为 count 个 xdelta_patch_segment，按输出顺序排列，
+/// 使用 xdelta_free_data 释放；成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_patch_segments(
+    patch_data: *const u8,
+    patch_len: usize,
+    segment_size: u64,
+    segments: *mut *mut Segment,
+    count: *mut usize,
+    header_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if segments.is_null() || count.is_null() || header_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        patch_segments(patch_bytes, segment_size)
+    });
+    return_segments(r, segments, count, header_len, err)
+}
+
+/// 与 xdelta_patch_segments 相同，但补丁为 patch_path 指向的文件，可以映射时通过只读内存映射读取，不整个读入内存
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_patch_file_segments(
+    patch_path: *const c_char,
+    segment_size: u64,
+    segments: *mut *mut Segment,
+    count: *mut usize,
+    header_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if segments.is_null() || count.is_null() || header_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let patch_path = path_arg(patch_path, "patch")?;
+        file::patch_file_segments(patch_path, segment_size)
+    });
+    return_segments(r, segments, count, header_len, err)
+}
+
+fn return_segments(
+    r: Result<(usize, Vec<Segment>), XDeltaError>,
+    segments: *mut *mut Segment,
+    count: *mut usize,
+    header_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    match r {
+        Ok((header, segs)) => {
+            let size = std::mem::size_of::<Segment>();
+            let data = unsafe { std::slice::from_raw_parts(segs.as_ptr() as *const u8, segs.len() * size) }.to_vec();
+            let mut len = 0usize;
+            let rc = return_buffer(data, segments as *mut *mut u8, &mut len, err);
+            if rc == 0 {
+                unsafe {
+                    *count = len / size;
+                    *header_len = header;
+                }
+            }
+            rc
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 不需要旧数据，返回应用补丁时 COPY 读取的旧数据区间，按偏移排序、互不重叠，相隔不超过 gap 字节的区间合并为一个
+/// VCDIFF 中从目标窗口复制的数据不读取旧数据，不计入；ranges 为 count 个 xdelta_source_range，使用 xdelta_free_data 释放
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_patch_source_ranges(
+    patch_data: *const u8,
+    patch_len: usize,
+    gap: u64,
+    ranges: *mut *mut SourceRange,
+    count: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if ranges.is_null() || count.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        ranges::source_ranges(patch_bytes, gap)
+    });
+
+    match r {
+        Ok(list) => {
+            let size = std::mem::size_of::<SourceRange>();
+            let data = unsafe { std::slice::from_raw_parts(list.as_ptr() as *const u8, list.len() * size) }.to_vec();
+            let mut len = 0usize;
+            let rc = return_buffer(data, ranges as *mut *mut u8, &mut len, err);
+            if rc == 0 {
+                unsafe {
+                    *count = len / size;
+                }
+            }
+            rc
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 把一串补丁合并成一个：第 i 个补丁的旧数据是第 i-1 个补丁的新数据，结果从第一个补丁的旧数据直接生成最后一个补丁的新数据
+/// 不需要任何一个版本的数据；patches 是 count 个补丁首尾相接的数据，lens 为各自的长度
+/// 结果为本库格式、不做二次压缩，通过 merged_data 返回，使用 xdelta_free_data 释放
+/// 某个补丁的 COPY 超出前一个补丁的输出范围时返回 XDELTA_ERR_SOURCE_MISMATCH，错误信息中注明是第几个补丁
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_merge_patches(
+    patches: *const u8,
+    lens: *const usize,
+    count: usize,
+    merged_data: *mut *mut u8,
+    merged_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| -> Result<Vec<u8>, XDeltaError> {
+        if merged_data.is_null() || merged_len.is_null() || (lens.is_null() && count > 0) {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let lens = if count == 0 { &[][..] } else { unsafe { std::slice::from_raw_parts(lens, count) } };
+        let total = lens
+            .iter()
+            .try_fold(0usize, |a, &n| a.checked_add(n))
+            .ok_or_else(|| XDeltaError::InvalidArg("patch lengths overflow".into()))?;
+        let mut rest = unsafe { input_slice(patches, total) }?;
+        let mut list = Vec::with_capacity(count);
+        for &n in lens {
+            let (p, r) = rest.split_at(n);
+            list.push(p);
+            rest = r;
+        }
+        merge::merge_patches(&list)
+    });
+
+    match r {
+        Ok(data) => return_buffer(data, merged_data, merged_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 内容定义分块的签名：把旧数据按平均 avg_chunk 字节（2 的幂，64 到 1 MiB）的内容定义分块切开，
+/// 返回每块的长度和 SHA-256，通过 sig 返回，使用 xdelta_free_data 释放；cancel 可以为 NULL
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_chunk_signature(
+    old_data: *const u8,
+    old_len: usize,
+    avg_chunk: u32,
+    cancel: *const CancelToken,
+    sig: *mut *mut u8,
+    sig_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Vec<u8>, XDeltaError> {
+        if sig.is_null() || sig_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        cdc::chunk_signature(old_bytes, avg_chunk as usize, unsafe { cancel.as_ref() })
+    })();
+
+    match r {
+        Ok(data) => return_buffer(data, sig, sig_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 从 xdelta_create_chunk_signature 生成的签名和新数据创建补丁，不需要旧数据：新数据按签名中的平均块长同样切开，
+/// 与签名中长度和 SHA-256 相同的块写成 COPY（连续的合并成一个），其余写成 ADD
+/// format、secondary、level 与 xdelta_create_patch_data_cancel 相同，不接受 XDELTA_FORMAT_BSDIFF，
+/// 快速匹配、追加和内容定义分块等只影响块匹配的标记被忽略；总是单线程编码
+/// 签名损坏时返回 XDELTA_ERR_CORRUPT_PATCH，版本不认识时返回 XDELTA_ERR_UNSUPPORTED
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_from_chunk_signature(
+    sig: *const u8,
+    sig_len: usize,
+    new_data: *const u8,
+    new_len: usize,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    cancel: *const CancelToken,
+    patch_data: *mut *mut u8,
+    patch_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Vec<u8>, XDeltaError> {
+        if patch_data.is_null() || patch_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let sig_bytes = unsafe { input_slice(sig, sig_len) }?;
+        let new_bytes = unsafe { input_slice(new_data, new_len) }?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let mut patch = Vec::new();
+        cdc::encode_from_signature(sig_bytes, new_bytes, encoding, unsafe { cancel.as_ref() }, &mut patch)?;
+        Ok(patch)
+    })();
+
+    match r {
+        Ok(data) => return_buffer(data, patch_data, patch_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// The C API uses 0 for "no output limit".
+pub(crate) fn max_limit(max_output: u64) -> Option<u64> {
+    if max_output == 0 {
+        None
+    } else {
+        Some(max_output)
+    }
+}
+
+fn path_arg<'a>(p: *const c_char, what: &str) -> Result<&'a std::path::Path, XDeltaError> {
+    if p.is_null() {
+        return Err(XDeltaError::InvalidArg("null pointer".into()));
+    }
+    let s = unsafe { CStr::from_ptr(p) }
+        .to_str()
+        .map_err(|_| XDeltaError::InvalidArg(format!("{} path is not valid UTF-8", what)))?;
+    Ok(std::path::Path::new(s))
+}
+
+/// 创建补丁文件（文件版本）
+/// 旧文件只保留块签名，新文件按窗口流式读取，补丁直接写入 patch_path
+/// format、secondary、level、threads 与 xdelta_create_patch_data_cancel 相同，不为 1 时每个线程缓存 8 MiB 新数据；
+/// use_mmap 不为 0 时两个输入文件尽量通过只读内存映射读取，无法映射时照常读取，补丁相同；
+/// 映射期间输入文件的长度发生变化时返回 XDELTA_ERR_IO（Linux、macOS 上文件被截断会使进程收到 SIGBUS）
+/// 失败时会删除未写完的补丁文件；stats 可以为 NULL
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_file(
+    old_path: *const c_char,
+    new_path: *const c_char,
+    patch_path: *const c_char,
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    threads: c_int,
+    use_mmap: c_int,
+    stats: *mut FileStats,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<FileStats, XDeltaError> {
+        let old_path = path_arg(old_path, "old")?;
+        let new_path = path_arg(new_path, "new")?;
+        let patch_path = path_arg(patch_path, "patch")?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let threads = threads_from_c(threads)?;
+        let block_size = block_size as usize;
+        file::create_patch_file(old_path, new_path, patch_path, block_size, encoding, threads, None, use_mmap != 0)
+    })();
+
+    match r {
+        Ok(s) => {
+            if !stats.is_null() {
+                unsafe {
+                    *stats = s;
+                }
+            }
+            0
         }
+        Err(e) => fail(e, err),
     }
 }
+
+/// 源窗口版本的 xdelta_create_patch_file：source_window 与 xdelta_create_patch_data_window 相同，
+/// 旧文件随窗口顺序读取，不再一次建立整个文件的签名；其余参数与 xdelta_create_patch_file 相同，总是单线程编码
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_file_window(
+    old_path: *const c_char,
+    new_path: *const c_char,
+    patch_path: *const c_char,
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    source_window: u64,
+    use_mmap: c_int,
+    stats: *mut FileStats,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<FileStats, XDeltaError> {
+        let old_path = path_arg(old_path, "old")?;
+        let new_path = path_arg(new_path, "new")?;
+        let patch_path = path_arg(patch_path, "patch")?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let window = (source_window > 0).then_some(source_window);
+        let block_size = block_size as usize;
+        file::create_patch_file(old_path, new_path, patch_path, block_size, encoding, None, window, use_mmap != 0)
+    })();
+
+    match r {
+        Ok(s) => {
+            if !stats.is_null() {
+                unsafe {
+                    *stats = s;
+                }
+            }
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 应用补丁文件（文件版本）
+/// 旧文件按需随机读取，补丁流式读取，结果直接写入 out_path（由调用方负责临时文件与重命名）
+/// max_output 为输出大小上限，0 表示不限制；use_mmap 与 xdelta_create_patch_file 相同，只映射旧文件
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_apply_patch_file(
+    old_path: *const c_char,
+    patch_path: *const c_char,
+    out_path: *const c_char,
+    max_output: u64,
+    use_mmap: c_int,
+    stats: *mut FileStats,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| -> Result<FileStats, XDeltaError> {
+        let old_path = path_arg(old_path, "old")?;
+        let patch_path = path_arg(patch_path, "patch")?;
+        let out_path = path_arg(out_path, "output")?;
+        file::apply_patch_file(old_path, patch_path, out_path, max_limit(max_output), use_mmap != 0)
+    });
+
+    match r {
+        Ok(s) => {
+            if !stats.is_null() {
+                unsafe {
+                    *stats = s;
+                }
+            }
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 文件描述符版本的 xdelta_create_patch_file：old_fd、new_fd、patch_fd 是调用方已经打开的文件描述符（Windows 上为 HANDLE），
+/// 调用期间必须保持打开，返回后仍由调用方负责关闭；输入从当前偏移量开始读取，补丁从 patch_fd 的当前偏移量开始写入。
+/// source_window 不为 0 时与 xdelta_create_patch_file_window 相同（threads 被忽略），其余参数与 xdelta_create_patch_file 相同；
+/// 失败时不会删除或截断 patch_fd 已经写入的内容，由调用方处理。stats 可以为 NULL
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_create_patch_fd(
+    old_fd: isize,
+    new_fd: isize,
+    patch_fd: isize,
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    threads: c_int,
+    source_window: u64,
+    use_mmap: c_int,
+    stats: *mut FileStats,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<FileStats, XDeltaError> {
+        let old = file::borrow_file(old_fd, "old")?;
+        let new = file::borrow_file(new_fd, "new")?;
+        let patch = file::borrow_file(patch_fd, "patch")?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        let window = (source_window > 0).then_some(source_window);
+        let threads = if window.is_some() { None } else { threads_from_c(threads)? };
+        let block_size = block_size as usize;
+        let names = ("old file".to_string(), "new file".to_string());
+        let patch = file::Output::File(&patch);
+        file::create_patch_files(&old, &new, &names, patch, block_size, encoding, threads, window, use_mmap != 0)
+    })();
+
+    match r {
+        Ok(s) => {
+            if !stats.is_null() {
+                unsafe {
+                    *stats = s;
+                }
+            }
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 文件描述符版本的 xdelta_apply_patch_file：old_fd 按绝对偏移量随机读取，patch_fd 从当前偏移量开始读取，
+/// 结果从 out_fd 的当前偏移量开始写入；生命周期与 xdelta_create_patch_fd 相同，失败时 out_fd 中可能留有部分输出
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_apply_patch_fd(
+    old_fd: isize,
+    patch_fd: isize,
+    out_fd: isize,
+    max_output: u64,
+    use_mmap: c_int,
+    stats: *mut FileStats,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| -> Result<FileStats, XDeltaError> {
+        let old = file::borrow_file(old_fd, "old")?;
+        let patch = file::borrow_file(patch_fd, "patch")?;
+        let out = file::borrow_file(out_fd, "output")?;
+        file::apply_patch_files(&old, "old file", &patch, file::Output::File(&out), max_limit(max_output), use_mmap != 0)
+    });
+
+    match r {
+        Ok(s) => {
+            if !stats.is_null() {
+                unsafe {
+                    *stats = s;
+                }
+            }
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 把补丁原地应用到 path 指向的文件，不需要第二份文件的空间
+/// 先被覆盖、后被读取的旧数据最多在内存中缓存 max_spill 字节，0 表示不限制，超出时返回 XDELTA_ERR_OUT_OF_MEMORY；
+/// 补丁无效、输出超过 max_output（0 表示不限制）或缓存超出上限时文件不会被修改，开始写入后失败则文件内容不可用
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_apply_patch_in_place(
+    path: *const c_char,
+    patch_data: *const u8,
+    patch_len: usize,
+    max_output: u64,
+    max_spill: u64,
+    stats: *mut FileStats,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| -> Result<FileStats, XDeltaError> {
+        let path = path_arg(path, "target")?;
+        let patch = unsafe { input_slice(patch_data, patch_len) }?;
+        inplace::apply_patch_in_place(path, patch, max_limit(max_output), max_limit(max_spill))
+    });
+
+    match r {
+        Ok(s) => {
+            if !stats.is_null() {
+                unsafe {
+                    *stats = s;
+                }
+            }
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 释放通过 err 参数返回的错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_free_error(err: *mut c_char) {
+    unsafe { alloc::free_error(err) }
+}
+
+/// 释放通过xdelta_create_patch_data或xdelta_apply_patch_data分配的内存
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_free_data(data: *mut u8) {
+    unsafe { alloc::free_buffer(data) }
+}
@@ -0,0 +1,59 @@
+// src/logging.rs
+//! Diagnostics forwarded to a callback registered by the host. The callback
+//! and the minimum level are plain atomics, so logging from any thread never
+//! takes a lock, and a disabled level costs one relaxed load.
+use std::os::raw::c_int;
+use std::sync::atomic::{AtomicI32, AtomicPtr, Ordering};
+
+pub(crate) const DEBUG: c_int = 0;
+#[allow(dead_code)]
+pub(crate) const INFO: c_int = 1;
+pub(crate) const WARN: c_int = 2;
+pub(crate) const ERROR: c_int = 3;
+const OFF: c_int = 4;
+
+type LogFn = extern "C" fn(level: c_int, msg: *const u8, len: usize) -> c_int;
+
+static CALLBACK: AtomicPtr<()> = AtomicPtr::new(std::ptr::null_mut());
+static LEVEL: AtomicI32 = AtomicI32::new(OFF);
+
+pub(crate) fn enabled(level: c_int) -> bool {
+    level >= LEVEL.load(Ordering::Relaxed)
+}
+
+pub(crate) fn emit(level: c_int, msg: &str) {
+    let cb = CALLBACK.load(Ordering::Acquire);
+    if !cb.is_null() {
+        // SAFETY: only ever stored from a `LogFn` in xdelta_set_log
+        let cb: LogFn = unsafe { std::mem::transmute::<*mut (), LogFn>(cb) };
+        cb(level, msg.as_ptr(), msg.len());
+    }
+}
+
+/// Log a formatted message at `level` if it is enabled; the arguments are
+/// not evaluated otherwise.
+macro_rules! log_at {
+    ($level:expr, $($arg:tt)*) => {
+        if $crate::logging::enabled($level) {
+            $crate::logging::emit($level, &format!($($arg)*))
+        }
+    };
+}
+pub(crate) use log_at;
+
+/// 设置接收日志的回调和最低级别（XDELTA_LOG_*），低于 level 的日志不会生成；
+/// cb 为 NULL 或 level 为 XDELTA_LOG_OFF 时不再输出日志。回调可能在原生库的任意线程上被并发调用，
+/// msg 不以 NUL 结尾，只在回调期间有效；修改级别不影响已经进入回调的调用
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_set_log(cb: Option<LogFn>, level: c_int) {
+    match cb {
+        Some(cb) => {
+            CALLBACK.store(cb as *mut (), Ordering::Release);
+            LEVEL.store(level.clamp(DEBUG, OFF), Ordering::Relaxed);
+        }
+        None => {
+            LEVEL.store(OFF, Ordering::Relaxed);
+            CALLBACK.store(std::ptr::null_mut(), Ordering::Release);
+        }
+    }
+}
@@ -0,0 +1,617 @@
+// src/lz4.rs
+//! LZ4 frame format for secondary compression. The encoder writes the
+//! subset every LZ4 implementation reads: independent blocks of at most
+//! 64 KiB, no checksums and no content size. The decoder accepts exactly
+//! that subset, which is all this library produces.
+
+use crate::XDeltaError;
+
+/// Frame magic 0x184D2204, little endian.
+pub(crate) const MAGIC: [u8; 4] = [0x04, 0x22, 0x4d, 0x18];
+
+/// Frame descriptor: version 01 with independent blocks, and 64 KiB blocks.
+const FLG: u8 = 0x60;
+const BD: u8 = 0x40;
+/// magic, FLG, BD and the header checksum byte
+const HEADER_LEN: usize = 7;
+
+const BLOCK_MAX: usize = 64 * 1024;
+/// High bit of a block size: the block is stored uncompressed.
+const STORED: u32 = 0x8000_0000;
+
+const MIN_MATCH: usize = 4;
+/// The last match starts at least 12 bytes before the end of a block and
+/// the last 5 bytes are always literals.
+const MF_LIMIT: usize = 12;
+const LAST_LITERALS: usize = 5;
+const MAX_OFFSET: usize = 65535;
+const HASH_BITS: u32 = 14;
+
+/// Candidates searched per position for xdelta3-style levels 0..=9.
+const LZ4_DEPTHS: [usize; 10] = [1, 1, 2, 4, 8, 16, 32, 64, 128, 256];
+
+/// Without a match the step grows by one every 2^SKIP_SHIFT positions since
+/// the last one, as in LZ4's fast mode, so incompressible data is passed over
+/// quickly; level 0 speeds up sooner.
+const SKIP_SHIFT: usize = 6;
+const FAST_SKIP_SHIFT: usize = 4;
+
+/// Level used without WithCompressionLevel, the lz4 tool's default fast mode.
+const DEFAULT_LEVEL: u32 = 1;
+
+/// The frame header bytes this library writes.
+fn frame_header() -> [u8; HEADER_LEN] {
+    let hc = (xxh32(&[FLG, BD]) >> 8) as u8;
+    [MAGIC[0], MAGIC[1], MAGIC[2], MAGIC[3], FLG, BD, hc]
+}
+
+/// XXH32 with seed 0 of fewer than 16 bytes, for the header checksum.
+fn xxh32(data: &[u8]) -> u32 {
+    const P1: u32 = 2654435761;
+    const P2: u32 = 2246822519;
+    const P3: u32 = 3266489917;
+    const P4: u32 = 668265263;
+    const P5: u32 = 374761393;
+    debug_assert!(data.len() < 16);
+    let mut h = P5.wrapping_add(data.len() as u32);
+    let mut words = data.chunks_exact(4);
+    for w in &mut words {
+        let v = u32::from_le_bytes([w[0], w[1], w[2], w[3]]);
+        h = h.wrapping_add(v.wrapping_mul(P3)).rotate_left(17).wrapping_mul(P4);
+    }
+    for &b in words.remainder() {
+        h = h
+            .wrapping_add((b as u32).wrapping_mul(P5))
+            .rotate_left(11)
+            .wrapping_mul(P1);
+    }
+    h ^= h >> 15;
+    h = h.wrapping_mul(P2);
+    h ^= h >> 13;
+    h = h.wrapping_mul(P3);
+    h ^ (h >> 16)
+}
+
+fn read_u32(b: &[u8], at: usize) -> u32 {
+    u32::from_le_bytes([b[at], b[at + 1], b[at + 2], b[at + 3]])
+}
+
+/// Length of the common run of src[a..] and src[b..], a < b, not past `end`.
+fn common_len(src: &[u8], a: usize, b: usize, end: usize) -> usize {
+    let mut n = 0;
+    while b + n + 8 <= end {
+        let x = u64::from_le_bytes(src[a + n..a + n + 8].try_into().unwrap());
+        let y = u64::from_le_bytes(src[b + n..b + n + 8].try_into().unwrap());
+        if x != y {
+            return n + ((x ^ y).trailing_zeros() / 8) as usize;
+        }
+        n += 8;
+    }
+    while b + n < end && src[a + n] == src[b + n] {
+        n += 1;
+    }
+    n
+}
+
+fn hash(v: u32) -> usize {
+    (v.wrapping_mul(2654435761) >> (32 - HASH_BITS)) as usize
+}
+
+/// Streaming LZ4 frame encoder: input is collected into 64 KiB blocks and
+/// every complete block is compressed on its own.
+pub(crate) struct Lz4Encoder {
+    depth: usize,
+    skip_shift: usize,
+    started: bool,
+    block: Vec<u8>,
+    /// position + 1 of the last block position with each hash, 0 for none
+    head: Vec<u32>,
+    /// distance from each block position to the previous one with the same hash, 0 for none
+    chain: Vec<u16>,
+    compressed: Vec<u8>,
+}
+
+impl Lz4Encoder {
+    pub(crate) fn new(level: Option<u32>) -> Self {
+        let level = level.unwrap_or(DEFAULT_LEVEL) as usize;
+        Lz4Encoder {
+            depth: LZ4_DEPTHS[level],
+            skip_shift: if level == 0 { FAST_SKIP_SHIFT } else { SKIP_SHIFT },
+            started: false,
+            block: Vec::new(),
+            head: vec![0; 1 << HASH_BITS],
+            chain: Vec::new(),
+            compressed: Vec::new(),
+        }
+    }
+
+    pub(crate) fn write(&mut self, mut data: &[u8], out: &mut Vec<u8>) {
+        self.start(out);
+        while !data.is_empty() {
+            let n = usize::min(BLOCK_MAX - self.block.len(), data.len());
+            self.block.extend_from_slice(&data[..n]);
+            data = &data[n..];
+            if self.block.len() == BLOCK_MAX {
+                self.end_block(out);
+            }
+        }
+    }
+
+    /// Write the partial block, so everything written so far can be decoded.
+    pub(crate) fn flush(&mut self, out: &mut Vec<u8>) {
+        self.start(out);
+        if !self.block.is_empty() {
+            self.end_block(out);
+        }
+    }
+
+    /// Write the partial block and the end mark.
+    pub(crate) fn finish(&mut self, out: &mut Vec<u8>) {
+        self.flush(out);
+        out.extend_from_slice(&0u32.to_le_bytes());
+    }
+
+    fn start(&mut self, out: &mut Vec<u8>) {
+        if !self.started {
+            self.started = true;
+            out.extend_from_slice(&frame_header());
+        }
+    }
+
+    /// Compress the current block, storing it when compression does not help.
+    fn end_block(&mut self, out: &mut Vec<u8>) {
+        let block = std::mem::take(&mut self.block);
+        let mut compressed = std::mem::take(&mut self.compressed);
+        compressed.clear();
+        self.compress_block(&block, &mut compressed);
+        if compressed.len() < block.len() {
+            out.extend_from_slice(&(compressed.len() as u32).to_le_bytes());
+            out.extend_from_slice(&compressed);
+        } else {
+            out.extend_from_slice(&(block.len() as u32 | STORED).to_le_bytes());
+            out.extend_from_slice(&block);
+        }
+        self.block = block;
+        self.block.clear();
+        self.compressed = compressed;
+    }
+
+    fn insert(&mut self, src: &[u8], at: usize) {
+        let h = hash(read_u32(src, at));
+        let prev = self.head[h] as usize;
+        self.chain[at] = if prev != 0 && at + 1 - prev <= MAX_OFFSET {
+            (at + 1 - prev) as u16
+        } else {
+            0
+        };
+        self.head[h] = at as u32 + 1;
+    }
+
+    /// The longest match for `at` among the positions already inserted, as
+    /// (start, length), ending no later than `end`.
+    fn find(&self, src: &[u8], at: usize, end: usize) -> Option<(usize, usize)> {
+        let mut cand = self.head[hash(read_u32(src, at))] as usize;
+        if cand == 0 {
+            return None;
+        }
+        cand -= 1;
+        let mut best: Option<(usize, usize)> = None;
+        for _ in 0..self.depth {
+            if at - cand > MAX_OFFSET {
+                break;
+            }
+            if read_u32(src, cand) == read_u32(src, at) {
+                let len = MIN_MATCH + common_len(src, cand + MIN_MATCH, at + MIN_MATCH, end);
+                if best.map_or(true, |(_, l)| len > l) {
+                    best = Some((cand, len));
+                    if at + len == end {
+                        break;
+                    }
+                }
+            }
+            match self.chain[cand] as usize {
+                0 => break,
+                d if d > cand => break,
+                d => cand -= d,
+            }
+        }
+        best
+    }
+
+    /// Compress one block into LZ4 sequences.
+    fn compress_block(&mut self, src: &[u8], dst: &mut Vec<u8>) {
+        let n = src.len();
+        self.head.fill(0);
+        self.chain.clear();
+        self.chain.resize(n, 0);
+        let mut anchor = 0;
+        let mut at = 0;
+        // matches start at most at n - MF_LIMIT and end at most at n - LAST_LITERALS
+        while n >= MF_LIMIT && at <= n - MF_LIMIT {
+            let found = self.find(src, at, n - LAST_LITERALS);
+            self.insert(src, at);
+            let Some((mut from, mut len)) = found else {
+                at += 1 + ((at - anchor) >> self.skip_shift);
+                continue;
+            };
+            let start = at;
+            while at > anchor && from > 0 && src[at - 1] == src[from - 1] {
+                at -= 1;
+                from -= 1;
+                len += 1;
+            }
+            emit_sequence(dst, &src[anchor..at], Some(((at - from) as u16, len)));
+            let end = at + len;
+            let last = usize::min(end, n - MF_LIMIT + 1);
+            if self.depth > 1 {
+                for p in start + 1..last {
+                    self.insert(src, p);
+                }
+            } else if end >= 2 && end - 2 > start && end - 2 < last {
+                self.insert(src, end - 2);
+            }
+            at = end;
+            anchor = end;
+        }
+        emit_sequence(dst, &src[anchor..], None);
+    }
+}
+
+fn push_len(dst: &mut Vec<u8>, mut n: usize) {
+    while n >= 255 {
+        dst.push(255);
+        n -= 255;
+    }
+    dst.push(n as u8);
+}
+
+/// One sequence: literals followed by a match (offset, length), or only
+/// literals for the last sequence of a block.
+fn emit_sequence(dst: &mut Vec<u8>, literals: &[u8], m: Option<(u16, usize)>) {
+    let ll = literals.len();
+    let ml = m.map_or(0, |(_, len)| len - MIN_MATCH);
+    dst.push((usize::min(ll, 15) << 4 | usize::min(ml, 15)) as u8);
+    if ll >= 15 {
+        push_len(dst, ll - 15);
+    }
+    dst.extend_from_slice(literals);
+    if let Some((offset, _)) = m {
+        dst.extend_from_slice(&offset.to_le_bytes());
+        if ml >= 15 {
+            push_len(dst, ml - 15);
+        }
+    }
+}
+
+fn corrupt(msg: &str) -> XDeltaError {
+    XDeltaError::Corrupt(format!("invalid lz4 stream: {}", msg))
+}
+
+enum State {
+    Header,
+    Size,
+    Block { len: usize, stored: bool },
+    Ended,
+}
+
+/// Streaming LZ4 frame decoder, passing each decoded block to the sink.
+pub(crate) struct Lz4Decoder {
+    state: State,
+    /// bytes of the header, block size or block collected so far
+    pending: Vec<u8>,
+    block: Vec<u8>,
+}
+
+impl Lz4Decoder {
+    pub(crate) fn new() -> Self {
+        Lz4Decoder {
+            state: State::Header,
+            pending: Vec::new(),
+            block: Vec::new(),
+        }
+    }
+
+    pub(crate) fn feed(
+        &mut self,
+        mut patch: &[u8],
+        sink: &mut impl FnMut(&[u8]) -> Result<(), XDeltaError>,
+    ) -> Result<(), XDeltaError> {
+        while !patch.is_empty() {
+            let want = match self.state {
+                State::Header => HEADER_LEN,
+                State::Size => 4,
+                State::Block { len, .. } => len,
+                State::Ended => return Err(XDeltaError::Corrupt("trailing data after lz4 stream".into())),
+            };
+            // a whole piece in `patch` is used in place, otherwise it is collected
+            let piece = if self.pending.is_empty() && patch.len() >= want {
+                let (piece, rest) = patch.split_at(want);
+                patch = rest;
+                piece
+            } else {
+                let n = usize::min(want - self.pending.len(), patch.len());
+                self.pending.extend_from_slice(&patch[..n]);
+                patch = &patch[n..];
+                if self.pending.len() < want {
+                    return Ok(());
+                }
+                &self.pending[..]
+            };
+            self.state = match self.state {
+                State::Header => {
+                    if piece[..4] != MAGIC {
+                        return Err(corrupt("bad magic"));
+                    }
+                    // version other than 01 or reserved bits set: not an LZ4 frame at all
+                    if piece[4] >> 6 != 1 || piece[4] & 0x02 != 0 || piece[5] & 0x8f != 0 || piece[5] >> 4 < 4 {
+                        return Err(corrupt("invalid frame descriptor"));
+                    }
+                    if piece[4] != FLG || piece[5] != BD {
+                        return Err(XDeltaError::Unsupported(format!(
+                            "lz4 frame descriptor {:#04x} {:#04x} is not supported",
+                            piece[4], piece[5]
+                        )));
+                    }
+                    if piece[6] != frame_header()[6] {
+                        return Err(corrupt("header checksum mismatch"));
+                    }
+                    State::Size
+                }
+                State::Size => match read_u32(piece, 0) {
+                    0 => State::Ended,
+                    size => {
+                        let len = (size & !STORED) as usize;
+                        if len == 0 || len > BLOCK_MAX {
+                            return Err(corrupt("block size out of range"));
+                        }
+                        State::Block {
+                            len,
+                            stored: size & STORED != 0,
+                        }
+                    }
+                },
+                State::Block { stored, .. } => {
+                    if stored {
+                        sink(piece)?;
+                    } else {
+                        if self.block.is_empty() {
+                            self.block.resize(BLOCK_MAX + WILD, 0);
+                        }
+                        let n = decode_block(piece, &mut self.block)?;
+                        sink(&self.block[..n])?;
+                    }
+                    State::Size
+                }
+                State::Ended => unreachable!(),
+            };
+            self.pending.clear();
+        }
+        Ok(())
+    }
+
+    pub(crate) fn ended(&self) -> bool {
+        matches!(self.state, State::Ended)
+    }
+}
+
+fn read_len(src: &[u8], at: &mut usize) -> Result<usize, XDeltaError> {
+    let mut n = 0usize;
+    loop {
+        let b = *src.get(*at).ok_or_else(|| corrupt("truncated length"))?;
+        *at += 1;
+        n += b as usize;
+        if n > BLOCK_MAX {
+            return Err(corrupt("length beyond the block"));
+        }
+        if b != 255 {
+            return Ok(n);
+        }
+    }
+}
+
+/// Slack after the decoded block, so short literals and matches can be
+/// copied as whole 16-byte pieces.
+const WILD: usize = 32;
+
+/// Decode one compressed block into `out`, which is BLOCK_MAX + WILD bytes
+/// long, returning the length of the decoded block.
+fn decode_block(src: &[u8], out: &mut [u8]) -> Result<usize, XDeltaError> {
+    let mut at = 0;
+    let mut op = 0;
+    loop {
+        let token = *src.get(at).ok_or_else(|| corrupt("truncated sequence"))?;
+        at += 1;
+        let mut ll = (token >> 4) as usize;
+        if ll == 15 {
+            ll += read_len(src, &mut at)?;
+        }
+        if at + ll > src.len() {
+            return Err(corrupt("truncated literals"));
+        }
+        if op + ll > BLOCK_MAX {
+            return Err(corrupt("block output too large"));
+        }
+        if ll <= 16 && at + 16 <= src.len() {
+            out[op..op + 16].copy_from_slice(&src[at..at + 16]);
+        } else {
+            out[op..op + ll].copy_from_slice(&src[at..at + ll]);
+        }
+        op += ll;
+        at += ll;
+        if at == src.len() {
+            return Ok(op);
+        }
+        let offset = match src.get(at..at + 2) {
+            Some(b) => u16::from_le_bytes([b[0], b[1]]) as usize,
+            None => return Err(corrupt("truncated offset")),
+        };
+        at += 2;
+        if offset == 0 || offset > op {
+            return Err(corrupt("match offset out of range"));
+        }
+        let mut ml = (token & 15) as usize + MIN_MATCH;
+        if token & 15 == 15 {
+            ml += read_len(src, &mut at)?;
+        }
+        if op + ml > BLOCK_MAX {
+            return Err(corrupt("block output too large"));
+        }
+        let from = op - offset;
+        if offset >= 16 && ml <= 32 {
+            out.copy_within(from..from + 16, op);
+            out.copy_within(from + 16..from + 32, op + 16);
+            op += ml;
+            continue;
+        }
+        // an overlapping match repeats the last `offset` bytes, copied in
+        // pieces that double as the repeated part grows
+        let mut done = 0;
+        while done < ml {
+            let n = usize::min(ml - done, op + done - from);
+            out.copy_within(from..from + n, op + done);
+            done += n;
+        }
+        op += ml;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::fixtures::{mixed, noise, run_tool, sample};
+
+    fn compress(data: &[u8], level: Option<u32>) -> Vec<u8> {
+        let mut enc = Lz4Encoder::new(level);
+        let mut out = Vec::new();
+        enc.write(data, &mut out);
+        enc.finish(&mut out);
+        out
+    }
+
+    /// Decode `stream` fed in pieces of `step` bytes, so pieces are also collected across calls.
+    fn decompress(stream: &[u8], step: usize) -> Result<Vec<u8>, XDeltaError> {
+        let mut dec = Lz4Decoder::new();
+        let mut out = Vec::new();
+        for piece in stream.chunks(step) {
+            dec.feed(piece, &mut |b: &[u8]| {
+                out.extend_from_slice(b);
+                Ok(())
+            })?;
+        }
+        if !dec.ended() {
+            return Err(corrupt("truncated"));
+        }
+        Ok(out)
+    }
+
+    #[test]
+    fn decodes_reference_frames() {
+        let frames: [(&[u8], Vec<u8>); 2] = [
+            (include_bytes!("testdata/sample.lz4"), sample()),
+            (include_bytes!("testdata/mixed.lz4"), mixed()),
+        ];
+        for (frame, want) in &frames {
+            assert_eq!(&decompress(frame, usize::MAX).unwrap(), want);
+            assert_eq!(&decompress(frame, 1000).unwrap(), want);
+        }
+    }
+
+    #[test]
+    fn round_trip() {
+        for data in [Vec::new(), b"a".to_vec(), sample()[..13].to_vec(), sample(), mixed(), vec![0; 200_000]] {
+            for level in [None, Some(0), Some(9)] {
+                let stream = compress(&data, level);
+                assert_eq!(decompress(&stream, usize::MAX).unwrap(), data, "{} bytes, level {:?}", data.len(), level);
+                assert_eq!(decompress(&stream, 7).unwrap(), data);
+            }
+        }
+    }
+
+    #[test]
+    fn compresses_text() {
+        let data = sample();
+        let fast = compress(&data, Some(0));
+        let best = compress(&data, Some(9));
+        assert!(fast.len() < data.len() / 2, "{} bytes from {}", fast.len(), data.len());
+        assert!(best.len() <= fast.len(), "level 9 gives {} bytes, level 0 {}", best.len(), fast.len());
+    }
+
+    #[test]
+    fn reference_tool_reads_our_frames() {
+        for data in [sample(), mixed()] {
+            let Some(got) = run_tool("lz4", &["-dc"], &compress(&data, None)) else {
+                eprintln!("lz4 is not installed, skipping");
+                return;
+            };
+            assert_eq!(got, data);
+        }
+    }
+
+    #[test]
+    fn flush_makes_the_written_data_decodable() {
+        let data = sample();
+        let mut enc = Lz4Encoder::new(None);
+        let mut out = Vec::new();
+        enc.write(&data[..1000], &mut out);
+        enc.flush(&mut out);
+        let mut dec = Lz4Decoder::new();
+        let mut got = Vec::new();
+        dec.feed(&out, &mut |b: &[u8]| {
+            got.extend_from_slice(b);
+            Ok(())
+        })
+        .unwrap();
+        assert_eq!(got, &data[..1000]);
+        enc.write(&data[1000..], &mut out);
+        enc.finish(&mut out);
+        assert_eq!(decompress(&out, usize::MAX).unwrap(), data);
+    }
+
+    #[test]
+    fn incompressible_blocks_are_stored() {
+        let data = noise(BLOCK_MAX + 10);
+        let stream = compress(&data, None);
+        assert_eq!(stream.len(), HEADER_LEN + 4 + BLOCK_MAX + 4 + 10 + 4);
+        assert_eq!(read_u32(&stream, HEADER_LEN), BLOCK_MAX as u32 | STORED);
+        assert_eq!(decompress(&stream, usize::MAX).unwrap(), data);
+    }
+
+    #[test]
+    fn truncated_and_corrupt_frames() {
+        let stream = compress(&sample(), None);
+        for cut in [0, 3, HEADER_LEN, HEADER_LEN + 2, stream.len() / 2, stream.len() - 1] {
+            assert!(decompress(&stream[..cut], usize::MAX).is_err(), "cut at {}", cut);
+        }
+        let mut bad = stream.clone();
+        bad[0] ^= 1;
+        assert!(matches!(decompress(&bad, usize::MAX), Err(XDeltaError::Corrupt(_))));
+        let mut bad = stream.clone();
+        bad[6] ^= 1;
+        assert!(matches!(decompress(&bad, usize::MAX), Err(XDeltaError::Corrupt(_))));
+        // block size larger than a block
+        let mut bad = stream.clone();
+        bad[HEADER_LEN..HEADER_LEN + 4].copy_from_slice(&(BLOCK_MAX as u32 + 1).to_le_bytes());
+        assert!(matches!(decompress(&bad, usize::MAX), Err(XDeltaError::Corrupt(_))));
+        let mut trailing = stream.clone();
+        trailing.push(0);
+        assert!(matches!(decompress(&trailing, usize::MAX), Err(XDeltaError::Corrupt(_))));
+    }
+
+    #[test]
+    fn other_frame_options_are_unsupported() {
+        // the lz4 tool's default frame has a content checksum and 4 MiB blocks
+        let mut stream = compress(b"hello", None);
+        stream[4] = 0x64;
+        stream[5] = 0x70;
+        stream[6] = (xxh32(&stream[4..6]) >> 8) as u8;
+        assert!(matches!(decompress(&stream, usize::MAX), Err(XDeltaError::Unsupported(_))));
+    }
+
+    #[test]
+    fn header_checksum_matches_the_specification() {
+        // the checksum byte lz4 writes for FLG 0x60 BD 0x40, and XXH32 test values
+        assert_eq!(frame_header()[6], 0x82);
+        assert_eq!(xxh32(b""), 0x02cc5d05);
+        assert_eq!(xxh32(b"a"), 0x550d7456);
+    }
+}
@@ -0,0 +1,2230 @@
+// src/lzma.rs
+//! xz format (LZMA2) for secondary compression. The encoder writes a
+//! single-block .xz stream with a CRC32 check, which the xz tool and every
+//! liblzma-based library read; a flush ends the current LZMA2 chunk, so
+//! everything written so far decodes. The decoder reads .xz streams of
+//! LZMA2 blocks with any of the standard checks, as xz and liblzma write
+//! them, but no other filters and no concatenated streams or padding after
+//! the stream.
+
+use sha2::{Digest, Sha256};
+
+use crate::XDeltaError;
+
+/// Stream header magic.
+pub(crate) const MAGIC: [u8; 6] = [0xfd, b'7', b'z', b'X', b'Z', 0x00];
+const FOOTER_MAGIC: [u8; 2] = *b"YZ";
+/// stream header and stream footer
+const STREAM_HEADER_LEN: usize = 12;
+
+const CHECK_NONE: u8 = 0x00;
+const CHECK_CRC32: u8 = 0x01;
+const CHECK_CRC64: u8 = 0x04;
+const CHECK_SHA256: u8 = 0x0a;
+
+const FILTER_LZMA2: u64 = 0x21;
+
+/// Limits of one LZMA2 chunk.
+const CHUNK_MAX_UNCOMPRESSED: usize = 2 << 20;
+const CHUNK_MAX_COMPRESSED: usize = 64 << 10;
+/// Largest range coder output of one packet, with room to spare: a match
+/// codes fewer than 50 bits and each costs at most about six bits.
+const PACKET_MAX: usize = 64;
+
+const MATCH_LEN_MIN: usize = 2;
+const MATCH_LEN_MAX: usize = 273;
+
+/// Literal context and position bits of the encoder, xz's defaults.
+const LC: u32 = 3;
+const LP: u32 = 0;
+const PB: u32 = 2;
+
+const STATES: usize = 12;
+const LIT_STATES: usize = 7;
+const POS_STATES_MAX: usize = 1 << 4;
+const DIST_STATES: usize = 4;
+const DIST_SLOT_BITS: u32 = 6;
+const DIST_MODEL_START: u32 = 4;
+const DIST_MODEL_END: u32 = 14;
+const FULL_DISTANCES: usize = 1 << (DIST_MODEL_END / 2);
+const ALIGN_BITS: u32 = 4;
+const LEN_LOW_BITS: u32 = 3;
+const LEN_MID_BITS: u32 = 3;
+const LEN_HIGH_BITS: u32 = 8;
+const LEN_LOW_SYMBOLS: usize = 1 << LEN_LOW_BITS;
+const LEN_MID_SYMBOLS: usize = 1 << LEN_MID_BITS;
+
+const PROB_BITS: u32 = 11;
+const PROB_INIT: u16 = 1 << (PROB_BITS - 1);
+const MOVE_BITS: u32 = 5;
+const TOP: u32 = 1 << 24;
+
+fn corrupt(msg: &str) -> XDeltaError {
+    XDeltaError::Corrupt(format!("invalid xz stream: {}", msg))
+}
+
+fn crc32(data: &[u8]) -> u32 {
+    let mut c = flate2::Crc::new();
+    c.update(data);
+    c.sum()
+}
+
+/// CRC64 (ECMA-182, reflected) table used by the xz CRC64 check.
+const CRC64_TABLE: [u64; 256] = {
+    let mut table = [0u64; 256];
+    let mut i = 0;
+    while i < 256 {
+        let mut c = i as u64;
+        let mut k = 0;
+        while k < 8 {
+            c = if c & 1 != 0 { (c >> 1) ^ 0xc96c_5795_d787_0f42 } else { c >> 1 };
+            k += 1;
+        }
+        table[i] = c;
+        i += 1;
+    }
+    table
+};
+
+/// Multibyte integer of the xz format: 7 bits per byte, least significant
+/// first, at most 9 bytes.
+fn put_varint(out: &mut Vec<u8>, mut v: u64) {
+    while v >= 0x80 {
+        out.push(v as u8 | 0x80);
+        v >>= 7;
+    }
+    out.push(v as u8);
+}
+
+fn get_varint(buf: &[u8], at: &mut usize) -> Result<u64, XDeltaError> {
+    let mut v = 0u64;
+    for i in 0..9 {
+        let b = *buf.get(*at).ok_or_else(|| corrupt("truncated integer"))?;
+        *at += 1;
+        if i > 0 && b == 0 {
+            return Err(corrupt("integer with a trailing zero byte"));
+        }
+        v |= ((b & 0x7f) as u64) << (7 * i);
+        if b & 0x80 == 0 {
+            return Ok(v);
+        }
+    }
+    Err(corrupt("integer longer than 9 bytes"))
+}
+
+/// Dictionary size coded by the LZMA2 filter property byte.
+fn dict_size_of(b: u8) -> Option<u64> {
+    match b {
+        40 => Some(u32::MAX as u64),
+        0..=39 => Some(((2 | (b & 1) as u64)) << (b / 2 + 11)),
+        _ => None,
+    }
+}
+
+/// The stream header the encoder writes: no flags but the check type.
+fn stream_header(check: u8) -> [u8; STREAM_HEADER_LEN] {
+    let mut h = [0u8; STREAM_HEADER_LEN];
+    h[..6].copy_from_slice(&MAGIC);
+    h[7] = check;
+    let crc = crc32(&h[6..8]);
+    h[8..].copy_from_slice(&crc.to_le_bytes());
+    h
+}
+
+/// The index of a stream with the given (unpadded size, uncompressed size)
+/// per block, including its padding and CRC32.
+fn index_bytes(blocks: &[(u64, u64)]) -> Vec<u8> {
+    let mut idx = vec![0x00];
+    put_varint(&mut idx, blocks.len() as u64);
+    for &(unpadded, uncompressed) in blocks {
+        put_varint(&mut idx, unpadded);
+        put_varint(&mut idx, uncompressed);
+    }
+    while idx.len() % 4 != 0 {
+        idx.push(0);
+    }
+    let crc = crc32(&idx);
+    idx.extend_from_slice(&crc.to_le_bytes());
+    idx
+}
+
+fn stream_footer(index_len: usize, check: u8) -> [u8; STREAM_HEADER_LEN] {
+    let mut f = [0u8; STREAM_HEADER_LEN];
+    f[4..8].copy_from_slice(&((index_len / 4 - 1) as u32).to_le_bytes());
+    f[9] = check;
+    f[10..].copy_from_slice(&FOOTER_MAGIC);
+    let crc = crc32(&f[4..10]);
+    f[..4].copy_from_slice(&crc.to_le_bytes());
+    f
+}
+
+fn literal_next(s: usize) -> usize {
+    match s {
+        0..=3 => 0,
+        4..=9 => s - 3,
+        _ => s - 6,
+    }
+}
+
+fn match_next(s: usize) -> usize {
+    if s < LIT_STATES { 7 } else { 10 }
+}
+
+fn long_rep_next(s: usize) -> usize {
+    if s < LIT_STATES { 8 } else { 11 }
+}
+
+fn short_rep_next(s: usize) -> usize {
+    if s < LIT_STATES { 9 } else { 11 }
+}
+
+#[derive(Clone)]
+struct LenModel {
+    choice: u16,
+    choice2: u16,
+    low: [[u16; LEN_LOW_SYMBOLS]; POS_STATES_MAX],
+    mid: [[u16; LEN_MID_SYMBOLS]; POS_STATES_MAX],
+    high: [u16; 1 << LEN_HIGH_BITS],
+}
+
+impl LenModel {
+    fn new() -> Self {
+        LenModel {
+            choice: PROB_INIT,
+            choice2: PROB_INIT,
+            low: [[PROB_INIT; LEN_LOW_SYMBOLS]; POS_STATES_MAX],
+            mid: [[PROB_INIT; LEN_MID_SYMBOLS]; POS_STATES_MAX],
+            high: [PROB_INIT; 1 << LEN_HIGH_BITS],
+        }
+    }
+}
+
+/// Probabilities and state of the LZMA coder, shared by both directions.
+/// `reps` are the last four match distances minus one.
+struct Model {
+    lc: u32,
+    lp: u32,
+    pb: u32,
+    literal: Vec<u16>,
+    is_match: [[u16; POS_STATES_MAX]; STATES],
+    is_rep: [u16; STATES],
+    is_rep0: [u16; STATES],
+    is_rep1: [u16; STATES],
+    is_rep2: [u16; STATES],
+    is_rep0_long: [[u16; POS_STATES_MAX]; STATES],
+    dist_slot: [[u16; 1 << DIST_SLOT_BITS]; DIST_STATES],
+    /// reverse trees of the distances below FULL_DISTANCES; the trees are
+    /// indexed from 1, so the one of slot s starts at (base of s) - s
+    dist_special: [u16; FULL_DISTANCES - DIST_MODEL_END as usize + 1],
+    dist_align: [u16; 1 << ALIGN_BITS],
+    match_len: LenModel,
+    rep_len: LenModel,
+    state: usize,
+    reps: [u32; 4],
+}
+
+impl Model {
+    fn new(lc: u32, lp: u32, pb: u32) -> Box<Self> {
+        Box::new(Model {
+            lc,
+            lp,
+            pb,
+            literal: vec![PROB_INIT; 0x300 << (lc + lp)],
+            is_match: [[PROB_INIT; POS_STATES_MAX]; STATES],
+            is_rep: [PROB_INIT; STATES],
+            is_rep0: [PROB_INIT; STATES],
+            is_rep1: [PROB_INIT; STATES],
+            is_rep2: [PROB_INIT; STATES],
+            is_rep0_long: [[PROB_INIT; POS_STATES_MAX]; STATES],
+            dist_slot: [[PROB_INIT; 1 << DIST_SLOT_BITS]; DIST_STATES],
+            dist_special: [PROB_INIT; FULL_DISTANCES - DIST_MODEL_END as usize + 1],
+            dist_align: [PROB_INIT; 1 << ALIGN_BITS],
+            match_len: LenModel::new(),
+            rep_len: LenModel::new(),
+            state: 0,
+            reps: [0; 4],
+        })
+    }
+
+    /// Offset of the literal coder for a byte at `pos` after `prev`.
+    fn literal_offset(&self, pos: u64, prev: u8) -> usize {
+        let lp_mask = (1u64 << self.lp) - 1;
+        0x300 * ((((pos & lp_mask) as usize) << self.lc) + ((prev as usize) >> (8 - self.lc)))
+    }
+
+    fn pos_state(&self, pos: u64) -> usize {
+        (pos & ((1u64 << self.pb) - 1)) as usize
+    }
+}
+
+/// Distance slot of `dist` (a distance minus one).
+fn dist_slot(dist: u32) -> u32 {
+    if dist < DIST_MODEL_START {
+        return dist;
+    }
+    let n = 31 - dist.leading_zeros();
+    2 * n + ((dist >> (n - 1)) & 1)
+}
+
+// ---------------------------------------------------------------- encoder
+
+struct RangeEncoder {
+    low: u64,
+    range: u32,
+    cache: u8,
+    cache_size: u64,
+    out: Vec<u8>,
+}
+
+impl RangeEncoder {
+    fn new() -> Self {
+        RangeEncoder {
+            low: 0,
+            range: u32::MAX,
+            cache: 0,
+            cache_size: 1,
+            out: Vec::new(),
+        }
+    }
+
+    fn reset(&mut self) {
+        self.low = 0;
+        self.range = u32::MAX;
+        self.cache = 0;
+        self.cache_size = 1;
+        self.out.clear();
+    }
+
+    fn shift_low(&mut self) {
+        if (self.low as u32) < 0xff00_0000 || self.low >> 32 != 0 {
+            let carry = (self.low >> 32) as u8;
+            let mut temp = self.cache;
+            loop {
+                self.out.push(temp.wrapping_add(carry));
+                temp = 0xff;
+                self.cache_size -= 1;
+                if self.cache_size == 0 {
+                    break;
+                }
+            }
+            self.cache = (self.low >> 24) as u8;
+        }
+        self.cache_size += 1;
+        self.low = (self.low & 0x00ff_ffff) << 8;
+    }
+
+    fn bit(&mut self, prob: &mut u16, bit: u32) {
+        let bound = (self.range >> PROB_BITS) * *prob as u32;
+        if bit == 0 {
+            self.range = bound;
+            *prob += ((1 << PROB_BITS) - *prob) >> MOVE_BITS;
+        } else {
+            self.low += bound as u64;
+            self.range -= bound;
+            *prob -= *prob >> MOVE_BITS;
+        }
+        if self.range < TOP {
+            self.range <<= 8;
+            self.shift_low();
+        }
+    }
+
+    fn direct(&mut self, value: u32, bits: u32) {
+        for i in (0..bits).rev() {
+            self.range >>= 1;
+            if (value >> i) & 1 != 0 {
+                self.low += self.range as u64;
+            }
+            if self.range < TOP {
+                self.range <<= 8;
+                self.shift_low();
+            }
+        }
+    }
+
+    fn tree(&mut self, probs: &mut [u16], bits: u32, symbol: u32) {
+        let mut m = 1usize;
+        for i in (0..bits).rev() {
+            let b = (symbol >> i) & 1;
+            self.bit(&mut probs[m], b);
+            m = (m << 1) | b as usize;
+        }
+    }
+
+    fn reverse(&mut self, probs: &mut [u16], bits: u32, symbol: u32) {
+        let mut m = 1usize;
+        for i in 0..bits {
+            let b = (symbol >> i) & 1;
+            self.bit(&mut probs[m], b);
+            m = (m << 1) | b as usize;
+        }
+    }
+
+    /// Bytes the chunk has once the coder is flushed.
+    fn pending_len(&self) -> usize {
+        self.out.len() + self.cache_size as usize + 4
+    }
+
+    fn finish(&mut self) {
+        for _ in 0..5 {
+            self.shift_low();
+        }
+    }
+}
+
+fn encode_len(rc: &mut RangeEncoder, m: &mut LenModel, len: usize, pos_state: usize) {
+    let l = (len - MATCH_LEN_MIN) as u32;
+    if l < LEN_LOW_SYMBOLS as u32 {
+        rc.bit(&mut m.choice, 0);
+        rc.tree(&mut m.low[pos_state], LEN_LOW_BITS, l);
+    } else if l < (LEN_LOW_SYMBOLS + LEN_MID_SYMBOLS) as u32 {
+        rc.bit(&mut m.choice, 1);
+        rc.bit(&mut m.choice2, 0);
+        rc.tree(&mut m.mid[pos_state], LEN_MID_BITS, l - LEN_LOW_SYMBOLS as u32);
+    } else {
+        rc.bit(&mut m.choice, 1);
+        rc.bit(&mut m.choice2, 1);
+        rc.tree(&mut m.high, LEN_HIGH_BITS, l - (LEN_LOW_SYMBOLS + LEN_MID_SYMBOLS) as u32);
+    }
+}
+
+/// How the encoder splits its input into literals and matches.
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum Parse {
+    /// the longest match at each position
+    Greedy,
+    /// greedy, but a match is deferred when the next position has a better one
+    Lazy,
+    /// the cheapest sequence by estimated price, as xz's normal mode
+    Optimal,
+}
+
+/// Encoder settings for xdelta3-style levels 0..=9: log2 of the dictionary
+/// size, match finder depth, the length at which a match is taken without
+/// looking further, and the parse. Levels 0 to 3 correspond to xz's fast
+/// presets, which find matches with hash chains, the others to its normal
+/// ones, which use binary trees.
+const LZMA_LEVELS: [(u32, usize, usize, Parse); 10] = [
+    (18, 4, 16, Parse::Greedy),
+    (20, 8, 32, Parse::Greedy),
+    (21, 16, 48, Parse::Greedy),
+    (22, 24, 64, Parse::Lazy),
+    (22, 24, 16, Parse::Optimal),
+    (23, 32, 32, Parse::Optimal),
+    (23, 48, 64, Parse::Optimal),
+    (24, 48, 64, Parse::Optimal),
+    (25, 64, 128, Parse::Optimal),
+    (25, 128, 273, Parse::Optimal),
+];
+
+/// Level used without WithCompressionLevel, as xz's default preset.
+const DEFAULT_LEVEL: u32 = 6;
+
+const HASH_BITS: u32 = 17;
+
+/// Input taken into the window at a time, so a large write does not
+/// grow the window and its match finder far past the dictionary.
+const WRITE_STEP: usize = 1 << 20;
+
+/// Length of the common run of win[a..] and win[b..], a < b, up to `limit`.
+fn common_len(win: &[u8], a: usize, b: usize, limit: usize) -> usize {
+    let mut n = 0;
+    while n + 8 <= limit {
+        let x = u64::from_le_bytes(win[a + n..a + n + 8].try_into().unwrap());
+        let y = u64::from_le_bytes(win[b + n..b + n + 8].try_into().unwrap());
+        if x != y {
+            return n + ((x ^ y).trailing_zeros() / 8) as usize;
+        }
+        n += 8;
+    }
+    while n < limit && win[a + n] == win[b + n] {
+        n += 1;
+    }
+    n
+}
+
+/// Whether `big` is so much farther than `small` that the shorter match at
+/// `small` is cheaper, as in xz's fast mode.
+fn change_pair(small: usize, big: usize) -> bool {
+    (big >> 7) > small
+}
+
+#[derive(Clone, Copy)]
+enum Choice {
+    Literal,
+    Match { len: usize, dist: usize },
+    Rep { index: usize, len: usize },
+    /// one byte at the last distance
+    ShortRep,
+}
+
+impl Choice {
+    fn len(self) -> usize {
+        match self {
+            Choice::Literal | Choice::ShortRep => 1,
+            Choice::Match { len, .. } | Choice::Rep { len, .. } => len,
+        }
+    }
+}
+
+/// Prices are estimated code lengths in 1/16 bits.
+const PRICE_SHIFT: u32 = 4;
+const PRICE_REDUCE_BITS: u32 = 4;
+const INFINITY_PRICE: u32 = 1 << 30;
+
+/// Price of coding a bit whose probability is [index << PRICE_REDUCE_BITS],
+/// -log2(p) computed by repeated squaring as in the LZMA SDK.
+const BIT_PRICES: [u32; 1 << (PROB_BITS - PRICE_REDUCE_BITS)] = {
+    let mut table = [0u32; 1 << (PROB_BITS - PRICE_REDUCE_BITS)];
+    let mut i = 0;
+    while i < table.len() {
+        let mut w = ((i as u32) << PRICE_REDUCE_BITS) + (1 << (PRICE_REDUCE_BITS - 1));
+        let mut bits = 0;
+        let mut j = 0;
+        while j < PRICE_SHIFT {
+            w *= w;
+            bits <<= 1;
+            while w >= 1 << 16 {
+                w >>= 1;
+                bits += 1;
+            }
+            j += 1;
+        }
+        table[i] = (PROB_BITS << PRICE_SHIFT) - 15 - bits;
+        i += 1;
+    }
+    table
+};
+
+fn bit_price(prob: u16, bit: u32) -> u32 {
+    let p = prob as u32 ^ (0u32.wrapping_sub(bit) & ((1 << PROB_BITS) - 1));
+    BIT_PRICES[(p >> PRICE_REDUCE_BITS) as usize]
+}
+
+fn tree_price(probs: &[u16], bits: u32, symbol: u32) -> u32 {
+    let mut price = 0;
+    let mut m = 1usize;
+    for i in (0..bits).rev() {
+        let b = (symbol >> i) & 1;
+        price += bit_price(probs[m], b);
+        m = (m << 1) | b as usize;
+    }
+    price
+}
+
+fn reverse_price(probs: &[u16], bits: u32, symbol: u32) -> u32 {
+    let mut price = 0;
+    let mut m = 1usize;
+    for i in 0..bits {
+        let b = (symbol >> i) & 1;
+        price += bit_price(probs[m], b);
+        m = (m << 1) | b as usize;
+    }
+    price
+}
+
+fn len_price(m: &LenModel, len: usize, pos_state: usize) -> u32 {
+    let l = (len - MATCH_LEN_MIN) as u32;
+    if l < LEN_LOW_SYMBOLS as u32 {
+        bit_price(m.choice, 0) + tree_price(&m.low[pos_state], LEN_LOW_BITS, l)
+    } else if l < (LEN_LOW_SYMBOLS + LEN_MID_SYMBOLS) as u32 {
+        bit_price(m.choice, 1)
+            + bit_price(m.choice2, 0)
+            + tree_price(&m.mid[pos_state], LEN_MID_BITS, l - LEN_LOW_SYMBOLS as u32)
+    } else {
+        bit_price(m.choice, 1)
+            + bit_price(m.choice2, 1)
+            + tree_price(&m.high, LEN_HIGH_BITS, l - (LEN_LOW_SYMBOLS + LEN_MID_SYMBOLS) as u32)
+    }
+}
+
+/// Price of the literal `byte` with the literal coder `probs`, matched
+/// against `match_byte` after a match.
+fn literal_price(probs: &[u16], byte: u8, match_byte: Option<u8>) -> u32 {
+    let byte = byte as u32;
+    let Some(match_byte) = match_byte else {
+        return tree_price(probs, 8, byte);
+    };
+    let mut match_byte = (match_byte as u32) << 1;
+    let mut offset = 0x100u32;
+    let mut symbol = 1u32;
+    let mut price = 0;
+    for i in (0..8).rev() {
+        let bit = (byte >> i) & 1;
+        let match_bit = match_byte & offset;
+        match_byte <<= 1;
+        price += bit_price(probs[(offset + match_bit + symbol) as usize], bit);
+        symbol = (symbol << 1) | bit;
+        if bit != 0 {
+            offset = match_bit;
+        } else {
+            offset ^= match_bit;
+        }
+    }
+    price
+}
+
+const LEN_SYMBOLS: usize = MATCH_LEN_MAX - MATCH_LEN_MIN + 1;
+const DIST_SLOTS: usize = 1 << DIST_SLOT_BITS;
+
+/// Matches coded between refreshes of the cached prices.
+const PRICE_REFRESH: u32 = 64;
+
+/// Cached length and distance prices from the model's probabilities, as the
+/// LZMA SDK keeps them; they are refreshed every PRICE_REFRESH matches.
+struct Prices {
+    match_len: [[u32; LEN_SYMBOLS]; POS_STATES_MAX],
+    rep_len: [[u32; LEN_SYMBOLS]; POS_STATES_MAX],
+    /// distance slot prices with the direct bits of the slot
+    dist_slot: [[u32; DIST_SLOTS]; DIST_STATES],
+    /// prices of the distances below FULL_DISTANCES (minus one)
+    dist: [[u32; FULL_DISTANCES]; DIST_STATES],
+    align: [u32; 1 << ALIGN_BITS],
+}
+
+impl Prices {
+    fn new() -> Box<Self> {
+        Box::new(Prices {
+            match_len: [[0; LEN_SYMBOLS]; POS_STATES_MAX],
+            rep_len: [[0; LEN_SYMBOLS]; POS_STATES_MAX],
+            dist_slot: [[0; DIST_SLOTS]; DIST_STATES],
+            dist: [[0; FULL_DISTANCES]; DIST_STATES],
+            align: [0; 1 << ALIGN_BITS],
+        })
+    }
+
+    fn fill(&mut self, m: &Model) {
+        for ps in 0..1usize << m.pb {
+            for l in 0..LEN_SYMBOLS {
+                self.match_len[ps][l] = len_price(&m.match_len, l + MATCH_LEN_MIN, ps);
+                self.rep_len[ps][l] = len_price(&m.rep_len, l + MATCH_LEN_MIN, ps);
+            }
+        }
+        for ds in 0..DIST_STATES {
+            for slot in 0..DIST_SLOTS as u32 {
+                let mut p = tree_price(&m.dist_slot[ds], DIST_SLOT_BITS, slot);
+                if slot >= DIST_MODEL_END {
+                    p += ((slot >> 1) - 1 - ALIGN_BITS) << PRICE_SHIFT;
+                }
+                self.dist_slot[ds][slot as usize] = p;
+            }
+            for d in 0..FULL_DISTANCES as u32 {
+                let slot = dist_slot(d);
+                let mut p = self.dist_slot[ds][slot as usize];
+                if slot >= DIST_MODEL_START {
+                    let footer = (slot >> 1) - 1;
+                    let base = (2 | (slot & 1)) << footer;
+                    p += reverse_price(&m.dist_special[(base - slot) as usize..], footer, d - base);
+                }
+                self.dist[ds][d as usize] = p;
+            }
+        }
+        for i in 0..1u32 << ALIGN_BITS {
+            self.align[i as usize] = reverse_price(&m.dist_align, ALIGN_BITS, i);
+        }
+    }
+
+    /// Price of the distance of a match of `len` bytes at `dist`.
+    fn dist(&self, dist: usize, len: usize) -> u32 {
+        let ds = usize::min(len - MATCH_LEN_MIN, DIST_STATES - 1);
+        let d = (dist - 1) as u32;
+        if (d as usize) < FULL_DISTANCES {
+            self.dist[ds][d as usize]
+        } else {
+            self.dist_slot[ds][dist_slot(d) as usize] + self.align[(d & ((1 << ALIGN_BITS) - 1)) as usize]
+        }
+    }
+}
+
+/// Positions the optimal parse looks ahead at most, as the LZMA SDK.
+const OPTS: usize = 1 << 12;
+
+/// A position of the optimal parse: the cheapest way found to reach it,
+/// the last step of that way, and the coder state and distances after it.
+#[derive(Clone, Copy)]
+struct Opt {
+    price: u32,
+    step: Choice,
+    state: usize,
+    reps: [u32; 4],
+}
+
+/// Streaming .xz encoder with one LZMA2 block. Input is collected in a
+/// window holding the dictionary; a position is coded once the longest
+/// match starting there is in the window or the stream is flushed.
+pub(crate) struct LzmaEncoder {
+    dict_size: usize,
+    depth: usize,
+    nice_len: usize,
+    parse: Parse,
+    started: bool,
+    win: Vec<u8>,
+    /// next window byte to code
+    pos: usize,
+    /// bytes coded since the dictionary reset, for the position state
+    coded: u64,
+    /// window index + 1 of the last position with each hash, 0 for none
+    head: Vec<u32>,
+    /// hash chains: window index + 1 of the previous position with the same
+    /// hash, per position inserted
+    chain: Vec<u32>,
+    /// binary trees instead of hash chains: per position inserted, its
+    /// smaller and larger child (window index + 1) in the tree of its hash,
+    /// ordered by the bytes from the position on, the latest at the root
+    tree: Vec<u32>,
+    /// the matches found when `pairs_at` was inserted into the trees
+    pairs: Vec<(usize, usize)>,
+    pairs_at: usize,
+    model: Box<Model>,
+    prices: Box<Prices>,
+    /// matches coded since the prices were filled
+    prices_age: u32,
+    /// choices of the optimal parse still to code, the next one last
+    plan: Vec<Choice>,
+    opts: Vec<Opt>,
+    rc: RangeEncoder,
+    chunk_start: usize,
+    need_dict_reset: bool,
+    need_props: bool,
+    need_state_reset: bool,
+    /// LZMA2 bytes of the block written so far and the uncompressed size
+    block_len: u64,
+    uncompressed: u64,
+    crc: flate2::Crc,
+}
+
+/// Block header: size, flags (one filter, no sizes), the LZMA2 filter with
+/// its dictionary byte, padding and CRC32.
+const BLOCK_HEADER_LEN: usize = 12;
+
+impl LzmaEncoder {
+    pub(crate) fn new(level: Option<u32>) -> Self {
+        let (dict_log, depth, nice_len, parse) = LZMA_LEVELS[level.unwrap_or(DEFAULT_LEVEL) as usize];
+        LzmaEncoder {
+            dict_size: 1 << dict_log,
+            depth,
+            nice_len,
+            parse,
+            started: false,
+            win: Vec::new(),
+            pos: 0,
+            coded: 0,
+            head: vec![0; 1 << HASH_BITS],
+            chain: Vec::new(),
+            tree: Vec::new(),
+            pairs: Vec::new(),
+            pairs_at: usize::MAX,
+            model: Model::new(LC, LP, PB),
+            prices: Prices::new(),
+            prices_age: PRICE_REFRESH,
+            plan: Vec::new(),
+            opts: Vec::new(),
+            rc: RangeEncoder::new(),
+            chunk_start: 0,
+            need_dict_reset: true,
+            need_props: true,
+            need_state_reset: false,
+            block_len: 0,
+            uncompressed: 0,
+            crc: flate2::Crc::new(),
+        }
+    }
+
+    pub(crate) fn write(&mut self, mut data: &[u8], out: &mut Vec<u8>) {
+        self.start(out);
+        while !data.is_empty() {
+            let n = usize::min(WRITE_STEP, data.len());
+            self.slide();
+            self.win.extend_from_slice(&data[..n]);
+            self.crc.update(&data[..n]);
+            self.uncompressed += n as u64;
+            data = &data[n..];
+            self.encode(false, out);
+        }
+    }
+
+    /// Code everything written and end the chunk, so it can all be decoded.
+    pub(crate) fn flush(&mut self, out: &mut Vec<u8>) {
+        self.start(out);
+        self.encode(true, out);
+        self.end_chunk(out);
+    }
+
+    /// Flush and write the end of the block, the index and the stream footer.
+    pub(crate) fn finish(&mut self, out: &mut Vec<u8>) {
+        self.flush(out);
+        out.push(0x00);
+        self.block_len += 1;
+        let mut n = BLOCK_HEADER_LEN as u64 + self.block_len;
+        while n % 4 != 0 {
+            out.push(0);
+            n += 1;
+        }
+        out.extend_from_slice(&self.crc.sum().to_le_bytes());
+        let unpadded = BLOCK_HEADER_LEN as u64 + self.block_len + 4;
+        let index = index_bytes(&[(unpadded, self.uncompressed)]);
+        out.extend_from_slice(&index);
+        out.extend_from_slice(&stream_footer(index.len(), CHECK_CRC32));
+    }
+
+    fn start(&mut self, out: &mut Vec<u8>) {
+        if self.started {
+            return;
+        }
+        self.started = true;
+        out.extend_from_slice(&stream_header(CHECK_CRC32));
+        let dict_byte = 2 * (self.dict_size.trailing_zeros() - 12) as u8;
+        let mut h = [0u8; BLOCK_HEADER_LEN];
+        h[0] = (BLOCK_HEADER_LEN / 4 - 1) as u8;
+        h[2] = FILTER_LZMA2 as u8;
+        h[3] = 1;
+        h[4] = dict_byte;
+        let crc = crc32(&h[..8]);
+        h[8..].copy_from_slice(&crc.to_le_bytes());
+        out.extend_from_slice(&h);
+    }
+
+    /// Drop window bytes more than a dictionary behind, keeping the chunk
+    /// being coded, once the window has grown a write step past the dictionary.
+    fn slide(&mut self) {
+        if self.pos <= self.dict_size + WRITE_STEP {
+            return;
+        }
+        let drop = usize::min(self.pos - self.dict_size, self.chunk_start);
+        if drop == 0 {
+            return;
+        }
+        self.win.drain(..drop);
+        if self.parse == Parse::Optimal {
+            self.tree.drain(..2 * drop);
+        } else {
+            self.chain.drain(..drop);
+        }
+        let d = drop as u32;
+        for v in self.head.iter_mut().chain(self.chain.iter_mut()).chain(self.tree.iter_mut()) {
+            *v = if *v > d { *v - d } else { 0 };
+        }
+        self.pos -= drop;
+        self.chunk_start -= drop;
+        self.pairs_at = self.pairs_at.wrapping_sub(drop);
+    }
+
+    fn hash(&self, at: usize) -> usize {
+        let w = &self.win;
+        let v = w[at] as u32 | (w[at + 1] as u32) << 8 | (w[at + 2] as u32) << 16;
+        (v.wrapping_mul(2654435761) >> (32 - HASH_BITS)) as usize
+    }
+
+    /// Window positions inserted into the match finder so far.
+    fn inserted(&self) -> usize {
+        if self.parse == Parse::Optimal {
+            self.tree.len() / 2
+        } else {
+            self.chain.len()
+        }
+    }
+
+    /// Insert the window positions before `end` not inserted yet into the
+    /// match finder. A tree position is only inserted once the window holds
+    /// `nice_len` bytes from it, since the trees are ordered by that many
+    /// bytes; until then it is skipped and inserted by a later call.
+    fn insert_upto(&mut self, end: usize) {
+        while self.inserted() < end {
+            let at = self.inserted();
+            if self.parse == Parse::Optimal {
+                if self.win.len() - at < self.nice_len {
+                    return;
+                }
+                self.tree_walk(at, true, None);
+                continue;
+            }
+            if at + 3 > self.win.len() {
+                self.chain.push(0);
+                continue;
+            }
+            let h = self.hash(at);
+            self.chain.push(self.head[h]);
+            self.head[h] = at as u32 + 1;
+        }
+    }
+
+    /// Search the tree of the hash of `at` as the LZ match finder of the
+    /// LZMA SDK, passing the matches to `out` with increasing lengths of at
+    /// least 3, up to `nice_len`. With `insert`, `at` is the next position
+    /// and the window holds `nice_len` bytes from it; the search then also
+    /// makes `at` the root of its tree.
+    fn tree_walk(&mut self, at: usize, insert: bool, mut out: Option<&mut Vec<(usize, usize)>>) {
+        let limit = usize::min(self.win.len() - at, self.nice_len);
+        if insert {
+            debug_assert!(2 * at == self.tree.len() && limit == self.nice_len);
+            self.tree.extend_from_slice(&[0, 0]);
+        }
+        if limit < 3 {
+            return;
+        }
+        let h = self.hash(at);
+        let mut cand = self.head[h] as usize;
+        if insert {
+            self.head[h] = at as u32 + 1;
+        }
+        let history = self.history(at);
+        // the slots where the next smaller and larger node go, and the
+        // length every node on that side shares with `at`
+        let (mut smaller, mut larger) = (2 * at, 2 * at + 1);
+        let (mut smaller_len, mut larger_len) = (0, 0);
+        let mut best = 2;
+        let mut depth = self.depth;
+        loop {
+            if cand == 0 || at - (cand - 1) > history || depth == 0 {
+                if insert {
+                    self.tree[smaller] = 0;
+                    self.tree[larger] = 0;
+                }
+                return;
+            }
+            depth -= 1;
+            let c = cand - 1;
+            let mut len = usize::min(smaller_len, larger_len);
+            if self.win[c + len] == self.win[at + len] {
+                len += common_len(&self.win, c + len, at + len, limit - len);
+                if len > best {
+                    best = len;
+                    if let Some(out) = out.as_deref_mut() {
+                        out.push((len, at - c));
+                    }
+                }
+                if len == limit {
+                    if insert {
+                        // `at` replaces `c`, whose subtrees it takes over
+                        self.tree[smaller] = self.tree[2 * c];
+                        self.tree[larger] = self.tree[2 * c + 1];
+                    }
+                    return;
+                }
+            }
+            if self.win[c + len] < self.win[at + len] {
+                if insert {
+                    self.tree[smaller] = cand as u32;
+                }
+                smaller = 2 * c + 1;
+                cand = self.tree[smaller] as usize;
+                smaller_len = len;
+            } else {
+                if insert {
+                    self.tree[larger] = cand as u32;
+                }
+                larger = 2 * c;
+                cand = self.tree[larger] as usize;
+                larger_len = len;
+            }
+        }
+    }
+
+    /// Window index + 1 of the latest earlier position that may match `at`.
+    fn first_candidate(&self, at: usize) -> usize {
+        if at < self.chain.len() {
+            self.chain[at] as usize
+        } else {
+            self.head[self.hash(at)] as usize
+        }
+    }
+
+    /// Bytes before `at` a match may reach back.
+    fn history(&self, at: usize) -> usize {
+        usize::min(self.dict_size, self.coded as usize + (at - self.pos))
+    }
+
+    /// The longest earlier match for `at`, and the best one found before it,
+    /// as (length, distance); lengths below 3 are reported as 0.
+    fn find(&self, at: usize, limit: usize) -> ((usize, usize), (usize, usize)) {
+        let (mut best, mut before) = ((0usize, 0usize), (0usize, 0usize));
+        if limit < 3 {
+            return (best, before);
+        }
+        let nice = usize::min(self.nice_len, limit);
+        let history = self.history(at);
+        let mut cand = self.first_candidate(at);
+        let mut depth = self.depth;
+        while cand != 0 && depth > 0 {
+            let c = cand - 1;
+            let dist = at - c;
+            if dist > history {
+                break;
+            }
+            if self.win[c + best.0] == self.win[at + best.0] {
+                let len = common_len(&self.win, c, at, limit);
+                if len > best.0 && len >= 3 {
+                    before = best;
+                    best = (len, dist);
+                    if len >= nice {
+                        break;
+                    }
+                }
+            }
+            cand = self.chain[c] as usize;
+            depth -= 1;
+        }
+        (best, before)
+    }
+
+    /// Length of the repeat of `rep` (a distance minus one) at `at`, 0 if it
+    /// is shorter than MATCH_LEN_MIN or reaches before the history.
+    fn rep_len(&self, at: usize, rep: u32, limit: usize) -> usize {
+        let dist = rep as usize + 1;
+        if dist > self.history(at) || limit < MATCH_LEN_MIN {
+            return 0;
+        }
+        let len = common_len(&self.win, at - dist, at, limit);
+        if len >= MATCH_LEN_MIN { len } else { 0 }
+    }
+
+    /// The longest repeat of the last distances at `at`, as (index, length).
+    fn find_rep(&self, at: usize, limit: usize) -> (usize, usize) {
+        let mut best = (0, 0);
+        for (i, &r) in self.model.reps.iter().enumerate() {
+            let len = self.rep_len(at, r, limit);
+            if len > best.1 {
+                best = (i, len);
+            }
+        }
+        best
+    }
+
+    /// Choose how to code the window byte at `pos`, the greedy parse of
+    /// xz's fast mode with one position of lookahead when lazy.
+    fn choose(&mut self, avail: usize) -> Choice {
+        let limit = usize::min(avail, MATCH_LEN_MAX);
+        let nice = usize::min(self.nice_len, limit);
+        let (rep_index, rep_len) = self.find_rep(self.pos, limit);
+        let ((mut main_len, mut main_dist), before) = self.find(self.pos, limit);
+        self.insert_upto(self.pos + 1);
+        if rep_len >= nice {
+            return Choice::Rep { index: rep_index, len: rep_len };
+        }
+        if main_len >= nice {
+            return Choice::Match { len: main_len, dist: main_dist };
+        }
+        if before.0 >= 3 && before.0 + 1 == main_len && change_pair(before.1, main_dist) {
+            (main_len, main_dist) = before;
+        }
+        if rep_len >= MATCH_LEN_MIN
+            && (rep_len + 1 >= main_len
+                || (rep_len + 2 >= main_len && main_dist >= 1 << 9)
+                || (rep_len + 3 >= main_len && main_dist >= 1 << 15))
+        {
+            return Choice::Rep { index: rep_index, len: rep_len };
+        }
+        if main_len < 3 || avail <= 2 {
+            return Choice::Literal;
+        }
+        if self.parse == Parse::Lazy {
+            let next = self.pos + 1;
+            let next_limit = usize::min(avail - 1, MATCH_LEN_MAX);
+            let ((next_len, next_dist), _) = self.find(next, next_limit);
+            if next_len >= MATCH_LEN_MIN
+                && ((next_len >= main_len && next_dist < main_dist)
+                    || (next_len == main_len + 1 && !change_pair(main_dist, next_dist))
+                    || next_len > main_len + 1
+                    || (next_len + 1 >= main_len && main_len >= 3 && change_pair(next_dist, main_dist)))
+            {
+                return Choice::Literal;
+            }
+            let (_, next_rep) = self.find_rep(next, next_limit);
+            if next_rep >= usize::max(main_len - 1, MATCH_LEN_MIN) {
+                return Choice::Literal;
+            }
+        }
+        Choice::Match { len: main_len, dist: main_dist }
+    }
+
+    /// Plan the cheapest choices from `pos` by the estimated prices, looking
+    /// ahead up to OPTS positions or to a match of at least the nice length.
+    fn plan(&mut self, avail: usize) {
+        if self.prices_age >= PRICE_REFRESH {
+            self.prices.fill(&self.model);
+            self.prices_age = 0;
+        }
+        self.insert_upto(self.pos);
+        let mut opts = std::mem::take(&mut self.opts);
+        let mut pairs = std::mem::take(&mut self.pairs);
+        opts.clear();
+        opts.push(Opt {
+            price: 0,
+            step: Choice::Literal,
+            state: self.model.state,
+            reps: self.model.reps,
+        });
+        let nice = self.nice_len;
+        let mut end = 0;
+        let mut cur = 0;
+        loop {
+            let at = self.pos + cur;
+            let limit = usize::min(avail - cur, MATCH_LEN_MAX);
+            if cur > 0 {
+                let o = opts[cur];
+                let prev = opts[cur - o.step.len()];
+                opts[cur].state = match o.step {
+                    Choice::Literal => literal_next(prev.state),
+                    Choice::ShortRep => short_rep_next(prev.state),
+                    Choice::Rep { .. } => long_rep_next(prev.state),
+                    Choice::Match { .. } => match_next(prev.state),
+                };
+                opts[cur].reps = match o.step {
+                    Choice::Rep { index, .. } => {
+                        let mut reps = prev.reps;
+                        reps.copy_within(0..index, 1);
+                        reps[0] = prev.reps[index];
+                        reps
+                    }
+                    Choice::Match { dist, .. } => [dist as u32 - 1, prev.reps[0], prev.reps[1], prev.reps[2]],
+                    _ => prev.reps,
+                };
+            }
+            let Opt { price, state, reps, .. } = opts[cur];
+            if at != self.pairs_at {
+                pairs.clear();
+                if at >= self.inserted() {
+                    let insert = at == self.inserted() && self.win.len() - at >= self.nice_len;
+                    self.tree_walk(at, insert, Some(&mut pairs));
+                    // a match of the nice length may go on
+                    if let Some((len, dist)) = pairs.last_mut() {
+                        if *len == self.nice_len {
+                            *len = common_len(&self.win, at - *dist, at, limit);
+                        }
+                    }
+                    self.pairs_at = at;
+                }
+                // otherwise `at` was searched by a plan dropped at a chunk reset
+            }
+            let rep_lens = reps.map(|r| self.rep_len(at, r, limit));
+            let longest = usize::max(pairs.last().map_or(0, |p| p.0), rep_lens.into_iter().max().unwrap());
+            if longest >= usize::min(nice, limit) {
+                if cur > 0 {
+                    // the long match is taken when planning from here
+                    break;
+                }
+                let index = (0..4).max_by_key(|&i| (rep_lens[i], 4 - i)).unwrap();
+                let step = if rep_lens[index] >= longest {
+                    Choice::Rep { index, len: longest }
+                } else {
+                    let (len, dist) = *pairs.last().unwrap();
+                    Choice::Match { len, dist }
+                };
+                opts.push(Opt { price: 0, step, state, reps });
+                opts.truncate(1);
+                self.plan.push(step);
+                self.opts = opts;
+                self.pairs = pairs;
+                return;
+            }
+            if cur + longest.max(1) > end {
+                let grow = cur + longest.max(1) - end;
+                opts.extend(std::iter::repeat_n(
+                    Opt {
+                        price: INFINITY_PRICE,
+                        step: Choice::Literal,
+                        state: 0,
+                        reps: [0; 4],
+                    },
+                    grow,
+                ));
+                end += grow;
+            }
+            let m = &*self.model;
+            let pos_state = m.pos_state(self.coded + cur as u64);
+            let is_match = m.is_match[state][pos_state];
+            let offer = |opts: &mut Vec<Opt>, to: usize, price: u32, step: Choice| {
+                if price < opts[to].price {
+                    opts[to].price = price;
+                    opts[to].step = step;
+                }
+            };
+
+            // a literal, or one byte at the last distance
+            let prev_byte = if self.coded + cur as u64 > 0 { self.win[at - 1] } else { 0 };
+            let off = m.literal_offset(self.coded + cur as u64, prev_byte);
+            let rep0_ok = (reps[0] as usize) < self.history(at);
+            let match_byte = if state >= LIT_STATES && rep0_ok {
+                Some(self.win[at - reps[0] as usize - 1])
+            } else {
+                None
+            };
+            let lit = price + bit_price(is_match, 0) + literal_price(&m.literal[off..off + 0x300], self.win[at], match_byte);
+            offer(&mut opts, cur + 1, lit, Choice::Literal);
+            let rep_base = price + bit_price(is_match, 1) + bit_price(m.is_rep[state], 1);
+            if rep0_ok && self.win[at] == self.win[at - reps[0] as usize - 1] {
+                let short = rep_base + bit_price(m.is_rep0[state], 0) + bit_price(m.is_rep0_long[state][pos_state], 0);
+                offer(&mut opts, cur + 1, short, Choice::ShortRep);
+            }
+
+            for (index, &len) in rep_lens.iter().enumerate() {
+                if len == 0 {
+                    continue;
+                }
+                let base = rep_base
+                    + match index {
+                        0 => bit_price(m.is_rep0[state], 0) + bit_price(m.is_rep0_long[state][pos_state], 1),
+                        1 => bit_price(m.is_rep0[state], 1) + bit_price(m.is_rep1[state], 0),
+                        _ => {
+                            bit_price(m.is_rep0[state], 1)
+                                + bit_price(m.is_rep1[state], 1)
+                                + bit_price(m.is_rep2[state], (index - 2) as u32)
+                        }
+                    };
+                for l in MATCH_LEN_MIN..=len {
+                    let p = base + self.prices.rep_len[pos_state][l - MATCH_LEN_MIN];
+                    offer(&mut opts, cur + l, p, Choice::Rep { index, len: l });
+                }
+            }
+
+            let match_base = price + bit_price(is_match, 1) + bit_price(m.is_rep[state], 0);
+            let mut l = MATCH_LEN_MIN;
+            for &(len, dist) in pairs.iter() {
+                while l <= len {
+                    let p = match_base + self.prices.match_len[pos_state][l - MATCH_LEN_MIN] + self.prices.dist(dist, l);
+                    offer(&mut opts, cur + l, p, Choice::Match { len: l, dist });
+                    l += 1;
+                }
+            }
+
+            cur += 1;
+            if cur == end || cur >= OPTS {
+                break;
+            }
+        }
+        // the steps of the cheapest way to `cur`, the first one last
+        let mut i = cur;
+        while i > 0 {
+            let step = opts[i].step;
+            self.plan.push(step);
+            i -= step.len();
+        }
+        self.opts = opts;
+        self.pairs = pairs;
+    }
+
+    /// Window bytes kept back uncoded after a write, so the longest matches
+    /// starting at the coded positions are in the window.
+    fn lookahead(&self) -> usize {
+        match self.parse {
+            Parse::Optimal => OPTS + MATCH_LEN_MAX + 1,
+            _ => MATCH_LEN_MAX + 1,
+        }
+    }
+
+    /// Code window bytes, leaving the last `lookahead` for later unless `all`.
+    fn encode(&mut self, all: bool, out: &mut Vec<u8>) {
+        loop {
+            let avail = self.win.len() - self.pos;
+            if avail == 0 || (self.plan.is_empty() && !all && avail <= self.lookahead()) {
+                return;
+            }
+            if self.pos - self.chunk_start + MATCH_LEN_MAX > CHUNK_MAX_UNCOMPRESSED
+                || self.rc.pending_len() + PACKET_MAX > CHUNK_MAX_COMPRESSED
+            {
+                self.end_chunk(out);
+            }
+            let choice = match self.parse {
+                Parse::Optimal => {
+                    if self.plan.is_empty() {
+                        self.plan(avail);
+                    }
+                    self.plan.pop().unwrap()
+                }
+                _ => self.choose(avail),
+            };
+            match choice {
+                Choice::Literal => self.literal(),
+                Choice::Match { len, dist } => self.code_match(len, dist),
+                Choice::Rep { index, len } => self.code_rep(index, len),
+                Choice::ShortRep => self.code_short_rep(),
+            }
+            let len = choice.len();
+            self.insert_upto(self.pos + len);
+            self.pos += len;
+            self.coded += len as u64;
+        }
+    }
+    fn literal(&mut self) {
+        let m = &mut *self.model;
+        let rc = &mut self.rc;
+        let pos_state = m.pos_state(self.coded);
+        rc.bit(&mut m.is_match[m.state][pos_state], 0);
+        let prev = if self.coded > 0 { self.win[self.pos - 1] } else { 0 };
+        let off = m.literal_offset(self.coded, prev);
+        let probs = &mut m.literal[off..off + 0x300];
+        let byte = self.win[self.pos] as u32;
+        if m.state < LIT_STATES {
+            rc.tree(probs, 8, byte);
+        } else {
+            let mut match_byte = (self.win[self.pos - m.reps[0] as usize - 1] as u32) << 1;
+            let mut offset = 0x100u32;
+            let mut symbol = 1u32;
+            for i in (0..8).rev() {
+                let bit = (byte >> i) & 1;
+                let match_bit = match_byte & offset;
+                match_byte <<= 1;
+                rc.bit(&mut probs[(offset + match_bit + symbol) as usize], bit);
+                symbol = (symbol << 1) | bit;
+                if bit != 0 {
+                    offset = match_bit;
+                } else {
+                    offset ^= match_bit;
+                }
+            }
+        }
+        m.state = literal_next(m.state);
+    }
+
+    fn code_match(&mut self, len: usize, dist: usize) {
+        let m = &mut *self.model;
+        let rc = &mut self.rc;
+        let pos_state = m.pos_state(self.coded);
+        rc.bit(&mut m.is_match[m.state][pos_state], 1);
+        rc.bit(&mut m.is_rep[m.state], 0);
+        encode_len(rc, &mut m.match_len, len, pos_state);
+        let d = (dist - 1) as u32;
+        let slot = dist_slot(d);
+        rc.tree(&mut m.dist_slot[usize::min(len - MATCH_LEN_MIN, DIST_STATES - 1)], DIST_SLOT_BITS, slot);
+        if slot >= DIST_MODEL_START {
+            let footer = (slot >> 1) - 1;
+            let base = (2 | (slot & 1)) << footer;
+            let reduced = d - base;
+            if slot < DIST_MODEL_END {
+                let at = (base - slot) as usize;
+                rc.reverse(&mut m.dist_special[at..], footer, reduced);
+            } else {
+                rc.direct(reduced >> ALIGN_BITS, footer - ALIGN_BITS);
+                rc.reverse(&mut m.dist_align, ALIGN_BITS, reduced & ((1 << ALIGN_BITS) - 1));
+            }
+        }
+        m.reps = [d, m.reps[0], m.reps[1], m.reps[2]];
+        m.state = match_next(m.state);
+        self.prices_age += 1;
+    }
+
+    fn code_rep(&mut self, index: usize, len: usize) {
+        let m = &mut *self.model;
+        let rc = &mut self.rc;
+        let pos_state = m.pos_state(self.coded);
+        rc.bit(&mut m.is_match[m.state][pos_state], 1);
+        rc.bit(&mut m.is_rep[m.state], 1);
+        if index == 0 {
+            rc.bit(&mut m.is_rep0[m.state], 0);
+            rc.bit(&mut m.is_rep0_long[m.state][pos_state], 1);
+        } else {
+            rc.bit(&mut m.is_rep0[m.state], 1);
+            if index == 1 {
+                rc.bit(&mut m.is_rep1[m.state], 0);
+            } else {
+                rc.bit(&mut m.is_rep1[m.state], 1);
+                rc.bit(&mut m.is_rep2[m.state], (index - 2) as u32);
+            }
+            let d = m.reps[index];
+            m.reps.copy_within(0..index, 1);
+            m.reps[0] = d;
+        }
+        encode_len(rc, &mut m.rep_len, len, pos_state);
+        m.state = long_rep_next(m.state);
+        self.prices_age += 1;
+    }
+
+    fn code_short_rep(&mut self) {
+        let m = &mut *self.model;
+        let rc = &mut self.rc;
+        let pos_state = m.pos_state(self.coded);
+        rc.bit(&mut m.is_match[m.state][pos_state], 1);
+        rc.bit(&mut m.is_rep[m.state], 1);
+        rc.bit(&mut m.is_rep0[m.state], 0);
+        rc.bit(&mut m.is_rep0_long[m.state][pos_state], 0);
+        m.state = short_rep_next(m.state);
+    }
+
+    /// Write the chunk coded since `chunk_start`, stored when LZMA does not
+    /// make it smaller; the coder state is then reset for the next chunk.
+    fn end_chunk(&mut self, out: &mut Vec<u8>) {
+        let u = self.pos - self.chunk_start;
+        if u == 0 {
+            return;
+        }
+        self.rc.finish();
+        let c = self.rc.out.len();
+        let start = out.len();
+        if c + 3 >= u {
+            for piece in self.win[self.chunk_start..self.pos].chunks(CHUNK_MAX_COMPRESSED) {
+                out.push(if self.need_dict_reset { 0x01 } else { 0x02 });
+                out.extend_from_slice(&((piece.len() - 1) as u16).to_be_bytes());
+                out.extend_from_slice(piece);
+                self.need_dict_reset = false;
+            }
+            self.model = Model::new(LC, LP, PB);
+            self.need_state_reset = true;
+            // the plan refers to the distances of the old state
+            self.plan.clear();
+            self.prices_age = PRICE_REFRESH;
+        } else {
+            let reset = if self.need_props {
+                if self.need_dict_reset { 0x60 } else { 0x40 }
+            } else if self.need_state_reset {
+                0x20
+            } else {
+                0x00
+            };
+            out.push(0x80 | reset | ((u - 1) >> 16) as u8);
+            out.extend_from_slice(&((u - 1) as u16).to_be_bytes());
+            out.extend_from_slice(&((c - 1) as u16).to_be_bytes());
+            if self.need_props {
+                out.push(((PB * 5 + LP) * 9 + LC) as u8);
+            }
+            out.extend_from_slice(&self.rc.out);
+            self.need_dict_reset = false;
+            self.need_props = false;
+            self.need_state_reset = false;
+        }
+        self.block_len += (out.len() - start) as u64;
+        self.rc.reset();
+        self.chunk_start = self.pos;
+    }
+}
+
+// ---------------------------------------------------------------- decoder
+
+/// Range decoder over one whole LZMA2 chunk. Reading past the chunk yields
+/// zeros and is reported by `finished`.
+struct RangeDecoder<'a> {
+    buf: &'a [u8],
+    pos: usize,
+    range: u32,
+    code: u32,
+    overrun: bool,
+}
+
+impl<'a> RangeDecoder<'a> {
+    fn new(buf: &'a [u8]) -> Result<Self, XDeltaError> {
+        if buf.len() < 5 || buf[0] != 0 {
+            return Err(corrupt("bad range coder start"));
+        }
+        Ok(RangeDecoder {
+            buf,
+            pos: 5,
+            range: u32::MAX,
+            code: u32::from_be_bytes([buf[1], buf[2], buf[3], buf[4]]),
+            overrun: false,
+        })
+    }
+
+    fn normalize(&mut self) {
+        if self.range < TOP {
+            self.range <<= 8;
+            let b = match self.buf.get(self.pos) {
+                Some(&b) => b,
+                None => {
+                    self.overrun = true;
+                    0
+                }
+            };
+            self.pos += 1;
+            self.code = (self.code << 8) | b as u32;
+        }
+    }
+
+    fn bit(&mut self, prob: &mut u16) -> u32 {
+        let bound = (self.range >> PROB_BITS) * *prob as u32;
+        let bit = if self.code < bound {
+            self.range = bound;
+            *prob += ((1 << PROB_BITS) - *prob) >> MOVE_BITS;
+            0
+        } else {
+            self.code -= bound;
+            self.range -= bound;
+            *prob -= *prob >> MOVE_BITS;
+            1
+        };
+        self.normalize();
+        bit
+    }
+
+    fn direct(&mut self, bits: u32) -> u32 {
+        let mut v = 0;
+        for _ in 0..bits {
+            self.range >>= 1;
+            let b = if self.code >= self.range {
+                self.code -= self.range;
+                1
+            } else {
+                0
+            };
+            v = (v << 1) | b;
+            self.normalize();
+        }
+        v
+    }
+
+    fn tree(&mut self, probs: &mut [u16], bits: u32) -> u32 {
+        let mut m = 1u32;
+        for _ in 0..bits {
+            m = (m << 1) | self.bit(&mut probs[m as usize]);
+        }
+        m - (1 << bits)
+    }
+
+    fn reverse(&mut self, probs: &mut [u16], bits: u32) -> u32 {
+        let mut m = 1usize;
+        let mut v = 0;
+        for i in 0..bits {
+            let b = self.bit(&mut probs[m]);
+            m = (m << 1) | b as usize;
+            v |= b << i;
+        }
+        v
+    }
+
+    /// Whether the chunk was used up exactly and the coder ended cleanly.
+    fn finished(&self) -> bool {
+        !self.overrun && self.pos == self.buf.len() && self.code == 0
+    }
+}
+
+fn decode_len(rc: &mut RangeDecoder, m: &mut LenModel, pos_state: usize) -> usize {
+    MATCH_LEN_MIN
+        + if rc.bit(&mut m.choice) == 0 {
+            rc.tree(&mut m.low[pos_state], LEN_LOW_BITS) as usize
+        } else if rc.bit(&mut m.choice2) == 0 {
+            LEN_LOW_SYMBOLS + rc.tree(&mut m.mid[pos_state], LEN_MID_BITS) as usize
+        } else {
+            LEN_LOW_SYMBOLS + LEN_MID_SYMBOLS + rc.tree(&mut m.high, LEN_HIGH_BITS) as usize
+        }
+}
+
+/// Decoded bytes kept for matches: at least the last dictionary's worth.
+struct History {
+    buf: Vec<u8>,
+    dict_size: u64,
+    /// bytes decoded since the dictionary reset
+    pos: u64,
+}
+
+impl History {
+    /// Valid distances are within the dictionary and the data since the reset.
+    fn check(&self, dist: u64) -> Result<(), XDeltaError> {
+        if dist > self.pos || dist > self.dict_size {
+            return Err(corrupt("match distance beyond the dictionary"));
+        }
+        Ok(())
+    }
+
+    fn copy(&mut self, dist: usize, len: usize) {
+        let from = self.buf.len() - dist;
+        if dist >= len {
+            self.buf.extend_from_within(from..from + len);
+        } else {
+            for i in 0..len {
+                let b = self.buf[from + i];
+                self.buf.push(b);
+            }
+        }
+        self.pos += len as u64;
+    }
+
+    /// Drop bytes no match can reach once they take twice the dictionary.
+    fn trim(&mut self) {
+        let keep = usize::try_from(self.dict_size).unwrap_or(usize::MAX);
+        if self.buf.len() > 2 * usize::max(keep, CHUNK_MAX_UNCOMPRESSED) {
+            self.buf.drain(..self.buf.len() - keep);
+        }
+    }
+}
+
+/// Decode one LZMA chunk of `u` bytes from `body` onto the history.
+fn decode_chunk(m: &mut Model, h: &mut History, body: &[u8], u: usize) -> Result<(), XDeltaError> {
+    let mut rc = RangeDecoder::new(body)?;
+    let end = h.buf.len() + u;
+    while h.buf.len() < end {
+        let pos_state = m.pos_state(h.pos);
+        if rc.bit(&mut m.is_match[m.state][pos_state]) == 0 {
+            let prev = if h.pos > 0 { *h.buf.last().unwrap() } else { 0 };
+            let off = m.literal_offset(h.pos, prev);
+            let probs = &mut m.literal[off..off + 0x300];
+            let mut symbol = 1u32;
+            if m.state < LIT_STATES {
+                while symbol < 0x100 {
+                    symbol = (symbol << 1) | rc.bit(&mut probs[symbol as usize]);
+                }
+            } else {
+                let dist = m.reps[0] as u64 + 1;
+                h.check(dist)?;
+                let mut match_byte = (h.buf[h.buf.len() - dist as usize] as u32) << 1;
+                let mut offset = 0x100u32;
+                while symbol < 0x100 {
+                    let match_bit = match_byte & offset;
+                    match_byte <<= 1;
+                    let bit = rc.bit(&mut probs[(offset + match_bit + symbol) as usize]);
+                    symbol = (symbol << 1) | bit;
+                    if bit != 0 {
+                        offset = match_bit;
+                    } else {
+                        offset ^= match_bit;
+                    }
+                }
+            }
+            h.buf.push(symbol as u8);
+            h.pos += 1;
+            m.state = literal_next(m.state);
+            continue;
+        }
+        let len = if rc.bit(&mut m.is_rep[m.state]) == 0 {
+            let len = decode_len(&mut rc, &mut m.match_len, pos_state);
+            let slot = rc.tree(&mut m.dist_slot[usize::min(len - MATCH_LEN_MIN, DIST_STATES - 1)], DIST_SLOT_BITS);
+            let dist = if slot < DIST_MODEL_START {
+                slot
+            } else {
+                let footer = (slot >> 1) - 1;
+                let base = (2 | (slot & 1)) << footer;
+                if slot < DIST_MODEL_END {
+                    let at = (base - slot) as usize;
+                    base + rc.reverse(&mut m.dist_special[at..], footer)
+                } else {
+                    let high = rc.direct(footer - ALIGN_BITS) << ALIGN_BITS;
+                    base + high + rc.reverse(&mut m.dist_align, ALIGN_BITS)
+                }
+            };
+            if dist == u32::MAX {
+                return Err(corrupt("end marker in an LZMA2 chunk"));
+            }
+            m.reps = [dist, m.reps[0], m.reps[1], m.reps[2]];
+            m.state = match_next(m.state);
+            len
+        } else {
+            if rc.bit(&mut m.is_rep0[m.state]) == 0 {
+                if rc.bit(&mut m.is_rep0_long[m.state][pos_state]) == 0 {
+                    let dist = m.reps[0] as u64 + 1;
+                    h.check(dist)?;
+                    h.copy(dist as usize, 1);
+                    m.state = short_rep_next(m.state);
+                    continue;
+                }
+            } else {
+                let index = if rc.bit(&mut m.is_rep1[m.state]) == 0 {
+                    1
+                } else if rc.bit(&mut m.is_rep2[m.state]) == 0 {
+                    2
+                } else {
+                    3
+                };
+                let d = m.reps[index];
+                m.reps.copy_within(0..index, 1);
+                m.reps[0] = d;
+            }
+            m.state = long_rep_next(m.state);
+            decode_len(&mut rc, &mut m.rep_len, pos_state)
+        };
+        let dist = m.reps[0] as u64 + 1;
+        h.check(dist)?;
+        if len > end - h.buf.len() {
+            return Err(corrupt("match past the end of the chunk"));
+        }
+        h.copy(dist as usize, len);
+        if rc.overrun {
+            break;
+        }
+    }
+    if !rc.finished() {
+        return Err(corrupt("chunk size does not match its data"));
+    }
+    Ok(())
+}
+
+enum Check {
+    None,
+    Crc32(flate2::Crc),
+    Crc64(u64),
+    Sha256(Box<Sha256>),
+}
+
+impl Check {
+    fn new(kind: u8) -> Result<Self, XDeltaError> {
+        Ok(match kind {
+            CHECK_NONE => Check::None,
+            CHECK_CRC32 => Check::Crc32(flate2::Crc::new()),
+            CHECK_CRC64 => Check::Crc64(u64::MAX),
+            CHECK_SHA256 => Check::Sha256(Box::new(Sha256::new())),
+            other => return Err(XDeltaError::Unsupported(format!("xz check type {:#x} is not supported", other))),
+        })
+    }
+
+    fn len(&self) -> usize {
+        match self {
+            Check::None => 0,
+            Check::Crc32(_) => 4,
+            Check::Crc64(_) => 8,
+            Check::Sha256(_) => 32,
+        }
+    }
+
+    fn update(&mut self, data: &[u8]) {
+        match self {
+            Check::None => {}
+            Check::Crc32(c) => c.update(data),
+            Check::Crc64(c) => {
+                for &b in data {
+                    *c = CRC64_TABLE[((*c ^ b as u64) & 0xff) as usize] ^ (*c >> 8);
+                }
+            }
+            Check::Sha256(h) => h.update(data),
+        }
+    }
+
+    /// The check value and a fresh check for the next block.
+    fn sum(&mut self) -> Vec<u8> {
+        match self {
+            Check::None => Vec::new(),
+            Check::Crc32(c) => {
+                let v = c.sum().to_le_bytes().to_vec();
+                *c = flate2::Crc::new();
+                v
+            }
+            Check::Crc64(c) => {
+                let v = (!*c).to_le_bytes().to_vec();
+                *c = u64::MAX;
+                v
+            }
+            Check::Sha256(h) => std::mem::take(&mut **h).finalize().to_vec(),
+        }
+    }
+}
+
+enum State {
+    StreamHeader,
+    /// a block header or the index follows
+    BlockStart,
+    BlockHeader { first: u8 },
+    ChunkControl,
+    ChunkHeader { control: u8 },
+    Uncompressed { left: usize },
+    Compressed { u: usize, c: usize },
+    BlockPadding,
+    Check,
+    Index,
+    Footer,
+    Ended,
+}
+
+/// Streaming .xz decoder, passing each decoded chunk to the sink.
+pub(crate) struct LzmaDecoder {
+    state: State,
+    /// bytes of the current piece collected so far
+    pending: Vec<u8>,
+    check_kind: u8,
+    check: Check,
+    model: Option<Box<Model>>,
+    history: History,
+    need_dict_reset: bool,
+    need_props: bool,
+    /// compressed and uncompressed sizes the block header declares
+    declared: (Option<u64>, Option<u64>),
+    /// current block: header length, LZMA2 bytes and uncompressed bytes
+    header_len: u64,
+    block_len: u64,
+    block_out: u64,
+    /// (unpadded size, uncompressed size) of the finished blocks
+    blocks: Vec<(u64, u64)>,
+    index: Vec<u8>,
+}
+
+impl LzmaDecoder {
+    pub(crate) fn new() -> Self {
+        LzmaDecoder {
+            state: State::StreamHeader,
+            pending: Vec::new(),
+            check_kind: CHECK_NONE,
+            check: Check::None,
+            model: None,
+            history: History {
+                buf: Vec::new(),
+                dict_size: 0,
+                pos: 0,
+            },
+            need_dict_reset: true,
+            need_props: true,
+            declared: (None, None),
+            header_len: 0,
+            block_len: 0,
+            block_out: 0,
+            blocks: Vec::new(),
+            index: Vec::new(),
+        }
+    }
+
+    pub(crate) fn ended(&self) -> bool {
+        matches!(self.state, State::Ended)
+    }
+
+    /// Bytes the current state needs before it can be handled.
+    fn want(&self) -> usize {
+        match self.state {
+            State::StreamHeader | State::Footer => STREAM_HEADER_LEN,
+            State::BlockStart | State::ChunkControl => 1,
+            State::BlockHeader { first } => (first as usize + 1) * 4 - 1,
+            State::ChunkHeader { control } => match control {
+                0x01 | 0x02 => 2,
+                c if c >= 0xc0 => 5,
+                _ => 4,
+            },
+            State::Uncompressed { left } => left,
+            State::Compressed { c, .. } => c,
+            State::BlockPadding => ((4 - (self.header_len + self.block_len) % 4) % 4) as usize,
+            State::Check => self.check.len(),
+            State::Index => self.index.len() - 1,
+            State::Ended => 0,
+        }
+    }
+
+    pub(crate) fn feed(
+        &mut self,
+        mut patch: &[u8],
+        sink: &mut impl FnMut(&[u8]) -> Result<(), XDeltaError>,
+    ) -> Result<(), XDeltaError> {
+        loop {
+            if let State::Ended = self.state {
+                if !patch.is_empty() {
+                    return Err(XDeltaError::Corrupt("trailing data after xz stream".into()));
+                }
+                return Ok(());
+            }
+            // stored data is passed on as it arrives
+            if let State::Uncompressed { left } = self.state {
+                let n = usize::min(left, patch.len());
+                if n == 0 {
+                    return Ok(());
+                }
+                self.stored(&patch[..n], sink)?;
+                patch = &patch[n..];
+                self.state = if n == left {
+                    State::ChunkControl
+                } else {
+                    State::Uncompressed { left: left - n }
+                };
+                continue;
+            }
+            let want = self.want();
+            if want > 0 && patch.is_empty() {
+                return Ok(());
+            }
+            // a whole piece in `patch` is used in place, otherwise it is collected
+            let mut taken = None;
+            let piece = if self.pending.is_empty() && patch.len() >= want {
+                let (piece, rest) = patch.split_at(want);
+                patch = rest;
+                piece
+            } else {
+                let n = usize::min(want - self.pending.len(), patch.len());
+                self.pending.extend_from_slice(&patch[..n]);
+                patch = &patch[n..];
+                if self.pending.len() < want {
+                    return Ok(());
+                }
+                &taken.insert(std::mem::take(&mut self.pending))[..]
+            };
+            self.handle(piece, sink)?;
+            if let Some(mut buf) = taken {
+                buf.clear();
+                self.pending = buf;
+            }
+        }
+    }
+
+    /// Handle one complete piece of the current state.
+    fn handle(
+        &mut self,
+        piece: &[u8],
+        sink: &mut impl FnMut(&[u8]) -> Result<(), XDeltaError>,
+    ) -> Result<(), XDeltaError> {
+        self.state = match self.state {
+            State::StreamHeader => {
+                if piece[..6] != MAGIC {
+                    return Err(corrupt("bad magic"));
+                }
+                if crc32(&piece[6..8]).to_le_bytes() != piece[8..12] {
+                    return Err(corrupt("stream header checksum mismatch"));
+                }
+                if piece[6] != 0 || piece[7] & 0xf0 != 0 {
+                    return Err(XDeltaError::Unsupported("xz stream flags are not supported".into()));
+                }
+                self.check_kind = piece[7];
+                self.check = Check::new(self.check_kind)?;
+                State::BlockStart
+            }
+            State::BlockStart => match piece[0] {
+                0 => {
+                    self.index = index_bytes(&self.blocks);
+                    State::Index
+                }
+                first => State::BlockHeader { first },
+            },
+            State::BlockHeader { first } => {
+                self.block_header(first, piece)?;
+                State::ChunkControl
+            }
+            State::ChunkControl => {
+                let control = piece[0];
+                self.block_len += 1;
+                match control {
+                    0x00 => {
+                        if self.declared.0.is_some_and(|c| c != self.block_len)
+                            || self.declared.1.is_some_and(|u| u != self.block_out)
+                        {
+                            return Err(corrupt("block size does not match its header"));
+                        }
+                        State::BlockPadding
+                    }
+                    0x01 | 0x02 | 0x80..=0xff => {
+                        if control == 0x01 || control >= 0xe0 {
+                            self.history.buf.clear();
+                            self.history.pos = 0;
+                            self.need_dict_reset = false;
+                            if control == 0x01 {
+                                self.need_props = true;
+                            }
+                        } else if self.need_dict_reset {
+                            return Err(corrupt("first chunk does not reset the dictionary"));
+                        }
+                        if control >= 0x80 && control < 0xc0 && self.need_props {
+                            return Err(corrupt("chunk without the properties it needs"));
+                        }
+                        State::ChunkHeader { control }
+                    }
+                    _ => return Err(corrupt("bad chunk control byte")),
+                }
+            }
+            State::ChunkHeader { control } => {
+                self.block_len += piece.len() as u64;
+                if control < 0x80 {
+                    State::Uncompressed {
+                        left: u16::from_be_bytes([piece[0], piece[1]]) as usize + 1,
+                    }
+                } else {
+                    let u = (((control & 0x1f) as usize) << 16 | u16::from_be_bytes([piece[0], piece[1]]) as usize) + 1;
+                    let c = u16::from_be_bytes([piece[2], piece[3]]) as usize + 1;
+                    if control >= 0xc0 {
+                        let props = piece[4];
+                        if props >= 9 * 5 * 5 {
+                            return Err(corrupt("bad LZMA properties"));
+                        }
+                        let (lc, lp, pb) = ((props % 9) as u32, (props / 9 % 5) as u32, (props / 45) as u32);
+                        if lc + lp > 4 {
+                            return Err(corrupt("bad LZMA properties"));
+                        }
+                        self.model = Some(Model::new(lc, lp, pb));
+                        self.need_props = false;
+                    } else if control >= 0xa0 {
+                        let m = self.model.as_ref().unwrap();
+                        self.model = Some(Model::new(m.lc, m.lp, m.pb));
+                    }
+                    State::Compressed { u, c }
+                }
+            }
+            State::Compressed { u, .. } => {
+                self.block_len += piece.len() as u64;
+                let start = self.history.buf.len();
+                decode_chunk(self.model.as_mut().unwrap(), &mut self.history, piece, u)?;
+                self.decoded(start, sink)?;
+                State::ChunkControl
+            }
+            State::Uncompressed { .. } => unreachable!(),
+            State::BlockPadding => {
+                if piece.iter().any(|&b| b != 0) {
+                    return Err(corrupt("nonzero block padding"));
+                }
+                State::Check
+            }
+            State::Check => {
+                if self.check.sum() != piece {
+                    return Err(corrupt("check mismatch"));
+                }
+                let unpadded = self.header_len + self.block_len + piece.len() as u64;
+                self.blocks.push((unpadded, self.block_out));
+                State::BlockStart
+            }
+            State::Index => {
+                if piece != &self.index[1..] {
+                    return Err(corrupt("index does not match the blocks"));
+                }
+                State::Footer
+            }
+            State::Footer => {
+                if crc32(&piece[4..10]).to_le_bytes() != piece[..4] {
+                    return Err(corrupt("stream footer checksum mismatch"));
+                }
+                if piece[..] != stream_footer(self.index.len(), self.check_kind) {
+                    return Err(corrupt("stream footer does not match the stream"));
+                }
+                State::Ended
+            }
+            State::Ended => unreachable!(),
+        };
+        Ok(())
+    }
+
+    /// Parse the block header whose size byte is `first`.
+    fn block_header(&mut self, first: u8, rest: &[u8]) -> Result<(), XDeltaError> {
+        let mut h = Vec::with_capacity(rest.len() + 1);
+        h.push(first);
+        h.extend_from_slice(rest);
+        let body = h.len() - 4;
+        if crc32(&h[..body]).to_le_bytes() != h[body..] {
+            return Err(corrupt("block header checksum mismatch"));
+        }
+        let flags = h[1];
+        if flags & 0x3c != 0 {
+            return Err(XDeltaError::Unsupported("xz block flags are not supported".into()));
+        }
+        let mut at = 2;
+        let h = &h[..body];
+        let compressed = if flags & 0x40 != 0 { Some(get_varint(h, &mut at)?) } else { None };
+        let uncompressed = if flags & 0x80 != 0 { Some(get_varint(h, &mut at)?) } else { None };
+        if compressed == Some(0) {
+            return Err(corrupt("block with an empty compressed size"));
+        }
+        let filters = (flags & 3) + 1;
+        let id = get_varint(h, &mut at)?;
+        let props_len = get_varint(h, &mut at)?;
+        if filters != 1 || id != FILTER_LZMA2 {
+            return Err(XDeltaError::Unsupported("xz filters other than a single LZMA2 are not supported".into()));
+        }
+        if props_len != 1 || at >= h.len() {
+            return Err(corrupt("bad LZMA2 filter properties"));
+        }
+        let dict_size = dict_size_of(h[at]).ok_or_else(|| corrupt("bad LZMA2 dictionary size"))?;
+        at += 1;
+        if h[at..].iter().any(|&b| b != 0) {
+            return Err(corrupt("nonzero block header padding"));
+        }
+        self.history = History {
+            buf: Vec::new(),
+            dict_size,
+            pos: 0,
+        };
+        self.model = None;
+        self.need_dict_reset = true;
+        self.need_props = true;
+        self.declared = (compressed, uncompressed);
+        self.header_len = body as u64 + 4;
+        self.block_len = 0;
+        self.block_out = 0;
+        Ok(())
+    }
+
+    fn stored(&mut self, data: &[u8], sink: &mut impl FnMut(&[u8]) -> Result<(), XDeltaError>) -> Result<(), XDeltaError> {
+        self.block_len += data.len() as u64;
+        let start = self.history.buf.len();
+        self.history.buf.extend_from_slice(data);
+        self.history.pos += data.len() as u64;
+        self.decoded(start, sink)
+    }
+
+    /// Pass the history from `start` on to the sink and the check.
+    fn decoded(
+        &mut self,
+        start: usize,
+        sink: &mut impl FnMut(&[u8]) -> Result<(), XDeltaError>,
+    ) -> Result<(), XDeltaError> {
+        let out = &self.history.buf[start..];
+        self.block_out += out.len() as u64;
+        if self.declared.1.is_some_and(|u| self.block_out > u) {
+            return Err(corrupt("block larger than its header says"));
+        }
+        self.check.update(out);
+        sink(out)?;
+        self.history.trim();
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::fixtures::{mixed, noise, run_tool, sample};
+
+    fn compress(data: &[u8], level: Option<u32>) -> Vec<u8> {
+        let mut enc = LzmaEncoder::new(level);
+        let mut out = Vec::new();
+        enc.write(data, &mut out);
+        enc.finish(&mut out);
+        out
+    }
+
+    /// Decode `stream` fed in pieces of `step` bytes, so pieces are also collected across calls.
+    fn decompress(stream: &[u8], step: usize) -> Result<Vec<u8>, XDeltaError> {
+        let mut dec = LzmaDecoder::new();
+        let mut out = Vec::new();
+        for piece in stream.chunks(step) {
+            dec.feed(piece, &mut |b: &[u8]| {
+                out.extend_from_slice(b);
+                Ok(())
+            })?;
+        }
+        if !dec.ended() {
+            return Err(corrupt("truncated"));
+        }
+        Ok(out)
+    }
+
+    #[test]
+    fn decodes_reference_streams() {
+        let streams: [(&str, &[u8], Vec<u8>); 10] = [
+            ("sample.xz", include_bytes!("testdata/sample.xz"), sample()),
+            ("sample-blocks-sha256.xz", include_bytes!("testdata/sample-blocks-sha256.xz"), sample()),
+            ("sample-none-0.xz", include_bytes!("testdata/sample-none-0.xz"), sample()),
+            ("sample-none-6.xz", include_bytes!("testdata/sample-none-6.xz"), sample()),
+            ("sample-none-9e.xz", include_bytes!("testdata/sample-none-9e.xz"), sample()),
+            ("sample-lc0-lp2-pb0.xz", include_bytes!("testdata/sample-lc0-lp2-pb0.xz"), sample()),
+            ("sample-lc4-pb4.xz", include_bytes!("testdata/sample-lc4-pb4.xz"), sample()),
+            ("long-none.xz", include_bytes!("testdata/long-none.xz"), sample().repeat(16)),
+            ("empty-none.xz", include_bytes!("testdata/empty-none.xz"), Vec::new()),
+            ("mixed.xz", include_bytes!("testdata/mixed.xz"), mixed()),
+        ];
+        for (name, stream, want) in &streams {
+            assert_eq!(&decompress(stream, usize::MAX).unwrap(), want, "{}", name);
+            assert_eq!(&decompress(stream, 333).unwrap(), want, "{} in pieces", name);
+        }
+    }
+
+    #[test]
+    fn round_trip() {
+        for data in [Vec::new(), b"a".to_vec(), sample()[..300].to_vec(), sample(), mixed(), vec![7; 300_000]] {
+            for level in [None, Some(0), Some(3), Some(6), Some(9)] {
+                let stream = compress(&data, level);
+                assert_eq!(decompress(&stream, usize::MAX).unwrap(), data, "{} bytes, level {:?}", data.len(), level);
+            }
+        }
+        let stream = compress(&mixed(), None);
+        assert_eq!(decompress(&stream, 1).unwrap(), mixed());
+    }
+
+    #[test]
+    fn compresses_text() {
+        let data = sample();
+        let stream = compress(&data, None);
+        // the sample is the same 44 KB four times, and text on top of that
+        assert!(stream.len() < data.len() / 20, "{} bytes from {}", stream.len(), data.len());
+        let lz4 = {
+            let mut enc = crate::lz4::Lz4Encoder::new(None);
+            let mut out = Vec::new();
+            enc.write(&data, &mut out);
+            enc.finish(&mut out);
+            out
+        };
+        assert!(stream.len() < lz4.len(), "xz {} bytes, lz4 {}", stream.len(), lz4.len());
+    }
+
+    #[test]
+    fn reference_tool_reads_our_streams() {
+        for data in [sample(), mixed(), Vec::new()] {
+            for level in [Some(0), Some(9)] {
+                let Some(got) = run_tool("xz", &["-dc"], &compress(&data, level)) else {
+                    eprintln!("xz is not installed, skipping");
+                    return;
+                };
+                assert_eq!(got, data, "{} bytes, level {:?}", data.len(), level);
+            }
+        }
+    }
+
+    #[test]
+    fn flush_ends_a_decodable_chunk() {
+        let data = sample();
+        let mut enc = LzmaEncoder::new(None);
+        let mut out = Vec::new();
+        let mut dec = LzmaDecoder::new();
+        let mut got = Vec::new();
+        let (mut fed, mut written) = (0, 0);
+        for piece in data.chunks(50_000) {
+            enc.write(piece, &mut out);
+            written += piece.len();
+            enc.flush(&mut out);
+            dec.feed(&out[fed..], &mut |b: &[u8]| {
+                got.extend_from_slice(b);
+                Ok(())
+            })
+            .unwrap();
+            fed = out.len();
+            // everything written so far, not only the complete chunks
+            assert_eq!(got.len(), written, "decoded after a flush");
+        }
+        assert_eq!(got, data);
+        enc.finish(&mut out);
+        assert_eq!(decompress(&out, usize::MAX).unwrap(), data);
+    }
+
+    #[test]
+    fn incompressible_data_round_trips() {
+        let data = noise(200_000);
+        let stream = compress(&data, None);
+        // uncompressed LZMA2 chunks cost three bytes per 64 KiB
+        assert!(stream.len() < data.len() + 200, "{} bytes from {}", stream.len(), data.len());
+        assert_eq!(decompress(&stream, usize::MAX).unwrap(), data);
+    }
+
+    #[test]
+    fn truncated_and_corrupt_streams() {
+        let stream = compress(&sample(), None);
+        for cut in [0, 5, STREAM_HEADER_LEN, STREAM_HEADER_LEN + 3, stream.len() / 2, stream.len() - 1] {
+            assert!(decompress(&stream[..cut], usize::MAX).is_err(), "cut at {}", cut);
+        }
+        let mut bad = stream.clone();
+        bad[1] ^= 1;
+        assert!(matches!(decompress(&bad, usize::MAX), Err(XDeltaError::Corrupt(_))));
+        // every byte of the block is covered by the CRC32 check or the headers
+        for at in [STREAM_HEADER_LEN + 20, stream.len() / 2, stream.len() - 30] {
+            let mut bad = stream.clone();
+            bad[at] ^= 0x20;
+            assert!(decompress(&bad, usize::MAX).is_err(), "flipped byte {}", at);
+        }
+        let mut trailing = stream.clone();
+        trailing.push(0);
+        assert!(matches!(decompress(&trailing, usize::MAX), Err(XDeltaError::Corrupt(_))));
+    }
+
+    #[test]
+    fn unknown_check_type_is_unsupported() {
+        // check type 0x02 is reserved; the header CRC32 covers the flags
+        let mut stream = compress(b"hello", None);
+        stream[7] = 0x02;
+        let crc = crc32(&stream[6..8]);
+        stream[8..12].copy_from_slice(&crc.to_le_bytes());
+        assert!(matches!(decompress(&stream, usize::MAX), Err(XDeltaError::Unsupported(_))));
+    }
+
+    #[test]
+    fn checks_match_the_specification() {
+        // the CRC64 check value of "123456789" in the xz format specification
+        let mut c = Check::new(CHECK_CRC64).unwrap();
+        c.update(b"123456789");
+        assert_eq!(c.sum(), 0x995dc9bbdf1939fa_u64.to_le_bytes());
+        assert_eq!(crc32(b"123456789"), 0xcbf43926);
+    }
+
+    #[test]
+    fn varints_round_trip() {
+        for v in [0u64, 1, 127, 128, 300, u32::MAX as u64, i64::MAX as u64] {
+            let mut buf = Vec::new();
+            put_varint(&mut buf, v);
+            let mut at = 0;
+            assert_eq!(get_varint(&buf, &mut at).unwrap(), v);
+            assert_eq!(at, buf.len());
+        }
+        // a zero continuation byte is not the shortest form
+        assert!(get_varint(&[0x80, 0x00], &mut 0).is_err());
+    }
+
+    #[test]
+    fn every_cut_and_flipped_byte_is_rejected() {
+        // one block holding text and noise, so both literals and matches are coded
+        let mut data = sample()[..2000].to_vec();
+        data.extend_from_slice(&noise(300));
+        let stream = compress(&data, None);
+        assert_eq!(decompress(&stream, usize::MAX).unwrap(), data);
+        crate::fixtures::check_malformed(&data, &stream, |s| decompress(s, usize::MAX));
+        crate::fixtures::check_malformed(b"", &compress(b"", None), |s| decompress(s, usize::MAX));
+    }
+}
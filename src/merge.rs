@@ -0,0 +1,208 @@
+// src/merge.rs
+//! Composition of a chain of patches into one, the equivalent of `xdelta3 merge`.
+//!
+//! Every patch is walked by the decoder in validation mode and its target is
+//! described as a list of pieces: bytes carried by the patch, a range of its
+//! source, or a run of one byte. The COPYs of a later patch are resolved
+//! against the pieces of the previous target, so in the end only the source
+//! of the first patch is referenced and no intermediate version is built.
+//! The result is written in the native format without secondary compression.
+use crate::decoder::{CopyFrom, Decoder, Event, NoSource};
+use crate::XDeltaError;
+
+/// Largest length of a single native ADD or COPY record.
+const MAX_RECORD: u64 = u32::MAX as u64;
+
+#[derive(Clone, Copy)]
+pub(crate) enum Piece {
+    /// offset into the shared data arena
+    Add(usize),
+    /// offset into the source of the first patch
+    Copy(u64),
+    Run(u8),
+}
+
+impl Piece {
+    /// The same piece starting `off` bytes later.
+    fn advance(self, off: u64) -> Piece {
+        match self {
+            Piece::Add(a) => Piece::Add(a + off as usize),
+            Piece::Copy(c) => Piece::Copy(c + off),
+            Piece::Run(b) => Piece::Run(b),
+        }
+    }
+}
+
+pub(crate) struct Seg {
+    pub(crate) at: u64,
+    pub(crate) len: u64,
+    pub(crate) piece: Piece,
+}
+
+/// The target of one patch as pieces covering `0..len` without gaps.
+#[derive(Default)]
+pub(crate) struct Layout {
+    pub(crate) segs: Vec<Seg>,
+    pub(crate) len: u64,
+}
+
+impl Layout {
+    fn push(&mut self, len: u64, piece: Piece) {
+        if len == 0 {
+            return;
+        }
+        if let Some(last) = self.segs.last_mut() {
+            let joined = match (last.piece, piece) {
+                (Piece::Add(a), Piece::Add(b)) => a as u64 + last.len == b as u64,
+                (Piece::Copy(a), Piece::Copy(b)) => a.checked_add(last.len) == Some(b),
+                (Piece::Run(a), Piece::Run(b)) => a == b,
+                _ => false,
+            };
+            if joined {
+                last.len += len;
+                self.len += len;
+                return;
+            }
+        }
+        self.segs.push(Seg { at: self.len, len, piece });
+        self.len += len;
+    }
+
+    /// The pieces that make up `from..from + len`, which must lie within the layout.
+    fn slice(&self, from: u64, len: u64) -> Vec<(u64, Piece)> {
+        let mut out = Vec::new();
+        let end = from + len;
+        let mut i = self.segs.partition_point(|s| s.at + s.len <= from);
+        let mut pos = from;
+        while pos < end {
+            let s = &self.segs[i];
+            let n = u64::min(s.at + s.len, end) - pos;
+            out.push((n, s.piece.advance(pos - s.at)));
+            pos += n;
+            i += 1;
+        }
+        out
+    }
+
+    /// Append `len` bytes copied from `from` in the layout itself (a VCDIFF
+    /// COPY from the target window). The copy may overlap the bytes it
+    /// produces; a repeated pattern made of literal bytes only is written to
+    /// `data` as one piece rather than one piece per repetition.
+    fn copy_within(&mut self, mut from: u64, mut len: u64, data: &mut Vec<u8>) {
+        let period = self.len - from;
+        if len > period {
+            let pieces = self.slice(from, period);
+            if pieces.iter().all(|(_, p)| !matches!(p, Piece::Copy(_))) {
+                let mut pattern = Vec::with_capacity(period as usize);
+                for (n, p) in pieces {
+                    match p {
+                        Piece::Add(a) => pattern.extend_from_slice(&data[a..a + n as usize]),
+                        Piece::Run(b) => pattern.resize(pattern.len() + n as usize, b),
+                        Piece::Copy(_) => unreachable!(),
+                    }
+                }
+                let at = data.len();
+                data.extend(pattern.iter().cycle().take(len as usize));
+                self.push(len, Piece::Add(at));
+                return;
+            }
+        }
+        while len > 0 {
+            let n = u64::min(len, self.len - from);
+            for (m, p) in self.slice(from, n) {
+                self.push(m, p);
+            }
+            from += n;
+            len -= n;
+        }
+    }
+}
+
+/// Compose `patches`, each applying to the target of the one before it,
+/// into a single native patch from the source of the first to the target of the last.
+pub(crate) fn merge_patches(patches: &[&[u8]]) -> Result<Vec<u8>, XDeltaError> {
+    if patches.is_empty() {
+        return Err(XDeltaError::InvalidArg("no patches to merge".into()));
+    }
+    let mut data = Vec::new();
+    let mut prev: Option<Layout> = None;
+    for (i, patch) in patches.iter().enumerate() {
+        let cur = layout(patch, prev.as_ref(), &mut data).map_err(|e| e.context(&format!("patch {}", i + 1)))?;
+        prev = Some(cur);
+    }
+    Ok(write_native(&prev.unwrap_or_default(), &data))
+}
+
+/// Walk one patch and describe its target; `prev` is the layout of its
+/// source, `None` for the first patch, whose source stays unresolved.
+pub(crate) fn layout(patch: &[u8], prev: Option<&Layout>, data: &mut Vec<u8>) -> Result<Layout, XDeltaError> {
+    let mut dec = Decoder::new(NoSource(prev.map(|p| p.len)));
+    dec.set_validate_only();
+    let mut cur = Layout::default();
+    // target offset of the current VCDIFF window
+    let mut start = 0u64;
+    let mut trace = |e: &Event| -> Result<(), XDeltaError> {
+        match *e {
+            Event::Window { .. } => start = cur.len,
+            Event::AddData(bytes) => {
+                let at = data.len();
+                data.extend_from_slice(bytes);
+                cur.push(bytes.len() as u64, Piece::Add(at));
+            }
+            Event::Run { len, byte, .. } => cur.push(len, Piece::Run(byte)),
+            Event::Copy { len, from, .. } => match (from, prev) {
+                (CopyFrom::Source(off), None) => cur.push(len, Piece::Copy(off)),
+                (CopyFrom::Source(off), Some(p)) => {
+                    // events come before the decoder's own range check
+                    if off.checked_add(len).is_none_or(|end| end > p.len) {
+                        return Err(XDeltaError::SourceMismatch("COPY beyond the output of the previous patch".into()));
+                    }
+                    for (n, piece) in p.slice(off, len) {
+                        cur.push(n, piece);
+                    }
+                }
+                (CopyFrom::Target(off), _) => cur.copy_within(start + off, len, data),
+            },
+            _ => {}
+        }
+        Ok(())
+    };
+    dec.write_traced(patch, &mut std::io::sink(), &mut trace)?;
+    dec.finish(&mut std::io::sink())?;
+    Ok(cur)
+}
+
+fn write_native(target: &Layout, data: &[u8]) -> Vec<u8> {
+    let mut out = Vec::new();
+    let add = |out: &mut Vec<u8>, len: u64| {
+        out.push(0x00);
+        out.extend_from_slice(&(len as u32).to_le_bytes());
+    };
+    for s in &target.segs {
+        let mut done = 0u64;
+        while done < s.len {
+            let n = u64::min(s.len - done, MAX_RECORD);
+            match s.piece.advance(done) {
+                Piece::Add(a) => {
+                    add(&mut out, n);
+                    out.extend_from_slice(&data[a..a + n as usize]);
+                }
+                Piece::Run(b) => {
+                    add(&mut out, n);
+                    out.resize(out.len() + n as usize, b);
+                }
+                Piece::Copy(c) => {
+                    out.push(0x01);
+                    out.extend_from_slice(&c.to_le_bytes());
+                    out.extend_from_slice(&(n as u32).to_le_bytes());
+                }
+            }
+            done += n;
+        }
+    }
+    if out.is_empty() {
+        // an empty target is still one zero-length ADD record
+        add(&mut out, 0);
+    }
+    out
+}
@@ -0,0 +1,122 @@
+// src/mmap.rs
+use std::fs::File;
+
+use crate::logging::{log_at, WARN};
+
+/// Read-only mapping of a whole file, unmapped on drop.
+pub(crate) struct Mmap {
+    ptr: *const u8,
+    len: usize,
+}
+
+// the mapping is read-only and owned by this value
+unsafe impl Send for Mmap {}
+unsafe impl Sync for Mmap {}
+
+impl Mmap {
+    /// Map `file` read-only at its current length. Returns `None` when it
+    /// cannot be mapped (not a regular file, larger than the address space,
+    /// or the system refuses), in which case the caller reads it instead.
+    /// Empty files are not mapped either: systems reject zero-length mappings,
+    /// and files in /proc or /sys report a length of 0 but still have content.
+    pub(crate) fn map(file: &File) -> Option<Mmap> {
+        let meta = file.metadata().ok()?;
+        if !meta.is_file() || meta.len() == 0 {
+            return None;
+        }
+        let len = usize::try_from(meta.len()).ok()?;
+        let Some(ptr) = (unsafe { sys::map(file, len) }) else {
+            log_at!(WARN, "mmap of a {} byte file failed, reading it instead", len);
+            return None;
+        };
+        Some(Mmap { ptr, len })
+    }
+
+    pub(crate) fn as_slice(&self) -> &[u8] {
+        unsafe { std::slice::from_raw_parts(self.ptr, self.len) }
+    }
+
+    /// Whether `file` still has the length it had when it was mapped. A file
+    /// that grew would otherwise be read only up to its old end without notice.
+    pub(crate) fn unchanged(&self, file: &File) -> bool {
+        file.metadata().is_ok_and(|m| m.len() == self.len as u64)
+    }
+}
+
+impl Drop for Mmap {
+    fn drop(&mut self) {
+        unsafe { sys::unmap(self.ptr, self.len) };
+    }
+}
+
+#[cfg(unix)]
+mod sys {
+    use std::fs::File;
+    use std::os::unix::io::AsRawFd;
+
+    pub(super) unsafe fn map(file: &File, len: usize) -> Option<*const u8> {
+        let fd = file.as_raw_fd();
+        let p = unsafe { libc::mmap(std::ptr::null_mut(), len, libc::PROT_READ, libc::MAP_SHARED, fd, 0) };
+        if p == libc::MAP_FAILED {
+            return None;
+        }
+        Some(p as *const u8)
+    }
+
+    pub(super) unsafe fn unmap(ptr: *const u8, len: usize) {
+        unsafe { libc::munmap(ptr as *mut libc::c_void, len) };
+    }
+}
+
+#[cfg(windows)]
+mod sys {
+    use std::ffi::c_void;
+    use std::fs::File;
+    use std::os::windows::io::AsRawHandle;
+
+    const PAGE_READONLY: u32 = 0x02;
+    const FILE_MAP_READ: u32 = 0x04;
+
+    extern "system" {
+        fn CreateFileMappingW(
+            file: *mut c_void,
+            attributes: *mut c_void,
+            protect: u32,
+            max_size_high: u32,
+            max_size_low: u32,
+            name: *const u16,
+        ) -> *mut c_void;
+        fn MapViewOfFile(mapping: *mut c_void, access: u32, offset_high: u32, offset_low: u32, len: usize)
+            -> *mut c_void;
+        fn UnmapViewOfFile(base: *const c_void) -> i32;
+        fn CloseHandle(handle: *mut c_void) -> i32;
+    }
+
+    pub(super) unsafe fn map(file: &File, len: usize) -> Option<*const u8> {
+        let size = len as u64;
+        let mapping = unsafe {
+            CreateFileMappingW(
+                file.as_raw_handle() as *mut c_void,
+                std::ptr::null_mut(),
+                PAGE_READONLY,
+                (size >> 32) as u32,
+                size as u32,
+                std::ptr::null(),
+            )
+        };
+        if mapping.is_null() {
+            return None;
+        }
+        // the view keeps the mapping object alive, so its handle can be closed right away
+        let p = unsafe { MapViewOfFile(mapping, FILE_MAP_READ, 0, 0, len) };
+        unsafe { CloseHandle(mapping) };
+        if p.is_null() {
+            return None;
+        }
+        Some(p as *const u8)
+    }
+
+    pub(super) unsafe fn unmap(ptr: *const u8, _len: usize) {
+        unsafe { UnmapViewOfFile(ptr as *const c_void) };
+    }
+}
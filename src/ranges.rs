@@ -0,0 +1,56 @@
+// src/ranges.rs
+//! The ranges of the old data a patch reads, found without the old data.
+//!
+//! The decoder walks the patch in validation mode and every COPY from the
+//! source is recorded; COPYs from the VCDIFF target window read the output
+//! and are left out. For a bsdiff patch the ranges are where its control
+//! entries add the diff block to the old data. A caller fetching the old data from far away can use
+//! the result to download only what the patch needs, in one batch.
+use crate::bsdiff;
+use crate::decoder::{CopyFrom, Decoder, Event, NoSource};
+use crate::XDeltaError;
+
+/// 旧数据中的一段区间，与 C 侧 xdelta_source_range 布局一致
+#[repr(C)]
+#[derive(Clone, Copy, Default)]
+pub struct SourceRange {
+    pub offset: u64,
+    pub len: u64,
+}
+
+/// The source ranges read by the COPYs of `patch`, sorted by offset, with
+/// ranges overlapping or at most `gap` bytes apart merged into one.
+pub(crate) fn source_ranges(patch: &[u8], gap: u64) -> Result<Vec<SourceRange>, XDeltaError> {
+    let mut ranges = Vec::new();
+    if patch.first() == Some(&bsdiff::MAGIC[0]) {
+        let mut read = |offset, len| ranges.push(SourceRange { offset, len });
+        bsdiff::apply_patch::<NoSource, _>(patch, None, &mut std::io::sink(), None, Some(&mut read))?;
+    } else {
+        let mut dec = Decoder::new(NoSource(None));
+        dec.set_validate_only();
+        let mut trace = |e: &Event| -> Result<(), XDeltaError> {
+            if let Event::Copy { len, from: CopyFrom::Source(offset), .. } = *e {
+                if len > 0 {
+                    ranges.push(SourceRange { offset, len });
+                }
+            }
+            Ok(())
+        };
+        dec.write_traced(patch, &mut std::io::sink(), &mut trace)?;
+        dec.finish(&mut std::io::sink())?;
+    }
+
+    ranges.sort_unstable_by_key(|r| r.offset);
+    let mut merged: Vec<SourceRange> = Vec::with_capacity(ranges.len());
+    for r in ranges {
+        // without the old data the offsets are unchecked and may be anything
+        let end = r.offset.saturating_add(r.len);
+        match merged.last_mut() {
+            Some(last) if r.offset <= (last.offset + last.len).saturating_add(gap) => {
+                last.len = u64::max(last.offset + last.len, end) - last.offset;
+            }
+            _ => merged.push(SourceRange { offset: r.offset, len: end - r.offset }),
+        }
+    }
+    Ok(merged)
+}
@@ -0,0 +1,250 @@
+// src/source.rs
+//! Handles bound to one source, for diffing many targets against the same base
+//! or applying many patches to it.
+//!
+//! A source encoder keeps only the block signatures of the old data, so the
+//! source itself is neither copied nor referenced after the handle is created.
+//! A source decoder needs the bytes for COPY and keeps its own copy, taken
+//! once. Neither is modified after creation and both are shared by every
+//! call, which makes concurrent use of one handle safe.
+use std::os::raw::{c_char, c_int};
+use std::sync::Arc;
+
+use crate::alloc::{free_handle, into_handle};
+use crate::cancel::CancelToken;
+use crate::decoder::{apply_patch_bytes_cancel, apply_patch_exact};
+use crate::encoder::{build_signatures, encode_cancel, threads_from_c, Encoding, Signatures};
+use crate::stats::{Live, SOURCE_DECODERS, SOURCE_ENCODERS};
+use crate::stream::EncoderHandle;
+use crate::{fail, guard_decode, input_slice, max_limit, return_buffer, XDeltaError};
+
+/// 绑定到一份旧数据的编码器句柄，只保存旧数据的块签名，可以在多个线程中同时使用
+pub struct SourceEncoderHandle {
+    sigs: Arc<Signatures>,
+    _live: Live,
+}
+
+/// 对旧数据建立块签名，句柄通过 enc 返回，旧数据只在调用期间被读取；threads 为计算签名的线程数，
+/// 含义与 xdelta_create_patch_data_cancel 相同；cancel 可以为 NULL
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，被取消返回 XDELTA_ERR_CANCELED
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_encoder_new(
+    old_data: *const u8,
+    old_len: usize,
+    block_size: u32,
+    threads: c_int,
+    cancel: *const CancelToken,
+    enc: *mut *mut SourceEncoderHandle,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Signatures, XDeltaError> {
+        if enc.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        build_signatures(old_bytes, block_size as usize, threads_from_c(threads)?, unsafe { cancel.as_ref() })
+    })();
+
+    match r {
+        Ok(sigs) => {
+            let h = SourceEncoderHandle { sigs: Arc::new(sigs), _live: Live::new(&SOURCE_ENCODERS) };
+            unsafe { *enc = into_handle(h) };
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 从 xdelta_encoder_signature 生成的块签名创建编码器句柄，不需要旧数据，签名只在调用期间被读取
+/// 签名损坏时返回 XDELTA_ERR_CORRUPT_PATCH，版本不认识时返回 XDELTA_ERR_UNSUPPORTED
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_encoder_from_signature(
+    sig: *const u8,
+    sig_len: usize,
+    enc: *mut *mut SourceEncoderHandle,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Signatures, XDeltaError> {
+        if enc.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        Signatures::from_bytes(unsafe { input_slice(sig, sig_len) }?)
+    })();
+
+    match r {
+        Ok(sigs) => {
+            let h = SourceEncoderHandle { sigs: Arc::new(sigs), _live: Live::new(&SOURCE_ENCODERS) };
+            unsafe { *enc = into_handle(h) };
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 创建一个共享该句柄块签名的流式编码器，直接接受 xdelta_encoder_write，不能再 add_source；
+/// format、secondary、level 与 xdelta_encoder_new 相同。可以对同一个句柄并发调用，
+/// 流式编码器与本句柄各自释放，先后不限；失败返回 NULL，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_encoder_stream(
+    h: *const SourceEncoderHandle,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    err: *mut *mut c_char,
+) -> *mut EncoderHandle {
+    let r = (|| -> Result<*mut EncoderHandle, XDeltaError> {
+        let h = unsafe { h.as_ref() }.ok_or_else(|| XDeltaError::InvalidArg("null pointer".into()))?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        Ok(EncoderHandle::with_signatures(Arc::clone(&h.sigs), encoding)?)
+    })();
+
+    match r {
+        Ok(enc) => enc,
+        Err(e) => {
+            fail(e, err);
+            std::ptr::null_mut()
+        }
+    }
+}
+
+/// 对新数据编码，结果与以同一份旧数据和块大小调用 xdelta_create_patch_data_cancel 完全相同
+/// format、secondary、level、threads、cancel 与 xdelta_create_patch_data_cancel 相同；可以对同一个句柄并发调用
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_encoder_diff(
+    h: *const SourceEncoderHandle,
+    new_data: *const u8,
+    new_len: usize,
+    patch_data: *mut *mut u8,
+    patch_len: *mut usize,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    threads: c_int,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Vec<u8>, XDeltaError> {
+        if h.is_null() || patch_data.is_null() || patch_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &*h };
+        let new_bytes = unsafe { input_slice(new_data, new_len) }?;
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        encode_cancel(&h.sigs, new_bytes, encoding, threads_from_c(threads)?, unsafe { cancel.as_ref() })
+    })();
+
+    match r {
+        Ok(data) => return_buffer(data, patch_data, patch_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 释放句柄，调用前必须确保没有正在进行的 xdelta_source_encoder_diff
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_encoder_free(h: *mut SourceEncoderHandle) {
+    unsafe { free_handle(h) }
+}
+
+/// 绑定到一份旧数据的解码器句柄，持有旧数据的一份副本，可以在多个线程中同时使用
+pub struct SourceDecoderHandle {
+    old: Vec<u8>,
+    _live: Live,
+}
+
+/// 复制一份旧数据并返回句柄，之后调用方可以修改或释放自己的缓冲区
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL，非 NULL 时返回错误信息，无法分配副本时返回 XDELTA_ERR_OUT_OF_MEMORY
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_decoder_new(
+    old_data: *const u8,
+    old_len: usize,
+    dec: *mut *mut SourceDecoderHandle,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<Vec<u8>, XDeltaError> {
+        if dec.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let old_bytes = unsafe { input_slice(old_data, old_len) }?;
+        let mut old = Vec::new();
+        old.try_reserve_exact(old_bytes.len())
+            .map_err(|_| XDeltaError::OutOfMemory(format!("cannot copy {} bytes of source", old_bytes.len())))?;
+        old.extend_from_slice(old_bytes);
+        Ok(old)
+    })();
+
+    match r {
+        Ok(old) => {
+            unsafe { *dec = into_handle(SourceDecoderHandle { old, _live: Live::new(&SOURCE_DECODERS) }) };
+            0
+        }
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 把补丁应用到句柄持有的旧数据，与 xdelta_apply_patch_data_cancel 相同，max_output、cancel 的含义也相同
+/// 可以对同一个句柄并发调用；成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_decoder_apply(
+    h: *const SourceDecoderHandle,
+    patch_data: *const u8,
+    patch_len: usize,
+    new_data: *mut *mut u8,
+    new_len: *mut usize,
+    max_output: u64,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| -> Result<Vec<u8>, XDeltaError> {
+        if h.is_null() || new_data.is_null() || new_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &*h };
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        apply_patch_bytes_cancel(&h.old, patch_bytes, max_limit(max_output), unsafe { cancel.as_ref() })
+    });
+
+    match r {
+        Ok(data) => return_buffer(data, new_data, new_len, err),
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 预先分配版本，与 xdelta_apply_patch_exact 相同：dst_cap 必须是补丁声明的输出长度，解码时不再分配或复制输出
+/// 可以对同一个句柄并发调用；成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_decoder_apply_exact(
+    h: *const SourceDecoderHandle,
+    patch_data: *const u8,
+    patch_len: usize,
+    dst: *mut u8,
+    dst_cap: usize,
+    cancel: *const CancelToken,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        if h.is_null() || (dst.is_null() && dst_cap > 0) {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &*h };
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        let out: &mut [u8] = if dst_cap == 0 {
+            &mut []
+        } else {
+            unsafe { std::slice::from_raw_parts_mut(dst, dst_cap) }
+        };
+        apply_patch_exact(&h.old, patch_bytes, out, unsafe { cancel.as_ref() })
+    });
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 释放句柄和旧数据的副本，调用前必须确保没有正在进行的 xdelta_source_decoder_apply
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_source_decoder_free(h: *mut SourceDecoderHandle) {
+    unsafe { free_handle(h) }
+}
@@ -0,0 +1,128 @@
+// src/stats.rs
+//! Process-wide resource counters for xdelta_native_stats: heap bytes held by
+//! the library, live handles and bytes processed. Every counter is a relaxed
+//! atomic bumped where the event happens, so reading them costs a few loads.
+//!
+//! Heap bytes are counted by wrapping the system allocator, which sees every
+//! Rust allocation of the library including the buffers handed to the caller.
+//! Memory that C code inside the compression crates takes from malloc itself
+//! and mapped files are not allocations and are not counted.
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::sync::atomic::{AtomicU64, Ordering};
+
+static CURRENT_BYTES: AtomicU64 = AtomicU64::new(0);
+static PEAK_BYTES: AtomicU64 = AtomicU64::new(0);
+pub(crate) static ENCODERS: AtomicU64 = AtomicU64::new(0);
+pub(crate) static DECODERS: AtomicU64 = AtomicU64::new(0);
+pub(crate) static SOURCE_ENCODERS: AtomicU64 = AtomicU64::new(0);
+pub(crate) static SOURCE_DECODERS: AtomicU64 = AtomicU64::new(0);
+static BYTES_ENCODED: AtomicU64 = AtomicU64::new(0);
+static BYTES_DECODED: AtomicU64 = AtomicU64::new(0);
+
+struct Counting;
+
+#[global_allocator]
+static ALLOCATOR: Counting = Counting;
+
+fn grow(bytes: usize) {
+    let now = CURRENT_BYTES.fetch_add(bytes as u64, Ordering::Relaxed) + bytes as u64;
+    PEAK_BYTES.fetch_max(now, Ordering::Relaxed);
+}
+
+fn shrink(bytes: usize) {
+    CURRENT_BYTES.fetch_sub(bytes as u64, Ordering::Relaxed);
+}
+
+unsafe impl GlobalAlloc for Counting {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        let p = unsafe { System.alloc(layout) };
+        if !p.is_null() {
+            grow(layout.size());
+        }
+        p
+    }
+
+    unsafe fn alloc_zeroed(&self, layout: Layout) -> *mut u8 {
+        let p = unsafe { System.alloc_zeroed(layout) };
+        if !p.is_null() {
+            grow(layout.size());
+        }
+        p
+    }
+
+    unsafe fn dealloc(&self, p: *mut u8, layout: Layout) {
+        unsafe { System.dealloc(p, layout) };
+        shrink(layout.size());
+    }
+
+    unsafe fn realloc(&self, p: *mut u8, layout: Layout, size: usize) -> *mut u8 {
+        let q = unsafe { System.realloc(p, layout, size) };
+        if !q.is_null() {
+            if size > layout.size() {
+                grow(size - layout.size());
+            } else {
+                shrink(layout.size() - size);
+            }
+        }
+        q
+    }
+}
+
+/// Counts one live object in a gauge for as long as it is alive; handles keep
+/// one as a field so every way of dropping them is covered.
+pub(crate) struct Live(&'static AtomicU64);
+
+impl Live {
+    pub(crate) fn new(gauge: &'static AtomicU64) -> Live {
+        gauge.fetch_add(1, Ordering::Relaxed);
+        Live(gauge)
+    }
+}
+
+impl Drop for Live {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Record `n` bytes of new data taken in by an encoder.
+pub(crate) fn encoded(n: u64) {
+    BYTES_ENCODED.fetch_add(n, Ordering::Relaxed);
+}
+
+/// Record `n` bytes of output produced by a decoder.
+pub(crate) fn decoded(n: u64) {
+    BYTES_DECODED.fetch_add(n, Ordering::Relaxed);
+}
+
+/// Layout matches xdelta_native_stats_info in xdelta_interface.h.
+#[repr(C)]
+pub struct NativeStats {
+    pub current_bytes: u64,
+    pub peak_bytes: u64,
+    pub encoders: u64,
+    pub decoders: u64,
+    pub source_encoders: u64,
+    pub source_decoders: u64,
+    pub bytes_encoded: u64,
+    pub bytes_decoded: u64,
+}
+
+/// 填写原生库的资源统计，stats 为 NULL 时什么也不做：本库在堆上持有的字节数及其峰值、
+/// 存活的流式编码器、解码器与绑定旧数据的编码器、解码器句柄个数，以及累计编码的新数据和解码输出的字节数
+/// 压缩库的 C 代码自行 malloc 的内存和映射的文件不计入；计数是原子的，可以在任意时刻、任意线程调用，
+/// 与其他线程的调用并发时各项之间不保证是同一时刻的值，但峰值总是不小于同时读到的当前值
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_native_stats(stats: *mut NativeStats) {
+    let Some(stats) = (unsafe { stats.as_mut() }) else {
+        return;
+    };
+    stats.current_bytes = CURRENT_BYTES.load(Ordering::Relaxed);
+    stats.peak_bytes = PEAK_BYTES.load(Ordering::Relaxed).max(stats.current_bytes);
+    stats.encoders = ENCODERS.load(Ordering::Relaxed);
+    stats.decoders = DECODERS.load(Ordering::Relaxed);
+    stats.source_encoders = SOURCE_ENCODERS.load(Ordering::Relaxed);
+    stats.source_decoders = SOURCE_DECODERS.load(Ordering::Relaxed);
+    stats.bytes_encoded = BYTES_ENCODED.load(Ordering::Relaxed);
+    stats.bytes_decoded = BYTES_DECODED.load(Ordering::Relaxed);
+}
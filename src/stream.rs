@@ -0,0 +1,570 @@
+// src/stream.rs
+use std::io::{BufWriter, Write};
+use std::os::raw::{c_char, c_int};
+use std::sync::Arc;
+
+use crate::alloc::{free_handle, into_handle};
+use crate::decoder::{Decoder, Source};
+use crate::dump::dump_patch;
+use crate::encoder::{threads_from_c, Encoder, Encoding, Format, SignatureBuilder, Signatures, PARALLEL_CHUNK};
+use crate::stats::{Live, DECODERS, ENCODERS};
+use crate::{fail, guard_decode, input_slice, max_limit, XDeltaError};
+
+/// How much of a patch dump is collected before it is passed to the write callback.
+const DUMP_BUFFER: usize = 64 * 1024;
+
+enum Stage {
+    /// the old data is still being fed into the signature table
+    Source(SignatureBuilder),
+    /// signatures are sealed, new data is being encoded
+    Target(Encoder),
+    /// finish() has been called
+    Done,
+}
+
+/// 流式编码器句柄：先通过 xdelta_encoder_add_source 送入旧数据，
+/// 再通过 xdelta_encoder_write 分窗口送入新数据
+pub struct EncoderHandle {
+    stage: Stage,
+    encoding: Encoding,
+    /// COPY offset of the first source byte, see xdelta_encoder_set_source_offset
+    source_base: u64,
+    /// encoding threads, see xdelta_encoder_set_threads; `None` encodes sequentially
+    threads: Option<usize>,
+    /// "new" bytes collected until a whole group of pieces can be encoded in parallel
+    pending: Vec<u8>,
+    /// whether new data has been written, after which the thread count is fixed
+    started: bool,
+    out: Vec<u8>,
+    _live: Live,
+}
+
+impl EncoderHandle {
+    /// A handle past the source stage that encodes against `sigs`.
+    pub(crate) fn with_signatures(
+        sigs: Arc<Signatures>,
+        encoding: Encoding,
+    ) -> Result<*mut EncoderHandle, XDeltaError> {
+        Ok(into_handle(EncoderHandle {
+            stage: Stage::Target(Encoder::new(sigs, encoding)?),
+            encoding,
+            source_base: 0,
+            threads: None,
+            pending: Vec::new(),
+            started: false,
+            out: Vec::new(),
+            _live: Live::new(&ENCODERS),
+        }))
+    }
+
+    fn target(&mut self) -> Result<&mut Encoder, XDeltaError> {
+        if let Stage::Source(_) = self.stage {
+            let Stage::Source(builder) = std::mem::replace(&mut self.stage, Stage::Done) else {
+                unreachable!()
+            };
+            self.seal(builder.finish())?;
+        }
+        match &mut self.stage {
+            Stage::Target(enc) => Ok(enc),
+            _ => Err(XDeltaError::InvalidArg("encoder already finished".into())),
+        }
+    }
+
+    /// Feed new data. With several threads it is collected into groups of
+    /// one `PARALLEL_CHUNK` piece per thread, so the pieces are cut at the
+    /// same offsets as in xdelta_create_patch_data_cancel whatever the write sizes.
+    fn write(&mut self, mut data: &[u8]) -> Result<(), XDeltaError> {
+        self.started = true;
+        let Some(threads) = self.threads else {
+            return self.target()?.write(data);
+        };
+        let group = PARALLEL_CHUNK * threads;
+        if !self.pending.is_empty() {
+            let n = usize::min(group - self.pending.len(), data.len());
+            self.pending.extend_from_slice(&data[..n]);
+            data = &data[n..];
+            if self.pending.len() < group {
+                return Ok(());
+            }
+            self.write_pending(threads)?;
+        }
+        let whole = data.len() / group * group;
+        if whole > 0 {
+            self.target()?.write_parallel(&data[..whole], threads, None)?;
+        }
+        self.pending.extend_from_slice(&data[whole..]);
+        Ok(())
+    }
+
+    /// Encode the collected new data, which may be a short group before
+    /// flush or finish.
+    fn write_pending(&mut self, threads: usize) -> Result<(), XDeltaError> {
+        let pending = std::mem::take(&mut self.pending);
+        let r = self.target()?.write_parallel(&pending, threads, None);
+        self.pending = pending;
+        self.pending.clear();
+        r
+    }
+
+    /// The encoder with everything written so far passed to it.
+    fn drained(&mut self) -> Result<&mut Encoder, XDeltaError> {
+        if let Some(threads) = self.threads {
+            if !self.pending.is_empty() {
+                self.write_pending(threads)?;
+            }
+        }
+        self.target()
+    }
+
+    /// Move on to the target stage, encoding against `sigs`.
+    fn seal(&mut self, sigs: Signatures) -> Result<(), XDeltaError> {
+        let mut enc = Encoder::new(Arc::new(sigs), self.encoding)?;
+        enc.set_source_base(self.source_base)?;
+        self.stage = Stage::Target(enc);
+        Ok(())
+    }
+}
+
+fn out_result(h: &mut EncoderHandle, out: *mut *const u8, out_len: *mut usize) {
+    unsafe {
+        *out = h.out.as_ptr();
+        *out_len = h.out.len();
+    }
+}
+
+/// 创建流式编码器，format 为 XDELTA_FORMAT_* 之一，secondary 为 XDELTA_SECONDARY_* 之一，
+/// level 为压缩级别（-1 为默认，0..9）；失败返回 NULL，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_new(
+    block_size: u32,
+    format: c_int,
+    secondary: c_int,
+    level: c_int,
+    err: *mut *mut c_char,
+) -> *mut EncoderHandle {
+    let r = (|| -> Result<(SignatureBuilder, Encoding), XDeltaError> {
+        let encoding = Encoding::from_c(format, secondary, level)?;
+        if encoding.format == Format::Bsdiff {
+            return Err(XDeltaError::InvalidArg("bsdiff patches can only be created from in-memory data".into()));
+        }
+        Ok((SignatureBuilder::new(block_size as usize)?, encoding))
+    })();
+    match r {
+        Ok((builder, encoding)) => into_handle(EncoderHandle {
+            stage: Stage::Source(builder),
+            encoding,
+            source_base: 0,
+            threads: None,
+            pending: Vec::new(),
+            started: false,
+            out: Vec::new(),
+            _live: Live::new(&ENCODERS),
+        }),
+        Err(e) => {
+            fail(e, err);
+            std::ptr::null_mut()
+        }
+    }
+}
+
+/// 送入一段旧数据，必须在第一次 xdelta_encoder_write 之前完成
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_add_source(
+    h: *mut EncoderHandle,
+    data: *const u8,
+    len: usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() || (data.is_null() && len > 0) {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        let Stage::Source(builder) = &mut h.stage else {
+            return Err(XDeltaError::InvalidArg("source already sealed".into()));
+        };
+        if len > 0 {
+            let data = unsafe { std::slice::from_raw_parts(data, len) };
+            match h.threads {
+                Some(threads) => builder.write_parallel(data, threads),
+                None => builder.write(data),
+            }
+        }
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 结束送入旧数据，out/out_len 返回旧数据的块签名（每块的弱校验和与 SHA-256，带格式版本），
+/// 对端可以用 xdelta_encoder_load_signature 在没有旧数据的情况下编码；之后仍可以 xdelta_encoder_write
+/// 返回的指针归编码器所有，在下一次调用该编码器之前有效
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_signature(
+    h: *mut EncoderHandle,
+    out: *mut *const u8,
+    out_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() || out.is_null() || out_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        let Stage::Source(_) = h.stage else {
+            return Err(XDeltaError::InvalidArg("source already sealed".into()));
+        };
+        let Stage::Source(builder) = std::mem::replace(&mut h.stage, Stage::Done) else {
+            unreachable!()
+        };
+        let sigs = builder.finish();
+        h.out = sigs.to_bytes();
+        h.seal(sigs)?;
+        out_result(h, out, out_len);
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 用 xdelta_encoder_signature 生成的块签名代替旧数据，必须在送入任何旧数据或新数据之前调用；
+/// 块大小取自签名，xdelta_encoder_new 的 block_size 被忽略。签名损坏时返回 XDELTA_ERR_CORRUPT_PATCH，
+/// 版本不认识时返回 XDELTA_ERR_UNSUPPORTED
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_load_signature(
+    h: *mut EncoderHandle,
+    sig: *const u8,
+    sig_len: usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let sig = unsafe { input_slice(sig, sig_len) }?;
+        let h = unsafe { &mut *h };
+        let Stage::Source(builder) = &h.stage else {
+            return Err(XDeltaError::InvalidArg("source already sealed".into()));
+        };
+        if !builder.is_empty() {
+            return Err(XDeltaError::InvalidArg("source data already added".into()));
+        }
+        let sigs = Signatures::from_bytes(sig)?;
+        h.seal(sigs)?;
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 声明送入的旧数据从完整旧数据的 offset 处开始：补丁中的 COPY 偏移都加上 offset，
+/// 用于只对旧数据的一段编码，补丁仍然应用到完整的旧数据；必须在第一次 xdelta_encoder_write 之前调用
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_set_source_offset(h: *mut EncoderHandle, offset: u64, err: *mut *mut c_char) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        match &mut h.stage {
+            Stage::Source(_) => {}
+            Stage::Target(enc) => enc.set_source_base(offset)?,
+            Stage::Done => return Err(XDeltaError::InvalidArg("encoder already finished".into())),
+        }
+        h.source_base = offset;
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 设置编码线程数，0 使用全部核心，1 为单线程编码（默认）；必须在第一次 xdelta_encoder_write 之前调用
+/// 不为 1 时之后送入的旧数据并行计算块签名，新数据在编码器中攒满每个线程 8 MiB 后按分段并行匹配，
+/// 与 xdelta_create_patch_data_cancel 使用相同线程设置时的补丁完全一致（与每次 write 的长度无关，flush 除外）
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_set_threads(h: *mut EncoderHandle, threads: c_int, err: *mut *mut c_char) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        if h.started || matches!(h.stage, Stage::Done) {
+            return Err(XDeltaError::InvalidArg("thread count set after the first write".into()));
+        }
+        h.threads = threads_from_c(threads)?;
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 送入一段新数据，out/out_len 返回本次产生的补丁字节
+/// 返回的指针归编码器所有，在下一次调用该编码器之前有效
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_write(
+    h: *mut EncoderHandle,
+    data: *const u8,
+    len: usize,
+    out: *mut *const u8,
+    out_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() || (data.is_null() && len > 0) || out.is_null() || out_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        if len > 0 {
+            h.write(unsafe { std::slice::from_raw_parts(data, len) })?;
+        }
+        let enc = h.target()?;
+        h.out = std::mem::take(enc.output());
+        out_result(h, out, out_len);
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 强制在当前位置结束一个窗口：已送入的新数据全部编码输出，之后仍可继续 write
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_flush(
+    h: *mut EncoderHandle,
+    out: *mut *const u8,
+    out_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() || out.is_null() || out_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        let enc = h.drained()?;
+        enc.flush()?;
+        h.out = std::mem::take(enc.output());
+        out_result(h, out, out_len);
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 结束编码，out/out_len 返回剩余的补丁字节，之后只能调用 xdelta_encoder_free
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_finish(
+    h: *mut EncoderHandle,
+    out: *mut *const u8,
+    out_len: *mut usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = (|| -> Result<(), XDeltaError> {
+        if h.is_null() || out.is_null() || out_len.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        let enc = h.drained()?;
+        enc.finish()?;
+        h.out = std::mem::take(enc.output());
+        h.stage = Stage::Done;
+        out_result(h, out, out_len);
+        Ok(())
+    })();
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 释放流式编码器
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_encoder_free(h: *mut EncoderHandle) {
+    unsafe { free_handle(h) }
+}
+
+/// 从旧数据 offset 处读满 len 字节：0 成功，-1 读取失败，-2 超出旧数据范围
+pub type ReadFn = extern "C" fn(ctx: usize, offset: u64, buf: *mut u8, len: usize) -> c_int;
+/// 写出 len 字节解码结果：0 成功，-1 写入失败
+pub type WriteFn = extern "C" fn(ctx: usize, buf: *const u8, len: usize) -> c_int;
+
+/// Source backed by a caller-supplied read callback.
+struct CallbackSource {
+    read: ReadFn,
+    ctx: usize,
+    len: Option<u64>,
+}
+
+impl Source for CallbackSource {
+    fn len(&self) -> Option<u64> {
+        self.len
+    }
+
+    fn read_at(&mut self, offset: u64, buf: &mut [u8]) -> Result<(), XDeltaError> {
+        match (self.read)(self.ctx, offset, buf.as_mut_ptr(), buf.len()) {
+            0 => Ok(()),
+            -2 => Err(XDeltaError::SourceMismatch("COPY out of range".into())),
+            _ => Err(XDeltaError::Io("failed to read old data".into())),
+        }
+    }
+}
+
+/// 以文本形式列出补丁的结构（相当于 xdelta3 printdelta），不需要旧数据，通过 write 回调流式写出
+/// instructions 非 0 时逐条列出 ADD、COPY、RUN 指令，否则只列出文件头、窗口头和合计；输出是确定的
+/// 补丁不合法时，出错位置之前的内容已经写出，返回 XDELTA_ERR_* 错误码；成功时返回0，err 可以为 NULL
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_dump_patch(
+    patch_data: *const u8,
+    patch_len: usize,
+    instructions: c_int,
+    write: Option<WriteFn>,
+    ctx: usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| {
+        let Some(write) = write else {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        };
+        let patch_bytes = unsafe { input_slice(patch_data, patch_len) }?;
+        let mut out = BufWriter::with_capacity(DUMP_BUFFER, CallbackSink { write, ctx });
+        dump_patch(patch_bytes, instructions != 0, &mut out)
+    });
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// Sink backed by a caller-supplied write callback.
+struct CallbackSink {
+    write: WriteFn,
+    ctx: usize,
+}
+
+impl Write for CallbackSink {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        match (self.write)(self.ctx, buf.as_ptr(), buf.len()) {
+            0 => Ok(buf.len()),
+            _ => Err(std::io::Error::other("failed to write output")),
+        }
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+/// 流式解码器句柄：补丁分段写入，旧数据通过回调按需读取，结果通过回调写出
+pub struct DecoderHandle {
+    dec: Decoder<CallbackSource>,
+    sink: CallbackSink,
+    _live: Live,
+}
+
+/// 创建流式解码器，source_len 为旧数据长度，未知时传 -1；max_output 为输出大小上限，0 表示不限制
+/// 失败返回 NULL，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_decoder_new(
+    read: Option<ReadFn>,
+    write: Option<WriteFn>,
+    ctx: usize,
+    source_len: i64,
+    max_output: u64,
+    err: *mut *mut c_char,
+) -> *mut DecoderHandle {
+    let (Some(read), Some(write)) = (read, write) else {
+        fail(XDeltaError::InvalidArg("null pointer".into()), err);
+        return std::ptr::null_mut();
+    };
+    let src = CallbackSource {
+        read,
+        ctx,
+        len: u64::try_from(source_len).ok(),
+    };
+    let mut dec = Decoder::new(src);
+    dec.set_max_output(max_limit(max_output));
+    into_handle(DecoderHandle {
+        dec,
+        sink: CallbackSink { write, ctx },
+        _live: Live::new(&DECODERS),
+    })
+}
+
+/// 送入一段补丁数据，解码出的数据通过回调写出
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_decoder_write(
+    h: *mut DecoderHandle,
+    data: *const u8,
+    len: usize,
+    err: *mut *mut c_char,
+) -> c_int {
+    let r = guard_decode(|| -> Result<(), XDeltaError> {
+        if h.is_null() || (data.is_null() && len > 0) {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        if len > 0 {
+            h.dec.write(unsafe { std::slice::from_raw_parts(data, len) }, &mut h.sink)?;
+        }
+        Ok(())
+    });
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 结束解码，补丁在记录中途截断时返回错误；bsdiff 补丁在这里应用，输出通过 write 回调写出
+/// 成功时返回0，失败返回 XDELTA_ERR_* 错误码，err 非 NULL 时返回错误信息
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_decoder_finish(h: *mut DecoderHandle, err: *mut *mut c_char) -> c_int {
+    let r = guard_decode(|| -> Result<(), XDeltaError> {
+        if h.is_null() {
+            return Err(XDeltaError::InvalidArg("null pointer".into()));
+        }
+        let h = unsafe { &mut *h };
+        h.dec.finish(&mut h.sink)
+    });
+
+    match r {
+        Ok(()) => 0,
+        Err(e) => fail(e, err),
+    }
+}
+
+/// 释放流式解码器
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_decoder_free(h: *mut DecoderHandle) {
+    unsafe { free_handle(h) }
+}
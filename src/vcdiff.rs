@@ -0,0 +1,946 @@
+// src/vcdiff.rs
+//! RFC 3284 (VCDIFF) output and input.
+//!
+//! The writer turns the native record stream into VCDIFF windows that use
+//! the default code table and no secondary compression, so any conforming
+//! decoder (xdelta3 -d, open-vcdiff) can apply them. The reader decodes such
+//! patches in front of the same `Source` abstraction the native decoder uses,
+//! and also accepts what xdelta3 itself writes by default: an application
+//! header and an adler32 checksum per window. Features it cannot handle are
+//! reported as `Unsupported` rather than as corruption.
+use std::io::Write;
+
+use crate::checksum::{adler32, Adler32};
+use crate::decoder::{emit, CopyFrom, Event, PatchInfo, Segment, Source, Trace};
+use crate::XDeltaError;
+
+/// File header: "VCD" with the high bits set, version 0.
+pub(crate) const MAGIC: [u8; 4] = [0xD6, 0xC3, 0xC4, 0x00];
+
+/// Hdr_Indicator bits.
+const VCD_DECOMPRESS: u8 = 0x01;
+const VCD_CODETABLE: u8 = 0x02;
+const VCD_APPHEADER: u8 = 0x04;
+
+/// Win_Indicator bits; VCD_ADLER32 is xdelta3's extension to RFC 3284.
+const VCD_SOURCE: u8 = 0x01;
+const VCD_TARGET: u8 = 0x02;
+const VCD_ADLER32: u8 = 0x04;
+
+/// Largest target window the writer produces. xdelta3 refuses windows above
+/// 16 MiB, 8 MiB is its own default.
+const MAX_WINDOW: u64 = 8 << 20;
+/// Largest source segment the writer produces; sizes are 32-bit in xdelta3 3.0.
+const MAX_SEGMENT: u64 = (1 << 31) - 1;
+/// Largest target window the reader accepts, since a window is reconstructed
+/// in memory before it is written out.
+const MAX_READ_WINDOW: u64 = 1 << 28;
+
+/// Address cache sizes of the default code table.
+const S_NEAR: usize = 4;
+const S_SAME: usize = 3;
+
+/// Opcodes of the default code table used by the writer.
+const ADD_SIZE0: u8 = 1;
+const COPY_SELF_SIZE0: u8 = 19;
+const COPY_HERE_SIZE0: u8 = 35;
+
+fn push_varint(out: &mut Vec<u8>, mut v: u64) {
+    let mut buf = [0u8; 10];
+    let mut i = buf.len() - 1;
+    buf[i] = (v & 0x7f) as u8;
+    v >>= 7;
+    while v > 0 {
+        i -= 1;
+        buf[i] = 0x80 | (v & 0x7f) as u8;
+        v >>= 7;
+    }
+    out.extend_from_slice(&buf[i..]);
+}
+
+fn varint_len(v: u64) -> usize {
+    let mut n = 1;
+    let mut v = v >> 7;
+    while v > 0 {
+        n += 1;
+        v >>= 7;
+    }
+    n
+}
+
+enum Op {
+    /// the next `len` bytes of the window's data section
+    Add { len: u64 },
+    /// `len` bytes of the old data starting at `offset`
+    Copy { offset: u64, len: u64 },
+}
+
+/// Re-encodes native records as VCDIFF. Records are collected into the
+/// current window and the window is written once it is full, on flush and
+/// on finish; every window can be decoded on its own.
+pub(crate) struct VcdiffWriter {
+    header_written: bool,
+    ops: Vec<Op>,
+    data: Vec<u8>,
+    target_len: u64,
+    /// old data range referenced by the COPYs of the current window
+    segment: Option<(u64, u64)>,
+    /// adler32 of the current window, written as xdelta3's VCD_ADLER32
+    adler: Option<Adler32>,
+}
+
+impl VcdiffWriter {
+    pub(crate) fn new(checksum: bool) -> Self {
+        VcdiffWriter {
+            header_written: false,
+            ops: Vec::new(),
+            data: Vec::new(),
+            target_len: 0,
+            segment: None,
+            adler: checksum.then(Adler32::new),
+        }
+    }
+
+    /// Consume complete native records. With checksums `target` holds the
+    /// bytes the records produce, otherwise it is empty.
+    pub(crate) fn write(
+        &mut self,
+        mut records: &[u8],
+        mut target: &[u8],
+        out: &mut Vec<u8>,
+    ) -> Result<(), XDeltaError> {
+        while !records.is_empty() {
+            match records[0] {
+                0x00 => {
+                    let len = u32::from_le_bytes(records[1..5].try_into().unwrap()) as usize;
+                    self.add(&records[5..5 + len], out);
+                    records = &records[5 + len..];
+                    target = &target[len.min(target.len())..];
+                }
+                0x01 => {
+                    let offset = u64::from_le_bytes(records[1..9].try_into().unwrap());
+                    let len = u32::from_le_bytes(records[9..13].try_into().unwrap()) as usize;
+                    let (bytes, rest) = target.split_at(len.min(target.len()));
+                    self.copy(offset, len as u64, bytes, out);
+                    records = &records[13..];
+                    target = rest;
+                }
+                other => return Err(XDeltaError::InvalidArg(format!("unexpected record {:#x}", other))),
+            }
+        }
+        Ok(())
+    }
+
+    /// Close the current window so everything written so far is decodable.
+    pub(crate) fn flush(&mut self, out: &mut Vec<u8>) {
+        self.emit(out);
+    }
+
+    /// Close the last window; an empty target is just the file header.
+    pub(crate) fn finish(&mut self, out: &mut Vec<u8>) {
+        self.emit(out);
+        self.header(out);
+    }
+
+    fn header(&mut self, out: &mut Vec<u8>) {
+        if !self.header_written {
+            out.extend_from_slice(&MAGIC);
+            out.push(0); // Hdr_Indicator: no secondary compressor, default code table
+            self.header_written = true;
+        }
+    }
+
+    fn add(&mut self, mut data: &[u8], out: &mut Vec<u8>) {
+        while !data.is_empty() {
+            let n = usize::min(data.len(), (MAX_WINDOW - self.target_len) as usize);
+            match self.ops.last_mut() {
+                Some(Op::Add { len, .. }) => *len += n as u64,
+                _ => self.ops.push(Op::Add { len: n as u64 }),
+            }
+            self.data.extend_from_slice(&data[..n]);
+            if let Some(a) = &mut self.adler {
+                a.update(&data[..n]);
+            }
+            self.target_len += n as u64;
+            data = &data[n..];
+            if self.target_len == MAX_WINDOW {
+                self.emit(out);
+            }
+        }
+    }
+
+    /// `bytes` is what the COPY produces when checksums are written.
+    fn copy(&mut self, mut offset: u64, mut len: u64, mut bytes: &[u8], out: &mut Vec<u8>) {
+        while len > 0 {
+            let n = u64::min(len, MAX_WINDOW - self.target_len);
+            let (start, end) = match self.segment {
+                Some((s, e)) => (s.min(offset), e.max(offset + n)),
+                None => (offset, offset + n),
+            };
+            if end - start > MAX_SEGMENT {
+                self.emit(out);
+                continue;
+            }
+            self.segment = Some((start, end));
+            match self.ops.last_mut() {
+                // blocks that follow each other in the old data become one COPY
+                Some(Op::Copy { offset: o, len: l }) if *o + *l == offset => *l += n,
+                _ => self.ops.push(Op::Copy { offset, len: n }),
+            }
+            if let Some(a) = &mut self.adler {
+                a.update(&bytes[..n as usize]);
+                bytes = &bytes[n as usize..];
+            }
+            self.target_len += n;
+            offset += n;
+            len -= n;
+            if self.target_len == MAX_WINDOW {
+                self.emit(out);
+            }
+        }
+    }
+
+    fn emit(&mut self, out: &mut Vec<u8>) {
+        if self.target_len == 0 {
+            return;
+        }
+        self.header(out);
+        let (seg_pos, seg_len) = match self.segment {
+            Some((s, e)) => (s, e - s),
+            None => (0, 0),
+        };
+
+        let mut inst = Vec::new();
+        let mut addrs = Vec::new();
+        let mut here = seg_len;
+        for op in &self.ops {
+            match *op {
+                Op::Add { len } => {
+                    if (1..=17).contains(&len) {
+                        inst.push(ADD_SIZE0 + len as u8);
+                    } else {
+                        inst.push(ADD_SIZE0);
+                        push_varint(&mut inst, len);
+                    }
+                    here += len;
+                }
+                Op::Copy { offset, len } => {
+                    let addr = offset - seg_pos;
+                    // VCD_SELF encodes the address, VCD_HERE its distance back from the current position
+                    let base = if varint_len(here - addr) < varint_len(addr) {
+                        push_varint(&mut addrs, here - addr);
+                        COPY_HERE_SIZE0
+                    } else {
+                        push_varint(&mut addrs, addr);
+                        COPY_SELF_SIZE0
+                    };
+                    if (4..=18).contains(&len) {
+                        inst.push(base + len as u8 - 3);
+                    } else {
+                        inst.push(base);
+                        push_varint(&mut inst, len);
+                    }
+                    here += len;
+                }
+            }
+        }
+
+        let data = &self.data;
+        let mut body = Vec::with_capacity(16);
+        push_varint(&mut body, self.target_len);
+        body.push(0); // Delta_Indicator: no section is compressed
+        push_varint(&mut body, data.len() as u64);
+        push_varint(&mut body, inst.len() as u64);
+        push_varint(&mut body, addrs.len() as u64);
+        let mut indicator = 0;
+        if let Some(a) = &mut self.adler {
+            body.extend_from_slice(&std::mem::replace(a, Adler32::new()).value().to_be_bytes());
+            indicator |= VCD_ADLER32;
+        }
+
+        if self.segment.is_some() {
+            out.push(indicator | VCD_SOURCE);
+            push_varint(out, seg_len);
+            push_varint(out, seg_pos);
+        } else {
+            out.push(indicator);
+        }
+        push_varint(out, (body.len() + data.len() + inst.len() + addrs.len()) as u64);
+        out.extend_from_slice(&body);
+        out.extend_from_slice(data);
+        out.extend_from_slice(&inst);
+        out.extend_from_slice(&addrs);
+
+        self.ops.clear();
+        self.data.clear();
+        self.target_len = 0;
+        self.segment = None;
+    }
+}
+
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum Kind {
+    Noop,
+    Add,
+    Run,
+    Copy,
+}
+
+#[derive(Clone, Copy)]
+struct Inst {
+    kind: Kind,
+    size: u8,
+    mode: u8,
+}
+
+const NOOP: Inst = Inst {
+    kind: Kind::Noop,
+    size: 0,
+    mode: 0,
+};
+
+/// The default instruction code table of RFC 3284 section 5.6.
+fn default_code_table() -> Vec<[Inst; 2]> {
+    let inst = |kind, size, mode| Inst { kind, size, mode };
+    let mut t = Vec::with_capacity(256);
+    t.push([inst(Kind::Run, 0, 0), NOOP]);
+    for size in 0..=17 {
+        t.push([inst(Kind::Add, size, 0), NOOP]);
+    }
+    for mode in 0..9 {
+        t.push([inst(Kind::Copy, 0, mode), NOOP]);
+        for size in 4..=18 {
+            t.push([inst(Kind::Copy, size, mode), NOOP]);
+        }
+    }
+    for mode in 0..6 {
+        for add in 1..=4 {
+            for copy in 4..=6 {
+                t.push([inst(Kind::Add, add, 0), inst(Kind::Copy, copy, mode)]);
+            }
+        }
+    }
+    for mode in 6..9 {
+        for add in 1..=4 {
+            t.push([inst(Kind::Add, add, 0), inst(Kind::Copy, 4, mode)]);
+        }
+    }
+    for mode in 0..9 {
+        t.push([inst(Kind::Copy, 4, mode), inst(Kind::Add, 1, 0)]);
+    }
+    t
+}
+
+fn corrupt(msg: &str) -> XDeltaError {
+    XDeltaError::Corrupt(format!("VCDIFF: {}", msg))
+}
+
+fn unsupported(msg: &str) -> XDeltaError {
+    XDeltaError::Unsupported(format!("VCDIFF: {}", msg))
+}
+
+/// Cursor over one section of a window.
+struct Reader<'a> {
+    buf: &'a [u8],
+    pos: usize,
+    what: &'static str,
+}
+
+impl<'a> Reader<'a> {
+    fn new(buf: &'a [u8], what: &'static str) -> Self {
+        Reader { buf, pos: 0, what }
+    }
+
+    fn done(&self) -> bool {
+        self.pos == self.buf.len()
+    }
+
+    fn overrun(&self) -> XDeltaError {
+        XDeltaError::Corrupt(format!("VCDIFF: {} section overrun", self.what))
+    }
+
+    fn byte(&mut self) -> Result<u8, XDeltaError> {
+        let b = *self.buf.get(self.pos).ok_or_else(|| self.overrun())?;
+        self.pos += 1;
+        Ok(b)
+    }
+
+    fn bytes(&mut self, n: u64) -> Result<&'a [u8], XDeltaError> {
+        if n > (self.buf.len() - self.pos) as u64 {
+            return Err(self.overrun());
+        }
+        let s = &self.buf[self.pos..self.pos + n as usize];
+        self.pos += n as usize;
+        Ok(s)
+    }
+
+    fn varint(&mut self) -> Result<u64, XDeltaError> {
+        match read_varint(&self.buf[self.pos..])? {
+            Some((v, n)) => {
+                self.pos += n;
+                Ok(v)
+            }
+            None => Err(self.overrun()),
+        }
+    }
+}
+
+/// Decode an integer from the front of `buf`; `None` if it is incomplete.
+fn read_varint(buf: &[u8]) -> Result<Option<(u64, usize)>, XDeltaError> {
+    let mut v: u64 = 0;
+    for (i, &b) in buf.iter().enumerate() {
+        if v > u64::MAX >> 7 {
+            return Err(corrupt("integer overflow"));
+        }
+        v = (v << 7) | (b & 0x7f) as u64;
+        if b & 0x80 == 0 {
+            return Ok(Some((v, i + 1)));
+        }
+    }
+    Ok(None)
+}
+
+/// The address cache of RFC 3284 section 5.1, reset for every window.
+struct AddressCache {
+    near: [u64; S_NEAR],
+    next: usize,
+    same: [u64; S_SAME * 256],
+}
+
+impl AddressCache {
+    fn new() -> Self {
+        AddressCache {
+            near: [0; S_NEAR],
+            next: 0,
+            same: [0; S_SAME * 256],
+        }
+    }
+
+    fn decode(&mut self, mode: u8, here: u64, addrs: &mut Reader) -> Result<u64, XDeltaError> {
+        let mode = mode as usize;
+        let addr = match mode {
+            0 => addrs.varint()?,
+            1 => here.checked_sub(addrs.varint()?).ok_or_else(|| corrupt("COPY address before window"))?,
+            m if m < 2 + S_NEAR => self.near[m - 2].wrapping_add(addrs.varint()?),
+            m => self.same[(m - 2 - S_NEAR) * 256 + addrs.byte()? as usize],
+        };
+        if addr >= here {
+            return Err(corrupt("COPY address beyond the current position"));
+        }
+        self.near[self.next] = addr;
+        self.next = (self.next + 1) % S_NEAR;
+        self.same[(addr % (S_SAME * 256) as u64) as usize] = addr;
+        Ok(addr)
+    }
+}
+
+/// Parsed file header: its length, the secondary compressor id and the
+/// position of the application header, if any.
+struct FileHeader {
+    len: usize,
+    indicator: u8,
+    secondary: Option<u8>,
+    app_header: Option<std::ops::Range<usize>>,
+}
+
+fn parse_file_header(buf: &[u8]) -> Result<Option<FileHeader>, XDeltaError> {
+    if buf.len() < 5 {
+        return Ok(None);
+    }
+    if buf[..4] != MAGIC {
+        return Err(corrupt("bad magic"));
+    }
+    let indicator = buf[4];
+    if indicator & !(VCD_DECOMPRESS | VCD_CODETABLE | VCD_APPHEADER) != 0 {
+        return Err(corrupt("unknown header indicator"));
+    }
+    if indicator & VCD_CODETABLE != 0 {
+        return Err(unsupported("custom code tables are not supported"));
+    }
+    let mut pos = 5;
+    // xdelta3 only compresses the sections where that pays off, so a
+    // compressor in the header is only an error once a window uses it
+    let mut secondary = None;
+    let mut app_header = None;
+    if indicator & VCD_DECOMPRESS != 0 {
+        let Some(&id) = buf.get(pos) else { return Ok(None) };
+        secondary = Some(id);
+        pos += 1;
+    }
+    if indicator & VCD_APPHEADER != 0 {
+        let Some((len, n)) = read_varint(&buf[pos..])? else { return Ok(None) };
+        pos += n;
+        if ((buf.len() - pos) as u64) < len {
+            return Ok(None);
+        }
+        check_app_header(&buf[pos..pos + len as usize])?;
+        app_header = Some(pos..pos + len as usize);
+        pos += len as usize;
+    }
+    Ok(Some(FileHeader {
+        len: pos,
+        indicator,
+        secondary,
+        app_header,
+    }))
+}
+
+pub(crate) fn secondary_name(id: u8) -> &'static str {
+    match id {
+        1 => "djw",
+        2 => "lzma",
+        16 => "fgk",
+        _ => "unknown",
+    }
+}
+
+/// `indicator` in hex followed by the names of its bits, for the patch dump;
+/// `window` selects Win_Indicator rather than Hdr_Indicator.
+pub(crate) fn indicator_names(indicator: u8, window: bool) -> String {
+    let bits: [(u8, &str); 3] = if window {
+        [(VCD_SOURCE, "VCD_SOURCE"), (VCD_TARGET, "VCD_TARGET"), (VCD_ADLER32, "VCD_ADLER32")]
+    } else {
+        [(VCD_DECOMPRESS, "VCD_DECOMPRESS"), (VCD_CODETABLE, "VCD_CODETABLE"), (VCD_APPHEADER, "VCD_APPHEADER")]
+    };
+    let mut s = format!("{:#04x}", indicator);
+    for (bit, name) in bits {
+        if indicator & bit != 0 {
+            s.push(' ');
+            s.push_str(name);
+        }
+    }
+    s
+}
+
+/// xdelta3 records "target/comp/source/comp" (or "target/comp") in the
+/// application header, where comp names the external compressor (G for
+/// gzip, B for bzip2, ...) it ran the files through before diffing. Such a
+/// patch describes the decompressed files, which this library cannot
+/// reproduce, so it is refused; any other application header is ignored.
+fn check_app_header(hdr: &[u8]) -> Result<(), XDeltaError> {
+    let fields: Vec<&[u8]> = hdr.split(|&b| b == b'/').collect();
+    let comps: &[usize] = match fields.len() {
+        2 => &[1],
+        4 => &[1, 3],
+        _ => return Ok(()),
+    };
+    for &i in comps {
+        if let [c] = fields[i] {
+            if c.is_ascii_uppercase() {
+                return Err(unsupported(&format!(
+                    "external compression ({}) is not supported; create the patch with xdelta3 -D",
+                    *c as char
+                )));
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Parsed window header; `end` is the offset just past the window in the buffer.
+struct WindowHeader {
+    indicator: u8,
+    source: Option<(u64, u64)>,
+    checksum: bool,
+    body: usize,
+    end: usize,
+}
+
+fn parse_window_header(buf: &[u8]) -> Result<Option<WindowHeader>, XDeltaError> {
+    let Some(&indicator) = buf.first() else {
+        return Ok(None);
+    };
+    let mut pos = 1;
+    let next = |pos: &mut usize| -> Result<Option<u64>, XDeltaError> {
+        Ok(read_varint(&buf[*pos..])?.map(|(v, n)| {
+            *pos += n;
+            v
+        }))
+    };
+    if indicator & VCD_TARGET != 0 {
+        return Err(unsupported("VCD_TARGET windows are not supported"));
+    }
+    if indicator & !(VCD_SOURCE | VCD_ADLER32) != 0 {
+        return Err(corrupt("unknown window indicator"));
+    }
+    let source = if indicator & VCD_SOURCE != 0 {
+        let Some(len) = next(&mut pos)? else { return Ok(None) };
+        let Some(at) = next(&mut pos)? else { return Ok(None) };
+        Some((at, len))
+    } else {
+        None
+    };
+    let Some(delta_len) = next(&mut pos)? else { return Ok(None) };
+    let end = (pos as u64)
+        .checked_add(delta_len)
+        .filter(|&e| e <= usize::MAX as u64)
+        .ok_or_else(|| corrupt("window too large"))? as usize;
+    Ok(Some(WindowHeader {
+        indicator,
+        source,
+        checksum: indicator & VCD_ADLER32 != 0,
+        body: pos,
+        end,
+    }))
+}
+
+enum ReadState {
+    /// collecting the file header and any application header
+    Header,
+    Windows,
+}
+
+/// Push-mode VCDIFF decoder. Patch bytes are buffered until a whole window
+/// is available; each window is reconstructed in memory and written out.
+pub(crate) struct VcdiffReader {
+    state: ReadState,
+    pending: Vec<u8>,
+    pos: usize,
+    /// secondary compressor named in the file header
+    secondary: Option<u8>,
+    table: Vec<[Inst; 2]>,
+    target: Vec<u8>,
+    validate_only: bool,
+    info: PatchInfo,
+}
+
+impl VcdiffReader {
+    /// With `validate_only` the windows are checked but never reconstructed,
+    /// so the source is not read and nothing is written to the output.
+    pub(crate) fn new(validate_only: bool) -> Self {
+        VcdiffReader {
+            state: ReadState::Header,
+            pending: Vec::new(),
+            pos: 0,
+            secondary: None,
+            table: default_code_table(),
+            target: Vec::new(),
+            validate_only,
+            info: PatchInfo::default(),
+        }
+    }
+
+    /// Composition of the windows decoded so far; `target_size` is left to the caller.
+    pub(crate) fn info(&self) -> PatchInfo {
+        PatchInfo {
+            format: 1,
+            secondary: self.secondary.unwrap_or(0) as u32,
+            ..self.info
+        }
+    }
+
+    /// Decode the complete windows in `patch`. `reserve` is called with the
+    /// size of every target window before it is reconstructed.
+    pub(crate) fn write<S: Source, W: Write + ?Sized>(
+        &mut self,
+        patch: &[u8],
+        src: &mut S,
+        out: &mut W,
+        mut reserve: impl FnMut(u64) -> Result<(), XDeltaError>,
+        trace: &mut Trace,
+    ) -> Result<(), XDeltaError> {
+        if self.pos == self.pending.len() {
+            // nothing buffered: decode straight from `patch` and keep only the incomplete tail
+            self.pending.clear();
+            self.pos = 0;
+            let used = self.decode(patch, src, out, &mut reserve, trace)?;
+            self.pending.extend_from_slice(&patch[used..]);
+            return Ok(());
+        }
+        if self.pos > 0 && self.pos >= self.pending.len() / 2 {
+            self.pending.drain(..self.pos);
+            self.pos = 0;
+        }
+        self.pending.extend_from_slice(patch);
+        let pending = std::mem::take(&mut self.pending);
+        let r = self.decode(&pending[self.pos..], src, out, &mut reserve, trace);
+        self.pending = pending;
+        self.pos += r?;
+        Ok(())
+    }
+
+    /// Decode everything complete at the start of `buf`, returning how many bytes were used.
+    fn decode<S: Source, W: Write + ?Sized>(
+        &mut self,
+        buf: &[u8],
+        src: &mut S,
+        out: &mut W,
+        reserve: &mut impl FnMut(u64) -> Result<(), XDeltaError>,
+        trace: &mut Trace,
+    ) -> Result<usize, XDeltaError> {
+        let mut pos = 0;
+        loop {
+            let rest = &buf[pos..];
+            match self.state {
+                ReadState::Header => {
+                    let Some(fh) = parse_file_header(rest)? else {
+                        return Ok(pos);
+                    };
+                    emit(
+                        trace,
+                        Event::Header {
+                            indicator: fh.indicator,
+                            secondary: fh.secondary,
+                            app_header: fh.app_header.map(|r| &rest[r]),
+                        },
+                    )?;
+                    pos += fh.len;
+                    self.secondary = fh.secondary;
+                    self.state = ReadState::Windows;
+                }
+                ReadState::Windows => {
+                    let Some(hdr) = parse_window_header(rest)? else {
+                        return Ok(pos);
+                    };
+                    if rest.len() < hdr.end {
+                        return Ok(pos);
+                    }
+                    let window = &rest[hdr.body..hdr.end];
+                    let target = if self.validate_only { None } else { Some(&mut self.target) };
+                    let w = decode_window(&self.table, self.secondary, &hdr, window, src, target, reserve, trace)
+                        .map_err(|e| match e {
+                            XDeltaError::ChecksumMismatch(m) => {
+                                XDeltaError::ChecksumMismatch(format!("{} {}", m, self.info.windows))
+                            }
+                            e => e,
+                        })?;
+                    self.info.merge(&w);
+                    out.write_all(&self.target).map_err(|e| XDeltaError::Io(e.to_string()))?;
+                    self.target.clear();
+                    pos += hdr.end;
+                }
+            }
+        }
+    }
+
+    /// Whether the patch ended on a window boundary.
+    pub(crate) fn finish(&self) -> Result<(), XDeltaError> {
+        match self.state {
+            ReadState::Header => Err(corrupt("truncated header")),
+            ReadState::Windows if self.pos < self.pending.len() => Err(corrupt("truncated window")),
+            ReadState::Windows => Ok(()),
+        }
+    }
+}
+
+/// Sum of the target window lengths, read from the window headers alone:
+/// the data, instruction and address sections are skipped, not decoded.
+pub(crate) fn target_size(patch: &[u8]) -> Result<u64, XDeltaError> {
+    let mut total: u64 = 0;
+    walk_windows(patch, |_, _, target_len| {
+        total = total.checked_add(target_len).ok_or_else(|| corrupt("target size overflows"))?;
+        Ok(())
+    })?;
+    Ok(total)
+}
+
+/// Split `patch` at window boundaries into segments of roughly `segment_size`
+/// target bytes, returning the length of the file header and the segments.
+/// Every window only copies from the source (VCD_TARGET is not supported), so
+/// the file header followed by one segment is a patch producing just that
+/// segment's part of the target.
+pub(crate) fn segments(patch: &[u8], segment_size: u64) -> Result<(usize, Vec<Segment>), XDeltaError> {
+    let mut segs = Vec::new();
+    let mut cur = Segment::default();
+    let header = walk_windows(patch, |at, len, target_len| {
+        if cur.patch_len == 0 {
+            cur.patch_offset = at as u64;
+        }
+        cur.patch_len += len as u64;
+        cur.target_len = cur.target_len.checked_add(target_len).ok_or_else(|| corrupt("target size overflows"))?;
+        if cur.target_len >= segment_size {
+            let next = cur.target_offset.checked_add(cur.target_len).ok_or_else(|| corrupt("target size overflows"))?;
+            segs.push(cur);
+            cur = Segment { target_offset: next, ..Segment::default() };
+        }
+        Ok(())
+    })?;
+    if cur.patch_len > 0 {
+        segs.push(cur);
+    }
+    Ok((header, segs))
+}
+
+/// Call `f` with the offset, length and target length of every window in
+/// order, returning the length of the file header.
+fn walk_windows(
+    patch: &[u8],
+    mut f: impl FnMut(usize, usize, u64) -> Result<(), XDeltaError>,
+) -> Result<usize, XDeltaError> {
+    let Some(fh) = parse_file_header(patch)? else {
+        return Err(corrupt("truncated header"));
+    };
+    let mut pos = fh.len;
+    while pos < patch.len() {
+        let rest = &patch[pos..];
+        let Some(hdr) = parse_window_header(rest)? else {
+            return Err(corrupt("truncated window"));
+        };
+        if rest.len() < hdr.end {
+            return Err(corrupt("truncated window"));
+        }
+        let target_len = Reader::new(&rest[hdr.body..hdr.end], "window header").varint()?;
+        if target_len > MAX_READ_WINDOW {
+            return Err(corrupt("target window too large"));
+        }
+        f(pos, hdr.end, target_len)?;
+        pos += hdr.end;
+    }
+    Ok(fh.len)
+}
+
+fn decode_window<S: Source>(
+    table: &[[Inst; 2]],
+    secondary: Option<u8>,
+    wh: &WindowHeader,
+    window: &[u8],
+    src: &mut S,
+    mut target: Option<&mut Vec<u8>>,
+    reserve: &mut impl FnMut(u64) -> Result<(), XDeltaError>,
+    trace: &mut Trace,
+) -> Result<PatchInfo, XDeltaError> {
+    let (seg_pos, seg_len) = wh.source.unwrap_or((0, 0));
+    let Some(seg_end) = seg_pos.checked_add(seg_len) else {
+        return Err(corrupt("source segment overflows"));
+    };
+    if let Some(src_len) = src.len() {
+        if seg_end > src_len {
+            return Err(XDeltaError::SourceMismatch("VCDIFF source segment out of range".into()));
+        }
+    }
+
+    let mut hdr = Reader::new(window, "window header");
+    let target_len = hdr.varint()?;
+    if hdr.byte()? != 0 {
+        return Err(match secondary {
+            Some(id) => unsupported(&format!(
+                "secondary compression ({}) is not supported; create the patch with xdelta3 -S none",
+                secondary_name(id)
+            )),
+            None => corrupt("compressed sections without a secondary compressor"),
+        });
+    }
+    let data_len = hdr.varint()?;
+    let inst_len = hdr.varint()?;
+    let addr_len = hdr.varint()?;
+    let checksum = if wh.checksum {
+        let b = hdr.bytes(4)?;
+        Some(u32::from_be_bytes([b[0], b[1], b[2], b[3]]))
+    } else {
+        None
+    };
+    let mut data = Reader::new(hdr.bytes(data_len)?, "data");
+    let mut inst = Reader::new(hdr.bytes(inst_len)?, "instruction");
+    let mut addrs = Reader::new(hdr.bytes(addr_len)?, "address");
+    if !hdr.done() {
+        return Err(corrupt("window length mismatch"));
+    }
+    if target_len > MAX_READ_WINDOW {
+        return Err(corrupt("target window too large"));
+    }
+    if seg_len.checked_add(target_len).is_none() {
+        return Err(corrupt("source segment overflows"));
+    }
+    emit(
+        trace,
+        Event::Window {
+            indicator: wh.indicator,
+            source: wh.source,
+            target_len,
+            checksum,
+            sections: [data_len, inst_len, addr_len],
+        },
+    )?;
+    reserve(target_len)?;
+    if let Some(t) = target.as_deref_mut() {
+        t.reserve(target_len as usize);
+    }
+
+    // `target` is None when only validating: the instructions are checked
+    // against the window, but nothing is read from the source or produced
+    let mut produced = 0u64;
+    let mut info = PatchInfo {
+        windows: 1,
+        source_size: if wh.source.is_some() { seg_end } else { 0 },
+        checksum: if wh.checksum { 1 } else { 0 },
+        ..PatchInfo::default()
+    };
+    let mut cache = AddressCache::new();
+    while !inst.done() {
+        let entry = table[inst.byte()? as usize];
+        for i in entry {
+            if i.kind == Kind::Noop {
+                continue;
+            }
+            let size = if i.size == 0 { inst.varint()? } else { i.size as u64 };
+            if size > target_len - produced {
+                return Err(corrupt("instruction exceeds the target window"));
+            }
+            match i.kind {
+                Kind::Noop => {}
+                Kind::Add => {
+                    info.add_bytes += size;
+                    let bytes = data.bytes(size)?;
+                    emit(trace, Event::Add { at: produced, len: size })?;
+                    emit(trace, Event::AddData(bytes))?;
+                    if let Some(t) = target.as_deref_mut() {
+                        t.extend_from_slice(bytes);
+                    }
+                }
+                Kind::Run => {
+                    info.run_bytes += size;
+                    let b = data.byte()?;
+                    emit(trace, Event::Run { at: produced, len: size, byte: b })?;
+                    if let Some(t) = target.as_deref_mut() {
+                        t.resize(t.len() + size as usize, b);
+                    }
+                }
+                Kind::Copy => {
+                    info.copy_bytes += size;
+                    let here = seg_len + produced;
+                    let addr = cache.decode(i.mode, here, &mut addrs)?;
+                    if addr < seg_len && addr.saturating_add(size) > seg_len {
+                        return Err(corrupt("COPY crosses the end of the source segment"));
+                    }
+                    let from = if addr < seg_len {
+                        CopyFrom::Source(seg_pos + addr)
+                    } else {
+                        CopyFrom::Target(addr - seg_len)
+                    };
+                    emit(trace, Event::Copy { at: produced, len: size, from })?;
+                    match target.as_deref_mut() {
+                        None => {}
+                        Some(t) if addr < seg_len => {
+                            let start = t.len();
+                            t.resize(start + size as usize, 0);
+                            src.read_at(seg_pos + addr, &mut t[start..])?;
+                        }
+                        Some(t) => {
+                            // may overlap the bytes it produces, so copy one at a time
+                            let mut from = (addr - seg_len) as usize;
+                            for _ in 0..size {
+                                let b = t[from];
+                                t.push(b);
+                                from += 1;
+                            }
+                        }
+                    }
+                }
+            }
+            produced += size;
+            info.instructions += 1;
+        }
+    }
+    if produced != target_len || !data.done() || !addrs.done() {
+        return Err(corrupt("window length mismatch"));
+    }
+    let Some(target) = target else {
+        // the checksum covers the reconstructed window, which validation does not build
+        return Ok(info);
+    };
+    if checksum.is_some_and(|c| c != adler32(target)) {
+        // the instructions decoded cleanly, so the source is the likelier culprit
+        return Err(XDeltaError::ChecksumMismatch("adler32 of VCDIFF window".into()));
+    }
+    Ok(info)
+}
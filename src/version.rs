@@ -0,0 +1,44 @@
+// src/version.rs
+//! Identification of the library for `xdelta_version`.
+
+/// FFI ABI revision, matches XDELTA_ABI_VERSION in xdelta_interface.h. Bump
+/// it whenever an export is added, a signature or struct layout changes, or
+/// the native record format changes.
+const ABI_VERSION: u32 = 27;
+
+/// Revision of the native record format produced with XDELTA_FORMAT_NATIVE.
+/// Decoders accept every revision up to this one. 2 added the CHECKSUM
+/// record, 3 the optional HEADER and END records (XDELTA_FORMAT_FLAG_END); a
+/// patch without either is the original revision 1 format.
+pub(crate) const FORMAT_VERSION: u32 = 3;
+
+/// Encoding algorithm and patch formats, for humans.
+const ALGORITHM: &str = "rolling-hash block matching, optional FastCDC chunking; native, RFC 3284 VCDIFF (xdelta3 3.x compatible) and bsdiff 4 formats";
+
+/// Layout matches xdelta_version_info in xdelta_interface.h.
+#[repr(C)]
+pub struct VersionInfo {
+    pub abi: u32,
+    pub format: u32,
+    pub crate_version: [u8; 32],
+    pub algorithm: [u8; 128],
+}
+
+/// Copy `s` into `dst` as a NUL-terminated string, truncating if needed.
+fn put_str(dst: &mut [u8], s: &str) {
+    let n = s.len().min(dst.len() - 1);
+    dst[..n].copy_from_slice(&s.as_bytes()[..n]);
+    dst[n..].fill(0);
+}
+
+/// 填写原生库的版本信息：crate 版本、算法说明、本库格式的修订号和 ABI 修订号，info 为 NULL 时什么也不做
+#[unsafe(no_mangle)]
+pub extern "C" fn xdelta_version(info: *mut VersionInfo) {
+    let Some(info) = (unsafe { info.as_mut() }) else {
+        return;
+    };
+    info.abi = ABI_VERSION;
+    info.format = FORMAT_VERSION;
+    put_str(&mut info.crate_version, env!("CARGO_PKG_VERSION"));
+    put_str(&mut info.algorithm, ALGORITHM);
+}
@@ -0,0 +1,150 @@
+// src/window.rs
+//! Encoding against a window of the source that slides along with the target
+//! (xdelta3's -B). Only the signatures of the old blocks around the current
+//! target offset are indexed, so memory is bounded by the window instead of
+//! growing with the source. COPY offsets stay absolute, so the patches are
+//! decoded exactly like any other.
+use std::collections::VecDeque;
+use std::io::Write;
+use std::sync::Arc;
+
+use crate::cancel::{self, CancelToken};
+use crate::decoder::{SliceSource, Source};
+use crate::encoder::{append_patch, drain, Encoder, Encoding, Signatures, CANCEL_WINDOW};
+use crate::logging::{log_at, DEBUG};
+use crate::XDeltaError;
+
+/// The blocks of old data currently indexed for an encoder.
+pub(crate) struct SourceWindow<'a> {
+    old: Box<dyn Source + 'a>,
+    old_len: u64,
+    block_size: u64,
+    /// window length in blocks, at least one
+    blocks: u64,
+    /// blocks `lo..hi` are indexed, `weaks` holds their weak sums in order
+    lo: u64,
+    hi: u64,
+    weaks: VecDeque<u32>,
+    /// "new" bytes fed through the window so far
+    input: u64,
+    /// how much "new" data is encoded between two moves of the window
+    step: usize,
+    buf: Vec<u8>,
+}
+
+impl<'a> SourceWindow<'a> {
+    /// A window of `window` bytes (rounded down to whole blocks, at least one)
+    /// over `old`, which must know its length.
+    pub(crate) fn new(old: Box<dyn Source + 'a>, block_size: usize, window: u64) -> Result<Self, XDeltaError> {
+        if block_size == 0 {
+            return Err(XDeltaError::InvalidArg("block_size must be > 0".into()));
+        }
+        let old_len = old.len().ok_or_else(|| XDeltaError::InvalidArg("source window needs the source length".into()))?;
+        let bs = block_size as u64;
+        let blocks = (window / bs).max(1);
+        // a quarter of the window, so a target offset never leaves the part
+        // of the window it was centred in before the next move
+        let step = (blocks * bs / 4).clamp(bs, CANCEL_WINDOW as u64) as usize;
+        log_at!(DEBUG, "source window: {} blocks of {} bytes over {} bytes of old data", blocks, bs, old_len);
+        Ok(SourceWindow {
+            old,
+            old_len,
+            block_size: bs,
+            blocks,
+            lo: 0,
+            hi: 0,
+            weaks: VecDeque::new(),
+            input: 0,
+            step,
+            buf: Vec::new(),
+        })
+    }
+
+    /// Feed `data` to `enc`, moving the window before every step so that it
+    /// is centred on the target offset being encoded.
+    pub(crate) fn write(
+        &mut self,
+        enc: &mut Encoder,
+        data: &[u8],
+        cancel: Option<&CancelToken>,
+    ) -> Result<(), XDeltaError> {
+        for piece in data.chunks(self.step) {
+            cancel::check(cancel)?;
+            self.slide(enc.signatures_mut(), self.input + piece.len() as u64 / 2, cancel)?;
+            enc.write(piece)?;
+            self.input += piece.len() as u64;
+            cancel::advance(cancel, piece.len());
+        }
+        Ok(())
+    }
+
+    /// Index the blocks around `target` (clamped to the old data) and drop
+    /// the ones the window has left. The target only moves forward, so each
+    /// old block is read and hashed at most once.
+    fn slide(&mut self, sigs: &mut Signatures, target: u64, cancel: Option<&CancelToken>) -> Result<(), XDeltaError> {
+        let total = self.old_len.div_ceil(self.block_size);
+        let hi = ((target / self.block_size).saturating_sub(self.blocks / 2) + self.blocks).min(total);
+        let lo = hi.saturating_sub(self.blocks).max(self.lo);
+        while self.lo < lo {
+            if let Some(weak) = self.weaks.pop_front() {
+                sigs.remove_block(self.lo, weak);
+            }
+            self.lo += 1;
+        }
+        self.hi = self.hi.max(lo);
+        let per_read = (CANCEL_WINDOW as u64 / self.block_size).max(1);
+        while self.hi < hi {
+            cancel::check(cancel)?;
+            let offset = self.hi * self.block_size;
+            let len = ((hi - self.hi).min(per_read) * self.block_size).min(self.old_len - offset);
+            self.buf.resize(len as usize, 0);
+            self.old.read_at(offset, &mut self.buf)?;
+            for block in self.buf.chunks(self.block_size as usize) {
+                self.weaks.push_back(sigs.insert_block(self.hi, block));
+                self.hi += 1;
+            }
+            cancel::advance(cancel, self.buf.len());
+        }
+        Ok(())
+    }
+}
+
+/// Same as `create_patch_bytes_cancel`, matching every part of `new` only
+/// against the `window` bytes of `old` around the same offset.
+pub(crate) fn create_patch_bytes_window(
+    old: &[u8],
+    new: &[u8],
+    block_size: usize,
+    window: u64,
+    encoding: Encoding,
+    cancel: Option<&CancelToken>,
+) -> Result<Vec<u8>, XDeltaError> {
+    let mut patch = Vec::new();
+    create_patch_window_to(old, new, block_size, window, encoding, cancel, &mut patch)?;
+    Ok(patch)
+}
+
+/// Same as `create_patch_bytes_window`, writing the patch to `out` as it is produced.
+pub(crate) fn create_patch_window_to<W: Write>(
+    old: &[u8],
+    new: &[u8],
+    block_size: usize,
+    window: u64,
+    encoding: Encoding,
+    cancel: Option<&CancelToken>,
+    out: &mut W,
+) -> Result<(), XDeltaError> {
+    if append_patch(old, new, block_size, encoding, cancel, out)? {
+        return Ok(());
+    }
+    let mut source = SourceWindow::new(Box::new(SliceSource(old)), block_size, window)?;
+    let mut enc = Encoder::new(Arc::new(Signatures::new(block_size)?), encoding)?;
+    // one step at a time, so the window moves exactly as for the whole input
+    for piece in new.chunks(source.step) {
+        source.write(&mut enc, piece, cancel)?;
+        drain(&mut enc, out)?;
+    }
+    cancel::check(cancel)?;
+    enc.finish()?;
+    drain(&mut enc, out)
+}
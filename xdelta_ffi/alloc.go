@@ -0,0 +1,101 @@
+package xdelta_ffi
+
+// AllocStats 原生层通过 FFI 边界交给本包、尚未释放的内存，见 DebugAllocStats
+type AllocStats struct {
+	// LiveBuffers、LiveBytes 尚未释放的结果缓冲区和错误信息的个数与字节数；本包在每次调用返回前释放它们，
+	// 没有正在进行的操作时应为 0
+	LiveBuffers int64
+	LiveBytes   int64
+	// LiveHandles 尚未释放的原生句柄个数：未 Close 的 Encoder、Decoder、SourceEncoder、SourceDecoder，
+	// 以及正在进行的流式、WithTimeout、WithProgress 操作持有的句柄；不含句柄本身持有的内存（例如 SourceDecoder 的旧数据副本）
+	LiveHandles int64
+	// TotalBuffers、TotalBytes 进程启动以来累计分配的结果缓冲区和错误信息的个数与字节数
+	TotalBuffers int64
+	TotalBytes   int64
+}
+
+// allocStatsC 与 xdelta_interface.h 中的 xdelta_alloc_stats 布局一致
+type allocStatsC struct {
+	liveBuffers  uint64
+	liveBytes    uint64
+	liveHandles  uint64
+	totalBuffers uint64
+	totalBytes   uint64
+}
+
+// DebugAllocStats 返回原生层交给本包、尚未释放的内存的统计（会触发 Init），用于排查长期运行的进程中
+// Go 堆分析看不到的 RSS 增长：空闲时 LiveBuffers 不为 0 说明本包漏了释放，LiveHandles 持续增长通常是调用方没有 Close
+// 原生层在一次调用中自行分配和释放的内存不计入；可以随时并发调用，开销只是几次原子读取
+func DebugAllocStats() (AllocStats, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return AllocStats{}, err
+	}
+	defer release()
+	s := nativeAllocStats()
+	return AllocStats{
+		LiveBuffers:  int64(s.liveBuffers),
+		LiveBytes:    int64(s.liveBytes),
+		LiveHandles:  int64(s.liveHandles),
+		TotalBuffers: int64(s.totalBuffers),
+		TotalBytes:   int64(s.totalBytes),
+	}, nil
+}
+
+// ResourceStats 原生库的资源统计，见 NativeStats
+type ResourceStats struct {
+	// CurrentBytes 原生库当前在堆上持有的字节数，runtime.MemStats 看不到这部分内存；
+	// 压缩库的 C 代码自行 malloc 的内存和映射的文件不计入
+	CurrentBytes int64
+	// PeakBytes 进程启动以来 CurrentBytes 的峰值，总是不小于同一次读到的 CurrentBytes
+	PeakBytes int64
+	// Encoders、Decoders 未 Close 的 Encoder、Decoder 以及正在进行的流式操作持有的原生句柄个数
+	Encoders int64
+	Decoders int64
+	// SourceEncoders、SourceDecoders 未 Close 的 SourceEncoder、SourceDecoder 个数
+	SourceEncoders int64
+	SourceDecoders int64
+	// BytesEncoded、BytesDecoded 进程启动以来原生层累计编码的新数据和解码输出的字节数，只校验不输出的不计入
+	BytesEncoded int64
+	BytesDecoded int64
+	// InFlightOperations、QueuedOperations 当前占用名额正在调用原生层的操作数和排队等待名额的操作数，
+	// 由 Go 侧维护，没有调用 SetMaxConcurrentOperations 时 QueuedOperations 总是 0
+	InFlightOperations int64
+	QueuedOperations   int64
+}
+
+// nativeStatsC 与 xdelta_interface.h 中的 xdelta_native_stats_info 布局一致
+type nativeStatsC struct {
+	currentBytes   uint64
+	peakBytes      uint64
+	encoders       uint64
+	decoders       uint64
+	sourceEncoders uint64
+	sourceDecoders uint64
+	bytesEncoded   uint64
+	bytesDecoded   uint64
+}
+
+// NativeStats 返回原生库的资源统计（会触发 Init），用于监控：计数在原生层用原子变量维护，
+// 读取只是几次原子读取，可以定期采集并随时并发调用；各项之间不保证是同一时刻的值
+func NativeStats() (ResourceStats, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return ResourceStats{}, err
+	}
+	defer release()
+	s := nativeStats()
+	return ResourceStats{
+		CurrentBytes:   int64(s.currentBytes),
+		PeakBytes:      int64(s.peakBytes),
+		Encoders:       int64(s.encoders),
+		Decoders:       int64(s.decoders),
+		SourceEncoders: int64(s.sourceEncoders),
+		SourceDecoders: int64(s.sourceDecoders),
+		BytesEncoded:   int64(s.bytesEncoded),
+		BytesDecoded:   int64(s.bytesDecoded),
+
+		InFlightOperations: opLimit.inFlight.Load(),
+		QueuedOperations:   opLimit.queued.Load(),
+	}, nil
+}
@@ -0,0 +1,187 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestDebugAllocStatsBalanced 交替执行几千次成功和失败的创建、应用、流式和句柄操作（补丁截断、输出超过上限、
+// 内存上限、已取消的 Context、格式不认识、提前 Close 的读取器），之后原生层交给本包的缓冲区全部释放，
+// 句柄个数回到开始时的值；Encoder、Decoder、SourceEncoder、SourceDecoder 未 Close 时计入 LiveHandles
+func TestDebugAllocStatsBalanced(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(16 << 10)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := DebugAllocStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.LiveBuffers != 0 || before.LiveBytes != 0 {
+		t.Fatalf("buffers still live before the test: %+v", before)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ops := []struct {
+		name string
+		run  func() error
+	}{
+		{"CreateDiffs", func() error {
+			_, err := CreateDiffs(oldData, newData, WithProgress(func(done, total int64) {}))
+			return err
+		}},
+		{"CreateDiffs zstd", func() error {
+			_, err := CreateDiffs(oldData, newData, WithSecondaryCompression(SecondaryZstd), WithTimeout(time.Minute))
+			return err
+		}},
+		{"CreateDiffs memory limit", func() error {
+			_, err := CreateDiffs(oldData, newData, WithMaxMemory(1))
+			return wantError(err, ErrMemoryLimit, "")
+		}},
+		{"CreateDiffs canceled", func() error {
+			_, err := CreateDiffsContext(canceled, oldData, newData)
+			return wantError(err, context.Canceled, "")
+		}},
+		{"ApplyDiffsData", func() error {
+			got, err := ApplyDiffsData(oldData, patch)
+			if err == nil && !bytes.Equal(got, newData) {
+				err = errors.New("output differs")
+			}
+			return err
+		}},
+		{"ApplyDiffsData truncated", func() error {
+			_, err := ApplyDiffsData(oldData, patch[:len(patch)/2])
+			return wantError(err, ErrCorruptPatch, "")
+		}},
+		{"ApplyDiffsData over the limit", func() error {
+			_, err := ApplyDiffsData(oldData, patch, WithMaxOutputSize(100))
+			return wantError(err, ErrOutputTooLarge, "")
+		}},
+		{"ApplyDiffsData unknown format", func() error {
+			if _, err := ApplyDiffsData(oldData, []byte("not a patch at all, just some text")); err == nil {
+				return errors.New("no error")
+			}
+			return nil
+		}},
+		{"ApplyDiffsStream", func() error {
+			return ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), io.Discard)
+		}},
+		{"ApplyDiffsStream truncated", func() error {
+			err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch[:len(patch)-3]), io.Discard)
+			return wantError(err, ErrCorruptPatch, "")
+		}},
+		{"ApplyDiffsStream over the limit", func() error {
+			err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), io.Discard, WithMaxOutputSize(100))
+			return wantError(err, ErrOutputTooLarge, "")
+		}},
+		{"Encoder", func() error {
+			var b bytes.Buffer
+			enc, err := NewEncoder(bytes.NewReader(oldData), &b)
+			if err != nil {
+				return err
+			}
+			if _, err := enc.Write(newData); err != nil {
+				enc.Close()
+				return err
+			}
+			return enc.Close()
+		}},
+		{"Decoder truncated", func() error {
+			dec, err := NewDecoder(bytes.NewReader(oldData), io.Discard)
+			if err != nil {
+				return err
+			}
+			dec.Write(patch[:len(patch)/2])
+			return wantError(dec.Close(), ErrCorruptPatch, "")
+		}},
+		{"ApplyReader closed early", func() error {
+			r, err := NewApplyReader(bytes.NewReader(oldData), patch)
+			if err != nil {
+				return err
+			}
+			if _, err := r.Read(make([]byte, 10)); err != nil {
+				r.Close()
+				return err
+			}
+			return r.Close()
+		}},
+		{"SourceEncoder and SourceDecoder", func() error {
+			se, err := NewSourceEncoder(oldData)
+			if err != nil {
+				return err
+			}
+			defer se.Close()
+			sd, err := NewSourceDecoder(oldData)
+			if err != nil {
+				return err
+			}
+			defer sd.Close()
+			p, err := se.Diff(newData)
+			if err != nil {
+				return err
+			}
+			if _, err := sd.Apply(p[:len(p)-1]); !errors.Is(err, ErrCorruptPatch) {
+				return fmt.Errorf("truncated patch: got %v, want ErrCorruptPatch", err)
+			}
+			_, err = sd.Apply(p)
+			return err
+		}},
+	}
+
+	n := 3000
+	if testing.Short() {
+		n = 300
+	}
+	for i := range n {
+		op := ops[i%len(ops)]
+		if err := op.run(); err != nil {
+			t.Fatalf("operation %d, %s: %v", i, op.name, err)
+		}
+	}
+	after, err := DebugAllocStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.LiveBuffers != 0 || after.LiveBytes != 0 || after.LiveHandles != before.LiveHandles {
+		t.Fatalf("after %d operations: %+v, started with %+v", n, after, before)
+	}
+	// 错误信息也经过计数的缓冲区，计数确实在增长
+	if after.TotalBuffers <= before.TotalBuffers+int64(n)/2 || after.TotalBytes <= before.TotalBytes {
+		t.Fatalf("%d buffers counted for %d operations", after.TotalBuffers-before.TotalBuffers, n)
+	}
+
+	// 未 Close 的句柄计入 LiveHandles，Close 之后回到原值
+	enc, err := NewEncoder(bytes.NewReader(oldData), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewDecoder(bytes.NewReader(oldData), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se, err := NewSourceEncoder(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := NewSourceDecoder(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := DebugAllocStats(); s.LiveHandles < before.LiveHandles+4 {
+		t.Fatalf("%d live handles with four open, %d before", s.LiveHandles, before.LiveHandles)
+	}
+	for _, c := range []io.Closer{enc, dec, se, sd} {
+		c.Close()
+	}
+	if s, _ := DebugAllocStats(); s.LiveHandles != before.LiveHandles || s.LiveBuffers != 0 {
+		t.Fatalf("after Close: %+v, started with %+v", s, before)
+	}
+}
@@ -0,0 +1,15 @@
+package xdelta_ffi
+
+// formatFlagAppend 与 xdelta_interface.h 中的 XDELTA_FORMAT_FLAG_APPEND 一致
+const formatFlagAppend = 0x800
+
+// WithAppendDetection 控制只追加的快速路径（默认开启）：新数据以完整的旧数据开头时（日志、日志型数据库文件等只在末尾增长的文件），
+// 不建签名表也不查找匹配，补丁直接由复制整个旧数据的 COPY 和追加部分的 ADD 组成，编码只需比较一遍旧数据；
+// 追加的部分不再与旧数据匹配，它大量重复旧数据中的内容时补丁会比正常编码大，这时使用 WithAppendDetection(false)
+// 补丁格式不变，所有应用接口（包括旧版本的解码器）都能直接应用；新数据不以旧数据开头（或旧数据为空）时照常编码，结果不受影响
+// 对 CreateDiffs、CreateDiffsFile（不分段时）以及基于它们的接口有效，流式接口、SourceEncoder 和基于签名的接口忽略这一选项
+func WithAppendDetection(on bool) Option {
+	return func(o *options) {
+		o.noAppend = !on
+	}
+}
@@ -0,0 +1,158 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"io"
+)
+
+// applyReader NewApplyReader 返回的 io.ReadCloser
+type applyReader struct {
+	dec    *nativeDecoder
+	patch  []byte    // 还没有送入原生层的补丁
+	src    io.Reader // NewPatchReader 的补丁流，读完后为 nil
+	chunk  []byte    // 从 src 读取一个窗口的缓冲区
+	window int
+	buf    bytes.Buffer // 已解码、还没有被读走的输出
+	target *targetWriter
+	err    error
+	done   bool
+	closed bool
+}
+
+// NewApplyReader 返回一个按需解码的 io.ReadCloser，读出的内容就是补丁应用到 old 的结果，适合把结果直接上传、计算哈希或重新压缩，
+// 而不必先在内存中保存完整的输出；每次缓存为空时才把下一个窗口（WithWindowSize）的补丁送入原生解码器，
+// 同一时间只缓存一个补丁窗口解码出的输出。old 需要支持随机读取，调用期间不能修改 patch
+// 补丁损坏或 old 读取失败时，已经解码的输出读完之后 Read 返回这个错误（之后每次 Read 和 Close 都返回它），而不是 io.EOF，
+// 读到 io.EOF 就说明输出完整；WithMaxOutputSize 有效；也接受信封，WithVerifyOutput 时校验结果同样在最后由 Read 返回
+// 用完后必须调用 Close 释放原生资源，没有读完时也一样；bsdiff 补丁要等整个补丁送入之后才解码，全部输出一次缓存下来，
+// old 的长度未知时（见 ApplyDiffsStream）返回 ErrUnsupportedPatch
+func NewApplyReader(old io.ReaderAt, patch []byte, opts ...Option) (io.ReadCloser, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	h, patch, err := o.openEnvelopeAt(patch, sourceSize(old))
+	if err != nil {
+		return nil, err
+	}
+	r := &applyReader{patch: patch, window: o.windowSize}
+	r.target = &targetWriter{w: &r.buf}
+	if h != nil {
+		if err := o.verifySourceAt(h, old); err != nil {
+			return nil, err
+		}
+		r.target.verify(h)
+	}
+	if r.dec, err = newNativeDecoder(old, r.target, o.outputLimit()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewPatchReader 与 NewApplyReader 相同，但补丁也是流，例如网络连接或对象存储的响应体：
+// 每次缓存为空时才从 patch 读取下一个窗口（WithWindowSize）送入原生解码器，补丁和输出都不会整个保存在内存中
+// 在返回之前先从 patch 读取开头可能是信封头的部分；patch 读取失败时 Read 在已解码的输出之后返回这个错误
+// 用完后必须调用 Close 释放原生资源；bsdiff 补丁与 NewApplyReader 一样读完整个补丁后才有输出。推送式的解码见 NewDecoder，
+// 流式创建补丁见 NewEncoder 和 NewDiffWriter
+func NewPatchReader(old io.ReaderAt, patch io.Reader, opts ...Option) (io.ReadCloser, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	h, _, patch, err := o.readEnvelope(patch, sourceSize(old))
+	if err != nil {
+		return nil, err
+	}
+	if err := o.verifySourceAt(h, old); err != nil {
+		return nil, err
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	r := &applyReader{src: patch, window: o.windowSize}
+	r.target = &targetWriter{w: &r.buf}
+	if h != nil {
+		r.target.verify(h)
+	}
+	if r.dec, err = newNativeDecoder(old, r.target, o.outputLimit()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *applyReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrClosed
+	}
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.step()
+	}
+	return r.buf.Read(p)
+}
+
+// step 把下一个窗口的补丁送入解码器，补丁已经全部送入时结束解码并检查信封
+func (r *applyReader) step() error {
+	p, err := r.next()
+	if err != nil {
+		return err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if len(p) == 0 {
+		r.done = true
+		if err := r.dec.finish(); err != nil {
+			return err
+		}
+		return r.target.check()
+	}
+	return r.dec.write(p)
+}
+
+// next 返回下一个窗口的补丁，补丁已经全部送入时返回空；从补丁流读取时在占用并发名额之前进行
+func (r *applyReader) next() ([]byte, error) {
+	if r.src != nil {
+		if r.chunk == nil {
+			r.chunk = make([]byte, r.window)
+		}
+		n, err := io.ReadFull(r.src, r.chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.src, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r.chunk[:n], nil
+	}
+	n := min(r.window, len(r.patch))
+	p := r.patch[:n]
+	r.patch = r.patch[n:]
+	return p, nil
+}
+
+// Close 释放原生资源，返回解码中出现过的错误；重复调用是安全的
+func (r *applyReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.dec.close()
+	}
+	return r.err
+}
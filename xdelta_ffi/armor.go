@@ -0,0 +1,127 @@
+package xdelta_ffi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	armorBegin = "-----BEGIN XDELTA PATCH-----"
+	armorEnd   = "-----END XDELTA PATCH-----"
+	// armorLineLen 正文每行的 base64 字符数
+	armorLineLen = 64
+)
+
+// EncodeArmored 把补丁写成 PEM 风格的文本，便于嵌入 JSON、YAML 等文本配置：
+//
+//	-----BEGIN XDELTA PATCH-----
+//	<补丁的 base64，每行 64 个字符>
+//	=<补丁的 CRC-24（与 OpenPGP ASCII armor 相同），base64 编码的 4 个字符>
+//	-----END XDELTA PATCH-----
+//
+// 每行以 "\n" 结尾；patch 可以为空，也可以是信封等任意数据，不做检查
+func EncodeArmored(patch []byte, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(armorBegin + "\n")
+	body := base64.StdEncoding.EncodeToString(patch)
+	for len(body) > 0 {
+		n := min(armorLineLen, len(body))
+		bw.WriteString(body[:n])
+		bw.WriteByte('\n')
+		body = body[n:]
+	}
+	bw.WriteString("=" + armorCRCString(crc24(patch)) + "\n")
+	bw.WriteString(armorEnd + "\n")
+	return bw.Flush()
+}
+
+// DecodeArmored 读取 EncodeArmored 生成的文本并返回其中的补丁，第一个非空行必须是 BEGIN 行
+// 容忍首尾任意的空白、每行前后的空白（例如 YAML 的缩进）和 "\r\n" 换行；END 行之后只能有空白
+// 缺少 END 行或校验和行（截断）、base64 不合法、CRC-24 与内容不符时返回包装了 ErrCorruptPatch 的错误，
+// 复制粘贴或编码转换中丢失、改动的字符因此不会被当作正确的补丁
+func DecodeArmored(r io.Reader) ([]byte, error) {
+	text, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(text), "\n")
+	i := 0
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	if i == len(lines) || strings.TrimSpace(lines[i]) != armorBegin {
+		return nil, armorCorrupt("missing %s line", armorBegin)
+	}
+	var body strings.Builder
+	var sum string
+	for i++; ; i++ {
+		if i == len(lines) {
+			return nil, armorCorrupt("truncated: no %s line", armorEnd)
+		}
+		line := strings.TrimSpace(lines[i])
+		if line == armorEnd {
+			break
+		}
+		switch {
+		case sum != "":
+			return nil, armorCorrupt("unexpected line %d after the checksum", i+1)
+		case strings.HasPrefix(line, "="):
+			sum = line[1:]
+		default:
+			body.WriteString(line)
+		}
+	}
+	for _, rest := range lines[i+1:] {
+		if strings.TrimSpace(rest) != "" {
+			return nil, armorCorrupt("unexpected data after the %s line", armorEnd)
+		}
+	}
+	if sum == "" {
+		return nil, armorCorrupt("truncated: no checksum line")
+	}
+	patch, err := base64.StdEncoding.DecodeString(body.String())
+	if err != nil {
+		return nil, armorCorrupt("bad base64 body: %v", err)
+	}
+	if want := armorCRCString(crc24(patch)); sum != want {
+		return nil, armorCorrupt("CRC-24 is %s, the armor says %s", want, sum)
+	}
+	return patch, nil
+}
+
+func armorCorrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: armor: %s", ErrCorruptPatch, fmt.Sprintf(format, args...))
+}
+
+// armorCRCString 返回 CRC-24 的 3 个字节的 base64
+func armorCRCString(crc uint32) string {
+	return base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)})
+}
+
+// crc24 RFC 4880 第 6.1 节的 CRC-24
+func crc24(data []byte) uint32 {
+	const (
+		crc24Init = 0xB704CE
+		crc24Poly = 0x1864CFB
+	)
+	crc := uint32(crc24Init)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for range 8 {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc & 0xFFFFFF
+}
+
+// isArmored 报告 data 去掉开头的空白后是否以 BEGIN 行开头
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armorBegin))
+}
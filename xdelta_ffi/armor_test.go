@@ -0,0 +1,104 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestArmorRoundTrip EncodeArmored 的输出每行不超过 64 个字符，DecodeArmored 读回原来的数据；
+// 带缩进、"\r\n" 换行和首尾空白的文本同样可以读回，ReadPatch 直接接受装甲文本
+func TestArmorRoundTrip(t *testing.T) {
+	// RFC 4880 的 CRC-24 对 "123456789" 的校验值
+	if got := crc24([]byte("123456789")); got != 0x21CF02 {
+		t.Fatalf("crc24 check value %06X, want 21CF02", got)
+	}
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{nil, {0}, bytes.Repeat([]byte{0xff}, 48), bytes.Repeat([]byte{1}, 49), patch} {
+		var b bytes.Buffer
+		if err := EncodeArmored(data, &b); err != nil {
+			t.Fatal(err)
+		}
+		text := b.String()
+		lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+		if lines[0] != armorBegin || lines[len(lines)-1] != armorEnd || !strings.HasPrefix(lines[len(lines)-2], "=") {
+			t.Fatalf("%d bytes: armor is\n%s", len(data), text)
+		}
+		for _, l := range lines {
+			if len(l) > armorLineLen && l != armorBegin {
+				t.Fatalf("%d bytes: line of %d characters", len(data), len(l))
+			}
+		}
+		got, err := DecodeArmored(strings.NewReader(text))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: decoded %d bytes, %v", len(data), len(got), err)
+		}
+		// 嵌在 YAML 中：每行缩进，Windows 换行，前后有空行
+		indented := "\r\n\n    " + strings.ReplaceAll(strings.TrimSuffix(text, "\n"), "\n", "\r\n    ") + "\r\n  \n"
+		if got, err := DecodeArmored(strings.NewReader(indented)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes, indented: decoded %d bytes, %v", len(data), len(got), err)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := EncodeArmored(patch, &b); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadPatch(strings.NewReader("\n  " + b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Bytes(), patch) {
+		t.Fatalf("ReadPatch of the armor: %d bytes, want %d", p.Len(), len(patch))
+	}
+}
+
+// TestArmorCorrupt 截断、改动一个字符、缺少 BEGIN 行或校验和行、END 行之后有内容的文本都返回 ErrCorruptPatch
+func TestArmorCorrupt(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := EncodeArmored(patch, &b); err != nil {
+		t.Fatal(err)
+	}
+	text := b.String()
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	body := len(armorBegin) + 1
+	// 把正文第一行的第 5 个字符换成另一个合法的 base64 字符
+	swapped := []byte(text)
+	if swapped[body+4] == 'A' {
+		swapped[body+4] = 'B'
+	} else {
+		swapped[body+4] = 'A'
+	}
+	for name, bad := range map[string]string{
+		"empty":             "",
+		"no END line":       strings.Join(lines[:len(lines)-1], "\n"),
+		"cut mid-body":      text[:len(text)/2],
+		"line dropped":      strings.Join(append(lines[:1:1], lines[2:]...), "\n"),
+		"character swapped": string(swapped),
+		"bad base64":        strings.Replace(text, lines[1], "!"+lines[1][1:], 1),
+		"no checksum":       strings.Replace(text, lines[len(lines)-2]+"\n", "", 1),
+		"no BEGIN line":     strings.Join(lines[1:], "\n"),
+		"text before":       "patch:\n" + text,
+		"text after":        text + "trailing\n",
+		"line after sum":    strings.Replace(text, lines[len(lines)-2]+"\n", lines[len(lines)-2]+"\nAAAA\n", 1),
+	} {
+		if _, err := DecodeArmored(strings.NewReader(bad)); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s: got %v, want ErrCorruptPatch", name, err)
+		}
+	}
+	if _, err := ReadPatch(strings.NewReader(text[:len(text)-10])); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("ReadPatch of truncated armor: got %v, want ErrCorruptPatch", err)
+	}
+}
@@ -0,0 +1,132 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// baselineCase testdata/baseline 中的一个补丁：第一个版本的库（见 generate.py）从 old 到 new 以 blockSize 生成
+type baselineCase struct {
+	name      string
+	old, new  []byte
+	blockSize uint32
+}
+
+// baselineCases 与 testdata/baseline/generate.py 中的 cases 一致，补丁的内容一并读出
+func baselineCases(tb testing.TB) map[*baselineCase][]byte {
+	tb.Helper()
+	oldData, err := os.ReadFile(filepath.Join("testdata", "text.old"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	newData, err := os.ReadFile(filepath.Join("testdata", "text.new"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cases := []*baselineCase{
+		{"text", oldData, newData, 1024},
+		{"reverse", newData, oldData, 1024},
+		{"append", oldData, append(bytes.Clone(oldData), newData[:4096]...), 1024},
+		{"from-empty", []byte{}, newData, 1024},
+		{"block-64", oldData, newData, 64},
+	}
+	patches := map[*baselineCase][]byte{}
+	for _, c := range cases {
+		p, err := os.ReadFile(filepath.Join("testdata", "baseline", c.name+".patch"))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		patches[c] = p
+	}
+	return patches
+}
+
+// TestApplyBaselinePatches 第一个版本的库生成的补丁（没有补丁头和结束记录）照常应用，ValidateFormat 也接受它们
+func TestApplyBaselinePatches(t *testing.T) {
+	for c, patch := range baselineCases(t) {
+		got, err := ApplyDiffsData(c.old, patch)
+		if err != nil || !bytes.Equal(got, c.new) {
+			t.Errorf("%s: ApplyDiffsData: %v", c.name, err)
+		}
+		var out bytes.Buffer
+		if err := ApplyDiffsStream(bytes.NewReader(c.old), bytes.NewReader(patch), &out); err != nil || !bytes.Equal(out.Bytes(), c.new) {
+			t.Errorf("%s: ApplyDiffsStream: %v", c.name, err)
+		}
+		if err := ValidateFormat(patch); err != nil {
+			t.Errorf("%s: ValidateFormat: %v", c.name, err)
+		}
+	}
+}
+
+// TestApplyLegacyRecords 手工拼出的原始格式补丁：一个 ADD 和一个 COPY，没有结束记录
+func TestApplyLegacyRecords(t *testing.T) {
+	patch := append([]byte{0x00, 5, 0, 0, 0}, "hello"...)
+	patch = binary.LittleEndian.AppendUint64(append(patch, 0x01), 0)
+	patch = binary.LittleEndian.AppendUint32(patch, 3)
+	got, err := ApplyDiffsData([]byte("abcdef"), patch)
+	if err != nil || string(got) != "helloabc" {
+		t.Fatalf("got %q, %v, want \"helloabc\"", got, err)
+	}
+	if n, err := PatchTargetSize(patch); err != nil || n != 8 {
+		t.Fatalf("PatchTargetSize: got %d, %v, want 8", n, err)
+	}
+}
+
+// TestEndRecordHeader WithEndRecord 的补丁以补丁头开头、以结束记录结尾，不带它时两者都没有
+func TestEndRecordHeader(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData, WithEndRecord(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch[0] != headerRecordOp || patch[1] != formatRevision {
+		t.Fatalf("patch starts with % x, want the header record", patch[:2])
+	}
+	end := patch[len(patch)-endRecordLen:]
+	if end[0] != endRecordOp || binary.LittleEndian.Uint64(end[1:]) != uint64(len(newData)) {
+		t.Fatalf("patch ends with % x, want the end record", end)
+	}
+	if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplyDiffsData: %v", err)
+	}
+	plain, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, patch[headerRecordLen:len(patch)-endRecordLen]) {
+		t.Fatal("the patch without WithEndRecord is not the same records without the header and end record")
+	}
+	if _, err := CreateDiffs(oldData, newData, WithEndRecord(true), WithStandardVCDIFF()); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("WithEndRecord with WithStandardVCDIFF: got %v, want ErrInvalidArgument", err)
+	}
+	future := append([]byte{headerRecordOp, formatRevision + 1}, patch[headerRecordLen:]...)
+	if _, err := ApplyDiffsData(oldData, future); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("header of a later format revision: got %v, want ErrUnsupportedPatch", err)
+	}
+}
+
+// TestZeroOptionsMatchBaseline 不带选项的 CreateDiffs 和 CreateDiffsData 的输出与第一个版本的库逐字节相同；
+// 新数据以旧数据开头时 CreateDiffs 默认走只追加的快速路径（见 WithAppendDetection），关闭它之后同样逐字节相同
+func TestZeroOptionsMatchBaseline(t *testing.T) {
+	requireNative(t)
+	for c, want := range baselineCases(t) {
+		if got, err := CreateDiffsData(c.old, c.new, c.blockSize); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: CreateDiffsData differs from the baseline patch (%d bytes, want %d): %v", c.name, len(got), len(want), err)
+		}
+		var opts []Option
+		if c.blockSize != DefaultBlockSize {
+			opts = append(opts, WithBlockSize(c.blockSize))
+		}
+		if c.name == "append" {
+			opts = append(opts, WithAppendDetection(false))
+		}
+		if got, err := CreateDiffs(c.old, c.new, opts...); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: CreateDiffs differs from the baseline patch (%d bytes, want %d): %v", c.name, len(got), len(want), err)
+		}
+	}
+}
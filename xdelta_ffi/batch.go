@@ -0,0 +1,231 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DiffJob CreateDiffsBatch 的一个任务
+// OldPath、NewPath 都不为空时从文件读取旧数据和新数据，否则使用 Old、New；
+// PatchPath 不为空时（只对文件任务有效）按 CreateDiffsFile 的方式流式编码并把补丁写入 PatchPath，否则补丁返回在 DiffResult.Patch 中
+type DiffJob struct {
+	Old, New         []byte
+	OldPath, NewPath string
+	PatchPath        string
+	// Options 与 CreateDiffs 的 opts 相同，内存任务按 CreateDiffsContext 执行，WithTimeout、WithReverse、WithDiffStats 等对每个任务分别生效；
+	// 写入 PatchPath 的文件任务只用到其中的编码参数和 WithMmap
+	Options []Option
+}
+
+// DiffResult CreateDiffsBatch 中与 DiffJob 一一对应的结果，Err 不为 nil 时其他字段无意义
+// 写入 PatchPath 的任务 Patch 为 nil，Stats.PatchSize 为补丁文件的大小
+type DiffResult struct {
+	Patch []byte
+	Stats FileStats
+	Err   error
+}
+
+// CreateDiffsBatch 用最多 workers 个 goroutine 并发执行 jobs，同一时刻最多 workers 个原生层编码，
+// 以此限制原生内存的峰值；workers 不大于 0 时使用 runtime.GOMAXPROCS(0)
+// 结果与 jobs 按下标一一对应；某个任务失败不影响其他任务，错误的格式为 "job i: ..."（i 从 0 开始）
+// ctx 结束后不再启动新任务，未启动的任务的 Err 为 ctx.Err()；正在进行的内存任务在原生层的下一个窗口中止，
+// 同样返回 ctx.Err()，写入 PatchPath 的文件任务无法中途取消，会执行完毕
+func CreateDiffsBatch(ctx context.Context, jobs []DiffJob, workers int) []DiffResult {
+	results := make([]DiffResult, len(jobs))
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(jobs))
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = runDiffJob(ctx, &jobs[i])
+				if results[i].Err != nil {
+					results[i].Err = fmt.Errorf("job %d: %w", i, results[i].Err)
+				}
+			}
+		}()
+	}
+	scheduled := 0
+schedule:
+	for ; scheduled < len(jobs); scheduled++ {
+		select {
+		case next <- scheduled:
+		case <-ctx.Done():
+			break schedule
+		}
+	}
+	close(next)
+	wg.Wait()
+	for i := scheduled; i < len(jobs); i++ {
+		results[i].Err = fmt.Errorf("job %d: %w", i, ctx.Err())
+	}
+	return results
+}
+
+func runDiffJob(ctx context.Context, job *DiffJob) DiffResult {
+	if err := ctx.Err(); err != nil {
+		return DiffResult{Err: err}
+	}
+	oldData, newData := job.Old, job.New
+	if job.OldPath != "" && job.NewPath != "" {
+		if job.PatchPath != "" {
+			if err := Init(); err != nil {
+				return DiffResult{Err: err}
+			}
+			o, err := newOptions(job.Options)
+			if err != nil {
+				return DiffResult{Err: err}
+			}
+			if dir := filepath.Dir(job.PatchPath); dir != "" {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					return DiffResult{Err: err}
+				}
+			}
+			blockSize := resolveBlockSize(o.blockSize, fileSize(job.OldPath), fileSize(job.NewPath))
+			release, err := acquireOpContext(ctx)
+			if err != nil {
+				return DiffResult{Err: err}
+			}
+			defer release()
+			stats, err := createPatchFile(job.OldPath, job.NewPath, job.PatchPath, blockSize, o.encoding(), o.mmap)
+			return DiffResult{Stats: stats, Err: err}
+		}
+		var err error
+		if oldData, err = os.ReadFile(job.OldPath); err != nil {
+			return DiffResult{Err: err}
+		}
+		if newData, err = os.ReadFile(job.NewPath); err != nil {
+			return DiffResult{Err: err}
+		}
+	}
+
+	patch, err := createDiffs(ctx, oldData, newData, job.Options)
+	if err != nil {
+		return DiffResult{Err: err}
+	}
+	return DiffResult{
+		Patch: patch,
+		Stats: FileStats{OldSize: int64(len(oldData)), NewSize: int64(len(newData)), PatchSize: int64(len(patch))},
+	}
+}
+
+// DiffPair CreateDiffsPairs 的一对输入
+type DiffPair struct {
+	Old, New []byte
+}
+
+// batchItem 与 xdelta_interface.h 中的 xdelta_batch_item 布局一致
+type batchItem struct {
+	oldOffset, oldLen uint64
+	newOffset, newLen uint64
+	blockSize         uint32
+	code              int32
+	outOffset, outLen uint64
+}
+
+// CreateDiffsPairs 为 pairs 中的每一对数据创建补丁，所有输入先复制到一块连续的内存中，整个批次只调用一次原生层，
+// 适合数量很多、每份只有几 KB 到几十 KB 的数据：逐个调用 CreateDiffs 时，每次调用原生层的固定开销可能超过编码本身
+// 结果与 pairs 按下标一一对应，每个补丁与同样选项下对这一对调用 CreateDiffs 的结果逐字节相同（WithThreads 除外）；
+// 某一对失败不影响其他对，错误的格式为 "pair i: ..."（i 从 0 开始）；只有选项不合法、原生库不可用、超时或被取消时返回 err
+// WithThreads 为同时编码的对数，每一对总是单线程编码；WithBlockSize 为 AutoBlockSize 时每一对按自己的大小选择块大小；
+// WithProgress、WithTimeout 和 WithDiffStats 对整个批次有效（DiffStats 的 Windows 为送入原生层的对数）；
+// WithReverse、WithMaxMemory 和 WithAutoCompressDetection 无效。输入复制一份，返回的补丁共用一块内存
+func CreateDiffsPairs(pairs []DiffPair, opts ...Option) (results []DiffResult, err error) {
+	var oldTotal, newTotal, patchTotal int64
+	for _, p := range pairs {
+		oldTotal += int64(len(p.Old))
+		newTotal += int64(len(p.New))
+	}
+	if m := beginOp(OpCreate, oldTotal, newTotal); m != nil {
+		defer func() { m.end(patchTotal, err) }()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	start := time.Now()
+
+	results = make([]DiffResult, len(pairs))
+	var items []batchItem
+	// index[k] 为 items[k] 在 pairs 中的下标，恒等补丁不送入原生层
+	var index []int
+	var size uint64
+	for i, p := range pairs {
+		results[i].Stats = FileStats{OldSize: int64(len(p.Old)), NewSize: int64(len(p.New))}
+		if o.identityEnabled() && len(p.Old) > 0 && bytes.Equal(p.Old, p.New) {
+			results[i].Patch = identityPatch(int64(len(p.Old)), o.writesEndRecord())
+			results[i].Stats.PatchSize = int64(len(results[i].Patch))
+			patchTotal += results[i].Stats.PatchSize
+			continue
+		}
+		oldLen, newLen := uint64(len(p.Old)), uint64(len(p.New))
+		items = append(items, batchItem{
+			oldOffset: size, oldLen: oldLen,
+			newOffset: size + oldLen, newLen: newLen,
+			blockSize: resolveBlockSize(o.blockSize, int64(oldLen), int64(newLen)),
+		})
+		index = append(index, i)
+		size += oldLen + newLen
+	}
+	if len(items) == 0 {
+		o.recordDiff(DiffStats{SourceSize: oldTotal, TargetSize: newTotal, PatchSize: patchTotal}, start)
+		return results, nil
+	}
+	data := make([]byte, 0, size)
+	for _, i := range index {
+		data = append(append(data, pairs[i].Old...), pairs[i].New...)
+	}
+
+	t := watchOptions(nil, o, int64(size))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	e := o.encoding()
+	out, err := createPatches(data, items, e, t.cancel())
+	if err != nil {
+		return nil, t.err(err)
+	}
+	for k, it := range items {
+		i := index[k]
+		b := out[it.outOffset : it.outOffset+it.outLen : it.outOffset+it.outLen]
+		if it.code != 0 {
+			results[i] = DiffResult{Err: fmt.Errorf("pair %d: %w", i, &Error{Code: ErrorCode(it.code), Message: string(b)})}
+			continue
+		}
+		results[i].Patch = b
+		results[i].Stats.PatchSize = int64(len(b))
+		patchTotal += int64(len(b))
+	}
+
+	threads := e.threads
+	if threads == 0 {
+		threads = min(runtime.NumCPU(), MaxThreads)
+	}
+	o.recordDiff(DiffStats{
+		SourceSize:  oldTotal,
+		TargetSize:  newTotal,
+		PatchSize:   patchTotal,
+		Windows:     len(items),
+		ThreadsUsed: min(threads, len(items)),
+	}, start)
+	return results, nil
+}
@@ -0,0 +1,254 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// opCounter 统计每种操作开始次数的 Collector
+type opCounter struct {
+	starts map[Operation]*atomic.Int64
+}
+
+func newOpCounter() *opCounter {
+	c := &opCounter{starts: map[Operation]*atomic.Int64{}}
+	for _, op := range []Operation{OpCreate, OpApply, OpCreateFile, OpApplyFile, OpCreateStream, OpApplyStream} {
+		c.starts[op] = &atomic.Int64{}
+	}
+	return c
+}
+
+func (c *opCounter) OpStart(info OpInfo) { c.starts[info.Op].Add(1) }
+func (c *opCounter) OpFinish(OpResult)   {}
+
+// smallPairs n 对几 KB 的数据，其中一对新旧相同，一对旧数据为空，一对都为空
+func smallPairs(n int) []DiffPair {
+	r := fixtureRand(266)
+	pairs := make([]DiffPair, n)
+	for i := range pairs {
+		old := bytes.Join(fixtureLines(&r, 20+i%50), nil)
+		nw := append(bytes.Clone(old[:len(old)/2]), fmt.Sprintf("record %d changed\n", i)...)
+		pairs[i] = DiffPair{Old: old, New: append(nw, old[len(old)/2+10:]...)}
+	}
+	pairs[3].New = bytes.Clone(pairs[3].Old)
+	pairs[5].Old = nil
+	pairs[7] = DiffPair{}
+	return pairs
+}
+
+// TestCreateDiffsPairs 每个补丁与同样选项下对这一对调用 CreateDiffs 的结果逐字节相同，应用后得到新数据；
+// 整个批次只报告一次操作，WithDiffStats 的 Windows 为送入原生层的对数（可以用恒等补丁时新旧相同的一对不送入）
+func TestCreateDiffsPairs(t *testing.T) {
+	requireNative(t)
+	pairs := smallPairs(200)
+	for _, c := range []struct {
+		opts []Option
+		// windows 送入原生层的对数：只有可以用恒等补丁时新旧相同的一对不送入
+		windows int
+	}{
+		{nil, len(pairs) - 1},
+		{[]Option{WithBlockSize(64)}, len(pairs) - 1},
+		{[]Option{WithChecksum(ChecksumXXH3), WithThreads(3)}, len(pairs)},
+		{[]Option{WithStandardVCDIFF()}, len(pairs)},
+	} {
+		opts := c.opts
+		counter := newOpCounter()
+		SetMetricsCollector(counter)
+		var stats DiffStats
+		results, err := CreateDiffsPairs(pairs, append(opts, WithDiffStats(&stats))...)
+		SetMetricsCollector(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := counter.starts[OpCreate].Load(); n != 1 {
+			t.Fatalf("%d create operations reported for one batch", n)
+		}
+		if len(results) != len(pairs) {
+			t.Fatalf("%d results for %d pairs", len(results), len(pairs))
+		}
+		var oldTotal, patchTotal int64
+		for i, r := range results {
+			if r.Err != nil {
+				t.Fatalf("pair %d: %v", i, r.Err)
+			}
+			want, err := CreateDiffs(pairs[i].Old, pairs[i].New, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(r.Patch, want) {
+				t.Fatalf("pair %d: patch of %d bytes, CreateDiffs gives %d", i, len(r.Patch), len(want))
+			}
+			if got, err := ApplyDiffsData(pairs[i].Old, r.Patch); err != nil || !bytes.Equal(got, pairs[i].New) {
+				t.Fatalf("pair %d: applied to %d bytes, %v", i, len(got), err)
+			}
+			if r.Stats != (FileStats{OldSize: int64(len(pairs[i].Old)), NewSize: int64(len(pairs[i].New)), PatchSize: int64(len(r.Patch))}) {
+				t.Fatalf("pair %d: stats %+v", i, r.Stats)
+			}
+			oldTotal += r.Stats.OldSize
+			patchTotal += r.Stats.PatchSize
+		}
+		if stats.Windows != c.windows || stats.SourceSize != oldTotal || stats.PatchSize != patchTotal {
+			t.Fatalf("DiffStats %+v, want %d windows, %d source bytes, %d patch bytes", stats, c.windows, oldTotal, patchTotal)
+		}
+	}
+
+	if results, err := CreateDiffsPairs(nil); err != nil || len(results) != 0 {
+		t.Fatalf("no pairs: %d results, %v", len(results), err)
+	}
+	if results, err := CreateDiffsPairs(pairs, WithBlockSize(MaxBlockSize+1)); !errors.Is(err, ErrInvalidArgument) || results != nil {
+		t.Fatalf("invalid option: %d results, %v, want ErrInvalidArgument", len(results), err)
+	}
+}
+
+// TestCreateDiffsBatch 结果按下标与任务对应：内存任务的补丁与 CreateDiffs 相同，文件任务读取文件或把补丁写入 PatchPath，
+// 与 CreateDiffsFile 的结果相同；一个任务的错误带上 "job i" 返回，不影响其他任务；
+// 同时进行的原生操作不超过 workers 个
+func TestCreateDiffsBatch(t *testing.T) {
+	requireNative(t)
+	dir := t.TempDir()
+	oldData, newData := textFixture(1 << 20)
+	writeTree(t, dir, map[string][]byte{"old": oldData, "new": newData})
+	oldPath, newPath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	pairs := smallPairs(12)
+
+	var jobs []DiffJob
+	for i, p := range pairs {
+		var opts []Option
+		if i%2 == 1 {
+			opts = []Option{WithBlockSize(64), WithChecksum(ChecksumXXH3)}
+		}
+		jobs = append(jobs, DiffJob{Old: p.Old, New: p.New, Options: opts})
+	}
+	jobs = append(jobs,
+		DiffJob{OldPath: oldPath, NewPath: newPath},
+		DiffJob{OldPath: oldPath, NewPath: newPath, PatchPath: filepath.Join(dir, "sub", "patch")},
+		DiffJob{Old: oldData, New: newData, Options: []Option{WithBlockSize(MaxBlockSize + 1)}},
+	)
+
+	// 在批次进行期间不断读取正在进行的原生操作数
+	var peak atomic.Int64
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			peak.Store(max(peak.Load(), opLimit.inFlight.Load()))
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	results := CreateDiffsBatch(context.Background(), jobs, 2)
+	close(stop)
+	<-done
+	if n := peak.Load(); n > 2 {
+		t.Fatalf("%d native operations at once with 2 workers", n)
+	}
+
+	if len(results) != len(jobs) {
+		t.Fatalf("%d results for %d jobs", len(results), len(jobs))
+	}
+	for i, p := range pairs {
+		want, err := CreateDiffs(p.Old, p.New, jobs[i].Options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := results[i]; r.Err != nil || !bytes.Equal(r.Patch, want) || r.Stats.PatchSize != int64(len(want)) || r.Stats.NewSize != int64(len(p.New)) {
+			t.Fatalf("job %d: %d bytes, %+v, %v; CreateDiffs gives %d bytes", i, len(r.Patch), r.Stats, r.Err, len(want))
+		}
+	}
+	fileJob := results[len(pairs)]
+	if got, err := ApplyDiffsData(oldData, fileJob.Patch); fileJob.Err != nil || err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("job reading files: %v, applied with %v", fileJob.Err, err)
+	}
+	wantPath := filepath.Join(dir, "want")
+	if err := CreateDiffsFile(oldPath, newPath, wantPath, DefaultBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(wantPath)
+	got, err := os.ReadFile(jobs[len(pairs)+1].PatchPath)
+	if r := results[len(pairs)+1]; r.Err != nil || r.Patch != nil || err != nil || !bytes.Equal(got, want) || r.Stats.PatchSize != int64(len(want)) {
+		t.Fatalf("job writing PatchPath: %d bytes, %+v, %v, %v; CreateDiffsFile gives %d bytes", len(got), r.Stats, r.Err, err, len(want))
+	}
+	last := len(jobs) - 1
+	if err := results[last].Err; !errors.Is(err, ErrInvalidArgument) || !strings.HasPrefix(err.Error(), fmt.Sprintf("job %d: ", last)) {
+		t.Fatalf("job with an invalid option: %v", err)
+	}
+
+	if results := CreateDiffsBatch(context.Background(), nil, 0); len(results) != 0 {
+		t.Fatalf("%d results for no jobs", len(results))
+	}
+}
+
+// TestCreateDiffsBatchCanceled ctx 已经结束时没有任务启动，每个结果都是 "job i" 加上 ctx.Err()
+func TestCreateDiffsBatchCanceled(t *testing.T) {
+	requireNative(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	counter := newOpCounter()
+	SetMetricsCollector(counter)
+	defer SetMetricsCollector(nil)
+	var jobs []DiffJob
+	for _, p := range smallPairs(8) {
+		jobs = append(jobs, DiffJob{Old: p.Old, New: p.New})
+	}
+	for i, r := range CreateDiffsBatch(ctx, jobs, 3) {
+		if !errors.Is(r.Err, context.Canceled) || r.Patch != nil || !strings.HasPrefix(r.Err.Error(), fmt.Sprintf("job %d: ", i)) {
+			t.Fatalf("job %d: %d bytes, %v", i, len(r.Patch), r.Err)
+		}
+	}
+	if n := counter.starts[OpCreate].Load(); n != 0 {
+		t.Fatalf("%d create operations started after the context ended", n)
+	}
+}
+
+// TestCreateDiffsBatchOptions 内存任务的选项与 CreateDiffs 一样生效：WithTimeout 到期返回 ErrTimeout，
+// WithReverse、WithDiffStats 写入各自任务的结果，新旧相同的一对得到与 CreateDiffs 相同的恒等补丁
+func TestCreateDiffsBatchOptions(t *testing.T) {
+	requireNative(t)
+	bigOld, bigNew := textFixture(8 << 20)
+	oldData, newData := testPair()
+	var reverse []byte
+	var stats DiffStats
+	jobs := []DiffJob{
+		{Old: bigOld, New: bigNew, Options: []Option{WithBlockSize(16), WithTimeout(time.Millisecond)}},
+		{Old: oldData, New: newData, Options: []Option{WithReverse(&reverse)}},
+		{Old: oldData, New: newData, Options: []Option{WithDiffStats(&stats)}},
+		{Old: oldData, New: oldData},
+	}
+	results := CreateDiffsBatch(context.Background(), jobs, 2)
+
+	if err := results[0].Err; !errors.Is(err, ErrTimeout) || !strings.HasPrefix(err.Error(), "job 0: ") {
+		t.Fatalf("job with WithTimeout: got %v, want ErrTimeout", err)
+	}
+	var wantReverse []byte
+	if _, err := CreateDiffs(oldData, newData, WithReverse(&wantReverse)); err != nil {
+		t.Fatal(err)
+	}
+	if results[1].Err != nil || !bytes.Equal(reverse, wantReverse) {
+		t.Fatalf("job with WithReverse: reverse patch of %d bytes, %v; CreateDiffs gives %d bytes", len(reverse), results[1].Err, len(wantReverse))
+	}
+	if got, err := ApplyDiffsData(newData, reverse); err != nil || !bytes.Equal(got, oldData) {
+		t.Fatalf("reverse patch applied to %d bytes, %v", len(got), err)
+	}
+	if r := results[2]; r.Err != nil || stats.PatchSize != int64(len(r.Patch)) || stats.SourceSize != int64(len(oldData)) || stats.TargetSize != int64(len(newData)) {
+		t.Fatalf("job with WithDiffStats: %+v for a patch of %d bytes, %v", stats, len(r.Patch), r.Err)
+	}
+	want, err := CreateDiffs(oldData, oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[3]; r.Err != nil || !bytes.Equal(r.Patch, want) || !IsIdentityPatch(r.Patch) {
+		t.Fatalf("identical pair: % x, %v, want the identity patch % x", r.Patch, r.Err, want)
+	}
+}
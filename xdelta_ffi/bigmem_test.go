@@ -0,0 +1,292 @@
+//go:build bigmem
+
+package xdelta_ffi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBigTarget 新数据超过 2 GiB 时的创建和应用：由 1 MiB 旧数据重复、每 MiB 改动几个字节拼成，
+// 补丁很小，结果的长度和 SHA-256 与新数据一致。需要约 2.5 GiB 内存，只在 -tags bigmem 时编译，-short 时跳过
+func TestBigTarget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs about 2.5 GiB of memory")
+	}
+	requireNative(t)
+	if math.MaxInt == math.MaxInt32 {
+		t.Skip("a 32-bit process cannot hold the target")
+	}
+	r := fixtureRand(21)
+	oldData := make([]byte, 1<<20)
+	for i := range oldData {
+		oldData[i] = byte(r.next())
+	}
+	const size = math.MaxInt32 + 100<<20
+	newData := make([]byte, 0, size)
+	for len(newData) < size {
+		n := len(newData)
+		newData = append(newData, oldData[:min(len(oldData), size-n)]...)
+		newData[n+r.intn(len(newData)-n)] ^= 0x5a
+	}
+	sum := sha256.Sum256(newData)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%d byte target, %d byte patch", len(newData), len(patch))
+	newData = nil
+	runtime.GC()
+	debug.FreeOSMemory()
+
+	got, err := ApplyDiffsData(oldData, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != size || sha256.Sum256(got) != sum {
+		t.Fatalf("ApplyDiffsData: %d bytes, want %d with the same SHA-256", len(got), size)
+	}
+}
+
+// bigFilePair 在 dir 中写入 size 字节的旧文件和新版本：随机数据，每 MiB 改动几个字节，每 64 MiB 插入一段新数据，
+// 新旧数据大体对齐
+func bigFilePair(tb testing.TB, dir string, size int64) (oldPath, newPath string) {
+	tb.Helper()
+	oldPath, newPath = filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	of, err := os.Create(oldPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer of.Close()
+	nf, err := os.Create(newPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer nf.Close()
+	ow, nw := bufio.NewWriterSize(of, 1<<20), bufio.NewWriterSize(nf, 1<<20)
+	r := fixtureRand(70)
+	chunk := make([]byte, 1<<20)
+	for n := int64(0); n < size; n += int64(len(chunk)) {
+		for i := 0; i < len(chunk); i += 8 {
+			v := r.next()
+			for k := range 8 {
+				chunk[i+k] = byte(v >> (8 * k))
+			}
+		}
+		ow.Write(chunk)
+		if n%(64<<20) == 0 {
+			nw.Write(bytes.Repeat([]byte{byte(r.next())}, 4096+r.intn(4096)))
+		}
+		for range 3 {
+			chunk[r.intn(len(chunk))] ^= 0x5a
+		}
+		nw.Write(chunk)
+	}
+	for _, w := range []*bufio.Writer{ow, nw} {
+		if err := w.Flush(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return oldPath, newPath
+}
+
+// processRSS 当前进程的常驻内存（字节），只在 Linux 上可用，否则返回 -1
+func processRSS() int64 {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return -1
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return -1
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return pages * int64(os.Getpagesize())
+}
+
+// peakDuring 运行 fn 的同时每毫秒采样一次，返回原生库持有的堆内存和进程常驻内存的峰值
+func peakDuring(fn func()) (native, rss int64) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if s, err := NativeStats(); err == nil {
+				native = max(native, s.CurrentBytes)
+			}
+			rss = max(rss, processRSS())
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	fn()
+	close(stop)
+	<-done
+	return native, rss
+}
+
+// benchSourceSize 大文件基准测试的文件大小：默认 4 GiB，XDELTA_BENCH_SOURCE_SIZE（字节）可以改变
+func benchSourceSize(b *testing.B) int64 {
+	v := os.Getenv("XDELTA_BENCH_SOURCE_SIZE")
+	if v == "" {
+		return 4 << 30
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return n
+}
+
+// BenchmarkSourceWindowRSS 对 4 GiB 的文件对调用 CreateDiffsFile：不限制窗口时签名表覆盖整个旧文件，
+// WithSourceWindowSize(64 MiB) 时原生库的内存和进程的常驻内存与旧文件的大小无关。
+// XDELTA_BENCH_SOURCE_SIZE 可以改变文件大小（字节）；需要两倍于此的磁盘空间，只在 -tags bigmem 时编译，-short 时跳过
+func BenchmarkSourceWindowRSS(b *testing.B) {
+	if testing.Short() {
+		b.Skip("writes two multi-GB files")
+	}
+	requireNative(b)
+	size := benchSourceSize(b)
+	dir := b.TempDir()
+	oldPath, newPath := bigFilePair(b, dir, size)
+	patchPath := filepath.Join(dir, "patch")
+	for _, bc := range []struct {
+		name   string
+		window int64
+	}{{"window-64MiB", 64 << 20}, {"whole-source", 0}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(size)
+			var native, rss int64
+			for b.Loop() {
+				runtime.GC()
+				debug.FreeOSMemory()
+				base := processRSS()
+				n, r := peakDuring(func() {
+					if err := CreateDiffsFile(oldPath, newPath, patchPath, 4096, WithSourceWindowSize(bc.window)); err != nil {
+						b.Fatal(err)
+					}
+				})
+				native, rss = max(native, n), max(rss, r-base)
+			}
+			b.ReportMetric(float64(native)/(1<<20), "native-MiB")
+			if rss >= 0 {
+				b.ReportMetric(float64(rss)/(1<<20), "rss-MiB")
+			}
+		})
+	}
+}
+
+// BenchmarkSegmentSize 对 4 GiB 的文件对调用 CreateDiffsFile：WithSegmentSize(256 MiB) 时原生库的内存约为
+// 线程数 × 一段的签名和补丁，与文件大小无关，不分段时签名表覆盖整个旧文件；同时报告补丁大小，
+// 新旧文件大体对齐，分段丢失的跨段匹配很少。文件大小和磁盘空间同 BenchmarkSourceWindowRSS
+func BenchmarkSegmentSize(b *testing.B) {
+	if testing.Short() {
+		b.Skip("writes two multi-GB files")
+	}
+	requireNative(b)
+	size := benchSourceSize(b)
+	dir := b.TempDir()
+	oldPath, newPath := bigFilePair(b, dir, size)
+	patchPath := filepath.Join(dir, "patch")
+	for _, bc := range []struct {
+		name    string
+		segment int64
+		threads int
+	}{{"segment-256MiB-1-thread", 256 << 20, 1}, {"segment-256MiB-4-threads", 256 << 20, 4}, {"whole-file", 0, 1}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(size)
+			var native, rss int64
+			for b.Loop() {
+				runtime.GC()
+				debug.FreeOSMemory()
+				base := processRSS()
+				n, r := peakDuring(func() {
+					if err := CreateDiffsFile(oldPath, newPath, patchPath, 4096, WithSegmentSize(bc.segment), WithThreads(bc.threads)); err != nil {
+						b.Fatal(err)
+					}
+				})
+				native, rss = max(native, n), max(rss, r-base)
+			}
+			b.ReportMetric(float64(native)/(1<<20), "native-MiB")
+			if rss >= 0 {
+				b.ReportMetric(float64(rss)/(1<<20), "rss-MiB")
+			}
+			if fi, err := os.Stat(patchPath); err == nil {
+				b.ReportMetric(float64(fi.Size())/(1<<20), "patch-MiB")
+			}
+		})
+	}
+}
+
+// BenchmarkApplyPresized 应用输出为 512 MiB 的补丁：ApplyDiffsData 按补丁声明的长度一次分配输出，原生层直接解码到其中；
+// 对照是 ApplyDiffsStream 写入 bytes.Buffer，输出缓冲区随写入反复扩容和复制。报告原生库和进程常驻内存（相对开始时）的峰值
+func BenchmarkApplyPresized(b *testing.B) {
+	if testing.Short() {
+		b.Skip("needs about 2.5 GiB of memory")
+	}
+	requireNative(b)
+	r := fixtureRand(91)
+	oldData := make([]byte, 512<<20)
+	for i := 0; i < len(oldData); i += 8 {
+		binary.LittleEndian.PutUint64(oldData[i:], r.next())
+	}
+	newData := bytes.Clone(oldData)
+	for i := 0; i < len(newData); i += 1 << 20 {
+		newData[i+r.intn(1<<20)] ^= 0x5a
+	}
+	patch, err := CreateDiffs(oldData, newData, WithBlockSize(4096))
+	if err != nil {
+		b.Fatal(err)
+	}
+	newData = nil
+	for _, bc := range []struct {
+		name  string
+		apply func() error
+	}{
+		{"ApplyDiffsData", func() error {
+			_, err := ApplyDiffsData(oldData, patch)
+			return err
+		}},
+		{"ApplyDiffsStream-buffer", func() error {
+			var out bytes.Buffer
+			return ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &out)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(oldData)))
+			var native, rss int64
+			for b.Loop() {
+				runtime.GC()
+				debug.FreeOSMemory()
+				base := processRSS()
+				n, r := peakDuring(func() {
+					if err := bc.apply(); err != nil {
+						b.Fatal(err)
+					}
+				})
+				native, rss = max(native, n), max(rss, r-base)
+			}
+			b.ReportMetric(float64(native)/(1<<20), "native-MiB")
+			if rss >= 0 {
+				b.ReportMetric(float64(rss)/(1<<20), "rss-MiB")
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// dirBlobDir WithBlobDedup 时 blob 在 outDir 中的子目录，每个 blob 保存为 blobs/<id>
+const dirBlobDir = "blobs"
+
+// BlobStore 按内容寻址的 blob 存储，id 为内容的小写十六进制 SHA-256；由调用方实现（例如对象存储），也可以用 NewDirBlobStore
+// CreateDirDiff 在同一个 goroutine 中依次调用，不需要并发安全
+type BlobStore interface {
+	// Has 报告 id 是否已经保存过，已有的 blob 不再 Put
+	Has(id string) (bool, error)
+	// Put 保存 r 的全部内容；内容的 SHA-256 与 id 不符时 r 在读到末尾时返回错误，此时不能保存
+	Put(id string, r io.Reader) error
+	// Open 返回 id 的内容，不存在时返回包装了 fs.ErrNotExist 的错误；读到的内容由调用方校验
+	Open(id string) (io.ReadCloser, error)
+}
+
+// WithBlobDedup CreateDirDiff 按内容去重：补丁和新增文件的完整内容以 blob 的形式保存在 outDir/blobs/<id> 中，
+// id 为内容的 SHA-256，相同的内容只保存一次，清单中的项在 Blob 中记录 id、Patch 为对应的 blobs/<id>；
+// 同一个新增文件出现在多个路径，或多个路径上是同一对旧、新内容（例如各个本地化版本中的同一个资源）时，
+// 补丁只编码、保存一次。节省的大小见 DirManifest.DedupStats；结果照常用 ApplyDirDiff 应用，也可以用 WriteBundle 打包
+func WithBlobDedup() Option {
+	return func(o *options) {
+		o.blobDedup = true
+	}
+}
+
+// WithBlobStore CreateDirDiff 把 blob 保存在 store 中而不是 outDir（隐含 WithBlobDedup）：store 中已有的 blob 不再保存，
+// 清单中的项只有 Blob、没有 Patch，outDir 中只有清单；ApplyDirDiff、ApplyDirDiffFS 从 store 中取得没有 Patch 的项引用的 blob，
+// 每个 blob 只取一次，供所有引用它的项使用，内容与 id 不符时返回 ErrCorruptPatch
+// 这样的清单需要这一版本以上的 ApplyDirDiff 才能应用
+func WithBlobStore(store BlobStore) Option {
+	return func(o *options) {
+		o.blobStore = store
+	}
+}
+
+// DirDedupStats 清单中 blob 的去重统计
+type DirDedupStats struct {
+	// Blobs 不同的 blob 数
+	Blobs int
+	// References 引用 blob 的项数
+	References int
+	// StoredBytes 不同 blob 的总大小，即实际保存的字节数
+	StoredBytes int64
+	// ReferencedBytes 每一项引用的 blob 大小之和，即不去重时需要保存的字节数
+	ReferencedBytes int64
+}
+
+// SavedBytes 去重节省的字节数
+func (s DirDedupStats) SavedBytes() int64 {
+	return s.ReferencedBytes - s.StoredBytes
+}
+
+// DedupStats 统计 m 中引用 blob 的项（WithBlobDedup、WithBlobStore 生成的清单），blob 的大小取自 PatchSize；
+// 没有引用 blob 的清单返回零值
+func (m *DirManifest) DedupStats() DirDedupStats {
+	var s DirDedupStats
+	seen := make(map[string]bool)
+	for _, e := range m.Entries {
+		if e.Blob == "" {
+			continue
+		}
+		s.References++
+		s.ReferencedBytes += e.PatchSize
+		if !seen[e.Blob] {
+			seen[e.Blob] = true
+			s.Blobs++
+			s.StoredBytes += e.PatchSize
+		}
+	}
+	return s
+}
+
+// NewDirBlobStore 返回把每个 blob 保存为目录 dir 中的文件 <id> 的 BlobStore，dir 在第一次 Put 时创建；
+// Put 先写入同目录下的临时文件，校验 SHA-256 之后再重命名，不会留下内容与名字不符的文件
+func NewDirBlobStore(dir string) BlobStore {
+	return dirBlobStore(dir)
+}
+
+type dirBlobStore string
+
+func (s dirBlobStore) path(id string) (string, error) {
+	if !validSHA256Hex(id) {
+		return "", fmt.Errorf("%w: blob id %q is not a lowercase hex SHA-256", ErrInvalidArgument, id)
+	}
+	return filepath.Join(string(s), id), nil
+}
+
+func (s dirBlobStore) Has(id string) (bool, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(p)
+	if notExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s dirBlobStore) Put(id string, r io.Reader) error {
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(string(s), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(string(s), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(tmp, io.TeeReader(r, h))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != id {
+		return fmt.Errorf("%w: content of blob %s has a different SHA-256", ErrInvalidArgument, id)
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s dirBlobStore) Open(id string) (io.ReadCloser, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// checkedReader 读到末尾时校验内容的 SHA-256，与 id 不符时以错误代替 io.EOF
+type checkedReader struct {
+	r  io.Reader
+	h  hash.Hash
+	id string
+}
+
+func (r *checkedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.h.Sum(nil)) != r.id {
+		err = fmt.Errorf("content of blob %s changed while the directory patch was created", r.id)
+	}
+	return n, err
+}
+
+// dirBlobs 一次 CreateDirDiff 保存的 blob
+type dirBlobs struct {
+	store BlobStore
+	// local 为 true 时 store 是 outDir/blobs，清单中的 Patch 指向其中的文件
+	local  bool
+	outDir string
+	saved  map[string]bool
+	// patches 已经编码过的旧、新内容（SHA-256）对应的补丁 blob
+	patches map[[2]string]blobRef
+}
+
+type blobRef struct {
+	id   string
+	size int64
+}
+
+// newDirBlobs 按 WithBlobDedup、WithBlobStore 返回保存 blob 的 dirBlobs，两者都没有时返回 nil
+func newDirBlobs(o options, outDir string) *dirBlobs {
+	if !o.blobDedup && o.blobStore == nil {
+		return nil
+	}
+	b := &dirBlobs{store: o.blobStore, outDir: outDir, saved: make(map[string]bool), patches: make(map[[2]string]blobRef)}
+	if b.store == nil {
+		b.store, b.local = NewDirBlobStore(filepath.Join(outDir, dirBlobDir)), true
+	}
+	return b
+}
+
+// addFull 把新增文件 newPath 的完整内容保存为 blob，id 就是 e.NewSHA256
+func (b *dirBlobs) addFull(e *DirEntry, newPath string) error {
+	if err := b.put(e.NewSHA256, newPath); err != nil {
+		return err
+	}
+	b.ref(e, blobRef{e.NewSHA256, e.NewSize})
+	return nil
+}
+
+// addPatch 生成从 oldPath 到 newPath 的补丁并保存为 blob，同一对旧、新内容之前已经编码过时直接引用那个 blob
+func (b *dirBlobs) addPatch(e *DirEntry, oldPath, newPath string, blockSize uint32, o options) error {
+	key := [2]string{e.OldSHA256, e.NewSHA256}
+	if r, ok := b.patches[key]; ok {
+		b.ref(e, r)
+		return nil
+	}
+	tmp, err := os.CreateTemp(b.outDir, ".xdelta-blob-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	stats, err := createPatchFile(oldPath, newPath, tmp.Name(), blockSize, o.encoding(), o.mmap)
+	release()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	_, id, _, err := hashReader(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := b.put(id, tmp.Name()); err != nil {
+		return err
+	}
+	r := blobRef{id, stats.PatchSize}
+	b.patches[key] = r
+	b.ref(e, r)
+	return nil
+}
+
+// put 把文件 p 的内容保存为 blob id，本次或之前已经保存过时什么也不做
+func (b *dirBlobs) put(id, p string) error {
+	if b.saved[id] {
+		return nil
+	}
+	ok, err := b.store.Has(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// NewDirBlobStore 自己校验内容，其他的存储在这里校验
+		var r io.Reader = f
+		if !b.local {
+			r = &checkedReader{r: f, h: sha256.New(), id: id}
+		}
+		if err := b.store.Put(id, r); err != nil {
+			return err
+		}
+	}
+	b.saved[id] = true
+	return nil
+}
+
+func (b *dirBlobs) ref(e *DirEntry, r blobRef) {
+	e.Blob, e.PatchSize = r.id, r.size
+	if b.local {
+		e.Patch = path.Join(dirBlobDir, r.id)
+	}
+}
+
+// blobFile 返回 e 引用的 blob 在暂存目录中的副本：第一次引用时从补丁目录或包（Patch 不为空时）或 WithBlobStore 中取得并校验，
+// 之后引用同一个 blob 的项直接使用这个副本
+func (a *dirApply) blobFile(e *DirEntry) (string, error) {
+	if p, ok := a.blobs[e.Blob]; ok {
+		return p, nil
+	}
+	var r io.ReadCloser
+	var err error
+	switch {
+	case e.Patch != "":
+		r, err = a.openPatch(e.Patch)
+	case a.o.blobStore != nil:
+		r, err = a.o.blobStore.Open(e.Blob)
+	default:
+		return "", fmt.Errorf("%w: blob %s is not in the patch directory, it needs WithBlobStore", ErrInvalidArgument, e.Blob)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	p := filepath.Join(a.journal, dirJournalStage, "blob-"+e.Blob)
+	h := sha256.New()
+	if _, err := writeFile(p, io.TeeReader(r, h)); err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.Blob {
+		os.Remove(p)
+		return "", fmt.Errorf("%w: blob %s SHA-256 mismatch", ErrCorruptPatch, e.Blob)
+	}
+	if a.blobs == nil {
+		a.blobs = make(map[string]string)
+	}
+	a.blobs[e.Blob] = p
+	return p, nil
+}
+
+// openPatch 打开补丁目录或包中的 name
+func (a *dirApply) openPatch(name string) (io.ReadCloser, error) {
+	if a.bundle != nil {
+		r, err := a.bundle.open(name)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(r), nil
+	}
+	return os.Open(filepath.Join(a.patches, filepath.FromSlash(name)))
+}
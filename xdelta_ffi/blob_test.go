@@ -0,0 +1,250 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memBlobStore 测试用的 BlobStore，记录每次 Put 的 id
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	puts  []string
+}
+
+func (s *memBlobStore) Has(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blobs[id]
+	return ok, nil
+}
+
+func (s *memBlobStore) Put(id string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobs == nil {
+		s.blobs = map[string][]byte{}
+	}
+	s.blobs[id] = data
+	s.puts = append(s.puts, id)
+	return nil
+}
+
+func (s *memBlobStore) Open(id string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[id]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", id, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// blobTrees 去重测试用的新旧目录：三个本地化版本中的 res.bin 是同一对旧、新内容，两个路径上新增了相同的文件，
+// 另有一个单独修改的文件和一个没有改动的文件
+func blobTrees() (oldTree, newTree map[string][]byte) {
+	r := fixtureRand(93)
+	res := bytes.Join(fixtureLines(&r, 4096), nil)
+	resNew := append(bytes.Clone(res[:3000]), res[3500:]...)
+	own := bytes.Join(fixtureLines(&r, 2048), nil)
+	added := bytes.Join(fixtureLines(&r, 512), nil)
+	oldTree = map[string][]byte{"en/res.bin": res, "fr/res.bin": res, "de/res.bin": res, "own.txt": own, "same.txt": []byte("same\n")}
+	newTree = map[string][]byte{
+		"en/res.bin": resNew, "fr/res.bin": resNew, "de/res.bin": resNew,
+		"own.txt":   append(bytes.Clone(own), "appended\n"...),
+		"same.txt":  []byte("same\n"),
+		"a/new.txt": added, "b/new.txt": added,
+	}
+	return oldTree, newTree
+}
+
+// checkBlobDedup res.bin 的补丁只编码一次、三个项引用同一个 blob，相同的新增文件只保存一次，DedupStats 与清单中的大小一致
+func checkBlobDedup(t *testing.T, m *DirManifest) {
+	t.Helper()
+	byPath := map[string]DirEntry{}
+	for _, e := range m.Entries {
+		byPath[e.Path] = e
+	}
+	res, own, added := byPath["en/res.bin"], byPath["own.txt"], byPath["a/new.txt"]
+	for _, p := range []string{"fr/res.bin", "de/res.bin"} {
+		if byPath[p].Blob != res.Blob || byPath[p].PatchSize != res.PatchSize {
+			t.Fatalf("%s references %s, en/res.bin references %s", p, byPath[p].Blob, res.Blob)
+		}
+	}
+	if b := byPath["b/new.txt"]; b.Blob != added.Blob || added.Blob != added.NewSHA256 || added.PatchSize != added.NewSize {
+		t.Fatalf("added files reference %s and %s, want the new content %s", added.Blob, b.Blob, added.NewSHA256)
+	}
+	if res.Blob == "" || own.Blob == "" || own.Blob == res.Blob || byPath["same.txt"].Blob != "" {
+		t.Fatalf("blobs: res.bin %q, own.txt %q, same.txt %q", res.Blob, own.Blob, byPath["same.txt"].Blob)
+	}
+	want := DirDedupStats{
+		Blobs:           3,
+		References:      6,
+		StoredBytes:     res.PatchSize + own.PatchSize + added.PatchSize,
+		ReferencedBytes: 3*res.PatchSize + own.PatchSize + 2*added.PatchSize,
+	}
+	got := m.DedupStats()
+	if got != want {
+		t.Fatalf("DedupStats %+v, want %+v", got, want)
+	}
+	if saved := got.SavedBytes(); saved != 2*res.PatchSize+added.PatchSize || saved <= 0 {
+		t.Fatalf("SavedBytes %d, want %d", saved, 2*res.PatchSize+added.PatchSize)
+	}
+}
+
+// TestBlobDedup WithBlobDedup 把重复的补丁和新增文件只保存一次在 outDir/blobs 中，DedupStats 报告节省的大小，
+// 结果照常用 ApplyDirDiff 应用；没有去重的清单 DedupStats 为零值
+func TestBlobDedup(t *testing.T) {
+	requireNative(t)
+	oldTree, newTree := blobTrees()
+	oldDir, newDir, patchDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTree(t, oldDir, oldTree)
+	writeTree(t, newDir, newTree)
+	m, err := CreateDirDiff(oldDir, newDir, patchDir, WithBlobDedup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlobDedup(t, m)
+	blobs, err := os.ReadDir(filepath.Join(patchDir, dirBlobDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 3 {
+		t.Fatalf("%d files in %s, want 3", len(blobs), dirBlobDir)
+	}
+	out := t.TempDir()
+	if err := ApplyDirDiff(oldDir, patchDir, out); err != nil {
+		t.Fatal(err)
+	}
+	got := readTree(t, out)
+	for name, want := range newTree {
+		if !bytes.Equal(got[name], want) {
+			t.Fatalf("%s: %d bytes, want %d", name, len(got[name]), len(want))
+		}
+	}
+
+	plain, err := CreateDirDiff(oldDir, newDir, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := plain.DedupStats(); s != (DirDedupStats{}) {
+		t.Fatalf("DedupStats without WithBlobDedup: %+v", s)
+	}
+}
+
+// TestBlobStore WithBlobStore 每个不同的 blob 只 Put 一次，outDir 中没有 blob；同一个存储再次创建时已有的 blob 不再 Put；
+// 应用时从存储中取得 blob，内容与 id 不符时返回 ErrCorruptPatch，没有 WithBlobStore 时返回 ErrInvalidArgument
+func TestBlobStore(t *testing.T) {
+	requireNative(t)
+	oldTree, newTree := blobTrees()
+	oldDir, newDir, patchDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTree(t, oldDir, oldTree)
+	writeTree(t, newDir, newTree)
+	store := &memBlobStore{}
+	m, err := CreateDirDiff(oldDir, newDir, patchDir, WithBlobStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlobDedup(t, m)
+	if len(store.puts) != 3 {
+		t.Fatalf("%d Puts, want 3", len(store.puts))
+	}
+	for _, e := range m.Entries {
+		if e.Patch != "" {
+			t.Fatalf("%s has Patch %s with WithBlobStore", e.Path, e.Patch)
+		}
+		if e.Blob != "" && int64(len(store.blobs[e.Blob])) != e.PatchSize {
+			t.Fatalf("%s: blob of %d bytes, PatchSize %d", e.Path, len(store.blobs[e.Blob]), e.PatchSize)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(patchDir, dirBlobDir)); !os.IsNotExist(err) {
+		t.Fatalf("%s exists in outDir: %v", dirBlobDir, err)
+	}
+
+	if _, err := CreateDirDiff(oldDir, newDir, t.TempDir(), WithBlobStore(store)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.puts) != 3 {
+		t.Fatalf("second CreateDirDiff put %d more blobs, want none", len(store.puts)-3)
+	}
+
+	out := t.TempDir()
+	if err := ApplyDirDiff(oldDir, patchDir, out, WithBlobStore(store)); err != nil {
+		t.Fatal(err)
+	}
+	got := readTree(t, out)
+	for name, want := range newTree {
+		if !bytes.Equal(got[name], want) {
+			t.Fatalf("%s: %d bytes, want %d", name, len(got[name]), len(want))
+		}
+	}
+
+	if err := ApplyDirDiff(oldDir, patchDir, t.TempDir()); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("without WithBlobStore: got %v, want ErrInvalidArgument", err)
+	}
+	for _, e := range m.Entries {
+		if e.Path == "own.txt" {
+			store.blobs[e.Blob][0] ^= 0x01
+		}
+	}
+	if err := ApplyDirDiff(oldDir, patchDir, t.TempDir(), WithBlobStore(store)); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("corrupt blob: got %v, want ErrCorruptPatch", err)
+	}
+}
+
+// sha256Hex data 的小写十六进制 SHA-256，即 data 作为 blob 的 id
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestDirBlobStore NewDirBlobStore 拒绝内容与 id 不符的 blob 和不合法的 id，不留下文件；不存在的 blob 返回 fs.ErrNotExist
+func TestDirBlobStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blobs")
+	s := NewDirBlobStore(dir)
+	data := []byte("blob content\n")
+	id := sha256Hex(data)
+	if ok, err := s.Has(id); ok || err != nil {
+		t.Fatalf("Has before Put: %v, %v", ok, err)
+	}
+	if err := s.Put(sha256Hex([]byte("other")), bytes.NewReader(data)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Put with a wrong id: got %v, want ErrInvalidArgument", err)
+	}
+	if err := s.Put("../escape", bytes.NewReader(data)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Put with an invalid id: got %v, want ErrInvalidArgument", err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("%d files left after rejected Puts, %v", len(entries), err)
+	}
+	if err := s.Put(id, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Has(id); !ok || err != nil {
+		t.Fatalf("Has after Put: %v, %v", ok, err)
+	}
+	r, err := s.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Open: %q, %v", got, err)
+	}
+	if _, err := s.Open(sha256Hex([]byte("missing"))); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open of a missing blob: got %v, want fs.ErrNotExist", err)
+	}
+}
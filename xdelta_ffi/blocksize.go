@@ -0,0 +1,58 @@
+package xdelta_ffi
+
+import (
+	"math"
+	"math/bits"
+)
+
+// AutoBlockSize 作为 blockSize（或 WithBlockSize 的参数）传入时，由库根据输入大小自动选择块大小，
+// 选择的结果与 RecommendedBlockSize 相同
+const AutoBlockSize uint32 = 0
+
+// 推荐的块大小范围，在 [MinBlockSize, MaxBlockSize] 之内；签名表超过 recommendedMaxBlocks 个块时
+// 不再受 recommendedPeakBlockSize 的限制，每块的签名连同索引约 80 字节
+const (
+	recommendedMinBlockSize  uint32 = 16
+	recommendedPeakBlockSize uint32 = 512
+	recommendedMaxBlockSize  uint32 = 64 << 10
+	recommendedMaxBlocks            = 1 << 22
+)
+
+// RecommendedBlockSize 返回库对给定输入大小推荐的块大小，永远不为 0，
+// 调用方可以记录或保存这个值，也可以在它的基础上调整后通过 WithBlockSize 传入
+//
+// 取较大输入长度四次方根的 8 倍，向上取到 2 的幂，限制在 [16, 512]；签名表超过 4M 个块
+// （约 2 GiB 以上）时改为使块数不超过 4M 的块大小，最大 64 KiB，以控制签名表的内存和计算时间，例如
+// 1 KB 为 64，64 KB 为 128，1 MB 为 256，10 MB 为 512，2 GB 为 512，16 GiB 为 4096
+// 补丁中每个 COPY 有固定的开销，每处修改又要以 ADD 带上大约一个块的数据，最合适的块大小由修改的密度决定，
+// 修改大致随输入增长时几乎不随大小变化；blocksize_test.go 的基准在文本、可执行文件和已压缩数据上，
+// 对 64 KiB 到 16 MiB 的输入选出的块大小得到的补丁与 16 到 8192 之间最小的补丁相差不超过 15%；
+// 更小的输入差距可能更大，但补丁本身只有几 KB
+// 大小未知时传负数，两个都未知时返回 DefaultBlockSize
+func RecommendedBlockSize(oldLen, newLen int64) uint32 {
+	n := max(oldLen, newLen)
+	if n < 0 {
+		return DefaultBlockSize
+	}
+	size := min(max(ceilPow2(uint64(math.Ceil(8*math.Sqrt(math.Sqrt(float64(n)))))), uint64(recommendedMinBlockSize)), uint64(recommendedPeakBlockSize))
+	if uint64(n) > size*recommendedMaxBlocks {
+		size = min(ceilPow2((uint64(n)+recommendedMaxBlocks-1)/recommendedMaxBlocks), uint64(recommendedMaxBlockSize))
+	}
+	return uint32(size)
+}
+
+// ceilPow2 不小于 n 的最小的 2 的幂，n 为 0 时为 1
+func ceilPow2(n uint64) uint64 {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len64(n-1)
+}
+
+// resolveBlockSize blockSize 为 AutoBlockSize 时根据输入大小选择块大小，否则原样返回
+func resolveBlockSize(blockSize uint32, oldLen, newLen int64) uint32 {
+	if blockSize != AutoBlockSize {
+		return blockSize
+	}
+	return RecommendedBlockSize(oldLen, newLen)
+}
@@ -0,0 +1,302 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fixtureRand 生成测试数据用的 xorshift 伪随机数，结果只由种子决定
+type fixtureRand uint64
+
+func (r *fixtureRand) next() uint64 {
+	*r ^= *r << 13
+	*r ^= *r >> 7
+	*r ^= *r << 17
+	return uint64(*r)
+}
+
+func (r *fixtureRand) intn(n int) int { return int(r.next() % uint64(n)) }
+
+var fixtureWords = strings.Fields("func return if else for range err nil ctx opts buf len cap append make copy " +
+	"int64 uint32 byte string error struct type var const package import defer go select case switch default " +
+	"break continue map chan interface true false data size offset block patch window source target read write " +
+	"close open file path name value index count total")
+
+// fixtureLines 至少 n 字节像源码一样的文本行
+func fixtureLines(r *fixtureRand, n int) [][]byte {
+	var lines [][]byte
+	for size := 0; size < n; {
+		var b bytes.Buffer
+		b.WriteString(strings.Repeat("\t", r.intn(4)))
+		for k := 1 + r.intn(9); k > 0; k-- {
+			b.WriteString(fixtureWords[r.intn(len(fixtureWords))])
+			if r.intn(6) == 0 {
+				fmt.Fprintf(&b, "%d", r.intn(1000))
+			}
+			b.WriteByte(" (),.:=;"[r.intn(8)])
+		}
+		b.WriteByte('\n')
+		lines = append(lines, b.Bytes())
+		size += b.Len()
+	}
+	return lines
+}
+
+// textFixture 约 n 字节的文本和它的新版本：平均每 800 行删除、替换一行或插入 40 行，中间的一行总是被替换
+func textFixture(n int) (oldData, newData []byte) {
+	r := fixtureRand(1)
+	lines := fixtureLines(&r, n)
+	var out [][]byte
+	for i, l := range lines {
+		k := r.intn(800)
+		if i == len(lines)/2 {
+			k = 2
+		}
+		switch k {
+		case 0:
+			continue
+		case 1:
+			out = append(out, fixtureLines(&r, 40)...)
+		case 2:
+			out = append(out, fixtureLines(&r, 1)...)
+			continue
+		}
+		out = append(out, l)
+	}
+	return bytes.Join(lines, nil), bytes.Join(out, nil)
+}
+
+// executableFixture 约 n 字节的机器码和它的新版本：由函数组成，函数中每隔几十字节有一条 rel32 的 call
+// 调用附近的函数；平均每 400 个函数插入一个新函数（中间总有一个），跨过插入点的 call 的偏移随之改变，
+// 每 300 个函数改动一个字节
+func executableFixture(n int) (oldData, newData []byte) {
+	r := fixtureRand(2)
+	type call struct{ off, target int }
+	type function struct {
+		id    int
+		body  []byte
+		calls []call
+	}
+	newFunction := func(id int) function {
+		f := function{id: id, body: make([]byte, 16+r.intn(400))}
+		for i := range f.body {
+			f.body[i] = byte(r.next() % 64)
+		}
+		for i := 0; i+5 < len(f.body); i += 16 + r.intn(64) {
+			f.calls = append(f.calls, call{i, max(0, id+r.intn(64)-32)})
+		}
+		return f
+	}
+	link := func(fs []function) []byte {
+		addr := make(map[int]uint32, len(fs))
+		a := uint32(0x400000)
+		for _, f := range fs {
+			addr[f.id] = a
+			a += uint32(len(f.body))
+		}
+		var b []byte
+		for _, f := range fs {
+			body := bytes.Clone(f.body)
+			for _, c := range f.calls {
+				t, ok := addr[c.target]
+				if !ok {
+					t = addr[0]
+				}
+				t -= addr[f.id] + uint32(c.off) + 5
+				body[c.off] = 0xe8
+				body[c.off+1], body[c.off+2], body[c.off+3], body[c.off+4] = byte(t), byte(t>>8), byte(t>>16), byte(t>>24)
+			}
+			b = append(b, body...)
+		}
+		return b
+	}
+	var fs []function
+	for size := 0; size < n; {
+		f := newFunction(len(fs))
+		fs = append(fs, f)
+		size += len(f.body)
+	}
+	var changed []function
+	for i, f := range fs {
+		if i%400 == 7 || i == len(fs)/2 {
+			g := newFunction(len(fs))
+			g.id = -1 - i
+			changed = append(changed, g)
+		}
+		if i%300 == 3 {
+			f.body = bytes.Clone(f.body)
+			f.body[r.intn(len(f.body))]++
+		}
+		changed = append(changed, f)
+	}
+	return link(fs), link(changed)
+}
+
+// compressedFixture 约 n 字节、由逐个 deflate 压缩的文本文件组成的归档和它的新版本：
+// 每 5 个文件有一个（第一个总是）改动了一行，改动的文件压缩后从改动处起完全不同
+func compressedFixture(n int) (oldData, newData []byte) {
+	r := fixtureRand(4)
+	deflate := func(b []byte) []byte {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, 6)
+		w.Write(b)
+		w.Close()
+		return buf.Bytes()
+	}
+	for len(oldData) < n {
+		lines := fixtureLines(&r, min(n, 4096+r.intn(60000)))
+		oldData = append(oldData, deflate(bytes.Join(lines, nil))...)
+		if len(newData) == 0 || r.intn(5) == 0 {
+			lines[r.intn(len(lines))] = fixtureLines(&r, 1)[0]
+		}
+		newData = append(newData, deflate(bytes.Join(lines, nil))...)
+	}
+	return oldData, newData
+}
+
+var blockSizeFixtures = []struct {
+	name string
+	gen  func(n int) (oldData, newData []byte)
+}{
+	{"text", textFixture},
+	{"executable", executableFixture},
+	{"compressed", compressedFixture},
+}
+
+// 与 RecommendedBlockSize 比较的块大小：16 到 8192 之间的 2 的幂；基准中的输入上更大的块只会更差
+const (
+	fixtureMinBlockSize uint32 = 16
+	fixtureMaxBlockSize uint32 = 8192
+)
+
+// patchSizes 用 fixtureMinBlockSize 到 fixtureMaxBlockSize 之间的每个 2 的幂创建补丁，返回各自的补丁长度
+func patchSizes(tb testing.TB, oldData, newData []byte) map[uint32]int {
+	sizes := map[uint32]int{}
+	for bs := fixtureMinBlockSize; bs <= fixtureMaxBlockSize; bs *= 2 {
+		patch, err := CreateDiffsData(oldData, newData, bs)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		sizes[bs] = len(patch)
+	}
+	return sizes
+}
+
+// TestRecommendedBlockSizeFixtures 对文本、可执行文件和已压缩数据，推荐的块大小得到的补丁与最小的补丁相差不超过 15%
+func TestRecommendedBlockSizeFixtures(t *testing.T) {
+	requireNative(t)
+	lengths := []int{64 << 10, 256 << 10, 1 << 20, 4 << 20}
+	if testing.Short() {
+		lengths = lengths[:2]
+	}
+	for _, fx := range blockSizeFixtures {
+		for _, n := range lengths {
+			oldData, newData := fx.gen(n)
+			sizes := patchSizes(t, oldData, newData)
+			best := fixtureMinBlockSize
+			for bs, size := range sizes {
+				if size < sizes[best] {
+					best = bs
+				}
+			}
+			rec := RecommendedBlockSize(int64(len(oldData)), int64(len(newData)))
+			excess := float64(sizes[rec]-sizes[best]) / float64(sizes[best])
+			t.Logf("%s %d: recommended %d (%d bytes), best %d (%d bytes), +%.1f%%", fx.name, n, rec, sizes[rec], best, sizes[best], 100*excess)
+			if excess > 0.15 {
+				t.Errorf("%s %d: block size %d gives a %d byte patch, %.1f%% larger than %d bytes with block size %d",
+					fx.name, n, rec, sizes[rec], 100*excess, sizes[best], best)
+			}
+		}
+	}
+}
+
+// TestRecommendedBlockSize 推荐值的典型输入、上下限和未知大小
+func TestRecommendedBlockSize(t *testing.T) {
+	for _, tc := range []struct {
+		oldLen, newLen int64
+		want           uint32
+	}{
+		{0, 0, 16},
+		{-1, 10, 16},
+		{1000, 1000, 64},
+		{64 << 10, 60 << 10, 128},
+		{1 << 20, 1 << 20, 256},
+		{-1, 10_000_000, 512},
+		{2 << 30, 2 << 30, 512},
+		{16 << 30, -1, 4096},
+		{1 << 50, 1 << 50, 64 << 10},
+		{-1, -1, DefaultBlockSize},
+	} {
+		got := RecommendedBlockSize(tc.oldLen, tc.newLen)
+		if got != tc.want {
+			t.Errorf("RecommendedBlockSize(%d, %d) = %d, want %d", tc.oldLen, tc.newLen, got, tc.want)
+		}
+		if got < MinBlockSize || got > MaxBlockSize {
+			t.Errorf("RecommendedBlockSize(%d, %d) = %d is out of [%d, %d]", tc.oldLen, tc.newLen, got, MinBlockSize, MaxBlockSize)
+		}
+	}
+}
+
+// BenchmarkBlockSize 报告各个块大小在基准数据上的补丁长度（patch-bytes）和编码时间
+func BenchmarkBlockSize(b *testing.B) {
+	requireNative(b)
+	for _, fx := range blockSizeFixtures {
+		for _, n := range []int{64 << 10, 1 << 20, 16 << 20} {
+			oldData, newData := fx.gen(n)
+			for bs := fixtureMinBlockSize; bs <= fixtureMaxBlockSize; bs *= 2 {
+				b.Run(fmt.Sprintf("%s/%d/%d", fx.name, n, bs), func(b *testing.B) {
+					b.SetBytes(int64(len(newData)))
+					var size int
+					for i := 0; i < b.N; i++ {
+						patch, err := CreateDiffsData(oldData, newData, bs)
+						if err != nil {
+							b.Fatal(err)
+						}
+						size = len(patch)
+					}
+					b.ReportMetric(float64(size), "patch-bytes")
+				})
+			}
+		}
+	}
+}
+
+// TestAutoBlockSize AutoBlockSize 按输入大小选出 RecommendedBlockSize 的值，其他值原样使用
+func TestAutoBlockSize(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want uint32
+	}{
+		{1000, 64},
+		{10_000_000, 512},
+		{2_000_000_000, 512},
+	} {
+		if got := resolveBlockSize(AutoBlockSize, tc.n, tc.n); got != tc.want {
+			t.Errorf("AutoBlockSize for %d bytes = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+	if got := resolveBlockSize(4096, 1000, 1000); got != 4096 {
+		t.Errorf("block size 4096 resolved to %d", got)
+	}
+
+	requireNative(t)
+	oldData, newData := textFixture(256 << 10)
+	want, err := CreateDiffsData(oldData, newData, RecommendedBlockSize(int64(len(oldData)), int64(len(newData))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auto, err := CreateDiffsData(oldData, newData, AutoBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt, err := CreateDiffs(oldData, newData, WithBlockSize(AutoBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(auto, want) || !bytes.Equal(opt, want) {
+		t.Fatal("AutoBlockSize produced a different patch from the recommended block size")
+	}
+}
@@ -0,0 +1,259 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// bsdiff 4.x 补丁的格式：32 字节的文件头（"BSDIFF40"、控制块长度、差分块长度、新数据长度），
+// 之后依次是 bzip2 压缩的控制块、差分块和额外块
+// 控制块由 (add, copy, seek) 三元组组成：从差分块读 add 字节并逐字节加上旧数据，
+// 再从额外块原样复制 copy 字节，最后把旧数据的读取位置移动 seek
+var bsdiffMagic = []byte("BSDIFF40")
+
+const bsdiffHeaderLen = 32
+
+func isBSDiff(patch []byte) bool {
+	return bytes.HasPrefix(patch, bsdiffMagic)
+}
+
+// ApplyBSDiff 将 bsdiff 4.x（BSDIFF40）补丁应用到旧数据生成新数据，结果与参考实现 bspatch 相同
+// 补丁截断或损坏时返回 ErrCorruptPatch，不是 bsdiff 补丁时也一样；opts 与 ApplyDiffsData 相同，
+// 文件头声明的新数据长度超过 WithMaxOutputSize 时不做任何解压直接返回 ErrOutputTooLarge
+// 与 ApplyDiffsData 一样由原生层应用（没有原生后端的构建使用纯 Go 解码器），先完整检查一遍补丁再按实际长度分配输出；
+// 所有应用补丁的接口都会根据文件头自动识别这种补丁，包括流式和文件版本，但补丁要完整读入后才开始输出，旧数据的长度必须已知
+func ApplyBSDiff(oldData, patch []byte, opts ...Option) ([]byte, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseBSDiff(patch, o.outputLimit()); err != nil {
+		return nil, err
+	}
+	return ApplyDiffsData(oldData, patch, opts...)
+}
+
+// WithBSDiff 创建补丁时输出 bsdiff 4.x（BSDIFF40）补丁，而不是本库自己的补丁格式，与 WithCodec(BSDiff) 相同，
+// 这样的补丁可以直接用 bspatch old new patch 应用，本库所有应用补丁的接口也会自动识别（见 ApplyBSDiff）
+// 由原生层按参考实现 bsdiff 的算法（后缀数组加近似匹配扩展）生成，控制块与参考实现相同，三个数据块用 bzip2 压缩；
+// 对内存中的数据有效（CreateDiffs、CreateDiffsContext、CreateDiffsFixed、CreateDiffsToFile、CreateEnvelope 等），
+// 流式、文件版本和复用签名的接口返回 ErrInvalidArgument；不能与 WithStandardVCDIFF、WithSecondaryCompression、WithChecksum、
+// WithContentDefinedChunking、WithSourceWindowSize 和 WithSegmentSize 同时使用，WithBlockSize、WithThreads 和 WithNoCompress 无效
+// 编码比本库的格式慢得多，原生层的内存约为旧数据的 16 倍加新数据的 3 倍，适合只能运行 bspatch 的客户端；
+// 新数据中很长的重复内容（例如数 MB 连续的零）与参考实现一样编码时间随其长度平方增长；新旧数据相同时也按 bsdiff 编码，不生成恒等补丁
+func WithBSDiff() Option {
+	return func(o *options) {
+		o.bsdiff = true
+	}
+}
+
+// checkBSDiff 检查 WithBSDiff 与其他选项的组合
+func (o options) checkBSDiff() error {
+	switch {
+	case !o.bsdiff:
+		return nil
+	case o.vcdiff:
+		return fmt.Errorf("%w: WithBSDiff cannot be used with WithStandardVCDIFF", ErrInvalidArgument)
+	case o.secondary != SecondaryNone:
+		return fmt.Errorf("%w: secondary compression %v is not available with WithBSDiff", ErrInvalidArgument, o.secondary)
+	case o.checksum != ChecksumNone:
+		return fmt.Errorf("%w: checksum %v is not available with WithBSDiff", ErrInvalidArgument, o.checksum)
+	case o.cdcChunk != 0:
+		return fmt.Errorf("%w: WithBSDiff cannot be used with WithContentDefinedChunking", ErrInvalidArgument)
+	case o.sourceWindow > 0:
+		return fmt.Errorf("%w: WithBSDiff cannot be used with WithSourceWindowSize", ErrInvalidArgument)
+	case o.segmentSize > 0:
+		return fmt.Errorf("%w: WithBSDiff cannot be used with WithSegmentSize", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// checkIndexedBSDiff 复用块签名的接口（Encoder、SourceEncoder、SignatureIndex）逐窗口编码新数据，
+// 不能生成 bsdiff 补丁；在创建时就拒绝 WithBSDiff，而不是等到第一次编码
+func (o options) checkIndexedBSDiff() error {
+	if o.bsdiff {
+		return fmt.Errorf("%w: bsdiff patches can only be created from in-memory data", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// bsdiffCreateBytes 估计原生层创建 bsdiff 补丁的内存：后缀数组和它的逆各 8 字节每旧数据字节，
+// 差分块、额外块和压缩结果最多约为新数据的 3 倍，再加 bzip2 一个块的排序和编码状态
+func bsdiffCreateBytes(oldLen, newLen int64) int64 {
+	return 16*(oldLen+1) + 3*newLen + bzip2BlockBytes
+}
+
+// bzip2BlockBytes bzip2.rs 压缩一个 900 000 字节块时的工作内存
+const bzip2BlockBytes = 24 << 20
+
+// bsdiffApplyBytes 估计原生层应用 bsdiff 补丁的内存：完整缓存的补丁，加上三个块各自的解压状态
+// （每个块内字节 4 字节的 BWT 向量和一个块的输出）和两个 64 KiB 的缓冲区
+func bsdiffApplyBytes(patchLen int64) int64 {
+	return patchLen + 3*bzip2ReadBytes + 2*bsdiffChunk
+}
+
+// bzip2ReadBytes bzip2.rs 解压一个 900 000 字节块时的工作内存
+const bzip2ReadBytes = 5 << 20
+
+// bsdiffInt 解码 bsdiff 的 64 位整数：小端序，最高位是符号位，其余是绝对值
+func bsdiffInt(b []byte) int64 {
+	v := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		return -v
+	}
+	return v
+}
+
+func bsdiffCorrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: bsdiff: %s", ErrCorruptPatch, fmt.Sprintf(format, args...))
+}
+
+func bsdiffReadErr(block string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return bsdiffCorrupt("truncated %s block", block)
+	}
+	return bsdiffCorrupt("%s block: %v", block, err)
+}
+
+// addOffset 返回 a+b，溢出时 ok 为 false
+func addOffset(a, b int64) (sum int64, ok bool) {
+	sum = a + b
+	return sum, (b >= 0) == (sum >= a)
+}
+
+// bsdiffPatch 解析后的文件头和三个压缩块
+type bsdiffPatch struct {
+	newSize           int64
+	ctrl, diff, extra []byte
+	// onEntry 不为 nil 时，apply 在执行每个控制项之前调用它，newPos、oldPos 为当前的读写位置
+	onEntry func(newPos, oldPos, add, cp, seek int64) error
+}
+
+// parseBSDiff 检查文件头，limit 为 0 表示不限制输出大小
+func parseBSDiff(patch []byte, limit uint64) (bsdiffPatch, error) {
+	var p bsdiffPatch
+	if len(patch) < bsdiffHeaderLen {
+		return p, bsdiffCorrupt("truncated header")
+	}
+	if !isBSDiff(patch) {
+		return p, bsdiffCorrupt("bad magic")
+	}
+	ctrlLen, diffLen, newSize := bsdiffInt(patch[8:]), bsdiffInt(patch[16:]), bsdiffInt(patch[24:])
+	body := patch[bsdiffHeaderLen:]
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || ctrlLen > int64(len(body)) || diffLen > int64(len(body))-ctrlLen {
+		return p, bsdiffCorrupt("invalid header")
+	}
+	if limit > 0 && uint64(newSize) > limit {
+		return p, fmt.Errorf("%w: bsdiff patch declares %d bytes of output, the limit is %d", ErrOutputTooLarge, newSize, limit)
+	}
+	p.newSize = newSize
+	p.ctrl, p.diff, p.extra = body[:ctrlLen], body[ctrlLen:ctrlLen+diffLen], body[ctrlLen+diffLen:]
+	return p, nil
+}
+
+// bsdiffChunk 差分块每次解压并加上旧数据的字节数
+const bsdiffChunk = 64 << 10
+
+// bsdiffStats 应用过程中统计的控制项个数，以及来自差分块和额外块的字节数
+type bsdiffStats struct {
+	entries, diffBytes, extraBytes int64
+}
+
+// apply 把新数据按顺序写入 w，从 old 读取 oldSize 字节的旧数据，内存占用与新数据的大小无关；
+// old 为 nil 时只检查结构，三个块照常解压
+func (p bsdiffPatch) apply(w io.Writer, old io.ReaderAt, oldSize int64) (bsdiffStats, error) {
+	ctrl := bzip2.NewReader(bytes.NewReader(p.ctrl))
+	diff := bzip2.NewReader(bytes.NewReader(p.diff))
+	extra := bzip2.NewReader(bytes.NewReader(p.extra))
+
+	var entry [24]byte
+	var scratch, oldBuf []byte
+	var st bsdiffStats
+	var newPos, oldPos int64
+	for newPos < p.newSize {
+		if _, err := io.ReadFull(ctrl, entry[:]); err != nil {
+			return st, bsdiffReadErr("control", err)
+		}
+		add, cp, seek := bsdiffInt(entry[0:]), bsdiffInt(entry[8:]), bsdiffInt(entry[16:])
+		if add < 0 || cp < 0 || add > p.newSize-newPos || cp > p.newSize-newPos-add {
+			return st, bsdiffCorrupt("control entry exceeds the new size")
+		}
+		oldEnd, ok := addOffset(oldPos, add)
+		if !ok {
+			return st, bsdiffCorrupt("old offset overflows")
+		}
+		if p.onEntry != nil {
+			if err := p.onEntry(newPos, oldPos, add, cp, seek); err != nil {
+				return st, err
+			}
+		}
+
+		if add > 0 && scratch == nil {
+			scratch = make([]byte, bsdiffChunk)
+			if old != nil {
+				oldBuf = make([]byte, bsdiffChunk)
+			}
+		}
+		for done := int64(0); done < add; {
+			chunk := scratch[:min(add-done, bsdiffChunk)]
+			if _, err := io.ReadFull(diff, chunk); err != nil {
+				return st, bsdiffReadErr("diff", err)
+			}
+			// 与 bspatch 一致，落在旧数据范围之外的字节不做加法
+			pos := oldPos + done
+			if lo, hi := max(-pos, 0), min(int64(len(chunk)), oldSize-pos); old != nil && lo < hi {
+				ob := oldBuf[:hi-lo]
+				if n, err := old.ReadAt(ob, pos+lo); n < len(ob) {
+					if err == nil || err == io.EOF {
+						err = fmt.Errorf("%w: old data is shorter than %d bytes", ErrSourceMismatch, oldSize)
+					}
+					return st, err
+				}
+				for i, b := range ob {
+					chunk[lo+int64(i)] += b
+				}
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return st, err
+			}
+			done += int64(len(chunk))
+		}
+		newPos += add
+		oldPos = oldEnd
+		st.entries++
+		st.diffBytes += add
+		st.extraBytes += cp
+
+		if _, err := io.CopyN(w, extra, cp); err != nil {
+			return st, bsdiffReadErr("extra", err)
+		}
+		newPos += cp
+		if oldPos, ok = addOffset(oldPos, seek); !ok {
+			return st, bsdiffCorrupt("old offset overflows")
+		}
+	}
+	for _, blk := range []struct {
+		name string
+		r    io.Reader
+	}{{"control", ctrl}, {"diff", diff}, {"extra", extra}} {
+		if err := bsdiffBlockEnd(blk.r); err != nil {
+			return st, bsdiffReadErr(blk.name, err)
+		}
+	}
+	return st, nil
+}
+
+// bsdiffBlockEnd 读到 bzip2 流的结尾，让解压器校验流末尾的 CRC，截断的块因此不会被当作完整的补丁
+// bspatch 忽略块中多余的数据，这里也一样：还有数据时直接返回
+func bsdiffBlockEnd(r io.Reader) error {
+	var b [1]byte
+	_, err := r.Read(b[:])
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,403 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestBSDiffApplyPaths WithCodec(BSDiff) 生成的补丁在每个应用接口上都由原生层应用
+func TestBSDiffApplyPaths(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData, WithCodec(BSDiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := DetectCodec(patch); c != BSDiff {
+		t.Fatalf("DetectCodec = %v, want BSDiff", c)
+	}
+	paths := applyPaths(t.TempDir(), oldData, patch)
+	delete(paths, "ApplyDiffsInPlace")
+	paths["ApplyBSDiff"] = func() ([]byte, error) { return ApplyBSDiff(oldData, patch) }
+	paths["ApplyDiffsFixed"] = func() ([]byte, error) {
+		dst := make([]byte, len(newData))
+		n, err := ApplyDiffsFixed(dst, oldData, patch)
+		return dst[:n], err
+	}
+	for name, apply := range paths {
+		t.Run(name, func(t *testing.T) {
+			got, err := apply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, newData) {
+				t.Fatalf("got %d bytes, want %d", len(got), len(newData))
+			}
+		})
+	}
+}
+
+// TestBSDiffCodecSelection WithCodec 与 WithBSDiff 按先后顺序生效，XDelta 生成本库格式
+func TestBSDiffCodecSelection(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want Codec
+	}{
+		{"default", nil, XDelta},
+		{"XDelta", []Option{WithCodec(XDelta)}, XDelta},
+		{"BSDiff", []Option{WithCodec(BSDiff)}, BSDiff},
+		{"WithBSDiff then XDelta", []Option{WithBSDiff(), WithCodec(XDelta)}, XDelta},
+		{"nil", []Option{WithBSDiff(), WithCodec(nil)}, XDelta},
+		{"VCDIFF", []Option{WithStandardVCDIFF()}, XDelta},
+	} {
+		patch, err := CreateDiffs(oldData, newData, tc.opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := DetectCodec(patch); got != tc.want {
+			t.Fatalf("%s: DetectCodec = %v, want %v", tc.name, got.Name(), tc.want.Name())
+		}
+		info, err := InspectPatch(patch)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if name := tc.want.Name(); info.Format != name && !(info.Format == "vcdiff" && name == "native") {
+			t.Fatalf("%s: InspectPatch format %q, codec %q", tc.name, info.Format, name)
+		}
+	}
+	if DetectCodec(nil) != nil || DetectCodec([]byte("not a patch")) != nil {
+		t.Fatal("DetectCodec recognises data that is not a patch")
+	}
+}
+
+// libbz2Pair testdata/libbz2.bsdiff 的新旧数据：补丁按 BSDIFF40 的布局拼出，三个块由 libbz2（Python 的 bz2 模块）压缩，
+// 差分块跨越多个 bzip2 块；补丁不是 bsdiff 工具生成的，与真实 bsdiff 的互通见 TestBSDiffTool
+func libbz2Pair() (oldData, newData []byte) {
+	lcg := func(seed uint32, n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			seed = seed*1103515245 + 12345
+			b[i] = byte(seed >> 16)
+		}
+		return b
+	}
+	oldData = lcg(1, 400000)
+	a := bytes.Clone(oldData[:200000])
+	for i := 0; i < len(a); i += 3 {
+		a[i]++
+	}
+	b := bytes.Clone(oldData[100000:250000])
+	for i := 0; i < len(b); i += 1013 {
+		b[i] += 3
+	}
+	newData = append(append(a, lcg(2, 5000)...), b...)
+	return oldData, newData
+}
+
+// TestBSDiffLibbz2 原生层的 bzip2 解压器读取 libbz2 写出的块
+func TestBSDiffLibbz2(t *testing.T) {
+	requireNative(t)
+	patch, err := os.ReadFile(filepath.Join("testdata", "libbz2.bsdiff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldData, newData := libbz2Pair()
+	got, err := ApplyDiffsData(oldData, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newData) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(newData))
+	}
+	var b bytes.Buffer
+	if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), newData) {
+		t.Fatalf("ApplyDiffsStream: got %d bytes, want %d", b.Len(), len(newData))
+	}
+	ranges, err := SourceRanges(patch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []SourceRange{{0, 250000}}; len(ranges) != 1 || ranges[0] != want[0] {
+		t.Fatalf("SourceRanges = %v, want %v", ranges, want)
+	}
+}
+
+// TestBSDiffTruncated 截断的 bsdiff 补丁在原生层被拒绝
+func TestBSDiffTruncated(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData, WithCodec(BSDiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n < len(patch); n++ {
+		if _, err := ApplyDiffsData(oldData, patch[:n]); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("ApplyDiffsData of %d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+		}
+		var b bytes.Buffer
+		if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch[:n]), &b); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("ApplyDiffsStream of %d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+		}
+	}
+}
+
+// unsizedReader 没有 Size 方法的 io.ReaderAt，旧数据的长度未知
+type unsizedReader struct{ r io.ReaderAt }
+
+func (u unsizedReader) ReadAt(p []byte, off int64) (int, error) { return u.r.ReadAt(p, off) }
+
+// TestBSDiffUnsupported 无法应用 bsdiff 补丁的接口返回 ErrUnsupportedPatch
+func TestBSDiffUnsupported(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData, WithCodec(BSDiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := ApplyDiffsStream(unsizedReader{bytes.NewReader(oldData)}, bytes.NewReader(patch), &b); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("ApplyDiffsStream without the old data length: got %v, want ErrUnsupportedPatch", err)
+	}
+	p := filepath.Join(t.TempDir(), "inplace")
+	if err := os.WriteFile(p, oldData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyDiffsInPlace(p, patch); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("ApplyDiffsInPlace: got %v, want ErrUnsupportedPatch", err)
+	}
+	if _, err := MergePatches(patch, patch); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("MergePatches: got %v, want ErrUnsupportedPatch", err)
+	}
+}
+
+// bspatch 参考实现 bspatch 4.3 的直接移植，作为测试中的对照：旧数据范围之外的字节不加到差分字节上
+func bspatch(tb testing.TB, oldData, patch []byte) []byte {
+	tb.Helper()
+	offtin := func(b []byte) int64 {
+		v := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+		if b[7]&0x80 != 0 {
+			v = -v
+		}
+		return v
+	}
+	if len(patch) < 32 || !bytes.Equal(patch[:8], []byte("BSDIFF40")) {
+		tb.Fatal("bspatch: not a BSDIFF40 patch")
+	}
+	ctrlLen, diffLen, newSize := offtin(patch[8:]), offtin(patch[16:]), offtin(patch[24:])
+	body := patch[32:]
+	ctrl := bzip2.NewReader(bytes.NewReader(body[:ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(body[ctrlLen : ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(body[ctrlLen+diffLen:]))
+	newData := make([]byte, newSize)
+	var oldPos, newPos int64
+	for newPos < newSize {
+		var entry [24]byte
+		if _, err := io.ReadFull(ctrl, entry[:]); err != nil {
+			tb.Fatalf("bspatch: control block: %v", err)
+		}
+		add, cp, seek := offtin(entry[:]), offtin(entry[8:]), offtin(entry[16:])
+		if _, err := io.ReadFull(diff, newData[newPos:newPos+add]); err != nil {
+			tb.Fatalf("bspatch: diff block: %v", err)
+		}
+		for i := range add {
+			if oldPos+i >= 0 && oldPos+i < int64(len(oldData)) {
+				newData[newPos+i] += oldData[oldPos+i]
+			}
+		}
+		newPos += add
+		oldPos += add
+		if _, err := io.ReadFull(extra, newData[newPos:newPos+cp]); err != nil {
+			tb.Fatalf("bspatch: extra block: %v", err)
+		}
+		newPos += cp
+		oldPos += seek
+	}
+	return newData
+}
+
+// TestBSDiffReference 测试中移植的 bspatch 能应用的补丁本库得到相同结果：testdata/bsdiff-seek.bsdiff 手工构造了
+// 向后移动读取位置、读取旧数据两端之外的字节、只有额外块或全空的控制项；还有 libbz2.bsdiff 和原生层生成的补丁。
+// 前两个补丁在没有原生后端的构建中由纯 Go 解码器应用
+func TestBSDiffReference(t *testing.T) {
+	check := func(name string, oldData, patch []byte) {
+		t.Helper()
+		want := bspatch(t, oldData, patch)
+		got, err := ApplyBSDiff(oldData, patch)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: ApplyBSDiff returned %d bytes, %v; bspatch %d bytes", name, len(got), err, len(want))
+		}
+		var b bytes.Buffer
+		if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b); err != nil || !bytes.Equal(b.Bytes(), want) {
+			t.Fatalf("%s: ApplyDiffsStream wrote %d bytes, %v; bspatch %d bytes", name, b.Len(), err, len(want))
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		old  func() (oldData, newData []byte)
+	}{
+		{"bsdiff-seek.bsdiff", testPair},
+		{"libbz2.bsdiff", libbz2Pair},
+	} {
+		patch, err := os.ReadFile(filepath.Join("testdata", tc.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldData, _ := tc.old()
+		check(tc.name, oldData, patch)
+	}
+
+	requireNative(t)
+	for _, n := range []int{1 << 10, 64 << 10, 512 << 10} {
+		oldData, newData := textFixture(n)
+		patch, err := CreateDiffs(oldData, newData, WithBSDiff())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bspatch(t, oldData, patch), newData) {
+			t.Fatalf("%d bytes: bspatch does not reproduce the new data", n)
+		}
+		check(fmt.Sprintf("textFixture(%d)", n), oldData, patch)
+	}
+}
+
+// TestBSDiffHeader 不是 bsdiff 补丁时 ApplyBSDiff 返回 ErrCorruptPatch；文件头声明的新数据超过 WithMaxOutputSize 时
+// 直接返回 ErrOutputTooLarge
+func TestBSDiffHeader(t *testing.T) {
+	oldData, _ := testPair()
+	patch, err := os.ReadFile(filepath.Join("testdata", "bsdiff-seek.bsdiff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][]byte{nil, []byte("BSDIFF4"), []byte("BSDIFF41" + string(patch[8:])), patch[:31]} {
+		if _, err := ApplyBSDiff(oldData, p); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("ApplyBSDiff(% x...): got %v, want ErrCorruptPatch", p[:min(len(p), 8)], err)
+		}
+	}
+	if _, err := ApplyBSDiff(oldData, patch, WithMaxOutputSize(100)); !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("ApplyBSDiff with a smaller output limit: got %v, want ErrOutputTooLarge", err)
+	}
+}
+
+// TestBSDiffTool 与参考实现 bsdiff 4.3 的命令行工具互通：本库应用 bsdiff 创建的补丁，bspatch 应用本库的补丁。
+// PATH 中没有 bsdiff 和 bspatch 时跳过
+func TestBSDiffTool(t *testing.T) {
+	requireNative(t)
+	bsdiffPath, err := exec.LookPath("bsdiff")
+	if err != nil {
+		t.Skip("bsdiff not found")
+	}
+	bspatchPath, err := exec.LookPath("bspatch")
+	if err != nil {
+		t.Skip("bspatch not found")
+	}
+	dir := t.TempDir()
+	for name, pair := range map[string]func() ([]byte, []byte){
+		"text":     func() ([]byte, []byte) { return textFixture(256 << 10) },
+		"libbz2":   libbz2Pair,
+		"testPair": testPair,
+	} {
+		oldData, newData := pair()
+		paths := writeFiles(t, dir, map[string][]byte{name + ".old": oldData, name + ".new": newData})
+		oldPath, newPath := paths[name+".old"], paths[name+".new"]
+
+		patchPath := filepath.Join(dir, name+".bsdiff")
+		if out, err := exec.Command(bsdiffPath, oldPath, newPath, patchPath).CombinedOutput(); err != nil {
+			t.Fatalf("%s: bsdiff: %v\n%s", name, err, out)
+		}
+		patch, err := os.ReadFile(patchPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ApplyBSDiff(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: ApplyBSDiff of the bsdiff patch returned %d bytes, %v", name, len(got), err)
+		}
+		var b bytes.Buffer
+		if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b); err != nil || !bytes.Equal(b.Bytes(), newData) {
+			t.Fatalf("%s: ApplyDiffsStream of the bsdiff patch wrote %d bytes, %v", name, b.Len(), err)
+		}
+
+		ours, err := CreateDiffs(oldData, newData, WithBSDiff())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		oursPath := writeFiles(t, dir, map[string][]byte{name + ".ours": ours})[name+".ours"]
+		outPath := filepath.Join(dir, name+".out")
+		if out, err := exec.Command(bspatchPath, oldPath, outPath, oursPath).CombinedOutput(); err != nil {
+			t.Fatalf("%s: bspatch: %v\n%s", name, err, out)
+		}
+		if got, err := os.ReadFile(outPath); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: bspatch wrote %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+// bsdiffToolFixtures testdata/bsdiff-tool 中由参考实现 bsdiff 生成的补丁及其新旧文件（testdata 中的文件名）
+var bsdiffToolFixtures = []struct{ name, old, new string }{
+	{"text.bsdiff", "text.old", "text.new"},
+	{"text-reverse.bsdiff", "text.new", "text.old"},
+}
+
+// TestBSDiffToolFixtures 应用 testdata/bsdiff-tool 中检入的、由参考实现 bsdiff 4.3 生成的补丁（见 bsdiffToolFixtures）：
+// ApplyBSDiff、ApplyDiffsStream 和测试中移植的 bspatch 都得到新文件，截断的补丁返回 ErrCorruptPatch。
+// PATH 中有 bsdiff 时 go test -run TestBSDiffToolFixtures -update 用它重新生成这些补丁；缺少任何一个补丁时失败
+func TestBSDiffToolFixtures(t *testing.T) {
+	dir := filepath.Join("testdata", "bsdiff-tool")
+	if *updateGolden {
+		bsdiffPath, err := exec.LookPath("bsdiff")
+		if err != nil {
+			t.Fatal("-update needs bsdiff on PATH")
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range bsdiffToolFixtures {
+			if out, err := exec.Command(bsdiffPath, filepath.Join("testdata", f.old), filepath.Join("testdata", f.new), filepath.Join(dir, f.name)).CombinedOutput(); err != nil {
+				t.Fatalf("bsdiff %s %s: %v\n%s", f.old, f.new, err, out)
+			}
+		}
+	}
+	for _, f := range bsdiffToolFixtures {
+		if _, err := os.Stat(filepath.Join(dir, f.name)); err != nil {
+			t.Fatalf("no bsdiff output %s in testdata/bsdiff-tool; run with -update where bsdiff is installed: %v", f.name, err)
+		}
+	}
+	for _, f := range bsdiffToolFixtures {
+		read := func(name string) []byte {
+			t.Helper()
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		oldData, newData := read(filepath.Join("testdata", f.old)), read(filepath.Join("testdata", f.new))
+		patch := read(filepath.Join(dir, f.name))
+		if got := bspatch(t, oldData, patch); !bytes.Equal(got, newData) {
+			t.Fatalf("%s: the bspatch port returned %d bytes, want %d", f.name, len(got), len(newData))
+		}
+		if got, err := ApplyBSDiff(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: ApplyBSDiff returned %d bytes, %v", f.name, len(got), err)
+		}
+		var b bytes.Buffer
+		if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b); err != nil || !bytes.Equal(b.Bytes(), newData) {
+			t.Fatalf("%s: ApplyDiffsStream wrote %d bytes, %v", f.name, b.Len(), err)
+		}
+		if _, err := ApplyBSDiff(oldData, patch[:len(patch)-1]); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s truncated: got %v, want ErrCorruptPatch", f.name, err)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 包的格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'B' 'N' 'D' 0D 0A
+//	version      1 字节  当前为 1
+//	数据                 各个补丁依次排列，内容相同的补丁只出现一次
+//	索引
+//	  manifest 长度 4 字节，之后是 JSON 编码的清单（格式见 DirManifestVersion）
+//	  项数          4 字节，之后每项为：
+//	    name 长度 2 字节、name（清单中的 Patch 路径）、offset 8 字节、size 8 字节、SHA-256 32 字节
+//	结尾 56 字节
+//	  index offset  8 字节
+//	  index size    8 字节
+//	  index hash   32 字节  索引的 SHA-256
+//	  magic         8 字节  与开头相同
+//
+// 索引在最后，写入时不需要回头修改；打开时只读取开头、结尾和索引，每个补丁在读取时才按索引中的 SHA-256 校验
+var bundleMagic = []byte{0x89, 'X', 'D', 'B', 'N', 'D', 0x0D, 0x0A}
+
+const (
+	// BundleVersion WriteBundle 写入的包格式版本
+	BundleVersion = 1
+
+	bundleHeaderLen  = 8 + 1
+	bundleTrailerLen = 8 + 8 + sha256.Size + 8
+	bundleEntryLen   = 2 + 8 + 8 + sha256.Size
+)
+
+// WriteBundle 把清单和它引用的补丁（以清单中的 Patch 路径为键，内容与 CreateDirDiff 写在 outDir 中的文件相同）
+// 写成一个单独的包，用 OpenBundle 读取，ApplyDirDiff 也可以直接应用包文件
+// 清单中引用的补丁缺失或键不是合法的相对路径时返回 ErrInvalidArgument，清单未引用的补丁同样写入；
+// 补丁按路径排序写入，内容相同的补丁只写入第一个，索引中的各项指向同一段数据；相同的输入总是得到相同的包
+// 清单中只有 Blob 的项（WithBlobStore）不需要 patches 中的内容，应用这样的包时需要 WithBlobStore
+func WriteBundle(manifest *DirManifest, patches map[string][]byte, w io.Writer) error {
+	if manifest == nil {
+		return fmt.Errorf("%w: nil manifest", ErrInvalidArgument)
+	}
+	for _, e := range manifest.Entries {
+		if e.Patch == "" {
+			continue
+		}
+		if _, ok := patches[e.Patch]; !ok {
+			return fmt.Errorf("%w: patch %s of %s is missing", ErrInvalidArgument, e.Patch, e.Path)
+		}
+	}
+	names := make([]string, 0, len(patches))
+	for name := range patches {
+		names = append(names, name)
+	}
+	return writeBundle(manifest, names, func(name string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(patches[name])), nil
+	}, w)
+}
+
+// writeBundle 把清单和 names 中的补丁写成包，open 返回补丁的内容；每个补丁读取两次，先计算 SHA-256 判断是否重复，再写入
+func writeBundle(manifest *DirManifest, names []string, open func(name string) (io.ReadCloser, error), w io.Writer) error {
+	for _, name := range names {
+		if !localPath(name) || len(name) > 0xFFFF {
+			return fmt.Errorf("%w: patch name %q is not a relative path", ErrInvalidArgument, name)
+		}
+	}
+	sort.Strings(names)
+	mdata, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	offset := uint64(bundleHeaderLen)
+	var index bytes.Buffer
+	index.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(mdata))))
+	index.Write(mdata)
+	index.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(names))))
+	if _, err := w.Write(append(append([]byte(nil), bundleMagic...), BundleVersion)); err != nil {
+		return err
+	}
+	// written 已经写入的内容的 SHA-256 及其偏移
+	written := make(map[[sha256.Size]byte]uint64)
+	for _, name := range names {
+		sum, size, err := copyBundlePatch(name, open, io.Discard)
+		if err != nil {
+			return err
+		}
+		at, ok := written[sum]
+		if !ok {
+			again, _, err := copyBundlePatch(name, open, w)
+			if err != nil {
+				return err
+			}
+			if again != sum {
+				return fmt.Errorf("%s changed while the bundle was written", name)
+			}
+			at = offset
+			written[sum] = at
+			offset += uint64(size)
+		}
+		b := binary.LittleEndian.AppendUint16(nil, uint16(len(name)))
+		b = append(b, name...)
+		b = binary.LittleEndian.AppendUint64(b, at)
+		b = binary.LittleEndian.AppendUint64(b, uint64(size))
+		index.Write(append(b, sum[:]...))
+	}
+	sum := sha256.Sum256(index.Bytes())
+	trailer := binary.LittleEndian.AppendUint64(nil, offset)
+	trailer = binary.LittleEndian.AppendUint64(trailer, uint64(index.Len()))
+	trailer = append(trailer, sum[:]...)
+	index.Write(append(trailer, bundleMagic...))
+	_, err = index.WriteTo(w)
+	return err
+}
+
+// copyBundlePatch 把补丁 name 的内容写入 w，同时计算 SHA-256，返回 SHA-256 和长度
+func copyBundlePatch(name string, open func(name string) (io.ReadCloser, error), w io.Writer) ([sha256.Size]byte, int64, error) {
+	r, err := open(name)
+	if err != nil {
+		return [sha256.Size]byte{}, 0, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return [sha256.Size]byte{}, 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return [sha256.Size]byte(h.Sum(nil)), n, nil
+}
+
+// CreateDirBundle 与 CreateDirDiff 相同，但结果不是目录，而是 WriteBundle 格式的单个包，写入 w：补丁先生成在临时目录中，
+// 再逐个读出写入包，内存占用与补丁的大小无关；用 ApplyDirDiff（包文件）、ApplyDirBundle 或 ApplyDirDiffFS 应用
+// opts 与 CreateDirDiff 相同；WithBlobStore 时 blob 保存在 store 中，包中只有清单
+func CreateDirBundle(oldDir, newDir string, w io.Writer, opts ...Option) (*DirManifest, error) {
+	tmp, err := os.MkdirTemp("", "xdelta-bundle-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	m, err := CreateDirDiff(oldDir, newDir, tmp, opts...)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range m.Entries {
+		if e.Patch != "" && !seen[e.Patch] {
+			seen[e.Patch] = true
+			names = append(names, e.Patch)
+		}
+	}
+	err = writeBundle(m, names, func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(tmp, filepath.FromSlash(name)))
+	}, w)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ApplyDirBundle 与 ApplyDirDiff 相同，但补丁是 OpenBundle 打开的包，例如内存中的包（bytes.NewReader）或网络上的包；
+// outDir 与 baseDir 相同时就地更新。opts 和错误与 ApplyDirDiff 相同，bundle 为 nil 时返回 ErrInvalidArgument
+func ApplyDirBundle(baseDir string, bundle *Bundle, outDir string, opts ...Option) error {
+	if bundle == nil {
+		return fmt.Errorf("%w: nil bundle", ErrInvalidArgument)
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	inPlace := isWithin(outDir, baseDir) && isWithin(baseDir, outDir)
+	a := &dirApply{o: o, base: baseDir, bundle: bundle, out: outDir, inPlace: inPlace}
+	return a.run(bundle.Manifest)
+}
+
+// Bundle OpenBundle 打开的包，可以并发读取其中的补丁
+type Bundle struct {
+	// Manifest 包中的清单
+	Manifest *DirManifest
+
+	r       io.ReaderAt
+	entries map[string]bundleEntry
+}
+
+type bundleEntry struct {
+	offset, size int64
+	sum          [sha256.Size]byte
+}
+
+// OpenBundle 读取 r 中 WriteBundle 写出的包的索引（size 为包的总长度），补丁在读取时才校验
+// 包被截断、索引的 SHA-256 不一致、清单不合法或引用了包中没有的补丁时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func OpenBundle(r io.ReaderAt, size int64) (*Bundle, error) {
+	if size < bundleHeaderLen+bundleTrailerLen {
+		return nil, fmt.Errorf("%w: bundle is truncated", ErrCorruptPatch)
+	}
+	hdr := make([]byte, bundleHeaderLen)
+	if err := readFullAt(r, hdr, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(hdr, bundleMagic) {
+		return nil, fmt.Errorf("%w: missing bundle magic", ErrCorruptPatch)
+	}
+	if v := hdr[len(bundleMagic)]; v != BundleVersion {
+		return nil, fmt.Errorf("%w: bundle version %d", ErrUnsupportedPatch, v)
+	}
+	trailer := make([]byte, bundleTrailerLen)
+	if err := readFullAt(r, trailer, size-bundleTrailerLen); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[bundleTrailerLen-len(bundleMagic):], bundleMagic) {
+		return nil, fmt.Errorf("%w: bundle is truncated or its trailer is damaged", ErrCorruptPatch)
+	}
+	indexOffset := binary.LittleEndian.Uint64(trailer)
+	indexSize := binary.LittleEndian.Uint64(trailer[8:])
+	dataEnd := uint64(size - bundleTrailerLen)
+	if indexOffset < bundleHeaderLen || indexOffset > dataEnd || indexSize != dataEnd-indexOffset {
+		return nil, fmt.Errorf("%w: bundle index out of range", ErrCorruptPatch)
+	}
+	index := make([]byte, indexSize)
+	if err := readFullAt(r, index, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(index) != [sha256.Size]byte(trailer[16:]) {
+		return nil, fmt.Errorf("%w: bundle index SHA-256 mismatch", ErrCorruptPatch)
+	}
+
+	b := &Bundle{r: r, entries: make(map[string]bundleEntry)}
+	if err := b.parseIndex(index, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	for _, e := range b.Manifest.Entries {
+		if _, ok := b.entries[e.Patch]; e.Patch != "" && !ok {
+			return nil, fmt.Errorf("%w: bundle has no patch %s for %s", ErrCorruptPatch, e.Patch, e.Path)
+		}
+	}
+	return b, nil
+}
+
+// readFullAt 读满 buf，数据不足时（size 大于实际长度）返回 ErrCorruptPatch
+func readFullAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return fmt.Errorf("%w: bundle is truncated", ErrCorruptPatch)
+	}
+	return err
+}
+
+// parseIndex 解析索引，数据都位于 [bundleHeaderLen, dataEnd) 之内
+func (b *Bundle) parseIndex(index []byte, dataEnd int64) error {
+	corrupt := func(format string, args ...any) error {
+		return fmt.Errorf("%w: bundle index: %s", ErrCorruptPatch, fmt.Sprintf(format, args...))
+	}
+	if len(index) < 4 {
+		return corrupt("truncated")
+	}
+	n := binary.LittleEndian.Uint32(index)
+	if uint64(len(index)-4) < uint64(n)+4 {
+		return corrupt("truncated")
+	}
+	m, err := LoadManifest(bytes.NewReader(index[4 : 4+n]))
+	if err != nil {
+		return err
+	}
+	b.Manifest = m
+	index = index[4+n:]
+	count := binary.LittleEndian.Uint32(index)
+	index = index[4:]
+	for range count {
+		if len(index) < 2 {
+			return corrupt("truncated")
+		}
+		l := int(binary.LittleEndian.Uint16(index))
+		if len(index) < bundleEntryLen+l {
+			return corrupt("truncated")
+		}
+		name := string(index[2 : 2+l])
+		rec := index[2+l:]
+		offset, size := binary.LittleEndian.Uint64(rec), binary.LittleEndian.Uint64(rec[8:])
+		if !localPath(name) {
+			return corrupt("patch name %q is not a relative path", name)
+		}
+		if _, ok := b.entries[name]; ok {
+			return corrupt("patch %s listed twice", name)
+		}
+		if offset < bundleHeaderLen || offset > uint64(dataEnd) || size > uint64(dataEnd)-offset {
+			return corrupt("patch %s out of range", name)
+		}
+		b.entries[name] = bundleEntry{offset: int64(offset), size: int64(size), sum: [sha256.Size]byte(rec[16:])}
+		index = index[bundleEntryLen+l:]
+	}
+	if len(index) != 0 {
+		return corrupt("%d trailing bytes", len(index))
+	}
+	return nil
+}
+
+// Names 返回包中所有补丁的路径，按字典序排列
+func (b *Bundle) Names() []string {
+	names := make([]string, 0, len(b.entries))
+	for name := range b.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WritePatchTo 把路径为 name 的补丁写入 w，返回写入的字节数；只读取这个补丁所在的区间
+// 包中没有 name 时返回 fs.ErrNotExist；内容与索引中的 SHA-256 不一致时返回 ErrCorruptPatch，此时 w 中已经写入的内容不可用
+func (b *Bundle) WritePatchTo(name string, w io.Writer) (int64, error) {
+	r, err := b.open(name)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, r)
+}
+
+// ReadPatch 返回路径为 name 的补丁，错误与 WritePatchTo 相同
+func (b *Bundle) ReadPatch(name string) ([]byte, error) {
+	var buf bytes.Buffer
+	if e, ok := b.entries[name]; ok {
+		buf.Grow(int(e.size))
+	}
+	if _, err := b.WritePatchTo(name, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// open 返回读取补丁 name 的 Reader，读到末尾时校验 SHA-256，不一致时以 ErrCorruptPatch 代替 io.EOF
+func (b *Bundle) open(name string) (io.Reader, error) {
+	e, ok := b.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("bundle patch %s: %w", name, os.ErrNotExist)
+	}
+	return &bundleReader{r: io.NewSectionReader(b.r, e.offset, e.size), h: sha256.New(), e: e, name: name}, nil
+}
+
+type bundleReader struct {
+	r    *io.SectionReader
+	h    hash.Hash
+	e    bundleEntry
+	n    int64
+	name string
+}
+
+func (r *bundleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF && (r.n != r.e.size || [sha256.Size]byte(r.h.Sum(nil)) != r.e.sum) {
+		err = fmt.Errorf("%w: bundle patch %s SHA-256 mismatch", ErrCorruptPatch, r.name)
+	}
+	return n, err
+}
+
+// extract 把补丁 name 写入文件 dst，出错时删除 dst
+func (b *Bundle) extract(name, dst string) (int64, error) {
+	r, err := b.open(name)
+	if err != nil {
+		return 0, err
+	}
+	return writeFile(dst, r)
+}
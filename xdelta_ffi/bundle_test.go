@@ -0,0 +1,208 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bundleTrees 包测试用的新旧目录：x/same 与 y/same 的新旧内容都相同，补丁也相同，在包中只存一份
+func bundleTrees() (oldTree, newTree map[string][]byte) {
+	r := fixtureRand(50)
+	shared := bytes.Join(fixtureLines(&r, 4096), nil)
+	changed := append(bytes.Clone(shared[:2000]), "changed in both copies\n"...)
+	changed = append(changed, shared[2000:]...)
+	other := bytes.Join(fixtureLines(&r, 2048), nil)
+	oldTree = map[string][]byte{"x/same": shared, "y/same": shared, "other": other, "gone": []byte("removed\n")}
+	newTree = map[string][]byte{"x/same": changed, "y/same": changed, "other": other[1000:], "added": []byte("new file\n")}
+	return oldTree, newTree
+}
+
+// writeTestBundle 用 CreateDirDiff 生成补丁目录，再用 WriteBundle 写成包，返回清单、各补丁和包的内容
+func writeTestBundle(t *testing.T) (oldDir string, newTree map[string][]byte, m *DirManifest, patches map[string][]byte, bundle []byte) {
+	t.Helper()
+	oldTree, newTree := bundleTrees()
+	oldDir, newDir, patchDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTree(t, oldDir, oldTree)
+	writeTree(t, newDir, newTree)
+	m, err := CreateDirDiff(oldDir, newDir, patchDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches = map[string][]byte{}
+	for _, e := range m.Entries {
+		if e.Patch == "" {
+			continue
+		}
+		if patches[e.Patch], err = os.ReadFile(filepath.Join(patchDir, filepath.FromSlash(e.Patch))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := WriteBundle(m, patches, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return oldDir, newTree, m, patches, buf.Bytes()
+}
+
+// TestBundleRoundTrip WriteBundle 写出的包用 OpenBundle 读回相同的清单和补丁，相同的补丁只存一份，相同的输入得到相同的包；
+// 用 ApplyDirBundle 应用得到新目录
+func TestBundleRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldDir, newTree, m, patches, data := writeTestBundle(t)
+	b, err := OpenBundle(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Manifest.Entries) != len(m.Entries) {
+		t.Fatalf("manifest has %d entries, want %d", len(b.Manifest.Entries), len(m.Entries))
+	}
+	if names := b.Names(); len(names) != len(patches) {
+		t.Fatalf("Names: %v, want %d patches", names, len(patches))
+	}
+	total := 0
+	unique := map[[sha256.Size]byte]int{}
+	for name, want := range patches {
+		got, err := b.ReadPatch(name)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("ReadPatch(%s): %d bytes, %v, want %d bytes", name, len(got), err, len(want))
+		}
+		var w bytes.Buffer
+		if n, err := b.WritePatchTo(name, &w); err != nil || n != int64(len(want)) || !bytes.Equal(w.Bytes(), want) {
+			t.Fatalf("WritePatchTo(%s): %d bytes, %v", name, n, err)
+		}
+		total += len(want)
+		unique[sha256.Sum256(want)] = len(want)
+	}
+	if len(unique) == len(patches) {
+		t.Fatal("the fixture has no duplicate patches")
+	}
+	stored := 0
+	for _, n := range unique {
+		stored += n
+	}
+	// 数据区只保存不同的补丁各一份
+	indexOffset := int(binary.LittleEndian.Uint64(data[len(data)-bundleTrailerLen:]))
+	if indexOffset-bundleHeaderLen != stored || stored >= total {
+		t.Fatalf("%d bytes of patch data for %d bytes of patches, %d of them distinct", indexOffset-bundleHeaderLen, total, stored)
+	}
+	if _, err := b.ReadPatch("missing.xdelta"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("ReadPatch of a missing patch: got %v, want fs.ErrNotExist", err)
+	}
+
+	var again bytes.Buffer
+	if err := WriteBundle(m, patches, &again); err != nil || !bytes.Equal(again.Bytes(), data) {
+		t.Fatalf("second WriteBundle differs: %v", err)
+	}
+
+	out := t.TempDir()
+	if err := ApplyDirBundle(oldDir, b, out); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range newTree {
+		if got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name))); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: %d bytes, %v, want %d bytes", name, len(got), err, len(want))
+		}
+	}
+
+	for _, e := range m.Entries {
+		if e.Patch != "" {
+			delete(patches, e.Patch)
+			break
+		}
+	}
+	if err := WriteBundle(m, patches, &again); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("WriteBundle without a referenced patch: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestBundleTruncated 在任何位置截断的包（以及 size 大于实际长度的包）都无法打开，返回 ErrCorruptPatch
+func TestBundleTruncated(t *testing.T) {
+	requireNative(t)
+	_, _, _, _, data := writeTestBundle(t)
+	for n := 0; n < len(data); n++ {
+		// 数据部分逐字节截断太慢，每隔一段取一个位置，开头和结尾的区域逐字节检查
+		if n > 64 && n < len(data)-4096 && n%97 != 0 {
+			continue
+		}
+		if _, err := OpenBundle(bytes.NewReader(data[:n]), int64(n)); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("first %d of %d bytes: got %v, want ErrCorruptPatch", n, len(data), err)
+		}
+	}
+	if _, err := OpenBundle(bytes.NewReader(data[:len(data)-1]), int64(len(data))); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("size larger than the data: got %v, want ErrCorruptPatch", err)
+	}
+}
+
+// TestBundleCorrupt 索引的 SHA-256 不一致、SHA-256 正确但内容不合法的索引、版本不认识的包都无法打开；
+// 数据被改动的补丁在读取时返回 ErrCorruptPatch
+func TestBundleCorrupt(t *testing.T) {
+	requireNative(t)
+	_, _, _, _, data := writeTestBundle(t)
+	trailer := data[len(data)-bundleTrailerLen:]
+	indexOffset := int(binary.LittleEndian.Uint64(trailer))
+	indexEnd := len(data) - bundleTrailerLen
+	open := func(p []byte) error {
+		_, err := OpenBundle(bytes.NewReader(p), int64(len(p)))
+		return err
+	}
+
+	for i := indexOffset; i < indexEnd; i += max(1, (indexEnd-indexOffset)/50) {
+		bad := bytes.Clone(data)
+		bad[i] ^= 0x01
+		if err := open(bad); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("index byte %d changed: got %v, want ErrCorruptPatch", i-indexOffset, err)
+		}
+	}
+
+	// 重新计算 SHA-256 的索引，最后一项的偏移超出数据范围
+	bad := bytes.Clone(data)
+	binary.LittleEndian.PutUint64(bad[indexEnd-bundleEntryLen+2:], uint64(indexEnd))
+	sum := sha256.Sum256(bad[indexOffset:indexEnd])
+	copy(bad[len(bad)-bundleTrailerLen+16:], sum[:])
+	if err := open(bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("patch offset out of range: got %v, want ErrCorruptPatch", err)
+	}
+
+	// 索引位置超出文件
+	bad = bytes.Clone(data)
+	binary.LittleEndian.PutUint64(bad[len(bad)-bundleTrailerLen:], uint64(len(bad)))
+	if err := open(bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("index offset out of range: got %v, want ErrCorruptPatch", err)
+	}
+
+	bad = bytes.Clone(data)
+	bad[len(bundleMagic)] = BundleVersion + 1
+	if err := open(bad); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+	bad = bytes.Clone(data)
+	bad[0] = 'x'
+	if err := open(bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("bad magic: got %v, want ErrCorruptPatch", err)
+	}
+
+	// 第一个补丁的数据从包头之后开始，改动其中一个字节：索引照常打开，读取这个补丁时才发现
+	bad = bytes.Clone(data)
+	bad[bundleHeaderLen] ^= 0x01
+	b, err := OpenBundle(bytes.NewReader(bad), int64(len(bad)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corrupt int
+	for _, name := range b.Names() {
+		if _, err := b.ReadPatch(name); errors.Is(err, ErrCorruptPatch) {
+			corrupt++
+		} else if err != nil {
+			t.Fatalf("ReadPatch(%s): %v", name, err)
+		}
+	}
+	if corrupt == 0 {
+		t.Fatal("no patch reported the changed data")
+	}
+}
@@ -0,0 +1,34 @@
+//go:build cgo && !xdelta_purego
+// +build cgo,!xdelta_purego
+
+package xdelta_ffi
+
+/*
+	#include <stdint.h>
+	#include <stddef.h>
+*/
+import "C"
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// cgo 后端的解码回调，ctx 为指向 *streamIO 的 cgo.Handle
+
+//export xdeltaGoRead
+func xdeltaGoRead(ctx C.uintptr_t, offset C.uint64_t, buf *C.uint8_t, n C.size_t) C.int {
+	s := cgo.Handle(ctx).Value().(*streamIO)
+	return C.int(s.readAt(unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(n)), uint64(offset)))
+}
+
+//export xdeltaGoWrite
+func xdeltaGoWrite(ctx C.uintptr_t, buf *C.uint8_t, n C.size_t) C.int {
+	s := cgo.Handle(ctx).Value().(*streamIO)
+	return C.int(s.write(unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(n))))
+}
+
+//export xdeltaGoLog
+func xdeltaGoLog(level C.int, msg *C.uint8_t, n C.size_t) C.int {
+	nativeLog(int(level), string(unsafe.Slice((*byte)(unsafe.Pointer(msg)), int(n))))
+	return 0
+}
@@ -0,0 +1,43 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+const (
+	// formatCDCShift 与 xdelta_interface.h 中的 XDELTA_FORMAT_CDC_SHIFT 一致，这些位存放平均块长的对数
+	formatCDCShift = 12
+	// MinCDCChunk、MaxCDCChunk WithContentDefinedChunking 允许的平均块长范围
+	MinCDCChunk = 1 << 6
+	MaxCDCChunk = 1 << 20
+)
+
+// WithContentDefinedChunking 以内容定义分块（FastCDC）编码，适合 SQL 导出、JSON 等经常在中间插入或删除内容的数据：
+// 旧数据和新数据都按内容切分成平均 avgChunk 字节的块（取不大于 avgChunk 的 2 的幂，必须在 [MinCDCChunk, MaxCDCChunk] 范围内），
+// 插入、删除只改变附近几块，相同的块向两侧逐字节延伸成尽量长的 COPY，而不是每块一个；新数据每 1 MiB 左右的窗口
+// 同时按块大小正常编码，取较小的一种，所以补丁不会比正常编码大多少
+// 补丁格式不变，所有应用接口（包括旧版本的解码器）都能直接应用；avgChunk 为 0 时不使用（默认）
+// 只对 CreateDiffs 及基于它的接口有效，编码总是单线程（WithThreads 只用于建签名表），与 WithSourceWindowSize 同时使用时被忽略；
+// 流式接口、文件版本和 SourceEncoder 忽略这一选项
+func WithContentDefinedChunking(avgChunk int) Option {
+	return func(o *options) {
+		o.cdcChunk = avgChunk
+	}
+}
+
+// checkCDC 检查 WithContentDefinedChunking 的平均块长
+func (o options) checkCDC() error {
+	if o.cdcChunk != 0 && (o.cdcChunk < MinCDCChunk || o.cdcChunk > MaxCDCChunk) {
+		return fmt.Errorf("%w: average chunk length %d is out of range [%d, %d]", ErrInvalidArgument, o.cdcChunk, MinCDCChunk, MaxCDCChunk)
+	}
+	return nil
+}
+
+// cdcFlag 返回与补丁格式按位或的平均块长，未使用 WithContentDefinedChunking 时为 0
+func (o options) cdcFlag() int {
+	if o.cdcChunk == 0 {
+		return 0
+	}
+	return (bits.Len(uint(o.cdcChunk)) - 1) << formatCDCShift
+}
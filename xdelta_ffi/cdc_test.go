@@ -0,0 +1,90 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// sqlDumpFixture 约 n 字节的 SQL 导出和它的新版本：平均每 every 行有一行的内容和长度改变，
+// 之后所有的块边界都错开几个字节
+func sqlDumpFixture(n, every int) (oldData, newData []byte) {
+	r := fixtureRand(94)
+	var o, w bytes.Buffer
+	for id := 1; o.Len() < n; id++ {
+		row := fmt.Sprintf("INSERT INTO orders VALUES (%d, '%s', '%s', %d.%02d);\n", id,
+			fixtureWords[r.intn(len(fixtureWords))], fixtureWords[r.intn(len(fixtureWords))], r.intn(10000), r.intn(100))
+		o.WriteString(row)
+		if r.intn(every) == 0 {
+			row = fmt.Sprintf("INSERT INTO orders VALUES (%d, '%s', NULL, %d);\n", id, fixtureWords[r.intn(len(fixtureWords))], r.intn(100))
+		}
+		w.WriteString(row)
+	}
+	return o.Bytes(), w.Bytes()
+}
+
+// TestContentDefinedChunking 在大量错位改动的 SQL 导出上，内容定义分块的补丁比同样块大小的固定分块小得多，
+// 也比更大块的固定分块小；改动稀疏的文本和不相关的数据上不比固定分块大多少（每个窗口取较小的一种）；
+// 补丁是普通补丁，所有应用接口都能还原；平均块长超出范围时返回 ErrInvalidArgument
+func TestContentDefinedChunking(t *testing.T) {
+	requireNative(t)
+	textOld, textNew := textFixture(1 << 20)
+	sqlOld, sqlNew := sqlDumpFixture(2<<20, 40)
+	sparseOld, sparseNew := sqlDumpFixture(2<<20, 200)
+	r := fixtureRand(95)
+	noise := make([]byte, 256<<10)
+	for i := range noise {
+		noise[i] = byte(r.next())
+	}
+	for _, tc := range []struct {
+		name             string
+		oldData, newData []byte
+		shifted          bool
+	}{
+		{"sql, every 40 rows", sqlOld, sqlNew, true},
+		{"sql, every 200 rows", sparseOld, sparseNew, true},
+		{"text", textOld, textNew, false},
+		{"unrelated", textOld, noise, false},
+	} {
+		fixed, err := CreateDiffs(tc.oldData, tc.newData, WithBlockSize(512))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixedLarge, err := CreateDiffs(tc.oldData, tc.newData, WithBlockSize(4096))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cdc, err := CreateDiffs(tc.oldData, tc.newData, WithBlockSize(512), WithContentDefinedChunking(512))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.shifted && (len(cdc) > len(fixed)/2 || len(cdc) > len(fixedLarge)/2) {
+			t.Fatalf("%s: %d byte patch with content-defined chunks, %d with 512 byte blocks, %d with 4096 byte blocks",
+				tc.name, len(cdc), len(fixed), len(fixedLarge))
+		}
+		if len(cdc) > len(fixed)+len(fixed)/50+100 {
+			t.Fatalf("%s: %d byte patch with content-defined chunks, %d with fixed blocks", tc.name, len(cdc), len(fixed))
+		}
+		for name, apply := range applyPaths(t.TempDir(), tc.oldData, cdc) {
+			if got, err := apply(); err != nil || !bytes.Equal(got, tc.newData) {
+				t.Fatalf("%s: %s returned %d bytes, %v", tc.name, name, len(got), err)
+			}
+		}
+	}
+
+	oldData, newData := sqlDumpFixture(256<<10, 40)
+	// 平均块长取不大于它的 2 的幂
+	want, err := CreateDiffs(oldData, newData, WithContentDefinedChunking(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := CreateDiffs(oldData, newData, WithContentDefinedChunking(1000)); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("average chunk 1000: %d byte patch differs from 512 (%d bytes), %v", len(got), len(want), err)
+	}
+	for _, avg := range []int{-1, 1, MinCDCChunk - 1, MaxCDCChunk + 1} {
+		if _, err := CreateDiffs(oldData, newData, WithContentDefinedChunking(avg)); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("average chunk %d: got %v, want ErrInvalidArgument", avg, err)
+		}
+	}
+}
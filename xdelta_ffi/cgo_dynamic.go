@@ -0,0 +1,7 @@
+//go:build !cgo || xdelta_purego || !xdelta_static
+// +build !cgo xdelta_purego !xdelta_static
+
+package xdelta_ffi
+
+// staticLinked 原生库在运行时加载（或没有原生后端），见 cgo_static.go
+const staticLinked = false
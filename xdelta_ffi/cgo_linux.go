@@ -0,0 +1,12 @@
+//go:build cgo && !xdelta_purego
+// +build cgo,!xdelta_purego
+
+package xdelta_ffi
+
+// loader.c 使用 dlopen/dlsym 加载 libxdelta.so；glibc 2.34 之前它们位于 libdl 中
+// libxdelta.so 自身依赖的 libm、libpthread 等由动态链接器在 dlopen 时解析，不需要在这里链接
+
+/*
+	#cgo LDFLAGS: -ldl
+*/
+import "C"
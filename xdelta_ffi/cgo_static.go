@@ -0,0 +1,20 @@
+//go:build cgo && !xdelta_purego && xdelta_static
+// +build cgo,!xdelta_purego,xdelta_static
+
+package xdelta_ffi
+
+// 使用 xdelta_static 构建时链接 Rust 的静态库 target/release/libxdelta.a（Cargo.toml 的 crate-type 含 staticlib），
+// 不再在运行时加载动态库；下面的系统库是 Rust 标准库自身的依赖（`cargo rustc -- --print native-static-libs`）。
+// 直接写出 .a 的路径，避免 -lxdelta 在同一目录下优先选中 libxdelta.so。
+// Windows 上需要 x86_64-pc-windows-gnu 目标构建的 libxdelta.a，MSVC 的 xdelta.lib 不能由 cgo 使用的 gcc 链接
+
+/*
+	#cgo LDFLAGS: ${SRCDIR}/../target/release/libxdelta.a
+	#cgo linux LDFLAGS: -lgcc_s -lutil -lrt -lpthread -lm -ldl -lc
+	#cgo darwin LDFLAGS: -lSystem -lc -lm
+	#cgo windows LDFLAGS: -ladvapi32 -lntdll -luserenv -lws2_32 -ldbghelp -lbcrypt
+*/
+import "C"
+
+// staticLinked 原生库静态链接进了程序，Init 不查找、不加载动态库
+const staticLinked = true
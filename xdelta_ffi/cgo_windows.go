@@ -0,0 +1,12 @@
+//go:build cgo && !xdelta_purego
+// +build cgo,!xdelta_purego
+
+package xdelta_ffi
+
+// loader.c 使用 LoadLibraryExW/GetProcAddress 加载 xdelta.dll，只需要 kernel32
+// xdelta.dll 依赖的 ntdll、userenv、ws2_32 等由系统加载器在 LoadLibraryExW 时只从 DLL 所在目录和 System32 中解析
+
+/*
+	#cgo LDFLAGS: -lkernel32
+*/
+import "C"
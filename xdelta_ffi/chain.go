@@ -0,0 +1,193 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ApplyChain 依次把 patches 应用到旧数据，返回最后一个补丁的输出
+func ApplyChain(oldData []byte, patches ...[]byte) ([]byte, error) {
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("%w: no patches to apply", ErrInvalidArgument)
+	}
+	cur, spare := oldData, []byte(nil)
+	var verified *EnvelopeHeader
+	for i, p := range patches {
+		out, h, err := applyChainStep(spare[:0], cur, p, verified)
+		if err != nil {
+			return nil, fmt.Errorf("patch %d: %w", i+1, err)
+		}
+		// 第一轮的 cur 是调用方的 oldData，不能作为下一轮的输出缓冲区
+		if i > 0 {
+			spare = cur
+		}
+		cur, verified = out, h
+	}
+	return cur, nil
+}
+
+// applyChainStep 把一个补丁应用到 cur，结果追加到 dst；返回的信封头表示结果已按它校验过
+// verified 不为 nil 时 cur 已经按它记录的新数据校验过
+func applyChainStep(dst, cur, patch []byte, verified *EnvelopeHeader) ([]byte, *EnvelopeHeader, error) {
+	if !IsEnvelope(patch) {
+		out, err := ApplyDiffsDataInto(dst, cur, patch)
+		return out, nil, err
+	}
+	h, inner, err := ParseEnvelope(patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if verified == nil || !verified.chainsTo(h) {
+		if err := h.checkSource(cur); err != nil {
+			return nil, nil, err
+		}
+	}
+	out, err := ApplyDiffsDataInto(dst, cur, inner)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := h.checkTarget(int64(len(out)), sha256.Sum256(out)); err != nil {
+		return nil, nil, err
+	}
+	return out, &h, nil
+}
+
+// ApplyChainFile 与 ApplyChain 相同，但旧数据、补丁和结果都是文件
+func ApplyChainFile(oldPath string, patchPaths []string, outPath string, opts ...Option) error {
+	if len(patchPaths) == 0 {
+		return fmt.Errorf("%w: no patches to apply", ErrInvalidArgument)
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	if err := o.checkStreamSignature(); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(outPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var tmps []string
+	defer func() {
+		for _, t := range tmps {
+			os.Remove(t)
+		}
+	}()
+	for range min(len(patchPaths), 2) {
+		tmp, err := os.CreateTemp(dir, "."+filepath.Base(outPath)+".tmp-*")
+		if err != nil {
+			return err
+		}
+		tmps = append(tmps, tmp.Name())
+		tmp.Close()
+	}
+
+	cur := oldPath
+	var verified *EnvelopeHeader
+	for i, patchPath := range patchPaths {
+		next := tmps[i%2]
+		h, err := applyChainFileStep(cur, patchPath, next, verified, opts)
+		if err != nil {
+			return fmt.Errorf("patch %d (%s): %w", i+1, patchPath, err)
+		}
+		cur, verified = next, h
+	}
+
+	if err := o.checkTarget(cur); err != nil {
+		return err
+	}
+	return replaceFile(cur, outPath, o.fsync)
+}
+
+// applyChainFileStep 把 patchPath 应用到 srcPath，结果覆盖写入 dstPath
+func applyChainFileStep(srcPath, patchPath, dstPath string, verified *EnvelopeHeader, opts []Option) (*EnvelopeHeader, error) {
+	pf, err := os.Open(patchPath)
+	if err != nil {
+		return nil, err
+	}
+	defer pf.Close()
+	head, err := readEnvelopeHead(pf)
+	if err != nil {
+		return nil, err
+	}
+	var h *EnvelopeHeader
+	patch := io.MultiReader(bytes.NewReader(head), pf)
+	if IsEnvelope(head) {
+		hdr, _, err := ParseEnvelope(head)
+		if err != nil {
+			return nil, err
+		}
+		if verified == nil || !verified.chainsTo(hdr) {
+			if err := checkSourceFile(srcPath, hdr); err != nil {
+				return nil, err
+			}
+		}
+		h, patch = &hdr, pf
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	var out io.Writer = dst
+	var sum hash.Hash
+	if h != nil {
+		sum = sha256.New()
+		out = io.MultiWriter(dst, sum)
+	}
+	if err := ApplyDiffsStream(src, patch, out, opts...); err != nil {
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	if h != nil {
+		fi, err := os.Stat(dstPath)
+		if err != nil {
+			return nil, err
+		}
+		var got [sha256.Size]byte
+		sum.Sum(got[:0])
+		if err := h.checkTarget(fi.Size(), got); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// checkSourceFile 与 checkSource 相同，但比较的是文件 path 的内容
+func checkSourceFile(path string, h EnvelopeHeader) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	n, err := io.Copy(sum, f)
+	if err != nil {
+		return err
+	}
+	if err := h.checkSourceSize(n); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum.Sum(nil), h.SourceSHA256[:]) {
+		return fmt.Errorf("%w: source SHA-256 differs from the envelope", ErrSourceMismatch)
+	}
+	return nil
+}
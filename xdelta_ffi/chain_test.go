@@ -0,0 +1,190 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chainVersions 五个版本，长度有增有减，每一版都与上一版有少量差异
+func chainVersions() [][]byte {
+	v0, v1 := textFixture(40000)
+	v2 := bytes.Clone(v1[:len(v1)/3])
+	v3 := append(bytes.Clone(v2), v0...)
+	v4 := append(bytes.Clone(v3[:len(v3)/2]), []byte("tail of the last version\n")...)
+	return [][]byte{v0, v1, v2, v3, v4}
+}
+
+// chainPatches 依次生成相邻版本之间的补丁：原生格式、标准 VCDIFF 和信封交替出现
+func chainPatches(tb testing.TB, versions [][]byte) [][]byte {
+	tb.Helper()
+	var patches [][]byte
+	for i := 1; i < len(versions); i++ {
+		var p []byte
+		var err error
+		switch i % 3 {
+		case 0:
+			p, err = CreateDiffs(versions[i-1], versions[i], WithStandardVCDIFF())
+		case 1:
+			p, err = CreateEnvelope(versions[i-1], versions[i])
+		default:
+			p, err = CreateDiffs(versions[i-1], versions[i])
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		patches = append(patches, p)
+	}
+	return patches
+}
+
+// writeChain 把旧数据和补丁写入 dir，返回它们的路径
+func writeChain(tb testing.TB, dir string, oldData []byte, patches [][]byte) (string, []string) {
+	tb.Helper()
+	oldPath := filepath.Join(dir, "old")
+	if err := os.WriteFile(oldPath, oldData, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	var paths []string
+	for i, p := range patches {
+		path := filepath.Join(dir, fmt.Sprintf("patch%d", i+1))
+		if err := os.WriteFile(path, p, 0o644); err != nil {
+			tb.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return oldPath, paths
+}
+
+// TestApplyChain 依次应用不同格式的补丁得到最后一个版本；两块缓冲区交替复用时不改写旧数据和上一轮的输入，
+// 结果不与旧数据共用内存，只有一个补丁时也是如此
+func TestApplyChain(t *testing.T) {
+	requireNative(t)
+	versions := chainVersions()
+	patches := chainPatches(t, versions)
+	oldData := bytes.Clone(versions[0])
+	for n := 1; n <= len(patches); n++ {
+		got, err := ApplyChain(oldData, patches[:n]...)
+		if err != nil {
+			t.Fatalf("%d patches: %v", n, err)
+		}
+		if !bytes.Equal(got, versions[n]) {
+			t.Fatalf("%d patches: got %d bytes, want version %d (%d bytes)", n, len(got), n, len(versions[n]))
+		}
+		if !bytes.Equal(oldData, versions[0]) {
+			t.Fatalf("%d patches: the old data was changed", n)
+		}
+		if len(got) > 0 {
+			got[0] ^= 0xff
+			if oldData[0] != versions[0][0] {
+				t.Fatalf("%d patches: the result shares memory with the old data", n)
+			}
+		}
+	}
+	// 一次调用的结果在下一次调用之后保持不变
+	first, err := ApplyChain(oldData, patches...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyChain(oldData, patches...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, versions[len(versions)-1]) {
+		t.Fatal("the result of an earlier call was overwritten")
+	}
+	if _, err := ApplyChain(oldData); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("no patches: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestApplyChainErrors 第 k 个补丁失败时错误以 "patch k:" 开头并包装原来的错误：补丁损坏、中途的信封与输入不符、
+// 信封的内层补丁生成的结果与信封记录的不符
+func TestApplyChainErrors(t *testing.T) {
+	requireNative(t)
+	versions := chainVersions()
+	other := append(bytes.Clone(versions[2]), "changed"...)
+	wrongSource, err := CreateEnvelope(other, versions[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rightHeader, err := CreateEnvelope(versions[2], versions[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongInner, err := CreateDiffs(versions[2], other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongTarget := append(bytes.Clone(rightHeader[:envelopeHeaderLen]), wrongInner...)
+
+	for _, c := range []struct {
+		name  string
+		k     int
+		patch []byte
+		want  error
+	}{
+		{"corrupt patch", 2, []byte("not a patch at all"), ErrCorruptPatch},
+		{"envelope for another source", 3, wrongSource, ErrSourceMismatch},
+		{"envelope with another result", 3, wrongTarget, ErrTargetMismatch},
+	} {
+		patches := chainPatches(t, versions)
+		patches[c.k-1] = c.patch
+		_, err := ApplyChain(versions[0], patches...)
+		if !errors.Is(err, c.want) || !strings.HasPrefix(err.Error(), fmt.Sprintf("patch %d: ", c.k)) {
+			t.Errorf("%s: got %v, want %v for patch %d", c.name, err, c.want, c.k)
+		}
+
+		dir := t.TempDir()
+		oldPath, paths := writeChain(t, dir, versions[0], patches)
+		outPath := filepath.Join(dir, "out")
+		err = ApplyChainFile(oldPath, paths, outPath)
+		if !errors.Is(err, c.want) || !strings.HasPrefix(err.Error(), fmt.Sprintf("patch %d (%s): ", c.k, paths[c.k-1])) {
+			t.Errorf("%s: ApplyChainFile: got %v, want %v for patch %d", c.name, err, c.want, c.k)
+		}
+		if fileExists(outPath) {
+			t.Errorf("%s: ApplyChainFile wrote the output after a failure", c.name)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1+len(paths) {
+			t.Errorf("%s: ApplyChainFile left %d files, want only the inputs", c.name, len(entries))
+		}
+	}
+}
+
+// TestApplyChainFile 结果与 ApplyChain 相同，中间版本的临时文件在返回前删除，outPath 可以是旧文件本身
+func TestApplyChainFile(t *testing.T) {
+	requireNative(t)
+	versions := chainVersions()
+	patches := chainPatches(t, versions)
+	dir := t.TempDir()
+	oldPath, paths := writeChain(t, dir, versions[0], patches)
+	outPath := filepath.Join(dir, "out")
+	for n := 1; n <= len(paths); n++ {
+		if err := ApplyChainFile(oldPath, paths[:n], outPath); err != nil {
+			t.Fatalf("%d patches: %v", n, err)
+		}
+		got, err := os.ReadFile(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, versions[n]) {
+			t.Fatalf("%d patches: got %d bytes, want version %d", n, len(got), n)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2+len(paths) {
+		t.Errorf("%d files left, want the inputs and the output", len(entries))
+	}
+
+	if err := ApplyChainFile(oldPath, paths, oldPath); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(oldPath); !bytes.Equal(got, versions[len(versions)-1]) {
+		t.Error("applying the chain onto the old file did not leave the last version")
+	}
+	if err := ApplyChainFile(oldPath, nil, outPath); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("no patches: got %v, want ErrInvalidArgument", err)
+	}
+}
@@ -0,0 +1,276 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// checkpointPartialSuffix 带检查点应用时，解码中的输出文件为 outPath 加上这个后缀
+const checkpointPartialSuffix = ".partial"
+
+// Checkpoint 带检查点的应用进行到的位置：补丁的前 Segment 段已经解码，
+// outPath + ".partial" 的前 Offset 字节是它们的输出，SHA256 为这部分输出的 SHA-256（十六进制）
+// OldSize、OldModTime（UnixNano）、PatchSize、PatchSHA256 用于确认恢复时旧文件和补丁文件没有换掉
+type Checkpoint struct {
+	OldSize     int64  `json:"old_size"`
+	OldModTime  int64  `json:"old_mod_time"`
+	PatchSize   int64  `json:"patch_size"`
+	PatchSHA256 string `json:"patch_sha256"`
+	Segment     int    `json:"segment"`
+	Offset      int64  `json:"offset"`
+	SHA256      string `json:"sha256"`
+}
+
+// CheckpointStore 保存 WithCheckpoint 产生的检查点，由调用方实现（例如写入应用的数据库），也可以用 NewFileCheckpointStore
+// 同一个存储同时只能用于一次应用
+type CheckpointStore interface {
+	// Load 返回最近一次 Save 的检查点，没有时返回 nil, nil
+	Load() (*Checkpoint, error)
+	// Save 保存检查点，替换之前的
+	Save(cp *Checkpoint) error
+	// Clear 删除检查点，应用成功后调用
+	Clear() error
+}
+
+// WithCheckpoint 让 ApplyDiffsFile 和 ResumeApply 每解码 every 段就在 store 中保存一次检查点，进程被杀后可以用 ResumeApply 继续
+// 补丁按记录（VCDIFF 为窗口）边界切成约 8 MiB 输出的段（与 ApplyDiffsAt 相同），二次压缩的本库格式补丁只有一段，无法中途继续；
+// 输出先写入 outPath + ".partial"，全部完成后才替换 outPath 并调用 store.Clear；失败时保留 ".partial" 文件和检查点供 ResumeApply 使用，
+// 不再继续时由调用方删除；WithAtomicReplace(true) 时保存检查点前先把 ".partial" 写入磁盘；every 小于 1 时返回 ErrInvalidArgument
+func WithCheckpoint(store CheckpointStore, every int) Option {
+	return func(o *options) {
+		o.checkpoint = store
+		o.checkpointEvery = every
+	}
+}
+
+// ResumeApply 继续 WithCheckpoint 下被中断的 ApplyDiffsFile，参数与当时相同，opts 中必须有 WithCheckpoint
+// 检查点存在、旧文件的大小和修改时间、补丁文件的大小和 SHA-256 与记录的一致、且 ".partial" 文件中已写入部分的 SHA-256 与检查点相符时，
+// 从记录的段继续解码；否则（没有检查点、文件被换掉、部分输出损坏或被截断）丢弃部分输出从头开始，不会产生错误的文件
+// 其余与 ApplyDiffsFile 相同；WithProgress 从已完成的部分开始计数
+func ResumeApply(oldPath, patchPath, outPath string, opts ...Option) (FileStats, error) {
+	if err := Init(); err != nil {
+		return FileStats{}, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return FileStats{}, err
+	}
+	if o.checkpoint == nil {
+		return FileStats{}, fmt.Errorf("%w: ResumeApply needs WithCheckpoint", ErrInvalidArgument)
+	}
+	if h, err := o.fileEnvelope(oldPath, patchPath); err != nil {
+		return FileStats{}, fmt.Errorf("apply %s to %s: %w", patchPath, oldPath, err)
+	} else if h != nil {
+		return FileStats{}, fmt.Errorf("%w: envelopes cannot be applied with a checkpoint", ErrUnsupportedPatch)
+	}
+	return applyCheckpointed(oldPath, patchPath, outPath, o, true)
+}
+
+// applyCheckpointed 按段解码到 outPath + ".partial" 并定期保存检查点，resume 时先尝试从检查点继续
+func applyCheckpointed(oldPath, patchPath, outPath string, o options, resume bool) (FileStats, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return FileStats{}, err
+	}
+	headerLen, segs, err := patchFileSegments(patchPath, applySegmentSize)
+	release()
+	if err != nil {
+		return FileStats{}, fmt.Errorf("apply %s to %s: %w", patchPath, oldPath, err)
+	}
+	var size uint64
+	if len(segs) > 0 {
+		last := segs[len(segs)-1]
+		size = last.targetOffset + last.targetLen
+	}
+	if limit := o.outputLimit(); limit > 0 && size > limit {
+		return FileStats{}, fmt.Errorf("%w: patch declares %d bytes of output, the limit is %d", ErrOutputTooLarge, size, limit)
+	}
+
+	old, err := os.Open(oldPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer old.Close()
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer patch.Close()
+	oldInfo, err := old.Stat()
+	if err != nil {
+		return FileStats{}, err
+	}
+	patchInfo, err := patch.Stat()
+	if err != nil {
+		return FileStats{}, err
+	}
+	stats := FileStats{OldSize: oldInfo.Size(), NewSize: int64(size), PatchSize: patchInfo.Size()}
+	patchSum := sha256.New()
+	if _, err := io.Copy(patchSum, io.NewSectionReader(patch, 0, stats.PatchSize)); err != nil {
+		return FileStats{}, err
+	}
+	// 检查点中记录的旧文件和补丁文件，恢复时与 Load 得到的比较
+	id := Checkpoint{
+		OldSize:     stats.OldSize,
+		OldModTime:  oldInfo.ModTime().UnixNano(),
+		PatchSize:   stats.PatchSize,
+		PatchSHA256: hex.EncodeToString(patchSum.Sum(nil)),
+	}
+	header := make([]byte, headerLen)
+	if _, err := patch.ReadAt(header, 0); err != nil {
+		return FileStats{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return FileStats{}, err
+	}
+	partialPath := outPath + checkpointPartialSuffix
+	out, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer out.Close()
+
+	sum := sha256.New()
+	start := 0
+	if resume {
+		if start, err = resumePoint(o.checkpoint, out, segs, id, sum); err != nil {
+			return FileStats{}, err
+		}
+	} else if err := o.checkpoint.Clear(); err != nil {
+		return FileStats{}, fmt.Errorf("clear checkpoint: %w", err)
+	}
+	offset := size
+	if start < len(segs) {
+		offset = segs[start].targetOffset
+	}
+	if err := out.Truncate(int64(offset)); err != nil {
+		return FileStats{}, err
+	}
+
+	prog := newProgress(o.progress, stats.PatchSize)
+	if start > 0 {
+		prog.add(int(segs[start].patchOffset))
+	}
+	src := newCachedSource(old, stats.OldSize, o.sourceCache)
+	for i := start; i < len(segs); i++ {
+		seg := segs[i]
+		data := io.NewSectionReader(patch, int64(seg.patchOffset), int64(seg.patchLen))
+		w := io.MultiWriter(io.NewOffsetWriter(out, int64(seg.targetOffset)), sum)
+		if err := decodeSegment(src, header, data, seg, w, o.windowSize); err != nil {
+			return FileStats{}, fmt.Errorf("apply %s to %s: %w", patchPath, oldPath, err)
+		}
+		n := int(seg.patchLen)
+		if i == 0 {
+			n += headerLen
+		}
+		prog.add(n)
+		if done := i + 1; done < len(segs) && (done-start)%o.checkpointEvery == 0 {
+			cp := id
+			cp.Segment = done
+			cp.Offset = int64(seg.targetOffset + seg.targetLen)
+			cp.SHA256 = hex.EncodeToString(sum.Sum(nil))
+			if o.fsync {
+				if err := out.Sync(); err != nil {
+					return FileStats{}, err
+				}
+			}
+			if err := o.checkpoint.Save(&cp); err != nil {
+				return FileStats{}, fmt.Errorf("save checkpoint: %w", err)
+			}
+		}
+	}
+	if err := out.Close(); err != nil {
+		return FileStats{}, err
+	}
+	// outPath 可以就是 oldPath，Windows 上不能替换仍然打开着的文件
+	old.Close()
+	patch.Close()
+	if err := o.checkTargetSum(sum.Sum(nil)); err != nil {
+		// 解码已经全部完成，从检查点继续只会得到同样的结果
+		os.Remove(partialPath)
+		o.checkpoint.Clear()
+		return FileStats{}, fmt.Errorf("apply %s to %s: %w", patchPath, oldPath, err)
+	}
+	if err := replaceFile(partialPath, outPath, o.fsync); err != nil {
+		return FileStats{}, err
+	}
+	if err := o.checkpoint.Clear(); err != nil {
+		return FileStats{}, fmt.Errorf("clear checkpoint: %w", err)
+	}
+	return stats, nil
+}
+
+// resumePoint 检查 store 中的检查点是否能用于继续：旧文件和补丁文件与 id 中记录的一致时返回下一个要解码的段，sum 为已写入部分的哈希；
+// 不能时返回 0，sum 为空；只有 store 本身出错时返回错误
+func resumePoint(store CheckpointStore, out *os.File, segs []patchSegment, id Checkpoint, sum hash.Hash) (int, error) {
+	cp, err := store.Load()
+	if err != nil {
+		return 0, fmt.Errorf("load checkpoint: %w", err)
+	}
+	if cp == nil || cp.OldSize != id.OldSize || cp.OldModTime != id.OldModTime || cp.PatchSize != id.PatchSize || cp.PatchSHA256 != id.PatchSHA256 ||
+		cp.Segment <= 0 || cp.Segment >= len(segs) || uint64(cp.Offset) != segs[cp.Segment].targetOffset {
+		return 0, nil
+	}
+	want, err := hex.DecodeString(cp.SHA256)
+	if err != nil {
+		return 0, nil
+	}
+	n, err := io.Copy(sum, io.NewSectionReader(out, 0, cp.Offset))
+	if err != nil || n != cp.Offset || !bytes.Equal(sum.Sum(nil), want) {
+		sum.Reset()
+		return 0, nil
+	}
+	return cp.Segment, nil
+}
+
+// NewFileCheckpointStore 返回把检查点以 JSON 保存在文件 path 中的 CheckpointStore，
+// 先写入同目录下的临时文件再重命名，保存到一半被中断时仍保留上一个检查点
+func NewFileCheckpointStore(path string) CheckpointStore {
+	return fileCheckpointStore(path)
+}
+
+type fileCheckpointStore string
+
+func (s fileCheckpointStore) Load() (*Checkpoint, error) {
+	b, err := os.ReadFile(string(s))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		// 检查点损坏只会导致从头开始
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+func (s fileCheckpointStore) Save(cp *Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := string(s) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, string(s))
+}
+
+func (s fileCheckpointStore) Clear() error {
+	if err := os.Remove(string(s)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memCheckpointStore 测试用的 CheckpointStore：记录每次 Save 的段号，failAt 不为 0 时第 failAt 次 Save 失败，模拟进程在那里被杀
+type memCheckpointStore struct {
+	mu     sync.Mutex
+	cp     *Checkpoint
+	saves  []int
+	failAt int
+}
+
+var errCheckpointKilled = errors.New("killed")
+
+func (s *memCheckpointStore) Load() (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cp == nil {
+		return nil, nil
+	}
+	cp := *s.cp
+	return &cp, nil
+}
+
+func (s *memCheckpointStore) Save(cp *Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saves = append(s.saves, cp.Segment)
+	if len(s.saves) == s.failAt {
+		return errCheckpointKilled
+	}
+	c := *cp
+	s.cp = &c
+	return nil
+}
+
+func (s *memCheckpointStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cp = nil
+	return nil
+}
+
+// checkpointFixture 输出有 3 段（见 applySegmentSize）以上的补丁，写在 dir 中，返回旧文件、补丁文件、输出文件的路径和新数据
+func checkpointFixture(t *testing.T, dir string) (oldPath, patchPath, outPath string, newData []byte) {
+	t.Helper()
+	oldData, newData := textFixture(3*applySegmentSize + applySegmentSize/2)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath, patchPath, outPath = filepath.Join(dir, "old"), filepath.Join(dir, "patch"), filepath.Join(dir, "out")
+	if err := os.WriteFile(oldPath, oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(patchPath, patch, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return oldPath, patchPath, outPath, newData
+}
+
+// interruptApply 带检查点应用，在第二次保存检查点时中断，留下第 1 段之后的检查点和 ".partial" 文件
+func interruptApply(t *testing.T, oldPath, patchPath, outPath string) *memCheckpointStore {
+	t.Helper()
+	store := &memCheckpointStore{failAt: 2}
+	if err := ApplyDiffsFile(oldPath, patchPath, outPath, WithCheckpoint(store, 1)); !errors.Is(err, errCheckpointKilled) {
+		t.Fatalf("interrupted apply: got %v, want the Save error", err)
+	}
+	if store.cp == nil || store.cp.Segment != 1 {
+		t.Fatalf("checkpoint after the interruption: %+v, want segment 1", store.cp)
+	}
+	if _, err := os.Stat(outPath + checkpointPartialSuffix); err != nil {
+		t.Fatalf("partial output: %v", err)
+	}
+	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+		t.Fatalf("%s exists after the interruption: %v", outPath, err)
+	}
+	store.failAt, store.saves = 0, nil
+	return store
+}
+
+// checkResumed ResumeApply 完成后输出与 want 相同、检查点和 ".partial" 文件都已删除；
+// 第一次保存的段号为 firstSave：从检查点继续时为 2，从头开始时为 1
+func checkResumed(t *testing.T, store *memCheckpointStore, outPath string, want []byte, firstSave int) {
+	t.Helper()
+	got, err := os.ReadFile(outPath)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("output: %d bytes, %v, want %d bytes", len(got), err, len(want))
+	}
+	if store.cp != nil {
+		t.Fatalf("checkpoint left after success: %+v", store.cp)
+	}
+	if _, err := os.Stat(outPath + checkpointPartialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("partial output left after success: %v", err)
+	}
+	if len(store.saves) == 0 || store.saves[0] != firstSave {
+		t.Fatalf("checkpoints saved for segments %v, want the first at %d", store.saves, firstSave)
+	}
+}
+
+// TestResumeApply 中断后 ResumeApply 从检查点记录的段继续，不重新解码已完成的段
+func TestResumeApply(t *testing.T) {
+	requireNative(t)
+	oldPath, patchPath, outPath, newData := checkpointFixture(t, t.TempDir())
+	store := interruptApply(t, oldPath, patchPath, outPath)
+	if _, err := ResumeApply(oldPath, patchPath, outPath, WithCheckpoint(store, 1)); err != nil {
+		t.Fatal(err)
+	}
+	checkResumed(t, store, outPath, newData, 2)
+
+	if _, err := ResumeApply(oldPath, patchPath, outPath); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("ResumeApply without WithCheckpoint: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestResumeApplyRestart 部分输出损坏、补丁换成大小相同的另一个补丁、旧文件被改动过时都不从检查点继续，
+// 而是从头开始，得到正确的结果
+func TestResumeApplyRestart(t *testing.T) {
+	requireNative(t)
+	t.Run("partial output corrupted", func(t *testing.T) {
+		oldPath, patchPath, outPath, newData := checkpointFixture(t, t.TempDir())
+		store := interruptApply(t, oldPath, patchPath, outPath)
+		f, err := os.OpenFile(outPath+checkpointPartialSuffix, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte{'#'}, store.cp.Offset/2); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if _, err := ResumeApply(oldPath, patchPath, outPath, WithCheckpoint(store, 1)); err != nil {
+			t.Fatal(err)
+		}
+		checkResumed(t, store, outPath, newData, 1)
+	})
+
+	t.Run("patch replaced", func(t *testing.T) {
+		oldPath, patchPath, outPath, newData := checkpointFixture(t, t.TempDir())
+		store := interruptApply(t, oldPath, patchPath, outPath)
+		// 改动第一段中新增的一个字节：补丁大小不变，COPY 也不变，只有 ADD 的内容不同
+		oldData, err := os.ReadFile(oldPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := 0
+		for i < len(newData) && newData[i] == oldData[i] {
+			i++
+		}
+		other := bytes.Clone(newData)
+		other[i] ^= 0x20
+		patch, err := CreateDiffs(oldData, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(patchPath); err != nil || info.Size() != int64(len(patch)) {
+			t.Fatalf("the replacement patch has %d bytes, want the size of the original: %v", len(patch), err)
+		}
+		if err := os.WriteFile(patchPath, patch, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ResumeApply(oldPath, patchPath, outPath, WithCheckpoint(store, 1)); err != nil {
+			t.Fatal(err)
+		}
+		checkResumed(t, store, outPath, other, 1)
+	})
+
+	t.Run("old file modified", func(t *testing.T) {
+		oldPath, patchPath, outPath, newData := checkpointFixture(t, t.TempDir())
+		store := interruptApply(t, oldPath, patchPath, outPath)
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(oldPath, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ResumeApply(oldPath, patchPath, outPath, WithCheckpoint(store, 1)); err != nil {
+			t.Fatal(err)
+		}
+		checkResumed(t, store, outPath, newData, 1)
+	})
+}
+
+// TestFileCheckpointStore 检查点以 JSON 保存在文件中，Clear 之后 Load 返回 nil；文件损坏时同样返回 nil，只会导致从头开始
+func TestFileCheckpointStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	s := NewFileCheckpointStore(path)
+	if cp, err := s.Load(); cp != nil || err != nil {
+		t.Fatalf("empty store: %+v, %v", cp, err)
+	}
+	want := Checkpoint{OldSize: 1, OldModTime: 2, PatchSize: 3, PatchSHA256: "ab", Segment: 4, Offset: 5, SHA256: "cd"}
+	if err := s.Save(&want); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err := s.Load(); err != nil || cp == nil || *cp != want {
+		t.Fatalf("Load: %+v, %v, want %+v", cp, err, want)
+	}
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err := s.Load(); cp != nil || err != nil {
+		t.Fatalf("corrupt file: %+v, %v", cp, err)
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatalf("second Clear: %v", err)
+	}
+	if cp, err := s.Load(); cp != nil || err != nil {
+		t.Fatalf("after Clear: %+v, %v", cp, err)
+	}
+}
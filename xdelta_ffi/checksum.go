@@ -0,0 +1,62 @@
+package xdelta_ffi
+
+import "fmt"
+
+// ChecksumKind 创建补丁时写入补丁的输出校验和，见 WithChecksum
+type ChecksumKind int
+
+const (
+	// ChecksumNone 不写校验和（默认），补丁格式与之前的版本完全相同，应用时也不做校验
+	ChecksumNone ChecksumKind = iota
+	// ChecksumAdler32 adler32，与 xdelta3 相同；WithStandardVCDIFF 的补丁写为 xdelta3 的每窗口校验和
+	ChecksumAdler32
+	// ChecksumXXH3 XXH3-64，比 adler32 快且碰撞概率低得多，只能用于本库格式
+	ChecksumXXH3
+)
+
+// 与 xdelta_interface.h 中的 XDELTA_FORMAT_FLAG_ADLER32、XDELTA_FORMAT_FLAG_XXH3 一致
+const (
+	formatFlagAdler32 = 0x200
+	formatFlagXXH3    = 0x400
+)
+
+func (k ChecksumKind) String() string {
+	switch k {
+	case ChecksumNone:
+		return "none"
+	case ChecksumAdler32:
+		return "adler32"
+	case ChecksumXXH3:
+		return "xxh3"
+	default:
+		return fmt.Sprintf("ChecksumKind(%d)", int(k))
+	}
+}
+
+func (k ChecksumKind) valid() bool {
+	return k >= ChecksumNone && k <= ChecksumXXH3
+}
+
+// formatFlag 返回与补丁格式按位或的标记
+func (k ChecksumKind) formatFlag() int {
+	switch k {
+	case ChecksumAdler32:
+		return formatFlagAdler32
+	case ChecksumXXH3:
+		return formatFlagXXH3
+	default:
+		return 0
+	}
+}
+
+// WithChecksum 设置创建补丁时写入的输出校验和，默认 ChecksumNone；对所有创建补丁的接口有效，应用补丁时被忽略
+// 本库格式每 1 MiB 输出（在记录边界）写一个校验和，补丁每 MiB 只大 6 到 10 字节；应用时种类从补丁中读出，
+// 每段输出写出后立即校验，不一致时返回 ErrChecksumMismatch，错误信息中有出错的校验窗口序号和输出范围
+// 没有校验和的补丁不做校验，没有额外开销；ValidateFormat 等不读旧数据的接口不校验校验和的值，
+// 但补丁带校验和时最后一个校验和记录必须覆盖到输出的末尾，之后还有未校验的输出时返回 ErrCorruptPatch
+// 带校验和的本库格式补丁需要格式修订号 2 及以上（见 Version）的原生库才能应用
+func WithChecksum(kind ChecksumKind) Option {
+	return func(o *options) {
+		o.checksum = kind
+	}
+}
@@ -0,0 +1,61 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestChecksumRoundTrip 两种校验和的补丁都能应用，旧数据不对时返回 ErrChecksumMismatch
+func TestChecksumRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	for _, kind := range []ChecksumKind{ChecksumAdler32, ChecksumXXH3} {
+		patch, err := CreateDiffs(oldData, newData, WithChecksum(kind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%v: %v", kind, err)
+		}
+		bad := append([]byte(nil), oldData...)
+		bad[0] ^= 0xff
+		if _, err := ApplyDiffsData(bad, patch); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("%v with changed old data: got %v, want ErrChecksumMismatch", kind, err)
+		}
+	}
+}
+
+// TestChecksumCoversEnd 带校验和的补丁在最后一个校验和记录之后还有输出时不能当作校验过的补丁应用
+func TestChecksumCoversEnd(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData, WithChecksum(ChecksumXXH3), WithEndRecord(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 补丁以 XXH3 校验和记录（2 + 8 字节）和结束记录结尾
+	body := patch[:len(patch)-endRecordLen]
+	if body[len(body)-10] != 0x02 {
+		t.Fatalf("patch does not end with a checksum record before the end record")
+	}
+	n := uint64(len(newData))
+	cases := map[string][]byte{
+		// 在最后一个校验和之后追加一个 ADD
+		"add after checksum": appendEndRecord(append(append([]byte(nil), body...), 0x00, 1, 0, 0, 0, 'x'), n+1),
+		// 去掉最后一个校验和记录
+		"last checksum removed": appendEndRecord(append([]byte(nil), body[:len(body)-10]...), n),
+	}
+	for name, p := range cases {
+		if _, err := ApplyDiffsData(oldData, p); !errors.Is(err, ErrCorruptPatch) {
+			t.Errorf("%s: ApplyDiffsData got %v, want ErrCorruptPatch", name, err)
+		}
+		var out bytes.Buffer
+		if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(p), &out); !errors.Is(err, ErrCorruptPatch) {
+			t.Errorf("%s: ApplyDiffsStream got %v, want ErrCorruptPatch", name, err)
+		}
+		if err := ValidateFormat(p); !errors.Is(err, ErrCorruptPatch) {
+			t.Errorf("%s: ValidateFormat got %v, want ErrCorruptPatch", name, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultChunkSignatureSize CreateChunkSignature 的 avgChunk 为 0 时使用的平均块长
+const DefaultChunkSignatureSize = 4 << 10
+
+// 内容定义分块的签名是 CreateSignature 的另一种形式，同样用于只有新数据的一方（例如服务端）为持有旧数据的一方生成补丁：
+//
+//  1. 持有旧数据的一方用 CreateChunkSignature 生成签名，发给持有新数据的一方
+//  2. 对方用 DeltaFromChunkSignature 从签名和新数据生成补丁，发回来
+//  3. 持有旧数据的一方用 ApplyDelta（或 ApplyDiffsData 等任意应用接口）应用补丁
+//
+// 两边都按内容切块（与 WithContentDefinedChunking 相同的 FastCDC 切分），插入、删除只改变附近一两块的边界，
+// 相同的块无论移动到哪里都能找到；签名中每块只有长度和 SHA-256，约为旧数据的 36/avgChunk，
+// 生成补丁时也不需要像定长块的签名那样在新数据上逐字节滑动查找。代价是匹配只以整块为单位，
+// 修改处附近的一两块总是作为新数据写入，平均块长越小补丁越小、签名越大
+
+// CreateChunkSignature 把旧数据按平均 avgChunk 字节的内容定义分块切开，返回签名；avgChunk 为 0 时使用 DefaultChunkSignatureSize，
+// 否则必须是 [MinCDCChunk, MaxCDCChunk] 范围内的 2 的幂，平均块长记录在签名中，对方不需要另外知道
+// opts 中 WithTimeout 有效
+func CreateChunkSignature(old []byte, avgChunk int, opts ...Option) ([]byte, error) {
+	if avgChunk == 0 {
+		avgChunk = DefaultChunkSignatureSize
+	}
+	if avgChunk < MinCDCChunk || avgChunk > MaxCDCChunk || avgChunk&(avgChunk-1) != 0 {
+		return nil, fmt.Errorf("%w: average chunk length %d is not a power of two in [%d, %d]", ErrInvalidArgument, avgChunk, MinCDCChunk, MaxCDCChunk)
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	t := watchOptions(nil, o, int64(len(old)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	sig, err := createChunkSignature(old, uint32(avgChunk), t.cancel())
+	if err != nil {
+		return nil, t.err(err)
+	}
+	return sig, nil
+}
+
+// DeltaFromChunkSignature 从 CreateChunkSignature 生成的签名 sig 和新数据 newData 生成补丁，不需要旧数据；
+// 补丁是普通的补丁，与签名中相同的块写成 COPY（连续的合并成一个），其余作为新数据写入
+// opts 中选择补丁编码方式的选项（WithSecondaryCompression、WithCompressionLevel、WithStandardVCDIFF、WithChecksum）、
+// WithProgress 和 WithTimeout 有效，块匹配相关的选项被忽略，WithBSDiff 返回 ErrInvalidArgument；
+// 签名损坏时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func DeltaFromChunkSignature(sig, newData []byte, opts ...Option) (delta []byte, err error) {
+	if m := beginOp(OpCreate, -1, int64(len(newData))); m != nil {
+		defer func() { m.end(int64(len(delta)), err) }()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkIndexedBSDiff(); err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	start := time.Now()
+	t := watchOptions(nil, o, int64(len(newData)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	delta, err = createPatchFromChunkSignature(appendTo(nil), sig, newData, o.encoding(), t.cancel())
+	if err != nil {
+		return nil, t.err(err)
+	}
+	o.recordDiffPatch(DiffStats{SourceSize: -1, TargetSize: int64(len(newData)), PatchSize: int64(len(delta)), ThreadsUsed: 1}, delta, start)
+	return delta, nil
+}
@@ -0,0 +1,138 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// chunkSigHeaderLen、chunkSigEntryLen 签名头和每块一项的长度，与 src/cdc.rs 一致
+const (
+	chunkSigHeaderLen = 8 + 1 + 4 + 8
+	chunkSigEntryLen  = 4 + 32
+)
+
+// chunkSigPair 1 MiB 的旧数据和新数据：开头附近插入一行，中间删掉一段，一大段移到末尾
+func chunkSigPair() (oldData, newData []byte) {
+	oldData, _ = textFixture(1 << 20)
+	newData = append(bytes.Clone(oldData[:5000]), "an inserted line\n"...)
+	newData = append(newData, oldData[5000:400000]...)
+	newData = append(newData, oldData[410000:600000]...)
+	newData = append(newData, oldData[800000:]...)
+	return oldData, append(newData, oldData[600000:800000]...)
+}
+
+// TestChunkSignature 签名由头和每块 36 字节组成，各块长度之和为旧数据的长度，块数接近长度除以平均块长；
+// 签名与旧数据一一对应，每次相同。DeltaFromChunkSignature 的补丁应用后得到新数据，插入、删除和移动只让附近几块作为新数据写入；
+// 平均块长越小签名越大、补丁越小
+func TestChunkSignature(t *testing.T) {
+	requireNative(t)
+	oldData, newData := chunkSigPair()
+	var prevSig, prevDelta int
+	for _, avg := range []int{16 << 10, DefaultChunkSignatureSize, 1 << 10} {
+		sig, err := CreateChunkSignature(oldData, avg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := binary.LittleEndian.Uint64(sig[13:])
+		if got := binary.LittleEndian.Uint32(sig[9:]); got != uint32(avg) || len(sig) != chunkSigHeaderLen+int(chunks)*chunkSigEntryLen {
+			t.Fatalf("avg %d: signature of %d bytes records avg %d and %d chunks", avg, len(sig), got, chunks)
+		}
+		if want := uint64(len(oldData) / avg); chunks < want/2 || chunks > want*2 {
+			t.Fatalf("avg %d: %d chunks, want about %d", avg, chunks, want)
+		}
+		var total int
+		for i := range int(chunks) {
+			total += int(binary.LittleEndian.Uint32(sig[chunkSigHeaderLen+i*chunkSigEntryLen:]))
+		}
+		if total != len(oldData) {
+			t.Fatalf("avg %d: chunks cover %d bytes of %d", avg, total, len(oldData))
+		}
+		if again, err := CreateChunkSignature(oldData, avg); err != nil || !bytes.Equal(again, sig) {
+			t.Fatalf("avg %d: second signature differs: %v", avg, err)
+		}
+
+		delta, err := DeltaFromChunkSignature(sig, newData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := ApplyDelta(bytes.NewReader(oldData), delta, &out); err != nil || !bytes.Equal(out.Bytes(), newData) {
+			t.Fatalf("avg %d: applied to %d bytes, %v", avg, out.Len(), err)
+		}
+		// 三处改动和移动的两端，每处最多几块
+		if limit := 16 * avg; len(delta) > limit {
+			t.Fatalf("avg %d: delta of %d bytes, want at most %d", avg, len(delta), limit)
+		}
+		if prevSig > 0 && (len(sig) <= prevSig || len(delta) >= prevDelta) {
+			t.Fatalf("avg %d: signature %d bytes and delta %d bytes, the larger average gave %d and %d", avg, len(sig), len(delta), prevSig, prevDelta)
+		}
+		prevSig, prevDelta = len(sig), len(delta)
+	}
+
+	if sig, err := CreateChunkSignature(nil, 0); err != nil || len(sig) != chunkSigHeaderLen {
+		t.Fatalf("signature of no data: %d bytes, %v", len(sig), err)
+	}
+	for _, avg := range []int{-1, MinCDCChunk / 2, 3000, MaxCDCChunk * 2} {
+		if _, err := CreateChunkSignature(oldData, avg); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("avg %d: got %v, want ErrInvalidArgument", avg, err)
+		}
+	}
+}
+
+// TestChunkSignatureCorrupt 截断的签名、块数与长度不符、块长为 0、平均块长不合法的签名和定长块的签名返回 ErrCorruptPatch，
+// 版本不认识时返回 ErrUnsupportedPatch；另一份数据的签名得到的补丁仍然正确，只是把新数据全部写入
+func TestChunkSignatureCorrupt(t *testing.T) {
+	requireNative(t)
+	oldData, newData := chunkSigPair()
+	sig, err := CreateChunkSignature(oldData, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 8, chunkSigHeaderLen - 1, chunkSigHeaderLen, len(sig) - chunkSigEntryLen, len(sig) - 1} {
+		if _, err := DeltaFromChunkSignature(sig[:n], newData); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("first %d of %d bytes: got %v, want ErrCorruptPatch", n, len(sig), err)
+		}
+	}
+	for name, edit := range map[string]func(b []byte){
+		"chunk count":    func(b []byte) { b[13]++ },
+		"chunk length 0": func(b []byte) { clear(b[chunkSigHeaderLen : chunkSigHeaderLen+4]) },
+		"average 3000":   func(b []byte) { binary.LittleEndian.PutUint32(b[9:], 3000) },
+		"magic":          func(b []byte) { b[3] = 'S' },
+	} {
+		bad := bytes.Clone(sig)
+		edit(bad)
+		if _, err := DeltaFromChunkSignature(bad, newData); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s: got %v, want ErrCorruptPatch", name, err)
+		}
+	}
+	bad := bytes.Clone(sig)
+	bad[8]++
+	if _, err := DeltaFromChunkSignature(bad, newData); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+	fixed, err := CreateSignature(bytes.NewReader(oldData), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeltaFromChunkSignature(fixed, newData); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("fixed-block signature: got %v, want ErrCorruptPatch", err)
+	}
+
+	other, err := CreateChunkSignature(bytes.ToUpper(oldData), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := DeltaFromChunkSignature(other, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ApplyDelta(bytes.NewReader(oldData), delta, &out); err != nil || !bytes.Equal(out.Bytes(), newData) {
+		t.Fatalf("delta from another signature: %d bytes, %v", out.Len(), err)
+	}
+	if len(delta) < len(newData) {
+		t.Fatalf("delta from another signature has %d bytes, less than the %d new bytes", len(delta), len(newData))
+	}
+}
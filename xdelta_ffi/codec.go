@@ -0,0 +1,72 @@
+package xdelta_ffi
+
+// Codec 补丁的编码格式，由 WithCodec 选择创建补丁时使用哪一种；两种格式都由原生层创建和应用
+// 应用补丁的接口总是按补丁的开头自动识别格式，不需要也不受 WithCodec 影响
+// 接口含有未导出的方法，只能使用本包提供的 XDelta 和 BSDiff
+type Codec interface {
+	// Name 格式的名字，与 PatchInfo.Format 相同；XDelta 为 "native"，WithStandardVCDIFF 生成的补丁同样属于它
+	Name() string
+	// Detect 报告 patch 是否是这种格式的补丁，只看开头，不检查整个补丁；信封按其中的补丁判断
+	Detect(patch []byte) bool
+	configure(o *options)
+}
+
+var (
+	// XDelta 本库的补丁格式（默认），WithStandardVCDIFF、WithSecondaryCompression、WithChecksum 等选项在它之内选择变体
+	XDelta Codec = xdeltaCodec{}
+	// BSDiff bsdiff 4.x（BSDIFF40）补丁，与 WithBSDiff 相同，可以直接用 bspatch 应用
+	BSDiff Codec = bsdiffCodec{}
+)
+
+// WithCodec 选择创建补丁的格式，与 opts 中的 WithBSDiff 按先后顺序生效，c 为 nil 时等于 XDelta
+// 对 CreateDiffs 等接受 opts 的创建接口有效，各接口对 BSDiff 的限制见 WithBSDiff
+func WithCodec(c Codec) Option {
+	if c == nil {
+		c = XDelta
+	}
+	return c.configure
+}
+
+// DetectCodec 按补丁的开头判断它的格式，信封按其中的补丁判断；空的或无法识别的补丁返回 nil
+func DetectCodec(patch []byte) Codec {
+	for _, c := range []Codec{BSDiff, XDelta} {
+		if c.Detect(patch) {
+			return c
+		}
+	}
+	return nil
+}
+
+// codecPatch 信封中的补丁，不是信封时为 patch 本身
+func codecPatch(patch []byte) []byte {
+	if IsEnvelope(patch) {
+		if _, inner, err := ParseEnvelope(patch); err == nil {
+			return inner
+		}
+		return nil
+	}
+	return patch
+}
+
+type xdeltaCodec struct{}
+
+func (xdeltaCodec) Name() string { return "native" }
+
+// Detect 本库格式的第一个字节是记录的操作码或二次压缩的标记，VCDIFF 以其魔数开头
+func (xdeltaCodec) Detect(patch []byte) bool {
+	p := codecPatch(patch)
+	if len(p) == 0 || isBSDiff(p) {
+		return false
+	}
+	return p[0] <= endRecordOp || p[0] == headerRecordOp || p[0] == vcdiffMagic[0] || secondaryOf(p[0]) != SecondaryNone
+}
+
+func (xdeltaCodec) configure(o *options) { o.bsdiff = false }
+
+type bsdiffCodec struct{}
+
+func (bsdiffCodec) Name() string { return "bsdiff" }
+
+func (bsdiffCodec) Detect(patch []byte) bool { return isBSDiff(codecPatch(patch)) }
+
+func (bsdiffCodec) configure(o *options) { o.bsdiff = true }
@@ -0,0 +1,265 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+// DefaultVerifySamples CompactionPolicy.VerifySamples 为 0 时压缩后抽查的版本数
+const DefaultVerifySamples = 16
+
+// ChainEntry 补丁链中一个版本的存储项：Snapshot 为 true 时 Data 是这一版本的完整内容，
+// 否则 Data 是应用到版本 Base 上得到这一版本的补丁（ApplyDiffsData 接受的任意格式或信封），Base 必须小于这一版本
+type ChainEntry struct {
+	Snapshot bool
+	Base     int
+	Data     []byte
+}
+
+// PatchStore 按版本顺序保存的补丁链，版本从 0 开始编号，版本 0 必须是快照；由调用方实现（例如备份系统的对象存储），
+// 也可以用 NewDirPatchStore。CompactChain 在同一个 goroutine 中依次调用，不需要并发安全
+type PatchStore interface {
+	// Len 返回链中的版本数
+	Len() (int, error)
+	// Load 返回版本 v 的项
+	Load(v int) (ChainEntry, error)
+	// Replace 用 e 替换版本 v 的项，v 等于 Len() 时追加一个版本；替换必须是原子的，
+	// 失败时原来的项保持不变，之后 Load 读到的要么是原来的项、要么是 e
+	Replace(v int, e ChainEntry) error
+}
+
+// CompactionPolicy CompactChain 的压缩策略
+type CompactionPolicy struct {
+	// KeyframeInterval 每隔多少个版本保存一个完整快照：版本 0、N、2N……为快照（关键帧），
+	// 其余版本保存为从它之前最近的关键帧直接到这一版本的补丁，恢复任一版本最多只需应用一个补丁；必须大于 0
+	KeyframeInterval int
+	// VerifySamples 压缩后从存储中随机抽取多少个版本重新恢复，与压缩前的内容比较 SHA-256；
+	// 0 时为 DefaultVerifySamples，小于 0 时不抽查，不少于版本数时检查全部
+	VerifySamples int
+	// Options 需要重新编码时传给 CreateDiffs 的选项，见 CompactChain
+	Options []Option
+}
+
+// CompactChain 按 policy 重写 store 中的补丁链，使恢复时间不再随链长线性增长：关键帧上的版本换成快照，
+// 其余版本换成从关键帧出发的补丁，由关键帧之后的各个补丁用 MergePatches 依次合并得到；
+// 项不是基于上一个版本的补丁（或是关键帧以外的快照）时，改用 CreateDiffs 从关键帧的内容重新编码，已经符合策略的项不变
+// 每个新项都先应用到关键帧的内容，与压缩前这一版本内容的 SHA-256 比较一致后才替换原来的项，不一致时返回 ErrTargetMismatch；
+// 替换按版本顺序逐个进行，由于每一项恢复的内容都不变，中途失败时存储中的链仍然完整可用，只是部分压缩，可以再次调用继续
+// 全部替换后按 policy.VerifySamples 从存储中抽查，恢复的内容与压缩前不符时返回 ErrTargetMismatch
+// 压缩过程中在内存中保存当前版本、上一个版本和当前关键帧的内容
+func CompactChain(store PatchStore, policy CompactionPolicy) error {
+	if policy.KeyframeInterval < 1 {
+		return fmt.Errorf("%w: keyframe interval %d is less than 1", ErrInvalidArgument, policy.KeyframeInterval)
+	}
+	n, err := store.Len()
+	if err != nil {
+		return err
+	}
+	hashes := make([][sha256.Size]byte, n)
+	var prev, keyframe []byte
+	var merged []byte // 从关键帧到上一个版本的补丁
+	for v := range n {
+		e, err := store.Load(v)
+		if err != nil {
+			return fmt.Errorf("version %d: %w", v, err)
+		}
+		k := v - v%policy.KeyframeInterval
+		cur, err := restoreEntry(store, v, e, prev, keyframe, k)
+		if err != nil {
+			return fmt.Errorf("version %d: %w", v, err)
+		}
+		hashes[v] = sha256.Sum256(cur)
+		if v == k {
+			keyframe = cur
+		}
+
+		next, changed, err := compactEntry(v, k, e, merged, keyframe, cur, policy)
+		if err != nil {
+			return fmt.Errorf("version %d: %w", v, err)
+		}
+		if changed {
+			if !next.Snapshot {
+				got, err := ApplyDiffsData(keyframe, next.Data)
+				if err != nil {
+					return fmt.Errorf("version %d: compacted patch: %w", v, err)
+				}
+				if sha256.Sum256(got) != hashes[v] {
+					return fmt.Errorf("%w: compacted patch of version %d does not reproduce it", ErrTargetMismatch, v)
+				}
+			}
+			if err := store.Replace(v, next); err != nil {
+				return fmt.Errorf("version %d: %w", v, err)
+			}
+		}
+		merged = next.Data
+		if next.Snapshot {
+			merged = nil
+		}
+		prev = cur
+	}
+	return verifyChainSample(store, hashes, policy.VerifySamples)
+}
+
+// restoreEntry 返回版本 v 的内容，prev 为版本 v-1、keyframe 为版本 k 的内容，基于其他版本时从 store 中恢复
+func restoreEntry(store PatchStore, v int, e ChainEntry, prev, keyframe []byte, k int) ([]byte, error) {
+	switch {
+	case e.Snapshot:
+		return e.Data, nil
+	case v > 0 && e.Base == v-1:
+		return ApplyDiffsData(prev, e.Data)
+	case e.Base == k && k < v:
+		return ApplyDiffsData(keyframe, e.Data)
+	}
+	return RestoreVersion(store, v)
+}
+
+// compactEntry 返回按策略版本 v（关键帧为 k）应有的项，changed 为 false 时 e 已经符合策略；
+// merged 为上一个版本从关键帧出发的补丁，上一个版本就是关键帧时为 nil
+func compactEntry(v, k int, e ChainEntry, merged, keyframe, cur []byte, policy CompactionPolicy) (ChainEntry, bool, error) {
+	switch {
+	case v == k:
+		return ChainEntry{Snapshot: true, Data: cur}, !e.Snapshot, nil
+	case !e.Snapshot && e.Base == k:
+		return e, false, nil
+	case !e.Snapshot && e.Base == v-1 && merged != nil:
+		p, err := MergePatches(merged, e.Data)
+		if err != nil {
+			return e, false, err
+		}
+		return ChainEntry{Base: k, Data: p}, true, nil
+	}
+	p, err := CreateDiffs(keyframe, cur, policy.Options...)
+	if err != nil {
+		return e, false, err
+	}
+	return ChainEntry{Base: k, Data: p}, true, nil
+}
+
+// verifyChainSample 从 store 中随机恢复 samples 个版本（含义见 CompactionPolicy.VerifySamples），与 hashes 比较
+func verifyChainSample(store PatchStore, hashes [][sha256.Size]byte, samples int) error {
+	if samples == 0 {
+		samples = DefaultVerifySamples
+	}
+	if samples < 0 {
+		return nil
+	}
+	for _, v := range rand.Perm(len(hashes))[:min(samples, len(hashes))] {
+		got, err := RestoreVersion(store, v)
+		if err != nil {
+			return fmt.Errorf("verify version %d: %w", v, err)
+		}
+		if sha256.Sum256(got) != hashes[v] {
+			return fmt.Errorf("%w: version %d restored from the compacted chain differs from before", ErrTargetMismatch, v)
+		}
+	}
+	return nil
+}
+
+// RestoreVersion 从 store 中恢复版本 v 的内容：从 v 沿着各项的 Base 找到最近的快照，再用 ApplyChain 依次应用沿途的补丁
+// 项的 Base 不小于自己的版本或超出范围时返回 ErrInvalidArgument；结果不会与快照的 Data 共用底层数组
+func RestoreVersion(store PatchStore, v int) ([]byte, error) {
+	var patches [][]byte
+	for {
+		e, err := store.Load(v)
+		if err != nil {
+			return nil, fmt.Errorf("version %d: %w", v, err)
+		}
+		if e.Snapshot {
+			if len(patches) == 0 {
+				return append([]byte(nil), e.Data...), nil
+			}
+			for i, j := 0, len(patches)-1; i < j; i, j = i+1, j-1 {
+				patches[i], patches[j] = patches[j], patches[i]
+			}
+			return ApplyChain(e.Data, patches...)
+		}
+		if e.Base < 0 || e.Base >= v {
+			return nil, fmt.Errorf("%w: version %d is based on version %d", ErrInvalidArgument, v, e.Base)
+		}
+		patches = append(patches, e.Data)
+		v = e.Base
+	}
+}
+
+// NewDirPatchStore 返回把每个版本保存为目录 dir 中的文件 v<版本号，8 位十进制> 的 PatchStore，dir 在第一次 Replace 时创建；
+// 文件以 Base 开头（int64 小端序，快照为 -1），之后是 Data。Len 为从 v00000000 开始连续存在的文件数；
+// Replace 先写入同目录下的临时文件，写入磁盘后再重命名覆盖，掉电或崩溃后文件要么是原来的项、要么是新的项
+func NewDirPatchStore(dir string) PatchStore {
+	return dirPatchStore(dir)
+}
+
+type dirPatchStore string
+
+func (s dirPatchStore) path(v int) string {
+	return filepath.Join(string(s), fmt.Sprintf("v%08d", v))
+}
+
+func (s dirPatchStore) Len() (int, error) {
+	n := 0
+	for {
+		_, err := os.Stat(s.path(n))
+		if notExist(err) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func (s dirPatchStore) Load(v int) (ChainEntry, error) {
+	b, err := os.ReadFile(s.path(v))
+	if err != nil {
+		return ChainEntry{}, err
+	}
+	if len(b) < 8 {
+		return ChainEntry{}, fmt.Errorf("%w: chain entry %s is truncated", ErrCorruptPatch, s.path(v))
+	}
+	base := int64(binary.LittleEndian.Uint64(b))
+	if base == -1 {
+		return ChainEntry{Snapshot: true, Data: b[8:]}, nil
+	}
+	return ChainEntry{Base: int(base), Data: b[8:]}, nil
+}
+
+func (s dirPatchStore) Replace(v int, e ChainEntry) error {
+	if n, err := s.Len(); err != nil {
+		return err
+	} else if v < 0 || v > n {
+		return fmt.Errorf("%w: version %d is out of range [0, %d]", ErrInvalidArgument, v, n)
+	}
+	if err := os.MkdirAll(string(s), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(string(s), ".entry-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	base := int64(e.Base)
+	if e.Snapshot {
+		base = -1
+	}
+	_, err = tmp.Write(binary.LittleEndian.AppendUint64(nil, uint64(base)))
+	if err == nil {
+		_, err = tmp.Write(e.Data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := renameReplace(tmp.Name(), s.path(v), true); err != nil {
+		return err
+	}
+	return syncDir(string(s))
+}
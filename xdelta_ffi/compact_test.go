@@ -0,0 +1,166 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memPatchStore 测试用的 PatchStore，记录每次 Replace 的版本；corrupt 不为 nil 时 Replace 保存的是 corrupt(e)
+type memPatchStore struct {
+	entries  []ChainEntry
+	replaced []int
+	corrupt  func(ChainEntry) ChainEntry
+}
+
+func (s *memPatchStore) Len() (int, error) { return len(s.entries), nil }
+
+func (s *memPatchStore) Load(v int) (ChainEntry, error) {
+	if v < 0 || v >= len(s.entries) {
+		return ChainEntry{}, fmt.Errorf("version %d: %w", v, os.ErrNotExist)
+	}
+	return s.entries[v], nil
+}
+
+func (s *memPatchStore) Replace(v int, e ChainEntry) error {
+	if s.corrupt != nil {
+		e = s.corrupt(e)
+	}
+	s.replaced = append(s.replaced, v)
+	if v == len(s.entries) {
+		s.entries = append(s.entries, e)
+	} else {
+		s.entries[v] = e
+	}
+	return nil
+}
+
+// compactVersions 八个版本，每一版在上一版的不同位置有少量改动
+func compactVersions() [][]byte {
+	v, _ := textFixture(64 << 10)
+	versions := [][]byte{v}
+	for i := 1; i < 8; i++ {
+		at := i * 7000
+		v = append(append(bytes.Clone(v[:at]), fmt.Sprintf("edit %d\n", i)...), v[at+100:]...)
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// linearChain 把 versions 写入 store：版本 0 是快照，其余每个版本是基于上一个版本的补丁
+func linearChain(t *testing.T, store PatchStore, versions [][]byte) {
+	t.Helper()
+	if err := store.Replace(0, ChainEntry{Snapshot: true, Data: versions[0]}); err != nil {
+		t.Fatal(err)
+	}
+	for v := 1; v < len(versions); v++ {
+		p, err := CreateDiffs(versions[v-1], versions[v])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Replace(v, ChainEntry{Base: v - 1, Data: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestCompactChainRoundTrip 压缩后关键帧上的版本是快照，其余版本是基于关键帧的补丁，每个版本恢复的内容不变；
+// 再次压缩时不替换任何项；NewDirPatchStore 中的链同样可以压缩
+func TestCompactChainRoundTrip(t *testing.T) {
+	requireNative(t)
+	versions := compactVersions()
+	policy := CompactionPolicy{KeyframeInterval: 3, VerifySamples: len(versions)}
+	for _, name := range []string{"memory", "dir"} {
+		var store PatchStore = &memPatchStore{}
+		if name == "dir" {
+			store = NewDirPatchStore(filepath.Join(t.TempDir(), "chain"))
+		}
+		linearChain(t, store, versions)
+		if err := CompactChain(store, policy); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for v, want := range versions {
+			e, err := store.Load(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k := v - v%3; e.Snapshot != (v == k) || !e.Snapshot && e.Base != k {
+				t.Fatalf("%s: version %d is a snapshot: %v, based on %d, want keyframe %d", name, v, e.Snapshot, e.Base, k)
+			}
+			got, err := RestoreVersion(store, v)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("%s: version %d restored to %d bytes, %v", name, v, len(got), err)
+			}
+		}
+	}
+
+	store := &memPatchStore{}
+	linearChain(t, store, versions)
+	store.replaced = nil
+	if err := CompactChain(store, policy); err != nil {
+		t.Fatal(err)
+	}
+	// 版本 3、6 换成快照，2、5 换成合并的补丁；1、4、7 本来就基于关键帧
+	if want := []int{2, 3, 5, 6}; fmt.Sprint(store.replaced) != fmt.Sprint(want) {
+		t.Fatalf("replaced %v, want %v", store.replaced, want)
+	}
+	store.replaced = nil
+	if err := CompactChain(store, policy); err != nil || len(store.replaced) != 0 {
+		t.Fatalf("second compaction replaced %v: %v", store.replaced, err)
+	}
+}
+
+// TestCompactChainCorrupt 链中的补丁损坏时返回 ErrCorruptPatch，之前的版本已经压缩，之后的项不变；
+// 存储保存的项与给它的不同时抽查返回 ErrTargetMismatch；截断的 NewDirPatchStore 文件返回 ErrCorruptPatch；
+// 关键帧间隔不大于 0 时返回 ErrInvalidArgument
+func TestCompactChainCorrupt(t *testing.T) {
+	requireNative(t)
+	versions := compactVersions()
+	policy := CompactionPolicy{KeyframeInterval: 3, VerifySamples: -1}
+
+	store := &memPatchStore{}
+	linearChain(t, store, versions)
+	store.entries[5].Data = store.entries[5].Data[:len(store.entries[5].Data)-3]
+	later := store.entries[6]
+	if err := CompactChain(store, policy); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("corrupt patch: got %v, want ErrCorruptPatch", err)
+	}
+	if e := store.entries[3]; !e.Snapshot {
+		t.Fatal("version 3 was not compacted before the corrupt patch")
+	}
+	if e := store.entries[6]; e.Snapshot || !bytes.Equal(e.Data, later.Data) {
+		t.Fatal("version 6 was changed after the corrupt patch")
+	}
+
+	// 存储把快照的最后一个字节改掉：逐项替换之前的检查看不到，抽查发现
+	store = &memPatchStore{}
+	linearChain(t, store, versions)
+	store.corrupt = func(e ChainEntry) ChainEntry {
+		if e.Snapshot {
+			e.Data = append(bytes.Clone(e.Data[:len(e.Data)-1]), '#')
+		}
+		return e
+	}
+	if err := CompactChain(store, CompactionPolicy{KeyframeInterval: 3, VerifySamples: len(versions)}); !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("store that corrupts snapshots: got %v, want ErrTargetMismatch", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "chain")
+	ds := NewDirPatchStore(dir)
+	linearChain(t, ds, versions)
+	if err := os.WriteFile(filepath.Join(dir, "v00000004"), []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompactChain(ds, policy); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("truncated entry file: got %v, want ErrCorruptPatch", err)
+	}
+	if err := ds.Replace(len(versions)+1, ChainEntry{Snapshot: true}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Replace past the end: got %v, want ErrInvalidArgument", err)
+	}
+	if err := CompactChain(&memPatchStore{}, CompactionPolicy{}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("keyframe interval 0: got %v, want ErrInvalidArgument", err)
+	}
+}
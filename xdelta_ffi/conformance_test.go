@@ -0,0 +1,243 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// conformanceCase 在 cgo 和 purego 后端上必须得到相同结果的一次调用，返回补丁、输出或错误
+type conformanceCase struct {
+	name string
+	run  func(oldData, newData []byte) ([]byte, error)
+}
+
+func conformanceCases() []conformanceCase {
+	applyTo := func(create func(oldData, newData []byte) ([]byte, error)) func(oldData, newData []byte) ([]byte, error) {
+		return func(oldData, newData []byte) ([]byte, error) {
+			patch, err := create(oldData, newData)
+			if err != nil {
+				return nil, err
+			}
+			return ApplyDiffsData(oldData, patch)
+		}
+	}
+	create := func(opts ...Option) func(oldData, newData []byte) ([]byte, error) {
+		return func(oldData, newData []byte) ([]byte, error) {
+			return CreateDiffs(oldData, newData, opts...)
+		}
+	}
+	cases := []conformanceCase{
+		{"CreateDiffsData", func(oldData, newData []byte) ([]byte, error) {
+			return CreateDiffsData(oldData, newData, 1024)
+		}},
+		{"CreateDiffsData empty old", func(_, newData []byte) ([]byte, error) {
+			return CreateDiffsData(nil, newData, 1024)
+		}},
+		{"CreateDiffsDataVec", func(oldData, newData []byte) ([]byte, error) {
+			return CreateDiffsDataVec([][]byte{oldData[:1000], oldData[1000:]}, [][]byte{newData[:5000], newData[5000:]}, 1024)
+		}},
+		{"CreateDiffs standard VCDIFF", create(WithStandardVCDIFF())},
+		{"CreateDiffs checksum", create(WithChecksum(ChecksumXXH3))},
+		{"CreateDiffsStream", func(oldData, newData []byte) ([]byte, error) {
+			var b bytes.Buffer
+			err := CreateDiffsStream(bytes.NewReader(oldData), bytes.NewReader(newData), &b)
+			return b.Bytes(), err
+		}},
+		{"SourceEncoder", func(oldData, newData []byte) ([]byte, error) {
+			se, err := NewSourceEncoder(oldData)
+			if err != nil {
+				return nil, err
+			}
+			defer se.Close()
+			return se.Diff(newData)
+		}},
+		{"ApplyDiffsData", applyTo(create())},
+		{"ApplyDiffsStream", func(oldData, newData []byte) ([]byte, error) {
+			patch, err := CreateDiffs(oldData, newData)
+			if err != nil {
+				return nil, err
+			}
+			var b bytes.Buffer
+			err = ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b)
+			return b.Bytes(), err
+		}},
+		{"InspectPatch", func(oldData, newData []byte) ([]byte, error) {
+			patch, err := CreateDiffs(oldData, newData, WithChecksum(ChecksumXXH3))
+			if err != nil {
+				return nil, err
+			}
+			info, err := InspectPatch(patch)
+			return fmt.Appendf(nil, "%+v", info), err
+		}},
+		{"DumpPatch", func(oldData, newData []byte) ([]byte, error) {
+			patch, err := CreateDiffs(oldData, newData)
+			if err != nil {
+				return nil, err
+			}
+			var b bytes.Buffer
+			err = DumpPatch(patch, &b, WithDumpInstructions())
+			return b.Bytes(), err
+		}},
+		{"corrupt patch", func(oldData, _ []byte) ([]byte, error) {
+			return ApplyDiffsData(oldData, []byte("garbage"))
+		}},
+		{"source mismatch", func(oldData, newData []byte) ([]byte, error) {
+			patch, err := CreateDiffs(oldData, newData)
+			if err != nil {
+				return nil, err
+			}
+			return ApplyDiffsData(oldData[:100], patch)
+		}},
+	}
+	for _, s := range testSecondaries[1:] {
+		cases = append(cases, conformanceCase{"CreateDiffs " + s.String(), create(WithSecondaryCompression(s))})
+	}
+	return cases
+}
+
+// TestConformance 两个原生后端共用的一组调用：创建的补丁都能还原出新数据，错误都带有原生错误码。
+// 设置了 XDELTA_CONFORMANCE_OUT 时把每个调用结果的摘要写入这个文件，供 TestBackendsConform 比较
+func TestConformance(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(256 << 10)
+	var summary strings.Builder
+	for _, c := range conformanceCases() {
+		got, err := c.run(oldData, newData)
+		if err != nil {
+			var ne *Error
+			if !errors.As(err, &ne) {
+				t.Errorf("%s: got %v, want a native *Error", c.name, err)
+			}
+			fmt.Fprintf(&summary, "%s: error %v\n", c.name, err)
+			continue
+		}
+		if strings.HasPrefix(c.name, "Create") || c.name == "SourceEncoder" {
+			base := oldData
+			if c.name == "CreateDiffsData empty old" {
+				base = nil
+			}
+			if out, err := ApplyDiffsData(base, got); err != nil || !bytes.Equal(out, newData) {
+				t.Errorf("%s: applying the patch gave %d bytes, %v", c.name, len(out), err)
+			}
+		} else if strings.HasPrefix(c.name, "Apply") && !bytes.Equal(got, newData) {
+			t.Errorf("%s: got %d bytes, want %d", c.name, len(got), len(newData))
+		}
+		fmt.Fprintf(&summary, "%s: %d bytes %x\n", c.name, len(got), sha256.Sum256(got))
+	}
+	if p := os.Getenv("XDELTA_CONFORMANCE_OUT"); p != "" {
+		if err := os.WriteFile(p, []byte(summary.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestBackendsConform 分别用 cgo 和 purego 后端运行 TestConformance，两者的补丁、输出和错误完全相同；
+// 需要 go 命令、cgo 工具链和原生库，-short 时跳过
+func TestBackendsConform(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the package twice")
+	}
+	if os.Getenv("XDELTA_CONFORMANCE_OUT") != "" {
+		t.Skip("running inside TestBackendsConform")
+	}
+	requireNative(t)
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	if out, err := exec.Command(gobin, "env", "CGO_ENABLED").Output(); err != nil || strings.TrimSpace(string(out)) != "1" {
+		t.Skip("cgo is not available")
+	}
+	if LibraryPath() == "" {
+		t.Skip("the native library is linked statically")
+	}
+	lib, err := filepath.Abs(LibraryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	summaries := map[string][]byte{}
+	for _, tags := range []string{"", "xdelta_purego"} {
+		out := filepath.Join(dir, "conformance"+tags)
+		cmd := exec.Command(gobin, "test", "-count=1", "-tags="+tags, "-run=^TestConformance$", ".")
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=1", "XDELTA_LIB_PATH="+lib, "XDELTA_CONFORMANCE_OUT="+out)
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go test -tags=%q: %v\n%s", tags, err, b)
+		}
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("-tags=%q: %v", tags, err)
+		}
+		summaries[tags] = b
+	}
+	cgoLines, puregoLines := strings.Split(string(summaries[""]), "\n"), strings.Split(string(summaries["xdelta_purego"]), "\n")
+	if len(cgoLines) != len(conformanceCases())+1 {
+		t.Fatalf("cgo backend reported %d results, want %d:\n%s", len(cgoLines)-1, len(conformanceCases()), summaries[""])
+	}
+	if !slices.Equal(cgoLines, puregoLines) {
+		for i := range min(len(cgoLines), len(puregoLines)) {
+			if cgoLines[i] != puregoLines[i] {
+				t.Errorf("cgo:    %s\npurego: %s", cgoLines[i], puregoLines[i])
+			}
+		}
+		t.Fatal("the backends disagree")
+	}
+}
+
+// TestMissingSymbolAtLoad 原生库缺少函数时加载阶段就失败并指出缺少的符号，已经加载的库不受影响；
+// 没有 xdelta_version 的库返回 ErrIncompatibleLibrary。需要 C 编译器，只在 Linux 和 macOS 上运行
+func TestMissingSymbolAtLoad(t *testing.T) {
+	requireNative(t)
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("builds a shared library with cc")
+	}
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("cc not found")
+	}
+	dir := t.TempDir()
+	build := func(name, src string) string {
+		t.Helper()
+		c, so := filepath.Join(dir, name+".c"), filepath.Join(dir, name+".so")
+		if err := os.WriteFile(c, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(cc, "-shared", "-fPIC", "-Iinclude", "-o", so, c).CombinedOutput(); err != nil {
+			t.Fatalf("cc: %v\n%s", err, out)
+		}
+		return so
+	}
+	// 只导出 xdelta_version、ABI 与本包相同的库
+	versionOnly := build("version_only", fmt.Sprintf(`#include <string.h>
+#include <xdelta_interface.h>
+void xdelta_version(xdelta_version_info* info) {
+    memset(info, 0, sizeof(*info));
+    info->abi = %d;
+    strcpy(info->crate_version, "test");
+}
+`, WrapperABIVersion))
+	if err := openLibrary(versionOnly); err == nil || errors.Is(err, ErrIncompatibleLibrary) || !strings.Contains(err.Error(), "missing symbol xdelta_") {
+		t.Fatalf("library without the API: got %v, want a missing symbol error", err)
+	}
+	empty := build("empty", "int not_xdelta(void) { return 0; }\n")
+	if err := openLibrary(empty); !errors.Is(err, ErrIncompatibleLibrary) || !strings.Contains(err.Error(), "missing symbol xdelta_version") {
+		t.Fatalf("library without xdelta_version: got %v, want ErrIncompatibleLibrary", err)
+	}
+	oldData, newData := testPair()
+	patch, err := CreateDiffsData(oldData, newData, 1024)
+	if err != nil {
+		t.Fatalf("CreateDiffsData after the failed loads: %v", err)
+	}
+	if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplyDiffsData after the failed loads: %d bytes, %v", len(got), err)
+	}
+}
@@ -0,0 +1,247 @@
+package xdelta_ffi
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithTimeout 让 CreateDiffs、CreateDiffsContext、CreateDiffsBatch 的内存任务、CreateDiffsFixed、ApplyDiffsData、ApplyDiffsDataInto、ApplyDiffsDataPooled、ApplyDiffsDataContext
+// 最多运行 d：到期时与 ctx 取消一样置位原生层的取消标记，释放已产生的部分结果并返回包装了 ErrTimeout 的错误；
+// 与 ctx 同时使用时先到者生效。d 小于等于 0 时不限时，对其他接口没有作用
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// cancelToken 把 ctx 的取消和 WithTimeout 的到期传递给原生层的协作式取消标记
+// 原生层的标记 c 只在 acquireOp 占用名额期间存在（arm 到 disarm），排队和等待期间不持有原生资源
+type cancelToken struct {
+	mu        sync.Mutex
+	c         *nativeCancel
+	triggered bool
+
+	ctx  context.Context
+	stop chan struct{}
+	done chan struct{}
+	// fired 在 ctx 结束或到期时关闭，acquireOp 据此放弃排队
+	fired   chan struct{}
+	timeout time.Duration
+	expired atomic.Bool
+
+	// prog 设置了 WithProgress 时在 arm 到 disarm 期间轮询原生层的进度，见 pollProgress
+	prog     *progress
+	pollStop chan struct{}
+	pollDone chan struct{}
+}
+
+// watchContext 在 ctx 结束时置位取消标记；调用方必须在原生调用返回后调用 release
+func watchContext(ctx context.Context) *cancelToken {
+	return watch(ctx, 0)
+}
+
+// watchOptions 返回在 ctx 结束（ctx 不为 nil 时）或 WithTimeout 到期时置位的取消标记，WithProgress 的回调按 total 报告它的进度；
+// 三者都没有时返回 nil
+func watchOptions(ctx context.Context, o options, total int64) *cancelToken {
+	if ctx == nil && o.timeout <= 0 && o.progress == nil {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := watch(ctx, o.timeout)
+	t.prog = newProgress(o.progress, total)
+	return t
+}
+
+// watch 在 ctx 结束或 timeout（大于 0 时）到期时置位取消标记
+func watch(ctx context.Context, timeout time.Duration) *cancelToken {
+	t := &cancelToken{
+		ctx:     ctx,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		fired:   make(chan struct{}),
+		timeout: timeout,
+	}
+	go func() {
+		defer close(t.done)
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			t.fire()
+		case <-expired:
+			t.expired.Store(true)
+			t.fire()
+		case <-t.stop:
+		}
+	}()
+	return t
+}
+
+// fire 置位取消标记（还没有 arm 时由 arm 补上）并关闭 fired
+func (t *cancelToken) fire() {
+	t.mu.Lock()
+	t.triggered = true
+	if t.c != nil {
+		t.c.trigger()
+	}
+	t.mu.Unlock()
+	close(t.fired)
+}
+
+// arm 建立原生层的取消标记，已经取消或到期时立即置位；由 acquireOp 在占用名额、持有原生库之后调用
+func (t *cancelToken) arm() {
+	t.mu.Lock()
+	t.c = newNativeCancel()
+	if t.triggered {
+		t.c.trigger()
+	}
+	t.mu.Unlock()
+	if t.prog != nil && t.prog.fn != nil {
+		t.pollProgress()
+	}
+}
+
+// disarm 报告最后的进度并释放 arm 建立的取消标记，由 acquireOp 返回的 release 在归还名额之前调用
+func (t *cancelToken) disarm() {
+	if t.pollStop != nil {
+		close(t.pollStop)
+		<-t.pollDone
+		t.pollStop = nil
+		t.reportProgress()
+	}
+	t.mu.Lock()
+	t.c.free()
+	t.c = nil
+	t.mu.Unlock()
+}
+
+// cancel 返回原生层的取消标记，t 为 nil 时返回 nil；只在 acquireOp 占用名额期间有效
+func (t *cancelToken) cancel() *nativeCancel {
+	if t == nil {
+		return nil
+	}
+	return t.c
+}
+
+// release 停止监听并等待监听协程退出；t 可以为 nil
+func (t *cancelToken) release() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+// err 原生层因取消标记被置位而失败时，到期时返回包装了 ErrTimeout 的错误，否则返回 ctx.Err()；其他错误原样返回
+func (t *cancelToken) err(err error) error {
+	var e *Error
+	if t == nil || !errors.As(err, &e) || e.Code != CodeCanceled {
+		return err
+	}
+	if t.expired.Load() {
+		return fmt.Errorf("%w after %v", ErrTimeout, t.timeout)
+	}
+	return t.ctx.Err()
+}
+
+// contextError 原生层因取消标记被置位而失败时返回 ctx.Err()，否则原样返回 err
+func contextError(ctx context.Context, err error) error {
+	var e *Error
+	if errors.As(err, &e) && e.Code == CodeCanceled {
+		return ctx.Err()
+	}
+	return err
+}
+
+// CreateDiffsDataContext 与 CreateDiffsData 相同，但支持通过 ctx 取消
+// 取消会真正中断原生层的计算（编码在每个窗口之间检查取消标记），释放所有原生内存并返回 ctx.Err()
+// ctx 已经结束时直接返回，不会调用原生层
+func CreateDiffsDataContext(ctx context.Context, oldData, newData []byte, blockSize uint32) (patchData []byte, err error) {
+	if m := beginOp(OpCreate, int64(len(oldData)), int64(len(newData))); m != nil {
+		defer func() { m.end(int64(len(patchData)), err) }()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
+	t := watchContext(ctx)
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	patchData, err = createPatchData(appendTo(nil), oldData, newData, resolveBlockSize(blockSize, int64(len(oldData)), int64(len(newData))), defaultEncoding, t.c)
+	release()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return patchData, nil
+}
+
+// CreateDiffsContext 与 CreateDiffs 相同，但支持通过 ctx 取消，opts 的用法不变
+// 取消时与 CreateDiffsDataContext 一样中断原生层的计算并返回 ctx.Err()；ctx 已经结束时直接返回，不会调用原生层；
+// 同时设置了 WithTimeout 时先到者生效，WithReverse 的反向补丁也在同一个 ctx 下生成
+func CreateDiffsContext(ctx context.Context, oldData, newData []byte, opts ...Option) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return createDiffs(ctx, oldData, newData, opts)
+}
+
+// ApplyDiffsDataContext 与 ApplyDiffsData 相同，但支持通过 ctx 取消
+// 解码在每个窗口之间检查取消标记，取消时释放原生层已产生的部分输出并返回 ctx.Err()
+// ctx 已经结束时直接返回，不会调用原生层；同时设置了 WithTimeout 时先到者生效
+func ApplyDiffsDataContext(ctx context.Context, oldData, diffsData []byte, opts ...Option) (newData []byte, err error) {
+	if m := beginOp(OpApply, int64(len(oldData)), int64(len(diffsData))); m != nil {
+		defer func() { m.end(int64(len(newData)), err) }()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	h, diffsData, err := o.openEnvelope(oldData, diffsData)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	t := watchOptions(ctx, o, int64(len(diffsData)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	newData, err = applyPresized(appendTo(nil), oldData, diffsData, o.applyLimit(), t.c)
+	release()
+	if err != nil {
+		return nil, o.limitError(t.err(err))
+	}
+	if h != nil {
+		if err := h.checkTarget(int64(len(newData)), sha256.Sum256(newData)); err != nil {
+			return nil, err
+		}
+	}
+	o.recordApplyPatch(ApplyStats{SourceSize: int64(len(oldData)), PatchSize: int64(len(diffsData)), TargetSize: int64(len(newData)), Windows: 1}, diffsData, start)
+	return newData, nil
+}
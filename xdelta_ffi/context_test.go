@@ -0,0 +1,101 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCreateDiffsDataContextCancel 在原生层编码期间取消 ctx：CreateDiffsDataContext 中断编码，返回 ctx.Err() 和 nil，
+// 比完整编码早得多地返回；之后原生层交给本包的缓冲区、句柄和原生堆都回到开始时的值。
+// 取消得晚时编码可能已经完成，此时结果与不取消时相同
+func TestCreateDiffsDataContextCancel(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(64 << 20)
+	start := time.Now()
+	want, err := CreateDiffsData(oldData, newData, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := time.Since(start)
+
+	allocs, err := DebugAllocStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	heap, err := NativeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceled := 0
+	for _, delay := range []time.Duration{0, full / 20, full / 5, full / 2, 2 * full} {
+		ctx, cancel := context.WithCancel(context.Background())
+		type result struct {
+			patch []byte
+			err   error
+			at    time.Time
+		}
+		done := make(chan result, 1)
+		go func() {
+			patch, err := CreateDiffsDataContext(ctx, oldData, newData, 0)
+			done <- result{patch, err, time.Now()}
+		}()
+		// 名额被占用时原生层的取消标记已经建立，之后的取消一定经由原生层生效
+		for opLimit.inFlight.Load() == 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+		time.Sleep(delay)
+		canceledAt := time.Now()
+		cancel()
+		r := <-done
+		switch {
+		case r.err == nil:
+			if !bytes.Equal(r.patch, want) {
+				t.Fatalf("delay %v: finished with a different patch", delay)
+			}
+		case errors.Is(r.err, context.Canceled) && r.err == ctx.Err():
+			canceled++
+			if r.patch != nil {
+				t.Fatalf("delay %v: %d bytes of patch returned with the error", delay, len(r.patch))
+			}
+			if took := r.at.Sub(canceledAt); took > full/2 && took > 50*time.Millisecond {
+				t.Fatalf("delay %v: returned %v after the cancel, a full encode takes %v", delay, took, full)
+			}
+		default:
+			t.Fatalf("delay %v: got %v, want ctx.Err()", delay, r.err)
+		}
+	}
+	if canceled == 0 {
+		t.Fatal("no encode was canceled")
+	}
+
+	if s, err := DebugAllocStats(); err != nil || s.LiveBuffers != 0 || s.LiveBytes != 0 || s.LiveHandles != allocs.LiveHandles {
+		t.Fatalf("after the canceled encodes: %+v, %v, want no buffers and %d handles", s, err, allocs.LiveHandles)
+	}
+	if s, err := NativeStats(); err != nil || s.CurrentBytes > heap.CurrentBytes {
+		t.Fatalf("native heap %d bytes after the canceled encodes, %d before: %v", s.CurrentBytes, heap.CurrentBytes, err)
+	}
+}
+
+// TestCreateDiffsDataContextDeadline ctx 到期时返回 context.DeadlineExceeded；ctx 已经结束时直接返回，原生层没有编码任何数据
+func TestCreateDiffsDataContextDeadline(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(64 << 20)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := CreateDiffsDataContext(ctx, oldData, newData, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	before, err := NativeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateDiffsDataContext(ctx, oldData, newData, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expired ctx: got %v, want context.DeadlineExceeded", err)
+	}
+	if after, _ := NativeStats(); after.BytesEncoded != before.BytesEncoded {
+		t.Fatalf("an expired ctx encoded %d bytes", after.BytesEncoded-before.BytesEncoded)
+	}
+}
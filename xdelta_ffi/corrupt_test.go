@@ -0,0 +1,137 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// corruptCorpus 读取 testdata/corrupt 中已知损坏的补丁：截断或长度不符的记录、未知的操作码、
+// 损坏的二次压缩流、VCDIFF 和 bsdiff 的错误文件头与截断
+func corruptCorpus(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "corrupt", "*.patch"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(files) == 0 {
+		tb.Fatal("no files in testdata/corrupt")
+	}
+	corpus := map[string][]byte{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		corpus[filepath.Base(f)] = b
+	}
+	return corpus
+}
+
+// TestCorruptCorpus testdata/corrupt 中的每个补丁在内存和流式接口上都返回 ErrCorruptPatch，而不是崩溃；
+// 纯 Go 解码器不支持 zstd，损坏的 zstd 流在这样的构建中返回 ErrUnsupportedPatch
+func TestCorruptCorpus(t *testing.T) {
+	oldData, _ := testPair()
+	for name, patch := range corruptCorpus(t) {
+		want := ErrCorruptPatch
+		if !nativeBackend && secondaryOf(patch[0]) == SecondaryZstd {
+			want = ErrUnsupportedPatch
+		}
+		if _, err := ApplyDiffsData(oldData, patch); !errors.Is(err, want) {
+			t.Errorf("%s: ApplyDiffsData: got %v, want %v", name, err, want)
+		}
+		if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), io.Discard); !errors.Is(err, want) {
+			t.Errorf("%s: ApplyDiffsStream: got %v, want %v", name, err, want)
+		}
+	}
+}
+
+// TestHostileCopy COPY 的偏移和长度在执行之前检查：超出旧数据、偏移加长度溢出都返回 ErrSourceMismatch
+func TestHostileCopy(t *testing.T) {
+	oldData, _ := testPair()
+	copyRecord := func(off uint64, n uint32) []byte {
+		b := binary.LittleEndian.AppendUint64([]byte{0x01}, off)
+		b = binary.LittleEndian.AppendUint32(b, n)
+		return binary.LittleEndian.AppendUint64(append(b, 0x03), uint64(n))
+	}
+	for _, tc := range []struct {
+		name string
+		off  uint64
+		n    uint32
+	}{
+		{"past the end", uint64(len(oldData)), 1},
+		{"overlapping the end", uint64(len(oldData)) - 1, 2},
+		{"offset overflows int64", math.MaxInt64 + 1, 10},
+		{"offset plus length overflows", math.MaxUint64 - 1, 10},
+	} {
+		patch := copyRecord(tc.off, tc.n)
+		if _, err := ApplyDiffsData(oldData, patch); !errors.Is(err, ErrSourceMismatch) {
+			t.Errorf("%s: ApplyDiffsData: got %v, want ErrSourceMismatch", tc.name, err)
+		}
+		if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), io.Discard); !errors.Is(err, ErrSourceMismatch) {
+			t.Errorf("%s: ApplyDiffsStream: got %v, want ErrSourceMismatch", tc.name, err)
+		}
+	}
+	if got, err := ApplyDiffsData(oldData, copyRecord(10, 20)); err != nil || !bytes.Equal(got, oldData[10:30]) {
+		t.Fatalf("valid COPY: %q, %v", got, err)
+	}
+}
+
+// FuzzApplyDiffsData 任意补丁都不会使进程崩溃：要么返回错误，要么内存和流式接口得到相同的结果。
+// 种子为 testdata/corrupt、testdata 中的补丁（包括按 xdelta3 布局编码的 VCDIFF），有原生后端时还有各种格式和二次压缩的合法补丁
+func FuzzApplyDiffsData(f *testing.F) {
+	oldData, newData := testPair()
+	for _, b := range corruptCorpus(f) {
+		f.Add(b)
+	}
+	for _, name := range []string{"lzma.patch", "liblzma.patch", "libbz2.bsdiff", "vcdiff.patch", "vcdiff-appheader.vcdiff", "vcdiff-lzma-declared.vcdiff"} {
+		b, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	if nativeBackend && Init() == nil {
+		seeds := [][]Option{{WithStandardVCDIFF()}, {WithChecksum(ChecksumXXH3)}, {WithBSDiff()}}
+		for _, s := range testSecondaries {
+			seeds = append(seeds, []Option{WithSecondaryCompression(s)})
+		}
+		for _, opts := range seeds {
+			patch, err := CreateDiffs(oldData, newData, opts...)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(patch)
+		}
+		env, err := CreateEnvelope(oldData, newData)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(env)
+	}
+	const limit = 1 << 22
+	f.Fuzz(func(t *testing.T, patch []byte) {
+		got, err := ApplyDiffsData(oldData, patch, WithMaxOutputSize(limit))
+		var b bytes.Buffer
+		serr := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b, WithMaxOutputSize(limit))
+		if err != nil {
+			for _, known := range []error{ErrCorruptPatch, ErrSourceMismatch, ErrOutputTooLarge, ErrUnsupportedPatch, ErrTargetMismatch} {
+				if errors.Is(err, known) {
+					return
+				}
+			}
+			t.Fatalf("ApplyDiffsData: unexpected error %v", err)
+		}
+		if serr != nil {
+			t.Fatalf("ApplyDiffsData succeeded but ApplyDiffsStream failed: %v", serr)
+		}
+		if !bytes.Equal(got, b.Bytes()) {
+			t.Fatalf("ApplyDiffsData returned %d bytes, ApplyDiffsStream %d", len(got), b.Len())
+		}
+	})
+}
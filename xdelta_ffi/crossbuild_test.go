@@ -0,0 +1,127 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// crossTarget go vet 检查的一种构建配置
+type crossTarget struct {
+	goos, goarch string
+	cgo          bool
+	tags         string
+}
+
+func (c crossTarget) String() string {
+	s := c.goos + "/" + c.goarch
+	if c.cgo {
+		s += ",cgo"
+	}
+	if c.tags != "" {
+		s += "," + c.tags
+	}
+	return s
+}
+
+// crossTargets 本包必须能编译的配置：32 位平台上长度、偏移都是 int，超过 int32 的常量不能与 len() 比较；
+// 没有 cgo 工具链时只能检查 purego 和 stub 后端
+var crossTargets = []crossTarget{
+	{goos: "linux", goarch: "386"},
+	{goos: "linux", goarch: "386", tags: "xdelta_purego"},
+	{goos: "linux", goarch: "arm"},
+	{goos: "linux", goarch: "arm", tags: "xdelta_purego"},
+	{goos: "windows", goarch: "386", tags: "xdelta_purego"},
+	{goos: "darwin", goarch: "arm64", tags: "xdelta_purego"},
+}
+
+// TestCrossBuild 对 crossTargets 中的每种配置运行 go vet，需要 go 命令，-short 时跳过
+func TestCrossBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cross-build vet is slow")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	for _, c := range crossTargets {
+		t.Run(c.String(), func(t *testing.T) {
+			t.Parallel()
+			args := []string{"vet"}
+			if c.tags != "" {
+				args = append(args, "-tags", c.tags)
+			}
+			cmd := exec.Command(gobin, append(args, ".")...)
+			cgo := "0"
+			if c.cgo {
+				cgo = "1"
+			}
+			cmd.Env = append(os.Environ(), "GOOS="+c.goos, "GOARCH="+c.goarch, "CGO_ENABLED="+cgo)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, out)
+			}
+		})
+	}
+}
+
+// TestLinkSmoke 在本机上用每种后端链接 cmd/xdelta 并运行 version：cgo 的链接参数按 GOOS 分开（cgo_linux.go、cgo_windows.go），
+// 不会链接别的平台的系统库；有 MinGW 时再交叉链接 windows/amd64。需要 go 命令和原生库，-short 时跳过
+func TestLinkSmoke(t *testing.T) {
+	if testing.Short() {
+		t.Skip("links several binaries")
+	}
+	requireNative(t)
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	if LibraryPath() == "" {
+		t.Skip("the native library is linked statically")
+	}
+	lib, err := filepath.Abs(LibraryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	type linkBuild struct{ name, tags, cgo string }
+	builds := []linkBuild{
+		{"cgo", "", "1"},
+		{"purego", "xdelta_purego", "0"},
+	}
+	if fileExists(filepath.Join("..", "target", "release", "libxdelta.a")) {
+		builds = append(builds, linkBuild{"static", "xdelta_static", "1"})
+	}
+	dir := t.TempDir()
+	for _, b := range builds {
+		t.Run(b.name, func(t *testing.T) {
+			exe := filepath.Join(dir, "xdelta-"+b.name)
+			cmd := exec.Command(gobin, "build", "-tags="+b.tags, "-o", exe, "../cmd/xdelta")
+			cmd.Env = append(os.Environ(), "CGO_ENABLED="+b.cgo)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("go build: %v\n%s", err, out)
+			}
+			cmd = exec.Command(exe, "version")
+			cmd.Env = append(os.Environ(), "XDELTA_LIB_PATH="+lib)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("xdelta version: %v\n%s", err, out)
+			}
+			if want := fmt.Sprintf("(abi %d)", WrapperABIVersion); !strings.Contains(string(out), "library:") || !strings.Contains(string(out), want) {
+				t.Fatalf("xdelta version printed:\n%s", out)
+			}
+		})
+	}
+	t.Run("windows/amd64,cgo", func(t *testing.T) {
+		cc, err := exec.LookPath("x86_64-w64-mingw32-gcc")
+		if err != nil {
+			t.Skip("x86_64-w64-mingw32-gcc not found")
+		}
+		cmd := exec.Command(gobin, "build", "-o", filepath.Join(dir, "xdelta.exe"), "../cmd/xdelta")
+		cmd.Env = append(os.Environ(), "GOOS=windows", "GOARCH=amd64", "CGO_ENABLED=1", "CC="+cc)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go build: %v\n%s", err, out)
+		}
+	})
+}
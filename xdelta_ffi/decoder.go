@@ -0,0 +1,126 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"io"
+)
+
+// Decoder 推送式解码器：补丁字节到达时调用 Write（例如来自 websocket），
+// 解码结果随即写入构造时提供的 out，COPY 引用的旧数据从 old 按需读取
+// Decoder 不是并发安全的
+type Decoder struct {
+	dec    *nativeDecoder
+	prog   *progress
+	err    error
+	closed bool
+
+	// out 经由 target 写出，WithVerifyOutput 时由它校验信封；sniffing 表示还在判断补丁是不是信封，head 为此缓存的开头
+	o        options
+	old      io.ReaderAt
+	target   *targetWriter
+	sniffing bool
+	head     []byte
+}
+
+// NewDecoder 创建推送式解码器
+// WithProgress 的回调在每次 Write 之后触发，补丁总量未知，total 为 -1
+// 也接受信封，信封头到齐之前的数据只缓存不解码；WithVerifyOutput 时输出的校验结果由 Close 返回
+// bsdiff 补丁在 Close 时才一次解码写出全部输出，old 的长度需要已知（同 ApplyDiffsStream）
+func NewDecoder(old io.ReaderAt, out io.Writer, opts ...Option) (*Decoder, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkStreamSignature(); err != nil {
+		return nil, err
+	}
+	target := &targetWriter{w: out}
+	dec, err := newNativeDecoder(old, target, o.outputLimit())
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{dec: dec, prog: newProgress(o.progress, -1), o: o, old: old, target: target, sniffing: true}, nil
+}
+
+// Write 送入一段补丁数据，已完整的记录会立即解码写出
+func (d *Decoder) Write(p []byte) (int, error) {
+	if d.closed {
+		return 0, ErrClosed
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	if err := d.feed(p, false); err != nil {
+		d.err = err
+		return 0, err
+	}
+	d.prog.add(len(p))
+	return len(p), nil
+}
+
+// feed 把 p 交给原生层；判断信封期间先缓存，直到能确定补丁是不是信封或者补丁已经结束（final）
+func (d *Decoder) feed(p []byte, final bool) error {
+	if d.sniffing {
+		d.head = append(d.head, p...)
+		if !final && len(d.head) < envelopeLen(d.head) && (IsEnvelope(d.head) || bytes.HasPrefix(envelopeMagic, d.head)) {
+			return nil
+		}
+		d.sniffing = false
+		p, d.head = d.head, nil
+		if IsEnvelope(p) {
+			h, err := d.o.streamEnvelope(p, sourceSize(d.old))
+			if err != nil {
+				return err
+			}
+			if h != nil {
+				if err := d.o.verifySourceAt(h, d.old); err != nil {
+					return err
+				}
+				d.target.verify(h)
+			}
+			p = p[envelopeLen(p):]
+		}
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return d.dec.write(p)
+}
+
+// Close 结束解码并释放原生资源；补丁在记录中途截断、或以补丁头开头（见 WithEndRecord）却没有结束记录时
+// 返回包装了 io.ErrUnexpectedEOF 的错误，
+// WithVerifyOutput 时输出与信封不一致返回 ErrTargetMismatch
+// 重复调用是安全的
+func (d *Decoder) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	defer d.dec.close()
+	if d.err != nil {
+		return d.err
+	}
+	if err := d.feed(nil, true); err != nil {
+		return err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	err = d.dec.finish()
+	release()
+	if err != nil {
+		return err
+	}
+	return d.target.check()
+}
@@ -0,0 +1,400 @@
+package xdelta_ffi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LocalChangePolicy ApplyDirDiff 遇到与清单不一致的本地文件时的处理方式，见 WithLocalChanges
+type LocalChangePolicy int
+
+const (
+	// LocalChangesFail 返回 ErrSourceMismatch，不修改任何文件（默认）
+	LocalChangesFail LocalChangePolicy = iota
+	// LocalChangesOverwrite 以补丁为准：未修改的文件保留本地内容，删除的文件照常删除，新增的文件覆盖本地已有的文件
+	LocalChangesOverwrite
+)
+
+// WithLocalChanges 设置 ApplyDirDiff 对本地改动的处理方式，对其他接口没有影响
+// 清单中 DirUnchanged、DirRemoved 的文件与记录的内容不同，或 DirAdded 的位置已有不同的文件，都算作本地改动；
+// DirModified 的文件或 DirAdded 的 From 与记录的旧内容不同时补丁无法应用，总是返回 ErrSourceMismatch
+func WithLocalChanges(policy LocalChangePolicy) Option {
+	return func(o *options) {
+		o.localChanges = policy
+	}
+}
+
+// WithFileProgress 设置 ApplyDirDiff 的进度回调，每处理完清单中的一个文件（包括无需改动的文件）调用一次，
+// done 为已处理的文件数，total 为清单中的文件总数；回调在调用方所在的 goroutine 中同步触发
+func WithFileProgress(fn func(path string, done, total int)) Option {
+	return func(o *options) {
+		o.fileProgress = fn
+	}
+}
+
+// ApplyDirDiff 把 CreateDirDiff 写在 patchDir 中的目录补丁应用到 baseDir，结果写入 outDir；outDir 与 baseDir 相同时就地更新
+// 先按清单检查 baseDir 中每个文件的大小和哈希，把修改和新增的文件生成到日志目录中暂存并校验；清单记录了 XXH64 时只用它校验
+// （比 SHA-256 快得多，但不能抵御有意构造的碰撞），否则用 SHA-256
+// 全部成功后才把它们移动到位、删除被删除的文件（以及因此变空的目录）；之前任何一步失败都不会改动 outDir 中已有的文件
+// 被替换和删除的文件先移到日志目录中备份，移动到位的过程中出错时自动恢复原状，进程中途退出时可以用 RecoverDirApply
+// 继续完成或用 RollbackDirApply 撤销；日志目录由 WithJournal 指定，默认为 outDir 下的临时目录 .xdelta-apply-*
+// 就地更新时，已经是新内容的文件直接跳过，因此中断后可以重新执行；不在清单中的文件保持不变，
+// outDir 与 baseDir 不同时只写入清单中留存的文件，权限沿用 baseDir 中的文件，新增的文件为 0644
+// 错误的格式为 "<path>: ..."；本地改动按 WithLocalChanges 处理，WithMaxOutputSize 对每个文件分别生效，
+// WithFileProgress 报告进度；清单不合法或引用 patchDir 之外的路径时返回 ErrCorruptPatch
+// patchDir 也可以是 WriteBundle 写出的包文件，包损坏时同样返回 ErrCorruptPatch；清单引用 blob 时每个 blob 只读取一次，
+// 只有 Blob 的项从 WithBlobStore 中取得（见 WithBlobStore）
+func ApplyDirDiff(baseDir, patchDir, outDir string, opts ...Option) error {
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	// patchDir 是文件时是 WriteBundle 写出的包
+	var m *DirManifest
+	var bundle *Bundle
+	if fi, err := os.Stat(patchDir); err == nil && !fi.IsDir() {
+		f, err := os.Open(patchDir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if bundle, err = OpenBundle(f, fi.Size()); err != nil {
+			return err
+		}
+		m = bundle.Manifest
+	} else if m, err = readDirManifest(patchDir); err != nil {
+		return err
+	}
+	inPlace := isWithin(outDir, baseDir) && isWithin(baseDir, outDir)
+	a := &dirApply{o: o, base: baseDir, patches: patchDir, bundle: bundle, out: outDir, inPlace: inPlace}
+	return a.run(m)
+}
+
+// dirApply 一次 ApplyDirDiff 的状态：prepare 只写暂存目录，commit 才改动 outDir
+type dirApply struct {
+	o                           options
+	base, patches, out, journal string
+	// baseFS 不为 nil 时从中读取旧文件（ApplyDirDiffFS），base 不使用
+	baseFS fs.FS
+	// bundle 不为 nil 时补丁从包中读取，patches 是包文件
+	bundle  *Bundle
+	inPlace bool
+	// staged 暂存的文件，按清单顺序移动到 outDir
+	staged []stagedFile
+	// removed 就地更新时需要删除的文件
+	removed []string
+	// blobs 已经取得的 blob 在暂存目录中的副本
+	blobs map[string]string
+}
+
+type stagedFile struct {
+	tmp, path string
+}
+
+// run 准备日志目录，逐个处理 m 中的文件，全部成功后提交
+func (a *dirApply) run(m *DirManifest) error {
+	if err := os.MkdirAll(a.out, 0755); err != nil {
+		return err
+	}
+	journal, err := newJournalDir(a.out, a.o.journal)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(journal, dirJournalStage), 0755); err != nil {
+		discardJournal(journal)
+		return err
+	}
+	a.journal = journal
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		if err := a.prepare(e); err != nil {
+			discardJournal(journal)
+			return fmt.Errorf("%s: %w", e.Path, err)
+		}
+		if a.o.fileProgress != nil {
+			a.o.fileProgress(e.Path, i+1, len(m.Entries))
+		}
+	}
+	return a.commit()
+}
+
+func (a *dirApply) prepare(e *DirEntry) error {
+	basePath := filepath.Join(a.base, filepath.FromSlash(e.Path))
+	switch e.Action {
+	case DirUnchanged:
+		ok, err := a.matches(e.Path, e.OldSize, e.OldSHA256, e.OldXXH64)
+		if err != nil {
+			return err
+		}
+		if !ok && a.o.localChanges == LocalChangesFail {
+			return fmt.Errorf("%w: the file has local changes", ErrSourceMismatch)
+		}
+		if a.inPlace {
+			return nil
+		}
+		return a.stageCopy(e.Path)
+
+	case DirRemoved:
+		if !a.inPlace {
+			return nil
+		}
+		// 已经是目录时文件在之前的一次执行中被新版本的目录替换了
+		if fi, err := os.Lstat(basePath); notExist(err) || err == nil && fi.IsDir() {
+			return nil
+		}
+		ok, err := a.matches(e.Path, e.OldSize, e.OldSHA256, e.OldXXH64)
+		if err != nil {
+			return err
+		}
+		if !ok && a.o.localChanges == LocalChangesFail {
+			return fmt.Errorf("%w: the file to remove has local changes", ErrSourceMismatch)
+		}
+		a.removed = append(a.removed, e.Path)
+		return nil
+
+	case DirAdded:
+		// 已有的目录只可能是旧版本中的目录（例如旧的 a/b 与新的 a），其中的文件在 commit 中先被删除
+		if a.inPlace {
+			if fi, err := os.Lstat(basePath); err == nil && !fi.IsDir() {
+				ok, err := a.matches(e.Path, e.NewSize, e.NewSHA256, e.NewXXH64)
+				if err != nil {
+					return err
+				}
+				if ok {
+					return nil
+				}
+				if a.o.localChanges == LocalChangesFail {
+					return fmt.Errorf("%w: a different file already exists", ErrSourceMismatch)
+				}
+			}
+		}
+		if e.From != "" {
+			return a.stageFrom(e)
+		}
+		tmp := a.tmpName()
+		if e.Blob != "" {
+			src, err := a.blobFile(e)
+			if err != nil {
+				return err
+			}
+			if _, err := copyFile(src, tmp); err != nil {
+				return err
+			}
+		} else if _, err := a.copyPatch(e.Patch, tmp); err != nil {
+			return err
+		}
+		if err := a.checkOutput(tmp, e.NewSize, e.NewSHA256, e.NewXXH64); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp, 0644); err != nil {
+			return err
+		}
+		a.staged = append(a.staged, stagedFile{tmp: tmp, path: e.Path})
+		return nil
+
+	case DirModified:
+		if a.inPlace {
+			if ok, err := a.matches(e.Path, e.NewSize, e.NewSHA256, e.NewXXH64); err == nil && ok {
+				return nil
+			}
+		}
+		ok, err := a.matches(e.Path, e.OldSize, e.OldSHA256, e.OldXXH64)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: the file differs from the one the patch was made for", ErrSourceMismatch)
+		}
+		tmp := a.tmpName()
+		// 输出超出记录的大小时补丁与清单不符，不必等到解码完毕
+		limit := a.o.outputLimit()
+		if e.NewSize > 0 && (limit == 0 || uint64(e.NewSize) < limit) {
+			limit = uint64(e.NewSize)
+		}
+		if a.baseFS != nil {
+			err = a.applyFS(e, tmp, limit)
+		} else {
+			err = a.applyFile(basePath, e, tmp, limit)
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.checkOutput(tmp, e.NewSize, e.NewSHA256, e.NewXXH64); err != nil {
+			return err
+		}
+		_ = os.Chmod(tmp, a.baseMode(e.Path))
+		a.staged = append(a.staged, stagedFile{tmp: tmp, path: e.Path})
+		return nil
+	}
+	return fmt.Errorf("%w: unknown action %q", ErrCorruptPatch, e.Action)
+}
+
+// applyFile 用 patchDir、包中的补丁或 blob 把 basePath 解码到 tmp
+func (a *dirApply) applyFile(basePath string, e *DirEntry, tmp string, limit uint64) error {
+	patchPath := filepath.Join(a.patches, filepath.FromSlash(e.Patch))
+	if e.Blob != "" {
+		p, err := a.blobFile(e)
+		if err != nil {
+			return err
+		}
+		patchPath = p
+	} else if a.bundle != nil {
+		// 原生层只能从文件读取补丁，先从包中解出
+		patchPath = filepath.Join(a.journal, dirJournalStage, "patch")
+		if _, err := a.bundle.extract(e.Patch, patchPath); err != nil {
+			return err
+		}
+		defer os.Remove(patchPath)
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = applyPatchFile(basePath, patchPath, tmp, limit, a.o.mmap)
+	return err
+}
+
+func (a *dirApply) statBase(rel string) (fs.FileInfo, error) {
+	if a.baseFS != nil {
+		return fs.Stat(a.baseFS, rel)
+	}
+	return os.Stat(filepath.Join(a.base, filepath.FromSlash(rel)))
+}
+
+func (a *dirApply) openBase(rel string) (fs.File, error) {
+	if a.baseFS != nil {
+		return a.baseFS.Open(rel)
+	}
+	return os.Open(filepath.Join(a.base, filepath.FromSlash(rel)))
+}
+
+// baseMode 返回旧文件 rel 的权限，作为新文件的权限；旧文件来自 fs.FS 时（例如 embed.FS 中只读的文件）一律为 0644
+func (a *dirApply) baseMode(rel string) fs.FileMode {
+	if a.baseFS == nil {
+		if fi, err := a.statBase(rel); err == nil {
+			return fi.Mode().Perm()
+		}
+	}
+	return 0644
+}
+
+// matches 报告旧文件 rel 的大小和哈希是否与记录的一致（记录了 XXH64 时只计算 XXH64），文件不存在时返回 false
+func (a *dirApply) matches(rel string, size int64, sum, xxh string) (bool, error) {
+	fi, err := a.statBase(rel)
+	if notExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() != size {
+		return false, nil
+	}
+	f, err := a.openBase(rel)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return sumMatches(f, sum, xxh)
+}
+
+// stageCopy 把旧文件 rel 复制到暂存目录，沿用它的权限
+func (a *dirApply) stageCopy(rel string) error {
+	tmp := a.tmpName()
+	src, err := a.openBase(rel)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := writeFile(tmp, src); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, a.baseMode(rel)); err != nil {
+		return err
+	}
+	a.staged = append(a.staged, stagedFile{tmp: tmp, path: rel})
+	return nil
+}
+
+// stageFrom 把改名或复制的来源 e.From 复制到暂存目录，先检查它就是记录的新内容；
+// 就地更新时来源可能随后被删除或修改，暂存的副本不受影响
+func (a *dirApply) stageFrom(e *DirEntry) error {
+	ok, err := a.matches(e.From, e.NewSize, e.NewSHA256, e.NewXXH64)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s to copy from differs from the manifest", ErrSourceMismatch, e.From)
+	}
+	if err := a.stageCopy(e.From); err != nil {
+		return err
+	}
+	a.staged[len(a.staged)-1].path = e.Path
+	return nil
+}
+
+// copyPatch 把补丁目录或包中的 name 复制到 dst
+func (a *dirApply) copyPatch(name, dst string) (int64, error) {
+	if a.bundle != nil {
+		return a.bundle.extract(name, dst)
+	}
+	return copyFile(filepath.Join(a.patches, filepath.FromSlash(name)), dst)
+}
+
+func (a *dirApply) checkOutput(p string, size int64, sum, xxh string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return fmt.Errorf("%w: output is %d bytes, the manifest expects %d", ErrTargetMismatch, fi.Size(), size)
+	}
+	ok, err := sumMatches(f, sum, xxh)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: output %s differs from the manifest", ErrTargetMismatch, hashName(xxh))
+	}
+	return nil
+}
+
+func (a *dirApply) tmpName() string {
+	return filepath.Join(a.journal, dirJournalStage, strconv.Itoa(len(a.staged)))
+}
+
+// notExist 报告 err 是否表示文件不存在，包括路径中的某个目录已经是文件的情况
+func notExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// readDirManifest 读取并检查 patchDir 中的清单
+func readDirManifest(patchDir string) (*DirManifest, error) {
+	f, err := os.Open(filepath.Join(patchDir, DirManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadManifest(f)
+}
+
+// localPath 报告 / 分隔的 p 是否是不会离开所在目录的相对路径；含有 \ 的路径在各个系统上都不接受，
+// 否则同一个清单在 Windows 和其他系统上会指向不同的文件
+func localPath(p string) bool {
+	return fs.ValidPath(p) && p != "." && !strings.ContainsRune(p, '\\') && filepath.IsLocal(filepath.FromSlash(p))
+}
@@ -0,0 +1,394 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DirManifestName CreateDirDiff 在 outDir 中写入的清单文件名
+const DirManifestName = "manifest.json"
+
+// dirPatchDir 补丁和新增文件在 outDir 中的子目录
+const dirPatchDir = "files"
+
+// DirAction 目录补丁中一个文件的变化
+type DirAction string
+
+const (
+	// DirAdded 只存在于新目录，outDir 中保存完整内容
+	DirAdded DirAction = "added"
+	// DirRemoved 只存在于旧目录
+	DirRemoved DirAction = "removed"
+	// DirModified 两边都存在但内容不同，outDir 中保存补丁
+	DirModified DirAction = "modified"
+	// DirUnchanged 两边内容相同
+	DirUnchanged DirAction = "unchanged"
+)
+
+// DirEntry 清单中的一个文件
+// Path 是相对于目录根的路径，在所有系统上都用 / 分隔；哈希为小写十六进制的 SHA-256，
+// 不存在的一侧大小为 0、哈希为空；Patch 是补丁（DirModified）或完整内容（DirAdded）相对于 outDir 的路径，其他情况为空
+// ModTime 为生成清单时文件的修改时间（Unix 纳秒），XXH64 为小写十六进制的 XXH64，供 WithPreviousManifest 和
+// ApplyDirDiff 的快速校验使用；旧版本写出的清单中没有这两项，为零值
+// Blob 为 WithBlobDedup、WithBlobStore 时 Patch 内容的 SHA-256（blob id），PatchSize 为 blob 的大小，多项可以引用同一个 blob；
+// 只有 Blob 没有 Patch 的项的内容在 BlobStore 中
+// From 为 WithRenameDetection 时内容与新增文件相同的旧文件路径，这样的 DirAdded 项没有 Patch 和 Blob，应用时从旧目录复制；
+// 旧文件同时被删除时就是改名
+type DirEntry struct {
+	Path       string    `json:"path"`
+	Action     DirAction `json:"action"`
+	OldSize    int64     `json:"old_size"`
+	OldSHA256  string    `json:"old_sha256,omitempty"`
+	OldModTime int64     `json:"old_mtime,omitempty"`
+	OldXXH64   string    `json:"old_xxh64,omitempty"`
+	NewSize    int64     `json:"new_size"`
+	NewSHA256  string    `json:"new_sha256,omitempty"`
+	NewModTime int64     `json:"new_mtime,omitempty"`
+	NewXXH64   string    `json:"new_xxh64,omitempty"`
+	Patch      string    `json:"patch,omitempty"`
+	Blob       string    `json:"blob,omitempty"`
+	From       string    `json:"from,omitempty"`
+	PatchSize  int64     `json:"patch_size"`
+}
+
+// WithRenameDetection CreateDirDiff 识别改名和复制：新增文件的内容（大小和 SHA-256）与某个旧文件相同时，
+// 不保存完整内容，而是在清单的 From 中记录旧文件的路径，应用时从旧目录复制，旧文件被删除时就是改名；
+// 有多个相同的旧文件时取路径最小的。这样的清单需要这一版本以上的 ApplyDirDiff 才能应用
+func WithRenameDetection() Option {
+	return func(o *options) {
+		o.renames = true
+	}
+}
+
+// DirSkipped 无法处理、没有写入 Entries 的路径，Reason 为原因
+type DirSkipped struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// DirManifest CreateDirDiff 生成的清单，Entries 按 Path 排序；JSON 格式见 DirManifestVersion
+type DirManifest struct {
+	Entries []DirEntry
+	Skipped []DirSkipped
+}
+
+// CreateDirDiff 递归比较 oldDir 和 newDir 中的普通文件，为每个修改过的文件生成补丁、为新增的文件保存完整内容，
+// 都写在 outDir/files 下（补丁为 <path>.xdelta，完整内容为 <path>.full），并把清单写入 outDir/manifest.json
+// 文件按大小和 SHA-256 判断是否修改，WithPreviousManifest 时大小和修改时间与记录相同的文件不再读取；补丁按 CreateDiffsFile 的方式流式生成，opts 的含义与它相同，
+// AutoBlockSize 对每个文件分别选择块大小；只记录文件，不记录空目录和权限
+// WithBlobDedup、WithBlobStore 时补丁和完整内容改为按内容去重保存为 blob（见 WithBlobDedup），
+// WithRenameDetection 时与旧文件相同的新增文件只记录来源（见 WithRenameDetection）
+// 无法读取的文件或目录、符号链接等非普通文件记录在 Skipped 中，不会中止整个操作；
+// 某一侧跳过的路径在另一侧的文件同样跳过，避免被误判为新增或删除
+// oldDir、newDir 本身无法读取，或写入 outDir 失败时返回错误；outDir 不能位于 oldDir 或 newDir 之内，其中已有的同名文件会被覆盖
+func CreateDirDiff(oldDir, newDir, outDir string, opts ...Option) (*DirManifest, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{oldDir, newDir} {
+		if isWithin(outDir, dir) {
+			return nil, fmt.Errorf("%w: output directory %s is inside %s", ErrInvalidArgument, outDir, dir)
+		}
+	}
+
+	oldTree, err := walkTree(oldDir)
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := walkTree(newDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	h := newDirHasher(o)
+	blobs := newDirBlobs(o, outDir)
+	m := &DirManifest{}
+	m.Skipped = append(m.Skipped, oldTree.skipped...)
+	m.Skipped = append(m.Skipped, newTree.skipped...)
+	skip := func(p string, err error) {
+		m.Skipped = append(m.Skipped, DirSkipped{Path: p, Reason: err.Error()})
+	}
+	// added 新增文件在 m.Entries 中的下标，所有旧文件的哈希都算出后才保存内容，以便识别改名
+	var added []int
+
+	for _, p := range unionPaths(oldTree.files, newTree.files) {
+		_, inOld := oldTree.files[p]
+		_, inNew := newTree.files[p]
+		// 另一侧跳过了同一路径（已经记录过）或它所在的目录时，无法判断文件的变化
+		if q, ok := oldTree.skippedAt(p); ok {
+			if q != p {
+				skip(p, fmt.Errorf("%s could not be read in the old tree", q))
+			}
+			continue
+		}
+		if q, ok := newTree.skippedAt(p); ok {
+			if q != p {
+				skip(p, fmt.Errorf("%s could not be read in the new tree", q))
+			}
+			continue
+		}
+
+		e := DirEntry{Path: p}
+		oldPath := filepath.Join(oldDir, filepath.FromSlash(p))
+		newPath := filepath.Join(newDir, filepath.FromSlash(p))
+		if inOld {
+			st, err := h.hash(oldPath, p)
+			if err != nil {
+				skip(p, err)
+				continue
+			}
+			e.setOld(st)
+		}
+		if inNew {
+			st, err := h.hash(newPath, p)
+			if err != nil {
+				skip(p, err)
+				continue
+			}
+			e.setNew(st)
+		}
+
+		switch {
+		case !inNew:
+			e.Action = DirRemoved
+		case !inOld:
+			e.Action = DirAdded
+			added = append(added, len(m.Entries))
+		case e.OldSize == e.NewSize && e.OldSHA256 == e.NewSHA256:
+			e.Action = DirUnchanged
+		case blobs != nil:
+			e.Action = DirModified
+			blockSize := resolveBlockSize(o.blockSize, e.OldSize, e.NewSize)
+			if err := blobs.addPatch(&e, oldPath, newPath, blockSize, o); err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+		default:
+			e.Action = DirModified
+			e.Patch = path.Join(dirPatchDir, p+".xdelta")
+			patchPath := filepath.Join(outDir, filepath.FromSlash(e.Patch))
+			if err := os.MkdirAll(filepath.Dir(patchPath), 0755); err != nil {
+				return nil, err
+			}
+			blockSize := resolveBlockSize(o.blockSize, e.OldSize, e.NewSize)
+			release, err := holdOp()
+			if err != nil {
+				return nil, err
+			}
+			stats, err := createPatchFile(oldPath, newPath, patchPath, blockSize, o.encoding(), o.mmap)
+			release()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			e.PatchSize = stats.PatchSize
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	var olds map[fileKey]string
+	if o.renames {
+		olds = oldFiles(m.Entries)
+	}
+	for _, i := range added {
+		e := &m.Entries[i]
+		if from, ok := olds[fileKey{e.NewSize, e.NewSHA256}]; ok {
+			e.From = from
+			continue
+		}
+		newPath := filepath.Join(newDir, filepath.FromSlash(e.Path))
+		if blobs != nil {
+			if err := blobs.addFull(e, newPath); err != nil {
+				return nil, fmt.Errorf("%s: %w", e.Path, err)
+			}
+			continue
+		}
+		e.Patch = path.Join(dirPatchDir, e.Path+".full")
+		if e.PatchSize, err = copyFile(newPath, filepath.Join(outDir, filepath.FromSlash(e.Patch))); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Path, err)
+		}
+	}
+	sort.Slice(m.Skipped, func(i, j int) bool { return m.Skipped[i].Path < m.Skipped[j].Path })
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(outDir, DirManifestName), buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fileKey 按大小和 SHA-256 区分文件内容
+type fileKey struct {
+	size   int64
+	sha256 string
+}
+
+// oldFiles 返回旧目录中每种内容的文件路径，相同的内容取路径最小的（entries 按路径排序）
+func oldFiles(entries []DirEntry) map[fileKey]string {
+	olds := make(map[fileKey]string)
+	for _, e := range entries {
+		k := fileKey{e.OldSize, e.OldSHA256}
+		if _, ok := olds[k]; e.Action != DirAdded && !ok {
+			olds[k] = e.Path
+		}
+	}
+	return olds
+}
+
+// tree 一侧目录中的普通文件（相对路径，/ 分隔）以及跳过的路径
+type tree struct {
+	files   map[string]struct{}
+	skipped []DirSkipped
+	// skippedPaths 跳过的文件和目录
+	skippedPaths map[string]bool
+}
+
+// walkTree 遍历 root，只有 root 本身无法读取时返回错误
+func walkTree(root string) (*tree, error) {
+	t := &tree{files: make(map[string]struct{}), skippedPaths: make(map[string]bool)}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(root, p)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			if rel == "." {
+				return err
+			}
+			t.skip(rel, err.Error())
+			if d == nil || d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.ContainsRune(rel, '\\') {
+			t.skip(rel, "the path contains a backslash, which manifests do not allow")
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case d.IsDir():
+		case d.Type().IsRegular():
+			t.files[rel] = struct{}{}
+		default:
+			t.skip(rel, fmt.Sprintf("not a regular file (%v)", d.Type()))
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (t *tree) skip(rel, reason string) {
+	t.skipped = append(t.skipped, DirSkipped{Path: rel, Reason: reason})
+	t.skippedPaths[rel] = true
+}
+
+// skippedAt 返回被跳过的 p 本身或 p 所在的目录
+func (t *tree) skippedAt(p string) (string, bool) {
+	for q := p; q != "."; q = path.Dir(q) {
+		if t.skippedPaths[q] {
+			return q, true
+		}
+	}
+	return "", false
+}
+
+// unionPaths 返回 a、b 中所有路径，按字典序排列
+func unionPaths(a, b map[string]struct{}) []string {
+	paths := make([]string, 0, len(a)+len(b))
+	for p := range a {
+		paths = append(paths, p)
+	}
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// hashFile 返回文件的大小、修改时间和两种哈希，内容只读取一遍
+func hashFile(p string) (fileState, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return fileState{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fileState{}, err
+	}
+	st := fileState{modTime: fi.ModTime().UnixNano()}
+	st.size, st.sha256, st.xxh64, err = hashReader(f)
+	return st, err
+}
+
+// hashReader 返回读到的字节数和小写十六进制的 SHA-256、XXH64
+func hashReader(r io.Reader) (int64, string, string, error) {
+	sum, x := sha256.New(), newXXH64()
+	n, err := io.Copy(io.MultiWriter(sum, x), r)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return n, hex.EncodeToString(sum.Sum(nil)), hex.EncodeToString(x.Sum(nil)), nil
+}
+
+// copyFile 把 src 复制到 dst，必要时创建 dst 的父目录，返回复制的字节数
+func copyFile(src, dst string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	return writeFile(dst, in)
+}
+
+// writeFile 把 r 的内容写入新建的 dst，出错时删除 dst
+func writeFile(dst string, r io.Reader) (int64, error) {
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return n, err
+}
+
+// isWithin 报告 p 是否是 dir 本身或位于 dir 之内
+func isWithin(p, dir string) bool {
+	ap, err1 := filepath.Abs(p)
+	ad, err2 := filepath.Abs(dir)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(ad, ap)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,102 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ApplyDirDiffFS 与 ApplyDirDiff 相同，但从只读的 base（例如 embed.FS、zip.Reader 或 os.DirFS）读取旧文件，
+// 补丁来自 OpenBundle 打开的包，结果写入 outDir；清单中的 Path 按 fs.FS 的约定（/ 分隔、没有开头的 /）在 base 中查找
+// base 不会被修改，因此总是按 outDir 与 baseDir 不同的方式处理：outDir 中只写入清单中留存的文件，权限一律为 0644；
+// 不支持随机读取（io.ReaderAt）的旧文件（例如 zip 中压缩的文件）先复制到日志目录中再解码
+// opts 和错误与 ApplyDirDiff 相同；base 或 patch 为 nil 时返回 ErrInvalidArgument
+func ApplyDirDiffFS(base fs.FS, patch *Bundle, outDir string, opts ...Option) error {
+	if base == nil || patch == nil {
+		return fmt.Errorf("%w: nil base or bundle", ErrInvalidArgument)
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	a := &dirApply{o: o, baseFS: base, bundle: patch, out: outDir}
+	return a.run(patch.Manifest)
+}
+
+// ApplyDiffsFS 与 ApplyDiffsStream 相同，但旧数据是 fsys 中的文件 name；
+// 文件不支持随机读取（io.ReaderAt）时先复制到临时目录
+func ApplyDiffsFS(fsys fs.FS, name string, patch io.Reader, out io.Writer, opts ...Option) error {
+	old, release, err := readerAtFS(fsys, name, "")
+	if err != nil {
+		return err
+	}
+	defer release()
+	return ApplyDiffsStream(old, patch, out, opts...)
+}
+
+// applyFS 从 baseFS 读取旧文件 e.Path，用包中的补丁（ApplyDirDiffFS 的补丁总是来自包）或 blob 解码到 tmp
+func (a *dirApply) applyFS(e *DirEntry, tmp string, limit uint64) error {
+	old, release, err := readerAtFS(a.baseFS, e.Path, filepath.Join(a.journal, dirJournalStage))
+	if err != nil {
+		return err
+	}
+	defer release()
+	var patch io.Reader
+	if e.Blob != "" {
+		p, err := a.blobFile(e)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		patch = f
+	} else if patch, err = a.bundle.open(e.Patch); err != nil {
+		return err
+	}
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = decodeStream(old, patch, out, a.o.windowSize, limit, newProgress(nil, -1))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// readerAtFS 打开 fsys 中的 name 用于随机读取，文件本身不支持时复制到 spoolDir 中的临时文件（spoolDir 为空时用系统临时目录）
+// 使用完毕后调用 release
+func readerAtFS(fsys fs.FS, name, spoolDir string) (io.ReaderAt, func(), error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r, ok := f.(io.ReaderAt); ok {
+		return r, func() { f.Close() }, nil
+	}
+	defer f.Close()
+	tmp, err := os.CreateTemp(spoolDir, "base-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, f); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return tmp, release, nil
+}
@@ -0,0 +1,127 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dirFSOld ApplyDirDiffFS、ApplyDiffsFS 测试用的旧目录，内嵌后作为只读的 base
+//
+//go:embed testdata/dirfs/old
+var dirFSOld embed.FS
+
+// dirFSBundle 以 testdata/dirfs/old 为旧目录创建目录补丁包：修改 sub/a.txt、删除 removed.txt、新增 new/c.txt，
+// 返回打开的包和新目录的全部内容
+func dirFSBundle(t *testing.T) (*Bundle, map[string][]byte) {
+	t.Helper()
+	oldDir := filepath.Join("testdata", "dirfs", "old")
+	newTree := map[string][]byte{}
+	for name, data := range readTree(t, oldDir) {
+		if data != nil && name != "removed.txt" {
+			newTree[name] = data
+		}
+	}
+	a := newTree["sub/a.txt"]
+	newTree["sub/a.txt"] = append(append(bytes.Clone(a[:len(a)/2]), "a changed line\n"...), a[len(a)/2:]...)
+	newTree["new/c.txt"] = []byte("a file that only exists in the new version\n")
+	newDir := t.TempDir()
+	writeTree(t, newDir, newTree)
+
+	var buf bytes.Buffer
+	if _, err := CreateDirBundle(oldDir, newDir, &buf); err != nil {
+		t.Fatal(err)
+	}
+	b, err := OpenBundle(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, readTree(t, newDir)
+}
+
+// noReaderAtFS 打开的文件不支持 io.ReaderAt，像 zip 中压缩的文件一样，需要先复制一份才能随机读取
+type noReaderAtFS struct{ fs.FS }
+
+func (f noReaderAtFS) Open(name string) (fs.File, error) {
+	file, err := f.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{file}, nil
+}
+
+// TestApplyDirDiffFS 以 embed.FS、os.DirFS 和不支持随机读取的 fs.FS 作为旧目录应用目录补丁包，得到与新目录相同的内容，
+// 旧目录中的路径按 fs.FS 的约定查找；base 或 bundle 为 nil 时返回 ErrInvalidArgument
+func TestApplyDirDiffFS(t *testing.T) {
+	requireNative(t)
+	bundle, want := dirFSBundle(t)
+	embedded, err := fs.Sub(dirFSOld, "testdata/dirfs/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, base := range map[string]fs.FS{
+		"embed.FS":  embedded,
+		"os.DirFS":  os.DirFS(filepath.Join("testdata", "dirfs", "old")),
+		"no ReadAt": noReaderAtFS{embedded},
+	} {
+		out := t.TempDir()
+		if err := ApplyDirDiffFS(base, bundle, out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := readTree(t, out)
+		for p, data := range want {
+			if data != nil && !bytes.Equal(got[p], data) {
+				t.Errorf("%s: %s differs from the new directory", name, p)
+			}
+		}
+		for p, data := range got {
+			if _, ok := want[p]; !ok && data != nil {
+				t.Errorf("%s: unexpected file %s in the output", name, p)
+			}
+		}
+	}
+	if err := ApplyDirDiffFS(nil, bundle, t.TempDir()); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil base: got %v, want ErrInvalidArgument", err)
+	}
+	if err := ApplyDirDiffFS(embedded, nil, t.TempDir()); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil bundle: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestApplyDiffsFS ApplyDiffsFS 从 embed.FS、os.DirFS 和不支持随机读取的 fs.FS 中读取旧文件，结果与 ApplyDiffsStream 相同；
+// 文件不存在时返回 fs.ErrNotExist
+func TestApplyDiffsFS(t *testing.T) {
+	requireNative(t)
+	const name = "sub/deep/b.txt"
+	oldData, err := dirFSOld.ReadFile("testdata/dirfs/old/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newData := append(bytes.Clone(oldData[:len(oldData)/3]), oldData[len(oldData)/2:]...)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := fs.Sub(dirFSOld, "testdata/dirfs/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fsName, fsys := range map[string]fs.FS{
+		"embed.FS":  embedded,
+		"os.DirFS":  os.DirFS(filepath.Join("testdata", "dirfs", "old")),
+		"no ReadAt": noReaderAtFS{embedded},
+	} {
+		var out bytes.Buffer
+		if err := ApplyDiffsFS(fsys, name, bytes.NewReader(patch), &out); err != nil || !bytes.Equal(out.Bytes(), newData) {
+			t.Errorf("%s: %d bytes, %v", fsName, out.Len(), err)
+		}
+	}
+	if err := ApplyDiffsFS(embedded, "missing.txt", bytes.NewReader(patch), io.Discard); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("missing file: got %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,147 @@
+package xdelta_ffi
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// WithPreviousManifest CreateDirDiff 的增量哈希：旧目录或新目录中的文件与 m 中同一路径记录的一侧大小和修改时间都相同时，
+// 直接沿用记录的哈希，不读取文件内容；m 通常是上一次 CreateDirDiff 的清单（它的新目录就是这一次的旧目录）
+// 或 ComputeManifest 的结果。只沿用带有修改时间和 XXH64 的记录，旧版本写出的清单没有效果
+// 修改时间相同并不保证内容相同（例如保留时间戳的复制、精度很低的文件系统），需要时加上 WithParanoidHashing
+func WithPreviousManifest(m *DirManifest) Option {
+	return func(o *options) {
+		o.previousManifest = m
+	}
+}
+
+// WithParanoidHashing 与 WithPreviousManifest 一起使用：大小和修改时间与记录相同的文件仍然完整读取一遍，
+// XXH64 也相同时才沿用记录的 SHA-256，否则重新计算；XXH64 比 SHA-256 快得多，但仍然要读取所有文件
+func WithParanoidHashing() Option {
+	return func(o *options) {
+		o.paranoid = true
+	}
+}
+
+// ComputeManifest 递归计算 dir 中每个普通文件的大小、修改时间、SHA-256 和 XXH64，不生成补丁也不写入任何文件
+// 每项都是 DirUnchanged（old_* 与 new_* 相同），可以保存下来（WriteTo）在下一次 CreateDirDiff 时作为 WithPreviousManifest；
+// 无法读取的路径和非普通文件与 CreateDirDiff 一样记录在 Skipped 中，只有 dir 本身无法读取时返回错误
+func ComputeManifest(dir string) (*DirManifest, error) {
+	t, err := walkTree(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &DirManifest{Skipped: t.skipped}
+	for _, p := range unionPaths(t.files, nil) {
+		st, err := hashFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			m.Skipped = append(m.Skipped, DirSkipped{Path: p, Reason: err.Error()})
+			continue
+		}
+		e := DirEntry{Path: p, Action: DirUnchanged}
+		e.setOld(st)
+		e.setNew(st)
+		m.Entries = append(m.Entries, e)
+	}
+	sort.Slice(m.Skipped, func(i, j int) bool { return m.Skipped[i].Path < m.Skipped[j].Path })
+	return m, nil
+}
+
+// fileState 文件的大小、修改时间（Unix 纳秒）和小写十六进制的 SHA-256、XXH64
+type fileState struct {
+	size          int64
+	modTime       int64
+	sha256, xxh64 string
+}
+
+func (e *DirEntry) setOld(st fileState) {
+	e.OldSize, e.OldModTime, e.OldSHA256, e.OldXXH64 = st.size, st.modTime, st.sha256, st.xxh64
+}
+
+func (e *DirEntry) setNew(st fileState) {
+	e.NewSize, e.NewModTime, e.NewSHA256, e.NewXXH64 = st.size, st.modTime, st.sha256, st.xxh64
+}
+
+// dirHasher 计算 CreateDirDiff 中文件的哈希，prev 为 WithPreviousManifest 中每个路径可以沿用的记录
+type dirHasher struct {
+	prev     map[string][]fileState
+	paranoid bool
+}
+
+func newDirHasher(o options) *dirHasher {
+	h := &dirHasher{paranoid: o.paranoid}
+	if o.previousManifest == nil {
+		return h
+	}
+	h.prev = make(map[string][]fileState, len(o.previousManifest.Entries))
+	for _, e := range o.previousManifest.Entries {
+		add := func(st fileState) {
+			if st.modTime != 0 && st.sha256 != "" && st.xxh64 != "" {
+				h.prev[e.Path] = append(h.prev[e.Path], st)
+			}
+		}
+		if e.Action != DirAdded {
+			add(fileState{e.OldSize, e.OldModTime, e.OldSHA256, e.OldXXH64})
+		}
+		if e.Action != DirRemoved {
+			add(fileState{e.NewSize, e.NewModTime, e.NewSHA256, e.NewXXH64})
+		}
+	}
+	return h
+}
+
+// hash 返回文件 p（清单中的路径为 rel）的状态，大小和修改时间与 prev 中的记录相同时沿用记录
+func (h *dirHasher) hash(p, rel string) (fileState, error) {
+	if recs := h.prev[rel]; len(recs) > 0 {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return fileState{}, err
+		}
+		for _, st := range recs {
+			if st.size != fi.Size() || st.modTime != fi.ModTime().UnixNano() {
+				continue
+			}
+			if !h.paranoid {
+				return st, nil
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return fileState{}, err
+			}
+			ok, err := sumMatches(f, "", st.xxh64)
+			f.Close()
+			if err != nil {
+				return fileState{}, err
+			}
+			if ok {
+				return st, nil
+			}
+			break
+		}
+	}
+	return hashFile(p)
+}
+
+// sumMatches 报告 r 的内容是否与记录的哈希一致：xxh 不为空时只计算 XXH64，否则计算 SHA-256
+func sumMatches(r io.Reader, sha, xxh string) (bool, error) {
+	if xxh != "" {
+		x := newXXH64()
+		if _, err := io.Copy(x, r); err != nil {
+			return false, err
+		}
+		return hex.EncodeToString(x.Sum(nil)) == xxh, nil
+	}
+	_, got, _, err := hashReader(r)
+	return got == sha, err
+}
+
+// hashName sumMatches 按 xxh 是否为空使用的哈希的名字，用于错误信息
+func hashName(xxh string) string {
+	if xxh != "" {
+		return "XXH64"
+	}
+	return "SHA-256"
+}
@@ -0,0 +1,110 @@
+package xdelta_ffi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestComputeManifest 每个普通文件一项，按路径排序，都是 DirUnchanged，两侧的大小、修改时间、SHA-256 和 XXH64 相同且与文件一致；
+// 符号链接记录在 Skipped 中；dir 不存在时返回错误
+func TestComputeManifest(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{"a": []byte("hello\n"), "d/b": []byte(strings.Repeat("line\n", 1000)), "empty": {}}
+	writeTree(t, dir, files)
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Skip(err)
+	}
+	m, err := ComputeManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 3 || m.Entries[0].Path != "a" || m.Entries[1].Path != "d/b" || m.Entries[2].Path != "empty" {
+		t.Fatalf("entries %+v", m.Entries)
+	}
+	for _, e := range m.Entries {
+		fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := files[e.Path]
+		if e.Action != DirUnchanged || e.OldSize != int64(len(data)) || e.OldSHA256 != sha256Hex(data) ||
+			e.OldModTime != fi.ModTime().UnixNano() || len(e.OldXXH64) != 16 || e.Patch != "" {
+			t.Fatalf("%s: %+v", e.Path, e)
+		}
+		if e.NewSize != e.OldSize || e.NewSHA256 != e.OldSHA256 || e.NewModTime != e.OldModTime || e.NewXXH64 != e.OldXXH64 {
+			t.Fatalf("%s: sides differ: %+v", e.Path, e)
+		}
+	}
+	// XXH64 的空输入参考值
+	if got := m.Entries[2].OldXXH64; got != "ef46db3751d8e999" {
+		t.Fatalf("XXH64 of an empty file is %s", got)
+	}
+	if len(m.Skipped) != 1 || m.Skipped[0].Path != "link" {
+		t.Fatalf("skipped %+v", m.Skipped)
+	}
+	if _, err := ComputeManifest(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("missing directory: no error")
+	}
+}
+
+// TestWithPreviousManifest 大小和修改时间与记录相同的文件不读取，直接沿用记录的哈希：记录被改成错误的哈希时，
+// 内容相同的文件因此被当作修改过；修改时间变了或加上 WithParanoidHashing（XXH64 也不符）时重新计算，得到 DirUnchanged；
+// 不带这个选项时总是读取文件
+func TestWithPreviousManifest(t *testing.T) {
+	requireNative(t)
+	oldDir, newDir := t.TempDir(), t.TempDir()
+	same := []byte(strings.Repeat("same line\n", 500))
+	writeTree(t, oldDir, map[string][]byte{"same": same, "changed": []byte("old\n")})
+	writeTree(t, newDir, map[string][]byte{"same": same, "changed": []byte("new\n")})
+	// 两边的文件可能在同一个时钟刻度内写入，新文件的修改时间不能与旧文件的记录相同
+	newTime := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(newDir, "same"), newTime, newTime); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, err := ComputeManifest(oldDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := strings.Repeat("ab", 32)
+	for i := range prev.Entries {
+		if prev.Entries[i].Path == "same" {
+			prev.Entries[i].OldSHA256, prev.Entries[i].NewSHA256 = fake, fake
+			prev.Entries[i].OldXXH64, prev.Entries[i].NewXXH64 = "0123456789abcdef", "0123456789abcdef"
+		}
+	}
+	sameEntry := func(name string, opts ...Option) DirEntry {
+		t.Helper()
+		m, err := CreateDirDiff(oldDir, newDir, t.TempDir(), opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, e := range m.Entries {
+			if e.Path == "same" {
+				return e
+			}
+		}
+		t.Fatalf("%s: no entry for same: %+v", name, m.Entries)
+		return DirEntry{}
+	}
+
+	if e := sameEntry("without the option"); e.Action != DirUnchanged || e.OldSHA256 != sha256Hex(same) {
+		t.Fatalf("without the option: %+v", e)
+	}
+	if e := sameEntry("previous manifest", WithPreviousManifest(prev)); e.Action != DirModified || e.OldSHA256 != fake || e.NewSHA256 != sha256Hex(same) {
+		t.Fatalf("previous manifest: %+v, want the recorded hash on the old side", e)
+	}
+	if e := sameEntry("paranoid", WithPreviousManifest(prev), WithParanoidHashing()); e.Action != DirUnchanged || e.OldSHA256 != sha256Hex(same) {
+		t.Fatalf("paranoid: %+v", e)
+	}
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(oldDir, "same"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if e := sameEntry("touched", WithPreviousManifest(prev)); e.Action != DirUnchanged || e.OldSHA256 != sha256Hex(same) {
+		t.Fatalf("modification time changed: %+v", e)
+	}
+}
@@ -0,0 +1,304 @@
+package xdelta_ffi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// 日志目录的内容：
+//
+//	stage/<n>        暂存的新文件
+//	stage/blob-<id>  清单中的项引用的 blob，每个只取得一次
+//	backup/<i>       第 i 步被替换或删除的原文件
+//	journal.json     暂存全部完成后写入，列出移动到位的每一步；存在时 outDir 可能已经被改动
+//	rollback         开始撤销时写入，之后 RecoverDirApply 也继续撤销
+//
+// 每一步都由两次重命名组成（原文件移到 backup/<i>，暂存的文件移到位），第几步做到哪里可以从这两个文件是否存在推断出来，
+// 因此日志只需要在开始移动之前写一次
+const (
+	dirJournalStage    = "stage"
+	dirJournalBackup   = "backup"
+	dirJournalFile     = "journal.json"
+	dirJournalRollback = "rollback"
+	// dirJournalPrefix 未指定 WithJournal 时在 outDir 中创建的日志目录的前缀
+	dirJournalPrefix = ".xdelta-apply-"
+)
+
+// WithJournal 指定 ApplyDirDiff 的日志目录，用于在进程崩溃后找到未完成的操作；对其他接口没有影响
+// 目录必须与 outDir 在同一个文件系统上（文件通过重命名移动到位），其中已有未完成的日志时 ApplyDirDiff 返回 ErrInvalidArgument，
+// 需要先调用 RecoverDirApply 或 RollbackDirApply；目录必须不存在或为空，ApplyDirDiff 结束后（无论成功与否）被删除
+func WithJournal(dir string) Option {
+	return func(o *options) {
+		o.journal = dir
+	}
+}
+
+// RecoverDirApply 处理 journalDir 中未完成的 ApplyDirDiff，通常在程序启动时调用：
+// 还没有开始改动 outDir 时丢弃暂存的文件，outDir 保持原状；已经开始改动时从中断的那一步继续完成，
+// 得到与 ApplyDirDiff 成功时相同的结果；之前的 RollbackDirApply 被中断时继续撤销
+// journalDir 不存在时什么也不做；完成后删除 journalDir，可以重复调用
+func RecoverDirApply(journalDir string) error {
+	j, err := loadJournal(journalDir)
+	if err != nil || j == nil {
+		return err
+	}
+	if _, err := os.Lstat(filepath.Join(journalDir, dirJournalRollback)); err == nil {
+		return j.rollback()
+	}
+	return j.finish()
+}
+
+// RollbackDirApply 撤销 journalDir 中未完成的 ApplyDirDiff，把已经移动到位的文件移走、恢复备份的原文件，
+// outDir 回到 ApplyDirDiff 之前的状态；journalDir 不存在时什么也不做，完成后删除 journalDir，可以重复调用
+func RollbackDirApply(journalDir string) error {
+	j, err := loadJournal(journalDir)
+	if err != nil || j == nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(journalDir, dirJournalRollback), nil, 0644); err != nil {
+		return err
+	}
+	return j.rollback()
+}
+
+// dirJournal journal.json 的内容
+type dirJournal struct {
+	Version int `json:"version"`
+	// Out outDir 的绝对路径
+	Out string  `json:"out"`
+	Ops []dirOp `json:"ops"`
+
+	dir string
+}
+
+// dirOp 移动到位的一步：Staged 为空时删除 Path，否则用暂存的文件（相对于日志目录）替换 Path
+type dirOp struct {
+	Path   string `json:"path"`
+	Staged string `json:"staged,omitempty"`
+}
+
+// newJournalDir 准备日志目录，dir 为空时在 outDir 中新建一个临时目录
+func newJournalDir(outDir, dir string) (string, error) {
+	if dir == "" {
+		return os.MkdirTemp(outDir, dirJournalPrefix+"*")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, dirJournalFile)); err == nil {
+		return "", fmt.Errorf("%w: journal %s holds an unfinished apply, recover or roll it back first", ErrInvalidArgument, dir)
+	}
+	// 没有 journal.json 时之前的操作还没有改动 outDir，留下的暂存文件可以直接丢弃；
+	// 整个目录最后会被删除，因此不接受含有其他文件的目录
+	entries, err := os.ReadDir(dir)
+	if err != nil && !notExist(err) {
+		return "", err
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case dirJournalStage, dirJournalBackup, dirJournalRollback, dirJournalFile + ".tmp":
+		default:
+			return "", fmt.Errorf("%w: %s is not empty and is not a journal directory", ErrInvalidArgument, dir)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// discardJournal 删除日志目录；journal.json 最先删除，之后再次中断也不会被当作未完成的日志
+func discardJournal(dir string) error {
+	if err := os.Remove(filepath.Join(dir, dirJournalFile)); err != nil && !notExist(err) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// commit 写入日志后依次执行每一步：先删除文件，再把暂存的文件移动到位，这样文件和目录可以互相替换（旧的 a 与新的 a/b）
+// 出错时撤销已经完成的步骤
+func (a *dirApply) commit() error {
+	out, err := filepath.Abs(a.out)
+	if err != nil {
+		return err
+	}
+	j := &dirJournal{Version: 1, Out: out, dir: a.journal}
+	for _, rel := range a.removed {
+		j.Ops = append(j.Ops, dirOp{Path: rel})
+	}
+	for _, s := range a.staged {
+		staged, err := filepath.Rel(a.journal, s.tmp)
+		if err != nil {
+			return err
+		}
+		j.Ops = append(j.Ops, dirOp{Path: s.path, Staged: filepath.ToSlash(staged)})
+	}
+	if err := os.MkdirAll(filepath.Join(a.journal, dirJournalBackup), 0755); err != nil {
+		return err
+	}
+	if err := j.write(); err != nil {
+		discardJournal(a.journal)
+		return err
+	}
+	if err := j.finish(); err != nil {
+		if rerr := j.rollback(); rerr != nil {
+			return fmt.Errorf("%w (rolling back failed too, the journal is kept in %s: %v)", err, a.journal, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// write 写入 journal.json；先写临时文件再重命名，不会留下写了一半的日志
+func (j *dirJournal) write() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(j.dir, dirJournalFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(j.dir, dirJournalFile))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loadJournal 读取 dir 中的日志；没有 journal.json 时丢弃暂存的文件并返回 nil
+func loadJournal(dir string) (*dirJournal, error) {
+	if _, err := os.Lstat(dir); notExist(err) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, dirJournalFile))
+	if notExist(err) {
+		return nil, discardJournal(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := &dirJournal{dir: dir}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("%w: journal: %v", ErrCorruptPatch, err)
+	}
+	if j.Version != 1 {
+		return nil, fmt.Errorf("%w: unknown journal version %d", ErrCorruptPatch, j.Version)
+	}
+	for _, op := range j.Ops {
+		if !localPath(op.Path) || op.Staged != "" && !localPath(op.Staged) {
+			return nil, fmt.Errorf("%w: journal path %q is not a relative path", ErrCorruptPatch, op.Path)
+		}
+	}
+	return j, nil
+}
+
+// finish 从第一步开始执行，已经完成的步骤被跳过，全部完成后删除日志
+func (j *dirJournal) finish() error {
+	for i := range j.Ops {
+		if err := j.forward(i); err != nil {
+			return fmt.Errorf("%s: %w", j.Ops[i].Path, err)
+		}
+	}
+	return discardJournal(j.dir)
+}
+
+// rollback 从最后一步开始撤销，全部撤销后删除日志
+func (j *dirJournal) rollback() error {
+	for i := len(j.Ops) - 1; i >= 0; i-- {
+		if err := j.backward(i); err != nil {
+			return fmt.Errorf("%s: %w", j.Ops[i].Path, err)
+		}
+	}
+	return discardJournal(j.dir)
+}
+
+func (j *dirJournal) target(op dirOp) string {
+	return filepath.Join(j.Out, filepath.FromSlash(op.Path))
+}
+
+func (j *dirJournal) backup(i int) string {
+	return filepath.Join(j.dir, dirJournalBackup, strconv.Itoa(i))
+}
+
+// forward 执行第 i 步；暂存的文件已经不在时这一步已经完成
+func (j *dirJournal) forward(i int) error {
+	op := j.Ops[i]
+	p, b := j.target(op), j.backup(i)
+	var staged string
+	if op.Staged != "" {
+		staged = filepath.Join(j.dir, filepath.FromSlash(op.Staged))
+		if _, err := os.Lstat(staged); notExist(err) {
+			return nil
+		}
+	}
+	// 备份已经存在时原文件已经移走了
+	if _, err := os.Lstat(b); notExist(err) {
+		fi, err := os.Lstat(p)
+		switch {
+		case err == nil && !fi.IsDir():
+			if err := os.Rename(p, b); err != nil {
+				return err
+			}
+		case err != nil && !notExist(err):
+			return err
+		}
+	}
+	if staged == "" {
+		j.prune(op.Path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.Rename(staged, p)
+}
+
+// backward 撤销第 i 步：移动到位的文件放回暂存的位置，再恢复备份，中途中断后可以重新执行
+func (j *dirJournal) backward(i int) error {
+	op := j.Ops[i]
+	p, b := j.target(op), j.backup(i)
+	if op.Staged != "" {
+		staged := filepath.Join(j.dir, filepath.FromSlash(op.Staged))
+		if _, err := os.Lstat(staged); notExist(err) {
+			if err := os.Rename(p, staged); err != nil && !notExist(err) {
+				return err
+			}
+		}
+		// 也包括 forward 在创建目录之后、移动文件之前被中断时留下的空目录
+		j.prune(op.Path)
+	}
+	if _, err := os.Lstat(b); err == nil {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		return os.Rename(b, p)
+	}
+	return nil
+}
+
+// prune 删除 rel 所在的、已经变空的目录，直到 outDir 为止
+func (j *dirJournal) prune(rel string) {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		p := filepath.Join(j.Out, filepath.FromSlash(dir))
+		fi, err := os.Lstat(p)
+		if notExist(err) {
+			continue
+		}
+		// 可能是尚未移走的旧文件（旧的 a 与新的 a/b），不能删除
+		if err != nil || !fi.IsDir() || os.Remove(p) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// journalTrees 日志测试用的新旧目录：n 个小文件，新目录修改三分之一、删除一部分、新增一部分，
+// 并把文件 swap 换成目录 swap/inner（以及反过来的 dir/inner 换成文件 dir）
+func journalTrees(n int) (oldTree, newTree map[string][]byte) {
+	r := fixtureRand(48)
+	oldTree, newTree = map[string][]byte{}, map[string][]byte{}
+	for i := range n {
+		name := fmt.Sprintf("d%02d/f%04d", i%17, i)
+		data := bytes.Join(fixtureLines(&r, 20+r.intn(60)), nil)
+		oldTree[name] = data
+		switch i % 6 {
+		case 0, 3:
+			newTree[name] = append(bytes.Clone(data[:len(data)/2]), fmt.Appendf(nil, "changed %d\n", i)...)
+		case 1:
+			// 删除
+		default:
+			newTree[name] = data
+		}
+		if i%5 == 0 {
+			newTree[fmt.Sprintf("new/d%02d/g%04d", i%7, i)] = bytes.Join(fixtureLines(&r, 30), nil)
+		}
+	}
+	oldTree["swap"] = []byte("old file\n")
+	newTree["swap/inner"] = []byte("new file in a directory\n")
+	oldTree["dir/inner"] = []byte("old file in a directory\n")
+	newTree["dir"] = []byte("new file\n")
+	return oldTree, newTree
+}
+
+func writeTree(tb testing.TB, dir string, files map[string][]byte) {
+	tb.Helper()
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// readTree dir 中的全部普通文件；目录（包括空目录）也记录下来，值为 nil
+func readTree(tb testing.TB, dir string) map[string][]byte {
+	tb.Helper()
+	files := map[string][]byte{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			files[rel+"/"] = nil
+			return nil
+		}
+		files[rel], err = os.ReadFile(p)
+		return err
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return files
+}
+
+// withDirs 在 files 中加上每个文件所在的目录，与 readTree 的结果比较
+func withDirs(files map[string][]byte) map[string][]byte {
+	out := maps.Clone(files)
+	for name := range files {
+		for dir := filepath.ToSlash(filepath.Dir(name)); dir != "."; dir = filepath.ToSlash(filepath.Dir(dir)) {
+			out[dir+"/"] = nil
+		}
+	}
+	return out
+}
+
+// TestDirJournalCrashHelper 设置了 XDELTA_JOURNAL_CRASH 时在子进程中运行 TestDirJournalCrash 要中断的操作：
+// 值为 apply 时把 XDELTA_JOURNAL_PATCH 就地应用到 XDELTA_JOURNAL_OUT，为 recover 时调用 RecoverDirApply
+func TestDirJournalCrashHelper(t *testing.T) {
+	op := os.Getenv("XDELTA_JOURNAL_CRASH")
+	if op == "" {
+		t.Skip("run by TestDirJournalCrash")
+	}
+	out, journal := os.Getenv("XDELTA_JOURNAL_OUT"), os.Getenv("XDELTA_JOURNAL_DIR")
+	var err error
+	switch op {
+	case "apply":
+		err = ApplyDirDiff(out, os.Getenv("XDELTA_JOURNAL_PATCH"), out, WithJournal(journal))
+	case "recover":
+		err = RecoverDirApply(journal)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDirJournalCrash 在子进程中就地应用目录补丁，在随机的时刻杀掉进程（暂存时、提交的任意一步中间或已经完成后），
+// 之后 RecoverDirApply 总是得到完整的旧目录或新目录，RollbackDirApply 总是回到旧目录（除非进程被杀时已经完成）；
+// 一部分轮次在 RecoverDirApply 的子进程中再杀一次，之后再恢复的结果相同
+func TestDirJournalCrash(t *testing.T) {
+	requireNative(t)
+	if os.Getenv("XDELTA_JOURNAL_CRASH") != "" {
+		t.Skip("running inside TestDirJournalCrash")
+	}
+	oldFiles, newFiles := journalTrees(800)
+	root := t.TempDir()
+	oldDir, newDir, patchDir := filepath.Join(root, "old"), filepath.Join(root, "new"), filepath.Join(root, "patch")
+	writeTree(t, oldDir, oldFiles)
+	writeTree(t, newDir, newFiles)
+	if _, err := CreateDirDiff(oldDir, newDir, patchDir); err != nil {
+		t.Fatal(err)
+	}
+	oldState, newState := withDirs(oldFiles), withDirs(newFiles)
+
+	out, journal := filepath.Join(root, "out"), filepath.Join(root, "journal")
+	// run 在子进程中执行 op；killAfter 大于 0 时在这之后杀掉进程，fromCommit 时从 journal.json 出现时开始计时。
+	// 返回进程是否自己结束，以及从 journal.json 出现到结束的时间
+	run := func(op string, killAfter time.Duration, fromCommit bool) (bool, time.Duration) {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDirJournalCrashHelper$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "XDELTA_JOURNAL_CRASH="+op, "XDELTA_JOURNAL_OUT="+out,
+			"XDELTA_JOURNAL_DIR="+journal, "XDELTA_JOURNAL_PATCH="+patchDir)
+		var stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stderr, &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		var committed time.Time
+		if fromCommit {
+			for !fileExists(filepath.Join(journal, dirJournalFile)) {
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Fatalf("%s: %v\n%s", op, err, stderr.Bytes())
+					}
+					return true, 0
+				case <-time.After(100 * time.Microsecond):
+				}
+			}
+			committed = time.Now()
+		}
+		var timer <-chan time.Time
+		if killAfter > 0 {
+			timer = time.After(killAfter)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("%s: %v\n%s", op, err, stderr.Bytes())
+			}
+			return true, time.Since(committed)
+		case <-timer:
+			cmd.Process.Kill()
+			<-done
+			return false, 0
+		}
+	}
+	reset := func() {
+		t.Helper()
+		for _, dir := range []string{out, journal} {
+			if err := os.RemoveAll(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeTree(t, out, oldFiles)
+	}
+
+	// 完整地运行一次，得到杀掉进程的时刻的范围：整个过程和提交阶段分别用了多久
+	reset()
+	start := time.Now()
+	_, commit := run("apply", 0, true)
+	full := time.Since(start)
+	if got := readTree(t, out); !maps.EqualFunc(got, newState, bytes.Equal) {
+		t.Fatal("the uninterrupted apply did not produce the new tree")
+	}
+	if fileExists(journal) {
+		t.Fatal("the journal is left behind after a successful apply")
+	}
+
+	rounds := 16
+	if testing.Short() {
+		rounds = 4
+	}
+	r := fixtureRand(480)
+	committing := 0
+	for round := range rounds {
+		reset()
+		// 一半的轮次在整个过程中随机的时刻杀掉进程，另一半在提交阶段
+		var finished bool
+		if round%2 == 0 {
+			finished, _ = run("apply", time.Duration(1+r.intn(int(full*11/10))), false)
+		} else {
+			finished, _ = run("apply", time.Duration(1+r.intn(int(commit*11/10+1))), true)
+		}
+		started := fileExists(filepath.Join(journal, dirJournalFile))
+		if started {
+			committing++
+		}
+		rollback := round%3 == 2
+		if round%3 == 1 && fileExists(journal) {
+			run("recover", time.Duration(1+r.intn(int(commit+1))), false)
+		}
+		var err error
+		if rollback {
+			err = RollbackDirApply(journal)
+		} else {
+			err = RecoverDirApply(journal)
+		}
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		if fileExists(journal) {
+			t.Fatalf("round %d: the journal is left behind after recovering", round)
+		}
+		got := readTree(t, out)
+		isOld, isNew := maps.EqualFunc(got, oldState, bytes.Equal), maps.EqualFunc(got, newState, bytes.Equal)
+		if !isOld && !isNew {
+			t.Fatalf("round %d (finished %v, rollback %v): the tree is neither the old nor the new one", round, finished, rollback)
+		}
+		// 日志被删除之后进程才被杀掉时 RollbackDirApply 找不到日志，新目录保留
+		if rollback && started && !isOld {
+			t.Fatalf("round %d: RollbackDirApply of an unfinished apply did not restore the old tree", round)
+		}
+		// 恢复后可以重新执行，得到新目录
+		if err := ApplyDirDiff(out, patchDir, out, WithJournal(journal)); err != nil {
+			t.Fatalf("round %d: applying again: %v", round, err)
+		}
+		if got := readTree(t, out); !maps.EqualFunc(got, newState, bytes.Equal) {
+			t.Fatalf("round %d: applying again did not produce the new tree", round)
+		}
+	}
+	t.Logf("%d of %d rounds were killed while moving files into place", committing, rounds)
+}
+
+// TestDirJournalRecover 日志的各个中间状态：没有 journal.json 时
+// outDir 保持原状，暂存目录被丢弃；未完成的日志阻止新的 ApplyDirDiff；损坏的日志返回 ErrCorruptPatch
+func TestDirJournalRecover(t *testing.T) {
+	requireNative(t)
+	oldFiles, newFiles := journalTrees(40)
+	root := t.TempDir()
+	oldDir, newDir, patchDir := filepath.Join(root, "old"), filepath.Join(root, "new"), filepath.Join(root, "patch")
+	writeTree(t, oldDir, oldFiles)
+	writeTree(t, newDir, newFiles)
+	if _, err := CreateDirDiff(oldDir, newDir, patchDir); err != nil {
+		t.Fatal(err)
+	}
+	out, journal := filepath.Join(root, "out"), filepath.Join(root, "journal")
+	writeTree(t, out, oldFiles)
+
+	// 不存在的日志目录
+	if err := RecoverDirApply(journal); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackDirApply(journal); err != nil {
+		t.Fatal(err)
+	}
+	// 只有暂存的文件：丢弃
+	writeTree(t, journal, map[string][]byte{dirJournalStage + "/0": []byte("staged")})
+	if err := RecoverDirApply(journal); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(journal) {
+		t.Fatal("RecoverDirApply kept a journal without journal.json")
+	}
+	if got := readTree(t, out); !maps.EqualFunc(got, withDirs(oldFiles), bytes.Equal) {
+		t.Fatal("discarding the staged files changed outDir")
+	}
+
+	// journal.json 存在时 ApplyDirDiff 拒绝使用这个目录
+	writeTree(t, journal, map[string][]byte{dirJournalFile: fmt.Appendf(nil, `{"version":1,"out":%q,"ops":[]}`, out)})
+	if err := ApplyDirDiff(out, patchDir, out, WithJournal(journal)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("apply with an unfinished journal: got %v, want ErrInvalidArgument", err)
+	}
+	if err := RollbackDirApply(journal); err != nil {
+		t.Fatal(err)
+	}
+	// 目录不是日志目录
+	writeTree(t, journal, map[string][]byte{"unrelated": nil})
+	if err := ApplyDirDiff(out, patchDir, out, WithJournal(journal)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("apply with a non-empty directory: got %v, want ErrInvalidArgument", err)
+	}
+	os.RemoveAll(journal)
+
+	for name, data := range map[string]string{
+		"not json":        "{",
+		"unknown version": `{"version":2,"out":"x","ops":[]}`,
+		"absolute path":   `{"version":1,"out":"x","ops":[{"path":"/etc/passwd"}]}`,
+		"escaping path":   `{"version":1,"out":"x","ops":[{"path":"a","staged":"../../x"}]}`,
+	} {
+		writeTree(t, journal, map[string][]byte{dirJournalFile: []byte(data)})
+		if err := RecoverDirApply(journal); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s: got %v, want ErrCorruptPatch", name, err)
+		}
+		os.RemoveAll(journal)
+	}
+}
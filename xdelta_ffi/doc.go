@@ -0,0 +1,50 @@
+// Package xdelta_ffi 通过 cgo 或 purego 调用 Rust 实现的原生库，创建和应用二进制差分补丁
+//
+// # 补丁
+//
+// CreateDiffs 创建补丁；收到的补丁推荐先用 ParsePatch（或从文件、网络读取时用 ReadPatch）检查结构，
+// 再通过 Patch 的方法检查（Verify）、查看（Info、TargetSize）、应用（Apply、ApplyTo）和保存（WriteTo），
+// 这些方法对所有支持的补丁格式和信封都有效；ApplyDiffsData 等直接接受 []byte 的函数仍然可用，Patch 只是对它们的包装
+//
+// # 大文件
+//
+// 内存版本要求旧数据、新数据和补丁同时在内存中；文件很大时改用 CreateDiffsFile、ApplyDiffsFile，
+// 文件在 Go 侧打开后把描述符交给原生层：旧文件只保存块签名（WithMmap 时映射到内存），新文件和补丁流式读写，
+// 输出先写入临时文件再重命名；只修改文件中已知的一段区域时用 CreateRegionDiff、ApplyRegionDiff
+//
+// # 并发
+//
+// 除明确说明的类型外，本包的所有函数都可以被任意多个 goroutine 同时调用，包括 CreateDiffs、ApplyDiffsData 等内存版本、
+// 流式和文件版本以及 SourceEncoder、SourceDecoder 的方法；并发的调用互不影响，结果和错误只属于各自的调用
+// 原生层没有全局的可变状态：错误信息由每次调用的输出参数单独返回，内存由调用各自分配和释放，
+// 全局状态只有日志回调和日志级别（原子变量，见 SetLogger）、NativeStats 和 DebugAllocStats 读取的计数器（同样是原子变量，
+// 只增减不参与任何判断）以及只执行一次的加载（见 Init）；Go 侧的 SetLogger、SetMetricsCollector 同样可以在操作进行时调用
+// 没有 xdelta3 那样的 last_error：原生函数的错误码是返回值，错误信息是这次调用的输出参数，由这次调用释放
+// Encoder、Decoder 不是并发安全的，一个实例同时只能由一个 goroutine 使用，不同的实例可以并发使用；
+// 同一次调用传入的 io.Reader、io.Writer 等只在这次调用中使用，ApplyDiffsAt 会并发调用它的 old 和 out（见其说明）
+// 调用期间调用方不能修改传入的切片，返回后本包不再持有它们
+//
+// # 内存
+//
+// 传给原生层的切片不会被复制：cgo 后端用 runtime.Pinner 固定底层数组，purego 后端用 unsafe.SliceData 直接传递指针，
+// 原生层只在这一次调用期间读取它们，不会保留指向 Go 内存的指针。需要跨调用保留的数据由原生层自己复制：
+// Encoder、Decoder 等句柄只复制还没有处理完的一个窗口和块签名，SourceDecoder 在 NewSourceDecoder 中复制一次旧数据
+// 原生层产生的补丁复制进 Go 切片后立即释放；应用补丁时 ApplyDiffsData 等先按补丁声明的长度分配好 Go 切片，
+// 原生层直接解码到其中。ApplyDiffsFixed、CreateDiffsFixed 把结果写入调用方的缓冲区，适合复用缓冲区的服务
+// 调用失败时也是如此：补丁损坏、取消和 WithTimeout 到期都由原生层自己返回（取消是协作式的，Go 侧等到原生调用结束才返回），
+// 返回之前原生层已经不再使用传入的切片，产生了一半的结果已经释放；传入的切片不会被写入，
+// 只有 ApplyDiffsFixed、CreateDiffsFixed 的 dst 中可能留下没有意义的部分输出
+//
+// # 静态链接
+//
+// 默认的 cgo 后端在运行时加载动态库（见 Init）。使用 xdelta_static 标签构建时改为静态链接 cargo build --release
+// 生成的 target/release/libxdelta.a，程序运行时不依赖 libxdelta.so、libxdelta.dylib 或 xdelta.dll；
+// 需要链接的系统库按平台分别在 cgo 指令中给出，Windows 上需要用 x86_64-pc-windows-gnu 目标构建静态库。
+// 这个标签只对 cgo 后端有效，purego 后端和没有 cgo 的构建会忽略它
+//
+// # 没有原生后端的构建
+//
+// CGO_ENABLED=0 且未使用 xdelta_purego 标签时没有原生后端，应用补丁的接口改由纯 Go 解码器实现：
+// 接受本库格式（zlib、lz4、lzma 二次压缩和校验和记录）与 VCDIFF 补丁，结果和错误码与原生层相同，只是较慢；
+// zstd 二次压缩的补丁返回 ErrUnsupportedPatch，创建补丁等其余接口返回 ErrNotSupported，Supported 返回 false
+package xdelta_ffi
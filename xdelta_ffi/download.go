@@ -0,0 +1,246 @@
+package xdelta_ffi
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDownloadBaseURL DownloadLibrary 默认的下载地址，即本项目的 GitHub releases
+const DefaultDownloadBaseURL = "https://github.com/PangolinLab/xdelta-rust-goffi/releases/download"
+
+const (
+	// defaultDownloadRetries DownloadOptions.Retries 为 0 时的重试次数
+	defaultDownloadRetries = 3
+	// maxLibrarySize 下载的原生库的大小上限，防止错误的地址把磁盘写满
+	maxLibrarySize = 256 << 20
+)
+
+// releaseChecksums 每个版本发布的预编译原生库的 SHA-256，格式见 checksums.txt
+//
+//go:embed checksums.txt
+var releaseChecksums string
+
+// DownloadOptions DownloadLibrary 的选项，零值表示全部使用默认值
+type DownloadOptions struct {
+	// BaseURL 下载地址，文件的 URL 为 BaseURL/v<WrapperVersion>/<文件名>，为空时为 DefaultDownloadBaseURL；
+	// 镜像需要保持相同的目录结构
+	BaseURL string
+	// Dir 保存原生库的目录，为空时为用户缓存目录下的 xdelta（不可用时使用 os.TempDir()）
+	Dir string
+	// Client 发送请求使用的 http.Client，为 nil 时使用 http.DefaultClient
+	Client *http.Client
+	// Retries 网络错误或服务器返回 5xx 时的重试次数，为 0 时重试 3 次，小于 0 时不重试
+	Retries int
+	// SHA256 期望的 SHA-256（十六进制），为空时使用内嵌的校验和表中 WrapperVersion 对应的值；
+	// 校验和表中没有当前版本和平台（例如自己编译、自己发布的原生库，或还没有经过发布流程的版本）时必须设置
+	SHA256 string
+}
+
+// DownloadLibrary 下载当前 GOOS/GOARCH（Linux 上还要区分 glibc 和 musl）对应的本包版本（WrapperVersion）的预编译原生库，返回保存的路径，
+// 可以直接传给 SetLibraryPath，省去安装 Rust 工具链或手工放置原生库：
+//
+//	path, err := xdelta_ffi.DownloadLibrary(ctx, xdelta_ffi.DownloadOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	xdelta_ffi.SetLibraryPath(path)
+//
+// 下载的文件必须与 opts.SHA256（为空时为内嵌的校验和表中的值）一致，不一致时删除已下载的数据并返回包装了
+// ErrLibraryChecksum 的错误，保存目录中不会留下可以加载的文件；内嵌的校验和表只包含发布流程写入的条目，
+// 其中没有当前版本和平台且 opts.SHA256 为空时不下载，返回 ErrInvalidArgument，不会加载未经校验的文件
+// 文件名包含内容哈希，已经下载过且内容正确时直接返回，不发送请求；下载先写入同一目录中的 .part 文件，
+// 网络错误和 5xx 时按 opts.Retries 重试，重试和下一次调用都用 Range 请求从中断处继续，校验通过后才重命名为最终的文件名
+// ctx 结束时停止下载并返回 ctx.Err()，.part 文件保留以便下次继续；多个进程同时下载同一个文件时可能互相覆盖 .part 文件，
+// 结果由校验和把关，失败的一方重试即可
+func DownloadLibrary(ctx context.Context, opts DownloadOptions) (string, error) {
+	asset := releaseAssetName(runtime.GOOS, runtime.GOARCH, detectedLibc())
+	want := opts.SHA256
+	if want == "" {
+		var ok bool
+		if want, ok = releaseChecksum("v" + WrapperVersion + "/" + asset); !ok {
+			return "", fmt.Errorf("%w: no pinned SHA-256 for the native library %s of version %s, set DownloadOptions.SHA256", ErrInvalidArgument, asset, WrapperVersion)
+		}
+	}
+	sum, err := hex.DecodeString(want)
+	if err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("%w: invalid library SHA-256 %q", ErrInvalidArgument, want)
+	}
+
+	dir := opts.Dir
+	if dir == "" {
+		if dir, err = os.UserCacheDir(); err != nil {
+			dir = os.TempDir()
+		}
+		dir = filepath.Join(dir, "xdelta")
+	}
+	path := filepath.Join(dir, hex.EncodeToString(sum[:8])+"-"+libraryVariant())
+	if verifyFile(path, [sha256.Size]byte(sum)) == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	base := opts.BaseURL
+	if base == "" {
+		base = DefaultDownloadBaseURL
+	}
+	url := strings.TrimSuffix(base, "/") + "/v" + WrapperVersion + "/" + asset
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	retries := opts.Retries
+	if retries == 0 {
+		retries = defaultDownloadRetries
+	}
+
+	part := path + ".part"
+	for attempt := 0; ; attempt++ {
+		err = downloadPart(ctx, client, url, part)
+		if err == nil || !retryableDownload(err) || attempt >= retries || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		case <-ctx.Done():
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("download %s: %w", url, err)
+	}
+	if err := verifyFile(part, [sha256.Size]byte(sum)); err != nil {
+		os.Remove(part)
+		return "", fmt.Errorf("%w: %s does not match SHA-256 %s", ErrLibraryChecksum, url, strings.ToLower(want))
+	}
+	if err := os.Chmod(part, 0755); err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	if err := os.Rename(part, path); err != nil {
+		os.Remove(part)
+		// 另一个进程可能已经放好了同一个文件（Windows 上正在使用的 DLL 不能被替换）
+		if verifyFile(path, [sha256.Size]byte(sum)) == nil {
+			return path, nil
+		}
+		return "", err
+	}
+	return path, nil
+}
+
+// releaseAssetName 返回 goos/goarch 的预编译原生库在发布中的文件名，Linux 上 libc 为 C 库的种类，
+// 例如 libxdelta-linux-amd64-gnu.so、libxdelta-linux-arm64-musl.so、xdelta-windows-amd64.dll
+func releaseAssetName(goos, goarch, libc string) string {
+	name := libraryName()
+	ext := filepath.Ext(name)
+	name = strings.TrimSuffix(name, ext) + "-" + goos + "-" + goarch
+	if libc != "" {
+		name += "-" + libc
+	}
+	return name + ext
+}
+
+// releaseChecksum 在内嵌的校验和表中查找 name 的 SHA-256
+func releaseChecksum(name string) (string, bool) {
+	s := bufio.NewScanner(strings.NewReader(releaseChecksums))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, file, ok := strings.Cut(line, " ")
+		if ok && strings.TrimLeft(strings.TrimSpace(file), "*") == name {
+			return sum, true
+		}
+	}
+	return "", false
+}
+
+// downloadError 服务器返回了非成功的状态 status，或者文件超过了 maxLibrarySize（tooLarge）
+type downloadError struct {
+	status   int
+	tooLarge bool
+}
+
+func (e *downloadError) Error() string {
+	if e.tooLarge {
+		return fmt.Sprintf("the file is larger than %d bytes", maxLibrarySize)
+	}
+	return fmt.Sprintf("server returned %d %s", e.status, http.StatusText(e.status))
+}
+
+// retryableDownload 报告下载错误是否值得重试：网络错误和 5xx 重试，其他 HTTP 状态（404 等）和过大的文件不重试
+func retryableDownload(err error) bool {
+	var d *downloadError
+	if errors.As(err, &d) {
+		return !d.tooLarge && d.status >= 500
+	}
+	return true
+}
+
+// downloadPart 把 url 的内容下载到 part，part 已经有数据时用 Range 请求只下载其后的部分；
+// 服务器不支持 Range（返回 200）时从头重新下载
+func downloadPart(ctx context.Context, client *http.Client, url, part string) error {
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if have > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(have, 10)+"-")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && have > 0:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && have > 0:
+		// .part 已经完整（或比文件还长），交给校验和判断
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		have = 0
+	default:
+		return &downloadError{status: resp.StatusCode}
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxLibrarySize-have+1))
+	if err != nil {
+		return err
+	}
+	if have+n > maxLibrarySize {
+		f.Truncate(0)
+		return &downloadError{tooLarge: true}
+	}
+	return f.Sync()
+}
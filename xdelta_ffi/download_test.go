@@ -0,0 +1,187 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// libraryServer 提供 body 作为当前平台预编译原生库的测试服务器：handle 决定第 n 次请求（从 0 开始）如何响应，
+// 返回 false 时按 Range 请求正常响应；收到的 Range 头依次记录在 ranges 中
+type libraryServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newLibraryServer(t *testing.T, body []byte, handle func(n int, w http.ResponseWriter, r *http.Request) bool) *libraryServer {
+	t.Helper()
+	s := &libraryServer{}
+	want := "/v" + WrapperVersion + "/" + releaseAssetName(runtime.GOOS, runtime.GOARCH, detectedLibc())
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != want {
+			http.NotFound(w, r)
+			return
+		}
+		s.mu.Lock()
+		n := len(s.ranges)
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		if handle != nil && handle(n, w, r) {
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *libraryServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// libraryBody 测试用的“原生库”内容和它的 SHA-256（十六进制）
+func libraryBody() ([]byte, string) {
+	body := bytes.Repeat([]byte("not really a shared library\n"), 4096)
+	sum := sha256.Sum256(body)
+	return body, hex.EncodeToString(sum[:])
+}
+
+// TestDownloadLibraryResume 第一次响应在中途断开，重试用 Range 请求从 .part 的末尾继续，
+// 校验通过后得到最终的文件；再次调用直接返回，不发送请求
+func TestDownloadLibraryResume(t *testing.T) {
+	body, sum := libraryBody()
+	half := len(body) / 2
+	srv := newLibraryServer(t, body, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		if n > 0 {
+			return false
+		}
+		// 声明完整的长度却只写出一半，客户端读到 io.ErrUnexpectedEOF
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body[:half])
+		return true
+	})
+	dir := t.TempDir()
+	opts := DownloadOptions{BaseURL: srv.URL, Dir: dir, SHA256: sum}
+	path, err := DownloadLibrary(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("downloaded file: %d bytes, %v, want %d bytes", len(got), err, len(body))
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("the .part file is left behind: %v", err)
+	}
+	reqs := srv.requests()
+	if len(reqs) != 2 || reqs[0] != "" || reqs[1] != "bytes="+strconv.Itoa(half)+"-" {
+		t.Fatalf("requests with Range %q, want a full request and one resuming at %d", reqs, half)
+	}
+
+	again, err := DownloadLibrary(context.Background(), opts)
+	if err != nil || again != path {
+		t.Fatalf("second call: %q, %v, want %q", again, err, path)
+	}
+	if n := len(srv.requests()); n != 2 {
+		t.Fatalf("second call sent %d more requests, want none", n-2)
+	}
+}
+
+// TestDownloadLibraryRetry 5xx 重试直到 Retries 用完，404 不重试
+func TestDownloadLibraryRetry(t *testing.T) {
+	body, sum := libraryBody()
+	srv := newLibraryServer(t, body, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	})
+	_, err := DownloadLibrary(context.Background(), DownloadOptions{BaseURL: srv.URL, Dir: t.TempDir(), SHA256: sum, Retries: 1})
+	if err == nil {
+		t.Fatal("download from a failing server succeeded")
+	}
+	if n := len(srv.requests()); n != 2 {
+		t.Fatalf("%d requests with Retries 1, want 2", n)
+	}
+
+	missing := newLibraryServer(t, body, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		http.NotFound(w, r)
+		return true
+	})
+	if _, err := DownloadLibrary(context.Background(), DownloadOptions{BaseURL: missing.URL, Dir: t.TempDir(), SHA256: sum}); err == nil {
+		t.Fatal("download of a missing file succeeded")
+	}
+	if n := len(missing.requests()); n != 1 {
+		t.Fatalf("%d requests for a 404, want 1", n)
+	}
+}
+
+// TestDownloadLibraryChecksumMismatch 内容与 SHA-256 不一致时返回 ErrLibraryChecksum，保存目录中不留下任何文件
+func TestDownloadLibraryChecksumMismatch(t *testing.T) {
+	body, _ := libraryBody()
+	other := sha256.Sum256([]byte("a different library"))
+	srv := newLibraryServer(t, body, nil)
+	dir := t.TempDir()
+	_, err := DownloadLibrary(context.Background(), DownloadOptions{BaseURL: srv.URL, Dir: dir, SHA256: hex.EncodeToString(other[:])})
+	if !errors.Is(err, ErrLibraryChecksum) {
+		t.Fatalf("got %v, want ErrLibraryChecksum", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%s still holds %s after a checksum mismatch", dir, entries[0].Name())
+	}
+}
+
+// TestDownloadLibraryNoChecksum 校验和表中没有当前版本且没有设置 SHA256 时不发送请求，返回 ErrInvalidArgument；
+// 不合法的 SHA256 同样如此
+func TestDownloadLibraryNoChecksum(t *testing.T) {
+	body, _ := libraryBody()
+	srv := newLibraryServer(t, body, nil)
+	dir := t.TempDir()
+	if _, ok := releaseChecksum("v" + WrapperVersion + "/" + releaseAssetName(runtime.GOOS, runtime.GOARCH, detectedLibc())); !ok {
+		if _, err := DownloadLibrary(context.Background(), DownloadOptions{BaseURL: srv.URL, Dir: dir}); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("without a pinned checksum: got %v, want ErrInvalidArgument", err)
+		}
+	}
+	if _, err := DownloadLibrary(context.Background(), DownloadOptions{BaseURL: srv.URL, Dir: dir, SHA256: "abc"}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("invalid SHA256: got %v, want ErrInvalidArgument", err)
+	}
+	if n := len(srv.requests()); n != 0 {
+		t.Fatalf("%d requests were sent", n)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("%s holds %d files, %v", dir, len(entries), err)
+	}
+}
+
+// TestReleaseChecksum 校验和表按 sha256sum 的格式解析，忽略注释和空行，文件名前的 * 表示二进制模式
+func TestReleaseChecksum(t *testing.T) {
+	old := releaseChecksums
+	defer func() { releaseChecksums = old }()
+	releaseChecksums = "# comment\n\nabc123  v1.0.0/libxdelta-linux-amd64-gnu.so\ndef456 *v1.0.0/xdelta-windows-amd64.dll\n"
+	for name, want := range map[string]string{
+		"v1.0.0/libxdelta-linux-amd64-gnu.so": "abc123",
+		"v1.0.0/xdelta-windows-amd64.dll":     "def456",
+	} {
+		if got, ok := releaseChecksum(name); !ok || got != want {
+			t.Errorf("%s: got %q, %v, want %q", name, got, ok, want)
+		}
+	}
+	if _, ok := releaseChecksum("v1.0.0/libxdelta-darwin-arm64.dylib"); ok {
+		t.Error("found a checksum for a file that is not in the table")
+	}
+}
@@ -0,0 +1,81 @@
+package xdelta_ffi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WithDumpInstructions 让 DumpPatch 逐条列出 ADD、COPY、RUN 指令（bsdiff 为控制项），
+// 默认只列出文件头、窗口头和合计；对其他接口没有影响
+func WithDumpInstructions() Option {
+	return func(o *options) {
+		o.dumpInstructions = true
+	}
+}
+
+// DumpPatch 以文本形式列出补丁的结构，相当于 xdelta3 printdelta，用于排查有问题的补丁；不需要旧数据
+// 支持本库格式、VCDIFF、bsdiff 和信封：VCDIFF 列出文件头和每个窗口的源数据段、目标偏移和长度、
+// 是否带 adler32 校验和以及各段的长度，最后是合计；指令的偏移是在新数据中的绝对偏移，
+// COPY 的 S@ 为旧数据中的偏移，T@ 为新数据中已生成部分的偏移
+// 使用 WithDumpInstructions 时本库格式的校验和记录列为 CHECKSUM 行（种类和值）
+// 输出是确定的，可以用于 golden 测试；边解析边写入 w，补丁再大也不会在内存中拼出完整的文本
+// 补丁不合法时返回与 ValidateFormat 相同的错误，出错位置之前的内容已经写入 w；opts 中只有 WithDumpInstructions 有效
+func DumpPatch(diffsData []byte, w io.Writer, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	err = dumpPatchTo(bw, diffsData, o.dumpInstructions)
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func dumpPatchTo(w *bufio.Writer, patch []byte, instructions bool) error {
+	if IsEnvelope(patch) {
+		h, inner, err := ParseEnvelope(patch)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "envelope: version %d block size %d\n", h.Version, h.BlockSize)
+		fmt.Fprintf(w, "  source: size %d sha256 %x\n", h.SourceSize, h.SourceSHA256)
+		fmt.Fprintf(w, "  target: size %d sha256 %x\n", h.TargetSize, h.TargetSHA256)
+		for _, k := range metadataKeys(h.Metadata) {
+			fmt.Fprintf(w, "  metadata: %s = %q\n", k, h.Metadata[k])
+		}
+		patch = inner
+	}
+	if isBSDiff(patch) {
+		return dumpBSDiff(w, patch, instructions)
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return dumpPatch(patch, w, instructions)
+}
+
+func dumpBSDiff(w *bufio.Writer, patch []byte, instructions bool) error {
+	p, err := parseBSDiff(patch, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "format: bsdiff\nsecondary: bzip2\n")
+	fmt.Fprintf(w, "blocks: control %d diff %d extra %d\n", len(p.ctrl), len(p.diff), len(p.extra))
+	if instructions {
+		p.onEntry = func(newPos, oldPos, add, cp, seek int64) error {
+			_, err := fmt.Fprintf(w, "    %012d DIFF %d S@%d EXTRA %d SEEK %d\n", newPos, add, oldPos, cp, seek)
+			return err
+		}
+	}
+	st, err := p.apply(io.Discard, nil, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "total: entries %d diff %d extra %d target %d\n", st.entries, st.diffBytes, st.extraBytes, p.newSize)
+	return err
+}
@@ -0,0 +1,132 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// dumpFixtures testdata 中用于 DumpPatch golden 测试的补丁，覆盖每种格式
+var dumpFixtures = []string{
+	"native.patch",
+	"envelope.patch",
+	"lzma.patch",
+	"vcdiff.patch",
+	"vcdiff-lzma-declared.vcdiff",
+	"bsdiff-seek.bsdiff",
+}
+
+// TestDumpPatchGolden DumpPatch 对 testdata 中的补丁输出与 testdata/dump 中的 golden 文件逐字节相同，
+// 两次输出也相同；go test -run TestDumpPatchGolden -update 重写 golden 文件。
+// 没有原生后端的构建只检查由 Go 代码列出的 bsdiff 补丁
+func TestDumpPatchGolden(t *testing.T) {
+	for _, name := range dumpFixtures {
+		patch, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nativeBackend && !isBSDiff(patch) {
+			continue
+		}
+		for _, mode := range []struct {
+			suffix string
+			opts   []Option
+		}{
+			{".txt", nil},
+			{".instructions.txt", []Option{WithDumpInstructions()}},
+		} {
+			golden := filepath.Join("testdata", "dump", name+mode.suffix)
+			var b bytes.Buffer
+			if err := DumpPatch(patch, &b, mode.opts...); err != nil {
+				t.Fatalf("%s: %v", golden, err)
+			}
+			var again bytes.Buffer
+			if err := DumpPatch(patch, &again, mode.opts...); err != nil || !bytes.Equal(again.Bytes(), b.Bytes()) {
+				t.Fatalf("%s: the second dump differs (%v)", golden, err)
+			}
+			if *updateGolden {
+				if err := os.WriteFile(golden, b.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b.Bytes(), want) {
+				t.Errorf("%s: DumpPatch output differs from the golden file:\n%s", golden, b.Bytes())
+			}
+		}
+	}
+}
+
+// failingWriter 写入 limit 字节之后返回 errWriterFull，记录总共写入的字节数和单次最大的写入
+type failingWriter struct {
+	limit, n, calls, largest int
+}
+
+var errWriterFull = errors.New("writer full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.calls++
+	w.largest = max(w.largest, len(p))
+	if w.n+len(p) > w.limit {
+		return 0, errWriterFull
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+// TestDumpPatchStreams 大补丁的输出分多次写入 w，每次不超过 64 KiB，而不是拼成一个完整的字符串；w 出错时 DumpPatch 停止并返回这个错误，
+// 写入的字节不超过 w 接受的部分
+func TestDumpPatchStreams(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(4 << 20)
+	patch, err := CreateDiffs(oldData, newData, WithBlockSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := &failingWriter{limit: math.MaxInt}
+	if err := DumpPatch(patch, all, WithDumpInstructions()); err != nil {
+		t.Fatal(err)
+	}
+	if all.largest > 64<<10 || all.calls < 4 {
+		t.Fatalf("dump of %d bytes written in %d calls, the largest %d bytes", all.n, all.calls, all.largest)
+	}
+	w := &failingWriter{limit: all.largest}
+	if err := DumpPatch(patch, w, WithDumpInstructions()); !errors.Is(err, errWriterFull) {
+		t.Fatalf("DumpPatch to a writer that fails: got %v, want its error", err)
+	}
+	if w.calls > all.calls/2 {
+		t.Fatalf("DumpPatch kept writing after the writer failed: %d of %d calls", w.calls, all.calls)
+	}
+}
+
+// TestDumpPatchCorrupt 补丁不合法时返回 ErrCorruptPatch，出错之前列出的内容已经写入
+func TestDumpPatchCorrupt(t *testing.T) {
+	requireNative(t)
+	patch, err := os.ReadFile(filepath.Join("testdata", "native.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := DumpPatch(patch[:len(patch)-3], &b, WithDumpInstructions()); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("truncated patch: got %v, want ErrCorruptPatch", err)
+	}
+	if !strings.HasPrefix(b.String(), "format: native\n") || !strings.Contains(b.String(), " COPY ") {
+		t.Fatalf("truncated patch: the records before the error were not written:\n%s", b.String())
+	}
+	for name, p := range corruptCorpus(t) {
+		if err := DumpPatch(p, &b); !errors.Is(err, ErrCorruptPatch) && !errors.Is(err, ErrUnsupportedPatch) {
+			t.Errorf("%s: got %v, want ErrCorruptPatch", name, err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build (cgo || xdelta_purego) && xdelta_embed && (linux || darwin || windows)
+// +build cgo xdelta_purego
+// +build xdelta_embed
+// +build linux darwin windows
+
+package xdelta_ffi
+
+func init() {
+	embeddedLibrary = extractEmbedded
+}
+
+// extractEmbedded 把内嵌的原生库解压到用户缓存目录，见 extractLibrary
+func extractEmbedded() (string, error) {
+	return extractLibrary(embeddedLib(), libraryVariant())
+}
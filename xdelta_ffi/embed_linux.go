@@ -0,0 +1,23 @@
+//go:build xdelta_embed
+// +build xdelta_embed
+
+package xdelta_ffi
+
+import _ "embed"
+
+// 预先编译好的两种原生库，构建前需要把链接 glibc 的 libxdelta-gnu.so 和链接 musl 的 libxdelta-musl.so 放到 bin/ 下，
+// 运行时按检测到的 C 库选择其中一种
+var (
+	//go:embed bin/libxdelta-gnu.so
+	embeddedGNU []byte
+	//go:embed bin/libxdelta-musl.so
+	embeddedMusl []byte
+)
+
+// embeddedLib 返回与当前系统匹配的内嵌原生库
+func embeddedLib() []byte {
+	if detectedLibc() == libcMusl {
+		return embeddedMusl
+	}
+	return embeddedGNU
+}
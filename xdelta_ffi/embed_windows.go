@@ -0,0 +1,16 @@
+//go:build xdelta_embed
+// +build xdelta_embed
+
+package xdelta_ffi
+
+import _ "embed"
+
+// embeddedLibData 预先编译好的原生库，构建前需要把 xdelta.dll 放到 bin/ 下
+//
+//go:embed bin/xdelta.dll
+var embeddedLibData []byte
+
+// embeddedLib 返回内嵌的原生库
+func embeddedLib() []byte {
+	return embeddedLibData
+}
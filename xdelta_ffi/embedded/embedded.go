@@ -0,0 +1,29 @@
+// Package embedded 把随包发布的预编译原生库内嵌到程序中：导入本包后 xdelta_ffi.Init 把当前平台的库解压到用户缓存目录再加载，
+// 使用者不需要 cargo、C 工具链，运行时也不需要 bin/ 目录
+//
+//	import _ "github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi/embedded"
+//
+// 库放在 lib/<GOOS>_<GOARCH>/ 下，文件名与 xdelta_ffi.SetLibraryNames 的默认值相同：Linux 上为 libxdelta-gnu.so
+// 和 libxdelta-musl.so（按检测到的 C 库选择，也可以只有 libxdelta.so），macOS 上为 libxdelta.dylib，Windows 上为 xdelta.dll，
+// 例如 lib/linux_amd64/libxdelta-gnu.so；没有当前平台的库时 Init 照常尝试其余位置
+// 本包内嵌 lib/ 下的全部文件，所有平台的库都会进入程序，体积敏感时改用 xdelta_embed 构建标签只内嵌一个平台的库
+// 加载仍然通过 cgo 或 xdelta_purego 后端进行，没有原生后端的构建中导入本包没有作用
+package embedded
+
+import (
+	"embed"
+	"io/fs"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+//go:embed lib
+var libs embed.FS
+
+func init() {
+	sub, err := fs.Sub(libs, "lib")
+	if err != nil {
+		return
+	}
+	xdelta_ffi.SetEmbeddedLibraries(sub)
+}
@@ -0,0 +1,113 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// embeddedFS SetEmbeddedLibraries 注册的原生库
+var (
+	embeddedMu sync.Mutex
+	embeddedFS fs.FS
+)
+
+// SetEmbeddedLibraries 注册内嵌的预编译原生库，Init 在 XDELTA_LIB_PATH 之后、可执行文件所在目录之前尝试它（见 Init）：
+// 在 fsys 的 <GOOS>_<GOARCH>/ 目录中依次查找 SetLibraryNames 的文件名（Linux 上因此先找与 C 库匹配的一种），
+// 把第一个找到的解压到用户缓存目录后加载；fsys 中没有当前平台的库时跳过这一步，错误信息中会说明
+// 通常不直接调用，而是导入 xdelta_ffi/embedded，由它在 init 中注册随包发布的库；与 SetLibraryPath 一样必须在 Init 之前调用，
+// fsys 为 nil 时取消注册。与 xdelta_embed 构建标签同时使用时先尝试标签内嵌的库
+func SetEmbeddedLibraries(fsys fs.FS) {
+	embeddedMu.Lock()
+	embeddedFS = fsys
+	embeddedMu.Unlock()
+}
+
+// embeddedPlatformDir 当前平台的库在 SetEmbeddedLibraries 的 fsys 中所在的目录
+func embeddedPlatformDir() string {
+	return runtime.GOOS + "_" + runtime.GOARCH
+}
+
+// extractRegistered 从 SetEmbeddedLibraries 注册的 fsys 中解压当前平台的原生库，没有注册时 ok 为 false
+func extractRegistered() (string, bool, error) {
+	embeddedMu.Lock()
+	fsys := embeddedFS
+	embeddedMu.Unlock()
+	if fsys == nil {
+		return "", false, nil
+	}
+	dir := embeddedPlatformDir()
+	for _, name := range libraryNames() {
+		lib, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", true, err
+		}
+		p, err := extractLibrary(lib, name)
+		return p, true, err
+	}
+	return "", true, fmt.Errorf("no embedded native library for %s (looked for %v)", dir, libraryNames())
+}
+
+// extractLibrary 把内嵌的原生库 lib 解压到用户缓存目录（不可用时使用 os.TempDir()），base 为库的文件名
+// 文件名包含内容哈希，重复运行直接复用已解压的文件；多个进程同时启动时先写临时文件再重命名，
+// 加载前会校验文件内容与内嵌的库一致
+func extractLibrary(lib []byte, base string) (string, error) {
+	sum := sha256.Sum256(lib)
+	name := hex.EncodeToString(sum[:8]) + "-" + base
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "xdelta")
+	path := filepath.Join(dir, name)
+
+	if verifyFile(path, sum) == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return path, err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return path, err
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(lib)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		// 另一个进程可能已经写好了同一个文件（Windows 上正在使用的 DLL 不能被替换）
+		if verifyFile(path, sum) == nil {
+			return path, nil
+		}
+		return path, fmt.Errorf("extract embedded library: %w", err)
+	}
+
+	if err := verifyFile(path, sum); err != nil {
+		return path, err
+	}
+	return path, nil
+}
@@ -0,0 +1,159 @@
+package xdelta_ffi
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrClosed 在已关闭的 Encoder/Decoder 上继续写入时返回
+var ErrClosed = errors.New("xdelta: use of closed encoder or decoder")
+
+// Encoder 推送式编码器：调用方按自己的节奏 Write 新数据，补丁字节随编码进度写入 patchOut
+// Encoder 不是并发安全的
+type Encoder struct {
+	enc    *nativeEncoder
+	out    io.Writer
+	window int
+	prog   *progress
+	err    error
+	closed bool
+}
+
+// NewEncoder 读取全部旧数据 oldSource 建立块签名，之后通过 Write 推送新数据
+// 旧数据按窗口读取，只保留块签名，不会整体载入内存
+// WithProgress 的回调在每个窗口之后触发，新数据总量未知，total 为 -1
+// WithThreads 与 CreateDiffsStream 相同：新数据在原生层攒满每个线程 8 MiB 才编码，补丁字节也随之成批写出；
+// Flush 会在当前位置截断分段
+func NewEncoder(oldSource io.Reader, patchOut io.Writer, opts ...Option) (*Encoder, error) {
+	return newEncoder(oldSource, readerSize(oldSource), patchOut, opts)
+}
+
+// NewDiffWriter 与 NewEncoder 相同，但旧数据是 io.ReaderAt（例如 *os.File 或对象存储的分段读取），从头到尾按窗口读取一遍；
+// 返回的 io.WriteCloser 就是 *Encoder，写入新数据，Close 结束补丁，需要 Flush 时可以断言为 *Encoder。
+// 与 NewPatchReader 配合，新数据和补丁都可以是网络连接之类的流，不需要整个保存在内存中
+// old 有 Size 方法或是普通文件时按它的长度选择 AutoBlockSize，否则读到 io.EOF 为止
+func NewDiffWriter(old io.ReaderAt, out io.Writer, opts ...Option) (io.WriteCloser, error) {
+	size := sourceSize(old)
+	n := size
+	if n < 0 {
+		n = math.MaxInt64
+	}
+	e, err := newEncoder(io.NewSectionReader(old, 0, n), size, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// newEncoder 创建 Encoder，oldSize 为 oldSource 的长度，未知时为 -1
+func newEncoder(oldSource io.Reader, oldSize int64, patchOut io.Writer, opts []Option) (*Encoder, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkIndexedBSDiff(); err != nil {
+		return nil, err
+	}
+	enc, err := newNativeEncoder(resolveBlockSize(o.blockSize, oldSize, -1), o.encoding())
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.setThreads(o.encodeThreads()); err != nil {
+		enc.close()
+		return nil, err
+	}
+	prog := newProgress(o.progress, -1)
+	err = readWindows(oldSource, make([]byte, o.windowSize), func(p []byte) error {
+		release, err := holdOp()
+		if err != nil {
+			return err
+		}
+		err = enc.addSource(p)
+		release()
+		if err != nil {
+			return err
+		}
+		prog.add(len(p))
+		return nil
+	})
+	if err != nil {
+		enc.close()
+		return nil, err
+	}
+	return &Encoder{enc: enc, out: patchOut, window: o.windowSize, prog: prog}, nil
+}
+
+// Write 推送一段新数据；超过窗口大小的数据会分窗口送入原生层
+func (e *Encoder) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, ErrClosed
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > e.window {
+			chunk = chunk[:e.window]
+		}
+		release, err := holdOp()
+		if err != nil {
+			return n, err
+		}
+		err = e.enc.write(chunk, e.out)
+		release()
+		if err != nil {
+			e.err = err
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+		e.prog.add(len(chunk))
+	}
+	return n, nil
+}
+
+// Flush 强制在当前位置结束一个窗口，把已推送的数据全部编码写出
+// 跨越该位置的数据无法再匹配旧数据，频繁 Flush 会使补丁变大
+func (e *Encoder) Flush() error {
+	if e.closed {
+		return ErrClosed
+	}
+	if e.err != nil {
+		return e.err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := e.enc.flush(e.out); err != nil {
+		e.err = err
+	}
+	return e.err
+}
+
+// Close 写出剩余数据并结束补丁，释放原生资源；重复调用是安全的
+func (e *Encoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	defer e.enc.close()
+	if e.err != nil {
+		return e.err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return e.enc.finish(e.out)
+}
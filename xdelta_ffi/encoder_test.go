@@ -0,0 +1,79 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestNewDiffWriterRoundTrip NewDiffWriter 写出的补丁经过管道由 NewPatchReader 同时读取，还原出新数据；
+// 旧数据长度未知和中途 Flush 时也一样
+func TestNewDiffWriterRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(1 << 20)
+	for _, tc := range []struct {
+		name  string
+		old   io.ReaderAt
+		flush bool
+	}{
+		{"sized", bytes.NewReader(oldData), false},
+		{"unsized", unsizedReader{bytes.NewReader(oldData)}, false},
+		{"flush", bytes.NewReader(oldData), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				w, err := NewDiffWriter(tc.old, pw, WithSecondaryCompression(SecondaryZstd))
+				if err != nil {
+					pw.CloseWithError(err)
+					done <- err
+					return
+				}
+				for p := newData; len(p) > 0; {
+					n := min(len(p), 100_000)
+					if _, err = w.Write(p[:n]); err != nil {
+						break
+					}
+					if tc.flush {
+						if err = w.(*Encoder).Flush(); err != nil {
+							break
+						}
+					}
+					p = p[n:]
+				}
+				if cerr := w.Close(); err == nil {
+					err = cerr
+				}
+				pw.CloseWithError(err)
+				done <- err
+			}()
+			r, err := NewPatchReader(bytes.NewReader(oldData), pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, newData) {
+				t.Fatalf("got %d bytes, want %d", len(got), len(newData))
+			}
+		})
+	}
+	var b bytes.Buffer
+	w, err := NewDiffWriter(bytes.NewReader(oldData), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(newData); err != ErrClosed {
+		t.Fatalf("Write after Close: got %v, want ErrClosed", err)
+	}
+}
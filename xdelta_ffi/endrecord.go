@@ -0,0 +1,57 @@
+package xdelta_ffi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// formatFlagEnd 与 xdelta_interface.h 中的 XDELTA_FORMAT_FLAG_END 一致
+	formatFlagEnd = 0x400000
+	// endRecordOp 本库格式可选的结束记录，以补丁头开头的补丁的最后一个记录，后面是 8 字节（小端序）的输出长度
+	endRecordOp  = 0x03
+	endRecordLen = 9
+	// headerRecordOp 以结束记录结尾的补丁的第一个记录，后面是 1 字节的格式修订号（0x04 是 LZ4 帧的开头）；
+	// 以它开头的补丁必须以结束记录结尾
+	headerRecordOp  = 0x05
+	headerRecordLen = 2
+	// formatRevision 本库格式的修订号，与原生层的 FORMAT_VERSION 一致
+	formatRevision = 3
+)
+
+// WithEndRecord 在本库格式的补丁开头写出记录了格式修订号的补丁头、末尾写出记录了输出长度的结束记录（默认关闭），
+// 补丁在任何位置截断（包括恰好在两个记录之间）都能在应用时发现；不带它们的补丁与旧版本的格式相同，
+// 旧版本的解码器不认识这两个记录，无法应用这样的补丁
+// 不能与 WithStandardVCDIFF、WithBSDiff 同时使用；开启时恒等补丁（见 WithIdentityDetection）同样带这两个记录
+func WithEndRecord(on bool) Option {
+	return func(o *options) {
+		o.endRecord = on
+	}
+}
+
+// checkEndRecord 检查 WithEndRecord 与其他选项的组合
+func (o options) checkEndRecord() error {
+	if o.endRecord && (o.vcdiff || o.bsdiff) {
+		return fmt.Errorf("%w: WithEndRecord is only available for native patches", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// writesEndRecord 这些选项下创建的补丁是否以补丁头开头、以结束记录结尾
+func (o options) writesEndRecord() bool {
+	return o.endRecord && !o.vcdiff && !o.bsdiff
+}
+
+// appendEndRecord 在 p 后面追加输出长度为 targetLen 的结束记录，与原生层 push_end 相同
+func appendEndRecord(p []byte, targetLen uint64) []byte {
+	return binary.LittleEndian.AppendUint64(append(p, endRecordOp), targetLen)
+}
+
+// segmentEnd 单独解码 seg 时接在它后面的结束记录：patchSegments 切分以补丁头开头的补丁时结束记录不属于任何一段，
+// header 为 patchSegments 返回的补丁头；其他补丁没有结束记录，返回 nil
+func segmentEnd(header []byte, seg patchSegment) []byte {
+	if len(header) == 0 || header[0] != headerRecordOp {
+		return nil
+	}
+	return appendEndRecord(nil, seg.targetLen)
+}
@@ -0,0 +1,539 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// 信封格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'E' 'N' 'V' 0D 0A
+//	version      1 字节  当前为 1
+//	block size   4 字节  创建补丁时实际使用的块大小
+//	source size  8 字节
+//	source hash 32 字节  旧数据的 SHA-256
+//	target size  8 字节
+//	target hash 32 字节  新数据的 SHA-256
+//
+// 版本 2 在其后加上 WithMetadata 的元数据：
+//
+//	metadata size 4 字节  元数据段的字节数
+//	metadata             条目数（2 字节），之后按键的字节序排列的每个条目：键长（1 字节）、键、值长（2 字节）、值
+//	header hash  32 字节  从 magic 到元数据段末尾的 SHA-256
+//
+// 之后是原样的补丁；magic 的首字节不是任何一种补丁格式的首字节，
+// 与 PNG 一样用 0D 0A 发现被按文本传输改坏的信封
+var envelopeMagic = []byte{0x89, 'X', 'D', 'E', 'N', 'V', 0x0D, 0x0A}
+
+const (
+	// EnvelopeVersion CreateEnvelope 不带元数据时写入的信封格式版本
+	EnvelopeVersion = 1
+	// EnvelopeMetadataVersion CreateEnvelope 带 WithMetadata 的元数据时写入的信封格式版本，
+	// 不认识它的旧版本本包读取这样的信封时返回 ErrUnsupportedPatch
+	EnvelopeMetadataVersion = 2
+
+	// MaxMetadataKeyLen WithMetadata 中每个键的最大字节数
+	MaxMetadataKeyLen = 255
+	// MaxMetadataSize WithMetadata 的元数据编码后的最大字节数，每个条目占键、值的长度再加 3 字节，另有 2 字节的条目数
+	MaxMetadataSize = 64 << 10
+
+	// envelopeHeaderLen 版本 1 的信封头的长度，也是版本 2 的信封头中元数据之前的固定部分
+	envelopeHeaderLen = 8 + 1 + 4 + 8 + sha256.Size + 8 + sha256.Size
+)
+
+// EnvelopeHeader 信封头中记录的元数据，见 CreateEnvelope
+type EnvelopeHeader struct {
+	Version      int
+	BlockSize    uint32
+	SourceSize   int64
+	SourceSHA256 [sha256.Size]byte
+	TargetSize   int64
+	TargetSHA256 [sha256.Size]byte
+	// Metadata WithMetadata 写入的应用元数据，没有时为 nil
+	Metadata map[string]string
+
+	// size 信封头的总字节数，由 ParseEnvelope 填写
+	size int
+}
+
+// IsEnvelope 报告 data 是否以信封的 magic 开头
+func IsEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, envelopeMagic)
+}
+
+// CreateEnvelope 与 CreateDiffs 相同，但在补丁前加上信封头，记录旧数据和新数据的长度与 SHA-256
+// 以及实际使用的块大小（AutoBlockSize 时为自动选出的值），应用时用 ApplyEnvelope 校验
+// 信封头为 93 字节，WithMetadata 时再加上元数据和 36 字节（格式版本 2）；ApplyDiffsData 等应用接口也接受信封，但只拆掉信封头，需要 WithVerifyOutput 才校验
+func CreateEnvelope(oldData, newData []byte, opts ...Option) ([]byte, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := resolveBlockSize(o.blockSize, int64(len(oldData)), int64(len(newData)))
+	hdr := EnvelopeHeader{
+		Version:      EnvelopeVersion,
+		BlockSize:    blockSize,
+		SourceSize:   int64(len(oldData)),
+		SourceSHA256: sha256.Sum256(oldData),
+		TargetSize:   int64(len(newData)),
+		TargetSHA256: sha256.Sum256(newData),
+		Metadata:     o.metadata,
+	}
+	if len(hdr.Metadata) > 0 {
+		hdr.Version = EnvelopeMetadataVersion
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	envelope, err := createPatchData(appendTo(hdr.appendTo(nil)), oldData, newData, blockSize, o.encoding(), nil)
+	if err != nil || o.reverse == nil {
+		return envelope, err
+	}
+	if err := o.createReverse(oldData, newData, blockSize, &hdr, nil); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// appendTo 把信封头追加到 b，版本 2 的元数据由 newOptions 检查过，不会超出限制
+func (h EnvelopeHeader) appendTo(b []byte) []byte {
+	start := len(b)
+	b = append(b, envelopeMagic...)
+	b = append(b, byte(h.Version))
+	b = binary.LittleEndian.AppendUint32(b, h.BlockSize)
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.SourceSize))
+	b = append(b, h.SourceSHA256[:]...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.TargetSize))
+	b = append(b, h.TargetSHA256[:]...)
+	if h.Version == EnvelopeVersion {
+		return b
+	}
+	meta := appendMetadata(nil, h.Metadata)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(meta)))
+	b = append(b, meta...)
+	sum := sha256.Sum256(b[start:])
+	return append(b, sum[:]...)
+}
+
+// ParseEnvelope 解析信封头，返回元数据和其后的补丁，除版本 2 信封头自身的 SHA-256 外不做任何校验
+// 没有 magic、信封头被截断或与它的 SHA-256 不符时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func ParseEnvelope(envelope []byte) (EnvelopeHeader, []byte, error) {
+	var h EnvelopeHeader
+	if !IsEnvelope(envelope) {
+		return h, nil, fmt.Errorf("%w: missing envelope magic", ErrCorruptPatch)
+	}
+	if len(envelope) < len(envelopeMagic)+1 {
+		return h, nil, fmt.Errorf("%w: truncated envelope header", ErrCorruptPatch)
+	}
+	h.Version = int(envelope[len(envelopeMagic)])
+	if h.Version != EnvelopeVersion && h.Version != EnvelopeMetadataVersion {
+		return h, nil, fmt.Errorf("%w: envelope version %d", ErrUnsupportedPatch, h.Version)
+	}
+	h.size = envelopeLen(envelope)
+	if len(envelope) < h.size {
+		return h, nil, fmt.Errorf("%w: truncated envelope header", ErrCorruptPatch)
+	}
+	b := envelope[len(envelopeMagic)+1:]
+	h.BlockSize = binary.LittleEndian.Uint32(b)
+	sourceSize := binary.LittleEndian.Uint64(b[4:])
+	copy(h.SourceSHA256[:], b[12:])
+	targetSize := binary.LittleEndian.Uint64(b[12+sha256.Size:])
+	copy(h.TargetSHA256[:], b[20+sha256.Size:])
+	if int64(sourceSize) < 0 || int64(targetSize) < 0 {
+		return h, nil, fmt.Errorf("%w: envelope sizes out of range", ErrCorruptPatch)
+	}
+	h.SourceSize, h.TargetSize = int64(sourceSize), int64(targetSize)
+	if h.Version == EnvelopeMetadataVersion {
+		n := binary.LittleEndian.Uint32(envelope[envelopeHeaderLen:])
+		if n > MaxMetadataSize {
+			return h, nil, fmt.Errorf("%w: envelope metadata is %d bytes, more than %d", ErrCorruptPatch, n, MaxMetadataSize)
+		}
+		body := h.size - sha256.Size
+		if sha256.Sum256(envelope[:body]) != [sha256.Size]byte(envelope[body:h.size]) {
+			return h, nil, fmt.Errorf("%w: envelope header SHA-256 mismatch", ErrCorruptPatch)
+		}
+		meta, err := parseMetadata(envelope[envelopeHeaderLen+4 : body])
+		if err != nil {
+			return h, nil, err
+		}
+		h.Metadata = meta
+	}
+	return h, envelope[h.size:], nil
+}
+
+// envelopeLen 返回 head 开头的信封头的总长度，只需要 head 的前 envelopeHeaderLen+4 字节；
+// head 太短还不能确定时返回确定长度所需的字节数，元数据的长度超出 MaxMetadataSize 时同样如此，交给 ParseEnvelope 报错
+func envelopeLen(head []byte) int {
+	if len(head) <= len(envelopeMagic) || head[len(envelopeMagic)] != EnvelopeMetadataVersion {
+		return envelopeHeaderLen
+	}
+	if len(head) < envelopeHeaderLen+4 {
+		return envelopeHeaderLen + 4
+	}
+	n := binary.LittleEndian.Uint32(head[envelopeHeaderLen:])
+	if n > MaxMetadataSize {
+		return envelopeHeaderLen + 4
+	}
+	return envelopeHeaderLen + 4 + int(n) + sha256.Size
+}
+
+// readEnvelopeHead 从 r 读取补丁开头可能是信封头的部分：不是信封时读取 envelopeHeaderLen 字节，
+// 是信封时读到整个信封头为止；r 提前结束时返回读到的全部数据
+func readEnvelopeHead(r io.Reader) ([]byte, error) {
+	var head []byte
+	for want := envelopeHeaderLen; len(head) < want; want = envelopeLen(head) {
+		n := len(head)
+		head = append(head, make([]byte, want-n)...)
+		m, err := io.ReadFull(r, head[n:])
+		head = head[:n+m]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !IsEnvelope(head) {
+			break
+		}
+	}
+	return head, nil
+}
+
+// ReadMetadata 返回信封中 WithMetadata 写入的元数据，只解析信封头，不需要旧数据也不解码补丁；
+// 不是信封或信封没有元数据时返回 nil，信封头损坏时返回与 ParseEnvelope 相同的错误
+func ReadMetadata(patch []byte) (map[string]string, error) {
+	if !IsEnvelope(patch) {
+		return nil, nil
+	}
+	h, _, err := ParseEnvelope(patch)
+	return h.Metadata, err
+}
+
+// WithMetadata 让 CreateEnvelope 在信封头中记录应用自己的元数据（构建号、发布渠道、最低客户端版本等），
+// 写成格式版本 2 的信封，由 ReadMetadata 或 ParseEnvelope 读出，信封头的 SHA-256 保护它不被改坏；m 为空时与不使用这个选项相同
+// 键不能为空、不超过 MaxMetadataKeyLen 字节，键和值都必须是合法的 UTF-8，编码后总共不超过 MaxMetadataSize 字节，
+// 否则返回 ErrInvalidArgument；m 在调用时被复制。只有 CreateEnvelope 和它的 WithReverse 写入元数据，其他接口忽略这个选项
+func WithMetadata(m map[string]string) Option {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return func(o *options) {
+		o.metadata = c
+	}
+}
+
+// checkMetadata 检查 WithMetadata 的元数据是否在限制之内
+func checkMetadata(m map[string]string) error {
+	size := 2
+	for k, v := range m {
+		if k == "" || len(k) > MaxMetadataKeyLen {
+			return fmt.Errorf("%w: metadata key %.32q is not 1 to %d bytes", ErrInvalidArgument, k, MaxMetadataKeyLen)
+		}
+		if !utf8.ValidString(k) || !utf8.ValidString(v) {
+			return fmt.Errorf("%w: metadata entry %q is not valid UTF-8", ErrInvalidArgument, k)
+		}
+		size += 3 + len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		return fmt.Errorf("%w: metadata is %d bytes, more than %d", ErrInvalidArgument, size, MaxMetadataSize)
+	}
+	return nil
+}
+
+// appendMetadata 把 m 按信封的元数据段格式追加到 b
+func appendMetadata(b []byte, m map[string]string) []byte {
+	keys := metadataKeys(m)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(keys)))
+	for _, k := range keys {
+		b = append(b, byte(len(k)))
+		b = append(b, k...)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(m[k])))
+		b = append(b, m[k]...)
+	}
+	return b
+}
+
+// metadataKeys 返回 m 中按字节序排列的键
+func metadataKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseMetadata 解析信封的元数据段，条目越界、键重复或为空时返回 ErrCorruptPatch
+func parseMetadata(b []byte) (map[string]string, error) {
+	corrupt := fmt.Errorf("%w: malformed envelope metadata", ErrCorruptPatch)
+	if len(b) < 2 {
+		return nil, corrupt
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	b = b[2:]
+	m := make(map[string]string, min(n, len(b)/3))
+	for range n {
+		if len(b) < 3 {
+			return nil, corrupt
+		}
+		klen := int(b[0])
+		if klen == 0 || len(b) < 1+klen+2 {
+			return nil, corrupt
+		}
+		k := string(b[1 : 1+klen])
+		b = b[1+klen:]
+		vlen := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+vlen {
+			return nil, corrupt
+		}
+		if _, dup := m[k]; dup {
+			return nil, fmt.Errorf("%w: duplicate envelope metadata key %q", ErrCorruptPatch, k)
+		}
+		m[k] = string(b[2 : 2+vlen])
+		b = b[2+vlen:]
+	}
+	if len(b) != 0 {
+		return nil, corrupt
+	}
+	return m, nil
+}
+
+// ApplyEnvelope 校验并应用 CreateEnvelope 生成的信封：
+// 先比较旧数据的长度和 SHA-256，不一致时不解码直接返回 ErrSourceMismatch；
+// 解码后比较新数据的长度和 SHA-256，不一致时返回 ErrTargetMismatch
+// opts 与 ApplyDiffsData 相同，WithMaxOutputSize 在解码前与信封记录的目标长度比较；总是按 WithVerifyOutput 校验
+func ApplyEnvelope(oldData, envelope []byte, opts ...Option) ([]byte, error) {
+	if _, _, err := ParseEnvelope(envelope); err != nil {
+		return nil, err
+	}
+	return ApplyDiffsData(oldData, envelope, append(opts[:len(opts):len(opts)], WithVerifyOutput())...)
+}
+
+// WithVerifyOutput 让应用补丁的接口在应用 CreateEnvelope 生成的信封时校验结果：解码的同时计算输出的 SHA-256，
+// 与信封记录的长度和哈希比较，不一致时返回 ErrTargetMismatch，输出超过信封记录的长度时立即返回；ApplyEnvelope 总是这样校验
+// 应用补丁的接口总是接受信封，没有这个选项时只拆掉信封头、应用其中的补丁，不做校验（信封记录的目标长度仍与 WithMaxOutputSize 比较）
+// ApplyDiffs、ApplyDiffsFrom 与流式版本相同；ApplyDiffsAt 按偏移写出，只比较长度；ApplyDiffsInPlace 在写完之后校验，
+// 失败时文件已被改写
+// 内存版本与 ApplyEnvelope 相同，先校验旧数据的长度和 SHA-256；流式版本、Decoder 和文件版本只比较旧数据的长度（能获取时，WithVerifySource 时也比较 SHA-256），
+// 旧数据不对表现为 ErrTargetMismatch 或 ErrChecksumMismatch
+// ApplyDiffsFile 校验通过后才把结果重命名到 outPath，否则删除临时文件；ApplyDiffsStream 和 Decoder 的 out 中可能已经写入了数据，
+// 错误由 ApplyDiffsStream 或 Decoder.Close 返回；不是信封的补丁照常应用，不做校验；信封与 WithCheckpoint 同时使用时返回 ErrUnsupportedPatch
+func WithVerifyOutput() Option {
+	return func(o *options) {
+		o.verifyOutput = true
+	}
+}
+
+// WithVerifySource 与 WithVerifyOutput 一起使用：ApplyDiffsStream、ApplyDiffsFile、Decoder、NewApplyReader、NewPatchReader
+// 应用信封时先完整读取一遍旧数据计算 SHA-256，与信封记录的长度和哈希比较，不一致时返回 ErrSourceMismatch，
+// 不向输出写入任何数据；代价是旧数据要多读一遍。内存版本本来就先校验旧数据，不需要这个选项，不是信封的补丁不受影响
+func WithVerifySource() Option {
+	return func(o *options) {
+		o.verifySource = true
+	}
+}
+
+// verifySourceAt WithVerifySource 时按信封 h 校验可随机读取的旧数据 old 的长度和 SHA-256，h 为 nil 时什么也不做
+func (o options) verifySourceAt(h *EnvelopeHeader, old io.ReaderAt) error {
+	if !o.verifySource || h == nil {
+		return nil
+	}
+	sum := sha256.New()
+	n, err := io.Copy(sum, io.NewSectionReader(old, 0, h.SourceSize))
+	if err != nil {
+		return fmt.Errorf("read old data: %w", err)
+	}
+	if n == h.SourceSize {
+		// 旧数据比信封记录的更长
+		var b [1]byte
+		if m, _ := old.ReadAt(b[:], h.SourceSize); m > 0 {
+			return fmt.Errorf("%w: source is longer than the %d bytes the envelope expects", ErrSourceMismatch, h.SourceSize)
+		}
+	}
+	if err := h.checkSourceSize(n); err != nil {
+		return err
+	}
+	if [sha256.Size]byte(sum.Sum(nil)) != h.SourceSHA256 {
+		return fmt.Errorf("%w: source SHA-256 differs from the envelope", ErrSourceMismatch)
+	}
+	return nil
+}
+
+// openEnvelope 拆开内存中的信封，返回其中的补丁，不是信封时原样返回 patch；总是比较信封记录的目标长度与输出上限，
+// WithVerifyOutput 时还校验旧数据并返回信封头，由调用方校验输出，否则返回的信封头为 nil；
+// WithRequireSignature 时先验证签名并去掉签名头
+func (o options) openEnvelope(oldData, patch []byte) (*EnvelopeHeader, []byte, error) {
+	patch, err := o.openSigned(patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.unwrapEnvelope(patch, func(h *EnvelopeHeader) error { return h.checkSource(oldData) })
+}
+
+// openEnvelopeAt 与 openEnvelope 相同，但旧数据只比较长度（sourceLen 为 -1 时不比较），
+// 用于旧数据可随机读取而补丁在内存中的接口
+func (o options) openEnvelopeAt(patch []byte, sourceLen int64) (*EnvelopeHeader, []byte, error) {
+	patch, err := o.openSigned(patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.unwrapEnvelope(patch, func(h *EnvelopeHeader) error {
+		if sourceLen < 0 {
+			return nil
+		}
+		return h.checkSourceSize(sourceLen)
+	})
+}
+
+// unwrapEnvelope 拆开信封 patch（不是信封时原样返回），WithVerifyOutput 时用 checkSource 校验旧数据并返回信封头
+func (o options) unwrapEnvelope(patch []byte, checkSource func(h *EnvelopeHeader) error) (*EnvelopeHeader, []byte, error) {
+	if !IsEnvelope(patch) {
+		return nil, patch, nil
+	}
+	h, inner, err := ParseEnvelope(patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := h.checkLimit(o.outputLimit()); err != nil {
+		return nil, nil, err
+	}
+	if !o.verifyOutput {
+		return nil, inner, nil
+	}
+	if err := checkSource(&h); err != nil {
+		return nil, nil, err
+	}
+	return &h, inner, nil
+}
+
+// readEnvelope 与 openEnvelope 相同，但补丁是流，旧数据只比较长度（sourceLen 为 -1 时不比较）；
+// 返回的 io.Reader 从信封头之后（不是信封时从头）继续读取补丁，skipped 为跳过的信封头长度
+func (o options) readEnvelope(patch io.Reader, sourceLen int64) (h *EnvelopeHeader, skipped int, r io.Reader, err error) {
+	if err := o.checkStreamSignature(); err != nil {
+		return nil, 0, nil, err
+	}
+	head, err := readEnvelopeHead(patch)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if !IsEnvelope(head) {
+		return nil, 0, io.MultiReader(bytes.NewReader(head), patch), nil
+	}
+	if h, err = o.streamEnvelope(head, sourceLen); err != nil {
+		return nil, 0, nil, err
+	}
+	return h, len(head), patch, nil
+}
+
+// streamEnvelope 解析 head 中完整的信封头并比较输出上限，WithVerifyOutput 时还比较旧数据的长度（sourceLen 为 -1 时不比较）
+// 并返回信封头，否则返回 nil
+func (o options) streamEnvelope(head []byte, sourceLen int64) (*EnvelopeHeader, error) {
+	if !o.verifyOutput {
+		sourceLen = -1
+	}
+	h, err := o.envelopeHeader(head, sourceLen)
+	if err != nil || !o.verifyOutput {
+		return nil, err
+	}
+	return h, nil
+}
+
+// envelopeHeader 解析 head 中完整的信封头，比较旧数据的长度（sourceLen 为 -1 时不比较）和输出上限
+func (o options) envelopeHeader(head []byte, sourceLen int64) (*EnvelopeHeader, error) {
+	h, _, err := ParseEnvelope(head)
+	if err != nil {
+		return nil, err
+	}
+	if sourceLen >= 0 {
+		if err := h.checkSourceSize(sourceLen); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.checkLimit(o.outputLimit()); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (h EnvelopeHeader) checkLimit(limit uint64) error {
+	if limit > 0 && uint64(h.TargetSize) > limit {
+		return fmt.Errorf("%w: envelope declares %d bytes of output, the limit is %d", ErrOutputTooLarge, h.TargetSize, limit)
+	}
+	return nil
+}
+
+func (h EnvelopeHeader) checkSource(oldData []byte) error {
+	if err := h.checkSourceSize(int64(len(oldData))); err != nil {
+		return err
+	}
+	if sha256.Sum256(oldData) != h.SourceSHA256 {
+		return fmt.Errorf("%w: source SHA-256 differs from the envelope", ErrSourceMismatch)
+	}
+	return nil
+}
+
+func (h EnvelopeHeader) checkSourceSize(n int64) error {
+	if n != h.SourceSize {
+		return fmt.Errorf("%w: source is %d bytes, the envelope expects %d", ErrSourceMismatch, n, h.SourceSize)
+	}
+	return nil
+}
+
+// checkTarget 比较应用结果的长度 n 和 SHA-256
+func (h EnvelopeHeader) checkTarget(n int64, sum [sha256.Size]byte) error {
+	if n != h.TargetSize {
+		return fmt.Errorf("%w: result is %d bytes, the envelope expects %d", ErrTargetMismatch, n, h.TargetSize)
+	}
+	if sum != h.TargetSHA256 {
+		return fmt.Errorf("%w: result SHA-256 differs from the envelope", ErrTargetMismatch)
+	}
+	return nil
+}
+
+// targetWriter 把输出转写到 w，同时计算长度和 SHA-256，用于 WithVerifyOutput；h 为 nil 时只转写
+type targetWriter struct {
+	w   io.Writer
+	h   *EnvelopeHeader
+	sum hash.Hash
+	n   int64
+}
+
+// verify 开始按 h 校验之后写出的数据
+func (t *targetWriter) verify(h *EnvelopeHeader) {
+	t.h, t.sum = h, sha256.New()
+}
+
+func (t *targetWriter) Write(p []byte) (int, error) {
+	if t.h == nil {
+		return t.w.Write(p)
+	}
+	if int64(len(p)) > t.h.TargetSize-t.n {
+		return 0, fmt.Errorf("%w: result exceeds the %d bytes the envelope expects", ErrTargetMismatch, t.h.TargetSize)
+	}
+	n, err := t.w.Write(p)
+	t.sum.Write(p[:n])
+	t.n += int64(n)
+	return n, err
+}
+
+// check 在写完之后比较长度和 SHA-256，没有 h 时返回 nil
+func (t *targetWriter) check() error {
+	if t.h == nil {
+		return nil
+	}
+	var got [sha256.Size]byte
+	t.sum.Sum(got[:0])
+	return t.h.checkTarget(t.n, got)
+}
@@ -0,0 +1,186 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestEnvelopeApplyWithoutOptions 不带任何选项时每个应用接口都拆开信封并得到新数据
+func TestEnvelopeApplyWithoutOptions(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	env, err := CreateEnvelope(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEnvelope(env) {
+		t.Fatal("CreateEnvelope result is not recognised by IsEnvelope")
+	}
+	for name, apply := range applyPaths(t.TempDir(), oldData, env) {
+		t.Run(name, func(t *testing.T) {
+			got, err := apply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, newData) {
+				t.Fatalf("got %d bytes, want %d", len(got), len(newData))
+			}
+		})
+	}
+}
+
+// TestEnvelopeVerifyOutput 旧数据不对时只有 WithVerifyOutput 报告不一致
+func TestEnvelopeVerifyOutput(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	env, err := CreateEnvelope(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := append([]byte(nil), oldData...)
+	bad[100] ^= 0xff
+	if _, err := ApplyDiffsData(bad, env); err != nil {
+		t.Fatalf("without WithVerifyOutput: %v", err)
+	}
+	if _, err := ApplyDiffsData(bad, env, WithVerifyOutput()); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("ApplyDiffsData with WithVerifyOutput: got %v, want ErrSourceMismatch", err)
+	}
+	var b bytes.Buffer
+	err = ApplyDiffsStream(bytes.NewReader(bad), bytes.NewReader(env), &b, WithVerifyOutput())
+	if !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("ApplyDiffsStream with WithVerifyOutput: got %v, want ErrTargetMismatch", err)
+	}
+	if got, err := ApplyEnvelope(oldData, env); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplyEnvelope: %v", err)
+	}
+}
+
+// metadataEnvelope 用 env 的固定部分和原样的元数据编码 raw 组成版本 2 的信封，重新计算信封头的 SHA-256
+func metadataEnvelope(env, raw, patch []byte) []byte {
+	b := append(bytes.Clone(env[:envelopeHeaderLen]), 0, 0, 0, 0)
+	b[len(envelopeMagic)] = EnvelopeMetadataVersion
+	binary.LittleEndian.PutUint32(b[envelopeHeaderLen:], uint32(len(raw)))
+	b = append(b, raw...)
+	sum := sha256.Sum256(b)
+	return append(append(b, sum[:]...), patch...)
+}
+
+// TestReadMetadata WithMetadata 写入的元数据由 ReadMetadata 原样读出，信封照常应用；
+// 不带元数据的信封和不是信封的补丁返回 nil；不合法的元数据让 CreateEnvelope 返回 ErrInvalidArgument
+func TestReadMetadata(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	meta := map[string]string{
+		"build":                                "1234",
+		"channel":                              "稳定版",
+		"empty":                                "",
+		strings.Repeat("k", MaxMetadataKeyLen): strings.Repeat("v", 1000),
+	}
+	env, err := CreateEnvelope(oldData, newData, WithMetadata(meta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env[len(envelopeMagic)] != EnvelopeMetadataVersion {
+		t.Fatalf("envelope version %d, want %d", env[len(envelopeMagic)], EnvelopeMetadataVersion)
+	}
+	got, err := ReadMetadata(env)
+	if err != nil || len(got) != len(meta) {
+		t.Fatalf("ReadMetadata: %v, %v", got, err)
+	}
+	for k, v := range meta {
+		if got[k] != v {
+			t.Fatalf("key %.16q: %q, want %q", k, got[k], v)
+		}
+	}
+	if out, err := ApplyEnvelope(oldData, env); err != nil || !bytes.Equal(out, newData) {
+		t.Fatalf("ApplyEnvelope: %d bytes, %v", len(out), err)
+	}
+
+	plain, err := CreateEnvelope(oldData, newData, WithMetadata(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"no metadata": plain, "not an envelope": patch, "nil": nil} {
+		if got, err := ReadMetadata(data); err != nil || got != nil {
+			t.Fatalf("%s: %v, %v, want nil", name, got, err)
+		}
+	}
+	if plain[len(envelopeMagic)] != EnvelopeVersion {
+		t.Fatalf("envelope without metadata has version %d", plain[len(envelopeMagic)])
+	}
+
+	for name, m := range map[string]map[string]string{
+		"empty key":     {"": "v"},
+		"long key":      {strings.Repeat("k", MaxMetadataKeyLen+1): "v"},
+		"invalid UTF-8": {"k": "\xff"},
+		"too large":     {"k": strings.Repeat("v", MaxMetadataSize)},
+	} {
+		if _, err := CreateEnvelope(oldData, newData, WithMetadata(m)); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("%s: got %v, want ErrInvalidArgument", name, err)
+		}
+	}
+}
+
+// TestReadMetadataCorrupt 截断的信封头、改坏的元数据（信封头的 SHA-256 不符）和格式不对的元数据编码返回 ErrCorruptPatch，
+// 不认识的版本返回 ErrUnsupportedPatch
+func TestReadMetadataCorrupt(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	env, err := CreateEnvelope(oldData, newData, WithMetadata(map[string]string{"build": "1234", "channel": "beta"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, patch, err := ParseEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := len(envelopeMagic); n < h.size; n++ {
+		if _, err := ReadMetadata(env[:n]); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("first %d of %d header bytes: got %v, want ErrCorruptPatch", n, h.size, err)
+		}
+	}
+	for i := envelopeHeaderLen; i < h.size; i++ {
+		bad := bytes.Clone(env)
+		bad[i] ^= 0x01
+		if _, err := ReadMetadata(bad); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("byte %d of the header flipped: got %v, want ErrCorruptPatch", i, err)
+		}
+	}
+
+	// 信封头的 SHA-256 重新计算过、只有元数据编码不对的信封
+	for name, raw := range map[string][]byte{
+		"empty":          {},
+		"count only":     {1, 0},
+		"missing entry":  {2, 0, 1, 'k', 0, 0},
+		"zero key":       {1, 0, 0, 0, 0},
+		"value too long": {1, 0, 1, 'k', 5, 0, 'v'},
+		"trailing bytes": {1, 0, 1, 'k', 0, 0, 'x'},
+		"duplicate key":  {2, 0, 1, 'k', 0, 0, 1, 'k', 0, 0},
+	} {
+		if _, err := ReadMetadata(metadataEnvelope(env, raw, patch)); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s: got %v, want ErrCorruptPatch", name, err)
+		}
+	}
+	if got, err := ReadMetadata(metadataEnvelope(env, []byte{1, 0, 1, 'k', 1, 0, 'v'}, patch)); err != nil || got["k"] != "v" {
+		t.Fatalf("hand-built metadata: %v, %v", got, err)
+	}
+	huge := metadataEnvelope(env, nil, patch)
+	binary.LittleEndian.PutUint32(huge[envelopeHeaderLen:], MaxMetadataSize+1)
+	if _, err := ReadMetadata(huge); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("metadata size over MaxMetadataSize: got %v, want ErrCorruptPatch", err)
+	}
+
+	later := bytes.Clone(env)
+	later[len(envelopeMagic)] = EnvelopeMetadataVersion + 1
+	if _, err := ReadMetadata(later); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+}
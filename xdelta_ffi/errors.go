@@ -0,0 +1,139 @@
+package xdelta_ffi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// 原生层错误类别，可通过 errors.Is 判断
+var (
+	// ErrInvalidArgument 参数不合法，例如 blockSize 超出 [MinBlockSize, MaxBlockSize]
+	ErrInvalidArgument = errors.New("xdelta: invalid argument")
+	// ErrCorruptPatch 补丁数据损坏、截断或格式不正确
+	ErrCorruptPatch = errors.New("xdelta: corrupt patch")
+	// ErrSourceMismatch 补丁与所给的旧数据不匹配，例如 COPY 超出旧数据范围
+	ErrSourceMismatch = errors.New("xdelta: source mismatch")
+	// ErrTargetMismatch 应用得到的新数据与信封中记录的长度或 SHA-256 不一致，见 ApplyEnvelope、WithVerifyOutput
+	ErrTargetMismatch = errors.New("xdelta: target mismatch")
+	// ErrOutputTooLarge 输出超出允许的大小，例如超过 WithMaxOutputSize 设置的上限
+	ErrOutputTooLarge = errors.New("xdelta: output too large")
+	// ErrIO 原生层读写文件失败
+	ErrIO = errors.New("xdelta: i/o error")
+	// ErrOutOfMemory 原生层分配内存失败
+	ErrOutOfMemory = errors.New("xdelta: out of memory")
+	// ErrUnsupportedPatch 补丁格式正确，但用到了本库不支持的功能，
+	// 例如 xdelta3 的二次压缩（-S djw/lzma）或外部压缩（源文件或目标是 .gz 等压缩文件）
+	ErrUnsupportedPatch = errors.New("xdelta: unsupported patch feature")
+	// ErrNative 无法归类的原生层错误，具体错误码见 *Error 的 Code
+	ErrNative = errors.New("xdelta: native error")
+	// ErrNotSupported 当前构建没有可用的原生后端（CGO_ENABLED=0 且未使用 xdelta_purego 标签），
+	// 这样的构建只能应用补丁（见 Supported），创建补丁等接口返回这个错误
+	ErrNotSupported = errors.New("xdelta: not supported in this build (requires cgo or the xdelta_purego build tag)")
+	// ErrMemoryLimit WithMaxMemory 设置的内存上限不足以完成操作
+	ErrMemoryLimit = errors.New("xdelta: memory limit exceeded")
+	// ErrChecksumMismatch 补丁中的校验和（见 WithChecksum，或 xdelta3 补丁的 adler32）与应用得到的输出不一致，
+	// 通常是旧数据不对，因此同时满足 errors.Is(err, ErrSourceMismatch)；错误信息中有出错的校验窗口序号和输出范围
+	ErrChecksumMismatch = fmt.Errorf("xdelta: checksum mismatch: %w", ErrSourceMismatch)
+	// ErrBadSignature 签名补丁没有签名、签名不对或签名密钥不可信，见 ApplySigned 和 WithRequireSignature
+	ErrBadSignature = errors.New("xdelta: bad signature")
+	// ErrTimeout 操作超过了 WithTimeout 设置的时间，同时满足 errors.Is(err, context.DeadlineExceeded)
+	ErrTimeout = fmt.Errorf("xdelta: operation timed out: %w", context.DeadlineExceeded)
+	// ErrBufferTooSmall ApplyDiffsFixed 的输出缓冲区放不下补丁的输出，或 CreateDiffsFixed 的缓冲区放不下补丁；
+	// 返回的 n 为需要的长度，按它准备缓冲区后重试，此时 dst 中的内容没有意义
+	ErrBufferTooSmall = errors.New("xdelta: buffer too small")
+	// ErrNoPatchPath PatchGraph 中没有从一个版本到另一个版本的补丁链，具体见 *NoPathError
+	ErrNoPatchPath = errors.New("xdelta: no patch path")
+	// ErrMissingSegments ApplySegments 应用了提供的段之后仍然缺少段，具体见 *MissingSegmentsError
+	ErrMissingSegments = errors.New("xdelta: missing patch segments")
+	// ErrBusy Shutdown 等待期间仍有进行中的原生调用或未关闭的句柄
+	ErrBusy = errors.New("xdelta: native library is busy")
+	// ErrLibraryChecksum DownloadLibrary 下载的原生库与记录的 SHA-256 不一致
+	ErrLibraryChecksum = errors.New("xdelta: native library checksum mismatch")
+	// ErrIncompatibleLibrary Init 找到的原生库 ABI 修订号比本包的 WrapperABIVersion 旧，通常是升级后残留的旧库文件
+	ErrIncompatibleLibrary = errors.New("xdelta: incompatible native library")
+	// ErrRegionLocked ApplyRegionDiff 要修改的区域与同一文件上正在进行的另一次 ApplyRegionDiff 重叠
+	ErrRegionLocked = errors.New("xdelta: file region is being patched")
+)
+
+// ErrorCode 原生层的错误码，与 xdelta_interface.h 中的 XDELTA_ERR_* 一致；
+// 一般用 errors.Is 与 ErrCorruptPatch 等错误类别比较即可，需要区分原生层的具体错误码时用 errors.As 取出 *Error 的 Code
+type ErrorCode int
+
+const (
+	CodeInvalidArgument  ErrorCode = -1
+	CodeCanceled         ErrorCode = -2
+	CodeCorruptPatch     ErrorCode = -3
+	CodeSourceMismatch   ErrorCode = -4
+	CodeOutputTooLarge   ErrorCode = -5
+	CodeIO               ErrorCode = -6
+	CodeOutOfMemory      ErrorCode = -7
+	CodeUnsupported      ErrorCode = -8
+	CodeChecksumMismatch ErrorCode = -9
+)
+
+// String 返回错误码的名称，未知的错误码返回 "code(N)"
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeInvalidArgument:
+		return "invalid argument"
+	case CodeCanceled:
+		return "canceled"
+	case CodeCorruptPatch:
+		return "corrupt patch"
+	case CodeSourceMismatch:
+		return "source mismatch"
+	case CodeOutputTooLarge:
+		return "output too large"
+	case CodeIO:
+		return "i/o error"
+	case CodeOutOfMemory:
+		return "out of memory"
+	case CodeUnsupported:
+		return "unsupported"
+	case CodeChecksumMismatch:
+		return "checksum mismatch"
+	default:
+		return fmt.Sprintf("code(%d)", int(c))
+	}
+}
+
+// Error 原生层返回的错误，Code 为原生错误码，Message 为原生层的错误信息
+// 通过 errors.Is 可以与 ErrCorruptPatch 等错误类别比较
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("xdelta unknown error (code %d)", int(e.Code))
+	}
+	return "xdelta error: " + e.Message
+}
+
+// Unwrap 返回错误码对应的错误类别
+func (e *Error) Unwrap() error {
+	switch e.Code {
+	case CodeInvalidArgument:
+		return ErrInvalidArgument
+	case CodeCanceled:
+		return context.Canceled
+	case CodeCorruptPatch:
+		return ErrCorruptPatch
+	case CodeSourceMismatch:
+		return ErrSourceMismatch
+	case CodeOutputTooLarge:
+		return ErrOutputTooLarge
+	case CodeIO:
+		return ErrIO
+	case CodeOutOfMemory:
+		return ErrOutOfMemory
+	case CodeUnsupported:
+		return ErrUnsupportedPatch
+	case CodeChecksumMismatch:
+		return ErrChecksumMismatch
+	default:
+		return ErrNative
+	}
+}
@@ -0,0 +1,89 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestPerCallErrors 32 个 goroutine 同时用会失败的输入调用 ApplyDiffsData 和原生的创建接口，中间穿插成功的调用，
+// 每个错误的错误码和信息都与单独调用同一输入时相同，成功的调用不会带出别的调用的错误
+func TestPerCallErrors(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffsData(oldData, newData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers = 32
+	type call struct {
+		name string
+		do   func() error
+	}
+	calls := make([]call, 0, 2*workers)
+	for g := range workers {
+		// 每个补丁的第一个字节不同，原生层的错误信息中带有这个字节
+		bad := append([]byte{byte(0x80 + g)}, "garbage"...)
+		calls = append(calls, call{fmt.Sprintf("apply %#x", bad[0]), func() error {
+			_, err := ApplyDiffsData(oldData, bad)
+			return err
+		}})
+		e := defaultEncoding
+		e.format = 100 + g
+		calls = append(calls, call{fmt.Sprintf("create format %d", e.format), func() error {
+			_, err := createPatchData(appendTo(nil), oldData, newData, 1024, e, nil)
+			return err
+		}})
+	}
+	want := map[string]string{}
+	for _, c := range calls {
+		err := c.do()
+		var ne *Error
+		if !errors.As(err, &ne) {
+			t.Fatalf("%s: got %v, want a native *Error", c.name, err)
+		}
+		want[c.name] = fmt.Sprintf("%d %s", ne.Code, ne.Message)
+	}
+	seen := map[string]string{}
+	for name, msg := range want {
+		if other, ok := seen[msg]; ok {
+			t.Fatalf("%s and %s both fail with %q", name, other, msg)
+		}
+		seen[msg] = name
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for g := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				c := calls[(g+i)%len(calls)]
+				var ne *Error
+				if err := c.do(); !errors.As(err, &ne) || fmt.Sprintf("%d %s", ne.Code, ne.Message) != want[c.name] {
+					errs <- fmt.Errorf("%s: got %v, want %q", c.name, err, want[c.name])
+					return
+				}
+				if i%5 == 0 {
+					got, err := CreateDiffsData(oldData, newData, 1024)
+					if err != nil || !bytes.Equal(got, patch) {
+						errs <- fmt.Errorf("CreateDiffsData between failures: %d bytes, %v", len(got), err)
+						return
+					}
+					if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+						errs <- fmt.Errorf("ApplyDiffsData between failures: %d bytes, %v", len(got), err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,195 @@
+package xdelta_ffi
+
+import (
+	"math/bits"
+	"runtime"
+)
+
+const (
+	// cancelWindow 原生编码器每次处理的新数据量，与 encoder.rs 的 CANCEL_WINDOW 一致
+	cancelWindow = 1 << 20
+	// checksumWindow 带校验和的补丁每段校验的输出量，与 checksum.rs 的 CHECKSUM_WINDOW 一致
+	checksumWindow = 1 << 20
+	// copyChunk 原生解码器从旧数据复制时的缓冲区大小，与 decoder.rs 的 COPY_CHUNK 一致
+	copyChunk = 64 << 10
+	// vcdiffWindow VCDIFF 补丁每个窗口最多产生的输出，与 vcdiff.rs 的 MAX_WINDOW 一致
+	vcdiffWindow = 8 << 20
+	// vcdiffOpBytes VCDIFF 编码器为窗口中每条指令保存的记录（24 字节）加指令和地址（最多各 10 字节）
+	vcdiffOpBytes = 24 + 2*10
+	// blockRecordBytes 新数据每个块最多产生的记录头：一条 COPY（13 字节）加一条 ADD（5 字节）
+	blockRecordBytes = 13 + 5
+	// decodeBaseBytes 原生解码器的固定开销（读缓冲、状态和余量），实测 64 到 130 KiB
+	decodeBaseBytes = 256 << 10
+	// zstdDecodeBytes zstd 解压状态：窗口最大 8 MiB（级别不超过 19），另加约 128 KiB 的缓冲
+	zstdDecodeBytes = 8<<20 + 128<<10
+	// zlibDecodeBytes zlib 解压状态：32 KiB 窗口加状态，再加 INFLATE_CHUNK 的输出缓冲
+	zlibDecodeBytes = 128 << 10
+	// zlibEncodeBytes zlib 压缩状态，按 zlib 文档 (1 << (windowBits+2)) + (1 << (memLevel+9))
+	zlibEncodeBytes = 256 << 10
+	// lz4EncodeBytes LZ4 压缩状态：64 KiB 的块和压缩结果、哈希表和匹配链，与 lz4.rs 一致
+	lz4EncodeBytes = 384 << 10
+	// lz4DecodeBytes LZ4 解压状态：收集中的块和解压出的块，各 64 KiB
+	lz4DecodeBytes = 128 << 10
+	// huffEncodeBytes DJW、FGK 压缩状态：1 MiB 的块、编码结果和 DJW 每组的切片与选择子，与 huffman.rs 一致
+	huffEncodeBytes = 3 << 20
+	// huffDecodeBytes DJW、FGK 解压状态：收集中的编码块和解出的块，各最多 1 MiB
+	huffDecodeBytes = 2<<20 + 64<<10
+	// lzmaHashBytes LZMA 压缩的哈希表（1<<17 项，每项 4 字节）、概率模型、价格表和最优解析的 4096 个节点
+	lzmaHashBytes = 512<<10 + 320<<10
+	// lzmaWindowSlack LZMA 压缩的窗口在字典之外还保留的数据：未结束的数据块（最多 2 MiB）和一次写入（lzma.rs 的 WRITE_STEP）
+	lzmaWindowSlack = 2<<20 + 1<<20
+	// lzmaChunkBytes LZMA2 块中一个数据块解压后最多 2 MiB，压缩后最多 64 KiB，解压时各收集一个
+	lzmaChunkBytes = 2<<20 + 64<<10
+)
+
+// lzmaDictLog 各压缩级别的 LZMA 字典大小（以 2 为底的对数），与 lzma.rs 的 LZMA_LEVELS 一致
+var lzmaDictLog = [MaxCompressionLevel + 1]uint{18, 20, 21, 22, 22, 23, 23, 24, 25, 25}
+
+// lzmaEncodeBytes LZMA 压缩 patch 字节的记录时的状态：窗口最多一个字典加 lzmaWindowSlack，每个位置另有
+// 4 字节的哈希链（级别 0 到 3）或 8 字节的二叉树（级别 4 到 9）
+func lzmaEncodeBytes(level int, patch int64) int64 {
+	if level == DefaultCompressionLevel {
+		level = 6
+	}
+	perByte := int64(5)
+	if level >= 4 {
+		perByte = 9
+	}
+	win := min(patch, 1<<lzmaDictLog[level]+lzmaWindowSlack)
+	return perByte*win + lzmaHashBytes
+}
+
+// lzmaDecodeBytes 解压 xz 流的状态：解压历史最多保留两个字典（至少两个 LZMA2 数据块），不超过目标长度，另加收集中的数据块；
+// 字典大小取自第一个块头，读不出时按最大的 4 GiB 计
+func lzmaDecodeBytes(patch []byte, targetSize int64) int64 {
+	dict := int64(4 << 30)
+	// 流头 12 字节，块头依次为长度、标志、可选的两个长度、过滤器 ID、属性长度和字典字节
+	if len(patch) > 13 && patch[13]&0x3c == 0 {
+		h, at := patch[12:], 2
+		for n := bits.OnesCount8(patch[13]&0xc0) + 2; n > 0 && at < len(h); n-- {
+			for at < len(h) && h[at]&0x80 != 0 {
+				at++
+			}
+			at++
+		}
+		if at < len(h) && h[at] <= 39 {
+			dict = int64(2|h[at]&1) << (h[at]/2 + 11)
+		}
+	}
+	return min(2*targetSize, 2*max(dict, 2<<20)) + lzmaChunkBytes
+}
+
+// EstimateCreateMemory 估计用 opts 把 oldLen 字节的旧数据和 newLen 字节的新数据做成补丁时原生层内存占用的上限，
+// 用于在内存有限的机器上安排任务；块大小、线程数、WithSourceWindow、WithMaxMemory 的调整与 CreateDiffs 相同
+// 估计由三部分组成：签名表（每个被索引的旧数据块 sigBytesPerBlock 字节），最坏情况（新数据与旧数据无关，
+// 每块一条 COPY 和一条 ADD）下的补丁缓冲区按扩容和返回时的复制计三倍，以及编码窗口、多线程分段、校验和、VCDIFF 窗口与二次压缩的缓冲
+// 对随机数据 NativeStats 的 PeakBytes 实测为估计的 40% 到 90%，与旧数据相似或可压缩的数据实测值更低，估计也就更保守
+// 不包括调用方传入的数据；zlib 二次压缩的状态由 C 代码分配，NativeStats 看不到，按 256 KiB 计入，
+// zstd 的压缩状态随级别从约 1 MiB 增长到数十 MiB，没有计入。oldLen 或 newLen 为负数时返回 -1
+func EstimateCreateMemory(oldLen, newLen int64, opts ...Option) int64 {
+	o, err := newOptions(opts)
+	if err != nil || oldLen < 0 || newLen < 0 {
+		return -1
+	}
+	if o.bsdiff {
+		return bsdiffCreateBytes(oldLen, newLen)
+	}
+	bs, err := o.fitMemory(o.blockSize, oldLen, newLen, false)
+	if err != nil {
+		bs = MaxBlockSize
+	}
+	sig := o.signatureBytes(o.indexedSize(oldLen), bs)
+	patch := maxPatchBytes(newLen, bs)
+	work := 4 * min(newLen, cancelWindow)
+	if t := o.createThreads(); t != 1 {
+		if t == 0 {
+			t = min(runtime.NumCPU(), MaxThreads)
+		}
+		// 每个线程的分段补丁在合并之前各自保存一份
+		work += int64(t) * 2 * maxPatchBytes(min(newLen, parallelChunk), bs)
+	}
+	if o.checksum != ChecksumNone {
+		work += 2 * min(newLen, checksumWindow)
+	}
+	if o.vcdiff {
+		// 当前窗口的 ADD 数据在扩容时最多有两份，另有每块一条指令
+		win := min(newLen, vcdiffWindow)
+		work += 2*win + (win/int64(bs)+1)*vcdiffOpBytes
+	}
+	switch o.encoding().secondary {
+	case SecondaryZlib:
+		work += patch + zlibEncodeBytes
+	case SecondaryZstd:
+		work += patch
+	case SecondaryLZ4:
+		work += patch + lz4EncodeBytes
+	case SecondaryDJW, SecondaryFGK:
+		work += patch + huffEncodeBytes
+	case SecondaryLZMA:
+		work += patch + lzmaEncodeBytes(o.encoding().level, patch)
+	}
+	return sig + 3*patch + work
+}
+
+// maxPatchBytes newLen 字节新数据按 bs 分块时补丁的最大长度
+func maxPatchBytes(newLen int64, bs uint32) int64 {
+	return newLen + (newLen+int64(bs)-1)/int64(bs)*blockRecordBytes + 64
+}
+
+// EstimateApplyMemory 估计把 patch 应用到 oldLen 字节的旧数据时原生层内存占用的上限，
+// 对 ApplyDiffsData、ApplyDiffsStream、ApplyDiffs、NewDecoder、NewApplyReader 有效：输出直接写入 Go 的内存或调用方的 io.Writer，
+// 本库格式的补丁只需要复制缓冲区和固定的解码状态，与补丁和输出的大小无关；VCDIFF 补丁每次缓冲一个完整的窗口，
+// 估计为最大窗口的补丁和输出各两份；bsdiff 补丁按缓存的整个补丁和三个 bzip2 块的解压状态估计。信封按其中的补丁估计
+// 本库格式的实测值为估计的 20% 到 50%，随机数据的 VCDIFF 补丁约为 75%，补丁比窗口小得多时更低；zlib、zstd 的解压状态由 C 代码分配，NativeStats 看不到，
+// 按各自的最大窗口计入。SourceDecoder 会把旧数据复制到原生层，需要另加 oldLen
+// 补丁无法解析时返回 -1，oldLen 为负数时按旧数据足够大估计
+func EstimateApplyMemory(patch []byte, oldLen int64) int64 {
+	if IsEnvelope(patch) {
+		h, _, err := ParseEnvelope(patch)
+		if err != nil {
+			return -1
+		}
+		patch = patch[h.size:]
+	}
+	if isBSDiff(patch) {
+		return bsdiffApplyBytes(int64(len(patch)))
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return -1
+	}
+	defer release()
+	info, err := inspectPatchData(patch)
+	if err != nil {
+		return -1
+	}
+	copyBuf := int64(copyChunk)
+	if oldLen >= 0 {
+		copyBuf = min(oldLen, copyBuf)
+	}
+	est := decodeBaseBytes + copyBuf
+	if info.format == formatVCDIFF {
+		_, segs, err := patchSegments(patch, 1)
+		if err != nil {
+			return -1
+		}
+		var maxPatch, maxTarget uint64
+		for _, s := range segs {
+			maxPatch, maxTarget = max(maxPatch, s.patchLen), max(maxTarget, s.targetLen)
+		}
+		return est + 2*int64(maxPatch) + 2*int64(maxTarget)
+	}
+	switch SecondaryCompression(info.secondary) {
+	case SecondaryZlib:
+		est += zlibDecodeBytes
+	case SecondaryZstd:
+		est += min(int64(info.targetSize), zstdDecodeBytes)
+	case SecondaryLZ4:
+		est += lz4DecodeBytes
+	case SecondaryDJW, SecondaryFGK:
+		est += huffDecodeBytes
+	case SecondaryLZMA:
+		est += lzmaDecodeBytes(patch, int64(info.targetSize))
+	}
+	return est
+}
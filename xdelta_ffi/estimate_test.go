@@ -0,0 +1,164 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// estimateCase 一个测量原生层内存峰值的操作：用 opts 创建 oldData 到 newData 的补丁，或者应用这样创建的补丁
+// （apply 时；stream 时用 ApplyDiffsStream，envelope 时补丁是信封）；factor 为 0 时只检查估计是上限，
+// 否则还检查估计不超过实测峰值的 factor 倍
+type estimateCase struct {
+	name             string
+	oldData, newData []byte
+	opts             []Option
+	apply, stream    bool
+	envelope         bool
+	factor           float64
+}
+
+// estimateCases TestEstimateMemory 的操作，父进程和子进程用同样的数据生成同样的表
+func estimateCases() []estimateCase {
+	r := fixtureRand(108)
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(r.next())
+		}
+		return b
+	}
+	randOld, randNew := random(4<<20), random(4<<20)
+	textOld, textNew := textFixture(4 << 20)
+	smallOld, smallNew := textOld[:1<<20], textNew[:1<<20]
+	// 随机数据上的创建实测为估计的 40% 到 90%，本库格式的应用为 20% 到 50%，随机数据的 VCDIFF 约 75%（见两个函数的说明）
+	return []estimateCase{
+		{name: "create random", oldData: randOld, newData: randNew, factor: 2.5},
+		{name: "create random, 64 byte blocks", oldData: randOld, newData: randNew, opts: []Option{WithBlockSize(64)}, factor: 2.5},
+		{name: "create random, xxh3", oldData: randOld, newData: randNew, opts: []Option{WithChecksum(ChecksumXXH3)}, factor: 2.5},
+		{name: "create random, threads", oldData: randOld[:1<<20], newData: random(20 << 20), opts: []Option{WithThreads(4)}, factor: 2.5},
+		{name: "create random, vcdiff", oldData: randOld, newData: randNew, opts: []Option{WithStandardVCDIFF()}, factor: 2.5},
+		{name: "create random, zlib", oldData: randOld, newData: randNew, opts: []Option{WithSecondaryCompression(SecondaryZlib)}},
+		{name: "create random, source window", oldData: randOld, newData: randNew, opts: []Option{WithSourceWindowSize(256 << 10)}},
+		{name: "create text", oldData: textOld, newData: textNew},
+		{name: "create bsdiff", oldData: smallOld, newData: smallNew, opts: []Option{WithBSDiff()}},
+		{name: "apply native", oldData: textOld, newData: textNew, apply: true, factor: 5},
+		{name: "apply native, stream", oldData: textOld, newData: textNew, apply: true, stream: true, factor: 5},
+		{name: "apply random", oldData: randOld, newData: randNew, apply: true, factor: 5},
+		{name: "apply vcdiff random", oldData: randOld, newData: randNew, opts: []Option{WithStandardVCDIFF()}, apply: true, factor: 1 / 0.6},
+		{name: "apply vcdiff random, stream", oldData: randOld, newData: randNew, opts: []Option{WithStandardVCDIFF()}, apply: true, stream: true, factor: 1 / 0.6},
+		{name: "apply vcdiff text", oldData: textOld, newData: textNew, opts: []Option{WithStandardVCDIFF()}, apply: true},
+		{name: "apply zstd", oldData: textOld, newData: textNew, opts: []Option{WithSecondaryCompression(SecondaryZstd)}, apply: true},
+		{name: "apply bsdiff", oldData: smallOld, newData: smallNew, opts: []Option{WithBSDiff()}, apply: true},
+		{name: "apply envelope", oldData: textOld, newData: textNew, apply: true, envelope: true},
+	}
+}
+
+// TestEstimateMemoryHelper 由 TestEstimateMemory 在子进程中运行 XDELTA_ESTIMATE_CASE 指定的操作，
+// 输出操作期间 NativeStats 的峰值比开始时多出的字节数；PeakBytes 只增不减，所以每个操作都在新的进程中测量
+func TestEstimateMemoryHelper(t *testing.T) {
+	name := os.Getenv("XDELTA_ESTIMATE_CASE")
+	if name == "" {
+		t.Skip("run by TestEstimateMemory")
+	}
+	for _, c := range estimateCases() {
+		if c.name != name {
+			continue
+		}
+		var patch []byte
+		if c.apply {
+			var err error
+			if patch, err = os.ReadFile(os.Getenv("XDELTA_ESTIMATE_PATCH")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before, err := NativeStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := max(before.PeakBytes, before.CurrentBytes)
+		switch {
+		case !c.apply:
+			_, err = CreateDiffs(c.oldData, c.newData, c.opts...)
+		case c.stream:
+			err = ApplyDiffsStream(bytes.NewReader(c.oldData), bytes.NewReader(patch), &bytes.Buffer{})
+		default:
+			var out []byte
+			out, err = ApplyDiffsData(c.oldData, patch)
+			if err == nil && !bytes.Equal(out, c.newData) {
+				t.Fatal("wrong output")
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := NativeStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Printf("peak %d\n", after.PeakBytes-before.CurrentBytes)
+		if after.PeakBytes <= base {
+			fmt.Println("below the earlier peak")
+		}
+		return
+	}
+	t.Fatalf("unknown case %q", name)
+}
+
+// TestEstimateMemory 实际执行创建和应用（随机和相似的数据、各种块大小、线程、校验和、格式、二次压缩、流式接口），
+// NativeStats 测得的原生层内存峰值都不超过 EstimateCreateMemory、EstimateApplyMemory 事先给出的估计，
+// 而在说明中给出了实测比例的情况下，估计也不超过实测峰值相应的倍数
+func TestEstimateMemory(t *testing.T) {
+	requireNative(t)
+	if testing.Short() {
+		t.Skip("runs a process for every operation")
+	}
+	dir := t.TempDir()
+	for _, c := range estimateCases() {
+		est := EstimateCreateMemory(int64(len(c.oldData)), int64(len(c.newData)), c.opts...)
+		patchPath := filepath.Join(dir, "patch")
+		if c.apply {
+			create := CreateDiffs
+			if c.envelope {
+				create = CreateEnvelope
+			}
+			patch, err := create(c.oldData, c.newData, c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(patchPath, patch, 0644); err != nil {
+				t.Fatal(err)
+			}
+			est = EstimateApplyMemory(patch, int64(len(c.oldData)))
+		}
+		if est <= 0 {
+			t.Fatalf("%s: estimate %d", c.name, est)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestEstimateMemoryHelper$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "XDELTA_ESTIMATE_CASE="+c.name, "XDELTA_ESTIMATE_PATCH="+patchPath)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", c.name, err, out)
+		}
+		var peak int64
+		if i := strings.Index(string(out), "peak "); i < 0 {
+			t.Fatalf("%s: no measurement in\n%s", c.name, out)
+		} else if _, err := fmt.Sscanf(string(out[i:]), "peak %d", &peak); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(out), "below the earlier peak") {
+			t.Fatalf("%s: the operation stayed below the peak reached while loading the library", c.name)
+		}
+		t.Logf("%s: peak %d, estimate %d (%.0f%%)", c.name, peak, est, 100*float64(peak)/float64(est))
+		if peak > est {
+			t.Errorf("%s: native peak %d bytes exceeds the estimate of %d", c.name, peak, est)
+		}
+		if c.factor > 0 && float64(est) > c.factor*float64(peak) {
+			t.Errorf("%s: estimate %d is more than %.1f times the native peak of %d bytes", c.name, est, c.factor, peak)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+//go:build cgo && !xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestApplyDiffsFixedAllocs cgo 后端成功的 ApplyDiffsFixed 不做任何 Go 堆分配（purego 后端的函数调用本身会分配）
+func TestApplyDiffsFixedAllocs(t *testing.T) {
+	oldData, newData := textFixture(256 << 10)
+	dst := make([]byte, len(newData))
+	for _, f := range []struct {
+		name string
+		opts []Option
+	}{
+		{"native", nil},
+		{"zstd", []Option{WithSecondaryCompression(SecondaryZstd)}},
+		{"vcdiff", []Option{WithStandardVCDIFF()}},
+		{"bsdiff", []Option{WithBSDiff()}},
+	} {
+		patch, err := CreateDiffs(oldData, newData, f.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allocs := testing.AllocsPerRun(50, func() {
+			if n, err := ApplyDiffsFixed(dst, oldData, patch); err != nil || n != len(newData) {
+				t.Fatalf("%s: %d bytes, %v", f.name, n, err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("%s: %v allocations per call", f.name, allocs)
+		}
+		if !bytes.Equal(dst, newData) {
+			t.Fatalf("%s: wrong output", f.name)
+		}
+	}
+}
+
+// TestApplyDiffsFixedVerboseLogger 设置了 logger 时，另一个 goroutine 上使用 WithVerboseLogging 的操作让原生层输出调试日志，
+// 并发的 ApplyDiffsFixed 也会回调 Go 的 logger，不能因此中止进程
+func TestApplyDiffsFixedVerboseLogger(t *testing.T) {
+	requireNative(t)
+	var lines atomic.Int64
+	SetLogger(func(Level, string) { lines.Add(1) })
+	defer SetLogger(nil)
+
+	oldData, newData := textFixture(64 << 10)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if _, err := ApplyDiffsData(oldData, patch, WithVerboseLogging()); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	dst := make([]byte, len(newData))
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; i < 200 || lines.Load() == 0; i++ {
+		if time.Now().After(deadline) {
+			break
+		}
+		if n, err := ApplyDiffsFixed(dst, oldData, patch); err != nil || n != len(newData) {
+			t.Fatalf("ApplyDiffsFixed: %d bytes, %v", n, err)
+		}
+		// 损坏的补丁让原生层通过 fail 记录错误日志
+		if _, err := ApplyDiffsFixed(dst, oldData, patch[:len(patch)/2]); err == nil {
+			t.Fatal("ApplyDiffsFixed accepted a truncated patch")
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if lines.Load() == 0 {
+		t.Fatal("the logger received no debug output")
+	}
+	if !bytes.Equal(dst, newData) {
+		t.Fatal("wrong output")
+	}
+}
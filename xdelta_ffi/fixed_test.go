@@ -0,0 +1,146 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestApplyDiffsFixed 各种格式的补丁直接解码进调用方的缓冲区：缓冲区正好、偏大时返回输出长度，之后的内容不被改动；
+// 偏小时返回 ErrBufferTooSmall 和补丁声明的长度，按它准备的缓冲区重试成功；原生层不经结果缓冲区交回输出
+func TestApplyDiffsFixed(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(256 << 10)
+	for _, f := range []struct {
+		name string
+		opts []Option
+	}{
+		{"native", nil},
+		{"zstd", []Option{WithSecondaryCompression(SecondaryZstd)}},
+		{"xxh3", []Option{WithChecksum(ChecksumXXH3)}},
+		{"vcdiff", []Option{WithStandardVCDIFF()}},
+		{"bsdiff", []Option{WithBSDiff()}},
+	} {
+		patch, err := CreateDiffs(oldData, newData, f.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before, err := DebugAllocStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := make([]byte, len(newData))
+		if n, err := ApplyDiffsFixed(dst, oldData, patch); err != nil || n != len(newData) || !bytes.Equal(dst, newData) {
+			t.Fatalf("%s: exact buffer: %d bytes, %v", f.name, n, err)
+		}
+		if s, err := DebugAllocStats(); err != nil || s.TotalBytes != before.TotalBytes {
+			t.Fatalf("%s: the native layer handed over %d bytes of buffers (%v)", f.name, s.TotalBytes-before.TotalBytes, err)
+		}
+
+		big := bytes.Repeat([]byte{0xAA}, len(newData)+100)
+		if n, err := ApplyDiffsFixed(big, oldData, patch); err != nil || n != len(newData) || !bytes.Equal(big[:n], newData) {
+			t.Fatalf("%s: larger buffer: %d bytes, %v", f.name, n, err)
+		}
+		if !bytes.Equal(big[len(newData):], bytes.Repeat([]byte{0xAA}, 100)) {
+			t.Fatalf("%s: bytes after the output were written", f.name)
+		}
+
+		for _, size := range []int{0, 1, len(newData) / 2, len(newData) - 1} {
+			n, err := ApplyDiffsFixed(make([]byte, size), oldData, patch)
+			if !errors.Is(err, ErrBufferTooSmall) || n != len(newData) {
+				t.Fatalf("%s: %d byte buffer: got %d, %v, want %d and ErrBufferTooSmall", f.name, size, n, err, len(newData))
+			}
+			retry := make([]byte, n)
+			if m, err := ApplyDiffsFixed(retry, oldData, patch); err != nil || !bytes.Equal(retry[:m], newData) {
+				t.Fatalf("%s: retry with the reported size: %d bytes, %v", f.name, m, err)
+			}
+		}
+	}
+
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := CreateEnvelope(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, len(newData))
+	for _, tc := range []struct {
+		name  string
+		patch []byte
+		want  error
+	}{
+		{"truncated", patch[:len(patch)/2], ErrCorruptPatch},
+		{"garbage", []byte("not a patch"), ErrCorruptPatch},
+		{"envelope", env, ErrUnsupportedPatch},
+	} {
+		if _, err := ApplyDiffsFixed(dst, oldData, tc.patch); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	empty, err := CreateDiffs(oldData, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ApplyDiffsFixed(nil, oldData, empty); err != nil || n != 0 {
+		t.Fatalf("empty output into a nil buffer: %d bytes, %v", n, err)
+	}
+}
+
+// TestCreateDiffsFixed 补丁直接写入调用方的缓冲区，与 CreateDiffs 的结果逐字节相同（原生格式、VCDIFF、bsdiff）；
+// 缓冲区偏小时返回 ErrBufferTooSmall 和补丁的长度，按它重试成功；新旧相同时写入恒等补丁；WithTimeout 到期返回 ErrTimeout
+func TestCreateDiffsFixed(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(256 << 10)
+	for _, f := range []struct {
+		name string
+		opts []Option
+	}{
+		{"native", nil},
+		{"vcdiff", []Option{WithStandardVCDIFF()}},
+		{"bsdiff", []Option{WithBSDiff()}},
+	} {
+		want, err := CreateDiffs(oldData, newData, f.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		big := bytes.Repeat([]byte{0xAA}, len(want)+100)
+		n, err := CreateDiffsFixed(big, oldData, newData, f.opts...)
+		if err != nil || !bytes.Equal(big[:n], want) {
+			t.Fatalf("%s: %d bytes, %v; CreateDiffs gives %d bytes", f.name, n, err, len(want))
+		}
+		if !bytes.Equal(big[n:], bytes.Repeat([]byte{0xAA}, 100)) {
+			t.Fatalf("%s: bytes after the patch were written", f.name)
+		}
+
+		for _, size := range []int{0, 1, len(want) - 1} {
+			n, err := CreateDiffsFixed(make([]byte, size), oldData, newData, f.opts...)
+			if !errors.Is(err, ErrBufferTooSmall) || n != len(want) {
+				t.Fatalf("%s: %d byte buffer: got %d, %v, want %d and ErrBufferTooSmall", f.name, size, n, err, len(want))
+			}
+			retry := make([]byte, n)
+			if m, err := CreateDiffsFixed(retry, oldData, newData, f.opts...); err != nil || !bytes.Equal(retry[:m], want) {
+				t.Fatalf("%s: retry with the reported size: %d bytes, %v", f.name, m, err)
+			}
+		}
+	}
+
+	for _, end := range []bool{false, true} {
+		want := identityPatch(int64(len(oldData)), end)
+		dst := make([]byte, len(want))
+		if n, err := CreateDiffsFixed(dst, oldData, bytes.Clone(oldData), WithEndRecord(end)); err != nil || !bytes.Equal(dst[:n], want) {
+			t.Fatalf("identity patch (end record %v): %d bytes, %v", end, n, err)
+		}
+		if n, err := CreateDiffsFixed(dst[:len(want)-1], oldData, oldData, WithEndRecord(end)); !errors.Is(err, ErrBufferTooSmall) || n != len(want) {
+			t.Fatalf("identity patch (end record %v) into a short buffer: got %d, %v, want %d and ErrBufferTooSmall", end, n, err, len(want))
+		}
+	}
+
+	bigOld, bigNew := textFixture(32 << 20)
+	dst := make([]byte, len(bigNew))
+	if _, err := CreateDiffsFixed(dst, bigOld, bigNew, WithTimeout(time.Millisecond)); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("WithTimeout: got %v, want ErrTimeout", err)
+	}
+}
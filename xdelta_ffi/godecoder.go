@@ -0,0 +1,498 @@
+//go:build !cgo && !xdelta_purego
+// +build !cgo,!xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// 没有原生后端的构建（CGO_ENABLED=0 且未使用 xdelta_purego 标签）用纯 Go 解码器应用补丁，行为与原生层
+// src/decoder.rs、src/vcdiff.rs 一致：接受本库格式（包括 zlib、lz4、lzma 二次压缩和校验和记录）以及不带二次压缩的 VCDIFF，
+// 错误同样是带原生错误码和相同信息的 *Error（损坏的 zlib 流可能在更靠后的位置才被发现）；bsdiff 补丁由 bsdiff.go 应用，
+// 同样要读入整个补丁、需要旧数据的长度，损坏时的错误包装 ErrCorruptPatch，但信息与原生层不同；
+// zstd 二次压缩的补丁返回 ErrUnsupportedPatch。创建补丁仍然需要原生库
+
+// goErrorPrefix 原生层 XDeltaError 的 Display 前缀，纯 Go 解码器的错误信息与原生层的相同
+var goErrorPrefix = map[ErrorCode]string{
+	CodeInvalidArgument:  "invalid argument: ",
+	CodeCorruptPatch:     "corrupt patch: ",
+	CodeSourceMismatch:   "source mismatch: ",
+	CodeIO:               "io error: ",
+	CodeOutputTooLarge:   "output too large: ",
+	CodeUnsupported:      "unsupported patch: ",
+	CodeChecksumMismatch: "checksum mismatch: ",
+}
+
+func goError(code ErrorCode, format string, args ...any) error {
+	return &Error{Code: code, Message: goErrorPrefix[code] + fmt.Sprintf(format, args...)}
+}
+
+var errGoCanceled = &Error{Code: CodeCanceled, Message: "operation canceled"}
+
+// nativeCancel 纯 Go 解码器的取消标记；progress 为已经读取的补丁字节数
+type nativeCancel struct {
+	canceled atomic.Bool
+	done     atomic.Int64
+}
+
+func newNativeCancel() *nativeCancel    { return &nativeCancel{} }
+func (c *nativeCancel) trigger()        { c.canceled.Store(true) }
+func (c *nativeCancel) free()           {}
+func (c *nativeCancel) progress() int64 { return c.done.Load() }
+
+func (c *nativeCancel) check() error {
+	if c != nil && c.canceled.Load() {
+		return errGoCanceled
+	}
+	return nil
+}
+
+// cancelReader 读取补丁时记录进度并检查取消
+type cancelReader struct {
+	r io.Reader
+	c *nativeCancel
+}
+
+func (r cancelReader) Read(p []byte) (int, error) {
+	if err := r.c.check(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.c.done.Add(int64(n))
+	return n, err
+}
+
+const (
+	goOpAdd      = 0x00
+	goOpCopy     = 0x01
+	goOpChecksum = 0x02
+	goOpEnd      = endRecordOp
+	goOpHeader   = headerRecordOp
+	// goCopyChunk COPY 分段读取旧数据的大小
+	goCopyChunk = 64 << 10
+)
+
+// goDecoder 一次解码：从 src 读取 COPY 的数据，把输出写入 out
+type goDecoder struct {
+	// src COPY 读取的旧数据，size 为 -1 表示长度未知；只校验时 src 为 nil
+	src  io.ReaderAt
+	size int64
+	out  io.Writer
+	// limit 输出上限，0 为不限制；produced 为补丁已经声明的输出
+	limit    uint64
+	produced uint64
+	cancel   *nativeCancel
+	// validate 只检查结构：COPY 只按 size 检查范围，不读取旧数据，也不写出任何数据，因此不校验校验和
+	validate bool
+	// sizeOnly 只统计输出的长度：VCDIFF 补丁只读取窗口头，不解码指令
+	sizeOnly bool
+	info     patchInfoC
+	scratch  []byte
+	// truncated 记录在解压后的数据中截断；与原生层一样，压缩流之后多余的数据先于截断报告
+	truncated bool
+
+	// sumKind 第一个校验和记录声明的种类，之前为 0
+	sumKind   byte
+	adler     uint32
+	xxh       *xxh3
+	sumWindow uint64
+	sumStart  uint64
+	// lastSum 最后一个校验和记录处的输出偏移，只校验结构时也记录；sumSeen 为是否有过校验和记录
+	lastSum uint64
+	sumSeen bool
+	// vcdiffData 重建 VCDIFF 目标窗口的缓冲区，在窗口之间复用
+	vcdiffData []byte
+}
+
+// reserve 检查再产生 n 字节输出是否超过上限
+func (d *goDecoder) reserve(n uint64) error {
+	produced := d.produced + n
+	if produced < d.produced {
+		produced = ^uint64(0)
+	}
+	if d.limit > 0 && produced > d.limit {
+		return goError(CodeOutputTooLarge, "output exceeds the limit of %d bytes", d.limit)
+	}
+	d.produced = produced
+	return nil
+}
+
+// run 解码整个补丁
+func (d *goDecoder) run(patch io.Reader) error {
+	if d.cancel != nil {
+		patch = cancelReader{r: patch, c: d.cancel}
+	}
+	br := bufio.NewReaderSize(patch, goCopyChunk)
+	head, err := br.Peek(1)
+	if len(head) == 0 {
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return goError(CodeCorruptPatch, "empty patch")
+	}
+	first := head[0]
+	if first == bsdiffMagic[0] {
+		d.info.format = formatBSDiff
+		return d.bsdiff(br)
+	}
+	if first == vcdiffMagic[0] {
+		d.info.format = 1
+		return d.vcdiff(br)
+	}
+	switch secondaryOf(first) {
+	case SecondaryNone:
+		return d.records(br)
+	case SecondaryZlib:
+		d.info.secondary = uint32(SecondaryZlib)
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return zlibError(err)
+		}
+		return d.compressed(br, zlibReader{zr}, "zlib")
+	case SecondaryLZ4:
+		d.info.secondary = uint32(SecondaryLZ4)
+		return d.compressed(br, newLZ4Reader(br), "lz4")
+	case SecondaryLZMA:
+		d.info.secondary = uint32(SecondaryLZMA)
+		return d.compressed(br, newLZMAReader(br), "xz")
+	case SecondaryDJW:
+		d.info.secondary = uint32(SecondaryDJW)
+		return d.compressed(br, newDJWReader(br), "djw")
+	case SecondaryFGK:
+		d.info.secondary = uint32(SecondaryFGK)
+		return d.compressed(br, newFGKReader(br), "fgk")
+	default:
+		return goError(CodeUnsupported, "zstd secondary compression needs the native library")
+	}
+}
+
+// bsdiff 读入整个 bsdiff 补丁后应用，与原生层一样需要旧数据的长度
+func (d *goDecoder) bsdiff(r io.Reader) error {
+	patch, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p, err := parseBSDiff(patch, 0)
+	if err != nil {
+		return err
+	}
+	if err := d.reserve(uint64(p.newSize)); err != nil || d.sizeOnly {
+		return err
+	}
+	src, out := d.src, d.out
+	if d.validate {
+		src, out = nil, io.Discard
+	} else if d.size < 0 {
+		return goError(CodeUnsupported, "bsdiff patches need the length of the old data")
+	}
+	st, err := p.apply(out, src, d.size)
+	d.info.instructions = uint64(st.entries)
+	d.info.addBytes = uint64(st.extraBytes)
+	d.info.copyBytes = uint64(st.diffBytes)
+	return err
+}
+
+// compressed 解码 inflated 解压出的记录，压缩流结束之后 patch 中不能再有数据
+func (d *goDecoder) compressed(patch *bufio.Reader, inflated io.Reader, name string) error {
+	err := d.records(bufio.NewReaderSize(inflated, goCopyChunk))
+	if err != nil && !d.truncated {
+		return err
+	}
+	switch _, rerr := patch.ReadByte(); {
+	case rerr == nil:
+		return goError(CodeCorruptPatch, "trailing data after %s stream", name)
+	case rerr != io.EOF:
+		return rerr
+	}
+	return err
+}
+
+// zlibReader 把 compress/zlib 的错误换成原生层的错误
+type zlibReader struct{ r io.Reader }
+
+func (z zlibReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = zlibError(err)
+	}
+	return n, err
+}
+
+func zlibError(err error) error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return err
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return goError(CodeCorruptPatch, "truncated zlib stream")
+	}
+	// 与原生层（flate2）一样不区分具体的错误
+	return goError(CodeCorruptPatch, "invalid zlib stream: deflate decompression error")
+}
+
+// readFull 读取一条记录的固定长度部分，在记录中间结束的补丁返回 what
+func (d *goDecoder) readFull(r io.Reader, buf []byte, what string) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.truncate(what)
+	}
+	return err
+}
+
+// truncate 补丁在记录中间结束
+func (d *goDecoder) truncate(what string) error {
+	d.truncated = true
+	return goError(CodeCorruptPatch, "%s", what)
+}
+
+// records 解码本库格式的记录，r 为解开二次压缩之后的数据
+func (d *goDecoder) records(r *bufio.Reader) error {
+	var buf [12]byte
+	// headed 补丁以补丁头开头，必须以结束记录结尾
+	first, headed, ended := true, false, false
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			if headed && !ended {
+				return d.truncate("truncated patch: no end record")
+			}
+			if d.sumSeen && d.lastSum < d.produced {
+				// 校验和记录之后的输出没有校验过，编码器总会在最后一段输出之后写出校验和记录
+				return goError(CodeCorruptPatch, "%d bytes of output after the last checksum record are not covered by a checksum", d.produced-d.lastSum)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ended {
+			return goError(CodeCorruptPatch, "data after the end record")
+		}
+		if op == goOpHeader && first {
+			if err := d.readFull(r, buf[:1], "truncated HEADER record"); err != nil {
+				return err
+			}
+			if buf[0] != formatRevision {
+				return goError(CodeUnsupported, "native format revision %d", buf[0])
+			}
+			first, headed = false, true
+			continue
+		}
+		first = false
+		switch op {
+		case goOpAdd:
+			if err := d.readFull(r, buf[:4], "truncated ADD length"); err != nil {
+				return err
+			}
+			n := uint64(binary.LittleEndian.Uint32(buf[:]))
+			if err := d.reserve(n); err != nil {
+				return err
+			}
+			d.info.instructions++
+			d.info.addBytes += n
+			if err := d.add(r, n); err != nil {
+				return err
+			}
+		case goOpCopy:
+			if err := d.readFull(r, buf[:12], "truncated COPY entry"); err != nil {
+				return err
+			}
+			offset := binary.LittleEndian.Uint64(buf[:8])
+			n := uint64(binary.LittleEndian.Uint32(buf[8:]))
+			if err := d.reserve(n); err != nil {
+				return err
+			}
+			d.info.instructions++
+			d.info.copyBytes += n
+			end := offset + n
+			if end < offset {
+				end = ^uint64(0)
+			}
+			d.info.sourceSize = max(d.info.sourceSize, end)
+			if err := d.copy(offset, n); err != nil {
+				return err
+			}
+		case goOpChecksum:
+			if err := d.readFull(r, buf[:1], "truncated checksum record"); err != nil {
+				return err
+			}
+			kind := buf[0]
+			size := 0
+			switch kind {
+			case 1:
+				size = 4
+			case 2:
+				size = 8
+			default:
+				return goError(CodeUnsupported, "unknown checksum kind %d", kind)
+			}
+			clear(buf[:8])
+			if err := d.readFull(r, buf[:size], "truncated checksum record"); err != nil {
+				return err
+			}
+			if d.info.checksum == 0 {
+				d.info.checksum = uint32(kind)
+			}
+			d.lastSum, d.sumSeen = d.produced, true
+			if err := d.checkSum(kind, binary.LittleEndian.Uint64(buf[:8])); err != nil {
+				return err
+			}
+		case goOpEnd:
+			if err := d.readFull(r, buf[:8], "truncated end record"); err != nil {
+				return err
+			}
+			if n := binary.LittleEndian.Uint64(buf[:8]); n != d.produced {
+				return goError(CodeCorruptPatch, "end record declares %d bytes of output, the records produce %d", n, d.produced)
+			}
+			ended = true
+		case goOpHeader:
+			return goError(CodeCorruptPatch, "HEADER record after the start of the patch")
+		default:
+			return goError(CodeCorruptPatch, "unknown opcode %#x", op)
+		}
+	}
+}
+
+// add 把 ADD 记录的 n 字节数据写出
+func (d *goDecoder) add(r *bufio.Reader, n uint64) error {
+	for n > 0 {
+		// 只等待缓冲区为空时的下一段补丁，推送式的解码因此能立即写出已经送入的部分
+		if r.Buffered() == 0 {
+			if _, err := r.Peek(1); err == io.EOF {
+				return d.truncate("truncated ADD data")
+			} else if err != nil {
+				return err
+			}
+		}
+		p, _ := r.Peek(int(min(n, uint64(r.Buffered()))))
+		if err := d.emit(p); err != nil {
+			return err
+		}
+		r.Discard(len(p))
+		n -= uint64(len(p))
+	}
+	return nil
+}
+
+// emit 写出一段输出并计入校验和
+func (d *goDecoder) emit(p []byte) error {
+	if d.validate {
+		return nil
+	}
+	if _, err := d.out.Write(p); err != nil {
+		return err
+	}
+	switch d.sumKind {
+	case 1:
+		d.adler = adler32Update(d.adler, p)
+	case 2:
+		d.xxh.update(p)
+	}
+	return nil
+}
+
+func (d *goDecoder) copy(offset, n uint64) error {
+	end := offset + n
+	if end < offset || (d.size >= 0 && end > uint64(d.size)) {
+		return goError(CodeSourceMismatch, "COPY out of range")
+	}
+	if d.validate {
+		return nil
+	}
+	if d.scratch == nil {
+		d.scratch = make([]byte, goCopyChunk)
+	}
+	for done := uint64(0); done < n; {
+		if err := d.cancel.check(); err != nil {
+			return err
+		}
+		p := d.scratch[:min(n-done, goCopyChunk)]
+		if err := d.readSource(p, offset+done); err != nil {
+			return err
+		}
+		if err := d.emit(p); err != nil {
+			return err
+		}
+		done += uint64(len(p))
+	}
+	return nil
+}
+
+// readSource 从旧数据读满 p；长度未知的旧数据提前结束时返回 ErrSourceMismatch
+func (d *goDecoder) readSource(p []byte, offset uint64) error {
+	if offset > 1<<63-1 {
+		return goError(CodeSourceMismatch, "COPY out of range")
+	}
+	n, err := d.src.ReadAt(p, int64(offset))
+	if n == len(p) {
+		return nil
+	}
+	if err == io.EOF || err == nil {
+		return goError(CodeSourceMismatch, "COPY out of range")
+	}
+	return err
+}
+
+// checkSum 与原生层 check_sum 相同：第一个记录必须在任何输出之前，并决定之后的种类
+func (d *goDecoder) checkSum(kind byte, sum uint64) error {
+	if d.validate {
+		return nil
+	}
+	end := d.produced
+	switch {
+	case d.sumKind == kind:
+	case d.sumKind != 0:
+		return goError(CodeCorruptPatch, "checksum kind changes within the patch")
+	case end == 0:
+		d.sumKind = kind
+		d.adler = 1
+		if kind == 2 {
+			d.xxh = newXXH3()
+		}
+	default:
+		return goError(CodeCorruptPatch, "first checksum record after the start of the output")
+	}
+	var got uint64
+	name := "adler32"
+	if kind == 1 {
+		got = uint64(d.adler)
+		d.adler = 1
+	} else {
+		got = d.xxh.digest()
+		d.xxh.reset()
+		name = "xxh3"
+	}
+	if got != sum {
+		return goError(CodeChecksumMismatch, "%s of checksum window %d (target bytes %d..%d)", name, d.sumWindow, d.sumStart, end)
+	}
+	if end > d.sumStart {
+		d.sumWindow++
+		d.sumStart = end
+	}
+	return nil
+}
+
+// adler32Update 在 adler 之后继续计算 p 的 adler32
+func adler32Update(adler uint32, p []byte) uint32 {
+	const mod = 65521
+	a, b := adler&0xffff, adler>>16
+	for len(p) > 0 {
+		// 5552 字节之内的累加不会溢出
+		n := min(len(p), 5552)
+		for _, x := range p[:n] {
+			a += uint32(x)
+			b += a
+		}
+		a %= mod
+		b %= mod
+		p = p[n:]
+	}
+	return b<<16 | a
+}
@@ -0,0 +1,441 @@
+//go:build !cgo && !xdelta_purego
+// +build !cgo,!xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// 纯 Go 解码器（见 godecoder.go）解开 DJW 和 FGK 二次压缩的补丁，与原生层 src/huffman.rs、src/djw.rs、src/fgk.rs 相同：
+// 4 字节 magic 之后是各自独立编码的块，块头为原始长度（为 0 时流结束）、编码长度（最高位表示未压缩）和原始数据的 CRC32
+
+const (
+	huffBlockMax = 1 << 20
+	huffStored   = 0x80000000
+	huffMaxLen   = 16
+
+	djwGroupLen = 32
+	fgkSymbols  = 256
+	fgkNodes    = 2*fgkSymbols - 1
+	fgkLimit    = 1 << 16
+)
+
+var (
+	djwMagic = [4]byte{0xd9, 'D', 'J', 'W'}
+	fgkMagic = [4]byte{0xdb, 'F', 'G', 'K'}
+)
+
+// huffReader 逐块解压 DJW 或 FGK 流
+type huffReader struct {
+	r       io.Reader
+	name    string
+	magic   [4]byte
+	decode  func(b *huffBits, n int, out []byte) ([]byte, error)
+	started bool
+	ended   bool
+	in      []byte
+	block   []byte
+	rest    []byte
+}
+
+func newDJWReader(r io.Reader) *huffReader {
+	return &huffReader{r: r, name: "djw", magic: djwMagic, decode: djwDecode}
+}
+
+func newFGKReader(r io.Reader) *huffReader {
+	return &huffReader{r: r, name: "fgk", magic: fgkMagic, decode: fgkDecode}
+}
+
+func (z *huffReader) corrupt(msg string) error {
+	return goError(CodeCorruptPatch, "invalid %s stream: %s", z.name, msg)
+}
+
+func (z *huffReader) Read(p []byte) (int, error) {
+	for len(z.rest) == 0 {
+		if z.ended {
+			return 0, io.EOF
+		}
+		if err := z.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.rest)
+	z.rest = z.rest[n:]
+	return n, nil
+}
+
+// next 读取 magic（第一次）和下一个块
+func (z *huffReader) next() error {
+	var h [12]byte
+	if !z.started {
+		if _, err := io.ReadFull(z.r, h[:4]); err != nil {
+			return z.truncated(err)
+		}
+		if [4]byte(h[:4]) != z.magic {
+			return z.corrupt("bad magic")
+		}
+		z.started = true
+	}
+	if _, err := io.ReadFull(z.r, h[:4]); err != nil {
+		return z.truncated(err)
+	}
+	rawLen := int(binary.LittleEndian.Uint32(h[:4]))
+	if rawLen == 0 {
+		z.ended = true
+		return nil
+	}
+	if _, err := io.ReadFull(z.r, h[4:]); err != nil {
+		return z.truncated(err)
+	}
+	coded := binary.LittleEndian.Uint32(h[4:])
+	stored := coded&huffStored != 0
+	codedLen := int(coded &^ huffStored)
+	if rawLen > huffBlockMax {
+		return z.corrupt("block size out of range")
+	}
+	if codedLen == 0 || stored && codedLen != rawLen || !stored && codedLen >= rawLen {
+		return z.corrupt("coded block size out of range")
+	}
+	if cap(z.in) < codedLen {
+		z.in = make([]byte, huffBlockMax)
+	}
+	in := z.in[:codedLen]
+	if _, err := io.ReadFull(z.r, in); err != nil {
+		return z.truncated(err)
+	}
+	raw := in
+	if !stored {
+		out, err := z.decode(&huffBits{data: in, name: z.name}, rawLen, z.block[:0])
+		if err != nil {
+			return err
+		}
+		if len(out) != rawLen {
+			return z.corrupt("block decodes to the wrong length")
+		}
+		z.block = out
+		raw = out
+	}
+	if crc32.ChecksumIEEE(raw) != binary.LittleEndian.Uint32(h[8:]) {
+		return z.corrupt("block CRC mismatch")
+	}
+	z.rest = raw
+	return nil
+}
+
+// truncated 流在结尾标记之前结束
+func (z *huffReader) truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return goError(CodeCorruptPatch, "truncated %s stream", z.name)
+	}
+	return err
+}
+
+// huffBits 高位在前的位读取，读过结尾是损坏的流
+type huffBits struct {
+	data []byte
+	pos  int
+	acc  byte
+	n    uint
+	name string
+}
+
+func (b *huffBits) bit() (int, error) {
+	if b.n == 0 {
+		if b.pos == len(b.data) {
+			return 0, goError(CodeCorruptPatch, "invalid %s stream: truncated block", b.name)
+		}
+		b.acc = b.data[b.pos]
+		b.pos++
+		b.n = 8
+	}
+	b.n--
+	return int(b.acc>>b.n) & 1, nil
+}
+
+func (b *huffBits) bits(n int) (int, error) {
+	v := 0
+	for range n {
+		bit, err := b.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+	return v, nil
+}
+
+// huffCanonical 规范 Huffman 码的解码表：每个长度的码数和按码排列的符号
+type huffCanonical struct {
+	count   [huffMaxLen + 1]int
+	symbols []byte
+}
+
+// newHuffCanonical 超额分配的码长是损坏的流，不完整的码可以接受，没有用到的码解码时出错
+func newHuffCanonical(lens []int, name string) (*huffCanonical, error) {
+	h := &huffCanonical{}
+	for _, l := range lens {
+		h.count[l]++
+	}
+	h.count[0] = 0
+	left := 1
+	for _, c := range h.count[1:] {
+		left = left<<1 - c
+		if left < 0 {
+			return nil, goError(CodeCorruptPatch, "invalid %s stream: over-subscribed code", name)
+		}
+	}
+	for l := 1; l <= huffMaxLen; l++ {
+		for s, sl := range lens {
+			if sl == l {
+				h.symbols = append(h.symbols, byte(s))
+			}
+		}
+	}
+	return h, nil
+}
+
+func (h *huffCanonical) decode(b *huffBits) (byte, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= huffMaxLen; l++ {
+		bit, err := b.bit()
+		if err != nil {
+			return 0, err
+		}
+		code |= bit
+		if code-first < h.count[l] {
+			return h.symbols[index+code-first], nil
+		}
+		index += h.count[l]
+		first = (first + h.count[l]) << 1
+		code <<= 1
+	}
+	return 0, goError(CodeCorruptPatch, "invalid %s stream: unused code", b.name)
+}
+
+// djwDecode 解码一个 DJW 块：用到的符号、表的个数、每个表的码长、每组的选择子和符号，格式见 src/djw.rs
+func djwDecode(b *huffBits, n int, out []byte) ([]byte, error) {
+	corrupt := func(msg string) error { return goError(CodeCorruptPatch, "invalid djw stream: %s", msg) }
+	ranges, err := b.bits(16)
+	if err != nil {
+		return nil, err
+	}
+	var used []int
+	for r := range 16 {
+		if ranges&(0x8000>>r) == 0 {
+			continue
+		}
+		bits, err := b.bits(16)
+		if err != nil {
+			return nil, err
+		}
+		for i := range 16 {
+			if bits&(0x8000>>i) != 0 {
+				used = append(used, r*16+i)
+			}
+		}
+	}
+	if len(used) == 0 {
+		return nil, corrupt("no symbols in use")
+	}
+	t, err := b.bits(3)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]*huffCanonical, t+1)
+	for i := range tables {
+		lens := make([]int, 256)
+		cur, err := b.bits(5)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range used {
+			for {
+				// 用到的符号都有码
+				if cur == 0 || cur > huffMaxLen {
+					return nil, corrupt("code length out of range")
+				}
+				more, err := b.bit()
+				if err != nil {
+					return nil, err
+				}
+				if more == 0 {
+					break
+				}
+				down, err := b.bit()
+				if err != nil {
+					return nil, err
+				}
+				cur += 1 - 2*down
+			}
+			lens[s] = cur
+		}
+		if tables[i], err = newHuffCanonical(lens, "djw"); err != nil {
+			return nil, err
+		}
+	}
+	groups := (n + djwGroupLen - 1) / djwGroupLen
+	selectors := make([]int, groups)
+	mtf := make([]int, len(tables))
+	for i := range mtf {
+		mtf[i] = i
+	}
+	for g := range selectors {
+		pos := 0
+		for pos+1 < len(tables) {
+			bit, err := b.bit()
+			if err != nil {
+				return nil, err
+			}
+			if bit == 0 {
+				break
+			}
+			pos++
+		}
+		sel := mtf[pos]
+		copy(mtf[1:pos+1], mtf[:pos])
+		mtf[0] = sel
+		selectors[g] = sel
+	}
+	for g, sel := range selectors {
+		for range min(djwGroupLen, n-g*djwGroupLen) {
+			c, err := tables[sel].decode(b)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// fgkNode 自适应 Huffman 树的节点：内部节点的两个子节点是 child 和 child+1，叶子的 child 是符号
+type fgkNode struct {
+	weight uint32
+	parent int
+	child  int
+	leaf   bool
+}
+
+// fgkTree 与 src/fgk.rs 相同的 FGK 树：节点按权重不增排列，根为 0 号节点
+type fgkTree struct {
+	nodes  [fgkNodes]fgkNode
+	leaves [fgkSymbols]int
+}
+
+func newFGKTree() *fgkTree {
+	t := &fgkTree{}
+	for s := range fgkSymbols {
+		t.leaves[s] = s
+		t.nodes[s] = fgkNode{weight: 1, child: s, leaf: true}
+	}
+	t.rebuild()
+	return t
+}
+
+// rebuild 按叶子的权重重建树：两个队列的 Huffman 算法按权重顺序合并节点，从数组末尾起依次编号
+func (t *fgkTree) rebuild() {
+	type item struct {
+		weight uint32
+		at     int // 叶子的符号，或合并节点的第一个子节点
+	}
+	leaves := make([]item, fgkSymbols)
+	for s := range fgkSymbols {
+		leaves[s] = item{t.nodes[t.leaves[s]].weight, s}
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		if leaves[i].weight != leaves[j].weight {
+			return leaves[i].weight < leaves[j].weight
+		}
+		return leaves[i].at < leaves[j].at
+	})
+	var merged []item
+	next := fgkNodes
+	take := func() (int, uint32) {
+		next--
+		if len(leaves) > 0 && (len(merged) == 0 || leaves[0].weight <= merged[0].weight) {
+			l := leaves[0]
+			leaves = leaves[1:]
+			t.nodes[next] = fgkNode{weight: l.weight, child: l.at, leaf: true}
+			t.leaves[l.at] = next
+		} else {
+			m := merged[0]
+			merged = merged[1:]
+			t.nodes[next] = fgkNode{weight: m.weight, child: m.at}
+			t.nodes[m.at].parent = next
+			t.nodes[m.at+1].parent = next
+		}
+		return next, t.nodes[next].weight
+	}
+	for {
+		a, wa := take()
+		if a == 0 {
+			return
+		}
+		b, wb := take()
+		merged = append(merged, item{wa + wb, b})
+	}
+}
+
+// update 符号 sym 的计数加一，保持兄弟性质
+func (t *fgkTree) update(sym byte) {
+	cur := t.leaves[sym]
+	for {
+		w := t.nodes[cur].weight
+		leader := sort.Search(cur, func(i int) bool { return t.nodes[i].weight <= w })
+		if leader != cur {
+			t.swap(leader, cur)
+			cur = leader
+		}
+		t.nodes[cur].weight++
+		if cur == 0 {
+			break
+		}
+		cur = t.nodes[cur].parent
+	}
+	if t.nodes[0].weight >= fgkLimit {
+		for s := range fgkSymbols {
+			n := &t.nodes[t.leaves[s]]
+			n.weight = (n.weight + 1) / 2
+		}
+		t.rebuild()
+	}
+}
+
+// swap 交换 a、b 两个位置上权重相同的子树
+func (t *fgkTree) swap(a, b int) {
+	pa, pb := t.nodes[a].parent, t.nodes[b].parent
+	t.nodes[a], t.nodes[b] = t.nodes[b], t.nodes[a]
+	t.nodes[a].parent, t.nodes[b].parent = pa, pb
+	for _, i := range []int{a, b} {
+		n := t.nodes[i]
+		if n.leaf {
+			t.leaves[n.child] = i
+		} else {
+			t.nodes[n.child].parent = i
+			t.nodes[n.child+1].parent = i
+		}
+	}
+}
+
+// fgkDecode 解码一个 FGK 块，每个块从同样的初始树开始
+func fgkDecode(b *huffBits, n int, out []byte) ([]byte, error) {
+	t := newFGKTree()
+	for range n {
+		i := 0
+		for !t.nodes[i].leaf {
+			bit, err := b.bit()
+			if err != nil {
+				return nil, err
+			}
+			i = t.nodes[i].child + bit
+		}
+		c := byte(t.nodes[i].child)
+		out = append(out, c)
+		t.update(c)
+	}
+	return out, nil
+}
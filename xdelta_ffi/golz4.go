@@ -0,0 +1,191 @@
+//go:build !cgo && !xdelta_purego
+// +build !cgo,!xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// 纯 Go 解码器（见 godecoder.go）解开 lz4 二次压缩的补丁，与原生层 src/lz4.rs 一样只接受本库写出的子集：
+// 独立的、最多 64 KiB 的块，没有校验和与内容长度
+
+// lz4FrameHeader 本库写出的帧头：magic、FLG（版本 01，块独立）、BD（64 KiB 的块）和帧头校验字节
+var lz4FrameHeader = []byte{0x04, 0x22, 0x4d, 0x18, 0x60, 0x40, 0x82}
+
+const (
+	lz4BlockMax = 64 << 10
+	// lz4Stored 块长度的最高位：块没有压缩
+	lz4Stored   = 0x80000000
+	lz4MinMatch = 4
+)
+
+func lz4Corrupt(msg string) error {
+	return goError(CodeCorruptPatch, "invalid lz4 stream: %s", msg)
+}
+
+// lz4Reader 逐块解压 lz4 帧
+type lz4Reader struct {
+	r       io.Reader
+	started bool
+	ended   bool
+	in      []byte
+	block   []byte
+	rest    []byte
+}
+
+func newLZ4Reader(r io.Reader) *lz4Reader {
+	return &lz4Reader{r: r}
+}
+
+func (z *lz4Reader) Read(p []byte) (int, error) {
+	for len(z.rest) == 0 {
+		if z.ended {
+			return 0, io.EOF
+		}
+		if err := z.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.rest)
+	z.rest = z.rest[n:]
+	return n, nil
+}
+
+// next 读取帧头（第一次）和下一个块
+func (z *lz4Reader) next() error {
+	if !z.started {
+		var head [7]byte
+		if _, err := io.ReadFull(z.r, head[:]); err != nil {
+			return z.truncated(err)
+		}
+		switch {
+		case !bytes.Equal(head[:4], lz4FrameHeader[:4]):
+			return lz4Corrupt("bad magic")
+		case head[4]>>6 != 1 || head[4]&0x02 != 0 || head[5]&0x8f != 0 || head[5]>>4 < 4:
+			// 版本不是 01 或保留位不为 0，不是合法的 LZ4 帧
+			return lz4Corrupt("invalid frame descriptor")
+		case head[4] != lz4FrameHeader[4] || head[5] != lz4FrameHeader[5]:
+			return goError(CodeUnsupported, "lz4 frame descriptor %#02x %#02x is not supported", head[4], head[5])
+		case head[6] != lz4FrameHeader[6]:
+			return lz4Corrupt("header checksum mismatch")
+		}
+		z.started = true
+	}
+	var b [4]byte
+	if _, err := io.ReadFull(z.r, b[:]); err != nil {
+		return z.truncated(err)
+	}
+	size := binary.LittleEndian.Uint32(b[:])
+	if size == 0 {
+		z.ended = true
+		return nil
+	}
+	n := int(size &^ lz4Stored)
+	if n == 0 || n > lz4BlockMax {
+		return lz4Corrupt("block size out of range")
+	}
+	if cap(z.in) < n {
+		z.in = make([]byte, lz4BlockMax)
+	}
+	in := z.in[:n]
+	if _, err := io.ReadFull(z.r, in); err != nil {
+		return z.truncated(err)
+	}
+	if size&lz4Stored != 0 {
+		z.rest = in
+		return nil
+	}
+	out, err := lz4DecodeBlock(in, z.block[:0])
+	if err != nil {
+		return err
+	}
+	z.block = out
+	z.rest = out
+	return nil
+}
+
+// truncated 帧在结尾标记之前结束
+func (z *lz4Reader) truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return goError(CodeCorruptPatch, "truncated lz4 stream")
+	}
+	return err
+}
+
+func lz4ReadLen(src []byte, at *int) (int, error) {
+	n := 0
+	for {
+		if *at >= len(src) {
+			return 0, lz4Corrupt("truncated length")
+		}
+		b := src[*at]
+		*at++
+		n += int(b)
+		if n > lz4BlockMax {
+			return 0, lz4Corrupt("length beyond the block")
+		}
+		if b != 255 {
+			return n, nil
+		}
+	}
+}
+
+// lz4DecodeBlock 解码一个压缩的块，追加到 out 之后
+func lz4DecodeBlock(src, out []byte) ([]byte, error) {
+	at := 0
+	for {
+		if at >= len(src) {
+			return nil, lz4Corrupt("truncated sequence")
+		}
+		token := src[at]
+		at++
+		ll := int(token >> 4)
+		if ll == 15 {
+			n, err := lz4ReadLen(src, &at)
+			if err != nil {
+				return nil, err
+			}
+			ll += n
+		}
+		if at+ll > len(src) {
+			return nil, lz4Corrupt("truncated literals")
+		}
+		if len(out)+ll > lz4BlockMax {
+			return nil, lz4Corrupt("block output too large")
+		}
+		out = append(out, src[at:at+ll]...)
+		at += ll
+		if at == len(src) {
+			return out, nil
+		}
+		if at+2 > len(src) {
+			return nil, lz4Corrupt("truncated offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[at:]))
+		at += 2
+		if offset == 0 || offset > len(out) {
+			return nil, lz4Corrupt("match offset out of range")
+		}
+		ml := int(token&15) + lz4MinMatch
+		if token&15 == 15 {
+			n, err := lz4ReadLen(src, &at)
+			if err != nil {
+				return nil, err
+			}
+			ml += n
+		}
+		if len(out)+ml > lz4BlockMax {
+			return nil, lz4Corrupt("block output too large")
+		}
+		// 重叠的匹配重复最后 offset 个字节，逐段复制，每段随重复的部分加倍
+		from := len(out) - offset
+		for ml > 0 {
+			n := min(ml, len(out)-from)
+			out = append(out, out[from:from+n]...)
+			ml -= n
+		}
+	}
+}
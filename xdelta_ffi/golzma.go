@@ -0,0 +1,724 @@
+//go:build !cgo && !xdelta_purego
+// +build !cgo,!xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"math"
+)
+
+// 纯 Go 解码器（见 godecoder.go）解开 lzma 二次压缩的补丁，与原生层 src/lzma.rs 一样接受 xz 和 liblzma 写出的
+// 由 LZMA2 块组成的 xz 流和其中任何一种标准校验，不接受其他过滤器、连接的多个流和流后的填充
+
+var (
+	xzMagic       = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+	xzCRC64Table  = crc64.MakeTable(crc64.ECMA)
+)
+
+const (
+	xzStreamHeaderLen = 12
+	xzFilterLZMA2     = 0x21
+	// xzChunkMax LZMA2 数据块压缩后的最大长度
+	xzChunkMax = 64 << 10
+
+	lzmaStates       = 12
+	lzmaLitStates    = 7
+	lzmaPosStatesMax = 1 << 4
+	lzmaDistStates   = 4
+	lzmaDistSlotBits = 6
+	lzmaDistModelEnd = 14
+	lzmaFullDist     = 1 << (lzmaDistModelEnd / 2)
+	lzmaAlignBits    = 4
+	lzmaMatchLenMin  = 2
+	lzmaProbBits     = 11
+	lzmaProbInit     = 1 << (lzmaProbBits - 1)
+	lzmaMoveBits     = 5
+	lzmaTop          = 1 << 24
+)
+
+func xzCorrupt(msg string) error {
+	return goError(CodeCorruptPatch, "invalid xz stream: %s", msg)
+}
+
+func xzVarint(buf []byte, at *int) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if *at >= len(buf) {
+			return 0, xzCorrupt("truncated integer")
+		}
+		b := buf[*at]
+		*at++
+		if i > 0 && b == 0 {
+			return 0, xzCorrupt("integer with a trailing zero byte")
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, xzCorrupt("integer longer than 9 bytes")
+}
+
+// xzIndex 各块为（未填充的长度，解压后的长度）的流的索引，含填充和 CRC32
+func xzIndex(blocks [][2]uint64) []byte {
+	idx := binary.AppendUvarint([]byte{0}, uint64(len(blocks)))
+	for _, b := range blocks {
+		idx = binary.AppendUvarint(idx, b[0])
+		idx = binary.AppendUvarint(idx, b[1])
+	}
+	for len(idx)%4 != 0 {
+		idx = append(idx, 0)
+	}
+	return binary.LittleEndian.AppendUint32(idx, crc32.ChecksumIEEE(idx))
+}
+
+func lzmaLiteralNext(s int) int {
+	switch {
+	case s < 4:
+		return 0
+	case s < 10:
+		return s - 3
+	}
+	return s - 6
+}
+
+func lzmaMatchNext(s int) int {
+	if s < lzmaLitStates {
+		return 7
+	}
+	return 10
+}
+
+func lzmaLongRepNext(s int) int {
+	if s < lzmaLitStates {
+		return 8
+	}
+	return 11
+}
+
+func lzmaShortRepNext(s int) int {
+	if s < lzmaLitStates {
+		return 9
+	}
+	return 11
+}
+
+type lzmaLenModel struct {
+	choice, choice2 uint16
+	low             [lzmaPosStatesMax][8]uint16
+	mid             [lzmaPosStatesMax][8]uint16
+	high            [256]uint16
+}
+
+// lzmaModel LZMA 解码器的概率和状态，reps 为最近四个匹配距离减一
+type lzmaModel struct {
+	lc, lp, pb uint
+	literal    []uint16
+	isMatch    [lzmaStates][lzmaPosStatesMax]uint16
+	isRep      [lzmaStates]uint16
+	isRep0     [lzmaStates]uint16
+	isRep1     [lzmaStates]uint16
+	isRep2     [lzmaStates]uint16
+	isRep0Long [lzmaStates][lzmaPosStatesMax]uint16
+	distSlot   [lzmaDistStates][1 << lzmaDistSlotBits]uint16
+	// 按 1 起始编号的反向位树，slot 的树从 (slot 的基数) - slot 开始
+	distSpecial [lzmaFullDist - lzmaDistModelEnd + 1]uint16
+	distAlign   [1 << lzmaAlignBits]uint16
+	matchLen    lzmaLenModel
+	repLen      lzmaLenModel
+	state       int
+	reps        [4]uint32
+}
+
+func lzmaInitProbs(p []uint16) {
+	for i := range p {
+		p[i] = lzmaProbInit
+	}
+}
+
+func (l *lzmaLenModel) init() {
+	l.choice, l.choice2 = lzmaProbInit, lzmaProbInit
+	for i := range l.low {
+		lzmaInitProbs(l.low[i][:])
+		lzmaInitProbs(l.mid[i][:])
+	}
+	lzmaInitProbs(l.high[:])
+}
+
+func newLZMAModel(lc, lp, pb uint) *lzmaModel {
+	m := &lzmaModel{lc: lc, lp: lp, pb: pb, literal: make([]uint16, 0x300<<(lc+lp))}
+	lzmaInitProbs(m.literal)
+	for s := 0; s < lzmaStates; s++ {
+		lzmaInitProbs(m.isMatch[s][:])
+		lzmaInitProbs(m.isRep0Long[s][:])
+	}
+	for _, p := range [][]uint16{m.isRep[:], m.isRep0[:], m.isRep1[:], m.isRep2[:], m.distSpecial[:], m.distAlign[:]} {
+		lzmaInitProbs(p)
+	}
+	for i := range m.distSlot {
+		lzmaInitProbs(m.distSlot[i][:])
+	}
+	m.matchLen.init()
+	m.repLen.init()
+	return m
+}
+
+// lzmaRangeDecoder 整个 LZMA2 数据块上的区间解码器，读过数据块的末尾得到 0，由 finished 报告
+type lzmaRangeDecoder struct {
+	buf     []byte
+	pos     int
+	rng     uint32
+	code    uint32
+	overrun bool
+}
+
+func newLZMARangeDecoder(buf []byte) (*lzmaRangeDecoder, error) {
+	if len(buf) < 5 || buf[0] != 0 {
+		return nil, xzCorrupt("bad range coder start")
+	}
+	return &lzmaRangeDecoder{buf: buf, pos: 5, rng: math.MaxUint32, code: binary.BigEndian.Uint32(buf[1:5])}, nil
+}
+
+func (rc *lzmaRangeDecoder) normalize() {
+	if rc.rng < lzmaTop {
+		rc.rng <<= 8
+		var b byte
+		if rc.pos < len(rc.buf) {
+			b = rc.buf[rc.pos]
+		} else {
+			rc.overrun = true
+		}
+		rc.pos++
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+func (rc *lzmaRangeDecoder) bit(prob *uint16) uint32 {
+	bound := (rc.rng >> lzmaProbBits) * uint32(*prob)
+	var bit uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*prob += ((1 << lzmaProbBits) - *prob) >> lzmaMoveBits
+	} else {
+		rc.code -= bound
+		rc.rng -= bound
+		*prob -= *prob >> lzmaMoveBits
+		bit = 1
+	}
+	rc.normalize()
+	return bit
+}
+
+func (rc *lzmaRangeDecoder) direct(bits uint32) uint32 {
+	var v uint32
+	for ; bits > 0; bits-- {
+		rc.rng >>= 1
+		var b uint32
+		if rc.code >= rc.rng {
+			rc.code -= rc.rng
+			b = 1
+		}
+		v = v<<1 | b
+		rc.normalize()
+	}
+	return v
+}
+
+func (rc *lzmaRangeDecoder) tree(probs []uint16, bits uint32) uint32 {
+	m := uint32(1)
+	for i := uint32(0); i < bits; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<bits
+}
+
+func (rc *lzmaRangeDecoder) reverse(probs []uint16, bits uint32) uint32 {
+	m, v := uint32(1), uint32(0)
+	for i := uint32(0); i < bits; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		v |= b << i
+	}
+	return v
+}
+
+// finished 数据块恰好用完，区间编码正常结束
+func (rc *lzmaRangeDecoder) finished() bool {
+	return !rc.overrun && rc.pos == len(rc.buf) && rc.code == 0
+}
+
+func (rc *lzmaRangeDecoder) length(m *lzmaLenModel, posState int) int {
+	switch {
+	case rc.bit(&m.choice) == 0:
+		return lzmaMatchLenMin + int(rc.tree(m.low[posState][:], 3))
+	case rc.bit(&m.choice2) == 0:
+		return lzmaMatchLenMin + 8 + int(rc.tree(m.mid[posState][:], 3))
+	}
+	return lzmaMatchLenMin + 16 + int(rc.tree(m.high[:], 8))
+}
+
+// lzmaHistory 解压出的数据，匹配可以引用字典范围内自字典重置以来的数据
+type lzmaHistory struct {
+	buf      []byte
+	dictSize uint64
+	// pos 自字典重置以来解压出的字节数
+	pos uint64
+}
+
+func (h *lzmaHistory) check(dist uint64) error {
+	if dist > h.pos || dist > h.dictSize {
+		return xzCorrupt("match distance beyond the dictionary")
+	}
+	return nil
+}
+
+func (h *lzmaHistory) copy(dist, n int) {
+	from := len(h.buf) - dist
+	for n > 0 {
+		k := min(n, len(h.buf)-from)
+		h.buf = append(h.buf, h.buf[from:from+k]...)
+		from += k
+		n -= k
+	}
+}
+
+// trim 丢弃匹配已经无法引用的数据，在占用两个字典（至少两个数据块）之后
+func (h *lzmaHistory) trim() {
+	keep := int(min(h.dictSize, uint64(math.MaxInt32)))
+	if len(h.buf) > 2*max(keep, 2<<20) {
+		n := copy(h.buf, h.buf[len(h.buf)-keep:])
+		h.buf = h.buf[:n]
+	}
+}
+
+// decodeChunk 把 body 中一个解压后 u 字节的 LZMA 数据块解码到历史之后
+func (h *lzmaHistory) decodeChunk(m *lzmaModel, body []byte, u int) error {
+	rc, err := newLZMARangeDecoder(body)
+	if err != nil {
+		return err
+	}
+	end := len(h.buf) + u
+	pbMask := uint64(1)<<m.pb - 1
+	lpMask := uint64(1)<<m.lp - 1
+	for len(h.buf) < end {
+		posState := int(h.pos & pbMask)
+		if rc.bit(&m.isMatch[m.state][posState]) == 0 {
+			var prev byte
+			if h.pos > 0 {
+				prev = h.buf[len(h.buf)-1]
+			}
+			off := 0x300 * (int(h.pos&lpMask)<<m.lc + int(prev)>>(8-m.lc))
+			probs := m.literal[off : off+0x300]
+			symbol := uint32(1)
+			if m.state < lzmaLitStates {
+				for symbol < 0x100 {
+					symbol = symbol<<1 | rc.bit(&probs[symbol])
+				}
+			} else {
+				dist := uint64(m.reps[0]) + 1
+				if err := h.check(dist); err != nil {
+					return err
+				}
+				matchByte := uint32(h.buf[len(h.buf)-int(dist)]) << 1
+				offset := uint32(0x100)
+				for symbol < 0x100 {
+					matchBit := matchByte & offset
+					matchByte <<= 1
+					bit := rc.bit(&probs[offset+matchBit+symbol])
+					symbol = symbol<<1 | bit
+					if bit != 0 {
+						offset = matchBit
+					} else {
+						offset ^= matchBit
+					}
+				}
+			}
+			h.buf = append(h.buf, byte(symbol))
+			h.pos++
+			m.state = lzmaLiteralNext(m.state)
+			continue
+		}
+		var n int
+		if rc.bit(&m.isRep[m.state]) == 0 {
+			n = rc.length(&m.matchLen, posState)
+			slot := rc.tree(m.distSlot[min(n-lzmaMatchLenMin, lzmaDistStates-1)][:], lzmaDistSlotBits)
+			dist := slot
+			if slot >= 4 {
+				footer := slot>>1 - 1
+				base := (2 | slot&1) << footer
+				if slot < lzmaDistModelEnd {
+					dist = base + rc.reverse(m.distSpecial[base-slot:], footer)
+				} else {
+					high := rc.direct(footer-lzmaAlignBits) << lzmaAlignBits
+					dist = base + high + rc.reverse(m.distAlign[:], lzmaAlignBits)
+				}
+			}
+			if dist == math.MaxUint32 {
+				return xzCorrupt("end marker in an LZMA2 chunk")
+			}
+			m.reps = [4]uint32{dist, m.reps[0], m.reps[1], m.reps[2]}
+			m.state = lzmaMatchNext(m.state)
+		} else {
+			if rc.bit(&m.isRep0[m.state]) == 0 {
+				if rc.bit(&m.isRep0Long[m.state][posState]) == 0 {
+					dist := uint64(m.reps[0]) + 1
+					if err := h.check(dist); err != nil {
+						return err
+					}
+					h.copy(int(dist), 1)
+					h.pos++
+					m.state = lzmaShortRepNext(m.state)
+					continue
+				}
+			} else {
+				index := 1
+				if rc.bit(&m.isRep1[m.state]) != 0 {
+					index = 2 + int(rc.bit(&m.isRep2[m.state]))
+				}
+				d := m.reps[index]
+				copy(m.reps[1:index+1], m.reps[:index])
+				m.reps[0] = d
+			}
+			m.state = lzmaLongRepNext(m.state)
+			n = rc.length(&m.repLen, posState)
+		}
+		dist := uint64(m.reps[0]) + 1
+		if err := h.check(dist); err != nil {
+			return err
+		}
+		if n > end-len(h.buf) {
+			return xzCorrupt("match past the end of the chunk")
+		}
+		h.copy(int(dist), n)
+		h.pos += uint64(n)
+		if rc.overrun {
+			break
+		}
+	}
+	if !rc.finished() {
+		return xzCorrupt("chunk size does not match its data")
+	}
+	return nil
+}
+
+// lzmaReader 逐个数据块解压 xz 流
+type lzmaReader struct {
+	r         io.Reader
+	started   bool
+	ended     bool
+	inBlock   bool
+	checkKind byte
+	// check 当前块的校验，CHECK_NONE 时为 nil
+	check         hash.Hash
+	model         *lzmaModel
+	hist          lzmaHistory
+	needDictReset bool
+	needProps     bool
+	// declared 块头声明的压缩后和解压后的长度，-1 表示没有声明
+	declared [2]int64
+	// headerLen、blockLen、blockOut 当前块的块头长度、LZMA2 数据长度和解压出的长度
+	headerLen, blockLen, blockOut uint64
+	// blocks 已经结束的块的（未填充的长度，解压后的长度）
+	blocks [][2]uint64
+	in     []byte
+	rest   []byte
+}
+
+func newLZMAReader(r io.Reader) *lzmaReader {
+	return &lzmaReader{r: r}
+}
+
+func (z *lzmaReader) Read(p []byte) (int, error) {
+	for len(z.rest) == 0 {
+		if z.ended {
+			return 0, io.EOF
+		}
+		if err := z.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.rest)
+	z.rest = z.rest[n:]
+	return n, nil
+}
+
+// read 读取流中接下来的 n 字节
+func (z *lzmaReader) read(n int) ([]byte, error) {
+	if cap(z.in) < n {
+		z.in = make([]byte, max(n, xzChunkMax))
+	}
+	b := z.in[:n]
+	if _, err := io.ReadFull(z.r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, goError(CodeCorruptPatch, "truncated xz stream")
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// next 读取流头（第一次）和下一个块头、数据块或块的结尾，直到索引和流尾
+func (z *lzmaReader) next() error {
+	if !z.started {
+		h, err := z.read(xzStreamHeaderLen)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !bytes.Equal(h[:6], xzMagic):
+			return xzCorrupt("bad magic")
+		case crc32.ChecksumIEEE(h[6:8]) != binary.LittleEndian.Uint32(h[8:12]):
+			return xzCorrupt("stream header checksum mismatch")
+		case h[6] != 0 || h[7]&0xf0 != 0:
+			return goError(CodeUnsupported, "xz stream flags are not supported")
+		}
+		z.checkKind = h[7]
+		switch z.checkKind {
+		case 0x00:
+		case 0x01:
+			z.check = crc32.NewIEEE()
+		case 0x04:
+			z.check = crc64.New(xzCRC64Table)
+		case 0x0a:
+			z.check = sha256.New()
+		default:
+			return goError(CodeUnsupported, "xz check type %#x is not supported", z.checkKind)
+		}
+		z.started = true
+	}
+	b, err := z.read(1)
+	if err != nil {
+		return err
+	}
+	if !z.inBlock {
+		if b[0] == 0 {
+			return z.index()
+		}
+		return z.blockHeader(b[0])
+	}
+	control := b[0]
+	z.blockLen++
+	switch {
+	case control == 0x00:
+		return z.endBlock()
+	case control == 0x01 || control == 0x02 || control >= 0x80:
+	default:
+		return xzCorrupt("bad chunk control byte")
+	}
+	if control == 0x01 || control >= 0xe0 {
+		z.hist.buf = z.hist.buf[:0]
+		z.hist.pos = 0
+		z.needDictReset = false
+		if control == 0x01 {
+			z.needProps = true
+		}
+	} else if z.needDictReset {
+		return xzCorrupt("first chunk does not reset the dictionary")
+	}
+	if control >= 0x80 && control < 0xc0 && z.needProps {
+		return xzCorrupt("chunk without the properties it needs")
+	}
+	z.hist.trim()
+	start := len(z.hist.buf)
+	if control < 0x80 {
+		h, err := z.read(2)
+		if err != nil {
+			return err
+		}
+		data, err := z.read(int(binary.BigEndian.Uint16(h)) + 1)
+		if err != nil {
+			return err
+		}
+		z.blockLen += 2 + uint64(len(data))
+		z.hist.buf = append(z.hist.buf, data...)
+		z.hist.pos += uint64(len(data))
+		return z.decoded(start)
+	}
+	hlen := 4
+	if control >= 0xc0 {
+		hlen = 5
+	}
+	h, err := z.read(hlen)
+	if err != nil {
+		return err
+	}
+	u := (int(control&0x1f)<<16 | int(binary.BigEndian.Uint16(h))) + 1
+	c := int(binary.BigEndian.Uint16(h[2:])) + 1
+	if control >= 0xc0 {
+		props := h[4]
+		if props >= 9*5*5 {
+			return xzCorrupt("bad LZMA properties")
+		}
+		lc, lp, pb := uint(props%9), uint(props/9%5), uint(props/45)
+		if lc+lp > 4 {
+			return xzCorrupt("bad LZMA properties")
+		}
+		z.model = newLZMAModel(lc, lp, pb)
+		z.needProps = false
+	} else if control >= 0xa0 {
+		z.model = newLZMAModel(z.model.lc, z.model.lp, z.model.pb)
+	}
+	body, err := z.read(c)
+	if err != nil {
+		return err
+	}
+	z.blockLen += uint64(hlen + c)
+	if err := z.hist.decodeChunk(z.model, body, u); err != nil {
+		return err
+	}
+	return z.decoded(start)
+}
+
+// decoded 历史中从 start 起新解压出的数据交给 Read，并计入校验
+func (z *lzmaReader) decoded(start int) error {
+	out := z.hist.buf[start:]
+	z.blockOut += uint64(len(out))
+	if z.declared[1] >= 0 && z.blockOut > uint64(z.declared[1]) {
+		return xzCorrupt("block larger than its header says")
+	}
+	if z.check != nil {
+		z.check.Write(out)
+	}
+	z.rest = out
+	return nil
+}
+
+// blockHeader 解析长度字节为 first 的块头
+func (z *lzmaReader) blockHeader(first byte) error {
+	rest, err := z.read(int(first)*4 + 3)
+	if err != nil {
+		return err
+	}
+	h := append([]byte{first}, rest...)
+	body := len(h) - 4
+	if crc32.ChecksumIEEE(h[:body]) != binary.LittleEndian.Uint32(h[body:]) {
+		return xzCorrupt("block header checksum mismatch")
+	}
+	flags := h[1]
+	if flags&0x3c != 0 {
+		return goError(CodeUnsupported, "xz block flags are not supported")
+	}
+	h = h[:body]
+	at := 2
+	declared := [2]int64{-1, -1}
+	for i, bit := range []byte{0x40, 0x80} {
+		if flags&bit != 0 {
+			v, err := xzVarint(h, &at)
+			if err != nil {
+				return err
+			}
+			declared[i] = int64(min(v, math.MaxInt64))
+		}
+	}
+	if declared[0] == 0 {
+		return xzCorrupt("block with an empty compressed size")
+	}
+	id, err := xzVarint(h, &at)
+	if err != nil {
+		return err
+	}
+	propsLen, err := xzVarint(h, &at)
+	if err != nil {
+		return err
+	}
+	if flags&3 != 0 || id != xzFilterLZMA2 {
+		return goError(CodeUnsupported, "xz filters other than a single LZMA2 are not supported")
+	}
+	if propsLen != 1 || at >= len(h) {
+		return xzCorrupt("bad LZMA2 filter properties")
+	}
+	d := h[at]
+	switch {
+	case d == 40:
+		z.hist.dictSize = math.MaxUint32
+	case d < 40:
+		z.hist.dictSize = uint64(2|d&1) << (d/2 + 11)
+	default:
+		return xzCorrupt("bad LZMA2 dictionary size")
+	}
+	for _, b := range h[at+1:] {
+		if b != 0 {
+			return xzCorrupt("nonzero block header padding")
+		}
+	}
+	z.hist.buf = z.hist.buf[:0]
+	z.hist.pos = 0
+	z.model = nil
+	z.needDictReset, z.needProps = true, true
+	z.declared = declared
+	z.headerLen = uint64(len(h)) + 4
+	z.blockLen, z.blockOut = 0, 0
+	z.inBlock = true
+	return nil
+}
+
+// endBlock 读取块的填充和校验
+func (z *lzmaReader) endBlock() error {
+	if z.declared[0] >= 0 && uint64(z.declared[0]) != z.blockLen || z.declared[1] >= 0 && uint64(z.declared[1]) != z.blockOut {
+		return xzCorrupt("block size does not match its header")
+	}
+	pad, err := z.read(int((4 - (z.headerLen+z.blockLen)%4) % 4))
+	if err != nil {
+		return err
+	}
+	for _, b := range pad {
+		if b != 0 {
+			return xzCorrupt("nonzero block padding")
+		}
+	}
+	var want []byte
+	switch c := z.check.(type) {
+	case nil:
+	case hash.Hash32:
+		want = binary.LittleEndian.AppendUint32(nil, c.Sum32())
+	case hash.Hash64:
+		want = binary.LittleEndian.AppendUint64(nil, c.Sum64())
+	default:
+		want = c.Sum(nil)
+	}
+	got, err := z.read(len(want))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return xzCorrupt("check mismatch")
+	}
+	if z.check != nil {
+		z.check.Reset()
+	}
+	z.blocks = append(z.blocks, [2]uint64{z.headerLen + z.blockLen + uint64(len(want)), z.blockOut})
+	z.inBlock = false
+	return nil
+}
+
+// index 读取并核对索引（其第一个字节已经读过）和流尾
+func (z *lzmaReader) index() error {
+	want := xzIndex(z.blocks)
+	got, err := z.read(len(want) - 1)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want[1:]) {
+		return xzCorrupt("index does not match the blocks")
+	}
+	f, err := z.read(xzStreamHeaderLen)
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(f[4:10]) != binary.LittleEndian.Uint32(f[:4]) {
+		return xzCorrupt("stream footer checksum mismatch")
+	}
+	if binary.LittleEndian.Uint32(f[4:8]) != uint32(len(want)/4-1) || f[8] != 0 || f[9] != z.checkKind || !bytes.Equal(f[10:], xzFooterMagic) {
+		return xzCorrupt("stream footer does not match the stream")
+	}
+	z.ended = true
+	return nil
+}
@@ -0,0 +1,547 @@
+//go:build !cgo && !xdelta_purego
+// +build !cgo,!xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/adler32"
+	"io"
+)
+
+// 纯 Go 解码器（见 godecoder.go）解码 VCDIFF（RFC 3284）补丁，与原生层 src/vcdiff.rs 的 VcdiffReader 相同：
+// 只支持默认代码表，不支持二次压缩和 VCD_TARGET 窗口；每个目标窗口在内存中重建后写出
+
+const (
+	vcdDecompress = 0x01
+	vcdCodeTable  = 0x02
+	vcdAppHeader  = 0x04
+
+	vcdSource  = 0x01
+	vcdTarget  = 0x02
+	vcdAdler32 = 0x04
+
+	// vcdMaxWindow 接受的最大目标窗口
+	vcdMaxWindow = 1 << 28
+	vcdNear      = 4
+	vcdSame      = 3
+)
+
+const (
+	vcdNoop = iota
+	vcdAdd
+	vcdRun
+	vcdCopy
+)
+
+type vcdInst struct {
+	kind, size, mode byte
+}
+
+// vcdCodeTableDefault RFC 3284 5.6 节的默认代码表
+var vcdCodeTableDefault = func() [256][2]vcdInst {
+	var t [256][2]vcdInst
+	i := 0
+	push := func(a, b vcdInst) {
+		t[i] = [2]vcdInst{a, b}
+		i++
+	}
+	push(vcdInst{vcdRun, 0, 0}, vcdInst{})
+	for size := byte(0); size <= 17; size++ {
+		push(vcdInst{vcdAdd, size, 0}, vcdInst{})
+	}
+	for mode := byte(0); mode < 9; mode++ {
+		push(vcdInst{vcdCopy, 0, mode}, vcdInst{})
+		for size := byte(4); size <= 18; size++ {
+			push(vcdInst{vcdCopy, size, mode}, vcdInst{})
+		}
+	}
+	for mode := byte(0); mode < 6; mode++ {
+		for add := byte(1); add <= 4; add++ {
+			for cp := byte(4); cp <= 6; cp++ {
+				push(vcdInst{vcdAdd, add, 0}, vcdInst{vcdCopy, cp, mode})
+			}
+		}
+	}
+	for mode := byte(6); mode < 9; mode++ {
+		for add := byte(1); add <= 4; add++ {
+			push(vcdInst{vcdAdd, add, 0}, vcdInst{vcdCopy, 4, mode})
+		}
+	}
+	for mode := byte(0); mode < 9; mode++ {
+		push(vcdInst{vcdCopy, 4, mode}, vcdInst{vcdAdd, 1, 0})
+	}
+	return t
+}()
+
+func vcdCorrupt(format string, args ...any) error {
+	return goError(CodeCorruptPatch, "VCDIFF: "+format, args...)
+}
+
+func vcdUnsupported(format string, args ...any) error {
+	return goError(CodeUnsupported, "VCDIFF: "+format, args...)
+}
+
+var errVcdIncomplete = fmt.Errorf("incomplete")
+
+// vcdVarint 从 r 读取一个整数；补丁在整数中间结束时返回 errVcdIncomplete
+func vcdVarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, errVcdIncomplete
+		}
+		if err != nil {
+			return 0, err
+		}
+		if v > ^uint64(0)>>7 {
+			return 0, vcdCorrupt("integer overflow")
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+}
+
+// vcdReadN 读取 n 字节，不足时返回 errVcdIncomplete；n 来自补丁，缓冲区随实际读到的数据增长
+func vcdReadN(r io.Reader, n uint64, buf []byte) ([]byte, error) {
+	if n <= uint64(cap(buf)) {
+		buf = buf[:n]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, errVcdIncomplete
+			}
+			return nil, err
+		}
+		return buf, nil
+	}
+	w := bytes.NewBuffer(buf[:0])
+	got, err := io.Copy(w, io.LimitReader(r, int64(min(n, 1<<63-1))))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(got) < n {
+		return nil, errVcdIncomplete
+	}
+	return w.Bytes(), nil
+}
+
+// vcdSection 窗口中的一段
+type vcdSection struct {
+	buf  []byte
+	pos  int
+	what string
+}
+
+func (s *vcdSection) done() bool { return s.pos == len(s.buf) }
+
+func (s *vcdSection) overrun() error {
+	return vcdCorrupt("%s section overrun", s.what)
+}
+
+func (s *vcdSection) byte() (byte, error) {
+	if s.pos >= len(s.buf) {
+		return 0, s.overrun()
+	}
+	s.pos++
+	return s.buf[s.pos-1], nil
+}
+
+func (s *vcdSection) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(s.buf)-s.pos) {
+		return nil, s.overrun()
+	}
+	p := s.buf[s.pos : s.pos+int(n)]
+	s.pos += int(n)
+	return p, nil
+}
+
+func (s *vcdSection) varint() (uint64, error) {
+	v, err := vcdVarint(s)
+	if err == errVcdIncomplete {
+		return 0, s.overrun()
+	}
+	return v, err
+}
+
+func (s *vcdSection) ReadByte() (byte, error) {
+	if s.pos >= len(s.buf) {
+		return 0, io.EOF
+	}
+	s.pos++
+	return s.buf[s.pos-1], nil
+}
+
+// vcdCache RFC 3284 5.1 节的地址缓存，每个窗口重新开始
+type vcdCache struct {
+	near [vcdNear]uint64
+	next int
+	same [vcdSame * 256]uint64
+}
+
+func (c *vcdCache) decode(mode byte, here uint64, addrs *vcdSection) (uint64, error) {
+	var addr uint64
+	switch {
+	case mode == 0:
+		v, err := addrs.varint()
+		if err != nil {
+			return 0, err
+		}
+		addr = v
+	case mode == 1:
+		v, err := addrs.varint()
+		if err != nil {
+			return 0, err
+		}
+		if v > here {
+			return 0, vcdCorrupt("COPY address before window")
+		}
+		addr = here - v
+	case mode < 2+vcdNear:
+		v, err := addrs.varint()
+		if err != nil {
+			return 0, err
+		}
+		addr = c.near[mode-2] + v
+	default:
+		b, err := addrs.byte()
+		if err != nil {
+			return 0, err
+		}
+		addr = c.same[int(mode-2-vcdNear)*256+int(b)]
+	}
+	if addr >= here {
+		return 0, vcdCorrupt("COPY address beyond the current position")
+	}
+	c.near[c.next] = addr
+	c.next = (c.next + 1) % vcdNear
+	c.same[addr%(vcdSame*256)] = addr
+	return addr, nil
+}
+
+// vcdiff 解码整个 VCDIFF 补丁
+func (d *goDecoder) vcdiff(r *bufio.Reader) error {
+	secondary, err := d.vcdiffHeader(r)
+	if err == errVcdIncomplete {
+		return vcdCorrupt("truncated header")
+	}
+	if err != nil {
+		return err
+	}
+	if secondary >= 0 {
+		d.info.secondary = uint32(secondary)
+	}
+	var window []byte
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		}
+		window, err = d.vcdiffWindow(r, secondary, window)
+		if err == errVcdIncomplete {
+			return vcdCorrupt("truncated window")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// vcdiffHeader 读取文件头，返回其中声明的二次压缩器，没有时为 -1
+func (d *goDecoder) vcdiffHeader(r *bufio.Reader) (int, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, errVcdIncomplete
+		}
+		return 0, err
+	}
+	if !bytes.Equal(head[:4], vcdiffMagic) {
+		return 0, vcdCorrupt("bad magic")
+	}
+	indicator := head[4]
+	if indicator&^(vcdDecompress|vcdCodeTable|vcdAppHeader) != 0 {
+		return 0, vcdCorrupt("unknown header indicator")
+	}
+	if indicator&vcdCodeTable != 0 {
+		return 0, vcdUnsupported("custom code tables are not supported")
+	}
+	// 与 xdelta3 一样，文件头中的压缩器只在窗口用到时才是错误
+	secondary := -1
+	if indicator&vcdDecompress != 0 {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, errVcdIncomplete
+		}
+		if err != nil {
+			return 0, err
+		}
+		secondary = int(b)
+	}
+	if indicator&vcdAppHeader != 0 {
+		n, err := vcdVarint(r)
+		if err != nil {
+			return 0, err
+		}
+		app, err := vcdReadN(r, n, nil)
+		if err != nil {
+			return 0, err
+		}
+		if err := vcdCheckAppHeader(app); err != nil {
+			return 0, err
+		}
+	}
+	return secondary, nil
+}
+
+// vcdCheckAppHeader 拒绝 xdelta3 先经过外部压缩器（G 为 gzip，B 为 bzip2 等）再计算差异的补丁，
+// 应用头为 "target/comp/source/comp" 或 "target/comp"；其他应用头忽略
+func vcdCheckAppHeader(hdr []byte) error {
+	fields := bytes.Split(hdr, []byte("/"))
+	var comps []int
+	switch len(fields) {
+	case 2:
+		comps = []int{1}
+	case 4:
+		comps = []int{1, 3}
+	}
+	for _, i := range comps {
+		if f := fields[i]; len(f) == 1 && f[0] >= 'A' && f[0] <= 'Z' {
+			return vcdUnsupported("external compression (%c) is not supported; create the patch with xdelta3 -D", f[0])
+		}
+	}
+	return nil
+}
+
+// vcdiffWindow 读取并解码一个窗口，buf 为可以复用的窗口缓冲区
+func (d *goDecoder) vcdiffWindow(r *bufio.Reader, secondary int, buf []byte) ([]byte, error) {
+	indicator, err := r.ReadByte()
+	if err != nil {
+		return buf, err
+	}
+	if indicator&vcdTarget != 0 {
+		return buf, vcdUnsupported("VCD_TARGET windows are not supported")
+	}
+	if indicator&^(vcdSource|vcdAdler32) != 0 {
+		return buf, vcdCorrupt("unknown window indicator")
+	}
+	var segLen, segPos uint64
+	hasSource := indicator&vcdSource != 0
+	if hasSource {
+		if segLen, err = vcdVarint(r); err != nil {
+			return buf, err
+		}
+		if segPos, err = vcdVarint(r); err != nil {
+			return buf, err
+		}
+	}
+	deltaLen, err := vcdVarint(r)
+	if err != nil {
+		return buf, err
+	}
+	window, err := vcdReadN(r, deltaLen, buf)
+	if err != nil {
+		return buf, err
+	}
+	if d.sizeOnly {
+		hdr := vcdSection{buf: window, what: "window header"}
+		targetLen, err := hdr.varint()
+		if err != nil {
+			return window, err
+		}
+		if targetLen > vcdMaxWindow {
+			return window, vcdCorrupt("target window too large")
+		}
+		if d.produced+targetLen < d.produced {
+			return window, vcdCorrupt("target size overflows")
+		}
+		d.produced += targetLen
+		return window, nil
+	}
+	if err := d.vcdiffDecode(indicator, hasSource, segPos, segLen, window, secondary); err != nil {
+		return window, err
+	}
+	return window, nil
+}
+
+// vcdiffDecode 解码一个窗口的内容并写出重建的目标窗口
+func (d *goDecoder) vcdiffDecode(indicator byte, hasSource bool, segPos, segLen uint64, window []byte, secondary int) error {
+	segEnd := segPos + segLen
+	if segEnd < segPos {
+		return vcdCorrupt("source segment overflows")
+	}
+	if d.size >= 0 && segEnd > uint64(d.size) {
+		return goError(CodeSourceMismatch, "VCDIFF source segment out of range")
+	}
+
+	hdr := vcdSection{buf: window, what: "window header"}
+	targetLen, err := hdr.varint()
+	if err != nil {
+		return err
+	}
+	delta, err := hdr.byte()
+	if err != nil {
+		return err
+	}
+	if delta != 0 {
+		if secondary >= 0 {
+			return vcdUnsupported("secondary compression (%s) is not supported; create the patch with xdelta3 -S none", vcdSecondaryName(byte(secondary)))
+		}
+		return vcdCorrupt("compressed sections without a secondary compressor")
+	}
+	var lens [3]uint64
+	for i := range lens {
+		if lens[i], err = hdr.varint(); err != nil {
+			return err
+		}
+	}
+	checksum := indicator&vcdAdler32 != 0
+	var sum uint32
+	if checksum {
+		b, err := hdr.bytes(4)
+		if err != nil {
+			return err
+		}
+		sum = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	var sections [3]vcdSection
+	for i, what := range []string{"data", "instruction", "address"} {
+		p, err := hdr.bytes(lens[i])
+		if err != nil {
+			return err
+		}
+		sections[i] = vcdSection{buf: p, what: what}
+	}
+	data, inst, addrs := &sections[0], &sections[1], &sections[2]
+	if !hdr.done() {
+		return vcdCorrupt("window length mismatch")
+	}
+	if targetLen > vcdMaxWindow {
+		return vcdCorrupt("target window too large")
+	}
+	if segLen+targetLen < segLen {
+		return vcdCorrupt("source segment overflows")
+	}
+	if err := d.reserve(targetLen); err != nil {
+		return err
+	}
+	if err := d.cancel.check(); err != nil {
+		return err
+	}
+
+	// 只校验时不重建目标窗口：指令按窗口检查，但不读取旧数据，也不产生输出
+	t := d.vcdiffData[:0]
+	if !d.validate && uint64(cap(t)) < targetLen {
+		t = make([]byte, 0, targetLen)
+	}
+	var produced uint64
+	info := d.info
+	info.windows++
+	if hasSource {
+		info.sourceSize = max(info.sourceSize, segEnd)
+	}
+	if checksum && info.checksum == 0 {
+		info.checksum = 1
+	}
+	var cache vcdCache
+	for !inst.done() {
+		code, err := inst.byte()
+		if err != nil {
+			return err
+		}
+		for _, in := range vcdCodeTableDefault[code] {
+			if in.kind == vcdNoop {
+				continue
+			}
+			size := uint64(in.size)
+			if size == 0 {
+				if size, err = inst.varint(); err != nil {
+					return err
+				}
+			}
+			if size > targetLen-produced {
+				return vcdCorrupt("instruction exceeds the target window")
+			}
+			switch in.kind {
+			case vcdAdd:
+				info.addBytes += size
+				p, err := data.bytes(size)
+				if err != nil {
+					return err
+				}
+				if !d.validate {
+					t = append(t, p...)
+				}
+			case vcdRun:
+				info.runBytes += size
+				b, err := data.byte()
+				if err != nil {
+					return err
+				}
+				if !d.validate {
+					for i := uint64(0); i < size; i++ {
+						t = append(t, b)
+					}
+				}
+			case vcdCopy:
+				info.copyBytes += size
+				addr, err := cache.decode(in.mode, segLen+produced, addrs)
+				if err != nil {
+					return err
+				}
+				if addr < segLen && (addr+size < addr || addr+size > segLen) {
+					return vcdCorrupt("COPY crosses the end of the source segment")
+				}
+				switch {
+				case d.validate:
+				case addr < segLen:
+					start := len(t)
+					t = t[:start+int(size)]
+					if err := d.readSource(t[start:], segPos+addr); err != nil {
+						return err
+					}
+				default:
+					// 可能与正在产生的数据重叠，逐字节复制
+					from := addr - segLen
+					for i := uint64(0); i < size; i++ {
+						t = append(t, t[from+i])
+					}
+				}
+			}
+			produced += size
+			info.instructions++
+		}
+	}
+	if produced != targetLen || !data.done() || !addrs.done() {
+		return vcdCorrupt("window length mismatch")
+	}
+	if d.validate {
+		d.info = info
+		return nil
+	}
+	d.vcdiffData = t
+	// 指令都能正常解码，旧数据不一致的可能性更大
+	if checksum && adler32.Checksum(t) != sum {
+		return goError(CodeChecksumMismatch, "adler32 of VCDIFF window %d", d.info.windows)
+	}
+	d.info = info
+	if _, err := d.out.Write(t); err != nil {
+		return err
+	}
+	return nil
+}
+
+func vcdSecondaryName(id byte) string {
+	switch id {
+	case 1:
+		return "djw"
+	case 2:
+		return "lzma"
+	case 16:
+		return "fgk"
+	}
+	return "unknown"
+}
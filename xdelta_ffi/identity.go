@@ -0,0 +1,134 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// 恒等补丁：旧数据与新数据相同时生成的本库格式补丁，由一个长度为 0 的 ADD 记录和依次复制整个旧数据的 COPY 记录组成，
+// 每个 COPY 最多 identityChunk 字节，默认没有补丁头和结束记录；它就是普通的补丁，旧版本的解码器照常应用，
+// WithEndRecord 时与其他补丁一样在前后加上这两个记录。正常编码不会在其他记录之前写出长度为 0 的 ADD
+// （只有空的新数据编码为单独一个这样的记录），IsIdentityPatch 据此只看补丁本身就能识别
+const identityChunk = 1 << 30
+
+// WithIdentityDetection 控制恒等补丁（默认开启）：CreateDiffs、CreateDiffsFile 的两份输入完全相同（且不为空）时
+// 不调用编码器，直接生成恒等补丁，补丁只有 5 + 13 × ⌈长度 / 1 GiB⌉ 字节（WithEndRecord 时再加上补丁头和结束记录的 11 字节）
+// WithStandardVCDIFF、WithChecksum 时照常编码（恒等补丁不带校验和）；WithSecondaryCompression 对恒等补丁无效，补丁中没有可压缩的数据
+func WithIdentityDetection(on bool) Option {
+	return func(o *options) {
+		o.noIdentity = !on
+	}
+}
+
+// WithIdentityNoCopy ApplyDiffsData 遇到长度与 oldData 相符的恒等补丁（见 IsIdentityPatch）时不调用解码器，默认返回 oldData 的副本，
+// 这个选项让它直接返回 oldData 本身，调用方之后修改其中一个也会改变另一个
+func WithIdentityNoCopy() Option {
+	return func(o *options) {
+		o.identityNoCopy = true
+	}
+}
+
+// IsIdentityPatch 报告 patch 是否是恒等补丁，即应用到长度正好为其中 COPY 总长度的旧数据时结果与旧数据相同；
+// 只检查补丁本身的记录，不需要旧数据，也不调用原生库。信封、签名等包装过的补丁返回 false
+func IsIdentityPatch(patch []byte) bool {
+	_, ok := identitySize(patch)
+	return ok
+}
+
+// identitySize patch 是恒等补丁时返回它复制的旧数据长度
+func identitySize(patch []byte) (int64, bool) {
+	headed := len(patch) >= headerRecordLen+endRecordLen && patch[0] == headerRecordOp && patch[1] == formatRevision
+	if headed {
+		end := patch[len(patch)-endRecordLen:]
+		patch = patch[headerRecordLen : len(patch)-endRecordLen]
+		n, ok := identitySize(patch)
+		return n, ok && end[0] == endRecordOp && binary.LittleEndian.Uint64(end[1:]) == uint64(n)
+	}
+	if len(patch) < 5+13 || (len(patch)-5)%13 != 0 || !bytes.Equal(patch[:5], []byte{0, 0, 0, 0, 0}) {
+		return 0, false
+	}
+	var n int64
+	for rec := patch[5:]; len(rec) > 0; rec = rec[13:] {
+		off, l := binary.LittleEndian.Uint64(rec[1:]), binary.LittleEndian.Uint32(rec[9:])
+		if rec[0] != 0x01 || off != uint64(n) || l == 0 || l > identityChunk {
+			return 0, false
+		}
+		n += int64(l)
+	}
+	return n, true
+}
+
+// identityPatch 返回长度为 n（大于 0）的数据的恒等补丁，end 为 true（见 writesEndRecord）时带补丁头和结束记录
+func identityPatch(n int64, end bool) []byte {
+	p := make([]byte, 0, headerRecordLen+5+13*((n+identityChunk-1)/identityChunk)+endRecordLen)
+	if end {
+		p = append(p, headerRecordOp, formatRevision)
+	}
+	p = append(p, 0, 0, 0, 0, 0)
+	for off := int64(0); off < n; off += identityChunk {
+		p = append(p, 0x01)
+		p = binary.LittleEndian.AppendUint64(p, uint64(off))
+		p = binary.LittleEndian.AppendUint32(p, uint32(min(identityChunk, n-off)))
+	}
+	if end {
+		p = appendEndRecord(p, uint64(n))
+	}
+	return p
+}
+
+// identityEnabled 是否可以用恒等补丁代替这些选项下正常编码的结果
+func (o options) identityEnabled() bool {
+	return !o.noIdentity && !o.vcdiff && !o.bsdiff && o.checksum == ChecksumNone
+}
+
+// sameFiles 报告两个文件的内容是否完全相同且不为空，并返回其长度；长度不同时不读取内容，读取失败时返回 false，错误留给编码器报告
+func sameFiles(oldPath, newPath string) (int64, bool) {
+	size := fileSize(oldPath)
+	if size <= 0 || size != fileSize(newPath) {
+		return 0, false
+	}
+	a, err := os.Open(oldPath)
+	if err != nil {
+		return 0, false
+	}
+	defer a.Close()
+	b, err := os.Open(newPath)
+	if err != nil {
+		return 0, false
+	}
+	defer b.Close()
+	bufA, bufB := make([]byte, 1<<20), make([]byte, 1<<20)
+	var done int64
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		m, errB := io.ReadFull(b, bufB)
+		if n != m || !bytes.Equal(bufA[:n], bufB[:m]) {
+			return 0, false
+		}
+		done += int64(n)
+		if errA != nil || errB != nil {
+			return size, errA == errB && (errA == io.EOF || errA == io.ErrUnexpectedEOF) && done == size
+		}
+	}
+}
+
+// writeIdentityFile 把长度为 n 的数据的恒等补丁写入 patchPath，先写入同目录下的临时文件再重命名，返回补丁的长度；end 见 identityPatch
+func writeIdentityFile(patchPath string, n int64, end, fsync bool) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(patchPath), "."+filepath.Base(patchPath)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	patch := identityPatch(n, end)
+	if _, err := tmp.Write(patch); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return int64(len(patch)), replaceFile(tmp.Name(), patchPath, fsync)
+}
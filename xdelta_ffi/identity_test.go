@@ -0,0 +1,126 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestIdentityPatch 两份相同的输入得到恒等补丁：一个长度为 0 的 ADD 和一个 COPY，只用原始格式的记录，
+// 没有补丁头和结束记录，各个应用接口照常应用；WithEndRecord 时在前后加上这两个记录
+func TestIdentityPatch(t *testing.T) {
+	requireNative(t)
+	data, _ := testPair()
+	patch, err := CreateDiffs(data, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := binary.LittleEndian.AppendUint64([]byte{0x00, 0, 0, 0, 0, 0x01}, 0)
+	want = binary.LittleEndian.AppendUint32(want, uint32(len(data)))
+	if !bytes.Equal(patch, want) {
+		t.Fatalf("identity patch is % x, want % x", patch, want)
+	}
+	headed, err := CreateDiffs(data, data, WithEndRecord(true))
+	wantHeaded := appendEndRecord(append([]byte{headerRecordOp, formatRevision}, want...), uint64(len(data)))
+	if err != nil || !bytes.Equal(headed, wantHeaded) {
+		t.Fatalf("identity patch with WithEndRecord is % x, %v, want % x", headed, err, wantHeaded)
+	}
+	for _, p := range [][]byte{patch, headed} {
+		if !IsIdentityPatch(p) {
+			t.Fatalf("IsIdentityPatch is false for % x", p)
+		}
+		if got, err := ApplyDiffsData(data, p); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("ApplyDiffsData: %v", err)
+		}
+		var out bytes.Buffer
+		if err := ApplyDiffsStream(bytes.NewReader(data), bytes.NewReader(p), &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("ApplyDiffsStream: %v", err)
+		}
+		if err := ValidateFormat(p); err != nil {
+			t.Fatalf("ValidateFormat: %v", err)
+		}
+	}
+}
+
+// TestIdentityPatchChunks 超过 1 GiB 的数据分成多个 COPY，IsIdentityPatch 据此还原长度，不需要真的分配这么多数据
+func TestIdentityPatchChunks(t *testing.T) {
+	n := int64(2*identityChunk + 5)
+	patch := identityPatch(n, false)
+	if len(patch) != 5+3*13 {
+		t.Fatalf("identity patch of %d bytes has %d bytes, want %d", n, len(patch), 5+3*13)
+	}
+	if got, ok := identitySize(patch); !ok || got != n {
+		t.Fatalf("identitySize: got %d, %v, want %d", got, ok, n)
+	}
+	// 记录顺序或偏移不对的补丁不是恒等补丁
+	bad := bytes.Clone(patch)
+	binary.LittleEndian.PutUint64(bad[5+13+1:], 0)
+	if IsIdentityPatch(bad) {
+		t.Fatal("IsIdentityPatch accepted a patch whose second COPY does not continue the first")
+	}
+	if IsIdentityPatch(patch[:5]) || IsIdentityPatch(append(bytes.Clone(patch), 0)) {
+		t.Fatal("IsIdentityPatch accepted a patch without exactly whole COPY records")
+	}
+	// 带补丁头时结束记录中的长度必须与 COPY 的总长度一致
+	headed := identityPatch(n, true)
+	if got, ok := identitySize(headed); !ok || got != n {
+		t.Fatalf("identitySize with the end record: got %d, %v, want %d", got, ok, n)
+	}
+	if IsIdentityPatch(appendEndRecord(headed[:len(headed)-endRecordLen], uint64(n-1))) || IsIdentityPatch(headed[:len(headed)-endRecordLen]) {
+		t.Fatal("IsIdentityPatch accepted a headed patch without a matching end record")
+	}
+}
+
+// TestIdentityDetectionOptions 关闭检测、带校验和或使用 VCDIFF 时照常编码；WithIdentityNoCopy 时直接返回 oldData
+func TestIdentityDetectionOptions(t *testing.T) {
+	requireNative(t)
+	data, _ := testPair()
+	for name, opts := range map[string][]Option{
+		"disabled": {WithIdentityDetection(false)},
+		"checksum": {WithChecksum(ChecksumXXH3)},
+		"vcdiff":   {WithStandardVCDIFF()},
+	} {
+		patch, err := CreateDiffs(data, data, opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if IsIdentityPatch(patch) {
+			t.Errorf("%s: got an identity patch", name)
+		}
+		if got, err := ApplyDiffsData(data, patch); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: ApplyDiffsData: %v", name, err)
+		}
+	}
+	got, err := ApplyDiffsData(data, identityPatch(int64(len(data)), true), WithIdentityNoCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) || &got[0] != &data[0] {
+		t.Fatal("WithIdentityNoCopy returned a copy of the old data")
+	}
+}
+
+// TestIdentityPatchFile CreateDiffsFile 对内容相同的两个文件写出同样的恒等补丁
+func TestIdentityPatchFile(t *testing.T) {
+	requireNative(t)
+	data, _ := testPair()
+	dir := t.TempDir()
+	oldPath, newPath, patchPath := filepath.Join(dir, "old"), filepath.Join(dir, "new"), filepath.Join(dir, "patch")
+	for _, p := range []string{oldPath, newPath} {
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateDiffsFile(oldPath, newPath, patchPath, DefaultBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	patch, err := os.ReadFile(patchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch, identityPatch(int64(len(data)), false)) {
+		t.Fatalf("CreateDiffsFile wrote % x, want the identity patch", patch)
+	}
+}
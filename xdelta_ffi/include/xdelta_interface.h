@@ -9,16 +9,424 @@
 extern "C" {
 #endif
 
-// 返回 0 表示成功，负数表示失败。失败后可通过 xdelta_last_error() 获取错误字符串（只读指针，线程局部）。
+// 本头文件对应的 ABI 修订号，新增导出函数或修改签名、结构体布局、补丁格式时递增；运行时的值见 xdelta_version
+#define XDELTA_ABI_VERSION 27
+
+// 线程安全：除 xdelta_set_log 外，所有函数都可以在任意线程上并发调用，库内没有全局的可变状态，
+// 错误信息通过各自的 err 输出参数返回，互不干扰；编码器、解码器等句柄同时只能由一个线程使用（xdelta_cancel 除外，
+// 它就是用来在其他线程中取消的），绑定到旧数据的 xdelta_source_encoder_* / xdelta_source_decoder_* 句柄可以被多个线程同时使用（见其说明）。
+// xdelta_set_log 修改的是全局的回调和级别（原子变量），可以与其他调用并发，但不应被多个线程同时调用
+
+// 错误码：返回 0 表示成功，负数表示对应类别的失败
+#define XDELTA_OK                    0
+#define XDELTA_ERR_INVALID_ARGUMENT (-1)
+#define XDELTA_ERR_CANCELED         (-2)
+#define XDELTA_ERR_CORRUPT_PATCH    (-3)
+#define XDELTA_ERR_SOURCE_MISMATCH  (-4)
+#define XDELTA_ERR_OUTPUT_TOO_LARGE (-5)
+#define XDELTA_ERR_IO               (-6)
+#define XDELTA_ERR_OUT_OF_MEMORY    (-7)
+#define XDELTA_ERR_UNSUPPORTED      (-8)
+// 补丁中的校验和与应用得到的输出不一致，通常是旧数据不对；错误信息中有出错的校验窗口序号和输出范围
+#define XDELTA_ERR_CHECKSUM_MISMATCH (-9)
+
+// 补丁格式：XDELTA_FORMAT_NATIVE 为本库的记录格式，XDELTA_FORMAT_VCDIFF 为 RFC 3284 VCDIFF（可以用 xdelta3 -d 应用）
+// 应用补丁时根据补丁的第一个字节自动识别格式，也接受 xdelta3 生成的 VCDIFF 补丁（包括应用头和 adler32 校验和）；
+// 补丁用到 xdelta3 的二次压缩、外部压缩、自定义指令表或 VCD_TARGET 窗口时返回 XDELTA_ERR_UNSUPPORTED
+#define XDELTA_FORMAT_NATIVE 0
+#define XDELTA_FORMAT_VCDIFF 1
+// bsdiff 4.x 补丁（BSDIFF40，可以用 bspatch 应用），只能由内存中的新旧数据创建：流式编码器和文件接口返回 XDELTA_ERR_INVALID_ARGUMENT，
+// 不能与二次压缩、校验和、内容定义分块或源窗口一起使用，忽略 block_size、threads、快速匹配和追加标记；
+// 应用补丁的接口都识别此格式，但补丁要完整缓存后才能解码（流式解码器在 finish 时才写出输出），且需要知道旧数据的长度；
+// 合并、原地应用和列出结构的接口对它返回 XDELTA_ERR_UNSUPPORTED
+#define XDELTA_FORMAT_BSDIFF 2
+// 可以与上面任一格式按位或的快速匹配标记：连续一个块的位置都没有匹配时，之后 7 个块不再查找匹配而直接作为新数据写入，
+// 没有可匹配内容的输入（例如已经压缩过的文件）编码快得多，代价是匹配的区域最多晚 7 个块才被发现；补丁格式不变
+#define XDELTA_FORMAT_FLAG_FAST_MATCH 0x100
+// 在补丁中写入输出的校验和的标记，最多选一个：本库格式每 1 MiB 输出（在记录边界）一个校验和，VCDIFF 为 xdelta3 的每窗口
+// adler32（只能用 ADLER32）。应用补丁时逐个校验，不一致返回 XDELTA_ERR_CHECKSUM_MISMATCH；不带标记的补丁没有校验和，也不做校验。
+// 带校验和的本库格式补丁需要格式修订号 2 及以上的库才能应用
+#define XDELTA_FORMAT_FLAG_ADLER32 0x200
+#define XDELTA_FORMAT_FLAG_XXH3    0x400
+// 只追加的快速路径标记：新数据以完整的（非空）旧数据开头时不建签名表、不查找匹配，直接写出复制整个旧数据的 COPY
+// 和其余部分的 ADD；否则照常编码。补丁格式不变。只对 xdelta_create_patch_data*、xdelta_create_patch_file* 有效，
+// 流式编码器和 xdelta_source_encoder 忽略这个标记
+#define XDELTA_FORMAT_FLAG_APPEND 0x800
+// 内容定义分块（FastCDC）：XDELTA_FORMAT_CDC_MASK 的位中存放平均块长的以 2 为底的对数（6 到 20，即 64 B 到 1 MiB），0 表示不使用。
+// 旧数据和新数据按内容切分，插入、删除只影响附近的块，匹配的块向两侧逐字节延伸成尽量长的 COPY；新数据每 1 MiB 左右的窗口
+// 同时按 block_size 正常编码，取记录较短的一种，补丁格式不变。只对 xdelta_create_patch_data_cancel 有效（总是单线程编码），
+// 其他创建补丁的函数忽略这些位
+#define XDELTA_FORMAT_CDC_SHIFT 12
+#define XDELTA_FORMAT_CDC_MASK  (0x1f << XDELTA_FORMAT_CDC_SHIFT)
+// 惰性匹配标记：一个块与旧数据中的多个块相同时优先选择紧接上一个 COPY 的那个，连续匹配的块合并成一个 COPY（最多约 1 MiB）
+// 在连续的区域结束时才写出；记录更少、补丁更小，编码稍慢。补丁格式不变
+#define XDELTA_FORMAT_FLAG_LAZY_MATCH 0x20000
+// 最短匹配：XDELTA_FORMAT_MIN_MATCH_MASK 的位中存放最少的连续匹配块数（0 到 15，0 和 1 表示每个匹配的块都写成 COPY），
+// 更短的连续匹配作为新数据写入，避免大量零散的短 COPY；大于 1 时连续匹配的块同样合并成一个 COPY。补丁格式不变
+#define XDELTA_FORMAT_MIN_MATCH_SHIFT 18
+#define XDELTA_FORMAT_MIN_MATCH_MASK  (0xf << XDELTA_FORMAT_MIN_MATCH_SHIFT)
+// 结束记录标记：本库格式的补丁以 HEADER 记录（0x05 加 1 字节格式修订号）开头、以记录了输出长度的 END 记录
+// （0x03 加 8 字节小端序长度）结尾，以 HEADER 开头的补丁缺少 END 时是损坏的补丁，在任何位置（包括两个记录之间）
+// 截断都能发现；不带标记时补丁两者都没有，在最后一个记录之后结束，与原来的格式相同。需要格式修订号 3 及以上的库才能应用，
+// 只对本库格式有效，与 XDELTA_FORMAT_VCDIFF、XDELTA_FORMAT_BSDIFF 同时使用时返回 XDELTA_ERR_INVALID_ARG
+#define XDELTA_FORMAT_FLAG_END 0x400000
+
+// 补丁的二次压缩方式：在记录流之上再压缩整个补丁，应用补丁时根据第一个字节自动识别
+#define XDELTA_SECONDARY_NONE 0
+#define XDELTA_SECONDARY_ZLIB 1
+#define XDELTA_SECONDARY_ZSTD 2
+#define XDELTA_SECONDARY_LZ4  3
+#define XDELTA_SECONDARY_LZMA 4
+#define XDELTA_SECONDARY_DJW  5
+#define XDELTA_SECONDARY_FGK  6
+
+// 二次压缩的级别：XDELTA_LEVEL_DEFAULT 使用压缩器的默认级别，否则为 0（最快）到 9（补丁最小）
+#define XDELTA_LEVEL_DEFAULT (-1)
+
+// 文件版本的统计信息（字节数）
+typedef struct xdelta_file_stats {
+    uint64_t old_size;
+    uint64_t new_size;
+    uint64_t patch_size;
+} xdelta_file_stats;
+
+// 补丁的组成，见 xdelta_inspect_patch_data
+typedef struct xdelta_patch_info {
+    uint32_t format;         // XDELTA_FORMAT_*
+    uint32_t secondary;      // 本库格式为 XDELTA_SECONDARY_*，VCDIFF 为文件头中的压缩器 ID（xdelta3：1 DJW，2 LZMA，16 FGK）
+    uint64_t windows;        // VCDIFF 的窗口数，本库格式为 0
+    uint64_t instructions;   // ADD、COPY、RUN 指令（本库格式为记录）的个数
+    uint64_t add_bytes;
+    uint64_t copy_bytes;
+    uint64_t run_bytes;
+    uint64_t target_size;    // 补丁声明的输出长度
+    uint64_t source_size;    // 能应用补丁的最短旧数据：最远的 COPY（VCDIFF 为最远的源数据段）的结束位置
+    uint32_t checksum;       // 补丁中的输出校验和：1 adler32，2 XXH3，没有时为 0
+} xdelta_patch_info;
+
+// xdelta_patch_segments 切出的一段：patch_offset、patch_len 为它在补丁中的位置，target_offset、target_len 为它在输出中的位置
+typedef struct xdelta_patch_segment {
+    uint64_t patch_offset;
+    uint64_t patch_len;
+    uint64_t target_offset;
+    uint64_t target_len;
+} xdelta_patch_segment;
+
+// xdelta_create_patches 的一对输入及其结果：old_offset、old_len、new_offset、new_len 为两份数据在 data 中的位置，
+// block_size 为这一对使用的块大小；code、out_offset、out_len 由原生层填写：code 为 0 或 XDELTA_ERR_*，
+// 成功时 out_offset、out_len 为补丁在 *out 中的位置，失败时为错误信息（UTF-8，不以 NUL 结尾）的位置
+typedef struct xdelta_batch_item {
+    uint64_t old_offset;
+    uint64_t old_len;
+    uint64_t new_offset;
+    uint64_t new_len;
+    uint32_t block_size;
+    int32_t code;
+    uint64_t out_offset;
+    uint64_t out_len;
+} xdelta_batch_item;
+
+// xdelta_patch_source_ranges 返回的一段旧数据区间
+typedef struct xdelta_source_range {
+    uint64_t offset;
+    uint64_t len;
+} xdelta_source_range;
+
+// 原生库的版本信息，见 xdelta_version；字符串以 NUL 结尾
+typedef struct xdelta_version_info {
+    uint32_t abi;               // 库实现的 ABI 修订号，与编译调用方时的 XDELTA_ABI_VERSION 比较
+    uint32_t format;            // XDELTA_FORMAT_NATIVE 格式的修订号
+    char crate_version[32];     // Rust crate 的版本，例如 "0.1.0"
+    char algorithm[128];        // 差分算法和支持的补丁格式的说明
+} xdelta_version_info;
+
+// 跨越 FFI 边界、尚未释放的内存，见 xdelta_debug_alloc_stats
+typedef struct xdelta_alloc_stats {
+    uint64_t live_buffers;      // 尚未用 xdelta_free_data / xdelta_free_error 释放的缓冲区和错误信息个数
+    uint64_t live_bytes;        // 它们的总字节数
+    uint64_t live_handles;      // 尚未释放的编码器、解码器、取消标记等句柄个数（不含句柄持有的内存）
+    uint64_t total_buffers;     // 累计分配的缓冲区和错误信息个数
+    uint64_t total_bytes;       // 累计分配的字节数
+} xdelta_alloc_stats;
+
+// 原生库的资源统计，见 xdelta_native_stats
+typedef struct xdelta_native_stats_info {
+    uint64_t current_bytes;     // 本库当前在堆上持有的字节数，包括尚未释放的缓冲区
+    uint64_t peak_bytes;        // current_bytes 的峰值，总是不小于同时读到的 current_bytes
+    uint64_t encoders;          // 存活的 xdelta_encoder 句柄个数
+    uint64_t decoders;          // 存活的 xdelta_decoder 句柄个数
+    uint64_t source_encoders;   // 存活的 xdelta_source_encoder 句柄个数
+    uint64_t source_decoders;   // 存活的 xdelta_source_decoder 句柄个数
+    uint64_t bytes_encoded;     // 累计编码的新数据字节数
+    uint64_t bytes_decoded;     // 累计解码输出的字节数（只校验不输出的不计入）
+} xdelta_native_stats_info;
+
+// 协作式取消标记，可以在任意线程置位
+typedef struct xdelta_cancel xdelta_cancel;
+
+// 流式编码器、解码器句柄
+typedef struct xdelta_encoder xdelta_encoder;
+typedef struct xdelta_decoder xdelta_decoder;
+// 绑定到一份旧数据的编码器句柄
+typedef struct xdelta_source_encoder xdelta_source_encoder;
+// 绑定到一份旧数据的解码器句柄
+typedef struct xdelta_source_decoder xdelta_source_decoder;
+
+// 从旧数据 offset 处读满 len 字节：返回 0 成功，-1 读取失败，-2 超出旧数据范围（按 XDELTA_ERR_SOURCE_MISMATCH 处理）
+typedef int (*xdelta_read_fn)(uintptr_t ctx, uint64_t offset, uint8_t* buf, size_t len);
+// 写出 len 字节解码结果：返回 0 成功，-1 写入失败
+typedef int (*xdelta_write_fn)(uintptr_t ctx, const uint8_t* buf, size_t len);
+
+// 日志级别，见 xdelta_set_log；XDELTA_LOG_DEBUG 包括编码器、解码器每个窗口的诊断信息
+#define XDELTA_LOG_DEBUG 0
+#define XDELTA_LOG_INFO  1
+#define XDELTA_LOG_WARN  2
+#define XDELTA_LOG_ERROR 3
+#define XDELTA_LOG_OFF   4
+
+// 接收一行日志：msg 不以 '\0' 结尾，只在回调期间有效；返回值被忽略
+typedef int (*xdelta_log_fn)(int level, const uint8_t* msg, size_t len);
+
+// 返回 0 表示成功，负数为 XDELTA_ERR_* 错误码。
+// 所有可能失败的函数最后一个参数为 char** err：失败且 err 非 NULL 时，*err 被设置为本次调用的错误字符串，
+// 由调用方通过 xdelta_free_error() 释放；成功时不修改 *err。
+// 输入缓冲区只在调用期间被读取，长度为 0 时指针可以为 NULL。
+// 新数据为空时补丁只包含一条长度为 0 的 ADD 记录，因此合法的补丁永远不为空，空补丁返回 XDELTA_ERR_CORRUPT_PATCH。
 int xdelta_create_patch_data(const uint8_t* old_data, size_t old_len,
                              const uint8_t* new_data, size_t new_len,
                              uint8_t** patch_data, size_t* patch_len,
-                             uint32_t block_size);
+                             uint32_t block_size, char** err);
+// 可取消版本：cancel 可以为 NULL，编码在窗口之间检查 cancel，被取消时返回 XDELTA_ERR_CANCELED 并释放所有中间结果。
+// format 为 XDELTA_FORMAT_* 之一，XDELTA_FORMAT_VCDIFF 和 XDELTA_FORMAT_BSDIFF 只能与 XDELTA_SECONDARY_NONE 一起使用。
+// secondary 为 XDELTA_SECONDARY_* 之一，level 为 XDELTA_LEVEL_DEFAULT 或 0..9，超出范围返回 XDELTA_ERR_INVALID_ARGUMENT。
+// threads 为编码线程数：1 为单线程；0 为所有 CPU 核心；不为 1 时签名和新数据按 8 MiB 分段并行处理，
+// 结果与线程数和核心数无关（但与 threads 为 1 时不同），都可以用 apply 正常解码；超出 0..256 返回 XDELTA_ERR_INVALID_ARGUMENT。
+int xdelta_create_patch_data_cancel(const uint8_t* old_data, size_t old_len,
+                                    const uint8_t* new_data, size_t new_len,
+                                    uint8_t** patch_data, size_t* patch_len,
+                                    uint32_t block_size, int format, int secondary, int level, int threads,
+                                    const xdelta_cancel* cancel, char** err);
+// 源窗口版本（相当于 xdelta3 -B）：新数据的每个位置只与旧数据中前后共 source_window 字节（按块向下取整，至少一块）匹配，
+// 签名表只覆盖窗口内的块，内存与旧数据的大小无关；挪动超过半个窗口的数据不再能匹配，补丁会变大。
+// COPY 使用绝对偏移，应用时不需要知道窗口大小。总是单线程编码，source_window 为 0 时与 threads 为 1 的 cancel 版本相同。
+int xdelta_create_patch_data_window(const uint8_t* old_data, size_t old_len,
+                                    const uint8_t* new_data, size_t new_len,
+                                    uint8_t** patch_data, size_t* patch_len,
+                                    uint32_t block_size, int format, int secondary, int level, uint64_t source_window,
+                                    const xdelta_cancel* cancel, char** err);
 int xdelta_apply_patch_data(const uint8_t* old_data, size_t old_len,
                             const uint8_t* patch_data, size_t patch_len,
-                            uint8_t** new_data, size_t* new_len);
+                            uint8_t** new_data, size_t* new_len, char** err);
+// 可取消版本：cancel 可以为 NULL，解码在窗口之间检查 cancel，被取消时返回 XDELTA_ERR_CANCELED 并释放已产生的部分输出。
+// max_output 为输出大小上限（0 表示不限制），补丁声明的输出超过上限时在产生这部分输出之前返回 XDELTA_ERR_OUTPUT_TOO_LARGE。
+int xdelta_apply_patch_data_cancel(const uint8_t* old_data, size_t old_len,
+                                   const uint8_t* patch_data, size_t patch_len,
+                                   uint8_t** new_data, size_t* new_len,
+                                   uint64_t max_output, const xdelta_cancel* cancel, char** err);
+// 固定缓冲区版本：输出直接写入调用方的 dst（dst_cap 字节），不分配随输出增长的内存；输出超过 dst_cap 时在写出超出的部分之前
+// 返回 XDELTA_ERR_OUTPUT_TOO_LARGE，dst 中已写入的内容没有意义。dst_cap 为 0 时 dst 可以为 NULL，成功时 new_len 为输出长度。
+int xdelta_apply_patch_into(const uint8_t* old_data, size_t old_len,
+                            const uint8_t* patch_data, size_t patch_len,
+                            uint8_t* dst, size_t dst_cap, size_t* new_len, char** err);
+// 预先分配版本：dst_cap 必须是补丁声明的输出长度（xdelta_validate_patch_data 的 new_len），调用方据此一次分配好 dst，解码时不再分配或复制输出；
+// 实际输出多于或少于 dst_cap 时返回 XDELTA_ERR_CORRUPT_PATCH，dst 中已写入的内容没有意义。cancel 与上面相同。
+int xdelta_apply_patch_exact(const uint8_t* old_data, size_t old_len,
+                             const uint8_t* patch_data, size_t patch_len,
+                             uint8_t* dst, size_t dst_cap, const xdelta_cancel* cancel, char** err);
+// 校验版本：完整解码但丢弃输出，内存占用与输出大小无关；max_output、cancel 与上面相同。
+// new_len、sha256 可以为 NULL，非 NULL 时写入输出的长度和 SHA-256（sha256 指向 32 字节的缓冲区）。
+int xdelta_verify_patch_data(const uint8_t* old_data, size_t old_len,
+                             const uint8_t* patch_data, size_t patch_len,
+                             uint64_t max_output, uint64_t* new_len, uint8_t* sha256,
+                             const xdelta_cancel* cancel, char** err);
+// 只检查补丁的结构，不需要旧数据：解析全部记录和 VCDIFF 窗口，检查长度、偏移是否自洽以及补丁是否截断。
+// source_len 为旧数据长度，未知时传 -1，已知时 COPY 超出范围返回 XDELTA_ERR_SOURCE_MISMATCH。
+// 耗时与补丁大小成线性，不按补丁声明的输出大小分配内存；VCDIFF 窗口的 adler32 只能在应用时检查。
+// new_len 可以为 NULL，非 NULL 时写入补丁声明的输出长度。
+int xdelta_validate_patch_data(const uint8_t* patch_data, size_t patch_len, int64_t source_len, uint64_t* new_len,
+                               char** err);
+// 统计补丁的组成，不需要旧数据，检查与 xdelta_validate_patch_data 相同，补丁不合法时返回错误。info 不能为 NULL。
+int xdelta_inspect_patch_data(const uint8_t* patch_data, size_t patch_len, xdelta_patch_info* info, char** err);
+// 读取补丁声明的输出长度，不需要旧数据。VCDIFF 只解析窗口头，耗时与窗口数成正比；本库格式没有文件头，
+// 需要遍历全部记录（跳过 ADD 数据），二次压缩的补丁还需要解压。补丁截断时返回 XDELTA_ERR_CORRUPT_PATCH，new_len 不能为 NULL。
+int xdelta_patch_target_size(const uint8_t* patch_data, size_t patch_len, uint64_t* new_len, char** err);
+// 把补丁按记录（VCDIFF 为窗口）边界切成若干段，每段约 segment_size 字节输出，不需要旧数据。补丁开头 header_len 字节
+// （本库格式为 0，带校验和时为第一个校验和记录，VCDIFF 为文件头）加上一段的补丁数据就是只生成这一段输出的补丁，各段只从旧数据复制，可以并行解码；
+// 二次压缩的本库格式补丁作为一段返回。只检查分帧，COPY 的范围在解码时检查；segments 按输出顺序排列，使用 xdelta_free_data 释放。
+int xdelta_patch_segments(const uint8_t* patch_data, size_t patch_len, uint64_t segment_size,
+                          xdelta_patch_segment** segments, size_t* count, size_t* header_len, char** err);
+// 与 xdelta_patch_segments 相同，但补丁为文件 patch_path，可以映射时通过只读内存映射读取，不整个读入内存。
+int xdelta_patch_file_segments(const char* patch_path, uint64_t segment_size, xdelta_patch_segment** segments,
+                               size_t* count, size_t* header_len, char** err);
+// 不需要旧数据，返回应用补丁时 COPY 读取的旧数据区间，按偏移排序、互不重叠，相隔不超过 gap 字节的区间合并为一个；
+// VCDIFF 中从目标窗口复制的数据不计入，bsdiff 补丁为控制块中差分块读取的旧数据。ranges 为 count 个 xdelta_source_range，使用 xdelta_free_data 释放。
+int xdelta_patch_source_ranges(const uint8_t* patch_data, size_t patch_len, uint64_t gap, xdelta_source_range** ranges,
+                               size_t* count, char** err);
+// 把一串补丁合并成一个（相当于 xdelta3 merge），第 i 个补丁的旧数据是第 i-1 个补丁的新数据，不需要任何一个版本的数据。
+// patches 为 count 个补丁首尾相接的数据，lens 为各自的长度；结果为本库格式、不做二次压缩，使用 xdelta_free_data 释放。
+// 某个补丁的 COPY 超出前一个补丁的输出范围时返回 XDELTA_ERR_SOURCE_MISMATCH，错误信息注明是第几个补丁。
+int xdelta_merge_patches(const uint8_t* patches, const size_t* lens, size_t count, uint8_t** merged_data,
+                         size_t* merged_len, char** err);
+// 文件版本：旧文件只读取块签名，新文件流式读取，补丁直接写入 patch_path。format、secondary、level、threads 同上，
+// 结果与内存版本相同；threads 不为 1 时每个线程缓冲 8 MiB 新数据。stats 可以为 NULL。
+// use_mmap 不为 0 时输入文件尽量通过只读内存映射读取（无法映射时照常读取，补丁相同），映射期间文件长度变化时返回
+// XDELTA_ERR_IO；Linux、macOS 上映射期间文件被截断会使进程收到 SIGBUS，Windows 不允许截断已映射的文件。
+int xdelta_create_patch_file(const char* old_path, const char* new_path, const char* patch_path,
+                             uint32_t block_size, int format, int secondary, int level, int threads, int use_mmap,
+                             xdelta_file_stats* stats, char** err);
+// 源窗口版本的文件接口：source_window 与 xdelta_create_patch_data_window 相同，旧文件随窗口顺序读取。
+int xdelta_create_patch_file_window(const char* old_path, const char* new_path, const char* patch_path,
+                                    uint32_t block_size, int format, int secondary, int level, uint64_t source_window,
+                                    int use_mmap, xdelta_file_stats* stats, char** err);
+// 内存输入、文件输出：与 xdelta_create_patch_data_window 相同（source_window 为 0 时与 xdelta_create_patch_data_cancel 相同，
+// threads 只在这时有效），补丁边编码边逐个窗口写入 patch_path，不在内存中保存整个补丁；文件内容与内存版本返回的补丁
+// 逐字节相同，失败或被取消时删除未写完的文件。stats 可以为 NULL。
+int xdelta_create_patch_data_to_file(const uint8_t* old_data, size_t old_len, const uint8_t* new_data, size_t new_len,
+                                     const char* patch_path, uint32_t block_size, int format, int secondary, int level,
+                                     int threads, uint64_t source_window, const xdelta_cancel* cancel,
+                                     xdelta_file_stats* stats, char** err);
+// 调用方缓冲区版本：参数与 xdelta_create_patch_data_to_file 相同，补丁直接写入 dst（dst_cap 字节），内容与内存版本逐字节相同；
+// 放不下时编码照常完成但不再写入，返回 XDELTA_ERR_OUTPUT_TOO_LARGE，patch_len 为完整补丁的长度，dst 中的内容没有意义。
+// patch_len 不能为 NULL；dst_cap 为 0 时 dst 可以为 NULL。
+int xdelta_create_patch_into(const uint8_t* old_data, size_t old_len, const uint8_t* new_data, size_t new_len,
+                             uint8_t* dst, size_t dst_cap, size_t* patch_len, uint32_t block_size, int format,
+                             int secondary, int level, int threads, uint64_t source_window, const xdelta_cancel* cancel,
+                             char** err);
+// 批量版本：一次调用为 items 中的 count 对数据创建补丁，两份数据都在 data 中，适合大量很小的输入。每一对的补丁与 threads 为 1 时
+// 用同样的参数和这一对的 block_size 调用 xdelta_create_patch_data_cancel（source_window 大于 0 时为 xdelta_create_patch_data_window）
+// 得到的补丁逐字节相同；threads 为同时编码的对数，0 为所有 CPU 核心。某一对失败只设置它的 code，不影响其他对；
+// 全部完成后返回 0，*out 为按顺序拼接的全部结果（*out_len 字节），使用 xdelta_free_data 释放；
+// 参数不合法或被取消时返回错误码且不返回结果。
+int xdelta_create_patches(const uint8_t* data, size_t data_len, xdelta_batch_item* items, size_t count, int format,
+                          int secondary, int level, int threads, uint64_t source_window, const xdelta_cancel* cancel,
+                          uint8_t** out, size_t* out_len, char** err);
+// 文件版本：旧文件按需随机读取，补丁流式读取，结果写入 out_path（失败时删除）。stats 可以为 NULL。
+// max_output 与 xdelta_apply_patch_data_cancel 相同；use_mmap 与 xdelta_create_patch_file 相同，只映射旧文件。
+int xdelta_apply_patch_file(const char* old_path, const char* patch_path, const char* out_path,
+                            uint64_t max_output, int use_mmap, xdelta_file_stats* stats, char** err);
+// 文件描述符版本：old_fd、new_fd、patch_fd（out_fd）是调用方已经打开的文件描述符（Windows 上为 HANDLE），原生层不按路径打开任何文件，
+// 打开时的权限检查完全由调用方决定。调用期间必须保持打开，返回后仍由调用方关闭；顺序读写的文件从当前偏移量开始，
+// 旧文件（应用时）按绝对偏移量随机读取。失败时不会删除已经写入 patch_fd、out_fd 的内容，由调用方处理。
+// xdelta_create_patch_fd 的 source_window 不为 0 时与 xdelta_create_patch_file_window 相同，threads 被忽略。
+int xdelta_create_patch_fd(intptr_t old_fd, intptr_t new_fd, intptr_t patch_fd, uint32_t block_size, int format,
+                           int secondary, int level, int threads, uint64_t source_window, int use_mmap,
+                           xdelta_file_stats* stats, char** err);
+int xdelta_apply_patch_fd(intptr_t old_fd, intptr_t patch_fd, intptr_t out_fd, uint64_t max_output, int use_mmap,
+                          xdelta_file_stats* stats, char** err);
+// 原地应用：把补丁应用到 path 指向的文件本身，只在内存中缓存先被覆盖、后被复制的旧数据，最多 max_spill 字节
+// （0 表示不限制，超出时返回 XDELTA_ERR_OUT_OF_MEMORY）。补丁无效、超出 max_output 或缓存上限时文件不会被修改；
+// 开始写入后失败或被中断会留下内容不可用的文件。stats 可以为 NULL。
+int xdelta_apply_patch_in_place(const char* path, const uint8_t* patch_data, size_t patch_len, uint64_t max_output,
+                                uint64_t max_spill, xdelta_file_stats* stats, char** err);
+
+xdelta_cancel* xdelta_cancel_new(void);
+void xdelta_cancel_trigger(const xdelta_cancel* cancel);
+// 使用该标记的操作已经处理的输入字节数（创建补丁时为旧数据加新数据，应用时为补丁），在窗口之间更新，可以在任意线程调用
+uint64_t xdelta_cancel_progress(const xdelta_cancel* cancel);
+// 调用前必须确保没有正在使用该标记的操作
+void xdelta_cancel_free(xdelta_cancel* cancel);
+
+// 流式编码：先用 add_source 送入全部旧数据，再用 write 分窗口送入新数据，最后 finish。
+// write/finish 通过 out/out_len 返回本次产生的补丁字节，指针归编码器所有，在下一次调用该编码器之前有效。
+// format、secondary、level 与 xdelta_create_patch_data_cancel 相同，flush 时压缩流也会同步刷出
+// （VCDIFF 格式结束当前窗口），已写出的补丁可以立即解码。
+xdelta_encoder* xdelta_encoder_new(uint32_t block_size, int format, int secondary, int level, char** err);
+int xdelta_encoder_add_source(xdelta_encoder* enc, const uint8_t* data, size_t len, char** err);
+// 基于签名的差分（librsync 风格）：持有旧数据的一方 add_source 之后用 signature 取得块签名，
+// 持有新数据的一方在 new 之后立即用 load_signature 载入签名代替旧数据（块大小取自签名），再照常 write/finish；
+// 生成的补丁是普通补丁。签名损坏时返回 XDELTA_ERR_CORRUPT_PATCH，版本不认识时返回 XDELTA_ERR_UNSUPPORTED
+int xdelta_encoder_signature(xdelta_encoder* enc, const uint8_t** out, size_t* out_len, char** err);
+int xdelta_encoder_load_signature(xdelta_encoder* enc, const uint8_t* sig, size_t sig_len, char** err);
+// set_source_offset 声明送入的旧数据从完整旧数据的 offset 处开始，补丁中的 COPY 偏移都加上 offset，
+// 用于对旧数据的一段单独编码而补丁仍应用到完整的旧数据；必须在第一次 write 之前调用。
+int xdelta_encoder_set_source_offset(xdelta_encoder* enc, uint64_t offset, char** err);
+// set_threads 设置编码线程数（0 为全部核心，1 为单线程，默认 1），必须在第一次 write 之前调用：之后的 add_source 并行计算块签名，
+// 新数据在编码器中攒满每个线程 8 MiB 后按分段并行匹配，补丁与同样 threads 的 xdelta_create_patch_data_cancel 一致，
+// 与每次 write 的长度无关（flush 会在当前位置截断分段）；编码器额外缓冲最多 threads × 8 MiB 的新数据。
+int xdelta_encoder_set_threads(xdelta_encoder* enc, int threads, char** err);
+int xdelta_encoder_write(xdelta_encoder* enc, const uint8_t* data, size_t len,
+                         const uint8_t** out, size_t* out_len, char** err);
+// flush 强制在当前位置结束一个窗口，之后仍可继续 write。
+int xdelta_encoder_flush(xdelta_encoder* enc, const uint8_t** out, size_t* out_len, char** err);
+int xdelta_encoder_finish(xdelta_encoder* enc, const uint8_t** out, size_t* out_len, char** err);
+void xdelta_encoder_free(xdelta_encoder* enc);
+
+// 流式解码：补丁分段 write，COPY 引用的旧数据通过 read 回调按需读取，结果通过 write 回调写出。
+// source_len 为旧数据长度，未知时传 -1；max_output 与 xdelta_apply_patch_data_cancel 相同。
+// finish 在补丁截断于记录中途时返回错误；bsdiff 补丁的输出全部在 finish 中写出，source_len 不能为 -1。
+xdelta_decoder* xdelta_decoder_new(xdelta_read_fn read, xdelta_write_fn write, uintptr_t ctx, int64_t source_len,
+                                   uint64_t max_output, char** err);
+int xdelta_decoder_write(xdelta_decoder* dec, const uint8_t* data, size_t len, char** err);
+int xdelta_decoder_finish(xdelta_decoder* dec, char** err);
+void xdelta_decoder_free(xdelta_decoder* dec);
+
+// 绑定到一份旧数据的编码器：new 对旧数据建立一次块签名（旧数据只在调用期间被读取，不会被复制或引用），
+// 之后 diff 对每份新数据编码，结果与用同一份旧数据、块大小和线程数调用 xdelta_create_patch_data_cancel 相同。
+// new 的 threads 用于建立签名，diff 的 threads 用于编码，含义与 xdelta_create_patch_data_cancel 相同。
+// 同一个句柄可以在多个线程中同时 diff；free 之前必须确保没有正在进行的 diff。new 成功时通过 enc 返回句柄。
+int xdelta_source_encoder_new(const uint8_t* old_data, size_t old_len, uint32_t block_size, int threads,
+                              const xdelta_cancel* cancel, xdelta_source_encoder** enc, char** err);
+int xdelta_source_encoder_diff(const xdelta_source_encoder* enc, const uint8_t* new_data, size_t new_len,
+                               uint8_t** patch_data, size_t* patch_len, int format, int secondary, int level,
+                               int threads, const xdelta_cancel* cancel, char** err);
+// from_signature 从 xdelta_encoder_signature 生成的签名建立同样的句柄，不需要旧数据，签名只解析和建索引一次；
+// stream 创建共享句柄块签名的流式编码器，直接 write/finish，与句柄各自释放，先后不限，可以并发调用
+int xdelta_source_encoder_from_signature(const uint8_t* sig, size_t sig_len, xdelta_source_encoder** enc, char** err);
+xdelta_encoder* xdelta_source_encoder_stream(const xdelta_source_encoder* enc, int format, int secondary, int level,
+                                             char** err);
+void xdelta_source_encoder_free(xdelta_source_encoder* enc);
+
+// 内容定义分块的签名（rsync 风格的同步，块边界由内容决定）：chunk_signature 把旧数据按平均 avg_chunk 字节
+// （2 的幂，64 到 1 MiB，否则返回 XDELTA_ERR_INVALID_ARGUMENT）的内容定义分块切开，为每块记录长度和 SHA-256（每块 36 字节），
+// 通过 sig 返回，使用 xdelta_free_data 释放。patch_from_chunk_signature 用同样的方式切开新数据，与签名中长度和 SHA-256
+// 相同的块写成 COPY（连续的合并成一个），其余写成 ADD，得到普通补丁，不需要旧数据；插入、删除只影响附近的块，
+// 两侧不需要像 xdelta_encoder_signature 的定长块那样逐字节滑动查找。format、secondary、level 与 xdelta_create_patch_data_cancel
+// 相同，不接受 XDELTA_FORMAT_BSDIFF，只影响块匹配的标记被忽略；总是单线程编码。cancel 可以为 NULL。
+// 签名损坏时返回 XDELTA_ERR_CORRUPT_PATCH，版本不认识时返回 XDELTA_ERR_UNSUPPORTED
+int xdelta_create_chunk_signature(const uint8_t* old_data, size_t old_len, uint32_t avg_chunk, const xdelta_cancel* cancel,
+                                  uint8_t** sig, size_t* sig_len, char** err);
+int xdelta_create_patch_from_chunk_signature(const uint8_t* sig, size_t sig_len, const uint8_t* new_data, size_t new_len,
+                                             int format, int secondary, int level, const xdelta_cancel* cancel,
+                                             uint8_t** patch_data, size_t* patch_len, char** err);
+
+// 绑定到一份旧数据的解码器：new 复制一份旧数据（无法分配时返回 XDELTA_ERR_OUT_OF_MEMORY），
+// 之后 apply 把补丁应用到这份副本，与 xdelta_apply_patch_data_cancel 相同，max_output、cancel 的含义也相同。
+// 同一个句柄可以在多个线程中同时 apply；free 之前必须确保没有正在进行的 apply。new 成功时通过 dec 返回句柄。
+int xdelta_source_decoder_new(const uint8_t* old_data, size_t old_len, xdelta_source_decoder** dec, char** err);
+int xdelta_source_decoder_apply(const xdelta_source_decoder* dec, const uint8_t* patch_data, size_t patch_len,
+                                uint8_t** new_data, size_t* new_len, uint64_t max_output,
+                                const xdelta_cancel* cancel, char** err);
+// 预先分配版本，与 xdelta_apply_patch_exact 相同：dst_cap 必须是补丁声明的输出长度（xdelta_validate_patch_data 的 new_len）。
+int xdelta_source_decoder_apply_exact(const xdelta_source_decoder* dec, const uint8_t* patch_data, size_t patch_len,
+                                      uint8_t* dst, size_t dst_cap, const xdelta_cancel* cancel, char** err);
+void xdelta_source_decoder_free(xdelta_source_decoder* dec);
+
+// 以文本形式列出补丁的结构（相当于 xdelta3 printdelta），不需要旧数据，结果通过 write 回调分段写出。
+// instructions 非 0 时逐条列出 ADD、COPY、RUN 指令和校验和记录，否则只列出文件头、窗口头和合计；输出是确定的。
+// 补丁不合法时，出错位置之前的内容已经写出。
+int xdelta_dump_patch(const uint8_t* patch_data, size_t patch_len, int instructions, xdelta_write_fn write,
+                      uintptr_t ctx, char** err);
+
+// 设置接收日志的回调和最低级别，低于 level 的日志不会生成；cb 为 NULL 或 level 为 XDELTA_LOG_OFF 时不再输出。
+// 回调可能在原生库的任意线程上被并发调用（包括多线程编码的工作线程），不能调用本库的函数。
+// 可以随时调用，但已经进入回调的调用不受影响，替换 cb 时调用方需要确保旧的回调仍然可以被调用。
+void xdelta_set_log(xdelta_log_fn cb, int level);
+
+// 填写原生库的版本信息，info 为 NULL 时什么也不做；可以在任意时刻、任意线程调用
+void xdelta_version(xdelta_version_info* info);
+
+// 填写跨越 FFI 边界、尚未释放的内存的统计，用于排查调用方忘记释放的情况，stats 为 NULL 时什么也不做；
+// 库内部在一次调用中分配和释放的内存不计入。计数是原子的，可以在任意时刻、任意线程调用，
+// 与其他线程的调用并发时各项之间不保证是同一时刻的值
+void xdelta_debug_alloc_stats(xdelta_alloc_stats* stats);
+
+// 填写原生库的资源统计，stats 为 NULL 时什么也不做；压缩库的 C 代码自行 malloc 的内存和映射的文件不计入 current_bytes。
+// 计数是原子的，开销只是几次原子读取，可以在任意时刻、任意线程调用，与其他线程的调用并发时各项之间不保证是同一时刻的值
+void xdelta_native_stats(xdelta_native_stats_info* stats);
+
+// 释放本库通过输出参数返回的缓冲区和错误信息；只能传入本库返回的指针，不能用 free 释放，NULL 会被忽略
 void xdelta_free_data(uint8_t* data);
-const char* xdelta_last_error(void);
+void xdelta_free_error(char* err);
 
 #ifdef __cplusplus
 }
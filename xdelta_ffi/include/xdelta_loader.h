@@ -0,0 +1,27 @@
+// xdelta_loader.h
+#ifndef XDELTA_LOADER_H
+#define XDELTA_LOADER_H
+
+#include <stddef.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// xdelta_load 的返回值：库的 ABI 修订号比 XDELTA_ABI_VERSION 旧（或没有 xdelta_version）
+#define XDELTA_LOAD_ABI_MISMATCH -2
+
+// 在运行时加载 path 指定的 libxdelta 动态库，先用 xdelta_version 检查 ABI 修订号，再解析 xdelta_interface.h 中的全部函数。
+// 返回 0 表示成功；失败时返回 -1（ABI 不符时为 XDELTA_LOAD_ABI_MISMATCH），并把错误信息写入 errbuf（最多 errlen 字节，以 '\0' 结尾）。
+// 成功加载之前不能调用 xdelta_interface.h 中的任何函数；不是线程安全的，由调用方保证不与其他调用并发。
+int xdelta_load(const char* path, char* errbuf, size_t errlen);
+
+// 卸载 xdelta_load 加载的动态库并清空函数指针，之后可以再次调用 xdelta_load；没有加载时什么也不做。
+// 调用方保证此时没有其他线程在调用 xdelta_interface.h 中的函数，也没有未释放的句柄。
+void xdelta_unload(void);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif // XDELTA_LOADER_H
@@ -0,0 +1,77 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultInPlaceSpill 未通过 WithInPlaceSpill 指定时 ApplyDiffsInPlace 最多在内存中缓存的旧数据量（字节）
+const DefaultInPlaceSpill = 64 << 20
+
+// WithInPlaceSpill 设置 ApplyDiffsInPlace 最多在内存中缓存的旧数据量（字节），不大于 0 时不限制；对其他接口没有影响
+func WithInPlaceSpill(size int64) Option {
+	return func(o *options) {
+		o.inPlaceSpill = max(size, 0)
+	}
+}
+
+// ApplyDiffsInPlace 把内存中的补丁原地应用到 path 指向的文件，不需要临时文件，也不需要第二份文件的磁盘空间
+// 原生层按依赖顺序执行补丁中的 COPY，保证每段旧数据在被覆盖前已复制到位；互相覆盖的 COPY（例如交换两半）
+// 中较短的一段先读入内存，总量超过 WithInPlaceSpill 的上限时返回 ErrOutOfMemory；之后写入字面数据并截断或扩展到输出长度
+// 补丁无效、COPY 超出文件（ErrSourceMismatch）、输出超过 WithMaxOutputSize 的上限或缓存超过上限时文件不会被修改；
+// 一旦开始写入，失败、进程崩溃或掉电都会留下既不是旧内容也不是新内容的文件，无法恢复，
+// 只应用于能够重新获取的文件，需要保证不损坏时使用 ApplyDiffsFile；补丁中的校验和（见 WithChecksum）不做校验
+func ApplyDiffsInPlace(path string, patch []byte, opts ...Option) error {
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	h, patch, err := o.openEnvelopeAt(patch, fileSize(path))
+	if err != nil {
+		return err
+	}
+	if h != nil && o.verifySource {
+		_, sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum != h.SourceSHA256 {
+			return fmt.Errorf("%w: source SHA-256 differs from the envelope", ErrSourceMismatch)
+		}
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if _, err := applyPatchInPlace(path, patch, o.outputLimit(), uint64(o.inPlaceSpill)); err != nil {
+		return fmt.Errorf("apply patch to %s in place: %w", path, err)
+	}
+	if h != nil {
+		n, sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		return h.checkTarget(n, sum)
+	}
+	return nil
+}
+
+// fileSHA256 返回文件 path 的长度和 SHA-256
+func fileSHA256(path string) (int64, [sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	h.Sum(sum[:0])
+	return n, sum, err
+}
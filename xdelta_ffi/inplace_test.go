@@ -0,0 +1,138 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inPlacePairs ApplyDiffsInPlace 测试的新旧数据：输出比旧文件短、长、一样长，
+// 以及旧数据的两半互换、整体前移和后移这些 COPY 会覆盖之后还要读取的旧数据的情况
+func inPlacePairs() []struct {
+	name             string
+	oldData, newData []byte
+} {
+	oldData, newData := textFixture(512 << 10)
+	half := len(oldData) / 2
+	r := fixtureRand(56)
+	lines := bytes.Join(fixtureLines(&r, 30000), nil)
+	return []struct {
+		name             string
+		oldData, newData []byte
+	}{
+		{"shrink", oldData, append(bytes.Clone(oldData[:100000]), oldData[300000:]...)},
+		{"grow", oldData, append(append(bytes.Clone(oldData[:200000]), lines...), oldData[200000:]...)},
+		{"same size", oldData, append(bytes.Clone(newData[:len(newData)/2]), oldData[len(newData)/2:]...)[:len(oldData)]},
+		{"swap halves", oldData, append(bytes.Clone(oldData[half:]), oldData[:half]...)},
+		{"shift forward", oldData, append(bytes.Clone(lines[:5000]), oldData...)},
+		{"shift back", oldData, bytes.Clone(oldData[5000:])},
+		{"text edits", oldData, newData},
+		{"to empty", oldData, nil},
+		{"from empty", nil, newData},
+	}
+}
+
+// TestApplyDiffsInPlace 在原文件上应用补丁得到与 ApplyDiffsData 相同的内容，文件被截断或扩展到输出长度；
+// 覆盖缩小、增大、长度不变和互相覆盖的 COPY，以及本库格式、二次压缩、VCDIFF 和信封
+func TestApplyDiffsInPlace(t *testing.T) {
+	requireNative(t)
+	dir := t.TempDir()
+	for _, f := range []struct {
+		name string
+		opts []Option
+	}{
+		{"native", nil},
+		{"zstd", []Option{WithSecondaryCompression(SecondaryZstd)}},
+		{"vcdiff", []Option{WithStandardVCDIFF()}},
+		{"small blocks", []Option{WithBlockSize(64)}},
+	} {
+		for _, p := range inPlacePairs() {
+			patch, err := CreateDiffs(p.oldData, p.newData, f.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "file")
+			if err := os.WriteFile(path, p.oldData, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ApplyDiffsInPlace(path, patch); err != nil {
+				t.Fatalf("%s, %s: %v", f.name, p.name, err)
+			}
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, p.newData) {
+				t.Fatalf("%s, %s: file holds %d bytes, want %d (%v)", f.name, p.name, len(got), len(p.newData), err)
+			}
+		}
+	}
+
+	for _, p := range inPlacePairs() {
+		env, err := CreateEnvelope(p.oldData, p.newData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "envelope")
+		if err := os.WriteFile(path, p.oldData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyDiffsInPlace(path, env); err != nil {
+			t.Fatalf("envelope, %s: %v", p.name, err)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, p.newData) {
+			t.Fatalf("envelope, %s: file holds %d bytes, want %d", p.name, len(got), len(p.newData))
+		}
+	}
+}
+
+// TestApplyDiffsInPlaceUnchanged 在开始写入之前发现的错误不修改文件：损坏的补丁、COPY 超出文件、
+// 输出超过 WithMaxOutputSize、互换两半需要缓存的旧数据超过 WithInPlaceSpill、信封的旧数据不符
+func TestApplyDiffsInPlaceUnchanged(t *testing.T) {
+	requireNative(t)
+	oldData, _ := textFixture(512 << 10)
+	half := len(oldData) / 2
+	swapped := append(bytes.Clone(oldData[half:]), oldData[:half]...)
+	patch, err := CreateDiffs(oldData, swapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := CreateEnvelope(oldData, swapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Clone(oldData)
+	changed[100] ^= 1
+	path := filepath.Join(t.TempDir(), "file")
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		patch []byte
+		opts  []Option
+		want  error
+	}{
+		{"corrupt patch", oldData, patch[:len(patch)/2], nil, ErrCorruptPatch},
+		{"copy past the file", oldData[:half], patch, nil, ErrSourceMismatch},
+		{"output too large", oldData, patch, []Option{WithMaxOutputSize(1000)}, ErrOutputTooLarge},
+		{"spill too large", oldData, patch, []Option{WithInPlaceSpill(4096)}, ErrOutOfMemory},
+		{"envelope source", changed, env, []Option{WithVerifyOutput(), WithVerifySource()}, ErrSourceMismatch},
+	} {
+		if err := os.WriteFile(path, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyDiffsInPlace(path, tc.patch, tc.opts...); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, tc.data) {
+			t.Fatalf("%s: the file was modified", tc.name)
+		}
+	}
+	// 上限足够时同一个补丁可以应用
+	if err := os.WriteFile(path, oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyDiffsInPlace(path, patch, WithInPlaceSpill(int64(half)+1)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, swapped) {
+		t.Fatal("swapping the halves gave the wrong content")
+	}
+}
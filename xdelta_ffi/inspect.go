@@ -0,0 +1,188 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// PatchInfo 补丁的组成，见 InspectPatch
+type PatchInfo struct {
+	// Format 补丁格式："native"（本库的记录格式）、"vcdiff" 或 "bsdiff"
+	Format string
+	// Secondary 二次压缩器：本库格式为 "zlib"、"zstd"、"lz4"、"lzma"、"djw"、"fgk"，VCDIFF 为 "djw"、"lzma"、"fgk"，
+	// bsdiff 总是 "bzip2"；没有二次压缩时为空
+	Secondary string
+	// Enveloped 补丁是否包在 CreateEnvelope 生成的信封中，以下统计均针对信封内的补丁
+	Enveloped bool
+	// Windows VCDIFF 的窗口数，其他格式为 0
+	Windows int64
+	// Instructions ADD、COPY、RUN 指令的个数；本库格式为记录数，bsdiff 为控制项数
+	Instructions int64
+	// AddBytes 补丁中直接携带的字节数（bsdiff 为额外块的字节数）
+	AddBytes int64
+	// CopyBytes 从旧数据复制的字节数（bsdiff 为差分块的字节数）
+	CopyBytes int64
+	// RunBytes VCDIFF RUN 指令生成的字节数
+	RunBytes int64
+	// TargetSize 补丁声明的输出长度，可以用于在应用之前分配输出
+	TargetSize int64
+	// SourceSize 应用补丁需要的旧数据长度：信封为记录的旧数据长度；本库格式和 VCDIFF 为最远的 COPY
+	// （VCDIFF 为最远的源数据段）的结束位置，旧数据至少这么长，更长也可以应用；bsdiff 不限制旧数据的长度，为 -1
+	SourceSize int64
+	// BlockSize 创建补丁时的块大小，只有信封记录，其他补丁为 0；补丁也不记录压缩级别
+	BlockSize uint32
+	// Checksum 补丁中逐段校验输出的校验和（WithChecksum），没有时为 ChecksumNone
+	Checksum ChecksumKind
+	// SourceSHA256、TargetSHA256 信封记录的旧数据和新数据的 SHA-256，不是信封时为零
+	SourceSHA256 [sha256.Size]byte
+	TargetSHA256 [sha256.Size]byte
+	// PatchSize 补丁本身的长度，包括信封头
+	PatchSize int64
+	// Ratio PatchSize 与 TargetSize 之比，越小补丁越省空间；TargetSize 为 0 时为 0
+	Ratio float64
+}
+
+// patchInfoC 与 xdelta_interface.h 中的 xdelta_patch_info 布局一致
+type patchInfoC struct {
+	format       uint32
+	secondary    uint32
+	windows      uint64
+	instructions uint64
+	addBytes     uint64
+	copyBytes    uint64
+	runBytes     uint64
+	targetSize   uint64
+	sourceSize   uint64
+	checksum     uint32
+}
+
+// InspectPatch 在没有旧数据的情况下统计补丁的组成，支持本库格式、VCDIFF（包括 xdelta3 生成的补丁）、
+// bsdiff 和信封；与 ValidateFormat 一样解析整个补丁，结构有误时返回相同的错误
+// 信封的 SourceSize 与补丁中的 COPY 不一致（旧数据比 COPY 的范围短）时返回 ErrCorruptPatch
+// 用二次压缩器压缩的 VCDIFF 补丁无法解析指令，返回 ErrUnsupportedPatch
+func InspectPatch(diffsData []byte) (PatchInfo, error) {
+	patch := diffsData
+	var h EnvelopeHeader
+	enveloped := IsEnvelope(diffsData)
+	if enveloped {
+		var err error
+		if h, patch, err = ParseEnvelope(diffsData); err != nil {
+			return PatchInfo{}, err
+		}
+	}
+	info, err := inspectPatch(patch)
+	if err != nil {
+		return PatchInfo{}, err
+	}
+	if enveloped && info.TargetSize != h.TargetSize {
+		return PatchInfo{}, fmt.Errorf("%w: patch declares %d bytes of output, the envelope expects %d", ErrCorruptPatch, info.TargetSize, h.TargetSize)
+	}
+	if enveloped && info.SourceSize > h.SourceSize {
+		return PatchInfo{}, fmt.Errorf("%w: patch copies up to offset %d, the envelope has %d bytes of source", ErrCorruptPatch, info.SourceSize, h.SourceSize)
+	}
+	if enveloped {
+		info.Enveloped = true
+		info.SourceSize = h.SourceSize
+		info.BlockSize = h.BlockSize
+		info.SourceSHA256, info.TargetSHA256 = h.SourceSHA256, h.TargetSHA256
+	}
+	info.PatchSize = int64(len(diffsData))
+	if info.TargetSize > 0 {
+		info.Ratio = float64(info.PatchSize) / float64(info.TargetSize)
+	}
+	return info, nil
+}
+
+func inspectPatch(patch []byte) (PatchInfo, error) {
+	if isBSDiff(patch) {
+		p, err := parseBSDiff(patch, 0)
+		if err != nil {
+			return PatchInfo{}, err
+		}
+		st, err := p.apply(io.Discard, nil, 0)
+		if err != nil {
+			return PatchInfo{}, err
+		}
+		return PatchInfo{
+			Format:       "bsdiff",
+			Secondary:    "bzip2",
+			Instructions: st.entries,
+			AddBytes:     st.extraBytes,
+			CopyBytes:    st.diffBytes,
+			TargetSize:   p.newSize,
+			SourceSize:   -1,
+		}, nil
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return PatchInfo{}, err
+	}
+	defer release()
+	c, err := inspectPatchData(patch)
+	if err != nil {
+		return PatchInfo{}, err
+	}
+	info := PatchInfo{
+		Format:       "native",
+		Windows:      int64(c.windows),
+		Instructions: int64(c.instructions),
+		AddBytes:     int64(c.addBytes),
+		CopyBytes:    int64(c.copyBytes),
+		RunBytes:     int64(c.runBytes),
+		TargetSize:   int64(c.targetSize),
+		SourceSize:   int64(c.sourceSize),
+		Checksum:     ChecksumKind(c.checksum),
+	}
+	if c.format == formatVCDIFF {
+		info.Format = "vcdiff"
+		info.Secondary = vcdiffSecondaryName(c.secondary)
+	} else if s := SecondaryCompression(c.secondary); s != SecondaryNone {
+		info.Secondary = s.String()
+	}
+	return info, nil
+}
+
+// vcdiffSecondaryName VCDIFF 文件头中的二次压缩器 ID（xdelta3 的编号）
+func vcdiffSecondaryName(id uint32) string {
+	switch id {
+	case 0:
+		return ""
+	case 1:
+		return "djw"
+	case 2:
+		return "lzma"
+	case 16:
+		return "fgk"
+	default:
+		return fmt.Sprintf("unknown(%d)", id)
+	}
+}
+
+// PatchTargetSize 返回补丁声明的输出长度，用于在应用前预分配空间或显示进度，不需要旧数据，也不做解码
+// VCDIFF 只解析窗口头，耗时与窗口数成正比；bsdiff 和信封直接读取头部记录的长度，信封内的补丁不做检查；
+// 本库格式没有文件头，需要遍历全部记录（跳过 ADD 数据），二次压缩的补丁还需要解压
+// 补丁截断或头部不合法时返回 ErrCorruptPatch；长度只是补丁的声明，应用时仍可能失败
+func PatchTargetSize(diffsData []byte) (int64, error) {
+	if IsEnvelope(diffsData) {
+		h, _, err := ParseEnvelope(diffsData)
+		return h.TargetSize, err
+	}
+	if isBSDiff(diffsData) {
+		p, err := parseBSDiff(diffsData, 0)
+		return p.newSize, err
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	n, err := patchTargetSize(diffsData)
+	if err != nil {
+		return 0, err
+	}
+	if int64(n) < 0 {
+		return 0, fmt.Errorf("%w: patch declares %d bytes of output", ErrCorruptPatch, n)
+	}
+	return int64(n), nil
+}
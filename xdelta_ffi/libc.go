@@ -0,0 +1,58 @@
+package xdelta_ffi
+
+import (
+	"debug/elf"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Linux 上原生库的两种构建，分别链接 glibc 和 musl（Alpine 等），文件名为 libxdelta-gnu.so、libxdelta-musl.so
+const (
+	libcGNU  = "gnu"
+	libcMusl = "musl"
+)
+
+// detectedLibc 运行中的 Linux 系统使用的 C 库，其他系统为空字符串
+var detectedLibc = sync.OnceValue(func() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	return detectLibc()
+})
+
+// detectLibc 先看本进程的 ELF 解释器（动态链接器）是 ld-musl 还是 ld-linux；
+// 静态链接（例如 CGO_ENABLED=0 的 purego 构建）没有解释器时，看系统中有没有 musl 的动态链接器
+func detectLibc() string {
+	if f, err := elf.Open("/proc/self/exe"); err == nil {
+		defer f.Close()
+		for _, p := range f.Progs {
+			if p.Type != elf.PT_INTERP {
+				continue
+			}
+			b := make([]byte, p.Filesz)
+			if _, err := p.ReadAt(b, 0); err == nil {
+				if strings.Contains(filepath.Base(string(b)), "musl") {
+					return libcMusl
+				}
+				return libcGNU
+			}
+		}
+	}
+	for _, dir := range []string{"/lib", "/usr/lib"} {
+		if m, _ := filepath.Glob(filepath.Join(dir, "ld-musl-*.so.1")); len(m) > 0 {
+			return libcMusl
+		}
+	}
+	return libcGNU
+}
+
+// libraryVariant 返回与当前系统匹配的原生库文件名：Linux 上为 libxdelta-gnu.so 或 libxdelta-musl.so，
+// 其他系统与 libraryName 相同；内嵌和下载的原生库都按它选择
+func libraryVariant() string {
+	if libc := detectedLibc(); libc != "" {
+		return "libxdelta-" + libc + ".so"
+	}
+	return libraryName()
+}
@@ -0,0 +1,153 @@
+package xdelta_ffi
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// SetMaxConcurrentOperations 限制同时进行的原生操作数为 n，不大于 0 时不限制（默认）：
+// 每次创建、应用、校验、合并补丁在调用原生层之前占用一个名额，结束后归还，没有空位时按到达顺序排队等待，
+// 避免突发的大量请求各自持有的原生缓冲区累加起来耗尽内存。Encoder、Decoder、NewApplyReader 返回的读取器、
+// SourceEncoder、SourceDecoder 等句柄在每次调用原生层（Write、Read、Diff、Apply、Close 等）期间占用名额，空闲时不占用；
+// 目录、批量、补丁链等组合接口按其中的每次原生调用分别计数，多个 worker 并行时各占一个名额
+// 等待期间 ctx 结束（*Context 接口和 CreateDiffsBatch）或 WithTimeout 到期时不再排队，返回 ctx.Err() 或包装了 ErrTimeout 的错误
+// 可以随时调用；调小时已经开始的操作不受影响，之后的操作等到低于新上限才开始，调大或取消限制时立即放行排队中的操作
+// 当前正在进行和排队的操作数见 NativeStats 返回的 InFlightOperations、QueuedOperations
+// 注意 Decoder、ApplyDiffsStream 等把结果写入调用方 io.Writer 的接口在写入期间仍占用名额，
+// 不要在这些 io.Writer 中再调用本包的函数，n 较小时会互相等待而死锁
+func SetMaxConcurrentOperations(n int) {
+	opLimit.setLimit(int64(max(n, 0)))
+}
+
+// opLimit 所有原生操作共用的并发上限
+var opLimit opLimiter
+
+// releaseOp 放开原生库并归还 opLimit 的一个名额；预先建好的函数值，acquireOp、holdOp 返回它时不分配内存
+var releaseOp = func() {
+	libLock.RUnlock()
+	opLimit.release()
+}
+
+// opLimiter 先到先得的计数信号量，limit 为 0 时不限制但仍然统计正在进行的操作数
+type opLimiter struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	waiters list.List // 按到达顺序排队的 chan struct{}，获得名额时关闭
+
+	inFlight atomic.Int64
+	queued   atomic.Int64
+}
+
+func (l *opLimiter) setLimit(n int64) {
+	l.mu.Lock()
+	l.limit = n
+	l.wakeLocked()
+	l.mu.Unlock()
+}
+
+// acquire 占用一个名额，done 关闭时放弃等待并返回 false；done 为 nil 时一直等待
+func (l *opLimiter) acquire(done <-chan struct{}) bool {
+	l.mu.Lock()
+	if l.waiters.Len() == 0 && (l.limit == 0 || l.used < l.limit) {
+		l.used++
+		l.mu.Unlock()
+		l.inFlight.Add(1)
+		return true
+	}
+	ready := make(chan struct{})
+	e := l.waiters.PushBack(ready)
+	l.queued.Add(1)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		l.queued.Add(-1)
+		l.inFlight.Add(1)
+		return true
+	case <-done:
+	}
+	l.mu.Lock()
+	select {
+	case <-ready:
+		// 放弃的同时已经获得了名额，还回去
+		l.used--
+	default:
+		l.waiters.Remove(e)
+	}
+	l.wakeLocked()
+	l.mu.Unlock()
+	l.queued.Add(-1)
+	return false
+}
+
+func (l *opLimiter) release() {
+	l.inFlight.Add(-1)
+	l.mu.Lock()
+	l.used--
+	l.wakeLocked()
+	l.mu.Unlock()
+}
+
+// wakeLocked 按顺序把空出的名额交给排队的操作
+func (l *opLimiter) wakeLocked() {
+	for l.waiters.Len() > 0 && (l.limit == 0 || l.used < l.limit) {
+		e := l.waiters.Front()
+		l.waiters.Remove(e)
+		l.used++
+		close(e.Value.(chan struct{}))
+	}
+}
+
+// acquireOp 在调用原生层之前占用一个并发操作的名额并持有原生库（见 useLibrary），t 不为 nil 时同时建立它的原生取消标记；
+// 成功时返回的 release 必须在原生调用结束后调用一次。等待期间 t 的 ctx 结束或 WithTimeout 到期时放弃，
+// 返回 ctx.Err() 或包装了 ErrTimeout 的错误；t 为 nil 时一直等待
+func acquireOp(t *cancelToken) (release func(), err error) {
+	var done <-chan struct{}
+	if t != nil {
+		done = t.fired
+	}
+	if !opLimit.acquire(done) {
+		return nil, t.stopErr("while waiting for a free operation slot")
+	}
+	if err := enterLibrary(); err != nil {
+		opLimit.release()
+		return nil, err
+	}
+	if t == nil {
+		return releaseOp, nil
+	}
+	t.arm()
+	return func() {
+		t.disarm()
+		releaseOp()
+	}, nil
+}
+
+// acquireOpContext 与 acquireOp 相同，ctx 结束时放弃等待并返回 ctx.Err()，用于没有取消标记的原生调用
+func acquireOpContext(ctx context.Context) (release func(), err error) {
+	if !opLimit.acquire(ctx.Done()) {
+		return nil, ctx.Err()
+	}
+	if err := enterLibrary(); err != nil {
+		opLimit.release()
+		return nil, err
+	}
+	return releaseOp, nil
+}
+
+// holdOp 与 acquireOp(nil) 相同，一直等到占用一个名额，用于无法取消的原生调用
+func holdOp() (release func(), err error) {
+	return acquireOp(nil)
+}
+
+// stopErr 返回 t 的 ctx 结束或到期时的错误，what 说明当时在做什么
+func (t *cancelToken) stopErr(what string) error {
+	if t.expired.Load() {
+		return fmt.Errorf("%w after %v %s", ErrTimeout, t.timeout, what)
+	}
+	return t.ctx.Err()
+}
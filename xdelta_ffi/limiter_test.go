@@ -0,0 +1,128 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gateWriter 在 gate 关闭之前阻塞每次 Write 的 io.Writer，ApplyDiffsStream 因此一直占用名额
+type gateWriter struct {
+	gate <-chan struct{}
+	bytes.Buffer
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.Buffer.Write(p)
+}
+
+// waitOps 等到 NativeStats 报告 inFlight 个正在进行、queued 个排队的操作
+func waitOps(t *testing.T, inFlight, queued int64) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s, err := NativeStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.InFlightOperations == inFlight && s.QueuedOperations == queued {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d in flight and %d queued, want %d and %d", s.InFlightOperations, s.QueuedOperations, inFlight, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestSetMaxConcurrentOperations 上限为 2 时第三、四个操作排队；排队中的操作在 WithTimeout 到期或 ctx 取消时放弃，
+// 返回 ErrTimeout 或 ctx.Err()；取消限制后排队的操作立即开始，全部得到正确的结果
+func TestSetMaxConcurrentOperations(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetMaxConcurrentOperations(2)
+	t.Cleanup(func() { SetMaxConcurrentOperations(0) })
+
+	gate := make(chan struct{})
+	outs := make([]*gateWriter, 4)
+	errs := make([]error, len(outs))
+	var wg sync.WaitGroup
+	for i := range outs {
+		outs[i] = &gateWriter{gate: gate}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), outs[i])
+		}()
+	}
+	waitOps(t, 2, 2)
+
+	if _, err := CreateDiffs(oldData, newData, WithTimeout(20*time.Millisecond)); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("queued past WithTimeout: got %v, want ErrTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := CreateDiffsContext(ctx, oldData, newData); !errors.Is(err, context.Canceled) {
+		t.Fatalf("queued until the context was canceled: got %v, want context.Canceled", err)
+	}
+	waitOps(t, 2, 2)
+
+	SetMaxConcurrentOperations(0)
+	waitOps(t, 4, 0)
+	close(gate)
+	wg.Wait()
+	for i, out := range outs {
+		if errs[i] != nil || !bytes.Equal(out.Bytes(), newData) {
+			t.Fatalf("operation %d: %d bytes, %v", i, out.Len(), errs[i])
+		}
+	}
+	waitOps(t, 0, 0)
+}
+
+// TestOpLimiterOrder 名额按到达顺序交给排队的操作，放弃等待的操作不占用名额
+func TestOpLimiterOrder(t *testing.T) {
+	var l opLimiter
+	l.setLimit(1)
+	l.acquire(nil)
+	canceled := make(chan struct{})
+	close(canceled)
+	if l.acquire(canceled) {
+		t.Fatal("acquired a slot with a closed done channel while the limit was reached")
+	}
+	var order []int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.acquire(nil)
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			l.release()
+		}()
+		// 等这个操作排上队再开始下一个
+		for l.queued.Load() != int64(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.release()
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("slots handed out in order %v", order)
+		}
+	}
+	if l.used != 0 || l.inFlight.Load() != 0 || l.queued.Load() != 0 {
+		t.Fatalf("%d used, %d in flight, %d queued after all operations", l.used, l.inFlight.Load(), l.queued.Load())
+	}
+}
@@ -0,0 +1,354 @@
+//go:build cgo && !xdelta_purego && !xdelta_static
+
+// loader.c
+// 运行时加载 libxdelta：xdelta_interface.h 中的每个函数在这里都有一个同名的转发实现，
+// 通过 xdelta_load 解析出的函数指针调用到动态库中，因此编译时不需要链接 libxdelta。
+#include <stdio.h>
+#include <string.h>
+
+#ifdef _WIN32
+#include <windows.h>
+#else
+#include <dlfcn.h>
+#endif
+
+#include "xdelta_interface.h"
+#include "xdelta_loader.h"
+
+// 有返回值的函数：X(返回类型, 函数名, 参数列表, 实参列表)
+#define XDELTA_FUNCS(X)                                                                              \
+    X(int, xdelta_create_patch_data,                                                                 \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* new_data, size_t new_len,             \
+       uint8_t** patch_data, size_t* patch_len, uint32_t block_size, char** err),                    \
+      (old_data, old_len, new_data, new_len, patch_data, patch_len, block_size, err))                \
+    X(int, xdelta_create_patch_data_cancel,                                                          \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* new_data, size_t new_len,             \
+       uint8_t** patch_data, size_t* patch_len, uint32_t block_size, int format, int secondary,      \
+       int level, int threads, const xdelta_cancel* cancel, char** err),                             \
+      (old_data, old_len, new_data, new_len, patch_data, patch_len, block_size, format, secondary,   \
+       level, threads, cancel, err))                                                                 \
+    X(int, xdelta_create_patch_data_window,                                                          \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* new_data, size_t new_len,             \
+       uint8_t** patch_data, size_t* patch_len, uint32_t block_size, int format, int secondary,      \
+       int level, uint64_t source_window, const xdelta_cancel* cancel, char** err),                  \
+      (old_data, old_len, new_data, new_len, patch_data, patch_len, block_size, format, secondary,   \
+       level, source_window, cancel, err))                                                           \
+    X(int, xdelta_apply_patch_data,                                                                  \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* patch_data, size_t patch_len,         \
+       uint8_t** new_data, size_t* new_len, char** err),                                             \
+      (old_data, old_len, patch_data, patch_len, new_data, new_len, err))                            \
+    X(int, xdelta_apply_patch_data_cancel,                                                           \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* patch_data, size_t patch_len,         \
+       uint8_t** new_data, size_t* new_len, uint64_t max_output, const xdelta_cancel* cancel,        \
+       char** err),                                                                                  \
+      (old_data, old_len, patch_data, patch_len, new_data, new_len, max_output, cancel, err))        \
+    X(int, xdelta_apply_patch_into,                                                                  \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* patch_data, size_t patch_len,         \
+       uint8_t* dst, size_t dst_cap, size_t* new_len, char** err),                                   \
+      (old_data, old_len, patch_data, patch_len, dst, dst_cap, new_len, err))                        \
+    X(int, xdelta_apply_patch_exact,                                                                 \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* patch_data, size_t patch_len,         \
+       uint8_t* dst, size_t dst_cap, const xdelta_cancel* cancel, char** err),                       \
+      (old_data, old_len, patch_data, patch_len, dst, dst_cap, cancel, err))                         \
+    X(int, xdelta_verify_patch_data,                                                                 \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* patch_data, size_t patch_len,         \
+       uint64_t max_output, uint64_t* new_len, uint8_t* sha256, const xdelta_cancel* cancel,         \
+       char** err),                                                                                  \
+      (old_data, old_len, patch_data, patch_len, max_output, new_len, sha256, cancel, err))          \
+    X(int, xdelta_validate_patch_data,                                                               \
+      (const uint8_t* patch_data, size_t patch_len, int64_t source_len, uint64_t* new_len,           \
+       char** err),                                                                                  \
+      (patch_data, patch_len, source_len, new_len, err))                                             \
+    X(int, xdelta_inspect_patch_data,                                                                \
+      (const uint8_t* patch_data, size_t patch_len, xdelta_patch_info* info, char** err),            \
+      (patch_data, patch_len, info, err))                                                            \
+    X(int, xdelta_patch_target_size,                                                                 \
+      (const uint8_t* patch_data, size_t patch_len, uint64_t* new_len, char** err),                  \
+      (patch_data, patch_len, new_len, err))                                                         \
+    X(int, xdelta_patch_segments,                                                                    \
+      (const uint8_t* patch_data, size_t patch_len, uint64_t segment_size,                           \
+       xdelta_patch_segment** segments, size_t* count, size_t* header_len, char** err),              \
+      (patch_data, patch_len, segment_size, segments, count, header_len, err))                       \
+    X(int, xdelta_patch_file_segments,                                                               \
+      (const char* patch_path, uint64_t segment_size, xdelta_patch_segment** segments, size_t* count,\
+       size_t* header_len, char** err),                                                              \
+      (patch_path, segment_size, segments, count, header_len, err))                                  \
+    X(int, xdelta_patch_source_ranges,                                                               \
+      (const uint8_t* patch_data, size_t patch_len, uint64_t gap, xdelta_source_range** ranges,      \
+       size_t* count, char** err),                                                                   \
+      (patch_data, patch_len, gap, ranges, count, err))                                              \
+    X(int, xdelta_merge_patches,                                                                     \
+      (const uint8_t* patches, const size_t* lens, size_t count, uint8_t** merged_data,              \
+       size_t* merged_len, char** err),                                                              \
+      (patches, lens, count, merged_data, merged_len, err))                                          \
+    X(int, xdelta_create_chunk_signature,                                                            \
+      (const uint8_t* old_data, size_t old_len, uint32_t avg_chunk, const xdelta_cancel* cancel,     \
+       uint8_t** sig, size_t* sig_len, char** err),                                                  \
+      (old_data, old_len, avg_chunk, cancel, sig, sig_len, err))                                     \
+    X(int, xdelta_create_patch_from_chunk_signature,                                                 \
+      (const uint8_t* sig, size_t sig_len, const uint8_t* new_data, size_t new_len, int format,      \
+       int secondary, int level, const xdelta_cancel* cancel, uint8_t** patch_data,                  \
+       size_t* patch_len, char** err),                                                               \
+      (sig, sig_len, new_data, new_len, format, secondary, level, cancel, patch_data, patch_len,     \
+       err))                                                                                         \
+    X(int, xdelta_create_patch_file,                                                                 \
+      (const char* old_path, const char* new_path, const char* patch_path, uint32_t block_size,      \
+       int format, int secondary, int level, int threads, int use_mmap, xdelta_file_stats* stats,    \
+       char** err),                                                                                  \
+      (old_path, new_path, patch_path, block_size, format, secondary, level, threads, use_mmap,      \
+       stats, err))                                                                                  \
+    X(int, xdelta_create_patch_file_window,                                                          \
+      (const char* old_path, const char* new_path, const char* patch_path, uint32_t block_size,      \
+       int format, int secondary, int level, uint64_t source_window, int use_mmap,                   \
+       xdelta_file_stats* stats, char** err),                                                        \
+      (old_path, new_path, patch_path, block_size, format, secondary, level, source_window, use_mmap,\
+       stats, err))                                                                                  \
+    X(int, xdelta_create_patch_fd,                                                                   \
+      (intptr_t old_fd, intptr_t new_fd, intptr_t patch_fd, uint32_t block_size, int format,        \
+       int secondary, int level, int threads, uint64_t source_window, int use_mmap,                  \
+       xdelta_file_stats* stats, char** err),                                                        \
+      (old_fd, new_fd, patch_fd, block_size, format, secondary, level, threads, source_window,       \
+       use_mmap, stats, err))                                                                        \
+    X(int, xdelta_create_patch_data_to_file,                                                         \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* new_data, size_t new_len,             \
+       const char* patch_path, uint32_t block_size, int format, int secondary, int level, int threads,\
+       uint64_t source_window, const xdelta_cancel* cancel, xdelta_file_stats* stats, char** err),   \
+      (old_data, old_len, new_data, new_len, patch_path, block_size, format, secondary, level, threads,\
+       source_window, cancel, stats, err))                                                           \
+    X(int, xdelta_create_patch_into,                                                                 \
+      (const uint8_t* old_data, size_t old_len, const uint8_t* new_data, size_t new_len, uint8_t* dst,\
+       size_t dst_cap, size_t* patch_len, uint32_t block_size, int format, int secondary, int level,  \
+       int threads, uint64_t source_window, const xdelta_cancel* cancel, char** err),                 \
+      (old_data, old_len, new_data, new_len, dst, dst_cap, patch_len, block_size, format, secondary,  \
+       level, threads, source_window, cancel, err))                                                  \
+    X(int, xdelta_create_patches,                                                                    \
+      (const uint8_t* data, size_t data_len, xdelta_batch_item* items, size_t count, int format,     \
+       int secondary, int level, int threads, uint64_t source_window, const xdelta_cancel* cancel,   \
+       uint8_t** out, size_t* out_len, char** err),                                                  \
+      (data, data_len, items, count, format, secondary, level, threads, source_window, cancel, out,  \
+       out_len, err))                                                                                \
+    X(int, xdelta_apply_patch_file,                                                                  \
+      (const char* old_path, const char* patch_path, const char* out_path, uint64_t max_output,      \
+       int use_mmap, xdelta_file_stats* stats, char** err),                                          \
+      (old_path, patch_path, out_path, max_output, use_mmap, stats, err))                            \
+    X(int, xdelta_apply_patch_fd,                                                                    \
+      (intptr_t old_fd, intptr_t patch_fd, intptr_t out_fd, uint64_t max_output, int use_mmap,       \
+       xdelta_file_stats* stats, char** err),                                                        \
+      (old_fd, patch_fd, out_fd, max_output, use_mmap, stats, err))                                  \
+    X(int, xdelta_apply_patch_in_place,                                                              \
+      (const char* path, const uint8_t* patch_data, size_t patch_len, uint64_t max_output,           \
+       uint64_t max_spill, xdelta_file_stats* stats, char** err),                                    \
+      (path, patch_data, patch_len, max_output, max_spill, stats, err))                              \
+    X(xdelta_cancel*, xdelta_cancel_new, (void), ())                                                 \
+    X(uint64_t, xdelta_cancel_progress, (const xdelta_cancel* cancel), (cancel))                     \
+    X(xdelta_encoder*, xdelta_encoder_new,                                                           \
+      (uint32_t block_size, int format, int secondary, int level, char** err),                       \
+      (block_size, format, secondary, level, err))                                                   \
+    X(int, xdelta_encoder_add_source,                                                                \
+      (xdelta_encoder* enc, const uint8_t* data, size_t len, char** err), (enc, data, len, err))     \
+    X(int, xdelta_encoder_signature,                                                                 \
+      (xdelta_encoder* enc, const uint8_t** out, size_t* out_len, char** err),                       \
+      (enc, out, out_len, err))                                                                      \
+    X(int, xdelta_encoder_load_signature,                                                            \
+      (xdelta_encoder* enc, const uint8_t* sig, size_t sig_len, char** err),                         \
+      (enc, sig, sig_len, err))                                                                      \
+    X(int, xdelta_encoder_set_source_offset, (xdelta_encoder* enc, uint64_t offset, char** err),     \
+      (enc, offset, err))                                                                            \
+    X(int, xdelta_encoder_set_threads, (xdelta_encoder* enc, int threads, char** err),               \
+      (enc, threads, err))                                                                           \
+    X(int, xdelta_encoder_write,                                                                     \
+      (xdelta_encoder* enc, const uint8_t* data, size_t len, const uint8_t** out, size_t* out_len,   \
+       char** err),                                                                                  \
+      (enc, data, len, out, out_len, err))                                                           \
+    X(int, xdelta_encoder_flush,                                                                     \
+      (xdelta_encoder* enc, const uint8_t** out, size_t* out_len, char** err),                       \
+      (enc, out, out_len, err))                                                                      \
+    X(int, xdelta_encoder_finish,                                                                    \
+      (xdelta_encoder* enc, const uint8_t** out, size_t* out_len, char** err),                       \
+      (enc, out, out_len, err))                                                                      \
+    X(xdelta_decoder*, xdelta_decoder_new,                                                           \
+      (xdelta_read_fn read, xdelta_write_fn write, uintptr_t ctx, int64_t source_len,                \
+       uint64_t max_output, char** err),                                                             \
+      (read, write, ctx, source_len, max_output, err))                                               \
+    X(int, xdelta_decoder_write,                                                                     \
+      (xdelta_decoder* dec, const uint8_t* data, size_t len, char** err), (dec, data, len, err))     \
+    X(int, xdelta_decoder_finish, (xdelta_decoder* dec, char** err), (dec, err))                     \
+    X(int, xdelta_source_encoder_new,                                                                \
+      (const uint8_t* old_data, size_t old_len, uint32_t block_size, int threads,                    \
+       const xdelta_cancel* cancel, xdelta_source_encoder** enc, char** err),                        \
+      (old_data, old_len, block_size, threads, cancel, enc, err))                                    \
+    X(int, xdelta_source_encoder_diff,                                                               \
+      (const xdelta_source_encoder* enc, const uint8_t* new_data, size_t new_len,                    \
+       uint8_t** patch_data, size_t* patch_len, int format, int secondary, int level,                \
+       int threads, const xdelta_cancel* cancel, char** err),                                        \
+      (enc, new_data, new_len, patch_data, patch_len, format, secondary, level, threads, cancel,     \
+       err))                                                                                         \
+    X(int, xdelta_source_encoder_from_signature,                                                     \
+      (const uint8_t* sig, size_t sig_len, xdelta_source_encoder** enc, char** err),                 \
+      (sig, sig_len, enc, err))                                                                      \
+    X(xdelta_encoder*, xdelta_source_encoder_stream,                                                 \
+      (const xdelta_source_encoder* enc, int format, int secondary, int level, char** err),          \
+      (enc, format, secondary, level, err))                                                          \
+    X(int, xdelta_source_decoder_new,                                                                \
+      (const uint8_t* old_data, size_t old_len, xdelta_source_decoder** dec, char** err),            \
+      (old_data, old_len, dec, err))                                                                 \
+    X(int, xdelta_source_decoder_apply,                                                              \
+      (const xdelta_source_decoder* dec, const uint8_t* patch_data, size_t patch_len,                \
+       uint8_t** new_data, size_t* new_len, uint64_t max_output, const xdelta_cancel* cancel,        \
+       char** err),                                                                                  \
+      (dec, patch_data, patch_len, new_data, new_len, max_output, cancel, err))                      \
+    X(int, xdelta_source_decoder_apply_exact,                                                        \
+      (const xdelta_source_decoder* dec, const uint8_t* patch_data, size_t patch_len, uint8_t* dst,  \
+       size_t dst_cap, const xdelta_cancel* cancel, char** err),                                     \
+      (dec, patch_data, patch_len, dst, dst_cap, cancel, err))                                       \
+    X(int, xdelta_dump_patch,                                                                        \
+      (const uint8_t* patch_data, size_t patch_len, int instructions, xdelta_write_fn write,         \
+       uintptr_t ctx, char** err),                                                                   \
+      (patch_data, patch_len, instructions, write, ctx, err))
+
+// 无返回值的函数：X(函数名, 参数列表, 实参列表)
+#define XDELTA_VOID_FUNCS(X)                                                       \
+    X(xdelta_cancel_trigger, (const xdelta_cancel* cancel), (cancel))              \
+    X(xdelta_cancel_free, (xdelta_cancel* cancel), (cancel))                       \
+    X(xdelta_encoder_free, (xdelta_encoder* enc), (enc))                           \
+    X(xdelta_decoder_free, (xdelta_decoder* dec), (dec))                           \
+    X(xdelta_source_encoder_free, (xdelta_source_encoder* enc), (enc))             \
+    X(xdelta_source_decoder_free, (xdelta_source_decoder* dec), (dec))             \
+    X(xdelta_set_log, (xdelta_log_fn cb, int level), (cb, level))                  \
+    X(xdelta_version, (xdelta_version_info* info), (info))                         \
+    X(xdelta_debug_alloc_stats, (xdelta_alloc_stats* stats), (stats))              \
+    X(xdelta_native_stats, (xdelta_native_stats_info* stats), (stats))             \
+    X(xdelta_free_data, (uint8_t* data), (data))                                   \
+    X(xdelta_free_error, (char* err), (err))
+
+#define DECLARE_PTR(ret, name, params, args) static ret(*p_##name) params;
+#define DECLARE_VOID_PTR(name, params, args) static void(*p_##name) params;
+XDELTA_FUNCS(DECLARE_PTR)
+XDELTA_VOID_FUNCS(DECLARE_VOID_PTR)
+
+#define DEFINE_FN(ret, name, params, args) \
+    ret name params { return p_##name args; }
+#define DEFINE_VOID_FN(name, params, args) \
+    void name params { p_##name args; }
+XDELTA_FUNCS(DEFINE_FN)
+XDELTA_VOID_FUNCS(DEFINE_VOID_FN)
+
+typedef struct {
+    const char* name;
+    void** ptr;
+} symbol;
+
+#define SYMBOL(ret, name, params, args) {#name, (void**)&p_##name},
+#define VOID_SYMBOL(name, params, args) {#name, (void**)&p_##name},
+static const symbol symbols[] = {
+    XDELTA_FUNCS(SYMBOL)
+    XDELTA_VOID_FUNCS(VOID_SYMBOL)
+};
+
+#ifdef _WIN32
+
+// 旧版 mingw 头文件中没有这两个标志（Windows 8 / KB2533623 引入）
+#ifndef LOAD_LIBRARY_SEARCH_DLL_LOAD_DIR
+#define LOAD_LIBRARY_SEARCH_DLL_LOAD_DIR 0x00000100
+#endif
+#ifndef LOAD_LIBRARY_SEARCH_SYSTEM32
+#define LOAD_LIBRARY_SEARCH_SYSTEM32 0x00000800
+#endif
+
+// path 必须是绝对路径；xdelta.dll 及其依赖只从 DLL 所在目录和 System32 中查找，不使用当前工作目录和 PATH
+static void* open_library(const char* path, char* errbuf, size_t errlen) {
+    wchar_t wpath[MAX_PATH * 4];
+    if (MultiByteToWideChar(CP_UTF8, 0, path, -1, wpath, sizeof(wpath) / sizeof(wpath[0])) == 0) {
+        snprintf(errbuf, errlen, "invalid library path (error %lu)", (unsigned long)GetLastError());
+        return NULL;
+    }
+    HMODULE h = LoadLibraryExW(wpath, NULL, LOAD_LIBRARY_SEARCH_DLL_LOAD_DIR | LOAD_LIBRARY_SEARCH_SYSTEM32);
+    if (h == NULL) {
+        snprintf(errbuf, errlen, "LoadLibraryEx failed (error %lu)", (unsigned long)GetLastError());
+    }
+    return (void*)h;
+}
+
+static void* find_symbol(void* lib, const char* name) {
+    return (void*)GetProcAddress((HMODULE)lib, name);
+}
+
+static void close_library(void* lib) {
+    FreeLibrary((HMODULE)lib);
+}
+
+#else
+
+static void* open_library(const char* path, char* errbuf, size_t errlen) {
+    void* h = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+    if (h == NULL) {
+        const char* msg = dlerror();
+        snprintf(errbuf, errlen, "%s", msg != NULL ? msg : "dlopen failed");
+    }
+    return h;
+}
+
+static void* find_symbol(void* lib, const char* name) {
+    return dlsym(lib, name);
+}
+
+static void close_library(void* lib) {
+    dlclose(lib);
+}
+
+#endif
+
+// 当前加载的动态库，xdelta_unload 时关闭
+static void* loaded_library;
+
+int xdelta_load(const char* path, char* errbuf, size_t errlen) {
+    void* lib = open_library(path, errbuf, errlen);
+    if (lib == NULL) {
+        return -1;
+    }
+
+    // 先通过 xdelta_version 确认 ABI，旧版本的库即使恰好导出了全部符号，行为也可能与本头文件不一致
+    void (*version)(xdelta_version_info*) = (void (*)(xdelta_version_info*))find_symbol(lib, "xdelta_version");
+    if (version == NULL) {
+        snprintf(errbuf, errlen, "missing symbol xdelta_version (the library predates ABI revision %d)", XDELTA_ABI_VERSION);
+        close_library(lib);
+        return XDELTA_LOAD_ABI_MISMATCH;
+    }
+    xdelta_version_info info;
+    memset(&info, 0, sizeof(info));
+    version(&info);
+    if (info.abi < XDELTA_ABI_VERSION) {
+        info.crate_version[sizeof(info.crate_version) - 1] = '\0';
+        snprintf(errbuf, errlen, "library %s has ABI revision %u, older than the %d this package requires",
+                 info.crate_version, (unsigned)info.abi, XDELTA_ABI_VERSION);
+        close_library(lib);
+        return XDELTA_LOAD_ABI_MISMATCH;
+    }
+
+    void* found[sizeof(symbols) / sizeof(symbols[0])];
+    for (size_t i = 0; i < sizeof(symbols) / sizeof(symbols[0]); i++) {
+        found[i] = find_symbol(lib, symbols[i].name);
+        if (found[i] == NULL) {
+            snprintf(errbuf, errlen, "missing symbol %s", symbols[i].name);
+            close_library(lib);
+            return -1;
+        }
+    }
+    // 全部符号都解析成功后才提交，失败时不会留下只加载了一半的函数表
+    for (size_t i = 0; i < sizeof(symbols) / sizeof(symbols[0]); i++) {
+        *symbols[i].ptr = found[i];
+    }
+    loaded_library = lib;
+    return 0;
+}
+
+void xdelta_unload(void) {
+    if (loaded_library == NULL) {
+        return;
+    }
+    for (size_t i = 0; i < sizeof(symbols) / sizeof(symbols[0]); i++) {
+        *symbols[i].ptr = NULL;
+    }
+    close_library(loaded_library);
+    loaded_library = NULL;
+}
@@ -0,0 +1,415 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LibraryPathEnv 指定原生库路径的环境变量，优先级仅次于 SetLibraryPath
+const LibraryPathEnv = "XDELTA_LIB_PATH"
+
+var (
+	// initMu 串行化 Init 和 Shutdown；initResult 为 nil 表示还没有加载（或已被 Shutdown 卸载）
+	initMu     sync.Mutex
+	initResult atomic.Pointer[initState]
+
+	// libLock 保护已加载的原生库：调用原生层期间持有读锁，Shutdown 只在拿到写锁时卸载
+	libLock sync.RWMutex
+
+	libMu      sync.Mutex
+	libPath    string   // SetLibraryPath 设置的路径
+	libSHA256  string   // SetLibrarySHA256 设置的十六进制 SHA-256
+	libNames   []string // SetLibraryNames 设置的文件名
+	loadedPath string   // 实际加载的路径
+
+	// embeddedLibrary 在 xdelta_embed 构建下把内嵌的原生库解压到缓存目录并返回其路径
+	embeddedLibrary func() (string, error)
+)
+
+// SetLibraryPath 显式指定原生库路径，必须在 Init（或第一次调用任意接口）之前调用，之后调用没有效果
+func SetLibraryPath(path string) {
+	libMu.Lock()
+	libPath = path
+	libMu.Unlock()
+}
+
+// SetLibrarySHA256 要求加载的原生库文件的 SHA-256 为 sum（十六进制，大小写均可），为空时不检查（默认）；
+// 与 SetLibraryPath 一样必须在 Init 之前调用。设置后 Init 尝试的每个路径都先计算文件的 SHA-256，
+// 不一致（或 sum 不是合法的 SHA-256）时跳过该路径并在错误信息中说明，用于防止加载被替换或植入的库
+// 校验和加载之间文件仍可能被替换，库所在的目录本身也应当只有可信的用户可以写入
+func SetLibrarySHA256(sum string) {
+	libMu.Lock()
+	libSHA256 = sum
+	libMu.Unlock()
+}
+
+// SetLibraryNames 设置 Init 在可执行文件所在目录和 bin/ 中依次尝试的文件名，不调用或 names 为空时使用默认的顺序：
+// Linux 上先尝试与检测到的 C 库匹配的 libxdelta-gnu.so 或 libxdelta-musl.so，再尝试 libxdelta.so；
+// 其他系统只有 libxdelta.dylib 或 xdelta.dll。与 SetLibraryPath 一样必须在 Init 之前调用
+// C 库由本进程的 ELF 解释器（静态链接时为系统中是否有 /lib/ld-musl-*）判断，判断有误时用它指定正确的文件名
+func SetLibraryNames(names ...string) {
+	libMu.Lock()
+	libNames = append([]string(nil), names...)
+	libMu.Unlock()
+}
+
+// LibraryPath 返回实际加载的原生库路径，尚未加载或加载失败时返回空字符串
+func LibraryPath() string {
+	libMu.Lock()
+	defer libMu.Unlock()
+	return loadedPath
+}
+
+// initState 一次 Init 的结果
+type initState struct {
+	err error
+}
+
+// Init 加载原生库，只会真正执行一次，之后返回第一次的结果（Shutdown 之后的下一次调用会重新加载）
+// 导入本包不会有任何副作用；未显式调用 Init 时，第一次调用任意接口会自动执行，
+// 加载失败时该接口返回的就是 Init 的错误
+//
+// 依次尝试以下位置，使用第一个加载成功的：
+//  1. SetLibraryPath 指定的路径
+//  2. 环境变量 XDELTA_LIB_PATH
+//  3. 使用 xdelta_embed 构建时，内嵌并解压到缓存目录的原生库（Linux 上为与检测到的 C 库匹配的一种），
+//     之后是 SetEmbeddedLibraries 注册（例如导入 xdelta_ffi/embedded）的当前平台的库
+//  4. 可执行文件所在目录，依次尝试 SetLibraryNames 的文件名（下同）
+//  5. 当前工作目录下的 bin/（Windows 上不尝试）
+//
+// 相对路径先转换成绝对路径再加载，LibraryPath 返回的也是绝对路径。Windows 上用
+// LOAD_LIBRARY_SEARCH_DLL_LOAD_DIR | LOAD_LIBRARY_SEARCH_SYSTEM32 加载：xdelta.dll 及其依赖只从 DLL 所在目录
+// 和 System32 中查找，不会使用当前工作目录和 PATH，避免程序在用户可写的目录中运行时被植入同名 DLL（DLL 劫持）
+//
+// 使用 cgo 和 xdelta_static 标签构建时原生库静态链接进程序，以上位置都不会尝试，SetLibraryPath 等设置不起作用，
+// LibraryPath 返回 "(static)"
+//
+// 加载每个动态库时先调用 xdelta_version 与原生库握手：ABI 修订号比 WrapperABIVersion 旧的库（通常是升级后残留的旧文件）
+// 在解析其余函数之前就被拒绝并尝试下一个位置，都不可用时返回的错误满足 errors.Is(err, ErrIncompatibleLibrary)，
+// 并列出每个路径上库的版本；比本包新的库可以加载（ABI 只会新增），记录一条警告
+func Init() error {
+	if s := initResult.Load(); s != nil {
+		return s.err
+	}
+	initMu.Lock()
+	defer initMu.Unlock()
+	if s := initResult.Load(); s != nil {
+		return s.err
+	}
+	var err error
+	if !nativeBackend {
+		// 没有原生库可以加载，应用补丁的接口由纯 Go 解码器实现
+		nativeLoaded.Store(true)
+	} else if err = loadNative(); err == nil {
+		nativeLoaded.Store(true)
+		syncLogLevel()
+		checkABI()
+	}
+	initResult.Store(&initState{err: err})
+	return err
+}
+
+// enterLibrary 持有 libLock 的读锁，成功时调用方用完后必须 libLock.RUnlock；库已被 Shutdown 卸载时先重新加载
+// 读锁可以重入：Shutdown 只用 TryLock 获取写锁，不会出现等待中的写者阻塞新的读者
+func enterLibrary() error {
+	libLock.RLock()
+	if !nativeLoaded.Load() {
+		if err := Init(); err != nil {
+			libLock.RUnlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// useLibrary 与 enterLibrary 相同，返回放开原生库的函数，用于不占用并发名额的原生调用（创建句柄、解析补丁结构等）
+func useLibrary() (release func(), err error) {
+	if err := enterLibrary(); err != nil {
+		return nil, err
+	}
+	return libLock.RUnlock, nil
+}
+
+// shutdownTimeout Shutdown 等待正在进行的操作结束的时间
+const shutdownTimeout = 10 * time.Second
+
+// Shutdown 卸载原生库，用于插件宿主卸载插件之前和测试末尾检查资源是否全部释放：
+// 先等待正在进行的原生调用结束，并要求所有 Encoder、Decoder、SourceEncoder、SourceDecoder、SignatureIndex、
+// NewApplyReader 返回的读取器等句柄都已 Close；10 秒内仍有调用或未关闭的句柄时返回包装了 ErrBusy 的错误，库保持加载
+// 卸载时关闭原生层日志，原生层交给本包的缓冲区还没有全部释放时（本包的 bug）记录一条警告；dlopen 加载的库随即被关闭，
+// LibraryPath 返回空字符串。之后调用任意接口都会像第一次一样按 Init 的顺序重新加载，没有加载过时 Shutdown 什么也不做
+// 等待期间新的调用照常进行，持续有调用时可能一直等不到空闲；需要更长或更短的等待时用 ShutdownContext
+func Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return ShutdownContext(ctx)
+}
+
+// ShutdownContext 与 Shutdown 相同，等到 ctx 结束为止，结束时返回包装了 ErrBusy 和 ctx.Err() 的错误
+func ShutdownContext(ctx context.Context) error {
+	initMu.Lock()
+	defer initMu.Unlock()
+	s := initResult.Load()
+	if s == nil {
+		return nil
+	}
+	if s.err != nil {
+		// 加载失败的结果也不再缓存，下一次调用重新尝试
+		initResult.Store(nil)
+		return nil
+	}
+	tick := time.NewTicker(time.Millisecond)
+	defer tick.Stop()
+	for {
+		if libLock.TryLock() {
+			// 持有写锁时没有进行中的原生调用，句柄计数为 0 就说明没有别的东西引用原生库
+			if a := nativeAllocStats(); a.liveHandles == 0 {
+				if a.liveBuffers != 0 {
+					logf(LevelWarn, "unloading native library with %d buffers (%d bytes) not freed", a.liveBuffers, a.liveBytes)
+				}
+				unloadLibrary()
+				libLock.Unlock()
+				return nil
+			}
+			libLock.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %d operations in flight, %d native handles open: %w",
+				ErrBusy, opLimit.inFlight.Load(), nativeAllocStats().liveHandles, ctx.Err())
+		case <-tick.C:
+		}
+	}
+}
+
+// unloadLibrary 关闭原生层日志并卸载原生库，调用方持有 initMu 和 libLock 的写锁
+func unloadLibrary() {
+	setNativeLog(levelOff)
+	nativeLoaded.Store(false)
+	closeLibrary()
+	libMu.Lock()
+	loadedPath = ""
+	libMu.Unlock()
+	initResult.Store(nil)
+}
+
+// Supported 报告当前构建能否使用原生库（会触发 Init），
+// 返回 false 时创建补丁的接口都会失败，调用方可以据此退回到其他方案，例如下载完整文件
+// 没有原生后端的构建（CGO_ENABLED=0 且未使用 xdelta_purego 标签）总是返回 false：Init 成功但不加载任何库，
+// 本库格式和 VCDIFF 补丁由纯 Go 解码器应用（zstd 二次压缩的补丁除外），创建补丁等其余需要原生层的接口返回 ErrNotSupported
+func Supported() bool {
+	return nativeBackend && Init() == nil
+}
+
+// InitOptions InitWithOptions 的参数，零值字段表示不修改对应的设置
+type InitOptions struct {
+	// LibraryPath 同 SetLibraryPath
+	LibraryPath string
+	// SHA256 同 SetLibrarySHA256
+	SHA256 string
+	// Names 同 SetLibraryNames
+	Names []string
+}
+
+// InitWithOptions 按 opts 调用 SetLibraryPath、SetLibrarySHA256、SetLibraryNames 后执行 Init，
+// 便于在一处配置加载方式；库已经加载时设置不起作用，返回的是已有的 Init 结果。
+// 没有静态链接的构建方式：不能依赖外部文件时使用 xdelta_embed 把原生库内嵌到程序中
+func InitWithOptions(opts InitOptions) error {
+	if opts.LibraryPath != "" {
+		SetLibraryPath(opts.LibraryPath)
+	}
+	if opts.SHA256 != "" {
+		SetLibrarySHA256(opts.SHA256)
+	}
+	if len(opts.Names) > 0 {
+		SetLibraryNames(opts.Names...)
+	}
+	return Init()
+}
+
+// MustInit 与 Init 相同，但加载失败时 panic，适合在 main 中尽早调用
+func MustInit() {
+	if err := Init(); err != nil {
+		panic(err)
+	}
+}
+
+// libraryNames 返回 Init 在每个目录中依次尝试的文件名，见 SetLibraryNames
+func libraryNames() []string {
+	libMu.Lock()
+	names := libNames
+	libMu.Unlock()
+	if len(names) > 0 {
+		return names
+	}
+	if v := libraryVariant(); v != libraryName() {
+		return []string{v, libraryName()}
+	}
+	return []string{libraryName()}
+}
+
+// libraryName 返回当前平台下动态库的通用文件名
+func libraryName() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "xdelta.dll"
+	case "darwin":
+		return "libxdelta.dylib"
+	default:
+		return "libxdelta.so"
+	}
+}
+
+// candidate 一个待尝试的原生库路径，err 非空时表示该路径无法得到（例如内嵌库解压失败）
+type candidate struct {
+	path string
+	err  error
+}
+
+// libraryCandidates 按优先级返回要尝试的原生库路径
+func libraryCandidates() []candidate {
+	var cs []candidate
+	libMu.Lock()
+	if libPath != "" {
+		cs = append(cs, candidate{path: libPath})
+	}
+	libMu.Unlock()
+	if p := os.Getenv(LibraryPathEnv); p != "" {
+		cs = append(cs, candidate{path: p})
+	}
+	if embeddedLibrary != nil {
+		p, err := embeddedLibrary()
+		if p == "" {
+			p = "(embedded)"
+		}
+		cs = append(cs, candidate{path: p, err: err})
+	}
+	if p, ok, err := extractRegistered(); ok {
+		if p == "" {
+			p = "(embedded " + embeddedPlatformDir() + ")"
+		}
+		cs = append(cs, candidate{path: p, err: err})
+	}
+	names := libraryNames()
+	if exe, err := os.Executable(); err == nil {
+		for _, name := range names {
+			cs = append(cs, candidate{path: filepath.Join(filepath.Dir(exe), name)})
+		}
+	}
+	// Windows 上工作目录是 DLL 植入的常见位置，不从这里加载
+	if runtime.GOOS != "windows" {
+		for _, name := range names {
+			cs = append(cs, candidate{path: filepath.Join("bin", name)})
+		}
+	}
+	return cs
+}
+
+// staticLibraryPath 使用 xdelta_static 构建时 LibraryPath 返回的值
+const staticLibraryPath = "(static)"
+
+// loadNative 加载原生库；静态链接时不需要加载，只记录 staticLibraryPath
+func loadNative() error {
+	if staticLinked {
+		libMu.Lock()
+		loadedPath = staticLibraryPath
+		libMu.Unlock()
+		return nil
+	}
+	return loadFirst(libraryCandidates())
+}
+
+// loadFirst 依次尝试 cs，失败时错误信息中列出每个路径及其失败原因
+func loadFirst(cs []candidate) error {
+	tried := make([]string, 0, len(cs))
+	stale := false
+	libMu.Lock()
+	sum := libSHA256
+	libMu.Unlock()
+	for _, c := range cs {
+		err := c.err
+		if err == nil {
+			c.path, err = filepath.Abs(c.path)
+		}
+		if err == nil {
+			err = load(c.path, sum)
+		}
+		if err == nil {
+			libMu.Lock()
+			loadedPath = c.path
+			libMu.Unlock()
+			return nil
+		}
+		if errors.Is(err, ErrIncompatibleLibrary) {
+			stale = true
+		}
+		tried = append(tried, fmt.Sprintf("%s: %v", c.path, err))
+	}
+	if stale {
+		// 至少有一个库因为 ABI 过旧被跳过，最可能的原因是残留的旧库文件，错误本身也满足 errors.Is(err, ErrIncompatibleLibrary)
+		return fmt.Errorf("%w: found only native libraries older than ABI revision %d (replace them with the library built "+
+			"from this version, or call SetLibraryPath); tried:\n\t%s", ErrIncompatibleLibrary, WrapperABIVersion, strings.Join(tried, "\n\t"))
+	}
+	var libc string
+	if l := detectedLibc(); l != "" {
+		libc = fmt.Sprintf("detected %s libc, looked for %s; ", l, strings.Join(libraryNames(), ", "))
+	}
+	return fmt.Errorf("xdelta: failed to load native library (build it with `cargo build --release`, "+
+		"then call SetLibraryPath or set %s); %stried:\n\t%s", LibraryPathEnv, libc, strings.Join(tried, "\n\t"))
+}
+
+// load 加载 path，sum 非空时先检查文件的 SHA-256
+func load(path, sum string) error {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("not found")
+		}
+		return err
+	}
+	if sum != "" {
+		if err := checkLibrarySHA256(path, sum); err != nil {
+			return err
+		}
+	}
+
+	return openLibrary(path)
+}
+
+// checkLibrarySHA256 检查 path 的 SHA-256 是否为十六进制的 want
+func checkLibrarySHA256(path, want string) error {
+	expected, err := hex.DecodeString(want)
+	if err != nil || len(expected) != sha256.Size {
+		return fmt.Errorf("%w: invalid library SHA-256 %q", ErrInvalidArgument, want)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], expected) {
+		return fmt.Errorf("SHA-256 is %x, expected %s", got, strings.ToLower(want))
+	}
+	return nil
+}
+
+// verifyFile 检查 path 的内容哈希是否为 sum
+func verifyFile(path string, sum [sha256.Size]byte) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], sum[:]) {
+		return fmt.Errorf("checksum mismatch for library %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build cgo && !xdelta_purego && xdelta_static
+
+// loader_static.c
+// 使用 xdelta_static 构建时 libxdelta 静态链接进程序，xdelta_interface.h 中的函数直接由 libxdelta.a 提供，
+// 这里只保留 xdelta_loader.h 的接口：不需要加载任何东西。
+#include "xdelta_loader.h"
+
+int xdelta_load(const char* path, char* errbuf, size_t errlen) {
+    (void)path;
+    (void)errbuf;
+    (void)errlen;
+    return 0;
+}
+
+void xdelta_unload(void) {
+}
@@ -0,0 +1,187 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShutdownInFlight 原生调用进行期间 ShutdownContext 拿不到写锁（TryLock 失败），ctx 到期时返回包装了 ErrBusy 和
+// context.DeadlineExceeded 的错误，库保持加载，调用照常完成；之后 Shutdown 等到调用结束再卸载
+func TestShutdownInFlight(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(64 << 20)
+	want, err := CreateDiffsData(oldData, newData, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		patch []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		patch, err := CreateDiffsData(oldData, newData, 0)
+		done <- result{patch, err}
+	}()
+	for opLimit.inFlight.Load() == 0 {
+		time.Sleep(100 * time.Microsecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err = ShutdownContext(ctx)
+	if !errors.Is(err, ErrBusy) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ShutdownContext during a call: got %v, want ErrBusy and context.DeadlineExceeded", err)
+	}
+	if LibraryPath() == "" {
+		t.Fatal("the library was unloaded during a call")
+	}
+	// Shutdown 在调用结束之前一直等待，不会让调用失败
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil || !bytes.Equal(r.patch, want) {
+		t.Fatalf("call during Shutdown: %d bytes, %v", len(r.patch), r.err)
+	}
+	if p := LibraryPath(); p != "" {
+		t.Fatalf("LibraryPath after Shutdown: %q", p)
+	}
+}
+
+// TestShutdownOpenHandle 有未 Close 的句柄时 ShutdownContext 在 ctx 取消时返回 ErrBusy 和 context.Canceled，
+// 句柄仍然可以使用；Close 之后 Shutdown 成功，再次 Shutdown 什么也不做
+func TestShutdownOpenHandle(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	var patch bytes.Buffer
+	e, err := NewEncoder(bytes.NewReader(oldData), &patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := ShutdownContext(ctx); !errors.Is(err, ErrBusy) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("ShutdownContext with an open Encoder: got %v, want ErrBusy and context.Canceled", err)
+	}
+	if _, err := e.Write(newData); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ApplyDiffsData(oldData, patch.Bytes()); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("patch written around the failed Shutdown: %d bytes, %v", len(got), err)
+	}
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Shutdown(); err != nil {
+		t.Fatalf("second Shutdown: %v", err)
+	}
+}
+
+// TestInitAfterShutdown Shutdown 之后 Init 重新加载同一个库，任意接口也会自动重新加载；
+// 卸载前后原生层交给本包的缓冲区都已释放
+func TestInitAfterShutdown(t *testing.T) {
+	requireNative(t)
+	path := LibraryPath()
+	oldData, newData := testPair()
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if p := LibraryPath(); p != path {
+		t.Fatalf("LibraryPath after Init: %q, want %q", p, path)
+	}
+	if _, err := Version(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	// 不调用 Init，第一次调用自动加载
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &out); err != nil || !bytes.Equal(out.Bytes(), newData) {
+		t.Fatalf("apply after an implicit reload: %d bytes, %v", out.Len(), err)
+	}
+	if p := LibraryPath(); p != path {
+		t.Fatalf("LibraryPath after the implicit reload: %q, want %q", p, path)
+	}
+	if s, err := DebugAllocStats(); err != nil || s.LiveBuffers != 0 || s.LiveHandles != 0 {
+		t.Fatalf("after the reload: %+v, %v", s, err)
+	}
+}
+
+// TestInitWithOptions InitWithOptions 按 SHA256 检查库文件，不一致时加载失败、不加载任何库，一致时（大小写均可）加载 LibraryPath；
+// 零值字段不修改已有的设置；库已经加载时新的设置不起作用，返回已有的结果
+func TestInitWithOptions(t *testing.T) {
+	requireNative(t)
+	if staticLinked {
+		t.Skip("the native library is linked statically")
+	}
+	path := LibraryPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	libMu.Lock()
+	savedPath, savedSHA, savedNames := libPath, libSHA256, libNames
+	libMu.Unlock()
+	t.Cleanup(func() {
+		Shutdown()
+		libMu.Lock()
+		libPath, libSHA256, libNames = savedPath, savedSHA, savedNames
+		libMu.Unlock()
+		if err := Init(); err != nil {
+			t.Errorf("reload after the test: %v", err)
+		}
+	})
+
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	err = InitWithOptions(InitOptions{LibraryPath: path, SHA256: strings.Repeat("00", sha256.Size), Names: []string{"libnothing.so"}})
+	if err == nil || !strings.Contains(err.Error(), "SHA-256 is") {
+		t.Fatalf("wrong SHA-256: got %v", err)
+	}
+	if p := LibraryPath(); p != "" {
+		t.Fatalf("loaded %q with the wrong SHA-256", p)
+	}
+	if names := libraryNames(); !slices.Equal(names, []string{"libnothing.so"}) {
+		t.Fatalf("library names %v", names)
+	}
+
+	// 失败的结果不缓存；只给 SHA256，路径沿用上面的设置
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitWithOptions(InitOptions{SHA256: strings.ToUpper(hex.EncodeToString(sum[:]))}); err != nil {
+		t.Fatal(err)
+	}
+	if p := LibraryPath(); p != path {
+		t.Fatalf("LibraryPath %q, want %q", p, path)
+	}
+	if err := InitWithOptions(InitOptions{LibraryPath: filepath.Join(t.TempDir(), "missing.so")}); err != nil {
+		t.Fatalf("InitWithOptions after loading: %v", err)
+	}
+	if p := LibraryPath(); p != path {
+		t.Fatalf("LibraryPath changed to %q after loading", p)
+	}
+}
@@ -0,0 +1,116 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// decoyDLLs 在 dir 中写入不是合法 PE 文件的 xdelta.dll、bin\xdelta.dll 以及 xdelta.dll 依赖的系统 DLL 的同名文件，
+// 加载器只要尝试了其中任何一个，加载就会失败或在错误信息中出现它的路径
+func decoyDLLs(tb testing.TB, dir string) {
+	tb.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	for _, name := range []string{"xdelta.dll", `bin\xdelta.dll`, "userenv.dll", "ws2_32.dll", "bcrypt.dll", "ntdll.dll", "advapi32.dll"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("decoy, not a DLL"), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// TestDecoyDLLHelper 由 TestDecoyDLL 在放了诱饵 DLL 的工作目录中运行，XDELTA_DECOY_CASE 选择场景
+func TestDecoyDLLHelper(t *testing.T) {
+	c := os.Getenv("XDELTA_DECOY_CASE")
+	if c == "" {
+		t.Skip("run by TestDecoyDLL")
+	}
+	lib := os.Getenv("XDELTA_DECOY_LIB")
+	switch c {
+	case "cwd":
+		// 没有配置路径：工作目录中的 xdelta.dll 和 bin\xdelta.dll 都不能被尝试
+		err := Init()
+		if err == nil {
+			t.Fatalf("loaded %s without a configured path", LibraryPath())
+		}
+		if wd, _ := os.Getwd(); strings.Contains(strings.ToLower(err.Error()), strings.ToLower(wd)) {
+			t.Fatalf("the loader tried the working directory: %v", err)
+		}
+	case "deps":
+		// 原生库在另一个目录中，工作目录里依赖的同名诱饵不能被使用
+		SetLibraryPath(lib)
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.EqualFold(LibraryPath(), lib) {
+			t.Fatalf("loaded %s, want %s", LibraryPath(), lib)
+		}
+		oldData, newData := testPair()
+		patch, err := CreateDiffs(oldData, newData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ApplyDiffsData(oldData, patch); err != nil {
+			t.Fatal(err)
+		}
+	case "sha-wrong":
+		SetLibraryPath(lib)
+		SetLibrarySHA256(strings.Repeat("00", sha256.Size))
+		if err := Init(); err == nil || !strings.Contains(err.Error(), "SHA-256 is") {
+			t.Fatalf("library with the wrong SHA-256: got %v", err)
+		}
+	case "sha-right":
+		data, err := os.ReadFile(lib)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		SetLibraryPath(lib)
+		SetLibrarySHA256(strings.ToUpper(hex.EncodeToString(sum[:])))
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown case %q", c)
+	}
+}
+
+// TestDecoyDLL Windows 上工作目录中植入的 xdelta.dll、bin\xdelta.dll 和与系统 DLL 同名的文件都不会被加载：
+// 没有配置路径时不回退到工作目录，配置的库的依赖只从它所在的目录和 System32 中解析；SetLibrarySHA256 不一致时拒绝加载。
+// 每个场景在工作目录为诱饵目录的子进程中运行，避免受本进程已经加载的库影响
+func TestDecoyDLL(t *testing.T) {
+	requireNative(t)
+	if staticLinked {
+		t.Skip("the native library is linked statically")
+	}
+	// 原生库复制到单独的目录，避免它原来所在的目录中有其他 DLL
+	lib := filepath.Join(t.TempDir(), "xdelta.dll")
+	data, err := os.ReadFile(LibraryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lib, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"cwd", "deps", "sha-wrong", "sha-right"} {
+		wd := t.TempDir()
+		decoyDLLs(t, wd)
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDecoyDLLHelper$", "-test.count=1")
+		cmd.Dir = wd
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(strings.ToUpper(kv), LibraryPathEnv+"=") {
+				cmd.Env = append(cmd.Env, kv)
+			}
+		}
+		// PATH 中的目录也不能被搜索，把诱饵目录放在最前面
+		cmd.Env = append(cmd.Env, "XDELTA_DECOY_CASE="+c, "XDELTA_DECOY_LIB="+lib, "PATH="+wd+string(os.PathListSeparator)+os.Getenv("PATH"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", c, err, out)
+		}
+	}
+}
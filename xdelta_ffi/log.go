@@ -0,0 +1,129 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Level 原生库诊断日志的级别，取值与 xdelta_interface.h 中的 XDELTA_LOG_* 一致
+type Level int
+
+const (
+	// LevelDebug 每个窗口的编解码统计、返回给调用方的错误等，只在使用 WithVerboseLogging 的操作期间输出
+	LevelDebug Level = iota
+	LevelInfo
+	// LevelWarn 不影响结果的异常，例如文件映射失败后退回到普通读取
+	LevelWarn
+	// LevelError 原生库内部错误，例如解码器 panic（对应的调用返回 ErrCorruptPatch）
+	LevelError
+)
+
+// levelOff XDELTA_LOG_OFF，不输出任何日志
+const levelOff = 4
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+}
+
+var (
+	// logMu 回调期间持有读锁，SetLogger 持有写锁，因此 SetLogger 返回后旧的 logger 不会再被调用
+	logMu  sync.RWMutex
+	logger func(level Level, msg string)
+
+	// verboseOps 正在进行的使用了 WithVerboseLogging 的操作个数
+	verboseOps atomic.Int32
+	// nativeLoaded 原生库已经加载，可以设置原生层的日志级别
+	nativeLoaded atomic.Bool
+	// logSyncMu 保证设置原生层级别的顺序与状态变化的顺序一致
+	logSyncMu sync.Mutex
+)
+
+// SetLogger 设置接收原生库诊断日志的函数，nil 表示不再接收；默认不接收，原生层也不生成日志
+// 默认只转发 LevelInfo 及以上的日志，使用 WithVerboseLogging 的操作期间还转发 LevelDebug（这期间并发的其他操作的调试日志也会转发）
+// fn 可能在任意 goroutine 或原生线程上被并发调用，msg 为单行文本；fn 中不能调用 SetLogger 或本包的其他接口，应当尽快返回
+// SetLogger 等待正在进行的 fn 调用结束后才返回，返回后旧的 fn 不会再被调用
+// 加载原生库时的警告（例如原生库的 ABI 比本包新，见 Version）也交给 fn，需要在 Init 之前设置才能收到
+func SetLogger(fn func(level Level, msg string)) {
+	logMu.Lock()
+	logger = fn
+	logMu.Unlock()
+	syncLogLevel()
+}
+
+// WithVerboseLogging 在本次操作期间让原生库生成 LevelDebug 的日志（每个窗口的编解码统计等）并交给 SetLogger 设置的函数，
+// 对 CreateDiffs、ApplyDiffsData 等 Operation 中列出的操作有效；没有设置 logger 时没有作用
+func WithVerboseLogging() Option {
+	return func(o *options) {
+		o.verbose = true
+	}
+}
+
+// verboseScope 使用了 WithVerboseLogging 时提高原生层的日志级别，返回的函数在操作结束时恢复
+func (o *options) verboseScope() func() {
+	if !o.verbose {
+		return func() {}
+	}
+	verboseOps.Add(1)
+	syncLogLevel()
+	return func() {
+		verboseOps.Add(-1)
+		syncLogLevel()
+	}
+}
+
+// syncLogLevel 按当前的 logger 和 verboseOps 设置原生层的日志级别
+func syncLogLevel() {
+	// 读锁防止 Shutdown 在设置期间卸载原生库
+	libLock.RLock()
+	defer libLock.RUnlock()
+	if !nativeLoaded.Load() {
+		return
+	}
+	logSyncMu.Lock()
+	defer logSyncMu.Unlock()
+	logMu.RLock()
+	level := levelOff
+	if logger != nil {
+		level = int(LevelInfo)
+		if verboseOps.Load() > 0 {
+			level = int(LevelDebug)
+		}
+	}
+	logMu.RUnlock()
+	setNativeLog(level)
+}
+
+// logf 把 Go 侧的诊断交给 logger，与原生层的日志使用相同的规则
+func logf(level Level, format string, args ...any) {
+	logMu.RLock()
+	fn := logger
+	logMu.RUnlock()
+	if fn != nil {
+		nativeLog(int(level), fmt.Sprintf(format, args...))
+	}
+}
+
+// nativeLog 由各后端的日志回调调用
+func nativeLog(level int, msg string) {
+	if Level(level) < LevelInfo && verboseOps.Load() == 0 {
+		// 级别降低之前已经生成的调试日志
+		return
+	}
+	logMu.RLock()
+	defer logMu.RUnlock()
+	if logger != nil {
+		logger(Level(level), msg)
+	}
+}
@@ -0,0 +1,130 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestMain 没有设置 XDELTA_LIB_PATH 时使用 cargo build --release 生成的原生库
+func TestMain(m *testing.M) {
+	if os.Getenv("XDELTA_LIB_PATH") == "" {
+		name := "libxdelta.so"
+		switch runtime.GOOS {
+		case "darwin":
+			name = "libxdelta.dylib"
+		case "windows":
+			name = "xdelta.dll"
+		}
+		if p := filepath.Join("..", "target", "release", name); fileExists(p) {
+			SetLibraryPath(p)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// requireNative 没有原生后端或原生库加载失败时跳过测试
+func requireNative(tb testing.TB) {
+	tb.Helper()
+	if !nativeBackend {
+		tb.Skip("built without a native backend")
+	}
+	if err := Init(); err != nil {
+		tb.Skipf("native library not available: %v", err)
+	}
+}
+
+// testPair 返回一对有少量差异、长度为几十 KB 的新旧数据
+func testPair() (oldData, newData []byte) {
+	oldData = bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 1000)
+	newData = append([]byte(nil), oldData[:20000]...)
+	newData = append(newData, "inserted text in the middle"...)
+	newData = append(newData, oldData[20010:]...)
+	return oldData, newData
+}
+
+// memWriterAt 测试用的 io.WriterAt，按需增长
+type memWriterAt struct{ b []byte }
+
+func (w *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if n := int(off) + len(p); n > len(w.b) {
+		w.b = append(w.b, make([]byte, n-len(w.b))...)
+	}
+	copy(w.b[off:], p)
+	return len(p), nil
+}
+
+// applyPaths 把 patch 应用到 oldData 的各个接口，每个返回得到的新数据；文件写在 dir 中
+func applyPaths(dir string, oldData, patch []byte) map[string]func() ([]byte, error) {
+	return map[string]func() ([]byte, error){
+		"ApplyDiffsData": func() ([]byte, error) {
+			return ApplyDiffsData(oldData, patch)
+		},
+		"ApplyDiffsStream": func() ([]byte, error) {
+			var b bytes.Buffer
+			err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b)
+			return b.Bytes(), err
+		},
+		"ApplyDiffs": func() ([]byte, error) {
+			var b bytes.Buffer
+			err := ApplyDiffs(bytes.NewReader(oldData), int64(len(oldData)), patch, &b)
+			return b.Bytes(), err
+		},
+		"ApplyDiffsAt": func() ([]byte, error) {
+			w := &memWriterAt{}
+			_, err := ApplyDiffsAt(bytes.NewReader(oldData), int64(len(oldData)), patch, w)
+			return w.b, err
+		},
+		"Decoder": func() ([]byte, error) {
+			var b bytes.Buffer
+			d, err := NewDecoder(bytes.NewReader(oldData), &b)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := d.Write(patch); err != nil {
+				return nil, err
+			}
+			err = d.Close()
+			return b.Bytes(), err
+		},
+		"NewPatchReader": func() ([]byte, error) {
+			r, err := NewPatchReader(bytes.NewReader(oldData), bytes.NewReader(patch))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		},
+		"ApplyDiffsFile": func() ([]byte, error) {
+			op, pp, np := filepath.Join(dir, "old"), filepath.Join(dir, "patch"), filepath.Join(dir, "new")
+			if err := os.WriteFile(op, oldData, 0o644); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(pp, patch, 0o644); err != nil {
+				return nil, err
+			}
+			if err := ApplyDiffsFile(op, pp, np); err != nil {
+				return nil, err
+			}
+			return os.ReadFile(np)
+		},
+		"ApplyDiffsInPlace": func() ([]byte, error) {
+			p := filepath.Join(dir, "inplace")
+			if err := os.WriteFile(p, oldData, 0o644); err != nil {
+				return nil, err
+			}
+			if err := ApplyDiffsInPlace(p, patch); err != nil {
+				return nil, err
+			}
+			return os.ReadFile(p)
+		},
+	}
+}
@@ -0,0 +1,239 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// 清单的 JSON 格式（版本 1）：
+//
+//	{
+//	  "version": 1,
+//	  "entries": [
+//	    {"path": "bin/game.exe", "action": "modified",
+//	     "old_size": 1048576, "old_sha256": "<64 位小写十六进制>",
+//	     "old_mtime": 1700000000000000000, "old_xxh64": "<16 位小写十六进制>",
+//	     "new_size": 1050000, "new_sha256": "<64 位小写十六进制>",
+//	     "new_mtime": 1700000000000000000, "new_xxh64": "<16 位小写十六进制>",
+//	     "patch": "files/bin/game.exe.xdelta", "blob": "<64 位小写十六进制>", "patch_size": 2048},
+//	    {"path": "data/new.pak", "action": "added", "new_size": 4096, "new_sha256": "...", "from": "data/old.pak"},
+//	    ...
+//	  ],
+//	  "skipped": [{"path": "logs", "reason": "..."}]
+//	}
+//
+// version、entries 必须存在；每项的 path、action 必须存在，path 是 / 分隔、不含 . 和 .. 的相对路径，不能重复；
+// path、from、patch 都不能含有 \：它在 Windows 上是分隔符、在其他系统上是普通字符，同一个清单会指向不同的文件
+// action 为 added、removed、modified、unchanged 之一，各自必须带有的字段：
+//
+//	added      new_size、new_sha256、patch、blob 或 from
+//	removed    old_size、old_sha256
+//	modified   old_size、old_sha256、new_size、new_sha256、patch 或 blob
+//	unchanged  old_size、old_sha256、new_size、new_sha256（与 old_* 相同）
+//
+// 大小是非负整数，写出时 old_size、new_size、patch_size 总是存在（不存在的一侧为 0）；
+// patch 是相对于补丁目录的 / 分隔路径，patch_size 可以省略；skipped 可以省略，读取时忽略未知的字段
+// *_mtime（Unix 纳秒）、*_xxh64 总是可以省略，旧版本写出的清单中没有；unchanged 的两个 XXH64 都存在时必须相同
+// blob 是补丁或完整内容的 SHA-256（见 WithBlobDedup），只能出现在 added、modified 中，added 的 blob 与 new_sha256 相同
+// from 只能出现在没有 patch 和 blob 的 added 中（见 WithRenameDetection），是清单中另一项的 path，
+// 那一项不能是 added，它的 old_size、old_sha256 与这一项的 new_size、new_sha256 相同
+const DirManifestVersion = 1
+
+// dirManifestJSON 清单的 JSON 表示
+type dirManifestJSON struct {
+	Version *int              `json:"version"`
+	Entries []json.RawMessage `json:"entries"`
+	Skipped []DirSkipped      `json:"skipped,omitempty"`
+}
+
+// MarshalJSON 按上面的版本 1 格式编码清单
+func (m DirManifest) MarshalJSON() ([]byte, error) {
+	version := DirManifestVersion
+	out := dirManifestJSON{Version: &version, Entries: make([]json.RawMessage, 0, len(m.Entries)), Skipped: m.Skipped}
+	for _, e := range m.Entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		out.Entries = append(out.Entries, data)
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON 解码并检查清单，不符合格式时返回包装了 ErrCorruptPatch 的错误
+func (m *DirManifest) UnmarshalJSON(data []byte) error {
+	var in dirManifestJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return fmt.Errorf("%w: manifest: %v", ErrCorruptPatch, err)
+	}
+	if in.Version == nil {
+		return fmt.Errorf("%w: manifest has no version", ErrCorruptPatch)
+	}
+	if *in.Version != DirManifestVersion {
+		return fmt.Errorf("%w: unknown manifest version %d", ErrCorruptPatch, *in.Version)
+	}
+	if in.Entries == nil {
+		return fmt.Errorf("%w: manifest has no entries", ErrCorruptPatch)
+	}
+	entries := make([]DirEntry, len(in.Entries))
+	seen := make(map[string]bool, len(in.Entries))
+	for i, raw := range in.Entries {
+		e, err := decodeDirEntry(raw)
+		if err != nil {
+			return fmt.Errorf("%w: manifest entry %d: %v", ErrCorruptPatch, i, err)
+		}
+		if seen[e.Path] {
+			return fmt.Errorf("%w: manifest lists %s twice", ErrCorruptPatch, e.Path)
+		}
+		seen[e.Path] = true
+		entries[i] = e
+	}
+	if err := checkDirSources(entries); err != nil {
+		return fmt.Errorf("%w: manifest: %v", ErrCorruptPatch, err)
+	}
+	m.Entries, m.Skipped = entries, in.Skipped
+	return nil
+}
+
+// dirEntryFields 每种 action 必须带有的字段（path、action 之外），added、modified 另外需要 patch 或 blob
+var dirEntryFields = map[DirAction][]string{
+	DirAdded:     {"new_size", "new_sha256"},
+	DirRemoved:   {"old_size", "old_sha256"},
+	DirModified:  {"old_size", "old_sha256", "new_size", "new_sha256"},
+	DirUnchanged: {"old_size", "old_sha256", "new_size", "new_sha256"},
+}
+
+func decodeDirEntry(raw json.RawMessage) (DirEntry, error) {
+	var fields map[string]json.RawMessage
+	var e DirEntry
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return e, err
+	}
+	for _, name := range []string{"path", "action"} {
+		if _, ok := fields[name]; !ok {
+			return e, fmt.Errorf("missing %q", name)
+		}
+	}
+	if !localPath(e.Path) {
+		return e, fmt.Errorf("path %q is not a relative path inside the directory", e.Path)
+	}
+	required, ok := dirEntryFields[e.Action]
+	if !ok {
+		return e, fmt.Errorf("%s: unknown action %q", e.Path, e.Action)
+	}
+	for _, name := range required {
+		if _, ok := fields[name]; !ok {
+			return e, fmt.Errorf("%s: %s entry without %q", e.Path, e.Action, name)
+		}
+	}
+	_, hasPatch := fields["patch"]
+	_, hasBlob := fields["blob"]
+	_, hasFrom := fields["from"]
+	content := e.Action == DirAdded || e.Action == DirModified
+	if hasFrom && (e.Action != DirAdded || hasPatch || hasBlob) {
+		return e, fmt.Errorf("%s: %s entry with \"from\" and content of its own", e.Path, e.Action)
+	}
+	if hasFrom && !localPath(e.From) {
+		return e, fmt.Errorf("%s: from %q is not a relative path inside the directory", e.Path, e.From)
+	}
+	if content && !hasPatch && !hasBlob && !hasFrom {
+		return e, fmt.Errorf("%s: %s entry without \"patch\" or \"blob\"", e.Path, e.Action)
+	}
+	if hasBlob && !content {
+		return e, fmt.Errorf("%s: %s entry with a blob", e.Path, e.Action)
+	}
+	if hasBlob && !validSHA256Hex(e.Blob) {
+		return e, fmt.Errorf("%s: blob %q is not a lowercase hex SHA-256", e.Path, e.Blob)
+	}
+	if e.Action == DirAdded && hasBlob && e.Blob != e.NewSHA256 {
+		return e, fmt.Errorf("%s: blob of an added file differs from its new_sha256", e.Path)
+	}
+	if e.OldSize < 0 || e.NewSize < 0 || e.PatchSize < 0 {
+		return e, fmt.Errorf("%s: negative size", e.Path)
+	}
+	for _, sum := range []string{e.OldSHA256, e.NewSHA256} {
+		if sum != "" && !validSHA256Hex(sum) {
+			return e, fmt.Errorf("%s: %q is not a lowercase hex SHA-256", e.Path, sum)
+		}
+	}
+	for _, sum := range []string{e.OldXXH64, e.NewXXH64} {
+		if sum != "" && (len(sum) != 16 || !validHex(sum)) {
+			return e, fmt.Errorf("%s: %q is not a lowercase hex XXH64", e.Path, sum)
+		}
+	}
+	if e.Patch != "" && !localPath(e.Patch) {
+		return e, fmt.Errorf("%s: patch %q is not a relative path inside the patch directory", e.Path, e.Patch)
+	}
+	if e.Action == DirUnchanged && (e.OldSize != e.NewSize || e.OldSHA256 != e.NewSHA256 ||
+		e.OldXXH64 != "" && e.NewXXH64 != "" && e.OldXXH64 != e.NewXXH64) {
+		return e, fmt.Errorf("%s: unchanged entry with different old and new content", e.Path)
+	}
+	return e, nil
+}
+
+// checkDirSources 检查 from 引用清单中内容相同的旧文件
+func checkDirSources(entries []DirEntry) error {
+	byPath := make(map[string]*DirEntry, len(entries))
+	for i := range entries {
+		byPath[entries[i].Path] = &entries[i]
+	}
+	for _, e := range entries {
+		if e.From == "" {
+			continue
+		}
+		src, ok := byPath[e.From]
+		if !ok || src.Action == DirAdded {
+			return fmt.Errorf("%s: from %s is not a file of the old directory in the manifest", e.Path, e.From)
+		}
+		if src.OldSize != e.NewSize || src.OldSHA256 != e.NewSHA256 {
+			return fmt.Errorf("%s: from %s has different content", e.Path, e.From)
+		}
+	}
+	return nil
+}
+
+func validSHA256Hex(s string) bool {
+	return len(s) == 64 && validHex(s)
+}
+
+// validHex 报告 s 是否只由小写十六进制数字组成
+func validHex(s string) bool {
+	for _, c := range []byte(s) {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo 把清单以缩进的 JSON 写入 w，与 CreateDirDiff 写入 manifest.json 的内容相同
+func (m *DirManifest) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return 0, err
+	}
+	buf.WriteByte('\n')
+	return buf.WriteTo(w)
+}
+
+// LoadManifest 从 r 读取并检查一个清单，格式见 DirManifestVersion；不符合格式时返回 ErrCorruptPatch
+func LoadManifest(r io.Reader) (*DirManifest, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &DirManifest{}
+	if err := m.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,171 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// goldenManifest 覆盖版本 1 格式每种字段的清单，与 testdata/manifest.json 对应
+func goldenManifest() *DirManifest {
+	sum := func(c byte) string { return strings.Repeat(string(c), 64) }
+	return &DirManifest{
+		Entries: []DirEntry{
+			{Path: "bin/game.exe", Action: DirModified, OldSize: 1048576, OldSHA256: sum('a'), OldModTime: 1700000000000000000, OldXXH64: "0123456789abcdef",
+				NewSize: 1050000, NewSHA256: sum('b'), NewModTime: 1700000001000000000, NewXXH64: "fedcba9876543210", Patch: "files/bin/game.exe.xdelta", PatchSize: 2048},
+			{Path: "data/blob.pak", Action: DirModified, OldSize: 10, OldSHA256: sum('c'), NewSize: 12, NewSHA256: sum('d'), Blob: sum('e'), PatchSize: 30},
+			{Path: "data/copy.pak", Action: DirAdded, NewSize: 10, NewSHA256: sum('c'), From: "data/old.pak"},
+			{Path: "data/new.pak", Action: DirAdded, NewSize: 4096, NewSHA256: sum('f'), Patch: "files/data/new.pak.full", PatchSize: 4096},
+			{Path: "data/old.pak", Action: DirRemoved, OldSize: 10, OldSHA256: sum('c')},
+			{Path: "readme.txt", Action: DirUnchanged, OldSize: 0, OldSHA256: sum('0'), NewSize: 0, NewSHA256: sum('0')},
+		},
+		Skipped: []DirSkipped{{Path: "logs", Reason: "permission denied"}},
+	}
+}
+
+// TestManifestGolden WriteTo 的输出与 testdata/manifest.json 逐字节相同：带 "version": 1，字段名固定，
+// 哈希为小写十六进制，大小为整数；LoadManifest 读回的清单与原来的相同。go test -run TestManifestGolden -update 重写 golden 文件
+func TestManifestGolden(t *testing.T) {
+	m := goldenManifest()
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "manifest.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("WriteTo output differs from %s:\n%s", golden, b.Bytes())
+	}
+	got, err := LoadManifest(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("LoadManifest(%s) = %+v, want %+v", golden, got, m)
+	}
+
+	// 其他语言的客户端看到的字段：版本号和大小是 JSON 数字
+	var raw struct {
+		Version any              `json:"version"`
+		Entries []map[string]any `json:"entries"`
+	}
+	if err := json.Unmarshal(want, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Version != float64(1) {
+		t.Fatalf("version is %#v, want the number 1", raw.Version)
+	}
+	for _, e := range raw.Entries {
+		for _, name := range []string{"old_size", "new_size", "patch_size"} {
+			if _, ok := e[name].(float64); !ok {
+				t.Fatalf("%v: %s is %#v, want a number", e["path"], name, e[name])
+			}
+		}
+	}
+}
+
+// TestManifestRoundTrip CreateDirDiff 写入的 manifest.json 就是 WriteTo 的输出，LoadManifest 读回与返回的清单相同，
+// 再编码一次逐字节不变；包括 blob 去重和改名检测的清单
+func TestManifestRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldFiles, newFiles := journalTrees(60)
+	newFiles["renamed/f0001"] = oldFiles["d01/f0001"]
+	root := t.TempDir()
+	oldDir, newDir := filepath.Join(root, "old"), filepath.Join(root, "new")
+	writeTree(t, oldDir, oldFiles)
+	writeTree(t, newDir, newFiles)
+	for name, opts := range map[string][]Option{
+		"plain": nil,
+		"blobs": {WithBlobDedup(), WithRenameDetection()},
+	} {
+		patchDir := filepath.Join(root, name)
+		m, err := CreateDirDiff(oldDir, newDir, patchDir, opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, err := os.ReadFile(filepath.Join(patchDir, DirManifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if _, err := m.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), data) {
+			t.Fatalf("%s: %s differs from WriteTo", name, DirManifestName)
+		}
+		got, err := LoadManifest(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Fatalf("%s: LoadManifest does not return the manifest CreateDirDiff returned", name)
+		}
+		b.Reset()
+		if _, err := got.WriteTo(&b); err != nil || !bytes.Equal(b.Bytes(), data) {
+			t.Fatalf("%s: encoding the loaded manifest again changed it (%v)", name, err)
+		}
+	}
+}
+
+// TestLoadManifestInvalid LoadManifest 拒绝未知版本、缺少必需字段和不合法的取值，返回 ErrCorruptPatch；
+// 未知的字段被忽略
+func TestLoadManifestInvalid(t *testing.T) {
+	sum := strings.Repeat("a", 64)
+	entry := func(fields string) string { return `{"version":1,"entries":[` + fields + `]}` }
+	for _, tc := range []struct{ name, data string }{
+		{"not json", "{"},
+		{"no version", `{"entries":[]}`},
+		{"version 0", `{"version":0,"entries":[]}`},
+		{"version 2", `{"version":2,"entries":[]}`},
+		{"version string", `{"version":"1","entries":[]}`},
+		{"no entries", `{"version":1}`},
+		{"no path", entry(`{"action":"removed","old_size":1,"old_sha256":"` + sum + `"}`)},
+		{"no action", entry(`{"path":"a","old_size":1,"old_sha256":"` + sum + `"}`)},
+		{"unknown action", entry(`{"path":"a","action":"moved"}`)},
+		{"removed without old_sha256", entry(`{"path":"a","action":"removed","old_size":1}`)},
+		{"added without new_size", entry(`{"path":"a","action":"added","new_sha256":"` + sum + `","patch":"files/a.full"}`)},
+		{"added without patch", entry(`{"path":"a","action":"added","new_size":1,"new_sha256":"` + sum + `"}`)},
+		{"uppercase hash", entry(`{"path":"a","action":"removed","old_size":1,"old_sha256":"` + strings.ToUpper(sum) + `"}`)},
+		{"short hash", entry(`{"path":"a","action":"removed","old_size":1,"old_sha256":"abcd"}`)},
+		{"bad xxh64", entry(`{"path":"a","action":"removed","old_size":1,"old_sha256":"` + sum + `","old_xxh64":"xyz"}`)},
+		{"string size", entry(`{"path":"a","action":"removed","old_size":"1","old_sha256":"` + sum + `"}`)},
+		{"fractional size", entry(`{"path":"a","action":"removed","old_size":1.5,"old_sha256":"` + sum + `"}`)},
+		{"negative size", entry(`{"path":"a","action":"removed","old_size":-1,"old_sha256":"` + sum + `"}`)},
+		{"absolute path", entry(`{"path":"/etc/passwd","action":"removed","old_size":1,"old_sha256":"` + sum + `"}`)},
+		{"dot dot", entry(`{"path":"a/../../b","action":"removed","old_size":1,"old_sha256":"` + sum + `"}`)},
+		{"backslash", entry(`{"path":"a\\b","action":"removed","old_size":1,"old_sha256":"` + sum + `"}`)},
+		{"patch outside", entry(`{"path":"a","action":"added","new_size":1,"new_sha256":"` + sum + `","patch":"../x"}`)},
+		{"duplicate path", entry(`{"path":"a","action":"removed","old_size":1,"old_sha256":"` + sum + `"},` +
+			`{"path":"a","action":"removed","old_size":1,"old_sha256":"` + sum + `"}`)},
+		{"unchanged differs", entry(`{"path":"a","action":"unchanged","old_size":1,"old_sha256":"` + sum + `","new_size":2,"new_sha256":"` + sum + `"}`)},
+		{"from missing", entry(`{"path":"a","action":"added","new_size":1,"new_sha256":"` + sum + `","from":"b"}`)},
+	} {
+		_, err := LoadManifest(strings.NewReader(tc.data))
+		if !errors.Is(err, ErrCorruptPatch) {
+			t.Errorf("%s: got %v, want ErrCorruptPatch", tc.name, err)
+		}
+	}
+
+	m, err := LoadManifest(strings.NewReader(`{"version":1,"generator":"other","entries":[` +
+		`{"path":"a","action":"removed","old_size":1,"old_sha256":"` + sum + `","comment":"x"}]}`))
+	if err != nil {
+		t.Fatalf("unknown fields: %v", err)
+	}
+	if len(m.Entries) != 1 || m.Entries[0].Path != "a" || m.Entries[0].OldSize != 1 {
+		t.Fatalf("unknown fields: got %+v", m.Entries)
+	}
+}
@@ -0,0 +1,114 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestDefaultOptions WithOptions(DefaultOptions()) 的补丁与不带选项时逐字节相同，修改过的 Options 与逐个使用对应的 Option 相同；
+// 零值的 Options 使用 AutoBlockSize，超出范围的 BlockSize 返回 ErrInvalidArgument
+func TestDefaultOptions(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(512 << 10)
+	plain, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := CreateDiffs(oldData, newData, WithOptions(DefaultOptions())); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("DefaultOptions: %d bytes, %v, want %d", len(got), err, len(plain))
+	}
+
+	o := DefaultOptions()
+	o.BlockSize, o.Secondary, o.Level, o.Matching, o.MinMatchBlocks = 256, SecondaryZstd, MaxCompressionLevel, MatchLazy, 3
+	want, err := CreateDiffs(oldData, newData, WithBlockSize(256), WithSecondaryCompression(SecondaryZstd),
+		WithCompressionLevel(MaxCompressionLevel), WithMatchStrategy(MatchLazy), WithMinMatchBlocks(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := CreateDiffs(oldData, newData, WithOptions(o)); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("modified Options: %d bytes, %v, want %d", len(got), err, len(want))
+	}
+	// 后出现的 Option 覆盖 WithOptions
+	if got, err := CreateDiffs(oldData, newData, WithOptions(DefaultOptions()), WithBlockSize(256)); err != nil || bytes.Equal(got, plain) {
+		t.Fatalf("WithBlockSize after WithOptions had no effect: %v", err)
+	}
+	auto, err := CreateDiffs(oldData, newData, WithBlockSize(AutoBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := CreateDiffs(oldData, newData, WithOptions(Options{})); err != nil || !bytes.Equal(got, auto) {
+		t.Fatalf("zero Options: %d bytes, %v, want the AutoBlockSize patch of %d", len(got), err, len(auto))
+	}
+	if _, err := CreateDiffs(oldData, newData, WithOptions(Options{BlockSize: MaxBlockSize + 1})); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("BlockSize over MaxBlockSize: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestMatchLazy MatchLazy 把连续匹配的块合并成少数几个 COPY：全零数据中改动 100 字节、在 5 字节之后接上整个旧数据时
+// 补丁比 MatchGreedy 小得多，指令少得多；MatchGreedy 与默认相同；WithMinMatchBlocks 丢掉零散的短匹配，指令更少；
+// 所有补丁都能应用。未知的策略和超出范围的最短匹配返回 ErrInvalidArgument
+func TestMatchLazy(t *testing.T) {
+	requireNative(t)
+	zeros := make([]byte, 8<<20)
+	edited := bytes.Clone(zeros)
+	copy(edited[3<<20:], bytes.Repeat([]byte{0xaa}, 100))
+	prefixed := append([]byte("12345"), zeros[:4<<20]...)
+	for _, c := range []struct {
+		name             string
+		oldData, newData []byte
+	}{
+		{"zeros", zeros, edited},
+		{"prefix", zeros[:4<<20], prefixed},
+	} {
+		greedy, err := CreateDiffs(c.oldData, c.newData, WithBlockSize(1024), WithMatchStrategy(MatchGreedy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plain, err := CreateDiffs(c.oldData, c.newData, WithBlockSize(1024)); err != nil || !bytes.Equal(plain, greedy) {
+			t.Fatalf("%s: MatchGreedy differs from the default", c.name)
+		}
+		lazy, err := CreateDiffs(c.oldData, c.newData, WithBlockSize(1024), WithMatchStrategy(MatchLazy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gi, _ := InspectPatch(greedy)
+		li, _ := InspectPatch(lazy)
+		if len(lazy)*10 > len(greedy) || li.Instructions*10 > gi.Instructions {
+			t.Fatalf("%s: lazy %d bytes in %d instructions, greedy %d bytes in %d", c.name, len(lazy), li.Instructions, len(greedy), gi.Instructions)
+		}
+		if got, err := ApplyDiffsData(c.oldData, lazy); err != nil || !bytes.Equal(got, c.newData) {
+			t.Fatalf("%s: lazy patch applied to %d bytes, %v", c.name, len(got), err)
+		}
+	}
+
+	oldData, newData := textFixture(512 << 10)
+	var prev int64
+	for _, n := range []int{0, 4, MaxMinMatchBlocks} {
+		patch, err := CreateDiffs(oldData, newData, WithBlockSize(16), WithMinMatchBlocks(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := InspectPatch(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev > 0 && info.Instructions >= prev {
+			t.Fatalf("min match %d: %d instructions, fewer blocks gave %d", n, info.Instructions, prev)
+		}
+		prev = info.Instructions
+		if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("min match %d: applied to %d bytes, %v", n, len(got), err)
+		}
+	}
+
+	for name, opt := range map[string]Option{
+		"strategy 2":    WithMatchStrategy(MatchLazy + 1),
+		"min match -1":  WithMinMatchBlocks(-1),
+		"min match max": WithMinMatchBlocks(MaxMinMatchBlocks + 1),
+	} {
+		if _, err := CreateDiffs(oldData, newData, opt); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("%s: got %v, want ErrInvalidArgument", name, err)
+		}
+	}
+}
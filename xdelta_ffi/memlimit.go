@@ -0,0 +1,126 @@
+package xdelta_ffi
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+const (
+	// sigBytesPerBlock 原生层每个旧数据块的签名占用的内存估计（实测约 140 字节，另加哈希表扩容时的余量）
+	sigBytesPerBlock = 160
+	// minMemoryWindow WithMaxMemory 缩小流式接口的窗口时的下限
+	minMemoryWindow = 64 << 10
+)
+
+// WithMaxMemory 限制原生层的内存占用约为 n 字节，不大于 0 时不限制（默认），用于内存很小的容器
+// 创建补丁时签名表与旧数据的块数成正比，超出时增大块大小（补丁会变大，但仍然正确），并减少 WithThreads 的线程数、
+// 缩小流式接口的窗口；最大的块大小也放不下时返回 ErrMemoryLimit，流式接口无法预先得知旧数据长度时在读到超出的位置返回
+// 应用补丁时缩小流式接口的窗口；内存接口按补丁声明的目标长度一次分配结果，超过 n 时返回 ErrMemoryLimit
+// 流式窗口和多线程编码的缓冲是固定开销，n 比它们还小时返回 ErrMemoryLimit，错误信息为 limit smaller than fixed overhead
+// 对 CreateDiffs、CreateDiffsStream、CreateDiffsFromStream、CreateDiffsFile、ApplyDiffsData、ApplyDiffsDataInto、ApplyDiffsDataContext、
+// ApplyDiffsDataPooled、ApplyDiffsStream、ApplyDiffs 有效；估计不包括调用方传入的数据和内存接口返回的补丁本身
+func WithMaxMemory(n int64) Option {
+	return func(o *options) {
+		o.maxMemory = max(n, 0)
+	}
+}
+
+// memoryWindow 按 WithMaxMemory 缩小流式接口的窗口
+func (o *options) memoryWindow() {
+	if o.maxMemory > 0 {
+		o.windowSize = int(min(int64(o.windowSize), max(o.maxMemory/4, minMemoryWindow)))
+	}
+}
+
+// fitMemory 按 WithMaxMemory 调整创建补丁的参数：减少线程数，返回签名表放得下的块大小（不小于 blockSize 解析后的值）
+// streaming 为调用方是否按窗口读取输入，只有这时才为窗口缓冲预留内存
+func (o *options) fitMemory(blockSize uint32, oldLen, newLen int64, streaming bool) (uint32, error) {
+	blockSize = resolveBlockSize(blockSize, oldLen, newLen)
+	if o.maxMemory <= 0 || oldLen < 0 {
+		return blockSize, nil
+	}
+	if o.bsdiff {
+		if n := bsdiffCreateBytes(oldLen, max(newLen, 0)); n > o.maxMemory {
+			return 0, fmt.Errorf("%w: bsdiff of %d bytes of old data needs about %d bytes", ErrMemoryLimit, oldLen, n)
+		}
+		return blockSize, nil
+	}
+	if t := o.createThreads(); t != 1 {
+		if t == 0 {
+			t = min(runtime.NumCPU(), MaxThreads)
+		}
+		// 每个线程缓冲一段 8 MiB 的新数据，最多占用一半的内存，否则退回单线程
+		o.threads = max(min(t, int(o.maxMemory/2/parallelChunk)), 1)
+	}
+	budget := o.signatureBudget(streaming)
+	if budget <= 0 {
+		return 0, o.overheadError(budget)
+	}
+	indexed := o.indexedSize(oldLen)
+	if o.signatureBytes(indexed, MaxBlockSize) > budget {
+		return 0, fmt.Errorf("%w: signatures of %d bytes of old data do not fit in %d bytes even with %d byte blocks",
+			ErrMemoryLimit, indexed, o.maxMemory, MaxBlockSize)
+	}
+	for o.signatureBytes(indexed, blockSize) > budget {
+		blockSize = min(blockSize*2, MaxBlockSize)
+	}
+	return blockSize, nil
+}
+
+// signatureBudget 内存上限中留给签名表的部分：扣除多线程编码的缓冲，streaming 时还扣除读入窗口和编码输出的缓冲
+func (o options) signatureBudget(streaming bool) int64 {
+	var work int64
+	if streaming {
+		work = 2 * int64(o.windowSize)
+	}
+	if t := o.createThreads(); t != 1 {
+		work += int64(t) * parallelChunk
+	}
+	return o.maxMemory - work
+}
+
+// overheadError WithMaxMemory 连固定开销都放不下时的错误，budget 为 signatureBudget 的结果
+func (o options) overheadError(budget int64) error {
+	return fmt.Errorf("%w: limit smaller than fixed overhead: %d bytes, of which %d are window and thread buffers",
+		ErrMemoryLimit, o.maxMemory, o.maxMemory-budget)
+}
+
+// signatureBytes 估计 oldLen 字节旧数据按 blockSize 分块后签名表的大小
+func (o options) signatureBytes(oldLen int64, blockSize uint32) int64 {
+	return (oldLen + int64(blockSize) - 1) / int64(blockSize) * sigBytesPerBlock
+}
+
+// checkSignatures 流式创建补丁已经读入 oldLen 字节旧数据时，签名表超出 WithMaxMemory 则返回 ErrMemoryLimit
+func (o options) checkSignatures(oldLen int64, blockSize uint32) error {
+	if o.maxMemory <= 0 {
+		return nil
+	}
+	budget := o.signatureBudget(true)
+	if budget <= 0 {
+		return o.overheadError(budget)
+	}
+	if o.signatureBytes(oldLen, blockSize) > budget {
+		return fmt.Errorf("%w: signatures of the first %d bytes of old data exceed %d bytes with %d byte blocks",
+			ErrMemoryLimit, oldLen, o.maxMemory, blockSize)
+	}
+	return nil
+}
+
+// applyLimit 内存接口应用补丁时的输出上限：结果按补丁声明的目标长度一次分配在 Go 侧，原生层直接写入，
+// 这块缓冲就是主要的内存占用，不能超过 WithMaxMemory
+func (o options) applyLimit() uint64 {
+	limit := o.outputLimit()
+	if o.maxMemory > 0 && (limit == 0 || uint64(o.maxMemory) < limit) {
+		limit = uint64(o.maxMemory)
+	}
+	return limit
+}
+
+// limitError 输出超过的是 WithMaxMemory 而不是 WithMaxOutputSize 时把 ErrOutputTooLarge 换成 ErrMemoryLimit
+func (o options) limitError(err error) error {
+	if err == nil || o.applyLimit() == o.outputLimit() || !errors.Is(err, ErrOutputTooLarge) {
+		return err
+	}
+	return fmt.Errorf("%w: output exceeds %d bytes", ErrMemoryLimit, o.maxMemory)
+}
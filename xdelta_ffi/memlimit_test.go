@@ -0,0 +1,63 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// TestMaxMemoryRoundTrip 很低的内存上限下补丁变大，但仍能还原新数据
+func TestMaxMemoryRoundTrip(t *testing.T) {
+	requireNative(t)
+	rng := rand.New(rand.NewSource(1))
+	oldData := make([]byte, 8<<20)
+	rng.Read(oldData)
+	newData := append([]byte(nil), oldData...)
+	for i := 0; i < 64; i++ {
+		newData[rng.Intn(len(newData))] ^= 0xff
+	}
+	full, err := CreateDiffs(oldData, newData, WithThreads(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 MiB 放不下 1 KiB 块的签名表（约 1.3 MB），也小于两个默认流式窗口
+	small, err := CreateDiffs(oldData, newData, WithThreads(1), WithMaxMemory(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(small) <= len(full) {
+		t.Errorf("patch under the limit is %d bytes, want more than the unlimited %d", len(small), len(full))
+	}
+	got, err := ApplyDiffsData(oldData, small, WithMaxMemory(16<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newData) {
+		t.Fatal("round trip under the memory limit does not reproduce the new data")
+	}
+	if _, err := ApplyDiffsData(oldData, small, WithMaxMemory(1<<20)); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatalf("applying %d bytes under a 1 MiB limit: got %v, want ErrMemoryLimit", len(newData), err)
+	}
+}
+
+// TestMaxMemoryFixedOverhead 流式接口的窗口缓冲放不下时报告固定开销，内存接口不受影响
+func TestMaxMemoryFixedOverhead(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	// 窗口最小为 64 KiB，读入和输出两个窗口超过 100 KiB
+	opts := []Option{WithThreads(1), WithMaxMemory(100 << 10)}
+	var patch bytes.Buffer
+	err := CreateDiffsStream(bytes.NewReader(oldData), bytes.NewReader(newData), &patch, opts...)
+	if !errors.Is(err, ErrMemoryLimit) || !strings.Contains(err.Error(), "limit smaller than fixed overhead") {
+		t.Fatalf("CreateDiffsStream: got %v, want the fixed overhead error", err)
+	}
+	p, err := CreateDiffs(oldData, newData, opts...)
+	if err != nil {
+		t.Fatalf("CreateDiffs reserved window buffers it does not use: %v", err)
+	}
+	if got, err := ApplyDiffsData(oldData, p); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("round trip: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package xdelta_ffi
+
+import "fmt"
+
+// MergePatches 把一串首尾相接的补丁（v1→v2、v2→v3、v3→v4）合并成一个 v1→v4 的补丁，相当于 xdelta3 merge
+// 不需要任何一个版本的数据：后一个补丁从旧数据复制的部分被换成前一个补丁生成这部分数据的指令，
+// 用结果应用到 v1 与依次应用整串补丁得到的数据完全相同
+// 支持本库格式（包括二次压缩的补丁）、VCDIFF 和信封，结果为本库格式、不做二次压缩也不带校验和（见 WithChecksum）；bsdiff 补丁返回 ErrUnsupportedPatch
+// 相邻的两个补丁都是信封时比较前者记录的新数据与后者记录的旧数据，不一致时返回 ErrSourceMismatch；
+// 其他情况下只能发现后一个补丁的 COPY 超出前一个补丁输出范围的错误，同样返回 ErrSourceMismatch
+// 所有补丁都是信封时结果也是信封，记录第一个补丁的旧数据和最后一个补丁的新数据与元数据（WithMetadata），块大小记为 0
+// 合并需要在内存中保存所有补丁携带的数据，VCDIFF 窗口内重复的内容会被展开
+func MergePatches(patches ...[]byte) ([]byte, error) {
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("%w: no patches to merge", ErrInvalidArgument)
+	}
+	inner := make([][]byte, len(patches))
+	headers := make([]*EnvelopeHeader, len(patches))
+	size := 0
+	for i, p := range patches {
+		inner[i] = p
+		if IsEnvelope(p) {
+			h, body, err := ParseEnvelope(p)
+			if err != nil {
+				return nil, fmt.Errorf("patch %d: %w", i+1, err)
+			}
+			if i > 0 && headers[i-1] != nil && !headers[i-1].chainsTo(h) {
+				return nil, fmt.Errorf("%w: patch %d does not apply to the output of patch %d", ErrSourceMismatch, i+1, i)
+			}
+			headers[i], inner[i] = &h, body
+		}
+		if isBSDiff(inner[i]) {
+			return nil, fmt.Errorf("%w: patch %d is a bsdiff patch, which cannot be merged", ErrUnsupportedPatch, i+1)
+		}
+		size += len(inner[i])
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
+	joined := make([]byte, 0, size)
+	lens := make([]int, len(inner))
+	for i, p := range inner {
+		joined = append(joined, p...)
+		lens[i] = len(p)
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	first, last := headers[0], headers[len(headers)-1]
+	for _, h := range headers {
+		if h == nil {
+			return mergePatchData(appendTo(nil), joined, lens)
+		}
+	}
+	hdr := EnvelopeHeader{
+		Version:      EnvelopeVersion,
+		SourceSize:   first.SourceSize,
+		SourceSHA256: first.SourceSHA256,
+		TargetSize:   last.TargetSize,
+		TargetSHA256: last.TargetSHA256,
+		Metadata:     last.Metadata,
+	}
+	if len(hdr.Metadata) > 0 {
+		hdr.Version = EnvelopeMetadataVersion
+	}
+	return mergePatchData(appendTo(hdr.appendTo(nil)), joined, lens)
+}
+
+// chainsTo 报告 next 记录的旧数据是否就是 h 记录的新数据
+func (h EnvelopeHeader) chainsTo(next EnvelopeHeader) bool {
+	return h.TargetSize == next.SourceSize && h.TargetSHA256 == next.SourceSHA256
+}
@@ -0,0 +1,177 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// versionChain 从 textFixture 的旧数据开始的 n 个版本，每个版本在前一个的基础上删除、插入、
+// 移动几段文本并追加一段连续的相同字节；第 emptyAt 个版本为空（小于 0 时没有空版本）
+func versionChain(n, emptyAt int) [][]byte {
+	r := fixtureRand(7)
+	v, _ := textFixture(128 << 10)
+	versions := [][]byte{v}
+	for i := 1; i < n; i++ {
+		prev := versions[i-1]
+		if i == emptyAt {
+			versions = append(versions, nil)
+			continue
+		}
+		if len(prev) == 0 {
+			prev, _ = textFixture(64 << 10)
+		}
+		a, b := r.intn(len(prev)/2), len(prev)/2+r.intn(len(prev)/2)
+		var next []byte
+		next = append(next, prev[b:]...)
+		next = append(next, bytes.Join(fixtureLines(&r, 2000), nil)...)
+		next = append(next, prev[a:b-r.intn(500)]...)
+		next = append(next, bytes.Repeat([]byte{byte('a' + i)}, 300)...)
+		next = append(next, prev[:a]...)
+		versions = append(versions, next)
+	}
+	return versions
+}
+
+// TestMergePatches 合并后的补丁应用到第一个版本，与依次应用整串补丁得到的数据完全相同：
+// 本库格式、二次压缩、带校验和、VCDIFF 的补丁以及它们的混合，中间有空版本时也一样
+func TestMergePatches(t *testing.T) {
+	requireNative(t)
+	formats := map[string][]Option{
+		"native":  nil,
+		"zstd":    {WithSecondaryCompression(SecondaryZstd)},
+		"lzma":    {WithSecondaryCompression(SecondaryLZMA)},
+		"xxh3":    {WithChecksum(ChecksumXXH3)},
+		"vcdiff":  {WithStandardVCDIFF(), WithChecksum(ChecksumAdler32)},
+		"blocks":  {WithBlockSize(64)},
+		"adler32": {WithChecksum(ChecksumAdler32)},
+	}
+	names := []string{"native", "zstd", "lzma", "xxh3", "vcdiff", "blocks", "adler32"}
+	for _, tc := range []struct {
+		name    string
+		emptyAt int
+		format  func(i int) string
+	}{
+		{"native", -1, func(int) string { return "native" }},
+		{"vcdiff", -1, func(int) string { return "vcdiff" }},
+		{"mixed", -1, func(i int) string { return names[i%len(names)] }},
+		{"empty version", 2, func(i int) string { return names[i%len(names)] }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			versions := versionChain(6, tc.emptyAt)
+			var patches [][]byte
+			for i := 1; i < len(versions); i++ {
+				p, err := CreateDiffs(versions[i-1], versions[i], formats[tc.format(i)]...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				patches = append(patches, p)
+			}
+			for n := 1; n <= len(patches); n++ {
+				seq := versions[0]
+				for _, p := range patches[:n] {
+					var err error
+					if seq, err = ApplyDiffsData(seq, p); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !bytes.Equal(seq, versions[n]) {
+					t.Fatalf("applying %d patches in turn does not give version %d", n, n)
+				}
+				merged, err := MergePatches(patches[:n]...)
+				if err != nil {
+					t.Fatalf("merging %d patches: %v", n, err)
+				}
+				got, err := ApplyDiffsData(versions[0], merged)
+				if err != nil {
+					t.Fatalf("merged %d patches: %v", n, err)
+				}
+				if !bytes.Equal(got, seq) {
+					t.Fatalf("merged %d patches: got %d bytes, want %d", n, len(got), len(seq))
+				}
+			}
+		})
+	}
+}
+
+// TestMergeEnvelopes 信封组成的链合并后仍是信封，记录第一个版本的旧数据和最后一个版本的新数据与元数据，ApplyEnvelope 据此校验；
+// 相邻的信封对不上时返回 ErrSourceMismatch 并指出是哪两个补丁
+func TestMergeEnvelopes(t *testing.T) {
+	requireNative(t)
+	versions := versionChain(4, -1)
+	var envs [][]byte
+	for i := 1; i < len(versions); i++ {
+		env, err := CreateEnvelope(versions[i-1], versions[i], WithMetadata(map[string]string{"version": fmt.Sprint(i + 1)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		envs = append(envs, env)
+	}
+	merged, err := MergePatches(envs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := ParseEnvelope(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := versions[len(versions)-1]
+	if h.SourceSize != int64(len(versions[0])) || h.SourceSHA256 != sha256.Sum256(versions[0]) ||
+		h.TargetSize != int64(len(last)) || h.TargetSHA256 != sha256.Sum256(last) || h.Metadata["version"] != "4" {
+		t.Fatalf("merged envelope header %+v", h)
+	}
+	if got, err := ApplyEnvelope(versions[0], merged); err != nil || !bytes.Equal(got, last) {
+		t.Fatalf("merged envelope: %d bytes, %v", len(got), err)
+	}
+	if _, err := ApplyEnvelope(versions[1], merged); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("merged envelope applied to the wrong version: got %v, want ErrSourceMismatch", err)
+	}
+
+	// v1→v2 后面跟 v1→v2：第二个信封的旧数据不是第一个的新数据
+	_, err = MergePatches(envs[0], envs[0])
+	if !errors.Is(err, ErrSourceMismatch) || !strings.Contains(err.Error(), "patch 2 does not apply to the output of patch 1") {
+		t.Fatalf("broken envelope chain: got %v, want ErrSourceMismatch naming the patches", err)
+	}
+	// 信封与普通补丁混合时结果是普通补丁
+	plain, err := CreateDiffs(versions[2], versions[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err = MergePatches(envs[0], envs[1], plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsEnvelope(merged) {
+		t.Fatal("merging an envelope with a plain patch returned an envelope")
+	}
+	if got, err := ApplyDiffsData(versions[0], merged); err != nil || !bytes.Equal(got, last) {
+		t.Fatalf("mixed chain: %d bytes, %v", len(got), err)
+	}
+}
+
+// TestMergeIncompatible 不能合并的补丁：没有补丁时返回 ErrInvalidArgument；
+// 后一个补丁从旧数据复制的范围超出前一个补丁的输出时返回 ErrSourceMismatch；损坏的补丁返回 ErrCorruptPatch
+func TestMergeIncompatible(t *testing.T) {
+	requireNative(t)
+	if _, err := MergePatches(); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("MergePatches(): got %v, want ErrInvalidArgument", err)
+	}
+	versions := versionChain(3, -1)
+	short, err := CreateDiffs(versions[0], versions[1][:1000])
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := CreateDiffs(versions[1], versions[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MergePatches(short, next); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("the second patch copies past the first one's output: got %v, want ErrSourceMismatch", err)
+	}
+	if _, err := MergePatches(next, []byte("garbage")); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("corrupt second patch: got %v, want ErrCorruptPatch", err)
+	}
+}
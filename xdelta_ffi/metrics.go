@@ -0,0 +1,144 @@
+package xdelta_ffi
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Operation 报告给 Collector 的操作类型
+type Operation string
+
+const (
+	// OpCreate 内存中创建补丁：CreateDiffs、CreateDiffsData、CreateDiffsDataInto、CreateDiffsFixed、CreateDiffsDataContext、CreateDiffsDataPooled、CreateDiffsPairs
+	OpCreate Operation = "create"
+	// OpApply 内存中的补丁应用：ApplyDiffsData、ApplyDiffsDataInto、ApplyDiffsDataContext、ApplyDiffsDataPooled、ApplyDiffs
+	OpApply Operation = "apply"
+	// OpCreateFile CreateDiffsFile、CreateDiffsFileStats
+	OpCreateFile Operation = "create_file"
+	// OpApplyFile ApplyDiffsFile、ApplyDiffsFileStats
+	OpApplyFile Operation = "apply_file"
+	// OpCreateStream CreateDiffsStream、CreateDiffsFromStream
+	OpCreateStream Operation = "create_stream"
+	// OpApplyStream ApplyDiffsStream
+	OpApplyStream Operation = "apply_stream"
+)
+
+// OpInfo 操作开始时已知的信息，长度未知时（例如不知道长度的流）为 -1
+type OpInfo struct {
+	Op Operation
+	// OldSize 旧数据的长度
+	OldSize int64
+	// InputSize 创建补丁时为新数据的长度，应用补丁时为补丁的长度
+	InputSize int64
+}
+
+// OpResult 操作结束时的结果
+type OpResult struct {
+	OpInfo
+	// OutputSize 生成的补丁或新数据的长度；失败时返回结果的接口为 0，写入 io.Writer 的接口为已经写出的字节数
+	OutputSize int64
+	Duration   time.Duration
+	Err        error
+	// ErrorClass Err 的类别，见 ErrorClass
+	ErrorClass string
+}
+
+// Collector 接收操作开始和结束的通知，例如导出为监控指标；方法在执行操作的 goroutine 中同步调用，
+// 可能被并发调用，应当尽快返回
+type Collector interface {
+	OpStart(info OpInfo)
+	OpFinish(res OpResult)
+}
+
+type collectorHolder struct{ c Collector }
+
+// metricsCollector 当前的 Collector，未设置时为 nil
+var metricsCollector atomic.Pointer[collectorHolder]
+
+// SetMetricsCollector 设置接收 Operation 中列出的操作开始和结束通知的 Collector，nil 表示不再报告
+// 可以在运行中随时替换：已经开始的操作仍向开始时的 Collector 报告结束；未设置时每个操作只多一次原子读取和 nil 判断
+func SetMetricsCollector(c Collector) {
+	if c == nil {
+		metricsCollector.Store(nil)
+		return
+	}
+	metricsCollector.Store(&collectorHolder{c: c})
+}
+
+// opMetrics 一次正在报告的操作
+type opMetrics struct {
+	c     Collector
+	info  OpInfo
+	start time.Time
+}
+
+// beginOp 设置了 Collector 时报告操作开始并返回 *opMetrics，否则返回 nil
+func beginOp(op Operation, oldSize, inputSize int64) *opMetrics {
+	h := metricsCollector.Load()
+	if h == nil {
+		return nil
+	}
+	m := &opMetrics{c: h.c, info: OpInfo{Op: op, OldSize: oldSize, InputSize: inputSize}, start: time.Now()}
+	m.c.OpStart(m.info)
+	return m
+}
+
+// end 报告操作结束
+func (m *opMetrics) end(outputSize int64, err error) {
+	if err != nil && outputSize < 0 {
+		outputSize = 0
+	}
+	m.c.OpFinish(OpResult{
+		OpInfo:     m.info,
+		OutputSize: outputSize,
+		Duration:   time.Since(m.start),
+		Err:        err,
+		ErrorClass: ErrorClass(err),
+	})
+}
+
+// ErrorClass 返回 err 的类别，适合作为监控指标的标签：nil 时为空字符串，
+// 否则为 invalid_argument、corrupt_patch、checksum_mismatch、source_mismatch、target_mismatch、output_too_large、io、out_of_memory、
+// unsupported_patch、not_supported、bad_signature、memory_limit、canceled、timeout（WithTimeout 到期）、deadline_exceeded、native 或 other（其他 Go 侧错误，例如读写失败）
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrInvalidArgument):
+		return "invalid_argument"
+	case errors.Is(err, ErrCorruptPatch):
+		return "corrupt_patch"
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum_mismatch"
+	case errors.Is(err, ErrSourceMismatch):
+		return "source_mismatch"
+	case errors.Is(err, ErrTargetMismatch):
+		return "target_mismatch"
+	case errors.Is(err, ErrOutputTooLarge):
+		return "output_too_large"
+	case errors.Is(err, ErrIO):
+		return "io"
+	case errors.Is(err, ErrOutOfMemory):
+		return "out_of_memory"
+	case errors.Is(err, ErrUnsupportedPatch):
+		return "unsupported_patch"
+	case errors.Is(err, ErrNotSupported):
+		return "not_supported"
+	case errors.Is(err, ErrBadSignature):
+		return "bad_signature"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrMemoryLimit):
+		return "memory_limit"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.Is(err, ErrNative):
+		return "native"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,164 @@
+package xdelta_ffi
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets ExpvarCollector 耗时直方图的桶上限（秒）
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// ExpvarCollector 内置的 Collector，把统计发布为 expvar 变量（/debug/vars），结构为：
+//
+//	name.<操作>.started / finished / in_flight      操作次数和正在进行的个数
+//	name.<操作>.old_bytes / input_bytes / output_bytes  累计字节数（长度未知的不计）
+//	name.<操作>.errors.<ErrorClass>                 按类别的失败次数
+//	name.<操作>.duration_seconds                    耗时直方图：{"buckets": {"0.001": n, ..., "+Inf": n}, "count": n, "sum": 秒}
+//	name.composition.diff / apply                   统计了 Composition 的创建、应用（见 StatsCollector）：
+//	                                                count、instructions、copy_bytes、add_bytes、run_bytes、target_bytes，
+//	                                                copy_bytes / target_bytes 即整体的 MatchRatio
+//
+// 直方图的桶是累计的（与 Prometheus 相同），可以直接转换为 Prometheus 的 histogram
+type ExpvarCollector struct {
+	root  *expvar.Map
+	ops   map[Operation]*expvarOp
+	diff  *expvar.Map
+	apply *expvar.Map
+}
+
+type expvarOp struct {
+	vars     *expvar.Map
+	errors   *expvar.Map
+	duration *histogram
+}
+
+// NewExpvarCollector 创建以 name 发布的 ExpvarCollector，用 SetMetricsCollector 启用
+// 与 expvar.NewMap 一样，name 已经发布过时 panic
+func NewExpvarCollector(name string) *ExpvarCollector {
+	c := &ExpvarCollector{root: expvar.NewMap(name), ops: make(map[Operation]*expvarOp)}
+	for _, op := range []Operation{OpCreate, OpApply, OpCreateFile, OpApplyFile, OpCreateStream, OpApplyStream} {
+		// 预先创建所有变量，之后的调用只做原子加法
+		e := &expvarOp{vars: new(expvar.Map), errors: new(expvar.Map), duration: newHistogram(durationBuckets)}
+		for _, k := range []string{"started", "finished", "in_flight", "old_bytes", "input_bytes", "output_bytes"} {
+			e.vars.Set(k, new(expvar.Int))
+		}
+		e.vars.Set("errors", e.errors)
+		e.vars.Set("duration_seconds", e.duration)
+		c.root.Set(string(op), e.vars)
+		c.ops[op] = e
+	}
+	comp := new(expvar.Map)
+	c.diff, c.apply = newCompositionMap(), newCompositionMap()
+	comp.Set("diff", c.diff)
+	comp.Set("apply", c.apply)
+	c.root.Set("composition", comp)
+	return c
+}
+
+func newCompositionMap() *expvar.Map {
+	m := new(expvar.Map)
+	for _, k := range []string{"count", "instructions", "copy_bytes", "add_bytes", "run_bytes", "target_bytes"} {
+		m.Set(k, new(expvar.Int))
+	}
+	return m
+}
+
+func (c *ExpvarCollector) OpStart(info OpInfo) {
+	e := c.ops[info.Op]
+	if e == nil {
+		return
+	}
+	e.vars.Add("started", 1)
+	e.vars.Add("in_flight", 1)
+}
+
+func (c *ExpvarCollector) OpFinish(res OpResult) {
+	e := c.ops[res.Op]
+	if e == nil {
+		return
+	}
+	e.vars.Add("finished", 1)
+	e.vars.Add("in_flight", -1)
+	e.addBytes("old_bytes", res.OldSize)
+	e.addBytes("input_bytes", res.InputSize)
+	e.addBytes("output_bytes", res.OutputSize)
+	if res.ErrorClass != "" {
+		e.errors.Add(res.ErrorClass, 1)
+	}
+	e.duration.observe(res.Duration)
+}
+
+func (c *ExpvarCollector) DiffFinished(s DiffStats) {
+	addComposition(c.diff, s.Composition, s.TargetSize)
+}
+
+func (c *ExpvarCollector) ApplyFinished(s ApplyStats) {
+	addComposition(c.apply, s.Composition, s.TargetSize)
+}
+
+// addComposition 累加一次统计了 Composition 的操作，没有统计的不计
+func addComposition(m *expvar.Map, comp Composition, targetSize int64) {
+	if comp.Instructions < 0 {
+		return
+	}
+	m.Add("count", 1)
+	m.Add("instructions", comp.Instructions)
+	m.Add("copy_bytes", comp.CopyBytes)
+	m.Add("add_bytes", comp.AddBytes)
+	m.Add("run_bytes", comp.RunBytes)
+	m.Add("target_bytes", targetSize)
+}
+
+// addBytes 累加字节数，长度未知（-1）时不计
+func (e *expvarOp) addBytes(key string, n int64) {
+	if n > 0 {
+		e.vars.Add(key, n)
+	}
+}
+
+// histogram 累计桶的耗时直方图，实现 expvar.Var
+type histogram struct {
+	bounds []float64
+	// counts 第 i 个为耗时不超过 bounds[i] 的次数（不累计），最后一个为超过所有上限的次数
+	counts []atomic.Int64
+	count  atomic.Int64
+	sum    atomic.Int64 // 纳秒
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && s > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) String() string {
+	var b strings.Builder
+	b.WriteString(`{"buckets": {`)
+	var total int64
+	for i := range h.counts {
+		total += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q: %d", le, total)
+	}
+	fmt.Fprintf(&b, `}, "count": %d, "sum": %g}`, h.count.Load(), time.Duration(h.sum.Load()).Seconds())
+	return b.String()
+}
@@ -0,0 +1,158 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+const (
+	// multiAnchors 预筛选时最多从新数据中取这么多个块
+	multiAnchors = 1 << 16
+	// multiHashBase 预筛选的滚动哈希的基数
+	multiHashBase = 0x100000001b3
+)
+
+// CreateDiffsMulti 对每个候选旧数据生成到 newData 的补丁，返回补丁最小的候选的下标和补丁；大小相同时取下标小的
+// 先做一次预筛选：从新数据中等距取最多 65536 个块，用滚动哈希统计每个候选包含其中多少个，
+// 包含的块数不到最好的候选一半的候选不再编码；候选之间不相干时（例如资源包与可执行文件）只有少数几个需要完整编码
+// 预筛选和编码都按下标并行，同时进行的个数为 WithThreads 的值（0 为所有 CPU 核心，默认为 1）；
+// 每个候选在一个线程中编码，补丁与单线程的 CreateDiffs(candidates[bestIndex], newData, opts...) 相同
+// 其他 opts 与 CreateDiffs 相同，只是 WithReverse 和 WithDiffStats 只对选中的候选生效：比较时不带它们，
+// 选出之后带着它们把这个候选再编码一次；candidates 为空时返回 ErrInvalidArgument，某个候选编码失败时返回 "candidate i: ..."
+func CreateDiffsMulti(candidates [][]byte, newData []byte, opts ...Option) (bestIndex int, patch []byte, err error) {
+	if len(candidates) == 0 {
+		return -1, nil, fmt.Errorf("%w: no candidates", ErrInvalidArgument)
+	}
+	if err := Init(); err != nil {
+		return -1, nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return -1, nil, err
+	}
+	workers := o.threads
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var longest int
+	for _, c := range candidates {
+		longest = max(longest, len(c))
+	}
+	bs := int(resolveBlockSize(o.blockSize, int64(longest), int64(len(newData))))
+
+	scores := make([]int, len(candidates))
+	if a := newAnchors(newData, bs); a != nil {
+		runParallel(len(candidates), workers, func(i int) {
+			scores[i] = a.count(candidates[i])
+		})
+	}
+	best := slices.Max(scores)
+
+	// 各个候选并发编码，不能都写入调用方的 *reverse 和 *stats
+	single := append(opts[:len(opts):len(opts)], WithThreads(1))
+	scoring := append(single[:len(single):len(single)], WithReverse(nil), WithDiffStats(nil))
+	patches := make([][]byte, len(candidates))
+	errs := make([]error, len(candidates))
+	runParallel(len(candidates), workers, func(i int) {
+		if scores[i]*2 < best {
+			return
+		}
+		patches[i], errs[i] = CreateDiffs(candidates[i], newData, scoring...)
+	})
+	bestIndex = -1
+	for i, p := range patches {
+		if errs[i] != nil {
+			return -1, nil, fmt.Errorf("candidate %d: %w", i, errs[i])
+		}
+		if p != nil && (bestIndex < 0 || len(p) < len(patch)) {
+			bestIndex, patch = i, p
+		}
+	}
+	if o.reverse != nil || o.diffStats != nil {
+		if patch, err = CreateDiffs(candidates[bestIndex], newData, single...); err != nil {
+			return -1, nil, fmt.Errorf("candidate %d: %w", bestIndex, err)
+		}
+	}
+	return bestIndex, patch, nil
+}
+
+// runParallel 用最多 workers 个 goroutine 对 [0, n) 中的每个下标调用 fn，全部返回后返回
+func runParallel(n, workers int, fn func(i int)) {
+	workers = max(min(workers, n), 1)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := range n {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// anchors 预筛选用的新数据的块：等距取出的长为 size 的块的滚动哈希
+type anchors struct {
+	size   int
+	pow    uint64 // multiHashBase 的 size 次方，滚出窗口的字节的权重
+	index  map[uint64]int
+	filter []uint64 // 哈希低位的位图，滚动时先查它，大部分位置不需要查 index
+}
+
+// newAnchors 从 data 中取块；data 不足一个块时返回 nil
+func newAnchors(data []byte, size int) *anchors {
+	if size <= 0 || len(data) < size {
+		return nil
+	}
+	stride := max(size, len(data)/multiAnchors)
+	a := &anchors{size: size, pow: 1, index: make(map[uint64]int), filter: make([]uint64, 1<<14)}
+	for range size {
+		a.pow *= multiHashBase
+	}
+	for off := 0; off+size <= len(data); off += stride {
+		h := rollHash(data[off : off+size])
+		if _, ok := a.index[h]; !ok {
+			a.index[h] = len(a.index)
+			a.filter[h>>6%uint64(len(a.filter))] |= 1 << (h & 63)
+		}
+	}
+	return a
+}
+
+func rollHash(b []byte) uint64 {
+	var h uint64
+	for _, c := range b {
+		h = h*multiHashBase + uint64(c)
+	}
+	return h
+}
+
+// count 返回 data 中出现了多少个不同的块
+func (a *anchors) count(data []byte) int {
+	if len(data) < a.size {
+		return 0
+	}
+	seen := make([]bool, len(a.index))
+	n := 0
+	h := rollHash(data[:a.size])
+	for i := a.size; ; i++ {
+		if a.filter[h>>6%uint64(len(a.filter))]&(1<<(h&63)) != 0 {
+			if k, ok := a.index[h]; ok && !seen[k] {
+				seen[k] = true
+				n++
+			}
+		}
+		if i == len(data) {
+			return n
+		}
+		h = h*multiHashBase + uint64(data[i]) - a.pow*uint64(data[i-a.size])
+	}
+}
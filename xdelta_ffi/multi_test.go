@@ -0,0 +1,92 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestCreateDiffsMulti 选中补丁最小的候选，补丁与单线程的 CreateDiffs 相同，大小相同时取下标小的；
+// 与新数据不相干的候选在预筛选中被排除，不送去编码；WithThreads 不影响结果；没有候选或选项无效时返回 ErrInvalidArgument
+func TestCreateDiffsMulti(t *testing.T) {
+	requireNative(t)
+	textOld, newData := textFixture(1 << 20)
+	randOld, randNew := randomPair()
+	near := bytes.Clone(newData)
+	copy(near[500000:], "a few bytes")
+	candidates := [][]byte{randOld, textOld, near, bytes.Clone(near), randNew}
+
+	for _, threads := range []int{1, 0, 3} {
+		counter := newOpCounter()
+		SetMetricsCollector(counter)
+		best, patch, err := CreateDiffsMulti(candidates, newData, WithThreads(threads))
+		SetMetricsCollector(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if best != 2 {
+			t.Fatalf("threads %d: picked candidate %d, want 2", threads, best)
+		}
+		want, err := CreateDiffs(near, newData, WithThreads(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patch, want) {
+			t.Fatalf("threads %d: patch of %d bytes, CreateDiffs gives %d", threads, len(patch), len(want))
+		}
+		if n := counter.starts[OpCreate].Load(); n != 3 {
+			t.Fatalf("threads %d: %d candidates encoded, want the 3 that share blocks with the new data", threads, n)
+		}
+	}
+	// 候选不同时取补丁最小的，而不是下标最小的
+	if best, _, err := CreateDiffsMulti([][]byte{textOld, near}, newData); err != nil || best != 1 {
+		t.Fatalf("two candidates: picked %d, %v", best, err)
+	}
+
+	if best, _, err := CreateDiffsMulti(nil, newData); !errors.Is(err, ErrInvalidArgument) || best != -1 {
+		t.Fatalf("no candidates: %d, %v, want ErrInvalidArgument", best, err)
+	}
+	if _, _, err := CreateDiffsMulti(candidates, newData, WithBlockSize(MaxBlockSize+1)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("invalid option: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestCreateDiffsMultiReverse WithReverse 和 WithDiffStats 只写入选中的候选的反向补丁和统计，
+// 与对它单独调用 CreateDiffs 的结果相同，不会被同时编码的其他候选覆盖
+func TestCreateDiffsMultiReverse(t *testing.T) {
+	requireNative(t)
+	textOld, newData := textFixture(1 << 20)
+	near := bytes.Clone(newData)
+	copy(near[500000:], "a few bytes")
+	// 其余候选与 near 长度不同，统计中的 SourceSize 也能区分它们
+	// 选中的候选放在最前面，后编码完的其他候选不能覆盖它的结果
+	candidates := [][]byte{near}
+	for i := range 6 {
+		c := append(bytes.Clone(newData[:len(newData)-1000*(i+1)]), textOld[:5000*(i+1)]...)
+		copy(c[100000*(i+1):], "changed in every candidate")
+		candidates = append(candidates, c)
+	}
+	var wantReverse []byte
+	var wantStats DiffStats
+	want, err := CreateDiffs(near, newData, WithThreads(1), WithReverse(&wantReverse), WithDiffStats(&wantStats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		var reverse []byte
+		var stats DiffStats
+		best, patch, err := CreateDiffsMulti(candidates, newData, WithThreads(4), WithReverse(&reverse), WithDiffStats(&stats))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if best != 0 || !bytes.Equal(patch, want) {
+			t.Fatalf("picked candidate %d with a patch of %d bytes, want 0 with %d bytes", best, len(patch), len(want))
+		}
+		if !bytes.Equal(reverse, wantReverse) {
+			t.Fatalf("reverse patch of %d bytes, want the %d bytes of the picked candidate", len(reverse), len(wantReverse))
+		}
+		if stats.SourceSize != wantStats.SourceSize || stats.PatchSize != wantStats.PatchSize || stats.Composition != wantStats.Composition {
+			t.Fatalf("DiffStats %+v, want %+v", stats, wantStats)
+		}
+	}
+}
@@ -0,0 +1,914 @@
+//go:build cgo && !xdelta_purego
+// +build cgo,!xdelta_purego
+
+package xdelta_ffi
+
+/*
+	#cgo CFLAGS: -I${SRCDIR}/include
+	#include <stdlib.h>
+	#include <xdelta_interface.h>
+	#include <xdelta_loader.h>
+
+	// applyPatchInto 不能在 Go 堆上分配：原生层不保留指针，结果按值返回，调用方不需要传出参数的地址；
+	// 原生层可能通过 xdeltaGoLog 回调 Go，因此不能标记 nocallback
+	typedef struct {
+		int code;
+		size_t n;
+		char* err;
+	} xdeltaIntoResult;
+
+	static inline xdeltaIntoResult xdeltaApplyPatchInto(const uint8_t* old_data, size_t old_len,
+		const uint8_t* patch_data, size_t patch_len, uint8_t* dst, size_t dst_cap) {
+		xdeltaIntoResult r = {0, 0, NULL};
+		r.code = xdelta_apply_patch_into(old_data, old_len, patch_data, patch_len, dst, dst_cap, &r.n, &r.err);
+		return r;
+	}
+	#cgo noescape xdeltaApplyPatchInto
+
+	extern int xdeltaGoRead(uintptr_t ctx, uint64_t offset, uint8_t* buf, size_t n);
+	extern int xdeltaGoWrite(uintptr_t ctx, uint8_t* buf, size_t n);
+	extern int xdeltaGoLog(int level, uint8_t* msg, size_t n);
+*/
+import "C"
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// nativeBackend cgo 后端：通过 loader.c 中的转发函数调用运行时加载的原生库
+const nativeBackend = true
+
+// nativeError 根据原生层返回的错误码和本次调用通过 err 参数返回的错误信息构造 *Error，并释放 cerr
+func nativeError(code C.int, cerr *C.char) error {
+	e := &Error{Code: ErrorCode(code)}
+	if cerr != nil {
+		e.Message = C.GoString(cerr)
+		C.xdelta_free_error(cerr)
+	}
+	return e
+}
+
+// openLibrary 加载 path 处的原生库并解析全部函数
+func openLibrary(path string) error {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var errbuf [256]C.char
+	switch C.xdelta_load(cPath, &errbuf[0], C.size_t(len(errbuf))) {
+	case 0:
+	case C.XDELTA_LOAD_ABI_MISMATCH:
+		return fmt.Errorf("%w: %s", ErrIncompatibleLibrary, C.GoString(&errbuf[0]))
+	default:
+		return errors.New(C.GoString(&errbuf[0]))
+	}
+	return nil
+}
+
+// closeLibrary 卸载原生库，loader.c 中的函数指针随之清空
+func closeLibrary() {
+	C.xdelta_unload()
+}
+
+// setNativeLog 把原生层的日志交给 xdeltaGoLog，level 为 levelOff 时关闭
+func setNativeLog(level int) {
+	if level == levelOff {
+		C.xdelta_set_log(nil, C.int(level))
+		return
+	}
+	C.xdelta_set_log(C.xdelta_log_fn(C.xdeltaGoLog), C.int(level))
+}
+
+// nativeVersion 返回原生库的版本信息
+func nativeVersion() versionInfoC {
+	var info C.xdelta_version_info
+	C.xdelta_version(&info)
+	return versionInfoC{
+		abi:          uint32(info.abi),
+		format:       uint32(info.format),
+		crateVersion: *(*[32]byte)(unsafe.Pointer(&info.crate_version)),
+		algorithm:    *(*[128]byte)(unsafe.Pointer(&info.algorithm)),
+	}
+}
+
+// nativeAllocStats 返回原生层跨越 FFI 边界、尚未释放的内存的统计
+func nativeAllocStats() allocStatsC {
+	var s C.xdelta_alloc_stats
+	C.xdelta_debug_alloc_stats(&s)
+	return allocStatsC{
+		liveBuffers:  uint64(s.live_buffers),
+		liveBytes:    uint64(s.live_bytes),
+		liveHandles:  uint64(s.live_handles),
+		totalBuffers: uint64(s.total_buffers),
+		totalBytes:   uint64(s.total_bytes),
+	}
+}
+
+// nativeStats 返回原生库的资源统计
+func nativeStats() nativeStatsC {
+	var s C.xdelta_native_stats_info
+	C.xdelta_native_stats(&s)
+	return nativeStatsC{
+		currentBytes:   uint64(s.current_bytes),
+		peakBytes:      uint64(s.peak_bytes),
+		encoders:       uint64(s.encoders),
+		decoders:       uint64(s.decoders),
+		sourceEncoders: uint64(s.source_encoders),
+		sourceDecoders: uint64(s.source_decoders),
+		bytesEncoded:   uint64(s.bytes_encoded),
+		bytesDecoded:   uint64(s.bytes_decoded),
+	}
+}
+
+// nativeCancel 原生层的协作式取消标记
+type nativeCancel struct {
+	c *C.xdelta_cancel
+}
+
+func newNativeCancel() *nativeCancel {
+	return &nativeCancel{c: C.xdelta_cancel_new()}
+}
+
+func (c *nativeCancel) trigger() {
+	C.xdelta_cancel_trigger(c.c)
+}
+
+func (c *nativeCancel) free() {
+	C.xdelta_cancel_free(c.c)
+}
+
+// progress 返回使用该标记的操作已经处理的输入字节数
+func (c *nativeCancel) progress() int64 {
+	return int64(C.xdelta_cancel_progress(c.c))
+}
+
+// cancelPtr 返回 c 的原生指针，c 为 nil 时返回 NULL
+func cancelPtr(c *nativeCancel) *C.xdelta_cancel {
+	if c == nil {
+		return nil
+	}
+	return c.c
+}
+
+// pinnedPtr 固定 p 的底层数组并返回其数据指针，原生层直接读取 Go 内存而不再复制一份到 C 堆上
+// 空切片返回 NULL（原生层接受长度为 0 的 NULL 输入）
+func pinnedPtr(pin *runtime.Pinner, p []byte) *C.uint8_t {
+	if len(p) == 0 {
+		return nil
+	}
+	ptr := unsafe.SliceData(p)
+	pin.Pin(ptr)
+	return (*C.uint8_t)(unsafe.Pointer(ptr))
+}
+
+// createPatchData 内存版本的编码，结果追加到 alloc 返回的切片之后，cancel 可以为 nil
+func createPatchData(alloc allocFunc, oldData, newData []byte, blockSize uint32, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	oldPtr := pinnedPtr(&pin, oldData)
+	newPtr := pinnedPtr(&pin, newData)
+
+	var patchPtr *C.uint8_t
+	var patchLen C.size_t
+	var cerr *C.char
+
+	var r C.int
+	if e.window > 0 {
+		r = C.xdelta_create_patch_data_window(
+			oldPtr, C.size_t(len(oldData)),
+			newPtr, C.size_t(len(newData)),
+			&patchPtr, &patchLen,
+			C.uint32_t(blockSize),
+			C.int(e.format), C.int(e.secondary), C.int(e.level), C.uint64_t(e.window),
+			cancelPtr(cancel),
+			&cerr,
+		)
+	} else {
+		r = C.xdelta_create_patch_data_cancel(
+			oldPtr, C.size_t(len(oldData)),
+			newPtr, C.size_t(len(newData)),
+			&patchPtr, &patchLen,
+			C.uint32_t(blockSize),
+			C.int(e.format), C.int(e.secondary), C.int(e.level), C.int(e.threads),
+			cancelPtr(cancel),
+			&cerr,
+		)
+	}
+
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+
+	return takeData(alloc, patchPtr, patchLen)
+}
+
+// applyPatchInto 把补丁解码到 dst，返回输出长度；输出超过 len(dst) 时返回 ErrOutputTooLarge，成功时不分配 Go 内存
+func applyPatchInto(dst, oldData, diffsData []byte) (int, error) {
+	r := C.xdeltaApplyPatchInto(
+		bytesPtr(oldData), C.size_t(len(oldData)),
+		bytesPtr(diffsData), C.size_t(len(diffsData)),
+		bytesPtr(dst), C.size_t(len(dst)),
+	)
+	if r.code != 0 {
+		return 0, nativeError(r.code, r.err)
+	}
+	return int(r.n), nil
+}
+
+// applyPatchExact 把补丁解码到 dst，len(dst) 必须是补丁声明的输出长度，实际输出长度不同时返回 ErrCorruptPatch；cancel 可以为 nil
+func applyPatchExact(dst, oldData, diffsData []byte, cancel *nativeCancel) error {
+	var cerr *C.char
+	r := C.xdelta_apply_patch_exact(
+		bytesPtr(oldData), C.size_t(len(oldData)),
+		bytesPtr(diffsData), C.size_t(len(diffsData)),
+		bytesPtr(dst), C.size_t(len(dst)),
+		cancelPtr(cancel), &cerr,
+	)
+	if r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// verifyPatchData 解码但丢弃输出，返回输出的长度和 SHA-256，cancel 可以为 nil
+func verifyPatchData(oldData, diffsData []byte, maxOutput uint64, cancel *nativeCancel) (uint64, [sha256.Size]byte, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	oldPtr := pinnedPtr(&pin, oldData)
+	patchPtr := pinnedPtr(&pin, diffsData)
+
+	var newLen C.uint64_t
+	var sum [sha256.Size]byte
+	var cerr *C.char
+
+	r := C.xdelta_verify_patch_data(
+		oldPtr, C.size_t(len(oldData)),
+		patchPtr, C.size_t(len(diffsData)),
+		C.uint64_t(maxOutput),
+		&newLen, (*C.uint8_t)(unsafe.Pointer(&sum[0])),
+		cancelPtr(cancel),
+		&cerr,
+	)
+
+	if r != 0 {
+		return 0, sum, nativeError(r, cerr)
+	}
+	return uint64(newLen), sum, nil
+}
+
+// validatePatchData 只检查补丁的结构，返回补丁声明的输出长度；sourceLen 为旧数据长度，未知时为 -1
+func validatePatchData(diffsData []byte, sourceLen int64) (uint64, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, diffsData)
+
+	var newLen C.uint64_t
+	var cerr *C.char
+	r := C.xdelta_validate_patch_data(patchPtr, C.size_t(len(diffsData)), C.int64_t(sourceLen), &newLen, &cerr)
+	if r != 0 {
+		return 0, nativeError(r, cerr)
+	}
+	return uint64(newLen), nil
+}
+
+// inspectPatchData 统计补丁的组成
+func inspectPatchData(diffsData []byte) (patchInfoC, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, diffsData)
+
+	var info C.xdelta_patch_info
+	var cerr *C.char
+	r := C.xdelta_inspect_patch_data(patchPtr, C.size_t(len(diffsData)), &info, &cerr)
+	if r != 0 {
+		return patchInfoC{}, nativeError(r, cerr)
+	}
+	return patchInfoC{
+		format:       uint32(info.format),
+		secondary:    uint32(info.secondary),
+		windows:      uint64(info.windows),
+		instructions: uint64(info.instructions),
+		addBytes:     uint64(info.add_bytes),
+		copyBytes:    uint64(info.copy_bytes),
+		runBytes:     uint64(info.run_bytes),
+		targetSize:   uint64(info.target_size),
+		sourceSize:   uint64(info.source_size),
+		checksum:     uint32(info.checksum),
+	}, nil
+}
+
+// mergePatchData 合并首尾相接存放在 joined 中的补丁，lens 为各自的长度
+func mergePatchData(alloc allocFunc, joined []byte, lens []int) ([]byte, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, joined)
+	clens := make([]C.size_t, len(lens))
+	for i, n := range lens {
+		clens[i] = C.size_t(n)
+	}
+	var lensPtr *C.size_t
+	if len(clens) > 0 {
+		lensPtr = &clens[0]
+	}
+
+	var outPtr *C.uint8_t
+	var outLen C.size_t
+	var cerr *C.char
+	r := C.xdelta_merge_patches(patchPtr, lensPtr, C.size_t(len(lens)), &outPtr, &outLen, &cerr)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(alloc, outPtr, outLen)
+}
+
+// createChunkSignature 旧数据按平均 avgChunk 字节的内容定义分块的签名
+func createChunkSignature(oldData []byte, avgChunk uint32, cancel *nativeCancel) ([]byte, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	oldPtr := pinnedPtr(&pin, oldData)
+
+	var sigPtr *C.uint8_t
+	var sigLen C.size_t
+	var cerr *C.char
+	r := C.xdelta_create_chunk_signature(oldPtr, C.size_t(len(oldData)), C.uint32_t(avgChunk), cancelPtr(cancel), &sigPtr, &sigLen, &cerr)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(appendTo(nil), sigPtr, sigLen)
+}
+
+// createPatchFromChunkSignature 从内容定义分块的签名和新数据创建补丁，结果追加到 alloc 返回的切片之后
+func createPatchFromChunkSignature(alloc allocFunc, sig, newData []byte, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	sigPtr := pinnedPtr(&pin, sig)
+	newPtr := pinnedPtr(&pin, newData)
+
+	var patchPtr *C.uint8_t
+	var patchLen C.size_t
+	var cerr *C.char
+	r := C.xdelta_create_patch_from_chunk_signature(
+		sigPtr, C.size_t(len(sig)),
+		newPtr, C.size_t(len(newData)),
+		C.int(e.format), C.int(e.secondary), C.int(e.level),
+		cancelPtr(cancel),
+		&patchPtr, &patchLen,
+		&cerr,
+	)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(alloc, patchPtr, patchLen)
+}
+
+// patchTargetSize 读取补丁声明的输出长度
+func patchTargetSize(diffsData []byte) (uint64, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, diffsData)
+
+	var n C.uint64_t
+	var cerr *C.char
+	r := C.xdelta_patch_target_size(patchPtr, C.size_t(len(diffsData)), &n, &cerr)
+	if r != 0 {
+		return 0, nativeError(r, cerr)
+	}
+	return uint64(n), nil
+}
+
+// patchSegments 把补丁切成可以分别解码的段，返回补丁头的长度和各段
+func patchSegments(diffsData []byte, segmentSize uint64) (int, []patchSegment, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, diffsData)
+
+	var segs *C.xdelta_patch_segment
+	var count, headerLen C.size_t
+	var cerr *C.char
+	r := C.xdelta_patch_segments(patchPtr, C.size_t(len(diffsData)), C.uint64_t(segmentSize), &segs, &count, &headerLen, &cerr)
+	if r != 0 {
+		return 0, nil, nativeError(r, cerr)
+	}
+	return int(headerLen), takeSegments(segs, count), nil
+}
+
+// patchFileSegments 与 patchSegments 相同，但补丁为文件 patchPath
+func patchFileSegments(patchPath string, segmentSize uint64) (int, []patchSegment, error) {
+	cPatch := C.CString(patchPath)
+	defer C.free(unsafe.Pointer(cPatch))
+
+	var segs *C.xdelta_patch_segment
+	var count, headerLen C.size_t
+	var cerr *C.char
+	r := C.xdelta_patch_file_segments(cPatch, C.uint64_t(segmentSize), &segs, &count, &headerLen, &cerr)
+	if r != 0 {
+		return 0, nil, nativeError(r, cerr)
+	}
+	return int(headerLen), takeSegments(segs, count), nil
+}
+
+// sourceRanges 补丁读取的旧数据区间，相隔不超过 gap 的合并
+func sourceRanges(diffsData []byte, gap uint64) ([]SourceRange, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, diffsData)
+
+	var ranges *C.xdelta_source_range
+	var count C.size_t
+	var cerr *C.char
+	r := C.xdelta_patch_source_ranges(patchPtr, C.size_t(len(diffsData)), C.uint64_t(gap), &ranges, &count, &cerr)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	defer C.xdelta_free_data((*C.uint8_t)(unsafe.Pointer(ranges)))
+	out := make([]SourceRange, int(count))
+	for i, s := range unsafe.Slice(ranges, int(count)) {
+		out[i] = SourceRange{Offset: int64(s.offset), Length: int64(s.len)}
+	}
+	return out, nil
+}
+
+// takeSegments 复制原生层返回的段并释放
+func takeSegments(segs *C.xdelta_patch_segment, count C.size_t) []patchSegment {
+	defer C.xdelta_free_data((*C.uint8_t)(unsafe.Pointer(segs)))
+	out := make([]patchSegment, int(count))
+	for i, s := range unsafe.Slice(segs, int(count)) {
+		out[i] = patchSegment{
+			patchOffset:  uint64(s.patch_offset),
+			patchLen:     uint64(s.patch_len),
+			targetOffset: uint64(s.target_offset),
+			targetLen:    uint64(s.target_len),
+		}
+	}
+	return out
+}
+
+// takeData 把原生层分配的缓冲区追加到 alloc 返回的切片之后并释放，容量足够时不会分配 Go 内存
+func takeData(alloc allocFunc, p *C.uint8_t, n C.size_t) ([]byte, error) {
+	defer C.xdelta_free_data(p)
+	size, err := resultLen(uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	dst := alloc(size)
+	if size == 0 {
+		return dst, nil
+	}
+	return append(dst, unsafe.Slice((*byte)(unsafe.Pointer(p)), size)...), nil
+}
+
+func fileStats(s *C.xdelta_file_stats) FileStats {
+	return FileStats{
+		OldSize:   int64(s.old_size),
+		NewSize:   int64(s.new_size),
+		PatchSize: int64(s.patch_size),
+	}
+}
+
+// createPatchFd 文件版本的编码，原生层通过 old、new、patch 的文件描述符读写，调用期间这些文件必须保持打开
+func createPatchFd(old, new, patch *os.File, blockSize uint32, e encoding, mmap bool) (FileStats, error) {
+	var useMmap C.int
+	if mmap {
+		useMmap = 1
+	}
+	var stats C.xdelta_file_stats
+	var cerr *C.char
+	r := C.xdelta_create_patch_fd(C.intptr_t(old.Fd()), C.intptr_t(new.Fd()), C.intptr_t(patch.Fd()), C.uint32_t(blockSize),
+		C.int(e.format), C.int(e.secondary), C.int(e.level), C.int(e.threads), C.uint64_t(e.window), useMmap, &stats, &cerr)
+	// Fd 返回的描述符只在 *os.File 存活期间有效，不能让它们在原生调用结束前被回收关闭
+	runtime.KeepAlive(old)
+	runtime.KeepAlive(new)
+	runtime.KeepAlive(patch)
+	if r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return fileStats(&stats), nil
+}
+
+// createPatchDataToFile 内存输入的编码，补丁由原生层边编码边写入 patchPath
+func createPatchDataToFile(oldData, newData []byte, patchPath string, blockSize uint32, e encoding, cancel *nativeCancel) (FileStats, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	oldPtr := pinnedPtr(&pin, oldData)
+	newPtr := pinnedPtr(&pin, newData)
+	cPatch := C.CString(patchPath)
+	defer C.free(unsafe.Pointer(cPatch))
+
+	var stats C.xdelta_file_stats
+	var cerr *C.char
+	r := C.xdelta_create_patch_data_to_file(
+		oldPtr, C.size_t(len(oldData)),
+		newPtr, C.size_t(len(newData)),
+		cPatch, C.uint32_t(blockSize),
+		C.int(e.format), C.int(e.secondary), C.int(e.level), C.int(e.threads), C.uint64_t(e.window),
+		cancelPtr(cancel),
+		&stats, &cerr,
+	)
+	if r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return fileStats(&stats), nil
+}
+
+// createPatchInto 内存版本的编码，补丁直接写入 dst，返回补丁的长度；放不下时返回 ErrOutputTooLarge，长度仍为完整补丁的长度
+func createPatchInto(dst, oldData, newData []byte, blockSize uint32, e encoding, cancel *nativeCancel) (int, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	oldPtr := pinnedPtr(&pin, oldData)
+	newPtr := pinnedPtr(&pin, newData)
+
+	var n C.size_t
+	var cerr *C.char
+	r := C.xdelta_create_patch_into(
+		oldPtr, C.size_t(len(oldData)),
+		newPtr, C.size_t(len(newData)),
+		bytesPtr(dst), C.size_t(len(dst)), &n,
+		C.uint32_t(blockSize),
+		C.int(e.format), C.int(e.secondary), C.int(e.level), C.int(e.threads), C.uint64_t(e.window),
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return int(n), nativeError(r, cerr)
+	}
+	return int(n), nil
+}
+
+// createPatches 批量编码，data 为全部输入，items 中每一对的结果由原生层填写，返回按顺序拼接的全部补丁和错误信息
+func createPatches(data []byte, items []batchItem, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	dataPtr := pinnedPtr(&pin, data)
+	var itemsPtr *C.xdelta_batch_item
+	if len(items) > 0 {
+		pin.Pin(&items[0])
+		itemsPtr = (*C.xdelta_batch_item)(unsafe.Pointer(&items[0]))
+	}
+
+	var outPtr *C.uint8_t
+	var outLen C.size_t
+	var cerr *C.char
+	r := C.xdelta_create_patches(
+		dataPtr, C.size_t(len(data)),
+		itemsPtr, C.size_t(len(items)),
+		C.int(e.format), C.int(e.secondary), C.int(e.level), C.int(e.threads), C.uint64_t(e.window),
+		cancelPtr(cancel),
+		&outPtr, &outLen,
+		&cerr,
+	)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(appendTo(nil), outPtr, outLen)
+}
+
+// applyPatchFd 文件版本的解码，原生层通过 old、patch、out 的文件描述符读写，结果写入 out
+func applyPatchFd(old, patch, out *os.File, maxOutput uint64, mmap bool) (FileStats, error) {
+	var useMmap C.int
+	if mmap {
+		useMmap = 1
+	}
+	var stats C.xdelta_file_stats
+	var cerr *C.char
+	r := C.xdelta_apply_patch_fd(C.intptr_t(old.Fd()), C.intptr_t(patch.Fd()), C.intptr_t(out.Fd()), C.uint64_t(maxOutput), useMmap, &stats, &cerr)
+	runtime.KeepAlive(old)
+	runtime.KeepAlive(patch)
+	runtime.KeepAlive(out)
+	if r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return fileStats(&stats), nil
+}
+
+// applyPatchInPlace 把补丁原地应用到 path
+func applyPatchInPlace(path string, patch []byte, maxOutput, maxSpill uint64) (FileStats, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, patch)
+
+	var stats C.xdelta_file_stats
+	var cerr *C.char
+	r := C.xdelta_apply_patch_in_place(cPath, patchPtr, C.size_t(len(patch)), C.uint64_t(maxOutput), C.uint64_t(maxSpill), &stats, &cerr)
+	if r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return fileStats(&stats), nil
+}
+
+// nativeEncoder 原生流式编码器的薄封装
+type nativeEncoder struct {
+	h *C.xdelta_encoder
+}
+
+func newNativeEncoder(blockSize uint32, e encoding) (*nativeEncoder, error) {
+	var cerr *C.char
+	h := C.xdelta_encoder_new(C.uint32_t(blockSize), C.int(e.format), C.int(e.secondary), C.int(e.level), &cerr)
+	if h == nil {
+		return nil, nativeError(C.int(CodeInvalidArgument), cerr)
+	}
+	return &nativeEncoder{h: h}, nil
+}
+
+// bytesPtr 返回切片数据指针，仅在本次 cgo 调用期间有效
+func bytesPtr(p []byte) *C.uint8_t {
+	if len(p) == 0 {
+		return nil
+	}
+	return (*C.uint8_t)(unsafe.Pointer(unsafe.SliceData(p)))
+}
+
+// addSource 送入一段旧数据，必须在第一次 write 之前完成
+func (e *nativeEncoder) addSource(p []byte) error {
+	var cerr *C.char
+	if r := C.xdelta_encoder_add_source(e.h, bytesPtr(p), C.size_t(len(p)), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// signature 结束送入旧数据，并把旧数据的块签名写入 w
+func (e *nativeEncoder) signature(w io.Writer) error {
+	var out *C.uint8_t
+	var outLen C.size_t
+	var cerr *C.char
+	if r := C.xdelta_encoder_signature(e.h, &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+// loadSignature 用块签名代替旧数据，必须在 addSource 和 write 之前调用
+func (e *nativeEncoder) loadSignature(sig []byte) error {
+	var cerr *C.char
+	if r := C.xdelta_encoder_load_signature(e.h, bytesPtr(sig), C.size_t(len(sig)), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// setSourceOffset 声明送入的旧数据从完整旧数据的 offset 处开始，必须在第一次 write 之前调用
+func (e *nativeEncoder) setSourceOffset(offset int64) error {
+	var cerr *C.char
+	if r := C.xdelta_encoder_set_source_offset(e.h, C.uint64_t(offset), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// setThreads 设置编码线程数，必须在第一次 write 之前调用
+func (e *nativeEncoder) setThreads(threads int) error {
+	var cerr *C.char
+	if r := C.xdelta_encoder_set_threads(e.h, C.int(threads), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// write 送入一段新数据，并把产生的补丁字节写入 w
+func (e *nativeEncoder) write(p []byte, w io.Writer) error {
+	var out *C.uint8_t
+	var outLen C.size_t
+	var cerr *C.char
+	if r := C.xdelta_encoder_write(e.h, bytesPtr(p), C.size_t(len(p)), &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+// flush 强制结束当前窗口，并把产生的补丁字节写入 w
+func (e *nativeEncoder) flush(w io.Writer) error {
+	var out *C.uint8_t
+	var outLen C.size_t
+	var cerr *C.char
+	if r := C.xdelta_encoder_flush(e.h, &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+// finish 结束编码，并把剩余的补丁字节写入 w
+func (e *nativeEncoder) finish(w io.Writer) error {
+	var out *C.uint8_t
+	var outLen C.size_t
+	var cerr *C.char
+	if r := C.xdelta_encoder_finish(e.h, &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+func (e *nativeEncoder) close() {
+	if e.h != nil {
+		C.xdelta_encoder_free(e.h)
+		e.h = nil
+	}
+}
+
+// nativeSourceEncoder 绑定到一份旧数据的原生编码器，diff 可以并发调用
+type nativeSourceEncoder struct {
+	h *C.xdelta_source_encoder
+}
+
+func newNativeSourceEncoder(oldData []byte, blockSize uint32, threads int, cancel *nativeCancel) (*nativeSourceEncoder, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	var h *C.xdelta_source_encoder
+	var cerr *C.char
+	r := C.xdelta_source_encoder_new(pinnedPtr(&pin, oldData), C.size_t(len(oldData)), C.uint32_t(blockSize), C.int(threads), cancelPtr(cancel), &h, &cerr)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return &nativeSourceEncoder{h: h}, nil
+}
+
+// newNativeSourceEncoderFromSignature 从 CreateSignature 生成的签名建立编码器
+func newNativeSourceEncoderFromSignature(sig []byte) (*nativeSourceEncoder, error) {
+	var h *C.xdelta_source_encoder
+	var cerr *C.char
+	if r := C.xdelta_source_encoder_from_signature(bytesPtr(sig), C.size_t(len(sig)), &h, &cerr); r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return &nativeSourceEncoder{h: h}, nil
+}
+
+// stream 创建共享块签名的流式编码器，直接 write，不需要 addSource
+func (s *nativeSourceEncoder) stream(e encoding) (*nativeEncoder, error) {
+	var cerr *C.char
+	h := C.xdelta_source_encoder_stream(s.h, C.int(e.format), C.int(e.secondary), C.int(e.level), &cerr)
+	if h == nil {
+		return nil, nativeError(C.int(CodeInvalidArgument), cerr)
+	}
+	return &nativeEncoder{h: h}, nil
+}
+
+// diff 对 newData 编码，结果追加到 alloc 返回的切片之后，cancel 可以为 nil
+func (s *nativeSourceEncoder) diff(alloc allocFunc, newData []byte, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	var patchPtr *C.uint8_t
+	var patchLen C.size_t
+	var cerr *C.char
+	r := C.xdelta_source_encoder_diff(
+		s.h,
+		pinnedPtr(&pin, newData), C.size_t(len(newData)),
+		&patchPtr, &patchLen,
+		C.int(e.format), C.int(e.secondary), C.int(e.level), C.int(e.threads),
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(alloc, patchPtr, patchLen)
+}
+
+func (s *nativeSourceEncoder) close() {
+	if s.h != nil {
+		C.xdelta_source_encoder_free(s.h)
+		s.h = nil
+	}
+}
+
+// nativeSourceDecoder 持有一份旧数据副本的原生解码器，apply 可以并发调用
+type nativeSourceDecoder struct {
+	h *C.xdelta_source_decoder
+}
+
+func newNativeSourceDecoder(oldData []byte) (*nativeSourceDecoder, error) {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	var h *C.xdelta_source_decoder
+	var cerr *C.char
+	if r := C.xdelta_source_decoder_new(pinnedPtr(&pin, oldData), C.size_t(len(oldData)), &h, &cerr); r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return &nativeSourceDecoder{h: h}, nil
+}
+
+// applyExact 把 diffsData 应用到旧数据副本，解码到 dst，len(dst) 必须是补丁声明的输出长度；cancel 可以为 nil
+func (s *nativeSourceDecoder) applyExact(dst, diffsData []byte, cancel *nativeCancel) error {
+	var cerr *C.char
+	r := C.xdelta_source_decoder_apply_exact(
+		s.h,
+		bytesPtr(diffsData), C.size_t(len(diffsData)),
+		bytesPtr(dst), C.size_t(len(dst)),
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+func (s *nativeSourceDecoder) close() {
+	if s.h != nil {
+		C.xdelta_source_decoder_free(s.h)
+		s.h = nil
+	}
+}
+
+// writeNative 把原生层持有的缓冲区直接写入 w，不经过额外拷贝
+func writeNative(w io.Writer, p *C.uint8_t, n C.size_t) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := w.Write(unsafe.Slice((*byte)(unsafe.Pointer(p)), int(n)))
+	return err
+}
+
+// nativeDecoder 原生流式解码器的薄封装，旧数据和输出通过回调访问
+type nativeDecoder struct {
+	h      *C.xdelta_decoder
+	io     *streamIO
+	handle cgo.Handle
+}
+
+func newNativeDecoder(old io.ReaderAt, out io.Writer, maxOutput uint64) (*nativeDecoder, error) {
+	d := &nativeDecoder{io: &streamIO{src: old, dst: out}}
+	d.handle = cgo.NewHandle(d.io)
+	var cerr *C.char
+	d.h = C.xdelta_decoder_new(
+		C.xdelta_read_fn(C.xdeltaGoRead),
+		C.xdelta_write_fn(C.xdeltaGoWrite),
+		C.uintptr_t(d.handle),
+		C.int64_t(sourceSize(old)),
+		C.uint64_t(maxOutput),
+		&cerr,
+	)
+	if d.h == nil {
+		d.handle.Delete()
+		return nil, nativeError(C.int(CodeInvalidArgument), cerr)
+	}
+	return d, nil
+}
+
+// err 优先返回回调中出现的 Go 错误，否则返回原生层的错误
+func (d *nativeDecoder) err(code C.int, cerr *C.char) error {
+	if d.io.err != nil {
+		if cerr != nil {
+			C.xdelta_free_error(cerr)
+		}
+		return d.io.err
+	}
+	return nativeError(code, cerr)
+}
+
+func (d *nativeDecoder) write(p []byte) error {
+	var cerr *C.char
+	if r := C.xdelta_decoder_write(d.h, bytesPtr(p), C.size_t(len(p)), &cerr); r != 0 {
+		return d.err(r, cerr)
+	}
+	return nil
+}
+
+// finish 在补丁截断于记录中途时返回包装了 io.ErrUnexpectedEOF 的错误
+func (d *nativeDecoder) finish() error {
+	var cerr *C.char
+	if r := C.xdelta_decoder_finish(d.h, &cerr); r != 0 {
+		return fmt.Errorf("%w: %w", io.ErrUnexpectedEOF, d.err(r, cerr))
+	}
+	return nil
+}
+
+func (d *nativeDecoder) close() {
+	if d.h != nil {
+		C.xdelta_decoder_free(d.h)
+		d.h = nil
+		d.handle.Delete()
+	}
+}
+
+// dumpPatch 把补丁的文本列表通过写回调写入 w，instructions 为 true 时逐条列出指令
+func dumpPatch(diffsData []byte, w io.Writer, instructions bool) error {
+	var pin runtime.Pinner
+	defer pin.Unpin()
+	patchPtr := pinnedPtr(&pin, diffsData)
+
+	s := &streamIO{dst: w}
+	handle := cgo.NewHandle(s)
+	defer handle.Delete()
+	var instr C.int
+	if instructions {
+		instr = 1
+	}
+	var cerr *C.char
+	r := C.xdelta_dump_patch(patchPtr, C.size_t(len(diffsData)), instr, C.xdelta_write_fn(C.xdeltaGoWrite), C.uintptr_t(handle), &cerr)
+	if r == 0 {
+		return nil
+	}
+	if s.err != nil {
+		if cerr != nil {
+			C.xdelta_free_error(cerr)
+		}
+		return s.err
+	}
+	return nativeError(r, cerr)
+}
@@ -0,0 +1,933 @@
+//go:build xdelta_purego
+// +build xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+)
+
+// nativeBackend purego 后端：运行时通过 dlopen/LoadLibrary 加载原生库，编译时不需要 cgo
+const nativeBackend = true
+
+// 函数签名与 xdelta_interface.h 一一对应，原生句柄统一用 uintptr 表示
+var (
+	xdeltaCreatePatchDataCancel func(oldData unsafe.Pointer, oldLen uintptr, newData unsafe.Pointer, newLen uintptr,
+		patchData *unsafe.Pointer, patchLen *uintptr, blockSize uint32, format, secondary, level, threads int32, cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaCreatePatchDataWindow func(oldData unsafe.Pointer, oldLen uintptr, newData unsafe.Pointer, newLen uintptr,
+		patchData *unsafe.Pointer, patchLen *uintptr, blockSize uint32, format, secondary, level int32, sourceWindow uint64, cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaApplyPatchInto func(oldData unsafe.Pointer, oldLen uintptr, patchData unsafe.Pointer, patchLen uintptr,
+		dst unsafe.Pointer, dstCap uintptr, newLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaApplyPatchExact func(oldData unsafe.Pointer, oldLen uintptr, patchData unsafe.Pointer, patchLen uintptr,
+		dst unsafe.Pointer, dstCap uintptr, cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaVerifyPatchData func(oldData unsafe.Pointer, oldLen uintptr, patchData unsafe.Pointer, patchLen uintptr,
+		maxOutput uint64, newLen *uint64, sha256 *byte, cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaValidatePatchData     func(patchData unsafe.Pointer, patchLen uintptr, sourceLen int64, newLen *uint64, err *unsafe.Pointer) int32
+	xdeltaInspectPatchData      func(patchData unsafe.Pointer, patchLen uintptr, info *patchInfoC, err *unsafe.Pointer) int32
+	xdeltaPatchTargetSize       func(patchData unsafe.Pointer, patchLen uintptr, newLen *uint64, err *unsafe.Pointer) int32
+	xdeltaPatchSegments         func(patchData unsafe.Pointer, patchLen uintptr, segmentSize uint64, segments *unsafe.Pointer, count, headerLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaPatchFileSegments     func(patchPath string, segmentSize uint64, segments *unsafe.Pointer, count, headerLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaPatchSourceRanges     func(patchData unsafe.Pointer, patchLen uintptr, gap uint64, ranges *unsafe.Pointer, count *uintptr, err *unsafe.Pointer) int32
+	xdeltaMergePatches          func(patches, lens unsafe.Pointer, count uintptr, out *unsafe.Pointer, outLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaCreatePatchFd         func(oldFd, newFd, patchFd uintptr, blockSize uint32, format, secondary, level, threads int32, sourceWindow uint64, useMmap int32, stats *fileStatsC, err *unsafe.Pointer) int32
+	xdeltaCreatePatchDataToFile func(oldData unsafe.Pointer, oldLen uintptr, newData unsafe.Pointer, newLen uintptr,
+		patchPath string, blockSize uint32, format, secondary, level, threads int32, sourceWindow uint64, cancel uintptr, stats *fileStatsC, err *unsafe.Pointer) int32
+	xdeltaCreatePatchInto func(oldData unsafe.Pointer, oldLen uintptr, newData unsafe.Pointer, newLen uintptr, dst unsafe.Pointer, dstCap uintptr,
+		patchLen *uintptr, blockSize uint32, format, secondary, level, threads int32, sourceWindow uint64, cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaCreatePatches func(data unsafe.Pointer, dataLen uintptr, items unsafe.Pointer, count uintptr, format, secondary, level, threads int32,
+		sourceWindow uint64, cancel uintptr, out *unsafe.Pointer, outLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaApplyPatchFd      func(oldFd, patchFd, outFd uintptr, maxOutput uint64, useMmap int32, stats *fileStatsC, err *unsafe.Pointer) int32
+	xdeltaApplyPatchInPlace func(path string, patch unsafe.Pointer, patchLen uintptr, maxOutput, maxSpill uint64, stats *fileStatsC, err *unsafe.Pointer) int32
+
+	xdeltaCancelNew      func() uintptr
+	xdeltaCancelTrigger  func(c uintptr)
+	xdeltaCancelFree     func(c uintptr)
+	xdeltaCancelProgress func(c uintptr) uint64
+
+	xdeltaEncoderNew             func(blockSize uint32, format, secondary, level int32, err *unsafe.Pointer) uintptr
+	xdeltaEncoderAddSource       func(h uintptr, data unsafe.Pointer, n uintptr, err *unsafe.Pointer) int32
+	xdeltaEncoderSignature       func(h uintptr, out *unsafe.Pointer, outLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaEncoderLoadSignature   func(h uintptr, sig unsafe.Pointer, n uintptr, err *unsafe.Pointer) int32
+	xdeltaEncoderSetSourceOffset func(h uintptr, offset uint64, err *unsafe.Pointer) int32
+	xdeltaEncoderSetThreads      func(h uintptr, threads int32, err *unsafe.Pointer) int32
+	xdeltaEncoderWrite           func(h uintptr, data unsafe.Pointer, n uintptr, out *unsafe.Pointer, outLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaEncoderFlush           func(h uintptr, out *unsafe.Pointer, outLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaEncoderFinish          func(h uintptr, out *unsafe.Pointer, outLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaEncoderFree            func(h uintptr)
+
+	xdeltaDecoderNew    func(read, write, ctx uintptr, sourceLen int64, maxOutput uint64, err *unsafe.Pointer) uintptr
+	xdeltaDecoderWrite  func(h uintptr, data unsafe.Pointer, n uintptr, err *unsafe.Pointer) int32
+	xdeltaDecoderFinish func(h uintptr, err *unsafe.Pointer) int32
+	xdeltaDecoderFree   func(h uintptr)
+
+	xdeltaSourceEncoderNew  func(oldData unsafe.Pointer, oldLen uintptr, blockSize uint32, threads int32, cancel uintptr, h *uintptr, err *unsafe.Pointer) int32
+	xdeltaSourceEncoderDiff func(h uintptr, newData unsafe.Pointer, newLen uintptr, patchData *unsafe.Pointer, patchLen *uintptr,
+		format, secondary, level, threads int32, cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaSourceEncoderFromSignature func(sig unsafe.Pointer, sigLen uintptr, h *uintptr, err *unsafe.Pointer) int32
+	xdeltaSourceEncoderStream        func(h uintptr, format, secondary, level int32, err *unsafe.Pointer) uintptr
+	xdeltaSourceEncoderFree          func(h uintptr)
+
+	xdeltaCreateChunkSignature          func(oldData unsafe.Pointer, oldLen uintptr, avgChunk uint32, cancel uintptr, sig *unsafe.Pointer, sigLen *uintptr, err *unsafe.Pointer) int32
+	xdeltaCreatePatchFromChunkSignature func(sig unsafe.Pointer, sigLen uintptr, newData unsafe.Pointer, newLen uintptr,
+		format, secondary, level int32, cancel uintptr, patchData *unsafe.Pointer, patchLen *uintptr, err *unsafe.Pointer) int32
+
+	xdeltaSourceDecoderNew   func(oldData unsafe.Pointer, oldLen uintptr, h *uintptr, err *unsafe.Pointer) int32
+	xdeltaSourceDecoderApply func(h uintptr, patchData unsafe.Pointer, patchLen uintptr, newData *unsafe.Pointer, newLen *uintptr,
+		maxOutput uint64, cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaSourceDecoderApplyExact func(h uintptr, patchData unsafe.Pointer, patchLen uintptr, dst unsafe.Pointer, dstCap uintptr,
+		cancel uintptr, err *unsafe.Pointer) int32
+	xdeltaSourceDecoderFree func(h uintptr)
+
+	xdeltaDumpPatch func(patchData unsafe.Pointer, patchLen uintptr, instructions int32, write, ctx uintptr, err *unsafe.Pointer) int32
+
+	xdeltaSetLog          func(cb uintptr, level int32)
+	xdeltaVersion         func(info *versionInfoC)
+	xdeltaDebugAllocStats func(stats *allocStatsC)
+	xdeltaNativeStats     func(stats *nativeStatsC)
+
+	xdeltaFreeData  func(p unsafe.Pointer)
+	xdeltaFreeError func(p unsafe.Pointer)
+)
+
+// symbols 需要从原生库解析的全部函数
+var symbols = []struct {
+	name string
+	fptr any
+}{
+	{"xdelta_create_patch_data_cancel", &xdeltaCreatePatchDataCancel},
+	{"xdelta_create_patch_data_window", &xdeltaCreatePatchDataWindow},
+	{"xdelta_apply_patch_into", &xdeltaApplyPatchInto},
+	{"xdelta_apply_patch_exact", &xdeltaApplyPatchExact},
+	{"xdelta_verify_patch_data", &xdeltaVerifyPatchData},
+	{"xdelta_validate_patch_data", &xdeltaValidatePatchData},
+	{"xdelta_inspect_patch_data", &xdeltaInspectPatchData},
+	{"xdelta_patch_target_size", &xdeltaPatchTargetSize},
+	{"xdelta_patch_segments", &xdeltaPatchSegments},
+	{"xdelta_patch_file_segments", &xdeltaPatchFileSegments},
+	{"xdelta_patch_source_ranges", &xdeltaPatchSourceRanges},
+	{"xdelta_merge_patches", &xdeltaMergePatches},
+	{"xdelta_create_chunk_signature", &xdeltaCreateChunkSignature},
+	{"xdelta_create_patch_from_chunk_signature", &xdeltaCreatePatchFromChunkSignature},
+	{"xdelta_create_patch_fd", &xdeltaCreatePatchFd},
+	{"xdelta_create_patch_data_to_file", &xdeltaCreatePatchDataToFile},
+	{"xdelta_create_patch_into", &xdeltaCreatePatchInto},
+	{"xdelta_create_patches", &xdeltaCreatePatches},
+	{"xdelta_apply_patch_fd", &xdeltaApplyPatchFd},
+	{"xdelta_apply_patch_in_place", &xdeltaApplyPatchInPlace},
+	{"xdelta_cancel_new", &xdeltaCancelNew},
+	{"xdelta_cancel_trigger", &xdeltaCancelTrigger},
+	{"xdelta_cancel_free", &xdeltaCancelFree},
+	{"xdelta_cancel_progress", &xdeltaCancelProgress},
+	{"xdelta_encoder_new", &xdeltaEncoderNew},
+	{"xdelta_encoder_add_source", &xdeltaEncoderAddSource},
+	{"xdelta_encoder_signature", &xdeltaEncoderSignature},
+	{"xdelta_encoder_load_signature", &xdeltaEncoderLoadSignature},
+	{"xdelta_encoder_set_source_offset", &xdeltaEncoderSetSourceOffset},
+	{"xdelta_encoder_set_threads", &xdeltaEncoderSetThreads},
+	{"xdelta_encoder_write", &xdeltaEncoderWrite},
+	{"xdelta_encoder_flush", &xdeltaEncoderFlush},
+	{"xdelta_encoder_finish", &xdeltaEncoderFinish},
+	{"xdelta_encoder_free", &xdeltaEncoderFree},
+	{"xdelta_decoder_new", &xdeltaDecoderNew},
+	{"xdelta_decoder_write", &xdeltaDecoderWrite},
+	{"xdelta_decoder_finish", &xdeltaDecoderFinish},
+	{"xdelta_decoder_free", &xdeltaDecoderFree},
+	{"xdelta_source_encoder_new", &xdeltaSourceEncoderNew},
+	{"xdelta_source_encoder_diff", &xdeltaSourceEncoderDiff},
+	{"xdelta_source_encoder_free", &xdeltaSourceEncoderFree},
+	{"xdelta_source_encoder_from_signature", &xdeltaSourceEncoderFromSignature},
+	{"xdelta_source_encoder_stream", &xdeltaSourceEncoderStream},
+	{"xdelta_source_decoder_new", &xdeltaSourceDecoderNew},
+	{"xdelta_source_decoder_apply", &xdeltaSourceDecoderApply},
+	{"xdelta_source_decoder_apply_exact", &xdeltaSourceDecoderApplyExact},
+	{"xdelta_source_decoder_free", &xdeltaSourceDecoderFree},
+	{"xdelta_dump_patch", &xdeltaDumpPatch},
+	{"xdelta_set_log", &xdeltaSetLog},
+	{"xdelta_version", &xdeltaVersion},
+	{"xdelta_debug_alloc_stats", &xdeltaDebugAllocStats},
+	{"xdelta_native_stats", &xdeltaNativeStats},
+	{"xdelta_free_data", &xdeltaFreeData},
+	{"xdelta_free_error", &xdeltaFreeError},
+}
+
+// readCallback/writeCallback 解码器使用的 C 回调，logCallback 日志回调，都只创建一次（回调数量有上限且不会释放），
+// Shutdown 之后重新加载时继续使用
+var readCallback, writeCallback, logCallback uintptr
+
+// library 当前加载的原生库句柄
+var library uintptr
+
+// openLibrary 加载 path 处的原生库；所有符号都解析成功后才注册，缺少符号时在加载阶段就返回错误
+func openLibrary(path string) error {
+	lib, err := dlopen(path)
+	if err != nil {
+		return err
+	}
+	if err := checkLibraryABI(lib); err != nil {
+		dlclose(lib)
+		return err
+	}
+	addrs := make([]uintptr, len(symbols))
+	for i, s := range symbols {
+		addr, err := dlsym(lib, s.name)
+		if err != nil || addr == 0 {
+			dlclose(lib)
+			return fmt.Errorf("missing symbol %s", s.name)
+		}
+		addrs[i] = addr
+	}
+	for i, s := range symbols {
+		purego.RegisterFunc(s.fptr, addrs[i])
+	}
+	library = lib
+	if readCallback == 0 {
+		readCallback = purego.NewCallback(goRead)
+		writeCallback = purego.NewCallback(goWrite)
+		logCallback = purego.NewCallback(goLog)
+	}
+	return nil
+}
+
+// checkLibraryABI 在解析其余符号之前通过 xdelta_version 确认 lib 的 ABI 不比本包旧，
+// 旧版本的库即使恰好导出了全部符号，行为也可能与本包不一致
+func checkLibraryABI(lib uintptr) error {
+	addr, err := dlsym(lib, "xdelta_version")
+	if err != nil || addr == 0 {
+		return fmt.Errorf("%w: missing symbol xdelta_version (the library predates ABI revision %d)", ErrIncompatibleLibrary, WrapperABIVersion)
+	}
+	var version func(info *versionInfoC)
+	purego.RegisterFunc(&version, addr)
+	var info versionInfoC
+	version(&info)
+	if int(info.abi) < WrapperABIVersion {
+		return fmt.Errorf("%w: library %s has ABI revision %d, older than the %d this package requires",
+			ErrIncompatibleLibrary, cString(info.crateVersion[:]), info.abi, WrapperABIVersion)
+	}
+	return nil
+}
+
+// closeLibrary 卸载原生库；注册过的函数变量仍指向库中的地址，在下一次 openLibrary 之前不能调用
+func closeLibrary() {
+	dlclose(library)
+	library = 0
+}
+
+// goString 把原生层的 C 字符串复制为 Go 字符串
+func goString(p unsafe.Pointer) string {
+	n := 0
+	for *(*byte)(unsafe.Add(p, n)) != 0 {
+		n++
+	}
+	return string(unsafe.Slice((*byte)(p), n))
+}
+
+// nativeError 根据原生层返回的错误码和本次调用通过 err 参数返回的错误信息构造 *Error，并释放 cerr
+func nativeError(code int32, cerr unsafe.Pointer) error {
+	e := &Error{Code: ErrorCode(code)}
+	if cerr != nil {
+		e.Message = goString(cerr)
+		xdeltaFreeError(cerr)
+	}
+	return e
+}
+
+// bytesPtr 返回切片数据指针，仅在本次调用期间有效
+func bytesPtr(p []byte) unsafe.Pointer {
+	if len(p) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(unsafe.SliceData(p))
+}
+
+// takeData 把原生层分配的缓冲区追加到 alloc 返回的切片之后并释放，容量足够时不会分配 Go 内存
+func takeData(alloc allocFunc, p unsafe.Pointer, n uintptr) ([]byte, error) {
+	defer xdeltaFreeData(p)
+	size, err := resultLen(uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	return append(alloc(size), unsafe.Slice((*byte)(p), size)...), nil
+}
+
+// nativeCancel 原生层的协作式取消标记
+type nativeCancel struct {
+	c uintptr
+}
+
+func newNativeCancel() *nativeCancel {
+	return &nativeCancel{c: xdeltaCancelNew()}
+}
+
+func (c *nativeCancel) trigger() {
+	xdeltaCancelTrigger(c.c)
+}
+
+func (c *nativeCancel) free() {
+	xdeltaCancelFree(c.c)
+}
+
+// progress 返回使用该标记的操作已经处理的输入字节数
+func (c *nativeCancel) progress() int64 {
+	return int64(xdeltaCancelProgress(c.c))
+}
+
+// cancelPtr 返回 c 的原生指针，c 为 nil 时返回 NULL
+func cancelPtr(c *nativeCancel) uintptr {
+	if c == nil {
+		return 0
+	}
+	return c.c
+}
+
+// createPatchData 内存版本的编码，结果追加到 alloc 返回的切片之后，cancel 可以为 nil
+func createPatchData(alloc allocFunc, oldData, newData []byte, blockSize uint32, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var patchPtr, cerr unsafe.Pointer
+	var patchLen uintptr
+	if e.window > 0 {
+		r := xdeltaCreatePatchDataWindow(
+			bytesPtr(oldData), uintptr(len(oldData)),
+			bytesPtr(newData), uintptr(len(newData)),
+			&patchPtr, &patchLen,
+			blockSize,
+			int32(e.format), int32(e.secondary), int32(e.level), e.window,
+			cancelPtr(cancel),
+			&cerr,
+		)
+		if r != 0 {
+			return nil, nativeError(r, cerr)
+		}
+		return takeData(alloc, patchPtr, patchLen)
+	}
+	r := xdeltaCreatePatchDataCancel(
+		bytesPtr(oldData), uintptr(len(oldData)),
+		bytesPtr(newData), uintptr(len(newData)),
+		&patchPtr, &patchLen,
+		blockSize,
+		int32(e.format), int32(e.secondary), int32(e.level), int32(e.threads),
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(alloc, patchPtr, patchLen)
+}
+
+// applyPatchInto 把补丁解码到 dst，返回输出长度；输出超过 len(dst) 时返回 ErrOutputTooLarge
+func applyPatchInto(dst, oldData, diffsData []byte) (int, error) {
+	var cerr unsafe.Pointer
+	var n uintptr
+	r := xdeltaApplyPatchInto(
+		bytesPtr(oldData), uintptr(len(oldData)),
+		bytesPtr(diffsData), uintptr(len(diffsData)),
+		bytesPtr(dst), uintptr(len(dst)),
+		&n, &cerr,
+	)
+	if r != 0 {
+		return 0, nativeError(r, cerr)
+	}
+	return int(n), nil
+}
+
+// applyPatchExact 把补丁解码到 dst，len(dst) 必须是补丁声明的输出长度，实际输出长度不同时返回 ErrCorruptPatch；cancel 可以为 nil
+func applyPatchExact(dst, oldData, diffsData []byte, cancel *nativeCancel) error {
+	var cerr unsafe.Pointer
+	r := xdeltaApplyPatchExact(
+		bytesPtr(oldData), uintptr(len(oldData)),
+		bytesPtr(diffsData), uintptr(len(diffsData)),
+		bytesPtr(dst), uintptr(len(dst)),
+		cancelPtr(cancel), &cerr,
+	)
+	if r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// verifyPatchData 解码但丢弃输出，返回输出的长度和 SHA-256，cancel 可以为 nil
+func verifyPatchData(oldData, diffsData []byte, maxOutput uint64, cancel *nativeCancel) (uint64, [sha256.Size]byte, error) {
+	var cerr unsafe.Pointer
+	var newLen uint64
+	var sum [sha256.Size]byte
+	r := xdeltaVerifyPatchData(
+		bytesPtr(oldData), uintptr(len(oldData)),
+		bytesPtr(diffsData), uintptr(len(diffsData)),
+		maxOutput,
+		&newLen, &sum[0],
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return 0, sum, nativeError(r, cerr)
+	}
+	return newLen, sum, nil
+}
+
+// validatePatchData 只检查补丁的结构，返回补丁声明的输出长度；sourceLen 为旧数据长度，未知时为 -1
+func validatePatchData(diffsData []byte, sourceLen int64) (uint64, error) {
+	var cerr unsafe.Pointer
+	var newLen uint64
+	r := xdeltaValidatePatchData(bytesPtr(diffsData), uintptr(len(diffsData)), sourceLen, &newLen, &cerr)
+	if r != 0 {
+		return 0, nativeError(r, cerr)
+	}
+	return newLen, nil
+}
+
+// inspectPatchData 统计补丁的组成
+func inspectPatchData(diffsData []byte) (patchInfoC, error) {
+	var cerr unsafe.Pointer
+	var info patchInfoC
+	r := xdeltaInspectPatchData(bytesPtr(diffsData), uintptr(len(diffsData)), &info, &cerr)
+	if r != 0 {
+		return patchInfoC{}, nativeError(r, cerr)
+	}
+	return info, nil
+}
+
+// mergePatchData 合并首尾相接存放在 joined 中的补丁，lens 为各自的长度
+func mergePatchData(alloc allocFunc, joined []byte, lens []int) ([]byte, error) {
+	ulens := make([]uintptr, len(lens))
+	for i, n := range lens {
+		ulens[i] = uintptr(n)
+	}
+	var lensPtr unsafe.Pointer
+	if len(ulens) > 0 {
+		lensPtr = unsafe.Pointer(&ulens[0])
+	}
+	var outPtr, cerr unsafe.Pointer
+	var outLen uintptr
+	r := xdeltaMergePatches(bytesPtr(joined), lensPtr, uintptr(len(lens)), &outPtr, &outLen, &cerr)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(alloc, outPtr, outLen)
+}
+
+// createChunkSignature 旧数据按平均 avgChunk 字节的内容定义分块的签名
+func createChunkSignature(oldData []byte, avgChunk uint32, cancel *nativeCancel) ([]byte, error) {
+	var sigPtr, cerr unsafe.Pointer
+	var sigLen uintptr
+	r := xdeltaCreateChunkSignature(bytesPtr(oldData), uintptr(len(oldData)), avgChunk, cancelPtr(cancel), &sigPtr, &sigLen, &cerr)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(appendTo(nil), sigPtr, sigLen)
+}
+
+// createPatchFromChunkSignature 从内容定义分块的签名和新数据创建补丁，结果追加到 alloc 返回的切片之后
+func createPatchFromChunkSignature(alloc allocFunc, sig, newData []byte, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var patchPtr, cerr unsafe.Pointer
+	var patchLen uintptr
+	r := xdeltaCreatePatchFromChunkSignature(
+		bytesPtr(sig), uintptr(len(sig)),
+		bytesPtr(newData), uintptr(len(newData)),
+		int32(e.format), int32(e.secondary), int32(e.level),
+		cancelPtr(cancel), &patchPtr, &patchLen, &cerr)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(alloc, patchPtr, patchLen)
+}
+
+// patchTargetSize 读取补丁声明的输出长度
+func patchTargetSize(diffsData []byte) (uint64, error) {
+	var cerr unsafe.Pointer
+	var n uint64
+	r := xdeltaPatchTargetSize(bytesPtr(diffsData), uintptr(len(diffsData)), &n, &cerr)
+	if r != 0 {
+		return 0, nativeError(r, cerr)
+	}
+	return n, nil
+}
+
+// patchSegments 把补丁切成可以分别解码的段，返回补丁头的长度和各段
+func patchSegments(diffsData []byte, segmentSize uint64) (int, []patchSegment, error) {
+	var segs, cerr unsafe.Pointer
+	var count, headerLen uintptr
+	r := xdeltaPatchSegments(bytesPtr(diffsData), uintptr(len(diffsData)), segmentSize, &segs, &count, &headerLen, &cerr)
+	if r != 0 {
+		return 0, nil, nativeError(r, cerr)
+	}
+	defer xdeltaFreeData(segs)
+	return int(headerLen), append([]patchSegment(nil), unsafe.Slice((*patchSegment)(segs), count)...), nil
+}
+
+func patchFileSegments(patchPath string, segmentSize uint64) (int, []patchSegment, error) {
+	var segs, cerr unsafe.Pointer
+	var count, headerLen uintptr
+	r := xdeltaPatchFileSegments(patchPath, segmentSize, &segs, &count, &headerLen, &cerr)
+	if r != 0 {
+		return 0, nil, nativeError(r, cerr)
+	}
+	defer xdeltaFreeData(segs)
+	return int(headerLen), append([]patchSegment(nil), unsafe.Slice((*patchSegment)(segs), count)...), nil
+}
+
+func sourceRanges(diffsData []byte, gap uint64) ([]SourceRange, error) {
+	var ranges, cerr unsafe.Pointer
+	var count uintptr
+	if r := xdeltaPatchSourceRanges(bytesPtr(diffsData), uintptr(len(diffsData)), gap, &ranges, &count, &cerr); r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	defer xdeltaFreeData(ranges)
+	// SourceRange 的两个 int64 与 xdelta_source_range 的布局一致
+	return append([]SourceRange(nil), unsafe.Slice((*SourceRange)(ranges), count)...), nil
+}
+
+// fileStatsC 与 C 侧 xdelta_file_stats 布局一致
+type fileStatsC struct {
+	oldSize   uint64
+	newSize   uint64
+	patchSize uint64
+}
+
+func (s *fileStatsC) stats() FileStats {
+	return FileStats{
+		OldSize:   int64(s.oldSize),
+		NewSize:   int64(s.newSize),
+		PatchSize: int64(s.patchSize),
+	}
+}
+
+// createPatchFd 文件版本的编码，原生层通过 old、new、patch 的文件描述符读写，调用期间这些文件必须保持打开
+func createPatchFd(old, new, patch *os.File, blockSize uint32, e encoding, mmap bool) (FileStats, error) {
+	var useMmap int32
+	if mmap {
+		useMmap = 1
+	}
+	var stats fileStatsC
+	var cerr unsafe.Pointer
+	r := xdeltaCreatePatchFd(old.Fd(), new.Fd(), patch.Fd(), blockSize,
+		int32(e.format), int32(e.secondary), int32(e.level), int32(e.threads), e.window, useMmap, &stats, &cerr)
+	// Fd 返回的描述符只在 *os.File 存活期间有效，不能让它们在原生调用结束前被回收关闭
+	runtime.KeepAlive(old)
+	runtime.KeepAlive(new)
+	runtime.KeepAlive(patch)
+	if r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return stats.stats(), nil
+}
+
+// createPatchDataToFile 内存输入的编码，补丁由原生层边编码边写入 patchPath
+func createPatchDataToFile(oldData, newData []byte, patchPath string, blockSize uint32, e encoding, cancel *nativeCancel) (FileStats, error) {
+	var stats fileStatsC
+	var cerr unsafe.Pointer
+	r := xdeltaCreatePatchDataToFile(
+		bytesPtr(oldData), uintptr(len(oldData)),
+		bytesPtr(newData), uintptr(len(newData)),
+		patchPath, blockSize,
+		int32(e.format), int32(e.secondary), int32(e.level), int32(e.threads), e.window,
+		cancelPtr(cancel),
+		&stats, &cerr,
+	)
+	if r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return stats.stats(), nil
+}
+
+// createPatchInto 内存版本的编码，补丁直接写入 dst，返回补丁的长度；放不下时返回 ErrOutputTooLarge，长度仍为完整补丁的长度
+func createPatchInto(dst, oldData, newData []byte, blockSize uint32, e encoding, cancel *nativeCancel) (int, error) {
+	var n uintptr
+	var cerr unsafe.Pointer
+	r := xdeltaCreatePatchInto(
+		bytesPtr(oldData), uintptr(len(oldData)),
+		bytesPtr(newData), uintptr(len(newData)),
+		bytesPtr(dst), uintptr(len(dst)), &n,
+		blockSize,
+		int32(e.format), int32(e.secondary), int32(e.level), int32(e.threads), e.window,
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return int(n), nativeError(r, cerr)
+	}
+	return int(n), nil
+}
+
+// createPatches 批量编码，data 为全部输入，items 中每一对的结果由原生层填写，返回按顺序拼接的全部补丁和错误信息
+func createPatches(data []byte, items []batchItem, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var out, cerr unsafe.Pointer
+	var outLen uintptr
+	r := xdeltaCreatePatches(
+		bytesPtr(data), uintptr(len(data)),
+		unsafe.Pointer(unsafe.SliceData(items)), uintptr(len(items)),
+		int32(e.format), int32(e.secondary), int32(e.level), int32(e.threads), e.window,
+		cancelPtr(cancel),
+		&out, &outLen,
+		&cerr,
+	)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(appendTo(nil), out, outLen)
+}
+
+// applyPatchFd 文件版本的解码，原生层通过 old、patch、out 的文件描述符读写，结果写入 out
+func applyPatchFd(old, patch, out *os.File, maxOutput uint64, mmap bool) (FileStats, error) {
+	var useMmap int32
+	if mmap {
+		useMmap = 1
+	}
+	var stats fileStatsC
+	var cerr unsafe.Pointer
+	r := xdeltaApplyPatchFd(old.Fd(), patch.Fd(), out.Fd(), maxOutput, useMmap, &stats, &cerr)
+	runtime.KeepAlive(old)
+	runtime.KeepAlive(patch)
+	runtime.KeepAlive(out)
+	if r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return stats.stats(), nil
+}
+
+func applyPatchInPlace(path string, patch []byte, maxOutput, maxSpill uint64) (FileStats, error) {
+	var stats fileStatsC
+	var cerr unsafe.Pointer
+	if r := xdeltaApplyPatchInPlace(path, bytesPtr(patch), uintptr(len(patch)), maxOutput, maxSpill, &stats, &cerr); r != 0 {
+		return FileStats{}, nativeError(r, cerr)
+	}
+	return stats.stats(), nil
+}
+
+// nativeEncoder 原生流式编码器的薄封装
+type nativeEncoder struct {
+	h uintptr
+}
+
+func newNativeEncoder(blockSize uint32, e encoding) (*nativeEncoder, error) {
+	var cerr unsafe.Pointer
+	h := xdeltaEncoderNew(blockSize, int32(e.format), int32(e.secondary), int32(e.level), &cerr)
+	if h == 0 {
+		return nil, nativeError(int32(CodeInvalidArgument), cerr)
+	}
+	return &nativeEncoder{h: h}, nil
+}
+
+// addSource 送入一段旧数据，必须在第一次 write 之前完成
+func (e *nativeEncoder) addSource(p []byte) error {
+	var cerr unsafe.Pointer
+	if r := xdeltaEncoderAddSource(e.h, bytesPtr(p), uintptr(len(p)), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// signature 结束送入旧数据，并把旧数据的块签名写入 w
+func (e *nativeEncoder) signature(w io.Writer) error {
+	var out, cerr unsafe.Pointer
+	var outLen uintptr
+	if r := xdeltaEncoderSignature(e.h, &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+// loadSignature 用块签名代替旧数据，必须在 addSource 和 write 之前调用
+func (e *nativeEncoder) loadSignature(sig []byte) error {
+	var cerr unsafe.Pointer
+	if r := xdeltaEncoderLoadSignature(e.h, bytesPtr(sig), uintptr(len(sig)), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// setSourceOffset 声明送入的旧数据从完整旧数据的 offset 处开始，必须在第一次 write 之前调用
+func (e *nativeEncoder) setSourceOffset(offset int64) error {
+	var cerr unsafe.Pointer
+	if r := xdeltaEncoderSetSourceOffset(e.h, uint64(offset), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// setThreads 设置编码线程数，必须在第一次 write 之前调用
+func (e *nativeEncoder) setThreads(threads int) error {
+	var cerr unsafe.Pointer
+	if r := xdeltaEncoderSetThreads(e.h, int32(threads), &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+// write 送入一段新数据，并把产生的补丁字节写入 w
+func (e *nativeEncoder) write(p []byte, w io.Writer) error {
+	var out, cerr unsafe.Pointer
+	var outLen uintptr
+	if r := xdeltaEncoderWrite(e.h, bytesPtr(p), uintptr(len(p)), &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+// flush 强制结束当前窗口，并把产生的补丁字节写入 w
+func (e *nativeEncoder) flush(w io.Writer) error {
+	var out, cerr unsafe.Pointer
+	var outLen uintptr
+	if r := xdeltaEncoderFlush(e.h, &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+// finish 结束编码，并把剩余的补丁字节写入 w
+func (e *nativeEncoder) finish(w io.Writer) error {
+	var out, cerr unsafe.Pointer
+	var outLen uintptr
+	if r := xdeltaEncoderFinish(e.h, &out, &outLen, &cerr); r != 0 {
+		return nativeError(r, cerr)
+	}
+	return writeNative(w, out, outLen)
+}
+
+func (e *nativeEncoder) close() {
+	if e.h != 0 {
+		xdeltaEncoderFree(e.h)
+		e.h = 0
+	}
+}
+
+// writeNative 把原生层持有的缓冲区直接写入 w，不经过额外拷贝
+func writeNative(w io.Writer, p unsafe.Pointer, n uintptr) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := w.Write(unsafe.Slice((*byte)(p), n))
+	return err
+}
+
+// streams 回调 ctx 到 *streamIO 的映射，作用与 cgo.Handle 相同
+var (
+	streams    sync.Map
+	nextStream atomic.Uintptr
+)
+
+func goRead(ctx uintptr, offset uint64, buf unsafe.Pointer, n uintptr) uintptr {
+	s, _ := streams.Load(ctx)
+	return uintptr(s.(*streamIO).readAt(unsafe.Slice((*byte)(buf), n), offset))
+}
+
+func goWrite(ctx uintptr, buf unsafe.Pointer, n uintptr) uintptr {
+	s, _ := streams.Load(ctx)
+	return uintptr(s.(*streamIO).write(unsafe.Slice((*byte)(buf), n)))
+}
+
+func goLog(level int32, msg unsafe.Pointer, n uintptr) uintptr {
+	nativeLog(int(level), string(unsafe.Slice((*byte)(msg), n)))
+	return 0
+}
+
+// setNativeLog 把原生层的日志交给 goLog，level 为 levelOff 时关闭
+func setNativeLog(level int) {
+	if level == levelOff {
+		xdeltaSetLog(0, int32(level))
+		return
+	}
+	xdeltaSetLog(logCallback, int32(level))
+}
+
+// nativeVersion 返回原生库的版本信息
+func nativeVersion() versionInfoC {
+	var info versionInfoC
+	xdeltaVersion(&info)
+	return info
+}
+
+func nativeAllocStats() allocStatsC {
+	var s allocStatsC
+	xdeltaDebugAllocStats(&s)
+	return s
+}
+
+// nativeStats 返回原生库的资源统计
+func nativeStats() nativeStatsC {
+	var s nativeStatsC
+	xdeltaNativeStats(&s)
+	return s
+}
+
+// nativeSourceEncoder 绑定到一份旧数据的原生编码器，diff 可以并发调用
+type nativeSourceEncoder struct {
+	h uintptr
+}
+
+func newNativeSourceEncoder(oldData []byte, blockSize uint32, threads int, cancel *nativeCancel) (*nativeSourceEncoder, error) {
+	var h uintptr
+	var cerr unsafe.Pointer
+	if r := xdeltaSourceEncoderNew(bytesPtr(oldData), uintptr(len(oldData)), blockSize, int32(threads), cancelPtr(cancel), &h, &cerr); r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return &nativeSourceEncoder{h: h}, nil
+}
+
+// newNativeSourceEncoderFromSignature 从 CreateSignature 生成的签名建立编码器
+func newNativeSourceEncoderFromSignature(sig []byte) (*nativeSourceEncoder, error) {
+	var h uintptr
+	var cerr unsafe.Pointer
+	if r := xdeltaSourceEncoderFromSignature(bytesPtr(sig), uintptr(len(sig)), &h, &cerr); r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return &nativeSourceEncoder{h: h}, nil
+}
+
+// stream 创建共享块签名的流式编码器，直接 write，不需要 addSource
+func (s *nativeSourceEncoder) stream(e encoding) (*nativeEncoder, error) {
+	var cerr unsafe.Pointer
+	h := xdeltaSourceEncoderStream(s.h, int32(e.format), int32(e.secondary), int32(e.level), &cerr)
+	if h == 0 {
+		return nil, nativeError(int32(CodeInvalidArgument), cerr)
+	}
+	return &nativeEncoder{h: h}, nil
+}
+
+// diff 对 newData 编码，结果追加到 alloc 返回的切片之后，cancel 可以为 nil
+func (s *nativeSourceEncoder) diff(alloc allocFunc, newData []byte, e encoding, cancel *nativeCancel) ([]byte, error) {
+	var patchPtr, cerr unsafe.Pointer
+	var patchLen uintptr
+	r := xdeltaSourceEncoderDiff(
+		s.h,
+		bytesPtr(newData), uintptr(len(newData)),
+		&patchPtr, &patchLen,
+		int32(e.format), int32(e.secondary), int32(e.level), int32(e.threads),
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return takeData(alloc, patchPtr, patchLen)
+}
+
+func (s *nativeSourceEncoder) close() {
+	if s.h != 0 {
+		xdeltaSourceEncoderFree(s.h)
+		s.h = 0
+	}
+}
+
+// nativeSourceDecoder 持有一份旧数据副本的原生解码器，apply 可以并发调用
+type nativeSourceDecoder struct {
+	h uintptr
+}
+
+func newNativeSourceDecoder(oldData []byte) (*nativeSourceDecoder, error) {
+	var h uintptr
+	var cerr unsafe.Pointer
+	if r := xdeltaSourceDecoderNew(bytesPtr(oldData), uintptr(len(oldData)), &h, &cerr); r != 0 {
+		return nil, nativeError(r, cerr)
+	}
+	return &nativeSourceDecoder{h: h}, nil
+}
+
+// applyExact 把 diffsData 应用到旧数据副本，解码到 dst，len(dst) 必须是补丁声明的输出长度；cancel 可以为 nil
+func (s *nativeSourceDecoder) applyExact(dst, diffsData []byte, cancel *nativeCancel) error {
+	var cerr unsafe.Pointer
+	r := xdeltaSourceDecoderApplyExact(
+		s.h,
+		bytesPtr(diffsData), uintptr(len(diffsData)),
+		bytesPtr(dst), uintptr(len(dst)),
+		cancelPtr(cancel),
+		&cerr,
+	)
+	if r != 0 {
+		return nativeError(r, cerr)
+	}
+	return nil
+}
+
+func (s *nativeSourceDecoder) close() {
+	if s.h != 0 {
+		xdeltaSourceDecoderFree(s.h)
+		s.h = 0
+	}
+}
+
+// nativeDecoder 原生流式解码器的薄封装，旧数据和输出通过回调访问
+type nativeDecoder struct {
+	h   uintptr
+	io  *streamIO
+	ctx uintptr
+}
+
+func newNativeDecoder(old io.ReaderAt, out io.Writer, maxOutput uint64) (*nativeDecoder, error) {
+	d := &nativeDecoder{io: &streamIO{src: old, dst: out}, ctx: nextStream.Add(1)}
+	streams.Store(d.ctx, d.io)
+	var cerr unsafe.Pointer
+	d.h = xdeltaDecoderNew(readCallback, writeCallback, d.ctx, sourceSize(old), maxOutput, &cerr)
+	if d.h == 0 {
+		streams.Delete(d.ctx)
+		return nil, nativeError(int32(CodeInvalidArgument), cerr)
+	}
+	return d, nil
+}
+
+// err 优先返回回调中出现的 Go 错误，否则返回原生层的错误
+func (d *nativeDecoder) err(code int32, cerr unsafe.Pointer) error {
+	if d.io.err != nil {
+		if cerr != nil {
+			xdeltaFreeError(cerr)
+		}
+		return d.io.err
+	}
+	return nativeError(code, cerr)
+}
+
+func (d *nativeDecoder) write(p []byte) error {
+	var cerr unsafe.Pointer
+	if r := xdeltaDecoderWrite(d.h, bytesPtr(p), uintptr(len(p)), &cerr); r != 0 {
+		return d.err(r, cerr)
+	}
+	return nil
+}
+
+// finish 在补丁截断于记录中途时返回包装了 io.ErrUnexpectedEOF 的错误
+func (d *nativeDecoder) finish() error {
+	var cerr unsafe.Pointer
+	if r := xdeltaDecoderFinish(d.h, &cerr); r != 0 {
+		return fmt.Errorf("%w: %w", io.ErrUnexpectedEOF, d.err(r, cerr))
+	}
+	return nil
+}
+
+func (d *nativeDecoder) close() {
+	if d.h != 0 {
+		xdeltaDecoderFree(d.h)
+		d.h = 0
+		streams.Delete(d.ctx)
+	}
+}
+
+// dumpPatch 把补丁的文本列表通过写回调写入 w，instructions 为 true 时逐条列出指令
+func dumpPatch(diffsData []byte, w io.Writer, instructions bool) error {
+	s := &streamIO{dst: w}
+	ctx := nextStream.Add(1)
+	streams.Store(ctx, s)
+	defer streams.Delete(ctx)
+	var instr int32
+	if instructions {
+		instr = 1
+	}
+	var cerr unsafe.Pointer
+	r := xdeltaDumpPatch(bytesPtr(diffsData), uintptr(len(diffsData)), instr, writeCallback, ctx, &cerr)
+	if r == 0 {
+		return nil
+	}
+	if s.err != nil {
+		if cerr != nil {
+			xdeltaFreeError(cerr)
+		}
+		return s.err
+	}
+	return nativeError(r, cerr)
+}
@@ -0,0 +1,19 @@
+//go:build xdelta_purego && (darwin || freebsd || linux || netbsd)
+// +build xdelta_purego
+// +build darwin freebsd linux netbsd
+
+package xdelta_ffi
+
+import "github.com/ebitengine/purego"
+
+func dlopen(path string) (uintptr, error) {
+	return purego.Dlopen(path, purego.RTLD_NOW|purego.RTLD_LOCAL)
+}
+
+func dlsym(lib uintptr, name string) (uintptr, error) {
+	return purego.Dlsym(lib, name)
+}
+
+func dlclose(lib uintptr) {
+	_ = purego.Dlclose(lib)
+}
@@ -0,0 +1,38 @@
+//go:build xdelta_purego
+// +build xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	loadLibrarySearchDLLLoadDir = 0x00000100
+	loadLibrarySearchSystem32   = 0x00000800
+)
+
+// kernel32 是 KnownDLL，总是从 System32 加载
+var procLoadLibraryExW = syscall.NewLazyDLL("kernel32.dll").NewProc("LoadLibraryExW")
+
+// dlopen 与 loader.c 相同：path 必须是绝对路径，xdelta.dll 及其依赖只从 DLL 所在目录和 System32 中查找
+func dlopen(path string) (uintptr, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	h, _, err := procLoadLibraryExW.Call(uintptr(unsafe.Pointer(p)), 0, loadLibrarySearchDLLLoadDir|loadLibrarySearchSystem32)
+	if h == 0 {
+		return 0, err
+	}
+	return h, nil
+}
+
+func dlsym(lib uintptr, name string) (uintptr, error) {
+	return syscall.GetProcAddress(syscall.Handle(lib), name)
+}
+
+func dlclose(lib uintptr) {
+	_ = syscall.FreeLibrary(syscall.Handle(lib))
+}
@@ -0,0 +1,365 @@
+//go:build !cgo && !xdelta_purego
+// +build !cgo,!xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// nativeBackend 没有原生后端（CGO_ENABLED=0 且未使用 xdelta_purego 标签）：Init 不加载任何库，
+// 应用、校验和检查补丁由纯 Go 解码器（godecoder.go）完成，创建补丁以及其余需要原生层的函数返回 ErrNotSupported
+const nativeBackend = false
+
+func openLibrary(path string) error {
+	return ErrNotSupported
+}
+
+func closeLibrary() {}
+
+func setNativeLog(level int) {}
+
+func nativeVersion() versionInfoC { return versionInfoC{} }
+
+func nativeAllocStats() allocStatsC { return allocStatsC{} }
+func nativeStats() nativeStatsC     { return nativeStatsC{} }
+
+func createPatchData(alloc allocFunc, oldData, newData []byte, blockSize uint32, e encoding, cancel *nativeCancel) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// decodeBytes 用纯 Go 解码器把 diffsData 应用到 oldData，输出写入 out
+func decodeBytes(oldData, diffsData []byte, out io.Writer, limit uint64, cancel *nativeCancel) (*goDecoder, error) {
+	d := &goDecoder{src: bytes.NewReader(oldData), size: int64(len(oldData)), out: out, limit: limit, cancel: cancel}
+	return d, d.run(bytes.NewReader(diffsData))
+}
+
+// sliceSink 写入调用方固定大小的缓冲区；输出上限就是缓冲区的长度，写满说明上限检查被绕过，与原生层一样返回 ErrIO
+type sliceSink struct {
+	buf []byte
+	n   int
+}
+
+func (s *sliceSink) Write(p []byte) (int, error) {
+	if len(s.buf)-s.n < len(p) {
+		return 0, goError(CodeIO, "output buffer is full")
+	}
+	s.n += copy(s.buf[s.n:], p)
+	return len(p), nil
+}
+
+func applyPatchInto(dst, oldData, diffsData []byte) (int, error) {
+	sink := &sliceSink{buf: dst}
+	_, err := decodeBytes(oldData, diffsData, sink, uint64(len(dst)), nil)
+	return sink.n, err
+}
+
+func applyPatchExact(dst, oldData, diffsData []byte, cancel *nativeCancel) error {
+	sink := &sliceSink{buf: dst}
+	_, err := decodeBytes(oldData, diffsData, sink, uint64(len(dst)), cancel)
+	var e *Error
+	switch {
+	case errors.As(err, &e) && e.Code == CodeOutputTooLarge:
+		return goError(CodeCorruptPatch, "patch produces more than the %d bytes it declares", len(dst))
+	case err != nil:
+		return err
+	case sink.n != len(dst):
+		return goError(CodeCorruptPatch, "patch produces %d bytes but declares %d", sink.n, len(dst))
+	}
+	return nil
+}
+
+// hashSink 只计算输出的长度和 SHA-256，不保留输出
+type hashSink struct {
+	h io.Writer
+	n uint64
+}
+
+func (s *hashSink) Write(p []byte) (int, error) {
+	s.h.Write(p)
+	s.n += uint64(len(p))
+	return len(p), nil
+}
+
+func verifyPatchData(oldData, diffsData []byte, maxOutput uint64, cancel *nativeCancel) (uint64, [sha256.Size]byte, error) {
+	h := sha256.New()
+	sink := &hashSink{h: h}
+	if _, err := decodeBytes(oldData, diffsData, sink, maxOutput, cancel); err != nil {
+		return 0, [sha256.Size]byte{}, err
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sink.n, sum, nil
+}
+
+// validatePatch 只检查补丁的结构，sourceLen 为 -1 表示旧数据的长度未知
+func validatePatch(diffsData []byte, sourceLen int64) (patchInfoC, error) {
+	d := &goDecoder{size: sourceLen, validate: true}
+	if err := d.run(bytes.NewReader(diffsData)); err != nil {
+		return patchInfoC{}, err
+	}
+	d.info.targetSize = d.produced
+	return d.info, nil
+}
+
+func validatePatchData(diffsData []byte, sourceLen int64) (uint64, error) {
+	info, err := validatePatch(diffsData, sourceLen)
+	return info.targetSize, err
+}
+
+func inspectPatchData(diffsData []byte) (patchInfoC, error) {
+	return validatePatch(diffsData, -1)
+}
+
+func mergePatchData(alloc allocFunc, joined []byte, lens []int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func createChunkSignature(oldData []byte, avgChunk uint32, cancel *nativeCancel) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func createPatchFromChunkSignature(alloc allocFunc, sig, newData []byte, e encoding, cancel *nativeCancel) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// patchTargetSize 与原生层相同，VCDIFF 补丁只读取窗口头，不解码指令
+func patchTargetSize(diffsData []byte) (uint64, error) {
+	d := &goDecoder{size: -1, validate: true, sizeOnly: true}
+	if err := d.run(bytes.NewReader(diffsData)); err != nil {
+		return 0, err
+	}
+	return d.produced, nil
+}
+
+func patchSegments(diffsData []byte, segmentSize uint64) (int, []patchSegment, error) {
+	return 0, nil, ErrNotSupported
+}
+
+func patchFileSegments(patchPath string, segmentSize uint64) (int, []patchSegment, error) {
+	return 0, nil, ErrNotSupported
+}
+
+func sourceRanges(diffsData []byte, gap uint64) ([]SourceRange, error) {
+	return nil, ErrNotSupported
+}
+
+func dumpPatch(diffsData []byte, w io.Writer, instructions bool) error {
+	return ErrNotSupported
+}
+
+func createPatchFd(old, new, patch *os.File, blockSize uint32, e encoding, mmap bool) (FileStats, error) {
+	return FileStats{}, ErrNotSupported
+}
+
+func createPatchDataToFile(oldData, newData []byte, patchPath string, blockSize uint32, e encoding, cancel *nativeCancel) (FileStats, error) {
+	return FileStats{}, ErrNotSupported
+}
+
+func createPatchInto(dst, oldData, newData []byte, blockSize uint32, e encoding, cancel *nativeCancel) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func createPatches(data []byte, items []batchItem, e encoding, cancel *nativeCancel) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// applyPatchFd 从 patch 的当前偏移量开始读取补丁，结果从 out 的当前偏移量开始写入；纯 Go 解码器不使用内存映射，mmap 被忽略
+func applyPatchFd(old, patch, out *os.File, maxOutput uint64, mmap bool) (FileStats, error) {
+	fi, err := old.Stat()
+	if err != nil {
+		return FileStats{}, goError(CodeIO, "failed to stat old file: %v", err)
+	}
+	w := &countingWriter{w: fileOutput{out}}
+	bw := bufio.NewWriterSize(w, goCopyChunk)
+	pr := &countingReader{r: patch}
+	d := &goDecoder{src: fileSource{old}, size: fi.Size(), out: bw, limit: maxOutput}
+	if err := d.run(pr); err != nil {
+		return FileStats{}, err
+	}
+	if err := bw.Flush(); err != nil {
+		return FileStats{}, err
+	}
+	return FileStats{OldSize: fi.Size(), NewSize: w.n, PatchSize: pr.n}, nil
+}
+
+// fileSource、fileOutput 与原生层一样把读写文件的错误报告为 ErrIO
+type fileSource struct{ f *os.File }
+
+func (s fileSource) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.f.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		err = goError(CodeIO, "failed to read old file: %v", err)
+	}
+	return n, err
+}
+
+type fileOutput struct{ f *os.File }
+
+func (o fileOutput) Write(p []byte) (int, error) {
+	n, err := o.f.Write(p)
+	if err != nil {
+		err = goError(CodeIO, "failed to write output file: %v", err)
+	}
+	return n, err
+}
+
+// countingReader 统计读取的补丁字节数，读取失败时返回 ErrIO
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		err = goError(CodeIO, "failed to read patch file: %v", err)
+	}
+	return n, err
+}
+
+func applyPatchInPlace(path string, patch []byte, maxOutput, maxSpill uint64) (FileStats, error) {
+	return FileStats{}, ErrNotSupported
+}
+
+type nativeEncoder struct{}
+
+func newNativeEncoder(blockSize uint32, e encoding) (*nativeEncoder, error) {
+	return nil, ErrNotSupported
+}
+
+func (e *nativeEncoder) addSource(p []byte) error           { return ErrNotSupported }
+func (e *nativeEncoder) signature(w io.Writer) error        { return ErrNotSupported }
+func (e *nativeEncoder) loadSignature(sig []byte) error     { return ErrNotSupported }
+func (e *nativeEncoder) setSourceOffset(offset int64) error { return ErrNotSupported }
+func (e *nativeEncoder) setThreads(threads int) error       { return ErrNotSupported }
+func (e *nativeEncoder) write(p []byte, w io.Writer) error  { return ErrNotSupported }
+func (e *nativeEncoder) flush(w io.Writer) error            { return ErrNotSupported }
+func (e *nativeEncoder) finish(w io.Writer) error           { return ErrNotSupported }
+func (e *nativeEncoder) close()                             {}
+
+type nativeSourceEncoder struct{}
+
+func newNativeSourceEncoder(oldData []byte, blockSize uint32, threads int, cancel *nativeCancel) (*nativeSourceEncoder, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *nativeSourceEncoder) diff(alloc allocFunc, newData []byte, e encoding, cancel *nativeCancel) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func newNativeSourceEncoderFromSignature(sig []byte) (*nativeSourceEncoder, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *nativeSourceEncoder) stream(e encoding) (*nativeEncoder, error) { return nil, ErrNotSupported }
+func (s *nativeSourceEncoder) close()                                    {}
+
+// nativeSourceDecoder 与原生层一样持有旧数据的副本，调用方之后修改 oldData 不影响解码
+type nativeSourceDecoder struct {
+	old []byte
+}
+
+func newNativeSourceDecoder(oldData []byte) (*nativeSourceDecoder, error) {
+	return &nativeSourceDecoder{old: bytes.Clone(oldData)}, nil
+}
+
+func (s *nativeSourceDecoder) applyExact(dst, diffsData []byte, cancel *nativeCancel) error {
+	return applyPatchExact(dst, s.old, diffsData, cancel)
+}
+
+func (s *nativeSourceDecoder) close() { s.old = nil }
+
+// nativeDecoder 推送式的解码：纯 Go 解码器在单独的 goroutine 中从 in 拉取补丁，
+// write 送入一段补丁后等到它被全部读取（其中完整的记录都已解码写出）或解码结束才返回
+type nativeDecoder struct {
+	in   chan []byte
+	ack  chan struct{}
+	done chan struct{}
+	// err 解码的结果，done 关闭之后才能读取；解码只在出错或者 in 关闭之后结束
+	err    error
+	closed bool
+}
+
+func newNativeDecoder(old io.ReaderAt, out io.Writer, maxOutput uint64) (*nativeDecoder, error) {
+	d := &nativeDecoder{in: make(chan []byte), ack: make(chan struct{}), done: make(chan struct{})}
+	dec := &goDecoder{src: old, size: sourceSize(old), out: out, limit: maxOutput}
+	go func() {
+		defer close(d.done)
+		d.err = dec.run(&chanReader{d: d})
+	}()
+	return d, nil
+}
+
+func (d *nativeDecoder) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	select {
+	case d.in <- p:
+	case <-d.done:
+		return d.err
+	}
+	select {
+	case <-d.ack:
+		return nil
+	case <-d.done:
+		return d.err
+	}
+}
+
+// finish 在补丁截断于记录中途时返回包装了 io.ErrUnexpectedEOF 的错误
+func (d *nativeDecoder) finish() error {
+	select {
+	case <-d.done:
+		// 解码在补丁结束之前就已失败，错误已经由 write 返回
+		return d.err
+	default:
+	}
+	d.close()
+	if d.err != nil {
+		return fmt.Errorf("%w: %w", io.ErrUnexpectedEOF, d.err)
+	}
+	return nil
+}
+
+// close 结束补丁输入并等待解码的 goroutine 退出
+func (d *nativeDecoder) close() {
+	if !d.closed {
+		d.closed = true
+		close(d.in)
+	}
+	<-d.done
+}
+
+// chanReader 解码 goroutine 一侧的补丁输入
+type chanReader struct {
+	d *nativeDecoder
+	// cur 当前这段补丁中还没有读取的部分，pending 为 true 时这段补丁还没有确认
+	cur     []byte
+	pending bool
+}
+
+func (r *chanReader) Read(p []byte) (int, error) {
+	if len(r.cur) == 0 {
+		if r.pending {
+			r.pending = false
+			r.d.ack <- struct{}{}
+		}
+		chunk, ok := <-r.d.in
+		if !ok {
+			return 0, io.EOF
+		}
+		r.cur, r.pending = chunk, true
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,188 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// clobber 把 b 的内容全部改掉，模拟调用方在调用返回后复用或释放缓冲区
+func clobber(b []byte) {
+	for i := range b {
+		b[i] = ^b[i]
+	}
+}
+
+// TestRetainedInputsCopied 跨调用保留数据的句柄自己复制了需要的部分：创建 SourceDecoder、SourceEncoder 之后，
+// 以及每次 Encoder.Write、Decoder.Write 之后改掉传入的缓冲区，结果不受影响
+func TestRetainedInputsCopied(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(1 << 20)
+
+	buf := bytes.Clone(oldData)
+	sd, err := NewSourceDecoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	clobber(buf)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sd.Apply(patch); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("SourceDecoder after the old data changed: %d bytes, %v", len(got), err)
+	}
+
+	buf = bytes.Clone(oldData)
+	se, err := NewSourceEncoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+	clobber(buf)
+	patch, err = se.Diff(newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("SourceEncoder after the old data changed: %d bytes, %v", len(got), err)
+	}
+
+	var patchOut bytes.Buffer
+	enc, err := NewEncoder(bytes.NewReader(oldData), &patchOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, 10_000)
+	for p := newData; len(p) > 0; {
+		n := copy(chunk, p)
+		if _, err := enc.Write(chunk[:n]); err != nil {
+			t.Fatal(err)
+		}
+		clobber(chunk[:n])
+		p = p[n:]
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	dec, err := NewDecoder(bytes.NewReader(oldData), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := patchOut.Bytes(); len(p) > 0; {
+		n := copy(chunk[:1000], p)
+		if _, err := dec.Write(chunk[:n]); err != nil {
+			t.Fatal(err)
+		}
+		clobber(chunk[:n])
+		p = p[n:]
+	}
+	if err := dec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), newData) {
+		t.Fatalf("Encoder and Decoder with a reused buffer: got %d bytes, want %d", out.Len(), len(newData))
+	}
+}
+
+// TestFailedCallsLeaveInputs 失败的调用（补丁损坏、超时）不写入传入的切片，返回后调用方可以立即复用它们
+func TestFailedCallsLeaveInputs(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(1 << 20)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := bytes.Clone(patch[:len(patch)/2])
+	oldCopy, badCopy := bytes.Clone(oldData), bytes.Clone(bad)
+	if _, err := ApplyDiffsData(oldData, bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("ApplyDiffsData: got %v, want ErrCorruptPatch", err)
+	}
+	dst := make([]byte, len(newData))
+	if _, err := ApplyDiffsFixed(dst, oldData, bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("ApplyDiffsFixed: got %v, want ErrCorruptPatch", err)
+	}
+	if !bytes.Equal(oldData, oldCopy) || !bytes.Equal(bad, badCopy) {
+		t.Fatal("a failed apply modified its inputs")
+	}
+
+	bigOld, bigNew := textFixture(32 << 20)
+	oldCopy, newCopy := bytes.Clone(bigOld), bytes.Clone(bigNew)
+	if _, err := CreateDiffs(bigOld, bigNew, WithTimeout(time.Millisecond)); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("CreateDiffs: got %v, want ErrTimeout", err)
+	}
+	if !bytes.Equal(bigOld, oldCopy) || !bytes.Equal(bigNew, newCopy) {
+		t.Fatal("a timed out CreateDiffs modified its inputs")
+	}
+	clobber(bigOld)
+	clobber(bigNew)
+	if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplyDiffsData after the failures: %d bytes, %v", len(got), err)
+	}
+}
+
+// TestPinnedInputs 输入直接以 Go 切片的指针传给原生层：起点不对齐的子切片、后面还有其他数据的切片只读取 len 以内的字节，
+// 长度为 0 但容量不为 0 的切片与 nil 相同
+func TestPinnedInputs(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	want, err := CreateDiffsData(oldData, newData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 前后各有一段无关数据，子切片从奇数偏移开始
+	buf := append(append(append([]byte("x"), oldData...), newData...), "trailing garbage"...)
+	oldSub, newSub := buf[1:1+len(oldData)], buf[1+len(oldData):1+len(oldData)+len(newData)]
+	got, err := CreateDiffsData(oldSub, newSub, 1024)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("CreateDiffsData on subslices: %d bytes, %v", len(got), err)
+	}
+	pbuf := append(append([]byte("xyz"), want...), 0xff, 0xff)
+	if got, err := ApplyDiffsData(oldSub, pbuf[3:3+len(want)]); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplyDiffsData on subslices: %d bytes, %v", len(got), err)
+	}
+
+	emptyPatch, err := CreateDiffsData(nil, nil, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, empty := range map[string][]byte{"empty": {}, "zero length": make([]byte, 0, 64), "end of buffer": buf[len(buf):]} {
+		if got, err := CreateDiffsData(empty, empty, 1024); err != nil || !bytes.Equal(got, emptyPatch) {
+			t.Fatalf("%s: CreateDiffsData: %d bytes, %v", name, len(got), err)
+		}
+		patch, err := CreateDiffsData(empty, newData, 1024)
+		if err != nil {
+			t.Fatalf("%s: CreateDiffsData: %v", name, err)
+		}
+		if got, err := ApplyDiffsData(empty, patch); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: ApplyDiffsData: %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+// BenchmarkInputPassing 16 MiB 的输入直接固定后传给原生层（pinned），与原来先把两个输入复制一份再传的做法（copied）比较
+func BenchmarkInputPassing(b *testing.B) {
+	requireNative(b)
+	oldData, newData := textFixture(16 << 20)
+	b.Run("pinned", func(b *testing.B) {
+		b.SetBytes(int64(len(oldData) + len(newData)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := CreateDiffsData(oldData, newData, 1024); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("copied", func(b *testing.B) {
+		b.SetBytes(int64(len(oldData) + len(newData)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := CreateDiffsData(bytes.Clone(oldData), bytes.Clone(newData), 1024); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// formatFlagFastMatch 与 xdelta_interface.h 中的 XDELTA_FORMAT_FLAG_FAST_MATCH 一致
+	formatFlagFastMatch = 0x100
+	// compressedEntropy WithAutoCompressDetection 认为输入已经压缩过的抽样熵（比特/字节），随机数据约为 7.99
+	compressedEntropy = 7.9
+	// entropySamples、entropySampleSize 估计熵时在输入中均匀抽取的片段数和每段的长度
+	entropySamples    = 16
+	entropySampleSize = 4 << 10
+)
+
+// WithNoCompress 为已经压缩过的输入（.zip、.png、视频等）快速生成以新数据为主的补丁：不做二次压缩（忽略
+// WithSecondaryCompression、WithCompressionLevel），并在连续一个块都找不到匹配时跳过之后的 7 个块不再查找
+// 这样的输入几乎找不到匹配、也压缩不动，编码时间可以减少到几分之一；代价是确有相同内容时匹配最多晚 7 个块才被发现，补丁可能稍大
+// 补丁格式不变，所有应用接口（包括旧版本的解码器）都能直接应用；对所有创建补丁的接口有效
+func WithNoCompress() Option {
+	return func(o *options) {
+		o.noCompress = true
+	}
+}
+
+// WithAutoCompressDetection 在 CreateDiffs、CreateDiffsFile 中抽样估计两份输入的熵，都接近随机数据时
+// （均匀抽取 16 段 4 KiB，超过 7.9 比特/字节）自动使用 WithNoCompress；抽样只读取 128 KiB，其他接口忽略这一选项
+func WithAutoCompressDetection() Option {
+	return func(o *options) {
+		o.autoCompress = true
+	}
+}
+
+// detectCompressed 使用了 WithAutoCompressDetection 且两份输入的抽样看起来都是压缩过的数据时启用 WithNoCompress
+func (o *options) detectCompressed(oldData, newData io.ReaderAt, oldLen, newLen int64) {
+	if o.autoCompress && !o.noCompress {
+		o.noCompress = sampleEntropy(oldData, oldLen) > compressedEntropy && sampleEntropy(newData, newLen) > compressedEntropy
+	}
+}
+
+// detectCompressedData 内存数据版本的 detectCompressed
+func (o *options) detectCompressedData(oldData, newData []byte) {
+	o.detectCompressed(bytes.NewReader(oldData), bytes.NewReader(newData), int64(len(oldData)), int64(len(newData)))
+}
+
+// detectCompressedFiles 文件版本的 detectCompressed，文件无法打开时不启用（错误由原生层打开文件时报告）
+func (o *options) detectCompressedFiles(oldPath, newPath string) {
+	if !o.autoCompress || o.noCompress {
+		return
+	}
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return
+	}
+	defer oldFile.Close()
+	newFile, err := os.Open(newPath)
+	if err != nil {
+		return
+	}
+	defer newFile.Close()
+	o.detectCompressed(oldFile, newFile, fileSize(oldPath), fileSize(newPath))
+}
+
+// sampleEntropy 返回 r 中均匀抽取的片段的字节熵（比特/字节），size 不足一段或读取失败时返回 0
+func sampleEntropy(r io.ReaderAt, size int64) float64 {
+	if size < entropySampleSize {
+		return 0
+	}
+	var counts [256]int
+	buf := make([]byte, entropySampleSize)
+	n := 0
+	for i := int64(0); i < entropySamples; i++ {
+		off := (size - entropySampleSize) * i / (entropySamples - 1)
+		if _, err := r.ReadAt(buf, off); err != nil {
+			return 0
+		}
+		for _, b := range buf {
+			counts[b]++
+		}
+		n += len(buf)
+	}
+	h := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
@@ -0,0 +1,105 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// randomPair 像压缩文件一样的随机新旧数据：新数据替换了旧数据中间的 64 KiB
+func randomPair() (oldData, newData []byte) {
+	r := fixtureRand(71)
+	fill := func(b []byte) {
+		for i := range b {
+			b[i] = byte(r.next() >> 32)
+		}
+	}
+	oldData = make([]byte, 1<<20)
+	fill(oldData)
+	newData = bytes.Clone(oldData)
+	fill(newData[400000 : 400000+64<<10])
+	return oldData, newData
+}
+
+// TestWithNoCompress WithNoCompress 忽略二次压缩：补丁没有二次压缩器，与不带 WithSecondaryCompression 时逐字节相同，应用后得到新数据
+func TestWithNoCompress(t *testing.T) {
+	requireNative(t)
+	for name, pair := range map[string]func() ([]byte, []byte){"random": randomPair, "text": func() ([]byte, []byte) { return textFixture(1 << 20) }} {
+		oldData, newData := pair()
+		zstd, err := CreateDiffs(oldData, newData, WithSecondaryCompression(SecondaryZstd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := CreateDiffs(oldData, newData, WithNoCompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, err := CreateDiffs(oldData, newData, WithSecondaryCompression(SecondaryZstd), WithCompressionLevel(9), WithNoCompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patch, plain) || bytes.Equal(patch, zstd) {
+			t.Fatalf("%s: patch with zstd and WithNoCompress differs from the uncompressed one or equals the zstd one", name)
+		}
+		if info, err := InspectPatch(patch); err != nil || info.Secondary != "" {
+			t.Fatalf("%s: secondary %q, %v", name, info.Secondary, err)
+		}
+		if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: applied to %d bytes, %v", name, len(got), err)
+		}
+	}
+}
+
+// TestWithAutoCompressDetection 两份输入的抽样熵都接近随机数据时 CreateDiffs 和 CreateDiffsFile 的补丁与 WithNoCompress 相同，
+// 文本与不带这个选项时相同；不足一段的输入熵为 0，不启用
+func TestWithAutoCompressDetection(t *testing.T) {
+	requireNative(t)
+	randOld, randNew := randomPair()
+	textOld, textNew := textFixture(1 << 20)
+	if h := sampleEntropy(bytes.NewReader(randNew), int64(len(randNew))); h <= compressedEntropy {
+		t.Fatalf("random data sampled at %.3f bits per byte", h)
+	}
+	if h := sampleEntropy(bytes.NewReader(textNew), int64(len(textNew))); h >= compressedEntropy {
+		t.Fatalf("text sampled at %.3f bits per byte", h)
+	}
+	if h := sampleEntropy(bytes.NewReader(randNew[:entropySampleSize-1]), entropySampleSize-1); h != 0 {
+		t.Fatalf("input shorter than a sample: %.3f bits per byte", h)
+	}
+
+	zstd := WithSecondaryCompression(SecondaryZstd)
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name             string
+		oldData, newData []byte
+		want             []Option
+	}{
+		{"random", randOld, randNew, []Option{zstd, WithNoCompress()}},
+		{"text", textOld, textNew, []Option{zstd}},
+		// 只有一侧像压缩过的数据时不启用
+		{"random to text", randOld, textNew, []Option{zstd}},
+	} {
+		want, err := CreateDiffs(c.oldData, c.newData, c.want...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := CreateDiffs(c.oldData, c.newData, zstd, WithAutoCompressDetection())
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: CreateDiffs gave %d bytes, want %d (%v)", c.name, len(got), len(want), err)
+		}
+
+		oldPath, newPath, patchPath, wantPath := filepath.Join(dir, "old"), filepath.Join(dir, "new"), filepath.Join(dir, "patch"), filepath.Join(dir, "want")
+		writeTree(t, dir, map[string][]byte{"old": c.oldData, "new": c.newData})
+		if err := CreateDiffsFile(oldPath, newPath, wantPath, 0, c.want...); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateDiffsFile(oldPath, newPath, patchPath, 0, zstd, WithAutoCompressDetection()); err != nil {
+			t.Fatal(err)
+		}
+		a, _ := os.ReadFile(patchPath)
+		b, _ := os.ReadFile(wantPath)
+		if !bytes.Equal(a, b) {
+			t.Fatalf("%s: CreateDiffsFile gave %d bytes, want %d", c.name, len(a), len(b))
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package xdelta_ffi
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultBlockSize 未通过 WithBlockSize 指定时使用的块大小
+	DefaultBlockSize uint32 = 1024
+	// MinBlockSize、MaxBlockSize 通过 WithBlockSize 指定的块大小允许的范围，
+	// 超过 16 MiB 的块几乎不可能匹配，签名表也失去意义
+	MinBlockSize uint32 = 1
+	MaxBlockSize uint32 = 1 << 24
+	// DefaultWindowSize 流式接口每次读取并送入原生层的数据量（字节）
+	DefaultWindowSize = 1 << 20
+)
+
+// Option 流式接口等的可选参数，在调用原生层之前检查，不合法时返回包装了 ErrInvalidArgument 的错误
+type Option func(*options)
+
+type options struct {
+	blockSize        uint32
+	windowSize       int
+	progress         func(done, total int64)
+	maxOutput        int64
+	secondary        SecondaryCompression
+	level            int
+	threads          int
+	vcdiff           bool
+	bsdiff           bool
+	dumpInstructions bool
+	reverse          *[]byte
+	localChanges     LocalChangePolicy
+	fileProgress     func(path string, done, total int)
+	journal          string
+	sourceCache      int
+	patchedCache     int64
+	mmap             bool
+	fsync            bool
+	targetSHA256     *[sha256.Size]byte
+	inPlaceSpill     int64
+	checkpoint       CheckpointStore
+	checkpointEvery  int
+	verbose          bool
+	timeout          time.Duration
+	diffStats        *DiffStats
+	applyStats       *ApplyStats
+	deterministic    bool
+	tuneObjective    TuneObjective
+	maxMemory        int64
+	sourceWindow     int64
+	noCompress       bool
+	noAppend         bool
+	noIdentity       bool
+	endRecord        bool
+	identityNoCopy   bool
+	autoCompress     bool
+	checksum         ChecksumKind
+	verifyOutput     bool
+	verifySource     bool
+	signatureKeys    []ed25519.PublicKey
+	metadata         map[string]string
+	exactZip         bool
+	segmentSize      int64
+	previousManifest *DirManifest
+	paranoid         bool
+	blobDedup        bool
+	renames          bool
+	blobStore        BlobStore
+	cdcChunk         int
+	matching         MatchStrategy
+	minMatch         int
+}
+
+// newOptions 应用 opts 并检查结果，选项不合法时返回包装了 ErrInvalidArgument 的错误
+func newOptions(opts []Option) (options, error) {
+	o := options{
+		blockSize:    DefaultBlockSize,
+		windowSize:   DefaultWindowSize,
+		level:        DefaultCompressionLevel,
+		threads:      1,
+		sourceCache:  DefaultSourceCacheSize,
+		patchedCache: DefaultPatchedFSCacheSize,
+		inPlaceSpill: DefaultInPlaceSpill,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.blockSize != AutoBlockSize && (o.blockSize < MinBlockSize || o.blockSize > MaxBlockSize) {
+		return o, fmt.Errorf("%w: block size %d is out of range [%d, %d]", ErrInvalidArgument, o.blockSize, MinBlockSize, MaxBlockSize)
+	}
+	if !o.secondary.valid() {
+		return o, fmt.Errorf("%w: unknown secondary compression %d", ErrInvalidArgument, int(o.secondary))
+	}
+	if o.vcdiff && o.secondary != SecondaryNone {
+		return o, fmt.Errorf("%w: secondary compression %v is not available with WithStandardVCDIFF", ErrInvalidArgument, o.secondary)
+	}
+	if o.level != DefaultCompressionLevel && (o.level < MinCompressionLevel || o.level > MaxCompressionLevel) {
+		return o, fmt.Errorf("%w: compression level %d is out of range [%d, %d]", ErrInvalidArgument, o.level, MinCompressionLevel, MaxCompressionLevel)
+	}
+	if o.checkpoint != nil && o.checkpointEvery < 1 {
+		return o, fmt.Errorf("%w: checkpoint interval %d is less than 1", ErrInvalidArgument, o.checkpointEvery)
+	}
+	if o.threads < 0 || o.threads > MaxThreads {
+		return o, fmt.Errorf("%w: thread count %d is out of range [0, %d]", ErrInvalidArgument, o.threads, MaxThreads)
+	}
+	if !o.checksum.valid() {
+		return o, fmt.Errorf("%w: unknown checksum kind %d", ErrInvalidArgument, int(o.checksum))
+	}
+	if o.vcdiff && o.checksum == ChecksumXXH3 {
+		return o, fmt.Errorf("%w: checksum %v is not available with WithStandardVCDIFF", ErrInvalidArgument, o.checksum)
+	}
+	if o.sourceWindow < 0 {
+		return o, fmt.Errorf("%w: source window size %d is negative", ErrInvalidArgument, o.sourceWindow)
+	}
+	if err := o.checkBSDiff(); err != nil {
+		return o, err
+	}
+	if err := o.checkEndRecord(); err != nil {
+		return o, err
+	}
+	if err := o.checkCDC(); err != nil {
+		return o, err
+	}
+	if err := o.checkMatching(); err != nil {
+		return o, err
+	}
+	if err := checkMetadata(o.metadata); err != nil {
+		return o, err
+	}
+	o.memoryWindow()
+	return o, nil
+}
+
+// WithBlockSize 设置块大小，含义与 CreateDiffsData 的 blockSize 参数相同，必须在 [MinBlockSize, MaxBlockSize] 范围内，
+// 或者为 AutoBlockSize，由输入大小（流式接口中无法获取大小时使用 DefaultBlockSize）自动选择
+func WithBlockSize(blockSize uint32) Option {
+	return func(o *options) {
+		o.blockSize = blockSize
+	}
+}
+
+// WithWindowSize 设置流式接口的窗口大小（字节）
+// 每次最多读取一个窗口的数据送入原生层，决定了流式接口的内存上界；不大于 0 时使用 DefaultWindowSize
+func WithWindowSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.windowSize = size
+		}
+	}
+}
+
+// WithProgress 设置进度回调，done 为已消耗的输入字节数，total 为输入总字节数，未知时为 -1
+// 创建补丁时输入为旧数据加新数据，应用补丁时输入为补丁数据
+// 流式和文件接口的回调只在窗口边界、在调用方所在的 goroutine 中同步触发，回调耗时只会拖慢操作本身；
+// CreateDiffs、CreateDiffsContext、CreateDiffsFixed、ApplyDiffsData、ApplyDiffsDataInto、ApplyDiffsDataContext、ApplyDiffsDataPooled 和 CreateDiffsToFile
+// 在原生调用期间由另一个 goroutine 每 100 ms 读取原生层的进度并调用（进度没有变化时不调用），最后一次在返回之前由调用方的 goroutine 调用，
+// 成功时 done 等于 total（恒等补丁不经过原生层，不调用回调）；两种方式的回调都不会并发调用
+func WithProgress(fn func(done, total int64)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithMaxOutputSize 限制应用补丁时输出的最大字节数，不大于 0 时不限制（默认）
+// 补丁通常来自不可信的来源，很小的补丁就可以声明数 GB 的输出；设置上限后，
+// 原生层在解码到声明的输出超过上限的记录时立即返回 ErrOutputTooLarge，不会先分配或写出这部分数据
+// ApplyDiffsData 等内存版本先读取补丁声明的输出长度，超过上限时不解码；实际输出与声明不符时返回 ErrCorruptPatch
+// 对所有应用补丁的接口（内存、流式、文件版本以及 Decoder）都有效，创建补丁时被忽略；ApplyTarDiff、ApplyZipDiff 和 ApplyRecompressDiff 限制的是整个输出的长度
+func WithMaxOutputSize(n int64) Option {
+	return func(o *options) {
+		o.maxOutput = n
+	}
+}
+
+// outputLimit 返回传给原生层的输出上限，0 表示不限制
+func (o options) outputLimit() uint64 {
+	if o.maxOutput <= 0 {
+		return 0
+	}
+	return uint64(o.maxOutput)
+}
+
+// WithStandardVCDIFF 创建补丁时输出标准的 RFC 3284 VCDIFF，而不是本库自己的补丁格式，
+// 这样的补丁可以直接用 xdelta3 -d -s old patch new（或其他 VCDIFF 解码器）应用，本库的应用接口也会自动识别
+// 补丁只使用默认指令表，不带应用头等 xdelta3 扩展（应用时则都能识别），WithChecksum(ChecksumAdler32) 时带 xdelta3 的每窗口校验和；
+// 不能与 WithSecondaryCompression 同时使用
+// 补丁按 8 MiB 的目标窗口写出，相邻的 COPY 会合并，通常比本库的格式更小；Encoder 的 Flush 会结束当前窗口
+func WithStandardVCDIFF() Option {
+	return func(o *options) {
+		o.vcdiff = true
+	}
+}
+
+// vcdiffMagic RFC 3284 VCDIFF 补丁开头的四个字节
+var vcdiffMagic = []byte{0xd6, 0xc3, 0xc4, 0x00}
+
+// 与 xdelta_interface.h 中 XDELTA_FORMAT_* 一致
+const (
+	formatNative = 0
+	formatVCDIFF = 1
+	formatBSDiff = 2
+)
+
+// encoding 传给原生层的补丁格式和二次压缩参数
+type encoding struct {
+	format    int
+	secondary SecondaryCompression
+	level     int
+	threads   int
+	// window 源窗口大小，0 表示整个旧数据，见 WithSourceWindowSize
+	window uint64
+}
+
+// defaultEncoding 不带选项的旧接口使用的参数
+var defaultEncoding = encoding{format: formatNative, secondary: SecondaryNone, level: DefaultCompressionLevel, threads: 1}
+
+// encoding 返回传给原生层的补丁格式和二次压缩参数
+func (o options) encoding() encoding {
+	if o.bsdiff {
+		return encoding{format: formatBSDiff, secondary: SecondaryNone, level: DefaultCompressionLevel, threads: 1}
+	}
+	e := encoding{format: formatNative, secondary: o.secondary, level: o.level, threads: o.encodeThreads(), window: uint64(o.sourceWindow)}
+	if o.vcdiff {
+		e.format = formatVCDIFF
+	}
+	if o.noCompress {
+		e.secondary, e.level = SecondaryNone, DefaultCompressionLevel
+		e.format |= formatFlagFastMatch
+	}
+	e.format |= o.checksum.formatFlag()
+	e.format |= o.cdcFlag()
+	e.format |= o.matchFlag()
+	if !o.noAppend {
+		e.format |= formatFlagAppend
+	}
+	if o.writesEndRecord() {
+		e.format |= formatFlagEnd
+	}
+	return e
+}
+
+// Options 一次列出创建补丁时影响补丁大小和编码时间的参数，由 WithOptions 转换成 Option；从 DefaultOptions 开始修改，
+// 零值的 BlockSize 即 AutoBlockSize。各字段的含义与对应的 Option 相同：
+//   - BlockSize：WithBlockSize，越小匹配越细、补丁越小，签名表越大、编码越慢
+//   - SourceWindow：WithSourceWindowSize，0 表示整个旧数据
+//   - Secondary、Level：WithSecondaryCompression、WithCompressionLevel
+//   - Matching：WithMatchStrategy
+//   - MinMatchBlocks：WithMinMatchBlocks
+//
+// 例如 CI 中对构建产物去重更在意编码时间，可以用较大的块（如 8192）、MatchGreedy、SecondaryLZ4；
+// 发给终端用户的更新只编码一次、下载很多次，可以用较小的块（如 256）、MatchLazy、SecondaryZstd 和 MaxCompressionLevel
+type Options struct {
+	BlockSize      uint32
+	SourceWindow   int64
+	Secondary      SecondaryCompression
+	Level          int
+	Matching       MatchStrategy
+	MinMatchBlocks int
+}
+
+// DefaultOptions 返回不带任何 Option 时使用的参数
+func DefaultOptions() Options {
+	return Options{
+		BlockSize:      DefaultBlockSize,
+		Secondary:      SecondaryNone,
+		Level:          DefaultCompressionLevel,
+		Matching:       MatchGreedy,
+		MinMatchBlocks: 0,
+	}
+}
+
+// WithOptions 按 opts 设置块大小、源窗口、二次压缩、级别和匹配参数，相当于依次使用对应的 Option；
+// 与其他 Option 一起使用时后出现的覆盖先出现的，取值的检查与单独使用对应的 Option 时相同
+func WithOptions(opts Options) Option {
+	return func(o *options) {
+		o.blockSize = opts.BlockSize
+		o.sourceWindow = opts.SourceWindow
+		o.secondary = opts.Secondary
+		o.level = opts.Level
+		o.matching = opts.Matching
+		o.minMatch = opts.MinMatchBlocks
+	}
+}
@@ -0,0 +1,89 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Patch 一份经过结构检查的补丁，由 ParsePatch 或 ReadPatch 得到，推荐用它代替直接传递 []byte：
+// 本库格式、VCDIFF、bsdiff 和信封都可以，信封在应用时总是按 WithVerifyOutput 校验
+// Info、TargetSize 第一次调用时才解析补丁并缓存结果；Patch 不可修改，可以被多个 goroutine 同时使用
+type Patch struct {
+	data []byte
+
+	once sync.Once
+	info PatchInfo
+}
+
+// ParsePatch 用 ValidateFormat 检查 data 的结构，通过后返回包装它的 Patch，错误与 ValidateFormat 相同
+// Patch 直接引用 data 而不复制，之后调用方不能再修改它
+func ParsePatch(data []byte) (*Patch, error) {
+	if err := ValidateFormat(data); err != nil {
+		return nil, err
+	}
+	return &Patch{data: data}, nil
+}
+
+// ReadPatch 读取 r 的全部内容并用 ParsePatch 检查；内容（去掉开头的空白后）是 EncodeArmored 生成的文本时先用 DecodeArmored 解码
+func ReadPatch(r io.Reader) (*Patch, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if isArmored(data) {
+		if data, err = DecodeArmored(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	return ParsePatch(data)
+}
+
+// Bytes 返回补丁数据本身，调用方不能修改
+func (p *Patch) Bytes() []byte {
+	return p.data
+}
+
+// Len 返回补丁的字节数，包括信封头
+func (p *Patch) Len() int {
+	return len(p.data)
+}
+
+// Apply 把补丁应用到 old，与 ApplyDiffsData 相同，信封按 WithVerifyOutput 校验
+func (p *Patch) Apply(old []byte, opts ...Option) ([]byte, error) {
+	return ApplyDiffsData(old, p.data, append(opts[:len(opts):len(opts)], WithVerifyOutput())...)
+}
+
+// ApplyTo 把补丁应用到 old，结果流式写入 out，与 ApplyDiffsStream 相同，信封按 WithVerifyOutput 校验；
+// 出错时 out 中可能已经写入了部分数据；bsdiff 补丁的输出在补丁读完后才写出
+func (p *Patch) ApplyTo(old io.ReaderAt, out io.Writer, opts ...Option) error {
+	return ApplyDiffsStream(old, bytes.NewReader(p.data), out, append(opts[:len(opts):len(opts)], WithVerifyOutput())...)
+}
+
+// Verify 检查补丁能否应用到 old，与 VerifyPatch 相同
+func (p *Patch) Verify(old []byte, opts ...Option) error {
+	return VerifyPatch(old, p.data, opts...)
+}
+
+// Info 返回补丁的组成，与 InspectPatch 相同；ParsePatch 已经检查过结构，解析不会失败，万一失败时只填写 PatchSize 和 Enveloped
+func (p *Patch) Info() PatchInfo {
+	p.once.Do(func() {
+		info, err := InspectPatch(p.data)
+		if err != nil {
+			info = PatchInfo{PatchSize: int64(len(p.data)), Enveloped: IsEnvelope(p.data)}
+		}
+		p.info = info
+	})
+	return p.info
+}
+
+// TargetSize 返回补丁声明的输出长度，即 Info().TargetSize
+func (p *Patch) TargetSize() int64 {
+	return p.Info().TargetSize
+}
+
+// WriteTo 把补丁数据写入 w，实现 io.WriterTo
+func (p *Patch) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(p.data)
+	return int64(n), err
+}
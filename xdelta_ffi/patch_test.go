@@ -0,0 +1,120 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// patchFormats 每种格式的一个补丁：本库格式、带校验和或结束记录的本库格式、VCDIFF、信封和 bsdiff
+func patchFormats(t *testing.T, oldData, newData []byte) map[string][]byte {
+	t.Helper()
+	patches := map[string][]byte{}
+	for name, opts := range map[string][]Option{
+		"native":   nil,
+		"checksum": {WithChecksum(ChecksumXXH3)},
+		"end":      {WithEndRecord(true)},
+		"vcdiff":   {WithStandardVCDIFF()},
+		"bsdiff":   {WithBSDiff()},
+	} {
+		p, err := CreateDiffs(oldData, newData, opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		patches[name] = p
+	}
+	env, err := CreateEnvelope(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches["envelope"] = env
+	return patches
+}
+
+// TestPatchRoundTrip 每种格式的补丁经过 WriteTo 和 ReadPatch 得到相同的数据；Info 与 InspectPatch 相同，TargetSize 为新数据的长度，
+// Apply、ApplyTo 得到新数据，Verify 通过
+func TestPatchRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	for name, data := range patchFormats(t, oldData, newData) {
+		p, err := ParsePatch(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var b bytes.Buffer
+		if n, err := p.WriteTo(&b); err != nil || n != int64(len(data)) {
+			t.Fatalf("%s: WriteTo wrote %d bytes, %v", name, n, err)
+		}
+		// 每次只读一个字节的 Reader 也能读完整个补丁
+		q, err := ReadPatch(iotest.OneByteReader(&b))
+		if err != nil || !bytes.Equal(q.Bytes(), data) || q.Len() != len(data) {
+			t.Fatalf("%s: ReadPatch: %d bytes, %v", name, q.Len(), err)
+		}
+		want, err := InspectPatch(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info := q.Info(); info != want || q.TargetSize() != int64(len(newData)) {
+			t.Fatalf("%s: Info %+v, TargetSize %d, want %+v", name, info, q.TargetSize(), want)
+		}
+		if got, err := q.Apply(oldData); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: Apply: %d bytes, %v", name, len(got), err)
+		}
+		var out bytes.Buffer
+		if err := q.ApplyTo(bytes.NewReader(oldData), &out); err != nil || !bytes.Equal(out.Bytes(), newData) {
+			t.Fatalf("%s: ApplyTo: %d bytes, %v", name, out.Len(), err)
+		}
+		if err := q.Verify(oldData); err != nil {
+			t.Fatalf("%s: Verify: %v", name, err)
+		}
+	}
+}
+
+// TestPatchCorrupt 本库格式（带结束记录）和信封的每一种截断、每种格式改坏的开头都被 ParsePatch 和 ReadPatch 拒绝，
+// 返回 ErrCorruptPatch 或 ErrUnsupportedPatch；读取失败时 ReadPatch 原样返回错误；
+// 结构正确但旧数据不对时 Verify 和 Apply 返回 ErrSourceMismatch
+func TestPatchCorrupt(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patches := patchFormats(t, oldData, newData)
+	for _, name := range []string{"end", "envelope"} {
+		data := patches[name]
+		for n := range len(data) {
+			if _, err := ParsePatch(data[:n]); !errors.Is(err, ErrCorruptPatch) {
+				t.Fatalf("%s: first %d of %d bytes: got %v, want ErrCorruptPatch", name, n, len(data), err)
+			}
+		}
+		if _, err := ReadPatch(bytes.NewReader(data[:len(data)-1])); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s: ReadPatch of a truncated patch: got %v, want ErrCorruptPatch", name, err)
+		}
+	}
+	for name, data := range patches {
+		bad := bytes.Clone(data)
+		bad[0] ^= 0xff
+		if _, err := ParsePatch(bad); !errors.Is(err, ErrCorruptPatch) && !errors.Is(err, ErrUnsupportedPatch) {
+			t.Fatalf("%s: first byte flipped: got %v, want ErrCorruptPatch or ErrUnsupportedPatch", name, err)
+		}
+	}
+
+	failed := errors.New("disk error")
+	if _, err := ReadPatch(iotest.ErrReader(failed)); !errors.Is(err, failed) {
+		t.Fatalf("failing reader: got %v, want its error", err)
+	}
+	if _, err := ReadPatch(io.MultiReader(bytes.NewReader(patches["native"][:10]), iotest.ErrReader(failed))); !errors.Is(err, failed) {
+		t.Fatalf("reader failing midway: got %v, want its error", err)
+	}
+
+	p, err := ParsePatch(patches["checksum"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := bytes.ToUpper(oldData)
+	if err := p.Verify(other); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("Verify with other old data: got %v, want ErrSourceMismatch", err)
+	}
+	if _, err := p.Apply(other); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("Apply with other old data: got %v, want ErrSourceMismatch", err)
+	}
+}
@@ -0,0 +1,458 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPatchedFSCacheSize 未通过 WithPatchedFSCache 指定时 NewPatchedFS 在内存中缓存的新文件内容（字节）
+const DefaultPatchedFSCacheSize = 64 << 20
+
+// WithPatchedFSCache 设置 NewPatchedFS 在内存中缓存的已解码文件的总大小（字节），超过时丢弃最久没有打开的文件，
+// 下次打开时重新解码；不大于 0 时不缓存，每次打开都解码；对其他接口没有影响
+func WithPatchedFSCache(size int64) Option {
+	return func(o *options) {
+		o.patchedCache = max(size, 0)
+	}
+}
+
+// NewPatchedFS 返回 base 应用包 bundle（WriteBundle、CreateDirBundle 写出的内容）之后的新版本的只读视图，
+// 不需要事先把补丁应用到磁盘，适合在旧版本的资源库之上直接提供新版本：
+//
+//   - 未修改的文件和清单中没有的文件直接从 base 读取
+//   - 删除的文件不再出现
+//   - 修改的文件在第一次打开时从 base 中的旧文件和包中的补丁解码，新增的文件取包中的完整内容、blob 或 From 指向的旧文件
+//
+// 解码得到的文件检查大小和 SHA-256（或 XXH64）与清单相同，不一致时 Open 返回包装了 ErrTargetMismatch 的错误；
+// 旧文件在解码前同样检查，不一致时返回包装了 ErrSourceMismatch 的错误。解码的结果整个放在内存中，
+// 按 WithPatchedFSCache 缓存，同一个文件的并发打开只解码一次；失败不会缓存，下次打开时重试
+// 返回的 fs.FS 同时实现 fs.StatFS 和 fs.ReadDirFS，Stat 和 ReadDir 按清单给出新的大小，不会解码文件；
+// 新文件的权限为 0644，修改时间取清单中记录的时间；目录的内容按 base 中的目录和新增文件的路径合成，
+// 只因删除而变空的目录仍然存在（与 ApplyDirDiff 相同）
+// opts 中 WithWindowSize、WithMaxOutput、WithBlobStore（包中没有的 blob）和 WithPatchedFSCache 有效；
+// base 或 bundle 为 nil 时返回 ErrInvalidArgument，包的错误与 OpenBundle 相同；
+// 清单中的 blob 既不在包中、也没有 WithBlobStore 时返回 ErrInvalidArgument
+func NewPatchedFS(base fs.FS, bundle []byte, opts ...Option) (fs.FS, error) {
+	if bundle == nil {
+		return nil, fmt.Errorf("%w: nil base or bundle", ErrInvalidArgument)
+	}
+	b, err := OpenBundle(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		return nil, err
+	}
+	return NewPatchedFSFromBundle(base, b, opts...)
+}
+
+// NewPatchedFSFromBundle 与 NewPatchedFS 相同，但包已经用 OpenBundle 打开，例如直接读取磁盘上的包文件，
+// 包不必整个读入内存
+func NewPatchedFSFromBundle(base fs.FS, bundle *Bundle, opts ...Option) (fs.FS, error) {
+	if base == nil || bundle == nil {
+		return nil, fmt.Errorf("%w: nil base or bundle", ErrInvalidArgument)
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	p := &patchedFS{
+		base:    base,
+		bundle:  bundle,
+		o:       o,
+		entries: make(map[string]*DirEntry, len(bundle.Manifest.Entries)),
+		added:   make(map[string]map[string]bool),
+		cache:   make(map[string]*list.Element),
+		pending: make(map[string]*patchedLoad),
+	}
+	for i := range bundle.Manifest.Entries {
+		e := &bundle.Manifest.Entries[i]
+		if !fs.ValidPath(e.Path) {
+			return nil, fmt.Errorf("%w: manifest path %q is not a valid fs.FS path", ErrCorruptPatch, e.Path)
+		}
+		if e.Blob != "" && e.Patch == "" && o.blobStore == nil {
+			return nil, fmt.Errorf("%w: blob %s is not in the bundle, it needs WithBlobStore", ErrInvalidArgument, e.Blob)
+		}
+		p.entries[e.Path] = e
+		if e.Action == DirAdded {
+			p.addPath(e.Path)
+		}
+	}
+	return p, nil
+}
+
+// patchedFS NewPatchedFS 返回的视图
+type patchedFS struct {
+	base   fs.FS
+	bundle *Bundle
+	o      options
+	// entries 按路径索引的清单，构造之后只读
+	entries map[string]*DirEntry
+	// added 目录 → 其中由新增文件带来的直接子项（名字 → 是否为目录），构造之后只读
+	added map[string]map[string]bool
+
+	mu sync.Mutex
+	// cache 路径 → lru 中的 *patchedData，最近打开的在前
+	cache  map[string]*list.Element
+	lru    list.List
+	cached int64
+	// pending 正在解码的路径，同一路径的其他打开等待它完成
+	pending map[string]*patchedLoad
+}
+
+type patchedData struct {
+	path string
+	data []byte
+}
+
+type patchedLoad struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// addPath 把新增文件 name 和它的各级目录登记到 added
+func (p *patchedFS) addPath(name string) {
+	dir := false
+	for name != "." {
+		parent := path.Dir(name)
+		children := p.added[parent]
+		if children == nil {
+			children = make(map[string]bool)
+			p.added[parent] = children
+		}
+		children[path.Base(name)] = dir
+		name, dir = parent, true
+	}
+}
+
+func (p *patchedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if e, ok := p.entries[name]; ok && e.Action != DirRemoved {
+		if e.Action == DirUnchanged {
+			return p.base.Open(name)
+		}
+		data, err := p.content(e)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &patchedFile{info: p.fileInfo(e), r: bytes.NewReader(data)}, nil
+	}
+	if info, err := p.dirInfo(name); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	} else if info != nil {
+		return &patchedDir{fsys: p, name: name, info: info}, nil
+	}
+	if _, ok := p.entries[name]; ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return p.base.Open(name)
+}
+
+func (p *patchedFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if e, ok := p.entries[name]; ok && e.Action != DirRemoved {
+		if e.Action == DirUnchanged {
+			return fs.Stat(p.base, name)
+		}
+		return p.fileInfo(e), nil
+	}
+	if info, err := p.dirInfo(name); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	} else if info != nil {
+		return info, nil
+	}
+	if _, ok := p.entries[name]; ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fs.Stat(p.base, name)
+}
+
+func (p *patchedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := p.dirInfo(name)
+	if err == nil && info == nil {
+		err = fs.ErrNotExist
+		if _, ok := p.entries[name]; !ok {
+			if fi, serr := fs.Stat(p.base, name); serr == nil && !fi.IsDir() {
+				err = errors.New("not a directory")
+			}
+		}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return p.readDir(name)
+}
+
+// dirInfo 返回新版本中目录 name 的信息，name 不是目录时返回 nil, nil；
+// 清单中的文件路径不是目录，除非它被删除之后又作为新增文件的目录出现
+func (p *patchedFS) dirInfo(name string) (fs.FileInfo, error) {
+	if e, ok := p.entries[name]; ok && e.Action != DirRemoved {
+		return nil, nil
+	}
+	fi, err := fs.Stat(p.base, name)
+	switch {
+	case err == nil && fi.IsDir():
+		return fi, nil
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	if _, ok := p.added[name]; ok || name == "." {
+		return &patchedInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, nil
+}
+
+// readDir 合成目录 name 的内容：base 中的项去掉删除的文件、修改的文件换成新的大小，再加上新增文件带来的项
+func (p *patchedFS) readDir(name string) ([]fs.DirEntry, error) {
+	ents, err := fs.ReadDir(p.base, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	children := make(map[string]fs.DirEntry, len(ents))
+	for _, d := range ents {
+		e, ok := p.entries[path.Join(name, d.Name())]
+		switch {
+		case !ok, e.Action == DirUnchanged:
+			children[d.Name()] = d
+		case e.Action == DirModified:
+			children[d.Name()] = fs.FileInfoToDirEntry(p.fileInfo(e))
+		}
+	}
+	for child, dir := range p.added[name] {
+		if dir {
+			if _, ok := children[child]; !ok || !children[child].IsDir() {
+				children[child] = fs.FileInfoToDirEntry(&patchedInfo{name: child, dir: true})
+			}
+			continue
+		}
+		children[child] = fs.FileInfoToDirEntry(p.fileInfo(p.entries[path.Join(name, child)]))
+	}
+	out := make([]fs.DirEntry, 0, len(children))
+	for _, d := range children {
+		out = append(out, d)
+	}
+	slices.SortFunc(out, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return out, nil
+}
+
+// fileInfo 清单中新增或修改的文件 e 在新版本中的信息
+func (p *patchedFS) fileInfo(e *DirEntry) *patchedInfo {
+	info := &patchedInfo{name: path.Base(e.Path), size: e.NewSize}
+	if e.NewModTime != 0 {
+		info.modTime = time.Unix(0, e.NewModTime)
+	}
+	return info
+}
+
+// content 返回新增或修改的文件 e 的新内容，优先取缓存；同一路径正在解码时等待它完成
+func (p *patchedFS) content(e *DirEntry) ([]byte, error) {
+	p.mu.Lock()
+	if el, ok := p.cache[e.Path]; ok {
+		p.lru.MoveToFront(el)
+		p.mu.Unlock()
+		return el.Value.(*patchedData).data, nil
+	}
+	if l, ok := p.pending[e.Path]; ok {
+		p.mu.Unlock()
+		<-l.done
+		return l.data, l.err
+	}
+	l := &patchedLoad{done: make(chan struct{})}
+	p.pending[e.Path] = l
+	p.mu.Unlock()
+
+	l.data, l.err = p.materialize(e)
+
+	p.mu.Lock()
+	delete(p.pending, e.Path)
+	if size := int64(len(l.data)); l.err == nil && size <= p.o.patchedCache {
+		p.cache[e.Path] = p.lru.PushFront(&patchedData{path: e.Path, data: l.data})
+		p.cached += size
+		for p.cached > p.o.patchedCache {
+			old := p.lru.Remove(p.lru.Back()).(*patchedData)
+			delete(p.cache, old.path)
+			p.cached -= int64(len(old.data))
+		}
+	}
+	p.mu.Unlock()
+	close(l.done)
+	return l.data, l.err
+}
+
+// materialize 生成 e 的新内容并检查它与清单相同
+func (p *patchedFS) materialize(e *DirEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	switch {
+	case e.Action == DirModified:
+		if err := p.decode(e, &buf); err != nil {
+			return nil, err
+		}
+	case e.From != "":
+		f, err := p.base.Open(e.From)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(&buf, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		r, err := p.source(e)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(&buf, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ok, err := sumMatches(bytes.NewReader(buf.Bytes()), e.NewSHA256, e.NewXXH64)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || int64(buf.Len()) != e.NewSize {
+		return nil, fmt.Errorf("%w: %s does not match the manifest (%d bytes, %s)", ErrTargetMismatch, e.Path, buf.Len(), hashName(e.NewXXH64))
+	}
+	return buf.Bytes(), nil
+}
+
+// decode 检查 base 中的旧文件 e.Path 与清单相同，再用补丁解码到 out
+func (p *patchedFS) decode(e *DirEntry, out io.Writer) error {
+	if e.OldSHA256 != "" || e.OldXXH64 != "" {
+		f, err := p.base.Open(e.Path)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		ok := err == nil && fi.Size() == e.OldSize
+		if ok {
+			ok, err = sumMatches(f, e.OldSHA256, e.OldXXH64)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: base file %s does not match the manifest", ErrSourceMismatch, e.Path)
+		}
+	}
+	old, release, err := readerAtFS(p.base, e.Path, "")
+	if err != nil {
+		return err
+	}
+	defer release()
+	patch, err := p.source(e)
+	if err != nil {
+		return err
+	}
+	defer patch.Close()
+	limit := p.o.outputLimit()
+	if e.NewSize > 0 && (limit == 0 || uint64(e.NewSize) < limit) {
+		limit = uint64(e.NewSize)
+	}
+	return decodeStream(old, patch, out, p.o.windowSize, limit, newProgress(nil, -1))
+}
+
+// source 打开 e 的补丁或完整内容：包中的补丁，或者包中没有时 WithBlobStore 中的 blob
+func (p *patchedFS) source(e *DirEntry) (io.ReadCloser, error) {
+	if e.Patch == "" {
+		return p.o.blobStore.Open(e.Blob)
+	}
+	r, err := p.bundle.open(e.Patch)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(r), nil
+}
+
+// patchedInfo 新版本中由清单或新增文件的路径得到的文件、目录信息
+type patchedInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *patchedInfo) Name() string       { return i.name }
+func (i *patchedInfo) Size() int64        { return i.size }
+func (i *patchedInfo) ModTime() time.Time { return i.modTime }
+func (i *patchedInfo) IsDir() bool        { return i.dir }
+func (i *patchedInfo) Sys() any           { return nil }
+
+func (i *patchedInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+// patchedFile 打开的新增或修改的文件，可以随机读取
+type patchedFile struct {
+	info *patchedInfo
+	r    *bytes.Reader
+}
+
+func (f *patchedFile) Stat() (fs.FileInfo, error)                   { return f.info, nil }
+func (f *patchedFile) Read(b []byte) (int, error)                   { return f.r.Read(b) }
+func (f *patchedFile) ReadAt(b []byte, off int64) (int, error)      { return f.r.ReadAt(b, off) }
+func (f *patchedFile) Seek(offset int64, whence int) (int64, error) { return f.r.Seek(offset, whence) }
+func (f *patchedFile) Close() error                                 { return nil }
+
+// patchedDir 打开的目录，内容在第一次 ReadDir 时合成
+type patchedDir struct {
+	fsys    *patchedFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *patchedDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *patchedDir) Close() error               { return nil }
+
+func (d *patchedDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *patchedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.readDir(d.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,139 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// patchedBase 把 oldDir 中的文件读成可以修改的 fstest.MapFS，目录由 MapFS 按路径合成
+func patchedBase(t *testing.T, oldDir string) fstest.MapFS {
+	t.Helper()
+	base := fstest.MapFS{}
+	for name, data := range readTree(t, oldDir) {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		base[name] = &fstest.MapFile{Data: data, Mode: 0o644}
+	}
+	return base
+}
+
+// TestPatchedFS 视图中的每个文件与新目录相同，删除的文件不存在，Stat 和 ReadDir 按清单给出新的大小，
+// 并通过 fstest.TestFS 的一致性检查；未修改的文件直接来自 base
+func TestPatchedFS(t *testing.T) {
+	requireNative(t)
+	oldDir, newTree, _, _, bundle := writeTestBundle(t)
+	base := patchedBase(t, oldDir)
+	fsys, err := NewPatchedFS(base, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name, want := range newTree {
+		names = append(names, name)
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: %d bytes, %v, want %d bytes", name, len(got), err, len(want))
+		}
+		if fi, err := fs.Stat(fsys, name); err != nil || fi.Size() != int64(len(want)) || fi.IsDir() {
+			t.Fatalf("Stat(%s): %v, %v", name, fi, err)
+		}
+	}
+	if _, err := fsys.Open("gone"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("removed file: got %v, want fs.ErrNotExist", err)
+	}
+	ents, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var top []string
+	for _, d := range ents {
+		top = append(top, d.Name())
+	}
+	if want := []string{"added", "other", "x", "y"}; !slices.Equal(top, want) {
+		t.Fatalf("ReadDir(.) = %v, want %v", top, want)
+	}
+	if err := fstest.TestFS(fsys, names...); err != nil {
+		t.Fatal(err)
+	}
+
+	// base 中新增一个清单里没有的文件，视图中原样可见
+	base["extra"] = &fstest.MapFile{Data: []byte("only in base\n")}
+	if got, err := fs.ReadFile(fsys, "extra"); err != nil || string(got) != "only in base\n" {
+		t.Fatalf("file only in base: %q, %v", got, err)
+	}
+}
+
+// TestPatchedFSCache 解码过的文件留在缓存中，之后 base 中的旧文件改变也不影响；不缓存时每次打开都重新解码，
+// 旧文件与清单不符时返回 ErrSourceMismatch
+func TestPatchedFSCache(t *testing.T) {
+	requireNative(t)
+	oldDir, newTree, _, _, bundle := writeTestBundle(t)
+	for _, size := range []int64{DefaultPatchedFSCacheSize, 0} {
+		base := patchedBase(t, oldDir)
+		fsys, err := NewPatchedFS(base, bundle, WithPatchedFSCache(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fs.ReadFile(fsys, "other"); err != nil || !bytes.Equal(got, newTree["other"]) {
+			t.Fatalf("cache %d: %d bytes, %v", size, len(got), err)
+		}
+		base["other"].Data = append([]byte("#"), base["other"].Data[1:]...)
+		got, err := fs.ReadFile(fsys, "other")
+		switch {
+		case size > 0 && (err != nil || !bytes.Equal(got, newTree["other"])):
+			t.Fatalf("cached file after the base changed: %d bytes, %v", len(got), err)
+		case size == 0 && !errors.Is(err, ErrSourceMismatch):
+			t.Fatalf("uncached file after the base changed: got %v, want ErrSourceMismatch", err)
+		}
+	}
+}
+
+// TestPatchedFSErrors base 或包为 nil 时返回 ErrInvalidArgument，截断的包返回 ErrCorruptPatch；
+// 包中的补丁与清单不符时打开这个文件返回 ErrTargetMismatch，其他文件照常可读
+func TestPatchedFSErrors(t *testing.T) {
+	requireNative(t)
+	oldDir, newTree, m, patches, bundle := writeTestBundle(t)
+	base := patchedBase(t, oldDir)
+	if _, err := NewPatchedFS(nil, bundle); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil base: got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := NewPatchedFS(base, nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil bundle: got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := NewPatchedFS(base, bundle[:len(bundle)/2]); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("truncated bundle: got %v, want ErrCorruptPatch", err)
+	}
+
+	// "other" 的补丁换成一个有效、但生成同样长度的不同内容的补丁
+	var patch string
+	for _, e := range m.Entries {
+		if e.Path == "other" {
+			patch = e.Patch
+		}
+	}
+	wrong, err := CreateDiffs(base["other"].Data, append(bytes.Clone(newTree["other"][1:]), '!'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches[patch] = wrong
+	var buf bytes.Buffer
+	if err := WriteBundle(m, patches, &buf); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewPatchedFS(base, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(fsys, "other"); !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("wrong patch: got %v, want ErrTargetMismatch", err)
+	}
+	if got, err := fs.ReadFile(fsys, "x/same"); err != nil || !bytes.Equal(got, newTree["x/same"]) {
+		t.Fatalf("x/same next to a wrong patch: %d bytes, %v", len(got), err)
+	}
+}
@@ -0,0 +1,167 @@
+package xdelta_ffi
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Edge PatchGraph 中的一个补丁：从版本 From 到 To，大小为 Size 字节，Locator 是 AddPatch 时给的定位信息（URL、路径等）
+type Edge struct {
+	From, To string
+	Size     int64
+	Locator  any
+}
+
+// PatchGraph 补丁服务端持有的各个版本之间的补丁，用于为任意两个版本找出下载量最小的补丁链
+// 零值可以直接使用；并发安全，AddPatch 与 Resolve 可以同时调用
+type PatchGraph struct {
+	mu    sync.RWMutex
+	edges map[string][]Edge
+}
+
+// AddPatch 登记一个从 fromID 到 toID、大小为 size 字节的补丁，locator 原样出现在 Resolve 返回的 Edge 中
+// 同一对版本可以登记多个补丁，Resolve 选择较小的；size 为负时返回 ErrInvalidArgument，不登记
+func (g *PatchGraph) AddPatch(fromID, toID string, size int64, locator any) error {
+	if size < 0 {
+		return fmt.Errorf("%w: patch %s -> %s has negative size %d", ErrInvalidArgument, fromID, toID, size)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.edges == nil {
+		g.edges = make(map[string][]Edge)
+	}
+	g.edges[fromID] = append(g.edges[fromID], Edge{From: fromID, To: toID, Size: size, Locator: locator})
+	return nil
+}
+
+// NoPathError Resolve 找不到补丁链，Reachable 是从 From 出发能到达的所有版本（不含 From，按字典序）
+// errors.Is(err, ErrNoPatchPath) 成立
+type NoPathError struct {
+	From, To  string
+	Reachable []string
+}
+
+func (e *NoPathError) Error() string {
+	if len(e.Reachable) == 0 {
+		return fmt.Sprintf("%v from %s to %s: no patches start at %s", ErrNoPatchPath, e.From, e.To, e.From)
+	}
+	return fmt.Sprintf("%v from %s to %s: reachable versions are %s", ErrNoPatchPath, e.From, e.To, strings.Join(e.Reachable, ", "))
+}
+
+// Unwrap 返回 ErrNoPatchPath
+func (e *NoPathError) Unwrap() error {
+	return ErrNoPatchPath
+}
+
+// graphNode Dijkstra 队列中的一个版本：到达它的总大小和补丁个数
+type graphNode struct {
+	id   string
+	size int64
+	hops int
+}
+
+func (a graphNode) less(b graphNode) bool {
+	if a.size != b.size {
+		return a.size < b.size
+	}
+	return a.hops < b.hops
+}
+
+type graphQueue []graphNode
+
+func (q graphQueue) Len() int           { return len(q) }
+func (q graphQueue) Less(i, j int) bool { return q[i].less(q[j]) }
+func (q graphQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *graphQueue) Push(x any)        { *q = append(*q, x.(graphNode)) }
+func (q *graphQueue) Pop() any {
+	old := *q
+	n := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return n
+}
+
+// Resolve 返回从版本 from 到 to 总大小最小的补丁链，按应用顺序排列（Dijkstra，总大小相同时选补丁个数少的）；
+// from 与 to 相同时返回空的链；找不到时返回 *NoPathError
+func (g *PatchGraph) Resolve(from, to string) ([]Edge, error) {
+	if from == to {
+		return []Edge{}, nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	best := map[string]graphNode{from: {id: from}}
+	prev := make(map[string]Edge)
+	done := make(map[string]bool)
+	q := &graphQueue{{id: from}}
+	for q.Len() > 0 {
+		n := heap.Pop(q).(graphNode)
+		if done[n.id] {
+			continue
+		}
+		done[n.id] = true
+		if n.id == to {
+			break
+		}
+		for _, e := range g.edges[n.id] {
+			next := graphNode{id: e.To, size: n.size + e.Size, hops: n.hops + 1}
+			if b, ok := best[e.To]; done[e.To] || ok && !next.less(b) {
+				continue
+			}
+			best[e.To] = next
+			prev[e.To] = e
+			heap.Push(q, next)
+		}
+	}
+	if !done[to] {
+		return nil, &NoPathError{From: from, To: to, Reachable: g.reachable(from)}
+	}
+	var chain []Edge
+	for v := to; v != from; v = prev[v].From {
+		chain = append(chain, prev[v])
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// reachable 返回从 from 出发能到达的所有版本，不含 from，按字典序；调用方持有读锁
+func (g *PatchGraph) reachable(from string) []string {
+	seen := map[string]bool{from: true}
+	stack := []string{from}
+	var out []string
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, e := range g.edges[v] {
+			if !seen[e.To] {
+				seen[e.To] = true
+				out = append(out, e.To)
+				stack = append(stack, e.To)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ApplyChain 用 Resolve 找出从 from 到 to 的补丁链，按顺序用 fetch 取得每个补丁，再用 ApplyChain 应用到 oldData
+// fetch 失败时返回 "fetch patch k (A -> B): ..." 并包装原来的错误；from 与 to 相同时返回 oldData 的副本
+func (g *PatchGraph) ApplyChain(oldData []byte, from, to string, fetch func(Edge) ([]byte, error)) ([]byte, error) {
+	chain, err := g.Resolve(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return append([]byte(nil), oldData...), nil
+	}
+	patches := make([][]byte, len(chain))
+	for i, e := range chain {
+		if patches[i], err = fetch(e); err != nil {
+			return nil, fmt.Errorf("fetch patch %d (%s -> %s): %w", i+1, e.From, e.To, err)
+		}
+	}
+	return ApplyChain(oldData, patches...)
+}
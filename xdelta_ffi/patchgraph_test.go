@@ -0,0 +1,141 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// edgePath 补丁链经过的版本，如 "v1 v2 v4"
+func edgePath(chain []Edge) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	path := chain[0].From
+	for _, e := range chain {
+		path += " " + e.To
+	}
+	return path
+}
+
+// TestPatchGraphResolve Resolve 选择总大小最小的补丁链，而不是补丁个数最少的；同一对版本有多个补丁时选较小的；
+// 总大小相同时选补丁个数少的；找不到时返回 *NoPathError，其中列出能到达的版本
+func TestPatchGraphResolve(t *testing.T) {
+	var g PatchGraph
+	for _, p := range []struct {
+		from, to string
+		size     int64
+	}{
+		{"v1", "v4", 1000}, // 直接的补丁比经过 v2、v3 的链大
+		{"v1", "v2", 100},
+		{"v2", "v3", 100},
+		{"v3", "v4", 100},
+		{"v2", "v4", 500},
+		{"v3", "v4", 50}, // 同一对版本的第二个补丁更小
+		{"v4", "v5", 10},
+		{"v1", "v5", 260}, // 与 v1 v2 v3 v4 v5 的总大小相同，补丁个数少
+		{"v0", "v1", 1},
+	} {
+		if err := g.AddPatch(p.from, p.to, p.size, fmt.Sprintf("%s-%s-%d", p.from, p.to, p.size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		from, to, path string
+		size           int64
+	}{
+		{"v1", "v4", "v1 v2 v3 v4", 250},
+		{"v2", "v4", "v2 v3 v4", 150},
+		{"v3", "v4", "v3 v4", 50},
+		{"v1", "v5", "v1 v5", 260},
+		{"v0", "v5", "v0 v1 v5", 261},
+		{"v4", "v4", "", 0},
+	} {
+		chain, err := g.Resolve(c.from, c.to)
+		if err != nil {
+			t.Fatalf("%s -> %s: %v", c.from, c.to, err)
+		}
+		var size int64
+		for i, e := range chain {
+			size += e.Size
+			if e.Locator != fmt.Sprintf("%s-%s-%d", e.From, e.To, e.Size) {
+				t.Fatalf("%s -> %s: patch %d has locator %v", c.from, c.to, i, e.Locator)
+			}
+		}
+		if p := edgePath(chain); p != c.path || size != c.size {
+			t.Fatalf("%s -> %s: %q of %d bytes, want %q of %d", c.from, c.to, p, size, c.path, c.size)
+		}
+	}
+
+	_, err := g.Resolve("v2", "v1")
+	var npe *NoPathError
+	if !errors.Is(err, ErrNoPatchPath) || !errors.As(err, &npe) {
+		t.Fatalf("v2 -> v1: got %v, want *NoPathError", err)
+	}
+	if want := []string{"v3", "v4", "v5"}; !slices.Equal(npe.Reachable, want) {
+		t.Fatalf("reachable from v2: %v, want %v", npe.Reachable, want)
+	}
+	if _, err := g.Resolve("v9", "v1"); !errors.As(err, &npe) || len(npe.Reachable) != 0 {
+		t.Fatalf("unknown version: got %v, want *NoPathError with nothing reachable", err)
+	}
+}
+
+// TestPatchGraphAddPatchNegative size 为负时 AddPatch 返回 ErrInvalidArgument，补丁不被登记
+func TestPatchGraphAddPatchNegative(t *testing.T) {
+	var g PatchGraph
+	if err := g.AddPatch("v1", "v2", -1, nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := g.Resolve("v1", "v2"); !errors.Is(err, ErrNoPatchPath) {
+		t.Fatalf("Resolve after a rejected patch: got %v, want ErrNoPatchPath", err)
+	}
+	if err := g.AddPatch("v1", "v2", 0, nil); err != nil {
+		t.Fatalf("size 0: %v", err)
+	}
+}
+
+// TestPatchGraphApplyChain ApplyChain 按最短的链取得补丁并应用，结果是目标版本；fetch 的错误被包装后返回
+func TestPatchGraphApplyChain(t *testing.T) {
+	requireNative(t)
+	versions := chainVersions()
+	patches := chainPatches(t, versions)
+	var g PatchGraph
+	for i, p := range patches {
+		if err := g.AddPatch(fmt.Sprint(i), fmt.Sprint(i+1), int64(len(p)), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 一个更大的直接补丁，不应被选中
+	if err := g.AddPatch("0", "4", 1<<40, -1); err != nil {
+		t.Fatal(err)
+	}
+	var fetched []int
+	fetch := func(e Edge) ([]byte, error) {
+		i := e.Locator.(int)
+		if i < 0 {
+			return nil, errors.New("the direct patch was fetched")
+		}
+		fetched = append(fetched, i)
+		return patches[i], nil
+	}
+	got, err := g.ApplyChain(versions[0], "0", "4", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, versions[4]) || !slices.Equal(fetched, []int{0, 1, 2, 3}) {
+		t.Fatalf("%d bytes after fetching %v, want %d", len(got), fetched, len(versions[4]))
+	}
+
+	failed := errors.New("offline")
+	_, err = g.ApplyChain(versions[0], "0", "4", func(e Edge) ([]byte, error) {
+		if e.From == "2" {
+			return nil, failed
+		}
+		return patches[e.Locator.(int)], nil
+	})
+	if !errors.Is(err, failed) || err.Error() != "fetch patch 3 (2 -> 3): offline" {
+		t.Fatalf("failing fetch: got %v", err)
+	}
+}
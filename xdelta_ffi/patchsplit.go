@@ -0,0 +1,251 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 分段索引格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'S' 'E' 'G' 0D 0A
+//	version      1 字节  当前为 1
+//	target size  8 字节  完整输出的长度
+//	count        4 字节  段数
+//	段                   每段 56 字节：输出偏移 8 字节、输出长度 8 字节、段的长度 8 字节、段的 SHA-256 32 字节
+var segmentIndexMagic = []byte{0x89, 'X', 'D', 'S', 'E', 'G', 0x0D, 0x0A}
+
+const (
+	// SegmentIndexVersion SegmentIndex.WriteTo 写入的索引格式版本
+	SegmentIndexVersion = 1
+
+	segmentIndexHeaderLen = 8 + 1 + 8 + 4
+	segmentEntryLen       = 8 + 8 + 8 + sha256.Size
+)
+
+// PatchSegment 分段索引中的一段：补丁的这一段生成完整输出中从 TargetOffset 开始的 TargetLen 字节
+type PatchSegment struct {
+	TargetOffset int64
+	TargetLen    int64
+	// Size 和 SHA256 是段本身的长度和 SHA-256，用于在应用之前检查下载到的段
+	Size   int64
+	SHA256 [sha256.Size]byte
+}
+
+// SegmentIndex SplitPatch 生成的分段索引，与各段一起发布（WriteTo），客户端先下载它，再按任意顺序下载各段
+type SegmentIndex struct {
+	// TargetSize 完整输出的长度
+	TargetSize int64
+	Segments   []PatchSegment
+}
+
+// MissingSegmentsError ApplySegments 应用了提供的所有段之后仍然缺少的段，Missing 为这些段的下标（升序）
+// errors.Is(err, ErrMissingSegments) 成立
+type MissingSegmentsError struct {
+	Missing []int
+}
+
+func (e *MissingSegmentsError) Error() string {
+	ids := make([]string, len(e.Missing))
+	for i, m := range e.Missing {
+		ids[i] = strconv.Itoa(m)
+	}
+	return fmt.Sprintf("%v: %d segments are missing: %s", ErrMissingSegments, len(e.Missing), strings.Join(ids, ", "))
+}
+
+// Unwrap 返回 ErrMissingSegments
+func (e *MissingSegmentsError) Unwrap() error {
+	return ErrMissingSegments
+}
+
+// SplitPatch 把补丁按记录（VCDIFF 为窗口）边界切成若干段，每段不超过 maxSegment 字节，返回分段索引和各段
+// 每段本身就是一个完整的补丁（带上补丁头），只生成完整输出中的一段，只从旧数据复制，不依赖其他段，
+// 可以分别下载、分别应用；所有段的输出依次拼起来与应用整个补丁的结果完全相同
+// 段只能在记录之间切开，VCDIFF 补丁只能在窗口（8 MiB 输出）之间、带校验和的补丁只能在校验和记录之后切开，
+// 这样的一个单位本身就超过 maxSegment 时对应的段也会超过；二次压缩的本库格式补丁无法切分，作为一段返回
+// 补丁不需要补丁头（不带校验和与结束记录的本库格式）时各段与 patch 共用内存；以结束记录结尾的补丁（见 WithEndRecord）
+// 的各段末尾另外加上只属于这一段的结束记录；
+// maxSegment 不大于 0 时返回 ErrInvalidArgument，
+// 只检查补丁的分帧，COPY 的范围在应用各段时检查
+func SplitPatch(patch []byte, maxSegment int64) (*SegmentIndex, [][]byte, error) {
+	if maxSegment <= 0 {
+		return nil, nil, fmt.Errorf("%w: segment size %d is not positive", ErrInvalidArgument, maxSegment)
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	// 先按一半的输出字节数切得细一些，再把相邻的小段合并到 maxSegment
+	headerLen, fine, err := patchSegments(patch, uint64(max(maxSegment/2, 1)))
+	if err != nil {
+		return nil, nil, err
+	}
+	header := patch[:headerLen]
+	// 每段在补丁数据之外还有补丁头和结束记录
+	overhead := int64(headerLen) + int64(len(segmentEnd(header, patchSegment{})))
+	x := &SegmentIndex{}
+	var segs [][]byte
+	for i := 0; i < len(fine); {
+		cur := fine[i]
+		for i++; i < len(fine) && overhead+int64(cur.patchLen+fine[i].patchLen) <= maxSegment; i++ {
+			cur.patchLen += fine[i].patchLen
+			cur.targetLen += fine[i].targetLen
+		}
+		data := patch[cur.patchOffset : cur.patchOffset+cur.patchLen]
+		if headerLen > 0 {
+			data = append(append(slices.Clip(header), data...), segmentEnd(header, cur)...)
+		}
+		x.Segments = append(x.Segments, PatchSegment{
+			TargetOffset: int64(cur.targetOffset),
+			TargetLen:    int64(cur.targetLen),
+			Size:         int64(len(data)),
+			SHA256:       sha256.Sum256(data),
+		})
+		x.TargetSize = int64(cur.targetOffset + cur.targetLen)
+		segs = append(segs, data)
+	}
+	return x, segs, nil
+}
+
+// ApplySegments 把 segments 中提供的段（下标和 SplitPatch 返回的段的内容）应用到旧数据 old，
+// 各段的输出按索引中的偏移写入 out；out 带有 Truncate(int64) error 方法（例如 *os.File）时先把它截断或扩展到完整输出的长度
+// segments 通常是目前已经下载到的所有段；下载中断之后带上新的段再次调用即可，重复应用同一段的结果相同
+// 段的长度或 SHA-256 与索引不符时返回 ErrCorruptPatch，下标超出范围时返回 ErrInvalidArgument，都不会写入这一段；
+// 全部提供的段都应用之后还缺少段（本次调用中没有提供的段）时返回 *MissingSegmentsError
+// opts 中 WithWindowSize、WithMaxOutputSize 有效，完整输出超过上限时不写入任何数据，直接返回 ErrOutputTooLarge
+func ApplySegments(old io.ReaderAt, oldSize int64, index *SegmentIndex, segments iter.Seq2[int, []byte], out io.WriterAt, opts ...Option) error {
+	if err := index.check(ErrInvalidArgument); err != nil {
+		return err
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	if limit := o.outputLimit(); limit > 0 && uint64(index.TargetSize) > limit {
+		return fmt.Errorf("%w: segments declare %d bytes of output, the limit is %d", ErrOutputTooLarge, index.TargetSize, limit)
+	}
+	if t, ok := out.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(index.TargetSize); err != nil {
+			return err
+		}
+	}
+
+	src := newCachedSource(old, oldSize, o.sourceCache)
+	applied := make([]bool, len(index.Segments))
+	for i, data := range segments {
+		if i < 0 || i >= len(index.Segments) {
+			return fmt.Errorf("%w: segment %d is out of range [0, %d)", ErrInvalidArgument, i, len(index.Segments))
+		}
+		s := index.Segments[i]
+		if int64(len(data)) != s.Size || sha256.Sum256(data) != s.SHA256 {
+			return fmt.Errorf("%w: segment %d does not match the index", ErrCorruptPatch, i)
+		}
+		seg := patchSegment{targetOffset: uint64(s.TargetOffset), targetLen: uint64(s.TargetLen)}
+		if err := decodeSegment(src, nil, bytes.NewReader(data), seg, io.NewOffsetWriter(out, s.TargetOffset), o.windowSize); err != nil {
+			return fmt.Errorf("segment %d: %w", i, err)
+		}
+		applied[i] = true
+	}
+	var missing []int
+	for i, ok := range applied {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	if missing != nil {
+		return &MissingSegmentsError{Missing: missing}
+	}
+	return nil
+}
+
+// WriteTo 把索引按上面的格式写入 w
+func (x *SegmentIndex) WriteTo(w io.Writer) (int64, error) {
+	if err := x.check(ErrInvalidArgument); err != nil {
+		return 0, err
+	}
+	b := make([]byte, 0, segmentIndexHeaderLen+len(x.Segments)*segmentEntryLen)
+	b = append(append(b, segmentIndexMagic...), SegmentIndexVersion)
+	b = binary.LittleEndian.AppendUint64(b, uint64(x.TargetSize))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(x.Segments)))
+	for _, s := range x.Segments {
+		b = binary.LittleEndian.AppendUint64(b, uint64(s.TargetOffset))
+		b = binary.LittleEndian.AppendUint64(b, uint64(s.TargetLen))
+		b = binary.LittleEndian.AppendUint64(b, uint64(s.Size))
+		b = append(b, s.SHA256[:]...)
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// LoadSegmentIndex 从 r 读取 WriteTo 写出的索引；截断或各段的输出区间不连续时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func LoadSegmentIndex(r io.Reader) (*SegmentIndex, error) {
+	hdr := make([]byte, segmentIndexHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: segment index is truncated", ErrCorruptPatch)
+		}
+		return nil, err
+	}
+	if !bytes.HasPrefix(hdr, segmentIndexMagic) {
+		return nil, fmt.Errorf("%w: not a segment index", ErrCorruptPatch)
+	}
+	if v := hdr[8]; v != SegmentIndexVersion {
+		return nil, fmt.Errorf("%w: segment index version %d", ErrUnsupportedPatch, v)
+	}
+	x := &SegmentIndex{TargetSize: int64(binary.LittleEndian.Uint64(hdr[9:]))}
+	count := binary.LittleEndian.Uint32(hdr[17:])
+	// 段数来自头部，按实际读到的数据增长，不会因为损坏的段数一次分配巨大的内存
+	buf := make([]byte, segmentEntryLen)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("%w: segment index is truncated at segment %d of %d", ErrCorruptPatch, i, count)
+			}
+			return nil, err
+		}
+		s := PatchSegment{
+			TargetOffset: int64(binary.LittleEndian.Uint64(buf)),
+			TargetLen:    int64(binary.LittleEndian.Uint64(buf[8:])),
+			Size:         int64(binary.LittleEndian.Uint64(buf[16:])),
+		}
+		copy(s.SHA256[:], buf[24:])
+		x.Segments = append(x.Segments, s)
+	}
+	if err := x.check(ErrCorruptPatch); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// check 检查各段的输出区间是否从 0 开始首尾相接、正好覆盖 TargetSize，错误包装 kind
+func (x *SegmentIndex) check(kind error) error {
+	if x == nil {
+		return fmt.Errorf("%w: nil segment index", kind)
+	}
+	if len(x.Segments) == 0 {
+		return fmt.Errorf("%w: segment index has no segments", kind)
+	}
+	var end int64
+	for i, s := range x.Segments {
+		if s.TargetOffset != end || s.TargetLen < 0 || s.TargetLen > 1<<62-end || s.Size <= 0 {
+			return fmt.Errorf("%w: segment %d covers output %d+%d (%d bytes), expected to start at %d",
+				kind, i, s.TargetOffset, s.TargetLen, s.Size, end)
+		}
+		end += s.TargetLen
+	}
+	if end != x.TargetSize {
+		return fmt.Errorf("%w: segments cover %d bytes of output, the index declares %d", kind, end, x.TargetSize)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+	"slices"
+	"testing"
+)
+
+// segmentFixture 切成多段的补丁：返回旧、新数据和读回的分段索引与各段
+func segmentFixture(t *testing.T) (oldData, newData []byte, index *SegmentIndex, segs [][]byte) {
+	t.Helper()
+	oldData, newData = textFixture(1 << 20)
+	patch, err := CreateDiffs(oldData, newData, WithBlockSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, segs, err := SplitPatch(patch, int64(len(patch)/5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) < 4 {
+		t.Fatalf("patch of %d bytes split into %d segments", len(patch), len(segs))
+	}
+	var b bytes.Buffer
+	if _, err := x.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = LoadSegmentIndex(&b); err != nil {
+		t.Fatal(err)
+	}
+	return oldData, newData, index, segs
+}
+
+// someSegments segs 中下标为 ids 的段，按 ids 的顺序
+func someSegments(segs [][]byte, ids ...int) iter.Seq2[int, []byte] {
+	return func(yield func(int, []byte) bool) {
+		for _, i := range ids {
+			if !yield(i, segs[i]) {
+				return
+			}
+		}
+	}
+}
+
+// TestApplySegmentsRoundTrip 先应用一部分段时返回列出其余段的 *MissingSegmentsError，带上其余的段再次调用后输出与新数据相同；
+// 各段按任意顺序提供、重复提供时结果相同
+func TestApplySegmentsRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData, index, segs := segmentFixture(t)
+	n := len(segs)
+	out := &sizedWriterAt{}
+	err := ApplySegments(bytes.NewReader(oldData), int64(len(oldData)), index, someSegments(segs, n-1, 1), out)
+	var missing *MissingSegmentsError
+	if !errors.Is(err, ErrMissingSegments) || !errors.As(err, &missing) {
+		t.Fatalf("first call: got %v, want *MissingSegmentsError", err)
+	}
+	var want []int
+	for i := range n {
+		if i != 1 && i != n-1 {
+			want = append(want, i)
+		}
+	}
+	if !slices.Equal(missing.Missing, want) {
+		t.Fatalf("missing %v, want %v", missing.Missing, want)
+	}
+	first := index.Segments[1]
+	if !bytes.Equal(out.b[first.TargetOffset:first.TargetOffset+first.TargetLen], newData[first.TargetOffset:first.TargetOffset+first.TargetLen]) {
+		t.Fatal("segment 1 was not written at its offset")
+	}
+
+	// 下载恢复之后带上全部段（倒序，其中两段已经应用过）再次调用
+	rest := make([]int, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		rest = append(rest, i)
+	}
+	if err := ApplySegments(bytes.NewReader(oldData), int64(len(oldData)), index, someSegments(segs, rest...), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.b, newData) || out.truncated != 2 {
+		t.Fatalf("%d bytes after %d truncations, want %d", len(out.b), out.truncated, len(newData))
+	}
+	// 没有 Truncate 的 out 只写入各段的区间
+	plain := &memWriterAt{}
+	if err := ApplySegments(bytes.NewReader(oldData), int64(len(oldData)), index, slices.All(segs), plain); err != nil || !bytes.Equal(plain.b, newData) {
+		t.Fatalf("memWriterAt: %d bytes, %v", len(plain.b), err)
+	}
+}
+
+// TestApplySegmentsCorrupt 内容或长度与索引不符的段返回 ErrCorruptPatch，不写入这一段；下标超出范围返回 ErrInvalidArgument；
+// 截断的索引返回 ErrCorruptPatch；完整输出超过 WithMaxOutputSize 时返回 ErrOutputTooLarge，不写入任何数据
+func TestApplySegmentsCorrupt(t *testing.T) {
+	requireNative(t)
+	oldData, _, index, segs := segmentFixture(t)
+	old := bytes.NewReader(oldData)
+	for name, bad := range map[string][]byte{
+		"flipped":   append([]byte{segs[2][0] ^ 0x01}, segs[2][1:]...),
+		"truncated": segs[2][:len(segs[2])-1],
+		"extended":  append(bytes.Clone(segs[2]), 0),
+	} {
+		out := &memWriterAt{}
+		given := func(yield func(int, []byte) bool) { yield(2, bad) }
+		if err := ApplySegments(old, int64(len(oldData)), index, given, out); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s segment: got %v, want ErrCorruptPatch", name, err)
+		}
+		if len(out.b) != 0 {
+			t.Fatalf("%s segment: %d bytes written", name, len(out.b))
+		}
+	}
+	for _, i := range []int{-1, len(segs)} {
+		given := func(yield func(int, []byte) bool) { yield(i, segs[0]) }
+		if err := ApplySegments(old, int64(len(oldData)), index, given, &memWriterAt{}); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("segment %d: got %v, want ErrInvalidArgument", i, err)
+		}
+	}
+	if err := ApplySegments(old, int64(len(oldData)), nil, slices.All(segs), &memWriterAt{}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil index: got %v, want ErrInvalidArgument", err)
+	}
+
+	out := &sizedWriterAt{}
+	err := ApplySegments(old, int64(len(oldData)), index, slices.All(segs), out, WithMaxOutputSize(index.TargetSize-1))
+	if !errors.Is(err, ErrOutputTooLarge) || out.truncated != 0 {
+		t.Fatalf("output over the limit: got %v after %d truncations, want ErrOutputTooLarge", err, out.truncated)
+	}
+
+	var b bytes.Buffer
+	if _, err := index.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	for _, n := range []int{0, 8, segmentIndexHeaderLen - 1, segmentIndexHeaderLen, len(data) - 1} {
+		if _, err := LoadSegmentIndex(bytes.NewReader(data[:n])); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("first %d of %d bytes: got %v, want ErrCorruptPatch", n, len(data), err)
+		}
+	}
+	bad := bytes.Clone(data)
+	bad[8] = SegmentIndexVersion + 1
+	if _, err := LoadSegmentIndex(bytes.NewReader(bad)); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+	// 第二段的输出偏移与第一段的末尾不相接
+	bad = bytes.Clone(data)
+	bad[segmentIndexHeaderLen+segmentEntryLen]++
+	if _, err := LoadSegmentIndex(bytes.NewReader(bad)); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("gap between segments: got %v, want ErrCorruptPatch", err)
+	}
+}
@@ -0,0 +1,156 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	// minPoolClass、maxPoolClass 缓冲池的最小、最大容量等级（2 的幂次），
+	// 小于 4 KiB 的结果分配代价很低，大于 256 MiB 的结果不值得常驻在池中，这两种都直接分配
+	minPoolClass = 12
+	maxPoolClass = 28
+)
+
+// bufferPools 按容量等级划分的缓冲池，第 i 个池中的缓冲区容量为 1<<(minPoolClass+i)
+var bufferPools [maxPoolClass - minPoolClass + 1]sync.Pool
+
+// poolClass 返回能容纳 n 字节的最小容量等级，超出池的范围时返回 -1
+func poolClass(n int) int {
+	if n <= 1<<minPoolClass {
+		return minPoolClass
+	}
+	c := bits.Len(uint(n - 1))
+	if c > maxPoolClass {
+		return -1
+	}
+	return c
+}
+
+// getBuffer 返回一个长度为 0、容量至少为 n 的缓冲区
+func getBuffer(n int) []byte {
+	c := poolClass(n)
+	if c < 0 {
+		return make([]byte, 0, n)
+	}
+	if b, ok := bufferPools[c-minPoolClass].Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	return make([]byte, 0, 1<<c)
+}
+
+// putBuffer 把 b 放回对应等级的池中，不是由 getBuffer 分配的容量直接丢弃
+func putBuffer(b []byte) {
+	c := poolClass(cap(b))
+	if c < 0 || cap(b) != 1<<c {
+		return
+	}
+	b = b[:0]
+	bufferPools[c-minPoolClass].Put(&b)
+}
+
+// PooledResult 使用缓冲池分配的结果，用完后调用 Release 把缓冲区还给池，
+// 在高并发下可以显著减少分配和 GC 压力
+//
+// 忘记调用 Release 是安全的，缓冲区只是像普通切片一样被垃圾回收；
+// 调用 Release 之后不能再使用之前通过 Bytes 得到的切片，因为它可能已经被其他调用复用
+type PooledResult struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// Bytes 返回结果数据，Release 之后返回 nil
+func (r *PooledResult) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf
+}
+
+// Len 返回结果的字节数，Release 之后返回 0
+func (r *PooledResult) Len() int {
+	return len(r.Bytes())
+}
+
+// Release 把缓冲区还给池，可以重复调用，第二次及之后的调用没有效果
+func (r *PooledResult) Release() {
+	r.mu.Lock()
+	b := r.buf
+	r.buf = nil
+	r.mu.Unlock()
+	if b != nil {
+		putBuffer(b)
+	}
+}
+
+// CreateDiffsDataPooled 与 CreateDiffsData 相同，但补丁数据保存在池化的缓冲区中
+func CreateDiffsDataPooled(oldData, newData []byte, blockSize uint32) (res *PooledResult, err error) {
+	if m := beginOp(OpCreate, int64(len(oldData)), int64(len(newData))); m != nil {
+		defer func() {
+			var n int64
+			if res != nil {
+				n = int64(res.Len())
+			}
+			m.end(n, err)
+		}()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	b, err := createPatchData(getBuffer, oldData, newData, resolveBlockSize(blockSize, int64(len(oldData)), int64(len(newData))), defaultEncoding, nil)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	return &PooledResult{buf: b}, nil
+}
+
+// ApplyDiffsDataPooled 与 ApplyDiffsData 相同，但新数据保存在池化的缓冲区中
+func ApplyDiffsDataPooled(oldData, diffsData []byte, opts ...Option) (res *PooledResult, err error) {
+	if m := beginOp(OpApply, int64(len(oldData)), int64(len(diffsData))); m != nil {
+		defer func() {
+			var n int64
+			if res != nil {
+				n = int64(res.Len())
+			}
+			m.end(n, err)
+		}()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	h, diffsData, err := o.openEnvelope(oldData, diffsData)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	t := watchOptions(nil, o, int64(len(diffsData)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	b, err := applyPresized(getBuffer, oldData, diffsData, o.applyLimit(), t.cancel())
+	release()
+	if err != nil {
+		return nil, o.limitError(t.err(err))
+	}
+	if h != nil {
+		if err := h.checkTarget(int64(len(b)), sha256.Sum256(b)); err != nil {
+			putBuffer(b)
+			return nil, err
+		}
+	}
+	o.recordApplyPatch(ApplyStats{SourceSize: int64(len(oldData)), PatchSize: int64(len(diffsData)), TargetSize: int64(len(b)), Windows: 1}, diffsData, start)
+	return &PooledResult{buf: b}, nil
+}
@@ -0,0 +1,132 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// TestPoolClass 容量等级的边界：4 KiB 以下都用最小等级，正好是 2 的幂时不升级，超过 256 MiB 不进池
+func TestPoolClass(t *testing.T) {
+	for _, tc := range []struct{ n, want int }{
+		{0, minPoolClass},
+		{1, minPoolClass},
+		{1 << minPoolClass, minPoolClass},
+		{1<<minPoolClass + 1, minPoolClass + 1},
+		{1 << 20, 20},
+		{1<<20 + 1, 21},
+		{1 << maxPoolClass, maxPoolClass},
+		{1<<maxPoolClass + 1, -1},
+	} {
+		if got := poolClass(tc.n); got != tc.want {
+			t.Errorf("poolClass(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+	if b := getBuffer(5000); len(b) != 0 || cap(b) != 8192 {
+		t.Fatalf("getBuffer(5000): len %d cap %d, want 0 and 8192", len(b), cap(b))
+	}
+	// 不是池分配的容量不放回池中
+	putBuffer(make([]byte, 0, 5000))
+	if b := getBuffer(5000); cap(b) != 8192 {
+		t.Fatalf("getBuffer after putting back an odd capacity: cap %d", cap(b))
+	}
+}
+
+// TestPooledResult 池化的结果与普通结果相同；Release 可以重复调用，之后 Bytes 返回 nil；
+// 被复用的缓冲区不会影响其他尚未 Release 或忘记 Release 的结果
+func TestPooledResult(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffsData(oldData, newData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := CreateDiffsDataPooled(oldData, newData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Bytes(), patch) || res.Len() != len(patch) {
+		t.Fatalf("CreateDiffsDataPooled returned %d bytes, want %d", res.Len(), len(patch))
+	}
+	res.Release()
+	res.Release()
+	if res.Bytes() != nil || res.Len() != 0 {
+		t.Fatal("Bytes after Release is not nil")
+	}
+
+	kept := make([]*PooledResult, 0, 100)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				res, err := ApplyDiffsDataPooled(oldData, patch)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(res.Bytes(), newData) {
+					t.Errorf("ApplyDiffsDataPooled returned %d bytes, want %d", res.Len(), len(newData))
+					return
+				}
+				if (g+i)%4 == 0 {
+					// 不 Release，留给垃圾回收
+					mu.Lock()
+					kept = append(kept, res)
+					mu.Unlock()
+					continue
+				}
+				if b := res.Bytes(); (g+i)%4 == 1 {
+					clobber(b)
+				}
+				res.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	runtime.GC()
+	for _, res := range kept {
+		if !bytes.Equal(res.Bytes(), newData) {
+			t.Fatal("an unreleased result changed after other results were released and reused")
+		}
+	}
+}
+
+// BenchmarkPooledApply 并发应用同一个补丁：ApplyDiffsData 每次分配结果，ApplyDiffsDataPooled 用完后 Release
+func BenchmarkPooledApply(b *testing.B) {
+	requireNative(b)
+	oldData, newData := textFixture(1 << 20)
+	patch, err := CreateDiffsData(oldData, newData, 1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("ApplyDiffsData", func(b *testing.B) {
+		b.SetBytes(int64(len(newData)))
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := ApplyDiffsData(oldData, patch); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("ApplyDiffsDataPooled", func(b *testing.B) {
+		b.SetBytes(int64(len(newData)))
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				res, err := ApplyDiffsDataPooled(oldData, patch)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				res.Release()
+			}
+		})
+	})
+}
@@ -0,0 +1,105 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// vcdiffTargetLenAt 补丁中第一个窗口的目标窗口长度（RFC 3284 的 Length of the target window）最后一个字节的位置，
+// 文件头的要求同 vcdiffWindowIndicators
+func vcdiffTargetLenAt(tb testing.TB, patch []byte) int {
+	tb.Helper()
+	vcdiffWindowIndicators(tb, patch)
+	pos := 6
+	skip := func() {
+		for patch[pos]&0x80 != 0 {
+			pos++
+		}
+		pos++
+	}
+	if patch[5]&winSource != 0 {
+		skip()
+		skip()
+	}
+	skip()
+	for patch[pos]&0x80 != 0 {
+		pos++
+	}
+	return pos
+}
+
+// TestApplyPresizedMismatch 补丁声明的输出长度（本库格式的结束记录、VCDIFF 的目标窗口长度、bsdiff 文件头中的新数据长度）
+// 与记录实际产生的长度不同时，按声明长度分配输出的各个接口都返回 ErrCorruptPatch，不截断也不补零；
+// 声明了巨大的长度时不会按它分配
+func TestApplyPresizedMismatch(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(128 << 10)
+	native, err := CreateDiffs(oldData, newData, WithEndRecord(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcdiff, err := CreateDiffs(oldData, newData, WithStandardVCDIFF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bsdiff, err := CreateDiffs(oldData, newData, WithBSDiff())
+	if err != nil {
+		t.Fatal(err)
+	}
+	endLen := func(n uint64) []byte {
+		return binary.LittleEndian.AppendUint64(bytes.Clone(native[:len(native)-8]), n)
+	}
+	flip := func(p []byte, i int) []byte {
+		p = bytes.Clone(p)
+		p[i] ^= 1
+		return p
+	}
+	cases := []struct {
+		name  string
+		patch []byte
+	}{
+		{"native end record + 1", endLen(uint64(len(newData)) + 1)},
+		{"native end record - 1", endLen(uint64(len(newData)) - 1)},
+		{"native end record 1 TiB", endLen(1 << 40)},
+		{"vcdiff target window", flip(vcdiff, vcdiffTargetLenAt(t, vcdiff))},
+		{"bsdiff new size", flip(bsdiff, 24)},
+	}
+	applies := map[string]func(patch []byte) error{
+		"ApplyDiffsData": func(patch []byte) error {
+			_, err := ApplyDiffsData(oldData, patch)
+			return err
+		},
+		"ApplyDiffsDataInto": func(patch []byte) error {
+			_, err := ApplyDiffsDataInto(make([]byte, 0, len(newData)+10), oldData, patch)
+			return err
+		},
+		"ApplyDiffsDataPooled": func(patch []byte) error {
+			r, err := ApplyDiffsDataPooled(oldData, patch)
+			if err == nil {
+				r.Release()
+			}
+			return err
+		},
+		"ApplyDiffsFixed": func(patch []byte) error {
+			_, err := ApplyDiffsFixed(make([]byte, len(newData)+10), oldData, patch)
+			return err
+		},
+	}
+	for _, tc := range cases {
+		for name, apply := range applies {
+			if err := apply(tc.patch); !errors.Is(err, ErrCorruptPatch) {
+				t.Errorf("%s, %s: got %v, want ErrCorruptPatch", tc.name, name, err)
+			}
+		}
+	}
+	// 未改动的补丁都能应用
+	for _, p := range [][]byte{native, vcdiff, bsdiff} {
+		for name, apply := range applies {
+			if err := apply(p); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package xdelta_ffi
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// progress 累计已消耗的输入字节数并在窗口边界调用用户回调
+type progress struct {
+	fn    func(done, total int64)
+	done  int64
+	total int64
+	// windows 调用 add 的次数
+	windows int
+}
+
+func newProgress(fn func(done, total int64), total int64) *progress {
+	return &progress{fn: fn, total: total}
+}
+
+func (p *progress) add(n int) {
+	p.done += int64(n)
+	p.windows++
+	if p.fn != nil {
+		p.fn(p.done, p.total)
+	}
+}
+
+// progressInterval 内存接口在原生调用期间轮询进度的间隔
+const progressInterval = 100 * time.Millisecond
+
+// pollProgress 启动轮询协程，每 progressInterval 读取原生层已经处理的字节数并报告给 t.prog；由 arm 调用，disarm 停止
+func (t *cancelToken) pollProgress() {
+	t.pollStop = make(chan struct{})
+	t.pollDone = make(chan struct{})
+	go func() {
+		defer close(t.pollDone)
+		tick := time.NewTicker(progressInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-t.pollStop:
+				return
+			case <-tick.C:
+				t.reportProgress()
+			}
+		}
+	}()
+}
+
+// reportProgress 进度比上次报告时增加了才调用回调；不超过 total（WithReverse 等会让原生层处理的字节数超出它）
+func (t *cancelToken) reportProgress() {
+	t.mu.Lock()
+	done := t.c.progress()
+	t.mu.Unlock()
+	if t.prog.total >= 0 {
+		done = min(done, t.prog.total)
+	}
+	if done > t.prog.done {
+		t.prog.add(int(done - t.prog.done))
+	}
+}
+
+// readerSize 尽量获取 r 中剩余的字节数，无法获取时返回 -1
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		off, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - off
+	}
+	return -1
+}
+
+// sumSizes 两个都已知时返回总和，否则返回 -1
+func sumSizes(a, b int64) int64 {
+	if a < 0 || b < 0 {
+		return -1
+	}
+	return a + b
+}
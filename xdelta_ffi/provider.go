@@ -0,0 +1,139 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SourceProvider 按需提供的旧数据，例如远程对象存储中的文件；Size 为旧数据的长度
+type SourceProvider interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// SourceRange 旧数据中从 Offset 开始的 Length 字节
+type SourceRange struct {
+	Offset int64
+	Length int64
+}
+
+// SourceStats ApplyDiffsFrom 读取旧数据的统计
+type SourceStats struct {
+	// Reads 调用 ReadAt 的次数
+	Reads int64
+	// BytesFetched ReadAt 读到的总字节数
+	BytesFetched int64
+}
+
+// SourceRanges 在没有旧数据的情况下返回应用补丁时 COPY 读取的旧数据区间，按偏移排序、互不重叠，
+// 相隔不超过 gap 字节的区间合并为一个（gap 为 0 时只合并相邻或重叠的区间），可以据此一次批量获取需要的旧数据
+// 与 ApplyDiffs 一样支持本库格式、VCDIFF 和 bsdiff；VCDIFF 中从目标窗口复制的数据不读取旧数据，不计入，bsdiff 为差分块读取的旧数据
+// 补丁结构有误时返回与 ValidateFormat 相同的错误，gap 小于 0 时返回 ErrInvalidArgument
+func SourceRanges(diffsData []byte, gap int64) ([]SourceRange, error) {
+	if gap < 0 {
+		return nil, fmt.Errorf("%w: negative gap %d", ErrInvalidArgument, gap)
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return sourceRanges(diffsData, uint64(gap))
+}
+
+// ApplyDiffsFrom 与 ApplyDiffs 相同，但旧数据来自 src，并且只读取补丁中 COPY 引用的区间：
+// 先用 SourceRanges 找出这些区间，解码时每次 ReadAt 读到所在区间的末尾（最多 WithSourceCache 设置的大小，默认 4 MiB），
+// 相邻的 COPY 因此合并为一次读取，区间之外的字节不会被读取；WithSourceCache 不大于 0 时按原生层的每次请求读取
+// 返回 ReadAt 的次数和读到的字节数，出错时也返回已经读取的部分；src 为 nil 或 Size 小于 0 时返回 ErrInvalidArgument
+func ApplyDiffsFrom(src SourceProvider, patch []byte, out io.Writer, opts ...Option) (SourceStats, error) {
+	if src == nil {
+		return SourceStats{}, fmt.Errorf("%w: nil source provider", ErrInvalidArgument)
+	}
+	size := src.Size()
+	if size < 0 {
+		return SourceStats{}, fmt.Errorf("%w: negative old data size %d", ErrInvalidArgument, size)
+	}
+	if err := Init(); err != nil {
+		return SourceStats{}, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return SourceStats{}, err
+	}
+	h, patch, err := o.openEnvelopeAt(patch, size)
+	if err != nil {
+		return SourceStats{}, err
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return SourceStats{}, err
+	}
+	ranges, err := sourceRanges(patch, 0)
+	release()
+	if err != nil {
+		return SourceStats{}, err
+	}
+	p := &providerSource{src: src, ranges: ranges, fetch: o.sourceCache}
+	old := newCachedSource(p, size, 0)
+	tw := &targetWriter{w: out}
+	if h != nil {
+		tw.verify(h)
+	}
+	if err = decodeStream(old, bytes.NewReader(patch), tw, o.windowSize, o.outputLimit(), newProgress(o.progress, int64(len(patch)))); err == nil {
+		err = tw.check()
+	}
+	return p.stats, err
+}
+
+// providerSource 从 SourceProvider 读取旧数据，每次读到请求所在区间的末尾（不超过 fetch 字节），
+// 多读的部分留给紧接着的请求
+type providerSource struct {
+	src    SourceProvider
+	ranges []SourceRange
+	fetch  int
+	buf    []byte
+	bufOff int64
+	stats  SourceStats
+}
+
+func (s *providerSource) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off >= s.bufOff && off < s.bufOff+int64(len(s.buf)) {
+		n = copy(p, s.buf[off-s.bufOff:])
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	// 缓冲区之外的部分从 pos 开始读取
+	rest, pos := p[n:], off+int64(n)
+	want := int64(len(rest))
+	i := sort.Search(len(s.ranges), func(i int) bool { return s.ranges[i].Offset+s.ranges[i].Length > pos })
+	if i < len(s.ranges) && s.ranges[i].Offset <= pos {
+		want = max(want, min(s.ranges[i].Offset+s.ranges[i].Length-pos, int64(s.fetch)))
+	}
+	if want == int64(len(rest)) {
+		m, err := s.src.ReadAt(rest, pos)
+		s.count(m)
+		return n + m, err
+	}
+	if int64(cap(s.buf)) < want {
+		s.buf = make([]byte, want)
+	}
+	s.buf = s.buf[:want]
+	m, err := s.src.ReadAt(s.buf, pos)
+	s.count(m)
+	if m < len(rest) {
+		copy(rest, s.buf[:m])
+		s.buf = s.buf[:0]
+		return n + m, err
+	}
+	s.buf, s.bufOff = s.buf[:m], pos
+	return n + copy(rest, s.buf), nil
+}
+
+func (s *providerSource) count(n int) {
+	s.stats.Reads++
+	s.stats.BytesFetched += int64(n)
+}
@@ -0,0 +1,88 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// recordingProvider 记录每次 ReadAt 的 SourceProvider
+type recordingProvider struct {
+	data  []byte
+	reads []SourceRange
+}
+
+func (p *recordingProvider) Size() int64 { return int64(len(p.data)) }
+
+func (p *recordingProvider) ReadAt(b []byte, off int64) (int, error) {
+	p.reads = append(p.reads, SourceRange{Offset: off, Length: int64(len(b))})
+	return bytes.NewReader(p.data).ReadAt(b, off)
+}
+
+// TestApplyDiffsFrom 结果与 ApplyDiffsData 相同；每次 ReadAt 都落在 SourceRanges 给出的某个区间之内，
+// 新数据只用到一小部分旧数据时读取的字节数也只有这么多；SourceStats 与实际的 ReadAt 一致，
+// WithSourceCache 不大于 0 时按原生层的每次请求读取，次数多于默认的合并读取；
+// 带 WithVerifyOutput 时信封与旧数据的长度不符，不读取就返回 ErrSourceMismatch；截断的 WithEndRecord 补丁返回 ErrCorruptPatch
+func TestApplyDiffsFrom(t *testing.T) {
+	requireNative(t)
+	oldData, _ := textFixture(4 << 20)
+	newData := append(bytes.Clone(oldData[1<<20:3<<19]), "between the two parts\n"...)
+	newData = append(newData, oldData[3<<20:3<<20+200000]...)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := SourceRanges(patch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readsByCache [2]int64
+	for i, opts := range [][]Option{nil, {WithSourceCache(0)}} {
+		src := &recordingProvider{data: oldData}
+		var out bytes.Buffer
+		stats, err := ApplyDiffsFrom(src, patch, &out, opts...)
+		if err != nil || !bytes.Equal(out.Bytes(), newData) {
+			t.Fatalf("options %d: %d bytes, %v", i, out.Len(), err)
+		}
+		var fetched int64
+		for _, r := range src.reads {
+			fetched += r.Length
+			inside := false
+			for _, sr := range ranges {
+				inside = inside || (r.Offset >= sr.Offset && r.Offset+r.Length <= sr.Offset+sr.Length)
+			}
+			if !inside {
+				t.Fatalf("options %d: read %+v outside the source ranges %v", i, r, ranges)
+			}
+		}
+		if stats.Reads != int64(len(src.reads)) || stats.BytesFetched != fetched {
+			t.Fatalf("options %d: stats %+v, %d reads of %d bytes", i, stats, len(src.reads), fetched)
+		}
+		if fetched > int64(len(newData))*2 {
+			t.Fatalf("options %d: read %d bytes of old data for %d new bytes", i, fetched, len(newData))
+		}
+		readsByCache[i] = stats.Reads
+	}
+	if readsByCache[0] >= readsByCache[1] {
+		t.Fatalf("%d reads with the default cache, %d without", readsByCache[0], readsByCache[1])
+	}
+
+	if _, err := ApplyDiffsFrom(nil, patch, &bytes.Buffer{}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil provider: got %v, want ErrInvalidArgument", err)
+	}
+	env, err := CreateEnvelope(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := &recordingProvider{data: oldData[:len(oldData)-1]}
+	if _, err := ApplyDiffsFrom(short, env, &bytes.Buffer{}, WithVerifyOutput()); !errors.Is(err, ErrSourceMismatch) || len(short.reads) != 0 {
+		t.Fatalf("envelope with a shorter source and WithVerifyOutput: %d reads, %v, want ErrSourceMismatch", len(short.reads), err)
+	}
+	headed, err := CreateDiffs(oldData, newData, WithEndRecord(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyDiffsFrom(&recordingProvider{data: oldData}, headed[:len(headed)/2], &bytes.Buffer{}); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("truncated patch: got %v, want ErrCorruptPatch", err)
+	}
+}
@@ -0,0 +1,158 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// DefaultSourceCacheSize 未通过 WithSourceCache 指定时 ApplyDiffs 缓存的旧数据量（字节）
+	DefaultSourceCacheSize = 4 << 20
+	// sourceCacheBlock 缓存的单位，与原生层读取 COPY 的分段大小相同
+	sourceCacheBlock = 64 << 10
+)
+
+// WithSourceCache 设置 ApplyDiffs 在内存中缓存的旧数据量（字节），按 64 KiB 的块缓存最近读取的部分，
+// 补丁中大量相邻或重复的 COPY 不必每次都调用 ReadAt；不大于 0 时不缓存；ApplyDiffsFrom 用它作为一次读取的上限，对其他接口没有影响
+func WithSourceCache(size int) Option {
+	return func(o *options) {
+		o.sourceCache = max(size, 0)
+	}
+}
+
+// ApplyDiffs 把内存中的补丁应用到可随机读取的旧数据 old（长度为 oldSize），结果写入 out
+// 旧数据不会整个读入内存：原生层只在解码 COPY 时通过回调读取所需的区间，内存中最多保留 WithSourceCache 设置的缓存，
+// 因此 *os.File 可以直接作为 old，适合放不进内存的大文件
+// 读取失败或旧数据比 oldSize 短时返回包装了 ReadAt 错误的错误（数据不足时为 io.ErrUnexpectedEOF），
+// COPY 超出 oldSize 时返回 ErrSourceMismatch；出错时 out 中可能已经写入了部分数据
+// opts 与 ApplyDiffsStream 相同，oldSize 小于 0 时返回 ErrInvalidArgument
+func ApplyDiffs(old io.ReaderAt, oldSize int64, patch []byte, out io.Writer, opts ...Option) (err error) {
+	if m := beginOp(OpApply, oldSize, int64(len(patch))); m != nil {
+		cw := &countingWriter{w: out}
+		out = cw
+		defer func() { m.end(cw.n, err) }()
+	}
+	if oldSize < 0 {
+		return fmt.Errorf("%w: negative old data size %d", ErrInvalidArgument, oldSize)
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	defer o.verboseScope()()
+	h, patch, err := o.openEnvelopeAt(patch, oldSize)
+	if err != nil {
+		return err
+	}
+	if err := o.verifySourceAt(h, old); err != nil {
+		return err
+	}
+	start := time.Now()
+	src := newCachedSource(old, oldSize, o.sourceCache)
+	prog := newProgress(o.progress, int64(len(patch)))
+	cw := &countingWriter{w: out}
+	tw := &targetWriter{w: cw}
+	if h != nil {
+		tw.verify(h)
+	}
+	if err := decodeStream(src, bytes.NewReader(patch), tw, o.windowSize, o.outputLimit(), prog); err != nil {
+		return err
+	}
+	if err := tw.check(); err != nil {
+		return err
+	}
+	o.recordApplyPatch(ApplyStats{SourceSize: oldSize, PatchSize: int64(len(patch)), TargetSize: cw.n, Windows: prog.windows}, patch, start)
+	return nil
+}
+
+// cachedSource 长度已知的旧数据，按块缓存最近读取的部分（LRU）；
+// Size 让原生层得知旧数据的长度，超出长度的读取返回 io.EOF（由 streamIO 按 COPY 越界处理），长度之内读不满时返回错误
+type cachedSource struct {
+	r    io.ReaderAt
+	size int64
+	// max 最多缓存的块数，为 0 时不缓存
+	max    int
+	blocks map[int64]*list.Element
+	lru    list.List
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+func newCachedSource(r io.ReaderAt, size int64, cache int) *cachedSource {
+	return &cachedSource{r: r, size: size, max: cache / sourceCacheBlock, blocks: make(map[int64]*list.Element)}
+}
+
+func (s *cachedSource) Size() int64 {
+	return s.size
+}
+
+func (s *cachedSource) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	want := p
+	if int64(len(p)) > s.size-off {
+		want = p[:s.size-off]
+	}
+	n := 0
+	if s.max == 0 {
+		m, err := s.r.ReadAt(want, off)
+		if m < len(want) {
+			return m, s.shortRead(off+int64(m), err)
+		}
+		n = m
+	}
+	for n < len(want) {
+		pos := off + int64(n)
+		b, err := s.block(pos / sourceCacheBlock)
+		if err != nil {
+			return n, err
+		}
+		n += copy(want[n:], b[pos%sourceCacheBlock:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block 返回第 i 块，不在缓存中时读入并淘汰最久未用的块
+func (s *cachedSource) block(i int64) ([]byte, error) {
+	if e, ok := s.blocks[i]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*cachedBlock).data, nil
+	}
+	var b *cachedBlock
+	if s.lru.Len() >= s.max {
+		e := s.lru.Back()
+		b = s.lru.Remove(e).(*cachedBlock)
+		delete(s.blocks, b.index)
+	} else {
+		b = &cachedBlock{data: make([]byte, sourceCacheBlock)}
+	}
+	start := i * sourceCacheBlock
+	data := b.data[:min(sourceCacheBlock, s.size-start)]
+	if m, err := s.r.ReadAt(data, start); m < len(data) {
+		return nil, s.shortRead(start+int64(m), err)
+	}
+	b.index, b.data = i, data
+	s.blocks[i] = s.lru.PushFront(b)
+	return data, nil
+}
+
+// shortRead 在 off 处读取中断的错误，ReadAt 没有报错或报告 io.EOF 时旧数据比声明的短
+func (s *cachedSource) shortRead(off int64, err error) error {
+	if err == nil || err == io.EOF {
+		return fmt.Errorf("old data ends at offset %d, %d bytes were expected: %w", off, s.size, io.ErrUnexpectedEOF)
+	}
+	return fmt.Errorf("read old data at offset %d: %w", off, err)
+}
@@ -0,0 +1,501 @@
+package xdelta_ffi
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+// 重新压缩补丁的格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'R' 'C' 'P' 0D 0A
+//	version      1 字节  当前为 1
+//	source size  8 字节
+//	source hash 32 字节  旧文件的 SHA-256
+//	记录                 按顺序产生新文件的各个片段，每条以 1 字节的类型开头：
+//	  1 same     old index 4 字节                                与旧文件的第 index 个片段相同
+//	  2 diff     old index 4 字节、patch 长度 8 字节、patch           把 patch 应用到旧文件的第 index 个片段（FFFFFFFF 为空数据）
+//	  3 deflate  old index 4 字节、level 1 字节、patch 长度 8 字节、patch
+//	                 把 patch 应用到旧文件第 index 个压缩片段解压后的内容，再用 compress/flate 的 level 级别压缩
+//	  4 idat     old index 4 字节、level 1 字节、zlib 头 2 字节、chunk 个数 4 字节、每个 chunk 的长度 4 字节、
+//	             patch 长度 8 字节、patch
+//	                 同样得到内容并压缩，加上 zlib 头和 Adler-32 后按给出的长度切分成 PNG 的 IDAT chunk
+//	  0 end      target size 8 字节、target hash 32 字节             新文件的长度和 SHA-256
+//
+// 片段是文件的原始字节：gzip 的每个成员拆成压缩数据和其前后的字节（成员头、CRC-32 和长度），
+// PNG 拆成 IDAT chunk 的连续序列和其前后的字节，其他文件整个是一个片段；片段按原样拼接就是原来的文件
+//
+// 只有 compress/flate 能复现的压缩片段（compress/gzip、image/png 写出的）使用 deflate、idat 记录，其他的对压缩数据差分；
+// 创建和应用补丁的 Go 版本中 compress/flate 的输出不同时，应用会返回 ErrTargetMismatch
+var recompressDiffMagic = []byte{0x89, 'X', 'D', 'R', 'C', 'P', 0x0D, 0x0A}
+
+const (
+	// RecompressDiffVersion CreateRecompressDiff 写入的补丁格式版本
+	RecompressDiffVersion = 1
+
+	recompressDiffHeaderLen = 8 + 1 + 8 + sha256.Size
+
+	rcOpEnd     = 0
+	rcOpSame    = 1
+	rcOpDiff    = 2
+	rcOpDeflate = 3
+	rcOpIDAT    = 4
+
+	// rcNoBase 记录不引用旧片段，patch 从空数据生成
+	rcNoBase = 1<<32 - 1
+
+	// rcMaxChunks idat 记录中 chunk 个数的上限
+	rcMaxChunks = 1 << 24
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// rcSegment 文件的一个片段；compressed 为 true 时 content 是解压后的内容，
+// level 是能复现 raw 的 compress/flate 级别，不能复现时为 -1
+type rcSegment struct {
+	raw        []byte
+	compressed bool
+	content    []byte
+	level      int
+
+	// PNG 的 IDAT 序列：zlib 头和每个 chunk 的数据长度；gzip 的压缩数据 chunks 为 nil
+	zlibHead []byte
+	chunks   []uint32
+}
+
+// splitRecompress 把 data 拆成片段；不认识的文件、损坏或无法解析的部分作为普通片段原样保留
+func splitRecompress(data []byte) []rcSegment {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return splitPNG(data)
+	case isGzipMember(data):
+		return splitGzip(data)
+	}
+	return []rcSegment{{raw: data, level: -1}}
+}
+
+func isGzipMember(b []byte) bool {
+	return len(b) >= 10 && b[0] == 0x1f && b[1] == 0x8b && b[2] == 8
+}
+
+// splitGzip 逐个拆分 gzip 成员；遇到无法解析的成员时，它和之后的所有数据并入最后一个普通片段
+func splitGzip(data []byte) []rcSegment {
+	var segs []rcSegment
+	start := 0 // 还没有归入任何片段的数据的起点
+	for pos := 0; isGzipMember(data[pos:]); {
+		body, ok := gzipHeaderLen(data[pos:])
+		if !ok {
+			break
+		}
+		body += pos
+		content, n, ok := inflateAt(data[body:])
+		end := body + n
+		if !ok || len(data)-end < 8 ||
+			binary.LittleEndian.Uint32(data[end:]) != crc32.ChecksumIEEE(content) ||
+			binary.LittleEndian.Uint32(data[end+4:]) != uint32(len(content)) {
+			break
+		}
+		raw := data[body:end]
+		segs = append(segs,
+			rcSegment{raw: data[start:body], level: -1},
+			rcSegment{raw: raw, compressed: true, content: content, level: deflateLevel(content, raw)})
+		start, pos = end, end+8
+	}
+	return append(segs, rcSegment{raw: data[start:], level: -1})
+}
+
+// gzipHeaderLen 返回 gzip 成员头的长度，头被截断时 ok 为 false
+func gzipHeaderLen(b []byte) (int, bool) {
+	const (
+		fhcrc    = 1 << 1
+		fextra   = 1 << 2
+		fname    = 1 << 3
+		fcomment = 1 << 4
+	)
+	flags := b[3]
+	n := 10
+	if flags&fextra != 0 {
+		if len(b) < n+2 {
+			return 0, false
+		}
+		n += 2 + int(binary.LittleEndian.Uint16(b[n:]))
+	}
+	for _, f := range []byte{fname, fcomment} {
+		if flags&f == 0 {
+			continue
+		}
+		if n > len(b) {
+			return 0, false
+		}
+		i := bytes.IndexByte(b[n:], 0)
+		if i < 0 {
+			return 0, false
+		}
+		n += i + 1
+	}
+	if flags&fhcrc != 0 {
+		n += 2
+	}
+	return n, n <= len(b)
+}
+
+// inflateAt 解压 b 开头的 deflate 数据，返回内容和压缩数据的长度
+// bytes.Reader 实现了 io.ByteReader，flate 按字节读取，不会读过压缩数据的结尾
+func inflateAt(b []byte) (content []byte, n int, ok bool) {
+	r := bytes.NewReader(b)
+	content, err := io.ReadAll(flate.NewReader(r))
+	if err != nil {
+		return nil, 0, false
+	}
+	return content, len(b) - r.Len(), true
+}
+
+// splitPNG 把 PNG 拆成第一个 IDAT 序列之前的字节、IDAT 序列和之后的字节；
+// chunk 结构不对或 IDAT 中不是一个完整的 zlib 流时整个文件是一个普通片段
+func splitPNG(data []byte) []rcSegment {
+	whole := []rcSegment{{raw: data, level: -1}}
+	var first, last int // IDAT 序列的起点和终点
+	var chunks []uint32
+	var stream []byte
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		n := binary.BigEndian.Uint32(data[pos:])
+		if uint64(n) > uint64(len(data)-pos-12) {
+			return whole
+		}
+		end := pos + 12 + int(n)
+		if string(data[pos+4:pos+8]) == "IDAT" {
+			if chunks == nil {
+				first = pos
+			} else if last != pos {
+				// 规范要求 IDAT 连续出现，不连续时只处理第一个序列
+				break
+			}
+			chunks = append(chunks, n)
+			stream = append(stream, data[pos+8:pos+8+int(n)]...)
+			last = end
+		}
+		pos = end
+	}
+	if chunks == nil || len(chunks) > rcMaxChunks || len(stream) < 6 {
+		return whole
+	}
+	// zlib 头：压缩方式为 deflate，没有预设字典，校验位正确
+	head := stream[:2]
+	if head[0]&0x0f != 8 || head[1]&0x20 != 0 || binary.BigEndian.Uint16(head)%31 != 0 {
+		return whole
+	}
+	content, n, ok := inflateAt(stream[2:])
+	if !ok || len(stream)-2-n != 4 || binary.BigEndian.Uint32(stream[2+n:]) != adler32.Checksum(content) {
+		return whole
+	}
+	seg := rcSegment{raw: data[first:last], compressed: true, content: content, level: -1, zlibHead: head, chunks: chunks}
+	if level := deflateLevel(content, stream[2:2+n]); level >= 0 {
+		// chunk 的 CRC-32 不对时无法复现
+		if b, err := buildIDAT(content, level, head, chunks); err == nil && bytes.Equal(b, seg.raw) {
+			seg.level = level
+		}
+	}
+	return []rcSegment{{raw: data[:first], level: -1}, seg, {raw: data[last:], level: -1}}
+}
+
+// buildIDAT 用 level 级别压缩 content，加上 zlib 头和 Adler-32，按 chunks 的长度写成 IDAT chunk
+func buildIDAT(content []byte, level int, head []byte, chunks []uint32) ([]byte, error) {
+	deflated, err := deflate(content, level)
+	if err != nil {
+		return nil, err
+	}
+	stream := append(append(append([]byte{}, head...), deflated...), binary.BigEndian.AppendUint32(nil, adler32.Checksum(content))...)
+	var total uint64
+	for _, n := range chunks {
+		total += uint64(n)
+	}
+	if total != uint64(len(stream)) {
+		return nil, fmt.Errorf("%w: IDAT chunks hold %d bytes, the zlib stream has %d", ErrTargetMismatch, total, len(stream))
+	}
+	out := make([]byte, 0, len(stream)+12*len(chunks))
+	for _, n := range chunks {
+		start := len(out)
+		out = binary.BigEndian.AppendUint32(out, n)
+		out = append(out, "IDAT"...)
+		out = append(out, stream[:n]...)
+		out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start+4:]))
+		stream = stream[n:]
+	}
+	return out, nil
+}
+
+// rcBase 新文件的片段 seg 对应的旧片段：压缩片段与旧文件中同样序号的压缩片段对应，其他片段与普通片段对应
+type rcBase struct {
+	plain, compressed []uint32
+}
+
+func newRCBase(segs []rcSegment) rcBase {
+	var b rcBase
+	for i, s := range segs {
+		if s.compressed {
+			b.compressed = append(b.compressed, uint32(i))
+		} else {
+			b.plain = append(b.plain, uint32(i))
+		}
+	}
+	return b
+}
+
+// next 返回与下一个 compressed 片段对应的旧片段的下标，没有时返回 rcNoBase
+func (b *rcBase) next(compressed bool) uint32 {
+	list := &b.plain
+	if compressed {
+		list = &b.compressed
+	}
+	if len(*list) == 0 {
+		return rcNoBase
+	}
+	i := (*list)[0]
+	*list = (*list)[1:]
+	return i
+}
+
+// CreateRecompressDiff 创建从 oldFile 到 newFile 的补丁并写入 out，gzip 和 PNG 中的压缩数据解压后再生成补丁
+func CreateRecompressDiff(oldFile, newFile io.Reader, out io.Writer, opts ...Option) error {
+	if err := Init(); err != nil {
+		return err
+	}
+	if _, err := newOptions(opts); err != nil {
+		return err
+	}
+	oldData, err := io.ReadAll(oldFile)
+	if err != nil {
+		return err
+	}
+	newData, err := io.ReadAll(newFile)
+	if err != nil {
+		return err
+	}
+	src := splitRecompress(oldData)
+	sum := sha256.Sum256(oldData)
+
+	bw := bufio.NewWriter(out)
+	head := append([]byte{}, recompressDiffMagic...)
+	head = append(head, RecompressDiffVersion)
+	head = binary.LittleEndian.AppendUint64(head, uint64(len(oldData)))
+	head = append(head, sum[:]...)
+	if _, err := bw.Write(head); err != nil {
+		return err
+	}
+
+	bases := newRCBase(src)
+	var rec []byte
+	for _, seg := range splitRecompress(newData) {
+		base := bases.next(seg.compressed)
+		var old []byte
+		if base != rcNoBase {
+			old = src[base].raw
+			if bytes.Equal(old, seg.raw) {
+				rec = binary.LittleEndian.AppendUint32(append(rec[:0], rcOpSame), base)
+				if _, err := bw.Write(rec); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		patch, err := CreateDiffs(old, seg.raw, opts...)
+		if err != nil {
+			return err
+		}
+		rec = binary.LittleEndian.AppendUint32(append(rec[:0], rcOpDiff), base)
+		// 能复现压缩数据时再对解压后的内容生成补丁，取较小的一个
+		if seg.compressed && seg.level >= 0 {
+			var oldContent []byte
+			if base != rcNoBase {
+				oldContent = src[base].content
+			}
+			cp, err := CreateDiffs(oldContent, seg.content, opts...)
+			if err != nil {
+				return err
+			}
+			if len(cp) < len(patch) {
+				patch = cp
+				rec = rcContentRecord(rec[:0], base, seg)
+			}
+		}
+		if err := writePatchRecord(bw, rec, patch); err != nil {
+			return err
+		}
+	}
+	rec = binary.LittleEndian.AppendUint64(append(rec[:0], rcOpEnd), uint64(len(newData)))
+	sum = sha256.Sum256(newData)
+	if _, err := bw.Write(append(rec, sum[:]...)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// rcContentRecord 把压缩片段 seg 的 deflate 或 idat 记录（patch 之前的部分）追加到 rec；
+// 旧片段不是压缩片段时 patch 从空数据生成
+func rcContentRecord(rec []byte, base uint32, seg rcSegment) []byte {
+	op := byte(rcOpDeflate)
+	if seg.chunks != nil {
+		op = rcOpIDAT
+	}
+	rec = binary.LittleEndian.AppendUint32(append(rec, op), base)
+	rec = append(rec, byte(seg.level))
+	if seg.chunks != nil {
+		rec = append(rec, seg.zlibHead...)
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(len(seg.chunks)))
+		for _, n := range seg.chunks {
+			rec = binary.LittleEndian.AppendUint32(rec, n)
+		}
+	}
+	return rec
+}
+
+// ApplyRecompressDiff 把 CreateRecompressDiff 生成的补丁应用到 oldFile，把新文件写入 out
+func ApplyRecompressDiff(oldFile io.Reader, patch io.Reader, out io.Writer, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	pr := bufio.NewReader(patch)
+	head := make([]byte, recompressDiffHeaderLen)
+	if _, err := io.ReadFull(pr, head[:len(recompressDiffMagic)+1]); err != nil || !bytes.HasPrefix(head, recompressDiffMagic) {
+		return fmt.Errorf("%w: missing recompress diff magic", ErrCorruptPatch)
+	}
+	if v := head[len(recompressDiffMagic)]; v != RecompressDiffVersion {
+		return fmt.Errorf("%w: recompress diff version %d", ErrUnsupportedPatch, v)
+	}
+	if _, err := io.ReadFull(pr, head[len(recompressDiffMagic)+1:]); err != nil {
+		return fmt.Errorf("%w: truncated recompress diff header", ErrCorruptPatch)
+	}
+	oldData, err := io.ReadAll(oldFile)
+	if err != nil {
+		return err
+	}
+	b := head[len(recompressDiffMagic)+1:]
+	if size := binary.LittleEndian.Uint64(b); size != uint64(len(oldData)) {
+		return fmt.Errorf("%w: old file is %d bytes, the patch expects %d", ErrSourceMismatch, len(oldData), size)
+	}
+	if sum := sha256.Sum256(oldData); !bytes.Equal(b[8:], sum[:]) {
+		return fmt.Errorf("%w: SHA-256 of the old file differs from the patch", ErrSourceMismatch)
+	}
+	src := splitRecompress(oldData)
+
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	budget := newDiffBudget(o, opts, "file")
+	var size int64
+	for {
+		op, err := pr.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: truncated recompress diff", ErrCorruptPatch)
+		}
+		var data []byte
+		switch op {
+		case rcOpEnd:
+			return checkDiffEnd(pr, size, h, "recompress")
+		case rcOpSame, rcOpDiff:
+			base, err := readRCIndex(pr, len(src), op == rcOpSame)
+			if err != nil {
+				return err
+			}
+			if base != rcNoBase {
+				data = src[base].raw
+			}
+			if op == rcOpDiff {
+				p, err := readRecordPatch(pr, "recompress")
+				if err != nil {
+					return err
+				}
+				if data, err = ApplyDiffsData(data, p, budget.patchOpts()...); err != nil {
+					return err
+				}
+			}
+		case rcOpDeflate, rcOpIDAT:
+			if data, err = readRecompressed(src, pr, op, budget.contentOpts()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown recompress diff record %d", ErrCorruptPatch, op)
+		}
+		if err := budget.add(len(data)); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		size += int64(len(data))
+	}
+}
+
+// readRCIndex 读取记录中的片段下标，检查它小于 n；required 为 false 时也接受 rcNoBase
+func readRCIndex(r io.Reader, n int, required bool) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, fmt.Errorf("%w: truncated recompress diff", ErrCorruptPatch)
+	}
+	i := binary.LittleEndian.Uint32(b[:])
+	if (i != rcNoBase || required) && uint64(i) >= uint64(n) {
+		return 0, fmt.Errorf("%w: recompress diff references segment %d of %d", ErrCorruptPatch, i, n)
+	}
+	return i, nil
+}
+
+// readRecompressed 读取 deflate、idat 记录，返回重新压缩后的片段
+func readRecompressed(src []rcSegment, pr *bufio.Reader, op byte, opts []Option) ([]byte, error) {
+	base, err := readRCIndex(pr, len(src), false)
+	if err != nil {
+		return nil, err
+	}
+	if base != rcNoBase && !src[base].compressed {
+		return nil, fmt.Errorf("%w: recompress diff decompresses segment %d, which is not compressed", ErrCorruptPatch, base)
+	}
+	level, err := pr.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: truncated recompress diff", ErrCorruptPatch)
+	}
+	if level < 1 || level > 9 {
+		return nil, fmt.Errorf("%w: recompress diff deflate level %d", ErrCorruptPatch, level)
+	}
+	var zlibHead []byte
+	var chunks []uint32
+	if op == rcOpIDAT {
+		var b [6]byte
+		if _, err := io.ReadFull(pr, b[:]); err != nil {
+			return nil, fmt.Errorf("%w: truncated recompress diff", ErrCorruptPatch)
+		}
+		zlibHead = b[:2]
+		n := binary.LittleEndian.Uint32(b[2:])
+		if n == 0 || n > rcMaxChunks {
+			return nil, fmt.Errorf("%w: recompress diff with %d IDAT chunks", ErrCorruptPatch, n)
+		}
+		lens := make([]byte, 4*int(n))
+		if _, err := io.ReadFull(pr, lens); err != nil {
+			return nil, fmt.Errorf("%w: truncated recompress diff", ErrCorruptPatch)
+		}
+		chunks = make([]uint32, n)
+		for i := range chunks {
+			chunks[i] = binary.LittleEndian.Uint32(lens[4*i:])
+		}
+	}
+	p, err := readRecordPatch(pr, "recompress")
+	if err != nil {
+		return nil, err
+	}
+	var old []byte
+	if base != rcNoBase {
+		old = src[base].content
+	}
+	content, err := ApplyDiffsData(old, p, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if op == rcOpIDAT {
+		return buildIDAT(content, int(level), zlibHead, chunks)
+	}
+	return deflate(content, int(level))
+}
@@ -0,0 +1,225 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readRecompressFixture 读取 testdata/recompress 中的文件（由 generate.py 用 zlib 压缩）
+func readRecompressFixture(tb testing.TB, name string) []byte {
+	tb.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "recompress", name))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// recompressRoundTrip 创建并应用补丁，检查结果与 newFile 逐字节相同，返回补丁
+func recompressRoundTrip(tb testing.TB, oldFile, newFile []byte, opts ...Option) []byte {
+	tb.Helper()
+	var patch bytes.Buffer
+	if err := CreateRecompressDiff(bytes.NewReader(oldFile), bytes.NewReader(newFile), &patch, opts...); err != nil {
+		tb.Fatal(err)
+	}
+	got, err := applyRecompressDiff(oldFile, patch.Bytes())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(got, newFile) {
+		tb.Fatalf("got %d bytes, want the %d byte new file", len(got), len(newFile))
+	}
+	return patch.Bytes()
+}
+
+func applyRecompressDiff(oldFile, patch []byte, opts ...Option) ([]byte, error) {
+	var out bytes.Buffer
+	err := ApplyRecompressDiff(bytes.NewReader(oldFile), bytes.NewReader(patch), &out, opts...)
+	return out.Bytes(), err
+}
+
+// rcDiffOps 按格式说明解析重新压缩补丁，返回 end 之前各条记录的类型
+func rcDiffOps(tb testing.TB, patch []byte) []byte {
+	tb.Helper()
+	p := patch[recompressDiffHeaderLen:]
+	var ops []byte
+	for p[0] != rcOpEnd {
+		op := p[0]
+		p = p[5:]
+		switch op {
+		case rcOpDeflate:
+			p = p[1:]
+		case rcOpIDAT:
+			p = p[7+4*binary.LittleEndian.Uint32(p[3:]):]
+		}
+		if op != rcOpSame {
+			p = p[8+binary.LittleEndian.Uint64(p):]
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// gzipMembers 用 compress/gzip 把每段内容写成一个成员，拼接起来
+func gzipMembers(tb testing.TB, contents ...[]byte) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	for _, c := range contents {
+		zw := gzip.NewWriter(&buf)
+		zw.Name = "data.txt"
+		if _, err := zw.Write(c); err != nil {
+			tb.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// pngImage 用 image/png 写出一张 256x256 的图片，changed 时中间的一块像素不同
+func pngImage(tb testing.TB, changed bool) []byte {
+	tb.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	r := fixtureRand(7)
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			c := color.NRGBA{uint8(x), uint8(y), uint8(r.intn(64)), 255}
+			if changed && x >= 100 && x < 120 && y >= 100 && y < 104 {
+				c = color.NRGBA{255, 0, 0, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestRecompressGzip compress/gzip 写出的成员能按记下的级别重新压缩，补丁对解压后的内容生成；
+// 多个成员逐个对应，没变的成员只记录引用
+func TestRecompressGzip(t *testing.T) {
+	requireNative(t)
+	oldText, newText := textFixture(60000)
+	oldFile := gzipMembers(t, oldText, []byte("second member\n"))
+	newFile := gzipMembers(t, newText, []byte("second member\n"))
+	patch := recompressRoundTrip(t, oldFile, newFile)
+	// 第一个成员的头、压缩数据，第一个成员的尾部（CRC-32 和长度变了）和第二个成员的头、压缩数据，以及最后的尾部
+	if ops, want := rcDiffOps(t, patch), []byte{rcOpSame, rcOpDeflate, rcOpDiff, rcOpSame, rcOpSame}; !bytes.Equal(ops, want) {
+		t.Errorf("records %v, want %v", ops, want)
+	}
+	direct, err := CreateDiffs(oldFile, newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) >= len(direct)/2 {
+		t.Errorf("patch is %d bytes, diffing the compressed files directly gives %d", len(patch), len(direct))
+	}
+}
+
+// TestRecompressPNG image/png 写出的 IDAT 序列按原来的 chunk 长度重新写出，其他 chunk 单独比较
+func TestRecompressPNG(t *testing.T) {
+	requireNative(t)
+	oldFile, newFile := pngImage(t, false), pngImage(t, true)
+	segs := splitRecompress(newFile)
+	if len(segs) != 3 || len(segs[1].chunks) < 2 || segs[1].level < 0 {
+		t.Fatalf("%d segments: want the IDAT sequence of several chunks in the middle, reproducible", len(segs))
+	}
+	patch := recompressRoundTrip(t, oldFile, newFile)
+	// 第一个 IDAT 之前（签名、IHDR）和之后（IEND）不变
+	if ops, want := rcDiffOps(t, patch), []byte{rcOpSame, rcOpIDAT, rcOpSame}; !bytes.Equal(ops, want) {
+		t.Errorf("records %v, want %v", ops, want)
+	}
+	direct, err := CreateDiffs(oldFile, newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) >= len(direct)/2 {
+		t.Errorf("patch is %d bytes, diffing the images directly gives %d", len(patch), len(direct))
+	}
+}
+
+// TestRecompressUnreproducible zlib 压缩的 gzip 和 PNG 无法用 compress/flate 复现，对压缩数据直接生成补丁，结果仍然逐字节相同
+func TestRecompressUnreproducible(t *testing.T) {
+	requireNative(t)
+	for _, name := range []string{"gz", "png"} {
+		oldFile, newFile := readRecompressFixture(t, "zlib-old."+name), readRecompressFixture(t, "zlib-new."+name)
+		segs := splitRecompress(newFile)
+		if len(segs) != 3 || !segs[1].compressed || segs[1].level >= 0 {
+			t.Fatalf("%s: %d segments: want one compressed segment that cannot be reproduced", name, len(segs))
+		}
+		patch := recompressRoundTrip(t, oldFile, newFile)
+		for _, op := range rcDiffOps(t, patch) {
+			if op != rcOpSame && op != rcOpDiff {
+				t.Errorf("%s: record %d", name, op)
+			}
+		}
+	}
+}
+
+// TestRecompressOther 不认识的文件（包括 zip 归档）整个是一个片段，直接生成补丁
+func TestRecompressOther(t *testing.T) {
+	requireNative(t)
+	oldZip, newZip := readZipFixture(t, "app-old.zip"), readZipFixture(t, "app-new.zip")
+	if segs := splitRecompress(newZip); len(segs) != 1 {
+		t.Fatalf("a zip is %d segments", len(segs))
+	}
+	patch := recompressRoundTrip(t, oldZip, newZip)
+	if ops := rcDiffOps(t, patch); !bytes.Equal(ops, []byte{rcOpDiff}) {
+		t.Errorf("records %v", ops)
+	}
+	// gzip 后面跟着无法解析的数据时，它们并入最后一个普通片段
+	gz := append(gzipMembers(t, []byte("content")), "\x1f\x8b\x08junk"...)
+	recompressRoundTrip(t, gz, append(bytes.Clone(gz), "more"...))
+}
+
+// TestRecompressErrors 旧文件不对时不写出数据、返回 ErrSourceMismatch；截断、版本和结尾校验的错误各自对应；
+// WithMaxOutputSize 限制整个新文件
+func TestRecompressErrors(t *testing.T) {
+	requireNative(t)
+	oldText, newText := textFixture(20000)
+	oldFile, newFile := gzipMembers(t, oldText), gzipMembers(t, newText)
+	patch := recompressRoundTrip(t, oldFile, newFile)
+
+	got, err := applyRecompressDiff(newFile, patch)
+	if !errors.Is(err, ErrSourceMismatch) || len(got) != 0 {
+		t.Fatalf("wrong old file: got %v after %d bytes, want ErrSourceMismatch before any output", err, len(got))
+	}
+	for _, n := range []int{0, 5, recompressDiffHeaderLen - 1, recompressDiffHeaderLen, recompressDiffHeaderLen + 3, len(patch) / 2, len(patch) - 1} {
+		if _, err := applyRecompressDiff(oldFile, patch[:n]); !errors.Is(err, ErrCorruptPatch) {
+			t.Errorf("%d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+		}
+	}
+	bad := bytes.Clone(patch)
+	bad[len(recompressDiffMagic)] = RecompressDiffVersion + 1
+	if _, err := applyRecompressDiff(oldFile, bad); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Errorf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+	bad = bytes.Clone(patch)
+	bad[len(bad)-1] ^= 1
+	if _, err := applyRecompressDiff(oldFile, bad); !errors.Is(err, ErrTargetMismatch) {
+		t.Errorf("changed target hash: got %v, want ErrTargetMismatch", err)
+	}
+	bad = bytes.Clone(patch)
+	bad[recompressDiffHeaderLen] = 9
+	if _, err := applyRecompressDiff(oldFile, bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Errorf("unknown record: got %v, want ErrCorruptPatch", err)
+	}
+
+	if _, err := applyRecompressDiff(oldFile, patch, WithMaxOutputSize(int64(len(newFile)))); err != nil {
+		t.Errorf("WithMaxOutputSize of the new size: %v", err)
+	}
+	if _, err := applyRecompressDiff(oldFile, patch, WithMaxOutputSize(int64(len(newFile)-1))); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("WithMaxOutputSize below the new size: got %v, want ErrOutputTooLarge", err)
+	}
+}
@@ -0,0 +1,171 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const (
+	// regionOffsetKey、regionLengthKey CreateRegionDiff 在信封元数据中记录区域的键，值为十进制数
+	regionOffsetKey = "xdelta.region.offset"
+	regionLengthKey = "xdelta.region.length"
+)
+
+// CreateRegionDiff 只对 oldSrc 和 newSrc 中 region 所指的同一段字节做补丁，用于大文件中只有已知区域变化的情况（例如数据库文件），
+// 两个输入的这段内容都读入内存。结果是带元数据的信封（格式版本 2），除 WithMetadata 的条目外
+// 还记录区域的偏移和长度，信封的旧数据、新数据哈希就是区域修改前后的 SHA-256，用 ApplyRegionDiff 应用
+// region 的偏移或长度为负数，或超出 oldSrc、newSrc 的范围（能得知长度时在读取之前检查）时返回 ErrInvalidArgument；
+// opts 与 CreateEnvelope 相同，WithMetadata 中与区域同名的键（xdelta.region.offset、xdelta.region.length）被覆盖
+func CreateRegionDiff(oldSrc, newSrc io.ReaderAt, region ByteRange, opts ...Option) ([]byte, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := region.check(sourceSize(oldSrc)); err != nil {
+		return nil, err
+	}
+	if err := region.check(sourceSize(newSrc)); err != nil {
+		return nil, err
+	}
+	oldData, err := region.read(oldSrc)
+	if err != nil {
+		return nil, fmt.Errorf("read old region: %w", err)
+	}
+	newData, err := region.read(newSrc)
+	if err != nil {
+		return nil, fmt.Errorf("read new region: %w", err)
+	}
+	m := maps.Clone(o.metadata)
+	if m == nil {
+		m = make(map[string]string, 2)
+	}
+	m[regionOffsetKey] = strconv.FormatInt(region.Offset, 10)
+	m[regionLengthKey] = strconv.FormatInt(region.Length, 10)
+	return CreateEnvelope(oldData, newData, append(opts[:len(opts):len(opts)], WithMetadata(m))...)
+}
+
+// ApplyRegionDiff 把 CreateRegionDiff 生成的补丁原地应用到 target 中记录的区域，文件的其他部分和长度不变
+// 先读出区域并比较修改前的 SHA-256，不一致时返回 ErrSourceMismatch；在内存中解码并比较修改后的 SHA-256，
+// 不一致时返回 ErrTargetMismatch；都通过后才一次写入 target，之前的任何错误都不会修改文件
+// 不是区域补丁时返回 ErrInvalidArgument，区域超出 target 的长度时返回 ErrInvalidArgument；
+// 同一文件（按 os.SameFile 判断）上区域重叠的 ApplyRegionDiff 不能同时进行，后开始的返回 ErrRegionLocked，不等待；
+// 只在本进程内互斥，其他进程修改文件不受限制。写入失败时区域中的内容可能只更新了一部分
+func ApplyRegionDiff(target *os.File, patch []byte) error {
+	h, _, err := ParseEnvelope(patch)
+	if err != nil {
+		return err
+	}
+	region, err := h.region()
+	if err != nil {
+		return err
+	}
+	fi, err := target.Stat()
+	if err != nil {
+		return err
+	}
+	if err := region.check(fi.Size()); err != nil {
+		return err
+	}
+	unlock, err := lockRegion(fi, region)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	oldData, err := region.read(target)
+	if err != nil {
+		return fmt.Errorf("read region: %w", err)
+	}
+	newData, err := ApplyEnvelope(oldData, patch)
+	if err != nil {
+		return err
+	}
+	if _, err := target.WriteAt(newData, region.Offset); err != nil {
+		return fmt.Errorf("write region: %w", err)
+	}
+	return nil
+}
+
+// region 读取信封元数据中记录的区域，区域长度必须与修改前后的数据长度一致
+func (h EnvelopeHeader) region() (ByteRange, error) {
+	offset, okOffset := h.Metadata[regionOffsetKey]
+	length, okLength := h.Metadata[regionLengthKey]
+	if !okOffset || !okLength {
+		return ByteRange{}, fmt.Errorf("%w: envelope has no region", ErrInvalidArgument)
+	}
+	var r ByteRange
+	var err1, err2 error
+	r.Offset, err1 = strconv.ParseInt(offset, 10, 64)
+	r.Length, err2 = strconv.ParseInt(length, 10, 64)
+	if err1 != nil || err2 != nil || r.Offset < 0 || r.Length < 0 || r.Offset > r.Offset+r.Length {
+		return ByteRange{}, fmt.Errorf("%w: envelope region %q+%q is invalid", ErrCorruptPatch, offset, length)
+	}
+	if h.SourceSize != r.Length || h.TargetSize != r.Length {
+		return ByteRange{}, fmt.Errorf("%w: region of %d bytes does not match %d bytes of source and %d bytes of target",
+			ErrCorruptPatch, r.Length, h.SourceSize, h.TargetSize)
+	}
+	return r, nil
+}
+
+// check 检查区域不超出长度为 size 的数据，size 为 -1（未知）时只检查偏移和长度不为负数
+func (r ByteRange) check(size int64) error {
+	if r.Offset < 0 || r.Length < 0 || r.Offset > r.Offset+r.Length {
+		return fmt.Errorf("%w: region at offset %d with length %d is invalid", ErrInvalidArgument, r.Offset, r.Length)
+	}
+	if size >= 0 && r.Offset+r.Length > size {
+		return fmt.Errorf("%w: region [%d, %d) is beyond the end of %d bytes of data", ErrInvalidArgument, r.Offset, r.Offset+r.Length, size)
+	}
+	return nil
+}
+
+// read 读出 ra 中的区域，数据不足时返回 ErrInvalidArgument
+func (r ByteRange) read(ra io.ReaderAt) ([]byte, error) {
+	buf := make([]byte, r.Length)
+	n, err := ra.ReadAt(buf, r.Offset)
+	if n == len(buf) {
+		return buf, nil
+	}
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: region [%d, %d) is beyond the end of data at %d", ErrInvalidArgument, r.Offset, r.Offset+r.Length, r.Offset+int64(n))
+	}
+	return nil, err
+}
+
+// overlaps 报告两个区域是否有共同的字节，空区域与任何区域都不重叠
+func (r ByteRange) overlaps(s ByteRange) bool {
+	return r.Offset < s.Offset+s.Length && s.Offset < r.Offset+r.Length
+}
+
+// lockedRegion 一个正在被 ApplyRegionDiff 修改的文件区域
+type lockedRegion struct {
+	file   os.FileInfo
+	region ByteRange
+}
+
+var (
+	regionMu      sync.Mutex
+	lockedRegions []*lockedRegion
+)
+
+// lockRegion 登记 file 中正在修改的区域，与已登记的区域重叠时返回 ErrRegionLocked；成功时返回解除登记的函数
+func lockRegion(file os.FileInfo, region ByteRange) (unlock func(), err error) {
+	regionMu.Lock()
+	defer regionMu.Unlock()
+	for _, l := range lockedRegions {
+		if l.region.overlaps(region) && os.SameFile(l.file, file) {
+			return nil, fmt.Errorf("%w: [%d, %d) of %s overlaps [%d, %d)", ErrRegionLocked,
+				region.Offset, region.Offset+region.Length, file.Name(), l.region.Offset, l.region.Offset+l.region.Length)
+		}
+	}
+	l := &lockedRegion{file: file, region: region}
+	lockedRegions = append(lockedRegions, l)
+	return func() {
+		regionMu.Lock()
+		lockedRegions = slices.DeleteFunc(lockedRegions, func(x *lockedRegion) bool { return x == l })
+		regionMu.Unlock()
+	}, nil
+}
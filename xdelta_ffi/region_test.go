@@ -0,0 +1,160 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// regionFixture 1 MiB 的旧文件内容和只在 region 内改动的新内容
+func regionFixture() (oldData, newData []byte, region ByteRange) {
+	oldData, _ = textFixture(1 << 20)
+	region = ByteRange{Offset: 300000, Length: 8192}
+	newData = bytes.Clone(oldData)
+	copy(newData[region.Offset+100:], "rewritten page header")
+	copy(newData[region.Offset+5000:], bytes.Repeat([]byte{0}, 700))
+	return oldData, newData, region
+}
+
+// openRegionTarget 把 data 写入 dir 中的文件，返回以读写方式打开的文件
+func openRegionTarget(t *testing.T, dir string, data []byte) *os.File {
+	t.Helper()
+	path := filepath.Join(dir, "target.db")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// fileContent 从头读出 f 的全部内容
+func fileContent(t *testing.T, f *os.File) []byte {
+	t.Helper()
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// mustStat f 的 os.FileInfo，用于直接登记正在修改的区域
+func mustStat(t *testing.T, f *os.File) os.FileInfo {
+	t.Helper()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+// TestRegionDiffRoundTrip 补丁只包含区域的改动，元数据记录区域，原地应用后文件与新内容相同、长度不变；
+// 不重叠的区域可以在同一文件上同时修改
+func TestRegionDiffRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData, region := regionFixture()
+	patch, err := CreateRegionDiff(bytes.NewReader(oldData), bytes.NewReader(newData), region, WithMetadata(map[string]string{"table": "users"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := ParseEnvelope(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.SourceSize != region.Length || h.TargetSize != region.Length || h.Metadata["table"] != "users" ||
+		h.Metadata[regionOffsetKey] != "300000" || h.Metadata[regionLengthKey] != "8192" {
+		t.Fatalf("envelope header %+v", h)
+	}
+	if len(patch) > int(region.Length) {
+		t.Fatalf("patch of %d bytes for a region of %d", len(patch), region.Length)
+	}
+
+	f := openRegionTarget(t, t.TempDir(), oldData)
+	// 另一个不重叠的区域正在修改，不影响这一次
+	unlock, err := lockRegion(mustStat(t, f), ByteRange{Offset: region.Offset + region.Length, Length: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err := ApplyRegionDiff(f, patch); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileContent(t, f); !bytes.Equal(got, newData) {
+		t.Fatalf("file of %d bytes after the patch differs from the new data", len(got))
+	}
+}
+
+// TestRegionDiffCorrupt 区域内容不是修改前的内容时返回 ErrSourceMismatch，损坏的补丁返回错误，都不修改文件；
+// 区域超出文件、不是区域补丁、区域与正在进行的修改重叠时分别返回 ErrInvalidArgument、ErrInvalidArgument、ErrRegionLocked
+func TestRegionDiffCorrupt(t *testing.T) {
+	requireNative(t)
+	oldData, newData, region := regionFixture()
+	patch, err := CreateRegionDiff(bytes.NewReader(oldData), bytes.NewReader(newData), region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// 区域内已经有别的改动
+	other := bytes.Clone(oldData)
+	other[region.Offset+region.Length-1] ^= 0x01
+	f := openRegionTarget(t, dir, other)
+	if err := ApplyRegionDiff(f, patch); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("changed region: got %v, want ErrSourceMismatch", err)
+	}
+	if !bytes.Equal(fileContent(t, f), other) {
+		t.Fatal("file modified after ErrSourceMismatch")
+	}
+	f.Close()
+
+	f = openRegionTarget(t, dir, oldData)
+	// 结束记录中的输出长度与补丁内容不符
+	bad, err := CreateRegionDiff(bytes.NewReader(oldData), bytes.NewReader(newData), region, WithEndRecord(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad[len(bad)-1] ^= 0xff
+	if err := ApplyRegionDiff(f, bad); !errors.Is(err, ErrCorruptPatch) && !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("corrupt patch: got %v, want ErrCorruptPatch or ErrTargetMismatch", err)
+	}
+	for _, n := range []int{0, 10, len(patch) / 2} {
+		if err := ApplyRegionDiff(f, patch[:n]); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("first %d bytes of the patch: got %v, want ErrCorruptPatch", n, err)
+		}
+	}
+	if !bytes.Equal(fileContent(t, f), oldData) {
+		t.Fatal("file modified by a corrupt patch")
+	}
+
+	unlock, err := lockRegion(mustStat(t, f), ByteRange{Offset: region.Offset + 10, Length: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyRegionDiff(f, patch); !errors.Is(err, ErrRegionLocked) {
+		t.Fatalf("overlapping region: got %v, want ErrRegionLocked", err)
+	}
+	unlock()
+	f.Close()
+
+	short := openRegionTarget(t, dir, oldData[:region.Offset+region.Length-1])
+	if err := ApplyRegionDiff(short, patch); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("file ending inside the region: got %v, want ErrInvalidArgument", err)
+	}
+	plain, err := CreateEnvelope(oldData[:100], newData[:100])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyRegionDiff(short, plain); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("envelope without a region: got %v, want ErrInvalidArgument", err)
+	}
+	for _, r := range []ByteRange{{Offset: -1, Length: 10}, {Offset: 0, Length: -1}, {Offset: int64(len(oldData)) - 10, Length: 11}} {
+		if _, err := CreateRegionDiff(bytes.NewReader(oldData), bytes.NewReader(newData), r); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("region %+v: got %v, want ErrInvalidArgument", r, err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 远程索引格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'R' 'I' 'X' 0D 0A
+//	version      1 字节  当前为 1
+//	block size   4 字节
+//	size         8 字节  新文件的长度
+//	hash        32 字节  新文件的 SHA-256
+//	块                   每块 20 字节：弱校验和 4 字节、强校验和 16 字节（块的 SHA-256 的前 16 字节），
+//	                     块数为 size 除以 block size 向上取整，最后一块可以不满
+//
+// 弱校验和与生成补丁时匹配旧数据用的相同（rsync 的滚动校验和），强校验和只用于确认匹配
+var remoteIndexMagic = []byte{0x89, 'X', 'D', 'R', 'I', 'X', 0x0D, 0x0A}
+
+const (
+	// RemoteIndexVersion CreateIndex 写入的索引格式版本
+	RemoteIndexVersion = 1
+	// 索引块大小的范围
+	MinIndexBlockSize = 256
+	MaxIndexBlockSize = 16 << 20
+
+	remoteIndexHeaderLen = 8 + 1 + 4 + 8 + sha256.Size
+	remoteBlockLen       = 4 + 16
+
+	// remoteMergeBlocks 相隔不超过这么多块的缺失区间合并为一个，少发区间比少下载几个块更划算
+	remoteMergeBlocks = 4
+	// remoteFetchBatch 每次调用 fetch 最多请求的区间数，HTTP 服务器通常限制一个请求的 Range 个数
+	remoteFetchBatch = 64
+)
+
+// ByteRange 文件中从 Offset 开始的 Length 字节
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// RemoteBlock 索引中一个块的校验和
+type RemoteBlock struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// RemoteIndex 新文件的块校验和索引，与新文件一起发布（WriteTo），客户端用 SyncFromRemote 只下载本地没有的块
+type RemoteIndex struct {
+	BlockSize int
+	// Size 新文件的长度
+	Size int64
+	// SHA256 新文件的 SHA-256，SyncFromRemote 的结果必须与之相同
+	SHA256 [sha256.Size]byte
+	Blocks []RemoteBlock
+}
+
+// CreateIndex 按 blockSize 字节一块计算 new 的索引，只读取一遍 new，内存占用与块数成正比（每块 20 字节）
+// blockSize 越小能复用的数据越多，索引也越大，通常取 4 KiB 到 64 KiB；
+// 不在 [MinIndexBlockSize, MaxIndexBlockSize] 内时返回 ErrInvalidArgument
+// 纯 Go 实现，不依赖原生库，SyncFromRemote 同样如此
+func CreateIndex(new io.Reader, blockSize int) (*RemoteIndex, error) {
+	if blockSize < MinIndexBlockSize || blockSize > MaxIndexBlockSize {
+		return nil, fmt.Errorf("%w: index block size %d is out of range [%d, %d]",
+			ErrInvalidArgument, blockSize, MinIndexBlockSize, MaxIndexBlockSize)
+	}
+	x := &RemoteIndex{BlockSize: blockSize}
+	sum := sha256.New()
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(new, buf)
+		if n > 0 {
+			x.Blocks = append(x.Blocks, remoteBlock(buf[:n]))
+			x.Size += int64(n)
+			sum.Write(buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sum.Sum(x.SHA256[:0])
+	return x, nil
+}
+
+func remoteBlock(data []byte) RemoteBlock {
+	b := RemoteBlock{Weak: newRollingSum(data).sum()}
+	sum := sha256.Sum256(data)
+	copy(b.Strong[:], sum[:])
+	return b
+}
+
+// WriteTo 把索引按上面的格式写入 w
+func (x *RemoteIndex) WriteTo(w io.Writer) (int64, error) {
+	if err := x.check(); err != nil {
+		return 0, err
+	}
+	b := make([]byte, 0, remoteIndexHeaderLen+len(x.Blocks)*remoteBlockLen)
+	b = append(append(b, remoteIndexMagic...), RemoteIndexVersion)
+	b = binary.LittleEndian.AppendUint32(b, uint32(x.BlockSize))
+	b = binary.LittleEndian.AppendUint64(b, uint64(x.Size))
+	b = append(b, x.SHA256[:]...)
+	for _, blk := range x.Blocks {
+		b = binary.LittleEndian.AppendUint32(b, blk.Weak)
+		b = append(b, blk.Strong[:]...)
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// LoadRemoteIndex 从 r 读取 WriteTo 写出的索引；截断或块数与长度不符时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func LoadRemoteIndex(r io.Reader) (*RemoteIndex, error) {
+	hdr := make([]byte, remoteIndexHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: remote index is truncated", ErrCorruptPatch)
+		}
+		return nil, err
+	}
+	if !bytes.HasPrefix(hdr, remoteIndexMagic) {
+		return nil, fmt.Errorf("%w: not a remote index", ErrCorruptPatch)
+	}
+	if v := hdr[8]; v != RemoteIndexVersion {
+		return nil, fmt.Errorf("%w: remote index version %d", ErrUnsupportedPatch, v)
+	}
+	x := &RemoteIndex{
+		BlockSize: int(binary.LittleEndian.Uint32(hdr[9:])),
+		Size:      int64(binary.LittleEndian.Uint64(hdr[13:])),
+	}
+	copy(x.SHA256[:], hdr[21:])
+	if x.BlockSize < MinIndexBlockSize || x.BlockSize > MaxIndexBlockSize || x.Size < 0 {
+		return nil, fmt.Errorf("%w: remote index declares block size %d and size %d", ErrCorruptPatch, x.BlockSize, x.Size)
+	}
+	// 块数由头部算出，按实际读到的数据增长，不会因为损坏的长度一次分配巨大的内存
+	count := (x.Size + int64(x.BlockSize) - 1) / int64(x.BlockSize)
+	buf := make([]byte, remoteBlockLen)
+	for i := int64(0); i < count; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("%w: remote index is truncated at block %d of %d", ErrCorruptPatch, i, count)
+			}
+			return nil, err
+		}
+		var blk RemoteBlock
+		blk.Weak = binary.LittleEndian.Uint32(buf)
+		copy(blk.Strong[:], buf[4:])
+		x.Blocks = append(x.Blocks, blk)
+	}
+	return x, nil
+}
+
+// check 检查块大小和块数是否与长度一致
+func (x *RemoteIndex) check() error {
+	if x == nil {
+		return fmt.Errorf("%w: nil remote index", ErrInvalidArgument)
+	}
+	if x.BlockSize < MinIndexBlockSize || x.BlockSize > MaxIndexBlockSize || x.Size < 0 {
+		return fmt.Errorf("%w: remote index has block size %d and size %d", ErrInvalidArgument, x.BlockSize, x.Size)
+	}
+	if want := (x.Size + int64(x.BlockSize) - 1) / int64(x.BlockSize); int64(len(x.Blocks)) != want {
+		return fmt.Errorf("%w: remote index has %d blocks, %d bytes need %d", ErrInvalidArgument, len(x.Blocks), x.Size, want)
+	}
+	return nil
+}
+
+// blockLen 返回第 i 块的长度
+func (x *RemoteIndex) blockLen(i int) int {
+	return int(min(int64(x.BlockSize), x.Size-int64(i)*int64(x.BlockSize)))
+}
+
+// SyncFromRemote 用本地的旧数据 old 和新文件的索引重建新文件写入 out：先用滚动校验和在 old 中查找新文件的块
+// （强校验和确认），再通过 fetch 下载其余部分；fetch 收到按偏移排序、互不重叠的区间，
+// 返回依次包含这些区间内容的流（例如多区间的 HTTP Range 请求的各部分拼接起来），每次最多 64 个区间，
+// 相隔不超过 4 块的缺失区间合并为一个；新文件的最后一块不满时总是下载
+// 下载的块与索引中的强校验和不符、结果的 SHA-256 与索引不符时返回 ErrTargetMismatch，
+// fetch 返回的数据不够时返回 io.ErrUnexpectedEOF；out 中已写入的数据只在返回 nil 时有效
+// old 从偏移 0 读到 ReadAt 返回 io.EOF 为止
+func SyncFromRemote(old io.ReaderAt, index *RemoteIndex, fetch func(ranges []ByteRange) (io.ReadCloser, error), out io.Writer) error {
+	if err := index.check(); err != nil {
+		return err
+	}
+	if old == nil || fetch == nil {
+		return fmt.Errorf("%w: nil old data or fetch function", ErrInvalidArgument)
+	}
+	have, err := matchBlocks(old, index)
+	if err != nil {
+		return err
+	}
+	ranges := missingRanges(index, have)
+	sum := sha256.New()
+	w := io.MultiWriter(out, sum)
+	var (
+		stream io.ReadCloser
+		batch  []ByteRange
+		next   int
+	)
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+	buf := make([]byte, index.BlockSize)
+	for i := 0; i < len(index.Blocks); i++ {
+		off, n := int64(i)*int64(index.BlockSize), index.blockLen(i)
+		block := buf[:n]
+		for next < len(ranges) && ranges[next].Offset+ranges[next].Length <= off {
+			next++
+		}
+		if next < len(ranges) && ranges[next].Offset <= off {
+			// 在缺失区间内，从 fetch 的流中读取；流读完一批后请求下一批
+			if len(batch) == 0 || batch[len(batch)-1].Offset+batch[len(batch)-1].Length <= off {
+				if stream != nil {
+					stream.Close()
+				}
+				batch = ranges[next:min(next+remoteFetchBatch, len(ranges))]
+				if stream, err = fetch(batch); err != nil {
+					stream = nil
+					return fmt.Errorf("fetch %d ranges: %w", len(batch), err)
+				}
+			}
+			if _, err := io.ReadFull(stream, block); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				return fmt.Errorf("fetch block %d: %w", i, err)
+			}
+			if remoteBlock(block).Strong != index.Blocks[i].Strong {
+				return fmt.Errorf("%w: fetched block %d differs from the index", ErrTargetMismatch, i)
+			}
+		} else if m, err := old.ReadAt(block, have[i]); m < n {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%w: old data shrank while syncing", ErrSourceMismatch)
+			}
+			return err
+		}
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+	}
+	if [sha256.Size]byte(sum.Sum(nil)) != index.SHA256 {
+		return fmt.Errorf("%w: result SHA-256 differs from the remote index", ErrTargetMismatch)
+	}
+	return nil
+}
+
+// matchBlocks 在 old 中查找索引中的满块，返回每块在 old 中的偏移，没有找到的为 -1
+func matchBlocks(old io.ReaderAt, index *RemoteIndex) ([]int64, error) {
+	bs := index.BlockSize
+	have := make([]int64, len(index.Blocks))
+	weak := make(map[uint32][]int32)
+	for i := range index.Blocks {
+		have[i] = -1
+		if index.blockLen(i) == bs {
+			weak[index.Blocks[i].Weak] = append(weak[index.Blocks[i].Weak], int32(i))
+		}
+	}
+	missing := len(weak)
+	if missing == 0 {
+		return have, nil
+	}
+
+	// buf 中是 old 从 base 开始的数据，pos 为当前窗口在 buf 中的起点
+	buf := make([]byte, 0, max(2*bs, 1<<20))
+	var base int64
+	pos, eof := 0, false
+	var roll rollingSum
+	valid := false
+	fill := func() error {
+		// 滚动时需要窗口前的一个字节
+		keep := pos
+		if valid && keep > 0 {
+			keep--
+		}
+		copy(buf[:cap(buf)], buf[keep:])
+		buf, base, pos = buf[:len(buf)-keep], base+int64(keep), pos-keep
+		n, err := old.ReadAt(buf[len(buf):cap(buf)], base+int64(len(buf)))
+		buf = buf[:len(buf)+n]
+		if errors.Is(err, io.EOF) {
+			eof = true
+			return nil
+		}
+		return err
+	}
+	for missing > 0 {
+		if pos+bs > len(buf) {
+			if eof {
+				break
+			}
+			if err := fill(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if valid {
+			roll.roll(buf[pos-1], buf[pos+bs-1], bs)
+		} else {
+			roll, valid = newRollingSum(buf[pos:pos+bs]), true
+		}
+		cands := weak[roll.sum()]
+		if len(cands) == 0 {
+			pos++
+			continue
+		}
+		strong := remoteBlock(buf[pos : pos+bs]).Strong
+		matched := false
+		for _, c := range cands {
+			if have[c] < 0 && index.Blocks[c].Strong == strong {
+				have[c] = base + int64(pos)
+				missing--
+				matched = true
+			}
+		}
+		if !matched {
+			pos++
+			continue
+		}
+		// 匹配后跳过整块，之后的窗口重新计算校验和
+		pos += bs
+		valid = false
+	}
+	return have, nil
+}
+
+// missingRanges 返回 have 中没有找到的块所在的区间，相隔不超过 remoteMergeBlocks 块的合并
+func missingRanges(index *RemoteIndex, have []int64) []ByteRange {
+	var ranges []ByteRange
+	for i, off := range have {
+		if off >= 0 {
+			continue
+		}
+		start, n := int64(i)*int64(index.BlockSize), int64(index.blockLen(i))
+		if k := len(ranges) - 1; k >= 0 && start-(ranges[k].Offset+ranges[k].Length) <= remoteMergeBlocks*int64(index.BlockSize) {
+			ranges[k].Length = start + n - ranges[k].Offset
+			continue
+		}
+		ranges = append(ranges, ByteRange{Offset: start, Length: n})
+	}
+	return ranges
+}
+
+// rollingSum rsync 的滚动校验和，与原生库匹配旧数据时使用的相同
+type rollingSum struct{ a, b uint32 }
+
+func newRollingSum(data []byte) rollingSum {
+	var r rollingSum
+	n := uint32(len(data))
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += (n - uint32(i)) * uint32(c)
+	}
+	return r
+}
+
+// roll 窗口右移一个字节：移出 out，移入 in，n 为窗口长度
+func (r *rollingSum) roll(out, in byte, n int) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - uint32(n)*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xFFFF | r.b<<16
+}
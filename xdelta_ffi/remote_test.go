@@ -0,0 +1,253 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// remoteServer 提供 data 的测试服务器，ignoreRange 为 true 时忽略 Range 头，总是返回 200 和完整内容；
+// served 为响应体的总字节数
+type remoteServer struct {
+	*httptest.Server
+	served atomic.Int64
+}
+
+func newRemoteServer(t *testing.T, data []byte, ignoreRange bool) *remoteServer {
+	t.Helper()
+	s := &remoteServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(servedCounter{w, &s.served}, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+type servedCounter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w servedCounter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+// httpFetch SyncFromRemote 的 fetch：用一个多区间的 Range 请求下载 ranges，依次拼接各部分的内容；
+// handleFull 为 true 时服务器忽略 Range、返回 200 和完整内容也能处理，从中取出各个区间
+func httpFetch(url string, handleFull bool) func(ranges []ByteRange) (io.ReadCloser, error) {
+	return func(ranges []ByteRange) (io.ReadCloser, error) {
+		specs := make([]string, len(ranges))
+		for i, r := range ranges {
+			specs[i] = fmt.Sprintf("%d-%d", r.Offset, r.Offset+r.Length-1)
+		}
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var out bytes.Buffer
+		switch mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); {
+		case resp.StatusCode == http.StatusOK && handleFull:
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range ranges {
+				out.Write(body[min(r.Offset, int64(len(body))):min(r.Offset+r.Length, int64(len(body)))])
+			}
+		case resp.StatusCode == http.StatusPartialContent && mediaType == "multipart/byteranges":
+			mr := multipart.NewReader(resp.Body, params["boundary"])
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				if _, err := io.Copy(&out, part); err != nil {
+					return nil, err
+				}
+			}
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+			// 一个区间的 206，或者不处理忽略 Range 的服务器时原样交出完整内容
+			if _, err := io.Copy(&out, resp.Body); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return io.NopCloser(&out), nil
+	}
+}
+
+// remotePair 远程同步测试用的新旧数据：新数据在开头之后的几处有改动，第一块不变，最后一块不满
+func remotePair() (oldData, newData []byte) {
+	oldData, _ = textFixture(1 << 20)
+	newData = bytes.Clone(oldData[:300000])
+	newData = append(newData, "a change in the middle of the file\n"...)
+	newData = append(newData, oldData[300000:700000]...)
+	newData = append(newData, oldData[710000:]...)
+	newData = append(newData, "appended at the end\n"...)
+	return oldData, newData
+}
+
+// TestRemoteIndexRoundTrip WriteTo 写出的索引用 LoadRemoteIndex 读回相同的内容；截断、块数与长度不符的索引
+// 返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch；块大小超出范围时 CreateIndex 返回 ErrInvalidArgument
+func TestRemoteIndexRoundTrip(t *testing.T) {
+	_, newData := remotePair()
+	x, err := CreateIndex(bytes.NewReader(newData), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Size != int64(len(newData)) || len(x.Blocks) != (len(newData)+4095)/4096 {
+		t.Fatalf("index of %d bytes with %d blocks", x.Size, len(x.Blocks))
+	}
+	var b bytes.Buffer
+	if _, err := x.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	if len(data) != remoteIndexHeaderLen+len(x.Blocks)*remoteBlockLen {
+		t.Fatalf("index of %d bytes", len(data))
+	}
+	got, err := LoadRemoteIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BlockSize != x.BlockSize || got.Size != x.Size || got.SHA256 != x.SHA256 || len(got.Blocks) != len(x.Blocks) {
+		t.Fatalf("loaded %d bytes in blocks of %d, want %d in blocks of %d", got.Size, got.BlockSize, x.Size, x.BlockSize)
+	}
+	for i := range x.Blocks {
+		if got.Blocks[i] != x.Blocks[i] {
+			t.Fatalf("block %d differs", i)
+		}
+	}
+
+	for _, n := range []int{0, 8, remoteIndexHeaderLen - 1, remoteIndexHeaderLen, len(data) - remoteBlockLen, len(data) - 1} {
+		if _, err := LoadRemoteIndex(bytes.NewReader(data[:n])); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("first %d of %d bytes: got %v, want ErrCorruptPatch", n, len(data), err)
+		}
+	}
+	bad := bytes.Clone(data)
+	bad[8] = RemoteIndexVersion + 1
+	if _, err := LoadRemoteIndex(bytes.NewReader(bad)); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Fatalf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+	bad = bytes.Clone(data)
+	bad[9], bad[10], bad[11], bad[12] = 0, 0, 0, 0
+	if _, err := LoadRemoteIndex(bytes.NewReader(bad)); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("block size 0: got %v, want ErrCorruptPatch", err)
+	}
+	for _, bs := range []int{0, MinIndexBlockSize - 1, MaxIndexBlockSize + 1} {
+		if _, err := CreateIndex(bytes.NewReader(newData), bs); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("block size %d: got %v, want ErrInvalidArgument", bs, err)
+		}
+	}
+	x.Blocks = x.Blocks[1:]
+	if _, err := x.WriteTo(io.Discard); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("WriteTo with a block missing: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestSyncFromRemoteHTTP 经由支持多区间 Range 请求的 HTTP 服务器同步：结果与新数据相同，只下载了改动附近的块；
+// 本地没有旧数据时下载全部内容
+func TestSyncFromRemoteHTTP(t *testing.T) {
+	oldData, newData := remotePair()
+	srv := newRemoteServer(t, newData, false)
+	x, err := CreateIndex(bytes.NewReader(newData), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := SyncFromRemote(bytes.NewReader(oldData), x, httpFetch(srv.URL, false), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), newData) {
+		t.Fatalf("synced %d bytes, want %d", out.Len(), len(newData))
+	}
+	// 两处改动和不满的最后一块，每处最多几块，加上 multipart 的分隔
+	if n := srv.served.Load(); n == 0 || n > 16*4096 {
+		t.Fatalf("downloaded %d bytes of %d", n, len(newData))
+	}
+
+	out.Reset()
+	if err := SyncFromRemote(bytes.NewReader(nil), x, httpFetch(srv.URL, false), &out); err != nil || !bytes.Equal(out.Bytes(), newData) {
+		t.Fatalf("sync without old data: %d bytes, %v", out.Len(), err)
+	}
+}
+
+// TestSyncFromRemoteIgnoresRange 服务器忽略 Range 返回完整内容时，把它原样交出的 fetch 得到错误的块，
+// SyncFromRemote 返回 ErrTargetMismatch 而不是错误的结果；从完整内容中取出各区间的 fetch 照常同步成功
+func TestSyncFromRemoteIgnoresRange(t *testing.T) {
+	oldData, newData := remotePair()
+	srv := newRemoteServer(t, newData, true)
+	x, err := CreateIndex(bytes.NewReader(newData), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncFromRemote(bytes.NewReader(oldData), x, httpFetch(srv.URL, false), io.Discard); !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("naive fetch: got %v, want ErrTargetMismatch", err)
+	}
+	var out bytes.Buffer
+	if err := SyncFromRemote(bytes.NewReader(oldData), x, httpFetch(srv.URL, true), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), newData) {
+		t.Fatalf("synced %d bytes, want %d", out.Len(), len(newData))
+	}
+}
+
+// TestSyncFromRemoteErrors fetch 返回的数据不够时返回 io.ErrUnexpectedEOF，索引与下载的内容不一致时返回 ErrTargetMismatch，
+// fetch 的错误原样返回；参数为 nil 时返回 ErrInvalidArgument
+func TestSyncFromRemoteErrors(t *testing.T) {
+	oldData, newData := remotePair()
+	x, err := CreateIndex(bytes.NewReader(newData), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := func(ranges []ByteRange) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(newData[ranges[0].Offset : ranges[0].Offset+1])), nil
+	}
+	if err := SyncFromRemote(bytes.NewReader(oldData), x, short, io.Discard); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("short fetch: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	// 索引来自另一份数据：下载的块与强校验和不符
+	other, err := CreateIndex(bytes.NewReader(append(bytes.Clone(newData[:len(newData)-1]), '#')), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newRemoteServer(t, newData, false)
+	if err := SyncFromRemote(bytes.NewReader(oldData), other, httpFetch(srv.URL, false), io.Discard); !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("index of other data: got %v, want ErrTargetMismatch", err)
+	}
+	failed := errors.New("network down")
+	fail := func([]ByteRange) (io.ReadCloser, error) { return nil, failed }
+	if err := SyncFromRemote(bytes.NewReader(oldData), x, fail, io.Discard); !errors.Is(err, failed) {
+		t.Fatalf("failing fetch: got %v, want its error", err)
+	}
+	if err := SyncFromRemote(nil, x, fail, io.Discard); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil old: got %v, want ErrInvalidArgument", err)
+	}
+	if err := SyncFromRemote(bytes.NewReader(oldData), nil, fail, io.Discard); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil index: got %v, want ErrInvalidArgument", err)
+	}
+}
@@ -0,0 +1,111 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WithAtomicReplace 设置 ApplyDiffsFile、ApplyChainFile 替换 outPath 的方式
+// 这两个接口总是先解码到 outPath 同目录下的临时文件，成功后再重命名覆盖 outPath，失败时删除临时文件、outPath 保持不变；
+// fsync 为 true 时还在重命名前把临时文件写入磁盘、重命名后同步所在的目录，掉电或崩溃后 outPath 要么是原来的内容，
+// 要么是完整的新内容；为 false 时（默认）不做同步，掉电后已经重命名的文件内容可能不完整
+// 同步目录失败时 outPath 已经被替换，但仍然返回错误，表示替换可能没有持久化
+// Windows 上 outPath 可能被杀毒软件等短暂打开，重命名遇到拒绝访问或共享冲突时会重试一段时间；
+// fsync 为 true 时以 MOVEFILE_WRITE_THROUGH 重命名，代替同步目录
+func WithAtomicReplace(fsync bool) Option {
+	return func(o *options) {
+		o.fsync = fsync
+	}
+}
+
+// WithTargetSHA256 让 ApplyDiffsFile、ApplyDiffsFileStats、ResumeApply、ApplyDiffsFileAtomic 和 ApplyChainFile 在替换 outPath 之前
+// 检查结果的 SHA-256 是否为 sum（例如发布时与补丁一起下发的版本摘要），不一致时返回 ErrTargetMismatch，outPath 保持不变；
+// 用于补丁不是信封（WithVerifyOutput 校验的是信封中记录的摘要）的情况。需要额外读一遍结果，带检查点的应用除外，
+// 它在解码的同时计算；带检查点时不一致的完整结果无法继续，".partial" 文件和检查点随之删除
+func WithTargetSHA256(sum [sha256.Size]byte) Option {
+	return func(o *options) {
+		o.targetSHA256 = &sum
+	}
+}
+
+// ApplyDiffsFileAtomic 用于安装、升级等不能留下半个文件的场合：与 ApplyDiffsFile 相同，但总是按 WithAtomicReplace(true)
+// 写入磁盘后再替换，掉电或崩溃后 outPath 要么是原来的内容，要么是完整的新内容；
+// opts 中有 WithCheckpoint 时按 ResumeApply 的方式执行，进程被中断后用同样的参数再次调用即从检查点继续，
+// 没有可用的检查点时从头开始；配合 WithTargetSHA256（或信封与 WithVerifyOutput）在替换之前校验结果
+func ApplyDiffsFileAtomic(oldPath, patchPath, outPath string, opts ...Option) (FileStats, error) {
+	// 放在最后，opts 中的 WithAtomicReplace(false) 不能关闭同步
+	opts = append(opts[:len(opts):len(opts)], WithAtomicReplace(true))
+	o, err := newOptions(opts)
+	if err != nil {
+		return FileStats{}, err
+	}
+	if o.checkpoint != nil {
+		return ResumeApply(oldPath, patchPath, outPath, opts...)
+	}
+	return ApplyDiffsFileStats(oldPath, patchPath, outPath, opts...)
+}
+
+// checkTarget 设置了 WithTargetSHA256 时检查文件 p 的 SHA-256
+func (o options) checkTarget(p string) error {
+	if o.targetSHA256 == nil {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return o.checkTargetSum(h.Sum(nil))
+}
+
+// checkTargetSum 设置了 WithTargetSHA256 时检查结果的 SHA-256 sum
+func (o options) checkTargetSum(sum []byte) error {
+	if o.targetSHA256 == nil || bytes.Equal(sum, o.targetSHA256[:]) {
+		return nil
+	}
+	return fmt.Errorf("%w: output SHA-256 is %x, expected %x", ErrTargetMismatch, sum, o.targetSHA256[:])
+}
+
+// replaceFile 用 tmp 替换 dst 并保持 dst 原有的权限，fsync 的含义见 WithAtomicReplace；
+// 替换失败时删除 tmp，dst 不变
+func replaceFile(tmp, dst string, fsync bool) error {
+	if fi, err := os.Stat(dst); err == nil {
+		_ = os.Chmod(tmp, fi.Mode().Perm())
+	}
+	var err error
+	if fsync {
+		err = syncFile(tmp)
+	}
+	if err == nil {
+		err = renameReplace(tmp, dst, fsync)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if fsync {
+		return syncDir(filepath.Dir(dst))
+	}
+	return nil
+}
+
+// syncFile 把已经关闭的文件 p 写入磁盘；是变量以便测试观察 WithAtomicReplace 的同步
+var syncFile = func(p string) error {
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package xdelta_ffi
+
+import "os"
+
+// renameReplace 把 from 重命名为 to，to 已经存在时原子地覆盖
+func renameReplace(from, to string, writeThrough bool) error {
+	return os.Rename(from, to)
+}
+
+// syncDir 同步目录 dir，使其中的重命名持久化
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
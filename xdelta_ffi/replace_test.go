@@ -0,0 +1,156 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// dirNames dir 中的文件名，按名字排序（os.ReadDir 已经排好）
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// TestApplyDiffsFileAtomicTargetMismatch 结果的 SHA-256 与 WithTargetSHA256 不一致时返回 ErrTargetMismatch：
+// 已有的 outPath 内容和修改时间都不变，临时文件被删除，目录中与调用之前完全相同；带检查点时 ".partial" 文件和检查点也被删除。
+// 一致时 outPath 被替换为结果
+func TestApplyDiffsFileAtomicTargetMismatch(t *testing.T) {
+	requireNative(t)
+	previous := []byte("the installed version\n")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, name := range []string{"plain", "checkpoint"} {
+		var opts []Option
+		store := &memCheckpointStore{}
+		if name == "checkpoint" {
+			opts = []Option{WithCheckpoint(store, 1)}
+		}
+		// 输出有多段，带检查点时在失败之前已经保存过检查点
+		dir := t.TempDir()
+		oldPath, patchPath, outPath, newData := checkpointFixture(t, dir)
+		if err := os.WriteFile(outPath, previous, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(outPath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		before := dirNames(t, dir)
+		wrong := sha256.Sum256(append(bytes.Clone(newData), '!'))
+		right := sha256.Sum256(newData)
+
+		_, err := ApplyDiffsFileAtomic(oldPath, patchPath, outPath, append(opts, WithTargetSHA256(wrong))...)
+		if !errors.Is(err, ErrTargetMismatch) {
+			t.Fatalf("%s: got %v, want ErrTargetMismatch", name, err)
+		}
+		if got, err := os.ReadFile(outPath); err != nil || !bytes.Equal(got, previous) {
+			t.Fatalf("%s: outPath changed after a mismatch: %q, %v", name, got, err)
+		}
+		if fi, err := os.Stat(outPath); err != nil || !fi.ModTime().Equal(mtime) {
+			t.Fatalf("%s: outPath touched after a mismatch: %v", name, err)
+		}
+		if after := dirNames(t, dir); !slices.Equal(after, before) {
+			t.Fatalf("%s: directory holds %v after a mismatch, want %v", name, after, before)
+		}
+		if name == "checkpoint" && len(store.saves) == 0 {
+			t.Fatalf("%s: no checkpoint was saved", name)
+		}
+		if store.cp != nil {
+			t.Fatalf("%s: checkpoint left after a mismatch: %+v", name, store.cp)
+		}
+
+		stats, err := ApplyDiffsFileAtomic(oldPath, patchPath, outPath, append(opts, WithTargetSHA256(right))...)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := os.ReadFile(outPath); err != nil || !bytes.Equal(got, newData) || stats.NewSize != int64(len(newData)) {
+			t.Fatalf("%s: %d bytes, %v, stats %+v", name, len(got), err, stats)
+		}
+		if after := dirNames(t, dir); !slices.Equal(after, before) {
+			t.Fatalf("%s: directory holds %v, want %v", name, after, before)
+		}
+	}
+}
+
+// TestWithAtomicReplace WithAtomicReplace(true) 在重命名之前把 outPath 同目录下、已经是完整结果的临时文件写入磁盘，
+// 此时 outPath 还是原来的内容；默认和 WithAtomicReplace(false) 不同步，ApplyDiffsFileAtomic 总是同步。
+// 同步失败时返回这个错误，outPath 不变，临时文件被删除
+func TestWithAtomicReplace(t *testing.T) {
+	requireNative(t)
+	previous := []byte("the installed version\n")
+	failed := errors.New("sync failed")
+	saved := syncFile
+	t.Cleanup(func() { syncFile = saved })
+
+	for _, c := range []struct {
+		name  string
+		apply func(oldPath, patchPath, outPath string) error
+		syncs int
+		fail  bool
+	}{
+		{"default", func(o, p, out string) error { return ApplyDiffsFile(o, p, out) }, 0, false},
+		{"false", func(o, p, out string) error { return ApplyDiffsFile(o, p, out, WithAtomicReplace(false)) }, 0, false},
+		{"true", func(o, p, out string) error { return ApplyDiffsFile(o, p, out, WithAtomicReplace(true)) }, 1, false},
+		{"atomic", func(o, p, out string) error {
+			_, err := ApplyDiffsFileAtomic(o, p, out, WithAtomicReplace(false))
+			return err
+		}, 1, false},
+		{"sync fails", func(o, p, out string) error { return ApplyDiffsFile(o, p, out, WithAtomicReplace(true)) }, 1, true},
+	} {
+		dir := t.TempDir()
+		oldPath, patchPath, outPath, newData := checkpointFixture(t, dir)
+		if err := os.WriteFile(outPath, previous, 0644); err != nil {
+			t.Fatal(err)
+		}
+		before := dirNames(t, dir)
+		var synced []string
+		syncFile = func(p string) error {
+			synced = append(synced, p)
+			if filepath.Dir(p) != dir || p == outPath {
+				t.Errorf("%s: synced %s, want a temporary file next to outPath", c.name, p)
+			}
+			if got, err := os.ReadFile(p); err != nil || !bytes.Equal(got, newData) {
+				t.Errorf("%s: synced file holds %d bytes, %v", c.name, len(got), err)
+			}
+			if got, _ := os.ReadFile(outPath); !bytes.Equal(got, previous) {
+				t.Errorf("%s: outPath replaced before the sync", c.name)
+			}
+			if c.fail {
+				return failed
+			}
+			return saved(p)
+		}
+		err := c.apply(oldPath, patchPath, outPath)
+		if len(synced) != c.syncs {
+			t.Fatalf("%s: %d files synced, want %d", c.name, len(synced), c.syncs)
+		}
+		want := newData
+		if c.fail {
+			if !errors.Is(err, failed) {
+				t.Fatalf("%s: got %v, want the sync error", c.name, err)
+			}
+			want = previous
+		} else if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got, err := os.ReadFile(outPath); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: outPath holds %d bytes, %v, want %d", c.name, len(got), err, len(want))
+		}
+		if after := dirNames(t, dir); !slices.Equal(after, before) {
+			t.Fatalf("%s: directory holds %v, want %v", c.name, after, before)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package xdelta_ffi
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	movefileReplaceExisting = 0x1
+	movefileWriteThrough    = 0x8
+
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+
+	// renameAttempts、renameBackoff 目标被短暂占用时的重试次数和首次等待时间（之后每次加倍，共约 2.5 秒）
+	renameAttempts = 8
+	renameBackoff  = 10 * time.Millisecond
+)
+
+var procMoveFileExW = syscall.NewLazyDLL("kernel32.dll").NewProc("MoveFileExW")
+
+// renameReplace 用 MoveFileEx 把 from 重命名为 to 并覆盖已有的 to；
+// to 被其他进程（例如杀毒软件扫描）短暂打开时 MoveFileEx 返回拒绝访问或共享冲突，等待后重试
+func renameReplace(from, to string, writeThrough bool) error {
+	pfrom, err := syscall.UTF16PtrFromString(from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	pto, err := syscall.UTF16PtrFromString(to)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	flags := uintptr(movefileReplaceExisting)
+	if writeThrough {
+		flags |= movefileWriteThrough
+	}
+	wait := renameBackoff
+	for i := 0; ; i++ {
+		r, _, e := procMoveFileExW.Call(uintptr(unsafe.Pointer(pfrom)), uintptr(unsafe.Pointer(pto)), flags)
+		if r != 0 {
+			return nil
+		}
+		if i+1 == renameAttempts || !transientRenameError(e) {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: e}
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func transientRenameError(err error) bool {
+	return errors.Is(err, syscall.ERROR_ACCESS_DENIED) || errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
+
+// syncDir Windows 上不能同步目录，重命名的持久化由 MOVEFILE_WRITE_THROUGH 保证
+func syncDir(dir string) error {
+	return nil
+}
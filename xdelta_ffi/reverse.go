@@ -0,0 +1,107 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// WithReverse 让 CreateDiffs（包括 CreateDiffsBatch 的内存任务）和 CreateEnvelope 同时生成从新数据回到旧数据的反向补丁，写入 *reverse，用于回滚；
+// 反向补丁使用相同的格式、二次压缩和块大小，CreateEnvelope 生成的反向补丁也是信封（旧数据与新数据互换）
+// 两个补丁都成功时才写入 *reverse；对其他接口没有影响，reverse 为 nil 时忽略
+func WithReverse(reverse *[]byte) Option {
+	return func(o *options) {
+		o.reverse = reverse
+	}
+}
+
+// ReversePatch 为已有的正向补丁生成反向补丁：应用到 newData 得到 oldData，用于回滚
+// 先确认 forwardPatch 应用到 oldData 得到的正是 newData，否则返回 ErrTargetMismatch（旧数据本身不匹配时为 ApplyDiffsData 的错误）；
+// 反向补丁沿用正向补丁的格式和二次压缩，信封生成信封，bsdiff 补丁生成 bsdiff 补丁
+// 块大小取信封记录的值，没有记录时使用 DefaultBlockSize；创建补丁时手头已有两份数据的，用 WithReverse 更直接
+func ReversePatch(oldData, newData, forwardPatch []byte) ([]byte, error) {
+	patch := forwardPatch
+	var h EnvelopeHeader
+	enveloped := IsEnvelope(forwardPatch)
+	if enveloped {
+		var err error
+		if h, patch, err = ParseEnvelope(forwardPatch); err != nil {
+			return nil, err
+		}
+		if err := h.checkSource(oldData); err != nil {
+			return nil, err
+		}
+		if err := h.checkTarget(int64(len(newData)), sha256.Sum256(newData)); err != nil {
+			return nil, err
+		}
+	}
+	n, sum, err := verifyOutput(oldData, patch, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != int64(len(newData)) || sum != sha256.Sum256(newData) {
+		return nil, fmt.Errorf("%w: forward patch does not produce the given new data", ErrTargetMismatch)
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
+	e := defaultEncoding
+	if isBSDiff(patch) {
+		e.format = formatBSDiff
+	} else {
+		release, err := useLibrary()
+		if err != nil {
+			return nil, err
+		}
+		c, err := inspectPatchData(patch)
+		release()
+		if err != nil {
+			return nil, err
+		}
+		if c.format == formatVCDIFF {
+			e.format = formatVCDIFF
+		} else {
+			e.secondary = SecondaryCompression(c.secondary)
+		}
+	}
+	blockSize := DefaultBlockSize
+	if enveloped && h.BlockSize != 0 {
+		blockSize = h.BlockSize
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if !enveloped {
+		return createPatchData(appendTo(nil), newData, oldData, blockSize, e, nil)
+	}
+	return createPatchData(appendTo(h.reversed(blockSize).appendTo(nil)), newData, oldData, blockSize, e, nil)
+}
+
+// createReverse 按 WithReverse 的要求生成反向补丁，hdr 不为 nil 时加上互换后的信封头
+func (o options) createReverse(oldData, newData []byte, blockSize uint32, hdr *EnvelopeHeader, cancel *nativeCancel) error {
+	dst := appendTo(nil)
+	if hdr != nil {
+		dst = appendTo(hdr.reversed(blockSize).appendTo(nil))
+	}
+	reverse, err := createPatchData(dst, newData, oldData, blockSize, o.encoding(), cancel)
+	if err != nil {
+		return err
+	}
+	*o.reverse = reverse
+	return nil
+}
+
+// reversed 返回旧数据与新数据互换、块大小为 blockSize 的信封头，元数据保持不变
+func (h EnvelopeHeader) reversed(blockSize uint32) EnvelopeHeader {
+	return EnvelopeHeader{
+		Version:      h.Version,
+		BlockSize:    blockSize,
+		SourceSize:   h.TargetSize,
+		SourceSHA256: h.TargetSHA256,
+		TargetSize:   h.SourceSize,
+		TargetSHA256: h.SourceSHA256,
+		Metadata:     h.Metadata,
+	}
+}
@@ -0,0 +1,168 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// reversePairs WithReverse 和 ReversePatch 测试的新旧数据，包括旧数据或新数据为空、两者都为空和相同的情况
+func reversePairs() []struct {
+	name             string
+	oldData, newData []byte
+} {
+	oldData, newData := textFixture(64 << 10)
+	return []struct {
+		name             string
+		oldData, newData []byte
+	}{
+		{"text", oldData, newData},
+		{"empty old", nil, newData},
+		{"empty new", oldData, nil},
+		{"both empty", nil, nil},
+		{"identical", oldData, oldData},
+	}
+}
+
+// reverseFormats 反向补丁必须沿用的各种正向补丁格式
+var reverseFormats = []struct {
+	name string
+	opts []Option
+}{
+	{"native", nil},
+	{"zstd", []Option{WithSecondaryCompression(SecondaryZstd)}},
+	{"vcdiff", []Option{WithStandardVCDIFF()}},
+	{"bsdiff", []Option{WithBSDiff()}},
+}
+
+// checkReverse 正向补丁把 oldData 变成 newData，反向补丁把 newData 变回 oldData，两者的格式和二次压缩相同
+func checkReverse(t *testing.T, oldData, newData, forward, reverse []byte) {
+	t.Helper()
+	if got, err := ApplyDiffsData(oldData, forward); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("forward patch: %d bytes, %v", len(got), err)
+	}
+	if got, err := ApplyDiffsData(newData, reverse); err != nil || !bytes.Equal(got, oldData) {
+		t.Fatalf("reverse patch: %d bytes, want %d, %v", len(got), len(oldData), err)
+	}
+	fi, err := InspectPatch(forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ri, err := InspectPatch(reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Format != ri.Format || fi.Secondary != ri.Secondary {
+		t.Fatalf("reverse patch is %s/%s, forward %s/%s", ri.Format, ri.Secondary, fi.Format, fi.Secondary)
+	}
+}
+
+// TestWithReverse CreateDiffs 一次生成正向和反向补丁，对每种格式和空数据都能互相还原；
+// 创建失败时不写入 *reverse
+func TestWithReverse(t *testing.T) {
+	requireNative(t)
+	for _, f := range reverseFormats {
+		for _, p := range reversePairs() {
+			var reverse []byte
+			forward, err := CreateDiffs(p.oldData, p.newData, append(f.opts, WithReverse(&reverse))...)
+			if err != nil {
+				t.Fatalf("%s, %s: %v", f.name, p.name, err)
+			}
+			if reverse == nil {
+				t.Fatalf("%s, %s: WithReverse did not write the reverse patch", f.name, p.name)
+			}
+			t.Run(f.name+"/"+p.name, func(t *testing.T) {
+				checkReverse(t, p.oldData, p.newData, forward, reverse)
+			})
+		}
+	}
+
+	sentinel := []byte("unchanged")
+	reverse := sentinel
+	oldData, newData := testPair()
+	if _, err := CreateDiffs(oldData, newData, WithBSDiff(), WithStandardVCDIFF(), WithReverse(&reverse)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("invalid options: got %v, want ErrInvalidArgument", err)
+	}
+	if !bytes.Equal(reverse, sentinel) {
+		t.Fatal("WithReverse wrote *reverse although CreateDiffs failed")
+	}
+	// reverse 为 nil 时忽略
+	if _, err := CreateDiffs(oldData, newData, WithReverse(nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWithReverseEnvelope CreateEnvelope 的反向补丁也是信封，旧数据与新数据互换，ApplyEnvelope 能校验并应用
+func TestWithReverseEnvelope(t *testing.T) {
+	requireNative(t)
+	for _, p := range reversePairs() {
+		var reverse []byte
+		forward, err := CreateEnvelope(p.oldData, p.newData, WithReverse(&reverse), WithMetadata(map[string]string{"k": "v"}))
+		if err != nil {
+			t.Fatalf("%s: %v", p.name, err)
+		}
+		h, _, err := ParseEnvelope(reverse)
+		if err != nil {
+			t.Fatalf("%s: the reverse patch is not an envelope: %v", p.name, err)
+		}
+		if h.SourceSHA256 != sha256.Sum256(p.newData) || h.TargetSHA256 != sha256.Sum256(p.oldData) ||
+			h.SourceSize != int64(len(p.newData)) || h.TargetSize != int64(len(p.oldData)) || h.Metadata["k"] != "v" {
+			t.Fatalf("%s: reverse envelope header %+v", p.name, h)
+		}
+		if got, err := ApplyEnvelope(p.newData, reverse); err != nil || !bytes.Equal(got, p.oldData) {
+			t.Fatalf("%s: ApplyEnvelope of the reverse patch: %d bytes, %v", p.name, len(got), err)
+		}
+		if got, err := ApplyEnvelope(p.oldData, forward); err != nil || !bytes.Equal(got, p.newData) {
+			t.Fatalf("%s: ApplyEnvelope of the forward patch: %d bytes, %v", p.name, len(got), err)
+		}
+	}
+}
+
+// TestReversePatch ReversePatch 为已有的正向补丁生成反向补丁，沿用它的格式，信封生成信封；
+// 正向补丁应用到 oldData 得不到 newData 时返回 ErrTargetMismatch，oldData 不匹配时返回应用的错误
+func TestReversePatch(t *testing.T) {
+	requireNative(t)
+	for _, f := range reverseFormats {
+		for _, p := range reversePairs() {
+			forward, err := CreateDiffs(p.oldData, p.newData, f.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reverse, err := ReversePatch(p.oldData, p.newData, forward)
+			if err != nil {
+				t.Fatalf("%s, %s: %v", f.name, p.name, err)
+			}
+			t.Run(f.name+"/"+p.name, func(t *testing.T) {
+				checkReverse(t, p.oldData, p.newData, forward, reverse)
+			})
+		}
+	}
+
+	oldData, newData := testPair()
+	env, err := CreateEnvelope(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverse, err := ReversePatch(oldData, newData, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ApplyEnvelope(newData, reverse); err != nil || !bytes.Equal(got, oldData) {
+		t.Fatalf("ReversePatch of an envelope: %d bytes, %v", len(got), err)
+	}
+
+	forward, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReversePatch(oldData, append(bytes.Clone(newData), 'x'), forward); !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("newData that the patch does not produce: got %v, want ErrTargetMismatch", err)
+	}
+	if _, err := ReversePatch(oldData[:100], newData, forward); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("oldData that the patch does not apply to: got %v, want ErrSourceMismatch", err)
+	}
+	if _, err := ReversePatch(oldData, newData, []byte("garbage")); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("corrupt forward patch: got %v, want ErrCorruptPatch", err)
+	}
+}
@@ -0,0 +1,262 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var testSecondaries = []SecondaryCompression{SecondaryNone, SecondaryZlib, SecondaryZstd, SecondaryLZ4, SecondaryLZMA, SecondaryDJW, SecondaryFGK}
+
+// secondaryPair testdata/lzma.patch 和 testdata/liblzma.patch 的新旧数据：新数据在改动过的文本后面追加了 32 KiB 新文本，
+// 补丁中大部分是可以压缩的新增数据
+func secondaryPair() (oldData, newData []byte) {
+	oldData, newData = textFixture(64 << 10)
+	r := fixtureRand(5)
+	return oldData, append(newData, bytes.Join(fixtureLines(&r, 32<<10), nil)...)
+}
+
+// TestSecondaryRoundTrip 每种二次压缩的补丁在每个应用接口上都还原出新数据，InspectPatch 报告所用的压缩方式（不压缩时为空）
+func TestSecondaryRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData := secondaryPair()
+	for _, s := range testSecondaries {
+		t.Run(s.String(), func(t *testing.T) {
+			patch, err := CreateDiffs(oldData, newData, WithSecondaryCompression(s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := InspectPatch(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := s.String(); info.Secondary != want && !(s == SecondaryNone && info.Secondary == "") {
+				t.Fatalf("InspectPatch secondary %q, want %q", info.Secondary, want)
+			}
+			for name, apply := range applyPaths(t.TempDir(), oldData, patch) {
+				got, err := apply()
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !bytes.Equal(got, newData) {
+					t.Fatalf("%s: got %d bytes, want %d", name, len(got), len(newData))
+				}
+			}
+		})
+	}
+}
+
+// TestSecondaryLZMASmaller 可压缩的补丁上 LZMA 比不压缩和 zlib 都小，每个级别都能应用
+func TestSecondaryLZMASmaller(t *testing.T) {
+	requireNative(t)
+	oldData, newData := secondaryPair()
+	sizes := map[SecondaryCompression]int{}
+	for _, s := range []SecondaryCompression{SecondaryNone, SecondaryZlib, SecondaryLZMA} {
+		patch, err := CreateDiffs(oldData, newData, WithSecondaryCompression(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[s] = len(patch)
+	}
+	t.Logf("none %d, zlib %d, lzma %d bytes", sizes[SecondaryNone], sizes[SecondaryZlib], sizes[SecondaryLZMA])
+	if sizes[SecondaryLZMA] >= sizes[SecondaryZlib] || sizes[SecondaryZlib] >= sizes[SecondaryNone] {
+		t.Fatalf("patch sizes none %d, zlib %d, lzma %d: want lzma < zlib < none",
+			sizes[SecondaryNone], sizes[SecondaryZlib], sizes[SecondaryLZMA])
+	}
+	for level := MinCompressionLevel; level <= MaxCompressionLevel; level++ {
+		patch, err := CreateDiffs(oldData, newData, WithSecondaryCompression(SecondaryLZMA), WithCompressionLevel(level))
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if len(patch) >= sizes[SecondaryNone] {
+			t.Errorf("level %d: %d bytes, not smaller than %d bytes uncompressed", level, len(patch), sizes[SecondaryNone])
+		}
+		got, err := ApplyDiffsData(oldData, patch)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if !bytes.Equal(got, newData) {
+			t.Fatalf("level %d: got %d bytes, want %d", level, len(got), len(newData))
+		}
+	}
+}
+
+// TestSecondaryLZMATestdata 本库写出的（lzma.patch）和 liblzma 写出的（liblzma.patch，CRC64 校验）xz 流
+// 在原生层和纯 Go 解码器上都能应用，截断或改动过的补丁被拒绝
+func TestSecondaryLZMATestdata(t *testing.T) {
+	for _, name := range []string{"lzma.patch", "liblzma.patch"} {
+		t.Run(name, func(t *testing.T) {
+			checkSecondaryTestdata(t, name, SecondaryLZMA)
+		})
+	}
+}
+
+// TestSecondaryHuffmanTestdata djw.patch 和 fgk.patch 是本库以默认级别从 secondaryPair 生成的补丁（-update 重新生成）：
+// 有原生库时重新生成的补丁与之逐字节相同，流格式没有变；在原生层和纯 Go 解码器上都能应用，截断或改动过的补丁被拒绝
+func TestSecondaryHuffmanTestdata(t *testing.T) {
+	for name, kind := range map[string]SecondaryCompression{"djw.patch": SecondaryDJW, "fgk.patch": SecondaryFGK} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join("testdata", name)
+			if nativeBackend && Init() == nil {
+				oldData, newData := secondaryPair()
+				patch, err := CreateDiffs(oldData, newData, WithSecondaryCompression(kind))
+				if err != nil {
+					t.Fatal(err)
+				}
+				plain, err := CreateDiffs(oldData, newData)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(patch) >= len(plain)*3/4 {
+					t.Errorf("%d bytes, want well under the %d bytes of the uncompressed patch", len(patch), len(plain))
+				}
+				if *updateGolden {
+					if err := os.WriteFile(path, patch, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(patch, want) {
+					t.Fatalf("the patch (%d bytes) differs from %s (%d bytes)", len(patch), path, len(want))
+				}
+			}
+			checkSecondaryTestdata(t, name, kind)
+		})
+	}
+}
+
+// checkSecondaryTestdata testdata 中以 kind 二次压缩的补丁 name 应用到 secondaryPair 的旧数据得到新数据，
+// 截断、多出字节或改动过的补丁被拒绝
+func checkSecondaryTestdata(t *testing.T, name string, kind SecondaryCompression) {
+	t.Helper()
+	oldData, newData := secondaryPair()
+	patch, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := secondaryOf(patch[0]); s != kind {
+		t.Fatalf("secondaryOf = %v, want %v", s, kind)
+	}
+	got, err := ApplyDiffsData(oldData, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newData) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(newData))
+	}
+	var b bytes.Buffer
+	if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), newData) {
+		t.Fatalf("ApplyDiffsStream: got %d bytes, want %d", b.Len(), len(newData))
+	}
+	for n := 1; n < len(patch); n += 97 {
+		if _, err := ApplyDiffsData(oldData, patch[:n]); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+		}
+	}
+	if _, err := ApplyDiffsData(oldData, append(bytes.Clone(patch), 0)); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("trailing byte: got %v, want ErrCorruptPatch", err)
+	}
+	for i := 0; i < len(patch); i += 61 {
+		bad := bytes.Clone(patch)
+		bad[i] ^= 0x55
+		if _, err := ApplyDiffsData(oldData, bad); err == nil {
+			t.Fatalf("byte %d changed: patch applied", i)
+		}
+	}
+}
+
+// TestSecondaryLZMAXZ 有 xz 命令时，它能检查并解压本库的 LZMA 补丁，得到不压缩的补丁
+func TestSecondaryLZMAXZ(t *testing.T) {
+	requireNative(t)
+	xz, err := exec.LookPath("xz")
+	if err != nil {
+		t.Skip("xz not found")
+	}
+	oldData, newData := secondaryPair()
+	plain, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := CreateDiffs(oldData, newData, WithSecondaryCompression(SecondaryLZMA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(xz, "-dc")
+	cmd.Stdin = bytes.NewReader(patch)
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("xz -dc gave %d bytes, want the %d byte uncompressed patch", len(got), len(plain))
+	}
+}
+
+// TestCompressionLevel 超出范围的级别在调用原生层之前返回 ErrInvalidArgument；默认级别与各压缩器的默认值
+// （zlib 6、zstd 3、LZ4 1、LZMA 6、DJW 6）得到相同的补丁，不压缩和 FGK 时忽略级别，9 级的补丁不比 0 级大
+func TestCompressionLevel(t *testing.T) {
+	requireNative(t)
+	oldData, newData := secondaryPair()
+	for _, level := range []int{DefaultCompressionLevel - 1, MaxCompressionLevel + 1, 100} {
+		if _, err := CreateDiffs(oldData, newData, WithSecondaryCompression(SecondaryZstd), WithCompressionLevel(level)); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("level %d: got %v, want ErrInvalidArgument", level, err)
+		}
+	}
+	create := func(s SecondaryCompression, opts ...Option) []byte {
+		t.Helper()
+		patch, err := CreateDiffs(oldData, newData, append([]Option{WithSecondaryCompression(s)}, opts...)...)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		return patch
+	}
+	defaults := map[SecondaryCompression]int{SecondaryZlib: 6, SecondaryZstd: 3, SecondaryLZ4: 1, SecondaryLZMA: 6, SecondaryDJW: 6}
+	for _, s := range testSecondaries {
+		def := create(s)
+		if !bytes.Equal(create(s, WithCompressionLevel(DefaultCompressionLevel)), def) {
+			t.Errorf("%s: WithCompressionLevel(DefaultCompressionLevel) changed the patch", s)
+		}
+		if !bytes.Equal(create(s, WithCompressionLevel(defaults[s])), def) {
+			t.Errorf("%s: level %d differs from the default", s, defaults[s])
+		}
+		fastest, smallest := create(s, WithCompressionLevel(MinCompressionLevel)), create(s, WithCompressionLevel(MaxCompressionLevel))
+		if len(smallest) > len(fastest) {
+			t.Errorf("%s: level 9 gave %d bytes, level 0 %d", s, len(smallest), len(fastest))
+		}
+		if (s == SecondaryNone || s == SecondaryFGK) && !bytes.Equal(fastest, def) {
+			t.Errorf("%s: the level changed the patch", s)
+		}
+	}
+}
+
+// BenchmarkCompressionLevel 50 MB 文本上每种二次压缩在 0、1、3、6、9 级的编码耗时和补丁大小（patch-bytes）
+func BenchmarkCompressionLevel(b *testing.B) {
+	requireNative(b)
+	oldData, newData := textFixture(50 << 20)
+	for _, s := range testSecondaries[1:] {
+		for _, level := range []int{0, 1, 3, 6, 9} {
+			b.Run(fmt.Sprintf("%s/%d", s, level), func(b *testing.B) {
+				b.SetBytes(int64(len(newData)))
+				var n int
+				for b.Loop() {
+					patch, err := CreateDiffs(oldData, newData, WithSecondaryCompression(s), WithCompressionLevel(level))
+					if err != nil {
+						b.Fatal(err)
+					}
+					n = len(patch)
+				}
+				b.ReportMetric(float64(n), "patch-bytes")
+			})
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// WithSegmentSize CreateDiffsFile 把旧文件和新文件都按 bytes 字节切成段，第 i 段新数据只与第 i 段旧数据做差分，
+// 各段在 WithThreads 个（0 为所有 CPU 核心）goroutine 中各自编码，段的补丁按顺序拼接成一个普通补丁，
+// 应用接口不需要知道补丁是分段生成的；补丁只取决于段大小，与线程数无关
+// 代价是跨段的匹配全部丢失：数据在文件中移动了（插入、删除导致后面的内容错位）时，错位的部分落在另一段中，
+// 补丁会明显变大，只适合新旧文件基本按位置对应的情况（磁盘镜像、虚拟机镜像、就地修改的数据库文件等）
+// 块大小仍按整个文件的大小选择；内存占用约为 线程数 × (段的签名 + 段的补丁)，与文件大小无关；不大于 0 时不分段（默认）
+// 分段时补丁只能是本库的格式且不带二次压缩（拼接后的压缩流无法解码），不能与 WithStandardVCDIFF、
+// WithSecondaryCompression、WithSourceWindowSize 同时使用；WithChecksum 有效
+func WithSegmentSize(bytes int64) Option {
+	return func(o *options) {
+		o.segmentSize = max(bytes, 0)
+	}
+}
+
+// checkSegments 检查分段编码的选项组合
+func (o options) checkSegments() error {
+	switch {
+	case o.vcdiff:
+		return fmt.Errorf("%w: WithSegmentSize cannot be used with WithStandardVCDIFF", ErrInvalidArgument)
+	case o.secondary != SecondaryNone && !o.noCompress:
+		return fmt.Errorf("%w: WithSegmentSize cannot be used with secondary compression %v", ErrInvalidArgument, o.secondary)
+	case o.sourceWindow > 0:
+		return fmt.Errorf("%w: WithSegmentSize cannot be used with WithSourceWindowSize", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// createSegmentedFile 分段编码 oldPath 到 newPath 的补丁，先写入 patchPath 同目录下的临时文件，成功后再重命名
+// 每次并行编码 workers 段，全部完成后按顺序写出，同时只有这些段的补丁在内存中；WithEndRecord 时去掉各段的补丁头和结束记录，
+// 补丁以一个补丁头开头、以整个新文件的结束记录结尾
+func createSegmentedFile(oldPath, newPath, patchPath string, blockSize uint32, o options) (FileStats, error) {
+	old, err := os.Open(oldPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer old.Close()
+	new, err := os.Open(newPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer new.Close()
+	oldInfo, err := old.Stat()
+	if err != nil {
+		return FileStats{}, err
+	}
+	newInfo, err := new.Stat()
+	if err != nil {
+		return FileStats{}, err
+	}
+	oldSize, newSize, seg := oldInfo.Size(), newInfo.Size(), o.segmentSize
+
+	tmp, err := os.CreateTemp(filepath.Dir(patchPath), "."+filepath.Base(patchPath)+".tmp-*")
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	workers := o.threads
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	e := o.encoding()
+	// 空的新文件也编码为一段，补丁不能为空
+	n := max((newSize+seg-1)/seg, 1)
+	prog := newProgress(o.progress, min(oldSize, n*seg)+newSize)
+	var patchSize int64
+	if o.writesEndRecord() {
+		if _, err := tmp.Write([]byte{headerRecordOp, formatRevision}); err != nil {
+			return FileStats{}, err
+		}
+		patchSize += headerRecordLen
+	}
+	for first := int64(0); first < n; first += int64(workers) {
+		batch := int(min(int64(workers), n-first))
+		patches := make([][]byte, batch)
+		errs := make([]error, batch)
+		runParallel(batch, workers, func(i int) {
+			off := (first + int64(i)) * seg
+			newLen := max(min(seg, newSize-off), 0)
+			patches[i], errs[i] = encodeSegment(
+				io.NewSectionReader(old, off, max(min(seg, oldSize-off), 0)),
+				io.NewSectionReader(new, off, newLen),
+				off, blockSize, e, o.windowSize)
+			if errs[i] == nil && o.writesEndRecord() {
+				patches[i], errs[i] = segmentBody(patches[i], newLen)
+			}
+		})
+		for i, p := range patches {
+			if errs[i] != nil {
+				return FileStats{}, fmt.Errorf("segment %d: %w", first+int64(i), errs[i])
+			}
+			if _, err := tmp.Write(p); err != nil {
+				return FileStats{}, err
+			}
+			patchSize += int64(len(p))
+			off := (first + int64(i)) * seg
+			prog.add(int(max(min(seg, oldSize-off), 0) + min(seg, newSize-off)))
+		}
+	}
+	if o.writesEndRecord() {
+		end := appendEndRecord(nil, uint64(newSize))
+		if _, err := tmp.Write(end); err != nil {
+			return FileStats{}, err
+		}
+		patchSize += int64(len(end))
+	}
+	if err := tmp.Close(); err != nil {
+		return FileStats{}, err
+	}
+	if err := replaceFile(tmp.Name(), patchPath, o.fsync); err != nil {
+		return FileStats{}, err
+	}
+	return FileStats{OldSize: oldSize, NewSize: newSize, PatchSize: patchSize}, nil
+}
+
+// segmentBody 去掉一段的补丁开头的补丁头和末尾的结束记录：各段的补丁按顺序拼接，只在最前面写出补丁头、最后接上整个输出的结束记录
+func segmentBody(p []byte, targetLen int64) ([]byte, error) {
+	n := len(p) - endRecordLen
+	if n < headerRecordLen || p[0] != headerRecordOp || p[n] != endRecordOp || binary.LittleEndian.Uint64(p[n+1:]) != uint64(targetLen) {
+		return nil, fmt.Errorf("the patch of a %d byte segment does not start with its header and end with its end record", targetLen)
+	}
+	return p[headerRecordLen:n], nil
+}
+
+// encodeSegment 返回 new 相对 old 的补丁，COPY 偏移加上 off，即 old 在完整旧数据中的位置
+func encodeSegment(old, new io.Reader, off int64, blockSize uint32, e encoding, windowSize int) ([]byte, error) {
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	enc, err := newNativeEncoder(blockSize, e)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.close()
+	buf := make([]byte, windowSize)
+	if err := readWindows(old, buf, enc.addSource); err != nil {
+		return nil, err
+	}
+	if err := enc.setSourceOffset(off); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := readWindows(new, buf, func(p []byte) error { return enc.write(p, &out) }); err != nil {
+		return nil, err
+	}
+	if err := enc.finish(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,108 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// imageFixture 约 n 字节的“磁盘镜像”和它的新版本：随机数据，每 64 KiB 就地改写几个字节，
+// 内容不移动，新旧数据按位置对应
+func imageFixture(n int) (oldData, newData []byte) {
+	r := fixtureRand(86)
+	oldData = make([]byte, n)
+	for i := range oldData {
+		oldData[i] = byte(r.next())
+	}
+	newData = bytes.Clone(oldData)
+	for at := 1000; at < n; at += 64 << 10 {
+		for k := range 4 {
+			newData[min(at+k*97, n-1)] ^= 0x5A
+		}
+	}
+	return oldData, newData
+}
+
+// TestWithSegmentSize 分段创建的补丁用所有应用接口都能还原，无论段大小是否按块对齐、新文件比旧文件长还是短；
+// 补丁与线程数无关；新旧数据按位置对应时补丁与不分段时差不多大，内容移到其他段时补丁变大（跨段的匹配丢失）
+func TestWithSegmentSize(t *testing.T) {
+	requireNative(t)
+	dir := t.TempDir()
+	imgOld, imgNew := imageFixture(1 << 20)
+	textOld, textNew := textFixture(1 << 20)
+	shifted := append([]byte("inserted at the start\n"), imgOld...)
+	create := func(oldData, newData []byte, opts ...Option) []byte {
+		t.Helper()
+		paths := writeFiles(t, dir, map[string][]byte{"old": oldData, "new": newData})
+		patchPath := filepath.Join(dir, "patch")
+		if err := CreateDiffsFile(paths["old"], paths["new"], patchPath, DefaultBlockSize, opts...); err != nil {
+			t.Fatal(err)
+		}
+		patch, err := os.ReadFile(patchPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return patch
+	}
+
+	for _, tc := range []struct {
+		name             string
+		oldData, newData []byte
+	}{
+		{"image", imgOld, imgNew},
+		{"text", textOld, textNew},
+		{"shifted", imgOld, shifted},
+		{"grown", imgOld[:300000], imgNew},
+		{"shrunk", imgOld, imgNew[:300000]},
+		{"empty new", imgOld, nil},
+		{"empty old", nil, imgNew},
+	} {
+		for _, seg := range []int64{4096, 100003, 256 << 10, int64(len(tc.newData)), 4 << 20} {
+			patch := create(tc.oldData, tc.newData, WithSegmentSize(seg))
+			for name, apply := range applyPaths(t.TempDir(), tc.oldData, patch) {
+				if got, err := apply(); err != nil || !bytes.Equal(got, tc.newData) {
+					t.Fatalf("%s, segment %d: %s returned %d bytes, %v", tc.name, seg, name, len(got), err)
+				}
+			}
+			if seg != 100003 {
+				continue
+			}
+			for _, threads := range []int{1, 3, 0} {
+				if got := create(tc.oldData, tc.newData, WithSegmentSize(seg), WithThreads(threads)); !bytes.Equal(got, patch) {
+					t.Fatalf("%s, segment %d: %d threads gave a different patch", tc.name, seg, threads)
+				}
+			}
+		}
+	}
+
+	plain := create(imgOld, imgNew)
+	if seg := create(imgOld, imgNew, WithSegmentSize(64<<10)); len(seg) > len(plain)+len(plain)/10+16*100 {
+		t.Fatalf("aligned image: %d byte patch in 64 KiB segments, %d bytes without", len(seg), len(plain))
+	}
+	half := len(imgOld) / 2
+	swapped := append(bytes.Clone(imgOld[half:]), imgOld[:half]...)
+	plainSwapped := create(imgOld, swapped)
+	if seg := create(imgOld, swapped, WithSegmentSize(64<<10)); len(seg) < len(swapped)/2 || len(plainSwapped) > len(swapped)/10 {
+		t.Fatalf("swapped halves: %d byte patch in segments, %d bytes without", len(seg), len(plainSwapped))
+	}
+
+	// 分段补丁的每段校验和都有效
+	patch := create(imgOld, imgNew, WithSegmentSize(100003), WithChecksum(ChecksumXXH3))
+	changed := bytes.Clone(imgOld)
+	changed[500000] ^= 1
+	if _, err := ApplyDiffsData(changed, patch); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("segmented patch with checksums on changed old data: got %v, want ErrChecksumMismatch", err)
+	}
+	paths := writeFiles(t, dir, map[string][]byte{"old": imgOld, "new": imgNew})
+	for name, opt := range map[string]Option{
+		"vcdiff":        WithStandardVCDIFF(),
+		"zstd":          WithSecondaryCompression(SecondaryZstd),
+		"source window": WithSourceWindowSize(64 << 10),
+	} {
+		if err := CreateDiffsFile(paths["old"], paths["new"], filepath.Join(dir, "patch"), DefaultBlockSize, WithSegmentSize(1<<20), opt); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("WithSegmentSize with %s: got %v, want ErrInvalidArgument", name, err)
+		}
+	}
+}
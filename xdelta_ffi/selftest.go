@@ -0,0 +1,118 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+)
+
+// selftestCorpus Selftest 使用的一对内置数据
+type selftestCorpus struct {
+	name     string
+	old, new []byte
+}
+
+// selftestVariant Selftest 对每对数据尝试的一组选项
+type selftestVariant struct {
+	name string
+	opts []Option
+}
+
+var selftestVariants = []selftestVariant{
+	{"native", nil},
+	{"block size 64, lazy", []Option{WithBlockSize(64), WithMatchStrategy(MatchLazy)}},
+	{"zlib", []Option{WithSecondaryCompression(SecondaryZlib)}},
+	{"zstd level 9", []Option{WithSecondaryCompression(SecondaryZstd), WithCompressionLevel(MaxCompressionLevel)}},
+	{"lz4", []Option{WithSecondaryCompression(SecondaryLZ4)}},
+	{"lzma", []Option{WithSecondaryCompression(SecondaryLZMA)}},
+	{"djw", []Option{WithSecondaryCompression(SecondaryDJW)}},
+	{"fgk", []Option{WithSecondaryCompression(SecondaryFGK)}},
+	{"xxh3 checksum", []Option{WithChecksum(ChecksumXXH3)}},
+	{"parallel", []Option{WithThreads(0), WithBlockSize(256)}},
+	{"vcdiff", []Option{WithStandardVCDIFF(), WithChecksum(ChecksumAdler32)}},
+}
+
+// selftestCorpora 生成内置数据：空数据、文本的插入删除、随机数据的移位、大段重复和只追加，总共不到 2 MiB；
+// 随机数用固定的种子，每次完全相同
+func selftestCorpora() []selftestCorpus {
+	r := rand.New(rand.NewPCG(0x78646c74, 0x73656c66))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+		return b
+	}
+	var text []byte
+	for i := 0; len(text) < 96<<10; i++ {
+		text = fmt.Appendf(text, "line %d: the quick brown fox %d jumps over the lazy dog\n", i, r.IntN(1000))
+	}
+	edited := append([]byte(nil), text[:10<<10]...)
+	edited = append(edited, "inserted paragraph\n"...)
+	edited = append(edited, text[12<<10:60<<10]...)
+	edited = append(edited, bytes.ToUpper(text[60<<10:61<<10])...)
+	edited = append(edited, text[61<<10:]...)
+
+	noise := random(512 << 10)
+	shifted := append(random(100), noise[:200<<10]...)
+	shifted = append(shifted, noise[300<<10:]...)
+
+	zeros := make([]byte, 1<<20)
+	patched := append([]byte(nil), zeros...)
+	copy(patched[123456:], random(64))
+
+	return []selftestCorpus{
+		{"empty", nil, nil},
+		{"create", nil, text},
+		{"delete", text, nil},
+		{"text edits", text, edited},
+		{"shifted random data", noise, shifted},
+		{"zeros", zeros, patched},
+		{"append", noise[:64<<10], noise[:100<<10]},
+	}
+}
+
+// Selftest 用内置的几对数据（空数据、文本修改、随机数据的移位、大段重复和只追加）和多组选项（各种二次压缩、校验和、
+// 小块与 MatchLazy、多线程编码和 VCDIFF）通过已加载的原生库创建补丁，再分别用内存版本和流式接口应用，检查得到的正是新数据。
+// 全部通过时返回 nil，否则返回第一个失败，错误信息中有数据和选项的名称；原生库无法加载时返回 Init 的错误，
+// 没有原生后端的构建返回 ErrNotSupported
+// 用于在部署到新机器、换了原生库之后的启动阶段确认原生库可用，耗时通常在 1 秒以内
+func Selftest() error {
+	if err := Init(); err != nil {
+		return err
+	}
+	if !nativeBackend {
+		return ErrNotSupported
+	}
+	for _, c := range selftestCorpora() {
+		for _, v := range selftestVariants {
+			if err := selftestRoundTrip(c, v.opts); err != nil {
+				return fmt.Errorf("xdelta: self-test %q with %s: %w", c.name, v.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// selftestRoundTrip 用 opts 为 c 创建补丁并应用
+func selftestRoundTrip(c selftestCorpus, opts []Option) error {
+	patch, err := CreateDiffs(c.old, c.new, opts...)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	out, err := ApplyDiffsData(c.old, patch)
+	if err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	if !bytes.Equal(out, c.new) {
+		return fmt.Errorf("apply produced %d bytes that differ from the %d new bytes", len(out), len(c.new))
+	}
+	var buf bytes.Buffer
+	if err := ApplyDiffsStream(bytes.NewReader(c.old), bytes.NewReader(patch), &buf, WithWindowSize(4<<10)); err != nil {
+		return fmt.Errorf("stream apply: %w", err)
+	}
+	if !bytes.Equal(buf.Bytes(), c.new) {
+		return fmt.Errorf("stream apply produced %d bytes that differ from the %d new bytes", buf.Len(), len(c.new))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestSelftest 原生库可用时 Selftest 返回 nil，没有原生后端时返回 ErrNotSupported；
+// 某组选项失败时返回的错误中有数据和选项的名称；内置数据每次生成的都相同
+func TestSelftest(t *testing.T) {
+	if !nativeBackend {
+		if err := Selftest(); !errors.Is(err, ErrNotSupported) {
+			t.Fatalf("without a native backend: got %v, want ErrNotSupported", err)
+		}
+		return
+	}
+	requireNative(t)
+	if err := Selftest(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := selftestCorpora(), selftestCorpora()
+	for i := range a {
+		if !bytes.Equal(a[i].old, b[i].old) || !bytes.Equal(a[i].new, b[i].new) {
+			t.Fatalf("corpus %q differs between runs", a[i].name)
+		}
+	}
+
+	defer func(v []selftestVariant) { selftestVariants = v }(selftestVariants)
+	selftestVariants = append(selftestVariants[:1:1], selftestVariant{"broken", []Option{WithBlockSize(MaxBlockSize + 1)}})
+	err := Selftest()
+	if !errors.Is(err, ErrInvalidArgument) || !strings.Contains(err.Error(), `"empty" with broken`) {
+		t.Fatalf("failing variant: got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// 签名补丁的格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'S' 'I' 'G' 0D 0A
+//	version      1 字节  当前为 1
+//	scheme       1 字节  1 为 Ed25519，2 为 HMAC-SHA256
+//	key id       8 字节  Ed25519 为公钥 SHA-256 的前 8 字节，用于在多个公钥中选出验证用的那个；HMAC-SHA256 为 0
+//	length       8 字节  其后补丁的长度
+//	signature   64 字节  Ed25519 签名（HMAC-SHA256 为 32 字节）
+//
+// 之后是原样的补丁，可以是任意格式的补丁或 CreateEnvelope 生成的信封
+// 签名（或 HMAC）的对象是 signature 之前的 26 字节头加上补丁的 SHA-256，
+// 头中的长度、方案和密钥标识都受签名保护，改动任何一个字节都会使验证失败
+var signedMagic = []byte{0x89, 'X', 'D', 'S', 'I', 'G', 0x0D, 0x0A}
+
+const (
+	// SignedVersion SignPatch、SignPatchHMAC 写入的签名格式版本
+	SignedVersion = 1
+
+	signSchemeEd25519 = 1
+	signSchemeHMAC    = 2
+
+	signedHeaderLen = 8 + 1 + 1 + 8 + 8
+)
+
+// IsSigned 报告 data 是否以签名补丁的 magic 开头
+func IsSigned(data []byte) bool {
+	return bytes.HasPrefix(data, signedMagic)
+}
+
+// SignPatch 用 Ed25519 私钥给补丁签名，返回签名补丁（补丁前加上 90 字节的签名头），用 ApplySigned 验证并应用
+// patch 可以是 CreateDiffs 等生成的任意补丁，需要同时校验旧数据和结果时先用 CreateEnvelope 生成信封再签名；
+// Ed25519 签名是确定的，同一补丁、同一私钥的结果每次都相同；私钥长度不对时返回 ErrInvalidArgument
+func SignPatch(patch []byte, key ed25519.PrivateKey) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%w: Ed25519 private key is %d bytes, want %d", ErrInvalidArgument, len(key), ed25519.PrivateKeySize)
+	}
+	head := signedHeader(signSchemeEd25519, ed25519KeyID(key.Public().(ed25519.PublicKey)), len(patch))
+	sig := ed25519.Sign(key, signedMessage(head, patch))
+	return append(append(append(make([]byte, 0, len(head)+len(sig)+len(patch)), head...), sig...), patch...), nil
+}
+
+// SignPatchHMAC 与 SignPatch 相同，但用共享密钥计算 HMAC-SHA256，适合发布方和客户端共享密钥的部署，用 ApplySignedHMAC 验证
+// 签名头为 58 字节；key 为空时返回 ErrInvalidArgument，密钥至少应有 32 字节的随机数据
+func SignPatchHMAC(patch, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: empty HMAC key", ErrInvalidArgument)
+	}
+	head := signedHeader(signSchemeHMAC, [8]byte{}, len(patch))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signedMessage(head, patch))
+	return append(append(append(make([]byte, 0, len(head)+sha256.Size+len(patch)), head...), mac.Sum(nil)...), patch...), nil
+}
+
+// VerifySigned 验证 SignPatch 生成的签名补丁，成功时返回其中的补丁（与 signed 共用底层数组）
+// keys 为可信的公钥，签名头中的密钥标识选出其中一个验证，可以同时放入新旧两代公钥以便轮换；keys 为空时返回 ErrInvalidArgument
+// 没有签名、签名不对、签名密钥不在 keys 中或使用的是 HMAC-SHA256 时返回 ErrBadSignature；
+// 签名头截断或长度与补丁不符时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func VerifySigned(signed []byte, keys []ed25519.PublicKey) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no public keys to verify against", ErrInvalidArgument)
+	}
+	scheme, id, sig, patch, err := parseSigned(signed)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != signSchemeEd25519 {
+		return nil, fmt.Errorf("%w: patch is signed with %s, not Ed25519", ErrBadSignature, signSchemeName(scheme))
+	}
+	for _, k := range keys {
+		if len(k) != ed25519.PublicKeySize || ed25519KeyID(k) != id {
+			continue
+		}
+		if len(sig) != ed25519.SignatureSize || !ed25519.Verify(k, signedMessage(signed[:signedHeaderLen], patch), sig) {
+			return nil, fmt.Errorf("%w: Ed25519 signature does not verify", ErrBadSignature)
+		}
+		return patch, nil
+	}
+	return nil, fmt.Errorf("%w: patch is signed by unknown key %x", ErrBadSignature, id)
+}
+
+// VerifySignedHMAC 与 VerifySigned 相同，但验证 SignPatchHMAC 生成的签名补丁；key 为空时返回 ErrInvalidArgument
+func VerifySignedHMAC(signed, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: empty HMAC key", ErrInvalidArgument)
+	}
+	scheme, _, sig, patch, err := parseSigned(signed)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != signSchemeHMAC {
+		return nil, fmt.Errorf("%w: patch is signed with %s, not HMAC-SHA256", ErrBadSignature, signSchemeName(scheme))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signedMessage(signed[:signedHeaderLen], patch))
+	if subtle.ConstantTimeCompare(mac.Sum(nil), sig) != 1 {
+		return nil, fmt.Errorf("%w: HMAC-SHA256 does not verify", ErrBadSignature)
+	}
+	return patch, nil
+}
+
+// ApplySigned 用 VerifySigned 验证签名补丁，通过后才把其中的补丁交给解码器应用到旧数据，任何验证失败都不会开始解码
+// 补丁是信封时按 WithVerifyOutput 校验旧数据和结果；opts 与 ApplyDiffsData 相同，
+// 等同于带上 WithRequireSignature(keys...) 和 WithVerifyOutput 调用 ApplyDiffsData
+func ApplySigned(oldData, signedPatch []byte, keys []ed25519.PublicKey, opts ...Option) ([]byte, error) {
+	return ApplyDiffsData(oldData, signedPatch, append(opts[:len(opts):len(opts)], WithVerifyOutput(), WithRequireSignature(keys...))...)
+}
+
+// ApplySignedHMAC 与 ApplySigned 相同，但用 VerifySignedHMAC 验证
+func ApplySignedHMAC(oldData, signedPatch, key []byte, opts ...Option) ([]byte, error) {
+	patch, err := VerifySignedHMAC(signedPatch, key)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyDiffsData(oldData, patch, append(opts[:len(opts):len(opts)], WithVerifyOutput())...)
+}
+
+// WithRequireSignature 让应用补丁的接口只接受 SignPatch 生成、由 keys 中某个公钥签名的补丁：
+// 先按 VerifySigned 验证，通过后才解码其中的补丁；没有签名、签名不对或签名密钥不在 keys 中时返回 ErrBadSignature，
+// keys 为空时返回 ErrInvalidArgument，任何验证失败都不会开始解码。这样分发到客户端的补丁在库内统一验证，调用方不必自己先调用 VerifySigned
+// 签名覆盖整个补丁，只能在补丁完整地在内存中时验证：ApplyDiffsData、ApplyDiffsDataInto、ApplyDiffsDataContext、ApplyDiffsDataPooled、
+// ApplyDiffs、ApplyDiffsAt、ApplyDiffsFrom、ApplyDiffsInPlace 和 NewApplyReader 有效；
+// ApplyDiffsStream、ApplyDiffsFile、Decoder、NewPatchReader 等流式读取补丁的接口返回 ErrInvalidArgument，
+// 补丁在文件中时先读入内存再调用内存版本；CreateZipDiff、CreateTarDiff 等容器补丁先用 VerifySigned 验证整个容器，再不带这个选项应用
+func WithRequireSignature(keys ...ed25519.PublicKey) Option {
+	return func(o *options) {
+		o.signatureKeys = append([]ed25519.PublicKey{}, keys...)
+	}
+}
+
+// openSigned WithRequireSignature 时验证内存中的签名补丁，返回其中的补丁；没有这个选项时原样返回 patch
+func (o options) openSigned(patch []byte) ([]byte, error) {
+	if o.signatureKeys == nil {
+		return patch, nil
+	}
+	return VerifySigned(patch, o.signatureKeys)
+}
+
+// checkStreamSignature 流式读取补丁的接口无法在解码之前验证签名，WithRequireSignature 时返回 ErrInvalidArgument
+func (o options) checkStreamSignature() error {
+	if o.signatureKeys != nil {
+		return fmt.Errorf("%w: WithRequireSignature needs the whole patch in memory, use ApplyDiffsData or ApplyDiffs", ErrInvalidArgument)
+	}
+	return nil
+}
+
+func signedHeader(scheme byte, id [8]byte, n int) []byte {
+	b := make([]byte, 0, signedHeaderLen)
+	b = append(b, signedMagic...)
+	b = append(b, SignedVersion, scheme)
+	b = append(b, id[:]...)
+	return binary.LittleEndian.AppendUint64(b, uint64(n))
+}
+
+// signedMessage 返回签名的对象：签名头加上补丁的 SHA-256
+func signedMessage(head, patch []byte) []byte {
+	sum := sha256.Sum256(patch)
+	return append(head[:len(head):len(head)], sum[:]...)
+}
+
+// ed25519KeyID 公钥 SHA-256 的前 8 字节
+func ed25519KeyID(pub ed25519.PublicKey) [8]byte {
+	sum := sha256.Sum256(pub)
+	return [8]byte(sum[:8])
+}
+
+func signSchemeName(scheme byte) string {
+	switch scheme {
+	case signSchemeEd25519:
+		return "Ed25519"
+	case signSchemeHMAC:
+		return "HMAC-SHA256"
+	default:
+		return fmt.Sprintf("unknown scheme %d", scheme)
+	}
+}
+
+// parseSigned 拆开签名补丁，只检查结构，不验证签名
+func parseSigned(signed []byte) (scheme byte, id [8]byte, sig, patch []byte, err error) {
+	if !IsSigned(signed) {
+		return 0, id, nil, nil, fmt.Errorf("%w: patch is not signed", ErrBadSignature)
+	}
+	if len(signed) < len(signedMagic)+1 {
+		return 0, id, nil, nil, fmt.Errorf("%w: truncated signature header", ErrCorruptPatch)
+	}
+	if v := signed[len(signedMagic)]; v != SignedVersion {
+		return 0, id, nil, nil, fmt.Errorf("%w: signature version %d", ErrUnsupportedPatch, v)
+	}
+	if len(signed) < signedHeaderLen {
+		return 0, id, nil, nil, fmt.Errorf("%w: truncated signature header", ErrCorruptPatch)
+	}
+	scheme = signed[len(signedMagic)+1]
+	id = [8]byte(signed[len(signedMagic)+2:])
+	n := binary.LittleEndian.Uint64(signed[signedHeaderLen-8:])
+	var sigLen int
+	switch scheme {
+	case signSchemeEd25519:
+		sigLen = ed25519.SignatureSize
+	case signSchemeHMAC:
+		sigLen = sha256.Size
+	default:
+		return 0, id, nil, nil, fmt.Errorf("%w: signature scheme %d", ErrUnsupportedPatch, scheme)
+	}
+	rest := signed[signedHeaderLen:]
+	if len(rest) < sigLen || uint64(len(rest)-sigLen) != n {
+		return 0, id, nil, nil, fmt.Errorf("%w: signed patch is %d bytes, the signature header declares %d", ErrCorruptPatch, max(len(rest)-sigLen, 0), n)
+	}
+	return scheme, id, rest[:sigLen], rest[sigLen:], nil
+}
@@ -0,0 +1,222 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// signingKey golden 测试用的 Ed25519 私钥，由固定的种子生成
+func signingKey(seed byte) ed25519.PrivateKey {
+	s := make([]byte, ed25519.SeedSize)
+	for i := range s {
+		s[i] = seed + byte(i)
+	}
+	return ed25519.NewKeyFromSeed(s)
+}
+
+// hmacTestKey golden 测试用的 HMAC-SHA256 密钥
+var hmacTestKey = []byte("0123456789abcdef0123456789abcdef")
+
+// TestSignedGolden 签名格式版本 1 的 golden 向量：用固定密钥给 testdata/native.patch 签名的结果与
+// testdata/native.ed25519.signed、native.hmac.signed 逐字节相同，两个文件都能验证并应用到 testPair 的旧数据。
+// go test -run TestSignedGolden -update 重写 golden 文件
+func TestSignedGolden(t *testing.T) {
+	oldData, newData := testPair()
+	patch, err := os.ReadFile(filepath.Join("testdata", "native.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signingKey(1)
+	ed, err := SignPatch(patch, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := SignPatchHMAC(patch, hmacTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []struct {
+		name     string
+		data     []byte
+		headLen  int
+		sigBytes int
+	}{
+		{"native.ed25519.signed", ed, signedHeaderLen, ed25519.SignatureSize},
+		{"native.hmac.signed", mac, signedHeaderLen, 32},
+	} {
+		path := filepath.Join("testdata", g.name)
+		if *updateGolden {
+			if err := os.WriteFile(path, g.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(g.data, want) {
+			t.Fatalf("%s: signing the patch gave % x..., golden file % x...", g.name, g.data[:g.headLen], want[:min(len(want), g.headLen)])
+		}
+		if !IsSigned(want) || want[8] != SignedVersion || !bytes.Equal(want[g.headLen+g.sigBytes:], patch) {
+			t.Fatalf("%s: not a version %d signed patch wrapping native.patch", g.name, SignedVersion)
+		}
+		// 按格式说明独立地验证：签名的对象是 26 字节的头加上补丁的 SHA-256
+		sum := sha256.Sum256(patch)
+		msg := append(bytes.Clone(want[:g.headLen]), sum[:]...)
+		sig := want[g.headLen : g.headLen+g.sigBytes]
+		if g.data[9] == signSchemeEd25519 {
+			if !ed25519.Verify(key.Public().(ed25519.PublicKey), msg, sig) {
+				t.Fatalf("%s: the signature does not verify over the header and the patch SHA-256", g.name)
+			}
+		} else {
+			m := hmac.New(sha256.New, hmacTestKey)
+			m.Write(msg)
+			if !hmac.Equal(m.Sum(nil), sig) {
+				t.Fatalf("%s: the HMAC does not match over the header and the patch SHA-256", g.name)
+			}
+		}
+	}
+
+	golden := func(name string) []byte {
+		b, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if got, err := ApplySigned(oldData, golden("native.ed25519.signed"), []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplySigned: %d bytes, %v", len(got), err)
+	}
+	if got, err := ApplySignedHMAC(oldData, golden("native.hmac.signed"), hmacTestKey); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplySignedHMAC: %d bytes, %v", len(got), err)
+	}
+}
+
+// TestApplySignedRejects 没有签名、签名不对、密钥未知、方案不符、签名头或补丁被改动的补丁都在解码之前被拒绝：
+// 签名失败返回 ErrBadSignature，结构错误返回 ErrCorruptPatch，版本和方案不认识时返回 ErrUnsupportedPatch
+func TestApplySignedRejects(t *testing.T) {
+	oldData, newData := testPair()
+	patch, err := os.ReadFile(filepath.Join("testdata", "native.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, other := signingKey(1), signingKey(2)
+	pub, otherPub := key.Public().(ed25519.PublicKey), other.Public().(ed25519.PublicKey)
+	keys := []ed25519.PublicKey{pub}
+	signed, err := SignPatch(patch, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := SignPatchHMAC(patch, hmacTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flip := func(b []byte, i int) []byte {
+		b = bytes.Clone(b)
+		b[i] ^= 0x01
+		return b
+	}
+
+	var decoded int64
+	if nativeBackend {
+		s, err := NativeStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = s.BytesDecoded
+	}
+	for _, tc := range []struct {
+		name   string
+		signed []byte
+		keys   []ed25519.PublicKey
+		want   error
+	}{
+		{"unsigned", patch, keys, ErrBadSignature},
+		{"unknown key", signed, []ed25519.PublicKey{otherPub}, ErrBadSignature},
+		{"hmac signed", mac, keys, ErrBadSignature},
+		{"version", flip(signed, 8), keys, ErrUnsupportedPatch},
+		{"scheme", flip(flip(signed, 9), 10), keys, ErrUnsupportedPatch},
+		{"key id", flip(signed, 10), keys, ErrBadSignature},
+		{"length", flip(signed, signedHeaderLen-8), keys, ErrCorruptPatch},
+		{"signature", flip(signed, signedHeaderLen+5), keys, ErrBadSignature},
+		{"patch", flip(signed, len(signed)-20), keys, ErrBadSignature},
+		{"truncated header", signed[:20], keys, ErrCorruptPatch},
+		{"truncated patch", signed[:len(signed)-1], keys, ErrCorruptPatch},
+		{"appended byte", append(bytes.Clone(signed), 0), keys, ErrCorruptPatch},
+		{"no keys", signed, nil, ErrInvalidArgument},
+	} {
+		if _, err := ApplySigned(oldData, tc.signed, tc.keys); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if nativeBackend {
+		if s, err := NativeStats(); err != nil || s.BytesDecoded != decoded {
+			t.Fatalf("rejected patches reached the decoder: %d bytes decoded (%v)", s.BytesDecoded-decoded, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		signed []byte
+		key    []byte
+		want   error
+	}{
+		{"wrong key", mac, []byte("another key"), ErrBadSignature},
+		{"ed25519 signed", signed, hmacTestKey, ErrBadSignature},
+		{"patch", flip(mac, len(mac)-1), hmacTestKey, ErrBadSignature},
+		{"mac", flip(mac, signedHeaderLen), hmacTestKey, ErrBadSignature},
+		{"empty key", mac, nil, ErrInvalidArgument},
+	} {
+		if _, err := ApplySignedHMAC(oldData, tc.signed, tc.key); !errors.Is(err, tc.want) {
+			t.Errorf("HMAC %s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// 轮换密钥：新旧两代公钥都可信时按密钥标识选出签名的那个
+	if got, err := ApplySigned(oldData, signed, []ed25519.PublicKey{otherPub, pub}); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("two trusted keys: %d bytes, %v", len(got), err)
+	}
+	if _, err := SignPatch(patch, key[:10]); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("short private key: got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := SignPatchHMAC(patch, nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("empty HMAC key: got %v, want ErrInvalidArgument", err)
+	}
+	// 流式接口无法在解码之前验证签名
+	var b bytes.Buffer
+	if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(signed), &b, WithRequireSignature(keys...)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("ApplyDiffsStream with WithRequireSignature: got %v, want ErrInvalidArgument", err)
+	}
+	if got, err := ApplyDiffsData(oldData, signed, WithRequireSignature(keys...)); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplyDiffsData with WithRequireSignature: %d bytes, %v", len(got), err)
+	}
+}
+
+// TestApplySignedEnvelope 签名的信封在验证签名后还按信封校验旧数据和结果
+func TestApplySignedEnvelope(t *testing.T) {
+	oldData, newData := testPair()
+	env, err := os.ReadFile(filepath.Join("testdata", "envelope.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signingKey(1)
+	keys := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+	signed, err := SignPatch(env, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ApplySigned(oldData, signed, keys); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("signed envelope: %d bytes, %v", len(got), err)
+	}
+	changed := bytes.Clone(oldData)
+	changed[0] ^= 1
+	if _, err := ApplySigned(changed, signed, keys); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("signed envelope applied to other data: got %v, want ErrSourceMismatch", err)
+	}
+}
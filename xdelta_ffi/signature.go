@@ -0,0 +1,198 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// 基于签名的差分（librsync 风格），用于旧数据和新数据不在同一处的情况：
+//
+//  1. 持有旧数据的一方用 CreateSignature 生成块签名，发给持有新数据的一方
+//  2. 对方用 DeltaFromSignature 从签名和新数据生成补丁，发回来
+//  3. 持有旧数据的一方用 ApplyDelta 应用补丁
+//
+// 签名中每个块有一个滚动弱校验和和一个 SHA-256，大小约为旧数据的 36/blockSize，带 magic 和格式版本；
+// 补丁就是普通的补丁，与 CreateDiffsData 使用同样块大小生成的补丁相同
+// 对同一份签名生成大量补丁时，用 LoadSignature 只解析一次签名
+
+// CreateSignature 读取旧数据 old，返回它的块签名；blockSize 为 AutoBlockSize（0）时
+// 根据 old 的长度（能获取时）自动选择，否则必须在 [MinBlockSize, MaxBlockSize] 范围内
+// 块大小记录在签名中，对方不需要另外知道；opts 中 WithWindowSize、WithProgress、WithMaxMemory 有效
+func CreateSignature(old io.Reader, blockSize int, opts ...Option) ([]byte, error) {
+	if blockSize < 0 || blockSize > int(MaxBlockSize) {
+		return nil, fmt.Errorf("%w: block size %d is out of range [%d, %d]", ErrInvalidArgument, blockSize, MinBlockSize, MaxBlockSize)
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	bs := resolveBlockSize(uint32(blockSize), readerSize(old), -1)
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	enc, err := newNativeEncoder(bs, defaultEncoding)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.close()
+
+	prog := newProgress(o.progress, readerSize(old))
+	buf := make([]byte, o.windowSize)
+	err = readWindows(old, buf, func(p []byte) error {
+		if err := o.checkSignatures(prog.done+int64(len(p)), bs); err != nil {
+			return err
+		}
+		if err := enc.addSource(p); err != nil {
+			return err
+		}
+		prog.add(len(p))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var sig bytes.Buffer
+	if err := enc.signature(&sig); err != nil {
+		return nil, err
+	}
+	return sig.Bytes(), nil
+}
+
+// DeltaFromSignature 从 CreateSignature 生成的签名 sig 和新数据 new 生成补丁，不需要旧数据；
+// new 按窗口（WithWindowSize）读取，只有补丁保存在内存中
+// opts 中选择补丁编码方式的选项（WithSecondaryCompression、WithStandardVCDIFF、WithChecksum 等）和 WithProgress 有效，
+// WithBlockSize 被忽略；签名损坏时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func DeltaFromSignature(sig []byte, new io.Reader, opts ...Option) (delta []byte, err error) {
+	if m := beginOp(OpCreateStream, -1, readerSize(new)); m != nil {
+		defer func() { m.end(int64(len(delta)), err) }()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	enc, err := newNativeEncoder(DefaultBlockSize, o.encoding())
+	if err != nil {
+		return nil, err
+	}
+	defer enc.close()
+	if err := enc.loadSignature(sig); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	prog := newProgress(o.progress, readerSize(new))
+	delta, err = encodeDelta(enc, new, o.windowSize, prog)
+	if err != nil {
+		return nil, err
+	}
+	o.recordDiffPatch(DiffStats{TargetSize: prog.done, PatchSize: int64(len(delta)), Windows: prog.windows, ThreadsUsed: 1}, delta, start)
+	return delta, nil
+}
+
+// encodeDelta 按窗口把 new 送入已经载入签名的 enc，返回补丁
+func encodeDelta(enc *nativeEncoder, new io.Reader, windowSize int, prog *progress) ([]byte, error) {
+	var out bytes.Buffer
+	err := readWindows(new, make([]byte, windowSize), func(p []byte) error {
+		if err := enc.write(p, &out); err != nil {
+			return err
+		}
+		prog.add(len(p))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.finish(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// SignatureIndex 解析过并建好索引的签名，用于对同一份签名生成大量补丁（例如服务端对同一个发布版本的所有客户端）：
+// 签名只在 LoadSignature 中解析一次，每次 Delta 只需要编码新数据
+// SignatureIndex 是并发安全的，多个 goroutine 可以同时调用 Delta；不再使用时必须调用 Close 释放原生内存
+type SignatureIndex struct {
+	mu         sync.RWMutex
+	enc        *nativeSourceEncoder
+	encoding   encoding
+	windowSize int
+}
+
+// LoadSignature 解析 CreateSignature 生成的签名并建立弱校验和的查找表；返回后调用方可以随意修改或丢弃 sig
+// opts 与 DeltaFromSignature 相同（WithProgress 除外），对之后所有的 Delta 生效；
+// 签名损坏时返回 ErrCorruptPatch，版本不认识时返回 ErrUnsupportedPatch
+func LoadSignature(sig []byte, opts ...Option) (*SignatureIndex, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkIndexedBSDiff(); err != nil {
+		return nil, err
+	}
+	enc, err := newNativeSourceEncoderFromSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	return &SignatureIndex{enc: enc, encoding: o.encoding(), windowSize: o.windowSize}, nil
+}
+
+// Delta 与 DeltaFromSignature 相同，但使用已经建好的索引；可以与其他 Delta 并发调用，Close 之后返回 ErrClosed
+func (x *SignatureIndex) Delta(new io.Reader) ([]byte, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if x.enc == nil {
+		return nil, ErrClosed
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	enc, err := x.enc.stream(x.encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.close()
+	return encodeDelta(enc, new, x.windowSize, newProgress(nil, -1))
+}
+
+// Close 释放原生层的索引，会等待正在进行的 Delta 结束；重复调用是安全的
+func (x *SignatureIndex) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.enc != nil {
+		x.enc.close()
+		x.enc = nil
+	}
+	return nil
+}
+
+// ApplyDelta 把 DeltaFromSignature 生成的补丁应用到生成签名时的旧数据 old，结果写入 out，
+// 与 ApplyDiffsStream(old, bytes.NewReader(delta), out, opts...) 相同；旧数据与签名不符时
+// 结果是错的，需要校验时在补丁中加上 WithChecksum
+func ApplyDelta(old io.ReaderAt, delta []byte, out io.Writer, opts ...Option) error {
+	return ApplyDiffsStream(old, bytes.NewReader(delta), out, opts...)
+}
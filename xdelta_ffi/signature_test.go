@@ -0,0 +1,249 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// signatureLen 块大小为 bs 时 n 字节旧数据的签名长度：21 字节的头，每块 4 字节弱校验和加 32 字节 SHA-256
+func signatureLen(n, bs int) int {
+	return 21 + (n+bs-1)/bs*36
+}
+
+// TestSignatureRoundTrip 多种块大小下 CreateSignature、DeltaFromSignature、ApplyDelta 的完整流程还原新数据，
+// 其中插入和删除的长度不是块大小的整数倍，之后的内容都不再按块对齐；签名带 magic、版本和块大小，
+// 补丁与同样块大小、不检测只追加时的 CreateDiffs 相同
+func TestSignatureRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(256 << 10)
+	at := len(oldData) / 3
+	for _, bs := range []int{1, 16, 64, 333, int(DefaultBlockSize), 16 << 10, int(AutoBlockSize)} {
+		for _, tc := range []struct {
+			name             string
+			oldData, newData []byte
+		}{
+			{"text edits", oldData, newData},
+			{"insert 3 bytes", oldData, append(append(bytes.Clone(oldData[:at]), "abc"...), oldData[at:]...)},
+			{"delete 7 bytes", oldData, append(bytes.Clone(oldData[:at]), oldData[at+7:]...)},
+			{"prepend 1 byte", oldData, append([]byte{'x'}, oldData...)},
+			{"append partial block", oldData, append(bytes.Clone(oldData), oldData[:bs/2+1]...)},
+			{"unaligned old", oldData[:len(oldData)-5], newData},
+			{"to empty", oldData, nil},
+			{"from empty", nil, newData},
+		} {
+			sig, err := CreateSignature(bytes.NewReader(tc.oldData), bs)
+			if err != nil {
+				t.Fatalf("block size %d, %s: %v", bs, tc.name, err)
+			}
+			used := bs
+			if bs == int(AutoBlockSize) {
+				used = int(binary.LittleEndian.Uint32(sig[9:]))
+			}
+			if !bytes.HasPrefix(sig, []byte("\x89XDSUM\r\n\x01")) || binary.LittleEndian.Uint32(sig[9:]) != uint32(used) || len(sig) != signatureLen(len(tc.oldData), used) {
+				t.Fatalf("block size %d, %s: %d byte signature with header % x", bs, tc.name, len(sig), sig[:min(len(sig), 21)])
+			}
+			delta, err := DeltaFromSignature(sig, bytes.NewReader(tc.newData))
+			if err != nil {
+				t.Fatalf("block size %d, %s: %v", bs, tc.name, err)
+			}
+			var out bytes.Buffer
+			if err := ApplyDelta(bytes.NewReader(tc.oldData), delta, &out); err != nil || !bytes.Equal(out.Bytes(), tc.newData) {
+				t.Fatalf("block size %d, %s: ApplyDelta returned %d bytes, %v", bs, tc.name, out.Len(), err)
+			}
+			want, err := CreateDiffs(tc.oldData, tc.newData, WithBlockSize(uint32(used)), WithAppendDetection(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(delta, want) {
+				t.Fatalf("block size %d, %s: %d byte delta differs from CreateDiffs (%d bytes)", bs, tc.name, len(delta), len(want))
+			}
+			// 滚动弱校验和在任意偏移上找到旧数据的块，未对齐的改动不会让补丁接近新数据的大小
+			// （块很小时每个 COPY 记录的开销与块相当，补丁本来就大）
+			if len(tc.oldData) > 0 && len(tc.newData) > 0 && used >= 64 && used <= int(DefaultBlockSize) && len(delta) > len(tc.newData)/4 {
+				t.Fatalf("block size %d, %s: %d byte delta for %d bytes of new data", bs, tc.name, len(delta), len(tc.newData))
+			}
+		}
+	}
+}
+
+// TestSignatureInvalid 块大小超出范围返回 ErrInvalidArgument，签名截断或被改动返回 ErrCorruptPatch，
+// 版本不认识返回 ErrUnsupportedPatch；带校验和的补丁应用到与签名不符的旧数据时报告校验失败
+func TestSignatureInvalid(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(64 << 10)
+	for _, bs := range []int{-1, int(MaxBlockSize) + 1} {
+		if _, err := CreateSignature(bytes.NewReader(oldData), bs); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("block size %d: got %v, want ErrInvalidArgument", bs, err)
+		}
+	}
+	sig, err := CreateSignature(bytes.NewReader(oldData), int(DefaultBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(i int, b byte) []byte {
+		s := bytes.Clone(sig)
+		s[i] = b
+		return s
+	}
+	for _, tc := range []struct {
+		name string
+		sig  []byte
+		want error
+	}{
+		{"empty", nil, ErrCorruptPatch},
+		{"magic", set(1, 'Y'), ErrCorruptPatch},
+		{"version", set(8, 2), ErrUnsupportedPatch},
+		{"truncated header", sig[:15], ErrCorruptPatch},
+		{"truncated blocks", sig[:len(sig)-1], ErrCorruptPatch},
+		{"block count", set(13, sig[13]+1), ErrCorruptPatch},
+		{"block size", append(append(bytes.Clone(sig[:9]), 0, 0, 0, 0), sig[13:]...), ErrCorruptPatch},
+		{"a patch", patch, ErrCorruptPatch},
+	} {
+		if _, err := DeltaFromSignature(tc.sig, bytes.NewReader(newData)); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	delta, err := DeltaFromSignature(sig, bytes.NewReader(newData), WithChecksum(ChecksumXXH3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Clone(oldData)
+	changed[len(changed)/4] ^= 1
+	if err := ApplyDelta(bytes.NewReader(changed), delta, &bytes.Buffer{}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("old data that does not match the signature: got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+// TestSignatureIndex 同一个 SignatureIndex 被几十个 goroutine 同时用于各自的新数据，每个补丁都与
+// DeltaFromSignature 相同并能还原；WithChecksum 对之后的每个 Delta 生效，Close 会等待正在进行的 Delta，
+// 之后返回 ErrClosed，重复 Close 是安全的，原生句柄全部释放
+func TestSignatureIndex(t *testing.T) {
+	requireNative(t)
+	base, _ := textFixture(256 << 10)
+	sig, err := CreateSignature(bytes.NewReader(base), int(DefaultBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := DebugAllocStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := LoadSignature(sig, WithChecksum(ChecksumXXH3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 载入之后签名的内容不再被使用
+	for i := range sig {
+		sig[i] = 0
+	}
+	workers := 32
+	if testing.Short() {
+		workers = 8
+	}
+	fresh, err := CreateSignature(bytes.NewReader(base), int(DefaultBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for g := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, newData := stressPair(base, g)
+			for range 4 {
+				delta, err := x.Delta(bytes.NewReader(newData))
+				if err != nil {
+					errs <- fmt.Errorf("goroutine %d: %w", g, err)
+					return
+				}
+				want, err := DeltaFromSignature(fresh, bytes.NewReader(newData), WithChecksum(ChecksumXXH3))
+				if err != nil || !bytes.Equal(delta, want) {
+					errs <- fmt.Errorf("goroutine %d: %d byte delta differs from DeltaFromSignature (%d bytes, %v)", g, len(delta), len(want), err)
+					return
+				}
+				var out bytes.Buffer
+				if err := ApplyDelta(bytes.NewReader(base), delta, &out); err != nil || !bytes.Equal(out.Bytes(), newData) {
+					errs <- fmt.Errorf("goroutine %d: ApplyDelta returned %d bytes, %v", g, out.Len(), err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// 与 Close 并发的 Delta 要么正常完成，要么返回 ErrClosed
+	results := make(chan error, workers)
+	for g := range workers {
+		go func() {
+			_, newData := stressPair(base, g)
+			_, err := x.Delta(bytes.NewReader(newData))
+			results <- err
+		}()
+	}
+	x.Close()
+	for range workers {
+		if err := <-results; err != nil && !errors.Is(err, ErrClosed) {
+			t.Errorf("Delta during Close: %v", err)
+		}
+	}
+	if _, err := x.Delta(bytes.NewReader(base)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Delta after Close: got %v, want ErrClosed", err)
+	}
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := DebugAllocStats(); err != nil || s.LiveHandles != before.LiveHandles {
+		t.Fatalf("after Close: %d live handles, %d before (%v)", s.LiveHandles, before.LiveHandles, err)
+	}
+	if _, err := LoadSignature(fresh[:30]); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("LoadSignature of a truncated signature: got %v, want ErrCorruptPatch", err)
+	}
+}
+
+// BenchmarkSignatureIndex 对同一份 64 MiB 旧数据的签名生成补丁：DeltaFromSignature 每次解析签名、建立查找表，
+// SignatureIndex.Delta 只编码新数据；新数据是一个 64 KiB 的小文件时两者的差距最明显
+func BenchmarkSignatureIndex(b *testing.B) {
+	requireNative(b)
+	r := fixtureRand(79)
+	old := bytes.Join(fixtureLines(&r, 64<<20), nil)
+	sig, err := CreateSignature(bytes.NewReader(old), int(DefaultBlockSize))
+	if err != nil {
+		b.Fatal(err)
+	}
+	newData := append(bytes.Clone(old[1<<20:1<<20+32<<10]), old[40<<20:40<<20+32<<10]...)
+	b.Run("DeltaFromSignature", func(b *testing.B) {
+		b.SetBytes(int64(len(newData)))
+		for b.Loop() {
+			if _, err := DeltaFromSignature(sig, bytes.NewReader(newData)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SignatureIndex", func(b *testing.B) {
+		x, err := LoadSignature(sig)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer x.Close()
+		b.SetBytes(int64(len(newData)))
+		for b.Loop() {
+			if _, err := x.Delta(bytes.NewReader(newData)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package xdelta_ffi
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// SourceDecoder 绑定到一份旧数据的解码器，用于把大量补丁应用到同一份旧数据，
+// 例如 CDN 边缘节点常驻内存的热门基础版本：旧数据只在 NewSourceDecoder 中复制到原生层一次，每次 Apply 不再传递或固定它
+// SourceDecoder 是并发安全的，多个 goroutine 可以同时调用 Apply；不再使用时必须调用 Close 释放原生层的副本
+type SourceDecoder struct {
+	mu        sync.RWMutex
+	dec       *nativeSourceDecoder
+	maxOutput uint64
+
+	// 旧数据的长度和 SHA-256，用于校验信封
+	oldLen int64
+	oldSum [sha256.Size]byte
+}
+
+// NewSourceDecoder 把 oldData 复制到原生层并计算其 SHA-256（用于校验信封），返回后调用方可以随意修改或丢弃它
+// opts 中只有 WithMaxOutputSize 有效，对之后所有的 Apply 生效
+func NewSourceDecoder(oldData []byte, opts ...Option) (*SourceDecoder, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newNativeSourceDecoder(oldData)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceDecoder{
+		dec:       dec,
+		maxOutput: o.outputLimit(),
+		oldLen:    int64(len(oldData)),
+		oldSum:    sha256.Sum256(oldData),
+	}, nil
+}
+
+// Apply 把补丁应用到旧数据，结果与 ApplyDiffsData 完全一致；也接受 CreateEnvelope 生成的信封，
+// 校验方式与 ApplyEnvelope 相同（旧数据的 SHA-256 只在创建时计算一次）
+// 也接受 bsdiff 补丁；可以与其他 Apply 并发调用，Close 之后返回 ErrClosed
+func (d *SourceDecoder) Apply(patch []byte) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.dec == nil {
+		return nil, ErrClosed
+	}
+	if !IsEnvelope(patch) {
+		return d.apply(patch)
+	}
+	h, inner, err := ParseEnvelope(patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkSourceSize(d.oldLen); err != nil {
+		return nil, err
+	}
+	if h.SourceSHA256 != d.oldSum {
+		return nil, fmt.Errorf("%w: source SHA-256 differs from the envelope", ErrSourceMismatch)
+	}
+	if err := h.checkLimit(d.maxOutput); err != nil {
+		return nil, err
+	}
+	newData, err := d.apply(inner)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.checkTarget(int64(len(newData)), sha256.Sum256(newData)); err != nil {
+		return nil, err
+	}
+	return newData, nil
+}
+
+func (d *SourceDecoder) apply(patch []byte) ([]byte, error) {
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// 与 ApplyDiffsData 一样按补丁声明的长度直接解码到 Go 的内存中，原生层不分配也不复制输出
+	return decodePresized(appendTo(nil), d.oldLen, patch, d.maxOutput, func(dst []byte) error {
+		return d.dec.applyExact(dst, patch, nil)
+	})
+}
+
+// Close 释放原生层的旧数据副本，会等待正在进行的 Apply 结束；重复调用是安全的
+func (d *SourceDecoder) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dec != nil {
+		d.dec.close()
+		d.dec = nil
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// sourcePatches 从 oldData 到每个变体的补丁，轮流使用本库格式、二次压缩、VCDIFF、bsdiff 和信封
+func sourcePatches(tb testing.TB, oldData []byte, variants [][]byte) [][]byte {
+	tb.Helper()
+	formats := [][]Option{nil, {WithSecondaryCompression(SecondaryZstd)}, {WithStandardVCDIFF()}, {WithBSDiff()}, {WithChecksum(ChecksumXXH3)}}
+	patches := make([][]byte, len(variants))
+	for i, v := range variants {
+		var err error
+		if i%6 == 5 {
+			patches[i], err = CreateEnvelope(oldData, v)
+		} else {
+			patches[i], err = CreateDiffs(oldData, v, formats[i%6]...)
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return patches
+}
+
+// TestSourceDecoderApply Apply 的结果与 ApplyDiffsData 完全相同，包括信封和 bsdiff 补丁；
+// 信封记录的旧数据不是这份旧数据时返回 ErrSourceMismatch，WithMaxOutputSize 对每次 Apply 生效
+func TestSourceDecoderApply(t *testing.T) {
+	requireNative(t)
+	oldData, _ := textFixture(256 << 10)
+	variants := sourceVariants(oldData, 12)
+	patches := sourcePatches(t, oldData, variants)
+	sd, err := NewSourceDecoder(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	for i, p := range patches {
+		got, err := sd.Apply(p)
+		if err != nil {
+			t.Fatalf("patch %d: %v", i, err)
+		}
+		if !bytes.Equal(got, variants[i]) {
+			t.Fatalf("patch %d: got %d bytes, want %d", i, len(got), len(variants[i]))
+		}
+	}
+	if _, err := sd.Apply([]byte("garbage")); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("corrupt patch: got %v, want ErrCorruptPatch", err)
+	}
+	other, err := CreateEnvelope(variants[0], variants[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sd.Apply(other); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("envelope for another source: got %v, want ErrSourceMismatch", err)
+	}
+
+	limited, err := NewSourceDecoder(oldData, WithMaxOutputSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+	for i, p := range patches[:6] {
+		if _, err := limited.Apply(p); !errors.Is(err, ErrOutputTooLarge) {
+			t.Fatalf("patch %d with WithMaxOutputSize: got %v, want ErrOutputTooLarge", i, err)
+		}
+	}
+}
+
+// TestSourceDecoderStress 16 个 goroutine 同时对同一个 SourceDecoder 应用不同格式的补丁，夹杂损坏和不匹配的补丁，
+// 每个调用都得到自己的结果或错误；最后 Close 与仍在进行的 Apply 并发，之后 Apply 返回 ErrClosed
+func TestSourceDecoderStress(t *testing.T) {
+	requireNative(t)
+	oldData, _ := textFixture(256 << 10)
+	variants := sourceVariants(oldData, 12)
+	patches := sourcePatches(t, oldData, variants)
+	truncated := patches[0][:len(patches[0])/2]
+	sd, err := NewSourceDecoder(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterations := 60
+	if testing.Short() {
+		iterations = 10
+	}
+	var wg sync.WaitGroup
+	for g := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				k := (g*5 + i) % len(patches)
+				if (g+i)%7 == 0 {
+					if _, err := sd.Apply(truncated); !errors.Is(err, ErrCorruptPatch) {
+						t.Errorf("goroutine %d: truncated patch: got %v, want ErrCorruptPatch", g, err)
+						return
+					}
+					continue
+				}
+				got, err := sd.Apply(patches[k])
+				if err != nil {
+					t.Errorf("goroutine %d: patch %d: %v", g, k, err)
+					return
+				}
+				if !bytes.Equal(got, variants[k]) {
+					t.Errorf("goroutine %d: patch %d gave %d bytes, want %d", g, k, len(got), len(variants[k]))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	errs := make(chan error, 4)
+	for g := range 4 {
+		go func() {
+			var err error
+			for err == nil {
+				_, err = sd.Apply(patches[g])
+			}
+			errs <- err
+		}()
+	}
+	if err := sd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		if err := <-errs; !errors.Is(err, ErrClosed) {
+			t.Fatalf("Apply racing with Close: got %v, want ErrClosed", err)
+		}
+	}
+	if err := sd.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+// BenchmarkSourceDecoder 并发地把小补丁应用到同一份 16 MiB 的旧数据：ApplyDiffsData 每次固定并传递旧数据，
+// SourceDecoder 只在创建时复制一次
+func BenchmarkSourceDecoder(b *testing.B) {
+	requireNative(b)
+	oldData, _ := textFixture(16 << 20)
+	variants := sourceVariants(oldData, 8)
+	patches := make([][]byte, len(variants))
+	for i, v := range variants {
+		var err error
+		if patches[i], err = CreateDiffs(oldData, v); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Run("ApplyDiffsData", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, err := ApplyDiffsData(oldData, patches[i%len(patches)]); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("SourceDecoder", func(b *testing.B) {
+		sd, err := NewSourceDecoder(oldData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer sd.Close()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, err := sd.Apply(patches[i%len(patches)]); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,70 @@
+package xdelta_ffi
+
+import "sync"
+
+// SourceEncoder 绑定到一份旧数据的编码器，用于把大量新数据与同一份旧数据比较，
+// 例如同一个基础资源的上千个本地化版本：旧数据只在 NewSourceEncoder 中建立一次块签名，每次 Diff 只需要编码新数据
+// SourceEncoder 是并发安全的，多个 goroutine 可以同时调用 Diff；不再使用时必须调用 Close 释放原生内存
+type SourceEncoder struct {
+	mu        sync.RWMutex
+	enc       *nativeSourceEncoder
+	blockSize uint32
+	encoding  encoding
+}
+
+// NewSourceEncoder 对 oldData 建立块签名；原生层只保存签名，不复制也不引用 oldData，返回后调用方可以随意修改或丢弃它
+// opts 中 WithBlockSize、WithSecondaryCompression、WithCompressionLevel、WithStandardVCDIFF 和 WithThreads 有效，
+// 对之后所有的 Diff 生效（WithThreads 同时用于建立签名）；AutoBlockSize 只根据旧数据的大小选择块大小，所选的值见 BlockSize；
+// 不能生成 bsdiff 补丁，使用 WithBSDiff 时返回 ErrInvalidArgument
+func NewSourceEncoder(oldData []byte, opts ...Option) (*SourceEncoder, error) {
+	release, err := useLibrary()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkIndexedBSDiff(); err != nil {
+		return nil, err
+	}
+	blockSize := resolveBlockSize(o.blockSize, int64(len(oldData)), -1)
+	enc, err := newNativeSourceEncoder(oldData, blockSize, o.encodeThreads(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceEncoder{enc: enc, blockSize: blockSize, encoding: o.encoding()}, nil
+}
+
+// Diff 创建从旧数据到 newData 的补丁，结果与以相同的块大小和选项加上 WithAppendDetection(false)（不带 WithContentDefinedChunking）调用 CreateDiffs 完全一致
+// 可以与其他 Diff 并发调用；Close 之后返回 ErrClosed
+func (e *SourceEncoder) Diff(newData []byte) ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.enc == nil {
+		return nil, ErrClosed
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return e.enc.diff(appendTo(nil), newData, e.encoding, nil)
+}
+
+// BlockSize 返回建立签名时实际使用的块大小
+func (e *SourceEncoder) BlockSize() uint32 {
+	return e.blockSize
+}
+
+// Close 释放原生层的块签名，会等待正在进行的 Diff 结束；重复调用是安全的
+func (e *SourceEncoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.enc != nil {
+		e.enc.close()
+		e.enc = nil
+	}
+	return nil
+}
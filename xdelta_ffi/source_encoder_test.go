@@ -0,0 +1,167 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// sourceVariants 同一份旧数据的 n 个变体，像同一个资源的本地化版本：每个变体替换了几处文本，长度各不相同
+func sourceVariants(oldData []byte, n int) [][]byte {
+	r := fixtureRand(11)
+	variants := make([][]byte, n)
+	for i := range variants {
+		v := bytes.Clone(oldData)
+		for k := 0; k < 5; k++ {
+			at := r.intn(len(v))
+			repl := fmt.Appendf(nil, "variant %d edit %d %x", i, k, r.next())
+			v = append(v[:at], append(repl, v[min(len(v), at+r.intn(200)):]...)...)
+		}
+		variants[i] = v
+	}
+	return variants
+}
+
+// TestSourceEncoderDiff Diff 的补丁与以相同的块大小和选项加上 WithAppendDetection(false) 调用 CreateDiffs 逐字节相同，
+// 并且能应用；AutoBlockSize 时 BlockSize 报告实际选用的块大小
+func TestSourceEncoderDiff(t *testing.T) {
+	requireNative(t)
+	oldData, _ := textFixture(1 << 20)
+	variants := sourceVariants(oldData, 4)
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"block size", []Option{WithBlockSize(512)}},
+		{"zstd", []Option{WithSecondaryCompression(SecondaryZstd), WithCompressionLevel(9)}},
+		{"vcdiff", []Option{WithStandardVCDIFF()}},
+		{"threads", []Option{WithThreads(4)}},
+	} {
+		se, err := NewSourceEncoder(oldData, tc.opts...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if se.BlockSize() == AutoBlockSize {
+			t.Fatalf("%s: BlockSize returned AutoBlockSize", tc.name)
+		}
+		for i, v := range variants {
+			got, err := se.Diff(v)
+			if err != nil {
+				t.Fatalf("%s: variant %d: %v", tc.name, i, err)
+			}
+			want, err := CreateDiffs(oldData, v, append(tc.opts, WithBlockSize(se.BlockSize()), WithAppendDetection(false))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: variant %d: Diff returned %d bytes, CreateDiffs %d", tc.name, i, len(got), len(want))
+			}
+			if out, err := ApplyDiffsData(oldData, got); err != nil || !bytes.Equal(out, v) {
+				t.Fatalf("%s: variant %d: applying the patch gave %d bytes, %v", tc.name, i, len(out), err)
+			}
+		}
+		se.Close()
+	}
+	if _, err := NewSourceEncoder(oldData, WithBSDiff()); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("NewSourceEncoder with WithBSDiff: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestSourceEncoderConcurrent 多个 goroutine 同时对同一个 SourceEncoder 调用 Diff，每个结果都与单独调用时相同；
+// Close 等待正在进行的 Diff，之后 Diff 返回 ErrClosed，重复 Close 是安全的
+func TestSourceEncoderConcurrent(t *testing.T) {
+	requireNative(t)
+	oldData, _ := textFixture(256 << 10)
+	variants := sourceVariants(oldData, 16)
+	se, err := NewSourceEncoder(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([][]byte, len(variants))
+	for i, v := range variants {
+		if want[i], err = se.Diff(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 40 {
+				k := (g*7 + i) % len(variants)
+				got, err := se.Diff(variants[k])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(got, want[k]) {
+					t.Errorf("goroutine %d: variant %d differs from the sequential result", g, k)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Close 与仍在进行的 Diff 并发
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		close(started)
+		var err error
+		for err == nil {
+			_, err = se.Diff(variants[0])
+		}
+		done <- err
+	}()
+	<-started
+	if err := se.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ErrClosed) {
+		t.Fatalf("Diff racing with Close: got %v, want ErrClosed", err)
+	}
+	if _, err := se.Diff(variants[0]); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Diff after Close: got %v, want ErrClosed", err)
+	}
+	if err := se.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+// BenchmarkSourceEncoder 把多个变体与同一份旧数据比较：CreateDiffsData 每次重新复制并索引旧数据，
+// SourceEncoder 只建立一次签名（不计入计时）
+func BenchmarkSourceEncoder(b *testing.B) {
+	requireNative(b)
+	oldData, _ := textFixture(16 << 20)
+	variants := sourceVariants(oldData, 8)
+	b.Run("CreateDiffsData", func(b *testing.B) {
+		b.SetBytes(int64(len(oldData)))
+		i := 0
+		for b.Loop() {
+			if _, err := CreateDiffsData(oldData, variants[i%len(variants)], DefaultBlockSize); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+	b.Run("SourceEncoder", func(b *testing.B) {
+		se, err := NewSourceEncoder(oldData, WithBlockSize(DefaultBlockSize))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer se.Close()
+		b.SetBytes(int64(len(oldData)))
+		i := 0
+		for b.Loop() {
+			if _, err := se.Diff(variants[i%len(variants)]); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package xdelta_ffi
+
+import (
+	"runtime"
+	"time"
+)
+
+// DiffStats 一次创建补丁的统计，见 WithDiffStats
+type DiffStats struct {
+	// SourceSize、TargetSize 读取的旧数据和新数据的字节数
+	SourceSize int64
+	TargetSize int64
+	// PatchSize 生成的补丁的字节数（不含 WithReverse 的反向补丁）
+	PatchSize int64
+	// Windows 新数据被分成多少块送入原生层编码：内存接口单线程时为 1，多线程时为 8 MiB 分段的个数，
+	// 流式接口为按 WithWindowSize 读取的块数
+	Windows int
+	// Duration 从开始编码到结束的耗时，不含检查参数和加载原生库
+	Duration time.Duration
+	// ThreadsUsed 实际并行编码的线程数，不会超过分段的个数
+	ThreadsUsed int
+	// Composition 补丁的指令组成，见 Composition
+	Composition
+}
+
+// Composition 补丁由哪些指令组成，用于分析某类数据补丁偏大的原因：CopyBytes 占新数据的比例低说明旧数据中找不到匹配
+// （例如已压缩或加密的数据，或者块大小相对于修改的间隔太大），Instructions 多而 CopyBytes 高说明匹配零碎
+// 内存中的创建、应用接口（CreateDiffs、CreateDiffsDataInto、CreateDiffsFixed、DeltaFromSignature、DeltaFromChunkSignature、
+// ApplyDiffsData 等）在需要统计时（WithDiffStats、WithApplyStats 或 StatsCollector）用 InspectPatch 再解析一遍补丁得到，
+// 耗时计入 Duration 之外；补丁不在内存中的接口（流式、文件）和 CreateDiffsPairs 不统计，各字段为 -1
+type Composition struct {
+	// Instructions 指令个数，与 PatchInfo.Instructions 相同
+	Instructions int64
+	// CopyBytes 从旧数据复制的字节数
+	CopyBytes int64
+	// AddBytes 补丁直接携带的字节数
+	AddBytes int64
+	// RunBytes VCDIFF RUN 指令生成的字节数，本库格式为 0
+	RunBytes int64
+}
+
+// unknownComposition 没有统计时的 Composition
+var unknownComposition = Composition{Instructions: -1, CopyBytes: -1, AddBytes: -1, RunBytes: -1}
+
+// composition 统计 patch 的指令组成，解析失败时返回 unknownComposition
+func composition(patch []byte) Composition {
+	info, err := InspectPatch(patch)
+	if err != nil {
+		return unknownComposition
+	}
+	return Composition{Instructions: info.Instructions, CopyBytes: info.CopyBytes, AddBytes: info.AddBytes, RunBytes: info.RunBytes}
+}
+
+// matchRatio 返回 CopyBytes 与 targetSize 之比，没有统计或新数据为空时返回 0
+func (c Composition) matchRatio(targetSize int64) float64 {
+	if c.CopyBytes < 0 || targetSize <= 0 {
+		return 0
+	}
+	return float64(c.CopyBytes) / float64(targetSize)
+}
+
+// MatchRatio 返回新数据中从旧数据复制的比例（CopyBytes / TargetSize），没有统计或新数据为空时返回 0
+func (s DiffStats) MatchRatio() float64 {
+	return s.matchRatio(s.TargetSize)
+}
+
+// Ratio 返回补丁与新数据的长度之比，新数据为空时返回 0
+func (s DiffStats) Ratio() float64 {
+	if s.TargetSize <= 0 {
+		return 0
+	}
+	return float64(s.PatchSize) / float64(s.TargetSize)
+}
+
+// ApplyStats 一次应用补丁的统计，见 WithApplyStats
+type ApplyStats struct {
+	// SourceSize 旧数据的长度，ApplyDiffsStream 无法得知 old 的长度时为 -1
+	SourceSize int64
+	// PatchSize 读取的补丁的字节数
+	PatchSize int64
+	// TargetSize 生成的新数据的字节数
+	TargetSize int64
+	// Windows 补丁被分成多少块送入原生层解码：内存接口为 1，ApplyDiffsStream、ApplyDiffs 为按 WithWindowSize 读取的块数
+	Windows int
+	// Duration 从开始解码到结束的耗时，不含检查参数和加载原生库
+	Duration time.Duration
+	// Composition 补丁的指令组成，见 Composition
+	Composition
+}
+
+// MatchRatio 返回新数据中从旧数据复制的比例（CopyBytes / TargetSize），没有统计或新数据为空时返回 0
+func (s ApplyStats) MatchRatio() float64 {
+	return s.matchRatio(s.TargetSize)
+}
+
+// StatsCollector 可以由传给 SetMetricsCollector 的 Collector 额外实现：每个成功的、会写出 WithDiffStats 或 WithApplyStats
+// 统计的操作结束时（OpFinish 之前），把同样的统计交给 DiffFinished 或 ApplyFinished，
+// 不需要在每次调用时设置选项；实现了这个接口时，内存接口总会统计 Composition
+type StatsCollector interface {
+	Collector
+	DiffFinished(s DiffStats)
+	ApplyFinished(s ApplyStats)
+}
+
+// statsCollector 返回当前实现了 StatsCollector 的 Collector，没有时返回 nil
+func statsCollector() StatsCollector {
+	h := metricsCollector.Load()
+	if h == nil {
+		return nil
+	}
+	sc, _ := h.c.(StatsCollector)
+	return sc
+}
+
+// WithDiffStats 在 CreateDiffs（包括 CreateDiffsBatch 的内存任务）、CreateDiffsStream 或 CreateDiffsFromStream 成功后把统计写入 *stats，失败时不修改；
+// 对其他接口没有影响（文件版本的大小见 CreateDiffsFileStats），stats 为 nil 时忽略
+func WithDiffStats(stats *DiffStats) Option {
+	return func(o *options) {
+		o.diffStats = stats
+	}
+}
+
+// WithApplyStats 在 ApplyDiffsData、ApplyDiffsDataInto、ApplyDiffsDataContext、ApplyDiffsDataPooled、
+// ApplyDiffsStream 或 ApplyDiffs 成功后把统计写入 *stats，失败时不修改；
+// 对其他接口没有影响（文件版本的大小见 ApplyDiffsFileStats），stats 为 nil 时忽略
+func WithApplyStats(stats *ApplyStats) Option {
+	return func(o *options) {
+		o.applyStats = stats
+	}
+}
+
+// parallelPieces 返回多线程编码 newLen 字节新数据时的分段数和实际使用的线程数，与原生层的分段规则一致
+func parallelPieces(threads int, newLen int64) (pieces, used int) {
+	if threads == 1 {
+		return 1, 1
+	}
+	if threads == 0 {
+		threads = min(runtime.NumCPU(), MaxThreads)
+	}
+	pieces = int(max((newLen+parallelChunk-1)/parallelChunk, 1))
+	return pieces, min(threads, pieces)
+}
+
+// recordDiff 设置了 WithDiffStats 时写入 s，并报告给 StatsCollector，Duration 为从 start 开始的耗时；不统计 Composition
+func (o options) recordDiff(s DiffStats, start time.Time) {
+	o.storeDiff(s, nil, start)
+}
+
+// recordDiffPatch 与 recordDiff 相同，需要统计时从生成的补丁 patch 统计 Composition
+func (o options) recordDiffPatch(s DiffStats, patch []byte, start time.Time) {
+	o.storeDiff(s, patch, start)
+}
+
+func (o options) storeDiff(s DiffStats, patch []byte, start time.Time) {
+	sc := statsCollector()
+	if o.diffStats == nil && sc == nil {
+		return
+	}
+	s.Duration = time.Since(start)
+	s.Composition = unknownComposition
+	if patch != nil {
+		s.Composition = composition(patch)
+	}
+	if o.diffStats != nil {
+		*o.diffStats = s
+	}
+	if sc != nil {
+		sc.DiffFinished(s)
+	}
+}
+
+// recordApply 设置了 WithApplyStats 时写入 s，并报告给 StatsCollector，Duration 为从 start 开始的耗时；不统计 Composition
+func (o options) recordApply(s ApplyStats, start time.Time) {
+	o.storeApply(s, nil, start)
+}
+
+// recordApplyPatch 与 recordApply 相同，需要统计时从应用的补丁 patch 统计 Composition
+func (o options) recordApplyPatch(s ApplyStats, patch []byte, start time.Time) {
+	o.storeApply(s, patch, start)
+}
+
+func (o options) storeApply(s ApplyStats, patch []byte, start time.Time) {
+	sc := statsCollector()
+	if o.applyStats == nil && sc == nil {
+		return
+	}
+	s.Duration = time.Since(start)
+	s.Composition = unknownComposition
+	if patch != nil {
+		s.Composition = composition(patch)
+	}
+	if o.applyStats != nil {
+		*o.applyStats = s
+	}
+	if sc != nil {
+		sc.ApplyFinished(s)
+	}
+}
@@ -0,0 +1,96 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestWithDiffStats CreateDiffs 成功后写入大小、耗时、线程数和与 InspectPatch 相同的指令组成，多线程时 Windows 为分段数；
+// CreateDiffsStream 的 Windows 为按窗口读取的块数，指令组成为 -1；失败时不修改 *stats
+func TestWithDiffStats(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(20 << 20)
+	var s DiffStats
+	patch, err := CreateDiffs(oldData, newData, WithDiffStats(&s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := InspectPatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.SourceSize != int64(len(oldData)) || s.TargetSize != int64(len(newData)) || s.PatchSize != int64(len(patch)) ||
+		s.Windows != 1 || s.ThreadsUsed != 1 || s.Duration <= 0 {
+		t.Fatalf("stats %+v", s)
+	}
+	if s.Composition != (Composition{info.Instructions, info.CopyBytes, info.AddBytes, info.RunBytes}) ||
+		s.CopyBytes+s.AddBytes != s.TargetSize || s.MatchRatio() < 0.5 || s.Ratio() != float64(len(patch))/float64(len(newData)) {
+		t.Fatalf("composition %+v, InspectPatch %+v", s.Composition, info)
+	}
+
+	var mt DiffStats
+	if _, err := CreateDiffs(oldData, newData, WithThreads(4), WithDiffStats(&mt)); err != nil {
+		t.Fatal(err)
+	}
+	if pieces, used := parallelPieces(4, int64(len(newData))); mt.Windows != pieces || mt.ThreadsUsed != used || pieces < 2 {
+		t.Fatalf("4 threads: %d windows and %d threads, want %d and %d", mt.Windows, mt.ThreadsUsed, pieces, used)
+	}
+
+	var st DiffStats
+	const window = 4 << 20
+	var out bytes.Buffer
+	if err := CreateDiffsStream(bytes.NewReader(oldData), bytes.NewReader(newData), &out, WithWindowSize(window), WithDiffStats(&st)); err != nil {
+		t.Fatal(err)
+	}
+	if st.Windows != (len(newData)+window-1)/window || st.PatchSize != int64(out.Len()) || st.TargetSize != int64(len(newData)) ||
+		st.Composition != unknownComposition || st.MatchRatio() != 0 {
+		t.Fatalf("stream stats %+v", st)
+	}
+
+	before := s
+	if _, err := CreateDiffs(oldData, newData, WithBlockSize(MaxBlockSize+1), WithDiffStats(&s)); err == nil || s != before {
+		t.Fatalf("failed call changed the stats to %+v (%v)", s, err)
+	}
+	if _, err := CreateDiffs(oldData, newData, WithDiffStats(nil)); err != nil {
+		t.Fatalf("nil stats: %v", err)
+	}
+}
+
+// TestWithApplyStats ApplyDiffsData 成功后写入三个大小、一个窗口和与 InspectPatch 相同的指令组成；
+// ApplyDiffsStream 的 Windows 为按窗口读取补丁的块数，旧数据长度未知时 SourceSize 为 -1；失败时不修改 *stats
+func TestWithApplyStats(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(4 << 20)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := InspectPatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s ApplyStats
+	if _, err := ApplyDiffsData(oldData, patch, WithApplyStats(&s)); err != nil {
+		t.Fatal(err)
+	}
+	if s.SourceSize != int64(len(oldData)) || s.PatchSize != int64(len(patch)) || s.TargetSize != int64(len(newData)) ||
+		s.Windows != 1 || s.Duration <= 0 || s.Composition != (Composition{info.Instructions, info.CopyBytes, info.AddBytes, info.RunBytes}) {
+		t.Fatalf("stats %+v, InspectPatch %+v", s, info)
+	}
+
+	var st ApplyStats
+	const window = 1 << 10
+	var out bytes.Buffer
+	if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &out, WithWindowSize(window), WithApplyStats(&st)); err != nil {
+		t.Fatal(err)
+	}
+	if st.PatchSize != int64(len(patch)) || st.TargetSize != int64(out.Len()) || st.Windows < (len(patch)+window-1)/window ||
+		st.Composition != unknownComposition {
+		t.Fatalf("stream stats %+v", st)
+	}
+
+	before := s
+	if _, err := ApplyDiffsData(oldData, patch[:len(patch)/2], WithApplyStats(&s)); err == nil || s != before {
+		t.Fatalf("failed call changed the stats to %+v (%v)", s, err)
+	}
+}
@@ -0,0 +1,348 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// stressPair 第 g 个 goroutine 的新旧数据：同一份旧数据加上只属于它的改动，
+// 任何两个 goroutine 的结果混在一起都会被发现
+func stressPair(base []byte, g int) (oldData, newData []byte) {
+	oldData = append(bytes.Clone(base), fmt.Appendf(nil, "goroutine %d old tail\n", g)...)
+	newData = bytes.Clone(oldData)
+	at := (g*7919 + 1000) % (len(newData) - 100)
+	newData = append(newData[:at], append(fmt.Appendf(nil, "edit from goroutine %d", g), newData[at+50:]...)...)
+	return oldData, newData
+}
+
+// TestConcurrentMixedOperations 几十个 goroutine 同时混合调用内存、流式、文件版本的创建和应用、信封、
+// Context 取消、共享的 SourceEncoder 和 SourceDecoder，其中一半是故意失败的调用（补丁截断、输出超过上限、
+// 旧数据不符、内存上限、已取消）；每个结果都与单独调用时相同，每个错误都属于自己的调用（错误信息中带有只属于这个调用的上限）。
+// 用 go test -race 运行时还检查 Go 侧没有数据竞争
+func TestConcurrentMixedOperations(t *testing.T) {
+	requireNative(t)
+	base, _ := textFixture(64 << 10)
+	workers, rounds := 32, 16
+	if testing.Short() {
+		workers, rounds = 8, 8
+	}
+	olds, news, patches := make([][]byte, workers), make([][]byte, workers), make([][]byte, workers)
+	for g := range workers {
+		olds[g], news[g] = stressPair(base, g)
+		var err error
+		if patches[g], err = CreateDiffs(olds[g], news[g]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 所有 goroutine 共用的句柄，各自创建和应用从 base 到自己的新数据的补丁
+	se, err := NewSourceEncoder(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+	sd, err := NewSourceDecoder(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir := t.TempDir()
+
+	ops := []struct {
+		name string
+		run  func(g int) error
+	}{
+		{"CreateDiffs", func(g int) error {
+			got, err := CreateDiffs(olds[g], news[g])
+			if err == nil && !bytes.Equal(got, patches[g]) {
+				err = errors.New("patch differs from the sequential one")
+			}
+			return err
+		}},
+		{"ApplyDiffsData", func(g int) error {
+			got, err := ApplyDiffsData(olds[g], patches[g])
+			if err == nil && !bytes.Equal(got, news[g]) {
+				err = errors.New("output differs")
+			}
+			return err
+		}},
+		{"ApplyDiffsData over the limit", func(g int) error {
+			limit := 1000 + g
+			_, err := ApplyDiffsData(olds[g], patches[g], WithMaxOutputSize(int64(limit)))
+			return wantError(err, ErrOutputTooLarge, fmt.Sprintf("the limit is %d", limit))
+		}},
+		{"ApplyDiffsStream", func(g int) error {
+			var b bytes.Buffer
+			err := ApplyDiffsStream(bytes.NewReader(olds[g]), bytes.NewReader(patches[g]), &b)
+			if err == nil && !bytes.Equal(b.Bytes(), news[g]) {
+				err = errors.New("output differs")
+			}
+			return err
+		}},
+		{"ApplyDiffsStream truncated", func(g int) error {
+			err := ApplyDiffsStream(bytes.NewReader(olds[g]), bytes.NewReader(patches[g][:len(patches[g])/2]), &bytes.Buffer{})
+			return wantError(err, ErrCorruptPatch, "")
+		}},
+		{"ApplyDiffsStream over the limit", func(g int) error {
+			limit := 2000 + g
+			var b bytes.Buffer
+			err := ApplyDiffsStream(bytes.NewReader(olds[g]), bytes.NewReader(patches[g]), &b, WithMaxOutputSize(int64(limit)))
+			return wantError(err, ErrOutputTooLarge, fmt.Sprintf("limit of %d bytes", limit))
+		}},
+		{"ApplyEnvelope wrong source", func(g int) error {
+			env, err := CreateEnvelope(olds[g], news[g])
+			if err != nil {
+				return err
+			}
+			if got, err := ApplyEnvelope(olds[g], env); err != nil || !bytes.Equal(got, news[g]) {
+				return fmt.Errorf("envelope: %d bytes, %v", len(got), err)
+			}
+			_, err = ApplyEnvelope(olds[(g+1)%workers], env)
+			return wantError(err, ErrSourceMismatch, "")
+		}},
+		{"CreateDiffs memory limit", func(g int) error {
+			_, err := CreateDiffs(olds[g], news[g], WithMaxMemory(int64(1+g)))
+			return wantError(err, ErrMemoryLimit, fmt.Sprintf("in %d bytes", 1+g))
+		}},
+		{"Context canceled", func(g int) error {
+			if _, err := CreateDiffsContext(canceled, olds[g], news[g]); !errors.Is(err, context.Canceled) {
+				return fmt.Errorf("CreateDiffsContext: got %v, want context.Canceled", err)
+			}
+			_, err := ApplyDiffsDataContext(canceled, olds[g], patches[g])
+			return wantError(err, context.Canceled, "")
+		}},
+		{"files", func(g int) error {
+			d := filepath.Join(dir, fmt.Sprint(g))
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+			oldPath, newPath, patchPath, outPath := filepath.Join(d, "old"), filepath.Join(d, "new"), filepath.Join(d, "patch"), filepath.Join(d, "out")
+			if err := os.WriteFile(oldPath, olds[g], 0644); err != nil {
+				return err
+			}
+			if err := os.WriteFile(newPath, news[g], 0644); err != nil {
+				return err
+			}
+			if err := CreateDiffsFile(oldPath, newPath, patchPath, DefaultBlockSize); err != nil {
+				return err
+			}
+			if err := ApplyDiffsFile(oldPath, patchPath, outPath); err != nil {
+				return err
+			}
+			if got, err := os.ReadFile(outPath); err != nil || !bytes.Equal(got, news[g]) {
+				return fmt.Errorf("output file: %d bytes, %v", len(got), err)
+			}
+			return nil
+		}},
+		{"shared SourceEncoder and SourceDecoder", func(g int) error {
+			patch, err := se.Diff(news[g])
+			if err != nil {
+				return err
+			}
+			got, err := sd.Apply(patch)
+			if err == nil && !bytes.Equal(got, news[g]) {
+				err = errors.New("output differs")
+			}
+			if err != nil {
+				return err
+			}
+			_, err = sd.Apply(patch[:len(patch)-1])
+			return wantError(err, ErrCorruptPatch, "")
+		}},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for g := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				op := ops[(g+i)%len(ops)]
+				if err := op.run(g); err != nil {
+					errs <- fmt.Errorf("goroutine %d, %s: %w", g, op.name, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if s, err := DebugAllocStats(); err != nil || s.LiveBuffers != 0 || s.LiveBytes != 0 {
+		t.Fatalf("after the stress test: %+v, %v", s, err)
+	}
+}
+
+// wantError err 应是 target，并且信息中带有 msg（为空时不检查）
+func wantError(err, target error, msg string) error {
+	if !errors.Is(err, target) || !strings.Contains(fmt.Sprint(err), msg) {
+		return fmt.Errorf("got %v, want %v containing %q", err, target, msg)
+	}
+	return nil
+}
+
+// TestConcurrentErrorState 原生层的错误信息由每次调用的输出参数返回，没有 last_error 之类的全局状态：几十个 goroutine
+// 通过同一个已加载的原生库同时应用在不同位置截断的补丁、超过各自上限的补丁和正确的补丁，每个错误信息都与单独调用时逐字相同，
+// 成功的调用不会拿到别人的错误；同时有 goroutine 反复调用 Init、Version、NativeStats、DebugAllocStats 和 LibraryPath，
+// 并替换 SetLogger、SetMetricsCollector 设置的回调，SetLogger 返回后旧的回调不再被调用。用 go test -race 运行
+func TestConcurrentErrorState(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(32 << 10)
+	patch, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 单独调用时每个截断位置的错误信息，截断在不同的记录中时信息不同
+	cuts := make([]int, 0, 64)
+	want := make(map[int]string)
+	for k := 1; k < len(patch); k += len(patch)/61 + 1 {
+		_, err := ApplyDiffsData(oldData, patch[:k])
+		if !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("patch truncated to %d bytes: got %v, want ErrCorruptPatch", k, err)
+		}
+		cuts = append(cuts, k)
+		want[k] = err.Error()
+	}
+	if distinct := len(slices.Compact(slices.Sorted(maps.Values(want)))); distinct < 2 {
+		t.Fatalf("only %d distinct error messages for %d truncations", distinct, len(cuts))
+	}
+	path := LibraryPath()
+
+	workers, rounds := 64, 40
+	if testing.Short() {
+		workers, rounds = 16, 10
+	}
+	done := make(chan struct{})
+	var bg sync.WaitGroup
+	bgErrs := make(chan error, 2)
+	bg.Add(2)
+	go func() {
+		defer bg.Done()
+		for {
+			select {
+			case <-done:
+				bgErrs <- nil
+				return
+			default:
+			}
+			if err := Init(); err != nil {
+				bgErrs <- err
+				return
+			}
+			if _, err := Version(); err != nil {
+				bgErrs <- err
+				return
+			}
+			if _, err := NativeStats(); err != nil {
+				bgErrs <- err
+				return
+			}
+			if _, err := DebugAllocStats(); err != nil {
+				bgErrs <- err
+				return
+			}
+			if p := LibraryPath(); p != path {
+				bgErrs <- fmt.Errorf("LibraryPath changed from %s to %s", path, p)
+				return
+			}
+		}
+	}()
+	var stale atomic.Int64
+	go func() {
+		defer bg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				SetLogger(nil)
+				SetMetricsCollector(nil)
+				bgErrs <- nil
+				return
+			default:
+			}
+			var active atomic.Bool
+			active.Store(true)
+			SetLogger(func(level Level, msg string) {
+				if !active.Load() {
+					stale.Add(1)
+				}
+			})
+			if i%2 == 0 {
+				SetMetricsCollector(classCheck{&stale})
+			} else {
+				SetMetricsCollector(nil)
+			}
+			SetLogger(nil)
+			active.Store(false)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for g := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				k := cuts[(g+i)%len(cuts)]
+				if _, err := ApplyDiffsData(oldData, patch[:k], WithVerboseLogging()); err == nil || err.Error() != want[k] {
+					errs <- fmt.Errorf("goroutine %d: patch truncated to %d bytes: got %v, want %q", g, k, err, want[k])
+					return
+				}
+				limit := 1000 + g*rounds + i
+				err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), io.Discard, WithMaxOutputSize(int64(limit)))
+				if err := wantError(err, ErrOutputTooLarge, fmt.Sprintf("limit of %d bytes", limit)); err != nil {
+					errs <- fmt.Errorf("goroutine %d: %w", g, err)
+					return
+				}
+				if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+					errs <- fmt.Errorf("goroutine %d: correct patch gave %d bytes, %v", g, len(got), err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	bg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	for range 2 {
+		if err := <-bgErrs; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := stale.Load(); n > 0 {
+		t.Errorf("%d callbacks after they were replaced or with the wrong error class", n)
+	}
+	if s, err := DebugAllocStats(); err != nil || s.LiveBuffers != 0 || s.LiveBytes != 0 {
+		t.Fatalf("after the test: %+v, %v", s, err)
+	}
+}
+
+// classCheck 检查每个结果的 ErrorClass 与 Err 一致的 Collector，不一致时计入 bad
+type classCheck struct{ bad *atomic.Int64 }
+
+func (classCheck) OpStart(OpInfo) {}
+
+func (c classCheck) OpFinish(res OpResult) {
+	if res.ErrorClass != ErrorClass(res.Err) {
+		c.bad.Add(1)
+	}
+}
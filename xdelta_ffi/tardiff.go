@@ -0,0 +1,379 @@
+package xdelta_ffi
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+)
+
+// tar 补丁的格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'T' 'A' 'R' 0D 0A
+//	version      1 字节  当前为 1
+//	source size  8 字节
+//	source hash 32 字节  旧 tar 的 SHA-256
+//	记录                 按顺序产生新 tar 的各个片段，每条以 1 字节的类型开头：
+//	  1 same   old index 4 字节                      与旧 tar 的第 index 个片段相同
+//	  2 diff   old index 4 字节、patch 长度 8 字节、patch  把 patch 应用到旧 tar 的第 index 个片段（FFFFFFFF 为空数据）
+//	  0 end    target size 8 字节、target hash 32 字节  新 tar 的长度和 SHA-256
+//
+// 片段是 tar 的原始字节：每个条目的头（包括前一个条目内容的填充、PAX 和 GNU 长文件名等扩展头）、条目的内容，
+// 以及最后的结束块和其后的所有数据；片段按原样拼接就是原来的 tar，因此应用的结果与新 tar 逐字节相同
+var tarDiffMagic = []byte{0x89, 'X', 'D', 'T', 'A', 'R', 0x0D, 0x0A}
+
+const (
+	// TarDiffVersion CreateTarDiff 写入的 tar 补丁格式版本
+	TarDiffVersion = 1
+
+	tarDiffHeaderLen = 8 + 1 + 8 + sha256.Size
+
+	tarOpEnd  = 0
+	tarOpSame = 1
+	tarOpDiff = 2
+
+	// tarNoBase diff 记录不引用旧片段，patch 从空数据生成
+	tarNoBase uint32 = 1<<32 - 1
+)
+
+// tarSegment tar 的一个片段；name 为头和内容所属条目的路径，结尾的片段为空
+type tarSegment struct {
+	data   []byte
+	name   string
+	header bool
+}
+
+// tarRecorder 记录 archive/tar 从 r 读取的原始字节
+type tarRecorder struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (t *tarRecorder) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.buf = append(t.buf, p[:n]...)
+	return n, err
+}
+
+// take 返回上次 take 之后读取的字节
+func (t *tarRecorder) take() []byte {
+	b := t.buf
+	t.buf = nil
+	return b
+}
+
+// splitTar 用 archive/tar 解析 r，按顺序对每个片段调用 fn：每个条目的头和内容（含补齐到 512 字节的填充），最后是结尾
+// archive/tar 在下一次 Next 时才跳过上一个条目的填充，这里把它从下一个片段移回内容，使条目换了位置时头不变
+func splitTar(r io.Reader, fn func(tarSegment) error) error {
+	rec := &tarRecorder{r: r}
+	tr := tar.NewReader(rec)
+	var content *tarSegment
+	// flush 交出上一个条目的内容，返回之后读取的字节
+	flush := func() ([]byte, error) {
+		b := rec.take()
+		if content == nil {
+			return b, nil
+		}
+		pad := min(int(-len(content.data)&511), len(b))
+		content.data = append(content.data, b[:pad]...)
+		err := fn(*content)
+		content = nil
+		return b[pad:], err
+	}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		b, err := flush()
+		if err != nil {
+			return err
+		}
+		if err := fn(tarSegment{data: b, name: hdr.Name, header: true}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return err
+		}
+		content = &tarSegment{data: rec.take(), name: hdr.Name}
+	}
+	if _, err := io.Copy(io.Discard, rec); err != nil {
+		return err
+	}
+	b, err := flush()
+	if err != nil {
+		return err
+	}
+	return fn(tarSegment{data: b})
+}
+
+// tarSource 旧 tar 的全部片段，以及按路径找到条目的头和内容片段的索引
+type tarSource struct {
+	segments []tarSegment
+	entries  map[string]int
+	size     int64
+	sum      [sha256.Size]byte
+}
+
+// readTarSource 读取并拆分整个旧 tar，同时计算长度和 SHA-256；同一路径出现多次时按最后一次匹配
+func readTarSource(r io.Reader) (*tarSource, error) {
+	h := sha256.New()
+	cw := &countingWriter{w: h}
+	s := &tarSource{entries: make(map[string]int)}
+	err := splitTar(io.TeeReader(r, cw), func(seg tarSegment) error {
+		if uint64(len(s.segments)) == uint64(tarNoBase) {
+			return fmt.Errorf("more than %d segments", tarNoBase)
+		}
+		if seg.header {
+			s.entries[seg.name] = len(s.segments)
+		}
+		s.segments = append(s.segments, seg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.size = cw.n
+	h.Sum(s.sum[:0])
+	return s, nil
+}
+
+// base 返回新 tar 的片段 seg 对应的旧片段：同一路径的条目的头或内容、结尾对结尾，没有时返回 tarNoBase
+func (s *tarSource) base(seg tarSegment) uint32 {
+	if seg.name == "" && !seg.header {
+		return uint32(len(s.segments) - 1)
+	}
+	i, ok := s.entries[seg.name]
+	if !ok {
+		return tarNoBase
+	}
+	if !seg.header {
+		i++
+	}
+	return uint32(i)
+}
+
+func (s *tarSource) data(i uint32) []byte {
+	if i == tarNoBase {
+		return nil
+	}
+	return s.segments[i].data
+}
+
+// CreateTarDiff 创建从 tar 归档 oldTar 到 newTar 的补丁并写入 out，条目按路径匹配、逐个生成补丁
+func CreateTarDiff(oldTar, newTar io.Reader, out io.Writer, opts ...Option) error {
+	if err := Init(); err != nil {
+		return err
+	}
+	if _, err := newOptions(opts); err != nil {
+		return err
+	}
+	src, err := readTarSource(oldTar)
+	if err != nil {
+		return fmt.Errorf("%w: old tar: %v", ErrInvalidArgument, err)
+	}
+	bw := bufio.NewWriter(out)
+	head := append([]byte{}, tarDiffMagic...)
+	head = append(head, TarDiffVersion)
+	head = binary.LittleEndian.AppendUint64(head, uint64(src.size))
+	head = append(head, src.sum[:]...)
+	if _, err := bw.Write(head); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	var size int64
+	var rec []byte
+	// werr 是差分或写出的错误，splitTar 返回的其他错误来自解析新 tar
+	var werr error
+	err = splitTar(io.TeeReader(newTar, h), func(seg tarSegment) error {
+		size += int64(len(seg.data))
+		base := src.base(seg)
+		old := src.data(base)
+		if base != tarNoBase && bytes.Equal(old, seg.data) {
+			rec = binary.LittleEndian.AppendUint32(append(rec[:0], tarOpSame), base)
+			_, werr = bw.Write(rec)
+			return werr
+		}
+		patch, err := CreateDiffs(old, seg.data, opts...)
+		if err != nil {
+			werr = err
+			return err
+		}
+		rec = binary.LittleEndian.AppendUint32(append(rec[:0], tarOpDiff), base)
+		rec = binary.LittleEndian.AppendUint64(rec, uint64(len(patch)))
+		if _, werr = bw.Write(rec); werr == nil {
+			_, werr = bw.Write(patch)
+		}
+		return werr
+	})
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: new tar: %v", ErrInvalidArgument, err)
+	}
+	rec = binary.LittleEndian.AppendUint64(append(rec[:0], tarOpEnd), uint64(size))
+	rec = h.Sum(rec)
+	if _, err := bw.Write(rec); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ApplyTarDiff 把 CreateTarDiff 生成的补丁应用到 oldTar，把新归档写入 out
+func ApplyTarDiff(oldTar io.Reader, patch io.Reader, out io.Writer, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	pr := bufio.NewReader(patch)
+	head := make([]byte, tarDiffHeaderLen)
+	if _, err := io.ReadFull(pr, head[:len(tarDiffMagic)+1]); err != nil || !bytes.HasPrefix(head, tarDiffMagic) {
+		return fmt.Errorf("%w: missing tar diff magic", ErrCorruptPatch)
+	}
+	if v := head[len(tarDiffMagic)]; v != TarDiffVersion {
+		return fmt.Errorf("%w: tar diff version %d", ErrUnsupportedPatch, v)
+	}
+	if _, err := io.ReadFull(pr, head[len(tarDiffMagic)+1:]); err != nil {
+		return fmt.Errorf("%w: truncated tar diff header", ErrCorruptPatch)
+	}
+	src, err := readTarSource(oldTar)
+	if err != nil {
+		return fmt.Errorf("%w: old tar: %v", ErrSourceMismatch, err)
+	}
+	b := head[len(tarDiffMagic)+1:]
+	if size := binary.LittleEndian.Uint64(b); size != uint64(src.size) {
+		return fmt.Errorf("%w: old tar is %d bytes, the patch expects %d", ErrSourceMismatch, src.size, size)
+	}
+	if !bytes.Equal(b[8:], src.sum[:]) {
+		return fmt.Errorf("%w: SHA-256 of the old tar differs from the patch", ErrSourceMismatch)
+	}
+
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	budget := newDiffBudget(o, opts, "tar")
+	var size int64
+	for {
+		op, err := pr.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: truncated tar diff", ErrCorruptPatch)
+		}
+		switch op {
+		case tarOpEnd:
+			return checkDiffEnd(pr, size, h, "tar")
+		case tarOpSame, tarOpDiff:
+		default:
+			return fmt.Errorf("%w: unknown tar diff record %d", ErrCorruptPatch, op)
+		}
+		var idx [4]byte
+		if _, err := io.ReadFull(pr, idx[:]); err != nil {
+			return fmt.Errorf("%w: truncated tar diff", ErrCorruptPatch)
+		}
+		base := binary.LittleEndian.Uint32(idx[:])
+		if (base != tarNoBase || op == tarOpSame) && uint64(base) >= uint64(len(src.segments)) {
+			return fmt.Errorf("%w: tar diff references segment %d of %d", ErrCorruptPatch, base, len(src.segments))
+		}
+		seg := src.data(base)
+		if op == tarOpDiff {
+			p, err := readRecordPatch(pr, "tar")
+			if err != nil {
+				return err
+			}
+			if seg, err = ApplyDiffsData(seg, p, budget.patchOpts()...); err != nil {
+				return err
+			}
+		}
+		if err := budget.add(len(seg)); err != nil {
+			return err
+		}
+		if _, err := w.Write(seg); err != nil {
+			return err
+		}
+		size += int64(len(seg))
+	}
+}
+
+// readRecordPatch 读取 tar、zip 补丁的记录中带长度的补丁，kind 用于错误信息；长度来自补丁本身，按实际读到的数据分配内存
+func readRecordPatch(r io.Reader, kind string) ([]byte, error) {
+	var n [8]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, fmt.Errorf("%w: truncated %s diff", ErrCorruptPatch, kind)
+	}
+	size := binary.LittleEndian.Uint64(n[:])
+	p, err := io.ReadAll(io.LimitReader(r, int64(min(size, 1<<62))))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(p)) != size {
+		return nil, fmt.Errorf("%w: truncated %s diff", ErrCorruptPatch, kind)
+	}
+	return p, nil
+}
+
+// checkDiffEnd 读取 tar、zip 补丁的 end 记录，与实际写出的长度和 SHA-256 比较，kind 用于错误信息
+func checkDiffEnd(r io.Reader, size int64, h hash.Hash, kind string) error {
+	var b [8 + sha256.Size]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return fmt.Errorf("%w: truncated %s diff", ErrCorruptPatch, kind)
+	}
+	if want := binary.LittleEndian.Uint64(b[:]); want != uint64(size) {
+		return fmt.Errorf("%w: new %s is %d bytes, the patch expects %d", ErrTargetMismatch, kind, size, want)
+	}
+	if !bytes.Equal(h.Sum(nil), b[8:]) {
+		return fmt.Errorf("%w: SHA-256 of the new %s differs from the patch", ErrTargetMismatch, kind)
+	}
+	return nil
+}
+
+// diffBudget 让 WithMaxOutputSize 对 tar、zip、重新压缩补丁的整个新文件生效，而不是分别对每条记录生效：
+// 否则每条记录都不超过上限、或者反复复制同一个旧片段的很小的补丁仍然可以写出任意多的数据
+type diffBudget struct {
+	opts        []Option
+	limit, used int64
+	kind        string
+}
+
+func newDiffBudget(o options, opts []Option, kind string) *diffBudget {
+	return &diffBudget{opts: opts, limit: max(o.maxOutput, 0), kind: kind}
+}
+
+// patchOpts 返回应用一条记录的补丁时的选项：上限换成剩下的额度
+// 额度用完时仍然传 1，超出的部分由 add 报告，因为 WithMaxOutputSize(0) 表示不限制
+func (b *diffBudget) patchOpts() []Option {
+	if b.limit == 0 {
+		return b.opts
+	}
+	return append(b.opts[:len(b.opts):len(b.opts)], WithMaxOutputSize(max(b.limit-b.used, 1)))
+}
+
+// deflateMaxRatio deflate 的最大压缩比：一个最长 258 字节的匹配最少用 2 位编码，不超过 1032:1
+const deflateMaxRatio = 1032
+
+// contentOpts 返回应用 deflate、idat、content 记录中解压后内容的补丁时的选项：内容重新压缩之后才计入额度，
+// 可以比剩下的额度大，上限按 deflate 的最大压缩比放大；内存另由 WithMaxMemory 限制
+func (b *diffBudget) contentOpts() []Option {
+	rest := max(b.limit-b.used, 1)
+	if b.limit == 0 || rest > math.MaxInt64/deflateMaxRatio {
+		return b.opts
+	}
+	return append(b.opts[:len(b.opts):len(b.opts)], WithMaxOutputSize(rest*deflateMaxRatio))
+}
+
+// add 在写出 n 字节之前计入额度，超出上限时返回 ErrOutputTooLarge
+func (b *diffBudget) add(n int) error {
+	b.used += int64(n)
+	if b.limit > 0 && b.used > b.limit {
+		return fmt.Errorf("%w: new %s exceeds the limit of %d bytes", ErrOutputTooLarge, b.kind, b.limit)
+	}
+	return nil
+}
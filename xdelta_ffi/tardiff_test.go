@@ -0,0 +1,226 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readTarFixture 读取 testdata/tar 中的归档（由 generate.py 生成）
+func readTarFixture(tb testing.TB, name string) []byte {
+	tb.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "tar", name))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// tarDiffRecord tar 补丁中的一条 same 或 diff 记录
+type tarDiffRecord struct {
+	op   byte
+	base uint32
+}
+
+// tarDiffRecords 按格式说明解析 tar 补丁，返回 end 之前的各条记录
+func tarDiffRecords(tb testing.TB, patch []byte) []tarDiffRecord {
+	tb.Helper()
+	p := patch[tarDiffHeaderLen:]
+	var recs []tarDiffRecord
+	for p[0] != tarOpEnd {
+		r := tarDiffRecord{op: p[0], base: binary.LittleEndian.Uint32(p[1:])}
+		p = p[5:]
+		if r.op == tarOpDiff {
+			p = p[8+binary.LittleEndian.Uint64(p):]
+		}
+		recs = append(recs, r)
+	}
+	if len(p) != 1+8+32 {
+		tb.Fatalf("%d bytes after the end record", len(p)-41)
+	}
+	return recs
+}
+
+// tarSegments 拆分 tar，返回各个片段
+func tarSegments(tb testing.TB, data []byte) []tarSegment {
+	tb.Helper()
+	var segs []tarSegment
+	if err := splitTar(bytes.NewReader(data), func(s tarSegment) error {
+		segs = append(segs, s)
+		return nil
+	}); err != nil {
+		tb.Fatal(err)
+	}
+	return segs
+}
+
+func createTarDiff(tb testing.TB, oldTar, newTar []byte, opts ...Option) []byte {
+	tb.Helper()
+	var patch bytes.Buffer
+	if err := CreateTarDiff(bytes.NewReader(oldTar), bytes.NewReader(newTar), &patch, opts...); err != nil {
+		tb.Fatal(err)
+	}
+	return patch.Bytes()
+}
+
+func applyTarDiff(oldTar, patch []byte, opts ...Option) ([]byte, error) {
+	var out bytes.Buffer
+	err := ApplyTarDiff(bytes.NewReader(oldTar), bytes.NewReader(patch), &out, opts...)
+	return out.Bytes(), err
+}
+
+// TestTarDiffLayers 两个镜像层之间的补丁还原出逐字节相同的新层；顺序变了的条目按路径匹配，
+// 没变的头和内容（包括带 PAX 路径头的条目）只引用旧片段，只改了 PAX xattr 的条目只有头需要补丁，
+// 新增的条目从空数据生成，删除的条目不被引用
+func TestTarDiffLayers(t *testing.T) {
+	requireNative(t)
+	oldTar, newTar := readTarFixture(t, "layer-old.tar"), readTarFixture(t, "layer-new.tar")
+	patch := createTarDiff(t, oldTar, newTar)
+	got, err := applyTarDiff(oldTar, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newTar) {
+		t.Fatalf("got %d bytes, want the %d byte new layer", len(got), len(newTar))
+	}
+	if len(patch) > len(newTar)/5 {
+		t.Errorf("patch is %d bytes for a %d byte layer", len(patch), len(newTar))
+	}
+
+	src, err := readTarSource(bytes.NewReader(oldTar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segs := tarSegments(t, newTar)
+	recs := tarDiffRecords(t, patch)
+	if len(recs) != len(segs) {
+		t.Fatalf("%d records for %d segments", len(recs), len(segs))
+	}
+	// 每个条目的头和内容的记录：op 为 0 表示不检查
+	readme := "usr/share/doc/package-documentation-0/package-documentation-1/package-documentation-2/package-documentation-3/package-documentation-4/README"
+	want := map[string][2]byte{
+		readme:                 {tarOpSame, tarOpSame},
+		"etc/os-release":       {tarOpSame, tarOpSame},
+		"usr/bin/tool-link":    {tarOpSame, tarOpSame},
+		"usr/bin/tool-hard":    {tarOpSame, tarOpSame},
+		"usr/bin/tool":         {tarOpSame, tarOpDiff},
+		"usr/lib/libx.so":      {tarOpDiff, tarOpSame},
+		"etc/hostname":         {0, tarOpDiff},
+		"var/lib/data.bin":     {0, tarOpDiff},
+		"opt/plugin/plugin.so": {tarOpDiff, tarOpDiff},
+	}
+	referenced := map[uint32]bool{}
+	for i, seg := range segs {
+		r := recs[i]
+		referenced[r.base] = true
+		added := strings.HasPrefix(seg.name, "opt/plugin") || seg.name == "opt/.wh.legacy"
+		if added != (r.base == tarNoBase) {
+			t.Errorf("segment %d (%q): base %d", i, seg.name, r.base)
+		}
+		if r.base != tarNoBase && r.base != src.base(seg) {
+			t.Errorf("segment %d (%q): base %d, want %d", i, seg.name, r.base, src.base(seg))
+		}
+		w, ok := want[seg.name]
+		if !ok {
+			continue
+		}
+		op := w[1]
+		if seg.header {
+			op = w[0]
+		}
+		if op != 0 && r.op != op {
+			t.Errorf("%q header=%v: record %d, want %d", seg.name, seg.header, r.op, op)
+		}
+	}
+	for i, seg := range src.segments {
+		if strings.HasPrefix(seg.name, "opt/legacy") && referenced[uint32(i)] {
+			t.Errorf("removed entry %q (segment %d) is referenced", seg.name, i)
+		}
+	}
+}
+
+// TestTarDiffPadding 归档结尾之后多出的填充（以及条目内容长度变化导致块内填充变化）原样还原，增加或去掉填充都可以
+func TestTarDiffPadding(t *testing.T) {
+	requireNative(t)
+	oldTar, newTar, padded := readTarFixture(t, "layer-old.tar"), readTarFixture(t, "layer-new.tar"), readTarFixture(t, "layer-padded.tar")
+	for _, c := range []struct {
+		name     string
+		from, to []byte
+	}{
+		{"add padding", oldTar, padded},
+		{"remove padding", padded, newTar},
+		{"padding only", newTar, padded},
+	} {
+		patch := createTarDiff(t, c.from, c.to)
+		got, err := applyTarDiff(c.from, patch)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !bytes.Equal(got, c.to) {
+			t.Fatalf("%s: got %d bytes, want %d", c.name, len(got), len(c.to))
+		}
+		recs := tarDiffRecords(t, patch)
+		last := recs[len(recs)-1]
+		if n := len(tarSegments(t, c.from)); last.op != tarOpDiff || last.base != uint32(n-1) {
+			t.Errorf("%s: the end of the archive is record %d with base %d, want a diff against segment %d", c.name, last.op, last.base, n-1)
+		}
+		if c.name == "padding only" {
+			for _, r := range recs[:len(recs)-1] {
+				if r.op != tarOpSame {
+					t.Fatalf("%s: a segment before the end was diffed", c.name)
+				}
+			}
+		}
+	}
+}
+
+// TestTarDiffErrors 旧归档不对时不写出数据、返回 ErrSourceMismatch；截断、版本和结尾校验的错误各自对应；
+// 不是 tar 的输入返回 ErrInvalidArgument；WithMaxOutputSize 限制整个新归档
+func TestTarDiffErrors(t *testing.T) {
+	requireNative(t)
+	oldTar, newTar := readTarFixture(t, "layer-old.tar"), readTarFixture(t, "layer-new.tar")
+	patch := createTarDiff(t, oldTar, newTar)
+
+	got, err := applyTarDiff(newTar, patch)
+	if !errors.Is(err, ErrSourceMismatch) || len(got) != 0 {
+		t.Fatalf("wrong old tar: got %v after %d bytes, want ErrSourceMismatch before any output", err, len(got))
+	}
+	for _, n := range []int{0, 5, tarDiffHeaderLen, tarDiffHeaderLen + 3, len(patch) / 2, len(patch) - 1} {
+		if _, err := applyTarDiff(oldTar, patch[:n]); !errors.Is(err, ErrCorruptPatch) {
+			t.Errorf("%d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+		}
+	}
+	bad := bytes.Clone(patch)
+	bad[len(tarDiffMagic)] = TarDiffVersion + 1
+	if _, err := applyTarDiff(oldTar, bad); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Errorf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+	bad = bytes.Clone(patch)
+	bad[len(bad)-1] ^= 1
+	if _, err := applyTarDiff(oldTar, bad); !errors.Is(err, ErrTargetMismatch) {
+		t.Errorf("changed target hash: got %v, want ErrTargetMismatch", err)
+	}
+	bad = bytes.Clone(patch)
+	bad[tarDiffHeaderLen] = 9
+	if _, err := applyTarDiff(oldTar, bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Errorf("unknown record: got %v, want ErrCorruptPatch", err)
+	}
+
+	junk := bytes.Repeat([]byte("not a tar archive "), 100)
+	for name, pair := range map[string][2][]byte{"old": {junk, newTar}, "new": {oldTar, junk}} {
+		if err := CreateTarDiff(bytes.NewReader(pair[0]), bytes.NewReader(pair[1]), &bytes.Buffer{}); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%s tar is not a tar: got %v, want ErrInvalidArgument", name, err)
+		}
+	}
+
+	if _, err := applyTarDiff(oldTar, patch, WithMaxOutputSize(int64(len(newTar)))); err != nil {
+		t.Errorf("WithMaxOutputSize of the new size: %v", err)
+	}
+	if _, err := applyTarDiff(oldTar, patch, WithMaxOutputSize(int64(len(newTar)-1))); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("WithMaxOutputSize below the new size: got %v, want ErrOutputTooLarge", err)
+	}
+}
@@ -0,0 +1,59 @@
+#!/usr/bin/env python3
+"""Regenerate the baseline patches in this directory.
+
+The patches are written by the first release of the library (commit 6157b3e,
+before any format change), so the tests apply patches that older versions
+produce and compare them with the output of the current encoder. Build that
+commit and pass its library:
+
+    git worktree add /tmp/baseline 6157b3e
+    (cd /tmp/baseline && cargo build --release)
+    python3 xdelta_ffi/testdata/baseline/generate.py /tmp/baseline/target/release/libxdelta.so
+"""
+
+import ctypes
+import os
+import sys
+
+HERE = os.path.dirname(os.path.abspath(__file__))
+
+
+def main():
+    lib = ctypes.CDLL(sys.argv[1])
+    u8p = ctypes.POINTER(ctypes.c_uint8)
+    lib.xdelta_create_patch_data.argtypes = [
+        ctypes.c_char_p, ctypes.c_size_t, ctypes.c_char_p, ctypes.c_size_t,
+        ctypes.POINTER(u8p), ctypes.POINTER(ctypes.c_size_t), ctypes.c_uint32,
+    ]
+    lib.xdelta_free_data.argtypes = [u8p]
+    lib.xdelta_last_error.restype = ctypes.c_char_p
+
+    def create(old, new, block_size):
+        out, n = u8p(), ctypes.c_size_t()
+        if lib.xdelta_create_patch_data(old, len(old), new, len(new), ctypes.byref(out), ctypes.byref(n), block_size) != 0:
+            raise RuntimeError(lib.xdelta_last_error())
+        patch = ctypes.string_at(out, n.value)
+        lib.xdelta_free_data(out)
+        return patch
+
+    with open(os.path.join(HERE, "..", "text.old"), "rb") as f:
+        old = f.read()
+    with open(os.path.join(HERE, "..", "text.new"), "rb") as f:
+        new = f.read()
+    # keep in sync with baselineCases in baseline_test.go; an empty new file is
+    # left out: the baseline writes an empty patch for it, which is rejected as
+    # corrupt since empty input semantics were defined
+    cases = {
+        "text": (old, new, 1024),
+        "reverse": (new, old, 1024),
+        "append": (old, old + new[:4096], 1024),
+        "from-empty": (b"", new, 1024),
+        "block-64": (old, new, 64),
+    }
+    for name, (a, b, bs) in cases.items():
+        with open(os.path.join(HERE, name + ".patch"), "wb") as f:
+            f.write(create(a, b, bs))
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,61 @@
+#!/usr/bin/env python3
+"""Write the fixtures for recompress_test.go with Python's zlib.
+
+zlib's deflate output cannot be reproduced by compress/flate, so
+CreateRecompressDiff has to diff these files' compressed data directly.
+
+  zlib-old.gz, zlib-new.gz    gzip -9 members without a name or time; the
+                              new file changes six bytes in the middle
+  zlib-old.png, zlib-new.png  128x128 RGB images, zlib level 9, the
+                              stream split into 4 KiB IDAT chunks; the new
+                              image changes a block of pixels
+
+Run from this directory:
+
+    python3 generate.py
+"""
+import gzip
+import struct
+import zlib
+
+
+def text(seed, n):
+    words = [b"gzip", b"member", b"deflate", b"stream", b"header", b"trailer", b"\n"]
+    x = seed
+    out = bytearray()
+    while len(out) < n:
+        x = (x * 1103515245 + 12345) & 0x7FFFFFFF
+        out += words[(x >> 16) % len(words)] + b" "
+    return bytes(out[:n])
+
+
+def chunk(kind, data):
+    return struct.pack(">I", len(data)) + kind + data + struct.pack(">I", zlib.crc32(kind + data))
+
+
+def png(changed):
+    w = h = 128
+    rows = bytearray()
+    for y in range(h):
+        rows.append(0)
+        for x in range(w):
+            px = [x * 2, y * 2, (x ^ y) & 0xFF]
+            if changed and 40 <= x < 56 and 40 <= y < 56:
+                px = [255, 0, 0]
+            rows += bytes(px)
+    stream = zlib.compress(bytes(rows), 9)
+    out = b"\x89PNG\r\n\x1a\n" + chunk(b"IHDR", struct.pack(">IIBBBBB", w, h, 8, 2, 0, 0, 0))
+    for i in range(0, len(stream), 4096):
+        out += chunk(b"IDAT", stream[i:i + 4096])
+    return out + chunk(b"IEND", b"")
+
+
+data = text(1, 60000)
+changed = bytearray(data)
+changed[30000:30006] = b"PATCH!"
+for name, content in [("zlib-old.gz", data), ("zlib-new.gz", bytes(changed))]:
+    with open(name, "wb") as f:
+        f.write(gzip.compress(content, 9, mtime=0))
+for name, c in [("zlib-old.png", False), ("zlib-new.png", True)]:
+    with open(name, "wb") as f:
+        f.write(png(c))
@@ -0,0 +1,102 @@
+#!/usr/bin/env python3
+"""Write the docker-style layer fixtures for tardiff_test.go.
+
+layer-old.tar and layer-new.tar are laid out like container image layers
+(docker save, docker export): PAX format, directories first, a symlink, a hard link, a whiteout file, an
+entry whose path needs a PAX header and entries with PAX xattrs. The new
+layer lists the entries in a different order, changes some contents and
+headers, removes opt/legacy and adds opt/plugin and a whiteout.
+layer-padded.tar is layer-new.tar followed by 4 KiB of zeros after the
+end of the archive, as some exporters pad to a larger record.
+
+Python's tarfile writes them, not archive/tar, so the tests also cover
+archives from another writer. Run from this directory:
+
+    python3 generate.py
+"""
+import io
+import tarfile
+
+LONG_DIR = "usr/share/doc/" + "/".join(["package-documentation-%d" % i for i in range(5)])
+
+
+def text(seed, n):
+    words = [b"layer", b"docker", b"export", b"config", b"binary", b"library", b"service", b"\n"]
+    x = seed
+    out = bytearray()
+    while len(out) < n:
+        x = (x * 1103515245 + 12345) & 0x7FFFFFFF
+        out += words[(x >> 16) % len(words)] + b" "
+    return bytes(out[:n])
+
+
+def entry(name, kind=tarfile.REGTYPE, data=b"", link="", xattrs=None, mode=0o644):
+    info = tarfile.TarInfo(name)
+    info.type = kind
+    info.mode = 0o755 if kind == tarfile.DIRTYPE else mode
+    info.mtime = 1700000000
+    info.uid = info.gid = 0
+    info.uname = info.gname = "root"
+    info.linkname = link
+    info.size = len(data) if kind == tarfile.REGTYPE else 0
+    if xattrs:
+        info.pax_headers = {"SCHILY.xattr." + k: v for k, v in xattrs.items()}
+    return info, data
+
+
+def write(path, entries, pad=0):
+    buf = io.BytesIO()
+    with tarfile.open(fileobj=buf, mode="w", format=tarfile.PAX_FORMAT) as tf:
+        for info, data in entries:
+            tf.addfile(info, io.BytesIO(data) if info.type == tarfile.REGTYPE else None)
+    with open(path, "wb") as f:
+        f.write(buf.getvalue() + bytes(pad))
+
+
+tool = text(1, 30000)
+changed_tool = bytearray(tool)
+changed_tool[15000:15006] = b"PATCH!"
+
+dirs = [entry(d, tarfile.DIRTYPE) for d in ["etc/", "usr/", "usr/bin/", "usr/lib/", "var/", "var/lib/"]]
+os_release = entry("etc/os-release", data=text(2, 700))
+readme = entry(LONG_DIR + "/README", data=text(3, 5000))
+lib = b"\x7fELF" + text(4, 12000)
+
+old = dirs + [
+    entry("etc/hostname", data=b"old-host\n"),
+    os_release,
+    entry("usr/bin/tool", data=tool, mode=0o755),
+    entry("usr/bin/tool-link", tarfile.SYMTYPE, link="tool"),
+    entry("usr/bin/tool-hard", tarfile.LNKTYPE, link="usr/bin/tool"),
+    entry("usr/lib/libx.so", data=lib, xattrs={"security.capability": "\x01\x00\x00\x02"}),
+    readme,
+    entry("var/lib/data.bin", data=text(5, 8000)),
+    entry("opt/", tarfile.DIRTYPE),
+    entry("opt/legacy/", tarfile.DIRTYPE),
+    entry("opt/legacy/config", data=text(6, 3000)),
+]
+
+new = [
+    entry("usr/", tarfile.DIRTYPE),
+    entry("usr/bin/", tarfile.DIRTYPE),
+    entry("usr/bin/tool", data=bytes(changed_tool), mode=0o755),
+    entry("usr/lib/", tarfile.DIRTYPE),
+    entry("usr/lib/libx.so", data=lib, xattrs={"security.capability": "\x01\x00\x00\x03", "user.origin": "layer2"}),
+    entry("usr/bin/tool-link", tarfile.SYMTYPE, link="tool"),
+    entry("usr/bin/tool-hard", tarfile.LNKTYPE, link="usr/bin/tool"),
+    readme,
+    entry("etc/", tarfile.DIRTYPE),
+    os_release,
+    entry("etc/hostname", data=b"new-host-name\n"),
+    entry("var/", tarfile.DIRTYPE),
+    entry("var/lib/", tarfile.DIRTYPE),
+    entry("var/lib/data.bin", data=text(5, 8000) + text(7, 100)),
+    entry("opt/", tarfile.DIRTYPE),
+    entry("opt/.wh.legacy"),
+    entry("opt/plugin/", tarfile.DIRTYPE),
+    entry("opt/plugin/plugin.so", data=b"\x7fELF" + text(8, 5000)),
+]
+
+write("layer-old.tar", old)
+write("layer-new.tar", new)
+write("layer-padded.tar", new, pad=4096)
@@ -0,0 +1,95 @@
+#!/usr/bin/env python3
+"""Write the zip fixtures for zipdiff_test.go with Info-ZIP zip 3.0.
+
+Info-ZIP compresses with its own deflate, which compress/flate cannot
+reproduce, so changed deflate entries need the semantic mode unless the
+patch is made with WithExactZip.
+
+  app-old.zip, app-new.zip      zip -X -9, *.bin entries stored; the new
+                                archive changes a deflate and a stored
+                                entry, removes old/legacy.txt and adds
+                                assets/new.txt
+  store-old.zip, store-new.zip  the same trees with zip -X -0: every entry
+                                stored
+  zip64-old.zip, zip64-new.zip  the same trees with zip -X -fz: zip64
+                                extra fields and end of central directory
+                                records although nothing needs them
+
+Run from this directory:
+
+    python3 generate.py
+"""
+import os
+import subprocess
+import tempfile
+
+MTIME = 1700000000
+
+
+def text(seed, n):
+    words = [b"class", b"method", b"field", b"resource", b"string", b"layout", b"activity", b"\n"]
+    x = seed
+    out = bytearray()
+    while len(out) < n:
+        x = (x * 1103515245 + 12345) & 0x7FFFFFFF
+        out += words[(x >> 16) % len(words)] + b" "
+    return bytes(out[:n])
+
+
+def noise(seed, n):
+    x = seed
+    out = bytearray()
+    for _ in range(n):
+        x = (x * 6364136223846793005 + 1442695040888963407) & (2**64 - 1)
+        out.append(x >> 56)
+    return bytes(out)
+
+
+def tree(files):
+    d = tempfile.mkdtemp()
+    for name, data in files.items():
+        path = os.path.join(d, name)
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        with open(path, "wb") as f:
+            f.write(data)
+        os.utime(path, (MTIME, MTIME))
+    return d
+
+
+def write(path, files, *flags):
+    d = tree(files)
+    out = os.path.abspath(path)
+    if os.path.exists(out):
+        os.remove(out)
+    env = dict(os.environ, TZ="UTC")
+    subprocess.run(["zip", "-q", "-X", "-D", *flags, "-n", ".bin", out, *files], cwd=d, env=env, check=True)
+
+
+classes = text(1, 40000)
+changed = bytearray(classes)
+changed[20000:20006] = b"PATCH!"
+res = noise(2, 6000)
+changed_res = bytearray(res)
+changed_res[100:104] = b"LIVE"
+
+old = {
+    "META-INF/MANIFEST.MF": b"Manifest-Version: 1.0\nCreated-By: generate.py\n",
+    "classes.txt": classes,
+    "res/raw.bin": res,
+    "res/layout.xml": text(3, 3000),
+    "old/legacy.txt": text(4, 2000),
+}
+new = {
+    "META-INF/MANIFEST.MF": old["META-INF/MANIFEST.MF"],
+    "classes.txt": bytes(changed),
+    "res/raw.bin": bytes(changed_res),
+    "res/layout.xml": old["res/layout.xml"],
+    "assets/new.txt": text(5, 1500),
+}
+
+write("app-old.zip", old, "-9")
+write("app-new.zip", new, "-9")
+write("store-old.zip", old, "-0")
+write("store-new.zip", new, "-0")
+write("zip64-old.zip", old, "-9", "-fz")
+write("zip64-new.zip", new, "-9", "-fz")
@@ -0,0 +1,41 @@
+package xdelta_ffi
+
+// MaxThreads WithThreads 允许的最大线程数
+const MaxThreads = 256
+
+// parallelChunk 多线程编码时新数据分段的大小，与原生层的 PARALLEL_CHUNK 相同
+const parallelChunk = 8 << 20
+
+// WithThreads 设置原生层创建补丁时使用的线程数，必须在 [0, MaxThreads] 范围内；0 表示使用所有 CPU 核心
+// 默认为 1，编码在调用方的线程中进行，结果与之前的版本完全相同
+// 不为 1 时旧数据的块签名并行建立，新数据按 8 MiB 分段、每段独立匹配后按顺序写出，
+// 补丁可能比单线程时稍大（跨段的匹配会被截断），但与具体的线程数和机器的核心数无关，同样的输入总是得到同样的补丁，
+// 所有应用接口都能正常解码；新数据不足 8 MiB 时几乎没有加速
+// 对 CreateDiffs、CreateEnvelope、CreateDiffsFile、SourceEncoder、CreateDiffsBatch、
+// CreateDiffsStream、CreateDiffsFromStream 和 Encoder 有效，文件版本和流式接口每个线程缓冲 8 MiB 新数据；
+// 流式接口的补丁同样与线程数无关，与 CreateDiffs 的结果相同；基于签名的接口（SignatureIndex 等）忽略这一选项
+// 应用时只有 ApplyDiffsAt 使用这一选项，按同样的 8 MiB 分段并行解码
+func WithThreads(n int) Option {
+	return func(o *options) {
+		o.threads = n
+	}
+}
+
+// WithDeterministic 保证同样的输入、格式、二次压缩、级别和块大小总是生成逐字节相同的补丁，适合要求可复现构建的发布流程
+// 原生编码器本身没有随机性（签名表只按键查找，不依赖遍历顺序），补丁只会因为是否多线程编码而不同
+// （WithThreads 为 1 与不为 1 时分段方式不同）；这一选项忽略 WithThreads，总是在调用方的线程中单线程编码，
+// 结果与不使用任何选项时相同。对 CreateDiffs、CreateEnvelope、CreateDiffsFile、SourceEncoder、CreateDiffsBatch 等所有创建接口有效，
+// 不影响 ApplyDiffsAt 的并行解码
+func WithDeterministic() Option {
+	return func(o *options) {
+		o.deterministic = true
+	}
+}
+
+// encodeThreads 返回创建补丁时使用的线程数，WithDeterministic 时总是 1
+func (o options) encodeThreads() int {
+	if o.deterministic {
+		return 1
+	}
+	return o.threads
+}
@@ -0,0 +1,101 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestWithDeterministic 同一对数据编码 50 次（其中一半同时在多个 goroutine 中进行），WithDeterministic 时
+// 即使要求了多线程，每次的补丁也都与不带选项的 CreateDiffs 逐字节相同；文件版本、流式接口和 SourceEncoder 也一样。
+// 新数据跨越多个 8 MiB 的分段，多线程编码时的分段方式会体现在补丁中
+func TestWithDeterministic(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(2*parallelChunk + 4321)
+	want, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	threaded, err := CreateDiffs(oldData, newData, WithThreads(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 否则这组数据无法说明 WithDeterministic 覆盖了 WithThreads
+	if bytes.Equal(threaded, want) {
+		t.Fatal("the multi-threaded patch equals the single-threaded one")
+	}
+	opts := []Option{WithThreads(8), WithDeterministic()}
+
+	runs := 50
+	if testing.Short() {
+		runs = 10
+	}
+	var wg sync.WaitGroup
+	results := make([][]byte, runs)
+	errs := make([]error, runs)
+	for i := range runs {
+		if i%2 == 0 {
+			results[i], errs[i] = CreateDiffs(oldData, newData, opts...)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = CreateDiffs(oldData, newData, opts...)
+		}()
+	}
+	wg.Wait()
+	for i := range runs {
+		if errs[i] != nil {
+			t.Fatalf("run %d: %v", i, errs[i])
+		}
+		if !bytes.Equal(results[i], want) {
+			t.Fatalf("run %d: %d bytes differ from the single-threaded patch (%d bytes)", i, len(results[i]), len(want))
+		}
+	}
+
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, map[string][]byte{"old": oldData, "new": newData})
+	patchPath := filepath.Join(dir, "patch")
+	if err := CreateDiffsFile(paths["old"], paths["new"], patchPath, DefaultBlockSize, opts...); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(patchPath)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("CreateDiffsFile: %d bytes differ from CreateDiffs (%v)", len(got), err)
+	}
+	var b bytes.Buffer
+	if err := CreateDiffsStream(bytes.NewReader(oldData), bytes.NewReader(newData), &b, opts...); err != nil || !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("CreateDiffsStream: %d bytes differ from CreateDiffs (%v)", b.Len(), err)
+	}
+	b.Reset()
+	if err := CreateDiffsFromStream(oldData, bytes.NewReader(newData), &b, opts...); err != nil || !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("CreateDiffsFromStream: %d bytes differ from CreateDiffs (%v)", b.Len(), err)
+	}
+	se, err := NewSourceEncoder(oldData, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+	single, err := NewSourceEncoder(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	wantSE, err := single.Diff(newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := se.Diff(newData); err != nil || !bytes.Equal(got, wantSE) {
+		t.Fatalf("SourceEncoder: %d bytes differ from the single-threaded SourceEncoder (%v)", len(got), err)
+	}
+	env, err := CreateEnvelope(oldData, newData, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, inner, err := ParseEnvelope(env); err != nil || !bytes.Equal(inner, want) {
+		t.Fatalf("CreateEnvelope: the inner patch differs from CreateDiffs (%v)", err)
+	}
+}
@@ -0,0 +1,285 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TuneObjective TuneBlockSize 选择推荐值的标准：每个候选的得分为
+// SizeWeight × 补丁大小 / 最小的补丁大小 + TimeWeight × 编码时间 / 最短的编码时间，取得分最低的
+// 两个权重都不能为负数，都为 0 时与 TuneSmallest 相同
+type TuneObjective struct {
+	SizeWeight float64
+	TimeWeight float64
+}
+
+var (
+	// TuneSmallest 选补丁最小的块大小（默认）
+	TuneSmallest = TuneObjective{SizeWeight: 1}
+	// TuneFastest 选编码最快的块大小
+	TuneFastest = TuneObjective{TimeWeight: 1}
+)
+
+// WithTuneObjective 设置 TuneBlockSize 选择推荐值的标准，默认为 TuneSmallest；对其他接口没有影响
+func WithTuneObjective(obj TuneObjective) Option {
+	return func(o *options) {
+		o.tuneObjective = obj
+	}
+}
+
+// TuneCandidate TuneBlockSize 中一个候选块大小的测量结果
+type TuneCandidate struct {
+	BlockSize uint32
+	// PatchSize 用这个块大小得到的补丁的字节数
+	PatchSize int64
+	// Duration 编码所用的时间，不包括等待并发名额（SetMaxConcurrentOperations）的时间
+	Duration time.Duration
+	// Skipped 预算用完时还没有开始，没有测量，其他字段为零
+	Skipped bool
+}
+
+// TuneResult TuneBlockSize 的结果
+type TuneResult struct {
+	// Candidates 与传入的 candidates 按下标一一对应
+	Candidates []TuneCandidate
+	// Recommended 按 WithTuneObjective 的标准在测量过的候选中选出的块大小
+	Recommended uint32
+}
+
+// TuneBlockSize 用样本 oldSample、newSample 按 candidates 中的每个块大小实际编码一次，返回各自的补丁大小和编码时间，
+// 以及按 WithTuneObjective 选出的推荐值，用于为特定格式的数据找到比 RecommendedBlockSize 更合适的块大小
+// candidates 为空时尝试 16 到 64 KiB 之间所有 2 的幂，其中每个值都必须在 [MinBlockSize, MaxBlockSize] 内，否则返回 ErrInvalidArgument
+// 候选最多 runtime.GOMAXPROCS(0) 个并行编码（同样受 SetMaxConcurrentOperations 限制）；budget 大于 0 时，
+// 从调用开始超过 budget 后不再开始新的候选，剩下的标记为 Skipped，因此总耗时最多比 budget 多出正在进行的一轮编码；
+// 第一轮总会开始，至少有一个候选被测量。budget 不大于 0 时不限时间
+// opts 与 CreateDiffs 相同（WithBlockSize 被忽略），某个候选编码失败时返回这个错误
+// 补丁大小只取决于输入和选项，WithDeterministic 且预算充足时结果可以复现；编码时间受机器负载影响，
+// TimeWeight 不为 0 的标准选出的值可能每次不同
+func TuneBlockSize(oldSample, newSample []byte, candidates []uint32, budget time.Duration, opts ...Option) (TuneResult, error) {
+	if err := Init(); err != nil {
+		return TuneResult{}, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return TuneResult{}, err
+	}
+	obj := o.tuneObjective
+	if obj.SizeWeight < 0 || obj.TimeWeight < 0 {
+		return TuneResult{}, fmt.Errorf("%w: negative tune objective weight", ErrInvalidArgument)
+	}
+	if obj == (TuneObjective{}) {
+		obj = TuneSmallest
+	}
+	if len(candidates) == 0 {
+		for bs := recommendedMinBlockSize; bs <= recommendedMaxBlockSize; bs *= 2 {
+			candidates = append(candidates, bs)
+		}
+	}
+	for _, bs := range candidates {
+		if bs < MinBlockSize || bs > MaxBlockSize {
+			return TuneResult{}, fmt.Errorf("%w: candidate block size %d is out of range [%d, %d]", ErrInvalidArgument, bs, MinBlockSize, MaxBlockSize)
+		}
+	}
+	defer o.verboseScope()()
+	o.detectCompressedData(oldSample, newSample)
+	e := o.encoding()
+
+	start := time.Now()
+	res := TuneResult{Candidates: make([]TuneCandidate, len(candidates))}
+	errs := make([]error, len(candidates))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(runtime.GOMAXPROCS(0), len(candidates)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < len(candidates); i = int(next.Add(1) - 1) {
+				c := &res.Candidates[i]
+				c.BlockSize = candidates[i]
+				// 第一个候选总是测量，保证有推荐值
+				if budget > 0 && i > 0 && time.Since(start) >= budget {
+					c.Skipped = true
+					continue
+				}
+				var patch []byte
+				patch, c.Duration, errs[i] = tuneEncode(oldSample, newSample, c.BlockSize, e)
+				c.PatchSize = int64(len(patch))
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return TuneResult{}, fmt.Errorf("block size %d: %w", candidates[i], err)
+		}
+	}
+	res.Recommended = obj.pick(res.Candidates)
+	return res, nil
+}
+
+// 以下为 BenchmarkProfile 尝试的块大小和二次压缩方式
+var (
+	profileBlockSizes  = []uint32{256, 1024, 4096, 16384}
+	profileSecondaries = []SecondaryCompression{SecondaryNone, SecondaryLZ4, SecondaryZlib, SecondaryZstd}
+)
+
+// ProfileEntry BenchmarkProfile 中一组参数的测量结果
+type ProfileEntry struct {
+	// Options 这组参数，可以直接交给 WithOptions
+	Options Options
+	// PatchSize 补丁的字节数
+	PatchSize int64
+	// EncodeDuration、ApplyDuration 创建和应用补丁所用的时间，不包括等待并发名额的时间
+	EncodeDuration time.Duration
+	ApplyDuration  time.Duration
+	// EncodeThroughput、ApplyThroughput 每秒编码、应用的新数据字节数
+	EncodeThroughput float64
+	ApplyThroughput  float64
+}
+
+// ProfileResult BenchmarkProfile 的结果
+type ProfileResult struct {
+	// Entries 每组参数一项，按块大小从小到大、同一块大小内按 SecondaryNone、SecondaryLZ4、SecondaryZlib、SecondaryZstd 排列
+	Entries []ProfileEntry
+	// Recommended 按 WithTuneObjective 的标准（用补丁大小和编码时间）在 Entries 中选出的参数
+	Recommended Options
+}
+
+// BenchmarkProfile 用样本 sampleOld、sampleNew 在当前机器上依次尝试块大小 256、1024、4096、16384 与不压缩、LZ4、zlib、zstd 的每种组合，
+// 各创建并应用一次补丁，报告补丁大小、编码和应用的时间与吞吐量，并按 WithTuneObjective（默认 TuneSmallest）推荐一组参数，
+// 适合在硬件各不相同的机器上启动时用一份有代表性的样本自动选择参数：
+//
+//	res, err := xdelta_ffi.BenchmarkProfile(oldSample, newSample, xdelta_ffi.WithTuneObjective(xdelta_ffi.TuneObjective{SizeWeight: 1, TimeWeight: 0.5}))
+//	...
+//	patch, err := xdelta_ffi.CreateDiffs(oldData, newData, xdelta_ffi.WithOptions(res.Recommended))
+//
+// opts 与 CreateDiffs 相同，其中的源窗口、压缩级别和匹配参数用于每一组（WithBlockSize、WithSecondaryCompression 被忽略）；
+// WithStandardVCDIFF 时只尝试不压缩。组合依次测量而不是并行，时间不受彼此影响，样本总共 n 字节时大约需要编码 16 次 n 字节的时间；
+// 应用得到的数据与 sampleNew 不同时返回错误
+func BenchmarkProfile(sampleOld, sampleNew []byte, opts ...Option) (ProfileResult, error) {
+	if err := Init(); err != nil {
+		return ProfileResult{}, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return ProfileResult{}, err
+	}
+	obj := o.tuneObjective
+	if obj.SizeWeight < 0 || obj.TimeWeight < 0 {
+		return ProfileResult{}, fmt.Errorf("%w: negative tune objective weight", ErrInvalidArgument)
+	}
+	if obj == (TuneObjective{}) {
+		obj = TuneSmallest
+	}
+	defer o.verboseScope()()
+	secondaries := profileSecondaries
+	if o.vcdiff {
+		secondaries = secondaries[:1]
+	}
+
+	var res ProfileResult
+	var cs []TuneCandidate
+	for _, bs := range profileBlockSizes {
+		for _, sec := range secondaries {
+			p := o
+			p.blockSize, p.secondary = bs, sec
+			entry, err := profileRun(sampleOld, sampleNew, p)
+			if err != nil {
+				return ProfileResult{}, fmt.Errorf("block size %d, %v: %w", bs, sec, err)
+			}
+			res.Entries = append(res.Entries, entry)
+			cs = append(cs, TuneCandidate{BlockSize: bs, PatchSize: entry.PatchSize, Duration: entry.EncodeDuration})
+		}
+	}
+	res.Recommended = res.Entries[obj.pickIndex(cs)].Options
+	return res, nil
+}
+
+// profileRun 用 o 创建并应用一次补丁，测量 BenchmarkProfile 的一项
+func profileRun(oldData, newData []byte, o options) (ProfileEntry, error) {
+	entry := ProfileEntry{Options: Options{
+		BlockSize:      o.blockSize,
+		SourceWindow:   o.sourceWindow,
+		Secondary:      o.secondary,
+		Level:          o.level,
+		Matching:       o.matching,
+		MinMatchBlocks: o.minMatch,
+	}}
+	patch, d, err := tuneEncode(oldData, newData, o.blockSize, o.encoding())
+	if err != nil {
+		return entry, err
+	}
+	entry.PatchSize, entry.EncodeDuration = int64(len(patch)), d
+	release, err := holdOp()
+	if err != nil {
+		return entry, err
+	}
+	start := time.Now()
+	out, err := applyPresized(appendTo(nil), oldData, patch, 0, nil)
+	entry.ApplyDuration = time.Since(start)
+	release()
+	if err != nil {
+		return entry, err
+	}
+	if !bytes.Equal(out, newData) {
+		return entry, fmt.Errorf("xdelta: applying the patch produced %d bytes that differ from the %d new bytes", len(out), len(newData))
+	}
+	entry.EncodeThroughput = throughput(len(newData), entry.EncodeDuration)
+	entry.ApplyThroughput = throughput(len(newData), entry.ApplyDuration)
+	return entry, nil
+}
+
+// throughput 每秒处理的字节数，d 为 0 时按 1 纳秒计算
+func throughput(n int, d time.Duration) float64 {
+	return float64(n) / max(d, 1).Seconds()
+}
+
+// tuneEncode 用块大小 bs 编码一次，返回补丁和编码时间
+func tuneEncode(oldData, newData []byte, bs uint32, e encoding) ([]byte, time.Duration, error) {
+	release, err := holdOp()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+	start := time.Now()
+	patch, err := createPatchData(appendTo(nil), oldData, newData, bs, e, nil)
+	return patch, time.Since(start), err
+}
+
+// pick 返回得分最低的测量过的候选的块大小，得分相同时取补丁较小的，再相同时取下标较小的
+func (obj TuneObjective) pick(cs []TuneCandidate) uint32 {
+	return cs[obj.pickIndex(cs)].BlockSize
+}
+
+// pickIndex 与 pick 相同，返回候选的下标
+func (obj TuneObjective) pickIndex(cs []TuneCandidate) int {
+	var minSize int64 = -1
+	var minTime time.Duration = -1
+	for _, c := range cs {
+		if c.Skipped {
+			continue
+		}
+		if minSize < 0 || c.PatchSize < minSize {
+			minSize = c.PatchSize
+		}
+		if minTime < 0 || c.Duration < minTime {
+			minTime = c.Duration
+		}
+	}
+	minSize, minTime = max(minSize, 1), max(minTime, 1)
+	best, bestScore := -1, 0.0
+	for i, c := range cs {
+		if c.Skipped {
+			continue
+		}
+		score := obj.SizeWeight*float64(c.PatchSize)/float64(minSize) + obj.TimeWeight*float64(c.Duration)/float64(minTime)
+		if best < 0 || score < bestScore || score == bestScore && c.PatchSize < cs[best].PatchSize {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,182 @@
+package xdelta_ffi
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestTuneBlockSize 每个候选的补丁大小与用这个块大小调用 CreateDiffs 得到的补丁相同，推荐值是补丁最小的候选；
+// 候选为空时尝试 16 到 64 KiB 的所有 2 的幂；超出范围的候选和为负的权重返回 ErrInvalidArgument
+func TestTuneBlockSize(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(256 << 10)
+	candidates := []uint32{64, 512, 4096, 32768}
+	res, err := TuneBlockSize(oldData, newData, candidates, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Candidates) != len(candidates) {
+		t.Fatalf("%d results for %d candidates", len(res.Candidates), len(candidates))
+	}
+	smallest := res.Candidates[0]
+	for i, c := range res.Candidates {
+		patch, err := CreateDiffs(oldData, newData, WithBlockSize(candidates[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.BlockSize != candidates[i] || c.Skipped || c.PatchSize != int64(len(patch)) || c.Duration <= 0 {
+			t.Fatalf("candidate %d: %+v, CreateDiffs gives %d bytes", i, c, len(patch))
+		}
+		if c.PatchSize < smallest.PatchSize {
+			smallest = c
+		}
+	}
+	if res.Recommended != smallest.BlockSize {
+		t.Fatalf("recommended %d, the smallest patch is from %d: %+v", res.Recommended, smallest.BlockSize, res.Candidates)
+	}
+	// 样本在 WithDeterministic 下重复测量，补丁大小和推荐值不变
+	again, err := TuneBlockSize(oldData, newData, candidates, 0, WithDeterministic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range again.Candidates {
+		if c.PatchSize != res.Candidates[i].PatchSize {
+			t.Fatalf("candidate %d: %d bytes, then %d", i, res.Candidates[i].PatchSize, c.PatchSize)
+		}
+	}
+
+	all, err := TuneBlockSize(oldData[:4096], newData[:4096], nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []uint32
+	for _, c := range all.Candidates {
+		sizes = append(sizes, c.BlockSize)
+	}
+	if len(sizes) != 13 || sizes[0] != 16 || sizes[12] != 64<<10 {
+		t.Fatalf("default candidates %v", sizes)
+	}
+
+	if _, err := TuneBlockSize(oldData, newData, []uint32{4096, MaxBlockSize + 1}, 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("candidate over MaxBlockSize: got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := TuneBlockSize(oldData, newData, candidates, 0, WithTuneObjective(TuneObjective{SizeWeight: -1})); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("negative weight: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// TestTuneBlockSizeBudget 预算用完后不再开始新的候选：第一轮总会测量，其余标记为 Skipped，推荐值来自测量过的候选
+func TestTuneBlockSizeBudget(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(1 << 20)
+	candidates := make([]uint32, 4*runtime.GOMAXPROCS(0)+4)
+	for i := range candidates {
+		candidates[i] = 256 << (i % 6)
+	}
+	res, err := TuneBlockSize(oldData, newData, candidates, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Candidates[0].Skipped {
+		t.Fatal("the first candidate was skipped")
+	}
+	skipped, measured := 0, map[uint32]bool{}
+	for _, c := range res.Candidates {
+		if c.Skipped {
+			skipped++
+			if c.PatchSize != 0 || c.Duration != 0 {
+				t.Fatalf("skipped candidate has results: %+v", c)
+			}
+		} else {
+			measured[c.BlockSize] = true
+		}
+	}
+	if skipped == 0 || !measured[res.Recommended] {
+		t.Fatalf("%d skipped, recommended %d of %v", skipped, res.Recommended, measured)
+	}
+}
+
+// TestTuneObjectivePick 得分按补丁大小、编码时间与各自最小值之比加权；跳过的候选不参与，得分相同时取补丁较小的
+func TestTuneObjectivePick(t *testing.T) {
+	cs := []TuneCandidate{
+		{BlockSize: 16, PatchSize: 1000, Duration: 40 * time.Millisecond},
+		{BlockSize: 64, PatchSize: 1100, Duration: 20 * time.Millisecond},
+		{BlockSize: 256, PatchSize: 1500, Duration: 10 * time.Millisecond},
+		{BlockSize: 1024, Skipped: true},
+	}
+	for _, c := range []struct {
+		obj  TuneObjective
+		want uint32
+	}{
+		{TuneSmallest, 16},
+		{TuneFastest, 256},
+		// 16：1 + 4×0.5 = 3；64：1.1 + 2×0.5 = 2.1；256：1.5 + 1×0.5 = 2
+		{TuneObjective{SizeWeight: 1, TimeWeight: 0.5}, 256},
+		// 16：1 + 4×0.2 = 1.8；64：1.1 + 2×0.2 = 1.5；256：1.5 + 0.2 = 1.7
+		{TuneObjective{SizeWeight: 1, TimeWeight: 0.2}, 64},
+	} {
+		if got := c.obj.pick(cs); got != c.want {
+			t.Fatalf("%+v picked %d, want %d", c.obj, got, c.want)
+		}
+	}
+	// 只有时间权重、时间相同时取补丁较小的
+	tie := []TuneCandidate{{BlockSize: 16, PatchSize: 900, Duration: time.Second}, {BlockSize: 64, PatchSize: 800, Duration: time.Second}}
+	if got := TuneFastest.pick(tie); got != 64 {
+		t.Fatalf("tie picked %d, want 64", got)
+	}
+}
+
+// TestBenchmarkProfile 每种块大小与二次压缩的组合各有一项，按文档的顺序排列；每项的补丁大小与用它的 Options 调用 CreateDiffs 相同，
+// 默认推荐补丁最小的一项；WithStandardVCDIFF 时只尝试不压缩；为负的权重返回 ErrInvalidArgument
+func TestBenchmarkProfile(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(128 << 10)
+	res, err := BenchmarkProfile(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != len(profileBlockSizes)*len(profileSecondaries) {
+		t.Fatalf("%d entries", len(res.Entries))
+	}
+	smallest := res.Entries[0]
+	for i, e := range res.Entries {
+		bs, sec := profileBlockSizes[i/len(profileSecondaries)], profileSecondaries[i%len(profileSecondaries)]
+		if e.Options.BlockSize != bs || e.Options.Secondary != sec {
+			t.Fatalf("entry %d is block size %d with %v, want %d with %v", i, e.Options.BlockSize, e.Options.Secondary, bs, sec)
+		}
+		patch, err := CreateDiffs(oldData, newData, WithOptions(e.Options))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.PatchSize != int64(len(patch)) {
+			t.Fatalf("entry %d: %d bytes, CreateDiffs gives %d", i, e.PatchSize, len(patch))
+		}
+		if e.EncodeDuration <= 0 || e.ApplyDuration <= 0 || e.EncodeThroughput <= 0 || e.ApplyThroughput <= 0 {
+			t.Fatalf("entry %d: %+v", i, e)
+		}
+		if e.PatchSize < smallest.PatchSize {
+			smallest = e
+		}
+	}
+	if res.Recommended != smallest.Options {
+		t.Fatalf("recommended %+v, the smallest patch is from %+v", res.Recommended, smallest.Options)
+	}
+
+	vc, err := BenchmarkProfile(oldData, newData, WithStandardVCDIFF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vc.Entries) != len(profileBlockSizes) {
+		t.Fatalf("%d entries with WithStandardVCDIFF", len(vc.Entries))
+	}
+	for _, e := range vc.Entries {
+		if e.Options.Secondary != SecondaryNone {
+			t.Fatalf("WithStandardVCDIFF tried %v", e.Options.Secondary)
+		}
+	}
+	if _, err := BenchmarkProfile(oldData, newData, WithTuneObjective(TuneObjective{TimeWeight: -1})); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("negative weight: got %v, want ErrInvalidArgument", err)
+	}
+}
@@ -0,0 +1,53 @@
+package xdelta_ffi
+
+import (
+	"fmt"
+	"io"
+)
+
+// ValidateFormat 在没有旧数据的情况下检查补丁的结构，适合在接收不可信的补丁时先行过滤：
+// 解析全部记录（VCDIFF 为全部窗口头和指令），检查长度、偏移是否自洽、补丁是否截断，
+// 格式不认识、截断或长度不可能成立时返回 ErrCorruptPatch，用到不支持的功能时返回 ErrUnsupportedPatch
+// 不重建新数据，耗时与补丁大小成线性，也不会按补丁声明的输出大小分配内存
+// 信封会检查信封头，用其中记录的旧数据长度检查 COPY 的范围（超出时返回 ErrSourceMismatch），
+// 并确认补丁声明的输出长度与信封一致；VCDIFF 和不带结束记录（见 WithEndRecord）的本库格式恰好截断在窗口或记录边界时
+// 仍然是合法的补丁，只有结束记录或信封能发现这种截断
+// bsdiff 补丁会完整解压三个块以校验 bzip2 的 CRC，耗时与解压后的大小成线性
+// 通过检查不代表补丁一定能应用：旧数据的内容、补丁中的校验和（见 WithChecksum）和信封的 SHA-256 只能在应用时检查
+func ValidateFormat(diffsData []byte) error {
+	if !IsEnvelope(diffsData) {
+		_, err := validateFormat(diffsData, -1)
+		return err
+	}
+	h, patch, err := ParseEnvelope(diffsData)
+	if err != nil {
+		return err
+	}
+	n, err := validateFormat(patch, h.SourceSize)
+	if err != nil {
+		return err
+	}
+	if n != uint64(h.TargetSize) {
+		return fmt.Errorf("%w: patch declares %d bytes of output, the envelope expects %d", ErrCorruptPatch, n, h.TargetSize)
+	}
+	return nil
+}
+
+// validateFormat 返回补丁声明的输出长度，sourceLen 为旧数据长度，未知时为 -1
+func validateFormat(patch []byte, sourceLen int64) (uint64, error) {
+	if isBSDiff(patch) {
+		p, err := parseBSDiff(patch, 0)
+		if err != nil {
+			return 0, err
+		}
+		// 没有旧数据时差分块不做加法，输出直接丢弃，检查的是控制项和三个块本身
+		_, err = p.apply(io.Discard, nil, 0)
+		return uint64(p.newSize), err
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return validatePatchData(patch, sourceLen)
+}
@@ -0,0 +1,344 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Win_Indicator 的两个标志，与 src/vcdiff.rs 一致
+const (
+	winSource  = 0x01
+	winAdler32 = 0x04
+)
+
+// vcdiffWindowIndicators 按 RFC 3284 的布局遍历补丁中的窗口，返回每个窗口的 Win_Indicator；
+// 文件头必须是不带二次压缩、应用头的五个字节
+func vcdiffWindowIndicators(tb testing.TB, patch []byte) []byte {
+	tb.Helper()
+	if len(patch) < 5 || !bytes.Equal(patch[:4], vcdiffMagic) || patch[4] != 0 {
+		tb.Fatalf("VCDIFF file header % x, want % x 00", patch[:min(len(patch), 5)], vcdiffMagic)
+	}
+	varint := func(b []byte) (uint64, []byte) {
+		var n uint64
+		for i, c := range b {
+			n = n<<7 | uint64(c&0x7f)
+			if c&0x80 == 0 {
+				return n, b[i+1:]
+			}
+		}
+		tb.Fatal("truncated varint")
+		return 0, nil
+	}
+	var indicators []byte
+	for b := patch[5:]; len(b) > 0; {
+		indicators = append(indicators, b[0])
+		b = b[1:]
+		if indicators[len(indicators)-1]&winSource != 0 {
+			_, b = varint(b)
+			_, b = varint(b)
+		}
+		var n uint64
+		n, b = varint(b)
+		if n > uint64(len(b)) {
+			tb.Fatalf("window %d: delta length %d, %d bytes left", len(indicators), n, len(b))
+		}
+		b = b[n:]
+	}
+	return indicators
+}
+
+// TestStandardVCDIFF WithStandardVCDIFF 输出标准的 VCDIFF：文件头后直接是窗口，窗口只用 VCD_SOURCE，
+// WithChecksum(ChecksumAdler32) 时才带 xdelta3 的 VCD_ADLER32；补丁在每个应用接口上都能还原，
+// 不能与二次压缩或 xxh3 校验和同时使用
+func TestStandardVCDIFF(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	for _, tc := range []struct {
+		name  string
+		opts  []Option
+		adler byte
+	}{
+		{"plain", nil, 0},
+		{"adler32", []Option{WithChecksum(ChecksumAdler32)}, winAdler32},
+	} {
+		patch, err := CreateDiffs(oldData, newData, append(tc.opts, WithStandardVCDIFF())...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		indicators := vcdiffWindowIndicators(t, patch)
+		if len(indicators) == 0 {
+			t.Fatalf("%s: no windows", tc.name)
+		}
+		for i, ind := range indicators {
+			if ind != winSource|tc.adler {
+				t.Fatalf("%s: window %d indicator %#x, want %#x", tc.name, i, ind, winSource|tc.adler)
+			}
+		}
+		for name, apply := range applyPaths(t.TempDir(), oldData, patch) {
+			if got, err := apply(); err != nil || !bytes.Equal(got, newData) {
+				t.Fatalf("%s: %s returned %d bytes, %v", tc.name, name, len(got), err)
+			}
+		}
+	}
+	// 旧数据为空时窗口没有源数据段
+	patch, err := CreateDiffs(nil, newData, WithStandardVCDIFF())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ind := range vcdiffWindowIndicators(t, patch) {
+		if ind != 0 {
+			t.Fatalf("empty old: window %d indicator %#x, want 0", i, ind)
+		}
+	}
+	for _, opts := range [][]Option{{WithSecondaryCompression(SecondaryZstd)}, {WithChecksum(ChecksumXXH3)}} {
+		if _, err := CreateDiffs(oldData, newData, append(opts, WithStandardVCDIFF())...); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("WithStandardVCDIFF with an unsupported option: got %v, want ErrInvalidArgument", err)
+		}
+	}
+}
+
+// TestVCDIFFFixture testdata/vcdiff.patch 是原生编码器对 testPair 输出的 VCDIFF 补丁，
+// 在没有原生库的构建中由纯 Go 解码器独立应用
+func TestVCDIFFFixture(t *testing.T) {
+	oldData, newData := testPair()
+	patch, err := os.ReadFile(filepath.Join("testdata", "vcdiff.patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vcdiffWindowIndicators(t, patch)
+	if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("ApplyDiffsData returned %d bytes, %v", len(got), err)
+	}
+	var b bytes.Buffer
+	if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b); err != nil || !bytes.Equal(b.Bytes(), newData) {
+		t.Fatalf("ApplyDiffsStream wrote %d bytes, %v", b.Len(), err)
+	}
+}
+
+// TestVCDIFFXdelta3 与 xdelta3 命令行工具互通：xdelta3 -d 应用本库的补丁，本库应用 xdelta3 -e 创建的补丁。
+// PATH 中没有 xdelta3 时跳过
+func TestVCDIFFXdelta3(t *testing.T) {
+	requireNative(t)
+	xdelta3, err := exec.LookPath("xdelta3")
+	if err != nil {
+		t.Skip("xdelta3 not found")
+	}
+	oldData, newData := textFixture(1 << 20)
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, map[string][]byte{"old": oldData, "new": newData})
+	oldPath, newPath := paths["old"], paths["new"]
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"adler32", []Option{WithChecksum(ChecksumAdler32)}},
+		{"empty old", nil},
+	} {
+		src := oldData
+		if tc.name == "empty old" {
+			src = nil
+		}
+		patch, err := CreateDiffs(src, newData, append(tc.opts, WithStandardVCDIFF())...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		patchPath := writeFiles(t, dir, map[string][]byte{tc.name + ".vcdiff": patch})[tc.name+".vcdiff"]
+		outPath := filepath.Join(dir, tc.name+".out")
+		args := []string{"-d", "-f"}
+		if src != nil {
+			args = append(args, "-s", oldPath)
+		}
+		if out, err := exec.Command(xdelta3, append(args, patchPath, outPath)...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: xdelta3 -d: %v\n%s", tc.name, err, out)
+		}
+		if got, err := os.ReadFile(outPath); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: xdelta3 -d wrote %d bytes, %v", tc.name, len(got), err)
+		}
+	}
+
+	for _, args := range [][]string{{"-e"}, {"-e", "-0"}, {"-e", "-9"}} {
+		patchPath := filepath.Join(dir, "xdelta3.vcdiff")
+		if out, err := exec.Command(xdelta3, append(args, "-f", "-s", oldPath, newPath, patchPath)...).CombinedOutput(); err != nil {
+			t.Fatalf("xdelta3 %v: %v\n%s", args, err, out)
+		}
+		patch, err := os.ReadFile(patchPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, apply := range applyPaths(t.TempDir(), oldData, patch) {
+			got, err := apply()
+			if errors.Is(err, ErrUnsupportedPatch) {
+				// 默认构建的 xdelta3 可能对数据段使用 djw 或 lzma 二次压缩
+				t.Logf("xdelta3 %v: %s: %v", args, name, err)
+				continue
+			}
+			if err != nil || !bytes.Equal(got, newData) {
+				t.Fatalf("xdelta3 %v: %s returned %d bytes, %v", args, name, len(got), err)
+			}
+		}
+	}
+}
+
+// TestVCDIFFLayoutFixtures testdata/vcdiff-*.vcdiff 是 text.old 到 text.new 的补丁，按 xdelta3 写出的布局手工编码，
+// 不是 xdelta3 生成的（与真实 xdelta3 的互通见 TestVCDIFFXdelta3）：带应用头、每个窗口带 VCD_ADLER32，
+// 指令使用默认代码表的 ADD+COPY 组合、RUN、近地址和同地址缓存以及目标内的 COPY，vcdiff-lzma-declared 在文件头中
+// 声明了 lzma 二次压缩但没有数据段使用它。原生层和纯 Go 解码器都能应用；
+// 源数据不符时返回 ErrChecksumMismatch，数据段用 djw 压缩或应用头声明外部压缩时返回 ErrUnsupportedPatch
+func TestVCDIFFLayoutFixtures(t *testing.T) {
+	read := func(name string) []byte {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	oldData, newData := read("text.old"), read("text.new")
+	apply := func(patch, old []byte) ([]byte, error) {
+		got, err := ApplyDiffsData(old, patch)
+		var b bytes.Buffer
+		// 流式接口在发现错误之前可能已经写出了前面的窗口
+		serr := ApplyDiffsStream(bytes.NewReader(old), bytes.NewReader(patch), &b)
+		if (err == nil) != (serr == nil) || err == nil && !bytes.Equal(got, b.Bytes()) {
+			t.Fatalf("ApplyDiffsData: %d bytes, %v; ApplyDiffsStream: %d bytes, %v", len(got), err, b.Len(), serr)
+		}
+		return got, err
+	}
+	for _, name := range []string{"vcdiff-appheader.vcdiff", "vcdiff-lzma-declared.vcdiff"} {
+		patch := read(name)
+		if got, err := apply(patch, oldData); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: got %d bytes, %v", name, len(got), err)
+		}
+		changed := bytes.Clone(oldData)
+		changed[100] ^= 1
+		if _, err := apply(patch, changed); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("%s with a changed source: got %v, want ErrChecksumMismatch", name, err)
+		}
+		if _, err := apply(patch[:len(patch)-1], oldData); !errors.Is(err, ErrCorruptPatch) {
+			t.Fatalf("%s truncated: got %v, want ErrCorruptPatch", name, err)
+		}
+	}
+	for _, tc := range []struct{ name, msg string }{
+		{"vcdiff-djw.vcdiff", "secondary compression (djw) is not supported"},
+		{"vcdiff-gzip.vcdiff", "external compression (G) is not supported"},
+	} {
+		_, err := apply(read(tc.name), oldData)
+		if !errors.Is(err, ErrUnsupportedPatch) || !strings.Contains(err.Error(), tc.msg) {
+			t.Fatalf("%s: got %v, want ErrUnsupportedPatch mentioning %q", tc.name, err, tc.msg)
+		}
+	}
+}
+
+// xdelta3Fixtures testdata/xdelta3/<版本>/ 中由真实 xdelta3 生成的 text.old 到 text.new 的补丁，以及生成时 xdelta3 的参数；
+// secondary 为 true 的补丁数据段可能用了本库不支持的二次压缩（取决于 xdelta3 的构建），允许返回 ErrUnsupportedPatch
+var xdelta3Fixtures = []struct {
+	name      string
+	args      []string
+	secondary bool
+}{
+	{"default.vcdiff", []string{"-e"}, true},
+	{"nosecondary.vcdiff", []string{"-e", "-S", "none"}, false},
+	{"level1.vcdiff", []string{"-e", "-1", "-S", "none"}, false},
+	{"level9.vcdiff", []string{"-e", "-9", "-S", "none"}, false},
+	{"nochecksum.vcdiff", []string{"-e", "-n", "-S", "none"}, false},
+	{"djw.vcdiff", []string{"-e", "-S", "djw"}, true},
+}
+
+// xdelta3Version 返回 xdelta3 -V 报告的版本号，例如 3.1.0
+func xdelta3Version(t *testing.T, xdelta3 string) string {
+	t.Helper()
+	out, _ := exec.Command(xdelta3, "-V").CombinedOutput()
+	m := regexp.MustCompile(`version (\d+\.\d+\.\d+)`).FindSubmatch(out)
+	if m == nil {
+		t.Fatalf("xdelta3 -V: no version in %q", out)
+	}
+	return string(m[1])
+}
+
+// TestVCDIFFXdelta3Fixtures 应用 testdata/xdelta3 中检入的、由真实 xdelta3 3.0.x、3.1.x 生成的补丁（见 xdelta3Fixtures），
+// 原生层（没有原生后端的构建中是纯 Go 解码器）得到 text.new；带 VCD_ADLER32 的补丁在源数据不符时返回 ErrChecksumMismatch，截断的补丁返回 ErrCorruptPatch。
+// PATH 中有 xdelta3 时 go test -run TestVCDIFFXdelta3Fixtures -update 用它重新生成 testdata/xdelta3/<版本>/ 中的补丁，
+// 在 testdata 中运行，应用头中只有相对的文件名；缺少 3.0.x 或 3.1.x 的补丁时失败
+func TestVCDIFFXdelta3Fixtures(t *testing.T) {
+	if *updateGolden {
+		xdelta3, err := exec.LookPath("xdelta3")
+		if err != nil {
+			t.Fatal("-update needs xdelta3 on PATH")
+		}
+		dir := filepath.Join("testdata", "xdelta3", xdelta3Version(t, xdelta3))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range xdelta3Fixtures {
+			out := filepath.Join("xdelta3", filepath.Base(dir), f.name)
+			cmd := exec.Command(xdelta3, append(f.args, "-f", "-s", "text.old", "text.new", out)...)
+			cmd.Dir = "testdata"
+			if msg, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("xdelta3 %v: %v\n%s", f.args, err, msg)
+			}
+		}
+	}
+	dirs, err := filepath.Glob(filepath.Join("testdata", "xdelta3", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"3.0.", "3.1."} {
+		found := false
+		for _, dir := range dirs {
+			found = found || strings.HasPrefix(filepath.Base(dir), want)
+		}
+		if !found {
+			t.Fatalf("no xdelta3 %sx output in testdata/xdelta3; run with -update where that xdelta3 is installed", want)
+		}
+	}
+	oldData, err := os.ReadFile(filepath.Join("testdata", "text.old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newData, err := os.ReadFile(filepath.Join("testdata", "text.new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个字节都改动过的源数据，补丁中任何一个来自源数据的 COPY 都会让结果不同
+	changed := bytes.Clone(oldData)
+	for i := range changed {
+		changed[i] ^= 1
+	}
+	for _, dir := range dirs {
+		for _, f := range xdelta3Fixtures {
+			name := filepath.Join(filepath.Base(dir), f.name)
+			patch, err := os.ReadFile(filepath.Join(dir, f.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ApplyDiffsData(oldData, patch)
+			if f.secondary && errors.Is(err, ErrUnsupportedPatch) {
+				t.Logf("%s: %v", name, err)
+				continue
+			}
+			if err != nil || !bytes.Equal(got, newData) {
+				t.Fatalf("%s: ApplyDiffsData returned %d bytes, %v", name, len(got), err)
+			}
+			var b bytes.Buffer
+			if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(patch), &b); err != nil || !bytes.Equal(b.Bytes(), newData) {
+				t.Fatalf("%s: ApplyDiffsStream wrote %d bytes, %v", name, b.Len(), err)
+			}
+			if f.name != "nochecksum.vcdiff" {
+				if _, err := ApplyDiffsData(changed, patch); !errors.Is(err, ErrChecksumMismatch) {
+					t.Fatalf("%s with a changed source: got %v, want ErrChecksumMismatch", name, err)
+				}
+			}
+			if _, err := ApplyDiffsData(oldData, patch[:len(patch)-1]); !errors.Is(err, ErrCorruptPatch) {
+				t.Fatalf("%s truncated: got %v, want ErrCorruptPatch", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"testing"
+)
+
+// splitAt 在 cuts 给出的偏移处把 data 切成若干段，cuts 中重复的偏移产生空段
+func splitAt(data []byte, cuts ...int) [][]byte {
+	var out [][]byte
+	prev := 0
+	for _, c := range cuts {
+		c = min(c, len(data))
+		out = append(out, data[prev:c])
+		prev = c
+	}
+	return append(out, data[prev:])
+}
+
+// splitEvery 把 data 切成每段 n 字节
+func splitEvery(data []byte, n int) [][]byte {
+	var out [][]byte
+	for len(data) > n {
+		out = append(out, data[:n])
+		data = data[n:]
+	}
+	return append(out, data)
+}
+
+// TestCreateDiffsDataVec 新旧数据按各种方式分段（每段一个字节、质数长度、块边界前后一个字节、随机位置、
+// 夹杂空段、只有一段、没有段）时，CreateDiffsDataVec 的补丁与拼接后调用 CreateDiffsData 逐字节相同
+func TestCreateDiffsDataVec(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(200 << 10)
+	small, smallNew := textFixture(4 << 10)
+	r := fixtureRand(80)
+	random := func(data []byte) [][]byte {
+		cuts := make([]int, 0, 40)
+		for at := 0; at < len(data); at += 1 + r.intn(20000) {
+			cuts = append(cuts, at)
+		}
+		return splitAt(data, cuts...)
+	}
+	bs := int(DefaultBlockSize)
+	type split struct {
+		name  string
+		split func([]byte) [][]byte
+	}
+	splits := []split{
+		{"one piece", func(b []byte) [][]byte { return [][]byte{b} }},
+		{"no pieces", func(b []byte) [][]byte {
+			if len(b) == 0 {
+				return nil
+			}
+			return [][]byte{b}
+		}},
+		{"7 bytes", func(b []byte) [][]byte { return splitEvery(b, 7) }},
+		{"4093 bytes", func(b []byte) [][]byte { return splitEvery(b, 4093) }},
+		{"block size - 1", func(b []byte) [][]byte { return splitEvery(b, bs-1) }},
+		{"block size + 1", func(b []byte) [][]byte { return splitEvery(b, bs+1) }},
+		{"around block boundaries", func(b []byte) [][]byte { return splitAt(b, bs-1, bs, bs+1, 3*bs, 3*bs, 10*bs+7) }},
+		{"empty pieces", func(b []byte) [][]byte { return splitAt(b, 0, 0, 100, 100, len(b), len(b)) }},
+		{"random", random},
+	}
+	pairs := []struct {
+		name             string
+		oldData, newData []byte
+	}{
+		{"text edits", oldData, newData},
+		{"identical", oldData, oldData},
+		{"append only", oldData, append(bytes.Clone(oldData), "tail"...)},
+		{"empty old", nil, newData},
+		{"empty new", oldData, nil},
+		{"both empty", nil, nil},
+	}
+	for _, blockSize := range []uint32{16, DefaultBlockSize, AutoBlockSize} {
+		for _, p := range pairs {
+			want, err := CreateDiffsData(p.oldData, p.newData, blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 每种分法都作为旧数据和新数据的分法各出现两次，搭配不同的另一边
+			for i, so := range splits {
+				for _, sn := range []split{splits[i], splits[(i+4)%len(splits)]} {
+					got, err := CreateDiffsDataVec(so.split(p.oldData), sn.split(p.newData), blockSize)
+					if err != nil {
+						t.Fatalf("block size %d, %s, old in %s, new in %s: %v", blockSize, p.name, so.name, sn.name, err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Fatalf("block size %d, %s, old in %s, new in %s: %d byte patch differs from CreateDiffsData (%d bytes)",
+							blockSize, p.name, so.name, sn.name, len(got), len(want))
+					}
+				}
+			}
+			if out, err := ApplyDiffsData(p.oldData, want); err != nil || !bytes.Equal(out, p.newData) {
+				t.Fatalf("block size %d, %s: applying gave %d bytes, %v", blockSize, p.name, len(out), err)
+			}
+		}
+	}
+
+	// 每段一个字节
+	want, err := CreateDiffsData(small, smallNew, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := CreateDiffsDataVec(splitEvery(small, 1), splitEvery(smallNew, 1), 16); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("one byte pieces: %d byte patch differs from CreateDiffsData (%d bytes), %v", len(got), len(want), err)
+	}
+}
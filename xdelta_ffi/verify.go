@@ -0,0 +1,48 @@
+package xdelta_ffi
+
+import "crypto/sha256"
+
+// VerifyPatch 检查补丁能否应用到旧数据：与 ApplyDiffsData 一样完整解码，但输出只用来计算长度和 SHA-256，
+// 不保留在内存中，内存占用与新数据的大小无关（VCDIFF 补丁仍需缓存一个目标窗口，xdelta3 生成的窗口通常不超过 8 MiB）
+// 成功返回 nil，失败返回与 ApplyDiffsData 相同的错误，bsdiff 补丁同样支持；
+// 对 CreateEnvelope 生成的信封，先校验旧数据，解码后再确认输出的长度和 SHA-256 与信封一致，否则返回 ErrTargetMismatch
+// opts 中只有 WithMaxOutputSize 有效
+func VerifyPatch(oldData, diffsData []byte, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	if !IsEnvelope(diffsData) {
+		_, _, err := verifyOutput(oldData, diffsData, o.outputLimit())
+		return err
+	}
+	h, patch, err := ParseEnvelope(diffsData)
+	if err != nil {
+		return err
+	}
+	if err := h.checkSource(oldData); err != nil {
+		return err
+	}
+	if err := h.checkLimit(o.outputLimit()); err != nil {
+		return err
+	}
+	n, sum, err := verifyOutput(oldData, patch, o.outputLimit())
+	if err != nil {
+		return err
+	}
+	return h.checkTarget(n, sum)
+}
+
+// verifyOutput 解码 patch 并丢弃输出，返回输出的长度和 SHA-256
+func verifyOutput(oldData, patch []byte, limit uint64) (int64, [sha256.Size]byte, error) {
+	if err := Init(); err != nil {
+		return 0, [sha256.Size]byte{}, err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return 0, [sha256.Size]byte{}, err
+	}
+	defer release()
+	n, sum, err := verifyPatchData(oldData, patch, limit, nil)
+	return int64(n), sum, err
+}
@@ -0,0 +1,75 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestVerifyPatch 每种格式的补丁用正确的旧数据校验通过，结果与 ApplyDiffsData 成功一致；
+// WithMaxOutputSize 不小于新数据的长度时照常通过
+func TestVerifyPatch(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	for name, patch := range patchFormats(t, oldData, newData) {
+		if err := VerifyPatch(oldData, patch); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, newData) {
+			t.Fatalf("%s: ApplyDiffsData: %d bytes, %v", name, len(got), err)
+		}
+		if err := VerifyPatch(oldData, patch, WithMaxOutputSize(int64(len(newData)))); err != nil {
+			t.Fatalf("%s: limit equal to the new size: %v", name, err)
+		}
+	}
+	// 新旧都为空
+	empty, err := CreateEnvelope(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPatch(nil, empty); err != nil {
+		t.Fatalf("empty envelope: %v", err)
+	}
+}
+
+// TestVerifyPatchCorrupt 截断的补丁和信封返回 ErrCorruptPatch；旧数据与信封或校验和不符时返回 ErrSourceMismatch；
+// 信封中的补丁换成生成同样长度的不同内容的补丁时返回 ErrTargetMismatch；输出超过 WithMaxOutputSize 时返回 ErrOutputTooLarge
+func TestVerifyPatchCorrupt(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patches := patchFormats(t, oldData, newData)
+	for _, name := range []string{"native", "checksum", "envelope"} {
+		data := patches[name]
+		for _, n := range []int{0, 1, 8, envelopeHeaderLen - 1, envelopeHeaderLen, len(data) / 2, len(data) - 1} {
+			if err := VerifyPatch(oldData, data[:n]); !errors.Is(err, ErrCorruptPatch) {
+				t.Fatalf("%s: first %d of %d bytes: got %v, want ErrCorruptPatch", name, n, len(data), err)
+			}
+		}
+	}
+
+	other := bytes.ToUpper(oldData)
+	for _, name := range []string{"checksum", "envelope"} {
+		if err := VerifyPatch(other, patches[name]); !errors.Is(err, ErrSourceMismatch) {
+			t.Fatalf("%s with other old data: got %v, want ErrSourceMismatch", name, err)
+		}
+	}
+	if err := VerifyPatch(oldData[:len(oldData)-1], patches["envelope"]); !errors.Is(err, ErrSourceMismatch) {
+		t.Fatalf("envelope with shorter old data: got %v, want ErrSourceMismatch", err)
+	}
+
+	// 版本 1 的信封头不保护后面的补丁：换成另一个补丁后只有解码结果能发现
+	wrong, err := CreateDiffs(oldData, append(bytes.Clone(newData[1:]), '!'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := append(bytes.Clone(patches["envelope"][:envelopeHeaderLen]), wrong...)
+	if err := VerifyPatch(oldData, env); !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("envelope around another patch: got %v, want ErrTargetMismatch", err)
+	}
+
+	for name, patch := range patches {
+		if err := VerifyPatch(oldData, patch, WithMaxOutputSize(int64(len(newData)-1))); !errors.Is(err, ErrOutputTooLarge) {
+			t.Fatalf("%s: limit below the new size: got %v, want ErrOutputTooLarge", name, err)
+		}
+	}
+}
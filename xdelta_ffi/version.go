@@ -0,0 +1,79 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// WrapperVersion 本包（Go 封装）的版本
+	WrapperVersion = "0.1.0"
+	// WrapperABIVersion 本包构建时对应的原生库 ABI 修订号（xdelta_interface.h 中的 XDELTA_ABI_VERSION），
+	// 也是 Init 接受的最低修订号，更旧的库返回 ErrIncompatibleLibrary
+	WrapperABIVersion = 27
+)
+
+// LibraryVersion 实际加载的原生库的版本信息，见 Version
+type LibraryVersion struct {
+	// CrateVersion 原生库 Rust crate 的版本
+	CrateVersion string
+	// Algorithm 差分算法和支持的补丁格式的说明
+	Algorithm string
+	// FormatVersion 本库补丁格式的修订号
+	FormatVersion int
+	// ABIVersion 原生库实现的 ABI 修订号，不会小于 WrapperABIVersion（见 Init），大于时说明原生库比本包新
+	ABIVersion int
+}
+
+func (v LibraryVersion) String() string {
+	return fmt.Sprintf("xdelta %s (abi %d, format %d, %s)", v.CrateVersion, v.ABIVersion, v.FormatVersion, v.Algorithm)
+}
+
+// versionInfoC 与 xdelta_interface.h 中的 xdelta_version_info 布局一致
+type versionInfoC struct {
+	abi          uint32
+	format       uint32
+	crateVersion [32]byte
+	algorithm    [128]byte
+}
+
+// Version 返回实际加载的原生库的版本信息（会触发 Init），用于排查加载了旧版本原生库之类的问题，
+// 实际加载的路径见 LibraryPath；没有原生后端的构建中返回 ErrNotSupported
+func Version() (LibraryVersion, error) {
+	if !nativeBackend {
+		return LibraryVersion{}, ErrNotSupported
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return LibraryVersion{}, err
+	}
+	defer release()
+	return libraryVersion(), nil
+}
+
+// libraryVersion 向已加载的原生库查询版本信息
+func libraryVersion() LibraryVersion {
+	info := nativeVersion()
+	return LibraryVersion{
+		CrateVersion:  cString(info.crateVersion[:]),
+		Algorithm:     cString(info.algorithm[:]),
+		FormatVersion: int(info.format),
+		ABIVersion:    int(info.abi),
+	}
+}
+
+// checkABI 原生库的 ABI 比本包新时记录一条警告：已有函数的行为可能已经改变
+func checkABI() {
+	if v := libraryVersion(); v.ABIVersion > WrapperABIVersion {
+		logf(LevelWarn, "native library %s at %s has ABI revision %d, newer than the %d this package was built against",
+			v.CrateVersion, LibraryPath(), v.ABIVersion, WrapperABIVersion)
+	}
+}
+
+// cString 返回 b 中第一个 NUL 之前的内容
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,32 @@
+package xdelta_ffi
+
+// WithSourceWindowSize 创建补丁时新数据的每个位置只与旧数据中前后共 n 字节（按块大小向下取整，至少一块）的范围匹配，
+// 相当于 xdelta3 的 -B；0 表示整个旧数据（默认），小于 0 返回 ErrInvalidArgument
+// 窗口随编码位置在旧数据上向后滑动，原生层只保存窗口内的块签名，内存约为 n / 块大小 × 160 字节，与旧数据的大小无关，
+// CreateDiffsFile 也只按窗口顺序读取旧文件，适合几十 GB 的旧文件
+// 代价是挪动超过半个窗口（或者在旧数据中往回引用）的内容不再能匹配而作为新数据写入补丁，补丁会变大；
+// 新旧数据大体对齐（例如磁盘镜像、只在局部修改的大文件）时补丁几乎不变。COPY 仍使用旧数据中的绝对偏移，
+// 所有应用接口都能直接应用，不需要知道编码时的窗口大小
+// 对 CreateDiffs、CreateDiffsFile（以及基于它们的 CreateDirDiff、CreateDiffsBatch 等）有效，使用时总是单线程编码、忽略 WithThreads；
+// 流式接口、Encoder 和 SourceEncoder 忽略这一选项
+func WithSourceWindowSize(n int64) Option {
+	return func(o *options) {
+		o.sourceWindow = n
+	}
+}
+
+// createThreads CreateDiffs、CreateDiffsFile 实际使用的编码线程数，使用源窗口或 WithBSDiff 时总是 1
+func (o options) createThreads() int {
+	if o.sourceWindow > 0 || o.bsdiff {
+		return 1
+	}
+	return o.encodeThreads()
+}
+
+// indexedSize 创建补丁时签名表覆盖的旧数据长度
+func (o options) indexedSize(oldLen int64) int64 {
+	if o.sourceWindow > 0 {
+		return min(oldLen, o.sourceWindow)
+	}
+	return oldLen
+}
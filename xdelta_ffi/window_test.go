@@ -0,0 +1,74 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWithSourceWindowSize 任意窗口大小创建的补丁都能用所有应用接口还原，应用时不需要知道窗口大小；
+// 新旧数据大体对齐时补丁与不限制窗口时几乎一样大，内容移动超过窗口时补丁变大但仍然正确
+func TestWithSourceWindowSize(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(1 << 20)
+	half := len(oldData) / 2
+	swapped := append(bytes.Clone(oldData[half:]), oldData[:half]...)
+	full, err := CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullSwapped, err := CreateDiffs(oldData, swapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, window := range []int64{1, int64(DefaultBlockSize), 64 << 10, 256 << 10, 4 << 20} {
+		for _, tc := range []struct {
+			name    string
+			newData []byte
+			opts    []Option
+		}{
+			{"text", newData, nil},
+			{"swapped", swapped, nil},
+			{"vcdiff", newData, []Option{WithStandardVCDIFF()}},
+			{"zstd", swapped, []Option{WithSecondaryCompression(SecondaryZstd)}},
+			{"threads", newData, []Option{WithThreads(4)}},
+		} {
+			patch, err := CreateDiffs(oldData, tc.newData, append(tc.opts, WithSourceWindowSize(window))...)
+			if err != nil {
+				t.Fatalf("window %d, %s: %v", window, tc.name, err)
+			}
+			for name, apply := range applyPaths(t.TempDir(), oldData, patch) {
+				if got, err := apply(); err != nil || !bytes.Equal(got, tc.newData) {
+					t.Fatalf("window %d, %s: %s returned %d bytes, %v", window, tc.name, name, len(got), err)
+				}
+			}
+			switch {
+			case tc.name == "text" && window >= 64<<10 && len(patch) > len(full)*11/10:
+				t.Fatalf("window %d: %d byte patch for aligned data, %d without a window", window, len(patch), len(full))
+			case tc.name == "swapped" && window <= 256<<10 && len(patch) < len(oldData)/2:
+				t.Fatalf("window %d: %d byte patch although the halves moved out of the window", window, len(patch))
+			case tc.name == "swapped" && window >= int64(len(oldData))*2 && !bytes.Equal(patch, fullSwapped):
+				t.Fatalf("window %d: a window covering the whole old data changed the patch", window)
+			}
+		}
+	}
+	// CreateDiffsFile 按窗口顺序读取旧文件，补丁与 CreateDiffs 相同
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, map[string][]byte{"old": oldData, "new": swapped})
+	want, err := CreateDiffs(oldData, swapped, WithSourceWindowSize(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchPath := filepath.Join(dir, "patch")
+	if err := CreateDiffsFile(paths["old"], paths["new"], patchPath, DefaultBlockSize, WithSourceWindowSize(64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(patchPath); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("CreateDiffsFile: %d bytes differ from CreateDiffs (%d bytes), %v", len(got), len(want), err)
+	}
+	if _, err := CreateDiffs(oldData, newData, WithSourceWindowSize(-1)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("negative window: got %v, want ErrInvalidArgument", err)
+	}
+}
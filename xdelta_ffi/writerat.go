@@ -0,0 +1,154 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// applySegmentSize ApplyDiffsAt 切分补丁的大小（每段的输出字节数），与多线程编码的分段大小相同
+const applySegmentSize = 8 << 20
+
+// patchSegment 与 xdelta_interface.h 中的 xdelta_patch_segment 布局一致
+type patchSegment struct {
+	patchOffset  uint64
+	patchLen     uint64
+	targetOffset uint64
+	targetLen    uint64
+}
+
+// ApplyDiffsAt 与 ApplyDiffs 相同，但结果按偏移写入 out，返回输出的长度
+// 补丁先按记录（VCDIFF 为窗口）边界切成约 8 MiB 输出的段，各段只从旧数据复制、互不依赖，
+// 按 WithThreads 设置的数量（0 表示所有 CPU 核心，默认为 1 即按顺序解码）并行解码，各自写入输出中的对应区间；
+// 二次压缩的本库格式补丁无法切分，只能按顺序解码
+// 解码前先从补丁得到输出的长度：超过 WithMaxOutputSize 的上限时不写入任何数据，直接返回 ErrOutputTooLarge；
+// out 带有 Truncate(int64) error 方法（例如 *os.File）时先把它截断或扩展到这个长度
+// 每个 goroutine 有自己的旧数据缓存（WithSourceCache），old 和 out 会被并发调用，各次写入的区间互不重叠；
+// WithProgress 在每段完成时调用；某段失败后不再开始新的段，返回按输出顺序最靠前的错误，此时 out 的内容不可用
+func ApplyDiffsAt(old io.ReaderAt, oldSize int64, patch []byte, out io.WriterAt, opts ...Option) (int64, error) {
+	if oldSize < 0 {
+		return 0, fmt.Errorf("%w: negative old data size %d", ErrInvalidArgument, oldSize)
+	}
+	if err := Init(); err != nil {
+		return 0, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return 0, err
+	}
+	h, patch, err := o.openEnvelopeAt(patch, oldSize)
+	if err != nil {
+		return 0, err
+	}
+	release, err := useLibrary()
+	if err != nil {
+		return 0, err
+	}
+	headerLen, segs, err := patchSegments(patch, applySegmentSize)
+	release()
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	if len(segs) > 0 {
+		last := segs[len(segs)-1]
+		size = last.targetOffset + last.targetLen
+	}
+	if limit := o.outputLimit(); limit > 0 && size > limit {
+		return 0, fmt.Errorf("%w: patch declares %d bytes of output, the limit is %d", ErrOutputTooLarge, size, limit)
+	}
+	if h != nil && size != uint64(h.TargetSize) {
+		return 0, fmt.Errorf("%w: patch declares %d bytes of output, the envelope expects %d", ErrTargetMismatch, size, h.TargetSize)
+	}
+	if size > 1<<63-1 {
+		return 0, fmt.Errorf("%w: patch declares %d bytes of output", ErrOutputTooLarge, size)
+	}
+	if t, ok := out.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(int64(size)); err != nil {
+			return 0, err
+		}
+	}
+
+	workers := o.threads
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = max(min(workers, len(segs)), 1)
+
+	header := patch[:headerLen]
+	errs := make([]error, len(segs))
+	var mu sync.Mutex
+	failed := false
+	prog := newProgress(o.progress, int64(len(patch)))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src := newCachedSource(old, oldSize, o.sourceCache)
+			for i := range next {
+				seg := segs[i]
+				data := patch[seg.patchOffset : seg.patchOffset+seg.patchLen]
+				err := decodeSegment(src, header, bytes.NewReader(data), seg, io.NewOffsetWriter(out, int64(seg.targetOffset)), o.windowSize)
+				mu.Lock()
+				if err != nil {
+					errs[i] = err
+					failed = true
+				} else {
+					n := int(segs[i].patchLen)
+					if i == 0 {
+						n += headerLen
+					}
+					prog.add(n)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range segs {
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(size), nil
+}
+
+// decodeSegment 把补丁头、seg 的补丁数据 data 和需要时的结束记录（见 segmentEnd）拼成一个补丁解码，seg 的输出写入 out
+// 解码的错误中的偏移和窗口序号都相对于这一段，因此加上这一段在输出中的偏移
+func decodeSegment(src io.ReaderAt, header []byte, data io.Reader, seg patchSegment, out io.Writer, windowSize int) error {
+	w := &countingWriter{w: out}
+	r := io.MultiReader(bytes.NewReader(header), data, bytes.NewReader(segmentEnd(header, seg)))
+	if err := decodeStream(src, r, w, windowSize, seg.targetLen, newProgress(nil, -1)); err != nil {
+		return fmt.Errorf("segment at output offset %d: %w", seg.targetOffset, err)
+	}
+	if uint64(w.n) != seg.targetLen {
+		return fmt.Errorf("%w: segment at output offset %d produced %d bytes, %d were declared", ErrCorruptPatch, seg.targetOffset, w.n, seg.targetLen)
+	}
+	return nil
+}
+
+// countingWriter 记录写入的字节数
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,152 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// sizedWriterAt 先由 Truncate 分配好长度的 io.WriterAt，之后并发写入互不重叠的区间是安全的
+type sizedWriterAt struct {
+	b         []byte
+	truncated int
+}
+
+func (w *sizedWriterAt) Truncate(size int64) error {
+	w.b = make([]byte, size)
+	w.truncated++
+	return nil
+}
+
+func (w *sizedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(w.b)) {
+		return 0, errors.New("write past the truncated size")
+	}
+	return copy(w.b[off:], p), nil
+}
+
+// TestApplyDiffsAtParallel 输出跨越多个段的补丁按任意线程数解码的结果都与 ApplyDiffsData 相同，
+// 写入前先截断 out；二次压缩的补丁按顺序解码，VCDIFF 和信封同样可以并行；WithProgress 在每段完成时调用
+func TestApplyDiffsAtParallel(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(3*applySegmentSize + 12345)
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		envelope bool
+	}{
+		{"native", []Option{WithThreads(4)}, false},
+		{"vcdiff", []Option{WithThreads(4), WithStandardVCDIFF()}, false},
+		{"zstd", []Option{WithSecondaryCompression(SecondaryZstd)}, false},
+		{"envelope", []Option{WithThreads(4)}, true},
+	} {
+		var patch []byte
+		var err error
+		if tc.envelope {
+			patch, err = CreateEnvelope(oldData, newData, tc.opts...)
+		} else {
+			patch, err = CreateDiffs(oldData, newData, tc.opts...)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for _, threads := range []int{1, 4, 0} {
+			w := &sizedWriterAt{}
+			var calls atomic.Int32
+			n, err := ApplyDiffsAt(bytes.NewReader(oldData), int64(len(oldData)), patch, w,
+				WithThreads(threads), WithProgress(func(done, total int64) { calls.Add(1) }))
+			if err != nil {
+				t.Fatalf("%s, %d threads: %v", tc.name, threads, err)
+			}
+			if n != int64(len(newData)) || !bytes.Equal(w.b, newData) {
+				t.Fatalf("%s, %d threads: got %d bytes, want %d", tc.name, threads, n, len(newData))
+			}
+			if w.truncated != 1 {
+				t.Fatalf("%s, %d threads: Truncate called %d times, want 1", tc.name, threads, w.truncated)
+			}
+			if tc.name != "zstd" && calls.Load() < 3 {
+				t.Fatalf("%s, %d threads: progress reported %d segments, want at least 3", tc.name, threads, calls.Load())
+			}
+		}
+	}
+}
+
+// TestApplyDiffsAtFile 输出到 *os.File：比输出长的已有文件被截断；输出超过 WithMaxOutputSize 时不写入任何数据，
+// 文件保持原状；某一段损坏时返回它的错误，带有这一段在输出中的偏移
+func TestApplyDiffsAtFile(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(2*applySegmentSize + 999)
+	patch, err := CreateDiffs(oldData, newData, WithThreads(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "out")
+	stale := bytes.Repeat([]byte{0xff}, len(newData)+4096)
+	if err := os.WriteFile(p, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := ApplyDiffsAt(bytes.NewReader(oldData), int64(len(oldData)), patch, f, WithMaxOutputSize(1000)); !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("WithMaxOutputSize: got %v, want ErrOutputTooLarge", err)
+	}
+	if got, _ := os.ReadFile(p); !bytes.Equal(got, stale) {
+		t.Fatal("ApplyDiffsAt changed the file although the output is too large")
+	}
+	if _, err := ApplyDiffsAt(bytes.NewReader(oldData), int64(len(oldData)), patch, f, WithThreads(0)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(p); err != nil || !bytes.Equal(got, newData) {
+		t.Fatalf("file holds %d bytes, want %d (%v)", len(got), len(newData), err)
+	}
+
+	// 带校验和的补丁第二段中的一个字节被改动：那一段的输出与校验和不符，错误指出这一段在输出中的偏移
+	checked, err := CreateDiffs(oldData, newData, WithThreads(2), WithChecksum(ChecksumXXH3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checked[len(checked)*6/10] ^= 0xff
+	_, err = ApplyDiffsAt(bytes.NewReader(oldData), int64(len(oldData)), checked, &sizedWriterAt{}, WithThreads(4))
+	if !errors.Is(err, ErrChecksumMismatch) || !strings.HasPrefix(err.Error(), "segment at output offset ") || strings.HasPrefix(err.Error(), "segment at output offset 0:") {
+		t.Fatalf("corrupt second segment: got %v, want ErrChecksumMismatch naming the segment's output offset", err)
+	}
+	if _, err := ApplyDiffsAt(bytes.NewReader(oldData), -1, patch, &sizedWriterAt{}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("negative old size: got %v, want ErrInvalidArgument", err)
+	}
+}
+
+// BenchmarkApplyDiffsAt 把 64 MiB 输出的补丁解码到预先分配的文件：按顺序与按所有 CPU 核心并行
+func BenchmarkApplyDiffsAt(b *testing.B) {
+	requireNative(b)
+	oldData, newData := textFixture(64 << 20)
+	patch, err := CreateDiffs(oldData, newData, WithThreads(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(b.TempDir(), "out"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	for _, bc := range []struct {
+		name    string
+		threads int
+	}{{"sequential", 1}, {"parallel", 0}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(newData)))
+			for b.Loop() {
+				if _, err := ApplyDiffsAt(bytes.NewReader(oldData), int64(len(oldData)), patch, f, WithThreads(bc.threads)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
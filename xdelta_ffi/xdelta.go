@@ -1,132 +1,385 @@
-//go:build cgo
-// +build cgo
-
 package xdelta_ffi
 
-/*
-	#cgo CFLAGS: -I${SRCDIR}/include
-	#cgo LDFLAGS: -lkernel32 -lntdll -luserenv -lws2_32 -ldbghelp -L${SRCDIR}/bin -lxdelta
-	#include <stdlib.h>
-	#include <xdelta_interface.h>
-*/
-import "C"
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"runtime"
-	"unsafe"
+	"math"
+	"time"
 )
 
-func init() {
-	// 动态库最终路径
-	var libFile string
-	switch runtime.GOOS {
-	case "windows":
-		libFile = "bin/xdelta.dll"
-	case "darwin":
-		libFile = "bin/libxdelta.dylib"
-	default:
-		libFile = "bin/libxdelta.so"
-	}
-
-	// 如果库不存在，则编译 Rust 并复制到 bin/
-	if _, err := os.Stat(libFile); os.IsNotExist(err) {
-		// Rust 源码目录（Cargo.toml 所在目录）
-		rustDir := "../" // 根据你的目录结构调整
-		buildCmd := exec.Command("cargo", "build", "--release")
-		buildCmd.Dir = rustDir
-		buildCmd.Stdout = os.Stdout
-		buildCmd.Stderr = os.Stderr
-		if err := buildCmd.Run(); err != nil {
-			panic("Failed to build Rust library: " + err.Error())
-		}
-
-		// 源文件路径（默认 target/release/）
-		var srcLib string
-		switch runtime.GOOS {
-		case "windows":
-			srcLib = filepath.Join(rustDir, "target", "release", "xdelta.dll")
-		case "darwin":
-			srcLib = filepath.Join(rustDir, "target", "release", "libxdelta.dylib")
-		default:
-			srcLib = filepath.Join(rustDir, "target", "release", "libxdelta.so")
-		}
-
-		// 确保 bin 目录存在
-		_ = os.MkdirAll("bin", 0755)
-
-		// 复制库到 bin/
-		input, err := os.ReadFile(srcLib)
-		if err != nil {
-			panic("Failed to read Rust library: " + err.Error())
+// allocFunc 给定原生层结果的长度 n，返回结果要追加到其后的切片
+type allocFunc func(n int) []byte
+
+// resultLen 检查原生层返回的结果长度能否作为 Go 切片的长度，
+// 32 位平台上 int 只有 32 位，超过 2 GiB 的结果无法表示
+func resultLen(n uint64) (int, error) {
+	if n > math.MaxInt {
+		return 0, &Error{Code: CodeOutputTooLarge, Message: fmt.Sprintf("result of %d bytes exceeds the maximum slice length", n)}
+	}
+	return int(n), nil
+}
+
+// appendTo 返回把结果追加到 dst 之后的 allocFunc
+func appendTo(dst []byte) allocFunc {
+	return func(int) []byte { return dst }
+}
+
+// CreateDiffs 从两个文件数据创建补丁数据，参数通过 opts 指定，未指定时使用 DefaultBlockSize
+func CreateDiffs(oldData, newData []byte, opts ...Option) ([]byte, error) {
+	return createDiffs(nil, oldData, newData, opts)
+}
+
+// createDiffs CreateDiffs 和 CreateDiffsContext 的实现，ctx 为 nil 时只按 WithTimeout 取消
+func createDiffs(ctx context.Context, oldData, newData []byte, opts []Option) (patch []byte, err error) {
+	if m := beginOp(OpCreate, int64(len(oldData)), int64(len(newData))); m != nil {
+		defer func() { m.end(int64(len(patch)), err) }()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	start := time.Now()
+	if o.identityEnabled() && len(oldData) > 0 && bytes.Equal(oldData, newData) {
+		patch = identityPatch(int64(len(oldData)), o.writesEndRecord())
+		if o.reverse != nil {
+			*o.reverse = identityPatch(int64(len(oldData)), o.writesEndRecord())
 		}
-		if err := os.WriteFile(libFile, input, 0644); err != nil {
-			panic("Failed to write library to bin/: " + err.Error())
+		o.recordDiffPatch(DiffStats{SourceSize: int64(len(oldData)), TargetSize: int64(len(newData)), PatchSize: int64(len(patch))}, patch, start)
+		return patch, nil
+	}
+	o.detectCompressedData(oldData, newData)
+	blockSize, err := o.fitMemory(o.blockSize, int64(len(oldData)), int64(len(newData)), false)
+	if err != nil {
+		return nil, err
+	}
+	t := watchOptions(ctx, o, int64(len(oldData)+len(newData)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	patch, err = createPatchData(appendTo(nil), oldData, newData, blockSize, o.encoding(), t.cancel())
+	if err != nil {
+		return nil, t.err(err)
+	}
+	if o.reverse != nil {
+		if err := o.createReverse(oldData, newData, blockSize, nil, t.cancel()); err != nil {
+			return nil, t.err(err)
 		}
 	}
+	pieces, used := parallelPieces(o.createThreads(), int64(len(newData)))
+	o.recordDiffPatch(DiffStats{
+		SourceSize:  int64(len(oldData)),
+		TargetSize:  int64(len(newData)),
+		PatchSize:   int64(len(patch)),
+		Windows:     pieces,
+		ThreadsUsed: used,
+	}, patch, start)
+	return patch, nil
 }
 
-// CreateDiffsData 从两个文件数据创建补丁数据
-// 较小的 blockSize 可以提高匹配精度，但会增加计算开销
-// 较大的 blockSize 会减少计算时间，但可能降低匹配效率
-func CreateDiffsData(oldData, newData []byte, blockSize uint32) ([]byte, error) {
-	oldPtr := (*C.uint8_t)(C.CBytes(oldData))
-	newPtr := (*C.uint8_t)(C.CBytes(newData))
-	defer C.free(unsafe.Pointer(oldPtr))
-	defer C.free(unsafe.Pointer(newPtr))
+// CreateDiffsData 从两个文件数据创建补丁数据，较小的 blockSize 匹配更精确但计算更慢；新代码建议使用 CreateDiffs
+// blockSize 为 AutoBlockSize（0）时按输入大小自动选择（见 RecommendedBlockSize）；oldData、newData 都可以为空（或 nil）
+func CreateDiffsData(oldData, newData []byte, blockSize uint32) (patch []byte, err error) {
+	if m := beginOp(OpCreate, int64(len(oldData)), int64(len(newData))); m != nil {
+		defer func() { m.end(int64(len(patch)), err) }()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return createPatchData(appendTo(nil), oldData, newData, resolveBlockSize(blockSize, int64(len(oldData)), int64(len(newData))), defaultEncoding, nil)
+}
 
-	var patchPtr *C.uint8_t
-	var patchLen C.size_t
+// CreateDiffsDataVec 与 CreateDiffsData 相同，但旧数据和新数据各由按顺序拼接的若干段组成，Go 侧不拼接，调用期间不能修改各段
+func CreateDiffsDataVec(oldData, newData [][]byte, blockSize uint32) (patch []byte, err error) {
+	oldLen, newLen := vecLen(oldData), vecLen(newData)
+	if m := beginOp(OpCreate, oldLen, newLen); m != nil {
+		defer func() { m.end(int64(len(patch)), err) }()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	enc, err := newNativeEncoder(resolveBlockSize(blockSize, oldLen, newLen), defaultEncoding)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.close()
+	for _, p := range oldData {
+		if len(p) == 0 {
+			continue
+		}
+		if err := enc.addSource(p); err != nil {
+			return nil, err
+		}
+	}
+	var out bytes.Buffer
+	for _, p := range newData {
+		if len(p) == 0 {
+			continue
+		}
+		if err := enc.write(p, &out); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.finish(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
 
-	r := C.xdelta_create_patch_data(
-		oldPtr, C.size_t(len(oldData)),
-		newPtr, C.size_t(len(newData)),
-		&patchPtr, &patchLen,
-		C.uint32_t(blockSize),
-	)
+// vecLen 返回各段的总长度
+func vecLen(vec [][]byte) int64 {
+	var n int64
+	for _, p := range vec {
+		n += int64(len(p))
+	}
+	return n
+}
 
-	if r != 0 {
-		cerr := C.xdelta_last_error()
-		if cerr != nil {
-			return nil, fmt.Errorf("xdelta error: %s", C.GoString(cerr))
+// ApplyDiffsData 将补丁（本库格式、xdelta3 的 VCDIFF、bsdiff 或信封）应用到旧数据生成新数据，按补丁声明的长度一次分配输出
+// 合法的补丁永远不为空，diffsData 为空时返回 ErrCorruptPatch；opts 中只有 WithMaxOutputSize、WithTimeout、WithVerifyOutput
+// 和 WithIdentityNoCopy 对内存版本有效
+func ApplyDiffsData(oldData, diffsData []byte, opts ...Option) (newData []byte, err error) {
+	if m := beginOp(OpApply, int64(len(oldData)), int64(len(diffsData))); m != nil {
+		defer func() { m.end(int64(len(newData)), err) }()
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	h, diffsData, err := o.openEnvelope(oldData, diffsData)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if n, ok := identitySize(diffsData); ok && n == int64(len(oldData)) && (o.applyLimit() == 0 || uint64(n) <= o.applyLimit()) {
+		// 恒等补丁不经过解码器
+		newData = oldData
+		if !o.identityNoCopy {
+			newData = bytes.Clone(oldData)
+		}
+	} else {
+		if err := Init(); err != nil {
+			return nil, err
+		}
+		t := watchOptions(nil, o, int64(len(diffsData)))
+		defer t.release()
+		release, err := acquireOp(t)
+		if err != nil {
+			return nil, err
+		}
+		newData, err = applyPresized(appendTo(nil), oldData, diffsData, o.applyLimit(), t.cancel())
+		release()
+		if err != nil {
+			return nil, o.limitError(t.err(err))
 		}
-		return nil, fmt.Errorf("xdelta unknown error")
 	}
+	if h != nil {
+		if err := h.checkTarget(int64(len(newData)), sha256.Sum256(newData)); err != nil {
+			return nil, err
+		}
+	}
+	o.recordApplyPatch(ApplyStats{SourceSize: int64(len(oldData)), PatchSize: int64(len(diffsData)), TargetSize: int64(len(newData)), Windows: 1}, diffsData, start)
+	return newData, nil
+}
 
-	defer C.xdelta_free_data(patchPtr)
-
-	patchData := C.GoBytes(unsafe.Pointer(patchPtr), C.int(patchLen))
-	return patchData, nil
+// CreateDiffsDataInto 与 CreateDiffsData 相同，但像 append 一样把补丁追加到 dst（不能与输入重叠）之后并返回结果切片
+func CreateDiffsDataInto(dst, oldData, newData []byte, blockSize uint32) (res []byte, err error) {
+	if m := beginOp(OpCreate, int64(len(oldData)), int64(len(newData))); m != nil {
+		defer func() { m.end(int64(len(res)-len(dst)), err) }()
+	}
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return createPatchData(appendTo(dst), oldData, newData, resolveBlockSize(blockSize, int64(len(oldData)), int64(len(newData))), defaultEncoding, nil)
 }
 
-// ApplyDiffsData 将补丁应用到旧数据生成新数据
-func ApplyDiffsData(oldData, diffsData []byte) ([]byte, error) {
-	oldPtr := (*C.uint8_t)(C.CBytes(oldData))
-	patchPtr := (*C.uint8_t)(C.CBytes(diffsData))
-	defer C.free(unsafe.Pointer(oldPtr))
-	defer C.free(unsafe.Pointer(patchPtr))
+// ApplyDiffsDataInto 与 ApplyDiffsData 相同，但像 append 一样把新数据追加到 dst（不能与输入重叠）之后并返回结果切片
+func ApplyDiffsDataInto(dst, oldData, diffsData []byte, opts ...Option) (res []byte, err error) {
+	if m := beginOp(OpApply, int64(len(oldData)), int64(len(diffsData))); m != nil {
+		defer func() { m.end(int64(len(res)-len(dst)), err) }()
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer o.verboseScope()()
+	h, diffsData, err := o.openEnvelope(oldData, diffsData)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if err := Init(); err != nil {
+		return nil, err
+	}
+	t := watchOptions(nil, o, int64(len(diffsData)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return nil, err
+	}
+	res, err = applyPresized(appendTo(dst), oldData, diffsData, o.applyLimit(), t.cancel())
+	release()
+	if err != nil {
+		return nil, o.limitError(t.err(err))
+	}
+	if h != nil {
+		if err := h.checkTarget(int64(len(res)-len(dst)), sha256.Sum256(res[len(dst):])); err != nil {
+			return nil, err
+		}
+	}
+	o.recordApplyPatch(ApplyStats{SourceSize: int64(len(oldData)), PatchSize: int64(len(diffsData)), TargetSize: int64(len(res) - len(dst)), Windows: 1}, diffsData, start)
+	return res, nil
+}
 
-	var newPtr *C.uint8_t
-	var newLen C.size_t
+// applyPresized 先校验补丁并取得它声明的输出长度，从 alloc 取得结果要追加到其后的切片并一次扩展到正好放得下输出，
+// 再让原生层直接解码到其中：原生层不分配随输出增长的缓冲区，结果也不必再复制进 Go 内存
+// 校验按 oldData 的长度检查 COPY 的范围，损坏的补丁在分配之前就被拒绝，不会因为错乱的长度分配巨大的内存；
+// 声明的长度超过 limit（0 为不限制）时同样不分配，直接返回 ErrOutputTooLarge，实际输出与声明的长度不同时返回 ErrCorruptPatch
+// 校验需要遍历补丁的全部记录（不产生输出），二次压缩的补丁和 bsdiff 补丁因此要多解压一遍
+func applyPresized(alloc allocFunc, oldData, diffsData []byte, limit uint64, cancel *nativeCancel) ([]byte, error) {
+	return decodePresized(alloc, int64(len(oldData)), diffsData, limit, func(dst []byte) error {
+		return applyPatchExact(dst, oldData, diffsData, cancel)
+	})
+}
 
-	r := C.xdelta_apply_patch_data(
-		oldPtr, C.size_t(len(oldData)),
-		patchPtr, C.size_t(len(diffsData)),
-		&newPtr, &newLen,
-	)
+// decodePresized 是 applyPresized 的通用部分：按补丁声明的长度分配输出，再由 exact 解码到其中，
+// sourceLen 为旧数据的长度，用于提前检查 COPY 的范围
+func decodePresized(alloc allocFunc, sourceLen int64, diffsData []byte, limit uint64, exact func(dst []byte) error) ([]byte, error) {
+	declared, err := validatePatchData(diffsData, sourceLen)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && declared > limit {
+		return nil, &Error{Code: CodeOutputTooLarge, Message: fmt.Sprintf("patch declares %d bytes of output, the limit is %d", declared, limit)}
+	}
+	n, err := resultLen(declared)
+	if err != nil {
+		return nil, err
+	}
+	dst := alloc(n)
+	if n > math.MaxInt-len(dst) {
+		return nil, &Error{Code: CodeOutputTooLarge, Message: fmt.Sprintf("result of %d bytes exceeds the maximum slice length", declared)}
+	}
+	// 容量不足时正好分配所需的长度，append 会按等级向上取整
+	var res []byte
+	if cap(dst)-len(dst) >= n {
+		res = dst[:len(dst)+n]
+	} else {
+		res = make([]byte, len(dst)+n)
+		copy(res, dst)
+	}
+	if err := exact(res[len(dst):]); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-	if r != 0 {
-		cerr := C.xdelta_last_error()
-		if cerr != nil {
-			return nil, fmt.Errorf("xdelta error: %s", C.GoString(cerr))
+// CreateDiffsFixed 与 CreateDiffs 相同，但补丁直接写入 dst（不能与输入重叠）并返回字节数，放不下时返回 ErrBufferTooSmall
+func CreateDiffsFixed(dst, oldData, newData []byte, opts ...Option) (n int, err error) {
+	if m := beginOp(OpCreate, int64(len(oldData)), int64(len(newData))); m != nil {
+		defer func() { m.end(int64(n), err) }()
+	}
+	if err := Init(); err != nil {
+		return 0, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer o.verboseScope()()
+	start := time.Now()
+	if o.identityEnabled() && len(oldData) > 0 && bytes.Equal(oldData, newData) {
+		patch := identityPatch(int64(len(oldData)), o.writesEndRecord())
+		if len(patch) > len(dst) {
+			return len(patch), fmt.Errorf("%w: the patch is %d bytes, dst holds %d", ErrBufferTooSmall, len(patch), len(dst))
 		}
-		return nil, fmt.Errorf("xdelta unknown error")
+		if o.reverse != nil {
+			*o.reverse = identityPatch(int64(len(oldData)), o.writesEndRecord())
+		}
+		o.recordDiffPatch(DiffStats{SourceSize: int64(len(oldData)), TargetSize: int64(len(newData)), PatchSize: int64(len(patch))}, patch, start)
+		return copy(dst, patch), nil
 	}
+	o.detectCompressedData(oldData, newData)
+	blockSize, err := o.fitMemory(o.blockSize, int64(len(oldData)), int64(len(newData)), false)
+	if err != nil {
+		return 0, err
+	}
+	t := watchOptions(nil, o, int64(len(oldData)+len(newData)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	n, err = createPatchInto(dst, oldData, newData, blockSize, o.encoding(), t.cancel())
+	if errors.Is(err, ErrOutputTooLarge) {
+		return n, fmt.Errorf("%w: the patch is %d bytes, dst holds %d", ErrBufferTooSmall, n, len(dst))
+	}
+	if err != nil {
+		return 0, t.err(err)
+	}
+	if o.reverse != nil {
+		if err := o.createReverse(oldData, newData, blockSize, nil, t.cancel()); err != nil {
+			return 0, t.err(err)
+		}
+	}
+	pieces, used := parallelPieces(o.createThreads(), int64(len(newData)))
+	o.recordDiffPatch(DiffStats{
+		SourceSize:  int64(len(oldData)),
+		TargetSize:  int64(len(newData)),
+		PatchSize:   int64(n),
+		Windows:     pieces,
+		ThreadsUsed: used,
+	}, dst[:n], start)
+	return n, nil
+}
 
-	defer C.xdelta_free_data(newPtr)
-
-	newData := C.GoBytes(unsafe.Pointer(newPtr), C.int(newLen))
-	return newData, nil
+// ApplyDiffsFixed 把 patch（不接受信封）应用到 old，新数据直接写入 dst（不能与输入重叠）并返回字节数，放不下时返回 ErrBufferTooSmall
+// cgo 后端成功的调用（Init 之后）不做任何 Go 堆分配，purego 后端的函数调用本身会分配少量内存；没有选项，也不记录指标
+func ApplyDiffsFixed(dst []byte, old, patch []byte) (n int, err error) {
+	if err := Init(); err != nil {
+		return 0, err
+	}
+	if IsEnvelope(patch) {
+		return 0, fmt.Errorf("%w: ApplyDiffsFixed does not take envelopes", ErrUnsupportedPatch)
+	}
+	release, err := holdOp()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	n, err = applyPatchInto(dst, old, patch)
+	if errors.Is(err, ErrOutputTooLarge) {
+		need, serr := patchTargetSize(patch)
+		if serr != nil {
+			return 0, serr
+		}
+		return int(min(need, math.MaxInt)), fmt.Errorf("%w: the patch produces %d bytes, dst holds %d", ErrBufferTooSmall, need, len(dst))
+	}
+	return n, err
 }
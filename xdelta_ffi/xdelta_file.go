@@ -0,0 +1,388 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileStats 文件版本接口的统计信息（字节数），应用补丁时 NewSize 为输出文件大小
+type FileStats struct {
+	OldSize   int64
+	NewSize   int64
+	PatchSize int64
+}
+
+// WithMmap 文件版本的接口（CreateDiffsFile、ApplyDiffsFile 以及 CreateDirDiff、ApplyDirDiff、CreateDiffsBatch 中的文件任务）
+// 通过只读内存映射读取输入文件，而不是逐段 read：应用时随机读取的旧文件不再需要每个 COPY 一次系统调用，
+// 创建补丁时两个输入都经由映射读取；映射占用的是页缓存，不额外分配内存，结果与不使用映射时完全相同
+// 无法映射的文件（空文件、管道、设备文件，或系统拒绝映射）照常读取
+// 映射期间输入文件的长度发生变化时返回 ErrIO；注意在 Linux、macOS 上映射期间文件被其他进程截断会使整个进程收到 SIGBUS，
+// 输入可能被同时修改时不要使用这一选项（Windows 不允许截断已映射的文件，没有这个问题）
+func WithMmap() Option {
+	return func(o *options) {
+		o.mmap = true
+	}
+}
+
+// CreateDiffsFile 从两个文件创建补丁文件
+// 旧文件只读取块签名，新文件由原生层流式读取，补丁直接写入 patchPath，不会把整个文件载入内存
+// patchPath 的父目录不存在时会自动创建；失败时不会留下写了一半的补丁文件
+// blockSize 为 AutoBlockSize 时根据两个文件的大小自动选择，规则与 CreateDiffsData 相同
+// opts 中 WithSecondaryCompression、WithCompressionLevel、WithStandardVCDIFF、WithSourceWindowSize、WithNoCompress、WithAutoCompressDetection 和 WithMmap 对文件版本有效；
+// WithSegmentSize 时改为在 Go 侧分段并行编码，WithThreads、WithChecksum、WithWindowSize 和 WithProgress 有效，WithMmap 被忽略
+func CreateDiffsFile(oldPath, newPath, patchPath string, blockSize uint32, opts ...Option) error {
+	_, err := CreateDiffsFileStats(oldPath, newPath, patchPath, blockSize, opts...)
+	return err
+}
+
+// CreateDiffsFileStats 与 CreateDiffsFile 相同，并返回输入文件和补丁文件的大小
+func CreateDiffsFileStats(oldPath, newPath, patchPath string, blockSize uint32, opts ...Option) (stats FileStats, err error) {
+	if m := beginOp(OpCreateFile, fileSize(oldPath), fileSize(newPath)); m != nil {
+		defer func() { m.end(stats.PatchSize, err) }()
+	}
+	if err := Init(); err != nil {
+		return FileStats{}, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer o.verboseScope()()
+
+	if dir := filepath.Dir(patchPath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return FileStats{}, err
+		}
+	}
+
+	if o.identityEnabled() {
+		if n, ok := sameFiles(oldPath, newPath); ok {
+			size, err := writeIdentityFile(patchPath, n, o.writesEndRecord(), o.fsync)
+			if err != nil {
+				return FileStats{}, err
+			}
+			return FileStats{OldSize: n, NewSize: n, PatchSize: size}, nil
+		}
+	}
+	o.detectCompressedFiles(oldPath, newPath)
+	blockSize, err = o.fitMemory(blockSize, fileSize(oldPath), fileSize(newPath), o.segmentSize > 0)
+	if err != nil {
+		return FileStats{}, err
+	}
+	if o.segmentSize > 0 {
+		if err := o.checkSegments(); err != nil {
+			return FileStats{}, err
+		}
+		return createSegmentedFile(oldPath, newPath, patchPath, blockSize, o)
+	}
+	release, err := holdOp()
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer release()
+	return createPatchFile(oldPath, newPath, patchPath, blockSize, o.encoding(), o.mmap)
+}
+
+// CreateDiffsToFile 与 CreateDiffs 相同，但补丁不返回给 Go 侧，而是由原生层在编码过程中逐个窗口直接写入 patchPath，
+// 原生层和 Go 侧都不保存整个补丁，适合补丁本身就很大、只需要落盘的场景；写出的文件与同样输入、同样选项下
+// CreateDiffs（以及不带选项时的 CreateDiffsData）返回的补丁逐字节相同
+// patchPath 的父目录不存在时会自动创建；失败、超时或被取消时不会留下写了一半的补丁文件
+// 返回的 FileStats 中 OldSize、NewSize 为两份数据的长度，PatchSize 为补丁文件的大小
+func CreateDiffsToFile(oldData, newData []byte, patchPath string, opts ...Option) (stats FileStats, err error) {
+	if m := beginOp(OpCreateFile, int64(len(oldData)), int64(len(newData))); m != nil {
+		defer func() { m.end(stats.PatchSize, err) }()
+	}
+	if err := Init(); err != nil {
+		return FileStats{}, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer o.verboseScope()()
+	start := time.Now()
+
+	if dir := filepath.Dir(patchPath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return FileStats{}, err
+		}
+	}
+
+	if o.identityEnabled() && len(oldData) > 0 && bytes.Equal(oldData, newData) {
+		size, err := writeIdentityFile(patchPath, int64(len(oldData)), o.writesEndRecord(), o.fsync)
+		if err != nil {
+			return FileStats{}, err
+		}
+		if o.reverse != nil {
+			*o.reverse = identityPatch(int64(len(oldData)), o.writesEndRecord())
+		}
+		o.recordDiff(DiffStats{SourceSize: int64(len(oldData)), TargetSize: int64(len(newData)), PatchSize: size}, start)
+		return FileStats{OldSize: int64(len(oldData)), NewSize: int64(len(newData)), PatchSize: size}, nil
+	}
+	o.detectCompressedData(oldData, newData)
+	blockSize, err := o.fitMemory(o.blockSize, int64(len(oldData)), int64(len(newData)), false)
+	if err != nil {
+		return FileStats{}, err
+	}
+	t := watchOptions(nil, o, int64(len(oldData)+len(newData)))
+	defer t.release()
+	release, err := acquireOp(t)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer release()
+	stats, err = createPatchDataToFile(oldData, newData, patchPath, blockSize, o.encoding(), t.cancel())
+	if err != nil {
+		return FileStats{}, t.err(err)
+	}
+	if o.reverse != nil {
+		if err := o.createReverse(oldData, newData, blockSize, nil, t.cancel()); err != nil {
+			os.Remove(patchPath)
+			return FileStats{}, t.err(err)
+		}
+	}
+	pieces, used := parallelPieces(o.createThreads(), int64(len(newData)))
+	o.recordDiff(DiffStats{
+		SourceSize:  stats.OldSize,
+		TargetSize:  stats.NewSize,
+		PatchSize:   stats.PatchSize,
+		Windows:     pieces,
+		ThreadsUsed: used,
+	}, start)
+	return stats, nil
+}
+
+// createPatchFile 在 Go 侧打开三个文件，再把文件描述符交给原生层编码：权限检查（以及 os.Root 等沙箱）都由 Go 侧的打开决定，
+// 原生层不按路径打开任何文件，输入也不经过 Go 的内存复制。失败时删除写了一半的补丁文件
+func createPatchFile(oldPath, newPath, patchPath string, blockSize uint32, e encoding, mmap bool) (FileStats, error) {
+	old, err := os.Open(oldPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer old.Close()
+	new, err := os.Open(newPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer new.Close()
+	patch, err := os.Create(patchPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	stats, err := createPatchFd(old, new, patch, blockSize, e, mmap)
+	if cerr := patch.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(patchPath)
+		return FileStats{}, fmt.Errorf("diff %s %s: %w", oldPath, newPath, err)
+	}
+	return stats, nil
+}
+
+// applyPatchFile 与 createPatchFile 相同，在 Go 侧打开文件后由原生层应用补丁，结果写入 outPath，失败时删除 outPath
+func applyPatchFile(oldPath, patchPath, outPath string, maxOutput uint64, mmap bool) (FileStats, error) {
+	old, err := os.Open(oldPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer old.Close()
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer patch.Close()
+	out, err := os.Create(outPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	stats, err := applyPatchFd(old, patch, out, maxOutput, mmap)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outPath)
+		return FileStats{}, err
+	}
+	return stats, nil
+}
+
+// fileSize 返回 path 的大小，无法获取时返回 -1（错误在之后打开文件时报告）
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// ApplyDiffsFile 将补丁文件应用到旧文件，结果写入 outPath
+// 结果先写入 outPath 同目录下的临时文件，成功后再重命名到 outPath，
+// 中途崩溃或应用失败都不会留下被截断的输出，也不会覆盖已有的 outPath
+// outPath 可以与 oldPath 相同，此时旧文件只会在应用成功后被替换；需要在掉电后也保证这一点时使用 WithAtomicReplace(true)
+// 使用 WithCheckpoint 时改为写入 outPath + ".partial" 并定期保存检查点，被中断后用 ResumeApply 继续
+// 也接受信封，跳过信封头后同样由原生层应用，WithMmap 有效；WithVerifyOutput 时输出与信封不一致返回 ErrTargetMismatch 且不替换 outPath
+func ApplyDiffsFile(oldPath, patchPath, outPath string, opts ...Option) error {
+	_, err := ApplyDiffsFileStats(oldPath, patchPath, outPath, opts...)
+	return err
+}
+
+// ApplyDiffsFileStats 与 ApplyDiffsFile 相同，并返回旧文件、补丁文件和输出文件的大小
+func ApplyDiffsFileStats(oldPath, patchPath, outPath string, opts ...Option) (stats FileStats, err error) {
+	if m := beginOp(OpApplyFile, fileSize(oldPath), fileSize(patchPath)); m != nil {
+		defer func() { m.end(stats.NewSize, err) }()
+	}
+	if err := Init(); err != nil {
+		return FileStats{}, err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer o.verboseScope()()
+	h, err := o.fileEnvelope(oldPath, patchPath)
+	if err != nil {
+		return FileStats{}, fmt.Errorf("apply %s to %s: %w", patchPath, oldPath, err)
+	}
+	if o.checkpoint != nil {
+		if h != nil {
+			return FileStats{}, fmt.Errorf("%w: envelopes cannot be applied with a checkpoint", ErrUnsupportedPatch)
+		}
+		return applyCheckpointed(oldPath, patchPath, outPath, o, false)
+	}
+
+	dir := filepath.Dir(outPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return FileStats{}, err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(outPath)+".tmp-*")
+	if err != nil {
+		return FileStats{}, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	if h != nil {
+		stats, err = applyEnvelopeFile(oldPath, patchPath, tmpPath, h, o)
+	} else {
+		var release func()
+		if release, err = holdOp(); err == nil {
+			stats, err = applyPatchFile(oldPath, patchPath, tmpPath, o.outputLimit(), o.mmap)
+			release()
+		}
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return FileStats{}, fmt.Errorf("apply %s to %s: %w", patchPath, oldPath, err)
+	}
+
+	if err := o.checkTarget(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return FileStats{}, fmt.Errorf("apply %s to %s: %w", patchPath, oldPath, err)
+	}
+	if err := replaceFile(tmpPath, outPath, o.fsync); err != nil {
+		return FileStats{}, err
+	}
+	return stats, nil
+}
+
+// fileEnvelope 读取补丁文件开头的信封头，WithVerifyOutput 时还比较旧文件的长度；不是信封时返回 nil
+func (o options) fileEnvelope(oldPath, patchPath string) (*EnvelopeHeader, error) {
+	if err := o.checkStreamSignature(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(patchPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head, err := readEnvelopeHead(f)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEnvelope(head) {
+		return nil, nil
+	}
+	sourceLen := fileSize(oldPath)
+	if !o.verifyOutput {
+		sourceLen = -1
+	}
+	return o.envelopeHeader(head, sourceLen)
+}
+
+// applyEnvelopeFile 把信封 patchPath 中的补丁应用到 oldPath，结果写入 outPath：补丁文件跳过信封头之后与普通补丁一样
+// 交给原生层（原生层从描述符的当前位置读取补丁），WithMmap 同样有效；WithVerifyOutput 时输出不能超过信封中的长度，
+// 写完后再读一遍输出按 h 校验
+func applyEnvelopeFile(oldPath, patchPath, outPath string, h *EnvelopeHeader, o options) (FileStats, error) {
+	old, err := os.Open(oldPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer old.Close()
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		return FileStats{}, err
+	}
+	defer patch.Close()
+	patchInfo, err := patch.Stat()
+	if err != nil {
+		return FileStats{}, err
+	}
+	if _, err := patch.Seek(int64(h.size), io.SeekStart); err != nil {
+		return FileStats{}, err
+	}
+	limit, capped := o.outputLimit(), false
+	if o.verifyOutput {
+		if err := o.verifySourceAt(h, old); err != nil {
+			return FileStats{}, err
+		}
+		if h.TargetSize > 0 && (limit == 0 || uint64(h.TargetSize) < limit) {
+			limit, capped = uint64(h.TargetSize), true
+		}
+	}
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return FileStats{}, err
+	}
+	release, err := holdOp()
+	if err != nil {
+		out.Close()
+		return FileStats{}, err
+	}
+	stats, err := applyPatchFd(old, patch, out, limit, o.mmap)
+	release()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if capped && errors.Is(err, ErrOutputTooLarge) {
+		return FileStats{}, fmt.Errorf("%w: result exceeds the %d bytes the envelope expects", ErrTargetMismatch, h.TargetSize)
+	}
+	if err != nil {
+		return FileStats{}, err
+	}
+	if o.verifyOutput {
+		f, err := os.Open(outPath)
+		if err != nil {
+			return FileStats{}, err
+		}
+		sum := sha256.New()
+		_, err = io.Copy(sum, f)
+		f.Close()
+		if err != nil {
+			return FileStats{}, err
+		}
+		var got [sha256.Size]byte
+		sum.Sum(got[:0])
+		if err := h.checkTarget(stats.NewSize, got); err != nil {
+			return FileStats{}, err
+		}
+	}
+	stats.PatchSize = patchInfo.Size()
+	return stats, nil
+}
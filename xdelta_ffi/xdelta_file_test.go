@@ -0,0 +1,179 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles 把 files 中的每项写入 dir 下同名的文件，返回各自的路径
+func writeFiles(t *testing.T, dir string, files map[string][]byte) map[string]string {
+	t.Helper()
+	paths := map[string]string{}
+	for name, b := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths[name] = p
+	}
+	return paths
+}
+
+// TestFileRoundTrip CreateDiffsFile、ApplyDiffsFile 按路径交给原生层，逐段读取或经由内存映射得到同样的补丁和结果
+func TestFileRoundTrip(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(4 << 20)
+	dir := t.TempDir()
+	p := writeFiles(t, dir, map[string][]byte{"old": oldData, "new": newData})
+	var patches [][]byte
+	for _, tc := range []struct {
+		name      string
+		blockSize uint32
+		opts      []Option
+	}{
+		{"read", 1024, nil},
+		{"mmap", 1024, []Option{WithMmap()}},
+		{"auto", AutoBlockSize, nil},
+	} {
+		patchPath, outPath := filepath.Join(dir, tc.name+".patch"), filepath.Join(dir, tc.name+".out")
+		if err := CreateDiffsFile(p["old"], p["new"], patchPath, tc.blockSize, tc.opts...); err != nil {
+			t.Fatalf("%s: CreateDiffsFile: %v", tc.name, err)
+		}
+		stats, err := ApplyDiffsFileStats(p["old"], patchPath, outPath, tc.opts...)
+		if err != nil {
+			t.Fatalf("%s: ApplyDiffsFile: %v", tc.name, err)
+		}
+		got, err := os.ReadFile(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, newData) {
+			t.Fatalf("%s: got %d bytes, want %d", tc.name, len(got), len(newData))
+		}
+		patch, _ := os.ReadFile(patchPath)
+		if want := (FileStats{OldSize: int64(len(oldData)), NewSize: int64(len(newData)), PatchSize: int64(len(patch))}); stats != want {
+			t.Fatalf("%s: stats %+v, want %+v", tc.name, stats, want)
+		}
+		if tc.blockSize == 1024 {
+			patches = append(patches, patch)
+		}
+	}
+	if !bytes.Equal(patches[0], patches[1]) {
+		t.Fatal("WithMmap changed the patch")
+	}
+}
+
+// TestFileEnvelope 信封补丁文件跳过信封头后由原生层应用（WithMmap 有效），WithVerifyOutput 拒绝与信封不一致的结果且不写出 outPath
+func TestFileEnvelope(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(1 << 20)
+	env, err := CreateEnvelope(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, inner, err := ParseEnvelope(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := env[:len(env)-len(inner)]
+	// 信封头与内容不一致：结果更长，或长度相同而内容不同
+	longer, err := CreateDiffs(oldData, append(bytes.Clone(newData), "more"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Clone(newData)
+	changed[len(changed)/2]++
+	different, err := CreateDiffs(oldData, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	p := writeFiles(t, dir, map[string][]byte{
+		"old":       oldData,
+		"env":       env,
+		"longer":    append(bytes.Clone(header), longer...),
+		"different": append(bytes.Clone(header), different...),
+	})
+	for _, opts := range [][]Option{nil, {WithMmap()}, {WithVerifyOutput()}, {WithVerifyOutput(), WithMmap()}} {
+		outPath := filepath.Join(dir, "out")
+		stats, err := ApplyDiffsFileStats(p["old"], p["env"], outPath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(outPath); !bytes.Equal(got, newData) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(newData))
+		}
+		if stats.PatchSize != int64(len(env)) || stats.NewSize != int64(len(newData)) {
+			t.Fatalf("stats %+v", stats)
+		}
+		os.Remove(outPath)
+	}
+	for _, name := range []string{"longer", "different"} {
+		outPath := filepath.Join(dir, name+".out")
+		if err := ApplyDiffsFile(p["old"], p[name], outPath, WithVerifyOutput()); !errors.Is(err, ErrTargetMismatch) {
+			t.Fatalf("%s: got %v, want ErrTargetMismatch", name, err)
+		}
+		if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+			t.Fatalf("%s: output written after a mismatch", name)
+		}
+		if err := ApplyDiffsFile(p["old"], p[name], outPath); err != nil {
+			t.Fatalf("%s without WithVerifyOutput: %v", name, err)
+		}
+	}
+}
+
+// TestCreateDiffsToFileMatches CreateDiffsToFile 写出的补丁与同样输入、同样选项下 CreateDiffsFile 写出的补丁
+// 以及 CreateDiffs 返回的补丁逐字节相同，FileStats 与文件一致
+func TestCreateDiffsToFileMatches(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(2 << 20)
+	dir := t.TempDir()
+	p := writeFiles(t, dir, map[string][]byte{"old": oldData, "new": newData})
+	for name, opts := range map[string][]Option{
+		"default":  nil,
+		"block":    {WithBlockSize(4096)},
+		"checksum": {WithChecksum(ChecksumXXH3)},
+		"lzma":     {WithSecondaryCompression(SecondaryLZMA)},
+		"end":      {WithEndRecord(true)},
+		"identity": nil,
+	} {
+		newPath := p["new"]
+		want := newData
+		if name == "identity" {
+			newPath, want = p["old"], oldData
+		}
+		toFile, fromFile := filepath.Join(dir, name+".to"), filepath.Join(dir, name+".file")
+		stats, err := CreateDiffsToFile(oldData, want, toFile, opts...)
+		if err != nil {
+			t.Fatalf("%s: CreateDiffsToFile: %v", name, err)
+		}
+		blockSize := uint32(DefaultBlockSize)
+		if name == "block" {
+			blockSize = 4096
+		}
+		if err := CreateDiffsFile(p["old"], newPath, fromFile, blockSize, opts...); err != nil {
+			t.Fatalf("%s: CreateDiffsFile: %v", name, err)
+		}
+		a, err := os.ReadFile(toFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(fromFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Fatalf("%s: CreateDiffsToFile wrote %d bytes, CreateDiffsFile %d bytes", name, len(a), len(b))
+		}
+		mem, err := CreateDiffs(oldData, want, opts...)
+		if err != nil || !bytes.Equal(a, mem) {
+			t.Fatalf("%s: CreateDiffs returned %d bytes, %v, want the %d bytes of the file", name, len(mem), err, len(a))
+		}
+		if w := (FileStats{OldSize: int64(len(oldData)), NewSize: int64(len(want)), PatchSize: int64(len(a))}); stats != w {
+			t.Fatalf("%s: stats %+v, want %+v", name, stats, w)
+		}
+	}
+}
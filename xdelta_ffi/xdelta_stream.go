@@ -0,0 +1,304 @@
+package xdelta_ffi
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// streamIO 原生层回调访问的 Go 侧读写对象
+type streamIO struct {
+	src io.ReaderAt
+	dst io.Writer
+	// err 记录回调中第一次出现的 Go 错误，优先于原生层的错误信息返回
+	err error
+}
+
+func (s *streamIO) setErr(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// readAt 读满 p：返回 0 成功，-1 读取失败，-2 超出旧数据范围
+// offset 直接来自补丁中的 COPY 记录，超出 int64 范围时按超出旧数据范围处理
+func (s *streamIO) readAt(p []byte, offset uint64) int32 {
+	if len(p) == 0 {
+		return 0
+	}
+	if offset > math.MaxInt64-uint64(len(p)) {
+		return -2
+	}
+	m, err := s.src.ReadAt(p, int64(offset))
+	if m == len(p) {
+		return 0
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		return -2
+	}
+	s.setErr(err)
+	return -1
+}
+
+// write 写出解码结果：返回 0 成功，-1 写入失败
+func (s *streamIO) write(p []byte) int32 {
+	if len(p) == 0 {
+		return 0
+	}
+	if _, err := s.dst.Write(p); err != nil {
+		s.setErr(err)
+		return -1
+	}
+	return 0
+}
+
+// readWindows 按窗口读取 r，对每个窗口调用 fn，直到 EOF
+func readWindows(r io.Reader, buf []byte, fn func([]byte) error) error {
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if ferr := fn(buf[:n]); ferr != nil {
+				return ferr
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CreateDiffsStream 从两个流创建补丁并写入 patch
+// old 与 new 都按窗口（WithWindowSize）读取，补丁随新数据的编码进度分段写出，
+// 内存占用只与旧数据的块签名和窗口大小有关；生成的补丁与 CreateDiffsData 完全一致
+// WithThreads 不为 1 时旧数据并行计算签名，新数据在原生层攒满每个线程 8 MiB 后分段并行编码，
+// 补丁与同样线程设置的 CreateDiffs 完全一致，原生层另外缓冲最多线程数 × 8 MiB 的新数据
+func CreateDiffsStream(old io.Reader, new io.Reader, patch io.Writer, opts ...Option) (err error) {
+	if m := beginOp(OpCreateStream, readerSize(old), readerSize(new)); m != nil {
+		cw := &countingWriter{w: patch}
+		patch = cw
+		defer func() { m.end(cw.n, err) }()
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	defer o.verboseScope()()
+	blockSize, err := o.fitMemory(o.blockSize, readerSize(old), readerSize(new), true)
+	if err != nil {
+		return err
+	}
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	enc, err := newNativeEncoder(blockSize, o.encoding())
+	if err != nil {
+		return err
+	}
+	defer enc.close()
+	threads := o.encodeThreads()
+	if err := enc.setThreads(threads); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	prog := newProgress(o.progress, sumSizes(readerSize(old), readerSize(new)))
+	buf := make([]byte, o.windowSize)
+	err = readWindows(old, buf, func(p []byte) error {
+		if err := o.checkSignatures(prog.done+int64(len(p)), blockSize); err != nil {
+			return err
+		}
+		if err := enc.addSource(p); err != nil {
+			return err
+		}
+		prog.add(len(p))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stats := DiffStats{SourceSize: prog.done}
+	if err := encodeTarget(enc, new, patch, buf, prog, &stats); err != nil {
+		return err
+	}
+	_, stats.ThreadsUsed = parallelPieces(threads, stats.TargetSize)
+	o.recordDiff(stats, start)
+	return nil
+}
+
+// CreateDiffsFromStream 与 CreateDiffsStream 相同，但旧数据已经整个在内存中，只有新数据是流（例如正在从网络接收）：
+// 块签名直接从 old 建立，new 按窗口（WithWindowSize）读取，补丁随编码进度分段写出，
+// COPY 仍然可以引用 old 中的任意位置；内存占用为块签名加一个窗口，与新数据的大小无关
+// 生成的补丁与以相同的块大小调用 CreateDiffsData(old, newData, blockSize) 完全一致，WithThreads 与 CreateDiffsStream 相同；
+// 按输入大小选择块大小（AutoBlockSize）时，只有 new 的长度可以预先得知（例如 *bytes.Reader、普通文件）才会选出相同的块大小
+// 流式编码无法预先比较两份数据，WithAppendDetection、WithIdentityDetection 对这里无效
+func CreateDiffsFromStream(old []byte, new io.Reader, patch io.Writer, opts ...Option) (err error) {
+	if m := beginOp(OpCreateStream, int64(len(old)), readerSize(new)); m != nil {
+		cw := &countingWriter{w: patch}
+		patch = cw
+		defer func() { m.end(cw.n, err) }()
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	defer o.verboseScope()()
+	blockSize, err := o.fitMemory(o.blockSize, int64(len(old)), readerSize(new), true)
+	if err != nil {
+		return err
+	}
+
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	start := time.Now()
+	prog := newProgress(o.progress, sumSizes(int64(len(old)), readerSize(new)))
+	threads := o.encodeThreads()
+	src, err := newNativeSourceEncoder(old, blockSize, threads, nil)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+	enc, err := src.stream(o.encoding())
+	if err != nil {
+		return err
+	}
+	defer enc.close()
+	if err := enc.setThreads(threads); err != nil {
+		return err
+	}
+	prog.add(len(old))
+
+	stats := DiffStats{SourceSize: int64(len(old))}
+	if err := encodeTarget(enc, new, patch, make([]byte, o.windowSize), prog, &stats); err != nil {
+		return err
+	}
+	_, stats.ThreadsUsed = parallelPieces(threads, stats.TargetSize)
+	o.recordDiff(stats, start)
+	return nil
+}
+
+// encodeTarget 按窗口读取 new 送入 enc，补丁写入 patch，结束后填写 stats 中的 Windows、TargetSize 和 PatchSize
+func encodeTarget(enc *nativeEncoder, new io.Reader, patch io.Writer, buf []byte, prog *progress, stats *DiffStats) error {
+	cw := &countingWriter{w: patch}
+	start := prog.done
+	err := readWindows(new, buf, func(p []byte) error {
+		if err := enc.write(p, cw); err != nil {
+			return err
+		}
+		prog.add(len(p))
+		stats.Windows++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.finish(cw); err != nil {
+		return err
+	}
+	stats.TargetSize = prog.done - start
+	stats.PatchSize = cw.n
+	return nil
+}
+
+// sourceSize 尽量获取旧数据的长度，无法获取时返回 -1
+func sourceSize(r io.ReaderAt) int64 {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := v.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	return -1
+}
+
+// ApplyDiffsStream 将补丁流应用到旧数据，结果写入 out
+// old 需要支持随机读取（COPY 可以引用任意偏移），patch 和 out 都是纯流式的，
+// 例如可以直接把 HTTP 响应体作为 patch；补丁按窗口（WithWindowSize）读取，内存占用有界
+// 补丁被截断或损坏时返回错误，本库格式的补丁截断时错误同时包装了 io.ErrUnexpectedEOF；WithEndRecord 的补丁在任何位置截断都能发现
+// （其他补丁恰好截断在记录或窗口边界时只有信封能发现，见 ValidateFormat），
+// 此时 out 中可能已经写入了部分数据；也接受信封，WithVerifyOutput 时写完后才返回校验结果
+// bsdiff 补丁的三个块交错读取，原生层缓存整个补丁，读到结尾才写出输出；old 需要有 Size 方法或是普通文件，
+// 长度未知时 bsdiff 补丁返回 ErrUnsupportedPatch
+func ApplyDiffsStream(old io.ReaderAt, patch io.Reader, out io.Writer, opts ...Option) (err error) {
+	if m := beginOp(OpApplyStream, sourceSize(old), readerSize(patch)); m != nil {
+		cw := &countingWriter{w: out}
+		out = cw
+		defer func() { m.end(cw.n, err) }()
+	}
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	defer o.verboseScope()()
+	start := time.Now()
+	prog := newProgress(o.progress, readerSize(patch))
+	h, skipped, patch, err := o.readEnvelope(patch, sourceSize(old))
+	if err != nil {
+		return err
+	}
+	if err := o.verifySourceAt(h, old); err != nil {
+		return err
+	}
+	cw := &countingWriter{w: out}
+	tw := &targetWriter{w: cw}
+	// 信封头计入进度，但不算作窗口
+	prog.done += int64(skipped)
+	if h != nil {
+		tw.verify(h)
+	}
+	if err := decodeStream(old, patch, tw, o.windowSize, o.outputLimit(), prog); err != nil {
+		return err
+	}
+	if err := tw.check(); err != nil {
+		return err
+	}
+	o.recordApply(ApplyStats{SourceSize: sourceSize(old), PatchSize: prog.done, TargetSize: cw.n, Windows: prog.windows}, start)
+	return nil
+}
+
+// decodeStream 按 windowSize 大小的窗口读取 patch 并解码，limit 为输出的上限（0 表示不限）
+func decodeStream(old io.ReaderAt, patch io.Reader, out io.Writer, windowSize int, limit uint64, prog *progress) error {
+	release, err := holdOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	dec, err := newNativeDecoder(old, out, limit)
+	if err != nil {
+		return err
+	}
+	defer dec.close()
+
+	buf := make([]byte, windowSize)
+	err = readWindows(patch, buf, func(p []byte) error {
+		if err := dec.write(p); err != nil {
+			return err
+		}
+		prog.add(len(p))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return dec.finish()
+}
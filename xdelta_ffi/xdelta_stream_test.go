@@ -0,0 +1,229 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// TestTruncatedPatch WithEndRecord 创建的本库格式补丁（带补丁头和结束记录，包括恒等补丁）在任何位置截断（包括恰好在两个记录之间）
+// 都返回 ErrCorruptPatch，不会当作较短的新数据应用成功；流式接口和 Decoder 的错误同时包装了 io.ErrUnexpectedEOF
+func TestTruncatedPatch(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	cases := map[string][]Option{
+		"plain":     nil,
+		"zlib":      {WithSecondaryCompression(SecondaryZlib)},
+		"zstd":      {WithSecondaryCompression(SecondaryZstd)},
+		"lz4":       {WithSecondaryCompression(SecondaryLZ4)},
+		"lzma":      {WithSecondaryCompression(SecondaryLZMA)},
+		"xxh3":      {WithChecksum(ChecksumXXH3)},
+		"threads":   {WithThreads(4)},
+		"identical": nil,
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			target := newData
+			if name == "identical" {
+				target = oldData
+			}
+			patch, err := CreateDiffs(oldData, target, append(opts, WithEndRecord(true))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patch[0] != headerRecordOp && secondaryOf(patch[0]) == SecondaryNone {
+				t.Fatalf("patch starts with %#x, want the header record", patch[0])
+			}
+			if got, err := ApplyDiffsData(oldData, patch); err != nil || !bytes.Equal(got, target) {
+				t.Fatalf("full patch: %v", err)
+			}
+			for n := 0; n < len(patch); n++ {
+				cut := patch[:n]
+				if _, err := ApplyDiffsData(oldData, cut); !errors.Is(err, ErrCorruptPatch) {
+					t.Fatalf("ApplyDiffsData of the first %d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+				}
+				var out bytes.Buffer
+				if err := ApplyDiffsStream(bytes.NewReader(oldData), bytes.NewReader(cut), &out); !errors.Is(err, ErrCorruptPatch) || !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("ApplyDiffsStream of the first %d of %d bytes: got %v, want ErrCorruptPatch and io.ErrUnexpectedEOF", n, len(patch), err)
+				}
+				out.Reset()
+				d, err := NewDecoder(bytes.NewReader(oldData), &out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := d.Write(cut); err != nil {
+					t.Fatalf("Decoder.Write of the first %d of %d bytes: %v", n, len(patch), err)
+				}
+				if err := d.Close(); !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("Decoder.Close after the first %d of %d bytes: got %v, want io.ErrUnexpectedEOF", n, len(patch), err)
+				}
+				if _, err := PatchTargetSize(cut); !errors.Is(err, ErrCorruptPatch) {
+					t.Fatalf("PatchTargetSize of the first %d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+				}
+				if err := ValidateFormat(cut); !errors.Is(err, ErrCorruptPatch) {
+					t.Fatalf("ValidateFormat of the first %d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+				}
+			}
+		})
+	}
+}
+
+// TestTrailingDataAfterEnd 结束记录之后多出的数据也是损坏的补丁
+func TestTrailingDataAfterEnd(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData, WithEndRecord(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := append(append([]byte(nil), patch...), 0x00, 0, 0, 0, 0)
+	if _, err := ApplyDiffsData(oldData, extra); !errors.Is(err, ErrCorruptPatch) {
+		t.Fatalf("got %v, want ErrCorruptPatch", err)
+	}
+}
+
+// TestSplitPatchSegmentsEnd SplitPatch 的每段都是完整的补丁，可以单独应用
+func TestSplitPatchSegmentsEnd(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffs(oldData, newData, WithBlockSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, segs, err := SplitPatch(patch, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) < 2 {
+		t.Fatalf("patch of %d bytes split into %d segments", len(patch), len(segs))
+	}
+	var joined []byte
+	for i, s := range segs {
+		got, err := ApplyDiffsData(oldData, s)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+		if int64(len(got)) != index.Segments[i].TargetLen {
+			t.Fatalf("segment %d produced %d bytes, the index says %d", i, len(got), index.Segments[i].TargetLen)
+		}
+		joined = append(joined, got...)
+	}
+	if !bytes.Equal(joined, newData) {
+		t.Fatal("joined segments differ from the new data")
+	}
+}
+
+// eofReader 读到 EOF 时设置 done 的 Reader，用来判断补丁是否在新数据读完之前就开始写出
+type eofReader struct {
+	r    io.Reader
+	done bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.done = true
+	}
+	return n, err
+}
+
+// earlyWriter 记录第一次写入补丁时新数据是否已经读完
+type earlyWriter struct {
+	bytes.Buffer
+	src          *eofReader
+	writes       int
+	beforeTheEnd bool
+}
+
+func (w *earlyWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		w.beforeTheEnd = !w.src.done
+	}
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// TestCreateDiffsFromStream 旧数据在内存中、新数据是流时，各种块大小、窗口大小和每次只返回一部分数据的 Reader 下，
+// 补丁都与同样块大小的 CreateDiffsData 逐字节相同，包括新数据引用旧数据末尾内容的情况；补丁在新数据读完之前就开始写出，
+// 读取新数据的错误原样返回
+func TestCreateDiffsFromStream(t *testing.T) {
+	requireNative(t)
+	oldData, newData := textFixture(1 << 20)
+	q := len(oldData) / 4
+	moved := append(bytes.Clone(oldData[3*q:]), oldData[:3*q]...)
+	r := fixtureRand(92)
+	noise := make([]byte, 200<<10)
+	for i := range noise {
+		noise[i] = byte(r.next())
+	}
+	for _, p := range []struct {
+		name             string
+		oldData, newData []byte
+	}{
+		{"text edits", oldData, newData},
+		{"moved", oldData, moved},
+		{"unrelated", oldData, noise},
+		{"empty new", oldData, nil},
+		{"empty old", nil, newData},
+	} {
+		for _, bs := range []uint32{16, DefaultBlockSize, 4096} {
+			want, err := CreateDiffsData(p.oldData, p.newData, bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, window := range []int{DefaultWindowSize, 1000, 4099} {
+				for rname, newReader := range map[string]func([]byte) io.Reader{
+					"bytes.Reader": func(b []byte) io.Reader { return bytes.NewReader(b) },
+					"HalfReader":   func(b []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(b)) },
+				} {
+					var out bytes.Buffer
+					if err := CreateDiffsFromStream(p.oldData, newReader(p.newData), &out, WithBlockSize(bs), WithWindowSize(window)); err != nil {
+						t.Fatalf("%s, block size %d, window %d, %s: %v", p.name, bs, window, rname, err)
+					}
+					if !bytes.Equal(out.Bytes(), want) {
+						t.Fatalf("%s, block size %d, window %d, %s: %d byte patch differs from CreateDiffsData (%d bytes)",
+							p.name, bs, window, rname, out.Len(), len(want))
+					}
+				}
+			}
+		}
+	}
+
+	// 新数据的长度已知时自动选择的块大小也相同；二次压缩与 CreateDiffs 相同
+	want, err := CreateDiffsData(oldData, moved, AutoBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := CreateDiffsFromStream(oldData, bytes.NewReader(moved), &out, WithBlockSize(AutoBlockSize)); err != nil || !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("AutoBlockSize: %d byte patch differs from CreateDiffsData (%d bytes), %v", out.Len(), len(want), err)
+	}
+	zstd := []Option{WithSecondaryCompression(SecondaryZstd), WithBlockSize(4096)}
+	want, err = CreateDiffs(oldData, newData, append(zstd, WithAppendDetection(false), WithIdentityDetection(false))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := CreateDiffsFromStream(oldData, iotest.OneByteReader(bytes.NewReader(newData)), &out, zstd...); err != nil || !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("zstd, one byte reads: %d byte patch differs from CreateDiffs (%d bytes), %v", out.Len(), len(want), err)
+	}
+
+	src := &eofReader{r: bytes.NewReader(moved)}
+	w := &earlyWriter{src: src}
+	if err := CreateDiffsFromStream(oldData, src, w, WithWindowSize(64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if !w.beforeTheEnd || w.writes < 2 {
+		t.Fatalf("the patch was written in %d pieces, the first one after the new data ended: %v", w.writes, !w.beforeTheEnd)
+	}
+	if got, err := ApplyDiffsData(oldData, w.Bytes()); err != nil || !bytes.Equal(got, moved) {
+		t.Fatalf("applying the streamed patch: %d bytes, %v", len(got), err)
+	}
+
+	failing := io.MultiReader(bytes.NewReader(newData[:300000]), iotest.ErrReader(iotest.ErrTimeout))
+	if err := CreateDiffsFromStream(oldData, failing, io.Discard); !errors.Is(err, iotest.ErrTimeout) {
+		t.Fatalf("failing reader: got %v, want %v", err, iotest.ErrTimeout)
+	}
+}
@@ -0,0 +1,171 @@
+package xdelta_ffi
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+// TestDataInto CreateDiffsDataInto、ApplyDiffsDataInto 像 append 一样追加到 dst 之后：已有内容保留，
+// 容量足够时使用 dst 的底层数组，不足时重新分配；结果与不带 Into 的版本相同
+func TestDataInto(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := CreateDiffsData(oldData, newData, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		dst   []byte
+		reuse bool
+	}{
+		{"nil", nil, false},
+		{"prefix", []byte("prefix"), false},
+		{"capacity", append(make([]byte, 0, len(newData)+100), "prefix"...), true},
+	} {
+		prefix := bytes.Clone(tc.dst)
+		got, err := CreateDiffsDataInto(bytes.Clone(tc.dst), oldData, newData, 1024)
+		if err != nil {
+			t.Fatalf("%s: CreateDiffsDataInto: %v", tc.name, err)
+		}
+		if !bytes.Equal(got, append(bytes.Clone(prefix), patch...)) {
+			t.Fatalf("%s: CreateDiffsDataInto returned %d bytes, want the prefix and the %d byte patch", tc.name, len(got), len(patch))
+		}
+		dst := tc.dst[:len(tc.dst):cap(tc.dst)]
+		got, err = ApplyDiffsDataInto(dst, oldData, patch)
+		if err != nil {
+			t.Fatalf("%s: ApplyDiffsDataInto: %v", tc.name, err)
+		}
+		if !bytes.Equal(got, append(prefix, newData...)) {
+			t.Fatalf("%s: ApplyDiffsDataInto returned %d bytes, want the prefix and %d bytes", tc.name, len(got), len(newData))
+		}
+		if reused := cap(dst) > 0 && &got[0] == &dst[:1][0]; reused != tc.reuse {
+			t.Fatalf("%s: reused dst = %v, want %v", tc.name, reused, tc.reuse)
+		}
+	}
+
+	// 复用上一次的结果
+	buf, err := ApplyDiffsDataInto(nil, oldData, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ApplyDiffsDataInto(buf[:0], oldData, patch)
+	if err != nil || !bytes.Equal(again, newData) || &again[0] != &buf[0] {
+		t.Fatalf("ApplyDiffsDataInto into the previous result: %d bytes, %v", len(again), err)
+	}
+}
+
+// BenchmarkApplyInto 反复应用同一个小补丁：ApplyDiffsData 每次分配结果，ApplyDiffsDataInto 复用上一次的缓冲区
+func BenchmarkApplyInto(b *testing.B) {
+	requireNative(b)
+	oldData, newData := testPair()
+	patch, err := CreateDiffsData(oldData, newData, 1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("ApplyDiffsData", func(b *testing.B) {
+		b.SetBytes(int64(len(newData)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := ApplyDiffsData(oldData, patch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ApplyDiffsDataInto", func(b *testing.B) {
+		b.SetBytes(int64(len(newData)))
+		b.ReportAllocs()
+		var buf []byte
+		for b.Loop() {
+			if buf, err = ApplyDiffsDataInto(buf[:0], oldData, patch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkCreateInto 与 BenchmarkApplyInto 相同，比较 CreateDiffsData 和复用缓冲区的 CreateDiffsDataInto
+func BenchmarkCreateInto(b *testing.B) {
+	requireNative(b)
+	oldData, newData := testPair()
+	b.Run("CreateDiffsData", func(b *testing.B) {
+		b.SetBytes(int64(len(newData)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := CreateDiffsData(oldData, newData, 1024); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("CreateDiffsDataInto", func(b *testing.B) {
+		b.SetBytes(int64(len(newData)))
+		b.ReportAllocs()
+		var buf []byte
+		var err error
+		for b.Loop() {
+			if buf, err = CreateDiffsDataInto(buf[:0], oldData, newData, 1024); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestResultLen 原生层返回的长度超过 int 的范围时返回 ErrOutputTooLarge，而不是截断成错误的切片长度；
+// 64 位平台上超过 2 GiB 的长度照常返回
+func TestResultLen(t *testing.T) {
+	want := uint64(math.MaxInt32) + 1
+	n, err := resultLen(want)
+	if math.MaxInt > math.MaxInt32 {
+		if err != nil || uint64(n) != want {
+			t.Fatalf("resultLen(%d) = %d, %v", want, n, err)
+		}
+	} else if !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("resultLen(%d) on a 32-bit platform: got %v, want ErrOutputTooLarge", want, err)
+	}
+	if _, err := resultLen(uint64(math.MaxInt) + 1); !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("resultLen(MaxInt+1): got %v, want ErrOutputTooLarge", err)
+	}
+}
+
+// TestEmptyInputs nil 与空切片的每种组合：旧数据为空时补丁从零重建新数据，新数据为空时补丁应用后得到空数据，
+// 空补丁返回 ErrCorruptPatch，与旧数据是否为空无关
+func TestEmptyInputs(t *testing.T) {
+	_, data := testPair()
+	inputs := []struct {
+		name string
+		b    []byte
+	}{
+		{"nil", nil},
+		{"empty", []byte{}},
+		{"data", data},
+	}
+	for _, old := range inputs {
+		for _, patch := range [][]byte{nil, {}} {
+			if _, err := ApplyDiffsData(old.b, patch); !errors.Is(err, ErrCorruptPatch) {
+				t.Fatalf("old %s, empty patch: got %v, want ErrCorruptPatch", old.name, err)
+			}
+		}
+	}
+	requireNative(t)
+	for _, old := range inputs {
+		for _, nw := range inputs {
+			name := "old " + old.name + ", new " + nw.name
+			patch, err := CreateDiffsData(old.b, nw.b, 1024)
+			if err != nil {
+				t.Fatalf("%s: CreateDiffsData: %v", name, err)
+			}
+			if len(patch) == 0 {
+				t.Fatalf("%s: CreateDiffsData returned an empty patch", name)
+			}
+			got, err := ApplyDiffsData(old.b, patch)
+			if err != nil {
+				t.Fatalf("%s: ApplyDiffsData: %v", name, err)
+			}
+			if !bytes.Equal(got, nw.b) {
+				t.Fatalf("%s: ApplyDiffsData returned %d bytes, want %d", name, len(got), len(nw.b))
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+//go:build !cgo && !xdelta_purego
+// +build !cgo,!xdelta_purego
+
+package xdelta_ffi
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XXH3-64（种子为 0）的 Go 实现，只有纯 Go 解码器（见 godecoder.go）用它校验 WithChecksum(ChecksumXXH3) 的校验和记录；
+// 与原生层 src/checksum.rs 中的实现逐步对应
+const (
+	xxh3Prime32_1 uint64 = 0x9E3779B1
+	xxh3Prime32_2 uint64 = 0x85EBCA77
+	xxh3Prime32_3 uint64 = 0xC2B2AE3D
+	xxh3PrimeMx1  uint64 = 0x165667919E3779F9
+	xxh3PrimeMx2  uint64 = 0x9FB21C651E98DF25
+
+	xxh3StripeLen     = 64
+	xxh3ConsumeRate   = 8
+	xxh3StripesPerBlk = (len(xxh3Secret) - xxh3StripeLen) / xxh3ConsumeRate
+	xxh3BlockLen      = xxh3StripeLen * xxh3StripesPerBlk
+	// xxh3MidsizeMax 不超过这个长度的输入整个交给短输入的算法
+	xxh3MidsizeMax = 240
+)
+
+// xxh3Secret 参考实现的默认密钥 kSecret
+var xxh3Secret = [192]byte{
+	0xb8, 0xfe, 0x6c, 0x39, 0x23, 0xa4, 0x4b, 0xbe, 0x7c, 0x01, 0x81, 0x2c, 0xf7, 0x21, 0xad, 0x1c,
+	0xde, 0xd4, 0x6d, 0xe9, 0x83, 0x90, 0x97, 0xdb, 0x72, 0x40, 0xa4, 0xa4, 0xb7, 0xb3, 0x67, 0x1f,
+	0xcb, 0x79, 0xe6, 0x4e, 0xcc, 0xc0, 0xe5, 0x78, 0x82, 0x5a, 0xd0, 0x7d, 0xcc, 0xff, 0x72, 0x21,
+	0xb8, 0x08, 0x46, 0x74, 0xf7, 0x43, 0x24, 0x8e, 0xe0, 0x35, 0x90, 0xe6, 0x81, 0x3a, 0x26, 0x4c,
+	0x3c, 0x28, 0x52, 0xbb, 0x91, 0xc3, 0x00, 0xcb, 0x88, 0xd0, 0x65, 0x8b, 0x1b, 0x53, 0x2e, 0xa3,
+	0x71, 0x64, 0x48, 0x97, 0xa2, 0x0d, 0xf9, 0x4e, 0x38, 0x19, 0xef, 0x46, 0xa9, 0xde, 0xac, 0xd8,
+	0xa8, 0xfa, 0x76, 0x3f, 0xe3, 0x9c, 0x34, 0x3f, 0xf9, 0xdc, 0xbb, 0xc7, 0xc7, 0x0b, 0x4f, 0x1d,
+	0x8a, 0x51, 0xe0, 0x4b, 0xcd, 0xb4, 0x59, 0x31, 0xc8, 0x9f, 0x7e, 0xc9, 0xd9, 0x78, 0x73, 0x64,
+	0xea, 0xc5, 0xac, 0x83, 0x34, 0xd3, 0xeb, 0xc3, 0xc5, 0x81, 0xa0, 0xff, 0xfa, 0x13, 0x63, 0xeb,
+	0x17, 0x0d, 0xdd, 0x51, 0xb7, 0xf0, 0xda, 0x49, 0xd3, 0x16, 0x55, 0x26, 0x29, 0xd4, 0x68, 0x9e,
+	0x2b, 0x16, 0xbe, 0x58, 0x7d, 0x47, 0xa1, 0xfc, 0x8f, 0xf8, 0xb8, 0xd1, 0x7a, 0xd0, 0x31, 0xce,
+	0x45, 0xcb, 0x3a, 0x8f, 0x95, 0x16, 0x04, 0x28, 0xaf, 0xd7, 0xfb, 0xca, 0xbb, 0x4b, 0x40, 0x7e,
+}
+
+func xxh3Read32(b []byte, at int) uint64 { return uint64(binary.LittleEndian.Uint32(b[at:])) }
+func xxh3Read64(b []byte, at int) uint64 { return binary.LittleEndian.Uint64(b[at:]) }
+
+func xxh3Mul128Fold64(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+func xxh3XXH64Avalanche(h uint64) uint64 {
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	return h ^ h>>32
+}
+
+func xxh3Avalanche(h uint64) uint64 {
+	h ^= h >> 37
+	h *= xxh3PrimeMx1
+	return h ^ h>>32
+}
+
+func xxh3Rrmxmx(h, length uint64) uint64 {
+	h ^= bits.RotateLeft64(h, 49) ^ bits.RotateLeft64(h, 24)
+	h *= xxh3PrimeMx2
+	h ^= h>>35 + length
+	h *= xxh3PrimeMx2
+	return h ^ h>>28
+}
+
+func xxh3Mix16(data []byte, at, secret int) uint64 {
+	return xxh3Mul128Fold64(
+		xxh3Read64(data, at)^xxh3Read64(xxh3Secret[:], secret),
+		xxh3Read64(data, at+8)^xxh3Read64(xxh3Secret[:], secret+8),
+	)
+}
+
+// xxh3Short 不超过 xxh3MidsizeMax 字节的输入的 XXH3-64
+func xxh3Short(data []byte) uint64 {
+	n := len(data)
+	n64 := uint64(n)
+	s := xxh3Secret[:]
+	switch {
+	case n == 0:
+		return xxh3XXH64Avalanche(xxh3Read64(s, 56) ^ xxh3Read64(s, 64))
+	case n <= 3:
+		combined := uint64(data[0])<<16 | uint64(data[n>>1])<<24 | uint64(data[n-1]) | n64<<8
+		return xxh3XXH64Avalanche(combined ^ (xxh3Read32(s, 0) ^ xxh3Read32(s, 4)))
+	case n <= 8:
+		input := xxh3Read32(data, n-4) + xxh3Read32(data, 0)<<32
+		return xxh3Rrmxmx(input^(xxh3Read64(s, 8)^xxh3Read64(s, 16)), n64)
+	case n <= 16:
+		lo := xxh3Read64(data, 0) ^ (xxh3Read64(s, 24) ^ xxh3Read64(s, 32))
+		hi := xxh3Read64(data, n-8) ^ (xxh3Read64(s, 40) ^ xxh3Read64(s, 48))
+		return xxh3Avalanche(n64 + bits.ReverseBytes64(lo) + hi + xxh3Mul128Fold64(lo, hi))
+	case n <= 128:
+		acc := n64 * xxhPrime1
+		for i := (n - 1) / 32; i >= 0; i-- {
+			acc += xxh3Mix16(data, 16*i, 32*i)
+			acc += xxh3Mix16(data, n-16*(i+1), 32*i+16)
+		}
+		return xxh3Avalanche(acc)
+	default:
+		acc := n64 * xxhPrime1
+		for i := 0; i < 8; i++ {
+			acc += xxh3Mix16(data, 16*i, 16*i)
+		}
+		acc = xxh3Avalanche(acc)
+		for i := 8; i < n/16; i++ {
+			acc += xxh3Mix16(data, 16*i, 16*(i-8)+3)
+		}
+		acc += xxh3Mix16(data, n-16, 136-17)
+		return xxh3Avalanche(acc)
+	}
+}
+
+func xxh3Accumulate(acc *[8]uint64, stripe []byte, secret int) {
+	for i := 0; i < 8; i++ {
+		value := xxh3Read64(stripe, 8*i)
+		key := value ^ xxh3Read64(xxh3Secret[:], secret+8*i)
+		acc[i^1] += value
+		acc[i] += (key & 0xffffffff) * (key >> 32)
+	}
+}
+
+func xxh3Scramble(acc *[8]uint64) {
+	for i := range acc {
+		v := acc[i]
+		v ^= v >> 47
+		v ^= xxh3Read64(xxh3Secret[:], len(xxh3Secret)-xxh3StripeLen+8*i)
+		acc[i] = v * xxh3Prime32_1
+	}
+}
+
+func xxh3ConsumeBlock(acc *[8]uint64, block []byte) {
+	for n := 0; n < xxh3StripesPerBlk; n++ {
+		xxh3Accumulate(acc, block[n*xxh3StripeLen:], n*xxh3ConsumeRate)
+	}
+	xxh3Scramble(acc)
+}
+
+// xxh3 流式计算 XXH3-64，digest 等于 update 过的全部数据的 XXH3_64bits
+type xxh3 struct {
+	acc [8]uint64
+	// buf 还没有累加的输入，最多一个块；最后一个块的算法不同，满块要等到后面还有输入时才累加
+	buf      [xxh3BlockLen]byte
+	buffered int
+	// lastStripe 最近累加的块的最后一个条带
+	lastStripe [xxh3StripeLen]byte
+	total      uint64
+}
+
+func newXXH3() *xxh3 {
+	h := &xxh3{}
+	h.reset()
+	return h
+}
+
+func (h *xxh3) reset() {
+	h.acc = [8]uint64{xxh3Prime32_3, xxhPrime1, xxhPrime2, xxhPrime3, xxhPrime4, xxh3Prime32_2, xxhPrime5, xxh3Prime32_1}
+	h.buffered = 0
+	h.total = 0
+}
+
+func (h *xxh3) update(data []byte) {
+	h.total += uint64(len(data))
+	if h.buffered < xxh3BlockLen {
+		n := copy(h.buf[h.buffered:], data)
+		h.buffered += n
+		data = data[n:]
+	}
+	if len(data) == 0 {
+		return
+	}
+	// 缓冲区已满，后面还有输入
+	xxh3ConsumeBlock(&h.acc, h.buf[:])
+	tail := h.buf[xxh3BlockLen-xxh3StripeLen:]
+	// 直接从输入累加整块，留下最后一块
+	for len(data) > xxh3BlockLen {
+		xxh3ConsumeBlock(&h.acc, data[:xxh3BlockLen])
+		tail = data[xxh3BlockLen-xxh3StripeLen : xxh3BlockLen]
+		data = data[xxh3BlockLen:]
+	}
+	copy(h.lastStripe[:], tail)
+	h.buffered = copy(h.buf[:], data)
+}
+
+func (h *xxh3) digest() uint64 {
+	if h.total <= xxh3MidsizeMax {
+		return xxh3Short(h.buf[:h.buffered])
+	}
+	acc := h.acc
+	rest := h.buf[:h.buffered]
+	stripes := (len(rest) - 1) / xxh3StripeLen
+	for n := 0; n < stripes; n++ {
+		xxh3Accumulate(&acc, rest[n*xxh3StripeLen:], n*xxh3ConsumeRate)
+	}
+	var last [xxh3StripeLen]byte
+	if len(rest) >= xxh3StripeLen {
+		copy(last[:], rest[len(rest)-xxh3StripeLen:])
+	} else {
+		// 最后一个条带要用到上一个块的末尾
+		fromPrev := xxh3StripeLen - len(rest)
+		copy(last[:fromPrev], h.lastStripe[len(rest):])
+		copy(last[fromPrev:], rest)
+	}
+	xxh3Accumulate(&acc, last[:], len(xxh3Secret)-xxh3StripeLen-7)
+	r := h.total * xxhPrime1
+	for i := 0; i < 4; i++ {
+		secret := 11 + 16*i
+		r += xxh3Mul128Fold64(acc[2*i]^xxh3Read64(xxh3Secret[:], secret), acc[2*i+1]^xxh3Read64(xxh3Secret[:], secret+8))
+	}
+	return xxh3Avalanche(r)
+}
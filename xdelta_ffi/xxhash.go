@@ -0,0 +1,110 @@
+package xdelta_ffi
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XXH64（种子为 0）的 Go 实现，目录清单用它快速校验文件；原生库中的 XXH3 只用于补丁内部的校验和记录
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+	// 第一个和第四个累加器的初值 xxhPrime1 + xxhPrime2、-xxhPrime1（模 2^64），常量表达式不能溢出，直接写出结果
+	xxhInit0 uint64 = 6983438078262162902
+	xxhInit3 uint64 = 7046029288634856825
+)
+
+// xxh64 流式计算 XXH64，实现 hash.Hash64
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // buf 中未处理的字节数
+}
+
+func newXXH64() *xxh64 {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh64) Reset() {
+	h.v = [4]uint64{xxhInit0, xxhPrime2, 0, xxhInit3}
+	h.total, h.n = 0, 0
+}
+
+func (h *xxh64) Size() int      { return 8 }
+func (h *xxh64) BlockSize() int { return 32 }
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.n+len(p) < 32 {
+		h.n += copy(h.buf[h.n:], p)
+		return n, nil
+	}
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.stripes(h.buf[:])
+		p, h.n = p[c:], 0
+	}
+	full := len(p) &^ 31
+	h.stripes(p[:full])
+	h.n = copy(h.buf[:], p[full:])
+	return n, nil
+}
+
+// stripes 处理 p 中每 32 字节一组的数据，len(p) 为 32 的倍数
+func (h *xxh64) stripes(p []byte) {
+	v0, v1, v2, v3 := h.v[0], h.v[1], h.v[2], h.v[3]
+	for ; len(p) >= 32; p = p[32:] {
+		v0 = xxhRound(v0, binary.LittleEndian.Uint64(p))
+		v1 = xxhRound(v1, binary.LittleEndian.Uint64(p[8:]))
+		v2 = xxhRound(v2, binary.LittleEndian.Uint64(p[16:]))
+		v3 = xxhRound(v3, binary.LittleEndian.Uint64(p[24:]))
+	}
+	h.v = [4]uint64{v0, v1, v2, v3}
+}
+
+func (h *xxh64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		v0, v1, v2, v3 := h.v[0], h.v[1], h.v[2], h.v[3]
+		acc = bits.RotateLeft64(v0, 1) + bits.RotateLeft64(v1, 7) + bits.RotateLeft64(v2, 12) + bits.RotateLeft64(v3, 18)
+		for _, v := range h.v {
+			acc = (acc^xxhRound(0, v))*xxhPrime1 + xxhPrime4
+		}
+	} else {
+		acc = xxhPrime5
+	}
+	acc += h.total
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc = bits.RotateLeft64(acc^xxhRound(0, binary.LittleEndian.Uint64(p)), 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(p) >= 4 {
+		acc = bits.RotateLeft64(acc^uint64(binary.LittleEndian.Uint32(p))*xxhPrime1, 23)*xxhPrime2 + xxhPrime3
+		p = p[4:]
+	}
+	for _, c := range p {
+		acc = bits.RotateLeft64(acc^uint64(c)*xxhPrime5, 11) * xxhPrime1
+	}
+	acc ^= acc >> 33
+	acc *= xxhPrime2
+	acc ^= acc >> 29
+	acc *= xxhPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+// Sum 把大端序的摘要追加到 b，与 xxhsum 输出的十六进制一致
+func (h *xxh64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*xxhPrime2, 31) * xxhPrime1
+}
@@ -0,0 +1,738 @@
+package xdelta_ffi
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+)
+
+// zip 补丁的格式（整数均为小端序）：
+//
+//	magic        8 字节  89 'X' 'D' 'Z' 'I' 'P' 0D 0A
+//	version      1 字节  当前为 1
+//	mode         1 字节  0 逐字节相同，1 语义相同
+//	source size  8 字节
+//	source hash 32 字节  旧 zip 的 SHA-256
+//	记录                 每条以 1 字节的类型开头
+//
+// 逐字节相同模式的记录按顺序产生新 zip 的各个片段：每个条目的压缩数据、压缩数据之前的字节（头：上一个条目的数据描述符
+// 和本条目的本地文件头，第一个头还包括归档前面附加的数据），以及最后一个条目之后的所有数据（结尾：中央目录等）
+//
+//	1 same     old index 4 字节                               与旧 zip 的第 index 个片段相同
+//	2 diff     old index 4 字节、patch 长度 8 字节、patch          把 patch 应用到旧 zip 的第 index 个片段（FFFFFFFF 为空数据）
+//	3 deflate  old entry 4 字节、level 1 字节、patch 长度 8 字节、patch  把 patch 应用到旧 zip 第 entry 个条目解压后的内容，
+//	                                                          再用 compress/flate 的 level 级别压缩
+//	0 end      target size 8 字节、target hash 32 字节            新 zip 的长度和 SHA-256
+//
+// 语义相同模式的记录按新 zip 中央目录的顺序产生每个条目，本地文件头和中央目录由 archive/zip 重新写出：
+//
+//	4 raw      header 长度 4 字节、header、old entry 4 字节      压缩数据与旧 zip 第 entry 个条目的相同
+//	5 content  header 长度 4 字节、header、old entry 4 字节、level 1 字节、patch 长度 8 字节、patch
+//	                                                     内容由 patch 应用到旧条目解压后的内容（FFFFFFFF 为空数据）得到，
+//	                                                     按 header 的压缩方式保存，deflate 时用 level 级别压缩
+//	0 end      comment 长度 4 字节、comment                  归档的注释
+//
+// header 是新条目的 zip.FileHeader 的 JSON，去掉了 zip64 扩展字段，由 archive/zip 按需要重新生成
+var zipDiffMagic = []byte{0x89, 'X', 'D', 'Z', 'I', 'P', 0x0D, 0x0A}
+
+const (
+	// ZipDiffVersion CreateZipDiff 写入的 zip 补丁格式版本
+	ZipDiffVersion = 1
+
+	zipDiffHeaderLen = 8 + 1 + 1 + 8 + sha256.Size
+
+	zipModeExact    = 0
+	zipModeSemantic = 1
+
+	zipOpEnd     = 0
+	zipOpSame    = 1
+	zipOpDiff    = 2
+	zipOpDeflate = 3
+	zipOpRaw     = 4
+	zipOpContent = 5
+
+	// zipNoBase 记录不引用旧片段或旧条目，patch 从空数据生成
+	zipNoBase uint32 = 1<<32 - 1
+
+	// zipSemanticLevel 语义相同模式下无法复现的条目重新压缩使用的级别，即 compress/flate 的默认级别
+	zipSemanticLevel = 6
+
+	// zipMaxHeader 语义相同模式中 header 的长度上限；名字、注释和扩展字段各自不超过 64 KiB
+	zipMaxHeader = 1 << 22
+
+	zip64ExtraID = 0x0001
+)
+
+// zipLevels 尝试复现压缩数据的 compress/flate 级别，archive/zip 写出时使用的 5 排在最前面
+var zipLevels = []int{5, 6, 9, 1, 2, 3, 4, 7, 8}
+
+// WithExactZip 让 CreateZipDiff 总是生成逐字节相同模式的补丁
+// 默认情况下，内容变化了而压缩数据无法用 compress/flate 复现的 deflate 条目（zlib、7-Zip 等压缩的）让补丁使用语义相同模式：
+// ApplyZipDiff 用 archive/zip 重新写出归档，条目的顺序、路径、属性和解压后的内容与新 zip 相同（写出前校验长度和 CRC-32），
+// 但压缩数据、偏移和本地文件头可能不同；指定后这些条目直接对压缩数据生成补丁，结果逐字节相同，适用于签过名的 apk、jar 等
+// 补丁大小取决于归档：压缩数据在修改处之后通常完全改变，大条目靠前的修改会让补丁接近整个条目的压缩数据
+// （600 KB 的 zip -9 文本条目改一行，逐字节相同约 600 KB，语义相同约 26 KB）；而语义相同模式要为每个条目记录头、
+// 由 ApplyZipDiff 重新写出整个归档，条目多而小时反而更大（20 个小条目改一个，语义相同约 8 KB，逐字节相同约 1.5 KB）
+func WithExactZip() Option {
+	return func(o *options) {
+		o.exactZip = true
+	}
+}
+
+// zipSegment zip 的一段原始字节：第 entry 个条目的头或压缩数据，或者结尾（entry 为 -1）
+type zipSegment struct {
+	off, size int64
+	entry     int
+	data      bool
+}
+
+// zipArchive 用 archive/zip 解析过的 zip，按偏移排列的全部片段，以及按路径找到条目的索引
+type zipArchive struct {
+	ra       io.ReaderAt
+	zr       *zip.Reader
+	segments []zipSegment
+	head     []int          // 条目的下标到其头片段的下标，压缩数据是下一个片段
+	entries  map[string]int // 同一路径出现多次时按最后一次匹配
+}
+
+// openZip 解析 ra 中长度为 size 的 zip 并拆分成片段；条目的压缩数据互相重叠时返回错误
+func openZip(ra io.ReaderAt, size int64) (*zipArchive, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil && !(errors.Is(err, zip.ErrInsecurePath) && zr != nil) {
+		return nil, err
+	}
+	a := &zipArchive{ra: ra, zr: zr, head: make([]int, len(zr.File)), entries: make(map[string]int, len(zr.File))}
+	offs := make([]int64, len(zr.File))
+	order := make([]int, len(zr.File))
+	for i, f := range zr.File {
+		off, err := f.DataOffset()
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %v", f.Name, err)
+		}
+		offs[i], order[i] = off, i
+		a.entries[f.Name] = i
+	}
+	sort.SliceStable(order, func(x, y int) bool { return offs[order[x]] < offs[order[y]] })
+	var pos int64
+	for _, i := range order {
+		f := zr.File[i]
+		end := offs[i] + int64(f.CompressedSize64)
+		if offs[i] < pos || end < offs[i] || end > size {
+			return nil, fmt.Errorf("entry %q overlaps another entry or the end of the archive", f.Name)
+		}
+		a.head[i] = len(a.segments)
+		a.segments = append(a.segments,
+			zipSegment{off: pos, size: offs[i] - pos, entry: i},
+			zipSegment{off: offs[i], size: end - offs[i], entry: i, data: true})
+		pos = end
+	}
+	a.segments = append(a.segments, zipSegment{off: pos, size: size - pos, entry: -1})
+	if uint64(len(a.segments)) > uint64(zipNoBase) {
+		return nil, fmt.Errorf("more than %d segments", zipNoBase)
+	}
+	return a, nil
+}
+
+// match 返回路径为 name 的条目的下标，没有时返回 -1
+func (a *zipArchive) match(name string) int {
+	if i, ok := a.entries[name]; ok {
+		return i
+	}
+	return -1
+}
+
+// bytes 读取片段 seg 的原始字节
+func (a *zipArchive) bytes(seg zipSegment) ([]byte, error) {
+	b := make([]byte, seg.size)
+	if _, err := io.ReadFull(io.NewSectionReader(a.ra, seg.off, seg.size), b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// raw 读取第 i 个条目的压缩数据
+func (a *zipArchive) raw(i int) ([]byte, error) {
+	return a.bytes(a.segments[a.head[i]+1])
+}
+
+// content 解压第 i 个条目，只支持 store 和 deflate，CRC-32 不对时返回错误
+func (a *zipArchive) content(i int) ([]byte, error) {
+	rc, err := a.zr.File[i].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// zipPlan 新 zip 的一个条目怎样生成
+type zipPlan struct {
+	old   int  // 同一路径的旧条目，没有时为 -1
+	same  bool // 压缩数据与旧条目的相同
+	plain bool // 能解压出内容：store 或 deflate，CRC-32 正确
+	level int  // deflate 条目能复现压缩数据的级别，不能时为 -1
+}
+
+// planZip 把新 zip 的每个条目与旧 zip 中同一路径的条目比较，并尝试复现变化了的 deflate 条目的压缩数据
+func planZip(src, dst *zipArchive) ([]zipPlan, error) {
+	plans := make([]zipPlan, len(dst.zr.File))
+	for i, f := range dst.zr.File {
+		p := zipPlan{old: src.match(f.Name), level: -1}
+		raw, err := dst.raw(i)
+		if err != nil {
+			return nil, err
+		}
+		if p.old >= 0 {
+			o := src.zr.File[p.old]
+			if o.Method == f.Method && o.CRC32 == f.CRC32 && o.CompressedSize64 == f.CompressedSize64 {
+				old, err := src.raw(p.old)
+				if err != nil {
+					return nil, err
+				}
+				p.same = bytes.Equal(old, raw)
+			}
+		}
+		if !p.same && (f.Method == zip.Store || f.Method == zip.Deflate) {
+			content, err := dst.content(i)
+			p.plain = err == nil
+			if p.plain && f.Method == zip.Deflate {
+				p.level = deflateLevel(content, raw)
+			}
+		}
+		plans[i] = p
+	}
+	return plans, nil
+}
+
+// zipMode 选择补丁的模式：有旧条目、内容变化了而压缩数据无法复现的 deflate 条目时用语义相同模式，
+// 除非指定了 WithExactZip，或者有变化了的条目无法解压（加密、不认识的压缩方式）
+func zipMode(dst *zipArchive, plans []zipPlan, exact bool) byte {
+	semantic := false
+	for i, p := range plans {
+		switch {
+		case p.same:
+		case !p.plain:
+			return zipModeExact
+		case p.old >= 0 && p.level < 0 && dst.zr.File[i].Method == zip.Deflate:
+			semantic = true
+		}
+	}
+	if semantic && !exact {
+		return zipModeSemantic
+	}
+	return zipModeExact
+}
+
+// matchWriter 比较写入的数据与 want，不一致时返回 errZipMismatch
+type matchWriter struct {
+	want []byte
+}
+
+var errZipMismatch = errors.New("compressed data differs")
+
+func (m *matchWriter) Write(p []byte) (int, error) {
+	if !bytes.HasPrefix(m.want, p) {
+		return 0, errZipMismatch
+	}
+	m.want = m.want[len(p):]
+	return len(p), nil
+}
+
+// deflateLevel 返回用 compress/flate 压缩 content 能得到 raw 的级别，都不能时返回 -1；
+// 压缩的输出与 raw 不一致时立即放弃这个级别，因此不能复现的条目通常只压缩开头的一小段
+func deflateLevel(content, raw []byte) int {
+	for _, level := range zipLevels {
+		m := &matchWriter{want: raw}
+		fw, err := flate.NewWriter(m, level)
+		if err != nil {
+			continue
+		}
+		if _, err := fw.Write(content); err == nil && fw.Close() == nil && len(m.want) == 0 {
+			return level
+		}
+	}
+	return -1
+}
+
+// deflate 用 compress/flate 的 level 级别压缩 content
+func deflate(content []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// zipHeader 返回语义相同模式中条目 f 的 header：去掉 zip64 扩展字段，清空 Modified 让 archive/zip 使用原来的
+// MS-DOS 时间，原有的扩展时间戳字段留在 Extra 中
+func zipHeader(f *zip.File) ([]byte, error) {
+	fh := f.FileHeader
+	fh.Modified = time.Time{}
+	fh.Extra = stripZip64(fh.Extra)
+	return json.Marshal(&fh)
+}
+
+// stripZip64 返回去掉 zip64 扩展字段后的 extra；extra 格式不对时原样返回
+func stripZip64(extra []byte) []byte {
+	var out []byte
+	for b := extra; len(b) > 0; {
+		if len(b) < 4 {
+			return extra
+		}
+		n := 4 + int(binary.LittleEndian.Uint16(b[2:]))
+		if n > len(b) {
+			return extra
+		}
+		if binary.LittleEndian.Uint16(b) != zip64ExtraID {
+			out = append(out, b[:n]...)
+		}
+		b = b[n:]
+	}
+	return out
+}
+
+// CreateZipDiff 创建从长度为 oldSize 的 zip 归档 oldZip 到长度为 newSize 的 newZip 的补丁并写入 out，条目按路径匹配、按解压后的内容生成补丁
+func CreateZipDiff(oldZip, newZip io.ReaderAt, oldSize, newSize int64, out io.Writer, opts ...Option) error {
+	if err := Init(); err != nil {
+		return err
+	}
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	sum, err := hashReaderAt(oldZip, oldSize)
+	if err != nil {
+		return err
+	}
+	src, err := openZip(oldZip, oldSize)
+	if err != nil {
+		return fmt.Errorf("%w: old zip: %v", ErrInvalidArgument, err)
+	}
+	dst, err := openZip(newZip, newSize)
+	if err != nil {
+		return fmt.Errorf("%w: new zip: %v", ErrInvalidArgument, err)
+	}
+	plans, err := planZip(src, dst)
+	if err != nil {
+		return err
+	}
+	mode := zipMode(dst, plans, o.exactZip)
+
+	bw := bufio.NewWriter(out)
+	head := append([]byte{}, zipDiffMagic...)
+	head = append(head, ZipDiffVersion, mode)
+	head = binary.LittleEndian.AppendUint64(head, uint64(oldSize))
+	head = append(head, sum[:]...)
+	if _, err := bw.Write(head); err != nil {
+		return err
+	}
+	if mode == zipModeSemantic {
+		err = writeSemanticZip(bw, src, dst, plans, opts)
+	} else {
+		err = writeExactZip(bw, src, dst, plans, opts)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// hashReaderAt 计算 ra 前 size 个字节的 SHA-256
+func hashReaderAt(ra io.ReaderAt, size int64) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(ra, 0, size)); err != nil {
+		return sum, err
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// writeExactZip 写出逐字节相同模式的记录：逐个片段与旧 zip 中对应的片段比较
+func writeExactZip(w io.Writer, src, dst *zipArchive, plans []zipPlan, opts []Option) error {
+	h := sha256.New()
+	var size int64
+	var rec []byte
+	for _, seg := range dst.segments {
+		data, err := dst.bytes(seg)
+		if err != nil {
+			return err
+		}
+		h.Write(data)
+		size += seg.size
+		base := zipNoBase
+		p := zipPlan{old: -1, level: -1}
+		switch {
+		case seg.entry < 0:
+			base = uint32(len(src.segments) - 1)
+		case plans[seg.entry].old >= 0:
+			p = plans[seg.entry]
+			base = uint32(src.head[p.old])
+			if seg.data {
+				base++
+			}
+		}
+		var old []byte
+		if base != zipNoBase {
+			if old, err = src.bytes(src.segments[base]); err != nil {
+				return err
+			}
+			if bytes.Equal(old, data) {
+				rec = binary.LittleEndian.AppendUint32(append(rec[:0], zipOpSame), base)
+				if _, err := w.Write(rec); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		patch, err := CreateDiffs(old, data, opts...)
+		if err != nil {
+			return err
+		}
+		rec = binary.LittleEndian.AppendUint32(append(rec[:0], zipOpDiff), base)
+		// 能复现压缩数据时再对解压后的内容生成补丁，取较小的一个；高度重复的内容压缩后很小，直接对压缩数据差分可能更小
+		if seg.data && p.level >= 0 {
+			if oldContent, err := src.content(p.old); err == nil {
+				content, err := dst.content(seg.entry)
+				if err != nil {
+					return err
+				}
+				cp, err := CreateDiffs(oldContent, content, opts...)
+				if err != nil {
+					return err
+				}
+				if len(cp) < len(patch) {
+					patch = cp
+					rec = binary.LittleEndian.AppendUint32(append(rec[:0], zipOpDeflate), uint32(p.old))
+					rec = append(rec, byte(p.level))
+				}
+			}
+		}
+		if err := writePatchRecord(w, rec, patch); err != nil {
+			return err
+		}
+	}
+	rec = binary.LittleEndian.AppendUint64(append(rec[:0], zipOpEnd), uint64(size))
+	_, err := w.Write(h.Sum(rec))
+	return err
+}
+
+// writeSemanticZip 写出语义相同模式的记录：按中央目录的顺序逐个条目与旧 zip 中同一路径的条目比较
+func writeSemanticZip(w io.Writer, src, dst *zipArchive, plans []zipPlan, opts []Option) error {
+	var rec []byte
+	for i, f := range dst.zr.File {
+		p := plans[i]
+		hdr, err := zipHeader(f)
+		if err != nil {
+			return err
+		}
+		if p.same {
+			rec = binary.LittleEndian.AppendUint32(append(rec[:0], zipOpRaw), uint32(len(hdr)))
+			rec = binary.LittleEndian.AppendUint32(append(rec, hdr...), uint32(p.old))
+			if _, err := w.Write(rec); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := dst.content(i)
+		if err != nil {
+			return err
+		}
+		base := zipNoBase
+		var old []byte
+		if p.old >= 0 {
+			if c, err := src.content(p.old); err == nil {
+				base, old = uint32(p.old), c
+			}
+		}
+		level := p.level
+		switch {
+		case f.Method == zip.Store:
+			level = 0
+		case level < 0:
+			level = zipSemanticLevel
+		}
+		patch, err := CreateDiffs(old, content, opts...)
+		if err != nil {
+			return err
+		}
+		rec = binary.LittleEndian.AppendUint32(append(rec[:0], zipOpContent), uint32(len(hdr)))
+		rec = binary.LittleEndian.AppendUint32(append(rec, hdr...), base)
+		rec = append(rec, byte(level))
+		if err := writePatchRecord(w, rec, patch); err != nil {
+			return err
+		}
+	}
+	rec = binary.LittleEndian.AppendUint32(append(rec[:0], zipOpEnd), uint32(len(dst.zr.Comment)))
+	_, err := w.Write(append(rec, dst.zr.Comment...))
+	return err
+}
+
+// writePatchRecord 写出 rec 以及其后带长度的 patch
+func writePatchRecord(w io.Writer, rec, patch []byte) error {
+	rec = binary.LittleEndian.AppendUint64(rec, uint64(len(patch)))
+	if _, err := w.Write(rec); err != nil {
+		return err
+	}
+	_, err := w.Write(patch)
+	return err
+}
+
+// ApplyZipDiff 把 CreateZipDiff 生成的补丁应用到长度为 oldSize 的 oldZip，把新 zip 写入 out
+func ApplyZipDiff(oldZip io.ReaderAt, oldSize int64, patch io.Reader, out io.Writer, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+	pr := bufio.NewReader(patch)
+	head := make([]byte, zipDiffHeaderLen)
+	if _, err := io.ReadFull(pr, head[:len(zipDiffMagic)+1]); err != nil || !bytes.HasPrefix(head, zipDiffMagic) {
+		return fmt.Errorf("%w: missing zip diff magic", ErrCorruptPatch)
+	}
+	if v := head[len(zipDiffMagic)]; v != ZipDiffVersion {
+		return fmt.Errorf("%w: zip diff version %d", ErrUnsupportedPatch, v)
+	}
+	if _, err := io.ReadFull(pr, head[len(zipDiffMagic)+1:]); err != nil {
+		return fmt.Errorf("%w: truncated zip diff header", ErrCorruptPatch)
+	}
+	b := head[len(zipDiffMagic)+1:]
+	mode := b[0]
+	if mode != zipModeExact && mode != zipModeSemantic {
+		return fmt.Errorf("%w: zip diff mode %d", ErrUnsupportedPatch, mode)
+	}
+	if size := binary.LittleEndian.Uint64(b[1:]); size != uint64(oldSize) {
+		return fmt.Errorf("%w: old zip is %d bytes, the patch expects %d", ErrSourceMismatch, oldSize, size)
+	}
+	sum, err := hashReaderAt(oldZip, oldSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b[9:], sum[:]) {
+		return fmt.Errorf("%w: SHA-256 of the old zip differs from the patch", ErrSourceMismatch)
+	}
+	src, err := openZip(oldZip, oldSize)
+	if err != nil {
+		return fmt.Errorf("%w: old zip: %v", ErrSourceMismatch, err)
+	}
+	budget := newDiffBudget(o, opts, "zip")
+	if mode == zipModeSemantic {
+		return applySemanticZip(src, pr, out, budget)
+	}
+	return applyExactZip(src, pr, out, budget)
+}
+
+// applyExactZip 应用逐字节相同模式的记录
+func applyExactZip(src *zipArchive, pr *bufio.Reader, out io.Writer, budget *diffBudget) error {
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	var size int64
+	for {
+		op, err := pr.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+		}
+		var data []byte
+		switch op {
+		case zipOpEnd:
+			return checkDiffEnd(pr, size, h, "zip")
+		case zipOpSame, zipOpDiff:
+			base, err := readZipIndex(pr, len(src.segments), op == zipOpSame)
+			if err != nil {
+				return err
+			}
+			if base != zipNoBase {
+				if data, err = src.bytes(src.segments[base]); err != nil {
+					return err
+				}
+			}
+			if op == zipOpDiff {
+				p, err := readRecordPatch(pr, "zip")
+				if err != nil {
+					return err
+				}
+				if data, err = ApplyDiffsData(data, p, budget.patchOpts()...); err != nil {
+					return err
+				}
+			}
+		case zipOpDeflate:
+			content, level, err := readZipContent(src, pr, budget.contentOpts())
+			if err != nil {
+				return err
+			}
+			if level < 1 || level > 9 {
+				return fmt.Errorf("%w: zip diff deflate level %d", ErrCorruptPatch, level)
+			}
+			if data, err = deflate(content, level); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown zip diff record %d", ErrCorruptPatch, op)
+		}
+		if err := budget.add(len(data)); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		size += int64(len(data))
+	}
+}
+
+// applySemanticZip 应用语义相同模式的记录，用 archive/zip 写出新 zip
+func applySemanticZip(src *zipArchive, pr *bufio.Reader, out io.Writer, budget *diffBudget) error {
+	zw := zip.NewWriter(out)
+	for {
+		op, err := pr.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+		}
+		if op == zipOpEnd {
+			break
+		}
+		if op != zipOpRaw && op != zipOpContent {
+			return fmt.Errorf("%w: unknown zip diff record %d", ErrCorruptPatch, op)
+		}
+		fh, err := readZipHeader(pr)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if op == zipOpRaw {
+			i, err := readZipIndex(pr, len(src.zr.File), true)
+			if err != nil {
+				return err
+			}
+			if f := src.zr.File[i]; f.CRC32 != fh.CRC32 || f.UncompressedSize64 != fh.UncompressedSize64 {
+				return fmt.Errorf("%w: zip diff copies entry %q into %q with different content", ErrCorruptPatch, f.Name, fh.Name)
+			}
+			if data, err = src.raw(int(i)); err != nil {
+				return err
+			}
+		} else {
+			content, level, err := readZipContent(src, pr, budget.contentOpts())
+			if err != nil {
+				return err
+			}
+			if uint64(len(content)) != fh.UncompressedSize64 || crc32.ChecksumIEEE(content) != fh.CRC32 {
+				return fmt.Errorf("%w: content of entry %q differs from its size or CRC-32", ErrTargetMismatch, fh.Name)
+			}
+			switch {
+			case fh.Method == zip.Store:
+				data = content
+			case fh.Method == zip.Deflate && level >= 1 && level <= 9:
+				if data, err = deflate(content, level); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("%w: entry %q has method %d and level %d", ErrCorruptPatch, fh.Name, fh.Method, level)
+			}
+		}
+		if err := budget.add(len(data)); err != nil {
+			return err
+		}
+		fh.CompressedSize64 = uint64(len(data))
+		fw, err := zw.CreateRaw(fh)
+		if err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			if _, err := fw.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	var n [4]byte
+	if _, err := io.ReadFull(pr, n[:]); err != nil {
+		return fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+	}
+	size := binary.LittleEndian.Uint32(n[:])
+	if size > 0xFFFF {
+		return fmt.Errorf("%w: zip diff comment of %d bytes", ErrCorruptPatch, size)
+	}
+	comment := make([]byte, size)
+	if _, err := io.ReadFull(pr, comment); err != nil {
+		return fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+	}
+	if err := zw.SetComment(string(comment)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readZipIndex 读取记录中的片段或条目下标，检查它小于 n；required 为 false 时也接受 zipNoBase
+func readZipIndex(r io.Reader, n int, required bool) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+	}
+	i := binary.LittleEndian.Uint32(b[:])
+	if (i != zipNoBase || required) && uint64(i) >= uint64(n) {
+		return 0, fmt.Errorf("%w: zip diff references %d of %d", ErrCorruptPatch, i, n)
+	}
+	return i, nil
+}
+
+// readZipContent 读取 deflate、content 记录中的旧条目、级别和补丁，返回应用补丁后的内容
+func readZipContent(src *zipArchive, pr *bufio.Reader, opts []Option) ([]byte, int, error) {
+	i, err := readZipIndex(pr, len(src.zr.File), false)
+	if err != nil {
+		return nil, 0, err
+	}
+	level, err := pr.ReadByte()
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+	}
+	p, err := readRecordPatch(pr, "zip")
+	if err != nil {
+		return nil, 0, err
+	}
+	var old []byte
+	if i != zipNoBase {
+		if old, err = src.content(int(i)); err != nil {
+			return nil, 0, fmt.Errorf("%w: entry %q of the old zip: %v", ErrCorruptPatch, src.zr.File[i].Name, err)
+		}
+	}
+	content, err := ApplyDiffsData(old, p, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return content, int(level), nil
+}
+
+// readZipHeader 读取语义相同模式的记录中的 header
+func readZipHeader(r io.Reader) (*zip.FileHeader, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+	}
+	size := binary.LittleEndian.Uint32(n[:])
+	if size > zipMaxHeader {
+		return nil, fmt.Errorf("%w: zip diff header of %d bytes", ErrCorruptPatch, size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: truncated zip diff", ErrCorruptPatch)
+	}
+	fh := new(zip.FileHeader)
+	if err := json.Unmarshal(b, fh); err != nil {
+		return nil, fmt.Errorf("%w: zip diff header: %v", ErrCorruptPatch, err)
+	}
+	return fh, nil
+}
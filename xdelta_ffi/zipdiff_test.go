@@ -0,0 +1,355 @@
+package xdelta_ffi
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readZipFixture 读取 testdata/zip 中的归档（由 generate.py 用 Info-ZIP zip 生成）
+func readZipFixture(tb testing.TB, name string) []byte {
+	tb.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "zip", name))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func createZipDiff(tb testing.TB, oldZip, newZip []byte, opts ...Option) []byte {
+	tb.Helper()
+	var patch bytes.Buffer
+	if err := CreateZipDiff(bytes.NewReader(oldZip), bytes.NewReader(newZip), int64(len(oldZip)), int64(len(newZip)), &patch, opts...); err != nil {
+		tb.Fatal(err)
+	}
+	return patch.Bytes()
+}
+
+func applyZipDiff(oldZip, patch []byte, opts ...Option) ([]byte, error) {
+	var out bytes.Buffer
+	err := ApplyZipDiff(bytes.NewReader(oldZip), int64(len(oldZip)), bytes.NewReader(patch), &out, opts...)
+	return out.Bytes(), err
+}
+
+// zipDiffOps 按格式说明解析 zip 补丁，返回模式和 end 之前各条记录的类型
+func zipDiffOps(tb testing.TB, patch []byte) (byte, []byte) {
+	tb.Helper()
+	mode, p := patch[len(zipDiffMagic)+1], patch[zipDiffHeaderLen:]
+	var ops []byte
+	for p[0] != zipOpEnd {
+		op := p[0]
+		p = p[1:]
+		if op == zipOpRaw || op == zipOpContent {
+			p = p[4+binary.LittleEndian.Uint32(p):]
+		}
+		p = p[4:]
+		if op == zipOpDeflate || op == zipOpContent {
+			p = p[1:]
+		}
+		if op != zipOpSame && op != zipOpRaw {
+			p = p[8+binary.LittleEndian.Uint64(p):]
+		}
+		ops = append(ops, op)
+	}
+	return mode, ops
+}
+
+// zipEntry 条目中语义相同模式保留的属性和解压后的内容
+type zipEntry struct {
+	name, comment string
+	method        uint16
+	crc           uint32
+	size          uint64
+	modified      time.Time
+	attrs         uint32
+	extra         string
+	content       string
+}
+
+// zipEntries 用 archive/zip 读取 data 中的全部条目
+func zipEntries(tb testing.TB, data []byte) ([]zipEntry, string) {
+	tb.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var entries []zipEntry
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			tb.Fatalf("%s: %v", f.Name, err)
+		}
+		entries = append(entries, zipEntry{
+			name: f.Name, comment: f.Comment, method: f.Method, crc: f.CRC32, size: f.UncompressedSize64,
+			modified: f.Modified, attrs: f.ExternalAttrs, extra: string(stripZip64(f.Extra)), content: string(content),
+		})
+	}
+	return entries, zr.Comment
+}
+
+// checkSemanticZip 检查 got 与 want 的条目顺序、属性和内容相同
+func checkSemanticZip(tb testing.TB, got, want []byte) {
+	tb.Helper()
+	ge, gc := zipEntries(tb, got)
+	we, wc := zipEntries(tb, want)
+	if len(ge) != len(we) || gc != wc {
+		tb.Fatalf("got %d entries and comment %q, want %d and %q", len(ge), gc, len(we), wc)
+	}
+	for i := range we {
+		if ge[i] != we[i] {
+			tb.Errorf("entry %d: got %q (%d bytes, CRC %08x), want %q (%d bytes, CRC %08x)",
+				i, ge[i].name, ge[i].size, ge[i].crc, we[i].name, we[i].size, we[i].crc)
+		}
+	}
+}
+
+// goZip 用 archive/zip 写出条目，name 以 .bin 结尾的用 store，其余用 deflate
+func goZip(tb testing.TB, files [][2]string) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		method := zip.Deflate
+		if filepath.Ext(f[0]) == ".bin" {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f[0], Method: method, Modified: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC)})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := io.WriteString(w, f[1]); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestZipDiffStore 只有 store 条目的归档总是逐字节相同：变化的条目对原始数据生成补丁，没变的只记录引用
+func TestZipDiffStore(t *testing.T) {
+	requireNative(t)
+	oldZip, newZip := readZipFixture(t, "store-old.zip"), readZipFixture(t, "store-new.zip")
+	patch := createZipDiff(t, oldZip, newZip)
+	got, err := applyZipDiff(oldZip, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newZip) {
+		t.Fatalf("got %d bytes, want the %d byte new zip", len(got), len(newZip))
+	}
+	if len(patch) > len(newZip)/5 {
+		t.Errorf("patch is %d bytes for a %d byte zip", len(patch), len(newZip))
+	}
+	mode, ops := zipDiffOps(t, patch)
+	if mode != zipModeExact {
+		t.Fatalf("mode %d, want the exact mode", mode)
+	}
+	same := 0
+	for _, op := range ops {
+		switch op {
+		case zipOpSame:
+			same++
+		case zipOpDiff:
+		default:
+			t.Errorf("record %d in a store-only zip", op)
+		}
+	}
+	// 5 个条目的头和数据加上结尾：MANIFEST.MF 和 layout.xml 的头和数据不变
+	if len(ops) != 11 || same < 4 {
+		t.Errorf("%d records, %d same", len(ops), same)
+	}
+}
+
+// TestZipDiffDeflateReproduced archive/zip 写出的 deflate 条目能按记下的级别重新压缩，不需要 WithExactZip 也逐字节相同，
+// 补丁对解压后的内容生成
+func TestZipDiffDeflateReproduced(t *testing.T) {
+	requireNative(t)
+	text, changed := textFixture(60000)
+	oldZip := goZip(t, [][2]string{{"a.txt", string(text)}, {"b.bin", "stored"}, {"c.txt", "unchanged"}})
+	newZip := goZip(t, [][2]string{{"a.txt", string(changed)}, {"b.bin", "stored!"}, {"c.txt", "unchanged"}})
+	patch := createZipDiff(t, oldZip, newZip)
+	got, err := applyZipDiff(oldZip, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newZip) {
+		t.Fatalf("got %d bytes, want the %d byte new zip", len(got), len(newZip))
+	}
+	mode, ops := zipDiffOps(t, patch)
+	if mode != zipModeExact || !bytes.Contains(ops, []byte{zipOpDeflate}) {
+		t.Errorf("mode %d, records %v: want the exact mode with a deflate record", mode, ops)
+	}
+	// 对压缩数据差分时，修改处之后的压缩数据完全改变，补丁接近整个条目
+	if n := len(newZip); len(patch) > n/2 {
+		t.Errorf("patch is %d bytes for a %d byte zip", len(patch), n)
+	}
+}
+
+// TestZipDiffSemantic Info-ZIP 压缩的条目变化后无法复现，默认用语义相同模式：重新写出的归档条目顺序、属性和内容与新 zip 相同，
+// 没变的条目沿用旧的压缩数据；WithExactZip 时逐字节相同
+func TestZipDiffSemantic(t *testing.T) {
+	requireNative(t)
+	for _, c := range []struct{ old, new string }{{"app-old.zip", "app-new.zip"}, {"zip64-old.zip", "zip64-new.zip"}} {
+		oldZip, newZip := readZipFixture(t, c.old), readZipFixture(t, c.new)
+		patch := createZipDiff(t, oldZip, newZip)
+		mode, ops := zipDiffOps(t, patch)
+		if mode != zipModeSemantic {
+			t.Fatalf("%s: mode %d, want the semantic mode", c.new, mode)
+		}
+		// MANIFEST.MF、classes.txt、raw.bin、layout.xml、new.txt
+		if want := []byte{zipOpRaw, zipOpContent, zipOpContent, zipOpRaw, zipOpContent}; !bytes.Equal(ops, want) {
+			t.Errorf("%s: records %v, want %v", c.new, ops, want)
+		}
+		got, err := applyZipDiff(oldZip, patch)
+		if err != nil {
+			t.Fatalf("%s: %v", c.new, err)
+		}
+		checkSemanticZip(t, got, newZip)
+		// 解压后的内容比整个归档大，上限只对重新压缩后的数据生效
+		if _, err := applyZipDiff(oldZip, patch, WithMaxOutputSize(int64(len(got)))); err != nil {
+			t.Errorf("%s: WithMaxOutputSize of the output size: %v", c.new, err)
+		}
+
+		patch = createZipDiff(t, oldZip, newZip, WithExactZip())
+		if mode, _ := zipDiffOps(t, patch); mode != zipModeExact {
+			t.Errorf("%s: WithExactZip wrote mode %d", c.new, mode)
+		}
+		got, err = applyZipDiff(oldZip, patch)
+		if err != nil {
+			t.Fatalf("%s: WithExactZip: %v", c.new, err)
+		}
+		if !bytes.Equal(got, newZip) {
+			t.Errorf("%s: WithExactZip: got %d bytes, want the %d byte new zip", c.new, len(got), len(newZip))
+		}
+	}
+}
+
+// TestZipDiffZip64 zip64 的扩展字段和目录结尾记录照常处理；语义相同模式下 header 不带 zip64 扩展字段，由 archive/zip 按需要生成
+func TestZipDiffZip64(t *testing.T) {
+	requireNative(t)
+	oldZip, newZip := readZipFixture(t, "zip64-old.zip"), readZipFixture(t, "zip64-new.zip")
+	if !bytes.Contains(newZip, []byte("PK\x06\x06")) {
+		t.Fatal("zip64-new.zip has no zip64 end of central directory record")
+	}
+	zr, err := zip.NewReader(bytes.NewReader(newZip), int64(len(newZip)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if extra := stripZip64(f.Extra); len(extra) == len(f.Extra) {
+			t.Fatalf("%s has no zip64 extra field", f.Name)
+		}
+	}
+	patch := createZipDiff(t, oldZip, newZip)
+	if bytes.Contains(patch, []byte(`"Extra":"AQA`)) {
+		t.Error("a semantic header keeps the zip64 extra field")
+	}
+	got, err := applyZipDiff(oldZip, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSemanticZip(t, got, newZip)
+	if bytes.Contains(got, []byte("PK\x06\x06")) {
+		t.Error("the rewritten zip needs no zip64 records but has them")
+	}
+}
+
+// TestZipDiffSemanticCRC 语义相同模式在写出每个条目之前校验解压后内容的长度和 CRC-32，不一致时返回 ErrTargetMismatch
+func TestZipDiffSemanticCRC(t *testing.T) {
+	requireNative(t)
+	oldZip, newZip := readZipFixture(t, "app-old.zip"), readZipFixture(t, "app-new.zip")
+	patch := createZipDiff(t, oldZip, newZip)
+	zr, err := zip.NewReader(bytes.NewReader(newZip), int64(len(newZip)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 改 classes.txt 的 header 中 CRC32 的一位十进制数字，长度不变
+	i := bytes.Index(patch, []byte(`"Name":"classes.txt"`))
+	j := bytes.Index(patch[i:], []byte(`"CRC32":`))
+	if i < 0 || j < 0 || zr.File[1].Name != "classes.txt" {
+		t.Fatal("no classes.txt header in the patch")
+	}
+	bad := bytes.Clone(patch)
+	d := &bad[i+j+len(`"CRC32":`)]
+	*d = '1' + (*d-'0')%8
+	_, err = applyZipDiff(oldZip, bad)
+	if !errors.Is(err, ErrTargetMismatch) {
+		t.Fatalf("changed CRC-32: got %v, want ErrTargetMismatch", err)
+	}
+
+	// raw 记录复制的旧条目与 header 的 CRC-32 不一致时补丁损坏
+	i = bytes.Index(patch, []byte(`"Name":"res/layout.xml"`))
+	j = bytes.Index(patch[i:], []byte(`"CRC32":`))
+	bad = bytes.Clone(patch)
+	d = &bad[i+j+len(`"CRC32":`)]
+	*d = '1' + (*d-'0')%8
+	if _, err := applyZipDiff(oldZip, bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Errorf("changed CRC-32 of a copied entry: got %v, want ErrCorruptPatch", err)
+	}
+}
+
+// TestZipDiffErrors 旧 zip 不对时不写出数据、返回 ErrSourceMismatch；截断、版本、模式和结尾校验的错误各自对应；
+// 不是 zip 的输入返回 ErrInvalidArgument；WithMaxOutputSize 限制整个新 zip
+func TestZipDiffErrors(t *testing.T) {
+	requireNative(t)
+	oldZip, newZip := readZipFixture(t, "store-old.zip"), readZipFixture(t, "store-new.zip")
+	patch := createZipDiff(t, oldZip, newZip)
+
+	got, err := applyZipDiff(newZip, patch)
+	if !errors.Is(err, ErrSourceMismatch) || len(got) != 0 {
+		t.Fatalf("wrong old zip: got %v after %d bytes, want ErrSourceMismatch before any output", err, len(got))
+	}
+	for _, n := range []int{0, 5, zipDiffHeaderLen - 1, zipDiffHeaderLen, zipDiffHeaderLen + 3, len(patch) / 2, len(patch) - 1} {
+		if _, err := applyZipDiff(oldZip, patch[:n]); !errors.Is(err, ErrCorruptPatch) {
+			t.Errorf("%d of %d bytes: got %v, want ErrCorruptPatch", n, len(patch), err)
+		}
+	}
+	bad := bytes.Clone(patch)
+	bad[len(zipDiffMagic)] = ZipDiffVersion + 1
+	if _, err := applyZipDiff(oldZip, bad); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Errorf("later version: got %v, want ErrUnsupportedPatch", err)
+	}
+	bad = bytes.Clone(patch)
+	bad[len(zipDiffMagic)+1] = 2
+	if _, err := applyZipDiff(oldZip, bad); !errors.Is(err, ErrUnsupportedPatch) {
+		t.Errorf("unknown mode: got %v, want ErrUnsupportedPatch", err)
+	}
+	bad = bytes.Clone(patch)
+	bad[len(bad)-1] ^= 1
+	if _, err := applyZipDiff(oldZip, bad); !errors.Is(err, ErrTargetMismatch) {
+		t.Errorf("changed target hash: got %v, want ErrTargetMismatch", err)
+	}
+	bad = bytes.Clone(patch)
+	bad[zipDiffHeaderLen] = 9
+	if _, err := applyZipDiff(oldZip, bad); !errors.Is(err, ErrCorruptPatch) {
+		t.Errorf("unknown record: got %v, want ErrCorruptPatch", err)
+	}
+
+	junk := bytes.Repeat([]byte("not a zip archive "), 100)
+	for name, pair := range map[string][2][]byte{"old": {junk, newZip}, "new": {oldZip, junk}} {
+		err := CreateZipDiff(bytes.NewReader(pair[0]), bytes.NewReader(pair[1]), int64(len(pair[0])), int64(len(pair[1])), &bytes.Buffer{})
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%s zip is not a zip: got %v, want ErrInvalidArgument", name, err)
+		}
+	}
+
+	if _, err := applyZipDiff(oldZip, patch, WithMaxOutputSize(int64(len(newZip)))); err != nil {
+		t.Errorf("WithMaxOutputSize of the new size: %v", err)
+	}
+	if _, err := applyZipDiff(oldZip, patch, WithMaxOutputSize(int64(len(newZip)-1))); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("WithMaxOutputSize below the new size: got %v, want ErrOutputTooLarge", err)
+	}
+}
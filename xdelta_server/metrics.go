@@ -0,0 +1,135 @@
+package xdelta_server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets 请求耗时直方图的桶上限（秒），与 xdelta_ffi.ExpvarCollector 相同
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// serverMetrics 各接口的指标，以 Prometheus 文本格式（0.0.4）导出：
+//
+//	xdelta_server_requests_total{endpoint, code}           按状态码的请求数
+//	xdelta_server_errors_total{endpoint, class}            按错误类别的失败数，类别见 errorClass
+//	xdelta_server_requests_in_flight{endpoint}             正在处理的请求数
+//	xdelta_server_request_bytes_total{endpoint}            读取的请求数据字节数（不含 multipart 的分隔符）
+//	xdelta_server_response_bytes_total{endpoint}           成功响应的字节数
+//	xdelta_server_request_duration_seconds{endpoint}       耗时直方图
+type serverMetrics struct {
+	// endpoints 在 New 中注册完毕，之后只读
+	endpoints []*endpointMetrics
+}
+
+type endpointMetrics struct {
+	name     string
+	inFlight atomic.Int64
+	reqBytes atomic.Int64
+	sent     atomic.Int64
+
+	mu     sync.Mutex
+	codes  map[int]int64
+	errors map[string]int64
+	// buckets 第 i 个为耗时不超过 durationBuckets[i] 的次数（不累计），最后一个为超过所有上限的次数
+	buckets []int64
+	count   int64
+	sum     time.Duration
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{}
+}
+
+// endpoint 注册名为 name 的接口
+func (m *serverMetrics) endpoint(name string) *endpointMetrics {
+	e := &endpointMetrics{name: name, codes: make(map[int]int64), errors: make(map[string]int64), buckets: make([]int64, len(durationBuckets)+1)}
+	m.endpoints = append(m.endpoints, e)
+	return e
+}
+
+// observe 记录一个结束的请求
+func (e *endpointMetrics) observe(code int, class string, in, out int64, d time.Duration) {
+	e.reqBytes.Add(in)
+	e.sent.Add(out)
+	s := d.Seconds()
+	i := 0
+	for i < len(durationBuckets) && s > durationBuckets[i] {
+		i++
+	}
+	e.mu.Lock()
+	e.codes[code]++
+	if class != "" {
+		e.errors[class]++
+	}
+	e.buckets[i]++
+	e.count++
+	e.sum += d
+	e.mu.Unlock()
+}
+
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	header := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	header("xdelta_server_requests_total", "counter", "Requests by endpoint and status code.")
+	for _, e := range m.endpoints {
+		e.mu.Lock()
+		codes := make([]int, 0, len(e.codes))
+		for c := range e.codes {
+			codes = append(codes, c)
+		}
+		slices.Sort(codes)
+		for _, c := range codes {
+			fmt.Fprintf(&b, "xdelta_server_requests_total{endpoint=%q,code=\"%d\"} %d\n", e.name, c, e.codes[c])
+		}
+		e.mu.Unlock()
+	}
+	header("xdelta_server_errors_total", "counter", "Failed requests by endpoint and error class.")
+	for _, e := range m.endpoints {
+		e.mu.Lock()
+		classes := make([]string, 0, len(e.errors))
+		for c := range e.errors {
+			classes = append(classes, c)
+		}
+		slices.Sort(classes)
+		for _, c := range classes {
+			fmt.Fprintf(&b, "xdelta_server_errors_total{endpoint=%q,class=%q} %d\n", e.name, c, e.errors[c])
+		}
+		e.mu.Unlock()
+	}
+	header("xdelta_server_requests_in_flight", "gauge", "Requests being processed.")
+	for _, e := range m.endpoints {
+		fmt.Fprintf(&b, "xdelta_server_requests_in_flight{endpoint=%q} %d\n", e.name, e.inFlight.Load())
+	}
+	header("xdelta_server_request_bytes_total", "counter", "Request data bytes read, excluding multipart framing.")
+	for _, e := range m.endpoints {
+		fmt.Fprintf(&b, "xdelta_server_request_bytes_total{endpoint=%q} %d\n", e.name, e.reqBytes.Load())
+	}
+	header("xdelta_server_response_bytes_total", "counter", "Response body bytes sent for successful requests.")
+	for _, e := range m.endpoints {
+		fmt.Fprintf(&b, "xdelta_server_response_bytes_total{endpoint=%q} %d\n", e.name, e.sent.Load())
+	}
+	header("xdelta_server_request_duration_seconds", "histogram", "Request duration in seconds.")
+	for _, e := range m.endpoints {
+		e.mu.Lock()
+		var cum int64
+		for i, le := range durationBuckets {
+			cum += e.buckets[i]
+			fmt.Fprintf(&b, "xdelta_server_request_duration_seconds_bucket{endpoint=%q,le=%q} %d\n", e.name, strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(&b, "xdelta_server_request_duration_seconds_bucket{endpoint=%q,le=\"+Inf\"} %d\n", e.name, e.count)
+		fmt.Fprintf(&b, "xdelta_server_request_duration_seconds_sum{endpoint=%q} %s\n", e.name, strconv.FormatFloat(e.sum.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&b, "xdelta_server_request_duration_seconds_count{endpoint=%q} %d\n", e.name, e.count)
+		e.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.Write(b.Bytes())
+}
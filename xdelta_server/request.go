@@ -0,0 +1,243 @@
+package xdelta_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+const (
+	contentTypeBinary = "application/octet-stream"
+	contentTypeJSON   = "application/json"
+
+	// multipartOverhead 请求体中分隔符和各部分头的余量，计入整个请求体的上限
+	multipartOverhead = 64 << 10
+)
+
+var (
+	// ErrTooLarge 请求的某一部分或生成的补丁超过了 Config 中的上限
+	ErrTooLarge = errors.New("xdelta_server: request too large")
+	// ErrBadRequest 请求的格式有误：不是 multipart/form-data、缺少或多出部分、请求体被截断
+	ErrBadRequest = errors.New("xdelta_server: bad request")
+)
+
+// StatusCode 返回 err 对应的 HTTP 状态码：
+//
+//	400  ErrBadRequest、ErrInvalidArgument（参数有误）
+//	413  ErrTooLarge、ErrOutputTooLarge、ErrMemoryLimit
+//	422  ErrCorruptPatch、ErrChecksumMismatch、ErrSourceMismatch、ErrTargetMismatch、ErrUnsupportedPatch（补丁与数据不符）
+//	501  ErrNotSupported（没有原生后端的构建）
+//	503  ErrTimeout（Config.Timeout 到期）
+//	500  其他
+func StatusCode(err error) int {
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrTooLarge), errors.As(err, &mbe),
+		errors.Is(err, xdelta_ffi.ErrOutputTooLarge), errors.Is(err, xdelta_ffi.ErrMemoryLimit):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadRequest), errors.Is(err, xdelta_ffi.ErrInvalidArgument):
+		return http.StatusBadRequest
+	case errors.Is(err, xdelta_ffi.ErrCorruptPatch), errors.Is(err, xdelta_ffi.ErrChecksumMismatch),
+		errors.Is(err, xdelta_ffi.ErrSourceMismatch), errors.Is(err, xdelta_ffi.ErrTargetMismatch),
+		errors.Is(err, xdelta_ffi.ErrUnsupportedPatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, xdelta_ffi.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, xdelta_ffi.ErrTimeout):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorClass 指标和错误响应中的类别：本包的错误为 too_large、bad_request，响应已经开始之后的失败为 send，
+// 其余为 xdelta_ffi.ErrorClass
+func errorClass(err error) string {
+	var mbe *http.MaxBytesError
+	var se *sendError
+	switch {
+	case errors.As(err, &se):
+		return "send"
+	case errors.Is(err, ErrTooLarge), errors.As(err, &mbe):
+		return "too_large"
+	case errors.Is(err, ErrBadRequest):
+		return "bad_request"
+	default:
+		return xdelta_ffi.ErrorClass(err)
+	}
+}
+
+// sendError 响应头发出之后写响应体失败
+type sendError struct{ err error }
+
+func (e *sendError) Error() string { return "xdelta_server: sending response: " + e.err.Error() }
+func (e *sendError) Unwrap() error { return e.err }
+
+// errorJSON 错误响应的内容
+type errorJSON struct {
+	Error string `json:"error"`
+	Class string `json:"class"`
+}
+
+// writeError 写出 err 的错误响应，返回状态码；响应已经开始时只能放弃，返回 200
+func writeError(w http.ResponseWriter, err error) int {
+	var se *sendError
+	if errors.As(err, &se) {
+		return http.StatusOK
+	}
+	code := StatusCode(err)
+	body, _ := json.Marshal(errorJSON{Error: err.Error(), Class: errorClass(err)})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+	return code
+}
+
+// multipartReader 限制整个请求体为 limit 加上分隔符的余量，返回 multipart 的读取器
+func multipartReader(w http.ResponseWriter, r *http.Request, limit int64) (*multipart.Reader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, limit+multipartOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return mr, nil
+}
+
+// nextPart 读取下一部分，它必须名为 name
+func nextPart(mr *multipart.Reader, name string, limit int64) (*partReader, error) {
+	part, err := mr.NextPart()
+	return openPart(part, err, name, limit)
+}
+
+// openPart 检查 NextPart 的结果 part、err，返回最多读取 limit 字节的 partReader
+func openPart(part *multipart.Part, err error, name string, limit int64) (*partReader, error) {
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: missing part %q", ErrBadRequest, name)
+	}
+	if err != nil {
+		return nil, requestError(err)
+	}
+	if got := part.FormName(); got != name {
+		return nil, fmt.Errorf("%w: expected part %q, got %q", ErrBadRequest, name, got)
+	}
+	return &partReader{r: part, limit: limit, what: fmt.Sprintf("part %q", name)}, nil
+}
+
+// requestError 读取请求体失败：超过整个请求体的上限时保留 *http.MaxBytesError，其余视为请求有误
+func requestError(err error) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return fmt.Errorf("%w: request body exceeds %d bytes", ErrTooLarge, mbe.Limit)
+	}
+	return fmt.Errorf("%w: reading request body: %v", ErrBadRequest, err)
+}
+
+// partReader 读取请求的一部分，记录读取的字节数 n，超过 limit 时返回 ErrTooLarge
+type partReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+	what  string
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	if rest := p.limit - p.n + 1; int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if p.n > p.limit {
+		return n, fmt.Errorf("%w: %s exceeds %d bytes", ErrTooLarge, p.what, p.limit)
+	}
+	if err != nil && err != io.EOF {
+		err = requestError(err)
+	}
+	return n, err
+}
+
+// lazyPart 第一次读取时才打开的部分
+type lazyPart struct {
+	mr    *multipart.Reader
+	name  string
+	limit int64
+	p     *partReader
+}
+
+func (l *lazyPart) Read(b []byte) (int, error) {
+	if l.p == nil {
+		p, err := nextPart(l.mr, l.name, l.limit)
+		if err != nil {
+			return 0, err
+		}
+		l.p = p
+	}
+	return l.p.Read(b)
+}
+
+// n 已经读取的字节数
+func (l *lazyPart) n() int64 {
+	if l.p == nil {
+		return 0
+	}
+	return l.p.n
+}
+
+// limitedWriter 写入超过 limit 字节时返回 ErrTooLarge
+type limitedWriter struct {
+	w     io.Writer
+	limit int64
+	n     int64
+	what  string
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.n+int64(len(b)) > l.limit {
+		return 0, fmt.Errorf("%w: %s exceeds %d bytes", ErrTooLarge, l.what, l.limit)
+	}
+	n, err := l.w.Write(b)
+	l.n += int64(n)
+	return n, err
+}
+
+// patchInfoJSON inspect 的响应，字段与 xdelta_ffi.PatchInfo 对应（与 xdelta inspect --json 相同）
+type patchInfoJSON struct {
+	Format       string  `json:"format"`
+	Secondary    string  `json:"secondary"`
+	Enveloped    bool    `json:"enveloped"`
+	Windows      int64   `json:"windows"`
+	Instructions int64   `json:"instructions"`
+	AddBytes     int64   `json:"add_bytes"`
+	CopyBytes    int64   `json:"copy_bytes"`
+	RunBytes     int64   `json:"run_bytes"`
+	TargetSize   int64   `json:"target_size"`
+	SourceSize   int64   `json:"source_size"`
+	BlockSize    uint32  `json:"block_size"`
+	Checksum     string  `json:"checksum"`
+	PatchSize    int64   `json:"patch_size"`
+	Ratio        float64 `json:"ratio"`
+}
+
+func newPatchInfoJSON(info xdelta_ffi.PatchInfo) patchInfoJSON {
+	return patchInfoJSON{
+		Format:       info.Format,
+		Secondary:    info.Secondary,
+		Enveloped:    info.Enveloped,
+		Windows:      info.Windows,
+		Instructions: info.Instructions,
+		AddBytes:     info.AddBytes,
+		CopyBytes:    info.CopyBytes,
+		RunBytes:     info.RunBytes,
+		TargetSize:   info.TargetSize,
+		SourceSize:   info.SourceSize,
+		BlockSize:    info.BlockSize,
+		Checksum:     info.Checksum.String(),
+		PatchSize:    info.PatchSize,
+		Ratio:        info.Ratio,
+	}
+}
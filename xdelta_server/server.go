@@ -0,0 +1,342 @@
+// Package xdelta_server 把 xdelta_ffi 包装为 HTTP 服务，提供创建、应用、合并和检查补丁四个接口以及 Prometheus 格式的监控指标：
+//
+//	POST /create   multipart/form-data，依次为 old 和 new 两部分，返回补丁
+//	POST /apply    multipart/form-data，依次为 old 和 patch 两部分，返回新数据
+//	POST /merge    multipart/form-data，若干个 patch 部分（按应用的先后顺序），返回合并后的补丁
+//	POST /inspect  请求体为补丁，返回 JSON 格式的 PatchInfo
+//	GET  /metrics  Prometheus 文本格式的指标
+//	GET  /healthz  原生库可用时返回 200
+//
+// 请求体按部分流式读取：create 的 old 和 new 直接交给 CreateDiffsStream，apply 的 patch 直接交给 ApplyDiffsStream，
+// 只有 apply 的 old 需要随机读取，先写入临时文件；结果先写入临时文件，完整生成之后才发出响应，
+// 失败时总能返回正确的状态码。各部分的大小由 Config 限制
+// 失败时返回 JSON {"error": 错误信息, "class": xdelta_ffi.ErrorClass}，状态码见 StatusCode
+package xdelta_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+// DefaultMaxSize Config 中的大小上限为 0 时使用的值
+const DefaultMaxSize = 1 << 30
+
+// Config 服务的配置，零值可用
+type Config struct {
+	// MaxOldSize 旧数据（create、apply 的 old 部分）的上限
+	MaxOldSize int64
+	// MaxNewSize create 的 new 部分的上限
+	MaxNewSize int64
+	// MaxPatchSize 补丁的上限：apply 的 patch 部分、inspect 的请求体、merge 的所有 patch 部分之和，以及 create 生成的补丁
+	MaxPatchSize int64
+	// MaxOutputSize apply 和 merge 输出的上限，超过时返回 413（apply 通过 WithMaxOutputSize，在写出之前就停止）
+	MaxOutputSize int64
+	// TempDir 临时文件所在的目录，为空时使用 os.TempDir()
+	TempDir string
+	// Timeout 每个操作的时限（WithTimeout），0 表示不限
+	Timeout time.Duration
+	// Options create 使用的默认选项，请求参数中的选项追加在之后
+	Options []xdelta_ffi.Option
+}
+
+// Server 补丁服务，实现 http.Handler，可以并发使用
+type Server struct {
+	cfg     Config
+	mux     *http.ServeMux
+	metrics *serverMetrics
+}
+
+// New 按 cfg 创建 Server，大小上限为 0 的使用 DefaultMaxSize
+func New(cfg Config) *Server {
+	for _, p := range []*int64{&cfg.MaxOldSize, &cfg.MaxNewSize, &cfg.MaxPatchSize, &cfg.MaxOutputSize} {
+		if *p <= 0 {
+			*p = DefaultMaxSize
+		}
+	}
+	s := &Server{cfg: cfg, mux: http.NewServeMux(), metrics: newServerMetrics()}
+	s.handle("POST /create", "create", s.create)
+	s.handle("POST /apply", "apply", s.apply)
+	s.handle("POST /merge", "merge", s.merge)
+	s.handle("POST /inspect", "inspect", s.inspect)
+	s.mux.Handle("GET /metrics", s.metrics)
+	s.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := xdelta_ffi.Init(); err != nil {
+			writeError(w, err)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// MetricsHandler 返回 /metrics 的 handler，用于挂在另一个（例如只对内的）地址上
+func (s *Server) MetricsHandler() http.Handler {
+	return s.metrics
+}
+
+// endpointFunc 处理一个接口的请求，把结果写入 w，返回请求和响应的字节数
+type endpointFunc func(w http.ResponseWriter, r *http.Request) (in, out int64, err error)
+
+// handle 注册 pattern，记录指标，失败时写出错误响应
+func (s *Server) handle(pattern, endpoint string, fn endpointFunc) {
+	m := s.metrics.endpoint(endpoint)
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		in, out, err := fn(w, r)
+		code := http.StatusOK
+		if err != nil {
+			code = writeError(w, err)
+		}
+		m.observe(code, errorClass(err), in, out, time.Since(start))
+	})
+}
+
+// create POST /create
+func (s *Server) create(w http.ResponseWriter, r *http.Request) (in, out int64, err error) {
+	opts, err := s.createOptions(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	mr, err := multipartReader(w, r, s.cfg.MaxOldSize+s.cfg.MaxNewSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	old, err := nextPart(mr, "old", s.cfg.MaxOldSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	// new 部分在 old 读完之后才能取得，CreateDiffsStream 开始读取新数据时再打开
+	nw := &lazyPart{mr: mr, name: "new", limit: s.cfg.MaxNewSize}
+	patch, err := s.tempFile()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer removeTemp(patch)
+	pw := &limitedWriter{w: patch, limit: s.cfg.MaxPatchSize, what: "patch"}
+	err = xdelta_ffi.CreateDiffsStream(old, nw, pw, opts...)
+	in = old.n + nw.n()
+	if err != nil {
+		return in, 0, err
+	}
+	out, err = sendFile(w, patch)
+	return in, out, err
+}
+
+// apply POST /apply
+func (s *Server) apply(w http.ResponseWriter, r *http.Request) (in, out int64, err error) {
+	mr, err := multipartReader(w, r, s.cfg.MaxOldSize+s.cfg.MaxPatchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	old, err := nextPart(mr, "old", s.cfg.MaxOldSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	oldFile, err := s.tempFile()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer removeTemp(oldFile)
+	if _, err := io.Copy(oldFile, old); err != nil {
+		return old.n, 0, err
+	}
+	patch, err := nextPart(mr, "patch", s.cfg.MaxPatchSize)
+	if err != nil {
+		return old.n, 0, err
+	}
+	result, err := s.tempFile()
+	if err != nil {
+		return old.n, 0, err
+	}
+	defer removeTemp(result)
+	err = xdelta_ffi.ApplyDiffsStream(oldFile, patch, result, s.operationOptions(xdelta_ffi.WithMaxOutputSize(s.cfg.MaxOutputSize))...)
+	in = old.n + patch.n
+	if err != nil {
+		return in, 0, err
+	}
+	out, err = sendFile(w, result)
+	return in, out, err
+}
+
+// merge POST /merge
+func (s *Server) merge(w http.ResponseWriter, r *http.Request) (in, out int64, err error) {
+	mr, err := multipartReader(w, r, s.cfg.MaxPatchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	var patches [][]byte
+	rest := s.cfg.MaxPatchSize
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) && len(patches) > 0 {
+			break
+		}
+		p, err := openPart(part, err, "patch", rest)
+		if err != nil {
+			return in, 0, err
+		}
+		data, err := io.ReadAll(p)
+		in += p.n
+		if err != nil {
+			return in, 0, err
+		}
+		rest -= p.n
+		patches = append(patches, data)
+	}
+	merged, err := xdelta_ffi.MergePatches(patches...)
+	if err != nil {
+		return in, 0, err
+	}
+	if info, err := xdelta_ffi.InspectPatch(merged); err == nil && info.TargetSize > s.cfg.MaxOutputSize {
+		return in, 0, fmt.Errorf("%w: merged patch produces %d bytes, the limit is %d", xdelta_ffi.ErrOutputTooLarge, info.TargetSize, s.cfg.MaxOutputSize)
+	}
+	w.Header().Set("Content-Type", contentTypeBinary)
+	w.Header().Set("Content-Length", strconv.Itoa(len(merged)))
+	n, err := w.Write(merged)
+	return in, int64(n), err
+}
+
+// inspect POST /inspect
+func (s *Server) inspect(w http.ResponseWriter, r *http.Request) (in, out int64, err error) {
+	body := &partReader{r: http.MaxBytesReader(w, r.Body, s.cfg.MaxPatchSize+1), limit: s.cfg.MaxPatchSize, what: "request body"}
+	patch, err := io.ReadAll(body)
+	if err != nil {
+		return body.n, 0, err
+	}
+	info, err := xdelta_ffi.InspectPatch(patch)
+	if err != nil {
+		return body.n, 0, err
+	}
+	resp, err := json.Marshal(newPatchInfoJSON(info))
+	if err != nil {
+		return body.n, 0, err
+	}
+	resp = append(resp, '\n')
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	n, err := w.Write(resp)
+	return body.n, int64(n), err
+}
+
+// createOptions create 的选项：Config.Options、请求参数 block_size、secondary、level、checksum、threads、vcdiff，最后是时限
+func (s *Server) createOptions(r *http.Request) ([]xdelta_ffi.Option, error) {
+	opts := append([]xdelta_ffi.Option(nil), s.cfg.Options...)
+	q := r.URL.Query()
+	if v := q.Get("block_size"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, badParam("block_size", v)
+		}
+		opts = append(opts, xdelta_ffi.WithBlockSize(uint32(n)))
+	}
+	if v := q.Get("secondary"); v != "" {
+		kind, ok := parseSecondary(v)
+		if !ok {
+			return nil, badParam("secondary", v)
+		}
+		opts = append(opts, xdelta_ffi.WithSecondaryCompression(kind))
+	}
+	if v := q.Get("level"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, badParam("level", v)
+		}
+		opts = append(opts, xdelta_ffi.WithCompressionLevel(n))
+	}
+	if v := q.Get("checksum"); v != "" {
+		kind, ok := parseChecksum(v)
+		if !ok {
+			return nil, badParam("checksum", v)
+		}
+		opts = append(opts, xdelta_ffi.WithChecksum(kind))
+	}
+	if v := q.Get("threads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, badParam("threads", v)
+		}
+		opts = append(opts, xdelta_ffi.WithThreads(n))
+	}
+	if v := q.Get("vcdiff"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, badParam("vcdiff", v)
+		}
+		if on {
+			opts = append(opts, xdelta_ffi.WithStandardVCDIFF())
+		}
+	}
+	return s.operationOptions(opts...), nil
+}
+
+// operationOptions 在 opts 之后加上 Config.Timeout
+func (s *Server) operationOptions(opts ...xdelta_ffi.Option) []xdelta_ffi.Option {
+	if s.cfg.Timeout > 0 {
+		opts = append(opts, xdelta_ffi.WithTimeout(s.cfg.Timeout))
+	}
+	return opts
+}
+
+func parseSecondary(name string) (xdelta_ffi.SecondaryCompression, bool) {
+	for _, k := range []xdelta_ffi.SecondaryCompression{xdelta_ffi.SecondaryNone, xdelta_ffi.SecondaryZlib, xdelta_ffi.SecondaryZstd, xdelta_ffi.SecondaryLZ4, xdelta_ffi.SecondaryLZMA, xdelta_ffi.SecondaryDJW, xdelta_ffi.SecondaryFGK} {
+		if k.String() == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+func parseChecksum(name string) (xdelta_ffi.ChecksumKind, bool) {
+	for _, k := range []xdelta_ffi.ChecksumKind{xdelta_ffi.ChecksumNone, xdelta_ffi.ChecksumAdler32, xdelta_ffi.ChecksumXXH3} {
+		if k.String() == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+func badParam(name, value string) error {
+	return fmt.Errorf("%w: bad value %q for parameter %s", xdelta_ffi.ErrInvalidArgument, value, name)
+}
+
+func (s *Server) tempFile() (*os.File, error) {
+	return os.CreateTemp(s.cfg.TempDir, "xdelta-server-*")
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// sendFile 把临时文件 f 的全部内容作为响应体发出
+func sendFile(w http.ResponseWriter, f *os.File) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	w.Header().Set("Content-Type", contentTypeBinary)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	// 响应头已经发出，之后的失败（通常是客户端断开）只能记入指标
+	n, err := io.Copy(w, f)
+	if err != nil {
+		err = &sendError{err}
+	}
+	return n, err
+}
@@ -0,0 +1,368 @@
+package xdelta_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+// TestMain 没有设置 XDELTA_LIB_PATH 时使用 cargo build --release 生成的原生库
+func TestMain(m *testing.M) {
+	if os.Getenv("XDELTA_LIB_PATH") == "" {
+		name := "libxdelta.so"
+		switch runtime.GOOS {
+		case "darwin":
+			name = "libxdelta.dylib"
+		case "windows":
+			name = "xdelta.dll"
+		}
+		if p := filepath.Join("..", "target", "release", name); fileExists(p) {
+			xdelta_ffi.SetLibraryPath(p)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// requireNative 没有原生后端或原生库加载失败时跳过测试（没有原生后端时 Init 成功，Version 返回 ErrNotSupported）
+func requireNative(t *testing.T) {
+	t.Helper()
+	if _, err := xdelta_ffi.Version(); err != nil {
+		t.Skipf("native library not available: %v", err)
+	}
+}
+
+// testPair 一对有少量差异的新旧数据
+func testPair() (oldData, newData []byte) {
+	oldData = bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 2000)
+	newData = append(bytes.Clone(oldData[:40000]), append([]byte("inserted"), oldData[40010:]...)...)
+	return oldData, newData
+}
+
+// part multipart 请求的一部分
+type part struct {
+	name string
+	data []byte
+}
+
+// post 以 multipart/form-data 发送 parts，请求体由 io.Pipe 边生成边发送、没有 Content-Length；
+// 返回状态码和响应体，失败时报告错误并返回 0（可以在其他 goroutine 中调用）
+func post(t *testing.T, url string, parts ...part) (int, []byte) {
+	t.Helper()
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for _, p := range parts {
+			w, err := mw.CreateFormFile(p.name, p.name)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			// 分成小块写入，服务端在请求体到齐之前就开始读取
+			for b := p.data; len(b) > 0; b = b[min(len(b), 8<<10):] {
+				if _, err := w.Write(b[:min(len(b), 8<<10)]); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	resp, err := http.Post(url, mw.FormDataContentType(), pr)
+	if err != nil {
+		t.Error(err)
+		return 0, nil
+	}
+	return readResponse(t, resp)
+}
+
+// readResponse 读完 resp 的响应体，失败时报告错误并返回 0
+func readResponse(t *testing.T, resp *http.Response) (int, []byte) {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+		return 0, nil
+	}
+	return resp.StatusCode, body
+}
+
+// TestServerRoundTrip 请求体边生成边发送时，create 生成的补丁与带同样选项（来自请求参数）的 CreateDiffsStream 相同，
+// 经 apply 还原新数据，inspect 的结果与 InspectPatch 相同，merge 的结果等于依次应用；healthz 返回 200
+func TestServerRoundTrip(t *testing.T) {
+	requireNative(t)
+	ts := httptest.NewServer(New(Config{}))
+	defer ts.Close()
+	oldData, newData := testPair()
+
+	for _, tc := range []struct {
+		query                       string
+		opts                        []xdelta_ffi.Option
+		format, secondary, checksum string
+	}{
+		{"", nil, "native", "", "none"},
+		{"?block_size=64", []xdelta_ffi.Option{xdelta_ffi.WithBlockSize(64)}, "native", "", "none"},
+		{"?secondary=zstd&level=3", []xdelta_ffi.Option{xdelta_ffi.WithSecondaryCompression(xdelta_ffi.SecondaryZstd), xdelta_ffi.WithCompressionLevel(3)}, "native", "zstd", "none"},
+		{"?checksum=xxh3&threads=2", []xdelta_ffi.Option{xdelta_ffi.WithChecksum(xdelta_ffi.ChecksumXXH3), xdelta_ffi.WithThreads(2)}, "native", "", "xxh3"},
+		{"?vcdiff=true&checksum=adler32", []xdelta_ffi.Option{xdelta_ffi.WithStandardVCDIFF(), xdelta_ffi.WithChecksum(xdelta_ffi.ChecksumAdler32)}, "vcdiff", "", "adler32"},
+	} {
+		q := tc.query
+		code, patch := post(t, ts.URL+"/create"+q, part{"old", oldData}, part{"new", newData})
+		if code != http.StatusOK {
+			t.Fatalf("create%s: %d %s", q, code, patch)
+		}
+		var want bytes.Buffer
+		if err := xdelta_ffi.CreateDiffsStream(bytes.NewReader(oldData), bytes.NewReader(newData), &want, tc.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(patch, want.Bytes()) {
+			t.Fatalf("create%s: %d byte patch differs from CreateDiffsStream with the same options (%d bytes)", q, len(patch), want.Len())
+		}
+		code, out := post(t, ts.URL+"/apply", part{"old", oldData}, part{"patch", patch})
+		if code != http.StatusOK || !bytes.Equal(out, newData) {
+			t.Fatalf("apply of create%s: %d, %d bytes", q, code, len(out))
+		}
+		resp, err := http.Post(ts.URL+"/inspect", contentTypeBinary, bytes.NewReader(patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, body := readResponse(t, resp)
+		if code != http.StatusOK || resp.Header.Get("Content-Type") != contentTypeJSON {
+			t.Fatalf("inspect of create%s: %d %s", q, code, body)
+		}
+		var got patchInfoJSON
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		info, err := xdelta_ffi.InspectPatch(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != newPatchInfoJSON(info) {
+			t.Fatalf("inspect of create%s: %+v, InspectPatch gives %+v", q, got, newPatchInfoJSON(info))
+		}
+		if got.Format != tc.format || got.Secondary != tc.secondary || got.Checksum != tc.checksum {
+			t.Fatalf("create%s: format %s, secondary %q, checksum %s", q, got.Format, got.Secondary, got.Checksum)
+		}
+	}
+
+	// 两个补丁合并后一次应用
+	third := append(bytes.Clone(newData), "and a tail"...)
+	p1, err := xdelta_ffi.CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := xdelta_ffi.CreateDiffs(newData, third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, merged := post(t, ts.URL+"/merge", part{"patch", p1}, part{"patch", p2})
+	if code != http.StatusOK {
+		t.Fatalf("merge: %d %s", code, merged)
+	}
+	if out, err := xdelta_ffi.ApplyDiffsData(oldData, merged); err != nil || !bytes.Equal(out, third) {
+		t.Fatalf("merged patch gives %d bytes, %v", len(out), err)
+	}
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := readResponse(t, resp); code != http.StatusOK {
+		t.Fatalf("healthz: %d %s", code, body)
+	}
+}
+
+// TestServerErrors 请求有误、超过 Config 的上限、补丁与数据不符时返回 StatusCode 给出的状态码和带类别的 JSON，
+// 临时文件在失败时同样被删除
+func TestServerErrors(t *testing.T) {
+	requireNative(t)
+	oldData, newData := testPair()
+	patch, err := xdelta_ffi.CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+	ts := httptest.NewServer(New(Config{MaxOldSize: 200 << 10, MaxNewSize: 200 << 10, MaxPatchSize: 64 << 10, MaxOutputSize: 64 << 10, TempDir: tmp}))
+	defer ts.Close()
+	big := bytes.Repeat([]byte{'x'}, 300<<10)
+	// 截断之前的输出不超过 MaxOutputSize
+	small, err := xdelta_ffi.CreateDiffs(oldData[:40000], newData[:40000])
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := small[:len(small)/2]
+	for _, tc := range []struct {
+		name  string
+		path  string
+		parts []part
+		code  int
+		class string
+	}{
+		{"missing new", "/create", []part{{"old", oldData}}, http.StatusBadRequest, "bad_request"},
+		{"parts swapped", "/create", []part{{"new", newData}, {"old", oldData}}, http.StatusBadRequest, "bad_request"},
+		{"bad block size", "/create?block_size=abc", []part{{"old", oldData}, {"new", newData}}, http.StatusBadRequest, "invalid_argument"},
+		{"unknown secondary", "/create?secondary=brotli", []part{{"old", oldData}, {"new", newData}}, http.StatusBadRequest, "invalid_argument"},
+		{"vcdiff with zstd", "/create?vcdiff=1&secondary=zstd", []part{{"old", oldData}, {"new", newData}}, http.StatusBadRequest, "invalid_argument"},
+		{"old too large", "/create", []part{{"old", big}, {"new", newData}}, http.StatusRequestEntityTooLarge, "too_large"},
+		{"patch too large", "/create", []part{{"old", oldData[:1000]}, {"new", big[:190<<10]}}, http.StatusRequestEntityTooLarge, "too_large"},
+		{"apply output too large", "/apply", []part{{"old", oldData}, {"patch", patch}}, http.StatusRequestEntityTooLarge, "output_too_large"},
+		{"apply truncated", "/apply", []part{{"old", oldData[:40000]}, {"patch", truncated}}, http.StatusUnprocessableEntity, "corrupt_patch"},
+		{"apply missing patch", "/apply", []part{{"old", oldData}}, http.StatusBadRequest, "bad_request"},
+		{"merge nothing", "/merge", nil, http.StatusBadRequest, "bad_request"},
+		{"merge garbage", "/merge", []part{{"patch", []byte("not a patch at all")}}, http.StatusUnprocessableEntity, ""},
+	} {
+		code, body := post(t, ts.URL+tc.path, tc.parts...)
+		var e errorJSON
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Fatalf("%s: %d, %d byte body is not an error: %v", tc.name, code, len(body), err)
+		}
+		if code != tc.code || (tc.class != "" && e.Class != tc.class) || e.Error == "" {
+			t.Errorf("%s: %d %+v, want %d with class %q", tc.name, code, e, tc.code, tc.class)
+		}
+	}
+
+	// 不是 multipart 的请求和超过上限的 inspect 请求体
+	resp, err := http.Post(ts.URL+"/apply", contentTypeBinary, bytes.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := readResponse(t, resp); code != http.StatusBadRequest {
+		t.Errorf("apply without multipart: %d %s", code, body)
+	}
+	for _, tc := range []struct {
+		name string
+		body []byte
+		code int
+	}{
+		{"inspect too large", big, http.StatusRequestEntityTooLarge},
+		{"inspect garbage", []byte("not a patch at all"), http.StatusUnprocessableEntity},
+	} {
+		resp, err := http.Post(ts.URL+"/inspect", contentTypeBinary, bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, body := readResponse(t, resp); code != tc.code {
+			t.Errorf("%s: %d %s, want %d", tc.name, code, body, tc.code)
+		}
+	}
+	resp, err = http.Get(ts.URL + "/create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := readResponse(t, resp); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /create: %d", code)
+	}
+	// 失败的请求也删除了临时文件
+	if left, err := os.ReadDir(tmp); err != nil || len(left) > 0 {
+		t.Errorf("%d temporary files left, %v", len(left), err)
+	}
+}
+
+// TestStatusCode 本包和 xdelta_ffi 的错误对应的状态码
+func TestStatusCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{ErrTooLarge, http.StatusRequestEntityTooLarge},
+		{&http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge},
+		{fmt.Errorf("wrapped: %w", xdelta_ffi.ErrOutputTooLarge), http.StatusRequestEntityTooLarge},
+		{xdelta_ffi.ErrMemoryLimit, http.StatusRequestEntityTooLarge},
+		{ErrBadRequest, http.StatusBadRequest},
+		{xdelta_ffi.ErrInvalidArgument, http.StatusBadRequest},
+		{xdelta_ffi.ErrCorruptPatch, http.StatusUnprocessableEntity},
+		{xdelta_ffi.ErrChecksumMismatch, http.StatusUnprocessableEntity},
+		{xdelta_ffi.ErrSourceMismatch, http.StatusUnprocessableEntity},
+		{xdelta_ffi.ErrTargetMismatch, http.StatusUnprocessableEntity},
+		{xdelta_ffi.ErrUnsupportedPatch, http.StatusUnprocessableEntity},
+		{xdelta_ffi.ErrNotSupported, http.StatusNotImplemented},
+		{xdelta_ffi.ErrTimeout, http.StatusServiceUnavailable},
+		{io.ErrUnexpectedEOF, http.StatusInternalServerError},
+	} {
+		if got := StatusCode(tc.err); got != tc.code {
+			t.Errorf("StatusCode(%v) = %d, want %d", tc.err, got, tc.code)
+		}
+	}
+}
+
+// TestServerMetrics 并发请求之后 /metrics 中各接口的请求数、错误类别、字节数和直方图与发出的请求一致
+func TestServerMetrics(t *testing.T) {
+	requireNative(t)
+	s := New(Config{})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	oldData, newData := testPair()
+	patch, err := xdelta_ffi.CreateDiffs(oldData, newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers = 8
+	var wg sync.WaitGroup
+	codes := make(chan int, 2*workers)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := post(t, ts.URL+"/apply", part{"old", oldData}, part{"patch", patch})
+			codes <- code
+			code, _ = post(t, ts.URL+"/apply", part{"old", oldData}, part{"patch", patch[:len(patch)/2]})
+			codes <- code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK && code != http.StatusUnprocessableEntity {
+			t.Fatalf("apply: %d", code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	text := rec.Body.String()
+	for _, want := range []string{
+		fmt.Sprintf(`xdelta_server_requests_total{endpoint="apply",code="200"} %d`, workers),
+		fmt.Sprintf(`xdelta_server_requests_total{endpoint="apply",code="422"} %d`, workers),
+		fmt.Sprintf(`xdelta_server_errors_total{endpoint="apply",class="corrupt_patch"} %d`, workers),
+		`xdelta_server_requests_in_flight{endpoint="apply"} 0`,
+		fmt.Sprintf(`xdelta_server_request_bytes_total{endpoint="apply"} %d`, workers*(2*len(oldData)+len(patch)+len(patch)/2)),
+		fmt.Sprintf(`xdelta_server_response_bytes_total{endpoint="apply"} %d`, workers*len(newData)),
+		fmt.Sprintf(`xdelta_server_request_duration_seconds_bucket{endpoint="apply",le="+Inf"} %d`, 2*workers),
+		fmt.Sprintf(`xdelta_server_request_duration_seconds_count{endpoint="apply"} %d`, 2*workers),
+		`xdelta_server_request_duration_seconds_count{endpoint="create"} 0`,
+		"# TYPE xdelta_server_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, text)
+		}
+	}
+	// /metrics 挂在同一个 Server 上时内容相同
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := readResponse(t, resp); code != http.StatusOK || !strings.Contains(string(body), `code="422"} 8`) {
+		t.Fatalf("GET /metrics: %d\n%s", code, body)
+	}
+}
@@ -0,0 +1,234 @@
+// Package xdeltahttp 按 RFC 3229 的增量编码返回 HTTP 响应：客户端在 A-IM 中声明支持 xdelta（或 vcdiff），
+// 并在 If-None-Match 中给出已有版本的 ETag 时，服务端只返回从该版本到当前版本的补丁（226 IM Used），
+// 客户端应用补丁得到当前版本；DeltaHandler 为服务端，DeltaTransport 为客户端
+//
+// 226 响应带有 IM、Delta-Base、当前版本的 ETag 和完整内容的 SHA-256（RFC 9530 的 Repr-Digest），客户端据此确认重建的内容；
+// 版本未知、补丁不比完整内容小、请求带有 Range 等情况返回完整的响应，所有响应都带有 Vary: A-IM, If-None-Match
+package xdeltahttp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+const (
+	// IMXDelta 本库格式补丁的增量编码名，用于 A-IM 和 IM 头
+	IMXDelta = "xdelta"
+	// IMVCDIFF 标准 VCDIFF 补丁（RFC 3284）的增量编码名
+	IMVCDIFF = "vcdiff"
+	// StatusIMUsed 返回补丁时的状态码（RFC 3229 的 226 IM Used）
+	StatusIMUsed = http.StatusIMUsed
+	// ContentTypeDelta 补丁响应的 Content-Type
+	ContentTypeDelta = "application/octet-stream"
+
+	// maxDigests DeltaHandler 记住的当前版本摘要的个数上限，超过时全部丢弃
+	maxDigests = 1024
+)
+
+// ErrUnknownVersion VersionStore 中没有请求的版本或补丁
+var ErrUnknownVersion = errors.New("xdeltahttp: unknown version")
+
+// VersionStore 提供资源各个版本的内容和补丁缓存，ETag 均不带引号（例如 v1.2.3，而不是 "v1.2.3"）
+// 方法可能被并发调用
+type VersionStore interface {
+	// Current 返回 r 所请求资源当前版本的 ETag；资源不提供增量时返回空字符串，请求交给 next 处理
+	Current(r *http.Request) (string, error)
+	// Version 返回该资源 ETag 为 etag 的版本的完整内容，没有这个版本（例如已经清理）时返回 ErrUnknownVersion
+	Version(r *http.Request, etag string) ([]byte, error)
+	// Patch 返回预先计算或之前缓存的从 base 到 target 的补丁，im 为 IMXDelta 或 IMVCDIFF；没有时返回 ErrUnknownVersion
+	Patch(r *http.Request, base, target, im string) ([]byte, error)
+	// SavePatch 缓存刚生成的补丁，供之后的 Patch 返回；不需要缓存时可以什么都不做
+	SavePatch(r *http.Request, base, target, im string, patch []byte) error
+}
+
+// DeltaHandler 包装 next，对带 A-IM 和 If-None-Match 的 GET 请求返回从客户端版本到当前版本的补丁，opts 传给 xdelta_ffi.CreateDiffs
+func DeltaHandler(store VersionStore, next http.Handler, opts ...xdelta_ffi.Option) http.Handler {
+	return &deltaHandler{store: store, next: next, opts: opts, digests: make(map[string]string)}
+}
+
+type deltaHandler struct {
+	store VersionStore
+	next  http.Handler
+	opts  []xdelta_ffi.Option
+
+	mu sync.Mutex
+	// digests URL 路径和 ETag 到 Repr-Digest 的值
+	digests map[string]string
+}
+
+func (h *deltaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "A-IM, If-None-Match")
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	im := acceptedIM(r.Header.Values("A-IM"))
+	bases := strongETags(r.Header.Values("If-None-Match"))
+	if im == "" || len(bases) == 0 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	target, err := h.store.Current(r)
+	if err != nil || target == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	for _, base := range bases {
+		if base == target {
+			h.next.ServeHTTP(w, r)
+			return
+		}
+	}
+	for _, base := range bases {
+		patch, digest, err := h.patch(r, base, target, im)
+		if err != nil {
+			continue
+		}
+		hdr := w.Header()
+		hdr.Set("IM", im)
+		hdr.Set("Delta-Base", quote(base))
+		hdr.Set("ETag", quote(target))
+		hdr.Set("Repr-Digest", digest)
+		hdr.Set("Content-Type", ContentTypeDelta)
+		hdr.Set("Content-Length", strconv.Itoa(len(patch)))
+		w.WriteHeader(StatusIMUsed)
+		w.Write(patch)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// errNoGain 生成的补丁不比完整内容小
+var errNoGain = errors.New("xdeltahttp: patch is not smaller than the full content")
+
+// patch 返回从 base 到 target 的补丁和 target 的 Repr-Digest，先查缓存，没有时生成并缓存
+func (h *deltaHandler) patch(r *http.Request, base, target, im string) ([]byte, string, error) {
+	if patch, err := h.store.Patch(r, base, target, im); err == nil {
+		digest, err := h.digest(r, target, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		return patch, digest, nil
+	} else if !errors.Is(err, ErrUnknownVersion) {
+		return nil, "", err
+	}
+	old, err := h.store.Version(r, base)
+	if err != nil {
+		return nil, "", err
+	}
+	cur, err := h.store.Version(r, target)
+	if err != nil {
+		return nil, "", err
+	}
+	opts := h.opts
+	if im == IMVCDIFF {
+		opts = append(opts[:len(opts):len(opts)], xdelta_ffi.WithStandardVCDIFF())
+	}
+	patch, err := xdelta_ffi.CreateDiffs(old, cur, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(patch) >= len(cur) {
+		return nil, "", errNoGain
+	}
+	// 缓存失败不影响这次响应
+	h.store.SavePatch(r, base, target, im, patch)
+	digest, err := h.digest(r, target, cur)
+	return patch, digest, err
+}
+
+// digest 返回 target 版本的 Repr-Digest，cur 为它的内容，为 nil 时需要的话从 store 读取
+func (h *deltaHandler) digest(r *http.Request, target string, cur []byte) (string, error) {
+	key := r.URL.Path + "\x00" + target
+	h.mu.Lock()
+	digest, ok := h.digests[key]
+	h.mu.Unlock()
+	if ok {
+		return digest, nil
+	}
+	if cur == nil {
+		var err error
+		if cur, err = h.store.Version(r, target); err != nil {
+			return "", err
+		}
+	}
+	digest = reprDigest(cur)
+	h.mu.Lock()
+	if len(h.digests) >= maxDigests {
+		clear(h.digests)
+	}
+	h.digests[key] = digest
+	h.mu.Unlock()
+	return digest, nil
+}
+
+// reprDigest 返回 data 的 Repr-Digest 头的值
+func reprDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// acceptedIM 从 A-IM 头中选出第一个支持的增量编码，没有时返回空字符串；q=0 的编码视为不接受
+func acceptedIM(values []string) string {
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(item, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if (name == IMXDelta || name == IMVCDIFF) && !rejected(params) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// rejected 报告分号分隔的参数中是否有 q=0
+func rejected(params string) bool {
+	for _, p := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(p, "=")
+		if strings.TrimSpace(k) == "q" {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			return err == nil && f == 0
+		}
+	}
+	return false
+}
+
+// strongETags 返回 If-None-Match 中的强 ETag（去掉引号），弱 ETag 和 * 不能作为补丁的基准，均被忽略
+func strongETags(values []string) []string {
+	var tags []string
+	for _, v := range values {
+		for v != "" {
+			v = strings.TrimLeft(v, " \t,")
+			weak := strings.HasPrefix(v, "W/")
+			if weak {
+				v = v[2:]
+			}
+			if !strings.HasPrefix(v, `"`) {
+				// * 或格式不对的部分，跳到下一个逗号
+				_, v, _ = strings.Cut(v, ",")
+				continue
+			}
+			end := strings.IndexByte(v[1:], '"')
+			if end < 0 {
+				break
+			}
+			if !weak {
+				tags = append(tags, v[1:1+end])
+			}
+			v = v[2+end:]
+		}
+	}
+	return tags
+}
+
+func quote(etag string) string {
+	return `"` + etag + `"`
+}
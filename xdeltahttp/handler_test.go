@@ -0,0 +1,304 @@
+package xdeltahttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+// TestMain 没有设置 XDELTA_LIB_PATH 时使用 cargo build --release 生成的原生库
+func TestMain(m *testing.M) {
+	if os.Getenv("XDELTA_LIB_PATH") == "" {
+		name := "libxdelta.so"
+		switch runtime.GOOS {
+		case "darwin":
+			name = "libxdelta.dylib"
+		case "windows":
+			name = "xdelta.dll"
+		}
+		if p := filepath.Join("..", "target", "release", name); fileExists(p) {
+			xdelta_ffi.SetLibraryPath(p)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// requireNative 没有原生后端或原生库加载失败时跳过测试（没有原生后端时 Init 成功，Version 返回 ErrNotSupported）
+func requireNative(t *testing.T) {
+	t.Helper()
+	if _, err := xdelta_ffi.Version(); err != nil {
+		t.Skipf("native library not available: %v", err)
+	}
+}
+
+// testVersions 一个资源的三个版本：v1、v2 差别很小，v3 是与它们无关的短内容
+func testVersions() map[string][]byte {
+	v1 := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 2000)
+	v2 := append(bytes.Clone(v1[:40000]), append([]byte("inserted"), v1[40010:]...)...)
+	return map[string][]byte{"v1": v1, "v2": v2, "v3": []byte("short and unrelated")}
+}
+
+// memStore 内存中的 VersionStore，记录各个方法的调用次数
+type memStore struct {
+	mu       sync.Mutex
+	current  string
+	err      error // Current 返回的错误
+	versions map[string][]byte
+	patches  map[string][]byte
+	calls    map[string]int
+}
+
+func newMemStore(current string) *memStore {
+	return &memStore{current: current, versions: testVersions(), patches: make(map[string][]byte), calls: make(map[string]int)}
+}
+
+func (s *memStore) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+func (s *memStore) Current(r *http.Request) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls["Current"]++
+	return s.current, s.err
+}
+
+func (s *memStore) Version(r *http.Request, etag string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls["Version"]++
+	if v, ok := s.versions[etag]; ok {
+		return v, nil
+	}
+	return nil, ErrUnknownVersion
+}
+
+func (s *memStore) Patch(r *http.Request, base, target, im string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls["Patch"]++
+	if p, ok := s.patches[base+" "+target+" "+im]; ok {
+		return p, nil
+	}
+	return nil, ErrUnknownVersion
+}
+
+func (s *memStore) SavePatch(r *http.Request, base, target, im string, patch []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls["SavePatch"]++
+	s.patches[base+" "+target+" "+im] = patch
+	return nil
+}
+
+// fullHandler 完整响应：当前版本带 ETag，If-None-Match 包含当前版本时返回 304
+func fullHandler(s *memStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		etag, body := s.current, s.versions[s.current]
+		s.mu.Unlock()
+		w.Header().Set("ETag", quote(etag))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if strings.Contains(r.Header.Get("If-None-Match"), quote(etag)) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(body)
+	})
+}
+
+// get 发送 GET 请求，header 中依次是头的名字和值
+func get(t *testing.T, h http.Handler, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	return do(t, h, http.MethodGet, header...)
+}
+
+func do(t *testing.T, h http.Handler, method string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/res", nil)
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Add(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// TestDeltaHandlerPatch 带 A-IM 和已有版本的 If-None-Match 时返回 226：IM、Delta-Base、ETag、Repr-Digest 和 Content-Length 正确，
+// 补丁应用到旧版本得到当前版本；生成的补丁通过 SavePatch 缓存，之后的请求直接使用，摘要不再读取当前版本
+func TestDeltaHandlerPatch(t *testing.T) {
+	requireNative(t)
+	store := newMemStore("v2")
+	h := DeltaHandler(store, fullHandler(store))
+	for i := 0; i < 2; i++ {
+		w := get(t, h, "A-IM", "xdelta", "If-None-Match", `"v1"`)
+		if w.Code != StatusIMUsed {
+			t.Fatalf("request %d: status %d, want 226", i, w.Code)
+		}
+		hdr := w.Header()
+		for name, want := range map[string]string{
+			"IM": IMXDelta, "Delta-Base": `"v1"`, "ETag": `"v2"`, "Content-Type": ContentTypeDelta,
+			"Repr-Digest": reprDigest(store.versions["v2"]), "Content-Length": strconv.Itoa(w.Body.Len()),
+			"Vary": "A-IM, If-None-Match",
+		} {
+			if got := hdr.Get(name); got != want {
+				t.Errorf("request %d: %s is %q, want %q", i, name, got, want)
+			}
+		}
+		got, err := xdelta_ffi.ApplyDiffsData(store.versions["v1"], w.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, store.versions["v2"]) {
+			t.Fatalf("request %d: the patch does not rebuild v2", i)
+		}
+	}
+	// 第一次读取两个版本生成补丁，第二次使用缓存的补丁和记住的摘要
+	if store.count("SavePatch") != 1 || store.count("Version") != 2 {
+		t.Errorf("SavePatch called %d times, Version %d times", store.count("SavePatch"), store.count("Version"))
+	}
+
+	// 重新创建的 DeltaHandler 使用缓存的补丁时读取当前版本计算摘要
+	h = DeltaHandler(store, fullHandler(store))
+	if w := get(t, h, "A-IM", "xdelta", "If-None-Match", `"v1"`); w.Code != StatusIMUsed || w.Header().Get("Repr-Digest") != reprDigest(store.versions["v2"]) {
+		t.Errorf("cached patch in a new handler: status %d, Repr-Digest %q", w.Code, w.Header().Get("Repr-Digest"))
+	}
+	if store.count("Version") != 3 {
+		t.Errorf("Version called %d times, want 3", store.count("Version"))
+	}
+}
+
+// TestDeltaHandlerNegotiation A-IM 中选第一个支持且 q 不为 0 的编码，vcdiff 返回标准 VCDIFF；
+// If-None-Match 中有多个版本时跳过未知的和弱 ETag，使用第一个已知的强 ETag
+func TestDeltaHandlerNegotiation(t *testing.T) {
+	requireNative(t)
+	store := newMemStore("v2")
+	h := DeltaHandler(store, fullHandler(store))
+	for _, c := range []struct {
+		aim, inm string
+		im, base string
+	}{
+		{"vcdiff", `"v1"`, IMVCDIFF, `"v1"`},
+		{"gzip, VCDIFF;q=0.5, xdelta", `"v1"`, IMVCDIFF, `"v1"`},
+		{"xdelta;q=0, vcdiff", `"v1"`, IMVCDIFF, `"v1"`},
+		{"xdelta; q=0.0, vcdiff;q=1", `"v1"`, IMVCDIFF, `"v1"`},
+		{" XDelta ", `"v1"`, IMXDelta, `"v1"`},
+		{"xdelta", `"v0", W/"v3", "v1"`, IMXDelta, `"v1"`},
+		{"xdelta", `*, "v1"`, IMXDelta, `"v1"`},
+	} {
+		w := get(t, h, "A-IM", c.aim, "If-None-Match", c.inm)
+		if w.Code != StatusIMUsed || w.Header().Get("IM") != c.im || w.Header().Get("Delta-Base") != c.base {
+			t.Errorf("A-IM %q, If-None-Match %q: status %d, IM %q, Delta-Base %q; want 226, %q, %q",
+				c.aim, c.inm, w.Code, w.Header().Get("IM"), w.Header().Get("Delta-Base"), c.im, c.base)
+			continue
+		}
+		format := "native"
+		if c.im == IMVCDIFF {
+			format = "vcdiff"
+		}
+		info, err := xdelta_ffi.InspectPatch(w.Body.Bytes())
+		if err != nil || info.Format != format {
+			t.Errorf("A-IM %q: patch format %q (%v), want %s", c.aim, info.Format, err, format)
+		}
+		got, err := xdelta_ffi.ApplyDiffsData(store.versions["v1"], w.Body.Bytes())
+		if err != nil || !bytes.Equal(got, store.versions["v2"]) {
+			t.Errorf("A-IM %q: the patch does not rebuild v2 (%v)", c.aim, err)
+		}
+	}
+}
+
+// TestDeltaHandlerFallback 不能或不需要返回补丁时交给 next：返回完整的 200（客户端已有当前版本时为 304），
+// 所有响应都带有 Vary
+func TestDeltaHandlerFallback(t *testing.T) {
+	requireNative(t)
+	for _, c := range []struct {
+		name    string
+		current string
+		err     error
+		method  string
+		header  []string
+		status  int
+	}{
+		{"no A-IM", "v2", nil, http.MethodGet, []string{"If-None-Match", `"v1"`}, http.StatusOK},
+		{"no If-None-Match", "v2", nil, http.MethodGet, []string{"A-IM", "xdelta"}, http.StatusOK},
+		{"unsupported A-IM", "v2", nil, http.MethodGet, []string{"A-IM", "gzip, xdelta;q=0", "If-None-Match", `"v1"`}, http.StatusOK},
+		{"HEAD", "v2", nil, http.MethodHead, []string{"A-IM", "xdelta", "If-None-Match", `"v1"`}, http.StatusOK},
+		{"Range", "v2", nil, http.MethodGet, []string{"A-IM", "xdelta", "If-None-Match", `"v1"`, "Range", "bytes=0-99"}, http.StatusOK},
+		{"weak ETag", "v2", nil, http.MethodGet, []string{"A-IM", "xdelta", "If-None-Match", `W/"v1"`}, http.StatusOK},
+		{"unknown base", "v2", nil, http.MethodGet, []string{"A-IM", "xdelta", "If-None-Match", `"v0"`}, http.StatusOK},
+		{"current version", "v2", nil, http.MethodGet, []string{"A-IM", "xdelta", "If-None-Match", `"v1", "v2"`}, http.StatusNotModified},
+		{"no gain", "v3", nil, http.MethodGet, []string{"A-IM", "xdelta", "If-None-Match", `"v1"`}, http.StatusOK},
+		{"no deltas", "", nil, http.MethodGet, []string{"A-IM", "xdelta", "If-None-Match", `"v1"`}, http.StatusOK},
+		{"store error", "v2", errors.New("store down"), http.MethodGet, []string{"A-IM", "xdelta", "If-None-Match", `"v1"`}, http.StatusOK},
+	} {
+		store := newMemStore(c.current)
+		store.err = c.err
+		if c.current == "" {
+			store.versions[""] = store.versions["v2"]
+		}
+		w := do(t, DeltaHandler(store, fullHandler(store)), c.method, c.header...)
+		if w.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, w.Code, c.status)
+		}
+		if w.Header().Get("IM") != "" || w.Header().Get("Delta-Base") != "" {
+			t.Errorf("%s: delta headers on a full response", c.name)
+		}
+		if w.Code == http.StatusOK && c.method == http.MethodGet && !bytes.Equal(w.Body.Bytes(), store.versions[c.current]) {
+			t.Errorf("%s: body is not the current version", c.name)
+		}
+		if got := w.Header().Values("Vary"); len(got) != 1 || got[0] != "A-IM, If-None-Match" {
+			t.Errorf("%s: Vary %q", c.name, got)
+		}
+		if store.count("SavePatch") != 0 {
+			t.Errorf("%s: a patch was saved", c.name)
+		}
+	}
+}
+
+// TestDeltaHandlerStream 经过真实的 HTTP 连接时 226 响应的长度与 Content-Length 一致
+func TestDeltaHandlerStream(t *testing.T) {
+	requireNative(t)
+	store := newMemStore("v2")
+	ts := httptest.NewServer(DeltaHandler(store, fullHandler(store)))
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/res", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("A-IM", "xdelta")
+	req.Header.Set("If-None-Match", `"v1"`)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	patch, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != StatusIMUsed || resp.ContentLength != int64(len(patch)) {
+		t.Fatalf("status %d, Content-Length %d for %d bytes", resp.StatusCode, resp.ContentLength, len(patch))
+	}
+	if got, err := xdelta_ffi.ApplyDiffsData(store.versions["v1"], patch); err != nil || !bytes.Equal(got, store.versions["v2"]) {
+		t.Errorf("the patch does not rebuild v2 (%v)", err)
+	}
+}
@@ -0,0 +1,215 @@
+package xdeltahttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+// maxBody DeltaTransport 缓存的完整响应体的大小上限，更大的响应照常返回但不缓存；
+// 也是 226 响应中补丁的大小上限，以及重建内容默认的 WithMaxOutputSize
+const maxBody = 64 << 20
+
+// ErrBadDelta 服务端返回的 226 响应缺少或带有不一致的 IM、Delta-Base、ETag、Repr-Digest 头，或者补丁超过 64 MiB；
+// 重建的内容与 Repr-Digest 不符时返回的是 xdelta_ffi.ErrTargetMismatch，这些情况都不会更新缓存
+var ErrBadDelta = errors.New("xdeltahttp: invalid delta response")
+
+// CachedResponse DeltaTransport 缓存的一个资源的完整响应
+type CachedResponse struct {
+	// ETag 不带引号的强 ETag
+	ETag string
+	// ContentType 完整响应的 Content-Type，补丁响应的 Content-Type 是 ContentTypeDelta，重建时用这里的值
+	ContentType string
+	Body        []byte
+}
+
+// CacheStore DeltaTransport 按 URL 保存的资源缓存，方法可能被并发调用
+// 带有强 ETag、没有 Content-Encoding 的 200 响应在调用方读完响应体后存入（不超过 64 MiB，Repr-Digest 存在时须一致），
+// 226 响应重建的内容在返回之前存入，304 响应用缓存的内容构造 200 响应
+type CacheStore interface {
+	// Get 返回 url 的缓存，没有时返回 nil, nil
+	Get(url string) (*CachedResponse, error)
+	// Put 保存 url 的完整响应，替换之前的
+	Put(url string, resp *CachedResponse) error
+}
+
+// DeltaTransport 包装 next（nil 时为 http.DefaultTransport），请求 cache 中已有的资源时只下载补丁；opts 传给 xdelta_ffi.ApplyDiffsData，默认输出上限 64 MiB
+func DeltaTransport(cache CacheStore, next http.RoundTripper, opts ...xdelta_ffi.Option) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	opts = append([]xdelta_ffi.Option{xdelta_ffi.WithMaxOutputSize(maxBody)}, opts...)
+	return &deltaTransport{cache: cache, next: next, opts: opts}
+}
+
+type deltaTransport struct {
+	cache CacheStore
+	next  http.RoundTripper
+	opts  []xdelta_ffi.Option
+}
+
+func (t *deltaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" ||
+		req.Header.Get("A-IM") != "" || req.Header.Get("If-None-Match") != "" {
+		return t.next.RoundTrip(req)
+	}
+	url := req.URL.String()
+	cached, err := t.cache.Get(url)
+	if err != nil || cached == nil || cached.ETag == "" {
+		cached = nil
+	}
+	out := req
+	if cached != nil {
+		// RoundTripper 不能修改调用方的请求
+		out = req.Clone(req.Context())
+		out.Header.Set("A-IM", IMXDelta+", "+IMVCDIFF)
+		out.Header.Set("If-None-Match", quote(cached.ETag))
+	}
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		switch resp.StatusCode {
+		case StatusIMUsed:
+			return t.applyDelta(req, resp, cached)
+		case http.StatusNotModified:
+			resp.Body.Close()
+			return fullResponse(req, resp, cached.ContentType, cached.Body), nil
+		}
+	}
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Encoding") == "" {
+		if etag, ok := strongETag(resp.Header.Get("ETag")); ok {
+			entry := &CachedResponse{ETag: etag, ContentType: resp.Header.Get("Content-Type")}
+			digest := resp.Header.Get("Repr-Digest")
+			resp.Body = &cachingBody{ReadCloser: resp.Body, put: func(body []byte) {
+				if digest == "" || verifyDigest(digest, body) == nil {
+					entry.Body = body
+					t.cache.Put(url, entry)
+				}
+			}}
+		}
+	}
+	return resp, nil
+}
+
+// applyDelta 把 226 响应中的补丁应用到 cached 上，返回重建的 200 响应
+func (t *deltaTransport) applyDelta(req *http.Request, resp *http.Response, cached *CachedResponse) (*http.Response, error) {
+	defer resp.Body.Close()
+	url := req.URL.String()
+	im := strings.ToLower(strings.TrimSpace(resp.Header.Get("IM")))
+	if im != IMXDelta && im != IMVCDIFF {
+		return nil, fmt.Errorf("%w: %s: unsupported IM %q", ErrBadDelta, url, im)
+	}
+	if base, ok := strongETag(resp.Header.Get("Delta-Base")); !ok || base != cached.ETag {
+		return nil, fmt.Errorf("%w: %s: Delta-Base %q is not the cached version %q", ErrBadDelta, url, resp.Header.Get("Delta-Base"), cached.ETag)
+	}
+	etag, ok := strongETag(resp.Header.Get("ETag"))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: missing strong ETag", ErrBadDelta, url)
+	}
+	digest := resp.Header.Get("Repr-Digest")
+	if digest == "" {
+		return nil, fmt.Errorf("%w: %s: missing Repr-Digest", ErrBadDelta, url)
+	}
+	patch, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) > maxBody {
+		return nil, fmt.Errorf("%w: %s: patch exceeds %d bytes", ErrBadDelta, url, maxBody)
+	}
+	body, err := xdelta_ffi.ApplyDiffsData(cached.Body, patch, t.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("apply delta for %s: %w", url, err)
+	}
+	if err := verifyDigest(digest, body); err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	// 缓存失败不影响这次响应
+	t.cache.Put(url, &CachedResponse{ETag: etag, ContentType: cached.ContentType, Body: body})
+	full := fullResponse(req, resp, cached.ContentType, body)
+	full.Header.Del("IM")
+	full.Header.Del("Delta-Base")
+	return full, nil
+}
+
+// fullResponse 以 resp 的头为基础构造内容为 body 的 200 响应
+func fullResponse(req *http.Request, resp *http.Response, contentType string, body []byte) *http.Response {
+	full := *resp
+	full.Status = "200 OK"
+	full.StatusCode = http.StatusOK
+	full.Header = resp.Header.Clone()
+	if contentType != "" {
+		full.Header.Set("Content-Type", contentType)
+	} else {
+		full.Header.Del("Content-Type")
+	}
+	full.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	full.ContentLength = int64(len(body))
+	full.Body = io.NopCloser(bytes.NewReader(body))
+	full.Request = req
+	return &full
+}
+
+// verifyDigest 检查 body 与 Repr-Digest 头中的 sha-256 是否一致，没有 sha-256 时返回 ErrBadDelta
+func verifyDigest(header string, body []byte) error {
+	for _, item := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		want, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil {
+			return fmt.Errorf("%w: malformed Repr-Digest %q", ErrBadDelta, header)
+		}
+		sum := sha256.Sum256(body)
+		if !bytes.Equal(sum[:], want) {
+			return fmt.Errorf("%w: reconstructed body does not match Repr-Digest", xdelta_ffi.ErrTargetMismatch)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: Repr-Digest %q has no sha-256", ErrBadDelta, header)
+}
+
+// strongETag 去掉强 ETag 的引号，不是强 ETag 时返回 false
+func strongETag(v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return "", false
+	}
+	return v[1 : len(v)-1], true
+}
+
+// cachingBody 在调用方读到响应体末尾时把读到的内容交给 put；中途关闭或超过 maxBody 时不调用
+type cachingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	skip bool
+	put  func(body []byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.skip {
+		if b.buf.Len()+n > maxBody {
+			b.skip = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+		if err == io.EOF && !b.skip {
+			b.skip = true
+			b.put(b.buf.Bytes())
+		}
+	}
+	return n, err
+}
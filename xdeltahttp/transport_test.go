@@ -0,0 +1,265 @@
+package xdeltahttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PangolinLab/xdelta-rust-goffi/xdelta_ffi"
+)
+
+// memCache 内存中的 CacheStore，记录 Put 的次数
+type memCache struct {
+	mu      sync.Mutex
+	entries map[string]*CachedResponse
+	puts    int
+}
+
+func newMemCache() *memCache {
+	return &memCache{entries: make(map[string]*CachedResponse)}
+}
+
+func (c *memCache) Get(url string) (*CachedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[url], nil
+}
+
+func (c *memCache) Put(url string, resp *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.puts++
+	c.entries[url] = resp
+	return nil
+}
+
+// roundTripFunc 把函数用作 http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// deltaServer 由 DeltaHandler 和 fullHandler 组成的服务端；edit 不为 nil 时在返回之前修改 226 响应的头
+func deltaServer(t *testing.T, store *memStore, edit func(http.Header)) *httptest.Server {
+	t.Helper()
+	h := DeltaHandler(store, fullHandler(store))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code == StatusIMUsed && edit != nil {
+			edit(rec.Header())
+		}
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// fetch 通过 rt 请求 url，返回响应和读完的响应体
+func fetch(t *testing.T, rt http.RoundTripper, url string) (*http.Response, []byte, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Header) != 0 {
+		t.Errorf("the caller's request was changed: %v", req.Header)
+	}
+	return resp, body, nil
+}
+
+// TestDeltaTransportCache 第一次请求得到完整的 200 响应，读完后存入缓存；资源更新后只下载补丁，重建的 200 响应带有原来的
+// Content-Type，没有 IM 和 Delta-Base，缓存更新为新版本；没有变化时 304 用缓存的内容构造 200 响应
+func TestDeltaTransportCache(t *testing.T) {
+	requireNative(t)
+	store := newMemStore("v1")
+	ts := deltaServer(t, store, nil)
+	cache := newMemCache()
+	rt := DeltaTransport(cache, nil)
+	url := ts.URL + "/res"
+
+	for i, c := range []struct {
+		current string
+		puts    int
+		patches int // 服务端生成补丁的次数
+	}{
+		{"v1", 1, 0},
+		{"v2", 2, 1},
+		{"v2", 2, 1},
+	} {
+		store.mu.Lock()
+		store.current = c.current
+		store.mu.Unlock()
+		resp, body, err := fetch(t, rt, url)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		want := store.versions[c.current]
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, want) {
+			t.Fatalf("request %d: status %d, %d bytes; want 200 with %s", i, resp.StatusCode, len(body), c.current)
+		}
+		if resp.Header.Get("Content-Type") != "text/plain" || resp.ContentLength != int64(len(want)) ||
+			resp.Header.Get("IM") != "" || resp.Header.Get("Delta-Base") != "" {
+			t.Errorf("request %d: headers %v, Content-Length %d", i, resp.Header, resp.ContentLength)
+		}
+		if e := cache.entries[url]; cache.puts != c.puts || e == nil || e.ETag != c.current || !bytes.Equal(e.Body, want) {
+			t.Errorf("request %d: %d puts, want %d with %s", i, cache.puts, c.puts, c.current)
+		}
+		if store.count("SavePatch") != c.patches {
+			t.Errorf("request %d: the server made %d patches, want %d", i, store.count("SavePatch"), c.patches)
+		}
+	}
+}
+
+// TestDeltaTransportFullResponse 200 响应在读完响应体之后才存入缓存：中途关闭、带有 Content-Encoding、
+// Repr-Digest 不一致或者没有强 ETag 时不存入
+func TestDeltaTransportFullResponse(t *testing.T) {
+	body := []byte("full response body")
+	for _, c := range []struct {
+		name   string
+		header map[string]string
+		read   bool
+		cached bool
+	}{
+		{"read to the end", map[string]string{"ETag": `"v1"`}, true, true},
+		{"matching digest", map[string]string{"ETag": `"v1"`, "Repr-Digest": reprDigest(body)}, true, true},
+		{"closed early", map[string]string{"ETag": `"v1"`}, false, false},
+		{"Content-Encoding", map[string]string{"ETag": `"v1"`, "Content-Encoding": "gzip"}, true, false},
+		{"digest mismatch", map[string]string{"ETag": `"v1"`, "Repr-Digest": reprDigest([]byte("other"))}, true, false},
+		{"weak ETag", map[string]string{"ETag": `W/"v1"`}, true, false},
+	} {
+		cache := newMemCache()
+		rt := DeltaTransport(cache, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(body)), Request: req}
+			for k, v := range c.header {
+				resp.Header.Set(k, v)
+			}
+			return resp, nil
+		}))
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/res", nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if c.read {
+			io.ReadAll(resp.Body)
+		} else {
+			resp.Body.Read(make([]byte, 4))
+		}
+		resp.Body.Close()
+		if (cache.puts == 1) != c.cached {
+			t.Errorf("%s: %d puts, want cached=%v", c.name, cache.puts, c.cached)
+		}
+	}
+}
+
+// TestDeltaTransportBadDelta 226 响应的 Repr-Digest 与重建的内容不符时返回 ErrTargetMismatch，Delta-Base 不是缓存的版本、
+// 缺少 ETag 或 Repr-Digest、IM 不认识时返回 ErrBadDelta；这些情况都不更新缓存
+func TestDeltaTransportBadDelta(t *testing.T) {
+	requireNative(t)
+	for _, c := range []struct {
+		name string
+		edit func(http.Header)
+		want error
+	}{
+		{"digest mismatch", func(h http.Header) { h.Set("Repr-Digest", reprDigest([]byte("other"))) }, xdelta_ffi.ErrTargetMismatch},
+		{"malformed digest", func(h http.Header) { h.Set("Repr-Digest", "sha-256=:!!:") }, ErrBadDelta},
+		{"no sha-256", func(h http.Header) { h.Set("Repr-Digest", "sha-512=:AAAA:") }, ErrBadDelta},
+		{"no digest", func(h http.Header) { h.Del("Repr-Digest") }, ErrBadDelta},
+		{"other Delta-Base", func(h http.Header) { h.Set("Delta-Base", `"v0"`) }, ErrBadDelta},
+		{"weak Delta-Base", func(h http.Header) { h.Set("Delta-Base", `W/"v1"`) }, ErrBadDelta},
+		{"no Delta-Base", func(h http.Header) { h.Del("Delta-Base") }, ErrBadDelta},
+		{"no ETag", func(h http.Header) { h.Del("ETag") }, ErrBadDelta},
+		{"unknown IM", func(h http.Header) { h.Set("IM", "gdiff") }, ErrBadDelta},
+	} {
+		store := newMemStore("v2")
+		ts := deltaServer(t, store, c.edit)
+		cache := newMemCache()
+		url := ts.URL + "/res"
+		cache.entries[url] = &CachedResponse{ETag: "v1", ContentType: "text/plain", Body: store.versions["v1"]}
+		_, _, err := fetch(t, DeltaTransport(cache, nil), url)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		if cache.puts != 0 || cache.entries[url].ETag != "v1" {
+			t.Errorf("%s: the cache was updated", c.name)
+		}
+	}
+}
+
+// TestDeltaTransportLimits 补丁超过 64 MiB 时不读完就返回 ErrBadDelta；重建的内容默认不超过 64 MiB，opts 中的 WithMaxOutputSize 覆盖默认值
+func TestDeltaTransportLimits(t *testing.T) {
+	requireNative(t)
+	cached := &CachedResponse{ETag: "v1", Body: []byte("old")}
+	respond := func(patch io.Reader) roundTripFunc {
+		return func(req *http.Request) (*http.Response, error) {
+			h := http.Header{"Im": {IMXDelta}, "Delta-Base": {`"v1"`}, "Etag": {`"v2"`}, "Repr-Digest": {reprDigest(nil)}}
+			return &http.Response{StatusCode: StatusIMUsed, Header: h, Body: io.NopCloser(patch), Request: req}, nil
+		}
+	}
+	fetchWith := func(next http.RoundTripper, opts ...xdelta_ffi.Option) error {
+		cache := newMemCache()
+		cache.entries["http://example.com/res"] = cached
+		_, _, err := fetch(t, DeltaTransport(cache, next, opts...), "http://example.com/res")
+		if cache.puts != 0 {
+			t.Error("the cache was updated")
+		}
+		return err
+	}
+
+	body := &countingReader{r: io.LimitReader(zeroReader{}, 2*maxBody)}
+	if err := fetchWith(respond(body)); !errors.Is(err, ErrBadDelta) || body.n > maxBody+32<<10 {
+		t.Errorf("oversized patch: got %v after reading %d bytes, want ErrBadDelta after about %d", err, body.n, maxBody)
+	}
+
+	huge, err := xdelta_ffi.CreateDiffs(cached.Body, make([]byte, maxBody+1), xdelta_ffi.WithSecondaryCompression(xdelta_ffi.SecondaryZlib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchWith(respond(bytes.NewReader(huge))); !errors.Is(err, xdelta_ffi.ErrOutputTooLarge) {
+		t.Errorf("output over 64 MiB: got %v, want ErrOutputTooLarge", err)
+	}
+	small, err := xdelta_ffi.CreateDiffs(cached.Body, []byte(strings.Repeat("new ", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchWith(respond(bytes.NewReader(small)), xdelta_ffi.WithMaxOutputSize(100)); !errors.Is(err, xdelta_ffi.ErrOutputTooLarge) {
+		t.Errorf("WithMaxOutputSize(100): got %v, want ErrOutputTooLarge", err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// countingReader 记录从 r 读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}